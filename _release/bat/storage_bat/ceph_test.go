@@ -15,6 +15,7 @@
 package storagebat
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -52,12 +53,12 @@ func TestCreateBlockDevice(t *testing.T) {
 	}
 	defer os.Remove(path)
 
-	device, err := driver.CreateBlockDevice("", path, 0)
+	device, err := driver.CreateBlockDevice(context.Background(), "", path, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = driver.DeleteBlockDevice(device.ID)
+	err = driver.DeleteBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,12 +73,12 @@ func TestCreateSizedBlockDevice(t *testing.T) {
 		t.Skip("Skipping test: Ceph ID not set")
 	}
 
-	device, err := driver.CreateBlockDevice("", "", 1)
+	device, err := driver.CreateBlockDevice(context.Background(), "", "", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	blockSize, err := driver.GetBlockDeviceSize(device.ID)
+	blockSize, err := driver.GetBlockDeviceSize(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,7 +87,7 @@ func TestCreateSizedBlockDevice(t *testing.T) {
 		t.Fatalf("Unexpected block size (%v): expected: %v got: %v", device.ID, 1*1024*1024*1024, blockSize)
 	}
 
-	err = driver.DeleteBlockDevice(device.ID)
+	err = driver.DeleteBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,22 +109,22 @@ func TestCopyBlockDevice(t *testing.T) {
 	}
 	defer os.Remove(path)
 
-	device, err := driver.CreateBlockDevice("", path, 0)
+	device, err := driver.CreateBlockDevice(context.Background(), "", path, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	copy, err := driver.CopyBlockDevice(device.ID)
+	copy, err := driver.CopyBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = driver.DeleteBlockDevice(copy.ID)
+	err = driver.DeleteBlockDevice(context.Background(), copy.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = driver.DeleteBlockDevice(device.ID)
+	err = driver.DeleteBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
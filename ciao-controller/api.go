@@ -27,7 +27,6 @@ import (
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
@@ -55,10 +54,13 @@ type APIResponse struct {
 
 func errorResponse(err error) APIResponse {
 	switch err {
-	case types.ErrQuota:
+	case types.ErrQuota,
+		types.ErrAuthTokensDisabled:
 		return APIResponse{http.StatusForbidden, nil}
 	case types.ErrTenantNotFound,
-		types.ErrInstanceNotFound:
+		types.ErrInstanceNotFound,
+		types.ErrNodeNotFound,
+		types.ErrAuthTokenNotFound:
 		return APIResponse{http.StatusNotFound, nil}
 	default:
 		return APIResponse{http.StatusInternalServerError, nil}
@@ -109,7 +111,9 @@ func (pager *nodePager) getNodes(filterType pagerFilterType, filter string, node
 
 	pageLength := 0
 
-	glog.V(2).Infof("Get nodes limit [%d] offset [%d]", limit, offset)
+	if pager.ctl.log.V(2) {
+		pager.ctl.log.Infof("Get nodes limit [%d] offset [%d]", limit, offset)
+	}
 
 	if nodes == nil || offset >= len(nodes) {
 		return computeNodes, nil
@@ -167,7 +171,9 @@ func (pager *nodeServerPager) getNodeServers(filterType pagerFilterType, filter
 	servers.TotalServers = len(instances)
 	pageLength := 0
 
-	glog.V(2).Infof("Get nodes limit [%d] offset [%d]", limit, offset)
+	if pager.ctl.log.V(2) {
+		pager.ctl.log.Infof("Get nodes limit [%d] offset [%d]", limit, offset)
+	}
 
 	if instances == nil || offset >= len(instances) {
 		return servers, nil
@@ -188,8 +194,10 @@ func (pager *nodeServerPager) getNodeServers(filterType pagerFilterType, filter
 func (pager *nodeServerPager) nextPage(filterType pagerFilterType, filter string, r *http.Request) (types.CiaoServersStats, error) {
 	limit, offset, lastSeen := pagerQueryParse(r)
 
-	glog.V(2).Infof("Next page marker [%s] limit [%d] offset [%d]",
-		lastSeen, limit, offset)
+	if pager.ctl.log.V(2) {
+		pager.ctl.log.Infof("Next page marker [%s] limit [%d] offset [%d]",
+			lastSeen, limit, offset)
+	}
 
 	if lastSeen == "" {
 		if limit != 0 {
@@ -295,8 +303,10 @@ func getUsage(c *controller, w http.ResponseWriter, r *http.Request) (APIRespons
 		return errorResponse(err), err
 	}
 
-	glog.V(2).Infof("Start %v\n", start)
-	glog.V(2).Infof("End %v\n", end)
+	if c.log.V(2) {
+		c.log.Infof("Start %v", start)
+		c.log.Infof("End %v", end)
+	}
 
 	usage.Usages, err = c.ds.GetTenantUsage(tenant, start, end)
 	if err != nil {
@@ -308,10 +318,14 @@ func getUsage(c *controller, w http.ResponseWriter, r *http.Request) (APIRespons
 
 type instanceAction func(string) error
 
+// serversAction applies an action to the instances of a tenant.  Instances
+// protected from deletion are skipped by os-delete and listed in the
+// response.
 func serversAction(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
 	vars := mux.Vars(r)
 	tenant := vars["tenant"]
 	var servers types.CiaoServersAction
+	var resp types.CiaoServersActionResponse
 	var actionFunc instanceAction
 	var statusFilter string
 
@@ -332,21 +346,36 @@ func serversAction(c *controller, w http.ResponseWriter, r *http.Request) (APIRe
 		actionFunc = c.stopInstance
 		statusFilter = payloads.Running
 	} else if servers.Action == "os-delete" {
-		actionFunc = c.deleteInstance
+		actionFunc = func(instanceID string) error {
+			return c.deleteInstance(r.Context(), instanceID)
+		}
 		statusFilter = ""
 	} else {
 		return APIResponse{http.StatusServiceUnavailable, nil},
 			errors.New("Unsupported action")
 	}
 
+	protected := func(instance *types.Instance) bool {
+		if servers.Action != "os-delete" || !instance.DeletionProtected {
+			return false
+		}
+
+		resp.Protected = append(resp.Protected, instance.ID)
+		return true
+	}
+
 	if len(servers.ServerIDs) > 0 {
 		for _, instanceID := range servers.ServerIDs {
 			// make sure the instance belongs to the tenant
-			_, err := c.ds.GetTenantInstance(tenant, instanceID)
+			instance, err := c.ds.GetTenantInstance(tenant, instanceID)
 			if err != nil {
 				return errorResponse(err), err
 			}
 
+			if protected(instance) {
+				continue
+			}
+
 			err = actionFunc(instanceID)
 			if err != nil {
 				return errorResponse(err), err
@@ -365,6 +394,10 @@ func serversAction(c *controller, w http.ResponseWriter, r *http.Request) (APIRe
 				continue
 			}
 
+			if protected(instance) {
+				continue
+			}
+
 			err = actionFunc(instance.ID)
 			if err != nil {
 				return errorResponse(err), err
@@ -372,7 +405,7 @@ func serversAction(c *controller, w http.ResponseWriter, r *http.Request) (APIRe
 		}
 	}
 
-	return APIResponse{http.StatusAccepted, nil}, nil
+	return APIResponse{http.StatusAccepted, resp}, nil
 }
 
 func trimComputeNodes(c *controller, nodeList types.CiaoNodes, targetRole ssntp.Role) (types.CiaoNodes, error) {
@@ -413,6 +446,14 @@ func listSubsetOfNodes(c *controller, w http.ResponseWriter, r *http.Request, ta
 		return errorResponse(err), err
 	}
 
+	offsets := c.nodeClockOffsets()
+	for i := range subsetOfNodes.Nodes {
+		if o, ok := offsets[subsetOfNodes.Nodes[i].ID]; ok {
+			subsetOfNodes.Nodes[i].ClockOffset = int64(o.offset / time.Millisecond)
+			subsetOfNodes.Nodes[i].ClockSkewed = o.skewed
+		}
+	}
+
 	for _, node := range nodeSummary {
 		for i := range subsetOfNodes.Nodes {
 			if subsetOfNodes.Nodes[i].ID != node.NodeID {
@@ -457,6 +498,41 @@ func listNodes(c *controller, w http.ResponseWriter, r *http.Request) (APIRespon
 	return listSubsetOfNodes(c, w, r, ssntp.UNKNOWN)
 }
 
+func nodesSummary(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	status := c.ds.GetClusterStatus()
+	status.Database = c.databaseStatus(c.config.config())
+	status.DegradedTenants = c.listDegradedTenants()
+
+	return APIResponse{http.StatusOK, status}, nil
+}
+
+// nodeSummary summarises the instances placed on a node.  The node is
+// flagged as stale if it has not sent stats for stale_minutes, which
+// defaults to the time after which a silent node becomes suspect.
+func nodeSummary(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	vars := mux.Vars(r)
+	nodeID := vars["node"]
+
+	staleAfter := c.durationSetting(settingNodeSuspectTimeout)
+	if v := r.URL.Query().Get("stale_minutes"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes <= 0 {
+			err = fmt.Errorf("Invalid stale_minutes %q", v)
+			return APIResponse{http.StatusBadRequest, nil}, err
+		}
+		staleAfter = time.Duration(minutes) * time.Minute
+	}
+
+	summary, err := c.ds.GetNodeInstanceSummary(nodeID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	summary.Stale = summary.LastSeen.IsZero() || time.Since(summary.LastSeen) > staleAfter
+
+	return APIResponse{http.StatusOK, summary}, nil
+}
+
 func listNodeServers(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
 	vars := mux.Vars(r)
 	nodeID := vars["node"]
@@ -521,6 +597,7 @@ func listCNCIs(c *controller, w http.ResponseWriter, r *http.Request) (APIRespon
 				TenantID: cnci.TenantID,
 				IPv4:     cnci.IPAddress,
 				Subnets:  subnets,
+				Image:    c.ds.GetCNCIInstanceImage(cnci.InstanceID),
 			},
 		)
 	}
@@ -555,6 +632,7 @@ func listCNCIDetails(c *controller, w http.ResponseWriter, r *http.Request) (API
 			TenantID: cnci.TenantID,
 			IPv4:     cnci.IPAddress,
 			Subnets:  subnets,
+			Image:    c.ds.GetCNCIInstanceImage(cnci.InstanceID),
 		}
 	}
 
@@ -597,10 +675,14 @@ func listEvents(c *controller, w http.ResponseWriter, r *http.Request) (APIRespo
 		}
 
 		event := types.CiaoEvent{
-			Timestamp: l.Timestamp,
-			TenantID:  l.TenantID,
-			EventType: l.EventType,
-			Message:   l.Message,
+			ID:         l.ID,
+			Timestamp:  l.Timestamp,
+			TenantID:   l.TenantID,
+			EventType:  l.EventType,
+			Message:    l.Message,
+			ObjectID:   l.ObjectID,
+			Actor:      l.Actor,
+			OnBehalfOf: l.OnBehalfOf,
 		}
 		events.Events = append(events.Events, event)
 	}
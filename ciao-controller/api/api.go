@@ -15,25 +15,52 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/service"
 	"github.com/ciao-project/ciao/uuid"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
 // Port is the default port number for the ciao API.
 const Port = 8889
 
+// RequestIDHeader is the HTTP response header which carries the unique
+// identifier assigned to each API request.  The same identifier is
+// attached to any log messages generated while processing the request.
+const RequestIDHeader = "X-Request-ID"
+
+// IdempotencyKeyHeader is the HTTP request header carrying a key chosen by
+// the client to identify a request which creates a resource.  Retrying
+// the request with the same key replays the original response rather
+// than creating a second resource.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// OnBehalfOfHeader is the HTTP request header with which an admin acts as
+// the tenant it names.  The request is executed with the scope of that
+// tenant and is audited with both identities.
+const OnBehalfOfHeader = "X-Ciao-On-Behalf-Of"
+
+// NextMarkerHeader is the HTTP response header carrying the marker of the
+// next page of a paginated list.  It is absent on the last page.
+const NextMarkerHeader = "X-Ciao-Next-Marker"
+
 const (
 	// PoolsV1 is the content-type string for v1 of our pools resource
 	PoolsV1 = "x.ciao.pools.v1"
@@ -58,8 +85,99 @@ const (
 
 	// InstancesV1 is the content-type string for v1 of our intances resource
 	InstancesV1 = "x.ciao.instances.v1"
+
+	// WebhooksV1 is the content-type string for v1 of our webhooks resource
+	WebhooksV1 = "x.ciao.webhooks.v1"
+
+	// EventsV1 is the content-type string for v1 of our events resource
+	EventsV1 = "x.ciao.events.v1"
+
+	// OperationsV1 is the content-type string for v1 of our operations resource
+	OperationsV1 = "x.ciao.operations.v1"
+
+	// TrashV1 is the content-type string for v1 of our trash resource
+	TrashV1 = "x.ciao.trash.v1"
+
+	// CNCIsV1 is the content-type string for v1 of our CNCIs resource
+	CNCIsV1 = "x.ciao.cncis.v1"
+
+	// CapabilitiesV1 is the content-type string for v1 of our capabilities resource
+	CapabilitiesV1 = "x.ciao.capabilities.v1"
+
+	// CapacityV1 is the content-type string for v1 of our capacity resource
+	CapacityV1 = "x.ciao.capacity.v1"
+
+	// SignedURLsV1 is the content-type string for v1 of our signed URLs
+	// resource
+	SignedURLsV1 = "x.ciao.signed-urls.v1"
+
+	// UsageV1 is the content-type string for v1 of our usage resource
+	UsageV1 = "x.ciao.usage.v1"
+
+	// LaunchTemplatesV1 is the content-type string for v1 of our launch
+	// templates resource
+	LaunchTemplatesV1 = "x.ciao.launch-templates.v1"
+
+	// ServerGroupsV1 is the content-type string for v1 of our server
+	// groups resource
+	ServerGroupsV1 = "x.ciao.server-groups.v1"
+
+	// SnapshotSchedulesV1 is the content-type string for v1 of our
+	// snapshot schedules resource
+	SnapshotSchedulesV1 = "x.ciao.snapshot-schedules.v1"
+
+	// PolicyV1 is the content-type string for v1 of our workload policy
+	// resource
+	PolicyV1 = "x.ciao.policy.v1"
+
+	// SettingsV1 is the content-type string for v1 of our cluster settings
+	// resource
+	SettingsV1 = "x.ciao.settings.v1"
+
+	// APIKeysV1 is the content-type string for v1 of our tenant API keys
+	// resource
+	APIKeysV1 = "x.ciao.api-keys.v1"
+
+	// AuditV1 is the content-type string for v1 of our audit log resource
+	AuditV1 = "x.ciao.audit.v1"
 )
 
+// apiVersions are the versions of each resource supported by the API.
+var apiVersions = map[string]string{
+	"pools":        PoolsV1,
+	"external-ips": ExternalIPsV1,
+	"workloads":    WorkloadsV1,
+	"tenants":      TenantsV1,
+	"node":         NodeV1,
+	"images":       ImagesV1,
+	"volumes":      VolumesV1,
+	"instances":    InstancesV1,
+	"webhooks":     WebhooksV1,
+	"events":       EventsV1,
+	"operations":   OperationsV1,
+	"trash":        TrashV1,
+	"cncis":        CNCIsV1,
+	"capabilities": CapabilitiesV1,
+	"capacity":     CapacityV1,
+	"signed-urls":  SignedURLsV1,
+	"usage":        UsageV1,
+
+	"launch-templates":   LaunchTemplatesV1,
+	"server-groups":      ServerGroupsV1,
+	"snapshot-schedules": SnapshotSchedulesV1,
+	"policy":             PolicyV1,
+	"settings":           SettingsV1,
+	"api-keys":           APIKeysV1,
+	"audit":              AuditV1,
+}
+
+// IsResourceGroup returns true if group is the name of one of the resources
+// served by the API, e.g. "instances".
+func IsResourceGroup(group string) bool {
+	_, ok := apiVersions[group]
+	return ok
+}
+
 // ErrorImage defines all possible image handling errors
 type ErrorImage error
 
@@ -88,14 +206,22 @@ type CreateImageRequest struct {
 	Visibility types.Visibility `json:"visibility,omitempty"`
 }
 
+// ImageVisibilityRequest contains the new visibility of an image.
+type ImageVisibilityRequest struct {
+	Visibility types.Visibility `json:"visibility"`
+}
+
 // RequestedVolume contains information about a volume to be created.
 type RequestedVolume struct {
 	Size        int    `json:"size"`
 	SourceVolID string `json:"source_volid,omitempty"`
+	SnapshotID  string `json:"snapshot_id,omitempty"`
 	Description string `json:"description,omitempty"`
 	Name        string `json:"name,omitempty"`
 	ImageRef    string `json:"imageRef,omitempty"`
 	Internal    bool   `json:"-"`
+
+	DeletionProtected bool `json:"deletion_protected,omitempty"`
 }
 
 // CreateServerRequest contains the details needed to start new instance(s)
@@ -103,12 +229,36 @@ type CreateServerRequest struct {
 	Server struct {
 		ID           string            `json:"id"`
 		Name         string            `json:"name"`
+		Description  string            `json:"description,omitempty"`
 		Image        string            `json:"imageRef"`
 		WorkloadID   string            `json:"workload_id"`
 		MaxInstances int               `json:"max_count"`
 		MinInstances int               `json:"min_count"`
 		Metadata     map[string]string `json:"metadata,omitempty"`
+		VCPUs        int               `json:"vcpus,omitempty"`
+		MemMB        int               `json:"mem_mb,omitempty"`
+		DiskGB       int               `json:"disk_gb,omitempty"`
+
+		DeletionProtected bool `json:"deletion_protected,omitempty"`
+
+		// ServerGroup is the ID of a server group of the tenant the
+		// instances created join.
+		ServerGroup string `json:"server_group,omitempty"`
+
+		// UserData is cloud-init user data, either YAML or base64
+		// encoded YAML, whose keys replace those of the workload's
+		// config.
+		UserData string `json:"user_data,omitempty"`
 	} `json:"server"`
+
+	// Actor is the user making the request.  It is recorded in the
+	// history of the instances created.
+	Actor string `json:"-"`
+
+	// Template and TemplateVersion identify the launch template the
+	// request was built from.  They are recorded in the instances created.
+	Template        string `json:"-"`
+	TemplateVersion int    `json:"-"`
 }
 
 // PrivateAddresses contains information about a single instance network
@@ -126,17 +276,92 @@ type ServerDetails struct {
 	NodeID           string             `json:"node_id"`
 	ID               string             `json:"id"`
 	Name             string             `json:"name"`
+	Description      string             `json:"description,omitempty"`
 	Volumes          []string           `json:"volumes"`
+	Attachments      []VolumeAttachment `json:"attachments,omitempty"`
 	Status           string             `json:"status"`
 	TenantID         string             `json:"tenant_id"`
 	SSHIP            string             `json:"ssh_ip"`
 	SSHPort          int                `json:"ssh_port"`
+	Template         string             `json:"template,omitempty"`
+	TemplateVersion  int                `json:"template_version,omitempty"`
+	StatusReason     string             `json:"status_reason,omitempty"`
+
+	DeletionProtected bool `json:"deletion_protected"`
+
+	// QueuePosition is the position, starting at 1, of a queued
+	// instance in its tenant's launch queue.
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	Conditions []types.InstanceCondition `json:"conditions,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// DeleteTime is when an instance pending deletion will be deleted
+	// unless it is restored.
+	DeleteTime *time.Time `json:"delete_time,omitempty"`
+}
+
+// VolumeAttachment describes a volume attached to an instance.  Tag is the
+// tag requested when the volume was attached and Device is the path at which
+// the volume was reported inside the instance.
+type VolumeAttachment struct {
+	ID       string `json:"id"`
+	VolumeID string `json:"volume_id"`
+	Tag      string `json:"tag,omitempty"`
+	Device   string `json:"device,omitempty"`
 }
 
-// Servers holds multiple servers including a count
+// Servers holds multiple servers including a count.  NextMarker is set
+// when more servers are available and should be passed as the marker of
+// the next request, and Links then holds the URL of that request.
+// Results is set when only some of the servers a request asked for were
+// launched, and reports the outcome of each.
 type Servers struct {
 	TotalServers int             `json:"total_servers"`
 	Servers      []ServerDetails `json:"servers"`
+	NextMarker   string          `json:"next_marker,omitempty"`
+	Links        []types.Link    `json:"links,omitempty"`
+	Results      []LaunchResult  `json:"results,omitempty"`
+}
+
+// LaunchResult reports the outcome of launching one of the servers of a
+// request.  Status is the HTTP status the request would have had if it had
+// only asked for this server.  ID is set if the server was launched, Error
+// otherwise.
+type LaunchResult struct {
+	Name   string         `json:"name,omitempty"`
+	ID     string         `json:"id,omitempty"`
+	Status int            `json:"status"`
+	Error  *HTTPErrorData `json:"error,omitempty"`
+}
+
+// InstanceLaunch is the outcome of launching one of the instances of a
+// request.  ID is set if the instance was launched, Err otherwise.
+type InstanceLaunch struct {
+	Name string
+	ID   string
+	Err  error
+}
+
+// BatchLaunchError is returned by CreateServer when only some of the
+// instances a request asked for were launched.  Servers holds those which
+// were, and Launches the outcome of every instance, in the order they were
+// requested.
+type BatchLaunchError struct {
+	Servers  Servers
+	Launches []InstanceLaunch
+}
+
+func (e *BatchLaunchError) Error() string {
+	failed := 0
+	for _, l := range e.Launches {
+		if l.Err != nil {
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("%d of %d instances failed to launch", failed, len(e.Launches))
 }
 
 // Server holds a single server's worth of details.
@@ -159,11 +384,15 @@ var (
 )
 
 // HTTPErrorData represents the HTTP response body for
-// a compute API request error.
+// a compute API request error.  FailureCode classifies failures to launch
+// instances and Violations lists the problems with an invalid workload.
 type HTTPErrorData struct {
-	Code    int    `json:"code"`
-	Name    string `json:"name"`
-	Message string `json:"message"`
+	Code        int      `json:"code"`
+	Name        string   `json:"name"`
+	Message     string   `json:"message"`
+	FailureCode string   `json:"failure_code,omitempty"`
+	InstanceID  string   `json:"instance_id,omitempty"`
+	Violations  []string `json:"violations,omitempty"`
 }
 
 // HTTPReturnErrorCode represents the unmarshalled version for Return codes
@@ -180,26 +409,208 @@ type Response struct {
 	response interface{}
 }
 
+// rawResponse is a response body which is sent as it is, with its own
+// content type, rather than marshalled.
+type rawResponse struct {
+	contentType string
+	body        []byte
+}
+
+// streamedResponse is returned by handlers which have written the response
+// themselves.
+type streamedResponse struct{}
+
+// EventStream is a subscription to the events logged by the controller.
+type EventStream struct {
+	// Backlog holds the events logged since the last event received by
+	// a reconnecting client, oldest first.
+	Backlog []types.CiaoEvent
+
+	// Events receives the events as they are logged.  It is closed when
+	// the subscriber falls behind or the controller shuts down.
+	Events <-chan types.CiaoEvent
+
+	// Close ends the subscription.
+	Close func()
+}
+
+// BodyTooLargeError returns the error reported when the body of a request
+// exceeds limit bytes.
+func BodyTooLargeError(limit int64) error {
+	return fmt.Errorf("Request body exceeds limit of %d bytes", limit)
+}
+
+// launchFailureStatus returns the HTTP status of a classified failure to
+// launch an instance.
+func launchFailureStatus(code types.LaunchFailureCode) int {
+	switch code {
+	case types.LaunchQuotaExceeded:
+		return http.StatusForbidden
+	case types.LaunchInvalidRequest:
+		return http.StatusBadRequest
+	case types.LaunchNoCapacity, types.LaunchNetworkNotReady:
+		return http.StatusServiceUnavailable
+	case types.LaunchNodeError:
+		return http.StatusBadGateway
+	case types.LaunchLimitExceeded:
+		return http.StatusTooManyRequests
+	case types.LaunchNetworkFull, types.LaunchPlacementConflict:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func errorResponse(err error) Response {
+	err = errors.Cause(err)
+
+	// a launch failure keeps the status of its cause, if that has one,
+	// so that e.g. launching a missing workload is still not found.
+	if e, ok := err.(*types.LaunchError); ok {
+		if resp := errorResponse(e.Err); resp.status != http.StatusInternalServerError {
+			return resp
+		}
+		return Response{launchFailureStatus(e.Code), nil}
+	}
+
+	if _, ok := err.(*types.ImageInUseError); ok {
+		return Response{http.StatusForbidden, nil}
+	}
+
+	if _, ok := err.(*types.PoolRestrictedError); ok {
+		return Response{http.StatusForbidden, nil}
+	}
+
+	if _, ok := err.(*types.AddressInUseError); ok {
+		return Response{http.StatusConflict, nil}
+	}
+
+	if _, ok := err.(*types.RangeOverlapError); ok {
+		return Response{http.StatusBadRequest, nil}
+	}
+
+	if _, ok := err.(*types.RequirementsBoundError); ok {
+		return Response{http.StatusBadRequest, nil}
+	}
+
+	if _, ok := err.(*types.WorkloadValidationError); ok {
+		return Response{http.StatusBadRequest, nil}
+	}
+
+	if _, ok := err.(*types.LaunchRequestError); ok {
+		return Response{http.StatusBadRequest, nil}
+	}
+
+	if _, ok := err.(*types.SubnetFullError); ok {
+		return Response{http.StatusConflict, nil}
+	}
+
+	if _, ok := err.(*types.PolicyViolationError); ok {
+		return Response{http.StatusForbidden, nil}
+	}
+
+	if _, ok := err.(*types.SettingValueError); ok {
+		return Response{http.StatusBadRequest, nil}
+	}
+
+	if _, ok := err.(*types.TenantNetworkDegradedError); ok {
+		return Response{http.StatusServiceUnavailable, nil}
+	}
+
 	switch err {
-	case types.ErrPoolNotFound,
+	case ErrNoImage,
+		types.ErrOperationNotFound,
+		types.ErrTenantCANotFound,
+		types.ErrPoolNotFound,
 		types.ErrTenantNotFound,
 		types.ErrAddressNotFound,
 		types.ErrInstanceNotFound,
-		types.ErrWorkloadNotFound:
+		types.ErrWorkloadNotFound,
+		types.ErrVolumeNotFound,
+		types.ErrTrashItemNotFound,
+		types.ErrLaunchTemplateNotFound,
+		types.ErrSnapshotScheduleNotFound,
+		types.ErrServerGroupNotFound,
+		types.ErrVolumeSnapshotNotFound,
+		types.ErrPolicyRuleNotFound,
+		types.ErrSettingNotFound,
+		types.ErrAPIKeyNotFound,
+		types.ErrLaunchConfigNotFound,
+		types.ErrInstanceTagNotFound,
+		types.ErrNodeNotFound,
+		types.ErrWebhookNotFound:
 		return Response{http.StatusNotFound, nil}
 
+	case types.ErrVolumeInstanceActive,
+		types.ErrVolumeAttached,
+		types.ErrVolumeHasSnapshots,
+		types.ErrVolumeTagInUse,
+		types.ErrVolumeBusy,
+		types.ErrVolumeNotAvailable,
+		types.ErrVolumeNotInUse,
+		types.ErrBootVolume,
+		types.ErrInstanceNotRunning,
+		types.ErrTrashNameReused,
+		types.ErrLaunchTemplateExists,
+		types.ErrDeletionProtected,
+		types.ErrTenantHasInstances,
+		types.ErrTenantDeleting,
+		types.ErrTenantOnlyPoolTenant,
+		types.ErrImageNotActive,
+		types.ErrInstanceNotMigratable,
+		types.ErrInstanceMigrating,
+		types.ErrInstanceNotResizable,
+		types.ErrInstanceResizing,
+		types.ErrInstancePending,
+		types.ErrInstanceNameInUse,
+		types.ErrInstanceChangingState,
+		types.ErrInstanceDeletePending,
+		types.ErrInstanceNotDeletePending,
+		types.ErrSubnetExhausted,
+		types.ErrTenantExists:
+		return Response{http.StatusConflict, nil}
+
+	case types.ErrTrashVolumePurged:
+		return Response{http.StatusGone, nil}
+
+	case types.ErrConsoleLogUnavailable:
+		return Response{http.StatusServiceUnavailable, nil}
+
+	case types.ErrDescriptionTooLong,
+		types.ErrBadUserData,
+		types.ErrBadPolicyRule,
+		types.ErrBadTenantExport,
+		types.ErrBadAPIKey,
+		types.ErrBadSnapshotSchedule,
+		types.ErrBadServerGroup,
+		types.ErrBadImagePreseed,
+		types.ErrBadMigration,
+		types.ErrBadResize,
+		types.ErrBadQuotaResource,
+		types.ErrBadInstanceName,
+		types.ErrBadVolumeSize,
+		types.ErrBadNodeStatus,
+		types.ErrBadVolumeTag,
+		types.ErrBadInstanceTag,
+		types.ErrTooManyInstanceTags,
+		types.ErrAddressNotInPool:
+		return Response{http.StatusBadRequest, nil}
+
 	case types.ErrQuota,
 		types.ErrInstanceNotAssigned,
-		types.ErrDuplicateSubnet,
-		types.ErrDuplicateIP,
 		types.ErrInvalidIP,
 		types.ErrPoolNotEmpty,
 		types.ErrInvalidPoolAddress,
 		types.ErrBadRequest,
 		types.ErrPoolEmpty,
 		types.ErrDuplicatePoolName,
-		types.ErrWorkloadInUse:
+		types.ErrWorkloadInUse,
+		types.ErrWorkloadRequirementsInUse,
+		types.ErrPublicWorkload,
+		types.ErrCNCIWorkload,
+		types.ErrNoPreviousCNCIImage,
+		types.ErrCNCIRolloutInProgress,
+		types.ErrSignedURLsDisabled:
 		return Response{http.StatusForbidden, nil}
 
 	default:
@@ -216,6 +627,27 @@ type Handler struct {
 	Privileged bool
 }
 
+// errorData describes an error for the body of a response with the given
+// status.
+func errorData(status int, err error) HTTPErrorData {
+	data := HTTPErrorData{
+		Code:    status,
+		Name:    http.StatusText(status),
+		Message: err.Error(),
+	}
+	if e, ok := errors.Cause(err).(*types.LaunchError); ok {
+		data.FailureCode = string(e.Code)
+	}
+	if e, ok := errors.Cause(err).(*types.AddressInUseError); ok {
+		data.InstanceID = e.InstanceID
+	}
+	if e, ok := errors.Cause(err).(*types.WorkloadValidationError); ok {
+		data.Violations = e.Violations
+	}
+
+	return data
+}
+
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// check whether we should send permission denied for this route.
 	if h.Privileged {
@@ -231,17 +663,28 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := h.Handler(h.Context, w, r)
 	if err != nil {
-		data := HTTPErrorData{
-			Code:    resp.status,
-			Name:    http.StatusText(resp.status),
-			Message: err.Error(),
+		// whatever error abandoned work ended with, the cause is the
+		// client going away or the request running out of time.
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			resp = Response{http.StatusServiceUnavailable, nil}
+			err = errors.Wrap(err, ctxErr.Error())
+		}
+
+		// handlers may fail to read an oversized body in many ways.
+		if tooLarge, ok := errors.Cause(err).(*http.MaxBytesError); ok {
+			resp = Response{http.StatusRequestEntityTooLarge, nil}
+			err = BodyTooLargeError(tooLarge.Limit)
 		}
 
 		code := HTTPReturnErrorCode{
-			Error: data,
+			Error: errorData(resp.status, err),
 		}
 
-		glog.Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
+		log := clogger.With(h.Log, "request", service.GetRequestID(r.Context()))
+		if tenant, ok := mux.Vars(r)["tenant"]; ok {
+			log = clogger.With(log, "tenant", tenant)
+		}
+		log.Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
 
 		b, err := json.Marshal(code)
 		if err != nil {
@@ -253,6 +696,17 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, ok := resp.response.(streamedResponse); ok {
+		return
+	}
+
+	if raw, ok := resp.response.(rawResponse); ok {
+		w.Header().Set("Content-Type", raw.contentType)
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(raw.body)
+		return
+	}
+
 	b, err := json.Marshal(resp.response)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError),
@@ -342,6 +796,99 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 		links = append(links, link)
 	}
 
+	// for the "webhooks" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "webhooks",
+			Version:    WebhooksV1,
+			MinVersion: WebhooksV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/webhooks", c.URL)
+		links = append(links, link)
+	}
+
+	// for the "policy" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "policy",
+			Version:    PolicyV1,
+			MinVersion: PolicyV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/policy/rules", c.URL)
+		links = append(links, link)
+	}
+
+	// for the "settings" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "settings",
+			Version:    SettingsV1,
+			MinVersion: SettingsV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/settings", c.URL)
+		links = append(links, link)
+	}
+
+	// for the "audit" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "audit",
+			Version:    AuditV1,
+			MinVersion: AuditV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/audit", c.URL)
+		links = append(links, link)
+	}
+
+	// for the "events" resource
+	link = types.APILink{
+		Rel:        "events",
+		Version:    EventsV1,
+		MinVersion: EventsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/events", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/events", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// for the "operations" resource
+	link = types.APILink{
+		Rel:        "operations",
+		Version:    OperationsV1,
+		MinVersion: OperationsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/operations", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/operations", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// for the "trash" resource
+	link = types.APILink{
+		Rel:        "trash",
+		Version:    TrashV1,
+		MinVersion: TrashV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/trash", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/trash", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
 	// for the "images" resource
 	link = types.APILink{
 		Rel:        "images",
@@ -381,9 +928,109 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 		links = append(links, link)
 	}
 
+	// for the "launch-templates" resource
+	if ok {
+		link = types.APILink{
+			Rel:        "launch-templates",
+			Version:    LaunchTemplatesV1,
+			MinVersion: LaunchTemplatesV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/%s/launch-templates", c.URL, tenantID)
+		links = append(links, link)
+	}
+
+	// for the "server-groups" resource
+	if ok {
+		link = types.APILink{
+			Rel:        "server-groups",
+			Version:    ServerGroupsV1,
+			MinVersion: ServerGroupsV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/%s/server-groups", c.URL, tenantID)
+		links = append(links, link)
+	}
+
+	// for the "snapshot-schedules" resource
+	if ok {
+		link = types.APILink{
+			Rel:        "snapshot-schedules",
+			Version:    SnapshotSchedulesV1,
+			MinVersion: SnapshotSchedulesV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/%s/snapshot-schedules", c.URL, tenantID)
+		links = append(links, link)
+	}
+
+	// for the "api-keys" resource
+	if ok {
+		link = types.APILink{
+			Rel:        "api-keys",
+			Version:    APIKeysV1,
+			MinVersion: APIKeysV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/%s/api-keys", c.URL, tenantID)
+		links = append(links, link)
+	}
+
+	// for the "cncis" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "cncis",
+			Version:    CNCIsV1,
+			MinVersion: CNCIsV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/cncis", c.URL)
+		links = append(links, link)
+	}
+
+	// for the "capabilities" resource
+	link = types.APILink{
+		Rel:        "capabilities",
+		Version:    CapabilitiesV1,
+		MinVersion: CapabilitiesV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/capabilities", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/capabilities", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// for the "capacity" resource
+	if ok {
+		link = types.APILink{
+			Rel:        "capacity",
+			Version:    CapacityV1,
+			MinVersion: CapacityV1,
+		}
+
+		link.Href = fmt.Sprintf("%s/%s/capacity", c.URL, tenantID)
+		links = append(links, link)
+	}
+
 	return Response{http.StatusOK, links}, nil
 }
 
+// showCapabilities describes the controller build and which optional
+// features it supports, so that clients need not probe for them.
+func showCapabilities(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	caps := c.Capabilities()
+
+	caps.APIVersions = make(map[string]string, len(apiVersions))
+	for rel, version := range apiVersions {
+		caps.APIVersions[rel] = version
+	}
+
+	return Response{http.StatusOK, caps}, nil
+}
+
 func showPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	ID := vars["pool"]
@@ -399,7 +1046,12 @@ func showPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, err
 func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var resp types.ListPoolsResponse
 	vars := mux.Vars(r)
-	_, ok := vars["tenant"]
+	tenantID, ok := vars["tenant"]
+
+	filter, err := parseListFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
 
 	pools, err := c.ListPools()
 	if err != nil {
@@ -411,7 +1063,13 @@ func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 	names, returnNamedPool := queries["name"]
 
 	var match bool
+	var listed []types.Pool
 	for i, p := range pools {
+		// tenants only see the pools they may map addresses from.
+		if ok && !p.Accessible(tenantID) {
+			continue
+		}
+
 		if returnNamedPool == true {
 			for _, name := range names {
 				if name == p.Name {
@@ -423,18 +1081,7 @@ func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 		}
 
 		if match {
-			summary := types.PoolSummary{
-				ID:   p.ID,
-				Name: p.Name,
-			}
-
-			if !ok {
-				summary.TotalIPs = &pools[i].TotalIPs
-				summary.Free = &pools[i].Free
-				summary.Links = pools[i].Links
-			}
-
-			resp.Pools = append(resp.Pools, summary)
+			listed = append(listed, pools[i])
 		}
 	}
 
@@ -442,7 +1089,32 @@ func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 		return Response{http.StatusNotFound, nil}, types.ErrPoolNotFound
 	}
 
-	return Response{http.StatusOK, resp}, err
+	start, end, next, err := listPage(len(listed), func(i int) types.ListCursor {
+		return listed[i].Cursor()
+	}, filter)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	for i := start; i < end; i++ {
+		summary := types.PoolSummary{
+			ID:   listed[i].ID,
+			Name: listed[i].Name,
+		}
+
+		if !ok {
+			summary.TotalIPs = &listed[i].TotalIPs
+			summary.Free = &listed[i].Free
+			summary.Links = listed[i].Links
+		}
+
+		resp.Pools = append(resp.Pools, summary)
+	}
+
+	setNextMarker(w, next)
+	resp.NextMarker = next
+
+	return Response{http.StatusOK, resp}, nil
 }
 
 func addPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
@@ -484,11 +1156,11 @@ func deletePool(c *Context, w http.ResponseWriter, r *http.Request) (Response, e
 	return Response{http.StatusNoContent, nil}, nil
 }
 
-func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func setPoolAccess(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	ID := vars["pool"]
 
-	var req types.NewAddressRequest
+	var req types.PoolAccessRequest
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -500,13 +1172,7 @@ func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 		return errorResponse(err), err
 	}
 
-	var ips []string
-
-	for _, ip := range req.IPs {
-		ips = append(ips, ip.IP)
-	}
-
-	err = c.AddAddress(ID, req.Subnet, ips)
+	err = c.SetPoolAccess(ID, req.Tenants)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -514,9 +1180,39 @@ func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 	return Response{http.StatusNoContent, nil}, nil
 }
 
-func deleteSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	poolID := vars["pool"]
+	ID := vars["pool"]
+
+	var req types.NewAddressRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var ips []string
+
+	for _, ip := range req.IPs {
+		ips = append(ips, ip.IP)
+	}
+
+	err = c.AddAddress(ID, req.Subnet, ips)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	poolID := vars["pool"]
 	subnetID := vars["subnet"]
 
 	err := c.RemoveAddress(poolID, &subnetID, nil)
@@ -546,12 +1242,30 @@ func listMappedIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	var IPs []types.MappedIP
 	var short []types.MappedIPShort
 
+	filter, err := parseListFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
 	if !ok {
 		IPs = c.ListMappedAddresses(nil)
+	} else {
+		IPs = c.ListMappedAddresses(&tenantID)
+	}
+
+	start, end, next, err := listPage(len(IPs), func(i int) types.ListCursor {
+		return IPs[i].Cursor()
+	}, filter)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+	IPs = IPs[start:end]
+	setNextMarker(w, next)
+
+	if !ok {
 		return Response{http.StatusOK, IPs}, nil
 	}
 
-	IPs = c.ListMappedAddresses(&tenantID)
 	for _, IP := range IPs {
 		s := types.MappedIPShort{
 			ID:         IP.ID,
@@ -582,7 +1296,11 @@ func mapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response
 
 	tenantID := vars["tenant"]
 
-	err = c.MapAddress(tenantID, req.PoolName, req.InstanceID)
+	err = c.MapAddress(tenantID, req.PoolName, req.InstanceID, req.Address)
+	if e, ok := err.(*types.AddressInUseError); ok && !service.GetPrivilege(r.Context()) {
+		// only the admin may learn which instance holds the address
+		err = &types.AddressInUseError{Address: e.Address}
+	}
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -620,12 +1338,9 @@ func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Respon
 func addWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var req types.Workload
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
-	}
-
-	err = json.Unmarshal(body, &req)
+	// workload definitions may be large, so they are decoded as they
+	// are read.
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -685,6 +1400,29 @@ func deleteWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Respons
 	return Response{http.StatusNoContent, nil}, nil
 }
 
+func updateWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["workload_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	var req types.Workload
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	wl, err := c.UpdateWorkload(tenantID, ID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, wl}, nil
+}
+
 func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	ID := vars["workload_id"]
@@ -702,12 +1440,61 @@ func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 	return Response{http.StatusOK, wl}, nil
 }
 
+// previewWorkloadConfig returns the configuration an instance of the
+// workload would be started with, compared with the configuration of an
+// existing instance if the request names one.
+func previewWorkloadConfig(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["workload_id"]
+
+	tenant, ok := vars["tenant"]
+	if !ok {
+		tenant = "admin"
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.ConfigPreviewRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	resp, err := c.PreviewWorkloadConfig(tenant, ID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// parseSearch returns the text searched for by the search query
+// parameter of a list request, empty if there is none.
+func parseSearch(r *http.Request) (string, error) {
+	search := r.URL.Query().Get("search")
+	if len(search) > types.MaxSearchLength {
+		return "", fmt.Errorf("search must be at most %d bytes", types.MaxSearchLength)
+	}
+
+	return search, nil
+}
+
 func listWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 
 	tenant := vars["tenant"]
 
-	wls, err := c.ListWorkloads(tenant)
+	search, err := parseSearch(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	wls, err := c.ListWorkloads(tenant, search)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -754,86 +1541,73 @@ func updateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 	return Response{http.StatusCreated, resp}, nil
 }
 
-func changeNodeStatus(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// listQuotaHistory returns the quota audit records of a tenant, optionally
+// only those of the resource given by the resource parameter and those
+// made since the since parameter.
+func listQuotaHistory(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	ID := vars["node_id"]
+	values := r.URL.Query()
+	filter := types.QuotaAuditFilter{
+		TenantID: vars["for_tenant"],
+		Resource: values.Get("resource"),
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
+	if v := values.Get("since"); v != "" {
+		var err error
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid since: %s", v)
+		}
 	}
 
-	var status types.CiaoNodeStatus
-	err = json.Unmarshal(body, &status)
+	history, err := c.ListQuotaHistory(filter)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	if status.Status == types.NodeStatusReady {
-		err = c.RestoreNode(ID)
-	} else if status.Status == types.NodeStatusMaintenance {
-		err = c.EvacuateNode(ID)
-	} else {
-		err = fmt.Errorf("Cannot transition node %s to %s",
-			ID, status.Status)
-	}
+	return Response{http.StatusOK, types.QuotaHistoryResponse{History: history}}, nil
+}
+
+func showTenantCA(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
 
+	ca, err := c.ShowTenantCA(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	return Response{http.StatusOK, ca}, nil
 }
 
-func listTenants(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	var resp types.TenantsListResponse
-
-	queries := r.URL.Query()
-	IDs, returnSingleTenant := queries["id"]
+func updateTenantCA(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
 
-	tenants, err := c.ListTenants()
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	if returnSingleTenant != true {
-		resp.Tenants = tenants
-		return Response{http.StatusOK, resp}, nil
-	}
-
-	for _, t := range tenants {
-		for _, tenantID := range IDs {
-			if t.ID == tenantID {
-				resp.Tenants = append(resp.Tenants, t)
-			}
-		}
+	var req types.TenantCARequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	return Response{http.StatusOK, resp}, nil
-}
-
-func showTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["tenant"]
-
-	resp, err := c.ShowTenant(ID)
+	ca, err := c.UpdateTenantCA(tenantID, req)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, resp}, nil
+	return Response{http.StatusCreated, ca}, nil
 }
 
-func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func deleteTenantCA(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	ID := vars["tenant"]
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	tenantID := vars["for_tenant"]
 
-	err = c.PatchTenant(ID, body)
+	err := c.DeleteTenantCA(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -841,612 +1615,3048 @@ func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 	return Response{http.StatusNoContent, nil}, nil
 }
 
-func createTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// freezeTenant freezes or unfreezes the tenant in the path.
+func freezeTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	var req types.TenantRequest
+	var req types.TenantFreezeRequest
 	err = json.Unmarshal(body, &req)
 	if err != nil {
-		return errorResponse(err), err
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	resp, err := c.CreateTenant(req.ID, req.Config)
+	err = c.FreezeTenant(tenantID, req)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusCreated, resp}, nil
+	return Response{http.StatusNoContent, nil}, nil
 }
 
-func deleteTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// exportTenant returns the definitions of a tenant in a form which can be
+// imported into another cluster.
+func exportTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	ID := vars["tenant"]
+	tenantID := vars["for_tenant"]
 
-	err := c.DeleteTenant(ID)
+	resp, err := c.ExportTenant(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
-}
-
-func validPrivilege(visibility types.Visibility, privileged bool) bool {
-	return visibility == types.Private || (visibility == types.Public || visibility == types.Internal) && privileged
+	return Response{http.StatusOK, resp}, nil
 }
 
-// createImage creates information about an image, but doesn't contain
-// any actual image.
-func createImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenantID := vars["tenant"]
+// importTenant recreates a tenant from an export.  The response reports
+// which classes of objects were imported and the conflicts which prevented
+// the others from being imported.  Nothing is changed if the validate_only
+// parameter is true.
+func importTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	validateOnly := false
+	if v := r.URL.Query().Get("validate_only"); v != "" {
+		var err error
+		validateOnly, err = strconv.ParseBool(v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid validate_only: %s", v)
+		}
+	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
+		return errorResponse(err), err
 	}
 
-	var req CreateImageRequest
-
+	var req types.TenantExport
 	err = json.Unmarshal(body, &req)
 	if err != nil {
-		return Response{http.StatusInternalServerError, nil}, err
-	}
-
-	privileged := service.GetPrivilege(r.Context())
-
-	if !validPrivilege(req.Visibility, privileged) {
-		return Response{http.StatusForbidden, nil}, nil
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	resp, err := context.CreateImage(tenantID, req)
-
+	resp, err := c.ImportTenant(req, validateOnly)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusCreated, resp}, nil
+	return Response{http.StatusOK, resp}, nil
 }
 
-// listImages returns a list of all created images.
-//
-// TBD: support query & sort parameters
-func listImages(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// prepareTenantNetwork starts launching the CNCI for a subnet of the
+// tenant's network and returns the operation tracking it.
+func prepareTenantNetwork(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	tenantID, ok := vars["tenant"]
 	if !ok {
-		tenantID = "admin"
+		tenantID = vars["for_tenant"]
 	}
 
-	images, err := context.ListImages(tenantID)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, images}, nil
+	var req types.TenantNetworkPrepareRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	op, err := c.PrepareTenantNetwork(tenantID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%s/operations/%s", c.URL, tenantID, op.ID))
+	return Response{http.StatusAccepted, op}, nil
 }
 
-// getImage get information about an image by image_id field
-//
-func getImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// retryTenantNetwork allows an admin to retry the initialization of the
+// network controller of a degraded tenant without restarting the
+// controller.
+func retryTenantNetwork(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	imageID := vars["image_id"]
-
-	tenantID, ok := vars["tenant"]
-	if !ok {
-		tenantID = "admin"
-	}
+	tenantID := vars["for_tenant"]
 
-	image, err := context.GetImage(tenantID, imageID)
+	err := c.RetryTenantNetwork(r.Context(), tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, image}, nil
+	return Response{http.StatusNoContent, nil}, nil
 }
 
-func uploadImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func showTenantNetwork(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	imageID := vars["image_id"]
-
 	tenantID, ok := vars["tenant"]
 	if !ok {
-		tenantID = "admin"
+		tenantID = vars["for_tenant"]
 	}
 
-	err := context.UploadImage(tenantID, imageID, r.Body)
+	network, err := c.ShowTenantNetwork(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
-	return Response{http.StatusNoContent, nil}, nil
+
+	return Response{http.StatusOK, network}, nil
 }
 
-func deleteImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// listTenantSubnets lists the subnets of the tenant in the path, or of any
+// tenant for the admin route, with their utilization.
+func listTenantSubnets(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	imageID := vars["image_id"]
-
 	tenantID, ok := vars["tenant"]
 	if !ok {
-		tenantID = "admin"
+		tenantID = vars["for_tenant"]
 	}
 
-	err := context.DeleteImage(tenantID, imageID)
+	network, err := c.ShowTenantNetwork(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	return Response{http.StatusOK, types.TenantSubnets{Subnets: network.Subnets}}, nil
 }
 
-func createVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// createSignedURL signs a URL through which a read-only resource of the
+// tenant in the path, or of any tenant for the admin route, may be
+// downloaded without credentials.
+func createSignedURL(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenant := vars["tenant"]
+	tenantID := vars["tenant"]
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
+		return errorResponse(err), err
 	}
 
-	var req RequestedVolume
+	var req types.SignedURLRequest
 	err = json.Unmarshal(body, &req)
 	if err != nil {
-		return Response{http.StatusInternalServerError, nil}, err
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	vol, err := bc.CreateVolume(tenant, req)
+	signed, err := c.CreateSignedURL(tenantID, req)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusAccepted, vol}, nil
+	return Response{http.StatusCreated, signed}, nil
 }
 
-func listVolumesDetail(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
+// usageCSV renders usage records as CSV, one record per line after a
+// header line.
+func usageCSV(records []types.UsageRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	_ = w.Write([]string{"tenant_id", "granularity", "start", "end",
+		"instance_hours", "volume_gb_hours", "external_ip_hours"})
+
+	for _, r := range records {
+		_ = w.Write([]string{
+			r.TenantID,
+			string(r.Granularity),
+			r.Start.UTC().Format(time.RFC3339),
+			r.End.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(r.InstanceHours, 'f', 6, 64),
+			strconv.FormatFloat(r.VolumeGBHours, 'f', 6, 64),
+			strconv.FormatFloat(r.ExternalIPHours, 'f', 6, 64),
+		})
+	}
 
-	vols, err := bc.ListVolumesDetail(tenant)
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// listUsage exports the usage records of the tenants, or of the tenant
+// given by the tenant_id parameter, which start between the start and end
+// parameters.  The records are returned as JSON, or as CSV if the format
+// parameter is csv.
+func listUsage(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	values := r.URL.Query()
+	filter := types.UsageFilter{
+		TenantID:    values.Get("tenant_id"),
+		Granularity: types.UsageGranularity(values.Get("granularity")),
+	}
+
+	var err error
+
+	if v := values.Get("start"); v != "" {
+		filter.Start, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid start: %s", v)
+		}
+	}
+
+	if v := values.Get("end"); v != "" {
+		filter.End, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid end: %s", v)
+		}
+	}
+
+	switch filter.Granularity {
+	case "", types.UsageSample, types.UsageHourly, types.UsageDaily:
+	default:
+		return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid granularity: %s", filter.Granularity)
+	}
+
+	format := values.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid format: %s", format)
+	}
+
+	records, err := c.ListUsage(filter)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, vols}, nil
+	if format != "csv" {
+		return Response{http.StatusOK, types.ListUsageResponse{Usage: records}}, nil
+	}
+
+	b, err := usageCSV(records)
+	if err != nil {
+		return Response{http.StatusInternalServerError, nil}, err
+	}
+
+	return Response{http.StatusOK, rawResponse{contentType: "text/csv", body: b}}, nil
 }
 
-func showVolumeDetails(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	volume := vars["volume_id"]
+// defaultQuotaDenialsLimit is the number of tenants returned by
+// listQuotaDenials when no limit is given.
+const defaultQuotaDenialsLimit = 10
 
-	vol, err := bc.ShowVolumeDetails(tenant, volume)
-	if err != nil {
-		return errorResponse(err), err
+func listQuotaDenials(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	limit := defaultQuotaDenialsLimit
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid limit: %s", l)
+		}
 	}
 
-	return Response{http.StatusOK, vol}, nil
+	return Response{http.StatusOK, c.ListQuotaDenials(limit)}, nil
 }
 
-func deleteVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	volume := vars["volume_id"]
+const (
+	// defaultEventsLimit is the number of events returned by listEvents
+	// when no limit is given.
+	defaultEventsLimit = 100
 
-	// TBD - satisfy preconditions here, or in interface?
-	err := bc.DeleteVolume(tenant, volume)
-	if err != nil {
-		return errorResponse(err), err
+	// maxEventsLimit is the largest number of events listEvents returns
+	// in a single response.
+	maxEventsLimit = 1000
+
+	// defaultConsoleLogLength is the number of lines returned by
+	// showConsoleLog when no length is given.
+	defaultConsoleLogLength = 100
+
+	// maxConsoleLogLength is the largest number of lines showConsoleLog
+	// returns in a single response.
+	maxConsoleLogLength = 1000
+)
+
+// parseListFilter parses the marker and limit query parameters of a list
+// request.  The whole list is returned when no limit is given.
+func parseListFilter(r *http.Request) (types.ListFilter, error) {
+	values := r.URL.Query()
+	filter := types.ListFilter{
+		Marker: values.Get("marker"),
 	}
 
-	return Response{http.StatusAccepted, nil}, nil
+	if filter.Marker != "" {
+		_, err := types.ParseListMarker(filter.Marker)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxEventsLimit {
+			return filter, fmt.Errorf("Invalid limit: %s", v)
+		}
+	}
+
+	return filter, nil
 }
 
-func volumeActionAttach(bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
-	val := m["attach"]
+// listPage returns the bounds of the page selected by filter from a list
+// of n items in canonical order, and the marker of the page which follows
+// it.  cursor returns the position of the ith item.  Pages start after
+// the position encoded in the marker rather than at an offset, so items
+// added or removed while a client pages through a list never cause other
+// items to be skipped or repeated.
+func listPage(n int, cursor func(i int) types.ListCursor, filter types.ListFilter) (int, int, string, error) {
+	start := 0
+	if filter.Marker != "" {
+		marker, err := types.ParseListMarker(filter.Marker)
+		if err != nil {
+			return 0, 0, "", err
+		}
 
-	m = val.(map[string]interface{})
+		start = sort.Search(n, func(i int) bool {
+			return marker.Before(cursor(i))
+		})
+	}
 
-	val, ok := m["instance_uuid"]
-	if !ok {
-		// we have to have the instance uuid
-		return Response{http.StatusBadRequest, nil}, nil
+	end := n
+	next := ""
+	if filter.Limit > 0 && end-start > filter.Limit {
+		end = start + filter.Limit
+		next = cursor(end - 1).Marker()
 	}
-	instance := val.(string)
 
-	val, ok = m["mountpoint"]
-	if !ok {
-		// we have to have the mountpoint ?
-		return Response{http.StatusBadRequest, nil}, nil
+	return start, end, next, nil
+}
+
+// setNextMarker adds the marker of the next page of a list to the
+// response headers.
+func setNextMarker(w http.ResponseWriter, next string) {
+	if next != "" {
+		w.Header().Set(NextMarkerHeader, next)
 	}
-	mountPoint := val.(string)
+}
 
-	err := bc.AttachVolume(tenant, volume, instance, mountPoint)
-	if err != nil {
-		return errorResponse(err), err
+// parseEventFilter parses the start, end, type, object_id, marker and
+// limit query parameters of an events request.
+func parseEventFilter(r *http.Request) (types.EventFilter, error) {
+	values := r.URL.Query()
+	filter := types.EventFilter{
+		Type:     values.Get("type"),
+		ObjectID: values.Get("object_id"),
+		Limit:    defaultEventsLimit,
 	}
 
-	return Response{http.StatusAccepted, nil}, nil
+	var err error
+
+	if v := values.Get("start"); v != "" {
+		filter.Start, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid start: %s", v)
+		}
+	}
+
+	if v := values.Get("end"); v != "" {
+		filter.End, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid end: %s", v)
+		}
+	}
+
+	if v := values.Get("marker"); v != "" {
+		filter.Marker, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || filter.Marker < 0 {
+			return filter, fmt.Errorf("Invalid marker: %s", v)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxEventsLimit {
+			return filter, fmt.Errorf("Invalid limit: %s", v)
+		}
+	}
+
+	return filter, nil
 }
 
-func volumeActionDetach(bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
-	val := m["detach"]
+// listAudit returns the audit records of the mutating API requests, oldest
+// first.  The records may be limited to a tenant with the tenant_id
+// parameter and to a time range with the start and end parameters.
+func listAudit(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	values := r.URL.Query()
+	filter := types.AuditFilter{
+		TenantID: values.Get("tenant_id"),
+		Limit:    defaultEventsLimit,
+	}
 
-	m = val.(map[string]interface{})
+	var err error
 
-	// attachment-id is optional
-	var attachment string
-	val = m["attachment-id"]
-	if val != nil {
-		attachment = val.(string)
+	if v := values.Get("start"); v != "" {
+		filter.Start, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid start: %s", v)
+		}
+	}
+
+	if v := values.Get("end"); v != "" {
+		filter.End, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid end: %s", v)
+		}
+	}
+
+	if v := values.Get("marker"); v != "" {
+		filter.Marker, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || filter.Marker < 0 {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid marker: %s", v)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxEventsLimit {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid limit: %s", v)
+		}
 	}
 
-	err := bc.DetachVolume(tenant, volume, attachment)
+	audit, err := c.ListAuditRecords(filter)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusAccepted, nil}, nil
+	setNextMarker(w, audit.NextMarker)
+
+	return Response{http.StatusOK, audit}, nil
 }
 
-func volumeAction(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	volume := vars["volume_id"]
+// listEvents returns the events of the tenant in the path.  When called
+// without a tenant in the path the events of all tenants, or of the tenant
+// given by the tenant_id parameter, are returned.
+func listEvents(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
 
-	var req interface{}
+	tenantID, ok := mux.Vars(r)["tenant"]
+	if !ok {
+		tenantID = r.URL.Query().Get("tenant_id")
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	var events types.CiaoEvents
+	if tenantID != "" {
+		events, err = c.ListTenantEvents(tenantID, filter)
+	} else {
+		events, err = c.ListEvents(filter)
+	}
 	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
+		return errorResponse(err), err
 	}
 
-	err = json.Unmarshal(body, &req)
+	setNextMarker(w, events.NextMarker)
+
+	return Response{http.StatusOK, events}, nil
+}
+
+// eventStreamKeepalive is the interval at which a comment is sent on an
+// idle event stream so that it is not closed by intermediaries.
+var eventStreamKeepalive = 30 * time.Second
+
+// streamEvents sends the events of the tenant in the path as server-sent
+// events as they are logged.  When called without a tenant in the path the
+// events of all tenants, or of the tenant given by the tenant_id
+// parameter, are sent.  A client which reconnects with the ID of the last
+// event it received, in the Last-Event-ID header or the last_event_id
+// parameter, is first sent the events it missed which are still in the
+// event log.
+func streamEvents(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return Response{http.StatusInternalServerError, nil}, errors.New("Streaming not supported")
+	}
+
+	var lastEventID int64
+	v := r.Header.Get("Last-Event-ID")
+	if q := r.URL.Query().Get("last_event_id"); q != "" {
+		v = q
+	}
+	if v != "" {
+		var err error
+		lastEventID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || lastEventID < 0 {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid last event ID: %s", v)
+		}
+	}
+
+	tenantID, ok := mux.Vars(r)["tenant"]
+	if !ok {
+		tenantID = r.URL.Query().Get("tenant_id")
+	}
+
+	stream, err := c.StreamEvents(tenantID, lastEventID)
 	if err != nil {
-		return Response{http.StatusInternalServerError, nil}, err
+		return errorResponse(err), err
 	}
+	defer stream.Close()
 
-	m := req.(map[string]interface{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
 
-	// for now, we will support only attach and detach
+	send := func(e types.CiaoEvent) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
 
-	if m["attach"] != nil {
-		return volumeActionAttach(bc, m, tenant, volume)
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.EventType, b)
+		return err
 	}
 
-	if m["detach"] != nil {
-		return volumeActionDetach(bc, m, tenant, volume)
+	for _, e := range stream.Backlog {
+		if err := send(e); err != nil {
+			return Response{http.StatusOK, streamedResponse{}}, nil
+		}
+		lastEventID = e.ID
 	}
+	flusher.Flush()
 
-	return Response{http.StatusBadRequest, nil}, err
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	// the stream ends when the client goes away or falls behind, or
+	// the controller shuts down.
+	for {
+		select {
+		case e, ok := <-stream.Events:
+			if !ok {
+				return Response{http.StatusOK, streamedResponse{}}, nil
+			}
+
+			// events logged while the backlog was read are
+			// received twice.
+			if e.ID <= lastEventID {
+				continue
+			}
+			lastEventID = e.ID
+
+			err = send(e)
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return Response{http.StatusOK, streamedResponse{}}, nil
+		}
+
+		if err != nil {
+			return Response{http.StatusOK, streamedResponse{}}, nil
+		}
+		flusher.Flush()
+	}
 }
 
-func createInstance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// listOperations returns the operations of the tenant in the path, or of
+// all tenants for the admin route.
+func listOperations(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenant := vars["tenant"]
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	operations, err := c.ListOperations(tenantID)
 	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
+		return errorResponse(err), err
 	}
 
-	var req CreateServerRequest
+	return Response{http.StatusOK, types.ListOperationsResponse{Operations: operations}}, nil
+}
 
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
+// showOperation returns a single operation so that clients can poll it
+// until it completes.
+func showOperation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	operationID := vars["operation_id"]
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
 	}
 
-	resp, err := c.CreateServer(tenant, req)
+	op, err := c.ShowOperation(tenantID, operationID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusAccepted, resp}, nil
+	return Response{http.StatusOK, op}, nil
 }
-func listInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-
-	values := r.URL.Query()
-
-	var workload string
 
-	// if this function is called via an admin context, we might
-	// have {workload} on the URL. If it's called from a user context,
-	// we might have workload as a query value.
-	workload, ok := vars["workload"]
+// listTrash returns the trash of the tenant in the path, or of all tenants
+// for the admin route.
+func listTrash(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
 	if !ok {
-		if len(values["workload"]) > 0 {
-			workload = values["workload"][0]
-		}
+		tenantID = "admin"
 	}
 
-	servers, err := c.ListServersDetail(tenant)
+	items, err := c.ListTrash(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	resp := Servers{}
+	return Response{http.StatusOK, types.ListTrashResponse{Items: items}}, nil
+}
 
-	if workload != "" {
-		for _, s := range servers {
-			if s.WorkloadID == workload {
-				resp.Servers = append(resp.Servers, s)
-			}
-		}
-	} else {
-		resp.Servers = servers
+// restoreTrashItem restores a deleted instance or volume from the trash of
+// the tenant and returns the ID of the restored resource.
+func restoreTrashItem(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = vars["for_tenant"]
 	}
+	itemID := vars["item_id"]
 
-	resp.TotalServers = len(resp.Servers)
+	resp, err := c.RestoreTrashItem(r.Context(), tenantID, itemID)
+	if err != nil {
+		return errorResponse(err), err
+	}
 
 	return Response{http.StatusOK, resp}, nil
 }
 
-func showInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// showTenantCapacity returns the capacity hints for the workloads of the
+// tenant in the path.
+func showTenantCapacity(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	server := vars["instance_id"]
+	tenantID := vars["tenant"]
 
-	resp, err := c.ShowServerDetails(tenant, server)
+	capacity, err := c.ShowTenantCapacity(tenantID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, resp}, nil
+	return Response{http.StatusOK, capacity}, nil
 }
 
-func deleteInstance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// showWorkloadCapacity returns how many more instances of the workload in
+// the path would fit on each node.
+func showWorkloadCapacity(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	server := vars["instance_id"]
+	workloadID := vars["workload_id"]
 
-	err := c.DeleteServer(tenant, server)
+	capacity, err := c.ShowWorkloadCapacity(workloadID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
-}
+	return Response{http.StatusOK, capacity}, nil
+}
+
+// showCNCIImage returns the image CNCIs are launched from.
+func showCNCIImage(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	image, err := c.GetCNCIImage()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, image}, nil
+}
+
+// rolloutCNCIs starts relaunching the CNCIs from a new image, or from the
+// previous image for a rollback, and returns the operation tracking it.
+func rolloutCNCIs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.CNCIRolloutRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var op types.Operation
+	if strings.HasSuffix(r.URL.Path, "/rollback") {
+		op, err = c.RollbackCNCIs(req)
+	} else {
+		op, err = c.UpgradeCNCIs(req)
+	}
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/operations/%s", c.URL, op.ID))
+	return Response{http.StatusAccepted, op}, nil
+}
+
+func changeNodeStatus(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["node_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var status types.CiaoNodeStatus
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if status.Status == types.NodeStatusReady {
+		err = c.RestoreNode(ID)
+	} else if status.Status == types.NodeStatusMaintenance {
+		err = c.EvacuateNode(ID)
+	} else {
+		err = fmt.Errorf("Cannot transition node %s to %s",
+			ID, status.Status)
+	}
+
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// setNodeStatus puts a node into or takes it out of maintenance.  The
+// instances on a node put into maintenance are moved to other nodes by an
+// operation if the evacuate query parameter is true.
+func setNodeStatus(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["node_id"]
+
+	evacuate := false
+	if v := r.URL.Query().Get("evacuate"); v != "" {
+		var err error
+		evacuate, err = strconv.ParseBool(v)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, fmt.Errorf("Invalid evacuate: %s", v)
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var status types.CiaoNodeStatus
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	status.Status = types.NodeStatusType(strings.ToUpper(string(status.Status)))
+	op, err := c.SetNodeStatus(ID, status.Status, evacuate)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if op.ID == "" {
+		return Response{http.StatusNoContent, nil}, nil
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/operations/%s", c.URL, op.ID))
+	return Response{http.StatusAccepted, op}, nil
+}
+
+func listTenants(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var resp types.TenantsListResponse
+
+	queries := r.URL.Query()
+	IDs, returnSingleTenant := queries["id"]
+
+	tenants, err := c.ListTenants()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if returnSingleTenant != true {
+		resp.Tenants = tenants
+		return Response{http.StatusOK, resp}, nil
+	}
+
+	for _, t := range tenants {
+		for _, tenantID := range IDs {
+			if t.ID == tenantID {
+				resp.Tenants = append(resp.Tenants, t)
+			}
+		}
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	resp, err := c.ShowTenant(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.PatchTenant(ID, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func createTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.TenantRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp, created, err := c.CreateTenant(req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !created {
+		return Response{http.StatusOK, resp}, nil
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// forceRequested returns whether a delete request asks for the deletion
+// protection of the resources deleted to be overridden, which only the admin
+// may do.
+func forceRequested(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("force")
+	if v == "" {
+		return false, nil
+	}
+
+	force, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, types.ErrBadRequest
+	}
+
+	if force && !service.GetPrivilege(r.Context()) {
+		return false, errors.New("Only admins may override deletion protection")
+	}
+
+	return force, nil
+}
+
+func deleteTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	force, err := forceRequested(r)
+	if err != nil {
+		return Response{http.StatusForbidden, nil}, err
+	}
+
+	op, err := c.DeleteTenant(r.Context(), ID, force)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/operations/%s", c.URL, op.ID))
+
+	return Response{http.StatusAccepted, op}, nil
+}
+
+func listWebhooks(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	webhooks, err := c.ListWebhooks()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ListWebhooksResponse{Webhooks: webhooks}
+	return Response{http.StatusOK, resp}, nil
+}
+
+func addWebhook(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.NewWebhookRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp, err := c.AddWebhook(req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func showWebhook(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["webhook"]
+
+	resp, err := c.ShowWebhook(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func deleteWebhook(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["webhook"]
+
+	err := c.DeleteWebhook(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func listPolicyRules(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	rules, err := c.ListPolicyRules()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ListPolicyRulesResponse{Rules: rules}
+	return Response{http.StatusOK, resp}, nil
+}
+
+func createPolicyRule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.PolicyRule
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.CreatePolicyRule(req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func showPolicyRule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["rule"]
+
+	resp, err := c.ShowPolicyRule(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// updatePolicyRule replaces the conditions of a policy rule.  The new rule
+// applies to the next workload created, updated or launched.
+func updatePolicyRule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["rule"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.PolicyRule
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.UpdatePolicyRule(ID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func deletePolicyRule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["rule"]
+
+	err := c.DeletePolicyRule(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func listSettings(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	settings, err := c.ListSettings()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ListSettingsResponse{Settings: settings}
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showSetting(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	key := vars["setting"]
+
+	resp, err := c.ShowSetting(key)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// updateSetting changes the value of a cluster setting.  The new value is
+// applied by the controller immediately.
+func updateSetting(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	key := vars["setting"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.SettingRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.UpdateSetting(r.Context(), key, req.Value)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// resetSetting restores the default value of a cluster setting.
+func resetSetting(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	key := vars["setting"]
+
+	resp, err := c.ResetSetting(r.Context(), key)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func validPrivilege(visibility types.Visibility, privileged bool) bool {
+	return visibility == types.Private || (visibility == types.Public || visibility == types.Internal) && privileged
+}
+
+// createImage creates information about an image, but doesn't contain
+// any actual image.
+func createImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req CreateImageRequest
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusInternalServerError, nil}, err
+	}
+
+	privileged := service.GetPrivilege(r.Context())
+
+	if !validPrivilege(req.Visibility, privileged) {
+		return Response{http.StatusForbidden, nil}, nil
+	}
+
+	resp, err := context.CreateImage(tenantID, req)
+
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// listImages returns a list of all created images.
+//
+// TBD: support query & sort parameters
+func listImages(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	images, err := context.ListImages(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, images}, nil
+}
+
+// getImage get information about an image by image_id field
+func getImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	image, err := context.GetImage(tenantID, imageID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, image}, nil
+}
+
+func uploadImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	err := context.UploadImage(r.Context(), tenantID, imageID, r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	err := context.DeleteImage(r.Context(), tenantID, imageID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// setImageVisibility allows an admin to share an image with all tenants, to
+// reserve it for ciao's internal use or to make it private to its owner.
+func setImageVisibility(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req ImageVisibilityRequest
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	err = context.SetImageVisibility(imageID, req.Visibility)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// preseedImage allows an admin to have compute nodes cache an image ahead
+// of its first launch on them.  The nodes cache the image asynchronously.
+func preseedImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.ImagePreseedRequest
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	image, err := context.PreseedImage(imageID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, image}, nil
+}
+
+func createVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req RequestedVolume
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusInternalServerError, nil}, err
+	}
+
+	// creating a volume from a large image may take longer than the
+	// client is prepared to wait, so an operation is returned instead.
+	if req.ImageRef != "" {
+		op, err := bc.CreateVolumeFromImage(r.Context(), tenant, req)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("%s/%s/operations/%s", bc.URL, tenant, op.ID))
+		return Response{http.StatusAccepted, op}, nil
+	}
+
+	vol, err := bc.CreateVolume(r.Context(), tenant, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, vol}, nil
+}
+
+func listVolumesDetail(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+
+	filter, err := parseListFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	vols, err := bc.ListVolumesDetail(tenant)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	start, end, next, err := listPage(len(vols), func(i int) types.ListCursor {
+		return vols[i].Cursor()
+	}, filter)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+	setNextMarker(w, next)
+
+	return Response{http.StatusOK, vols[start:end]}, nil
+}
+
+func showVolumeDetails(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	vol, err := bc.ShowVolumeDetails(tenant, volume)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, vol}, nil
+}
+
+// listVolumeSnapshots returns the snapshots taken of a volume on request
+// or by its snapshot schedules.
+func listVolumeSnapshots(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	snapshots, err := bc.ListVolumeSnapshots(tenant, volume)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ListVolumeSnapshotsResponse{Snapshots: snapshots}}, nil
+}
+
+// createVolumeSnapshot takes a snapshot of a volume.
+func createVolumeSnapshot(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.VolumeSnapshotRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	snap, err := bc.CreateVolumeSnapshot(r.Context(), tenant, volume, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, snap}, nil
+}
+
+// deleteVolumeSnapshot deletes a snapshot of a volume.
+func deleteVolumeSnapshot(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+	snapshot := vars["snapshot_id"]
+
+	err := bc.DeleteVolumeSnapshot(r.Context(), tenant, volume, snapshot)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	force, err := forceRequested(r)
+	if err != nil {
+		return Response{http.StatusForbidden, nil}, err
+	}
+
+	// TBD - satisfy preconditions here, or in interface?
+	err = bc.DeleteVolume(r.Context(), tenant, volume, force)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+func updateVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	vol, err := bc.PatchVolume(r.Context(), tenant, volume, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, vol}, nil
+}
+
+func volumeActionAttach(ctx context.Context, bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
+	val := m["attach"]
+
+	m = val.(map[string]interface{})
+
+	val, ok := m["instance_uuid"]
+	if !ok {
+		// we have to have the instance uuid
+		return Response{http.StatusBadRequest, nil}, nil
+	}
+	instance := val.(string)
+
+	val, ok = m["mountpoint"]
+	if !ok {
+		// we have to have the mountpoint ?
+		return Response{http.StatusBadRequest, nil}, nil
+	}
+	mountPoint := val.(string)
+
+	// the tag is optional
+	var tag string
+	val = m["tag"]
+	if val != nil {
+		tag, ok = val.(string)
+		if !ok {
+			return Response{http.StatusBadRequest, nil}, nil
+		}
+	}
+
+	err := bc.AttachVolume(ctx, tenant, volume, instance, mountPoint, tag)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+func volumeActionDetach(ctx context.Context, bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
+	val := m["detach"]
+
+	m = val.(map[string]interface{})
+
+	// attachment-id is optional
+	var attachment string
+	val = m["attachment-id"]
+	if val != nil {
+		attachment = val.(string)
+	}
+
+	err := bc.DetachVolume(ctx, tenant, volume, attachment)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+func volumeActionExtend(ctx context.Context, bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
+	m, ok := m["os-extend"].(map[string]interface{})
+	if !ok {
+		return Response{http.StatusBadRequest, nil}, nil
+	}
+
+	size, ok := m["new_size"].(float64)
+	if !ok || size != float64(int(size)) {
+		return Response{http.StatusBadRequest, nil}, nil
+	}
+
+	// extending attached volumes must be requested explicitly
+	var online bool
+	if val := m["online"]; val != nil {
+		online, ok = val.(bool)
+		if !ok {
+			return Response{http.StatusBadRequest, nil}, nil
+		}
+	}
+
+	err := bc.ExtendVolume(ctx, tenant, volume, int(size), online)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+func volumeAction(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	var req interface{}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusInternalServerError, nil}, err
+	}
+
+	m := req.(map[string]interface{})
+
+	if m["attach"] != nil {
+		return volumeActionAttach(r.Context(), bc, m, tenant, volume)
+	}
+
+	if m["detach"] != nil {
+		return volumeActionDetach(r.Context(), bc, m, tenant, volume)
+	}
+
+	if m["os-extend"] != nil {
+		return volumeActionExtend(r.Context(), bc, m, tenant, volume)
+	}
+
+	return Response{http.StatusBadRequest, nil}, err
+}
+
+// volumeAttachRequest parses the body of an attach or detach volume
+// request.
+func volumeAttachRequest(r *http.Request) (types.VolumeAttachRequest, error) {
+	var req types.VolumeAttachRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return req, err
+	}
+
+	if req.InstanceID == "" {
+		return req, types.ErrBadRequest
+	}
+
+	return req, nil
+}
+
+// attachVolume attaches a volume to a running instance.  The attach
+// completes once the node running the instance has attached the volume.
+func attachVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	req, err := volumeAttachRequest(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	op, err := bc.AttachVolumeToInstance(r.Context(), tenant, volume, req.InstanceID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, op}, nil
+}
+
+// detachVolume detaches a volume from a running instance.  The detach
+// completes once the node running the instance has detached the volume.
+func detachVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	req, err := volumeAttachRequest(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	op, err := bc.DetachVolumeFromInstance(r.Context(), tenant, volume, req.InstanceID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, op}, nil
+}
+
+// forceDetachVolume allows an admin to remove the attachments of a volume
+// whose instance, or node, can no longer detach it.
+func forceDetachVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	volume := vars["volume_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.ForceDetachRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	err = bc.ForceDetachVolume(r.Context(), volume, req.Confirm)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// setVolumeState allows an admin to repair the state of a stuck volume.
+// parseAttachmentFilter parses the tenant_id, instance_id, volume_id,
+// node_id, state, marker and limit query parameters of an attachments
+// request.
+func parseAttachmentFilter(r *http.Request) (types.AttachmentFilter, error) {
+	values := r.URL.Query()
+	filter := types.AttachmentFilter{
+		TenantID:   values.Get("tenant_id"),
+		InstanceID: values.Get("instance_id"),
+		VolumeID:   values.Get("volume_id"),
+		NodeID:     values.Get("node_id"),
+		State:      types.BlockState(values.Get("state")),
+		Marker:     values.Get("marker"),
+		Limit:      defaultEventsLimit,
+	}
+
+	switch filter.State {
+	case "", types.Available, types.Attaching, types.InUse, types.Detaching, types.PendingDelete:
+	default:
+		return filter, fmt.Errorf("Invalid state: %s", filter.State)
+	}
+
+	if v := values.Get("limit"); v != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxEventsLimit {
+			return filter, fmt.Errorf("Invalid limit: %s", v)
+		}
+	}
+
+	return filter, nil
+}
+
+// listAttachments returns a page of the storage attachments of all
+// tenants, filtered by the query parameters.
+func listAttachments(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	filter, err := parseAttachmentFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := bc.ListAttachments(filter)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	setNextMarker(w, resp.NextMarker)
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func setVolumeState(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	volume := vars["volume_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.VolumeStateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	err = bc.SetVolumeState(r.Context(), volume, req.State, req.Reason)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func createInstance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	// a request naming a launch template carries only the fields of
+	// the template's request to override.
+	var fromTemplate struct {
+		Template string          `json:"template"`
+		Server   json.RawMessage `json:"server"`
+	}
+
+	err = json.Unmarshal(body, &fromTemplate)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var resp interface{}
+	if fromTemplate.Template != "" {
+		resp, err = c.CreateServerFromTemplate(r.Context(), tenant, fromTemplate.Template,
+			fromTemplate.Server, service.GetActor(r.Context()))
+	} else {
+		var req CreateServerRequest
+
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, err
+		}
+		req.Actor = service.GetActor(r.Context())
+
+		resp, err = c.CreateServer(r.Context(), tenant, req)
+	}
+	if batch, ok := errors.Cause(err).(*BatchLaunchError); ok {
+		return Response{http.StatusMultiStatus, batchLaunchResults(batch)}, nil
+	}
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, resp}, nil
+}
+
+// batchLaunchResults returns the body of the response to a request which
+// launched only some of the instances it asked for.
+func batchLaunchResults(batch *BatchLaunchError) Servers {
+	resp := batch.Servers
+	resp.Results = make([]LaunchResult, 0, len(batch.Launches))
+
+	for _, l := range batch.Launches {
+		result := LaunchResult{
+			Name:   l.Name,
+			ID:     l.ID,
+			Status: http.StatusAccepted,
+		}
+
+		if l.Err != nil {
+			result.Status = errorResponse(l.Err).status
+			data := errorData(result.Status, l.Err)
+			result.Error = &data
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp
+}
+
+// listLaunchTemplates returns the launch templates of the tenant in the path.
+func listLaunchTemplates(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	templates, err := c.ListLaunchTemplates(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ListLaunchTemplatesResponse{Templates: templates}}, nil
+}
+
+// createLaunchTemplate validates and stores a new launch template for the
+// tenant in the path.
+func createLaunchTemplate(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.LaunchTemplateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.CreateLaunchTemplate(tenantID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func showLaunchTemplate(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	name := vars["template"]
+
+	resp, err := c.ShowLaunchTemplate(tenantID, name)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// updateLaunchTemplate replaces the launch request of a launch template.
+// Instances already launched from the template are not affected.
+func updateLaunchTemplate(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	name := vars["template"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.LaunchTemplateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.UpdateLaunchTemplate(tenantID, name, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func deleteLaunchTemplate(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	name := vars["template"]
+
+	err := c.DeleteLaunchTemplate(tenantID, name)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// listServerGroups returns the server groups of the tenant in the path.
+func listServerGroups(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	groups, err := c.ListServerGroups(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ListServerGroupsResponse{Groups: groups}}, nil
+}
+
+// createServerGroup creates a new server group for the tenant in the path.
+func createServerGroup(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.ServerGroupRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.CreateServerGroup(tenantID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func showServerGroup(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	ID := vars["group_id"]
+
+	resp, err := c.ShowServerGroup(tenantID, ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func deleteServerGroup(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	ID := vars["group_id"]
+
+	err := c.DeleteServerGroup(tenantID, ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// listSnapshotSchedules returns the snapshot schedules of the tenant in the
+// path.
+func listSnapshotSchedules(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	schedules, err := c.ListSnapshotSchedules(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ListSnapshotSchedulesResponse{Schedules: schedules}}, nil
+}
+
+// createSnapshotSchedule validates and stores a new snapshot schedule for
+// the tenant in the path.
+func createSnapshotSchedule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.SnapshotScheduleRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.CreateSnapshotSchedule(tenantID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func showSnapshotSchedule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	ID := vars["schedule_id"]
+
+	resp, err := c.ShowSnapshotSchedule(tenantID, ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func deleteSnapshotSchedule(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	ID := vars["schedule_id"]
+
+	err := c.DeleteSnapshotSchedule(tenantID, ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// listAPIKeys returns the API keys of the tenant in the path.  The keys
+// themselves are never returned.
+func listAPIKeys(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	keys, err := c.ListAPIKeys(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ListAPIKeysResponse{Keys: keys}}, nil
+}
+
+// createAPIKey creates a new API key for the tenant in the path.  The
+// response is the only time the key is returned.
+func createAPIKey(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req types.APIKeyRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.CreateAPIKey(tenantID, req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// deleteAPIKey revokes an API key of the tenant in the path.
+func deleteAPIKey(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	keyID := vars["key_id"]
+
+	err := c.DeleteAPIKey(tenantID, keyID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// instanceStates are the states by which instances may be listed, indexed
+// by the value of the state parameter.  running is accepted as a synonym
+// of active.
+var instanceStates = map[string]string{
+	payloads.Pending:       payloads.Pending,
+	payloads.Queued:        payloads.Queued,
+	payloads.Running:       payloads.Running,
+	"running":              payloads.Running,
+	payloads.Stopping:      payloads.Stopping,
+	payloads.Exited:        payloads.Exited,
+	payloads.ExitFailed:    payloads.ExitFailed,
+	payloads.Hung:          payloads.Hung,
+	payloads.Missing:       payloads.Missing,
+	payloads.Unreachable:   payloads.Unreachable,
+	payloads.Migrating:     payloads.Migrating,
+	payloads.DeletePending: payloads.DeletePending,
+}
+
+// parseInstanceFilter parses the workload, workload_id, state, node_id,
+// name, tag and search query parameters of an instance list request.  The
+// workload in the path of the admin workload routes takes precedence.
+func parseInstanceFilter(c *Context, r *http.Request) (types.InstanceFilter, error) {
+	vars := mux.Vars(r)
+	values := r.URL.Query()
+
+	match := types.InstanceFilter{
+		WorkloadID: values.Get("workload_id"),
+		NodeID:     values.Get("node_id"),
+		Name:       values.Get("name"),
+	}
+
+	if match.WorkloadID == "" {
+		match.WorkloadID = values.Get("workload")
+	}
+
+	if workload, ok := vars["workload"]; ok {
+		match.WorkloadID = workload
+	}
+
+	if v := values.Get("state"); v != "" {
+		state, ok := instanceStates[v]
+		if !ok {
+			return match, fmt.Errorf("Unknown instance state: %s", v)
+		}
+		match.State = state
+	}
+
+	if v := values.Get("tag"); v != "" {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return match, fmt.Errorf("Invalid tag, expected key:value: %s", v)
+		}
+		match.TagKey = kv[0]
+		match.TagValue = kv[1]
+	}
+
+	// tenants which may not see the nodes may not select instances by them
+	if match.NodeID != "" && !nodesVisible(c, r) {
+		return match, errors.New("Instances may not be listed by node")
+	}
+
+	var err error
+	match.Search, err = parseSearch(r)
+
+	return match, err
+}
+
+// listInstanceDetails returns a page of the instances of the tenant in the
+// path, or of all tenants for the admin route, selected by the query
+// parameters.  Filters given together must all match.
+func listInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenant := mux.Vars(r)["tenant"]
+	values := r.URL.Query()
+
+	filter, err := parseListFilter(r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	match, err := parseInstanceFilter(c, r)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	servers, next, err := c.ListServersDetail(tenant, match, filter)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !nodesVisible(c, r) {
+		for i := range servers {
+			servers[i].NodeID = ""
+		}
+	}
+
+	resp := Servers{
+		TotalServers: len(servers),
+		Servers:      servers,
+		NextMarker:   next,
+	}
+
+	if next != "" {
+		values.Set("marker", next)
+		resp.Links = []types.Link{
+			{
+				Rel:  "next",
+				Href: fmt.Sprintf("%s%s?%s", c.URL, r.URL.Path, values.Encode()),
+			},
+		}
+	}
+	setNextMarker(w, next)
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	server := vars["instance_id"]
+
+	resp, err := c.ShowServerDetails(tenant, server)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !nodesVisible(c, r) {
+		resp.Server.NodeID = ""
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// updateInstance applies a JSON merge patch to the attributes of an
+// instance which may be changed once it has been created.
+func updateInstance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	server := vars["instance_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	resp, err := c.PatchServer(tenant, server, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !nodesVisible(c, r) {
+		resp.Server.NodeID = ""
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// nodesVisible returns true if the nodes instances are placed on may be
+// returned to the caller.  Admins always see them, tenants only if the
+// cluster allows it.
+func nodesVisible(c *Context, r *http.Request) bool {
+	return service.GetPrivilege(r.Context()) || c.TenantNodeVisibility()
+}
+
+// showInstancePlacements returns the node an instance is placed on and the
+// history of its placements.
+func showInstancePlacements(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+
+	resp, err := c.ShowInstancePlacements(instanceID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// showInstanceHistory returns a page of the history of an instance, which
+// may have been deleted.  Tenants only see the nodes involved if the
+// cluster allows it.
+func showInstanceHistory(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instanceID := vars["instance_id"]
+
+	values := r.URL.Query()
+	filter := types.InstanceHistoryFilter{
+		Limit: defaultEventsLimit,
+	}
+
+	var err error
+
+	if v := values.Get("marker"); v != "" {
+		filter.Marker, err = strconv.Atoi(v)
+		if err != nil || filter.Marker < 0 {
+			err = fmt.Errorf("Invalid marker: %s", v)
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxEventsLimit {
+			err = fmt.Errorf("Invalid limit: %s", v)
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	resp, err := c.ShowInstanceHistory(tenant, instanceID, filter)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !nodesVisible(c, r) {
+		for i := range resp.Entries {
+			resp.Entries[i].NodeID = ""
+		}
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// showConsoleLog returns the last lines written by an instance to its
+// serial console, which are retrieved from the node running it.
+func showConsoleLog(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instanceID := vars["instance_id"]
+
+	length := defaultConsoleLogLength
+
+	if v := r.URL.Query().Get("length"); v != "" {
+		var err error
+		length, err = strconv.Atoi(v)
+		if err != nil || length <= 0 || length > maxConsoleLogLength {
+			err = fmt.Errorf("Invalid length: %s", v)
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	resp, err := c.ShowConsoleLog(tenant, instanceID, length)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// setInstanceTag tags an instance with the key in the path and the value in
+// the request body.
+func setInstanceTag(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instanceID := vars["instance_id"]
+
+	var req types.InstanceTagRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	err = c.SetInstanceTag(tenant, instanceID, vars["key"], req.Value)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteInstanceTag(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instanceID := vars["instance_id"]
+
+	err := c.DeleteInstanceTag(tenant, instanceID, vars["key"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteInstance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	server := vars["instance_id"]
+
+	force, err := forceRequested(r)
+	if err != nil {
+		return Response{http.StatusForbidden, nil}, err
+	}
+
+	err = c.DeleteServer(r.Context(), tenant, server, force)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func instanceAction(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	server := vars["instance_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	bodyString := string(body)
+
+	if strings.Contains(bodyString, "os-start") {
+		err = c.StartServer(tenant, server)
+	} else if strings.Contains(bodyString, "os-stop") {
+		err = c.StopServer(tenant, server)
+	} else if strings.Contains(bodyString, `"restore"`) {
+		err = c.RestoreServer(tenant, server)
+	} else if strings.Contains(bodyString, `"migrate"`) {
+		if !service.GetPrivilege(r.Context()) {
+			return Response{http.StatusForbidden, nil},
+				errors.New("Only admins may migrate instances")
+		}
+
+		var req types.InstanceMigrateRequest
+		err = json.Unmarshal(body, &req)
+		if err != nil || req.Migrate.NodeID == "" {
+			return Response{http.StatusBadRequest, nil}, types.ErrBadMigration
+		}
+
+		op, err := c.MigrateInstance(tenant, server, req.Migrate.NodeID)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("%s/operations/%s", c.URL, op.ID))
+		return Response{http.StatusAccepted, op}, nil
+	} else if strings.Contains(bodyString, `"resize"`) {
+		var req types.InstanceResizeRequest
+		err = json.Unmarshal(body, &req)
+		if err != nil || req.Resize.VCPUs < 0 || req.Resize.MemMB < 0 ||
+			(req.Resize.VCPUs == 0 && req.Resize.MemMB == 0) {
+			return Response{http.StatusBadRequest, nil}, types.ErrBadResize
+		}
+
+		err = c.ResizeInstance(tenant, server, req.Resize.VCPUs, req.Resize.MemMB)
+	} else {
+		return Response{http.StatusServiceUnavailable, nil},
+			errors.New("Unsupported Action")
+	}
+
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+// Service is an interface which must be implemented by the ciao API context.
+// The methods which may block on the storage backend are passed the context
+// of the request and are expected to give up when it is done.
+type Service interface {
+	AddPool(name string, subnet *string, ips []string) (types.Pool, error)
+	ListPools() ([]types.Pool, error)
+	ShowPool(id string) (types.Pool, error)
+	DeletePool(id string) error
+	SetPoolAccess(id string, tenants []string) error
+	AddAddress(poolID string, subnet *string, IPs []string) error
+	RemoveAddress(poolID string, subnetID *string, IPID *string) error
+	ListMappedAddresses(tenantID *string) []types.MappedIP
+	MapAddress(tenantID string, poolName *string, instanceID string, address string) error
+	UnMapAddress(ID string) error
+	CreateWorkload(req types.Workload) (types.Workload, error)
+	UpdateWorkload(tenantID string, workloadID string, req types.Workload) (types.Workload, error)
+	DeleteWorkload(tenantID string, workloadID string) error
+	ShowWorkload(tenantID string, workloadID string) (types.Workload, error)
+	ListWorkloads(tenantID string, search string) ([]types.Workload, error)
+	ListQuotas(tenantID string) []types.QuotaDetails
+	UpdateQuotas(tenantID string, qds []types.QuotaDetails) error
+	ListQuotaDenials(limit int) types.QuotaDenialsResponse
+	ListQuotaHistory(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error)
+	ListEvents(filter types.EventFilter) (types.CiaoEvents, error)
+	ListTenantEvents(tenantID string, filter types.EventFilter) (types.CiaoEvents, error)
+	StreamEvents(tenantID string, lastEventID int64) (EventStream, error)
+	ListAuditRecords(filter types.AuditFilter) (types.AuditResponse, error)
+	EvacuateNode(nodeID string) error
+	RestoreNode(nodeID string) error
+	SetNodeStatus(nodeID string, status types.NodeStatusType, evacuate bool) (types.Operation, error)
+	ListTenants() ([]types.TenantSummary, error)
+	ShowTenant(ID string) (types.TenantDetails, error)
+	PatchTenant(ID string, patch []byte) error
+	CreateTenant(req types.TenantRequest) (types.TenantRecord, bool, error)
+	DeleteTenant(ctx context.Context, ID string, force bool) (types.Operation, error)
+	CreateImage(string, CreateImageRequest) (types.Image, error)
+	UploadImage(context.Context, string, string, io.Reader) error
+	ListImages(string) ([]types.Image, error)
+	GetImage(string, string) (types.Image, error)
+	DeleteImage(context.Context, string, string) error
+	SetImageVisibility(string, types.Visibility) error
+	PreseedImage(string, types.ImagePreseedRequest) (types.Image, error)
+	CreateVolume(ctx context.Context, tenant string, req RequestedVolume) (types.Volume, error)
+	CreateVolumeFromImage(ctx context.Context, tenant string, req RequestedVolume) (types.Operation, error)
+	DeleteVolume(ctx context.Context, tenant string, volume string, force bool) error
+	PatchVolume(ctx context.Context, tenant string, volume string, patch []byte) (types.Volume, error)
+	ExtendVolume(ctx context.Context, tenant string, volume string, sizeGiB int, online bool) error
+	AttachVolume(ctx context.Context, tenant string, volume string, instance string, mountpoint string, tag string) error
+	DetachVolume(ctx context.Context, tenant string, volume string, attachment string) error
+	AttachVolumeToInstance(ctx context.Context, tenant string, volume string, instance string) (types.Operation, error)
+	DetachVolumeFromInstance(ctx context.Context, tenant string, volume string, instance string) (types.Operation, error)
+	ListVolumesDetail(tenant string) ([]types.Volume, error)
+	ShowVolumeDetails(tenant string, volume string) (types.Volume, error)
+	ForceDetachVolume(ctx context.Context, volume string, confirm bool) error
+	SetVolumeState(ctx context.Context, volume string, state types.BlockState, reason string) error
+	ListAttachments(filter types.AttachmentFilter) (types.ListAttachmentsResponse, error)
+	CreateServer(ctx context.Context, tenant string, req CreateServerRequest) (interface{}, error)
+	CreateServerFromTemplate(ctx context.Context, tenant string, template string, overrides []byte, actor string) (interface{}, error)
+	ListLaunchTemplates(tenantID string) ([]types.LaunchTemplate, error)
+	CreateLaunchTemplate(tenantID string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error)
+	ShowLaunchTemplate(tenantID string, name string) (types.LaunchTemplate, error)
+	UpdateLaunchTemplate(tenantID string, name string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error)
+	DeleteLaunchTemplate(tenantID string, name string) error
+	ListServerGroups(tenantID string) ([]types.ServerGroup, error)
+	CreateServerGroup(tenantID string, req types.ServerGroupRequest) (types.ServerGroup, error)
+	ShowServerGroup(tenantID string, ID string) (types.ServerGroup, error)
+	DeleteServerGroup(tenantID string, ID string) error
+	ListSnapshotSchedules(tenantID string) ([]types.SnapshotSchedule, error)
+	CreateSnapshotSchedule(tenantID string, req types.SnapshotScheduleRequest) (types.SnapshotSchedule, error)
+	ShowSnapshotSchedule(tenantID string, ID string) (types.SnapshotSchedule, error)
+	DeleteSnapshotSchedule(tenantID string, ID string) error
+	ListVolumeSnapshots(tenantID string, volumeID string) ([]types.VolumeSnapshot, error)
+	CreateVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, req types.VolumeSnapshotRequest) (types.VolumeSnapshot, error)
+	DeleteVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, snapshotID string) error
+	PreviewWorkloadConfig(tenantID string, workloadID string, req types.ConfigPreviewRequest) (types.ConfigPreview, error)
+	ListAPIKeys(tenantID string) ([]types.APIKey, error)
+	CreateAPIKey(tenantID string, req types.APIKeyRequest) (types.NewAPIKey, error)
+	DeleteAPIKey(tenantID string, keyID string) error
+	ListServersDetail(tenant string, match types.InstanceFilter, filter types.ListFilter) ([]ServerDetails, string, error)
+	ShowServerDetails(tenant string, server string) (Server, error)
+	PatchServer(tenant string, server string, patch []byte) (Server, error)
+	ShowInstancePlacements(instanceID string) (types.InstancePlacements, error)
+	ShowInstanceHistory(tenant string, instanceID string, filter types.InstanceHistoryFilter) (types.InstanceHistory, error)
+	ShowConsoleLog(tenant string, instanceID string, length int) (types.ConsoleLog, error)
+	SetInstanceTag(tenant string, instanceID string, key string, value string) error
+	DeleteInstanceTag(tenant string, instanceID string, key string) error
+	TenantNodeVisibility() bool
+	DeleteServer(ctx context.Context, tenant string, server string, force bool) error
+	StartServer(tenant string, server string) error
+	StopServer(tenant string, server string) error
+	RestoreServer(tenant string, server string) error
+	MigrateInstance(tenant string, instance string, nodeID string) (types.Operation, error)
+	ResizeInstance(tenant string, instance string, vcpus int, memMB int) error
+	ListWebhooks() ([]types.Webhook, error)
+	AddWebhook(req types.NewWebhookRequest) (types.Webhook, error)
+	ShowWebhook(ID string) (types.Webhook, error)
+	DeleteWebhook(ID string) error
+	ListPolicyRules() ([]types.PolicyRule, error)
+	CreatePolicyRule(req types.PolicyRule) (types.PolicyRule, error)
+	ShowPolicyRule(ID string) (types.PolicyRule, error)
+	UpdatePolicyRule(ID string, req types.PolicyRule) (types.PolicyRule, error)
+	DeletePolicyRule(ID string) error
+	ListSettings() ([]types.Setting, error)
+	ShowSetting(key string) (types.Setting, error)
+	UpdateSetting(ctx context.Context, key string, value string) (types.Setting, error)
+	ResetSetting(ctx context.Context, key string) (types.Setting, error)
+	ListOperations(tenantID string) ([]types.Operation, error)
+	ShowOperation(tenantID string, operationID string) (types.Operation, error)
+	ListTrash(tenantID string) ([]types.TrashItem, error)
+	RestoreTrashItem(ctx context.Context, tenantID string, ID string) (types.TrashRestoreResponse, error)
+	GetCNCIImage() (types.CNCIImage, error)
+	UpgradeCNCIs(req types.CNCIRolloutRequest) (types.Operation, error)
+	RollbackCNCIs(req types.CNCIRolloutRequest) (types.Operation, error)
+	ShowTenantCA(tenantID string) (types.TenantCA, error)
+	UpdateTenantCA(tenantID string, req types.TenantCARequest) (types.TenantCA, error)
+	DeleteTenantCA(tenantID string) error
+	FreezeTenant(tenantID string, req types.TenantFreezeRequest) error
+	ExportTenant(tenantID string) (types.TenantExport, error)
+	ImportTenant(req types.TenantExport, validateOnly bool) (types.TenantImportResponse, error)
+	PrepareTenantNetwork(tenantID string, req types.TenantNetworkPrepareRequest) (types.Operation, error)
+	ShowTenantNetwork(tenantID string) (types.TenantNetwork, error)
+	RetryTenantNetwork(ctx context.Context, tenantID string) error
+	CreateSignedURL(tenantID string, req types.SignedURLRequest) (types.SignedURL, error)
+	ListUsage(filter types.UsageFilter) ([]types.UsageRecord, error)
+	Capabilities() types.Capabilities
+	ShowTenantCapacity(tenantID string) (types.TenantCapacity, error)
+	ShowWorkloadCapacity(workloadID string) (types.WorkloadNodeCapacity, error)
+}
+
+// Context is used to provide the services, logger and current URL to the
+// handlers.
+type Context struct {
+	URL string
+	Service
+	Log clogger.CiaoLog
+}
+
+// Config is used to setup the Context for the ciao API.  If Log is nil
+// messages are written to glog.
+type Config struct {
+	URL         string
+	CiaoService Service
+	Log         clogger.CiaoLog
+}
+
+// Routes returns the supported ciao API endpoints.
+// A plain application/json request will return v1 of the resource
+// since we only have one version of this api so far, that means
+// most routes will match both json as well as our custom
+// content type.
+func Routes(config Config, r *mux.Router) *mux.Router {
+	// make new Context
+	log := config.Log
+	if log == nil {
+		log = gloginterface.CiaoGlogLogger{}
+	}
+	context := &Context{config.URL, config.CiaoService, log}
+
+	if r == nil {
+		r = mux.NewRouter()
+	}
+
+	// external IP pools
+	route := r.Handle("/", Handler{context, listResources, true})
+	route.Methods("GET")
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}", Handler{context, listResources, false})
+	route.Methods("GET")
+
+	matchContent := fmt.Sprintf("application/(%s|json)", PoolsV1)
+
+	route = r.Handle("/pools", Handler{context, listPools, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/pools", Handler{context, listPools, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools", Handler{context, addPool, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, showPool, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, deletePool, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, addToPool, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/tenants", Handler{context, setPoolAccess, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/subnets/{subnet:"+uuid.UUIDRegex+"}", Handler{context, deleteSubnet, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/external-ips/{ip_id:"+uuid.UUIDRegex+"}", Handler{context, deleteExternalIP, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// mapped external IPs
+	matchContent = fmt.Sprintf("application/(%s|json)", ExternalIPsV1)
+
+	route = r.Handle("/external-ips", Handler{context, listMappedIPs, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, listMappedIPs, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/external-ips", Handler{context, mapExternalIP, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, mapExternalIP, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// workloads
+	matchContent = fmt.Sprintf("application/(%s|json)", WorkloadsV1)
+
+	route = r.Handle("/workloads", Handler{context, addWorkload, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/workloads", Handler{context, listWorkloads, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, updateWorkload, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}/preview", Handler{context, previewWorkloadConfig, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, addWorkload, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, listWorkloads, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, updateWorkload, false})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}/preview", Handler{context, previewWorkloadConfig, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenants
+	matchContent = fmt.Sprintf("application/(%s|json)", TenantsV1)
+
+	route = r.Handle("/tenants", Handler{context, listTenants, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants", Handler{context, createTenant, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, showTenant, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, deleteTenant, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants", Handler{context, showTenant, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, updateTenant, true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
+
+	// tenant quotas
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/quotas", Handler{context, listQuotas, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, listQuotas, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, updateQuotas, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/quotas/denials", Handler{context, listQuotaDenials, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas/history", Handler{context, listQuotaHistory, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenant client CAs
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/ca", Handler{context, showTenantCA, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/ca", Handler{context, updateTenantCA, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/ca", Handler{context, deleteTenantCA, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenant maintenance freeze
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/freeze", Handler{context, freezeTenant, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenant export and import
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/export", Handler{context, exportTenant, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/import", Handler{context, importTenant, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenant network preparation
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/network/prepare", Handler{context, prepareTenantNetwork, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/network/prepare", Handler{context, prepareTenantNetwork, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/network/retry", Handler{context, retryTenantNetwork, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenant network utilization
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/network", Handler{context, showTenantNetwork, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/network", Handler{context, showTenantNetwork, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/subnets", Handler{context, listTenantSubnets, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/subnets", Handler{context, listTenantSubnets, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func instanceAction(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenant := vars["tenant"]
-	server := vars["instance_id"]
+	// webhooks
+	matchContent = fmt.Sprintf("application/(%s|json)", WebhooksV1)
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return Response{http.StatusBadRequest, nil}, err
-	}
+	route = r.Handle("/webhooks", Handler{context, listWebhooks, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	bodyString := string(body)
+	route = r.Handle("/webhooks", Handler{context, addWebhook, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	if strings.Contains(bodyString, "os-start") {
-		err = c.StartServer(tenant, server)
-	} else if strings.Contains(bodyString, "os-stop") {
-		err = c.StopServer(tenant, server)
-	} else {
-		return Response{http.StatusServiceUnavailable, nil},
-			errors.New("Unsupported Action")
-	}
+	route = r.Handle("/webhooks/{webhook:"+uuid.UUIDRegex+"}", Handler{context, showWebhook, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = r.Handle("/webhooks/{webhook:"+uuid.UUIDRegex+"}", Handler{context, deleteWebhook, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusAccepted, nil}, nil
-}
+	// workload policy
+	matchContent = fmt.Sprintf("application/(%s|json)", PolicyV1)
 
-// Service is an interface which must be implemented by the ciao API context.
-type Service interface {
-	AddPool(name string, subnet *string, ips []string) (types.Pool, error)
-	ListPools() ([]types.Pool, error)
-	ShowPool(id string) (types.Pool, error)
-	DeletePool(id string) error
-	AddAddress(poolID string, subnet *string, IPs []string) error
-	RemoveAddress(poolID string, subnetID *string, IPID *string) error
-	ListMappedAddresses(tenantID *string) []types.MappedIP
-	MapAddress(tenantID string, poolName *string, instanceID string) error
-	UnMapAddress(ID string) error
-	CreateWorkload(req types.Workload) (types.Workload, error)
-	DeleteWorkload(tenantID string, workloadID string) error
-	ShowWorkload(tenantID string, workloadID string) (types.Workload, error)
-	ListWorkloads(tenantID string) ([]types.Workload, error)
-	ListQuotas(tenantID string) []types.QuotaDetails
-	UpdateQuotas(tenantID string, qds []types.QuotaDetails) error
-	EvacuateNode(nodeID string) error
-	RestoreNode(nodeID string) error
-	ListTenants() ([]types.TenantSummary, error)
-	ShowTenant(ID string) (types.TenantConfig, error)
-	PatchTenant(ID string, patch []byte) error
-	CreateTenant(ID string, config types.TenantConfig) (types.TenantSummary, error)
-	DeleteTenant(ID string) error
-	CreateImage(string, CreateImageRequest) (types.Image, error)
-	UploadImage(string, string, io.Reader) error
-	ListImages(string) ([]types.Image, error)
-	GetImage(string, string) (types.Image, error)
-	DeleteImage(string, string) error
-	CreateVolume(tenant string, req RequestedVolume) (types.Volume, error)
-	DeleteVolume(tenant string, volume string) error
-	AttachVolume(tenant string, volume string, instance string, mountpoint string) error
-	DetachVolume(tenant string, volume string, attachment string) error
-	ListVolumesDetail(tenant string) ([]types.Volume, error)
-	ShowVolumeDetails(tenant string, volume string) (types.Volume, error)
-	CreateServer(string, CreateServerRequest) (interface{}, error)
-	ListServersDetail(tenant string) ([]ServerDetails, error)
-	ShowServerDetails(tenant string, server string) (Server, error)
-	DeleteServer(tenant string, server string) error
-	StartServer(tenant string, server string) error
-	StopServer(tenant string, server string) error
-}
+	route = r.Handle("/policy/rules", Handler{context, listPolicyRules, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Context is used to provide the services and current URL to the handlers.
-type Context struct {
-	URL string
-	Service
-}
+	route = r.Handle("/policy/rules", Handler{context, createPolicyRule, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Config is used to setup the Context for the ciao API.
-type Config struct {
-	URL         string
-	CiaoService Service
-}
+	route = r.Handle("/policy/rules/{rule:"+uuid.UUIDRegex+"}", Handler{context, showPolicyRule, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Routes returns the supported ciao API endpoints.
-// A plain application/json request will return v1 of the resource
-// since we only have one version of this api so far, that means
-// most routes will match both json as well as our custom
-// content type.
-func Routes(config Config, r *mux.Router) *mux.Router {
-	// make new Context
-	context := &Context{config.URL, config.CiaoService}
+	route = r.Handle("/policy/rules/{rule:"+uuid.UUIDRegex+"}", Handler{context, updatePolicyRule, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	if r == nil {
-		r = mux.NewRouter()
-	}
+	route = r.Handle("/policy/rules/{rule:"+uuid.UUIDRegex+"}", Handler{context, deletePolicyRule, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	// external IP pools
-	route := r.Handle("/", Handler{context, listResources, true})
+	// cluster settings
+	matchContent = fmt.Sprintf("application/(%s|json)", SettingsV1)
+
+	route = r.Handle("/settings", Handler{context, listSettings, true})
 	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}", Handler{context, listResources, false})
+	route = r.Handle("/settings/{setting}", Handler{context, showSetting, true})
 	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	matchContent := fmt.Sprintf("application/(%s|json)", PoolsV1)
+	route = r.Handle("/settings/{setting}", Handler{context, updateSetting, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools", Handler{context, listPools, true})
+	route = r.Handle("/settings/{setting}", Handler{context, resetSetting, true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// events
+	matchContent = fmt.Sprintf("application/(%s|json)", EventsV1)
+
+	route = r.Handle("/events", Handler{context, listEvents, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/pools", Handler{context, listPools, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/events", Handler{context, listEvents, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools", Handler{context, addPool, true})
-	route.Methods("POST")
+	route = r.Handle("/events/stream", Handler{context, streamEvents, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, showPool, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/events/stream", Handler{context, streamEvents, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, deletePool, true})
-	route.Methods("DELETE")
+	// audit log
+	matchContent = fmt.Sprintf("application/(%s|json)", AuditV1)
+
+	route = r.Handle("/audit", Handler{context, listAudit, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, addToPool, true})
-	route.Methods("POST")
+	// operations
+	matchContent = fmt.Sprintf("application/(%s|json)", OperationsV1)
+
+	route = r.Handle("/operations", Handler{context, listOperations, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/subnets/{subnet:"+uuid.UUIDRegex+"}", Handler{context, deleteSubnet, true})
-	route.Methods("DELETE")
+	route = r.Handle("/operations/{operation_id:"+uuid.UUIDRegex+"}", Handler{context, showOperation, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/external-ips/{ip_id:"+uuid.UUIDRegex+"}", Handler{context, deleteExternalIP, true})
-	route.Methods("DELETE")
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/operations", Handler{context, listOperations, false})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// mapped external IPs
-	matchContent = fmt.Sprintf("application/(%s|json)", ExternalIPsV1)
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/operations/{operation_id:"+uuid.UUIDRegex+"}", Handler{context, showOperation, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips", Handler{context, listMappedIPs, true})
+	// trash
+	matchContent = fmt.Sprintf("application/(%s|json)", TrashV1)
+
+	route = r.Handle("/trash", Handler{context, listTrash, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, listMappedIPs, false})
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/trash/{item_id:"+uuid.UUIDRegex+"}/restore", Handler{context, restoreTrashItem, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/trash", Handler{context, listTrash, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips", Handler{context, mapExternalIP, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/trash/{item_id:"+uuid.UUIDRegex+"}/restore", Handler{context, restoreTrashItem, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, mapExternalIP, false})
+	// launch templates
+	matchContent = fmt.Sprintf("application/(%s|json)", LaunchTemplatesV1)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/launch-templates", Handler{context, listLaunchTemplates, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/launch-templates", Handler{context, createLaunchTemplate, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, true})
-	route.Methods("DELETE")
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/launch-templates/{template}", Handler{context, showLaunchTemplate, false})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/launch-templates/{template}", Handler{context, updateLaunchTemplate, false})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/launch-templates/{template}", Handler{context, deleteLaunchTemplate, false})
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// workloads
-	matchContent = fmt.Sprintf("application/(%s|json)", WorkloadsV1)
+	// server groups
+	matchContent = fmt.Sprintf("application/(%s|json)", ServerGroupsV1)
 
-	route = r.Handle("/workloads", Handler{context, addWorkload, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/server-groups", Handler{context, listServerGroups, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/server-groups", Handler{context, createServerGroup, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads", Handler{context, listWorkloads, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/server-groups/{group_id}", Handler{context, showServerGroup, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/server-groups/{group_id}", Handler{context, deleteServerGroup, false})
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, true})
+	// snapshot schedules
+	matchContent = fmt.Sprintf("application/(%s|json)", SnapshotSchedulesV1)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/snapshot-schedules", Handler{context, listSnapshotSchedules, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, addWorkload, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/snapshot-schedules", Handler{context, createSnapshotSchedule, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, listWorkloads, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/snapshot-schedules/{schedule_id}", Handler{context, showSnapshotSchedule, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/snapshot-schedules/{schedule_id}", Handler{context, deleteSnapshotSchedule, false})
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, false})
+	// API keys
+	matchContent = fmt.Sprintf("application/(%s|json)", APIKeysV1)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/api-keys", Handler{context, listAPIKeys, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// tenants
-	matchContent = fmt.Sprintf("application/(%s|json)", TenantsV1)
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/api-keys", Handler{context, createAPIKey, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants", Handler{context, listTenants, true})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/api-keys/{key_id:"+uuid.UUIDRegex+"}", Handler{context, deleteAPIKey, false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// CNCI images
+	matchContent = fmt.Sprintf("application/(%s|json)", CNCIsV1)
+
+	route = r.Handle("/cncis/image", Handler{context, showCNCIImage, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants", Handler{context, createTenant, true})
+	route = r.Handle("/cncis/upgrade", Handler{context, rolloutCNCIs, true})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, showTenant, true})
-	route.Methods("GET")
+	route = r.Handle("/cncis/rollback", Handler{context, rolloutCNCIs, true})
+	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, deleteTenant, true})
-	route.Methods("DELETE")
+	// capabilities
+	matchContent = fmt.Sprintf("application/(%s|json)", CapabilitiesV1)
+
+	route = r.Handle("/capabilities", Handler{context, showCapabilities, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants", Handler{context, showTenant, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/capabilities", Handler{context, showCapabilities, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, updateTenant, true})
-	route.Methods("PATCH")
-	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
+	// signed URLs
+	matchContent = fmt.Sprintf("application/(%s|json)", SignedURLsV1)
 
-	// tenant quotas
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/quotas", Handler{context, listQuotas, false})
+	route = r.Handle("/signed-urls", Handler{context, createSignedURL, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/signed-urls", Handler{context, createSignedURL, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// usage
+	matchContent = fmt.Sprintf("application/(%s|json)", UsageV1)
+
+	route = r.Handle("/usage", Handler{context, listUsage, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, listQuotas, true})
+	// capacity
+	matchContent = fmt.Sprintf("application/(%s|json)", CapacityV1)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/capacity", Handler{context, showTenantCapacity, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, updateQuotas, true})
-	route.Methods("PUT")
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}/capacity", Handler{context, showWorkloadCapacity, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
 	// evacuation and restore
@@ -1456,6 +4666,11 @@ func Routes(config Config, r *mux.Router) *mux.Router {
 	route.Methods("PUT")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	// node maintenance
+	route = r.Handle("/nodes/{node_id:"+uuid.UUIDRegex+"}/status", Handler{context, setNodeStatus, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	// images
 	matchContent = fmt.Sprintf("application/(%s|json)", ImagesV1)
 
@@ -1499,6 +4714,14 @@ func Routes(config Config, r *mux.Router) *mux.Router {
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/visibility", Handler{context, setImageVisibility, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/preseed", Handler{context, preseedImage, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	// Volumes
 	matchContent = fmt.Sprintf("application/(%s|json)", VolumesV1)
 	route = r.Handle("/{tenant}/volumes", Handler{context, createVolume, false})
@@ -1517,18 +4740,67 @@ func Routes(config Config, r *mux.Router) *mux.Router {
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/{tenant}/volumes/{volume_id}", Handler{context, updateVolume, false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
+
+	route = r.Handle("/{tenant}/volumes/{volume_id}/snapshots", Handler{context, listVolumeSnapshots, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/volumes/{volume_id}/snapshots", Handler{context, createVolumeSnapshot, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/volumes/{volume_id}/snapshots/{snapshot_id}", Handler{context, deleteVolumeSnapshot, false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	// Volume actions
 	route = r.Handle("/{tenant}/volumes/{volume_id}/action", Handler{context, volumeAction, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/{tenant}/volumes/{volume_id}/attach", Handler{context, attachVolume, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/volumes/{volume_id}/detach", Handler{context, detachVolume, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// Volume repair
+	route = r.Handle("/volumes/{volume_id}/force-detach", Handler{context, forceDetachVolume, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/volumes/{volume_id}/state", Handler{context, setVolumeState, true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/volumes/attachments", Handler{context, listAttachments, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	// Instances
 	matchContent = fmt.Sprintf("application/(%s|json)", InstancesV1)
 
+	route = r.Handle("/instances/{instance_id:"+uuid.UUIDRegex+"}/placements", Handler{context, showInstancePlacements, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/instances/{instance_id:"+uuid.UUIDRegex+"}/history", Handler{context, showInstanceHistory, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	route = r.Handle("/{tenant}/instances", Handler{context, createInstance, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/instances/detail", Handler{context, listInstanceDetails, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	route = r.Handle("/{tenant}/instances/detail", Handler{context, listInstanceDetails, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
@@ -1541,9 +4813,29 @@ func Routes(config Config, r *mux.Router) *mux.Router {
 	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/{tenant}/instances/{instance_id}", Handler{context, updateInstance, false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
+
 	route = r.Handle("/{tenant}/instances/{instance_id}/action", Handler{context, instanceAction, false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	route = r.Handle("/{tenant}/instances/{instance_id}/history", Handler{context, showInstanceHistory, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/instances/{instance_id}/consolelog", Handler{context, showConsoleLog, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/instances/{instance_id}/tags/{key}", Handler{context, setInstanceTag, false})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = r.Handle("/{tenant}/instances/{instance_id}/tags/{key}", Handler{context, deleteInstanceTag, false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
 	return r
 }
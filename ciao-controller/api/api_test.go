@@ -16,17 +16,24 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/service"
+	"github.com/pkg/errors"
 )
 
 type test struct {
@@ -45,7 +52,15 @@ var tests = []test{
 		"",
 		"application/text",
 		http.StatusOK,
-		`[{"rel":"pools","href":"/pools","version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"},{"rel":"external-ips","href":"/external-ips","version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"rel":"workloads","href":"/workloads","version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"},{"rel":"tenants","href":"/tenants","version":"x.ciao.tenants.v1","minimum_version":"x.ciao.tenants.v1"},{"rel":"node","href":"/node","version":"x.ciao.node.v1","minimum_version":"x.ciao.node.v1"},{"rel":"images","href":"/images","version":"x.ciao.images.v1","minimum_version":"x.ciao.images.v1"}]`,
+		`[{"rel":"pools","href":"/pools","version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"},{"rel":"external-ips","href":"/external-ips","version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"rel":"workloads","href":"/workloads","version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"},{"rel":"tenants","href":"/tenants","version":"x.ciao.tenants.v1","minimum_version":"x.ciao.tenants.v1"},{"rel":"node","href":"/node","version":"x.ciao.node.v1","minimum_version":"x.ciao.node.v1"},{"rel":"webhooks","href":"/webhooks","version":"x.ciao.webhooks.v1","minimum_version":"x.ciao.webhooks.v1"},{"rel":"policy","href":"/policy/rules","version":"x.ciao.policy.v1","minimum_version":"x.ciao.policy.v1"},{"rel":"settings","href":"/settings","version":"x.ciao.settings.v1","minimum_version":"x.ciao.settings.v1"},{"rel":"audit","href":"/audit","version":"x.ciao.audit.v1","minimum_version":"x.ciao.audit.v1"},{"rel":"events","href":"/events","version":"x.ciao.events.v1","minimum_version":"x.ciao.events.v1"},{"rel":"operations","href":"/operations","version":"x.ciao.operations.v1","minimum_version":"x.ciao.operations.v1"},{"rel":"trash","href":"/trash","version":"x.ciao.trash.v1","minimum_version":"x.ciao.trash.v1"},{"rel":"images","href":"/images","version":"x.ciao.images.v1","minimum_version":"x.ciao.images.v1"},{"rel":"cncis","href":"/cncis","version":"x.ciao.cncis.v1","minimum_version":"x.ciao.cncis.v1"},{"rel":"capabilities","href":"/capabilities","version":"x.ciao.capabilities.v1","minimum_version":"x.ciao.capabilities.v1"}]`,
+	},
+	{
+		"GET",
+		"/capabilities",
+		"",
+		fmt.Sprintf("application/%s", CapabilitiesV1),
+		http.StatusOK,
+		`{"version":"1.0","git_commit":"abcdef","api_versions":{"api-keys":"x.ciao.api-keys.v1","audit":"x.ciao.audit.v1","capabilities":"x.ciao.capabilities.v1","capacity":"x.ciao.capacity.v1","cncis":"x.ciao.cncis.v1","events":"x.ciao.events.v1","external-ips":"x.ciao.external-ips.v1","images":"x.ciao.images.v1","instances":"x.ciao.instances.v1","launch-templates":"x.ciao.launch-templates.v1","node":"x.ciao.node.v1","operations":"x.ciao.operations.v1","policy":"x.ciao.policy.v1","pools":"x.ciao.pools.v1","server-groups":"x.ciao.server-groups.v1","settings":"x.ciao.settings.v1","signed-urls":"x.ciao.signed-urls.v1","snapshot-schedules":"x.ciao.snapshot-schedules.v1","tenants":"x.ciao.tenants.v1","trash":"x.ciao.trash.v1","usage":"x.ciao.usage.v1","volumes":"x.ciao.volumes.v1","webhooks":"x.ciao.webhooks.v1","workloads":"x.ciao.workloads.v1"},"features":{"webhooks":true}}`,
 	},
 	{
 		"GET",
@@ -63,6 +78,30 @@ var tests = []test{
 		http.StatusOK,
 		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
 	},
+	{
+		"GET",
+		"/pools?marker=MDAwMS0wMS0wMVQwMDowMDowMFogYmE1OGY0NzEtMDczNS00NzczLTk1NTAtMTg4ZTJkMDEyOTQx",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":null}`,
+	},
+	{
+		"GET",
+		"/pools?marker=notamarker",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid marker: notamarker"}}` + "\n",
+	},
+	{
+		"GET",
+		"/pools?limit=0",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid limit: 0"}}` + "\n",
+	},
 	{
 		"POST",
 		"/pools",
@@ -77,7 +116,7 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[]}`,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"create_time":"0001-01-01T00:00:00Z"}`,
 	},
 	{
 		"DELETE",
@@ -95,6 +134,14 @@ var tests = []test{
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"PUT",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/tenants",
+		`{"tenants":["8a497c68-a88a-4c1c-be56-12a4883208d3"]}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
 	{
 		"DELETE",
 		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
@@ -117,7 +164,7 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", ExternalIPsV1),
 		http.StatusOK,
-		`[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}]`,
+		`[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}],"create_time":"0001-01-01T00:00:00Z"}]`,
 	},
 	{
 		"POST",
@@ -127,6 +174,14 @@ var tests = []test{
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"POST",
+		"/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","address":"192.168.0.2"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Address 192.168.0.2 is already mapped","instance_id":"otherinstanceID"}}` + "\n",
+	},
 	{
 		"POST",
 		"/workloads",
@@ -143,13 +198,37 @@ var tests = []test{
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"PUT",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		`{"description":"updated","fw_type":"legacy","vm_type":"qemu","config":"this will totally work!"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"updated","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"public","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}}`,
+	},
 	{
 		"GET",
 		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
 		"",
 		fmt.Sprintf("application/%s", WorkloadsV1),
 		http.StatusOK,
-		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"private","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}}`,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"admin","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"private","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}}`,
+	},
+	{
+		"POST",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/preview",
+		`{"name":"web"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workload_id":"ba58f471-0735-4773-9550-188e2d012941","meta_data":"{\n\t\"uuid\": \"\",\n\t\"hostname\": \"web\"\n}","cloud_init":"this will totally work!","start":"start: {}\n"}`,
+	},
+	{
+		"POST",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/preview",
+		`{"instance_id":"3390740c-dce9-48d6-b83a-a717417072ce"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Launch configuration not found"}}` + "\n",
 	},
 	{
 		"GET",
@@ -167,6 +246,118 @@ var tests = []test{
 		http.StatusOK,
 		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3"},{"name":"test-quota-2","value":"unlimited","usage":"10"},{"name":"test-limit","value":"123"}]}`,
 	},
+	{
+		"GET",
+		"/tenants/quotas/denials?limit=1",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"window":"1h0m0s","tenants":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","denials":5}]}`,
+	},
+	{
+		"GET",
+		"/tenants/quotas/denials?limit=0",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid limit: 0"}}` + "\n",
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/history?resource=instances&since=2017-06-01T00:00:00Z",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"history":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","resource":"instance","delta":1,"usage":10,"allowed":false,"timestamp":"2017-06-01T10:00:00Z"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/history?since=yesterday",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid since: yesterday"}}` + "\n",
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/history?resource=routers",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Resource not subject to a quota"}}` + "\n",
+	},
+	{
+		"GET",
+		"/audit?tenant_id=bc70dcd6-7298-4933-98a9-cded2d232d02&start=2017-01-01T00:00:00Z&limit=1",
+		"",
+		fmt.Sprintf("application/%s", AuditV1),
+		http.StatusOK,
+		`{"records":[{"id":7,"timestamp":"2017-01-01T00:00:00Z","request_id":"d8aa2ebc-9ed4-4ba5-9c15-2f18e6c7f1e3","tenant_id":"bc70dcd6-7298-4933-98a9-cded2d232d02","actor":"user","method":"DELETE","resource":"/bc70dcd6-7298-4933-98a9-cded2d232d02/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","status":202,"body_size":0}],"next_marker":"7"}`,
+	},
+	{
+		"GET",
+		"/audit?end=tomorrow",
+		"",
+		fmt.Sprintf("application/%s", AuditV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid end: tomorrow"}}` + "\n",
+	},
+	{
+		"GET",
+		"/events?tenant_id=bc70dcd6-7298-4933-98a9-cded2d232d02",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusOK,
+		`{"events":[{"id":2,"time_stamp":"2017-01-01T00:00:00Z","tenant_id":"bc70dcd6-7298-4933-98a9-cded2d232d02","type":"action","message":"DELETE /bc70dcd6-7298-4933-98a9-cded2d232d02/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","object_id":"c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","actor":"admin"}]}`,
+	},
+	{
+		"GET",
+		"/events?limit=1",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusOK,
+		`{"events":[{"id":1,"time_stamp":"2017-01-01T00:00:00Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","type":"info","message":"Deleted Instance 5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35","object_id":"5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35"}],"next_marker":"1"}`,
+	},
+	{
+		"GET",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/events?tenant_id=bc70dcd6-7298-4933-98a9-cded2d232d02",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusOK,
+		`{"events":[{"id":1,"time_stamp":"2017-01-01T00:00:00Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","type":"info","message":"Deleted Instance 5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35","object_id":"5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35"}]}`,
+	},
+	{
+		"GET",
+		"/events/stream?last_event_id=1",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusOK,
+		"id: 2\nevent: action\ndata: " + `{"id":2,"time_stamp":"2017-01-01T00:00:00Z","tenant_id":"bc70dcd6-7298-4933-98a9-cded2d232d02","type":"action","message":"DELETE /bc70dcd6-7298-4933-98a9-cded2d232d02/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","object_id":"c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","actor":"admin"}` + "\n\n",
+	},
+	{
+		"GET",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/events/stream",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusOK,
+		"id: 1\nevent: info\ndata: " + `{"id":1,"time_stamp":"2017-01-01T00:00:00Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","type":"info","message":"Deleted Instance 5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35","object_id":"5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35"}` + "\n\n",
+	},
+	{
+		"GET",
+		"/events/stream?last_event_id=latest",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid last event ID: latest"}}` + "\n",
+	},
+	{
+		"GET",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/events?start=yesterday",
+		"",
+		fmt.Sprintf("application/%s", EventsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid start: yesterday"}}` + "\n",
+	},
 	{
 		"GET",
 		"/tenants",
@@ -181,7 +372,7 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", TenantsV1),
 		http.StatusOK,
-		`{"name":"Test Tenant","subnet_bits":24,"permissions":{"privileged_containers":false}}`,
+		`{"name":"Test Tenant","subnet_bits":24,"permissions":{"privileged_containers":false},"cnci_size":{"vcpus":8},"effective_cnci_size":{"vcpus":8,"mem_mb":2048,"disk_mb":2048}}`,
 	},
 	{
 		"PATCH",
@@ -197,445 +388,2342 @@ var tests = []test{
 		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":4}}`,
 		fmt.Sprintf("application/%s", TenantsV1),
 		http.StatusCreated,
-		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","config":{"name":"New Tenant","subnet_bits":4,"permissions":{"privileged_containers":false}},"quotas":null,"links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5","config":{"name":"Old Tenant"},"quotas":[{"name":"tenant-instances-quota","value":"10"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"id":"5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5","name":"Old Tenant","config":{"name":"Old Tenant","subnet_bits":0,"permissions":{"privileged_containers":false}},"quotas":[{"name":"tenant-instances-quota","value":"10","usage":"0"}],"links":[{"rel":"self","href":"/tenants/5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5"}]}`,
 	},
 	{
 		"DELETE",
 		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
 		"",
 		fmt.Sprintf("application/%s", TenantsV1),
-		http.StatusNoContent,
-		"null",
-	}, {
-		"POST",
-		"/images",
-		`{"container_format":"bare","disk_format":"raw","name":"Ubuntu","id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","visibility":"private"}`,
-		fmt.Sprintf("application/%s", ImagesV1),
-		http.StatusCreated,
-		`{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"private"}`,
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","type":"delete_tenant","target":"093ae09b-f653-464e-9ae6-5ae28bd03a22","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"DELETE",
+		"/tenants/5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Tenant has instances"}}` + "\n",
 	},
 	{
 		"GET",
-		"/images",
+		"/webhooks",
 		"",
-		fmt.Sprintf("application/%s", ImagesV1),
+		fmt.Sprintf("application/%s", WebhooksV1),
 		http.StatusOK,
-		`[{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"public"}]`,
+		`{"webhooks":[{"id":"8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e","url":"https://example.com/hook","event_types":["instance_failed"],"state":"active","create_time":"2015-11-29T22:21:42Z","stats":{"delivered":0,"failed_attempts":0,"failed":0,"dropped":0,"last_delivery":"0001-01-01T00:00:00Z"},"links":[{"rel":"self","href":"/webhooks/8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e"}]}]}`,
+	},
+	{
+		"POST",
+		"/webhooks",
+		`{"url":"https://example.com/hook","secret":"s3cr3t","event_types":["instance_failed"]}`,
+		fmt.Sprintf("application/%s", WebhooksV1),
+		http.StatusCreated,
+		`{"id":"8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e","url":"https://example.com/hook","event_types":["instance_failed"],"state":"active","create_time":"2015-11-29T22:21:42Z","stats":{"delivered":0,"failed_attempts":0,"failed":0,"dropped":0,"last_delivery":"0001-01-01T00:00:00Z"},"links":[{"rel":"self","href":"/webhooks/8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e"}]}`,
 	},
 	{
 		"GET",
-		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		"/webhooks/8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e",
 		"",
-		fmt.Sprintf("application/%s", ImagesV1),
+		fmt.Sprintf("application/%s", WebhooksV1),
 		http.StatusOK,
-		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27","state":"active","tenant_id":"","name":"cirros-0.3.2-x86_64-disk","create_time":"2014-05-05T17:15:10Z","size":13167616,"visibility":"public"}`,
+		`{"id":"8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e","url":"https://example.com/hook","event_types":["instance_failed"],"state":"active","create_time":"2015-11-29T22:21:42Z","stats":{"delivered":0,"failed_attempts":0,"failed":0,"dropped":0,"last_delivery":"0001-01-01T00:00:00Z"},"links":[{"rel":"self","href":"/webhooks/8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e"}]}`,
 	},
 	{
 		"DELETE",
-		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		"/webhooks/8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e",
 		"",
-		fmt.Sprintf("application/%s", ImagesV1),
+		fmt.Sprintf("application/%s", WebhooksV1),
 		http.StatusNoContent,
-		`null`,
+		"null",
+	},
+	{
+		"GET",
+		"/policy/rules",
+		"",
+		fmt.Sprintf("application/%s", PolicyV1),
+		http.StatusOK,
+		`{"rules":[{"id":"5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71","description":"No unpatched images","severity":"deny","image_pattern":"ubuntu-14.*","create_time":"2015-11-29T22:21:42Z"}]}`,
 	},
 	{
 		"POST",
-		"/validtenantid/volumes",
-		`{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":null}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"new volume","description":"newly created volume","internal":false}`,
+		"/policy/rules",
+		`{"description":"No unpatched images","severity":"deny","image_pattern":"ubuntu-14.*"}`,
+		fmt.Sprintf("application/%s", PolicyV1),
+		http.StatusCreated,
+		`{"id":"5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71","description":"No unpatched images","severity":"deny","image_pattern":"ubuntu-14.*","create_time":"2015-11-29T22:21:42Z"}`,
+	},
+	{
+		"POST",
+		"/policy/rules",
+		`{"severity":"deny"}`,
+		fmt.Sprintf("application/%s", PolicyV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid policy rule"}}` + "\n",
 	},
 	{
 		"GET",
-		"/validtenantid/volumes",
+		"/policy/rules/5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
+		fmt.Sprintf("application/%s", PolicyV1),
 		http.StatusOK,
-		`[{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false},{"id":"new-test-id2","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"volume 2","description":"my other volume","internal":false}]`,
+		`{"id":"5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71","description":"No unpatched images","severity":"deny","image_pattern":"ubuntu-14.*","create_time":"2015-11-29T22:21:42Z"}`,
 	},
 	{
 		"GET",
-		"/validtenantid/volumes/validvolumeid",
+		"/policy/rules/0fd1bd8f-6a1c-4c3b-8c66-8e1b3c2f4a10",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
+		fmt.Sprintf("application/%s", PolicyV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Policy rule not found"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/policy/rules/5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71",
+		`{"severity":"warn","image_pattern":"ubuntu-14.*"}`,
+		fmt.Sprintf("application/%s", PolicyV1),
 		http.StatusOK,
-		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false}`,
+		`{"id":"5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71","severity":"warn","image_pattern":"ubuntu-14.*","create_time":"2015-11-29T22:21:42Z"}`,
 	},
 	{
 		"DELETE",
-		"/validtenantid/volumes/validvolumeid",
+		"/policy/rules/5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
+		fmt.Sprintf("application/%s", PolicyV1),
+		http.StatusNoContent,
 		"null",
 	},
 	{
-		"POST",
-		"/validtenantid/volumes/validvolumeid/action",
-		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc"}}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		"null",
+		"GET",
+		"/settings",
+		"",
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusOK,
+		`{"settings":[{"key":"pending_instance_timeout","type":"duration","description":"Time after which pending instances are reported, 0 to disable","value":"10m0s","default":"10m0s","min":"0s","max":"24h0m0s","modified":false,"update_time":"0001-01-01T00:00:00Z"}]}`,
 	},
 	{
-		"POST",
-		"/validtenantid/volumes/validvolumeid/action",
-		`{"detach":{}}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		"null",
+		"GET",
+		"/settings/pending_instance_timeout",
+		"",
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusOK,
+		`{"key":"pending_instance_timeout","type":"duration","description":"Time after which pending instances are reported, 0 to disable","value":"10m0s","default":"10m0s","min":"0s","max":"24h0m0s","modified":false,"update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"GET",
+		"/settings/no_such_setting",
+		"",
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Unknown setting"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/settings/pending_instance_timeout",
+		`{"value":"5m"}`,
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusOK,
+		`{"key":"pending_instance_timeout","type":"duration","description":"Time after which pending instances are reported, 0 to disable","value":"5m","default":"10m0s","min":"0s","max":"24h0m0s","modified":true,"update_time":"2015-11-29T22:21:42Z"}`,
+	},
+	{
+		"PUT",
+		"/settings/pending_instance_timeout",
+		`{"value":"soon"}`,
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid value for setting pending_instance_timeout: not a valid duration: soon"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/settings/no_such_setting",
+		`{"value":"5m"}`,
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Unknown setting"}}` + "\n",
 	},
 	{
+		"DELETE",
+		"/settings/pending_instance_timeout",
+		"",
+		fmt.Sprintf("application/%s", SettingsV1),
+		http.StatusOK,
+		`{"key":"pending_instance_timeout","type":"duration","description":"Time after which pending instances are reported, 0 to disable","value":"10m0s","default":"10m0s","min":"0s","max":"24h0m0s","modified":false,"update_time":"0001-01-01T00:00:00Z"}`,
+	}, {
 		"POST",
-		"/validtenantid/instances",
-		`{"server":{"name":"new-server-test","imageRef": "http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","metadata":{"My Server Name":"Apache1"}}}`,
-		fmt.Sprintf("application/%s", InstancesV1),
-		http.StatusAccepted,
-		`{"server":{"id":"validServerID","name":"new-server-test","imageRef":"http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","max_count":0,"min_count":0,"metadata":{"My Server Name":"Apache1"}}}`,
+		"/images",
+		`{"container_format":"bare","disk_format":"raw","name":"Ubuntu","id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","visibility":"private"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusCreated,
+		`{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"private"}`,
 	},
 	{
 		"GET",
-		"/validtenantid/instances/detail",
+		"/images",
 		"",
-		fmt.Sprintf("application/%s", InstancesV1),
+		fmt.Sprintf("application/%s", ImagesV1),
 		http.StatusOK,
-		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}]}`},
+		`[{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"public"}]`,
+	},
 	{
 		"GET",
-		"/validtenantid/instances/instanceid",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
 		"",
-		fmt.Sprintf("application/%s", InstancesV1),
+		fmt.Sprintf("application/%s", ImagesV1),
 		http.StatusOK,
-		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}}`,
+		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27","state":"active","tenant_id":"","name":"cirros-0.3.2-x86_64-disk","create_time":"2014-05-05T17:15:10Z","size":13167616,"visibility":"public"}`,
 	},
 	{
 		"DELETE",
-		"/validtenantid/instances/instanceid",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
 		"",
-		fmt.Sprintf("application/%s", InstancesV1),
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusNoContent,
+		`null`,
+	},
+	{
+		"DELETE",
+		"/images/4e16e743-265a-4bf2-9fd1-57ada0b28904",
+		"",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Image 4e16e743-265a-4bf2-9fd1-57ada0b28904 is used by workloads: 69e84267-ed01-4738-b15f-b47de06b62e7"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/visibility",
+		`{"visibility":"internal"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"PUT",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/visibility",
+		`{"visibility":"everyone"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}` + "\n",
+	},
 	{
 		"POST",
-		"/validtenantid/instances/instanceid/action",
-		`{"os-start":null}`,
-		fmt.Sprintf("application/%s", InstancesV1),
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/preseed",
+		`{"label":"ssd"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
 		http.StatusAccepted,
-		"null",
+		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27","state":"active","tenant_id":"","name":"cirros-0.3.2-x86_64-disk","create_time":"2014-05-05T17:15:10Z","size":13167616,"visibility":"public","seeds":[{"node_id":"6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b","state":"seeding","update_time":"2014-05-05T17:15:10Z"}]}`,
 	},
 	{
 		"POST",
-		"/validtenantid/instances/instanceid/action",
-		`{"os-stop":null}`,
-		fmt.Sprintf("application/%s", InstancesV1),
-		http.StatusAccepted,
-		"null",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/preseed",
+		`{"all":true,"label":"ssd"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid image preseed request"}}` + "\n",
 	},
-}
-
+	{
+		"POST",
+		"/validtenantid/volumes",
+		`{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":null}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"new volume","description":"newly created volume","internal":false,"deletion_protected":false}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes",
+		`{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":"73a86d7e-93c0-480e-9c41-ab42f69b7799"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"create_volume","target":"73a86d7e-93c0-480e-9c41-ab42f69b7799","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"PUT",
+		"/nodes/6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b/status",
+		`{"status":"maintenance"}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PUT",
+		"/nodes/6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b/status?evacuate=true",
+		`{"status":"maintenance"}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"","type":"evacuate_node","target":"6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"PUT",
+		"/nodes/6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b/status?evacuate=maybe",
+		`{"status":"maintenance"}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid evacuate: maybe"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/nodes/6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b/status",
+		`{"status":"full"}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Node status must be ready or maintenance"}}` + "\n",
+	},
+	{
+		"GET",
+		"/operations",
+		"",
+		fmt.Sprintf("application/%s", OperationsV1),
+		http.StatusOK,
+		`{"operations":[{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"create_volume","target":"73a86d7e-93c0-480e-9c41-ab42f69b7799","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/operations/9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b",
+		"",
+		fmt.Sprintf("application/%s", OperationsV1),
+		http.StatusOK,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"create_volume","target":"73a86d7e-93c0-480e-9c41-ab42f69b7799","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"PUT",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/ca",
+		`{"certificate":"-----BEGIN CERTIFICATE-----"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","certificate":"-----BEGIN CERTIFICATE-----","subject":"CN=tenant CA","fingerprint":"","not_after":"0001-01-01T00:00:00Z","create_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"GET",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/ca",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant CA not found"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/ca",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PUT",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/freeze",
+		`{"frozen":true,"reason":"storage migration"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/export",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"version":1,"id":"3390740c-dce9-48d6-b83a-a717417072ce","config":{"name":"test","subnet_bits":24,"permissions":{"privileged_containers":false}},"quotas":[{"name":"tenant-instances-quota","value":"10","usage":"0"}],"workloads":[],"launch_templates":[]}`,
+	},
+	{
+		"POST",
+		"/tenants/import",
+		`{"version":1,"id":"3390740c-dce9-48d6-b83a-a717417072ce","config":{"name":"test"},"quotas":[{"name":"tenant-instances-quota","value":"10"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","validate_only":false,"classes":[{"class":"tenant","count":1,"applied":true},{"class":"quotas","count":1,"applied":true},{"class":"workloads","count":0,"applied":false},{"class":"launch_templates","count":1,"applied":false,"conflicts":[{"name":"web","reason":"Launch template already exists"}]}]}`,
+	},
+	{
+		"POST",
+		"/tenants/import?validate_only=true",
+		`{"version":1,"id":"3390740c-dce9-48d6-b83a-a717417072ce","config":{"name":"test"}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","validate_only":true,"classes":[{"class":"tenant","count":1,"applied":false},{"class":"quotas","count":0,"applied":false},{"class":"workloads","count":0,"applied":false},{"class":"launch_templates","count":1,"applied":false,"conflicts":[{"name":"web","reason":"Launch template already exists"}]}]}`,
+	},
+	{
+		"POST",
+		"/tenants/import",
+		`{"version":2,"id":"3390740c-dce9-48d6-b83a-a717417072ce"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid tenant export"}}` + "\n",
+	},
+	{
+		"POST",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/network/prepare",
+		`{"subnet":"172.16.1.0/24"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"prepare_network","target":"172.16.1.0/24","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/network/prepare",
+		`{"subnet":"10.0.0.0/8"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}` + "\n",
+	},
+	{
+		"GET",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/network",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","subnet_bits":29,"max_subnets":1,"subnets":[{"subnet":"172.16.0.0/29","capacity":5,"used":5,"cnci_id":"d7d86208-b46c-4465-9018-fe14087d415f"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/subnets",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"subnets":[{"subnet":"172.16.0.0/29","capacity":5,"used":5,"cnci_id":"d7d86208-b46c-4465-9018-fe14087d415f"}]}`,
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/tenants/subnets",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"subnets":[{"subnet":"172.16.0.0/29","capacity":5,"used":5,"cnci_id":"d7d86208-b46c-4465-9018-fe14087d415f"}]}`,
+	},
+	{
+		"POST",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/network/retry",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/tenants/5f0cd9a4-7d0e-4ac5-9b0c-2f2d5c5c9e1a/network/retry",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusServiceUnavailable,
+		`{"error":{"code":503,"name":"Service Unavailable","message":"Tenant network controller failed to initialize for tenant 5f0cd9a4-7d0e-4ac5-9b0c-2f2d5c5c9e1a: CNCI 0e4b3c35-3f6d-4ac1-a4c3-0a5d8a29a0d2 has invalid subnet \"garbage\""}}` + "\n",
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/signed-urls",
+		`{"resource":"operation","id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b"}`,
+		fmt.Sprintf("application/%s", SignedURLsV1),
+		http.StatusCreated,
+		`{"url":"/signed/operation/9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b?expires=60\u0026signature=abcdef\u0026tenant=3390740c-dce9-48d6-b83a-a717417072ce","resource":"operation","id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","expires":"1970-01-01T00:01:00Z"}`,
+	},
+	{
+		"POST",
+		"/signed-urls",
+		`{"resource":"console","id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b"}`,
+		fmt.Sprintf("application/%s", SignedURLsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}` + "\n",
+	},
+	{
+		"GET",
+		"/usage?start=2017-06-01T00:00:00Z&end=2017-06-02T00:00:00Z&granularity=daily",
+		"",
+		fmt.Sprintf("application/%s", UsageV1),
+		http.StatusOK,
+		`{"usage":[{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","granularity":"daily","start":"2017-06-01T00:00:00Z","end":"2017-06-02T00:00:00Z","instance_hours":36,"volume_gb_hours":240,"external_ip_hours":1.5}]}`,
+	},
+	{
+		"GET",
+		"/usage?start=2017-06-01T00:00:00Z&end=2017-06-02T00:00:00Z&granularity=daily&format=csv",
+		"",
+		fmt.Sprintf("application/%s", UsageV1),
+		http.StatusOK,
+		"tenant_id,granularity,start,end,instance_hours,volume_gb_hours,external_ip_hours\n" +
+			"3390740c-dce9-48d6-b83a-a717417072ce,daily,2017-06-01T00:00:00Z,2017-06-02T00:00:00Z,36.000000,240.000000,1.500000\n",
+	},
+	{
+		"GET",
+		"/usage?format=xml",
+		"",
+		fmt.Sprintf("application/%s", UsageV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid format: xml"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/trash",
+		"",
+		fmt.Sprintf("application/%s", TrashV1),
+		http.StatusOK,
+		`{"items":[{"id":"73a86d7e-93c0-480e-9c41-ab42f69b7799","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"volume","name":"data","delete_time":"0001-01-01T00:00:00Z","purge_time":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates",
+		"",
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusOK,
+		`{"templates":[{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","version":1,"request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}},"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates",
+		`{"name":"web","request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}}}`,
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Launch template already exists"}}` + "\n",
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates",
+		`{"name":"db","request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}}}`,
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusCreated,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"db","version":1,"request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}},"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates",
+		`{"name":"bad","request":{"server":{"flavor":"large"}}}`,
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid launch request: json: unknown field \"flavor\""}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates/web",
+		"",
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","version":1,"request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}},"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates/missing",
+		"",
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Launch template not found"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates/web",
+		`{"request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"www"}}}`,
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","version":2,"request":{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"www"}},"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/launch-templates/web",
+		"",
+		fmt.Sprintf("application/%s", LaunchTemplatesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups",
+		"",
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusOK,
+		`{"server_groups":[{"id":"7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","policy":"anti-affinity","soft":false,"members":["9b1c1a45-7d3b-4e5f-a4f0-16e6b5e58e2f"],"create_time":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups",
+		`{"name":"web","policy":"affinity","soft":true}`,
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusCreated,
+		`{"id":"7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","policy":"affinity","soft":true,"members":[],"create_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups",
+		`{"name":"web","policy":"spread"}`,
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid server group policy"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups/7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e",
+		"",
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusOK,
+		`{"id":"7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","policy":"anti-affinity","soft":false,"members":["9b1c1a45-7d3b-4e5f-a4f0-16e6b5e58e2f"],"create_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups/missing",
+		"",
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Server group not found"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/server-groups/7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e",
+		"",
+		fmt.Sprintf("application/%s", ServerGroupsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules",
+		"",
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusOK,
+		`{"schedules":[{"id":"5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","tag":"data","interval_minutes":1440,"offset_minutes":120,"retention":7,"create_time":"0001-01-01T00:00:00Z","last_run":"0001-01-01T00:00:00Z","next_run":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules",
+		`{"tag":"data","interval_minutes":1440,"offset_minutes":120,"retention":7}`,
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusCreated,
+		`{"id":"5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","tag":"data","interval_minutes":1440,"offset_minutes":120,"retention":7,"create_time":"0001-01-01T00:00:00Z","last_run":"0001-01-01T00:00:00Z","next_run":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules",
+		`{"interval_minutes":1440,"retention":7}`,
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid snapshot schedule"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules/5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30",
+		"",
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusOK,
+		`{"id":"5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","tag":"data","interval_minutes":1440,"offset_minutes":120,"retention":7,"create_time":"0001-01-01T00:00:00Z","last_run":"0001-01-01T00:00:00Z","next_run":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules/missing",
+		"",
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Snapshot schedule not found"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/snapshot-schedules/5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30",
+		"",
+		fmt.Sprintf("application/%s", SnapshotSchedulesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/volumes/validvolumeid/snapshots",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`{"snapshots":[{"id":"e8c4a3f2-2b1d-4f6a-8c9e-7d5b3a1f0e62","volume_id":"validvolumeid","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","schedule_id":"5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30","attached":false,"create_time":"0001-01-01T00:00:00Z"}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/volumes/validvolumeid/snapshots",
+		`{"name":"before upgrade"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusCreated,
+		`{"id":"a1d3c6b2-8e4f-4b7a-9c2d-5f6e7a8b9c0d","volume_id":"validvolumeid","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","schedule_id":"","name":"before upgrade","attached":true,"create_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/volumes/validvolumeid/snapshots/a1d3c6b2-8e4f-4b7a-9c2d-5f6e7a8b9c0d",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/volumes/validvolumeid/snapshots/unknownsnapshotid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Volume snapshot not found"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/api-keys",
+		"",
+		fmt.Sprintf("application/%s", APIKeysV1),
+		http.StatusOK,
+		`{"keys":[{"id":"0b2f4a1e-6b8e-4c39-9d0a-6c1b5e7f2a41","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"ci","scopes":["instances"],"expire_time":"0001-01-01T00:00:00Z","last_used_time":"0001-01-01T00:00:00Z","create_time":"2015-11-29T22:21:42Z"}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/api-keys",
+		`{"name":"ci","scopes":["instances"]}`,
+		fmt.Sprintf("application/%s", APIKeysV1),
+		http.StatusCreated,
+		`{"id":"0b2f4a1e-6b8e-4c39-9d0a-6c1b5e7f2a41","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"ci","scopes":["instances"],"expire_time":"0001-01-01T00:00:00Z","last_used_time":"0001-01-01T00:00:00Z","create_time":"2015-11-29T22:21:42Z","key":"c2VjcmV0"}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/api-keys",
+		`{"name":"ci","scopes":["spaceships"]}`,
+		fmt.Sprintf("application/%s", APIKeysV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid API key request"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/api-keys/0b2f4a1e-6b8e-4c39-9d0a-6c1b5e7f2a41",
+		"",
+		fmt.Sprintf("application/%s", APIKeysV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/api-keys/5e7f2a41-6b8e-4c39-9d0a-6c1b0b2f4a1e",
+		"",
+		fmt.Sprintf("application/%s", APIKeysV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"API key not found"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/capacity",
+		"",
+		fmt.Sprintf("application/%s", CapacityV1),
+		http.StatusOK,
+		`{"tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","updated":"2017-01-01T00:00:00Z","ready_nodes":2,"sampled_nodes":2,"workloads":[{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","description":"testWorkload","cluster":8,"quota":3,"available":3}]}`,
+	},
+	{
+		"GET",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/capacity",
+		"",
+		fmt.Sprintf("application/%s", CapacityV1),
+		http.StatusOK,
+		`{"workload_id":"ba58f471-0735-4773-9550-188e2d012941","total":3,"nodes":[{"node_id":"node1","hostname":"host1","updated":"2017-01-01T00:00:00Z","pending_instances":1,"ram_available":3072,"disk_available":20480,"vcpus_available":6,"instances":3}]}`,
+	},
+	{
+		"POST",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/trash/73a86d7e-93c0-480e-9c41-ab42f69b7799/restore",
+		"",
+		fmt.Sprintf("application/%s", TrashV1),
+		http.StatusOK,
+		`{"type":"volume","id":"73a86d7e-93c0-480e-9c41-ab42f69b7799"}`,
+	},
+	{
+		"POST",
+		"/tenants/3390740c-dce9-48d6-b83a-a717417072ce/trash/9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b/restore",
+		"",
+		fmt.Sprintf("application/%s", TrashV1),
+		http.StatusGone,
+		`{"error":{"code":410,"name":"Gone","message":"Volume storage has already been purged"}}` + "\n",
+	},
+	{
+		"GET",
+		"/cncis/image",
+		"",
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusOK,
+		`{"image":"0ac2ad34-3e63-4c58-a0d5-3a2f8a1ea2e1","previous_image":"4e16e743-265a-4bf2-9fd1-57ada0b28904"}`,
+	},
+	{
+		"POST",
+		"/cncis/upgrade",
+		`{"image_id":"0ac2ad34-3e63-4c58-a0d5-3a2f8a1ea2e1","batch_size":2}`,
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusAccepted,
+		`{"id":"d5e8f5d6-0c4b-4e0e-9c1a-3f8b7e6a5d4c","tenant_id":"","type":"upgrade_cnci","target":"0ac2ad34-3e63-4c58-a0d5-3a2f8a1ea2e1","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/cncis/rollback",
+		`{"by_tenant":true}`,
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"No previous CNCI image"}}` + "\n",
+	},
+	{
+		"GET",
+		"/3390740c-dce9-48d6-b83a-a717417072ce/operations/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		"",
+		fmt.Sprintf("application/%s", OperationsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Operation not found"}}` + "\n",
+	},
+	{
+		"GET",
+		"/validtenantid/volumes",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`[{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false,"deletion_protected":false},{"id":"new-test-id2","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"volume 2","description":"my other volume","internal":false,"deletion_protected":false}]`,
+	},
+	{
+		"GET",
+		"/validtenantid/volumes/validvolumeid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false,"deletion_protected":false}`,
+	},
+	{
+		"DELETE",
+		"/validtenantid/volumes/validvolumeid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"PATCH",
+		"/validtenantid/volumes/validvolumeid",
+		`{"deletion_protected":true}`,
+		"application/merge-patch+json",
+		http.StatusOK,
+		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false,"deletion_protected":true}`,
+	},
+	{
+		"DELETE",
+		"/validtenantid/volumes/protectedvolumeid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Deletion protection must be cleared before deleting"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/validtenantid/volumes/protectedvolumeid?force=true",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc","tag":"data"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc","tag":"inuse"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Tag already used by a volume attached to the instance"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"detach":{}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"os-extend":{"new_size":4}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/inusevolumeid/action",
+		`{"os-extend":{"new_size":4}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Volume is attached, it may only be extended online"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/inusevolumeid/action",
+		`{"os-extend":{"new_size":4,"online":true}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"os-extend":{"new_size":1}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Volumes may only be extended"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"os-extend":{"new_size":"big"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/attach",
+		`{"instance_id":"validinstanceid"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"create_volume","target":"73a86d7e-93c0-480e-9c41-ab42f69b7799","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/busyvolumeid/attach",
+		`{"instance_id":"validinstanceid"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Volume is being attached or detached"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/attach",
+		`{}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid Request"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/detach",
+		`{"instance_id":"validinstanceid"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"3390740c-dce9-48d6-b83a-a717417072ce","type":"create_volume","target":"73a86d7e-93c0-480e-9c41-ab42f69b7799","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/detach",
+		`{"instance_id":"stoppedinstanceid"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Instance is not running"}}` + "\n",
+	},
+	{
+		"POST",
+		"/volumes/validvolumeid/force-detach",
+		`{"confirm":false}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/volumes/activevolumeid/force-detach",
+		`{"confirm":false}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Volume is attached to a running instance"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/volumes/validvolumeid/state",
+		`{"state":"available","reason":"node lost"}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/volumes/attachments?node_id=3b5c8d2e-4f3a-4c2b-9e1d-7a6f5c4b3a21&state=attaching&limit=1",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`{"attachments":[{"id":"1f4e3b2a-6c5d-4e7f-8a9b-0c1d2e3f4a5b","tenant_id":"validtenantid","instance_id":"validinstanceid","volume_id":"validvolumeid","node_id":"3b5c8d2e-4f3a-4c2b-9e1d-7a6f5c4b3a21","state":"attaching","state_time":"2015-11-29T22:21:42Z","boot":false,"ephemeral":false}],"next_marker":"1f4e3b2a-6c5d-4e7f-8a9b-0c1d2e3f4a5b"}`,
+	},
+	{
+		"GET",
+		"/volumes/attachments?state=stuck",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid state: stuck"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","imageRef": "http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","metadata":{"My Server Name":"Apache1"}}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		`{"server":{"id":"validServerID","name":"new-server-test","imageRef":"http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","max_count":0,"min_count":0,"metadata":{"My Server Name":"Apache1"}}}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"batch","workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","max_count":2}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusMultiStatus,
+		`{"total_servers":1,"servers":[{"private_addresses":null,"created":"0001-01-01T00:00:00Z","workload_id":"","node_id":"","id":"validServerID","name":"batch-0","volumes":null,"status":"","tenant_id":"","ssh_ip":"","ssh_port":0,"deletion_protected":false}],"results":[{"name":"batch-0","id":"validServerID","status":202},{"name":"batch-1","status":403,"error":{"code":403,"name":"Forbidden","message":"Over Quota","failure_code":"quota_exceeded"}}]}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"template":"web","server":{"name":"web-2"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		`{"server":{"id":"validServerID","name":"web-2","imageRef":"","workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","max_count":0,"min_count":0}}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"template":"missing"}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Launch template not found"}}` + "\n",
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}]}`},
+	{
+		"GET",
+		"/validtenantid/instances/detail?state=running&workload_id=testWorkloadUUID",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?state=sleeping",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Unknown instance state: sleeping"}}` + "\n",
+	},
+	{
+		"GET",
+		"/instances/detail?state=exited&node_id=nodeUUID",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":0,"servers":null}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?limit=1",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}],"next_marker":"MDAwMS0wMS0wMVQwMDowMDowMFogdGVzdFVVSUQ","links":[{"rel":"next","href":"/validtenantid/instances/detail?limit=1\u0026marker=MDAwMS0wMS0wMVQwMDowMDowMFogdGVzdFVVSUQ"}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}}`,
+	},
+	{
+		"PATCH",
+		"/validtenantid/instances/instanceid",
+		`{"description":"nightly ETL runner"}`,
+		"application/merge-patch+json",
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","description":"nightly ETL runner","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}}`,
+	},
+	{
+		"PATCH",
+		"/validtenantid/instances/instanceid",
+		`{"name":"etl"}`,
+		"application/merge-patch+json",
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"etl","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0,"deletion_protected":false}}`,
+	},
+	{
+		"PATCH",
+		"/validtenantid/instances/instanceid",
+		`{"name":"inuse"}`,
+		"application/merge-patch+json",
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Instance name already in use"}}` + "\n",
+	},
+	{
+		"PATCH",
+		"/validtenantid/instances/instanceid",
+		`{"name":"c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3"}`,
+		"application/merge-patch+json",
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Instance names may not be UUIDs"}}` + "\n",
+	},
+	{
+		"GET",
+		"/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3/placements",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","node_id":"nodeUUID","placements":[{"node_id":"nodeUUID","timestamp":"2017-01-01T00:00:00Z","reason":"initial"}]}`,
+	},
+	{
+		"GET",
+		"/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3/history",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3","tenant_id":"validtenantid","entries":[{"timestamp":"2017-01-01T00:00:00Z","type":"created","message":"Created from workload testWorkloadUUID","actor":"admin"},{"timestamp":"2017-01-01T00:00:01Z","type":"placement","message":"Placed on node (initial)","node_id":"nodeUUID"}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/history?limit=1",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"instanceid","tenant_id":"validtenantid","entries":[{"timestamp":"2017-01-01T00:00:00Z","type":"created","message":"Created from workload testWorkloadUUID","actor":"admin"}],"next_marker":"1"}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/history?marker=1",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"instanceid","tenant_id":"validtenantid","entries":[{"timestamp":"2017-01-01T00:00:01Z","type":"placement","message":"Placed on node (initial)","node_id":"nodeUUID"}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/consolelog",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"instanceid","lines":["Ubuntu 16.04 LTS ciao ttyS0","ciao login: "]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/consolelog?length=1",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"instance_id":"instanceid","lines":["ciao login: "]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/consolelog?length=0",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid length: 0"}}` + "\n",
+	},
+	{
+		"GET",
+		"/validtenantid/instances/pendingid/consolelog",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Instance is pending"}}` + "\n",
+	},
+	{
+		"PUT",
+		"/validtenantid/instances/instanceid/tags/role",
+		`{"value":"web"}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PUT",
+		"/validtenantid/instances/instanceid/tags/bad:key",
+		`{"value":"web"}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid instance tag"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/instanceid/tags/role",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/instanceid/tags/missing",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Instance tag not found"}}` + "\n",
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?tag=role",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid tag, expected key:value: role"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/instanceid",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/protectedid",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Deletion protection must be cleared before deleting"}}` + "\n",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/protectedid?force=true",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/protectedid?force=maybe",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"os-start":null}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"os-stop":null}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"restore":null}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"migrate":{"node_id":"nodeid"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		`{"id":"9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b","tenant_id":"validtenantid","type":"migrate_instance","target":"instanceid","state":"running","progress":0,"create_time":"0001-01-01T00:00:00Z","update_time":"0001-01-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"migrate":{}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid migration target"}}` + "\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"resize":{"vcpus":4,"mem_mb":2048}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"resize":{"mem_mb":-1}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid resize requirements"}}` + "\n",
+	},
+}
+
 type testCiaoService struct{}
 
-func (ts testCiaoService) ListPools() ([]types.Pool, error) {
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+func (ts testCiaoService) ListPools() ([]types.Pool, error) {
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+	}
+
+	return []types.Pool{resp}, nil
+}
+
+func (ts testCiaoService) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
+	return types.Pool{}, nil
+}
+
+func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
+	fmt.Println("ShowPool")
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+	}
+
+	return resp, nil
+}
+
+func (ts testCiaoService) DeletePool(id string) error {
+	return nil
+}
+
+func (ts testCiaoService) SetPoolAccess(id string, tenants []string) error {
+	return nil
+}
+
+func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
+	return nil
+}
+
+func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
+	return nil
+}
+
+func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	var ref string
+
+	m := types.MappedIP{
+		ID:         "ba58f471-0735-4773-9550-188e2d012941",
+		ExternalIP: "192.168.0.1",
+		InternalIP: "172.16.0.1",
+		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName:   "mypool",
+	}
+
+	if tenant != nil {
+		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
+	} else {
+		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+	}
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	m.Links = []types.Link{link}
+
+	if tenant == nil {
+		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+
+		link := types.Link{
+			Rel:  "pool",
+			Href: ref,
+		}
+
+		m.Links = append(m.Links, link)
+	}
+
+	return []types.MappedIP{m}
+}
+
+func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string, address string) error {
+	if address == "192.168.0.2" {
+		return &types.AddressInUseError{Address: address, InstanceID: "otherinstanceID"}
+	}
+	return nil
+}
+
+func (ts testCiaoService) UnMapAddress(string) error {
+	return nil
+}
+
+func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
+	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
+	return req, nil
+}
+
+func (ts testCiaoService) UpdateWorkload(tenant string, ID string, req types.Workload) (types.Workload, error) {
+	req.ID = ID
+	req.Visibility = types.Public
+	return req, nil
+}
+
+func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
+	return nil
+}
+
+func (ts testCiaoService) PreviewWorkloadConfig(tenant string, ID string, req types.ConfigPreviewRequest) (types.ConfigPreview, error) {
+	if req.InstanceID != "" {
+		return types.ConfigPreview{}, types.ErrLaunchConfigNotFound
+	}
+
+	wl, err := ts.ShowWorkload(tenant, ID)
+	if err != nil {
+		return types.ConfigPreview{}, err
+	}
+
+	return types.ConfigPreview{
+		WorkloadID: wl.ID,
+		MetaData:   "{\n\t\"uuid\": \"\",\n\t\"hostname\": \"" + req.Name + "\"\n}",
+		CloudInit:  wl.Config,
+		Start:      "start: {}\n",
+	}, nil
+}
+
+func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
+	return types.Workload{
+		ID:          "ba58f471-0735-4773-9550-188e2d012941",
+		TenantID:    tenant,
+		Description: "testWorkload",
+		FWType:      payloads.Legacy,
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Visibility:  types.Private,
+	}, nil
+}
+
+func (ts testCiaoService) ListWorkloads(tenant string, search string) ([]types.Workload, error) {
+	return []types.Workload{
+		{
+			ID:          "ba58f471-0735-4773-9550-188e2d012941",
+			TenantID:    tenant,
+			Description: "testWorkload",
+			FWType:      payloads.Legacy,
+			VMType:      payloads.QEMU,
+			Config:      "this will totally work!",
+			Visibility:  types.Private,
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
+	return []types.QuotaDetails{
+		{Name: "test-quota-1", Value: 10, Usage: 3},
+		{Name: "test-quota-2", Value: -1, Usage: 10},
+		{Name: "test-limit", Value: 123, Usage: 0},
+	}
+}
+
+func (ts testCiaoService) ListQuotaDenials(limit int) types.QuotaDenialsResponse {
+	tenants := []types.TenantQuotaDenials{
+		{TenantID: "093ae09b-f653-464e-9ae6-5ae28bd03a22", Denials: 5},
+		{TenantID: "bc70dcd6-7298-4933-98a9-cded2d232d02", Denials: 2},
+	}
+
+	if len(tenants) > limit {
+		tenants = tenants[:limit]
+	}
+
+	return types.QuotaDenialsResponse{Window: time.Hour.String(), Tenants: tenants}
+}
+
+func (ts testCiaoService) ListQuotaHistory(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error) {
+	if filter.Resource != "" && filter.Resource != "instances" {
+		return nil, types.ErrBadQuotaResource
+	}
+
+	return []types.QuotaAuditRecord{
+		{
+			TenantID:  filter.TenantID,
+			Resource:  "instance",
+			Delta:     1,
+			Usage:     10,
+			Allowed:   false,
+			Timestamp: time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+	}, nil
+}
+
+func (ts testCiaoService) EvacuateNode(nodeID string) error {
+	return nil
+}
+
+func (ts testCiaoService) RestoreNode(nodeID string) error {
+	return nil
+}
+
+func (ts testCiaoService) SetNodeStatus(nodeID string, status types.NodeStatusType, evacuate bool) (types.Operation, error) {
+	if status != types.NodeStatusReady && status != types.NodeStatusMaintenance {
+		return types.Operation{}, types.ErrBadNodeStatus
+	}
+
+	if !evacuate {
+		return types.Operation{}, nil
+	}
+
+	return types.Operation{
+		ID:     testOperation().ID,
+		Type:   types.EvacuateNodeOperation,
+		Target: nodeID,
+		State:  types.OperationRunning,
+	}, nil
+}
+
+func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	return nil
+}
+
+func (ts testCiaoService) ListTenants() ([]types.TenantSummary, error) {
+	summary := types.TenantSummary{
+		ID:   "bc70dcd6-7298-4933-98a9-cded2d232d02",
+		Name: "Test Tenant",
+	}
+
+	ref := fmt.Sprintf("/tenants/%s", summary.ID)
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	summary.Links = append(summary.Links, link)
+
+	return []types.TenantSummary{summary}, nil
+}
+
+func (ts testCiaoService) ShowTenant(ID string) (types.TenantDetails, error) {
+	details := types.TenantDetails{
+		TenantConfig: types.TenantConfig{
+			Name:       "Test Tenant",
+			SubnetBits: 24,
+			CNCISize:   &types.CNCISize{VCPUs: 8},
+		},
+		EffectiveCNCISize: types.CNCISize{VCPUs: 8, MemMB: 2048, DiskMB: 2048},
+	}
+
+	return details, nil
+}
+
+func (ts testCiaoService) PatchTenant(string, []byte) error {
+	return nil
+}
+
+// existingTenantID is the ID of the tenant testCiaoService reports as
+// already created.
+const existingTenantID = "5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5"
+
+func (ts testCiaoService) CreateTenant(req types.TenantRequest) (types.TenantRecord, bool, error) {
+	record := types.TenantRecord{
+		ID:     req.ID,
+		Name:   req.Config.Name,
+		Config: req.Config,
+		Quotas: req.Quotas,
+	}
+
+	ref := fmt.Sprintf("/tenants/%s", record.ID)
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+	record.Links = append(record.Links, link)
+
+	return record, req.ID != existingTenantID, nil
+}
+
+func (ts testCiaoService) DeleteTenant(ctx context.Context, ID string, force bool) (types.Operation, error) {
+	if ID == "5d2d7a5f-b3bc-4e2e-a4b4-52ab8cd5c7a5" && !force {
+		return types.Operation{}, types.ErrTenantHasInstances
+	}
+
+	return types.Operation{
+		ID:       testOperation().ID,
+		TenantID: ID,
+		Type:     types.DeleteTenantOperation,
+		Target:   ID,
+		State:    types.OperationRunning,
+	}, nil
+}
+
+func (ts testCiaoService) CreateImage(tenantID string, req CreateImageRequest) (types.Image, error) {
+	name := "Ubuntu"
+	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	return types.Image{
+		State:      types.Created,
+		CreateTime: createdAt,
+		Visibility: types.Private,
+		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
+		Name:       name,
+	}, nil
+}
+
+func (ts testCiaoService) ListImages(tenantID string) ([]types.Image, error) {
+	name := "Ubuntu"
+	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	image := types.Image{
+		State:      types.Created,
+		CreateTime: createdAt,
+		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
+		Name:       name,
+		Visibility: types.Public,
+	}
+
+	var images []types.Image
+	images = append(images, image)
+
+	return images, nil
+}
+
+func (ts testCiaoService) GetImage(tenantID, ID string) (types.Image, error) {
+	imageID := "1bea47ed-f6a9-463b-b423-14b9cca9ad27"
+	name := "cirros-0.3.2-x86_64-disk"
+	createdAt, _ := time.Parse(time.RFC3339, "2014-05-05T17:15:10Z")
+	var size uint64 = 13167616
+
+	return types.Image{
+		State:      types.Active,
+		CreateTime: createdAt,
+		Visibility: types.Public,
+		ID:         imageID,
+		Name:       name,
+		Size:       size,
+	}, nil
+}
+
+func (ts testCiaoService) UploadImage(context.Context, string, string, io.Reader) error {
+	return nil
+}
+
+func (ts testCiaoService) DeleteImage(ctx context.Context, tenantID, ID string) error {
+	if ID == "4e16e743-265a-4bf2-9fd1-57ada0b28904" {
+		return &types.ImageInUseError{
+			ImageID:   ID,
+			Workloads: []string{"69e84267-ed01-4738-b15f-b47de06b62e7"},
+		}
 	}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+	return nil
+}
+
+func (ts testCiaoService) SetImageVisibility(ID string, visibility types.Visibility) error {
+	switch visibility {
+	case types.Public, types.Private, types.Internal:
+		return nil
+	default:
+		return types.ErrBadRequest
 	}
+}
 
-	return []types.Pool{resp}, nil
+func (ts testCiaoService) PreseedImage(ID string, req types.ImagePreseedRequest) (types.Image, error) {
+	if req.All == (req.Label != "") {
+		return types.Image{}, types.ErrBadImagePreseed
+	}
+
+	createTime, _ := time.Parse(time.RFC3339, "2014-05-05T17:15:10Z")
+
+	return types.Image{
+		ID:         ID,
+		State:      types.Active,
+		Name:       "cirros-0.3.2-x86_64-disk",
+		CreateTime: createTime,
+		Size:       13167616,
+		Visibility: types.Public,
+		Seeds: []types.ImageSeed{
+			{
+				NodeID:     "6ce2ac64-fb8a-4bf6-b4ab-4f7ba3c17b0b",
+				State:      types.ImageSeeding,
+				UpdateTime: createTime,
+			},
+		},
+	}, nil
 }
 
-func (ts testCiaoService) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
-	return types.Pool{}, nil
+func (ts testCiaoService) ShowVolumeDetails(tenant string, volume string) (types.Volume, error) {
+	return types.Volume{
+		BlockDevice: storage.BlockDevice{
+			ID:   "new-test-id",
+			Size: 123456,
+		},
+		State:       types.Available,
+		Name:        "my volume",
+		Description: "my volume for stuff",
+		TenantID:    "test-tenant-id",
+	}, nil
 }
 
-func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
-	fmt.Println("ShowPool")
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+func (ts testCiaoService) CreateVolume(ctx context.Context, tenant string, req RequestedVolume) (types.Volume, error) {
+	return types.Volume{
+		BlockDevice: storage.BlockDevice{
+			ID:   "new-test-id",
+			Size: 123456,
+		},
+		State:       types.Available,
+		Name:        "new volume",
+		Description: "newly created volume",
+		TenantID:    "test-tenant-id",
+	}, nil
+}
+
+func testOperation() types.Operation {
+	return types.Operation{
+		ID:       "9f3a4d7c-0b1e-4c5d-8f2a-6e7b8c9d0a1b",
+		TenantID: "3390740c-dce9-48d6-b83a-a717417072ce",
+		Type:     types.CreateVolumeOperation,
+		Target:   "73a86d7e-93c0-480e-9c41-ab42f69b7799",
+		State:    types.OperationRunning,
 	}
+}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+func (ts testCiaoService) CreateVolumeFromImage(ctx context.Context, tenant string, req RequestedVolume) (types.Operation, error) {
+	return testOperation(), nil
+}
+
+func (ts testCiaoService) ListOperations(tenantID string) ([]types.Operation, error) {
+	return []types.Operation{testOperation()}, nil
+}
+
+func (ts testCiaoService) ShowOperation(tenantID string, operationID string) (types.Operation, error) {
+	if operationID != testOperation().ID {
+		return types.Operation{}, types.ErrOperationNotFound
 	}
 
-	return resp, nil
+	return testOperation(), nil
 }
 
-func (ts testCiaoService) DeletePool(id string) error {
-	return nil
+func testTrashItem() types.TrashItem {
+	return types.TrashItem{
+		ID:       "73a86d7e-93c0-480e-9c41-ab42f69b7799",
+		TenantID: "3390740c-dce9-48d6-b83a-a717417072ce",
+		Type:     types.TrashVolume,
+		Name:     "data",
+	}
 }
 
-func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
-	return nil
+func testLaunchTemplate() types.LaunchTemplate {
+	return types.LaunchTemplate{
+		TenantID: "3390740c-dce9-48d6-b83a-a717417072ce",
+		Name:     "web",
+		Version:  1,
+		Request:  json.RawMessage(`{"server":{"workload_id":"ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e","name":"web"}}`),
+	}
 }
 
-func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
-	return nil
+func (ts testCiaoService) CreateServerFromTemplate(ctx context.Context, tenant string, template string, overrides []byte, actor string) (interface{}, error) {
+	t := testLaunchTemplate()
+	if template != t.Name {
+		return nil, types.ErrLaunchTemplateNotFound
+	}
+
+	var req CreateServerRequest
+	if err := json.Unmarshal(t.Request, &req); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(overrides, &req.Server); err != nil {
+		return nil, err
+	}
+
+	req.Server.ID = "validServerID"
+	return req, nil
 }
 
-func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
-	var ref string
+func (ts testCiaoService) ListLaunchTemplates(tenantID string) ([]types.LaunchTemplate, error) {
+	return []types.LaunchTemplate{testLaunchTemplate()}, nil
+}
 
-	m := types.MappedIP{
-		ID:         "ba58f471-0735-4773-9550-188e2d012941",
-		ExternalIP: "192.168.0.1",
-		InternalIP: "172.16.0.1",
-		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
-		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
-		PoolName:   "mypool",
+func (ts testCiaoService) CreateLaunchTemplate(tenantID string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error) {
+	if req.Name == testLaunchTemplate().Name {
+		return types.LaunchTemplate{}, types.ErrLaunchTemplateExists
 	}
 
-	if tenant != nil {
-		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
-	} else {
-		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+	var server CreateServerRequest
+	dec := json.NewDecoder(bytes.NewReader(req.Request))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&server); err != nil {
+		return types.LaunchTemplate{}, &types.LaunchRequestError{Reason: err.Error()}
 	}
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+	t := testLaunchTemplate()
+	t.Name = req.Name
+	t.Request = req.Request
+	return t, nil
+}
+
+func (ts testCiaoService) ShowLaunchTemplate(tenantID string, name string) (types.LaunchTemplate, error) {
+	if name != testLaunchTemplate().Name {
+		return types.LaunchTemplate{}, types.ErrLaunchTemplateNotFound
 	}
 
-	m.Links = []types.Link{link}
+	return testLaunchTemplate(), nil
+}
 
-	if tenant == nil {
-		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+func (ts testCiaoService) UpdateLaunchTemplate(tenantID string, name string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error) {
+	t, err := ts.ShowLaunchTemplate(tenantID, name)
+	if err != nil {
+		return t, err
+	}
 
-		link := types.Link{
-			Rel:  "pool",
-			Href: ref,
-		}
+	t.Version++
+	t.Request = req.Request
+	return t, nil
+}
 
-		m.Links = append(m.Links, link)
+func (ts testCiaoService) DeleteLaunchTemplate(tenantID string, name string) error {
+	_, err := ts.ShowLaunchTemplate(tenantID, name)
+	return err
+}
+
+func testServerGroup() types.ServerGroup {
+	return types.ServerGroup{
+		ID:       "7d2f4b1c-9a6e-4c3b-8f5d-1e0a2b3c4d5e",
+		TenantID: "3390740c-dce9-48d6-b83a-a717417072ce",
+		Name:     "web",
+		Policy:   types.ServerGroupAntiAffinity,
+		Members:  []string{"9b1c1a45-7d3b-4e5f-a4f0-16e6b5e58e2f"},
 	}
+}
 
-	return []types.MappedIP{m}
+func (ts testCiaoService) ListServerGroups(tenantID string) ([]types.ServerGroup, error) {
+	return []types.ServerGroup{testServerGroup()}, nil
 }
 
-func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string) error {
-	return nil
+func (ts testCiaoService) CreateServerGroup(tenantID string, req types.ServerGroupRequest) (types.ServerGroup, error) {
+	if req.Policy != types.ServerGroupAffinity && req.Policy != types.ServerGroupAntiAffinity {
+		return types.ServerGroup{}, types.ErrBadServerGroup
+	}
+
+	g := testServerGroup()
+	g.Name = req.Name
+	g.Policy = req.Policy
+	g.Soft = req.Soft
+	g.Members = []string{}
+	return g, nil
 }
 
-func (ts testCiaoService) UnMapAddress(string) error {
-	return nil
+func (ts testCiaoService) ShowServerGroup(tenantID string, ID string) (types.ServerGroup, error) {
+	if ID != testServerGroup().ID {
+		return types.ServerGroup{}, types.ErrServerGroupNotFound
+	}
+
+	return testServerGroup(), nil
 }
 
-func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
-	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
-	return req, nil
+func (ts testCiaoService) DeleteServerGroup(tenantID string, ID string) error {
+	_, err := ts.ShowServerGroup(tenantID, ID)
+	return err
 }
 
-func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
-	return nil
+func testSnapshotSchedule() types.SnapshotSchedule {
+	return types.SnapshotSchedule{
+		ID:              "5c1b6a0e-4f3d-4a8e-9b1f-2d6e8c7a9b30",
+		TenantID:        "3390740c-dce9-48d6-b83a-a717417072ce",
+		Tag:             "data",
+		IntervalMinutes: 1440,
+		OffsetMinutes:   120,
+		Retention:       7,
+	}
 }
 
-func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
-	return types.Workload{
-		ID:          "ba58f471-0735-4773-9550-188e2d012941",
-		TenantID:    tenant,
-		Description: "testWorkload",
-		FWType:      payloads.Legacy,
-		VMType:      payloads.QEMU,
-		Config:      "this will totally work!",
-		Visibility:  types.Private,
-	}, nil
+func (ts testCiaoService) ListSnapshotSchedules(tenantID string) ([]types.SnapshotSchedule, error) {
+	return []types.SnapshotSchedule{testSnapshotSchedule()}, nil
 }
 
-func (ts testCiaoService) ListWorkloads(tenant string) ([]types.Workload, error) {
-	return []types.Workload{
+func (ts testCiaoService) CreateSnapshotSchedule(tenantID string, req types.SnapshotScheduleRequest) (types.SnapshotSchedule, error) {
+	if (req.VolumeID == "") == (req.Tag == "") {
+		return types.SnapshotSchedule{}, types.ErrBadSnapshotSchedule
+	}
+
+	s := testSnapshotSchedule()
+	s.VolumeID = req.VolumeID
+	s.Tag = req.Tag
+	s.IntervalMinutes = req.IntervalMinutes
+	s.OffsetMinutes = req.OffsetMinutes
+	s.Retention = req.Retention
+	return s, nil
+}
+
+func (ts testCiaoService) ShowSnapshotSchedule(tenantID string, ID string) (types.SnapshotSchedule, error) {
+	if ID != testSnapshotSchedule().ID {
+		return types.SnapshotSchedule{}, types.ErrSnapshotScheduleNotFound
+	}
+
+	return testSnapshotSchedule(), nil
+}
+
+func (ts testCiaoService) DeleteSnapshotSchedule(tenantID string, ID string) error {
+	_, err := ts.ShowSnapshotSchedule(tenantID, ID)
+	return err
+}
+
+func (ts testCiaoService) ListVolumeSnapshots(tenantID string, volumeID string) ([]types.VolumeSnapshot, error) {
+	return []types.VolumeSnapshot{
 		{
-			ID:          "ba58f471-0735-4773-9550-188e2d012941",
-			TenantID:    tenant,
-			Description: "testWorkload",
-			FWType:      payloads.Legacy,
-			VMType:      payloads.QEMU,
-			Config:      "this will totally work!",
-			Visibility:  types.Private,
+			ID:         "e8c4a3f2-2b1d-4f6a-8c9e-7d5b3a1f0e62",
+			VolumeID:   volumeID,
+			TenantID:   tenantID,
+			ScheduleID: testSnapshotSchedule().ID,
 		},
 	}, nil
 }
 
-func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
-	return []types.QuotaDetails{
-		{Name: "test-quota-1", Value: 10, Usage: 3},
-		{Name: "test-quota-2", Value: -1, Usage: 10},
-		{Name: "test-limit", Value: 123, Usage: 0},
+func (ts testCiaoService) CreateVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, req types.VolumeSnapshotRequest) (types.VolumeSnapshot, error) {
+	return types.VolumeSnapshot{
+		ID:       "a1d3c6b2-8e4f-4b7a-9c2d-5f6e7a8b9c0d",
+		VolumeID: volumeID,
+		TenantID: tenantID,
+		Name:     req.Name,
+		Attached: true,
+	}, nil
+}
+
+func (ts testCiaoService) DeleteVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, snapshotID string) error {
+	if snapshotID != "a1d3c6b2-8e4f-4b7a-9c2d-5f6e7a8b9c0d" {
+		return types.ErrVolumeSnapshotNotFound
+	}
+	return nil
+}
+
+func testAPIKey() types.APIKey {
+	createTime, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	return types.APIKey{
+		ID:         "0b2f4a1e-6b8e-4c39-9d0a-6c1b5e7f2a41",
+		TenantID:   "3390740c-dce9-48d6-b83a-a717417072ce",
+		Name:       "ci",
+		Scopes:     []string{"instances"},
+		Hash:       "hash",
+		CreateTime: createTime,
 	}
 }
 
-func (ts testCiaoService) EvacuateNode(nodeID string) error {
+func (ts testCiaoService) ListAPIKeys(tenantID string) ([]types.APIKey, error) {
+	return []types.APIKey{testAPIKey()}, nil
+}
+
+func (ts testCiaoService) CreateAPIKey(tenantID string, req types.APIKeyRequest) (types.NewAPIKey, error) {
+	for _, scope := range req.Scopes {
+		if !IsResourceGroup(scope) {
+			return types.NewAPIKey{}, types.ErrBadAPIKey
+		}
+	}
+
+	return types.NewAPIKey{APIKey: testAPIKey(), Key: "c2VjcmV0"}, nil
+}
+
+func (ts testCiaoService) DeleteAPIKey(tenantID string, keyID string) error {
+	if keyID != testAPIKey().ID {
+		return types.ErrAPIKeyNotFound
+	}
+
 	return nil
 }
 
-func (ts testCiaoService) RestoreNode(nodeID string) error {
+func testPolicyRule() types.PolicyRule {
+	createTime, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	return types.PolicyRule{
+		ID:           "5d4a3a3a-7d3e-4a59-9a2c-2a0e3c5d6f71",
+		Description:  "No unpatched images",
+		Severity:     types.PolicyDeny,
+		ImagePattern: "ubuntu-14.*",
+		CreateTime:   createTime,
+	}
+}
+
+func (ts testCiaoService) ListPolicyRules() ([]types.PolicyRule, error) {
+	return []types.PolicyRule{testPolicyRule()}, nil
+}
+
+func (ts testCiaoService) CreatePolicyRule(req types.PolicyRule) (types.PolicyRule, error) {
+	if !req.Valid() {
+		return types.PolicyRule{}, types.ErrBadPolicyRule
+	}
+
+	return testPolicyRule(), nil
+}
+
+func (ts testCiaoService) ShowPolicyRule(ID string) (types.PolicyRule, error) {
+	if ID != testPolicyRule().ID {
+		return types.PolicyRule{}, types.ErrPolicyRuleNotFound
+	}
+
+	return testPolicyRule(), nil
+}
+
+func (ts testCiaoService) UpdatePolicyRule(ID string, req types.PolicyRule) (types.PolicyRule, error) {
+	r, err := ts.ShowPolicyRule(ID)
+	if err != nil {
+		return r, err
+	}
+
+	if !req.Valid() {
+		return types.PolicyRule{}, types.ErrBadPolicyRule
+	}
+
+	req.ID = r.ID
+	req.CreateTime = r.CreateTime
+	return req, nil
+}
+
+func (ts testCiaoService) DeletePolicyRule(ID string) error {
+	_, err := ts.ShowPolicyRule(ID)
+	return err
+}
+
+func testSetting() types.Setting {
+	return types.Setting{
+		Key:         "pending_instance_timeout",
+		Type:        types.SettingDuration,
+		Description: "Time after which pending instances are reported, 0 to disable",
+		Value:       "10m0s",
+		Default:     "10m0s",
+		Min:         "0s",
+		Max:         "24h0m0s",
+	}
+}
+
+func (ts testCiaoService) ListSettings() ([]types.Setting, error) {
+	return []types.Setting{testSetting()}, nil
+}
+
+func (ts testCiaoService) ShowSetting(key string) (types.Setting, error) {
+	if key != testSetting().Key {
+		return types.Setting{}, types.ErrSettingNotFound
+	}
+
+	return testSetting(), nil
+}
+
+func (ts testCiaoService) UpdateSetting(ctx context.Context, key string, value string) (types.Setting, error) {
+	s, err := ts.ShowSetting(key)
+	if err != nil {
+		return s, err
+	}
+
+	if _, err := time.ParseDuration(value); err != nil {
+		return types.Setting{}, &types.SettingValueError{Key: key, Reason: "not a valid duration: " + value}
+	}
+
+	s.Value = value
+	s.Modified = true
+	s.UpdateTime, _ = time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+	return s, nil
+}
+
+func (ts testCiaoService) ResetSetting(ctx context.Context, key string) (types.Setting, error) {
+	return ts.ShowSetting(key)
+}
+
+func (ts testCiaoService) ListTrash(tenantID string) ([]types.TrashItem, error) {
+	return []types.TrashItem{testTrashItem()}, nil
+}
+
+func (ts testCiaoService) RestoreTrashItem(ctx context.Context, tenantID string, ID string) (types.TrashRestoreResponse, error) {
+	if ID != testTrashItem().ID {
+		return types.TrashRestoreResponse{}, types.ErrTrashVolumePurged
+	}
+
+	return types.TrashRestoreResponse{Type: types.TrashVolume, ID: ID}, nil
+}
+
+func (ts testCiaoService) ShowTenantCA(tenantID string) (types.TenantCA, error) {
+	return types.TenantCA{}, types.ErrTenantCANotFound
+}
+
+func (ts testCiaoService) UpdateTenantCA(tenantID string, req types.TenantCARequest) (types.TenantCA, error) {
+	return types.TenantCA{
+		TenantID:    tenantID,
+		Certificate: req.Certificate,
+		Subject:     "CN=tenant CA",
+	}, nil
+}
+
+func (ts testCiaoService) DeleteTenantCA(tenantID string) error {
 	return nil
 }
 
-func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+func (ts testCiaoService) FreezeTenant(tenantID string, req types.TenantFreezeRequest) error {
 	return nil
 }
 
-func (ts testCiaoService) ListTenants() ([]types.TenantSummary, error) {
-	summary := types.TenantSummary{
-		ID:   "bc70dcd6-7298-4933-98a9-cded2d232d02",
-		Name: "Test Tenant",
+func (ts testCiaoService) ExportTenant(tenantID string) (types.TenantExport, error) {
+	export := types.TenantExport{
+		Version:   types.TenantExportVersion,
+		ID:        tenantID,
+		Quotas:    []types.QuotaDetails{{Name: "tenant-instances-quota", Value: 10}},
+		Workloads: []types.Workload{},
+		Templates: []types.LaunchTemplateRequest{},
+	}
+	export.Config.Name = "test"
+	export.Config.SubnetBits = 24
+	return export, nil
+}
+
+func (ts testCiaoService) ImportTenant(req types.TenantExport, validateOnly bool) (types.TenantImportResponse, error) {
+	if req.Version != types.TenantExportVersion {
+		return types.TenantImportResponse{}, types.ErrBadTenantExport
 	}
 
-	ref := fmt.Sprintf("/tenants/%s", summary.ID)
+	return types.TenantImportResponse{
+		TenantID:     req.ID,
+		ValidateOnly: validateOnly,
+		Classes: []types.TenantImportClassResult{
+			{Class: types.TenantImportTenant, Count: 1, Applied: !validateOnly},
+			{Class: types.TenantImportQuotas, Count: len(req.Quotas), Applied: !validateOnly},
+			{Class: types.TenantImportWorkloads},
+			{
+				Class:     types.TenantImportTemplates,
+				Count:     1,
+				Conflicts: []types.TenantImportConflict{{Name: "web", Reason: "Launch template already exists"}},
+			},
+		},
+	}, nil
+}
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+func (ts testCiaoService) RetryTenantNetwork(ctx context.Context, tenantID string) error {
+	if tenantID == "5f0cd9a4-7d0e-4ac5-9b0c-2f2d5c5c9e1a" {
+		return &types.TenantNetworkDegradedError{
+			TenantID: tenantID,
+			Reason:   `CNCI 0e4b3c35-3f6d-4ac1-a4c3-0a5d8a29a0d2 has invalid subnet "garbage"`,
+		}
 	}
 
-	summary.Links = append(summary.Links, link)
+	return nil
+}
 
-	return []types.TenantSummary{summary}, nil
+func (ts testCiaoService) ShowTenantNetwork(tenantID string) (types.TenantNetwork, error) {
+	return types.TenantNetwork{
+		TenantID:   tenantID,
+		SubnetBits: 29,
+		MaxSubnets: 1,
+		Subnets: []types.TenantSubnet{
+			{Subnet: "172.16.0.0/29", Capacity: 5, Used: 5, CNCIID: "d7d86208-b46c-4465-9018-fe14087d415f"},
+		},
+	}, nil
 }
 
-func (ts testCiaoService) ShowTenant(ID string) (types.TenantConfig, error) {
-	config := types.TenantConfig{
-		Name:       "Test Tenant",
-		SubnetBits: 24,
+func (ts testCiaoService) CreateSignedURL(tenantID string, req types.SignedURLRequest) (types.SignedURL, error) {
+	if req.Resource != types.SignedOperation {
+		return types.SignedURL{}, types.ErrBadRequest
 	}
 
-	return config, nil
+	return types.SignedURL{
+		URL:      fmt.Sprintf("/signed/%s/%s?expires=60&signature=abcdef&tenant=%s", req.Resource, req.ID, tenantID),
+		Resource: req.Resource,
+		ID:       req.ID,
+		TenantID: tenantID,
+		Expires:  time.Unix(60, 0).UTC(),
+	}, nil
 }
 
-func (ts testCiaoService) PatchTenant(string, []byte) error {
-	return nil
+func (ts testCiaoService) ListUsage(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	return []types.UsageRecord{
+		{
+			TenantID:        "3390740c-dce9-48d6-b83a-a717417072ce",
+			Granularity:     filter.Granularity,
+			Start:           filter.Start,
+			End:             filter.End,
+			InstanceHours:   36,
+			VolumeGBHours:   240,
+			ExternalIPHours: 1.5,
+		},
+	}, nil
 }
 
-func (ts testCiaoService) CreateTenant(ID string, config types.TenantConfig) (types.TenantSummary, error) {
-	summary := types.TenantSummary{
-		ID:   ID,
-		Name: config.Name,
+func (ts testCiaoService) PrepareTenantNetwork(tenantID string, req types.TenantNetworkPrepareRequest) (types.Operation, error) {
+	if req.Subnet != "172.16.1.0/24" {
+		return types.Operation{}, types.ErrBadRequest
 	}
 
-	ref := fmt.Sprintf("/tenants/%s", summary.ID)
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+	return types.Operation{
+		ID:       testOperation().ID,
+		TenantID: tenantID,
+		Type:     types.PrepareNetworkOperation,
+		Target:   req.Subnet,
+		State:    types.OperationRunning,
+	}, nil
+}
+
+func (ts testCiaoService) Capabilities() types.Capabilities {
+	return types.Capabilities{
+		Version:   "1.0",
+		GitCommit: "abcdef",
+		Features:  map[string]bool{types.FeatureWebhooks: true},
 	}
-	summary.Links = append(summary.Links, link)
+}
 
-	return summary, nil
+func (ts testCiaoService) ShowTenantCapacity(tenantID string) (types.TenantCapacity, error) {
+	return types.TenantCapacity{
+		TenantID:     tenantID,
+		Updated:      time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		ReadyNodes:   2,
+		SampledNodes: 2,
+		Workloads: []types.WorkloadCapacity{
+			{
+				WorkloadID:  "ab68111c-03a6-11e7-8a96-0b3d3c2a4c8e",
+				Description: "testWorkload",
+				Cluster:     8,
+				Quota:       3,
+				Available:   3,
+			},
+		},
+	}, nil
 }
 
-func (ts testCiaoService) DeleteTenant(string) error {
-	return nil
+func (ts testCiaoService) ShowWorkloadCapacity(workloadID string) (types.WorkloadNodeCapacity, error) {
+	return types.WorkloadNodeCapacity{
+		WorkloadID: workloadID,
+		Total:      3,
+		Nodes: []types.NodeWorkloadCapacity{
+			{
+				NodeID:           "node1",
+				Hostname:         "host1",
+				Updated:          time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+				PendingInstances: 1,
+				MemAvailable:     3072,
+				DiskAvailable:    20480,
+				VCPUsAvailable:   6,
+				Instances:        3,
+			},
+		},
+	}, nil
 }
 
-func (ts testCiaoService) CreateImage(tenantID string, req CreateImageRequest) (types.Image, error) {
-	name := "Ubuntu"
-	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+func (ts testCiaoService) GetCNCIImage() (types.CNCIImage, error) {
+	return types.CNCIImage{
+		Image:         "0ac2ad34-3e63-4c58-a0d5-3a2f8a1ea2e1",
+		PreviousImage: "4e16e743-265a-4bf2-9fd1-57ada0b28904",
+	}, nil
+}
 
-	return types.Image{
-		State:      types.Created,
-		CreateTime: createdAt,
-		Visibility: types.Private,
-		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
-		Name:       name,
+func (ts testCiaoService) UpgradeCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	return types.Operation{
+		ID:     "d5e8f5d6-0c4b-4e0e-9c1a-3f8b7e6a5d4c",
+		Type:   types.UpgradeCNCIOperation,
+		Target: req.ImageID,
+		State:  types.OperationRunning,
 	}, nil
 }
 
-func (ts testCiaoService) ListImages(tenantID string) ([]types.Image, error) {
-	name := "Ubuntu"
-	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+func (ts testCiaoService) RollbackCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	return types.Operation{}, types.ErrNoPreviousCNCIImage
+}
 
-	image := types.Image{
-		State:      types.Created,
-		CreateTime: createdAt,
-		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
-		Name:       name,
-		Visibility: types.Public,
+func (ts testCiaoService) DeleteVolume(ctx context.Context, tenant string, volume string, force bool) error {
+	if volume == "protectedvolumeid" && !force {
+		return types.ErrDeletionProtected
 	}
+	return nil
+}
 
-	var images []types.Image
-	images = append(images, image)
+func (ts testCiaoService) ExtendVolume(ctx context.Context, tenant string, volume string, sizeGiB int, online bool) error {
+	if sizeGiB <= 2 {
+		return types.ErrBadVolumeSize
+	}
 
-	return images, nil
+	if volume == "inusevolumeid" && !online {
+		return types.ErrVolumeAttached
+	}
+
+	return nil
 }
 
-func (ts testCiaoService) GetImage(tenantID, ID string) (types.Image, error) {
-	imageID := "1bea47ed-f6a9-463b-b423-14b9cca9ad27"
-	name := "cirros-0.3.2-x86_64-disk"
-	createdAt, _ := time.Parse(time.RFC3339, "2014-05-05T17:15:10Z")
-	var size uint64 = 13167616
+func (ts testCiaoService) PatchVolume(ctx context.Context, tenant string, volume string, patch []byte) (types.Volume, error) {
+	var update types.VolumeUpdate
+	err := json.Unmarshal(patch, &update)
+	if err != nil {
+		return types.Volume{}, types.ErrBadRequest
+	}
 
-	return types.Image{
-		State:      types.Active,
-		CreateTime: createdAt,
-		Visibility: types.Public,
-		ID:         imageID,
-		Name:       name,
-		Size:       size,
-	}, nil
+	v, err := ts.ShowVolumeDetails(tenant, volume)
+	v.DeletionProtected = update.DeletionProtected
+
+	return v, err
 }
 
-func (ts testCiaoService) UploadImage(string, string, io.Reader) error {
+func (ts testCiaoService) AttachVolume(ctx context.Context, tenant string, volume string, instance string, mountpoint string, tag string) error {
+	if tag == "inuse" {
+		return types.ErrVolumeTagInUse
+	}
 	return nil
 }
 
-func (ts testCiaoService) DeleteImage(string, string) error {
+func (ts testCiaoService) DetachVolume(ctx context.Context, tenant string, volume string, attachment string) error {
 	return nil
 }
 
-func (ts testCiaoService) ShowVolumeDetails(tenant string, volume string) (types.Volume, error) {
-	return types.Volume{
-		BlockDevice: storage.BlockDevice{
-			ID:   "new-test-id",
-			Size: 123456,
-		},
-		State:       types.Available,
-		Name:        "my volume",
-		Description: "my volume for stuff",
-		TenantID:    "test-tenant-id",
-	}, nil
+func (ts testCiaoService) AttachVolumeToInstance(ctx context.Context, tenant string, volume string, instance string) (types.Operation, error) {
+	if volume == "busyvolumeid" {
+		return types.Operation{}, types.ErrVolumeBusy
+	}
+	return testOperation(), nil
 }
 
-func (ts testCiaoService) CreateVolume(tenant string, req RequestedVolume) (types.Volume, error) {
-	return types.Volume{
-		BlockDevice: storage.BlockDevice{
-			ID:   "new-test-id",
-			Size: 123456,
-		},
-		State:       types.Available,
-		Name:        "new volume",
-		Description: "newly created volume",
-		TenantID:    "test-tenant-id",
-	}, nil
+func (ts testCiaoService) DetachVolumeFromInstance(ctx context.Context, tenant string, volume string, instance string) (types.Operation, error) {
+	if instance == "stoppedinstanceid" {
+		return types.Operation{}, types.ErrInstanceNotRunning
+	}
+	return testOperation(), nil
 }
 
-func (ts testCiaoService) DeleteVolume(tenant string, volume string) error {
+func (ts testCiaoService) ForceDetachVolume(ctx context.Context, volume string, confirm bool) error {
+	if volume == "activevolumeid" && !confirm {
+		return types.ErrVolumeInstanceActive
+	}
 	return nil
 }
 
-func (ts testCiaoService) AttachVolume(tenant string, volume string, instance string, mountpoint string) error {
+func (ts testCiaoService) SetVolumeState(ctx context.Context, volume string, state types.BlockState, reason string) error {
 	return nil
 }
 
-func (ts testCiaoService) DetachVolume(tenant string, volume string, attachment string) error {
-	return nil
+func (ts testCiaoService) ListAttachments(filter types.AttachmentFilter) (types.ListAttachmentsResponse, error) {
+	stateTime, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	a := types.AttachmentDetails{
+		ID:         "1f4e3b2a-6c5d-4e7f-8a9b-0c1d2e3f4a5b",
+		TenantID:   "validtenantid",
+		InstanceID: "validinstanceid",
+		VolumeID:   "validvolumeid",
+		NodeID:     filter.NodeID,
+		State:      filter.State,
+		StateTime:  stateTime,
+	}
+
+	resp := types.ListAttachmentsResponse{Attachments: []types.AttachmentDetails{a}}
+	if filter.Limit == 1 {
+		resp.NextMarker = a.ID
+	}
+
+	return resp, nil
 }
 
 func (ts testCiaoService) ListVolumesDetail(tenant string) ([]types.Volume, error) {
@@ -663,14 +2751,31 @@ func (ts testCiaoService) ListVolumesDetail(tenant string) ([]types.Volume, erro
 	}, nil
 }
 
-func (ts testCiaoService) CreateServer(tenant string, req CreateServerRequest) (interface{}, error) {
+func (ts testCiaoService) CreateServer(ctx context.Context, tenant string, req CreateServerRequest) (interface{}, error) {
+	if req.Server.Name == "batch" {
+		return nil, &BatchLaunchError{
+			Servers: Servers{
+				TotalServers: 1,
+				Servers:      []ServerDetails{{ID: "validServerID", Name: "batch-0"}},
+			},
+			Launches: []InstanceLaunch{
+				{Name: "batch-0", ID: "validServerID"},
+				{Name: "batch-1", Err: &types.LaunchError{Code: types.LaunchQuotaExceeded, Err: types.ErrQuota}},
+			},
+		}
+	}
+
 	req.Server.ID = "validServerID"
 	return req, nil
 }
 
-func (ts testCiaoService) ListServersDetail(tenant string) ([]ServerDetails, error) {
+func (ts testCiaoService) ListServersDetail(tenant string, match types.InstanceFilter, filter types.ListFilter) ([]ServerDetails, string, error) {
 	var servers []ServerDetails
 
+	if match.State != "" && match.State != "active" {
+		return servers, "", nil
+	}
+
 	server := ServerDetails{
 		NodeID:     "nodeUUID",
 		ID:         "testUUID",
@@ -687,7 +2792,12 @@ func (ts testCiaoService) ListServersDetail(tenant string) ([]ServerDetails, err
 
 	servers = append(servers, server)
 
-	return servers, nil
+	next := ""
+	if filter.Limit == 1 {
+		next = types.ListCursor{CreateTime: server.Created, ID: server.ID}.Marker()
+	}
+
+	return servers, next, nil
 }
 
 func (ts testCiaoService) ShowServerDetails(tenant string, server string) (Server, error) {
@@ -708,7 +2818,111 @@ func (ts testCiaoService) ShowServerDetails(tenant string, server string) (Serve
 	return Server{Server: s}, nil
 }
 
-func (ts testCiaoService) DeleteServer(tenant string, server string) error {
+func (ts testCiaoService) PatchServer(tenant string, server string, patch []byte) (Server, error) {
+	var update types.InstanceUpdate
+	err := json.Unmarshal(patch, &update)
+	if err != nil {
+		return Server{}, types.ErrBadRequest
+	}
+
+	switch update.Name {
+	case "inuse":
+		return Server{}, types.ErrInstanceNameInUse
+	case "c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3":
+		return Server{}, types.ErrBadInstanceName
+	}
+
+	s, err := ts.ShowServerDetails(tenant, server)
+	s.Server.Name = update.Name
+	s.Server.Description = update.Description
+
+	return s, err
+}
+
+func (ts testCiaoService) ShowInstancePlacements(instanceID string) (types.InstancePlacements, error) {
+	return types.InstancePlacements{
+		InstanceID: instanceID,
+		NodeID:     "nodeUUID",
+		Placements: []types.Placement{
+			{
+				NodeID:    "nodeUUID",
+				Timestamp: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+				Reason:    types.PlacementInitial,
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ShowInstanceHistory(tenant string, instanceID string, filter types.InstanceHistoryFilter) (types.InstanceHistory, error) {
+	entries := []types.InstanceHistoryEntry{
+		{
+			Timestamp: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			Type:      types.HistoryCreated,
+			Message:   "Created from workload testWorkloadUUID",
+			Actor:     "admin",
+		},
+		{
+			Timestamp: time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC),
+			Type:      types.HistoryPlacement,
+			Message:   "Placed on node (initial)",
+			NodeID:    "nodeUUID",
+		},
+	}
+
+	history := types.InstanceHistory{
+		InstanceID: instanceID,
+		TenantID:   "validtenantid",
+		Entries:    entries[filter.Marker:],
+	}
+	if filter.Limit < len(history.Entries) {
+		history.Entries = history.Entries[:filter.Limit]
+		history.NextMarker = fmt.Sprintf("%d", filter.Marker+filter.Limit)
+	}
+
+	return history, nil
+}
+
+func (ts testCiaoService) ShowConsoleLog(tenant string, instanceID string, length int) (types.ConsoleLog, error) {
+	if instanceID == "pendingid" {
+		return types.ConsoleLog{}, types.ErrInstancePending
+	}
+
+	lines := []string{
+		"Ubuntu 16.04 LTS ciao ttyS0",
+		"ciao login: ",
+	}
+	if length < len(lines) {
+		lines = lines[len(lines)-length:]
+	}
+
+	return types.ConsoleLog{
+		InstanceID: instanceID,
+		Lines:      lines,
+	}, nil
+}
+
+func (ts testCiaoService) SetInstanceTag(tenant string, instanceID string, key string, value string) error {
+	if strings.Contains(key, ":") {
+		return types.ErrBadInstanceTag
+	}
+	return nil
+}
+
+func (ts testCiaoService) DeleteInstanceTag(tenant string, instanceID string, key string) error {
+	if key == "missing" {
+		return types.ErrInstanceTagNotFound
+	}
+	return nil
+}
+
+func (ts testCiaoService) TenantNodeVisibility() bool {
+	return false
+}
+
+func (ts testCiaoService) DeleteServer(ctx context.Context, tenant string, server string, force bool) error {
+	if server == "protectedid" && !force {
+		return types.ErrDeletionProtected
+	}
 	return nil
 }
 
@@ -720,10 +2934,154 @@ func (ts testCiaoService) StopServer(tenant string, server string) error {
 	return nil
 }
 
+func (ts testCiaoService) RestoreServer(tenant string, server string) error {
+	return nil
+}
+
+func (ts testCiaoService) MigrateInstance(tenant string, instance string, nodeID string) (types.Operation, error) {
+	return types.Operation{
+		ID:       testOperation().ID,
+		TenantID: tenant,
+		Type:     types.MigrateInstanceOperation,
+		Target:   instance,
+		State:    types.OperationRunning,
+	}, nil
+}
+
+func (ts testCiaoService) ResizeInstance(tenant string, instance string, vcpus int, memMB int) error {
+	return nil
+}
+
+func testWebhook() types.Webhook {
+	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+	ID := "8ce9b5c5-2a8b-4f43-95a6-2b4e5d4c6d2e"
+
+	return types.Webhook{
+		ID:         ID,
+		URL:        "https://example.com/hook",
+		Secret:     "s3cr3t",
+		EventTypes: []types.EventType{types.InstanceFailedEvent},
+		State:      types.WebhookActive,
+		CreateTime: createdAt,
+		Links: []types.Link{
+			{
+				Rel:  "self",
+				Href: fmt.Sprintf("/webhooks/%s", ID),
+			},
+		},
+	}
+}
+
+var testEvents = []types.CiaoEvent{
+	{
+		ID:        1,
+		Timestamp: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		TenantID:  "093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		EventType: "info",
+		Message:   "Deleted Instance 5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35",
+		ObjectID:  "5b4d4ee8-2ab3-4de7-a0cf-d4d9d1fe7c35",
+	},
+	{
+		ID:        2,
+		Timestamp: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		TenantID:  "bc70dcd6-7298-4933-98a9-cded2d232d02",
+		EventType: "action",
+		Message:   "DELETE /bc70dcd6-7298-4933-98a9-cded2d232d02/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3",
+		ObjectID:  "c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3",
+		Actor:     "admin",
+	},
+}
+
+func (ts testCiaoService) ListEvents(filter types.EventFilter) (types.CiaoEvents, error) {
+	return ts.ListTenantEvents("", filter)
+}
+
+func (ts testCiaoService) ListTenantEvents(tenantID string, filter types.EventFilter) (types.CiaoEvents, error) {
+	events := types.NewCiaoEvents()
+
+	for _, e := range testEvents {
+		if tenantID != "" && e.TenantID != tenantID || e.ID <= filter.Marker {
+			continue
+		}
+
+		events.Events = append(events.Events, e)
+		if len(events.Events) == filter.Limit {
+			events.NextMarker = strconv.FormatInt(e.ID, 10)
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// StreamEvents returns the test events logged after lastEventID as the
+// backlog and all the test events, which are skipped if they were in the
+// backlog, as the logged events.
+func (ts testCiaoService) StreamEvents(tenantID string, lastEventID int64) (EventStream, error) {
+	var stream EventStream
+
+	if lastEventID > 0 {
+		backlog, _ := ts.ListTenantEvents(tenantID, types.EventFilter{Marker: lastEventID})
+		stream.Backlog = backlog.Events
+	}
+
+	all, _ := ts.ListTenantEvents(tenantID, types.EventFilter{})
+	events := make(chan types.CiaoEvent, len(all.Events))
+	for _, e := range all.Events {
+		events <- e
+	}
+	close(events)
+
+	stream.Events = events
+	stream.Close = func() {}
+
+	return stream, nil
+}
+
+func (ts testCiaoService) ListAuditRecords(filter types.AuditFilter) (types.AuditResponse, error) {
+	resp := types.AuditResponse{Records: []types.AuditRecord{}}
+
+	if filter.Start.IsZero() {
+		return resp, nil
+	}
+
+	resp.Records = append(resp.Records, types.AuditRecord{
+		ID:        7,
+		Timestamp: filter.Start,
+		RequestID: "d8aa2ebc-9ed4-4ba5-9c15-2f18e6c7f1e3",
+		TenantID:  filter.TenantID,
+		Actor:     "user",
+		Method:    "DELETE",
+		Resource:  "/" + filter.TenantID + "/instances/c5ea8e3f-f0b6-4e13-bd4b-fd0e9ee1e0a3",
+		Status:    http.StatusAccepted,
+	})
+	if len(resp.Records) == filter.Limit {
+		resp.NextMarker = "7"
+	}
+
+	return resp, nil
+}
+
+func (ts testCiaoService) ListWebhooks() ([]types.Webhook, error) {
+	return []types.Webhook{testWebhook()}, nil
+}
+
+func (ts testCiaoService) AddWebhook(req types.NewWebhookRequest) (types.Webhook, error) {
+	return testWebhook(), nil
+}
+
+func (ts testCiaoService) ShowWebhook(ID string) (types.Webhook, error) {
+	return testWebhook(), nil
+}
+
+func (ts testCiaoService) DeleteWebhook(ID string) error {
+	return nil
+}
+
 func TestResponse(t *testing.T) {
 	var ts testCiaoService
 
-	mux := Routes(Config{"", ts}, nil)
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
 
 	for i, tt := range tests {
 		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
@@ -751,10 +3109,96 @@ func TestResponse(t *testing.T) {
 
 func TestRoutes(t *testing.T) {
 	var ts testCiaoService
-	config := Config{"", ts}
+	config := Config{URL: "", CiaoService: ts}
 
 	r := Routes(config, nil)
 	if r == nil {
 		t.Fatalf("No routes returned")
 	}
 }
+
+func TestLaunchFailureResponse(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&types.LaunchError{Code: types.LaunchQuotaExceeded, Err: types.ErrQuota}, http.StatusForbidden},
+		{&types.LaunchError{Code: types.LaunchNoCapacity, Err: errors.New("full")}, http.StatusServiceUnavailable},
+		{&types.LaunchError{Code: types.LaunchStorageError, Err: errors.New("ceph")}, http.StatusInternalServerError},
+		{&types.LaunchError{Code: types.LaunchNetworkNotReady, Err: errors.New("no cnci")}, http.StatusServiceUnavailable},
+		{&types.LaunchError{Code: types.LaunchInvalidRequest, Err: errors.New("bad")}, http.StatusBadRequest},
+		{&types.LaunchError{Code: types.LaunchInvalidRequest, Err: types.ErrWorkloadNotFound}, http.StatusNotFound},
+		{&types.LaunchError{Code: types.LaunchNodeError, Err: errors.New("launcher")}, http.StatusBadGateway},
+		{&types.LaunchError{Code: types.LaunchLimitExceeded, Err: types.ErrLaunchLimit}, http.StatusTooManyRequests},
+		{&types.LaunchError{Code: types.LaunchNetworkFull, Err: types.ErrSubnetExhausted}, http.StatusConflict},
+		{&types.LaunchError{Code: types.LaunchNetworkFull, Err: &types.SubnetFullError{Subnet: "172.16.0.0/29", Capacity: 5}}, http.StatusConflict},
+		{&types.LaunchError{Code: types.LaunchPlacementConflict, Err: errors.New("anti-affinity")}, http.StatusConflict},
+		{&types.LaunchError{Code: types.LaunchInternal, Err: errors.New("datastore")}, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		launchErr := errors.Wrap(tt.err, "Error creating instance")
+		h := Handler{
+			Context: &Context{Log: clogger.CiaoNullLogger{}},
+			Handler: func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+				return errorResponse(launchErr), launchErr
+			},
+		}
+
+		req, err := http.NewRequest("POST", "/servers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		code := tt.err.(*types.LaunchError).Code
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", code, tt.status, rr.Code)
+		}
+
+		var body HTTPReturnErrorCode
+		err = json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Error.FailureCode != string(code) {
+			t.Errorf("%s: expected failure code in response, got %q", code, body.Error.FailureCode)
+		}
+	}
+}
+
+func TestWorkloadValidationResponse(t *testing.T) {
+	violations := []string{"workload_requirements.mem_mb must be positive", "image_name is required for docker workloads"}
+	validationErr := &types.WorkloadValidationError{Violations: violations}
+	h := Handler{
+		Context: &Context{Log: clogger.CiaoNullLogger{}},
+		Handler: func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+			return errorResponse(validationErr), validationErr
+		},
+	}
+
+	req, err := http.NewRequest("POST", "/workloads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	var body HTTPReturnErrorCode
+	err = json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(body.Error.Violations, violations) {
+		t.Fatalf("Expected violations %v, got %v", violations, body.Error.Violations)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
+)
+
+// apiKeyBytes is the number of random bytes in an API key.
+const apiKeyBytes = 32
+
+// apiKeyLastUsedPeriod is how often the last used time of an API key is
+// written to the datastore while the key is in use.
+const apiKeyLastUsedPeriod = time.Minute
+
+// API key names follow the rules for instance names.
+var apiKeyNameRegexp = regexp.MustCompile("^[a-z0-9-]{1,64}$")
+
+// apiKeyScopeAliases maps the resources of the legacy compute API to the
+// resource groups which grant access to them.
+var apiKeyScopeAliases = map[string]string{
+	"servers":   "instances",
+	"resources": "tenants",
+	"quotas":    "tenants",
+}
+
+// hashAPIKey returns the hash of an API key under which the key is stored.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyScope returns the scope an API key needs to be used for the route
+// with the given path template, which is the resource group following the
+// tenant in the path, e.g. "instances" for /{tenant}/instances/{id}.  Routes
+// which do not belong to a tenant have no scope.
+func apiKeyScope(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		if !strings.HasPrefix(s, "{tenant") {
+			continue
+		}
+
+		// the tenant itself lists the tenant's resources
+		if i+1 == len(segments) {
+			return "tenants"
+		}
+
+		scope := segments[i+1]
+		if alias, ok := apiKeyScopeAliases[scope]; ok {
+			return alias
+		}
+		return scope
+	}
+
+	return ""
+}
+
+// bearerToken returns the token of the Authorization header of r, if the
+// header holds a bearer token.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+
+	token := strings.TrimSpace(auth[len(prefix):])
+	return token, token != ""
+}
+
+// ListAPIKeys returns the API keys of a tenant.  The keys themselves are
+// not stored and cannot be returned.
+func (c *controller) ListAPIKeys(tenantID string) ([]types.APIKey, error) {
+	return c.ds.GetAPIKeys(tenantID), nil
+}
+
+// CreateAPIKey creates an API key for a tenant limited to the resource
+// groups in the request.  The key is returned only in the response, only
+// its hash is stored.
+func (c *controller) CreateAPIKey(tenantID string, req types.APIKeyRequest) (types.NewAPIKey, error) {
+	if !apiKeyNameRegexp.MatchString(req.Name) || len(req.Scopes) == 0 {
+		return types.NewAPIKey{}, types.ErrBadAPIKey
+	}
+
+	now := time.Now()
+	if !req.ExpireTime.IsZero() && !req.ExpireTime.After(now) {
+		return types.NewAPIKey{}, types.ErrBadAPIKey
+	}
+
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !api.IsResourceGroup(scope) {
+			return types.NewAPIKey{}, types.ErrBadAPIKey
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return types.NewAPIKey{}, errors.Wrap(err, "Error generating API key")
+	}
+	key := base64.RawURLEncoding.EncodeToString(b)
+
+	k := types.APIKey{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		Name:       req.Name,
+		Scopes:     scopes,
+		Hash:       hashAPIKey(key),
+		ExpireTime: req.ExpireTime,
+		CreateTime: now,
+	}
+
+	if err := c.ds.AddAPIKey(k); err != nil {
+		return types.NewAPIKey{}, err
+	}
+
+	return types.NewAPIKey{APIKey: k, Key: key}, nil
+}
+
+// DeleteAPIKey revokes an API key of a tenant.  Requests made with the key
+// are refused from then on.
+func (c *controller) DeleteAPIKey(tenantID string, keyID string) error {
+	return c.ds.DeleteAPIKey(tenantID, keyID)
+}
+
+// authenticateAPIKey returns the API key matching key if it has not expired
+// and its tenant still exists, and records its use.
+func (c *controller) authenticateAPIKey(key string) (types.APIKey, error) {
+	k, err := c.ds.GetAPIKeyByHash(hashAPIKey(key))
+	if err != nil {
+		return k, err
+	}
+
+	now := time.Now()
+	if k.Expired(now) {
+		return types.APIKey{}, errors.New("API key expired")
+	}
+
+	tenant, err := c.ds.GetTenant(k.TenantID)
+	if err != nil || tenant == nil {
+		return types.APIKey{}, types.ErrTenantNotFound
+	}
+
+	if now.Sub(k.LastUsedTime) >= apiKeyLastUsedPeriod {
+		if err := c.ds.UpdateAPIKeyLastUsed(k.ID, now); err != nil {
+			c.log.Warningf("Unable to record use of API key %s: %v", k.ID, err)
+		}
+	}
+
+	return k, nil
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// apiKeyRequest makes a request authenticated by key alone and returns the
+// status and the body of the response.
+func apiKeyRequest(t *testing.T, key string, method string, url string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func createTestAPIKey(t *testing.T, tenantID string, scopes ...string) types.NewAPIKey {
+	k, err := ctl.CreateAPIKey(tenantID, types.APIKeyRequest{Name: "ci", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	tests := []struct {
+		path  string
+		scope string
+	}{
+		{"/{tenant:[0-9a-f-]+}/instances/{instance_id}", "instances"},
+		{"/{tenant}/volumes", "volumes"},
+		{"/{tenant:[0-9a-f-]+}", "tenants"},
+		{"/v2.1/{tenant}/servers/action", "instances"},
+		{"/v2.1/{tenant}/quotas", "tenants"},
+		{"/tenants/{for_tenant:[0-9a-f-]+}/quotas", ""},
+		{"/workloads", ""},
+	}
+
+	for _, test := range tests {
+		if scope := apiKeyScope(test.path); scope != test.scope {
+			t.Errorf("Expected scope %q for %s, got %q", test.scope, test.path, scope)
+		}
+	}
+}
+
+func TestAPIKeyScopeEnforcement(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := createTestAPIKey(t, tenant.ID, "instances", "workloads")
+	tenantURL := testutil.ComputeURL + "/" + tenant.ID
+
+	for _, url := range []string{tenantURL + "/instances/detail", tenantURL + "/workloads"} {
+		if status, body := apiKeyRequest(t, k.Key, "GET", url); status != http.StatusOK {
+			t.Errorf("Request to %s in scope refused: %d %s", url, status, body)
+		}
+	}
+
+	status, body := apiKeyRequest(t, k.Key, "GET", tenantURL+"/volumes")
+	if status != http.StatusForbidden || !strings.Contains(body, "scope volumes") {
+		t.Errorf("Expected request out of scope to be forbidden naming the scope: %d %s", status, body)
+	}
+
+	status, _ = apiKeyRequest(t, k.Key, "GET", testutil.ComputeURL+"/"+other.ID+"/instances/detail")
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected request for another tenant to be refused: %d", status)
+	}
+
+	status, _ = apiKeyRequest(t, k.Key, "GET", testutil.ComputeURL+"/tenants")
+	if status != http.StatusForbidden {
+		t.Errorf("Expected admin request to be forbidden: %d", status)
+	}
+
+	status, _ = apiKeyRequest(t, "not-a-key", "GET", tenantURL+"/instances/detail")
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected request with unknown key to be refused: %d", status)
+	}
+
+	keys, err := ctl.ListAPIKeys(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0].LastUsedTime.IsZero() {
+		t.Errorf("Use of API key not recorded: %+v", keys)
+	}
+}
+
+func TestAPIKeyRevocation(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := createTestAPIKey(t, tenant.ID, "instances")
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances/detail"
+
+	if status, _ := apiKeyRequest(t, k.Key, "GET", url); status != http.StatusOK {
+		t.Fatalf("Request with API key refused: %d", status)
+	}
+
+	err = ctl.DeleteAPIKey(tenant.ID, k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := apiKeyRequest(t, k.Key, "GET", url); status != http.StatusUnauthorized {
+		t.Fatalf("Request with revoked API key not refused: %d", status)
+	}
+
+	err = ctl.DeleteAPIKey(tenant.ID, k.ID)
+	if err != types.ErrAPIKeyNotFound {
+		t.Fatalf("Expected %v deleting revoked key, got %v", types.ErrAPIKeyNotFound, err)
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.CreateAPIKey(tenant.ID, types.APIKeyRequest{
+		Name:       "ci",
+		Scopes:     []string{"instances"},
+		ExpireTime: time.Now().Add(-time.Minute),
+	})
+	if err != types.ErrBadAPIKey {
+		t.Fatalf("Expected %v creating expired key, got %v", types.ErrBadAPIKey, err)
+	}
+
+	k, err := ctl.CreateAPIKey(tenant.ID, types.APIKeyRequest{
+		Name:       "ci",
+		Scopes:     []string{"instances"},
+		ExpireTime: time.Now().Add(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.authenticateAPIKey(k.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Until(k.ExpireTime))
+
+	_, err = ctl.authenticateAPIKey(k.Key)
+	if err == nil {
+		t.Fatal("Expired API key accepted")
+	}
+}
+
+func TestAPIKeyHashing(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := createTestAPIKey(t, tenant.ID, "instances")
+	if k.Key == "" || k.Hash != hashAPIKey(k.Key) || strings.Contains(k.Hash, k.Key) {
+		t.Fatalf("API key not stored as its hash: %+v", k)
+	}
+
+	keys, err := ctl.ListAPIKeys(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(types.ListAPIKeysResponse{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), k.Key) || strings.Contains(string(b), k.Hash) {
+		t.Fatalf("API key listing reveals the key: %s", string(b))
+	}
+
+	// the key cannot be used in place of its hash or vice versa
+	if _, err := ctl.ds.GetAPIKeyByHash(k.Key); err != types.ErrAPIKeyNotFound {
+		t.Fatalf("API key found by the key itself: %v", err)
+	}
+
+	if _, err := ctl.authenticateAPIKey(k.Hash); err == nil {
+		t.Fatal("Hash of API key accepted as the key")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// auditBody keeps the first limit bytes of a request body as they are read
+// by the handler of the request and counts the bytes read.
+type auditBody struct {
+	io.ReadCloser
+	limit int64
+	size  int64
+	data  bytes.Buffer
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if keep := b.limit - int64(b.data.Len()); keep > 0 {
+			if keep > int64(n) {
+				keep = int64(n)
+			}
+			_, _ = b.data.Write(p[:keep])
+		}
+		b.size += int64(n)
+	}
+
+	return n, err
+}
+
+// auditRecorder records the status of the response to a mutating API
+// request and the body of the request for the audit log.
+type auditRecorder struct {
+	statusRecorder
+	body  *auditBody
+	start time.Time
+}
+
+// newAuditRecorder starts auditing r.  The body of r is replaced so that
+// it is recorded as it is read.
+func (c *controller) newAuditRecorder(w http.ResponseWriter, r *http.Request) *auditRecorder {
+	limit := int64(c.config.config().AuditBodyLimit) * 1024
+
+	body := &auditBody{ReadCloser: r.Body, limit: limit}
+	r.Body = body
+
+	return &auditRecorder{
+		statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK},
+		body:           body,
+		start:          time.Now(),
+	}
+}
+
+// auditRequest records a mutating API request in the audit log, and in the
+// audit file if there is one.  The body of the request is only recorded if
+// it was read in full and is no larger than audit_body_limit_kb.
+func (c *controller) auditRequest(r *http.Request, rec *auditRecorder) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	if tenantID == "" {
+		tenantID = vars["for_tenant"]
+	}
+
+	record := types.AuditRecord{
+		Timestamp:  rec.start,
+		RequestID:  service.GetRequestID(ctx),
+		TenantID:   tenantID,
+		Actor:      service.GetActor(ctx),
+		OnBehalfOf: service.GetOnBehalfOf(ctx),
+		Method:     r.Method,
+		Resource:   r.URL.Path,
+		Status:     rec.status,
+		BodySize:   rec.body.size,
+	}
+
+	if r.ContentLength > record.BodySize {
+		record.BodySize = r.ContentLength
+	}
+
+	if record.BodySize == rec.body.size && record.BodySize <= rec.body.limit {
+		record.Body = rec.body.data.String()
+	}
+
+	err := c.ds.AddAuditRecord(record)
+	if err != nil {
+		c.log.Warningf("Unable to record audit: %v", err)
+	}
+
+	if path := c.config.config().AuditFile; path != "" {
+		err = c.auditFile.write(path, record)
+		if err != nil {
+			c.log.Warningf("Unable to write audit file: %v", err)
+		}
+	}
+}
+
+// auditFile is the file to which audit records are appended as JSON lines.
+// It is reopened when its path changes, or after it has been closed so
+// that it can be rotated.
+type auditFile struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+func (a *auditFile) write(path string, record types.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling audit record")
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.f != nil && a.path != path {
+		_ = a.f.Close()
+		a.f = nil
+	}
+
+	if a.f == nil {
+		a.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.Wrap(err, "Error opening audit file")
+		}
+		a.path = path
+	}
+
+	_, err = a.f.Write(append(line, '\n'))
+
+	return errors.Wrap(err, "Error writing audit file")
+}
+
+// close closes the file, which is reopened by the next write.
+func (a *auditFile) close() {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.f != nil {
+		_ = a.f.Close()
+		a.f = nil
+	}
+}
+
+// ListAuditRecords returns the audit records selected by filter, oldest
+// first.
+func (c *controller) ListAuditRecords(filter types.AuditFilter) (types.AuditResponse, error) {
+	records, err := c.ds.GetAuditRecords(filter)
+	if err != nil {
+		return types.AuditResponse{}, err
+	}
+
+	resp := types.AuditResponse{Records: records}
+
+	// a full page may be followed by more records
+	if filter.Limit > 0 && len(records) == filter.Limit {
+		resp.NextMarker = strconv.FormatInt(records[len(records)-1].ID, 10)
+	}
+
+	return resp, nil
+}
+
+// pruneAudit removes the audit records made more than audit_retention ago.
+func (c *controller) pruneAudit(cfg controllerConfig, now time.Time) {
+	pruned, err := c.ds.PruneAuditRecords(now.Add(-cfg.AuditRetention))
+	if err != nil {
+		c.log.Warningf("Unable to prune audit records: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d audit records", pruned)
+	}
+}
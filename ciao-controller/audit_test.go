@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "audit.json")
+
+	restore := setTestConfig(func(cfg *controllerConfig) {
+		cfg.AuditBodyLimit = 1
+		cfg.AuditFile = path
+	})
+	defer func() {
+		restore()
+		ctl.auditFile.close()
+	}()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/volumes"
+	small := `{"size": "one"}`
+	large := strings.Repeat(" ", 2048)
+
+	status, msg := testPostBody(t, url, strings.NewReader(small), int64(len(small)), tenant.ID)
+	if status < http.StatusBadRequest {
+		t.Fatalf("Expected invalid volume to be refused, got %d: %s", status, msg)
+	}
+
+	_, _ = testPostBody(t, url, strings.NewReader(large), int64(len(large)), tenant.ID)
+
+	// requests which cannot change anything are not audited
+	_ = testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, onBehalfOf(tenant.ID))
+
+	resp, err := ctl.ListAuditRecords(types.AuditFilter{TenantID: tenant.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := resp.Records
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 audit records got %+v", records)
+	}
+
+	r := records[0]
+	if r.Method != "POST" || r.Resource != "/"+tenant.ID+"/volumes" || r.Status != status ||
+		r.Actor == "" || r.OnBehalfOf != tenant.ID || r.RequestID == "" {
+		t.Errorf("Unexpected audit record %+v", r)
+	}
+
+	if r.Body != small || r.BodySize != int64(len(small)) {
+		t.Errorf("Small body not recorded: %+v", r)
+	}
+
+	if records[1].Body != "" || records[1].BodySize != int64(len(large)) {
+		t.Errorf("Large body should not be recorded: %+v", records[1])
+	}
+
+	resp, err = ctl.ListAuditRecords(types.AuditFilter{
+		TenantID: tenant.ID,
+		Start:    time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Records) != 0 {
+		t.Errorf("Expected no audit records in the future got %+v", resp.Records)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines in audit file got %q", data)
+	}
+
+	var line types.AuditRecord
+	err = json.Unmarshal([]byte(lines[0]), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line.RequestID != r.RequestID || line.Body != small {
+		t.Errorf("Unexpected audit file record %+v", line)
+	}
+}
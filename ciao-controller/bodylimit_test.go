@@ -0,0 +1,145 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// sizeReader generates a body of size bytes without holding it in memory
+// and records how much of it has been read.
+type sizeReader struct {
+	size int64
+	read int64
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	remaining := s.size - atomic.LoadInt64(&s.read)
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	for i := range p {
+		p[i] = ' '
+	}
+	atomic.AddInt64(&s.read, int64(len(p)))
+
+	return len(p), nil
+}
+
+func setBodyLimits(t *testing.T, apiLimit int, workloadLimit int) func() {
+	return setTestConfig(func(cfg *controllerConfig) {
+		cfg.APIBodyLimit = apiLimit
+		cfg.WorkloadBodyLimit = workloadLimit
+	})
+}
+
+// testPostBody posts body to url, announcing its length if known, and
+// returns the response status and body.
+func testPostBody(t *testing.T, url string, body io.Reader, length int64, tenantID string) (int, string) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/json")
+	if tenantID != "" {
+		req.Header = onBehalfOf(tenantID)
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := testHTTPClient(t).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+func TestBodyLimit(t *testing.T) {
+	defer setBodyLimits(t, 1, 64)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 256 * 1024 * 1024
+
+	tests := []struct {
+		url    string
+		tenant string
+		limit  string
+	}{
+		{testutil.ComputeURL + "/" + tenant.ID + "/volumes", tenant.ID, "1024"},
+		{testutil.ComputeURL + "/v2.1/" + tenant.ID + "/servers/action", tenant.ID, "1024"},
+		{testutil.ComputeURL + "/workloads", "", "65536"},
+		{testutil.ComputeURL + "/" + tenant.ID + "/workloads", tenant.ID, "65536"},
+	}
+
+	for _, test := range tests {
+		// bodies of unknown length are cut off once the limit is read.
+		body := &sizeReader{size: size}
+		status, msg := testPostBody(t, test.url, body, -1, test.tenant)
+		if status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected %d, got %d: %s", test.url, http.StatusRequestEntityTooLarge, status, msg)
+		}
+		if !strings.Contains(msg, test.limit) {
+			t.Errorf("%s: limit not stated: %s", test.url, msg)
+		}
+		if read := atomic.LoadInt64(&body.read); read >= size/8 {
+			t.Errorf("%s: %d bytes of oversized body read", test.url, read)
+		}
+
+		// bodies announcing their length are rejected before they are
+		// read.
+		body = &sizeReader{size: size}
+		status, msg = testPostBody(t, test.url, body, size, test.tenant)
+		if status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected %d, got %d: %s", test.url, http.StatusRequestEntityTooLarge, status, msg)
+		}
+		if !strings.Contains(msg, test.limit) {
+			t.Errorf("%s: limit not stated: %s", test.url, msg)
+		}
+		if read := atomic.LoadInt64(&body.read); read >= size/8 {
+			t.Errorf("%s: %d bytes of oversized body read", test.url, read)
+		}
+	}
+
+	// workload definitions may be larger than other requests.
+	body := strings.Repeat(" ", 32*1024) + "{}"
+	status, msg := testPostBody(t, testutil.ComputeURL+"/workloads", strings.NewReader(body), int64(len(body)), "")
+	if status == http.StatusRequestEntityTooLarge {
+		t.Errorf("Workload within limit rejected: %s", msg)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// version and gitCommit identify the controller build.  They are set when
+// linking, e.g. -ldflags "-X main.version=1.0 -X main.gitCommit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+)
+
+// compiledFeatures lists the optional features and whether they are built
+// into this controller.
+var compiledFeatures = map[string]bool{
+	types.FeatureSnapshots:          false,
+	types.FeatureMigrations:         true,
+	types.FeatureMetadataService:    false,
+	types.FeatureEventStream:        true,
+	types.FeatureWebhooks:           true,
+	types.FeatureImpersonation:      true,
+	types.FeatureTenantCAs:          true,
+	types.FeatureWorkloadOverrides:  true,
+	types.FeatureVolumeRepair:       true,
+	types.FeatureLeaderElection:     true,
+	types.FeatureDBMaintenance:      true,
+	types.FeatureNetworkPrepare:     true,
+	types.FeatureTenantNetworkRetry: true,
+	types.FeatureTrash:              true,
+	types.FeaturePoolAccess:         true,
+	types.FeatureInstanceHistory:    true,
+	types.FeatureCapacityHints:      true,
+	types.FeatureSubnetLimits:       true,
+	types.FeatureSignedURLs:         true,
+	types.FeatureUsageHistory:       true,
+	types.FeatureLaunchTemplates:    true,
+	types.FeatureServerGroups:       true,
+	types.FeatureSnapshotSchedules:  true,
+	types.FeatureVolumeSnapshots:    true,
+	types.FeatureImagePreseed:       true,
+	types.FeatureWorkloadPolicy:     true,
+	types.FeatureAuditLog:           true,
+	types.FeatureVolumeAttachments:  true,
+	types.FeatureSettings:           true,
+	types.FeatureTenantExport:       true,
+	types.FeatureConsoleLog:         true,
+	types.FeatureInstanceResize:     true,
+	types.FeatureInstanceTags:       true,
+	types.FeatureDeferredDelete:     true,
+	types.FeatureAuthTokens:         true,
+}
+
+// Capabilities reports the controller build and the optional features
+// which are both compiled in and enabled by the current configuration.
+func (c *controller) Capabilities() types.Capabilities {
+	cfg := c.config.config()
+
+	features := make(map[string]bool, len(compiledFeatures))
+	for f, compiled := range compiledFeatures {
+		features[f] = compiled
+	}
+
+	features[types.FeatureImpersonation] = features[types.FeatureImpersonation] && cfg.Impersonation
+	features[types.FeatureLeaderElection] = features[types.FeatureLeaderElection] && cfg.LeaderElection
+	features[types.FeatureDBMaintenance] = features[types.FeatureDBMaintenance] && cfg.DBMaintenance
+	features[types.FeatureSignedURLs] = features[types.FeatureSignedURLs] && cfg.SignedURLKeyPath != ""
+	features[types.FeatureAuthTokens] = features[types.FeatureAuthTokens] && cfg.TokenKeyPath != ""
+	features[types.FeatureUsageHistory] = features[types.FeatureUsageHistory] && cfg.UsageSampleInterval > 0
+
+	return types.Capabilities{
+		Version:   version,
+		GitCommit: gitCommit,
+		Features:  features,
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func getCapabilities(t *testing.T, url string) types.Capabilities {
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var caps types.Capabilities
+	err := json.Unmarshal(body, &caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return caps
+}
+
+func TestCapabilities(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{
+		testutil.ComputeURL + "/capabilities",
+		testutil.ComputeURL + "/" + tenant.ID + "/capabilities",
+	} {
+		caps := getCapabilities(t, url)
+
+		if caps.Version != version || caps.GitCommit != gitCommit {
+			t.Errorf("Unexpected build %s %s", caps.Version, caps.GitCommit)
+		}
+
+		if caps.APIVersions["volumes"] != api.VolumesV1 {
+			t.Errorf("Volumes API version not reported: %v", caps.APIVersions)
+		}
+
+		if caps.Features[types.FeatureSnapshots] {
+			t.Errorf("Snapshots reported but not compiled in")
+		}
+
+		if !caps.Features[types.FeatureVolumeRepair] {
+			t.Errorf("Volume repair not reported")
+		}
+	}
+}
+
+func TestCapabilitiesConfig(t *testing.T) {
+	url := testutil.ComputeURL + "/capabilities"
+
+	for _, enabled := range []bool{true, false} {
+		restore := setTestConfig(func(cfg *controllerConfig) {
+			cfg.Impersonation = enabled
+		})
+		caps := getCapabilities(t, url)
+		restore()
+
+		if caps.Features[types.FeatureImpersonation] != enabled {
+			t.Errorf("Impersonation reported as %v expected %v",
+				caps.Features[types.FeatureImpersonation], enabled)
+		}
+	}
+}
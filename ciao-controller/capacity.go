@@ -0,0 +1,287 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// capacitySampleSize is the maximum number of nodes of each role the
+// capacity hints are computed from.  On larger clusters the estimates are
+// extrapolated from a random sample so the hints stay cheap to compute.
+const capacitySampleSize = 64
+
+// nodeSample is a random sample of the ready nodes of one role.
+type nodeSample struct {
+	nodes []types.CiaoNode
+	ready int
+}
+
+// sampleNodes picks at most size of the nodes at random.
+func sampleNodes(nodes []types.CiaoNode, size int) nodeSample {
+	s := nodeSample{ready: len(nodes)}
+	if len(nodes) <= size {
+		s.nodes = nodes
+		return s
+	}
+
+	for _, i := range rand.Perm(len(nodes))[:size] {
+		s.nodes = append(s.nodes, nodes[i])
+	}
+
+	return s
+}
+
+// nodeCapacity returns how many instances needing memMB of memory and
+// diskMB of local disk the scheduler could still place on a node.
+func nodeCapacity(n types.CiaoNode, memMB int, diskMB int) int {
+	if memMB < 1 {
+		memMB = 1
+	}
+
+	count := n.MemAvailable / memMB
+	if diskMB > 0 && n.DiskAvailable/diskMB < count {
+		count = n.DiskAvailable / diskMB
+	}
+
+	if count < 0 {
+		return 0
+	}
+
+	return count
+}
+
+// workloadLocalStorage returns the total size of the storage the launcher
+// will create for each instance of wl.
+func workloadLocalStorage(wl *types.Workload) int {
+	size := 0
+	for _, s := range wl.Storage {
+		if s.ID == "" && s.Local {
+			size += s.Size
+		}
+	}
+	return size
+}
+
+// pinnedTo reports whether a workload pinned to a node or host may be
+// placed on n.
+func pinnedTo(n types.CiaoNode, wl *types.Workload) bool {
+	if wl.Requirements.NodeID != "" && wl.Requirements.NodeID != n.ID {
+		return false
+	}
+
+	return wl.Requirements.Hostname == "" || wl.Requirements.Hostname == n.Hostname
+}
+
+// clusterCapacity estimates how many instances of wl the ready nodes could
+// place.  Workloads pinned to a node or host are checked against all the
+// ready nodes as only a few of them can match.  Otherwise the capacity of
+// the sampled nodes is scaled up to the number of ready nodes.
+func clusterCapacity(wl *types.Workload, all []types.CiaoNode, sample nodeSample) int {
+	memMB := wl.Requirements.MemMB
+	diskMB := workloadLocalStorage(wl) * 1024
+
+	if wl.Requirements.NodeID != "" || wl.Requirements.Hostname != "" {
+		count := 0
+		for _, n := range all {
+			if pinnedTo(n, wl) {
+				count += nodeCapacity(n, memMB, diskMB)
+			}
+		}
+		return count
+	}
+
+	if len(sample.nodes) == 0 {
+		return 0
+	}
+
+	count := 0
+	for _, n := range sample.nodes {
+		count += nodeCapacity(n, memMB, diskMB)
+	}
+
+	return count * sample.ready / len(sample.nodes)
+}
+
+// launchResources returns the resources charged to the quotas of a tenant
+// when an instance of wl is launched, including the volumes created from
+// its storage.
+func launchResources(wl *types.Workload) []payloads.RequestedResource {
+	i := &types.Instance{EphemeralGB: workloadLocalStorage(wl)}
+	resources := instanceResources(i, wl)
+
+	for _, s := range wl.Storage {
+		if s.ID != "" || s.Local {
+			continue
+		}
+
+		resources = append(resources,
+			payloads.RequestedResource{Type: payloads.Volume, Value: 1},
+			payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: s.Size})
+	}
+
+	return resources
+}
+
+// ShowTenantCapacity estimates how many more instances of each of the
+// workloads visible to a tenant could be launched, given the current
+// capacity of the cluster and the remaining quota of the tenant.
+func (c *controller) ShowTenantCapacity(tenantID string) (types.TenantCapacity, error) {
+	wls, err := c.ListWorkloads(tenantID, "")
+	if err != nil {
+		return types.TenantCapacity{}, err
+	}
+
+	var compute, network []types.CiaoNode
+	for _, n := range c.ds.GetNodeLastStats().Nodes {
+		if n.Status != string(types.NodeStatusReady) {
+			continue
+		}
+
+		node, err := c.ds.GetNode(n.ID)
+		if err != nil {
+			continue
+		}
+
+		if node.NodeRole.IsNetAgent() {
+			network = append(network, n)
+		}
+		if node.NodeRole.IsAgent() {
+			compute = append(compute, n)
+		}
+	}
+
+	computeSample := sampleNodes(compute, capacitySampleSize)
+	networkSample := sampleNodes(network, capacitySampleSize)
+
+	capacity := types.TenantCapacity{
+		TenantID:     tenantID,
+		Updated:      time.Now(),
+		ReadyNodes:   computeSample.ready + networkSample.ready,
+		SampledNodes: len(computeSample.nodes) + len(networkSample.nodes),
+		Workloads:    make([]types.WorkloadCapacity, 0, len(wls)),
+	}
+
+	for _, s := range []nodeSample{computeSample, networkSample} {
+		for _, n := range s.nodes {
+			if !n.Timestamp.IsZero() && n.Timestamp.Before(capacity.Updated) {
+				capacity.Updated = n.Timestamp
+			}
+		}
+	}
+
+	for i := range wls {
+		wl := &wls[i]
+
+		nodes, sample := compute, computeSample
+		if wl.Requirements.NetworkNode {
+			nodes, sample = network, networkSample
+		}
+
+		wc := types.WorkloadCapacity{
+			WorkloadID:  wl.ID,
+			Description: wl.Description,
+			Cluster:     clusterCapacity(wl, nodes, sample),
+			Quota:       c.qs.Headroom(tenantID, launchResources(wl)...),
+		}
+
+		wc.Available = wc.Cluster
+		if wc.Quota >= 0 && wc.Quota < wc.Available {
+			wc.Available = wc.Quota
+		}
+
+		capacity.Workloads = append(capacity.Workloads, wc)
+	}
+
+	return capacity, nil
+}
+
+// workloadNodeCapacity returns how many instances of wl would fit in the
+// resources of a node which are free and not claimed by pending instances.
+func workloadNodeCapacity(n types.CiaoNode, a types.NodeAllocation, wl *types.Workload) types.NodeWorkloadCapacity {
+	nc := types.NodeWorkloadCapacity{
+		NodeID:           n.ID,
+		Hostname:         n.Hostname,
+		Updated:          n.Timestamp,
+		PendingInstances: a.PendingInstances,
+		MemAvailable:     n.MemAvailable - a.PendingMemMB,
+		DiskAvailable:    n.DiskAvailable - a.PendingDiskMB,
+		VCPUsAvailable:   n.OnlineCPUs - a.VCPUs,
+	}
+
+	free := n
+	free.MemAvailable = nc.MemAvailable
+	free.DiskAvailable = nc.DiskAvailable
+	nc.Instances = nodeCapacity(free, wl.Requirements.MemMB, workloadLocalStorage(wl)*1024)
+
+	if vcpus := wl.Requirements.VCPUs; vcpus > 0 {
+		count := nc.VCPUsAvailable / vcpus
+		if count < 0 {
+			count = 0
+		}
+		if count < nc.Instances {
+			nc.Instances = count
+		}
+	}
+
+	return nc
+}
+
+// ShowWorkloadCapacity computes how many more instances of a workload
+// would fit on each of the ready nodes which may host it, from the latest
+// stats of the nodes and the instances pending against them.
+func (c *controller) ShowWorkloadCapacity(workloadID string) (types.WorkloadNodeCapacity, error) {
+	wl, err := c.ds.GetWorkload(workloadID)
+	if err != nil {
+		return types.WorkloadNodeCapacity{}, err
+	}
+
+	capacity := types.WorkloadNodeCapacity{
+		WorkloadID: wl.ID,
+		Nodes:      []types.NodeWorkloadCapacity{},
+	}
+
+	allocations := c.ds.GetNodeAllocations()
+	for _, n := range c.ds.GetNodeLastStats().Nodes {
+		if n.Status != string(types.NodeStatusReady) || n.Maintenance || !pinnedTo(n, &wl) {
+			continue
+		}
+
+		node, err := c.ds.GetNode(n.ID)
+		if err != nil {
+			continue
+		}
+
+		if wl.Requirements.NetworkNode && !node.NodeRole.IsNetAgent() ||
+			!wl.Requirements.NetworkNode && !node.NodeRole.IsAgent() {
+			continue
+		}
+
+		nc := workloadNodeCapacity(n, allocations[n.ID], &wl)
+		capacity.Total += nc.Instances
+		capacity.Nodes = append(capacity.Nodes, nc)
+	}
+
+	sort.Slice(capacity.Nodes, func(i, j int) bool {
+		return capacity.Nodes[i].NodeID < capacity.Nodes[j].NodeID
+	})
+
+	return capacity, nil
+}
@@ -0,0 +1,395 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func capacityNodes(n int, memMB int, diskMB int) []types.CiaoNode {
+	nodes := make([]types.CiaoNode, n)
+	for i := range nodes {
+		nodes[i] = types.CiaoNode{
+			ID:            fmt.Sprintf("node-%d", i),
+			Hostname:      fmt.Sprintf("host-%d", i),
+			MemAvailable:  memMB,
+			DiskAvailable: diskMB,
+		}
+	}
+	return nodes
+}
+
+func TestClusterCapacity(t *testing.T) {
+	nodes := capacityNodes(4, 1000, 10240)
+
+	tests := []struct {
+		name     string
+		wl       types.Workload
+		expected int
+	}{
+		{
+			name: "memory",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{MemMB: 300},
+			},
+			expected: 12,
+		},
+		{
+			name: "local disk",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{MemMB: 100},
+				Storage:      []types.StorageResource{{Size: 5, Local: true}},
+			},
+			expected: 8,
+		},
+		{
+			name: "too big",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{MemMB: 2000},
+			},
+			expected: 0,
+		},
+		{
+			name: "pinned",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{MemMB: 300, NodeID: "node-1"},
+			},
+			expected: 3,
+		},
+		{
+			name: "pinned unknown host",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{MemMB: 300, Hostname: "host-9"},
+			},
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		c := clusterCapacity(&tt.wl, nodes, sampleNodes(nodes, capacitySampleSize))
+		if c != tt.expected {
+			t.Errorf("%s: expected %d got %d", tt.name, tt.expected, c)
+		}
+	}
+}
+
+func TestClusterCapacitySampled(t *testing.T) {
+	nodes := capacityNodes(capacitySampleSize*4, 1000, 10240)
+
+	sample := sampleNodes(nodes, capacitySampleSize)
+	if len(sample.nodes) != capacitySampleSize || sample.ready != len(nodes) {
+		t.Fatalf("Expected %d of %d nodes sampled got %d of %d",
+			capacitySampleSize, len(nodes), len(sample.nodes), sample.ready)
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range sample.nodes {
+		if seen[n.ID] {
+			t.Fatalf("Node %s sampled twice", n.ID)
+		}
+		seen[n.ID] = true
+	}
+
+	wl := types.Workload{
+		Requirements: payloads.WorkloadRequirements{MemMB: 500},
+	}
+	c := clusterCapacity(&wl, nodes, sample)
+	if c != len(nodes)*2 {
+		t.Fatalf("Expected %d got %d", len(nodes)*2, c)
+	}
+
+	// pinned workloads are not extrapolated from the sample
+	wl.Requirements.Hostname = "host-1"
+	c = clusterCapacity(&wl, nodes, sample)
+	if c != 2 {
+		t.Fatalf("Expected 2 got %d", c)
+	}
+}
+
+func addCapacityWorkload(t *testing.T, tenantID string, memMB int) types.Workload {
+	wl, err := ctl.CreateWorkload(types.Workload{
+		TenantID:    tenantID,
+		Description: "capacity workload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.Docker,
+		ImageName:   "ubuntu:latest",
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 1,
+			MemMB: memMB,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wl
+}
+
+// addCapacityNode adds a ready compute node to the cluster so that there is
+// room to launch the test workloads.
+func addCapacityNode(t *testing.T) string {
+	nodeID := uuid.Generate().String()
+	ctl.ds.AddNode(nodeID, payloads.ComputeNode)
+
+	stat := testutil.StatsPayload(nodeID, "capacity-node", nil, nil)
+	if err := ctl.ds.HandleStats(stat); err != nil {
+		t.Fatal(err)
+	}
+
+	return nodeID
+}
+
+func getTenantCapacity(t *testing.T, tenantID string, workloadID string) (types.TenantCapacity, types.WorkloadCapacity) {
+	url := testutil.ComputeURL + "/" + tenantID + "/capacity"
+	body := testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, onBehalfOf(tenantID))
+
+	var capacity types.TenantCapacity
+	err := json.Unmarshal(body, &capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if capacity.TenantID != tenantID || capacity.Updated.IsZero() {
+		t.Fatalf("Unexpected capacity %+v", capacity)
+	}
+
+	if capacity.SampledNodes > capacity.ReadyNodes {
+		t.Fatalf("%d nodes sampled from %d ready nodes", capacity.SampledNodes, capacity.ReadyNodes)
+	}
+
+	for _, wc := range capacity.Workloads {
+		if wc.WorkloadID == workloadID {
+			return capacity, wc
+		}
+	}
+
+	t.Fatalf("Workload %s missing from capacity", workloadID)
+	return capacity, types.WorkloadCapacity{}
+}
+
+func TestTenantCapacityQuotaLimited(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addCapacityWorkload(t, tenant.ID, 1)
+
+	nodeID := addCapacityNode(t)
+	defer func() { _ = ctl.ds.DeleteNode(nodeID) }()
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 2},
+	})
+
+	_, wc := getTenantCapacity(t, tenant.ID, wl.ID)
+	if wc.Quota != 2 || wc.Cluster <= 2 || wc.Available != 2 {
+		t.Fatalf("Expected quota limited capacity of 2 got %+v", wc)
+	}
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: -1},
+	})
+
+	_, wc = getTenantCapacity(t, tenant.ID, wl.ID)
+	if wc.Quota != -1 || wc.Available != wc.Cluster {
+		t.Fatalf("Expected unlimited quota got %+v", wc)
+	}
+}
+
+func TestTenantCapacityClusterLimited(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addCapacityWorkload(t, tenant.ID, 1<<30)
+
+	nodeID := addCapacityNode(t)
+	defer func() { _ = ctl.ds.DeleteNode(nodeID) }()
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 10},
+	})
+	defer ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: -1},
+	})
+
+	capacity, wc := getTenantCapacity(t, tenant.ID, wl.ID)
+	if capacity.ReadyNodes == 0 {
+		t.Fatal("Expected ready nodes")
+	}
+
+	if wc.Quota != 10 || wc.Cluster != 0 || wc.Available != 0 {
+		t.Fatalf("Expected cluster limited capacity of 0 got %+v", wc)
+	}
+}
+
+func TestWorkloadNodeCapacity(t *testing.T) {
+	n := types.CiaoNode{
+		ID:            "node-0",
+		MemAvailable:  4096,
+		DiskAvailable: 20480,
+		OnlineCPUs:    8,
+	}
+
+	tests := []struct {
+		name       string
+		wl         types.Workload
+		allocation types.NodeAllocation
+		expected   int
+	}{
+		{
+			name: "memory",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{VCPUs: 1, MemMB: 1024},
+			},
+			expected: 4,
+		},
+		{
+			name: "pending memory",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{VCPUs: 1, MemMB: 1024},
+			},
+			allocation: types.NodeAllocation{PendingInstances: 1, PendingMemMB: 2048},
+			expected:   2,
+		},
+		{
+			name: "pending disk",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{VCPUs: 1, MemMB: 256},
+				Storage:      []types.StorageResource{{Size: 5, Local: true}},
+			},
+			allocation: types.NodeAllocation{PendingInstances: 1, PendingDiskMB: 10240},
+			expected:   2,
+		},
+		{
+			name: "vcpus",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{VCPUs: 2, MemMB: 256},
+			},
+			allocation: types.NodeAllocation{Instances: 2, VCPUs: 4},
+			expected:   2,
+		},
+		{
+			name: "overcommitted",
+			wl: types.Workload{
+				Requirements: payloads.WorkloadRequirements{VCPUs: 1, MemMB: 256},
+			},
+			allocation: types.NodeAllocation{Instances: 5, VCPUs: 10},
+			expected:   0,
+		},
+	}
+
+	for _, test := range tests {
+		nc := workloadNodeCapacity(n, test.allocation, &test.wl)
+		if nc.Instances != test.expected {
+			t.Errorf("%s: expected %d got %d", test.name, test.expected, nc.Instances)
+		}
+	}
+}
+
+func getWorkloadNodeCapacity(t *testing.T, workloadID string, nodeID string) (types.WorkloadNodeCapacity, types.NodeWorkloadCapacity) {
+	url := testutil.ComputeURL + "/workloads/" + workloadID + "/capacity"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var capacity types.WorkloadNodeCapacity
+	err := json.Unmarshal(body, &capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, nc := range capacity.Nodes {
+		total += nc.Instances
+	}
+	if capacity.WorkloadID != workloadID || capacity.Total != total {
+		t.Fatalf("Unexpected capacity %+v", capacity)
+	}
+
+	for _, nc := range capacity.Nodes {
+		if nc.NodeID == nodeID {
+			return capacity, nc
+		}
+	}
+
+	t.Fatalf("Node %s missing from capacity", nodeID)
+	return capacity, types.NodeWorkloadCapacity{}
+}
+
+func TestShowWorkloadCapacity(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addCapacityWorkload(t, tenant.ID, 1024)
+
+	nodeID := uuid.Generate().String()
+	ctl.ds.AddNode(nodeID, payloads.ComputeNode)
+	defer func() { _ = ctl.ds.DeleteNode(nodeID) }()
+
+	stat := testutil.StatsPayload(nodeID, "capacity-node", nil, nil)
+	stat.MemAvailableMB = 4096
+	stat.CpusOnline = 4
+	if err := ctl.ds.HandleStats(stat); err != nil {
+		t.Fatal(err)
+	}
+
+	_, nc := getWorkloadNodeCapacity(t, wl.ID, nodeID)
+	if nc.Instances != 4 || nc.MemAvailable != 4096 || nc.VCPUsAvailable != 4 {
+		t.Fatalf("Expected room for 4 instances got %+v", nc)
+	}
+
+	// a pending instance is charged against the free memory of its node
+	// as well as its CPUs
+	states := []string{payloads.Pending, payloads.Running}
+	for _, state := range states {
+		i := &types.Instance{
+			ID:          uuid.Generate().String(),
+			TenantID:    tenant.ID,
+			WorkloadID:  wl.ID,
+			NodeID:      nodeID,
+			MACAddress:  uuid.Generate().String(),
+			State:       state,
+			CreateTime:  time.Now(),
+			StateChange: sync.NewCond(&sync.Mutex{}),
+		}
+		if err := ctl.ds.AddInstance(context.Background(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, nc = getWorkloadNodeCapacity(t, wl.ID, nodeID)
+	if nc.PendingInstances != 1 || nc.MemAvailable != 3072 || nc.VCPUsAvailable != 2 ||
+		nc.Instances != 2 {
+		t.Fatalf("Expected room for 2 instances got %+v", nc)
+	}
+
+	url := testutil.ComputeURL + "/workloads/" + uuid.Generate().String() + "/capacity"
+	_ = testHTTPRequest(t, "GET", url, http.StatusNotFound, nil, true)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The parts of the certificate the API host name can be taken from, as
+// listed in api_name_order.
+const (
+	nameSANDNS = "san_dns"
+	nameCN     = "cn"
+	nameSANIP  = "san_ip"
+)
+
+// lookupHost resolves host names found in the certificate.  It is replaced
+// by the tests.
+var lookupHost = net.LookupHost
+
+// parseNameOrder splits api_name_order into the list of certificate parts
+// to be tried.
+func parseNameOrder(order string) []string {
+	var parts []string
+	for _, p := range strings.Split(order, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// validateNameOrder checks that every part of api_name_order is known.
+func validateNameOrder(order string) error {
+	parts := parseNameOrder(order)
+	if len(parts) == 0 {
+		return errors.New("api_name_order must not be empty")
+	}
+
+	for _, p := range parts {
+		if p != nameSANDNS && p != nameCN && p != nameSANIP {
+			return fmt.Errorf("Unknown api_name_order entry: %s", p)
+		}
+	}
+
+	return nil
+}
+
+func getNameFromCert(httpsCAcert, httpsKey string, order []string) (string, error) {
+	cert, err := tls.LoadX509KeyPair(httpsCAcert, httpsKey)
+	if err != nil {
+		return "", errors.Wrap(err, "Error loading certificate pair")
+	}
+
+	// leaf is first
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("Expected at least one certificate in encoded data")
+	}
+
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", errors.Wrap(err, "Error parsing certificate")
+	}
+
+	return nameFromCert(c, order)
+}
+
+// nameFromCert returns the first name in the certificate which can be used
+// to reach the API, trying the parts of the certificate in order.  If none
+// can be used the error lists every name found.
+func nameFromCert(cert *x509.Certificate, order []string) (string, error) {
+	var found []string
+
+	for _, part := range order {
+		var names []string
+
+		switch part {
+		case nameSANDNS:
+			names = cert.DNSNames
+		case nameCN:
+			if cert.Subject.CommonName != "" {
+				names = []string{cert.Subject.CommonName}
+			}
+		case nameSANIP:
+			for _, ip := range cert.IPAddresses {
+				names = append(names, ip.String())
+			}
+		}
+
+		for _, name := range names {
+			err := checkHostName(name)
+			if err == nil {
+				return name, nil
+			}
+			found = append(found, fmt.Sprintf("%s %q (%v)", part, name, err))
+		}
+	}
+
+	if len(found) == 0 {
+		return "", fmt.Errorf("No names found in certificate using %s",
+			strings.Join(order, ","))
+	}
+
+	return "", fmt.Errorf("No usable name in certificate: %s",
+		strings.Join(found, ", "))
+}
+
+// checkHostName returns an error unless name is a literal IP address or a
+// host name which resolves.
+func checkHostName(name string) error {
+	if net.ParseIP(name) != nil {
+		return nil
+	}
+
+	if !isHostName(name) {
+		return errors.New("not a host name")
+	}
+
+	if _, err := lookupHost(name); err != nil {
+		return errors.New("does not resolve")
+	}
+
+	return nil
+}
+
+// isHostName returns true if name is a syntactically valid DNS host name.
+func isHostName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+				r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
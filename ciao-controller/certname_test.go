@@ -0,0 +1,232 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestCert returns a self signed certificate and its key in PEM
+// format.
+func createTestCert(t *testing.T, cn string, dnsNames []string, ips []net.IP) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func testLookupHost(host string) ([]string, error) {
+	switch host {
+	case "controller.example.com", "localhost":
+		return []string{"127.0.0.1"}, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func TestGetNameFromCert(t *testing.T) {
+	lookupHost = testLookupHost
+	defer func() { lookupHost = net.LookupHost }()
+
+	dir, err := ioutil.TempDir("", "controller_certname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	defaultOrder := parseNameOrder(defaultConfig().APINameOrder)
+
+	tests := []struct {
+		name     string
+		cn       string
+		dnsNames []string
+		ips      []net.IP
+		order    []string
+		expected string
+		err      string
+	}{
+		{
+			name:     "san only",
+			dnsNames: []string{"*.example.com", "controller.example.com"},
+			order:    defaultOrder,
+			expected: "controller.example.com",
+		},
+		{
+			name:     "cn only",
+			cn:       "localhost",
+			order:    defaultOrder,
+			expected: "localhost",
+		},
+		{
+			name:     "san preferred to cn",
+			cn:       "localhost",
+			dnsNames: []string{"controller.example.com"},
+			order:    defaultOrder,
+			expected: "controller.example.com",
+		},
+		{
+			name:     "cn preferred to san",
+			cn:       "localhost",
+			dnsNames: []string{"controller.example.com"},
+			order:    []string{nameCN, nameSANDNS},
+			expected: "localhost",
+		},
+		{
+			name:     "ip san",
+			cn:       "Ciao Controller",
+			ips:      []net.IP{net.ParseIP("192.168.0.1")},
+			order:    defaultOrder,
+			expected: "192.168.0.1",
+		},
+		{
+			name:     "ipv6 san",
+			cn:       "Ciao Controller",
+			ips:      []net.IP{net.ParseIP("fd00::1")},
+			order:    defaultOrder,
+			expected: "fd00::1",
+		},
+		{
+			name:     "unresolvable san",
+			dnsNames: []string{"unknown.example.com"},
+			ips:      []net.IP{net.ParseIP("192.168.0.1")},
+			order:    defaultOrder,
+			expected: "192.168.0.1",
+		},
+		{
+			name:  "garbage cn",
+			cn:    "Ciao Controller",
+			order: defaultOrder,
+			err:   `cn "Ciao Controller"`,
+		},
+		{
+			name:  "ip san not in order",
+			ips:   []net.IP{net.ParseIP("192.168.0.1")},
+			order: []string{nameSANDNS, nameCN},
+			err:   "No names found",
+		},
+	}
+
+	for i, tt := range tests {
+		cert, key := createTestCert(t, tt.cn, tt.dnsNames, tt.ips)
+
+		certPath := filepath.Join(dir, fmt.Sprintf("cert%d.pem", i))
+		keyPath := filepath.Join(dir, fmt.Sprintf("key%d.pem", i))
+		writeTestConfig(t, certPath, string(cert))
+		writeTestConfig(t, keyPath, string(key))
+
+		name, err := getNameFromCert(certPath, keyPath, tt.order)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		} else if name != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, name)
+		}
+	}
+}
+
+func TestIsHostName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"controller.example.com.", true},
+		{"node-1.example.com", true},
+		{"", false},
+		{"Ciao Controller", false},
+		{"*.example.com", false},
+		{"-node.example.com", false},
+		{"node..example.com", false},
+		{strings.Repeat("a", 64) + ".com", false},
+	}
+
+	for _, tt := range tests {
+		if isHostName(tt.name) != tt.expected {
+			t.Errorf("%q: expected %v", tt.name, tt.expected)
+		}
+	}
+}
+
+func TestSetAPIConfigIPv6(t *testing.T) {
+	savedPort, savedCert, savedKey, savedCA := controllerAPIPort, httpsCAcert, httpsKey, clientCertCAPath
+	defer func() {
+		controllerAPIPort, httpsCAcert, httpsKey, clientCertCAPath = savedPort, savedCert, savedKey, savedCA
+	}()
+
+	dir, err := ioutil.TempDir("", "controller_certname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cert, key := createTestCert(t, "Ciao Controller", nil, []net.IP{net.ParseIP("fd00::1")})
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeTestConfig(t, certPath, string(cert))
+	writeTestConfig(t, keyPath, string(key))
+
+	cfg := defaultConfig()
+	cfg.HTTPSCACert = certPath
+	cfg.HTTPSKey = keyPath
+	cfg.APIPort = 8774
+
+	c := &controller{log: ctl.log}
+	c.setAPIConfig(cfg)
+
+	if c.apiURL != "https://[fd00::1]:8774" {
+		t.Errorf("Expected https://[fd00::1]:8774 got %s", c.apiURL)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+)
+
+const (
+	adminRole        = "admin"
+	tenantRolePrefix = "tenant:"
+)
+
+// certRoleAttributes are the subject attributes of client certificates
+// which may hold their roles, by cert_role_attribute value.
+var certRoleAttributes = map[string]func(pkix.Name) []string{
+	"ou": func(n pkix.Name) []string { return n.OrganizationalUnit },
+	"o":  func(n pkix.Name) []string { return n.Organization },
+}
+
+func validateCertRoleAttribute(attribute string) error {
+	if attribute == "" {
+		return nil
+	}
+
+	if _, ok := certRoleAttributes[attribute]; !ok {
+		return fmt.Errorf("Unknown cert_role_attribute: %s", attribute)
+	}
+
+	return nil
+}
+
+// certRoles returns whether a client certificate grants the admin role and
+// the tenants it grants access to.  The roles are read from attribute,
+// whose values are either "admin" or "tenant:<id>".  Certificates without
+// any role in attribute are authorized by their organizations, "admin"
+// alone granting the admin role and any other organization naming a
+// tenant.
+func certRoles(cert *x509.Certificate, attribute string) (bool, []string) {
+	admin := false
+	var tenants []string
+
+	if values, ok := certRoleAttributes[attribute]; ok {
+		for _, v := range values(cert.Subject) {
+			if v == adminRole {
+				admin = true
+			} else if strings.HasPrefix(v, tenantRolePrefix) {
+				tenants = append(tenants, strings.TrimPrefix(v, tenantRolePrefix))
+			}
+		}
+	}
+
+	if admin || len(tenants) > 0 {
+		return admin, tenants
+	}
+
+	tenants = cert.Subject.Organization
+	if len(tenants) == 1 && tenants[0] == adminRole {
+		return true, nil
+	}
+
+	return false, tenants
+}
+
+// adminRoute returns true if only admins may use the route with path
+// template path served by h: the privileged API routes and those which
+// are not scoped to a tenant.
+func adminRoute(h http.Handler, path string) bool {
+	switch h := h.(type) {
+	case api.Handler:
+		if h.Privileged {
+			return true
+		}
+	case legacyAPIHandler:
+		if h.Privileged {
+			return true
+		}
+	case tokenExchangeHandler:
+		return false
+	}
+
+	return !strings.Contains(path, "{tenant")
+}
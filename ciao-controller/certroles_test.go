@@ -0,0 +1,253 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// roleCert returns a client certificate for user signed by the CA whose
+// organizational units hold roles.
+func (ca testCA) roleCert(t *testing.T, user string, roles []string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: user, OrganizationalUnit: roles},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// trustTestCA adds ca to the global client CAs until the returned function
+// is called.
+func trustTestCA(ca testCA) func() {
+	s := &ctl.clientCAs
+	s.Lock()
+	saved := s.global
+	s.global = append(append([]*x509.Certificate{}, saved...), ca.cert)
+	s.built = false
+	s.Unlock()
+
+	return func() {
+		s.Lock()
+		s.global = saved
+		s.built = false
+		s.Unlock()
+	}
+}
+
+func TestCertRoles(t *testing.T) {
+	tests := []struct {
+		name      string
+		subject   pkix.Name
+		attribute string
+		admin     bool
+		tenants   []string
+	}{
+		{"admin role", pkix.Name{OrganizationalUnit: []string{"admin"}}, "ou", true, nil},
+		{"tenant roles", pkix.Name{OrganizationalUnit: []string{"tenant:a", "tenant:b"}}, "ou", false, []string{"a", "b"}},
+		{"roles override organization", pkix.Name{Organization: []string{"admin"}, OrganizationalUnit: []string{"tenant:a"}}, "ou", false, []string{"a"}},
+		{"unknown roles ignored", pkix.Name{Organization: []string{"a"}, OrganizationalUnit: []string{"ops"}}, "ou", false, []string{"a"}},
+		{"organization admin", pkix.Name{Organization: []string{"admin"}}, "ou", true, nil},
+		{"organization tenants", pkix.Name{Organization: []string{"admin", "a"}}, "ou", false, []string{"admin", "a"}},
+		{"organization roles", pkix.Name{Organization: []string{"tenant:a"}}, "o", false, []string{"a"}},
+		{"roles disabled", pkix.Name{Organization: []string{"b"}, OrganizationalUnit: []string{"admin"}}, "", false, []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		admin, tenants := certRoles(&x509.Certificate{Subject: tt.subject}, tt.attribute)
+		if admin != tt.admin || !reflect.DeepEqual(tenants, tt.tenants) {
+			t.Errorf("%s: expected %v %v got %v %v", tt.name, tt.admin, tt.tenants, admin, tenants)
+		}
+	}
+}
+
+// fillPathTemplate replaces the variables of a route path template with
+// tenantID for the tenant and with a UUID for the others.
+func fillPathTemplate(template string, tenantID string) string {
+	var path, name []rune
+	depth := 0
+
+	for _, c := range template {
+		switch {
+		case c == '{' && depth == 0:
+			name = name[:0]
+			depth++
+		case c == '{':
+			depth++
+		case c == '}' && depth == 1:
+			depth--
+			v := strings.SplitN(string(name), ":", 2)[0]
+			if v == "tenant" {
+				path = append(path, []rune(tenantID)...)
+			} else {
+				path = append(path, []rune("ba58f471-0735-4773-9550-188e2d012941")...)
+			}
+		case c == '}':
+			depth--
+		case depth > 0:
+			name = append(name, c)
+		default:
+			path = append(path, c)
+		}
+	}
+
+	return string(path)
+}
+
+// routeRequest returns a request with method matched by route, whose
+// tenant is tenantID, or nil if route does not serve method.
+func routeRequest(r *mux.Router, route *mux.Route, method string, tenantID string) *http.Request {
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+
+	for _, contentType := range []string{"application/json", "application/merge-patch+json"} {
+		req := httptest.NewRequest(method, fillPathTemplate(template, tenantID), nil)
+		req.Header.Set("Content-Type", contentType)
+
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route == route {
+			return req
+		}
+	}
+
+	return nil
+}
+
+func TestRouteRoles(t *testing.T) {
+	tenantA, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantB, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := createTestCA(t, "role CA")
+	defer trustTestCA(ca)()
+
+	users := []struct {
+		name  string
+		cert  *x509.Certificate
+		admin bool
+	}{
+		{"admin", ca.roleCert(t, "admin", []string{"admin"}), true},
+		{"tenant", ca.roleCert(t, "user-a", []string{"tenant:" + tenantA.ID}), false},
+	}
+
+	r := mux.NewRouter()
+	if err := ctl.createComputeRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.createCiaoRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handlers are replaced so that only the authorization of the
+	// requests is exercised
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var routes []*mux.Route
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if h, ok := route.GetHandler().(*clientCertAuthHandler); ok {
+			h.Next = next
+			routes = append(routes, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods := []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	for _, route := range routes {
+		path, _ := route.GetPathTemplate()
+		// any user may exchange their certificate for a token
+		exchange := route.GetHandler().(*clientCertAuthHandler).Exchange
+		admin := !exchange && (!strings.Contains(path, "{tenant") || strings.HasPrefix(path, "/tenants/"))
+
+		served := false
+		for _, method := range methods {
+			for _, tenantID := range []string{tenantA.ID, tenantB.ID} {
+				for _, u := range users {
+					req := routeRequest(r, route, method, tenantID)
+					if req == nil {
+						continue
+					}
+					served = true
+
+					req.TLS = &tls.ConnectionState{
+						VerifiedChains: [][]*x509.Certificate{{u.cert, ca.cert}},
+					}
+
+					expected := http.StatusOK
+					if !u.admin && admin {
+						expected = http.StatusForbidden
+					} else if !u.admin && !exchange && tenantID != tenantA.ID {
+						expected = http.StatusUnauthorized
+					}
+
+					rec := httptest.NewRecorder()
+					r.ServeHTTP(rec, req)
+					if rec.Code != expected {
+						t.Errorf("%s %s %s as %s: expected %d got %d",
+							method, path, tenantID, u.name, expected, rec.Code)
+					}
+				}
+			}
+		}
+
+		if !served {
+			t.Errorf("No request matched route %s", path)
+		}
+	}
+}
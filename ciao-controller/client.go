@@ -23,9 +23,9 @@ import (
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -40,10 +40,19 @@ type controllerClient interface {
 	RemoveInstance(instanceID string)
 	EvacuateNode(nodeID string) error
 	RestoreNode(nodeID string) error
+	nodeMaintenance(nodeID string, maintenance bool) error
 	Disconnect()
 	mapExternalIP(t types.Tenant, m types.MappedIP) error
 	unMapExternalIP(t types.Tenant, m types.MappedIP) error
-	attachVolume(volID string, instanceID string, nodeID string) error
+	attachVolume(volID string, instanceID string, nodeID string, tag string) error
+	detachVolume(volID string, instanceID string, nodeID string) error
+	requestInventory(nodeID string) error
+	prefetchImage(nodeID string, imageID string) error
+	prepareMigration(cmd payloads.PrepareMigrationCmd) error
+	migrateInstance(instanceID string, nodeID string, targetNodeID string, address string) error
+	abortMigration(instanceID string, nodeID string) error
+	consoleLog(instanceID string, nodeID string, requestID string, length int) error
+	resizeInstance(instanceID string, nodeID string, vcpus int, memMB int) error
 	ssntpClient() *ssntp.Client
 	CNCIRefresh(cnciID string, cnciList []payloads.CNCINet) error
 }
@@ -55,42 +64,105 @@ type ssntpClient struct {
 }
 
 func (client *ssntpClient) ConnectNotify() {
-	glog.Info(client.name, " connected")
+	client.ctl.log.Infof("%s connected", client.name)
+
+	// the scheduler does not remember which nodes are in maintenance
+	// when it restarts
+	go func() {
+		for _, nodeID := range client.ctl.ds.GetMaintenanceNodes() {
+			if err := client.nodeMaintenance(nodeID, true); err != nil {
+				clogger.With(client.ctl.log, "node", nodeID).Warningf("Error sending node maintenance: %v", err)
+			}
+		}
+	}()
 }
 
 func (client *ssntpClient) DisconnectNotify() {
-	glog.Info(client.name, " disconnected")
+	client.ctl.log.Infof("%s disconnected", client.name)
 }
 
 func (client *ssntpClient) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
-	glog.Info("STATUS for ", client.name)
+	client.ctl.log.Infof("STATUS for %s", client.name)
+	client.ctl.metrics.ssntpFrame("status", status.String())
 }
 
 func (client *ssntpClient) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
 	var stats payloads.Stat
 	payload := frame.Payload
 
-	glog.Info("COMMAND ", command, " for ", client.name)
+	client.ctl.log.Infof("COMMAND %s for %s", command, client.name)
+	client.ctl.metrics.ssntpFrame("command", command.String())
 
 	if command == ssntp.STATS {
 		stats.Init()
 		err := yaml.Unmarshal(payload, &stats)
 		if err != nil {
-			glog.Warningf("Error unmarshalling STATS: %v", err)
+			client.ctl.log.Warningf("Error unmarshalling STATS: %v", err)
 			return
 		}
 		err = client.ctl.ds.HandleStats(stats)
 		if err != nil {
-			glog.Warningf("Error updating stats in datastore: %v", err)
+			client.ctl.log.Warningf("Error updating stats in datastore: %v", err)
+		}
+		client.updateInstanceConditions(stats)
+		client.ctl.migrationStats(stats)
+		client.ctl.nodeHeartbeat(stats.NodeUUID, stats.Timestamp)
+		client.ctl.cnciHeartbeats(stats)
+		client.ctl.launchQueue.wake()
+	}
+	if command == ssntp.CONFIGURE {
+		var clusterConfig payloads.Configure
+		err := yaml.Unmarshal(payload, &clusterConfig)
+		if err != nil {
+			client.ctl.log.Warningf("Error unmarshalling CONFIGURE: %v", err)
+			return
+		}
+		client.ctl.updateClusterConfig(clusterConfig)
+	}
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", payload)
+	}
+}
+
+// updateInstanceConditions records the warnings reported for each instance
+// in a STATS command and publishes the conditions raised and cleared.
+func (client *ssntpClient) updateInstanceConditions(stats payloads.Stat) {
+	for _, stat := range stats.Instances {
+		i, err := client.ctl.ds.GetInstance(stat.InstanceUUID)
+		if err != nil {
+			continue
+		}
+
+		raised, cleared, err := client.ctl.ds.UpdateInstanceConditions(i.ID, stat.Warnings)
+		if err != nil {
+			client.ctl.log.Warningf("Error updating conditions of instance %s: %v", i.ID, err)
+			continue
+		}
+
+		for _, c := range raised {
+			client.ctl.publishEvent(types.InstanceConditionRaisedEvent, i.TenantID,
+				c.Message, map[string]string{
+					"instance":  i.ID,
+					"node":      stats.NodeUUID,
+					"condition": string(c.Type),
+				})
+		}
+
+		for _, c := range cleared {
+			client.ctl.publishEvent(types.InstanceConditionClearedEvent, i.TenantID,
+				fmt.Sprintf("Condition %s cleared", c.Type), map[string]string{
+					"instance":  i.ID,
+					"node":      stats.NodeUUID,
+					"condition": string(c.Type),
+				})
 		}
 	}
-	glog.V(1).Info(string(payload))
 }
 
 func (client *ssntpClient) deleteEphemeralStorage(instanceID string) {
 	err := client.ctl.deleteEphemeralStorage(instanceID)
 	if err != nil {
-		glog.Warningf("Error deleting ephemeral storage for instance: %s: %v", instanceID, err)
+		client.ctl.log.Warningf("Error deleting ephemeral storage for instance: %s: %v", instanceID, err)
 	}
 }
 
@@ -110,49 +182,72 @@ func (client *ssntpClient) releaseResources(instanceID string) error {
 		return errors.Wrapf(err, "error getting workload for instance from datastore")
 	}
 
-	resources := []payloads.RequestedResource{
-		{Type: payloads.Instance, Value: 1},
-		{Type: payloads.MemMB, Value: wl.Requirements.MemMB},
-		{Type: payloads.VCPUs, Value: wl.Requirements.VCPUs}}
-	client.ctl.qs.Release(i.TenantID, resources...)
+	client.ctl.qs.Release(i.TenantID, instanceResources(i, &wl)...)
 	return nil
 }
 
+// cnciEventHandler is notified of the events of a CNCI instance.
+type cnciEventHandler interface {
+	CNCIAdded(id string) error
+	CNCIRemoved(id string) error
+	CNCIStopped(id string) error
+	StartFailure(id string) error
+}
+
+// cnciEvents returns the handler for the events of a CNCI, which is the
+// CNCI pool for CNCIs not yet assigned to a tenant.
+func (c *controller) cnciEvents(i *types.Instance) (cnciEventHandler, error) {
+	if i.TenantID == "" {
+		return poolCNCIEvents{ctrl: c}, nil
+	}
+
+	tenant, err := c.ds.GetTenant(i.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, errors.Errorf("Tenant %s not found", i.TenantID)
+	}
+
+	return tenant.CNCIctrl, nil
+}
+
 func (client *ssntpClient) RemoveInstance(instanceID string) {
 	err := client.releaseResources(instanceID)
 	if err != nil {
-		glog.Warningf("Error when releasing resources for deleted instance: %v", err)
+		client.ctl.log.Warningf("Error when releasing resources for deleted instance: %v", err)
 	}
 	client.deleteEphemeralStorage(instanceID)
 
 	i, err := client.ctl.ds.GetInstance(instanceID)
 	if err != nil {
-		glog.Warningf("Error getting instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error getting instance from datastore: %v", err)
 		return
 	}
 
 	err = client.ctl.ds.DeleteInstance(instanceID)
 	if err != nil {
-		glog.Warningf("Error deleting instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error deleting instance from datastore: %v", err)
 	}
+	client.ctl.launchQueue.wake()
 
 	if i.CNCI {
-		tenant, err := client.ctl.ds.GetTenant(i.TenantID)
+		events, err := client.ctl.cnciEvents(i)
 		if err != nil {
-			glog.Warningf("Error retrieving tenant %v", err)
+			client.ctl.log.Warningf("Error retrieving tenant %v", err)
 			return
 		}
 
-		err = tenant.CNCIctrl.CNCIRemoved(i.ID)
+		err = events.CNCIRemoved(i.ID)
 		if err != nil {
-			glog.Warningf("Error removing CNCI: %v", err)
+			client.ctl.log.Warningf("Error removing CNCI: %v", err)
 		}
 	}
 
 	// notify anyone is listening for a state change
 	err = i.TransitionInstanceState(payloads.Deleted)
 	if err != nil {
-		glog.Warningf("Error transitioning CNCI to deleted: %v", err)
+		client.ctl.log.Warningf("Error transitioning CNCI to deleted: %v", err)
 	}
 }
 
@@ -160,7 +255,7 @@ func (client *ssntpClient) instanceDeleted(payload []byte) {
 	var event payloads.EventInstanceDeleted
 	err := yaml.Unmarshal(payload, &event)
 	if err != nil {
-		glog.Warningf("Error unmarshalling InstanceDeleted: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling InstanceDeleted: %v", err)
 		return
 	}
 	client.RemoveInstance(event.InstanceDeleted.InstanceUUID)
@@ -170,32 +265,32 @@ func (client *ssntpClient) instanceStopped(payload []byte) {
 	var event payloads.EventInstanceStopped
 	err := yaml.Unmarshal(payload, &event)
 	if err != nil {
-		glog.Warning("Error unmarshalling InstanceStopped: %v")
+		client.ctl.log.Warningf("Error unmarshalling InstanceStopped: %v", err)
 		return
 	}
 	instanceID := event.InstanceStopped.InstanceUUID
-	glog.Infof("Stopped instance %s", instanceID)
+	client.ctl.log.Infof("Stopped instance %s", instanceID)
 
 	i, err := client.ctl.ds.GetInstance(instanceID)
 	if err != nil {
-		glog.Warningf("Error getting instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error getting instance from datastore: %v", err)
 		return
 	}
 
 	err = client.ctl.ds.InstanceStopped(instanceID)
 	if err != nil {
-		glog.Warningf("Error stopping instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error stopping instance from datastore: %v", err)
 	}
 
 	if i.CNCI {
-		tenant, err := client.ctl.ds.GetTenant(i.TenantID)
+		events, err := client.ctl.cnciEvents(i)
 		if err != nil {
-			glog.Warningf("Error retrieving tenant %v", err)
+			client.ctl.log.Warningf("Error retrieving tenant %v", err)
 			return
 		}
-		err = tenant.CNCIctrl.CNCIStopped(i.ID)
+		err = events.CNCIStopped(i.ID)
 		if err != nil {
-			glog.Warningf("Error stopping CNCI: %v", err)
+			client.ctl.log.Warningf("Error stopping CNCI: %v", err)
 		}
 	}
 }
@@ -204,13 +299,13 @@ func (client *ssntpClient) concentratorInstanceAdded(payload []byte) {
 	var event payloads.EventConcentratorInstanceAdded
 	err := yaml.Unmarshal(payload, &event)
 	if err != nil {
-		glog.Warningf("Error unmarshalling EventConcentratorInstanceAdded: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling EventConcentratorInstanceAdded: %v", err)
 		return
 	}
 	newCNCI := event.CNCIAdded
 	i, err := client.ctl.ds.GetInstance(newCNCI.InstanceUUID)
 	if err != nil {
-		glog.Warningf("Error getting instance: %v", err)
+		client.ctl.log.Warningf("Error getting instance: %v", err)
 		return
 	}
 
@@ -219,18 +314,18 @@ func (client *ssntpClient) concentratorInstanceAdded(payload []byte) {
 
 	err = client.ctl.ds.UpdateInstance(i)
 	if err != nil {
-		glog.Warningf("Error updating CNCI Info: %v", err)
+		client.ctl.log.Warningf("Error updating CNCI Info: %v", err)
 	}
 
-	tenant, err := client.ctl.ds.GetTenant(i.TenantID)
-	if err != nil || tenant == nil {
-		glog.Warningf("Error getting tenant: %v", err)
+	events, err := client.ctl.cnciEvents(i)
+	if err != nil {
+		client.ctl.log.Warningf("Error getting tenant: %v", err)
 		return
 	}
 
-	err = tenant.CNCIctrl.CNCIAdded(newCNCI.InstanceUUID)
+	err = events.CNCIAdded(newCNCI.InstanceUUID)
 	if err != nil {
-		glog.Warningf("Error adding CNCI: %v", err)
+		client.ctl.log.Warningf("Error adding CNCI: %v", err)
 	}
 }
 
@@ -238,12 +333,12 @@ func (client *ssntpClient) traceReport(payload []byte) {
 	var trace payloads.Trace
 	err := yaml.Unmarshal(payload, &trace)
 	if err != nil {
-		glog.Warningf("Error unmarshalling TraceReport: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling TraceReport: %v", err)
 		return
 	}
 	err = client.ctl.ds.HandleTraceReport(trace)
 	if err != nil {
-		glog.Warningf("Error updating trace report in datastore: %v", err)
+		client.ctl.log.Warningf("Error updating trace report in datastore: %v", err)
 	}
 }
 
@@ -251,10 +346,10 @@ func (client *ssntpClient) nodeConnected(payload []byte) {
 	var nodeConnected payloads.NodeConnected
 	err := yaml.Unmarshal(payload, &nodeConnected)
 	if err != nil {
-		glog.Warningf("Error unmarshalling NodeConnected: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling NodeConnected: %v", err)
 		return
 	}
-	glog.Infof("Node %s connected", nodeConnected.Connected.NodeUUID)
+	client.ctl.log.Infof("Node %s connected", nodeConnected.Connected.NodeUUID)
 
 	client.ctl.ds.AddNode(nodeConnected.Connected.NodeUUID, nodeConnected.Connected.NodeType)
 }
@@ -263,14 +358,20 @@ func (client *ssntpClient) nodeDisconnected(payload []byte) {
 	var nodeDisconnected payloads.NodeDisconnected
 	err := yaml.Unmarshal(payload, &nodeDisconnected)
 	if err != nil {
-		glog.Warningf("Error unmarshalling NodeDisconnected: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling NodeDisconnected: %v", err)
 		return
 	}
 
-	glog.Infof("Node %s disconnected", nodeDisconnected.Disconnected.NodeUUID)
+	client.ctl.log.Infof("Node %s disconnected", nodeDisconnected.Disconnected.NodeUUID)
+	if client.ctl.liveness != nil {
+		client.ctl.liveness.remove(nodeDisconnected.Disconnected.NodeUUID)
+	}
+	if client.ctl.clockSkew != nil {
+		client.ctl.clockSkew.remove(nodeDisconnected.Disconnected.NodeUUID)
+	}
 	err = client.ctl.ds.DeleteNode(nodeDisconnected.Disconnected.NodeUUID)
 	if err != nil {
-		glog.Warningf("Error marking node as deleted in datastore: %v", err)
+		client.ctl.log.Warningf("Error marking node as deleted in datastore: %v", err)
 	}
 }
 
@@ -278,19 +379,19 @@ func (client *ssntpClient) unassignEvent(payload []byte) {
 	var event payloads.EventPublicIPUnassigned
 	err := yaml.Unmarshal(payload, &event)
 	if err != nil {
-		glog.Warningf("Error unmarshalling EventPublicIPUnassigned: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling EventPublicIPUnassigned: %v", err)
 		return
 	}
 
 	i, err := client.ctl.ds.GetInstance(event.UnassignedIP.InstanceUUID)
 	if err != nil {
-		glog.Warningf("Error getting instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error getting instance from datastore: %v", err)
 		return
 	}
 
 	err = client.ctl.ds.UnMapExternalIP(event.UnassignedIP.PublicIP)
 	if err != nil {
-		glog.Warningf("Error unmapping external IP: %v", err)
+		client.ctl.log.Warningf("Error unmapping external IP: %v", err)
 		return
 	}
 
@@ -299,7 +400,7 @@ func (client *ssntpClient) unassignEvent(payload []byte) {
 	msg := fmt.Sprintf("Unmapped %s from %s", event.UnassignedIP.PublicIP, event.UnassignedIP.PrivateIP)
 	err = client.ctl.ds.LogEvent(i.TenantID, msg)
 	if err != nil {
-		glog.Warningf("Error logging event: %v", err)
+		client.ctl.log.Warningf("Error logging event: %v", err)
 	}
 }
 
@@ -307,29 +408,130 @@ func (client *ssntpClient) assignEvent(payload []byte) {
 	var event payloads.EventPublicIPAssigned
 	err := yaml.Unmarshal(payload, &event)
 	if err != nil {
-		glog.Warningf("Error unmarshalling EventPublicIPAssigned: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling EventPublicIPAssigned: %v", err)
 		return
 	}
 
 	i, err := client.ctl.ds.GetInstance(event.AssignedIP.InstanceUUID)
 	if err != nil {
-		glog.Warningf("Error getting instance from datastore: %v", err)
+		client.ctl.log.Warningf("Error getting instance from datastore: %v", err)
 		return
 	}
 
 	msg := fmt.Sprintf("Mapped %s to %s", event.AssignedIP.PublicIP, event.AssignedIP.PrivateIP)
 	err = client.ctl.ds.LogEvent(i.TenantID, msg)
 	if err != nil {
-		glog.Warningf("Error logging event: %v", err)
+		client.ctl.log.Warningf("Error logging event: %v", err)
+	}
+}
+
+func (client *ssntpClient) inventoryReport(payload []byte) {
+	var event payloads.EventInventoryReport
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling InstanceInventoryReport: %v", err)
+		return
+	}
+
+	if !client.ctl.inventories.deliver(event.Report) {
+		client.ctl.log.Warningf("Unexpected inventory from node %s", event.Report.NodeUUID)
+	}
+}
+
+func (client *ssntpClient) prefetchReport(payload []byte) {
+	var event payloads.EventImagePrefetchReport
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling ImagePrefetchReport: %v", err)
+		return
+	}
+
+	client.ctl.imagePrefetched(event.Report)
+}
+
+func (client *ssntpClient) migrationPrepared(payload []byte) {
+	var event payloads.EventMigrationPrepared
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling MigrationPrepared: %v", err)
+		return
+	}
+
+	client.ctl.migrationPrepared(event.Prepared)
+}
+
+func (client *ssntpClient) instanceMigrated(payload []byte) {
+	var event payloads.EventInstanceMigrated
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling InstanceMigrated: %v", err)
+		return
+	}
+
+	client.ctl.instanceMigrated(event.Migrated)
+}
+
+func (client *ssntpClient) consoleLogReport(payload []byte) {
+	var event payloads.EventConsoleLogReport
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling ConsoleLogReport: %v", err)
+		return
+	}
+
+	if !client.ctl.consoleLogs.deliver(event.Report) {
+		client.ctl.log.Warningf("Unexpected console log of instance %s from node %s",
+			event.Report.InstanceUUID, event.Report.NodeUUID)
+	}
+}
+
+func (client *ssntpClient) instanceResized(payload []byte) {
+	var event payloads.EventInstanceResized
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling InstanceResized: %v", err)
+		return
+	}
+
+	client.ctl.instanceResized(event.Resized)
+}
+
+func (client *ssntpClient) volumeAttached(payload []byte) {
+	var event payloads.EventVolumeAttached
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling VolumeAttached: %v", err)
+		return
+	}
+
+	// attaches requested through the os-attach volume action are not
+	// waited for
+	client.ctl.volumeRequests.deliver(event.Attached.VolumeUUID, event.Attached.InstanceUUID, nil)
+}
+
+func (client *ssntpClient) volumeDetached(payload []byte) {
+	var event payloads.EventVolumeDetached
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling VolumeDetached: %v", err)
+		return
+	}
+
+	if !client.ctl.volumeRequests.deliver(event.Detached.VolumeUUID, event.Detached.InstanceUUID, nil) {
+		client.ctl.log.Warningf("Unexpected detach of volume %s from instance %s",
+			event.Detached.VolumeUUID, event.Detached.InstanceUUID)
 	}
 }
 
 func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	payload := frame.Payload
 
-	glog.Info("EVENT ", event, " for ", client.name)
+	client.ctl.log.Infof("EVENT %s for %s", event, client.name)
+	client.ctl.metrics.ssntpFrame("event", event.String())
 
-	glog.V(1).Info(string(payload))
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", payload)
+	}
 
 	switch event {
 	case ssntp.InstanceDeleted:
@@ -356,6 +558,30 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	case ssntp.PublicIPUnassigned:
 		client.unassignEvent(payload)
 
+	case ssntp.InstanceInventoryReport:
+		client.inventoryReport(payload)
+
+	case ssntp.ImagePrefetchReport:
+		client.prefetchReport(payload)
+
+	case ssntp.MigrationPrepared:
+		client.migrationPrepared(payload)
+
+	case ssntp.InstanceMigrated:
+		client.instanceMigrated(payload)
+
+	case ssntp.ConsoleLogReport:
+		client.consoleLogReport(payload)
+
+	case ssntp.InstanceResized:
+		client.instanceResized(payload)
+
+	case ssntp.VolumeAttached:
+		client.volumeAttached(payload)
+
+	case ssntp.VolumeDetached:
+		client.volumeDetached(payload)
+
 	}
 }
 
@@ -363,41 +589,57 @@ func (client *ssntpClient) startFailure(payload []byte) {
 	var failure payloads.ErrorStartFailure
 	err := yaml.Unmarshal(payload, &failure)
 	if err != nil {
-		glog.Warningf("Error unmarshalling StartFailure: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling StartFailure: %v", err)
 		return
 	}
+
+	log := clogger.With(client.ctl.log, "instance", failure.InstanceUUID,
+		"node", failure.NodeUUID, "reason", failure.Reason.String())
+	log.Warningf("Instance failed to start")
+	client.ctl.metrics.launchFailed(failure.Reason)
+
 	if failure.Reason.IsFatal() && !failure.Restart {
 		client.deleteEphemeralStorage(failure.InstanceUUID)
 		err = client.releaseResources(failure.InstanceUUID)
 		if err != nil {
-			glog.Warningf("Error when releasing resources for start failed instance: %v", err)
+			log.Warningf("Error when releasing resources for start failed instance: %v", err)
 		}
 	}
 
 	i, err := client.ctl.ds.GetInstance(failure.InstanceUUID)
 	if err != nil {
-		glog.Warningf("Error getting instance: %v", err)
+		log.Warningf("Error getting instance: %v", err)
 		return
 	}
 
 	cnci := i.CNCI
 	tenantID := i.TenantID
+	events, eventsErr := client.ctl.cnciEvents(i)
+	log = clogger.With(log, "tenant", tenantID)
 
 	err = client.ctl.ds.StartFailure(failure.InstanceUUID, failure.Reason, failure.Restart, failure.NodeUUID)
 	if err != nil {
-		glog.Warningf("Error adding StartFailure to datastore: %v", err)
+		log.Warningf("Error adding StartFailure to datastore: %v", err)
 	}
+	client.ctl.launchQueue.wake()
+
+	client.ctl.publishEvent(types.InstanceFailedEvent, tenantID,
+		"Instance failed to start", map[string]string{
+			"instance":     failure.InstanceUUID,
+			"node":         failure.NodeUUID,
+			"reason":       failure.Reason.String(),
+			"failure_code": string(types.StartFailureCode(failure.Reason)),
+		})
 
 	if cnci {
-		tenant, err := client.ctl.ds.GetTenant(tenantID)
-		if err != nil {
-			glog.Warningf("Unable to send start failure event: Error getting tenant %v", err)
+		if eventsErr != nil {
+			log.Warningf("Unable to send start failure event: Error getting tenant %v", eventsErr)
 			return
 		}
 
-		err = tenant.CNCIctrl.StartFailure(failure.InstanceUUID)
+		err = events.StartFailure(failure.InstanceUUID)
 		if err != nil {
-			glog.Warningf("Error adding StartFailure to datastore: %v", err)
+			log.Warningf("Error adding StartFailure to datastore: %v", err)
 		}
 	}
 }
@@ -406,12 +648,30 @@ func (client *ssntpClient) attachVolumeFailure(payload []byte) {
 	var failure payloads.ErrorAttachVolumeFailure
 	err := yaml.Unmarshal(payload, &failure)
 	if err != nil {
-		glog.Warningf("Error unmarshalling AttachVolumeFailure: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling AttachVolumeFailure: %v", err)
 		return
 	}
 	err = client.ctl.ds.AttachVolumeFailure(failure.InstanceUUID, failure.VolumeUUID, failure.Reason)
 	if err != nil {
-		glog.Warningf("Error handling AttachVolumeFailure in datastore: %v", err)
+		client.ctl.log.Warningf("Error handling AttachVolumeFailure in datastore: %v", err)
+	}
+
+	client.ctl.volumeRequests.deliver(failure.VolumeUUID, failure.InstanceUUID,
+		fmt.Errorf("Attach of volume failed: %s", failure.Reason.String()))
+}
+
+func (client *ssntpClient) detachVolumeFailure(payload []byte) {
+	var failure payloads.ErrorDetachVolumeFailure
+	err := yaml.Unmarshal(payload, &failure)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling DetachVolumeFailure: %v", err)
+		return
+	}
+
+	if !client.ctl.volumeRequests.deliver(failure.VolumeUUID, failure.InstanceUUID,
+		fmt.Errorf("Detach of volume failed: %s", failure.Reason.String())) {
+		client.ctl.log.Warningf("Unexpected detach failure of volume %s from instance %s: %s",
+			failure.VolumeUUID, failure.InstanceUUID, failure.Reason.String())
 	}
 }
 
@@ -419,13 +679,13 @@ func (client *ssntpClient) assignError(payload []byte) {
 	var failure payloads.ErrorPublicIPFailure
 	err := yaml.Unmarshal(payload, &failure)
 	if err != nil {
-		glog.Warningf("Error unmarshalling ErrorPublicIPFailure:: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling ErrorPublicIPFailure:: %v", err)
 		return
 	}
 
 	err = client.ctl.ds.UnMapExternalIP(failure.PublicIP)
 	if err != nil {
-		glog.Warningf("Error unmapping external IP: %v", err)
+		client.ctl.log.Warningf("Error unmapping external IP: %v", err)
 	}
 
 	client.ctl.qs.Release(failure.TenantUUID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
@@ -433,7 +693,7 @@ func (client *ssntpClient) assignError(payload []byte) {
 	msg := fmt.Sprintf("Failed to map %s to %s: %s", failure.PublicIP, failure.InstanceUUID, failure.Reason.String())
 	err = client.ctl.ds.LogError(failure.TenantUUID, msg)
 	if err != nil {
-		glog.Warningf("Error logging error: %v", err)
+		client.ctl.log.Warningf("Error logging error: %v", err)
 	}
 }
 
@@ -441,7 +701,7 @@ func (client *ssntpClient) unassignError(payload []byte) {
 	var failure payloads.ErrorPublicIPFailure
 	err := yaml.Unmarshal(payload, &failure)
 	if err != nil {
-		glog.Warningf("Error unmarshalling ErrorPublicIPFailure: %v", err)
+		client.ctl.log.Warningf("Error unmarshalling ErrorPublicIPFailure: %v", err)
 		return
 	}
 
@@ -449,15 +709,40 @@ func (client *ssntpClient) unassignError(payload []byte) {
 	msg := fmt.Sprintf("Failed to unmap %s from %s: %s", failure.PublicIP, failure.InstanceUUID, failure.Reason.String())
 	err = client.ctl.ds.LogError(failure.TenantUUID, msg)
 	if err != nil {
-		glog.Warningf("Error logging error: %v", err)
+		client.ctl.log.Warningf("Error logging error: %v", err)
 	}
 }
 
+func (client *ssntpClient) migrationFailure(payload []byte) {
+	var failure payloads.ErrorMigrationFailure
+	err := yaml.Unmarshal(payload, &failure)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling MigrationFailure: %v", err)
+		return
+	}
+
+	client.ctl.migrationFailure(failure)
+}
+
+func (client *ssntpClient) resizeFailure(payload []byte) {
+	var failure payloads.ErrorResizeFailure
+	err := yaml.Unmarshal(payload, &failure)
+	if err != nil {
+		client.ctl.log.Warningf("Error unmarshalling ResizeFailure: %v", err)
+		return
+	}
+
+	client.ctl.resizeFailure(failure)
+}
+
 func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 	payload := frame.Payload
 
-	glog.Info("ERROR (", err, ") for ", client.name)
-	glog.V(1).Info(string(payload))
+	client.ctl.log.Infof("ERROR (%s) for %s", err, client.name)
+	client.ctl.metrics.ssntpFrame("error", err.String())
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", payload)
+	}
 
 	switch err {
 	case ssntp.StartFailure:
@@ -466,25 +751,103 @@ func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 	case ssntp.AttachVolumeFailure:
 		client.attachVolumeFailure(payload)
 
+	case ssntp.DetachVolumeFailure:
+		client.detachVolumeFailure(payload)
+
 	case ssntp.AssignPublicIPFailure:
 		client.assignError(payload)
 
 	case ssntp.UnassignPublicIPFailure:
 		client.unassignError(payload)
 
+	case ssntp.MigrationFailure:
+		client.migrationFailure(payload)
+
+	case ssntp.ResizeFailure:
+		client.resizeFailure(payload)
+
 	}
 }
 
-func newSSNTPClient(ctl *controller, config *ssntp.Config) (controllerClient, error) {
+// ssntpRetryDelay is the delay before the first retry of a failed
+// connection to the scheduler.  It doubles with each retry up to
+// ssntpMaxRetryDelay.
+var ssntpRetryDelay = time.Second
+
+const ssntpMaxRetryDelay = 30 * time.Second
+
+// dialSSNTP makes a single attempt, abandoned after timeout, to connect to
+// the scheduler and retrieve the cluster configuration it sends to the
+// clients which connect to it.
+func dialSSNTP(ctl *controller, config *ssntp.Config, timeout time.Duration) (*ssntpClient, payloads.Configure, error) {
 	client := &ssntpClient{name: "ciao Controller", ctl: ctl}
 
-	err := client.ssntp.Dial(config, client)
-	return client, err
+	// Dial waits for the scheduler to come up, it returns once the
+	// client is closed.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.ssntp.Dial(config, client)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return nil, payloads.Configure{}, err
+		}
+	case <-time.After(timeout):
+		client.ssntp.Close()
+		return nil, payloads.Configure{}, errors.New("Timed out connecting to SSNTP server")
+	}
+
+	clusterConfig, err := client.ssntp.ClusterConfiguration()
+	if err != nil {
+		client.Disconnect()
+		return nil, payloads.Configure{}, errors.Wrap(err, "Unable to retrieve cluster configuration")
+	}
+
+	return client, clusterConfig, nil
+}
+
+// newSSNTPClient connects to the scheduler and retrieves the cluster
+// configuration.  Failed attempts are retried with exponential backoff, so
+// that the controller may be started before the scheduler, until the next
+// attempt would start after timeout.
+func newSSNTPClient(ctl *controller, config *ssntp.Config, timeout time.Duration) (controllerClient, payloads.Configure, error) {
+	deadline := time.Now().Add(timeout)
+	delay := ssntpRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		client, clusterConfig, err := dialSSNTP(ctl, config, time.Until(deadline))
+		if err == nil {
+			return client, clusterConfig, nil
+		}
+
+		// there is no point in waiting to retry once the retry
+		// would have no time left to connect
+		if time.Until(deadline) <= delay {
+			return nil, payloads.Configure{}, errors.Wrapf(err, "Gave up after %d attempts", attempt)
+		}
+
+		ctl.log.Warningf("Attempt %d to connect to SSNTP server failed, retrying in %v: %v", attempt, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctl.ctx.Done():
+			return nil, payloads.Configure{}, ctl.ctx.Err()
+		}
+
+		delay *= 2
+		if delay > ssntpMaxRetryDelay {
+			delay = ssntpMaxRetryDelay
+		}
+	}
 }
 
 func (client *ssntpClient) StartTracedWorkload(config string, startTime time.Time, label string) error {
-	glog.V(1).Info("START TRACED config:")
-	glog.V(1).Info(config)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("START TRACED config:")
+		client.ctl.log.Infof("%s", redactConfig(config))
+	}
 
 	traceConfig := &ssntp.TraceConfig{
 		PathTrace: true,
@@ -498,8 +861,10 @@ func (client *ssntpClient) StartTracedWorkload(config string, startTime time.Tim
 }
 
 func (client *ssntpClient) StartWorkload(config string) error {
-	glog.V(1).Info("START config:")
-	glog.V(1).Info(config)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("START config:")
+		client.ctl.log.Infof("%s", redactConfig(config))
+	}
 
 	_, err := client.ssntp.SendCommand(ssntp.START, []byte(config))
 
@@ -512,8 +877,10 @@ func (client *ssntpClient) deleteInstance(payload *payloads.Delete, instanceID s
 		return err
 	}
 
-	glog.Info("DELETE instance_id: ", instanceID, "node_id ", nodeID)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("DELETE instance_id: %s node_id %s", instanceID, nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.DELETE, y)
 
@@ -525,7 +892,7 @@ func (client *ssntpClient) DeleteInstance(instanceID string, nodeID string) erro
 		// This instance is not running and not assigned to a node.  We
 		// can just remove its details from controller's db and delete
 		// any ephemeral storage.
-		glog.Info("Deleting unassigned instance")
+		client.ctl.log.Infof("Deleting unassigned instance")
 		client.RemoveInstance(instanceID)
 		return nil
 	}
@@ -587,7 +954,7 @@ func (client *ssntpClient) RestartInstance(i *types.Instance, w *types.Workload,
 		FWType:              payloads.Firmware(w.FWType),
 		VMType:              w.VMType,
 		InstancePersistence: payloads.Host,
-		Requirements:        w.Requirements,
+		Requirements:        instanceRequirements(i, w),
 		Networking: payloads.NetworkResources{
 			VnicMAC:  i.MACAddress,
 			VnicUUID: i.VnicUUID,
@@ -601,6 +968,11 @@ func (client *ssntpClient) RestartInstance(i *types.Instance, w *types.Workload,
 		restartCmd.Networking.ConcentratorIP = cnci.IPAddress
 		restartCmd.Networking.Subnet = i.Subnet
 		restartCmd.Networking.PrivateIP = i.IPAddress
+
+		restartCmd.ExtraNetworking, err = nicNetworking(t, i.NICs)
+		if err != nil {
+			return err
+		}
 	}
 
 	if w.VMType == payloads.Docker {
@@ -612,6 +984,7 @@ func (client *ssntpClient) RestartInstance(i *types.Instance, w *types.Workload,
 		vol.ID = attachments[k].BlockID
 		vol.Bootable = attachments[k].Boot
 		vol.Ephemeral = attachments[k].Ephemeral
+		vol.Tag = attachments[k].Tag
 	}
 
 	payload := payloads.Start{
@@ -637,8 +1010,10 @@ func (client *ssntpClient) RestartInstance(i *types.Instance, w *types.Workload,
 	_, _ = buf.Write(b)
 	_, _ = buf.WriteString("\n...\n")
 
-	glog.Info("RESTART instance: ", i.ID)
-	glog.V(1).Info(buf.String())
+	client.ctl.log.Infof("RESTART instance: %s", i.ID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", buf.String())
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.START, buf.Bytes())
 
@@ -659,8 +1034,10 @@ func (client *ssntpClient) EvacuateNode(nodeID string) error {
 		return err
 	}
 
-	glog.Info("EVACUATE node: ", nodeID)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("EVACUATE node: %s", nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.EVACUATE, y)
 
@@ -681,20 +1058,43 @@ func (client *ssntpClient) RestoreNode(nodeID string) error {
 		return err
 	}
 
-	glog.Info("Restore node: ", nodeID)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("Restore node: %s", nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.Restore, y)
 
 	return err
 }
 
-func (client *ssntpClient) attachVolume(volID string, instanceID string, nodeID string) error {
+func (client *ssntpClient) nodeMaintenance(nodeID string, maintenance bool) error {
+	payload := payloads.EventNodeMaintenance{
+		NodeMaintenance: payloads.NodeMaintenanceEvent{
+			NodeUUID:    nodeID,
+			Maintenance: maintenance,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Node %s maintenance %v", nodeID, maintenance)
+
+	_, err = client.ssntp.SendEvent(ssntp.NodeMaintenance, y)
+
+	return err
+}
+
+func (client *ssntpClient) attachVolume(volID string, instanceID string, nodeID string, tag string) error {
 	payload := payloads.AttachVolume{
 		Attach: payloads.VolumeCmd{
 			InstanceUUID:      instanceID,
 			VolumeUUID:        volID,
 			WorkloadAgentUUID: nodeID,
+			Tag:               tag,
 		},
 	}
 
@@ -703,14 +1103,203 @@ func (client *ssntpClient) attachVolume(volID string, instanceID string, nodeID
 		return err
 	}
 
-	glog.Infof("AttachVolume %s to %s\n", volID, instanceID)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("AttachVolume %s to %s\n", volID, instanceID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.AttachVolume, y)
 
 	return err
 }
 
+func (client *ssntpClient) detachVolume(volID string, instanceID string, nodeID string) error {
+	payload := payloads.DetachVolume{
+		Detach: payloads.VolumeCmd{
+			InstanceUUID:      instanceID,
+			VolumeUUID:        volID,
+			WorkloadAgentUUID: nodeID,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("DetachVolume %s from %s\n", volID, instanceID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.DetachVolume, y)
+
+	return err
+}
+
+func (client *ssntpClient) requestInventory(nodeID string) error {
+	payload := payloads.Inventory{
+		Inventory: payloads.InventoryCmd{
+			WorkloadAgentUUID: nodeID,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Request inventory from node: %s", nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.InstanceInventory, y)
+
+	return err
+}
+
+func (client *ssntpClient) prefetchImage(nodeID string, imageID string) error {
+	payload := payloads.PrefetchImage{
+		Prefetch: payloads.PrefetchImageCmd{
+			WorkloadAgentUUID: nodeID,
+			ImageUUID:         imageID,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Request prefetch of image %s on node: %s", imageID, nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.PrefetchImage, y)
+
+	return err
+}
+
+func (client *ssntpClient) prepareMigration(cmd payloads.PrepareMigrationCmd) error {
+	payload := payloads.PrepareMigration{
+		Prepare: cmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Prepare migration of instance %s on node: %s", cmd.InstanceUUID, cmd.WorkloadAgentUUID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.PrepareMigration, y)
+
+	return err
+}
+
+func (client *ssntpClient) migrateInstance(instanceID string, nodeID string, targetNodeID string, address string) error {
+	payload := payloads.MigrateInstance{
+		Migrate: payloads.MigrateInstanceCmd{
+			InstanceUUID:      instanceID,
+			WorkloadAgentUUID: nodeID,
+			TargetAgentUUID:   targetNodeID,
+			TargetAddress:     address,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Migrate instance %s from node %s to node: %s", instanceID, nodeID, targetNodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.MigrateInstance, y)
+
+	return err
+}
+
+func (client *ssntpClient) abortMigration(instanceID string, nodeID string) error {
+	payload := payloads.AbortMigration{
+		Abort: payloads.AbortMigrationCmd{
+			InstanceUUID:      instanceID,
+			WorkloadAgentUUID: nodeID,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Abort migration of instance %s on node: %s", instanceID, nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.AbortMigration, y)
+
+	return err
+}
+
+func (client *ssntpClient) consoleLog(instanceID string, nodeID string, requestID string, length int) error {
+	payload := payloads.ConsoleLog{
+		ConsoleLog: payloads.ConsoleLogCmd{
+			WorkloadAgentUUID: nodeID,
+			InstanceUUID:      instanceID,
+			RequestID:         requestID,
+			Length:            length,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Request console log of instance %s from node: %s", instanceID, nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.ConsoleLog, y)
+
+	return err
+}
+
+func (client *ssntpClient) resizeInstance(instanceID string, nodeID string, vcpus int, memMB int) error {
+	payload := payloads.ResizeInstance{
+		Resize: payloads.ResizeInstanceCmd{
+			WorkloadAgentUUID: nodeID,
+			InstanceUUID:      instanceID,
+			VCPUs:             vcpus,
+			MemMB:             memMB,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client.ctl.log.Infof("Request resize of instance %s on node: %s", instanceID, nodeID)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
+
+	_, err = client.ssntp.SendCommand(ssntp.ResizeInstance, y)
+
+	return err
+}
+
 func (client *ssntpClient) ssntpClient() *ssntp.Client {
 	return &client.ssntp
 }
@@ -742,8 +1331,10 @@ func (client *ssntpClient) mapExternalIP(t types.Tenant, m types.MappedIP) error
 		return err
 	}
 
-	glog.Infof("Request Map of %s to %s\n", m.ExternalIP, m.InternalIP)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("Request Map of %s to %s\n", m.ExternalIP, m.InternalIP)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.AssignPublicIP, y)
 	return err
@@ -772,8 +1363,10 @@ func (client *ssntpClient) unMapExternalIP(t types.Tenant, m types.MappedIP) err
 		return err
 	}
 
-	glog.Infof("Request unmap of %s from %s\n", m.ExternalIP, m.InternalIP)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("Request unmap of %s from %s\n", m.ExternalIP, m.InternalIP)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.ReleasePublicIP, y)
 	return err
@@ -792,8 +1385,10 @@ func (client *ssntpClient) CNCIRefresh(cnciID string, cnciList []payloads.CNCINe
 		return err
 	}
 
-	glog.Infof("Refresh CNCI %s: %v\n", cnciID, cnciList)
-	glog.V(1).Info(string(y))
+	client.ctl.log.Infof("Refresh CNCI %s: %v\n", cnciID, cnciList)
+	if client.ctl.log.V(1) {
+		client.ctl.log.Infof("%s", y)
+	}
 
 	_, err = client.ssntp.SendCommand(ssntp.RefreshCNCI, y)
 	return err
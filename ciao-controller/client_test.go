@@ -0,0 +1,227 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const connectTestConfig = `configure:
+  scheduler:
+    storage_uri: file:///etc/ciao/configuration.yaml
+  controller:
+    compute_ca: /etc/pki/ciao/ciao-controller-cacert.pem
+    compute_cert: /etc/pki/ciao/ciao-controller-key.pem
+    client_auth_ca_cert_path: /etc/pki/ciao/auth-CA.pem
+    cnci_vcpus: 6
+  storage:
+    ceph_id: ciao
+`
+
+// freePort returns a TCP port on which nothing is listening.
+func freePort(t *testing.T) uint32 {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	return uint32(l.Addr().(*net.TCPAddr).Port)
+}
+
+func connectTestSSNTPConfig(port uint32) *ssntp.Config {
+	return &ssntp.Config{
+		URI:    "localhost",
+		UUID:   uuid.Generate().String(),
+		Port:   port,
+		CAcert: ssntp.DefaultCACert,
+		Cert:   ssntp.RoleToDefaultCertName(ssntp.Controller),
+	}
+}
+
+func TestSSNTPConnectRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connect-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "configuration.yaml")
+	err = ioutil.WriteFile(path, []byte(connectTestConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+
+	type result struct {
+		client        controllerClient
+		clusterConfig payloads.Configure
+		err           error
+	}
+	resultCh := make(chan result, 1)
+
+	go func() {
+		client, clusterConfig, err := newSSNTPClient(ctl, connectTestSSNTPConfig(port), time.Minute)
+		resultCh <- result{client, clusterConfig, err}
+	}()
+
+	// the scheduler comes up after the controller
+	time.Sleep(500 * time.Millisecond)
+
+	server := testutil.StartConfiguredTestServer(port, "file://"+path)
+	defer server.Shutdown()
+
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			t.Fatalf("Unable to connect: %v", r.err)
+		}
+		defer r.client.Disconnect()
+
+		if r.clusterConfig.Configure.Controller.CNCIVcpus != 6 {
+			t.Fatalf("Unexpected cluster configuration: %+v", r.clusterConfig.Configure.Controller)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("Timed out waiting for connection")
+	}
+}
+
+func TestSSNTPConnectTimeout(t *testing.T) {
+	saved := ssntpRetryDelay
+	ssntpRetryDelay = 100 * time.Millisecond
+	defer func() { ssntpRetryDelay = saved }()
+
+	start := time.Now()
+	_, _, err := newSSNTPClient(ctl, connectTestSSNTPConfig(freePort(t)), 2*time.Second)
+	if err == nil {
+		t.Fatal("Expected connection to fail")
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed > 10*time.Second {
+		t.Fatalf("Expected to give up after the timeout, gave up after %v", elapsed)
+	}
+}
+
+func TestSSNTPConnectNoConfiguration(t *testing.T) {
+	saved := ssntpRetryDelay
+	ssntpRetryDelay = 100 * time.Millisecond
+	defer func() { ssntpRetryDelay = saved }()
+
+	// the scheduler has no cluster configuration to send
+	port := freePort(t)
+	server := testutil.StartConfiguredTestServer(port, "")
+	defer server.Shutdown()
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+
+		if i == 50 {
+			t.Fatalf("Server not listening: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_, _, err := newSSNTPClient(ctl, connectTestSSNTPConfig(port), 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "cluster configuration") {
+		t.Fatalf("Expected retrieving the cluster configuration to fail, got %v", err)
+	}
+}
+
+func TestConfigureCommand(t *testing.T) {
+	restore := setTestConfig(func(cfg *controllerConfig) {
+		*cfg = defaultConfig()
+	})
+	defer func() {
+		restore()
+		ctl.ds.GenerateCNCIWorkload(4, 128, 128, "")
+	}()
+
+	ID, err := ctl.ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clusterConfig payloads.Configure
+	clusterConfig.Configure.Controller.CNCIVcpus = 6
+	clusterConfig.Configure.Controller.AdminSSHKey = "ssh-rsa configure-test"
+	clusterConfig.Configure.Controller.CNCINet = "10.0.0.0"
+
+	payload, err := yaml.Marshal(&clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrappedClient.CommandNotify(ssntp.CONFIGURE, &ssntp.Frame{Payload: payload})
+
+	wl, err := ctl.ds.GetWorkload(ID)
+	if err != nil {
+		t.Fatalf("CNCI workload not kept: %v", err)
+	}
+
+	if wl.Requirements.VCPUs != 6 || !strings.Contains(wl.Config, "ssh-rsa configure-test") {
+		t.Fatalf("CNCI workload not regenerated: %+v", wl)
+	}
+
+	if cfg := ctl.config.config(); cfg.CNCINet != defaultConfig().CNCINet {
+		t.Fatalf("cnci_net should be deferred until restart: %s", cfg.CNCINet)
+	}
+}
+
+func TestServerCertReload(t *testing.T) {
+	saved := ctl.serverCert.cert
+	defer func() {
+		ctl.serverCert.Lock()
+		ctl.serverCert.cert = saved
+		ctl.serverCert.Unlock()
+	}()
+
+	err := ctl.loadServerCert(httpsCAcert, httpsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ctl.serverCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.loadServerCert("/does/not/exist.pem", httpsKey)
+	if err == nil {
+		t.Fatal("Expected missing certificate to be rejected")
+	}
+
+	current, err := ctl.serverCertificate(nil)
+	if err != nil || current != cert {
+		t.Fatalf("Previous certificate not kept: %v", err)
+	}
+}
@@ -104,6 +104,10 @@ func (client *ssntpClientWrapper) RestoreNode(nodeID string) error {
 	return client.realClient.RestoreNode(nodeID)
 }
 
+func (client *ssntpClientWrapper) nodeMaintenance(nodeID string, maintenance bool) error {
+	return client.realClient.nodeMaintenance(nodeID, maintenance)
+}
+
 func (client *ssntpClientWrapper) mapExternalIP(t types.Tenant, m types.MappedIP) error {
 	return client.realClient.mapExternalIP(t, m)
 }
@@ -112,8 +116,40 @@ func (client *ssntpClientWrapper) unMapExternalIP(t types.Tenant, m types.Mapped
 	return client.realClient.unMapExternalIP(t, m)
 }
 
-func (client *ssntpClientWrapper) attachVolume(volID string, instanceID string, nodeID string) error {
-	return client.realClient.attachVolume(volID, instanceID, nodeID)
+func (client *ssntpClientWrapper) attachVolume(volID string, instanceID string, nodeID string, tag string) error {
+	return client.realClient.attachVolume(volID, instanceID, nodeID, tag)
+}
+
+func (client *ssntpClientWrapper) detachVolume(volID string, instanceID string, nodeID string) error {
+	return client.realClient.detachVolume(volID, instanceID, nodeID)
+}
+
+func (client *ssntpClientWrapper) requestInventory(nodeID string) error {
+	return client.realClient.requestInventory(nodeID)
+}
+
+func (client *ssntpClientWrapper) prefetchImage(nodeID string, imageID string) error {
+	return client.realClient.prefetchImage(nodeID, imageID)
+}
+
+func (client *ssntpClientWrapper) prepareMigration(cmd payloads.PrepareMigrationCmd) error {
+	return client.realClient.prepareMigration(cmd)
+}
+
+func (client *ssntpClientWrapper) migrateInstance(instanceID string, nodeID string, targetNodeID string, address string) error {
+	return client.realClient.migrateInstance(instanceID, nodeID, targetNodeID, address)
+}
+
+func (client *ssntpClientWrapper) abortMigration(instanceID string, nodeID string) error {
+	return client.realClient.abortMigration(instanceID, nodeID)
+}
+
+func (client *ssntpClientWrapper) consoleLog(instanceID string, nodeID string, requestID string, length int) error {
+	return client.realClient.consoleLog(instanceID, nodeID, requestID, length)
+}
+
+func (client *ssntpClientWrapper) resizeInstance(instanceID string, nodeID string, vcpus int, memMB int) error {
+	return client.realClient.resizeInstance(instanceID, nodeID, vcpus, memMB)
 }
 
 func (client *ssntpClientWrapper) ssntpClient() *ssntp.Client {
@@ -0,0 +1,211 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+)
+
+// clockSkewSamples is the number of offset samples over which the clock
+// offset of a node is smoothed.
+const clockSkewSamples = 5
+
+// clockSkewMinSamples is the number of samples needed before a node's
+// clock is considered skewed, so that a single delayed stats message is
+// not mistaken for skew.
+const clockSkewMinSamples = 3
+
+// nodeClock is the clock offset of a single node.  The offset is the
+// median of the most recent samples, which ignores the occasional message
+// delayed by the network.
+type nodeClock struct {
+	samples []time.Duration
+	offset  time.Duration
+	skewed  bool
+}
+
+// nodeClockOffset is the smoothed clock offset of a node, positive if the
+// node's clock is ahead of the controller's.
+type nodeClockOffset struct {
+	nodeID string
+	offset time.Duration
+	skewed bool
+}
+
+// clockSkewTransition describes a node's clock drifting beyond the skew
+// threshold or returning within it.
+type clockSkewTransition struct {
+	nodeClockOffset
+	threshold time.Duration
+}
+
+func (t clockSkewTransition) String() string {
+	if t.skewed {
+		return fmt.Sprintf("Clock of node %s is %s from the controller's, more than %s",
+			t.nodeID, t.offset, t.threshold)
+	}
+	return fmt.Sprintf("Clock of node %s is %s from the controller's, within %s",
+		t.nodeID, t.offset, t.threshold)
+}
+
+// clockSkewTracker measures the clock offset of each node from the
+// timestamps of the stats it sends.  The offset includes the time taken
+// to deliver the stats, which is assumed to be small compared to the skew
+// threshold.
+type clockSkewTracker struct {
+	now   func() time.Time
+	lock  sync.Mutex
+	nodes map[string]*nodeClock
+}
+
+func newClockSkewTracker(now func() time.Time) *clockSkewTracker {
+	return &clockSkewTracker{
+		now:   now,
+		nodes: make(map[string]*nodeClock),
+	}
+}
+
+func medianOffset(samples []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func absOffset(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// sample records that a node sent stats at sent, according to its own
+// clock.  It returns the time at which the stats were sent according to
+// the controller's clock, compensating for the node's smoothed offset, and
+// the change, if any, in whether the node's clock is skewed.
+func (t *clockSkewTracker) sample(nodeID string, sent time.Time, threshold time.Duration) (time.Time, []clockSkewTransition) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n, ok := t.nodes[nodeID]
+	if !ok {
+		n = &nodeClock{}
+		t.nodes[nodeID] = n
+	}
+
+	n.samples = append(n.samples, sent.Sub(t.now()))
+	if len(n.samples) > clockSkewSamples {
+		n.samples = n.samples[1:]
+	}
+	n.offset = medianOffset(n.samples)
+
+	seen := sent.Add(-n.offset)
+
+	skewed := n.skewed
+	if len(n.samples) >= clockSkewMinSamples {
+		skewed = absOffset(n.offset) > threshold
+	}
+
+	if skewed == n.skewed {
+		return seen, nil
+	}
+	n.skewed = skewed
+
+	return seen, []clockSkewTransition{{
+		nodeClockOffset: nodeClockOffset{nodeID: nodeID, offset: n.offset, skewed: skewed},
+		threshold:       threshold,
+	}}
+}
+
+// offsets returns the clock offsets of the nodes, furthest from the
+// controller's clock first.
+func (t *clockSkewTracker) offsets() []nodeClockOffset {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	offsets := make([]nodeClockOffset, 0, len(t.nodes))
+	for ID, n := range t.nodes {
+		offsets = append(offsets, nodeClockOffset{nodeID: ID, offset: n.offset, skewed: n.skewed})
+	}
+
+	sort.Slice(offsets, func(i, j int) bool {
+		a, b := absOffset(offsets[i].offset), absOffset(offsets[j].offset)
+		if a != b {
+			return a > b
+		}
+		return offsets[i].nodeID < offsets[j].nodeID
+	})
+
+	return offsets
+}
+
+// remove stops tracking a node which has disconnected.
+func (t *clockSkewTracker) remove(nodeID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.nodes, nodeID)
+}
+
+// nodeClockSample is called when stats timestamped by a node are received.
+// It returns the time at which the stats were sent according to the
+// controller's clock.
+func (c *controller) nodeClockSample(nodeID string, sent time.Time) time.Time {
+	threshold := c.durationSetting(settingClockSkewThreshold)
+	seen, transitions := c.clockSkew.sample(nodeID, sent, threshold)
+
+	for _, t := range transitions {
+		log := clogger.With(c.log, "node", t.nodeID)
+		if t.skewed {
+			log.Warningf("%s", t)
+		} else {
+			log.Infof("%s", t)
+		}
+
+		c.publishEvent(types.NodeClockSkewEvent, "", t.String(), map[string]string{
+			"node_id":   t.nodeID,
+			"offset_ms": strconv.FormatInt(int64(t.offset/time.Millisecond), 10),
+			"skewed":    strconv.FormatBool(t.skewed),
+		})
+	}
+
+	c.metrics.clockOffsets(c.clockSkew.offsets())
+
+	return seen
+}
+
+// nodeClockOffsets returns the clock offsets of the nodes indexed by node.
+func (c *controller) nodeClockOffsets() map[string]nodeClockOffset {
+	offsets := make(map[string]nodeClockOffset)
+	if c.clockSkew == nil {
+		return offsets
+	}
+
+	for _, o := range c.clockSkew.offsets() {
+		offsets[o.nodeID] = o
+	}
+	return offsets
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestClockSkewSmoothing(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s := newClockSkewTracker(clock.Now)
+	threshold := 5 * time.Second
+
+	// a node 10s ahead whose second stats are delayed by the network
+	delays := []time.Duration{0, 3 * time.Second, 0}
+	for i, d := range delays {
+		clock.advance(time.Second)
+		_, tr := s.sample("node", clock.now.Add(10*time.Second-d), threshold)
+		if i < len(delays)-1 && len(tr) != 0 {
+			t.Fatalf("Skew reported after %d samples", i+1)
+		}
+		if i == len(delays)-1 && (len(tr) != 1 || !tr[0].skewed) {
+			t.Fatalf("Expected node to become skewed, got %v", tr)
+		}
+	}
+
+	offsets := s.offsets()
+	if len(offsets) != 1 || offsets[0].offset != 10*time.Second {
+		t.Fatalf("Expected smoothed offset of 10s, got %+v", offsets)
+	}
+
+	// the node's clock is corrected
+	for i := 0; i < clockSkewSamples; i++ {
+		clock.advance(time.Second)
+		_, tr := s.sample("node", clock.now, threshold)
+		if len(tr) == 1 && !tr[0].skewed {
+			return
+		}
+	}
+
+	t.Fatal("Node still skewed after its clock was corrected")
+}
+
+func TestClockSkewOffsetsOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s := newClockSkewTracker(clock.Now)
+
+	s.sample("a", clock.now.Add(time.Second), time.Minute)
+	s.sample("b", clock.now.Add(-time.Hour), time.Minute)
+	s.sample("c", clock.now, time.Minute)
+
+	offsets := s.offsets()
+	if len(offsets) != 3 || offsets[0].nodeID != "b" || offsets[1].nodeID != "a" {
+		t.Fatalf("Expected nodes furthest from the controller first, got %+v", offsets)
+	}
+
+	s.remove("b")
+	if len(s.offsets()) != 2 {
+		t.Fatal("Node not removed")
+	}
+}
+
+func TestClockSkewCompensatedStaleness(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s := newClockSkewTracker(clock.Now)
+	l := newLivenessTracker(clock.Now)
+	raw := newLivenessTracker(clock.Now)
+
+	// the node's clock is 10 minutes behind the controller's
+	skew := -10 * time.Minute
+	for i := 0; i < clockSkewSamples; i++ {
+		sent := clock.now.Add(skew)
+		seen, _ := s.sample("node", sent, 5*time.Second)
+		expectTransitions(t, "compensated stats", l.heartbeatAt("node", seen, testThresholds))
+		raw.heartbeatAt("node", sent, testThresholds)
+		clock.advance(10 * time.Second)
+	}
+
+	// stats timestamped by the skewed clock all appear stale
+	if len(raw.nodes) != 0 {
+		t.Fatal("Expected raw timestamps to be ignored as stale")
+	}
+
+	// stats delayed for longer than the suspect timeout are stale even
+	// though the node's clock is behind
+	clock.advance(testThresholds.suspect)
+	seen, _ := s.sample("node", clock.now.Add(skew-testThresholds.suspect), 5*time.Second)
+	expectTransitions(t, "delayed stats", l.heartbeatAt("node", seen, testThresholds),
+		types.NodeStatusSuspect)
+}
+
+func waitClockSkewEvent(t *testing.T, ch chan types.Event, nodeID string) types.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.Type == types.NodeClockSkewEvent && e.Data["node_id"] == nodeID {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %s event published for %s", types.NodeClockSkewEvent, nodeID)
+		}
+	}
+}
+
+func TestNodeClockSkew(t *testing.T) {
+	ctl.clockSkew = newClockSkewTracker(time.Now)
+	defer func() { ctl.clockSkew = nil }()
+
+	client, err := testutil.NewSsntpTestClientConnection("ClockSkew", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	ch := ctl.events.subscribe(10)
+	defer ctl.events.unsubscribe(ch)
+
+	client.SetClockOffset(-time.Minute)
+	for i := 0; i < clockSkewMinSamples; i++ {
+		sendStatsCmd(client, t)
+	}
+
+	e := waitClockSkewEvent(t, ch, testutil.AgentUUID)
+	if e.Data["skewed"] != "true" {
+		t.Fatalf("Expected node to be reported skewed: %+v", e)
+	}
+
+	offset, ok := ctl.metrics.nodeClockOffsets.Value(testutil.AgentUUID)
+	if !ok || offset > -59000 || offset < -61000 {
+		t.Errorf("Expected clock offset metric of about -60000ms, got %d", offset)
+	}
+	if ctl.metrics.nodesClockSkewed.Value() != 1 {
+		t.Errorf("Expected 1 skewed node, got %d", ctl.metrics.nodesClockSkewed.Value())
+	}
+
+	url := testutil.ComputeURL + "/v2.1/nodes"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var result types.CiaoNodes
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, n := range result.Nodes {
+		if n.ID == testutil.AgentUUID {
+			found = true
+			if !n.ClockSkewed || n.ClockOffset > -59000 {
+				t.Errorf("Clock skew not shown on node list: %+v", n)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Node not listed")
+	}
+
+	client.SetClockOffset(0)
+	for i := 0; i < clockSkewSamples; i++ {
+		sendStatsCmd(client, t)
+	}
+
+	e = waitClockSkewEvent(t, ch, testutil.AgentUUID)
+	if e.Data["skewed"] != "false" {
+		t.Fatalf("Expected node to be reported within the threshold: %+v", e)
+	}
+}
@@ -25,8 +25,8 @@ import (
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
@@ -56,6 +56,9 @@ type CNCI struct {
 	eventCh  *chan event
 	subnet   string
 	timer    *time.Timer
+
+	// lastSeen is when the CNCI was last reported running by its node
+	lastSeen time.Time
 }
 
 // CNCIManager is a structure which defines a manager for CNCI instances
@@ -63,6 +66,7 @@ type CNCI struct {
 type CNCIManager struct {
 	tenant string
 	ctrl   *controller
+	log    clogger.CiaoLog
 
 	// there's no reason to have separate lock for each map.
 	cnciLock sync.RWMutex
@@ -72,6 +76,9 @@ type CNCIManager struct {
 
 	// this is a map of subnet strings to CNCI structs
 	subnets map[string]*CNCI
+
+	// this is a map of subnet strings to the failovers of their CNCIs
+	failovers map[string]*cnciFailover
 }
 
 func (c *CNCI) stop() error {
@@ -80,7 +87,7 @@ func (c *CNCI) stop() error {
 		return err
 	}
 
-	err = c.ctrl.deleteInstance(c.instance.ID)
+	err = c.ctrl.deleteInstance(c.ctrl.ctx, c.instance.ID)
 	if err != nil {
 		return errors.Wrapf(err, "error deleting CNCI instance")
 	}
@@ -101,11 +108,12 @@ func waitForEventTimeout(ch chan event, e event, timeout time.Duration) error {
 }
 
 func (c *CNCI) transitionState(to CNCIState) {
-	glog.Infof("State transition to %s received for %s", to, c.instance.ID)
+	log := clogger.With(c.ctrl.log, "tenant", c.instance.TenantID, "instance", c.instance.ID)
+	log.Infof("State transition to %s received", to)
 
 	err := c.instance.TransitionInstanceState(string(to))
 	if err != nil {
-		glog.Warningf("Error transitioning instance %s to %s state", c.instance.ID, string(to))
+		log.Warningf("Error transitioning instance to %s state: %v", string(to), err)
 	}
 
 	// some state changes cause events
@@ -169,37 +177,89 @@ func (c *CNCIManager) Active(ID string) bool {
 }
 
 func (c *CNCIManager) launch(subnet string) (*types.Instance, error) {
-	glog.V(2).Infof("launching cnci for subnet %s", subnet)
+	if c.log.V(2) {
+		c.log.Infof("launching cnci for subnet %s", subnet)
+	}
+
+	return c.ctrl.launchCNCI(c.tenant, subnet)
+}
 
+// launchCNCI launches a CNCI for a tenant's subnet.  CNCIs launched ahead of
+// demand have no tenant and are launched onto cnciPoolSubnet.
+func (c *controller) launchCNCI(tenantID string, subnet string) (*types.Instance, error) {
 	b := make([]byte, 4)
 	_, err := rand.Read(b)
 	if err != nil {
 		return nil, err
 	}
 
-	name := fmt.Sprintf("cnci-%s-%s", c.tenant, hex.EncodeToString(b))
+	owner := tenantID
+	if owner == "" {
+		owner = "pool"
+	}
+	name := fmt.Sprintf("cnci-%s-%s", owner, hex.EncodeToString(b))
 
-	workloadID, err := c.ctrl.ds.GetCNCIWorkloadID()
+	workloadID, err := c.ds.GetCNCIWorkloadID()
+	if err != nil {
+		return nil, err
+	}
+
+	wl, err := c.ds.GetWorkload(workloadID)
 	if err != nil {
 		return nil, err
 	}
 
 	w := types.WorkloadRequest{
 		WorkloadID: workloadID,
-		TenantID:   c.tenant,
+		TenantID:   tenantID,
 		Instances:  1,
 		Subnet:     subnet,
 		Name:       name,
 	}
 
-	instances, err := c.ctrl.startWorkload(w)
+	if tenantID != "" {
+		w.Overrides, err = c.cnciOverrides(tenantID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instances, err := c.startWorkload(c.ctx, w)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to Launch CNCI")
 	}
 
+	// remember which image the CNCI runs so that it can be upgraded
+	if len(wl.Storage) > 0 {
+		err = c.ds.SetCNCIInstanceImage(instances[0].ID, wl.Storage[0].Source)
+		if err != nil {
+			c.log.Warningf("Unable to record image of CNCI %s: %v", instances[0].ID, err)
+		}
+	}
+
 	return instances[0], nil
 }
 
+// cnciOverrides returns the overrides of the CNCI workload's requirements
+// with which the CNCIs of a tenant are launched.  The disk size of the
+// tenant's CNCIs is rounded up to whole GiB.
+func (c *controller) cnciOverrides(tenantID string) (types.RequirementOverrides, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.RequirementOverrides{}, err
+	}
+
+	if tenant == nil || tenant.CNCISize == nil {
+		return types.RequirementOverrides{}, nil
+	}
+
+	return types.RequirementOverrides{
+		VCPUs:  tenant.CNCISize.VCPUs,
+		MemMB:  tenant.CNCISize.MemMB,
+		DiskGB: (tenant.CNCISize.DiskMB + 1023) / 1024,
+	}, nil
+}
+
 // WaitForActive will launch a cnci if needed and wait for it to be active,
 // or wait for an existing cnci to become active.
 func (c *CNCIManager) WaitForActive(subnet string) error {
@@ -219,7 +279,31 @@ func (c *CNCIManager) WaitForActive(subnet string) error {
 		return c.waitForActive(subnet)
 	}
 
-	glog.V(2).Infof("cnci does not exist for subnet %s", subnet)
+	if c.log.V(2) {
+		c.log.Infof("cnci does not exist for subnet %s", subnet)
+	}
+
+	// a CNCI from the pool is already active and only needs to be told
+	// about the subnet, unless the tenant's CNCIs are not of the size
+	// of the pooled CNCIs.
+	var instance *types.Instance
+	if o, err := c.ctrl.cnciOverrides(c.tenant); err == nil && o == (types.RequirementOverrides{}) {
+		instance = c.ctrl.claimPoolCNCI()
+	}
+
+	if instance != nil {
+		err := c.assignPoolCNCI(instance, subnet)
+		c.cnciLock.Unlock()
+		if err == nil {
+			err = c.refresh()
+			if err == nil {
+				c.ctrl.poolCNCIConfigured(instance.ID)
+			}
+			return err
+		}
+		c.log.Warningf("Unable to use pooled CNCI %s for subnet %s: %v", instance.ID, subnet, err)
+		c.cnciLock.Lock()
+	}
 
 	ch := make(chan event)
 
@@ -245,7 +329,9 @@ func (c *CNCIManager) WaitForActive(subnet string) error {
 		return err
 	}
 
-	glog.V(2).Infof("AddSubnet CNCI instance is %s", instance.ID)
+	if c.log.V(2) {
+		c.log.Infof("AddSubnet CNCI instance is %s", instance.ID)
+	}
 
 	cnci.instance = instance
 	cnci.subnet = subnet
@@ -264,6 +350,120 @@ func (c *CNCIManager) WaitForActive(subnet string) error {
 	return c.refresh()
 }
 
+// assignPoolCNCI makes a CNCI claimed from the pool serve subnet.  The CNCI
+// learns of the subnet from the refresh sent to the tenant's CNCIs once it
+// has been assigned, after which it is no longer part of the pool.  The
+// caller must hold cnciLock.
+func (c *CNCIManager) assignPoolCNCI(instance *types.Instance, subnet string) error {
+	err := c.ctrl.ds.AssignCNCI(instance.ID, c.tenant, subnet)
+	if err != nil {
+		return err
+	}
+
+	cnci := &CNCI{
+		ctrl:     c.ctrl,
+		instance: instance,
+		subnet:   subnet,
+	}
+
+	c.subnets[subnet] = cnci
+	c.cncis[instance.ID] = cnci
+
+	if c.log.V(2) {
+		c.log.Infof("Pooled CNCI %s assigned to subnet %s", instance.ID, subnet)
+	}
+
+	return nil
+}
+
+// Replace launches a new CNCI for subnet from the current CNCI image and,
+// once it is active, makes it serve the subnet in place of the existing
+// CNCI, which is then stopped.  If the new CNCI fails to start the
+// existing CNCI continues to serve the subnet.  The new CNCI is returned.
+func (c *CNCIManager) Replace(subnet string) (*types.Instance, error) {
+	c.cnciLock.Lock()
+
+	old, ok := c.subnets[subnet]
+	if !ok {
+		c.cnciLock.Unlock()
+		return nil, errors.New("Subnet doesn't exist")
+	}
+
+	if old.eventCh != nil {
+		c.cnciLock.Unlock()
+		return nil, errors.New("CNCI for subnet is changing state")
+	}
+
+	ch := make(chan event)
+
+	cnci := &CNCI{
+		ctrl:    c.ctrl,
+		eventCh: &ch,
+		subnet:  subnet,
+	}
+
+	defer func() {
+		close(ch)
+		cnci.eventCh = nil
+	}()
+
+	instance, err := c.launch(subnet)
+	if err != nil {
+		c.cnciLock.Unlock()
+		return nil, err
+	}
+
+	cnci.instance = instance
+	c.cncis[instance.ID] = cnci
+
+	c.cnciLock.Unlock()
+
+	err = waitForEventTimeout(ch, added, cnciEventTimeout)
+	if err != nil {
+		c.cnciLock.Lock()
+		_, launched := c.cncis[instance.ID]
+		delete(c.cncis, instance.ID)
+		c.cnciLock.Unlock()
+
+		// a CNCI which failed to start has already been removed
+		if launched {
+			if err := cnci.stop(); err != nil {
+				c.log.Warningf("Unable to stop replacement CNCI %s: %v", instance.ID, err)
+			}
+		}
+
+		return nil, errors.Wrapf(err, "Replacement CNCI %s for subnet %s failed", instance.ID, subnet)
+	}
+
+	c.cnciLock.Lock()
+
+	c.subnets[subnet] = cnci
+	delete(c.cncis, old.instance.ID)
+
+	// the replacement inherits a pending removal of an unused subnet
+	scheduled := old.timer != nil
+	if scheduled {
+		old.timer.Stop()
+		old.timer = nil
+	}
+
+	c.cnciLock.Unlock()
+
+	err = old.stop()
+	if err != nil {
+		c.log.Warningf("Unable to stop replaced CNCI %s: %v", old.instance.ID, err)
+	}
+
+	if scheduled {
+		err = c.ScheduleRemoveSubnet(subnet)
+		if err != nil {
+			c.log.Warningf("Unable to remove subnet (%v)", err)
+		}
+	}
+
+	return instance, c.refresh()
+}
+
 // ScheduleRemoveSubnet will kick off a timer to remove a subnet after 5 min.
 // If a subnet is requested to be used again before the timer expires, the
 // timer will get cancelled and the subnet will not be removed.
@@ -290,7 +490,7 @@ func (c *CNCIManager) ScheduleRemoveSubnet(subnet string) error {
 
 		err := c.RemoveSubnet(subnet)
 		if err != nil {
-			glog.Warningf("Unable to remove subnet: (%v)\n", err)
+			c.log.Warningf("Unable to remove subnet: (%v)", err)
 		}
 	})
 
@@ -302,7 +502,9 @@ func (c *CNCIManager) ScheduleRemoveSubnet(subnet string) error {
 // RemoveSubnet is called when a subnet no longer is needed.
 // a cnci can be stopped.
 func (c *CNCIManager) RemoveSubnet(subnet string) error {
-	glog.V(2).Infof("RemoveSubnet %s", subnet)
+	if c.log.V(2) {
+		c.log.Infof("RemoveSubnet %s", subnet)
+	}
 
 	c.cnciLock.Lock()
 
@@ -403,7 +605,11 @@ func (c *CNCIManager) StartFailure(id string) error {
 	}
 
 	delete(c.cncis, id)
-	delete(c.subnets, cnci.subnet)
+
+	// a failed replacement leaves the existing CNCI serving the subnet
+	if c.subnets[cnci.subnet] == cnci {
+		delete(c.subnets, cnci.subnet)
+	}
 
 	cnci.transitionState(failed)
 
@@ -472,7 +678,7 @@ func (c *CNCIManager) refresh() error {
 		err := c.ctrl.client.CNCIRefresh(cnci.instance.ID, cnciList)
 		if err != nil {
 			// keep going, but log error.
-			glog.Warningf("Unable to send cnci refresh to %s: (%v)", cnci.instance.ID, err)
+			c.log.Warningf("Unable to send cnci refresh to %s: (%v)", cnci.instance.ID, err)
 		}
 	}
 
@@ -549,9 +755,11 @@ func newCNCIManager(ctrl *controller, tenant string) (*CNCIManager, error) {
 	mgr := CNCIManager{
 		tenant: tenant,
 		ctrl:   ctrl,
+		log:    clogger.With(ctrl.log, "tenant", tenant),
 
-		cncis:   make(map[string]*CNCI),
-		subnets: make(map[string]*CNCI),
+		cncis:     make(map[string]*CNCI),
+		subnets:   make(map[string]*CNCI),
+		failovers: make(map[string]*cnciFailover),
 	}
 
 	instances, err := ctrl.ds.GetTenantCNCIs(tenant)
@@ -563,6 +771,10 @@ func newCNCIManager(ctrl *controller, tenant string) (*CNCIManager, error) {
 	// anymore.
 
 	for _, i := range instances {
+		if _, _, err := net.ParseCIDR(i.Subnet); err != nil {
+			return nil, errors.Errorf("CNCI %s has invalid subnet %q", i.ID, i.Subnet)
+		}
+
 		cnci := CNCI{
 			ctrl: ctrl,
 		}
@@ -587,7 +799,7 @@ func newCNCIManager(ctrl *controller, tenant string) (*CNCIManager, error) {
 			err = mgr.ScheduleRemoveSubnet(i.Subnet)
 			if err != nil {
 				// keep going, but log error.
-				glog.Warningf("Unable to remove subnet (%v)", err)
+				mgr.log.Warningf("Unable to remove subnet (%v)", err)
 			}
 		}
 
@@ -620,10 +832,13 @@ func initializeCNCICtrls(c *controller) error {
 	}
 
 	for _, t := range ts {
-		t.CNCIctrl, err = newCNCIManager(c, t.ID)
+		mgr, err := newCNCIManager(c, t.ID)
 		if err != nil {
-			return errors.Wrap(err, "error allocating CNCI manager")
+			c.tenantNetworkFailed(t, err)
+			continue
 		}
+
+		t.CNCIctrl = mgr
 	}
 
 	return nil
@@ -0,0 +1,197 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+)
+
+// degradedTenantState tracks the tenants whose network controllers could
+// not be initialized.  It is only held in memory as the network controllers
+// are initialized afresh each time the controller starts.
+type degradedTenantState struct {
+	sync.Mutex
+	tenants map[string]types.DegradedTenant
+}
+
+// degradedCNCIManager stands in for the network controller of a degraded
+// tenant so that everything which needs the tenant's CNCIs fails with the
+// reason the network controller could not be initialized.
+type degradedCNCIManager struct {
+	err error
+}
+
+func (d degradedCNCIManager) CNCIAdded(ID string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) CNCIRemoved(ID string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) CNCIStopped(ID string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) StartFailure(ID string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) Active(ID string) bool {
+	return false
+}
+
+func (d degradedCNCIManager) ScheduleRemoveSubnet(subnet string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) RemoveSubnet(subnet string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) WaitForActive(subnet string) error {
+	return d.err
+}
+
+func (d degradedCNCIManager) GetInstanceCNCI(InstanceID string) (*types.Instance, error) {
+	return nil, d.err
+}
+
+func (d degradedCNCIManager) GetSubnetCNCI(subnet string) (*types.Instance, error) {
+	return nil, d.err
+}
+
+func (d degradedCNCIManager) Replace(subnet string) (*types.Instance, error) {
+	return nil, d.err
+}
+
+func (d degradedCNCIManager) Shutdown() {
+}
+
+// tenantNetworkFailed records that the network controller of a tenant could
+// not be initialized, in the tenant's event log and on the event hub, and
+// leaves the tenant with a network controller which rejects all requests.
+func (c *controller) tenantNetworkFailed(tenant *types.Tenant, err error) {
+	degraded := types.DegradedTenant{
+		TenantID: tenant.ID,
+		Error:    err.Error(),
+		Time:     time.Now(),
+	}
+
+	c.degradedTenants.Lock()
+	if c.degradedTenants.tenants == nil {
+		c.degradedTenants.tenants = make(map[string]types.DegradedTenant)
+	}
+	c.degradedTenants.tenants[tenant.ID] = degraded
+	c.degradedTenants.Unlock()
+
+	tenant.CNCIctrl = degradedCNCIManager{
+		err: &types.TenantNetworkDegradedError{TenantID: tenant.ID, Reason: degraded.Error},
+	}
+
+	msg := fmt.Sprintf("Tenant network controller failed to initialize: %v", err)
+	c.log.Errorf("%s for tenant %s", msg, tenant.ID)
+	if err := c.ds.LogError(tenant.ID, msg); err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+	c.publishEvent(types.TenantNetworkDegradedEvent, tenant.ID, msg, map[string]string{
+		"error": degraded.Error,
+	})
+}
+
+// tenantNetworkDegraded returns an error if the network controller of a
+// tenant could not be initialized.
+func (c *controller) tenantNetworkDegraded(tenantID string) error {
+	c.degradedTenants.Lock()
+	defer c.degradedTenants.Unlock()
+
+	degraded, ok := c.degradedTenants.tenants[tenantID]
+	if !ok {
+		return nil
+	}
+
+	return &types.TenantNetworkDegradedError{TenantID: tenantID, Reason: degraded.Error}
+}
+
+// forgetDegradedTenant stops tracking a tenant, because its network
+// controller has been initialized or because it has been deleted.
+func (c *controller) forgetDegradedTenant(tenantID string) {
+	c.degradedTenants.Lock()
+	defer c.degradedTenants.Unlock()
+
+	delete(c.degradedTenants.tenants, tenantID)
+}
+
+// listDegradedTenants returns the tenants whose network controllers could
+// not be initialized, ordered by tenant.
+func (c *controller) listDegradedTenants() []types.DegradedTenant {
+	c.degradedTenants.Lock()
+	defer c.degradedTenants.Unlock()
+
+	var degraded []types.DegradedTenant
+	for _, d := range c.degradedTenants.tenants {
+		degraded = append(degraded, d)
+	}
+
+	sort.Slice(degraded, func(i, j int) bool {
+		return degraded[i].TenantID < degraded[j].TenantID
+	})
+
+	return degraded
+}
+
+// RetryTenantNetwork attempts again to initialize the network controller of
+// a degraded tenant, e.g. once its CNCI records have been repaired.  It
+// does nothing for tenants which are not degraded.
+func (c *controller) RetryTenantNetwork(ctx context.Context, tenantID string) error {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if tenant == nil {
+		return types.ErrTenantNotFound
+	}
+
+	if c.tenantNetworkDegraded(tenantID) == nil {
+		return nil
+	}
+
+	mgr, err := newCNCIManager(c, tenantID)
+	if err != nil {
+		c.tenantNetworkFailed(tenant, err)
+		return c.tenantNetworkDegraded(tenantID)
+	}
+
+	tenant.CNCIctrl = mgr
+	c.forgetDegradedTenant(tenantID)
+
+	msg := "Tenant network controller initialized on retry"
+	err = c.ds.LogAction(tenantID, tenantID, service.GetActor(ctx), service.GetOnBehalfOf(ctx), msg)
+	if err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+	c.log.Infof("%s for tenant %s", msg, tenantID)
+	c.publishEvent(types.TenantNetworkRecoveredEvent, tenantID, msg, nil)
+
+	return nil
+}
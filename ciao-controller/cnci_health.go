@@ -0,0 +1,263 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
+
+// cnciHealthCheckPeriod is how often the CNCIs are checked for missed stats.
+const cnciHealthCheckPeriod = time.Second
+
+// cnciFailoverMaxBackoff bounds the delay between failovers of a subnet.
+const cnciFailoverMaxBackoff = time.Hour
+
+// cnciFailover tracks the failovers of the CNCIs of a subnet so that a
+// subnet whose CNCIs keep failing is not failed over in a loop.
+type cnciFailover struct {
+	attempts   int
+	last       time.Time
+	inProgress bool
+}
+
+// failoverBackoff returns how long after a failover the subnet may be
+// failed over again, given the number of failovers already made.
+func failoverBackoff(base time.Duration, attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+
+	backoff := base
+	for i := 1; i < attempts && backoff < cnciFailoverMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > cnciFailoverMaxBackoff {
+		return cnciFailoverMaxBackoff
+	}
+
+	return backoff
+}
+
+// heartbeat records that a CNCI was reported running at t.
+func (c *CNCIManager) heartbeat(id string, t time.Time) {
+	c.cnciLock.Lock()
+	defer c.cnciLock.Unlock()
+
+	cnci, ok := c.cncis[id]
+	if !ok {
+		return
+	}
+
+	if t.After(cnci.lastSeen) {
+		cnci.lastSeen = t
+	}
+}
+
+// failedSubnets returns the subnets whose active CNCI has not been reported
+// running for timeout and which may be failed over at now.  The returned
+// subnets are marked as being failed over until failoverDone is called.
+// A CNCI which has not yet been reported running is given timeout from
+// the first check which sees it.
+func (c *CNCIManager) failedSubnets(now time.Time, timeout time.Duration, backoff time.Duration) []string {
+	c.cnciLock.Lock()
+	defer c.cnciLock.Unlock()
+
+	var subnets []string
+	for subnet, cnci := range c.subnets {
+		// CNCIs which are changing state, or serve subnets which are
+		// about to be removed, are left alone
+		if cnci.eventCh != nil || cnci.timer != nil || !instanceActive(cnci.instance) {
+			continue
+		}
+
+		if cnci.lastSeen.IsZero() {
+			cnci.lastSeen = now
+			continue
+		}
+
+		if now.Sub(cnci.lastSeen) < timeout {
+			continue
+		}
+
+		f, ok := c.failovers[subnet]
+		if !ok {
+			f = &cnciFailover{}
+			c.failovers[subnet] = f
+		}
+
+		if f.inProgress {
+			continue
+		}
+
+		// a subnet which has gone twice the longest backoff without
+		// failing over is no longer flapping
+		if now.Sub(f.last) >= 2*cnciFailoverMaxBackoff {
+			f.attempts = 0
+		}
+
+		if now.Before(f.last.Add(failoverBackoff(backoff, f.attempts))) {
+			continue
+		}
+
+		f.attempts++
+		f.last = now
+		f.inProgress = true
+
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets
+}
+
+// failoverDone records that the failover of a subnet has finished.
+func (c *CNCIManager) failoverDone(subnet string) {
+	c.cnciLock.Lock()
+	defer c.cnciLock.Unlock()
+
+	if f, ok := c.failovers[subnet]; ok {
+		f.inProgress = false
+	}
+}
+
+// failover replaces the CNCI of a subnet which has stopped being reported
+// running.  Once the replacement is active it is sent the tenant's subnets
+// and the external IPs mapped to the instances of the subnet.  If the
+// replacement fails to start the failed CNCI is left serving the subnet
+// and is failed over again after the backoff.
+func (c *CNCIManager) failover(subnet string) error {
+	defer c.failoverDone(subnet)
+
+	old, err := c.GetSubnetCNCI(subnet)
+	if err != nil {
+		return err
+	}
+
+	c.log.Warningf("CNCI %s for subnet %s is not running, replacing it", old.ID, subnet)
+
+	instance, err := c.Replace(subnet)
+	if err != nil {
+		return err
+	}
+
+	tenant, err := c.ctrl.ds.GetTenant(c.tenant)
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenant")
+	}
+
+	err = c.ctrl.remapExternalIPs(tenant, subnet)
+	if err != nil {
+		return err
+	}
+
+	c.cnciLock.RLock()
+	attempts := 0
+	if f, ok := c.failovers[subnet]; ok {
+		attempts = f.attempts
+	}
+	c.cnciLock.RUnlock()
+
+	msg := fmt.Sprintf("CNCI %s for subnet %s failed, replaced by %s", old.ID, subnet, instance.ID)
+	c.log.Infof("%s", msg)
+	if err := c.ctrl.ds.LogEvent(c.tenant, msg); err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+	c.ctrl.publishEvent(types.CNCIFailoverEvent, c.tenant, msg, map[string]string{
+		"subnet":      subnet,
+		"failed_cnci": old.ID,
+		"cnci":        instance.ID,
+		"attempt":     strconv.Itoa(attempts),
+	})
+
+	return nil
+}
+
+// cnciHeartbeats is called when stats are received from a node, to record
+// that the tenant CNCIs the node reports are running.
+func (c *controller) cnciHeartbeats(stats payloads.Stat) {
+	now := time.Now()
+
+	for _, stat := range stats.Instances {
+		if stat.State != payloads.Running {
+			continue
+		}
+
+		i, err := c.ds.GetInstance(stat.InstanceUUID)
+		if err != nil || !i.CNCI || i.TenantID == "" {
+			continue
+		}
+
+		tenant, err := c.ds.GetTenant(i.TenantID)
+		if err != nil || tenant == nil {
+			continue
+		}
+
+		if mgr, ok := tenant.CNCIctrl.(*CNCIManager); ok {
+			mgr.heartbeat(i.ID, now)
+		}
+	}
+}
+
+// checkCNCIHealth starts the failover of the tenant CNCIs which have not
+// been reported running for the CNCI heartbeat timeout.
+func (c *controller) checkCNCIHealth(now time.Time) {
+	tenants, err := c.ds.GetAllTenants()
+	if err != nil {
+		c.log.Warningf("Unable to check CNCI health: %v", err)
+		return
+	}
+
+	timeout := c.durationSetting(settingCNCIHeartbeatTimeout)
+	backoff := c.durationSetting(settingCNCIFailoverBackoff)
+
+	for _, t := range tenants {
+		// degraded tenants have no CNCIs to monitor
+		mgr, ok := t.CNCIctrl.(*CNCIManager)
+		if !ok {
+			continue
+		}
+
+		for _, subnet := range mgr.failedSubnets(now, timeout, backoff) {
+			go func(mgr *CNCIManager, subnet string) {
+				err := mgr.failover(subnet)
+				c.metrics.cnciFailedOver(err)
+				if err != nil {
+					mgr.log.Warningf("Failover of subnet %s failed: %v", subnet, err)
+				}
+			}(mgr, subnet)
+		}
+	}
+}
+
+// monitorCNCIHealth periodically checks the tenant CNCIs for missed stats.
+func (c *controller) monitorCNCIHealth() {
+	ticker := time.NewTicker(cnciHealthCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.checkCNCIHealth(time.Now())
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
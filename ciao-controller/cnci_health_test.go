@@ -0,0 +1,246 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestFailoverBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{0, 0},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, cnciFailoverMaxBackoff},
+		{100, cnciFailoverMaxBackoff},
+	}
+
+	for _, test := range tests {
+		backoff := failoverBackoff(time.Minute, test.attempts)
+		if backoff != test.backoff {
+			t.Errorf("Expected backoff of %v after %d attempts, got %v", test.backoff, test.attempts, backoff)
+		}
+	}
+}
+
+func TestCNCIFailedSubnets(t *testing.T) {
+	timeout := 10 * time.Second
+	backoff := 30 * time.Second
+	subnet := "172.16.0.0/24"
+
+	mgr := &CNCIManager{
+		ctrl:      ctl,
+		log:       ctl.log,
+		cncis:     make(map[string]*CNCI),
+		subnets:   make(map[string]*CNCI),
+		failovers: make(map[string]*cnciFailover),
+	}
+
+	cnci := &CNCI{
+		ctrl:     ctl,
+		instance: &types.Instance{ID: "cnci", State: payloads.Running},
+		subnet:   subnet,
+	}
+	mgr.cncis["cnci"] = cnci
+	mgr.subnets[subnet] = cnci
+
+	// a pending CNCI is never failed over
+	pending := &CNCI{
+		ctrl:     ctl,
+		instance: &types.Instance{ID: "pending", State: payloads.Pending},
+		subnet:   "172.16.1.0/24",
+	}
+	mgr.cncis["pending"] = pending
+	mgr.subnets[pending.subnet] = pending
+
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name      string
+		heartbeat time.Duration
+		done      bool
+		at        time.Duration
+		failed    bool
+		attempts  int
+	}{
+		{"first check", -1, false, 0, false, 0},
+		{"before timeout", 5 * time.Second, false, 14 * time.Second, false, 0},
+		{"timeout", -1, false, 15 * time.Second, true, 1},
+		{"in progress", -1, false, 16 * time.Second, false, 1},
+		{"first backoff", -1, true, 44 * time.Second, false, 1},
+		{"after first backoff", -1, false, 45 * time.Second, true, 2},
+		{"second backoff", -1, true, 104 * time.Second, false, 2},
+		{"after second backoff", -1, false, 105 * time.Second, true, 3},
+		{"recovered", 106 * time.Second, true, 115 * time.Second, false, 3},
+		{"stable", -1, false, 105*time.Second + 2*cnciFailoverMaxBackoff, true, 1},
+	}
+
+	for _, test := range tests {
+		if test.heartbeat >= 0 {
+			mgr.heartbeat("cnci", start.Add(test.heartbeat))
+		}
+
+		if test.done {
+			mgr.failoverDone(subnet)
+		}
+
+		subnets := mgr.failedSubnets(start.Add(test.at), timeout, backoff)
+		if test.failed != (len(subnets) == 1) {
+			t.Fatalf("%s: expected failed %v, got %v", test.name, test.failed, subnets)
+		}
+
+		if len(subnets) == 1 && subnets[0] != subnet {
+			t.Fatalf("%s: expected %s to fail, got %s", test.name, subnet, subnets[0])
+		}
+
+		f := mgr.failovers[subnet]
+		attempts := 0
+		if f != nil {
+			attempts = f.attempts
+		}
+
+		if attempts != test.attempts {
+			t.Fatalf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+	}
+}
+
+func TestCNCIFailover(t *testing.T) {
+	netClient, client, instances := testStartWorkloadLaunchCNCI(t, 1)
+	defer netClient.Shutdown()
+	defer client.Shutdown()
+
+	tenant, err := ctl.ds.GetTenant(instances[0].TenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr, ok := tenant.CNCIctrl.(*CNCIManager)
+	if !ok {
+		t.Fatal("Tenant has no CNCI manager")
+	}
+
+	subnet := instances[0].Subnet
+	oldCNCI, err := mgr.GetSubnetCNCI(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the network node reports the CNCI running
+	sendStatsCmd(netClient, t)
+
+	mgr.cnciLock.RLock()
+	lastSeen := mgr.cncis[oldCNCI.ID].lastSeen
+	mgr.cnciLock.RUnlock()
+
+	if lastSeen.IsZero() {
+		t.Fatal("CNCI heartbeat not recorded")
+	}
+
+	timeout := ctl.durationSetting(settingCNCIHeartbeatTimeout)
+	backoff := ctl.durationSetting(settingCNCIFailoverBackoff)
+
+	subnets := mgr.failedSubnets(lastSeen.Add(timeout), timeout, backoff)
+	if len(subnets) != 1 || subnets[0] != subnet {
+		t.Fatalf("Expected subnet %s to fail, got %v", subnet, subnets)
+	}
+
+	ch := ctl.events.subscribe(10)
+	defer ctl.events.unsubscribe(ch)
+
+	netClientCmdCh := netClient.AddCmdChan(ssntp.START)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- mgr.failover(subnet)
+	}()
+
+	result, err := netClient.GetCmdChanResult(netClientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciClient, err := testutil.NewSsntpTestClientConnection("CNCIFailover", ssntp.CNCIAGENT, tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnciClient.Shutdown()
+
+	summary, err := ctl.ds.GetTenantCNCISummary(result.InstanceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciClient.SendConcentratorAddedEvent(result.InstanceUUID, tenant.ID, testutil.CNCIIP, summary[0].MACAddress)
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	cnci, err := mgr.GetSubnetCNCI(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnci.ID != result.InstanceUUID {
+		t.Fatalf("CNCI not replaced: got %s expected %s", cnci.ID, result.InstanceUUID)
+	}
+
+	select {
+	case e := <-ch:
+		if e.Type != types.CNCIFailoverEvent || e.TenantID != tenant.ID ||
+			e.Data["failed_cnci"] != oldCNCI.ID || e.Data["cnci"] != cnci.ID {
+			t.Fatalf("Unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failover event not published")
+	}
+
+	if mgr.failovers[subnet].inProgress {
+		t.Fatal("Failover still in progress")
+	}
+
+	// the replacement fails to start, leaving the subnet to its CNCI
+	netClient.StartFail = true
+	netClient.StartFailReason = payloads.FullCloud
+	defer func() {
+		netClient.StartFail = false
+		netClient.StartFailReason = ""
+	}()
+
+	err = mgr.failover(subnet)
+	if err == nil {
+		t.Fatal("Expected failover to fail")
+	}
+
+	failed, err := mgr.GetSubnetCNCI(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed.ID != cnci.ID {
+		t.Fatalf("CNCI replaced by failed replacement %s", failed.ID)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// cnciRolloutBatches groups the CNCIs which were not launched from image
+// into the batches in which they are replaced.  CNCIs are ordered by
+// tenant so that the CNCIs of a tenant are replaced together.
+func (c *controller) cnciRolloutBatches(image string, req types.CNCIRolloutRequest) ([][]*types.Instance, error) {
+	tenants, err := c.ds.GetAllTenants()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting tenants")
+	}
+
+	var tenantIDs []string
+	for _, t := range tenants {
+		tenantIDs = append(tenantIDs, t.ID)
+	}
+	sort.Strings(tenantIDs)
+
+	var batches [][]*types.Instance
+	var batch []*types.Instance
+
+	for _, tenantID := range tenantIDs {
+		cncis, err := c.ds.GetTenantCNCIs(tenantID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error getting tenant CNCIs")
+		}
+		sort.Sort(types.SortedInstancesByID(cncis))
+
+		for _, cnci := range cncis {
+			if c.ds.GetCNCIInstanceImage(cnci.ID) == image {
+				continue
+			}
+
+			batch = append(batch, cnci)
+			if !req.ByTenant && len(batch) == req.BatchSize {
+				batches = append(batches, batch)
+				batch = nil
+			}
+		}
+
+		if req.ByTenant && len(batch) > 0 {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
+
+// remapExternalIPs sends the external IPs mapped to the instances of a
+// subnet to the CNCI which now serves it.
+func (c *controller) remapExternalIPs(tenant *types.Tenant, subnet string) error {
+	for _, m := range c.ds.GetMappedIPs(&tenant.ID) {
+		i, err := c.ds.GetInstance(m.InstanceID)
+		if err != nil || i.Subnet != subnet {
+			continue
+		}
+
+		err = c.client.mapExternalIP(*tenant, m)
+		if err != nil {
+			return errors.Wrapf(err, "Error mapping %s to replacement CNCI", m.ExternalIP)
+		}
+	}
+
+	return nil
+}
+
+func (c *controller) replaceCNCI(cnci *types.Instance) error {
+	tenant, err := c.ds.GetTenant(cnci.TenantID)
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenant")
+	}
+
+	if tenant.CNCIctrl == nil {
+		return errors.Errorf("No CNCI manager for tenant %s", tenant.ID)
+	}
+
+	_, err = tenant.CNCIctrl.Replace(cnci.Subnet)
+	if err != nil {
+		return err
+	}
+
+	return c.remapExternalIPs(tenant, cnci.Subnet)
+}
+
+// rolloutCNCIImage replaces the CNCIs which were not launched from image
+// one batch at a time, waiting for each batch of replacements to become
+// active before moving on.  The rollout pauses at the first replacement
+// which fails, leaving the CNCI it was to replace in service.
+func (c *controller) rolloutCNCIImage(image string, req types.CNCIRolloutRequest, progress operationProgress) (string, error) {
+	batches, err := c.cnciRolloutBatches(image, req)
+	if err != nil {
+		return "", err
+	}
+
+	total := 0
+	for _, batch := range batches {
+		total += len(batch)
+	}
+
+	replaced := 0
+	for _, batch := range batches {
+		errCh := make(chan error)
+		for _, cnci := range batch {
+			go func(cnci *types.Instance) {
+				errCh <- c.replaceCNCI(cnci)
+			}(cnci)
+		}
+
+		var failure error
+		for range batch {
+			err := <-errCh
+			if err == nil {
+				replaced++
+			} else if failure == nil {
+				failure = err
+			}
+		}
+
+		if failure != nil {
+			c.log.Warningf("CNCI image rollout paused: %v", failure)
+			return "", errors.Wrapf(failure, "CNCI image rollout paused after replacing %d of %d CNCIs", replaced, total)
+		}
+
+		progress(replaced * 100 / total)
+	}
+
+	return "", nil
+}
+
+// startCNCIRollout starts an operation which relaunches the CNCIs from
+// the image chosen by register.  Only one rollout may run at a time.
+func (c *controller) startCNCIRollout(opType types.OperationType, req types.CNCIRolloutRequest, register func() (types.CNCIImage, error)) (types.Operation, error) {
+	if req.BatchSize < 0 {
+		return types.Operation{}, types.ErrBadRequest
+	}
+
+	if req.BatchSize == 0 {
+		req.BatchSize = 1
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.cnciRollout, 0, 1) {
+		return types.Operation{}, types.ErrCNCIRolloutInProgress
+	}
+
+	image, err := register()
+	if err != nil {
+		atomic.StoreInt32(&c.cnciRollout, 0)
+		return types.Operation{}, err
+	}
+
+	op, err := c.startOperation("", opType, image.Image,
+		func(_ context.Context, progress operationProgress) (string, error) {
+			defer atomic.StoreInt32(&c.cnciRollout, 0)
+			return c.rolloutCNCIImage(image.Image, req, progress)
+		})
+	if err != nil {
+		atomic.StoreInt32(&c.cnciRollout, 0)
+	}
+
+	return op, err
+}
+
+// GetCNCIImage returns the image new CNCIs are launched from and the image
+// CNCIs return to on rollback.
+func (c *controller) GetCNCIImage() (types.CNCIImage, error) {
+	return c.ds.GetCNCIImage(), nil
+}
+
+// UpgradeCNCIs registers a new CNCI image and starts relaunching the CNCIs
+// which run other images from it.  Repeating the request for the same
+// image resumes a rollout which paused.
+func (c *controller) UpgradeCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	s := types.StorageResource{
+		SourceType: types.ImageService,
+		Source:     req.ImageID,
+		Internal:   true,
+	}
+
+	image, err := c.storageImage("admin", s)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if image.State != types.Active {
+		return types.Operation{}, types.ErrBadRequest
+	}
+
+	return c.startCNCIRollout(types.UpgradeCNCIOperation, req, func() (types.CNCIImage, error) {
+		return c.ds.RegisterCNCIImage(image.ID)
+	})
+}
+
+// RollbackCNCIs returns to the CNCI image used before the current one was
+// registered and starts relaunching the CNCIs from it.
+func (c *controller) RollbackCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	return c.startCNCIRollout(types.RollbackCNCIOperation, req, c.ds.RollbackCNCIImage)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// onlyRolloutTenant marks the CNCIs of all other tenants as running image
+// so that a rollout replaces just the CNCIs of tenantID.  The returned
+// function restores the images they were recorded with.
+func onlyRolloutTenant(t *testing.T, tenantID string, image string) func() {
+	tenants, err := ctl.ds.GetAllTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(map[string]string)
+	for _, tenant := range tenants {
+		if tenant.ID == tenantID {
+			continue
+		}
+
+		cncis, err := ctl.ds.GetTenantCNCIs(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, cnci := range cncis {
+			saved[cnci.ID] = ctl.ds.GetCNCIInstanceImage(cnci.ID)
+			err = ctl.ds.SetCNCIInstanceImage(cnci.ID, image)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return func() {
+		for id, image := range saved {
+			_ = ctl.ds.SetCNCIInstanceImage(id, image)
+		}
+	}
+}
+
+func TestCNCIRollout(t *testing.T) {
+	netClient, client, instances := testStartWorkloadLaunchCNCI(t, 1)
+	defer netClient.Shutdown()
+	defer client.Shutdown()
+
+	tenant, err := ctl.ds.GetTenant(instances[0].TenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCNCI, err := tenant.CNCIctrl.GetSubnetCNCI(instances[0].Subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage("", types.Internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := ctl.ds.GetCNCIImage()
+	defer func() { _, _ = ctl.ds.RegisterCNCIImage(orig.Image) }()
+
+	restore := onlyRolloutTenant(t, tenant.ID, image.ID)
+	defer restore()
+
+	// the replacement fails to start, pausing the rollout
+	netClient.StartFail = true
+	netClient.StartFailReason = payloads.FullCloud
+
+	req := types.CNCIRolloutRequest{ImageID: image.ID}
+	op, err := ctl.UpgradeCNCIs(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ctl.UpgradeCNCIs(req); err != types.ErrCNCIRolloutInProgress {
+		t.Errorf("Expected concurrent rollout to be refused: %v", err)
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationFailed || !strings.Contains(op.Error, "paused") {
+		t.Fatalf("Expected rollout to pause: %+v", op)
+	}
+
+	cnci, err := tenant.CNCIctrl.GetSubnetCNCI(instances[0].Subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnci.ID != oldCNCI.ID {
+		t.Fatalf("CNCI replaced by failed replacement %s", cnci.ID)
+	}
+
+	if ctl.ds.GetCNCIImage().Image != image.ID {
+		t.Errorf("Image not registered: %+v", ctl.ds.GetCNCIImage())
+	}
+
+	// resuming the rollout replaces the CNCI once its replacement is
+	// active
+	netClient.StartFail = false
+	netClientCmdCh := netClient.AddCmdChan(ssntp.START)
+
+	op, err = ctl.UpgradeCNCIs(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := netClient.GetCmdChanResult(netClientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciClient, err := testutil.NewSsntpTestClientConnection("CNCIRollout", ssntp.CNCIAGENT, tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnciClient.Shutdown()
+
+	summary, err := ctl.ds.GetTenantCNCISummary(result.InstanceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciClient.SendConcentratorAddedEvent(result.InstanceUUID, tenant.ID, testutil.CNCIIP, summary[0].MACAddress)
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Expected rollout to succeed: %+v", op)
+	}
+
+	cnci, err = tenant.CNCIctrl.GetSubnetCNCI(instances[0].Subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnci.ID != result.InstanceUUID {
+		t.Errorf("CNCI not replaced: got %s expected %s", cnci.ID, result.InstanceUUID)
+	}
+
+	if ctl.ds.GetCNCIInstanceImage(cnci.ID) != image.ID {
+		t.Errorf("Replacement CNCI image not recorded")
+	}
+}
@@ -15,9 +15,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
 )
 
 func TestCNCIInitializeCtrls(t *testing.T) {
@@ -103,7 +111,7 @@ func TestCNCIRemoved(t *testing.T) {
 	clientCh := client.AddCmdChan(ssntp.DELETE)
 	netClientCh := netClient.AddCmdChan(ssntp.DELETE)
 
-	err = ctl.deleteInstance(instanceID)
+	err = ctl.deleteInstance(context.Background(), instanceID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,9 +150,9 @@ func TestCNCIRemoved(t *testing.T) {
 
 	// call remove subnet directly to remove the cnci.
 	go func() {
-		err = tenant.CNCIctrl.RemoveSubnet(instance.Subnet)
+		err := tenant.CNCIctrl.RemoveSubnet(instance.Subnet)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -165,3 +173,239 @@ func TestCNCIRemoved(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// testPreparedCNCI waits for the launch of the CNCI for tenantID on
+// netClient and reports the CNCI as active.  The CNCI's ID is returned.
+func testPreparedCNCI(t *testing.T, netClient *testutil.SsntpTestClient, netClientCmdCh chan testutil.Result, tenantID string) string {
+	result, err := netClient.GetCmdChanResult(netClientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.CNCI || result.TenantUUID != tenantID {
+		t.Fatalf("Expected CNCI launch for %s: %+v", tenantID, result)
+	}
+
+	cnciClient, err := testutil.NewSsntpTestClientConnection("PrepareTenantNetwork", ssntp.CNCIAGENT, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnciClient.Shutdown()
+
+	summary, err := ctl.ds.GetTenantCNCISummary(result.InstanceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciClient.SendConcentratorAddedEvent(result.InstanceUUID, tenantID, testutil.CNCIIP, summary[0].MACAddress)
+
+	return result.InstanceUUID
+}
+
+func TestPrepareTenantNetwork(t *testing.T) {
+	netClient, err := testutil.NewSsntpTestClientConnection("PrepareTenantNetwork", ssntp.NETAGENT, testutil.NetAgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netClient.Shutdown()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants/" + tenant.ID + "/network/prepare"
+	netClientCmdCh := netClient.AddCmdChan(ssntp.START)
+
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, []byte("{}"), true)
+
+	var op types.Operation
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Type != types.PrepareNetworkOperation || op.Target != "172.16.0.0/24" {
+		t.Errorf("Unexpected operation: %+v", op)
+	}
+
+	cnciID := testPreparedCNCI(t, netClient, netClientCmdCh, tenant.ID)
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationSucceeded || op.Result != cnciID {
+		t.Fatalf("Expected CNCI %s to be prepared: %+v", cnciID, op)
+	}
+
+	// preparing the network again does not launch another CNCI
+	body = testHTTPRequest(t, "POST", url, http.StatusAccepted, nil, true)
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationSucceeded || op.Result != cnciID {
+		t.Errorf("Expected existing CNCI %s: %+v", cnciID, op)
+	}
+
+	cncis, err := ctl.ds.GetTenantCNCIs(tenant.ID)
+	if err != nil || len(cncis) != 1 {
+		t.Fatalf("Expected a single CNCI: %v %v", cncis, err)
+	}
+
+	_ = testHTTPRequest(t, "POST", url, http.StatusForbidden, []byte(`{"subnet":"10.0.0.0/24"}`), true)
+
+	// the tenant's first instance does not wait for its CNCI
+	client, err := testutil.NewSsntpTestClientConnection("PrepareTenantNetwork", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+	instanceCh := make(chan []*types.Instance)
+	go startTenantWorkload(t, tenant.ID, instanceCh)
+
+	select {
+	case instances := <-instanceCh:
+		if len(instances) != 1 || instances[0].Subnet != "172.16.0.0/24" {
+			t.Fatalf("Unexpected instances: %+v", instances)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Launch waited for tenant readiness")
+	}
+
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreprovisionTenantNetwork(t *testing.T) {
+	netClient, err := testutil.NewSsntpTestClientConnection("PreprovisionTenantNetwork", ssntp.NETAGENT, testutil.NetAgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netClient.Shutdown()
+
+	req := types.TenantRequest{ID: uuid.Generate().String()}
+	req.Config.Name = "preprovisioned tenant"
+	req.Config.PreprovisionNetwork = true
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netClientCmdCh := netClient.AddCmdChan(ssntp.START)
+	_ = testHTTPRequest(t, "POST", testutil.ComputeURL+"/tenants", http.StatusCreated, b, true)
+
+	cnciID := testPreparedCNCI(t, netClient, netClientCmdCh, req.ID)
+
+	ops := ctl.ds.GetOperations(req.ID)
+	if len(ops) != 1 || ops[0].Type != types.PrepareNetworkOperation {
+		t.Fatalf("Expected network preparation: %+v", ops)
+	}
+
+	op := pollOperation(t, testutil.ComputeURL+"/operations/"+ops[0].ID)
+	if op.State != types.OperationSucceeded || op.Result != cnciID {
+		t.Errorf("Expected CNCI %s to be prepared: %+v", cnciID, op)
+	}
+
+	tenant, err := ctl.ds.GetTenant(req.ID)
+	if err != nil || !tenant.PreprovisionNetwork {
+		t.Errorf("Pre-provisioning not recorded: %+v %v", tenant, err)
+	}
+}
+
+func TestCNCIInitializeDegradedTenant(t *testing.T) {
+	healthy, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	degraded, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.forgetDegradedTenant(degraded.ID)
+
+	cncis, err := ctl.ds.GetTenantCNCIs(degraded.ID)
+	if err != nil || len(cncis) != 1 {
+		t.Fatalf("Expected 1 CNCI for tenant, got %d: %v", len(cncis), err)
+	}
+	subnet := cncis[0].Subnet
+	cncis[0].Subnet = "garbage"
+
+	err = initializeCNCICtrls(ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := healthy.CNCIctrl.(*CNCIManager); !ok {
+		t.Fatalf("CNCIctrl of healthy tenant not initialized: %T", healthy.CNCIctrl)
+	}
+	if _, err := healthy.CNCIctrl.GetSubnetCNCI(subnet); err != nil {
+		t.Fatalf("CNCI of healthy tenant not found: %v", err)
+	}
+
+	url := testutil.ComputeURL + "/v2.1/nodes/summary"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var status types.CiaoClusterStatus
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.DegradedTenants) != 1 || status.DegradedTenants[0].TenantID != degraded.ID ||
+		!strings.Contains(status.DegradedTenants[0].Error, "garbage") {
+		t.Fatalf("Expected tenant %s to be degraded, got %+v", degraded.ID, status.DegradedTenants)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(degraded.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatalf("No workloads for tenant: %v", err)
+	}
+
+	_, err = ctl.startWorkload(context.Background(), types.WorkloadRequest{
+		WorkloadID: wls[0].ID,
+		TenantID:   degraded.ID,
+		Instances:  1,
+	})
+	launchErr, ok := err.(*types.LaunchError)
+	if !ok || launchErr.Code != types.LaunchNetworkNotReady {
+		t.Fatalf("Expected launch to be rejected, got %v", err)
+	}
+	if _, ok := launchErr.Err.(*types.TenantNetworkDegradedError); !ok {
+		t.Fatalf("Expected tenant network error, got %v", launchErr.Err)
+	}
+
+	retryURL := testutil.ComputeURL + "/tenants/" + degraded.ID + "/network/retry"
+	_ = testHTTPRequest(t, "POST", retryURL, http.StatusServiceUnavailable, nil, true)
+
+	cncis[0].Subnet = subnet
+	_ = testHTTPRequest(t, "POST", retryURL, http.StatusNoContent, nil, true)
+
+	if _, ok := degraded.CNCIctrl.(*CNCIManager); !ok {
+		t.Fatalf("CNCIctrl not initialized on retry: %T", degraded.CNCIctrl)
+	}
+
+	if err := ctl.tenantNetworkDegraded(degraded.ID); err != nil {
+		t.Fatalf("Tenant still degraded after retry: %v", err)
+	}
+
+	events, err := ctl.ds.GetEventsForTenant(degraded.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed, recovered bool
+	for _, e := range events {
+		failed = failed || strings.Contains(e.Message, "failed to initialize")
+		recovered = recovered || strings.Contains(e.Message, "initialized on retry")
+	}
+	if !failed || !recovered {
+		t.Fatalf("Degradation and recovery not logged: %+v", events)
+	}
+}
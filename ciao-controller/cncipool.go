@@ -0,0 +1,317 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
+
+// cnciPoolSubnet is the subnet onto which the CNCIs of the pool are
+// launched.  A CNCI is given the subnet it serves when a tenant claims it.
+const cnciPoolSubnet = "pool"
+
+// cnciPoolCheckPeriod is how often the pool is refilled and its claimed
+// CNCIs checked, in addition to whenever a CNCI is claimed.
+const cnciPoolCheckPeriod = 30 * time.Second
+
+// cnciPoolState tracks the CNCIs launched ahead of demand which have not
+// yet been assigned to a tenant.  A CNCI is launching until it becomes
+// active, ready until a tenant claims it and claimed until it has been
+// configured for the tenant's subnet.
+type cnciPoolState struct {
+	sync.Mutex
+	launching map[string]bool
+	ready     []string
+	claimed   map[string]time.Time
+	wakeCh    chan struct{}
+}
+
+func (p *cnciPoolState) init() {
+	if p.launching == nil {
+		p.launching = make(map[string]bool)
+		p.claimed = make(map[string]time.Time)
+	}
+}
+
+func (p *cnciPoolState) wakeChannel() chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.wakeCh == nil {
+		p.wakeCh = make(chan struct{}, 1)
+	}
+	return p.wakeCh
+}
+
+// wake makes the pool be refilled straight away, e.g. because a CNCI has
+// been claimed or the pool settings have changed.
+func (p *cnciPoolState) wake() {
+	select {
+	case p.wakeChannel() <- struct{}{}:
+	default:
+	}
+}
+
+// remove forgets a CNCI in any state, returning whether it was in the pool.
+// The caller must hold the lock.
+func (p *cnciPoolState) remove(id string) bool {
+	p.init()
+
+	_, claimed := p.claimed[id]
+	found := p.launching[id] || claimed
+	delete(p.launching, id)
+	delete(p.claimed, id)
+
+	for i := range p.ready {
+		if p.ready[i] == id {
+			p.ready = append(p.ready[:i], p.ready[i+1:]...)
+			return true
+		}
+	}
+
+	return found
+}
+
+// loadCNCIPool restores the pool from the unassigned CNCIs in the datastore
+// when the controller starts.
+func (c *controller) loadCNCIPool() error {
+	instances, err := c.ds.GetUnassignedCNCIs()
+	if err != nil {
+		return errors.Wrap(err, "Error getting unassigned CNCIs")
+	}
+
+	p := &c.cnciPool
+	p.Lock()
+	defer p.Unlock()
+
+	p.init()
+	for _, i := range instances {
+		if instanceActive(i) {
+			p.ready = append(p.ready, i.ID)
+		} else {
+			p.launching[i.ID] = true
+		}
+	}
+
+	return nil
+}
+
+// claimPoolCNCI takes an active CNCI from the pool, returning nil if the
+// pool is disabled or empty.  The pool is refilled in the background.
+func (c *controller) claimPoolCNCI() *types.Instance {
+	if !c.boolSetting(settingCNCIPoolEnabled) {
+		return nil
+	}
+
+	p := &c.cnciPool
+	p.Lock()
+	defer p.Unlock()
+
+	p.init()
+	for len(p.ready) > 0 {
+		id := p.ready[0]
+		p.ready = p.ready[1:]
+
+		i, err := c.ds.GetInstance(id)
+		if err != nil || !instanceActive(i) {
+			continue
+		}
+
+		p.claimed[id] = time.Now()
+		go p.wake()
+
+		return i
+	}
+
+	return nil
+}
+
+// poolCNCIConfigured removes a claimed CNCI, now configured for its
+// tenant's subnet, from the pool.
+func (c *controller) poolCNCIConfigured(id string) {
+	p := &c.cnciPool
+	p.Lock()
+	defer p.Unlock()
+
+	p.init()
+	delete(p.claimed, id)
+}
+
+// stopPoolCNCI deletes a CNCI which is no longer wanted in the pool.
+func (c *controller) stopPoolCNCI(id string) {
+	err := c.deleteInstance(c.ctx, id)
+	if err != nil {
+		c.log.Warningf("Unable to stop pooled CNCI %s: %v", id, err)
+	}
+}
+
+// refillCNCIPool launches CNCIs until the pool holds its configured number,
+// launching no more than the refill concurrency at a time.  Claimed CNCIs
+// which have not been configured for their subnet within the claim timeout
+// are recycled, as are surplus ready CNCIs when the pool shrinks or is
+// disabled.  It returns the number of CNCIs launched.
+func (c *controller) refillCNCIPool(now time.Time) int {
+	size := c.intSetting(settingCNCIPoolSize)
+	if !c.boolSetting(settingCNCIPoolEnabled) {
+		size = 0
+	}
+	concurrency := c.intSetting(settingCNCIPoolConcurrency)
+	timeout := c.durationSetting(settingCNCIPoolClaimTimeout)
+
+	p := &c.cnciPool
+	p.Lock()
+	p.init()
+
+	var recycle []string
+	for id, claimed := range p.claimed {
+		if now.Sub(claimed) >= timeout {
+			recycle = append(recycle, id)
+			delete(p.claimed, id)
+		}
+	}
+
+	for len(p.ready) > 0 && len(p.ready)+len(p.launching) > size {
+		recycle = append(recycle, p.ready[len(p.ready)-1])
+		p.ready = p.ready[:len(p.ready)-1]
+	}
+
+	launches := size - len(p.ready) - len(p.launching)
+	if available := concurrency - len(p.launching); launches > available {
+		launches = available
+	}
+
+	// launches are recorded as they happen so that the CNCIs are known
+	// to the pool before their events arrive.
+	launched := 0
+	for ; launched < launches; launched++ {
+		i, err := c.launchCNCI("", cnciPoolSubnet)
+		if err != nil {
+			c.log.Warningf("Unable to launch pooled CNCI: %v", err)
+			break
+		}
+		p.launching[i.ID] = true
+	}
+
+	p.Unlock()
+
+	for _, id := range recycle {
+		c.log.Infof("Recycling pooled CNCI %s", id)
+		c.stopPoolCNCI(id)
+	}
+
+	return launched
+}
+
+// maintainCNCIPool periodically refills the CNCI pool until the controller
+// is shut down.
+func (c *controller) maintainCNCIPool() {
+	ticker := time.NewTicker(cnciPoolCheckPeriod)
+	defer ticker.Stop()
+
+	wakeCh := c.cnciPool.wakeChannel()
+	for {
+		c.refillCNCIPool(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-wakeCh:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// poolCNCIEvents handles the events of the CNCIs which have not yet been
+// assigned to a tenant.
+type poolCNCIEvents struct {
+	ctrl *controller
+}
+
+// CNCIAdded makes a launching CNCI ready to be claimed.
+func (e poolCNCIEvents) CNCIAdded(id string) error {
+	i, err := e.ctrl.ds.GetInstance(id)
+	if err != nil {
+		return err
+	}
+
+	p := &e.ctrl.cnciPool
+	p.Lock()
+	defer p.Unlock()
+
+	p.init()
+	if !p.launching[id] {
+		return errors.New("No CNCI found")
+	}
+
+	err = i.TransitionInstanceState(payloads.Running)
+	if err != nil {
+		return err
+	}
+
+	delete(p.launching, id)
+	p.ready = append(p.ready, id)
+
+	return nil
+}
+
+// CNCIRemoved forgets a CNCI which has been deleted.  CNCIs deleted by the
+// pool itself have already been forgotten.
+func (e poolCNCIEvents) CNCIRemoved(id string) error {
+	p := &e.ctrl.cnciPool
+	p.Lock()
+	found := p.remove(id)
+	p.Unlock()
+
+	if found {
+		p.wake()
+	}
+	return nil
+}
+
+// CNCIStopped deletes a CNCI which has stopped, to be replaced by a fresh
+// one, rather than restarting it as a tenant's CNCI would be.
+func (e poolCNCIEvents) CNCIStopped(id string) error {
+	p := &e.ctrl.cnciPool
+	p.Lock()
+	found := p.remove(id)
+	p.Unlock()
+
+	if !found {
+		return errors.New("No CNCI found")
+	}
+
+	go e.ctrl.stopPoolCNCI(id)
+	return nil
+}
+
+// StartFailure forgets a CNCI which failed to start.  The pool is refilled
+// at the next check rather than straight away so that a CNCI which cannot
+// be started is not relaunched continually.
+func (e poolCNCIEvents) StartFailure(id string) error {
+	p := &e.ctrl.cnciPool
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.remove(id) {
+		return errors.New("No CNCI found")
+	}
+
+	return nil
+}
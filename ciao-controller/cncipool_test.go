@@ -0,0 +1,201 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func enableTestCNCIPool(t *testing.T, size string) {
+	for key, value := range map[string]string{
+		settingCNCIPoolEnabled:     "true",
+		settingCNCIPoolSize:        size,
+		settingCNCIPoolConcurrency: "1",
+	} {
+		if _, err := ctl.UpdateSetting(context.Background(), key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// resetTestCNCIPool disables the pool and removes any CNCIs left in it.
+func resetTestCNCIPool(t *testing.T) {
+	resetTestSetting(t, settingCNCIPoolEnabled)
+	resetTestSetting(t, settingCNCIPoolSize)
+	resetTestSetting(t, settingCNCIPoolConcurrency)
+
+	instances, err := ctl.ds.GetUnassignedCNCIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range instances {
+		_ = ctl.ds.DeleteInstance(i.ID)
+	}
+
+	ctl.cnciPool.Lock()
+	ctl.cnciPool.launching = nil
+	ctl.cnciPool.ready = nil
+	ctl.cnciPool.claimed = nil
+	ctl.cnciPool.Unlock()
+}
+
+// refillTestCNCIPool refills the pool, expecting a single CNCI to be
+// launched, and makes the new CNCI active.
+func refillTestCNCIPool(t *testing.T, now time.Time) string {
+	serverCmdCh := server.AddCmdChan(ssntp.START)
+
+	if n := ctl.refillCNCIPool(now); n != 1 {
+		t.Fatalf("Expected 1 CNCI to be launched, got %d", n)
+	}
+
+	result, err := server.GetCmdChanResult(serverCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.CNCI || result.TenantUUID != "" {
+		t.Fatalf("Expected an unassigned CNCI launch, got CNCI %v tenant %q", result.CNCI, result.TenantUUID)
+	}
+
+	cnciClient, err := testutil.NewSsntpTestClientConnection("CNCIPool", ssntp.CNCIAGENT, testutil.CNCIUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnciClient.Shutdown()
+
+	i, err := ctl.ds.GetInstance(result.InstanceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverEventCh := server.AddEventChan(ssntp.ConcentratorInstanceAdded)
+	go cnciClient.SendConcentratorAddedEvent(i.ID, "", testutil.CNCIIP, i.MACAddress)
+	_, err = server.GetEventChanResult(serverEventCh, ssntp.ConcentratorInstanceAdded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for start := time.Now(); !instanceActive(i); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Pooled CNCI %s did not become active", i.ID)
+		}
+	}
+
+	return i.ID
+}
+
+func waitTestCNCIDeleted(t *testing.T, id string) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := ctl.ds.GetInstance(id); err != nil {
+			return
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Pooled CNCI %s was not deleted", id)
+		}
+	}
+}
+
+func TestCNCIPoolClaim(t *testing.T) {
+	enableTestCNCIPool(t, "1")
+	defer resetTestCNCIPool(t)
+
+	pooled := refillTestCNCIPool(t, time.Now())
+
+	if n := ctl.refillCNCIPool(time.Now()); n != 0 {
+		t.Fatalf("Expected full pool not to be refilled, %d CNCIs launched", n)
+	}
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet := "172.16.10.0/24"
+	refreshCh := server.AddCmdChan(ssntp.RefreshCNCI)
+
+	err = tenant.CNCIctrl.WaitForActive(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(refreshCh, ssntp.RefreshCNCI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnci, err := tenant.CNCIctrl.GetSubnetCNCI(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnci.ID != pooled {
+		t.Fatalf("Expected pooled CNCI %s to be claimed, got %s", pooled, cnci.ID)
+	}
+
+	if cnci.TenantID != tenant.ID || cnci.Subnet != subnet {
+		t.Fatalf("Claimed CNCI not reconfigured: tenant %s subnet %s", cnci.TenantID, cnci.Subnet)
+	}
+
+	ctl.cnciPool.Lock()
+	claimed := len(ctl.cnciPool.claimed)
+	ctl.cnciPool.Unlock()
+	if claimed != 0 {
+		t.Fatalf("Configured CNCI still claimed")
+	}
+
+	refillTestCNCIPool(t, time.Now())
+}
+
+func TestCNCIPoolRecycleClaim(t *testing.T) {
+	enableTestCNCIPool(t, "1")
+	defer resetTestCNCIPool(t)
+
+	pooled := refillTestCNCIPool(t, time.Now())
+
+	i := ctl.claimPoolCNCI()
+	if i == nil || i.ID != pooled {
+		t.Fatalf("Expected pooled CNCI %s to be claimed", pooled)
+	}
+
+	timeout := ctl.durationSetting(settingCNCIPoolClaimTimeout)
+	refillTestCNCIPool(t, time.Now().Add(timeout))
+
+	waitTestCNCIDeleted(t, pooled)
+}
+
+func TestCNCIPoolDisabled(t *testing.T) {
+	enableTestCNCIPool(t, "1")
+	defer resetTestCNCIPool(t)
+
+	pooled := refillTestCNCIPool(t, time.Now())
+
+	resetTestSetting(t, settingCNCIPoolEnabled)
+
+	if i := ctl.claimPoolCNCI(); i != nil {
+		t.Fatalf("CNCI %s claimed from disabled pool", i.ID)
+	}
+
+	if n := ctl.refillCNCIPool(time.Now()); n != 0 {
+		t.Fatalf("Expected disabled pool not to be refilled, %d CNCIs launched", n)
+	}
+
+	waitTestCNCIDeleted(t, pooled)
+}
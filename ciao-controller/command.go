@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"runtime"
@@ -24,7 +25,6 @@ import (
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
@@ -35,6 +35,10 @@ func (c *controller) restartInstance(instanceID string) error {
 		return err
 	}
 
+	if i.State == payloads.DeletePending {
+		return types.ErrInstanceDeletePending
+	}
+
 	if i.State != "exited" {
 		return errors.New("You may only restart paused instances")
 	}
@@ -56,9 +60,11 @@ func (c *controller) restartInstance(instanceID string) error {
 		}
 	}
 
+	c.recordCommand(i, "restart")
+
 	go func() {
 		if err := c.client.RestartInstance(i, &w, t); err != nil {
-			glog.Warningf("Error restarting instance: %v", err)
+			c.instanceLog(i).Warningf("Error restarting instance: %v", err)
 		}
 	}()
 
@@ -72,6 +78,10 @@ func (c *controller) stopInstance(instanceID string) error {
 		return err
 	}
 
+	if i.State == payloads.DeletePending {
+		return types.ErrInstanceDeletePending
+	}
+
 	if i.NodeID == "" {
 		return types.ErrInstanceNotAssigned
 	}
@@ -80,9 +90,15 @@ func (c *controller) stopInstance(instanceID string) error {
 		return errors.New("You may not stop a pending instance")
 	}
 
+	if i.State == payloads.Migrating {
+		return types.ErrInstanceMigrating
+	}
+
+	c.recordCommand(i, "stop")
+
 	go func() {
 		if err := c.client.StopInstance(instanceID, i.NodeID); err != nil {
-			glog.Warningf("Error stopping instance: %v", err)
+			c.instanceLog(i).Warningf("Error stopping instance: %v", err)
 		}
 	}()
 
@@ -90,7 +106,7 @@ func (c *controller) stopInstance(instanceID string) error {
 }
 
 // delete an instance, wait for the deleted event.
-func (c *controller) deleteInstanceSync(instanceID string) error {
+func (c *controller) deleteInstanceSync(ctx context.Context, instanceID string) error {
 	wait := make(chan struct{})
 
 	i, err := c.ds.GetInstance(instanceID)
@@ -98,7 +114,7 @@ func (c *controller) deleteInstanceSync(instanceID string) error {
 		return err
 	}
 
-	err = c.deleteInstance(instanceID)
+	err = c.deleteInstance(ctx, instanceID)
 	if err != nil {
 		return err
 	}
@@ -110,7 +126,9 @@ func (c *controller) deleteInstanceSync(instanceID string) error {
 			if i.State == payloads.Deleted || i.State == payloads.Hung {
 				break
 			}
-			glog.V(2).Infof("waiting for %s to be deleted", i.ID)
+			if c.log.V(2) {
+				c.log.Infof("waiting for %s to be deleted", i.ID)
+			}
 			i.StateLock.RUnlock()
 			i.StateChange.Wait()
 		}
@@ -118,23 +136,27 @@ func (c *controller) deleteInstanceSync(instanceID string) error {
 		i.StateLock.RUnlock()
 		i.StateChange.L.Unlock()
 
-		glog.V(2).Infof("%s is hung or deleted", i.ID)
+		if c.log.V(2) {
+			c.log.Infof("%s is hung or deleted", i.ID)
+		}
 		close(wait)
 	}()
 
 	select {
 	case <-wait:
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-time.After(2 * time.Minute):
 		err = i.TransitionInstanceState(payloads.Hung)
 		if err != nil {
-			glog.Warningf("Error transitioning instance to hung state: %v", err)
+			c.instanceLog(i).Warningf("Error transitioning instance to hung state: %v", err)
 		}
 		return fmt.Errorf("timeout waiting for delete")
 	}
 }
 
-func (c *controller) deleteInstance(instanceID string) error {
+func (c *controller) deleteInstance(ctx context.Context, instanceID string) error {
 	// get node id.  If there is no node id and the instance is
 	// pending we can't send a delete
 	i, err := c.ds.GetInstance(instanceID)
@@ -146,10 +168,18 @@ func (c *controller) deleteInstance(instanceID string) error {
 		return types.ErrInstanceNotAssigned
 	}
 
+	if i.State == payloads.Queued && !c.cancelQueuedLaunch(i) {
+		return types.ErrInstanceNotAssigned
+	}
+
 	if i.State == payloads.Missing {
 		return types.ErrInstanceNotAssigned
 	}
 
+	if i.State == payloads.Migrating {
+		return types.ErrInstanceMigrating
+	}
+
 	// check for any external IPs
 	IPs := c.ds.GetMappedIPs(&i.TenantID)
 	for _, m := range IPs {
@@ -158,9 +188,16 @@ func (c *controller) deleteInstance(instanceID string) error {
 		}
 	}
 
+	// the delete cannot be withdrawn once it has been sent
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.recordCommand(i, "delete")
+
 	go func() {
 		if err := c.client.DeleteInstance(instanceID, i.NodeID); err != nil {
-			glog.Warningf("Error deleting instance: %v", err)
+			c.instanceLog(i).Warningf("Error deleting instance: %v", err)
 		}
 	}()
 
@@ -232,14 +269,22 @@ func (c *controller) confirmTenant(tenantID string) error {
 	return err
 }
 
-func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload, name string, newIP net.IP) (*types.Instance, error) {
+func (c *controller) createInstance(ctx context.Context, w types.WorkloadRequest, wl types.Workload, name string, newIP net.IP, p placement) (*types.Instance, error) {
 	startTime := time.Now()
 
-	instance, err := newInstance(c, w.TenantID, &wl, name, w.Subnet, newIP)
+	instance, err := newInstance(ctx, c, w.TenantID, &wl, name, w.Subnet, newIP, p)
 	if err != nil {
+		if newIP != nil {
+			_ = c.ds.ReleaseTenantIP(w.TenantID, newIP.String())
+		}
 		return nil, errors.Wrap(err, "Error creating instance")
 	}
 	instance.startTime = startTime
+	instance.Description = w.Description
+	instance.DeletionProtected = w.DeletionProtected
+	instance.Template = w.Template
+	instance.TemplateVersion = w.TemplateVersion
+	instance.UserData = w.UserData
 
 	ok, err := instance.Allowed()
 	if err != nil {
@@ -249,15 +294,32 @@ func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload,
 
 	if !ok {
 		_ = instance.Clean()
-		return nil, errors.New("Over quota")
+		return nil, launchFailure(types.LaunchQuotaExceeded, types.ErrQuota)
 	}
 
-	err = instance.Add()
+	queued, err := c.admitLaunch(ctx, instance, w.TraceLabel)
+	if err != nil {
+		_ = instance.Clean()
+		return nil, err
+	}
+
+	if queued {
+		c.recordCreation(instance.Instance, wl, w.Actor)
+		return instance.Instance, nil
+	}
+
+	if !instance.CNCI {
+		defer c.launchStarted(w.TenantID)
+	}
+
+	err = instance.Add(ctx)
 	if err != nil {
 		_ = instance.Clean()
 		return nil, errors.Wrap(err, "Error adding instance")
 	}
 
+	c.recordCreation(instance.Instance, wl, w.Actor)
+
 	if w.TraceLabel == "" {
 		err = c.client.StartWorkload(instance.newConfig.config)
 	} else {
@@ -265,19 +327,65 @@ func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload,
 	}
 
 	if err != nil {
+		c.addHistory(instance.Instance, types.InstanceHistoryEntry{
+			Type:    types.HistoryResult,
+			Message: fmt.Sprintf("Start failed: %v", err),
+		})
 		_ = instance.Clean()
-		return nil, errors.Wrap(err, "Error starting workload")
+		return nil, launchFailure(types.LaunchInternal, errors.Wrap(err, "Error starting workload"))
 	}
 
+	c.recordCommand(instance.Instance, "start")
+
 	return instance.Instance, nil
 }
 
-func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance, error) {
+// launchResult is the outcome of launching one of the instances of a
+// request.
+type launchResult struct {
+	name     string
+	instance *types.Instance
+	err      error
+}
+
+// startWorkload launches the instances of a request and returns those which
+// were launched, along with the error the first instance which failed to
+// launch failed with.
+func (c *controller) startWorkload(ctx context.Context, w types.WorkloadRequest) ([]*types.Instance, error) {
+	results, err := c.launchInstances(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+
 	var e error
+	var newInstances []*types.Instance
+	for _, r := range results {
+		if r.err == nil {
+			newInstances = append(newInstances, r.instance)
+		} else if e == nil {
+			e = r.err
+		}
+	}
+
+	return newInstances, e
+}
+
+// launchInstances launches the instances of a request and returns the
+// outcome of each, in the order in which they were requested.  Each
+// instance is checked against quotas and cleaned up on its own, so an
+// instance which fails to launch releases only the resources it consumed.
+// An error is returned only if the request as a whole is rejected, in
+// which case no instance was launched.  Instances not yet created when ctx
+// is cancelled fail with its error.
+func (c *controller) launchInstances(ctx context.Context, w types.WorkloadRequest) ([]launchResult, error) {
 	var sem = make(chan int, runtime.NumCPU())
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if w.Instances <= 0 {
-		return nil, errors.New("Missing number of instances to start")
+		return nil, launchFailure(types.LaunchInvalidRequest, errors.New("Missing number of instances to start"))
 	}
 
 	wl, err := c.ds.GetWorkload(w.WorkloadID)
@@ -285,14 +393,70 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 		return nil, err
 	}
 
+	// CNCIs are launched by the controller itself and are sized by it
+	// rather than within the bounds of the CNCI workload.  Nor are they
+	// subject to the workload policy.
+	if w.Subnet != "" {
+		wl = overrideRequirements(wl, w.Overrides)
+	} else {
+		wl, err = applyOverrides(wl, w.Overrides)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.tenantNetworkDegraded(w.TenantID)
+		if err != nil {
+			return nil, launchFailure(types.LaunchNetworkNotReady, err)
+		}
+
+		err = c.evaluatePolicy(&wl, w.TenantID, policyLaunch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var p placement
+	if w.ServerGroup != "" {
+		g, err := c.ds.GetServerGroup(w.TenantID, w.ServerGroup)
+		if err != nil {
+			return nil, launchFailure(types.LaunchInvalidRequest, err)
+		}
+
+		p, err = c.serverGroupPlacement(g, &wl, w.Instances)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(w.Volumes) > 0 {
+		if w.Instances > 1 {
+			return nil, launchFailure(types.LaunchInvalidRequest, errors.New("Volumes may only be attached to a single instance"))
+		}
+
+		// the storage slice is shared with the datastore's copy
+		storage := make([]types.StorageResource, len(wl.Storage), len(wl.Storage)+len(w.Volumes))
+		copy(storage, wl.Storage)
+		for _, ID := range w.Volumes {
+			storage = append(storage, types.StorageResource{ID: ID})
+		}
+		wl.Storage = storage
+	}
+
+	if w.UserData != "" {
+		wl.Config, err = mergeUserData(wl.Config, w.UserData)
+		if err != nil {
+			return nil, launchFailure(types.LaunchInvalidRequest, err)
+		}
+	}
+
 	if wl.Requirements.Privileged {
 		tenant, err := c.ds.GetTenant(w.TenantID)
 		if err != nil {
-			return nil, errors.Wrap(err, "error getting tenant from datastore")
+			return nil, launchFailure(types.LaunchInternal, errors.Wrap(err, "error getting tenant from datastore"))
 		}
 
 		if !tenant.Permissions.PrivilegedContainers {
-			return nil, errors.New("Permission denied: you do not have permission to create privileged workloads")
+			return nil, launchFailure(types.LaunchInvalidRequest, errors.New("Permission denied: you do not have permission to create privileged workloads"))
 		}
 	}
 
@@ -302,17 +466,15 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 	if w.Subnet == "" {
 		IPPool, err = c.ds.AllocateTenantIPPool(w.TenantID, w.Instances)
 		if err != nil {
+			if networkFull(err) {
+				return nil, launchFailure(types.LaunchNetworkFull, err)
+			}
 			return nil, err
 		}
 	}
 
-	var newInstances []*types.Instance
-	type result struct {
-		instance *types.Instance
-		err      error
-	}
-
-	errChan := make(chan result)
+	results := make([]launchResult, w.Instances)
+	done := make(chan struct{})
 
 	for i := 0; i < w.Instances; i++ {
 		var newIP net.IP
@@ -328,58 +490,74 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 			}
 		}
 
-		go func(newIP net.IP, name string) {
+		go func(i int, newIP net.IP, name string) {
 			sem <- 1
-			instance, err := c.createInstance(w, wl, name, newIP)
-			ret := result{
-				err:      err,
+			instance, err := c.createInstance(ctx, w, wl, name, newIP, p)
+			if err == nil && w.ServerGroup != "" {
+				e := c.ds.AddServerGroupMember(w.TenantID, w.ServerGroup, instance.ID)
+				if e != nil {
+					c.log.Warningf("Unable to add instance %s to server group %s: %v", instance.ID, w.ServerGroup, e)
+				}
+			}
+			results[i] = launchResult{
+				name:     name,
 				instance: instance,
+				err:      err,
 			}
 			<-sem
-			errChan <- ret
-		}(newIP, name)
+			done <- struct{}{}
+		}(i, newIP, name)
 	}
 
 	for i := 0; i < w.Instances; i++ {
-		retVal := <-errChan
-		if retVal.err == nil {
-			newInstances = append(newInstances, retVal.instance)
-		} else if e == nil {
-			// return the first error
-			e = retVal.err
-		}
+		<-done
 	}
 
-	return newInstances, e
+	return results, nil
 }
 
+// deleteEphemeralStorage deletes the ephemeral volumes attached to an
+// instance.  A volume which cannot be deleted does not prevent the deletion
+// of the others, the first error is returned.
 func (c *controller) deleteEphemeralStorage(instanceID string) error {
+	var retval error
+
 	attachments := c.ds.GetStorageAttachments(instanceID)
 	for _, attachment := range attachments {
 		if !attachment.Ephemeral {
 			continue
 		}
-		err := c.ds.DeleteStorageAttachment(attachment.ID)
-		if err != nil {
-			return errors.Wrap(err, "Error deleting storage attachment from datastore")
-		}
-		bd, err := c.ds.GetBlockDevice(attachment.BlockID)
-		if err != nil {
-			return errors.Wrap(err, "Error getting block device from datastore")
-		}
-		err = c.ds.DeleteBlockDevice(attachment.BlockID)
-		if err != nil {
-			return errors.Wrap(err, "Error deleting block device from datastore")
-		}
-		err = c.DeleteBlockDevice(attachment.BlockID)
-		if err != nil {
-			return errors.Wrap(err, "Error deleting block device")
-		}
-		if !bd.Internal {
-			c.qs.Release(bd.TenantID,
-				payloads.RequestedResource{Type: payloads.Volume, Value: 1},
-				payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: bd.Size})
+
+		err := c.deleteEphemeralVolume(attachment)
+		if err != nil && retval == nil {
+			retval = err
 		}
 	}
+
+	return retval
+}
+
+func (c *controller) deleteEphemeralVolume(attachment types.StorageAttachment) error {
+	err := c.ds.DeleteStorageAttachment(attachment.ID)
+	if err != nil {
+		return errors.Wrap(err, "Error deleting storage attachment from datastore")
+	}
+	bd, err := c.ds.GetBlockDevice(attachment.BlockID)
+	if err != nil {
+		return errors.Wrap(err, "Error getting block device from datastore")
+	}
+	err = c.ds.DeleteBlockDevice(c.ctx, attachment.BlockID)
+	if err != nil {
+		return errors.Wrap(err, "Error deleting block device from datastore")
+	}
+	err = c.DeleteBlockDevice(c.ctx, attachment.BlockID)
+	if err != nil {
+		return errors.Wrap(err, "Error deleting block device")
+	}
+	if !bd.Internal {
+		c.qs.Release(bd.TenantID,
+			payloads.RequestedResource{Type: payloads.Volume, Value: 1},
+			payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: bd.Size})
+	}
 	return nil
 }
@@ -15,22 +15,42 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"sort"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func instanceToServer(ctl *controller, instance *types.Instance) (api.ServerDetails, error) {
 	var volumes []string
+	var volumeAttachments []api.VolumeAttachment
 
 	attachments := ctl.ds.GetStorageAttachments(instance.ID)
+	sort.Slice(attachments, func(i, j int) bool {
+		return attachments[i].BlockID < attachments[j].BlockID
+	})
 
 	for _, vol := range attachments {
 		volumes = append(volumes, vol.BlockID)
+		volumeAttachments = append(volumeAttachments, api.VolumeAttachment{
+			ID:       vol.ID,
+			VolumeID: vol.BlockID,
+			Tag:      vol.Tag,
+			Device:   vol.Device,
+		})
 	}
 
 	server := api.ServerDetails{
@@ -45,17 +65,101 @@ func instanceToServer(ctl *controller, instance *types.Instance) (api.ServerDeta
 				MacAddr: instance.MACAddress,
 			},
 		},
-		Volumes: volumes,
-		SSHIP:   instance.SSHIP,
-		SSHPort: instance.SSHPort,
-		Created: instance.CreateTime,
-		Name:    instance.Name,
+		Volumes:     volumes,
+		Attachments: volumeAttachments,
+		SSHIP:       instance.SSHIP,
+		SSHPort:     instance.SSHPort,
+		Created:     instance.CreateTime,
+		Name:        instance.Name,
+
+		Description: instance.Description,
+
+		Template:        instance.Template,
+		TemplateVersion: instance.TemplateVersion,
+		StatusReason:    instance.StatusReason,
+
+		DeletionProtected: instance.DeletionProtected,
+
+		Conditions: ctl.ds.GetInstanceConditions(instance.ID),
+		Tags:       instance.Tags,
+	}
+
+	for _, nic := range instance.NICs {
+		server.PrivateAddresses = append(server.PrivateAddresses, api.PrivateAddresses{
+			Addr:    nic.IPAddress,
+			MacAddr: nic.MACAddress,
+		})
+	}
+
+	if instance.State == payloads.Queued {
+		server.QueuePosition = ctl.launchQueuePosition(instance)
+	}
+
+	if instance.State == payloads.DeletePending {
+		deleteTime := instance.DeleteTime
+		server.DeleteTime = &deleteTime
 	}
 
 	return server, nil
 }
 
-func (c *controller) CreateServer(tenant string, server api.CreateServerRequest) (resp interface{}, err error) {
+// validateServerRequest checks the attributes of the instances requested
+// which do not depend on the workload.
+func validateServerRequest(server api.CreateServerRequest) error {
+	if server.Server.Name != "" {
+		// Between 1 and 64 (HOST_NAME_MAX) alphanum (+ "-")
+		r := regexp.MustCompile("^[a-z0-9-]{1,64}$")
+		if !r.MatchString(server.Server.Name) {
+			return types.ErrBadName
+		}
+	}
+
+	if len(server.Server.Description) > types.MaxDescriptionLength {
+		return types.ErrDescriptionTooLong
+	}
+
+	if _, err := decodeUserData(server.Server.UserData); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decodeUserData returns the cloud-init user data of a request, which may
+// be given either as YAML or base64 encoded YAML.  The user data must be a
+// mapping so that its keys can be merged with the workload's config.
+func decodeUserData(userData string) (string, error) {
+	if userData == "" {
+		return "", nil
+	}
+
+	if len(userData) > types.MaxUserDataLength {
+		return "", types.ErrBadUserData
+	}
+
+	var m yaml.MapSlice
+	if b, err := base64.StdEncoding.DecodeString(userData); err == nil {
+		if yaml.Unmarshal(b, &m) == nil && len(m) > 0 {
+			return string(b), nil
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte(userData), &m); err != nil || len(m) == 0 {
+		return "", types.ErrBadUserData
+	}
+
+	return userData, nil
+}
+
+func serverOverrides(server api.CreateServerRequest) types.RequirementOverrides {
+	return types.RequirementOverrides{
+		VCPUs:  server.Server.VCPUs,
+		MemMB:  server.Server.MemMB,
+		DiskGB: server.Server.DiskGB,
+	}
+}
+
+func (c *controller) CreateServer(ctx context.Context, tenant string, server api.CreateServerRequest) (resp interface{}, err error) {
 	nInstances := 1
 
 	if server.Server.MaxInstances > 0 {
@@ -64,33 +168,57 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 		nInstances = server.Server.MinInstances
 	}
 
-	if server.Server.Name != "" {
-		// Between 1 and 64 (HOST_NAME_MAX) alphanum (+ "-")
-		r := regexp.MustCompile("^[a-z0-9-]{1,64}$")
-		if !r.MatchString(server.Server.Name) {
-			return server, types.ErrBadName
-		}
+	if err := validateServerRequest(server); err != nil {
+		return server, err
 	}
 
 	label := server.Server.Metadata["label"]
 
 	w := types.WorkloadRequest{
-		WorkloadID: server.Server.WorkloadID,
-		TenantID:   tenant,
-		Instances:  nInstances,
-		TraceLabel: label,
-		Name:       server.Server.Name,
+		WorkloadID:  server.Server.WorkloadID,
+		TenantID:    tenant,
+		Instances:   nInstances,
+		TraceLabel:  label,
+		Name:        server.Server.Name,
+		Description: server.Server.Description,
+		Actor:       server.Actor,
+		Overrides:   serverOverrides(server),
+
+		DeletionProtected: server.Server.DeletionProtected,
+
+		Template:        server.Template,
+		TemplateVersion: server.TemplateVersion,
+
+		ServerGroup: server.Server.ServerGroup,
 	}
-	var e error
-	instances, err := c.startWorkload(w)
+
+	w.UserData, err = decodeUserData(server.Server.UserData)
 	if err != nil {
-		e = err
+		return server, err
 	}
 
+	results, err := c.launchInstances(ctx, w)
+	if err != nil {
+		_ = c.ds.LogLaunchFailure(tenant, launchFailureCode(err), fmt.Sprintf("Error launching instance(s): %v", err))
+		return server, err
+	}
+
+	var e error
 	var servers api.Servers
+	launches := make([]api.InstanceLaunch, len(results))
+
+	for i, r := range results {
+		launches[i].Name = r.name
+		if r.err != nil {
+			launches[i].Err = r.err
+			if e == nil {
+				e = r.err
+			}
+			continue
+		}
 
-	for _, instance := range instances {
-		server, err := instanceToServer(c, instance)
+		launches[i].ID = r.instance.ID
+		server, err := instanceToServer(c, r.instance)
 		if err != nil && e == nil {
 			e = err
 		}
@@ -98,18 +226,25 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 	}
 
 	if e != nil {
-		_ = c.ds.LogError(tenant, fmt.Sprintf("Error launching instance(s): %v", e))
+		_ = c.ds.LogLaunchFailure(tenant, launchFailureCode(e), fmt.Sprintf("Error launching instance(s): %v", e))
 	}
 
-	// If no instances launcher or if none converted bail early
-	if e != nil && len(servers.Servers) == 0 {
+	// If no instances launched bail early
+	if len(servers.Servers) == 0 {
 		return server, e
 	}
 
-	servers.TotalServers = len(instances)
+	servers.TotalServers = len(servers.Servers)
+
+	if len(servers.Servers) < len(results) {
+		return server, &api.BatchLaunchError{
+			Servers:  servers,
+			Launches: launches,
+		}
+	}
 
 	// set machine ID for OpenStack compatibility
-	server.Server.ID = instances[0].ID
+	server.Server.ID = servers.Servers[0].ID
 
 	// builtServers is define to meet OpenStack compatibility on result
 	// format and keep CIAOs legacy behavior.
@@ -129,23 +264,17 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 	return builtServers, nil
 }
 
-func (c *controller) ListServersDetail(tenant string) ([]api.ServerDetails, error) {
+// ListServersDetail returns the page selected by filter of the instances
+// of a tenant, or of all tenants if tenant is empty, and the marker of the
+// next page.  Only the instances selected by match are returned.
+func (c *controller) ListServersDetail(tenant string, match types.InstanceFilter, filter types.ListFilter) ([]api.ServerDetails, string, error) {
 	var servers []api.ServerDetails
-	var err error
-	var instances []*types.Instance
-
-	if tenant != "" {
-		instances, err = c.ds.GetAllInstancesFromTenant(tenant)
-	} else {
-		instances, err = c.ds.GetAllInstances()
-	}
 
+	instances, next, err := c.ds.ListInstances(tenant, match, filter)
 	if err != nil {
-		return servers, err
+		return servers, "", err
 	}
 
-	sort.Sort(types.SortedInstancesByID(instances))
-
 	for _, instance := range instances {
 		server, err := instanceToServer(c, instance)
 		if err != nil {
@@ -155,7 +284,7 @@ func (c *controller) ListServersDetail(tenant string) ([]api.ServerDetails, erro
 		servers = append(servers, server)
 	}
 
-	return servers, nil
+	return servers, next, nil
 }
 
 func (c *controller) ShowServerDetails(tenant string, server string) (api.Server, error) {
@@ -174,16 +303,129 @@ func (c *controller) ShowServerDetails(tenant string, server string) (api.Server
 	return s, nil
 }
 
-func (c *controller) DeleteServer(tenant string, server string) error {
+// PatchServer applies a JSON merge patch to the attributes of a tenant's
+// instance which may be changed once it has been created, and returns the
+// updated instance.
+func (c *controller) PatchServer(tenant string, server string, patch []byte) (api.Server, error) {
+	var s api.Server
+
+	instance, err := c.ds.GetTenantInstance(tenant, server)
+	if err != nil {
+		return s, err
+	}
+
+	orig, err := json.Marshal(types.InstanceUpdate{
+		Name:              instance.Name,
+		Description:       instance.Description,
+		DeletionProtected: instance.DeletionProtected,
+	})
+	if err != nil {
+		return s, errors.Wrap(err, "Error updating instance")
+	}
+
+	merged, err := jsonpatch.MergePatch(orig, patch)
+	if err != nil {
+		return s, types.ErrBadRequest
+	}
+
+	var update types.InstanceUpdate
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&update); err != nil {
+		return s, types.ErrBadRequest
+	}
+
+	if len(update.Description) > types.MaxDescriptionLength {
+		return s, types.ErrDescriptionTooLong
+	}
+
+	if update.Name != instance.Name {
+		err = c.renameInstance(instance, update.Name)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if update.Description != instance.Description {
+		err = c.ds.UpdateInstanceDescription(instance.ID, update.Description)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if update.DeletionProtected != instance.DeletionProtected {
+		err = c.ds.UpdateInstanceDeletionProtection(instance.ID, update.DeletionProtected)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return c.ShowServerDetails(tenant, server)
+}
+
+// renameInstance gives an instance a new name, which must not look like an
+// instance ID as names and IDs are used interchangeably to look up
+// instances.  Instances which are being launched, stopped, migrated or
+// deleted may not be renamed.
+func (c *controller) renameInstance(i *types.Instance, name string) error {
+	if _, err := uuid.Parse(name); err == nil {
+		return types.ErrBadInstanceName
+	}
+
+	return c.ds.UpdateInstanceName(i.ID, name)
+}
+
+// ShowInstancePlacements returns the node an instance is placed on and the
+// history of its placements.
+func (c *controller) ShowInstancePlacements(instanceID string) (types.InstancePlacements, error) {
+	return c.ds.GetInstancePlacements(instanceID)
+}
+
+// TenantNodeVisibility returns true if tenants may see the nodes their
+// instances are placed on.
+func (c *controller) TenantNodeVisibility() bool {
+	return c.config.config().TenantNodeVisibility
+}
+
+// DeleteServer deletes an instance of a tenant.  An instance protected from
+// deletion is only deleted if force is set, and is never kept in the trash.
+func (c *controller) DeleteServer(ctx context.Context, tenant string, server string, force bool) error {
 	/* First check that the instance belongs to this tenant */
-	_, err := c.ds.GetTenantInstance(tenant, server)
+	i, err := c.ds.GetTenantInstance(tenant, server)
 	if err != nil {
 		return api.ErrInstanceNotFound
 	}
 
-	err = c.deleteInstance(server)
+	if i.DeletionProtected {
+		err = c.overrideDeletionProtection(ctx, tenant, []protectedResource{{"instance", i.ID}}, force)
+		if err != nil {
+			return err
+		}
+	}
 
-	return err
+	// deleting an instance already pending deletion deletes it now
+	if i.State == payloads.DeletePending {
+		_, err = c.deletePendingInstance(ctx, i)
+		return err
+	}
+
+	if grace := c.deferredDeleteGrace(tenant); grace > 0 {
+		switch i.State {
+		case payloads.Running, payloads.Exited, payloads.ExitFailed:
+			return c.deferInstanceDeletion(ctx, i, time.Now().Add(grace))
+		}
+	}
+
+	err = c.deleteInstance(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	if retention := c.trashRetention(tenant); retention > 0 && !i.DeletionProtected {
+		c.trashInstance(i, retention)
+	}
+
+	return nil
 }
 
 func (c *controller) StartServer(tenant string, ID string) error {
@@ -210,6 +452,7 @@ func (c *controller) StopServer(tenant string, ID string) error {
 
 func (c *controller) createComputeRoutes(r *mux.Router) error {
 	legacyComputeRoutes(c, r)
+	tokenRoutes(c, r)
 
 	return nil
 }
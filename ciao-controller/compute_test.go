@@ -16,7 +16,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -24,16 +26,19 @@ import (
 	"net/url"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
 	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -53,13 +58,11 @@ func (c ByTenantID) Less(i int, j int) bool {
 }
 
 func testHTTPRequest(t *testing.T, method string, URL string, expectedResponse int, data []byte, validToken bool) []byte {
-	req, err := http.NewRequest(method, URL, bytes.NewBuffer(data))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
+	return testHTTPRequestWithHeader(t, method, URL, expectedResponse, data, nil)
+}
 
+// testHTTPClient returns a client authenticated with the admin certificate.
+func testHTTPClient(t *testing.T) *http.Client {
 	tlsConfig := &tls.Config{}
 
 	clientCertFile := "/etc/pki/ciao/auth-admin.pem"
@@ -75,8 +78,21 @@ func testHTTPRequest(t *testing.T, method string, URL string, expectedResponse i
 		TLSClientConfig: tlsConfig,
 	}
 
-	client := &http.Client{Transport: transport}
-	resp, err := client.Do(req)
+	return &http.Client{Transport: transport}
+}
+
+func testHTTPRequestWithHeader(t *testing.T, method string, URL string, expectedResponse int, data []byte, header http.Header) []byte {
+	req, err := http.NewRequest(method, URL, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := testHTTPClient(t).Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,6 +160,152 @@ func testCreateServer(t *testing.T, n int) api.Servers {
 	return servers
 }
 
+func TestCreateServerBatchQuotaExhausted(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	// only half of the batch fits within the quota
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 2},
+	})
+
+	var req api.CreateServerRequest
+	req.Server.Name = "batch"
+	req.Server.MaxInstances = 4
+	req.Server.WorkloadID = wls[0].ID
+
+	_, err = ctl.CreateServer(context.Background(), tenant.ID, req)
+	batch, ok := err.(*api.BatchLaunchError)
+	if !ok {
+		t.Fatalf("Expected a batch launch error, got %v", err)
+	}
+
+	if batch.Servers.TotalServers != 2 || len(batch.Servers.Servers) != 2 {
+		t.Fatalf("Expected 2 servers to be launched, got %d", batch.Servers.TotalServers)
+	}
+
+	if len(batch.Launches) != 4 {
+		t.Fatalf("Expected the outcome of 4 launches, got %d", len(batch.Launches))
+	}
+
+	launched := 0
+	for i, l := range batch.Launches {
+		if l.Name != fmt.Sprintf("batch-%d", i) {
+			t.Errorf("Launch %d reported out of order: %s", i, l.Name)
+		}
+
+		if l.Err == nil {
+			if l.ID == "" {
+				t.Errorf("Launch %d succeeded without an instance ID", i)
+			}
+			launched++
+			continue
+		}
+
+		if l.ID != "" {
+			t.Errorf("Launch %d failed but reported instance %s", i, l.ID)
+		}
+
+		if code := launchFailureCode(l.Err); code != types.LaunchQuotaExceeded {
+			t.Errorf("Expected launch %d to fail with %s, got %q", i, types.LaunchQuotaExceeded, code)
+		}
+	}
+
+	if launched != 2 {
+		t.Fatalf("Expected 2 successful launches, got %d", launched)
+	}
+
+	instances, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(instances))
+	}
+
+	// the failed launches must release what they consumed, leaving the
+	// quota used only by the instances which were launched.
+	for _, qd := range ctl.qs.DumpQuotas(tenant.ID) {
+		if qd.Name == "tenant-instances-quota" && qd.Usage != 2 {
+			t.Fatalf("Expected instance quota usage of 2, got %d", qd.Usage)
+		}
+	}
+}
+
+func TestCreateServerWorkloadQuota(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	name := string(quotas.WorkloadInstances(wls[0].ID))
+
+	bad := []struct {
+		qd  types.QuotaDetails
+		err error
+	}{
+		{types.QuotaDetails{Name: "workload:bogus:instances", Value: 1}, types.ErrBadQuotaResource},
+		{types.QuotaDetails{Name: name, Value: -2}, types.ErrBadRequest},
+		{types.QuotaDetails{Name: string(quotas.WorkloadInstances(uuid.Generate().String())), Value: 1},
+			types.ErrWorkloadNotFound},
+	}
+	for _, b := range bad {
+		if err := ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{b.qd}); err != b.err {
+			t.Errorf("Expected %v updating %+v, got %v", b.err, b.qd, err)
+		}
+	}
+
+	err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{{Name: name, Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qds, err := ctl.ds.GetQuotas(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qd := findQuota(qds, name); qd == nil || qd.Value != 1 {
+		t.Fatalf("Workload quota not stored: %+v", qds)
+	}
+
+	var req api.CreateServerRequest
+	req.Server.Name = "workload-quota"
+	req.Server.MaxInstances = 2
+	req.Server.WorkloadID = wls[0].ID
+
+	_, err = ctl.CreateServer(context.Background(), tenant.ID, req)
+	batch, ok := err.(*api.BatchLaunchError)
+	if !ok {
+		t.Fatalf("Expected a batch launch error, got %v", err)
+	}
+
+	if batch.Servers.TotalServers != 1 {
+		t.Fatalf("Expected 1 server to be launched, got %d", batch.Servers.TotalServers)
+	}
+
+	// the failed launch must release the workload instance it consumed
+	qds = ctl.ListQuotas(tenant.ID)
+	if qd := findQuota(qds, name); qd == nil || qd.Usage != 1 {
+		t.Fatalf("Expected workload quota usage of 1, got %+v", qd)
+	}
+	if qd := findQuota(qds, "tenant-instances-quota"); qd == nil || qd.Usage != 1 {
+		t.Fatalf("Expected instance quota usage of 1, got %+v", qd)
+	}
+}
+
 func testListServerDetailsTenant(t *testing.T, tenantID string) api.Servers {
 	url := testutil.ComputeURL + "/" + tenantID + "/instances/detail"
 
@@ -610,10 +772,13 @@ func testListEventsTenant(t *testing.T, httpExpectedStatus int, validToken bool)
 		}
 
 		event := types.CiaoEvent{
+			ID:        l.ID,
 			Timestamp: l.Timestamp,
 			TenantID:  l.TenantID,
 			EventType: l.EventType,
 			Message:   l.Message,
+			ObjectID:  l.ObjectID,
+			Actor:     l.Actor,
 		}
 		expected.Events = append(expected.Events, event)
 	}
@@ -726,6 +891,69 @@ func TestListNodes(t *testing.T) {
 	testListNodes(t, http.StatusOK, true)
 }
 
+func TestNodesSummary(t *testing.T) {
+	expected := ctl.ds.GetClusterStatus()
+
+	url := testutil.ComputeURL + "/v2.1/nodes/summary"
+
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var result types.CiaoClusterStatus
+
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reflect.DeepEqual(expected.Status, result.Status) == false {
+		t.Fatalf("expected: \n%+v\n result: \n%+v\n", expected, result)
+	}
+
+	if result.Database.PageCount == 0 || result.Database.PageSize == 0 {
+		t.Fatalf("Database size missing from summary: %+v", result.Database)
+	}
+}
+
+func TestNodeSummary(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, _ := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	instances, err := ctl.ds.GetAllInstancesByNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/v2.1/nodes/" + client.UUID + "/summary?stale_minutes=10"
+
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var result types.CiaoNodeSummary
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ID != client.UUID || result.TotalInstances != len(instances) ||
+		result.TotalRunningInstances != len(instances) {
+		t.Fatalf("Expected %d running instances, got %+v", len(instances), result)
+	}
+
+	if result.LastSeen.IsZero() || result.Stale {
+		t.Fatalf("Node should have been seen recently: %+v", result)
+	}
+
+	url = testutil.ComputeURL + "/v2.1/nodes/" + client.UUID + "/summary?stale_minutes=0"
+	_ = testHTTPRequest(t, "GET", url, http.StatusBadRequest, nil, true)
+
+	url = testutil.ComputeURL + "/v2.1/nodes/" + uuid.Generate().String() + "/summary"
+	_ = testHTTPRequest(t, "GET", url, http.StatusNotFound, nil, true)
+}
+
 func testListCNCIs(t *testing.T, httpExpectedStatus int, validToken bool) {
 	var expected types.CiaoCNCIs
 
@@ -755,6 +983,7 @@ func testListCNCIs(t *testing.T, httpExpectedStatus int, validToken bool) {
 				TenantID: cnci.TenantID,
 				IPv4:     cnci.IPAddress,
 				Subnets:  subnets,
+				Image:    ctl.ds.GetCNCIInstanceImage(cnci.InstanceID),
 			},
 		)
 	}
@@ -818,6 +1047,7 @@ func testListCNCIDetails(t *testing.T, httpExpectedStatus int, validToken bool)
 				TenantID: cnci.TenantID,
 				IPv4:     cnci.IPAddress,
 				Subnets:  subnets,
+				Image:    ctl.ds.GetCNCIInstanceImage(cnci.InstanceID),
 			}
 		}
 
@@ -905,10 +1135,13 @@ func testListEvents(t *testing.T, httpExpectedStatus int, validToken bool) {
 
 	for _, l := range logs {
 		event := types.CiaoEvent{
+			ID:        l.ID,
 			Timestamp: l.Timestamp,
 			TenantID:  l.TenantID,
 			EventType: l.EventType,
 			Message:   l.Message,
+			ObjectID:  l.ObjectID,
+			Actor:     l.Actor,
 		}
 		expected.Events = append(expected.Events, event)
 	}
@@ -1015,3 +1248,411 @@ func testTraceData(t *testing.T, httpExpectedStatus int, validToken bool) {
 func TestTraceData(t *testing.T) {
 	testTraceData(t, http.StatusOK, true)
 }
+
+func TestServerDescriptionSearch(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := addRunningInstance(t, tenant.ID)
+	db := addRunningInstance(t, tenant.ID)
+	hidden := addRunningInstance(t, other.ID)
+
+	for _, i := range []*types.Instance{web, hidden} {
+		_, err = ctl.PatchServer(i.TenantID, i.ID, []byte(`{"description": "50% frontend"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	detailURL := testutil.ComputeURL + "/" + tenant.ID + "/instances/detail"
+	search := func(term string) []string {
+		searchURL := detailURL + "?search=" + url.QueryEscape(term)
+		body := testHTTPRequest(t, "GET", searchURL, http.StatusOK, nil, true)
+
+		var s api.Servers
+		err := json.Unmarshal(body, &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var IDs []string
+		for _, server := range s.Servers {
+			IDs = append(IDs, server.ID)
+		}
+		return IDs
+	}
+
+	if IDs := search("frontend"); !reflect.DeepEqual(IDs, []string{web.ID}) {
+		t.Errorf("Expected only %s to match got %v", web.ID, IDs)
+	}
+
+	if IDs := search("0%"); !reflect.DeepEqual(IDs, []string{web.ID}) {
+		t.Errorf("Expected %% to match literally got %v", IDs)
+	}
+
+	if IDs := search("_"); len(IDs) != 0 {
+		t.Errorf("Expected _ to match literally got %v", IDs)
+	}
+
+	s, err := ctl.PatchServer(tenant.ID, db.ID, []byte(`{"description": "backend"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.Description != "backend" {
+		t.Errorf("Description not updated: %+v", s.Server)
+	}
+
+	if IDs := search("backend"); !reflect.DeepEqual(IDs, []string{db.ID}) {
+		t.Errorf("Expected only %s to match got %v", db.ID, IDs)
+	}
+
+	long, err := json.Marshal(types.InstanceUpdate{
+		Description: strings.Repeat("x", types.MaxDescriptionLength+1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.PatchServer(tenant.ID, db.ID, long)
+	if errors.Cause(err) != types.ErrDescriptionTooLong {
+		t.Errorf("Expected %v got %v", types.ErrDescriptionTooLong, err)
+	}
+
+	searchURL := detailURL + "?search=" + strings.Repeat("x", types.MaxSearchLength+1)
+	_ = testHTTPRequest(t, "GET", searchURL, http.StatusBadRequest, nil, true)
+}
+
+func TestServerRename(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := addRunningInstance(t, tenant.ID)
+	db := addRunningInstance(t, tenant.ID)
+
+	s, err := ctl.PatchServer(tenant.ID, web.ID, []byte(`{"name": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.Name != "web" {
+		t.Errorf("Name not updated: %+v", s.Server)
+	}
+
+	id, err := ctl.ds.ResolveInstance(tenant.ID, "web")
+	if err != nil || id != web.ID {
+		t.Errorf("Expected web to resolve to %s, got %s: %v", web.ID, id, err)
+	}
+
+	_, err = ctl.PatchServer(tenant.ID, db.ID, []byte(`{"name": "web"}`))
+	if err != types.ErrInstanceNameInUse {
+		t.Errorf("Expected %v got %v", types.ErrInstanceNameInUse, err)
+	}
+
+	_, err = ctl.PatchServer(tenant.ID, db.ID, []byte(`{"name": "`+web.ID+`"}`))
+	if err != types.ErrBadInstanceName {
+		t.Errorf("Expected %v got %v", types.ErrBadInstanceName, err)
+	}
+
+	// names only need to be unique within a tenant
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hidden := addRunningInstance(t, other.ID)
+	_, err = ctl.PatchServer(other.ID, hidden.ID, []byte(`{"name": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is released once the instance is renamed
+	_, err = ctl.PatchServer(tenant.ID, web.ID, []byte(`{"name": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.PatchServer(tenant.ID, db.ID, []byte(`{"name": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Name != "web" {
+		t.Errorf("Name not updated: %s", db.Name)
+	}
+
+	// instances which are changing state may not be renamed
+	states := []string{
+		payloads.Stopping,
+		payloads.Pending,
+		payloads.Queued,
+		payloads.Migrating,
+		payloads.DeletePending,
+		payloads.Deleted,
+	}
+
+	for _, state := range states {
+		err = db.TransitionInstanceState(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ctl.PatchServer(tenant.ID, db.ID, []byte(`{"name": "db"}`))
+		if err != types.ErrInstanceChangingState {
+			t.Errorf("%s: expected %v got %v", state, types.ErrInstanceChangingState, err)
+		}
+
+		if db.Name != "web" {
+			t.Errorf("%s: name changed to %s", state, db.Name)
+		}
+	}
+}
+
+func TestDecodeUserData(t *testing.T) {
+	raw := "#cloud-config\npackages:\n  - git\n"
+
+	tests := []struct {
+		name     string
+		userData string
+		expected string
+		err      error
+	}{
+		{"none", "", "", nil},
+		{"yaml", raw, raw, nil},
+		{"base64", base64.StdEncoding.EncodeToString([]byte(raw)), raw, nil},
+		{"not a mapping", "- git\n", "", types.ErrBadUserData},
+		{"invalid yaml", "packages: [git\n", "", types.ErrBadUserData},
+		{"too long", "a: " + strings.Repeat("b", types.MaxUserDataLength), "", types.ErrBadUserData},
+	}
+
+	for _, test := range tests {
+		userData, err := decodeUserData(test.userData)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+
+		if userData != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, userData)
+		}
+	}
+}
+
+func TestMergeUserData(t *testing.T) {
+	config := "---\n#cloud-config\nhostname: workload\npackages:\n  - git\n...\n"
+
+	merged, err := mergeUserData(config, "hostname: instance\nruncmd:\n  - [touch, /ready]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m yaml.MapSlice
+	err = yaml.Unmarshal([]byte(merged), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the workload's keys keep their order and the instance's follow
+	keys := []interface{}{"hostname", "packages", "runcmd"}
+	if len(m) != len(keys) {
+		t.Fatalf("Expected keys %v, got %v", keys, m)
+	}
+
+	for i, key := range keys {
+		if m[i].Key != key {
+			t.Fatalf("Expected keys %v, got %v", keys, m)
+		}
+	}
+
+	if m[0].Value != "instance" {
+		t.Errorf("Expected instance hostname to override workload's, got %v", m[0].Value)
+	}
+
+	if !strings.HasPrefix(merged, "---\n#cloud-config\n") || !strings.HasSuffix(merged, "\n...\n") {
+		t.Errorf("Merged config is not a cloud-config document: %q", merged)
+	}
+}
+
+func TestCreateServerUserData(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	config := wls[0].Config
+	var base map[string]interface{}
+	err = yaml.Unmarshal([]byte(config[:strings.Index(config, "\n...\n")+1]), &base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userData := []string{
+		"hostname: first\nruncmd:\n  - [touch, /first]\n",
+		base64.StdEncoding.EncodeToString([]byte("hostname: second\n")),
+	}
+
+	var configs []renderedConfig
+	for _, u := range userData {
+		var req api.CreateServerRequest
+		req.Server.MaxInstances = 1
+		req.Server.WorkloadID = wls[0].ID
+		req.Server.UserData = u
+
+		resp, err := ctl.CreateServer(context.Background(), tenant.ID, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var servers api.Servers
+		err = json.Unmarshal(b, &servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ID := servers.Servers[0].ID
+		config, err := ctl.ds.GetLaunchConfig(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		launched, err := splitConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, launched)
+
+		i, err := ctl.ds.GetInstance(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i.UserData == "" {
+			t.Errorf("User data not stored with instance %s", ID)
+		}
+	}
+
+	if configs[0].cloudInit == configs[1].cloudInit {
+		t.Fatalf("Instances started with the same config:\n%s", configs[0].cloudInit)
+	}
+
+	for i, hostname := range []string{"first", "second"} {
+		var cloudInit map[string]interface{}
+		err = yaml.Unmarshal([]byte(configs[i].cloudInit), &cloudInit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cloudInit["hostname"] != hostname {
+			t.Errorf("Expected hostname %s, got %v", hostname, cloudInit["hostname"])
+		}
+
+		for key := range base {
+			if _, ok := cloudInit[key]; !ok {
+				t.Errorf("Workload config key %s missing from instance config", key)
+			}
+		}
+	}
+
+	var req api.CreateServerRequest
+	req.Server.MaxInstances = 1
+	req.Server.WorkloadID = wls[0].ID
+	req.Server.UserData = "- not a mapping\n"
+
+	_, err = ctl.CreateServer(context.Background(), tenant.ID, req)
+	if err != types.ErrBadUserData {
+		t.Fatalf("Expected %v, got %v", types.ErrBadUserData, err)
+	}
+}
+
+func TestCreateServerCancelled(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var req api.CreateServerRequest
+	req.Server.MaxInstances = 2
+	req.Server.WorkloadID = wls[0].ID
+
+	_, err = ctl.CreateServer(ctx, tenant.ID, req)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	instances, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("Expected no instances after a cancelled launch, got %d", len(instances))
+	}
+}
+
+func TestLaunchCancelledBeforeAdd(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	ips, err := ctl.ds.AllocateTenantIPPool(tenant.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := newInstance(context.Background(), ctl, tenant.ID, &wls[0], "", "", ips[0], placement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.ds.ReleaseTenantIP(tenant.ID, ips[0].String()) }()
+
+	// the request is cancelled while the instance is being created
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = i.Add(ctx)
+	if err == nil {
+		t.Fatal("Expected a cancelled launch to fail")
+	}
+
+	_, err = ctl.ds.GetInstance(i.ID)
+	if err == nil {
+		t.Fatal("Instance of a cancelled launch recorded in datastore")
+	}
+
+	config, _ := ctl.ds.GetLaunchConfig(i.ID)
+	if config != "" {
+		t.Fatal("Launch config of a cancelled launch recorded in datastore")
+	}
+}
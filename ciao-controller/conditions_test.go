@@ -0,0 +1,109 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func testShowServerConditions(t *testing.T, i *types.Instance) []types.InstanceCondition {
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID
+	body := testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, onBehalfOf(i.TenantID))
+
+	var s api.Server
+	err := json.Unmarshal(body, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.Server.Conditions
+}
+
+func waitConditionEvent(t *testing.T, ch chan types.Event, eventType types.EventType, instanceID string) types.Event {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.Type == eventType && e.Data["instance"] == instanceID {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %s event published for %s", eventType, instanceID)
+		}
+	}
+}
+
+func TestInstanceConditions(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	i := instances[0]
+
+	ch := ctl.events.subscribe(20)
+	defer ctl.events.unsubscribe(ch)
+
+	client.SetInstanceWarnings(i.ID, []payloads.InstanceWarning{
+		{Type: payloads.SoftwareVirtualization, Message: "KVM unavailable"},
+		{Type: payloads.SoftwareVirtualization, Message: "KVM unavailable"},
+		{Type: payloads.DiskSpaceLow, Message: "Disk 95% full"},
+	})
+	sendStatsCmd(client, t)
+
+	conditions := testShowServerConditions(t, i)
+	if len(conditions) != 2 ||
+		conditions[0].Type != payloads.SoftwareVirtualization ||
+		conditions[1].Type != payloads.DiskSpaceLow {
+		t.Fatalf("Unexpected conditions: %+v", conditions)
+	}
+
+	e := waitConditionEvent(t, ch, types.InstanceConditionRaisedEvent, i.ID)
+	if e.TenantID != i.TenantID || e.Message != "KVM unavailable" {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+	_ = waitConditionEvent(t, ch, types.InstanceConditionRaisedEvent, i.ID)
+
+	client.SetInstanceWarnings(i.ID, []payloads.InstanceWarning{
+		{Type: payloads.DiskSpaceLow, Message: "Disk 95% full"},
+	})
+	sendStatsCmd(client, t)
+
+	e = waitConditionEvent(t, ch, types.InstanceConditionClearedEvent, i.ID)
+	if e.Data["condition"] != string(payloads.SoftwareVirtualization) {
+		t.Errorf("Unexpected condition cleared: %+v", e)
+	}
+
+	remaining := testShowServerConditions(t, i)
+	if len(remaining) != 1 || remaining[0].Type != payloads.DiskSpaceLow ||
+		!remaining[0].Timestamp.Equal(conditions[1].Timestamp) {
+		t.Errorf("Unexpected conditions after clear: %+v", remaining)
+	}
+
+	client.SetInstanceWarnings(i.ID, nil)
+	sendStatsCmd(client, t)
+
+	if conditions := testShowServerConditions(t, i); len(conditions) != 0 {
+		t.Errorf("Conditions not cleared: %+v", conditions)
+	}
+}
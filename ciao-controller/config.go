@@ -0,0 +1,880 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// controllerConfig contains the settings of the controller.
+//
+// Each setting can be supplied from several sources.  In order of
+// precedence these are:
+//
+//  1. command line flags with the same name as the yaml key
+//  2. the configuration file given by the -config flag
+//  3. the cluster configuration retrieved from the scheduler
+//  4. the defaults returned by defaultConfig
+//
+// Settings tagged with reload:"true" are re-read from the configuration
+// file when the controller receives SIGHUP and are updated when the
+// scheduler sends a new cluster configuration.  Changes to any other
+// setting require a restart.
+type controllerConfig struct {
+	ServerURL     string `yaml:"url"`
+	Cert          string `yaml:"cert"`
+	CACert        string `yaml:"cacert"`
+	WorkloadsPath string `yaml:"workloads_path"`
+	DatabasePath  string `yaml:"database_path"`
+	CephID        string `yaml:"ceph_id"`
+
+	// ConnectTimeout bounds the time spent trying to connect to the
+	// scheduler at start up.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+	// LegacyStatsPath is the statistics database of controllers which
+	// kept their statistics and event log apart from the persistent
+	// database.  Its contents are imported into the persistent database
+	// at start up, after which it is renamed.
+	LegacyStatsPath string `yaml:"legacy_stats_path"`
+
+	LogFormat    string `yaml:"log_format"`
+	LogVerbosity int    `yaml:"log_verbosity" reload:"true"`
+
+	APIPort              int    `yaml:"api_port"`
+	HTTPSCACert          string `yaml:"https_ca_cert" reload:"true"`
+	HTTPSKey             string `yaml:"https_key" reload:"true"`
+	ClientAuthCACertPath string `yaml:"client_auth_ca_cert_path" reload:"true"`
+	AdminSSHKey          string `yaml:"admin_ssh_key" reload:"true"`
+	APIHostname          string `yaml:"api_hostname"`
+	APINameOrder         string `yaml:"api_name_order"`
+
+	// APIRequestTimeout bounds the time spent handling an API request,
+	// zero for no limit.
+	APIRequestTimeout time.Duration `yaml:"api_request_timeout" reload:"true"`
+
+	// APIBodyLimit bounds the size of API request bodies in KiB.  Workload
+	// definitions, which carry their cloud-init configuration, are bounded
+	// by WorkloadBodyLimit instead.
+	APIBodyLimit      int `yaml:"api_body_limit_kb" reload:"true"`
+	WorkloadBodyLimit int `yaml:"workload_body_limit_kb" reload:"true"`
+
+	// APIWriteRate and APIReadRate are the number of mutating and
+	// read-only API requests a client other than an admin may make per
+	// minute, zero for no limit.  Clients which have been idle may make
+	// up to the burst size of requests at once.
+	APIWriteRate  int `yaml:"api_write_rate" reload:"true"`
+	APIWriteBurst int `yaml:"api_write_burst" reload:"true"`
+	APIReadRate   int `yaml:"api_read_rate" reload:"true"`
+	APIReadBurst  int `yaml:"api_read_burst" reload:"true"`
+
+	CNCINet   string `yaml:"cnci_net"`
+	CNCIVcpus int    `yaml:"cnci_vcpus" reload:"true"`
+	CNCIMem   int    `yaml:"cnci_mem" reload:"true"`
+	CNCIDisk  int    `yaml:"cnci_disk" reload:"true"`
+
+	// CNCIPoolEnabled keeps up to CNCIPoolSize CNCIs launched ahead of
+	// demand so that a tenant which needs a new subnet can claim one
+	// which is already active.  At most CNCIPoolRefillConcurrency CNCIs
+	// are launched at a time to refill the pool and a claimed CNCI which
+	// is not configured for its subnet within CNCIPoolClaimTimeout is
+	// recycled.
+	CNCIPoolEnabled           bool          `yaml:"cnci_pool_enabled" reload:"true"`
+	CNCIPoolSize              int           `yaml:"cnci_pool_size" reload:"true"`
+	CNCIPoolRefillConcurrency int           `yaml:"cnci_pool_refill_concurrency" reload:"true"`
+	CNCIPoolClaimTimeout      time.Duration `yaml:"cnci_pool_claim_timeout" reload:"true"`
+
+	// CNCIHeartbeatTimeout is how long a tenant's CNCI may go without
+	// being reported running by its node before it is replaced.  A
+	// subnet whose CNCIs keep failing is failed over again only after
+	// CNCIFailoverBackoff, which doubles with each failover.
+	CNCIHeartbeatTimeout time.Duration `yaml:"cnci_heartbeat_timeout" reload:"true"`
+	CNCIFailoverBackoff  time.Duration `yaml:"cnci_failover_backoff" reload:"true"`
+
+	// TenantIPAllocation is the strategy with which the addresses of
+	// tenant subnets are given to instances: sequential, lru or random.
+	TenantIPAllocation string `yaml:"tenant_ip_allocation"`
+
+	WebhookMaxAttempts int           `yaml:"webhook_max_attempts" reload:"true"`
+	WebhookBackoff     time.Duration `yaml:"webhook_backoff" reload:"true"`
+	WebhookTimeout     time.Duration `yaml:"webhook_timeout" reload:"true"`
+
+	LeaderElection bool          `yaml:"leader_election"`
+	LeaderLease    time.Duration `yaml:"leader_lease"`
+	AdvertiseURL   string        `yaml:"advertise_url"`
+
+	ReconcileTimeout time.Duration `yaml:"reconcile_timeout"`
+
+	// ReconcilePendingAge is how long an instance must have been pending
+	// before a reconciliation restarts its launch because no node
+	// reports it.
+	ReconcilePendingAge time.Duration `yaml:"reconcile_pending_age"`
+
+	NodeSuspectTimeout time.Duration `yaml:"node_suspect_timeout" reload:"true"`
+	NodeDownTimeout    time.Duration `yaml:"node_down_timeout" reload:"true"`
+	NodeRecoveryPeriod time.Duration `yaml:"node_recovery_period" reload:"true"`
+
+	// ClockSkewThreshold is how far the clock of a node may be from the
+	// controller's clock before a warning is raised.
+	ClockSkewThreshold time.Duration `yaml:"clock_skew_threshold" reload:"true"`
+
+	// PendingInstanceTimeout is how long an instance may remain pending
+	// before an error is logged for its tenant, zero to never report
+	// pending instances.
+	PendingInstanceTimeout time.Duration `yaml:"pending_instance_timeout" reload:"true"`
+
+	// TenantLaunchLimit is the number of launches a tenant may have
+	// pending at once, zero for no limit.  Launches beyond the limit are
+	// rejected unless TenantLaunchQueue is set, in which case they are
+	// queued until earlier launches have completed.
+	TenantLaunchLimit int  `yaml:"tenant_launch_limit" reload:"true"`
+	TenantLaunchQueue bool `yaml:"tenant_launch_queue" reload:"true"`
+
+	// PreferSeededNodes asks the scheduler to prefer the nodes which have
+	// cached the image of a workload when launching its instances.
+	PreferSeededNodes bool `yaml:"prefer_seeded_nodes" reload:"true"`
+
+	// MetricsAddr, if set, is the address on which the metrics are
+	// exported over plain HTTP without authentication, e.g.,
+	// 127.0.0.1:9101 to limit them to local scrapers.  The /metrics
+	// route of the API is restricted to admins, so scrapers without an
+	// admin certificate must use this address.
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	MetricsMaxTenants          int           `yaml:"metrics_max_tenants"`
+	QuotaDenialWindow          time.Duration `yaml:"quota_denial_window"`
+	QuotaDenialSummaryInterval time.Duration `yaml:"quota_denial_summary_interval"`
+
+	DBMaintenance            bool          `yaml:"db_maintenance" reload:"true"`
+	DBMaintenanceInterval    time.Duration `yaml:"db_maintenance_interval" reload:"true"`
+	DBMaintenanceMaxRequests int           `yaml:"db_maintenance_max_requests" reload:"true"`
+	DBBackupLock             string        `yaml:"db_backup_lock" reload:"true"`
+	DBSizeWarning            int           `yaml:"db_size_warning_mb" reload:"true"`
+
+	OperationRetention   time.Duration `yaml:"operation_retention" reload:"true"`
+	IdempotencyRetention time.Duration `yaml:"idempotency_retention" reload:"true"`
+
+	// StatsRetention is how long node and instance statistics are kept.
+	// The latest statistics of each node and instance, which record the
+	// last known state of the instances, are never pruned.
+	StatsRetention time.Duration `yaml:"stats_retention" reload:"true"`
+
+	// QuotaAudit records every change in the consumption of the
+	// resources subject to quotas, which is kept for QuotaAuditRetention.
+	QuotaAudit          bool          `yaml:"quota_audit"`
+	QuotaAuditRetention time.Duration `yaml:"quota_audit_retention" reload:"true"`
+
+	// TrashRetention is how long deleted instances and volumes may be
+	// restored before they are purged, zero to delete them immediately.
+	TrashRetention time.Duration `yaml:"trash_retention" reload:"true"`
+
+	Impersonation bool `yaml:"impersonation" reload:"true"`
+
+	// SignedURLKeyPath is the file holding the key with which signed
+	// URLs are signed, empty to disable them.  Replacing the key revokes
+	// all the URLs signed with it.  SignedURLExpiry bounds the lifetime
+	// of the URLs and SignedURLResources lists the resources which may
+	// be downloaded through them.
+	SignedURLKeyPath   string        `yaml:"signed_url_key_path" reload:"true"`
+	SignedURLExpiry    time.Duration `yaml:"signed_url_expiry" reload:"true"`
+	SignedURLResources string        `yaml:"signed_url_resources" reload:"true"`
+
+	// TokenKeyPath is the file holding the key with which bearer tokens
+	// are signed, empty to accept client certificates only.  Replacing
+	// the key revokes all the tokens signed with it.  TokenExpiry is the
+	// lifetime of the tokens.
+	TokenKeyPath string        `yaml:"token_key_path" reload:"true"`
+	TokenExpiry  time.Duration `yaml:"token_expiry" reload:"true"`
+
+	TenantNodeVisibility bool `yaml:"tenant_node_visibility" reload:"true"`
+
+	// CertRoleAttribute is the subject attribute of client certificates,
+	// "ou" or "o", whose "admin" and "tenant:<id>" values grant their
+	// roles.  Certificates with no role in the attribute, or any
+	// certificate if it is empty, are authorized by their organizations.
+	CertRoleAttribute string `yaml:"cert_role_attribute" reload:"true"`
+
+	// AuditRetention is how long the audit records of mutating API
+	// requests are kept.  Request bodies larger than AuditBodyLimit KiB
+	// are not recorded, zero to record no bodies.  The records are also
+	// appended to AuditFile as JSON lines if it is set.
+	AuditRetention time.Duration `yaml:"audit_retention" reload:"true"`
+	AuditBodyLimit int           `yaml:"audit_body_limit_kb" reload:"true"`
+	AuditFile      string        `yaml:"audit_file" reload:"true"`
+
+	// UsageSampleInterval is how often the usage of the tenants'
+	// resources is sampled, zero to disable usage recording.  Samples
+	// are kept for UsageSampleRetention once rolled up into hourly
+	// records.
+	UsageSampleInterval  time.Duration `yaml:"usage_sample_interval" reload:"true"`
+	UsageSampleRetention time.Duration `yaml:"usage_sample_retention" reload:"true"`
+}
+
+func defaultConfig() controllerConfig {
+	return controllerConfig{
+		WorkloadsPath:        "/var/lib/ciao/data/controller/workloads",
+		DatabasePath:         "/var/lib/ciao/data/controller/ciao-controller.db",
+		LogFormat:            "glog",
+		ConnectTimeout:       5 * time.Minute,
+		APIPort:              api.Port,
+		HTTPSCACert:          "/etc/pki/ciao/ciao-controller-cacert.pem",
+		HTTPSKey:             "/etc/pki/ciao/ciao-controller-key.pem",
+		ClientAuthCACertPath: "/etc/pki/ciao/auth-CA.pem",
+		APINameOrder:         "san_dns,cn,san_ip",
+		CertRoleAttribute:    "ou",
+		APIBodyLimit:         1024,
+		WorkloadBodyLimit:    16 * 1024,
+		APIWriteRate:         120,
+		APIWriteBurst:        60,
+		CNCINet:              "192.168.128.0",
+		CNCIVcpus:            4,
+		CNCIMem:              2048,
+		CNCIDisk:             2048,
+		TenantIPAllocation:   datastore.IPAllocationSequential,
+		WebhookMaxAttempts:   5,
+		WebhookBackoff:       time.Second,
+		WebhookTimeout:       10 * time.Second,
+		LeaderLease:          15 * time.Second,
+		ReconcileTimeout:     30 * time.Second,
+		ReconcilePendingAge:  2 * time.Minute,
+		NodeSuspectTimeout:   30 * time.Second,
+		NodeDownTimeout:      2 * time.Minute,
+		NodeRecoveryPeriod:   time.Minute,
+		ClockSkewThreshold:   5 * time.Second,
+
+		PendingInstanceTimeout: 10 * time.Minute,
+
+		CNCIPoolSize:              2,
+		CNCIPoolRefillConcurrency: 1,
+		CNCIPoolClaimTimeout:      2 * time.Minute,
+
+		CNCIHeartbeatTimeout: time.Minute,
+		CNCIFailoverBackoff:  time.Minute,
+
+		MetricsMaxTenants:          50,
+		QuotaDenialWindow:          time.Hour,
+		QuotaDenialSummaryInterval: 15 * time.Minute,
+
+		DBMaintenance:            true,
+		DBMaintenanceInterval:    24 * time.Hour,
+		DBMaintenanceMaxRequests: 2,
+		DBBackupLock:             "/var/lib/ciao/data/controller/backup.lock",
+		DBSizeWarning:            1024,
+
+		OperationRetention:   24 * time.Hour,
+		IdempotencyRetention: 24 * time.Hour,
+		StatsRetention:       24 * time.Hour,
+
+		QuotaAudit:          true,
+		QuotaAuditRetention: 30 * 24 * time.Hour,
+
+		Impersonation: true,
+
+		AuditRetention: 90 * 24 * time.Hour,
+		AuditBodyLimit: 4,
+
+		SignedURLExpiry:    15 * time.Minute,
+		SignedURLResources: "operation,instance_history",
+
+		TokenExpiry: time.Hour,
+
+		UsageSampleInterval:  5 * time.Minute,
+		UsageSampleRetention: 48 * time.Hour,
+	}
+}
+
+func (c *controllerConfig) validate() error {
+	if c.LogFormat != "glog" && c.LogFormat != "json" {
+		return fmt.Errorf("Unknown log format: %s", c.LogFormat)
+	}
+
+	if c.LogVerbosity < 0 {
+		return errors.New("log_verbosity must not be negative")
+	}
+
+	if c.APIPort <= 0 || c.APIPort > 65535 {
+		return fmt.Errorf("Invalid api_port: %d", c.APIPort)
+	}
+
+	if err := validateNameOrder(c.APINameOrder); err != nil {
+		return err
+	}
+
+	if err := validateCertRoleAttribute(c.CertRoleAttribute); err != nil {
+		return err
+	}
+
+	if c.APIRequestTimeout < 0 {
+		return errors.New("api_request_timeout must not be negative")
+	}
+
+	if c.APIBodyLimit <= 0 || c.WorkloadBodyLimit <= 0 {
+		return errors.New("api_body_limit_kb and workload_body_limit_kb must be positive")
+	}
+
+	if err := validateRateLimit("api_write", c.APIWriteRate, c.APIWriteBurst); err != nil {
+		return err
+	}
+
+	if err := validateRateLimit("api_read", c.APIReadRate, c.APIReadBurst); err != nil {
+		return err
+	}
+
+	if net.ParseIP(c.CNCINet) == nil {
+		return fmt.Errorf("Unable to parse cnci_net: %s", c.CNCINet)
+	}
+
+	if c.CNCIVcpus <= 0 || c.CNCIMem <= 0 || c.CNCIDisk <= 0 {
+		return errors.New("cnci_vcpus, cnci_mem and cnci_disk must be positive")
+	}
+
+	if c.CNCIPoolSize < 0 {
+		return errors.New("cnci_pool_size must not be negative")
+	}
+
+	if c.CNCIPoolRefillConcurrency <= 0 || c.CNCIPoolClaimTimeout <= 0 {
+		return errors.New("cnci_pool_refill_concurrency and cnci_pool_claim_timeout must be positive")
+	}
+
+	if c.CNCIHeartbeatTimeout <= 0 || c.CNCIFailoverBackoff <= 0 {
+		return errors.New("cnci_heartbeat_timeout and cnci_failover_backoff must be positive")
+	}
+
+	switch c.TenantIPAllocation {
+	case datastore.IPAllocationSequential, datastore.IPAllocationLRU, datastore.IPAllocationRandom:
+	default:
+		return fmt.Errorf("Unknown tenant_ip_allocation: %s", c.TenantIPAllocation)
+	}
+
+	if c.WebhookMaxAttempts <= 0 {
+		return errors.New("webhook_max_attempts must be positive")
+	}
+
+	if c.WebhookBackoff <= 0 || c.WebhookTimeout <= 0 {
+		return errors.New("webhook_backoff and webhook_timeout must be positive")
+	}
+
+	if c.ConnectTimeout <= 0 {
+		return errors.New("connect_timeout must be positive")
+	}
+
+	if c.LeaderElection && c.LeaderLease < time.Second {
+		return errors.New("leader_lease must be at least one second")
+	}
+
+	if c.ReconcileTimeout <= 0 {
+		return errors.New("reconcile_timeout must be positive")
+	}
+
+	if c.ReconcilePendingAge <= 0 {
+		return errors.New("reconcile_pending_age must be positive")
+	}
+
+	if c.NodeSuspectTimeout <= 0 || c.NodeRecoveryPeriod <= 0 {
+		return errors.New("node_suspect_timeout and node_recovery_period must be positive")
+	}
+
+	if c.NodeDownTimeout <= c.NodeSuspectTimeout {
+		return errors.New("node_down_timeout must be greater than node_suspect_timeout")
+	}
+
+	if c.ClockSkewThreshold <= 0 {
+		return errors.New("clock_skew_threshold must be positive")
+	}
+
+	if c.PendingInstanceTimeout < 0 {
+		return errors.New("pending_instance_timeout must not be negative")
+	}
+
+	if c.TenantLaunchLimit < 0 {
+		return errors.New("tenant_launch_limit must not be negative")
+	}
+
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			return errors.Wrap(err, "Invalid metrics_addr")
+		}
+	}
+
+	if c.MetricsMaxTenants <= 0 {
+		return errors.New("metrics_max_tenants must be positive")
+	}
+
+	if c.QuotaDenialWindow < time.Minute {
+		return errors.New("quota_denial_window must be at least one minute")
+	}
+
+	if c.QuotaDenialSummaryInterval <= 0 {
+		return errors.New("quota_denial_summary_interval must be positive")
+	}
+
+	if c.DBMaintenanceInterval < time.Minute {
+		return errors.New("db_maintenance_interval must be at least one minute")
+	}
+
+	if c.DBMaintenanceMaxRequests < 0 || c.DBSizeWarning < 0 {
+		return errors.New("db_maintenance_max_requests and db_size_warning_mb must not be negative")
+	}
+
+	if c.OperationRetention <= 0 || c.IdempotencyRetention <= 0 || c.StatsRetention <= 0 {
+		return errors.New("operation_retention, idempotency_retention and stats_retention must be positive")
+	}
+
+	if c.QuotaAuditRetention <= 0 {
+		return errors.New("quota_audit_retention must be positive")
+	}
+
+	if c.TrashRetention < 0 {
+		return errors.New("trash_retention must not be negative")
+	}
+
+	if c.AuditRetention <= 0 {
+		return errors.New("audit_retention must be positive")
+	}
+
+	if c.AuditBodyLimit < 0 {
+		return errors.New("audit_body_limit_kb must not be negative")
+	}
+
+	if c.SignedURLExpiry <= 0 {
+		return errors.New("signed_url_expiry must be positive")
+	}
+
+	if err := validateSignedResources(c.SignedURLResources); err != nil {
+		return err
+	}
+
+	if c.TokenExpiry <= 0 {
+		return errors.New("token_expiry must be positive")
+	}
+
+	if c.UsageSampleInterval < 0 {
+		return errors.New("usage_sample_interval must not be negative")
+	}
+
+	if c.UsageSampleRetention <= 0 {
+		return errors.New("usage_sample_retention must be positive")
+	}
+
+	return nil
+}
+
+// configSource is a set of settings obtained from a single source.  Only
+// the settings whose yaml keys are present in set are applied when the
+// sources are merged.
+type configSource struct {
+	config controllerConfig
+	set    map[string]bool
+}
+
+// configKeys returns the yaml keys of the settings in controllerConfig.
+func configKeys() []string {
+	var keys []string
+
+	t := reflect.TypeOf(controllerConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, configKey(t.Field(i)))
+	}
+
+	return keys
+}
+
+func configKey(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("yaml"), ",")[0]
+}
+
+func defaultConfigSource() configSource {
+	s := configSource{
+		config: defaultConfig(),
+		set:    make(map[string]bool),
+	}
+
+	for _, k := range configKeys() {
+		s.set[k] = true
+	}
+
+	return s
+}
+
+// parseConfigSource parses a yaml configuration file.  Unknown keys are
+// treated as errors to catch typos.
+func parseConfigSource(data []byte) (configSource, error) {
+	s := configSource{set: make(map[string]bool)}
+
+	err := yaml.Unmarshal(data, &s.config)
+	if err != nil {
+		return s, errors.Wrap(err, "Error parsing configuration file")
+	}
+
+	var keys map[string]interface{}
+	err = yaml.Unmarshal(data, &keys)
+	if err != nil {
+		return s, errors.Wrap(err, "Error parsing configuration file")
+	}
+
+	known := make(map[string]bool)
+	for _, k := range configKeys() {
+		known[k] = true
+	}
+
+	for k := range keys {
+		if !known[k] {
+			return s, fmt.Errorf("Unknown configuration setting: %s", k)
+		}
+		s.set[k] = true
+	}
+
+	return s, nil
+}
+
+// fileConfigSource reads the configuration file at path.  An empty path
+// returns an empty source.
+func fileConfigSource(path string) (configSource, error) {
+	if path == "" {
+		return configSource{set: make(map[string]bool)}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return configSource{}, errors.Wrap(err, "Error reading configuration file")
+	}
+
+	return parseConfigSource(data)
+}
+
+// clusterConfigSource returns the settings present in the cluster
+// configuration.  Settings with zero values are considered to be unset.
+func clusterConfigSource(clusterConfig payloads.Configure) configSource {
+	s := configSource{set: make(map[string]bool)}
+	cc := clusterConfig.Configure.Controller
+
+	setString := func(key string, dst *string, val string) {
+		if val != "" {
+			*dst = val
+			s.set[key] = true
+		}
+	}
+
+	setInt := func(key string, dst *int, val int) {
+		if val != 0 {
+			*dst = val
+			s.set[key] = true
+		}
+	}
+
+	setSeconds := func(key string, dst *time.Duration, val int) {
+		if val != 0 {
+			*dst = time.Duration(val) * time.Second
+			s.set[key] = true
+		}
+	}
+
+	setString("ceph_id", &s.config.CephID, clusterConfig.Configure.Storage.CephID)
+	setInt("api_port", &s.config.APIPort, cc.CiaoPort)
+	setString("https_ca_cert", &s.config.HTTPSCACert, cc.HTTPSCACert)
+	setString("https_key", &s.config.HTTPSKey, cc.HTTPSKey)
+	setString("client_auth_ca_cert_path", &s.config.ClientAuthCACertPath, cc.ClientAuthCACertPath)
+	setString("admin_ssh_key", &s.config.AdminSSHKey, cc.AdminSSHKey)
+	setString("api_hostname", &s.config.APIHostname, cc.APIHostname)
+	setString("cnci_net", &s.config.CNCINet, cc.CNCINet)
+	setInt("cnci_vcpus", &s.config.CNCIVcpus, cc.CNCIVcpus)
+	setInt("cnci_mem", &s.config.CNCIMem, cc.CNCIMem)
+	setInt("cnci_disk", &s.config.CNCIDisk, cc.CNCIDisk)
+	setSeconds("node_suspect_timeout", &s.config.NodeSuspectTimeout, cc.NodeSuspectTimeout)
+	setSeconds("node_down_timeout", &s.config.NodeDownTimeout, cc.NodeDownTimeout)
+	setSeconds("node_recovery_period", &s.config.NodeRecoveryPeriod, cc.NodeRecoveryPeriod)
+	setString("token_key_path", &s.config.TokenKeyPath, cc.TokenKeyPath)
+	setSeconds("token_expiry", &s.config.TokenExpiry, cc.TokenExpiry)
+	setInt("api_write_rate", &s.config.APIWriteRate, cc.APIWriteRate)
+	setInt("api_write_burst", &s.config.APIWriteBurst, cc.APIWriteBurst)
+	setInt("api_read_rate", &s.config.APIReadRate, cc.APIReadRate)
+	setInt("api_read_burst", &s.config.APIReadBurst, cc.APIReadBurst)
+
+	return s
+}
+
+// flagConfigSource returns the settings given explicitly on the command
+// line.  Flags left at their default values are not considered to be set.
+func flagConfigSource(fs *flag.FlagSet) (configSource, error) {
+	s := configSource{set: make(map[string]bool)}
+
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(&s.config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fields[configKey(v.Type().Field(i))] = v.Field(i)
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		field, ok := fields[f.Name]
+		if !ok || err != nil {
+			return
+		}
+
+		err = setConfigField(field, f.Value.String())
+		if err != nil {
+			err = errors.Wrapf(err, "Invalid value for flag %s", f.Name)
+			return
+		}
+		s.set[f.Name] = true
+	})
+
+	return s, err
+}
+
+func setConfigField(field reflect.Value, val string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Int:
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("Unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+// resolveConfig merges the sources, which must be given in increasing
+// order of precedence.
+func resolveConfig(sources ...configSource) controllerConfig {
+	var c controllerConfig
+
+	dst := reflect.ValueOf(&c).Elem()
+	for _, s := range sources {
+		src := reflect.ValueOf(s.config)
+		for i := 0; i < dst.NumField(); i++ {
+			if s.set[configKey(dst.Type().Field(i))] {
+				dst.Field(i).Set(src.Field(i))
+			}
+		}
+	}
+
+	return c
+}
+
+// configChange describes a setting whose value differs between two
+// configurations.
+type configChange struct {
+	key      string
+	old      interface{}
+	new      interface{}
+	reloaded bool
+}
+
+func (c configChange) String() string {
+	return fmt.Sprintf("%s changed from %v to %v", c.key, c.old, c.new)
+}
+
+// diffConfig returns the settings which differ between old and new.
+func diffConfig(old controllerConfig, new controllerConfig) []configChange {
+	var changes []configChange
+
+	o := reflect.ValueOf(old)
+	n := reflect.ValueOf(new)
+	for i := 0; i < o.NumField(); i++ {
+		if reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+
+		f := o.Type().Field(i)
+		changes = append(changes, configChange{
+			key:      configKey(f),
+			old:      o.Field(i).Interface(),
+			new:      n.Field(i).Interface(),
+			reloaded: f.Tag.Get("reload") == "true",
+		})
+	}
+
+	return changes
+}
+
+// configLoader keeps track of the configuration sources so that the
+// configuration file can be re-read while preserving the precedence of the
+// other sources.
+type configLoader struct {
+	sync.Mutex
+	path    string
+	flags   configSource
+	file    configSource
+	cluster configSource
+	current controllerConfig
+}
+
+// newConfigLoader reads the configuration file at path and resolves it
+// together with the command line flags in fs and the defaults.
+func newConfigLoader(path string, fs *flag.FlagSet) (*configLoader, error) {
+	flags, err := flagConfigSource(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fileConfigSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &configLoader{
+		path:    path,
+		flags:   flags,
+		file:    file,
+		cluster: configSource{set: make(map[string]bool)},
+	}
+
+	l.current = l.resolve()
+	if err := l.current.validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid configuration")
+	}
+
+	return l, nil
+}
+
+func (l *configLoader) resolve() controllerConfig {
+	return resolveConfig(defaultConfigSource(), l.cluster, l.file, l.flags)
+}
+
+// config returns the current configuration, or the defaults if there is
+// no loader.
+func (l *configLoader) config() controllerConfig {
+	if l == nil {
+		return defaultConfig()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.current
+}
+
+// setConfig replaces the current configuration.  The loader is changed in
+// place as the configuration is read concurrently by the API servers.
+func (l *configLoader) setConfig(c controllerConfig) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.current = c
+}
+
+// setClusterConfig adds the settings from the cluster configuration.
+func (l *configLoader) setClusterConfig(clusterConfig payloads.Configure) (controllerConfig, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.cluster = clusterConfigSource(clusterConfig)
+	c := l.resolve()
+	if err := c.validate(); err != nil {
+		return l.current, errors.Wrap(err, "Invalid configuration")
+	}
+	l.current = c
+
+	return l.current, nil
+}
+
+// reload re-reads the configuration file and applies the changes to the
+// settings which can be reloaded.  The changes to all settings are
+// returned so that those which require a restart can be reported.  If the
+// file cannot be read or is invalid the current configuration is kept.
+func (l *configLoader) reload() (controllerConfig, []configChange, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	file, err := fileConfigSource(l.path)
+	if err != nil {
+		return l.current, nil, err
+	}
+
+	saved := l.file
+	l.file = file
+	c := l.resolve()
+	if err := c.validate(); err != nil {
+		l.file = saved
+		return l.current, nil, errors.Wrap(err, "Invalid configuration")
+	}
+
+	changes := l.update(c)
+
+	return l.current, changes, nil
+}
+
+// updateClusterConfig replaces the settings from the cluster configuration
+// and applies the changes to the settings which can be reloaded, in the
+// same way as reload.  If the new cluster configuration is invalid the
+// current configuration is kept.
+func (l *configLoader) updateClusterConfig(clusterConfig payloads.Configure) (controllerConfig, []configChange, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	saved := l.cluster
+	l.cluster = clusterConfigSource(clusterConfig)
+	c := l.resolve()
+	if err := c.validate(); err != nil {
+		l.cluster = saved
+		return l.current, nil, errors.Wrap(err, "Invalid configuration")
+	}
+
+	changes := l.update(c)
+
+	return l.current, changes, nil
+}
+
+// update copies the settings which can be reloaded from c into the current
+// configuration and returns the changes to all settings.  The caller must
+// hold the loader's lock.
+func (l *configLoader) update(c controllerConfig) []configChange {
+	changes := diffConfig(l.current, c)
+
+	cur := reflect.ValueOf(&l.current).Elem()
+	n := reflect.ValueOf(c)
+	for i := 0; i < cur.NumField(); i++ {
+		if cur.Type().Field(i).Tag.Get("reload") == "true" {
+			cur.Field(i).Set(n.Field(i))
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/payloads"
+)
+
+func writeTestConfig(t *testing.T, path string, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("ceph_id", "", "")
+	fs.String("url", "", "")
+	fs.Int("log_verbosity", 0, "")
+	fs.Duration("connect_timeout", 0, "")
+	fs.Bool("unrelated", false, "")
+
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "controller.yaml")
+	writeTestConfig(t, path, `
+ceph_id: file
+connect_timeout: 1m
+api_port: 9999
+cnci_mem: 1024
+webhook_backoff: 5s
+db_maintenance: false
+`)
+
+	l, err := newConfigLoader(path, testFlagSet(t, "-ceph_id", "flag", "-connect_timeout", "30s", "-unrelated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clusterConfig payloads.Configure
+	clusterConfig.Configure.Storage.CephID = "cluster"
+	clusterConfig.Configure.Controller.CiaoPort = 8889
+	clusterConfig.Configure.Controller.CNCIMem = 512
+	clusterConfig.Configure.Controller.CNCIDisk = 4096
+	clusterConfig.Configure.Controller.NodeDownTimeout = 300
+	clusterConfig.Configure.Controller.APIHostname = "ciao.example.com"
+	clusterConfig.Configure.Controller.TokenExpiry = 600
+
+	cfg, err := l.setClusterConfig(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := defaultConfig()
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"flag over file and cluster", cfg.CephID, "flag"},
+		{"flag over file", cfg.ConnectTimeout, 30 * time.Second},
+		{"file over cluster", cfg.APIPort, 9999},
+		{"file over cluster", cfg.CNCIMem, 1024},
+		{"file over default", cfg.WebhookBackoff, 5 * time.Second},
+		{"file over default", cfg.DBMaintenance, false},
+		{"cluster over default", cfg.CNCIDisk, 4096},
+		{"cluster over default", cfg.NodeDownTimeout, 5 * time.Minute},
+		{"cluster over default", cfg.APIHostname, "ciao.example.com"},
+		{"cluster over default", cfg.TokenExpiry, 10 * time.Minute},
+		{"default", cfg.CNCIVcpus, defaults.CNCIVcpus},
+		{"default", cfg.WorkloadsPath, defaults.WorkloadsPath},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []string{
+		"no_such_setting: 1\n",
+		"log_format: xml\n",
+		"connect_timeout: 0s\n",
+		"cnci_net: not-an-ip\n",
+		"tenant_ip_allocation: first-fit\n",
+		"webhook_max_attempts: 0\n",
+		"node_down_timeout: 10s\n",
+		"metrics_addr: localhost\n",
+		"metrics_max_tenants: 0\n",
+		"quota_denial_window: 10s\n",
+		"db_maintenance_interval: 1s\n",
+		"operation_retention: 0s\n",
+		"idempotency_retention: -1h\n",
+		"stats_retention: 0s\n",
+		"signed_url_expiry: 0s\n",
+		"token_expiry: 0s\n",
+		"signed_url_resources: operation,console\n",
+		"usage_sample_interval: -5m\n",
+		"usage_sample_retention: 0s\n",
+		"api_port: [1, 2]\n",
+		"api_name_order: san_dns,subject\n",
+		"cert_role_attribute: cn\n",
+		"api_body_limit_kb: 0\n",
+		"api_write_burst: 0\n",
+		"api_read_rate: -1\n",
+		"audit_retention: 0s\n",
+		"audit_body_limit_kb: -1\n",
+	}
+
+	for _, data := range tests {
+		s, err := parseConfigSource([]byte(data))
+		if err == nil {
+			cfg := resolveConfig(defaultConfigSource(), s)
+			err = cfg.validate()
+		}
+
+		if err == nil {
+			t.Errorf("Expected error for configuration %q", data)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "controller.yaml")
+	writeTestConfig(t, path, `
+log_verbosity: 1
+webhook_max_attempts: 3
+ceph_id: file
+`)
+
+	l, err := newConfigLoader(path, testFlagSet(t, "-log_verbosity", "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestConfig(t, path, `
+log_verbosity: 2
+webhook_max_attempts: 10
+ceph_id: changed
+`)
+
+	cfg, changes, err := l.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.WebhookMaxAttempts != 10 {
+		t.Errorf("webhook_max_attempts not reloaded: %d", cfg.WebhookMaxAttempts)
+	}
+
+	if cfg.LogVerbosity != 4 {
+		t.Errorf("log_verbosity flag overridden by file: %d", cfg.LogVerbosity)
+	}
+
+	if cfg.CephID != "file" {
+		t.Errorf("ceph_id should not be reloaded: %s", cfg.CephID)
+	}
+
+	reloaded := map[string]bool{}
+	for _, c := range changes {
+		reloaded[c.key] = c.reloaded
+	}
+
+	if len(changes) != 2 || !reloaded["webhook_max_attempts"] ||
+		reloaded["ceph_id"] {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+
+	writeTestConfig(t, path, "webhook_max_attempts: -1\n")
+
+	_, _, err = l.reload()
+	if err == nil {
+		t.Fatal("Expected invalid configuration to be rejected")
+	}
+
+	if l.config().WebhookMaxAttempts != 10 {
+		t.Errorf("Previous configuration not kept: %+v", l.config())
+	}
+
+	writeTestConfig(t, path, "log_verbosity: 2\n")
+
+	cfg, _, err = l.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.WebhookMaxAttempts != defaultConfig().WebhookMaxAttempts {
+		t.Errorf("Removed setting did not revert to default: %d", cfg.WebhookMaxAttempts)
+	}
+}
+
+func TestConfigUpdateCluster(t *testing.T) {
+	l, err := newConfigLoader("", testFlagSet(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clusterConfig payloads.Configure
+	clusterConfig.Configure.Controller.CNCIVcpus = 2
+	clusterConfig.Configure.Controller.CNCINet = "192.168.0.0"
+
+	_, err = l.setClusterConfig(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterConfig.Configure.Controller.CNCIVcpus = 8
+	clusterConfig.Configure.Controller.AdminSSHKey = "ssh-rsa key"
+	clusterConfig.Configure.Controller.CNCINet = "10.0.0.0"
+
+	cfg, changes, err := l.updateClusterConfig(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.CNCIVcpus != 8 || cfg.AdminSSHKey != "ssh-rsa key" {
+		t.Errorf("Cluster configuration not updated: %+v", cfg)
+	}
+
+	if cfg.CNCINet != "192.168.0.0" {
+		t.Errorf("cnci_net should not be updated: %s", cfg.CNCINet)
+	}
+
+	reloaded := map[string]bool{}
+	for _, c := range changes {
+		reloaded[c.key] = c.reloaded
+	}
+
+	if len(changes) != 3 || !reloaded["cnci_vcpus"] || !reloaded["admin_ssh_key"] ||
+		reloaded["cnci_net"] {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+
+	clusterConfig.Configure.Controller.CNCIVcpus = -1
+
+	_, _, err = l.updateClusterConfig(clusterConfig)
+	if err == nil {
+		t.Fatal("Expected invalid configuration to be rejected")
+	}
+
+	if l.config().CNCIVcpus != 8 {
+		t.Errorf("Previous configuration not kept: %+v", l.config())
+	}
+}
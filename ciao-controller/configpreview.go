@@ -0,0 +1,238 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces the secrets in instance configurations which are
+// logged or previewed.
+const redactedValue = "<redacted>"
+
+// secretKeyRegexp matches the YAML and JSON keys whose values are secrets,
+// e.g. "password: hunter2" or "api_token": "abc".
+var secretKeyRegexp = regexp.MustCompile(`(?im)^([ \t]*-?[ \t]*"?[\w.-]*(?:passw(?:or)?d|secret|token|private_key|api_key)[\w.-]*"?[ \t]*[:=][ \t]*)(\S.*)$`)
+
+// privateKeyRegexp matches PEM encoded private keys.
+var privateKeyRegexp = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+// redactConfig replaces the secrets in an instance configuration, or one of
+// its documents, with redactedValue.
+func redactConfig(config string) string {
+	config = privateKeyRegexp.ReplaceAllString(config, redactedValue)
+	return secretKeyRegexp.ReplaceAllStringFunc(config, func(line string) string {
+		m := secretKeyRegexp.FindStringSubmatch(line)
+
+		// flags such as lock-passwd are not secrets
+		switch strings.ToLower(strings.Trim(m[2], `",`)) {
+		case "true", "false":
+			return line
+		}
+
+		return m[1] + redactedValue
+	})
+}
+
+// diffLines returns the lines of a and b, prefixed with "-" if they are only
+// in a, "+" if they are only in b and " " if they are in both.
+func diffLines(a string, b string) []string {
+	x := strings.SplitAfter(a, "\n")
+	y := strings.SplitAfter(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	add := func(prefix string, line string) {
+		if line != "" {
+			lines = append(lines, prefix+strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			add(" ", x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add("-", x[i])
+			i++
+		default:
+			add("+", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		add("-", x[i])
+	}
+	for ; j < len(y); j++ {
+		add("+", y[j])
+	}
+
+	return lines
+}
+
+// PreviewWorkloadConfig renders the configuration an instance of a workload
+// would be started with, using the same renderer as a launch but without
+// allocating any resources.  The addresses and volumes which would be
+// allocated to a new instance are left empty.  If the request names an
+// instance the configuration is rendered with the instance's identity and
+// resources and compared with the configuration it was started with.
+func (c *controller) PreviewWorkloadConfig(tenantID string, workloadID string, req types.ConfigPreviewRequest) (types.ConfigPreview, error) {
+	wl, err := c.ShowWorkload(tenantID, workloadID)
+	if err != nil {
+		return types.ConfigPreview{}, err
+	}
+
+	wl, err = applyOverrides(wl, types.RequirementOverrides{
+		VCPUs:  req.VCPUs,
+		MemMB:  req.MemMB,
+		DiskGB: req.DiskGB,
+	})
+	if err != nil {
+		return types.ConfigPreview{}, err
+	}
+
+	instanceTenant := tenantID
+	if tenantID == "admin" {
+		instanceTenant = wl.TenantID
+	}
+
+	var instanceID string
+	var networking payloads.NetworkResources
+	extra := make([]payloads.NetworkResources, len(wl.Networks))
+	var storage, volumes []payloads.StorageResource
+	var launched renderedConfig
+	name := req.Name
+	p := placement{preferred: c.preferredNodes(instanceTenant, &wl)}
+
+	if req.InstanceID != "" {
+		var i *types.Instance
+		if tenantID == "admin" {
+			i, err = c.ds.GetInstance(req.InstanceID)
+		} else {
+			i, err = c.ds.GetTenantInstance(tenantID, req.InstanceID)
+		}
+		if err != nil {
+			return types.ConfigPreview{}, types.ErrInstanceNotFound
+		}
+
+		config, err := c.ds.GetLaunchConfig(i.ID)
+		if err != nil {
+			return types.ConfigPreview{}, err
+		}
+
+		launched, err = splitConfig(config)
+		if err != nil {
+			return types.ConfigPreview{}, err
+		}
+
+		var sc payloads.Start
+		err = yaml.Unmarshal([]byte(launched.start), &sc)
+		if err != nil {
+			return types.ConfigPreview{}, errors.Wrap(err, "Error parsing instance configuration")
+		}
+
+		instanceID = i.ID
+		instanceTenant = i.TenantID
+		networking = sc.Start.Networking
+		extra = sc.Start.ExtraNetworking
+		volumes = sc.Start.Storage
+		p = placement{preferred: sc.Start.PreferredNodes, avoid: sc.Start.AvoidNodes}
+		if name == "" {
+			name = i.Name
+		}
+
+		if i.UserData != "" {
+			wl.Config, err = mergeUserData(wl.Config, i.UserData)
+			if err != nil {
+				return types.ConfigPreview{}, err
+			}
+		}
+	}
+
+	// the volumes created for the instance previewed stand in for those
+	// which would be created for a new instance.
+	for k, i := range bootOrder(wl.Storage) {
+		var volumeID string
+		if k < len(volumes) {
+			volumeID = volumes[k].ID
+		}
+		storage = append(storage, workloadStorage(wl.Storage[i], volumeID))
+	}
+
+	_, rendered, err := renderConfig(&wl, instanceID, instanceTenant, name, networking, extra, storage, p)
+	if err != nil {
+		return types.ConfigPreview{}, err
+	}
+
+	preview := types.ConfigPreview{
+		WorkloadID: wl.ID,
+		InstanceID: instanceID,
+		MetaData:   redactConfig(rendered.metaData),
+		CloudInit:  redactConfig(rendered.cloudInit),
+		Start:      redactConfig(rendered.start),
+	}
+
+	if instanceID == "" {
+		return preview, nil
+	}
+
+	documents := []struct {
+		name    string
+		before  string
+		preview string
+	}{
+		{"meta_data", launched.metaData, preview.MetaData},
+		{"cloud_init", launched.cloudInit, preview.CloudInit},
+		{"start", launched.start, preview.Start},
+	}
+
+	for _, d := range documents {
+		before := redactConfig(d.before)
+		if before != d.preview {
+			preview.Diff = append(preview.Diff, types.ConfigDiff{
+				Document: d.name,
+				Lines:    diffLines(before, d.preview),
+			})
+		}
+	}
+
+	return preview, nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// consoleLogTimeout bounds the time spent waiting for a node to report the
+// console log of an instance.
+var consoleLogTimeout = 10 * time.Second
+
+// consoleLogRequests routes the console logs reported by the nodes to the
+// API requests waiting for them.  Several requests may wait for the
+// console log of the same instance, each with its own length, so the
+// requests are identified by the request ID echoed in the reports.
+type consoleLogRequests struct {
+	lock    sync.Mutex
+	pending map[string]consoleLogWaiter
+}
+
+type consoleLogWaiter struct {
+	instanceID string
+	ch         chan payloads.ConsoleLogReportEvent
+}
+
+// add registers a request for the console log of an instance and returns
+// the ID to send with it and the channel on which the report is delivered.
+func (r *consoleLogRequests) add(instanceID string) (string, chan payloads.ConsoleLogReportEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]consoleLogWaiter)
+	}
+
+	requestID := uuid.Generate().String()
+	ch := make(chan payloads.ConsoleLogReportEvent, 1)
+	r.pending[requestID] = consoleLogWaiter{instanceID: instanceID, ch: ch}
+
+	return requestID, ch
+}
+
+func (r *consoleLogRequests) remove(requestID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, requestID)
+}
+
+// deliver passes report on to the request it answers.  It returns false if
+// no such request for the console log of the instance is waiting.
+func (r *consoleLogRequests) deliver(report payloads.ConsoleLogReportEvent) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w, ok := r.pending[report.RequestID]
+	if !ok || w.instanceID != report.InstanceUUID {
+		return false
+	}
+
+	select {
+	case w.ch <- report:
+	default:
+	}
+
+	return true
+}
+
+// ShowConsoleLog asks the node running an instance for the last length
+// lines written by the instance to its serial console.  Pending instances
+// have not been started on a node and have no console log yet.
+func (c *controller) ShowConsoleLog(tenantID string, instanceID string, length int) (types.ConsoleLog, error) {
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return types.ConsoleLog{}, err
+	}
+
+	if i.TenantID != tenantID {
+		return types.ConsoleLog{}, types.ErrInstanceNotFound
+	}
+
+	if i.State == payloads.Pending || i.NodeID == "" {
+		return types.ConsoleLog{}, types.ErrInstancePending
+	}
+
+	log := clogger.With(c.log, "tenant", i.TenantID, "instance", i.ID)
+
+	requestID, ch := c.consoleLogs.add(i.ID)
+	defer c.consoleLogs.remove(requestID)
+
+	err = c.client.consoleLog(i.ID, i.NodeID, requestID, length)
+	if err != nil {
+		log.Warningf("Unable to request console log from node %s: %v", i.NodeID, err)
+		return types.ConsoleLog{}, types.ErrConsoleLogUnavailable
+	}
+
+	select {
+	case report := <-ch:
+		if report.Reason != "" {
+			log.Warningf("Node %s unable to read console log: %s", report.NodeUUID, report.Reason)
+			return types.ConsoleLog{}, types.ErrConsoleLogUnavailable
+		}
+
+		lines := report.Lines
+		if lines == nil {
+			lines = []string{}
+		}
+
+		return types.ConsoleLog{
+			InstanceID: i.ID,
+			Lines:      lines,
+		}, nil
+	case <-time.After(consoleLogTimeout):
+		log.Warningf("Timed out waiting for console log from node %s", i.NodeID)
+		return types.ConsoleLog{}, types.ErrConsoleLogUnavailable
+	}
+}
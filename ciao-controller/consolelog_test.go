@@ -0,0 +1,177 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func TestShowConsoleLog(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+	sendStatsCmd(client, t)
+
+	i := instances[0]
+	client.ConsoleLog = []string{
+		"[    0.000000] Linux version 4.4.0-21-generic",
+		"Ubuntu 16.04 LTS ciao ttyS0",
+		"ciao login: ",
+	}
+
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/consolelog?length=2"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var log types.ConsoleLog
+	err := json.Unmarshal(body, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if log.InstanceID != i.ID || len(log.Lines) != 2 ||
+		log.Lines[0] != client.ConsoleLog[1] || log.Lines[1] != client.ConsoleLog[2] {
+		t.Fatalf("Unexpected console log %+v", log)
+	}
+
+	// the instance is not visible to other tenants
+	_, err = ctl.ShowConsoleLog(uuid.Generate().String(), i.ID, 2)
+	if err != types.ErrInstanceNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+}
+
+func TestShowConsoleLogConcurrent(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+	sendStatsCmd(client, t)
+
+	i := instances[0]
+	client.ConsoleLog = []string{"one", "two", "three", "four"}
+
+	var wg sync.WaitGroup
+	for length := 1; length <= len(client.ConsoleLog); length++ {
+		wg.Add(1)
+		go func(length int) {
+			defer wg.Done()
+
+			log, err := ctl.ShowConsoleLog(i.TenantID, i.ID, length)
+			if err != nil {
+				t.Errorf("length %d: %v", length, err)
+				return
+			}
+
+			if len(log.Lines) != length {
+				t.Errorf("length %d: got %d lines %v", length, len(log.Lines), log.Lines)
+			}
+		}(length)
+	}
+	wg.Wait()
+}
+
+func TestConsoleLogRequestsDeliver(t *testing.T) {
+	var r consoleLogRequests
+
+	instanceID := uuid.Generate().String()
+	firstID, first := r.add(instanceID)
+	secondID, second := r.add(instanceID)
+	defer r.remove(firstID)
+	defer r.remove(secondID)
+
+	report := payloads.ConsoleLogReportEvent{
+		InstanceUUID: instanceID,
+		RequestID:    secondID,
+		Lines:        []string{"ciao login: "},
+	}
+	if !r.deliver(report) {
+		t.Fatal("Report not delivered")
+	}
+
+	select {
+	case <-first:
+		t.Error("Report delivered to the wrong request")
+	default:
+	}
+
+	select {
+	case got := <-second:
+		if got.RequestID != secondID {
+			t.Errorf("Unexpected report %+v", got)
+		}
+	default:
+		t.Error("Report not delivered to its request")
+	}
+
+	// reports must match both the request and the instance
+	report.InstanceUUID = uuid.Generate().String()
+	if r.deliver(report) {
+		t.Error("Report for another instance delivered")
+	}
+
+	report.InstanceUUID = instanceID
+	report.RequestID = uuid.Generate().String()
+	if r.deliver(report) {
+		t.Error("Report for an unknown request delivered")
+	}
+}
+
+func TestShowConsoleLogFailure(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+	sendStatsCmd(client, t)
+
+	client.ConsoleLogFailReason = "No console log available"
+
+	i := instances[0]
+	_, err := ctl.ShowConsoleLog(i.TenantID, i.ID, 10)
+	if err != types.ErrConsoleLogUnavailable {
+		t.Fatalf("Expected %v, got %v", types.ErrConsoleLogUnavailable, err)
+	}
+}
+
+func TestShowConsoleLogPending(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenant.ID,
+		MACAddress: uuid.Generate().String(),
+		State:      payloads.Pending,
+		CreateTime: time.Now(),
+	}
+	if err := ctl.ds.AddInstance(context.Background(), i); err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/consolelog"
+	_ = testHTTPRequest(t, "GET", url, http.StatusConflict, nil, true)
+}
@@ -17,14 +17,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
-	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -34,11 +38,15 @@ import (
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/ciao-controller/utils"
 	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/osprepare"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
 	"github.com/ciao-project/ciao/testutil"
 	"github.com/ciao-project/ciao/uuid"
 	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
 )
 
 func addTestWorkload(tenantID string) error {
@@ -91,7 +99,7 @@ func addFakeCNCI(tenant *types.Tenant) (*types.Instance, error) {
 		Subnet:     "172.16.0.0/24",
 	}
 
-	return &CNCI, ctl.ds.AddInstance(&CNCI)
+	return &CNCI, ctl.ds.AddInstance(context.Background(), &CNCI)
 }
 
 func addTestTenant() (tenant *types.Tenant, err error) {
@@ -197,7 +205,7 @@ func BenchmarkStartSingleWorkload(b *testing.B) {
 			TenantID:   tenant.ID,
 			Instances:  1,
 		}
-		_, err = ctl.startWorkload(w)
+		_, err = ctl.startWorkload(context.Background(), w)
 		if err != nil {
 			b.Error(err)
 		}
@@ -225,7 +233,7 @@ func BenchmarkStart1000Workload(b *testing.B) {
 			TenantID:   tenant.ID,
 			Instances:  1000,
 		}
-		_, err = ctl.startWorkload(w)
+		_, err = ctl.startWorkload(context.Background(), w)
 		if err != nil {
 			b.Error(err)
 		}
@@ -252,7 +260,7 @@ func BenchmarkNewConfig(b *testing.B) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		_, err := newConfig(ctl, &wls[0], id.String(), tenant.ID, fmt.Sprintf("test-%d", n), ip)
+		_, err := newConfig(context.Background(), ctl, &wls[0], id.String(), tenant.ID, fmt.Sprintf("test-%d", n), ip, placement{})
 		if err != nil {
 			b.Error(err)
 		}
@@ -283,7 +291,7 @@ func TestTenantWithinBounds(t *testing.T) {
 		TenantID:   tenant.ID,
 		Instances:  1,
 	}
-	_, err = ctl.startWorkload(w)
+	_, err = ctl.startWorkload(context.Background(), w)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -319,7 +327,7 @@ func TestTenantOutOfBounds(t *testing.T) {
 		TenantID:   tenant.ID,
 		Instances:  2,
 	}
-	_, err = ctl.startWorkload(w)
+	_, err = ctl.startWorkload(context.Background(), w)
 	if err == nil {
 		t.Errorf("Not tracking limits correctly")
 	}
@@ -346,7 +354,7 @@ func TestNamedWorkload(t *testing.T) {
 		t.Errorf("Expected one instance created")
 	}
 
-	sds, err := ctl.ListServersDetail(instances[0].TenantID)
+	sds, _, err := ctl.ListServersDetail(instances[0].TenantID, types.InstanceFilter{}, types.ListFilter{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -360,6 +368,72 @@ func TestNamedWorkload(t *testing.T) {
 	}
 }
 
+func TestMultiNICInstance(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatalf("unable to get workload: %v", err)
+	}
+
+	wl := wls[0]
+	wl.Networks = []types.NetworkRequirement{
+		{Subnet: "172.16.0.0/24"},
+		{},
+	}
+
+	IP, err := ctl.ds.AllocateTenantIP(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := newInstance(context.Background(), ctl, tenant.ID, &wl, "", "", IP, placement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := i.newConfig.sc.Start.ExtraNetworking
+	if len(i.NICs) != 2 || len(extra) != 2 {
+		t.Fatalf("Expected 2 extra NICs, got %v and %v", i.NICs, extra)
+	}
+
+	seen := map[string]bool{i.IPAddress: true}
+	for k, nic := range i.NICs {
+		if seen[nic.IPAddress] {
+			t.Fatalf("Address %s allocated twice", nic.IPAddress)
+		}
+		seen[nic.IPAddress] = true
+
+		if extra[k].PrivateIP != nic.IPAddress || extra[k].VnicUUID != nic.VnicUUID ||
+			extra[k].VnicMAC != nic.MACAddress || extra[k].VnicUUID == i.VnicUUID {
+			t.Fatalf("NIC %v does not match its configuration %v", nic, extra[k])
+		}
+	}
+
+	subnets, err := ctl.ds.TenantSubnets(tenant.ID)
+	if err != nil || len(subnets) != 1 || subnets[0].Used != 3 {
+		t.Fatalf("Expected 3 addresses in use, got %v: %v", subnets, err)
+	}
+
+	ok, err := i.Allowed()
+	if err != nil || !ok {
+		t.Fatalf("Instance not allowed: %v", err)
+	}
+
+	err = i.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnets, err = ctl.ds.TenantSubnets(tenant.ID)
+	if err != nil || len(subnets) != 0 {
+		t.Fatalf("Expected all addresses released, got %v: %v", subnets, err)
+	}
+}
+
 func TestStartTracedWorkload(t *testing.T) {
 	client := testStartTracedWorkload(t)
 	defer client.Shutdown()
@@ -411,7 +485,7 @@ func TestDeleteInstance(t *testing.T) {
 
 	serverCh := server.AddCmdChan(ssntp.DELETE)
 
-	err := ctl.deleteInstance(instances[0].ID)
+	err := ctl.deleteInstance(context.Background(), instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -546,6 +620,115 @@ func TestRestoreNode(t *testing.T) {
 	}
 }
 
+func nodeMaintenanceFlag(nodeID string) bool {
+	for _, node := range ctl.ds.GetNodeLastStats().Nodes {
+		if node.ID == nodeID {
+			return node.Maintenance
+		}
+	}
+	return false
+}
+
+func TestSetNodeStatus(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	if _, err := ctl.SetNodeStatus(client.UUID, types.NodeStatusFull, false); err != types.ErrBadNodeStatus {
+		t.Fatalf("Expected ErrBadNodeStatus: %v", err)
+	}
+
+	if _, err := ctl.SetNodeStatus(client.UUID, types.NodeStatusReady, true); err != types.ErrBadNodeStatus {
+		t.Fatalf("Expected ErrBadNodeStatus: %v", err)
+	}
+
+	if _, err := ctl.SetNodeStatus(uuid.Generate().String(), types.NodeStatusMaintenance, false); err != types.ErrNodeNotFound {
+		t.Fatalf("Expected ErrNodeNotFound: %v", err)
+	}
+
+	// other tests leave instances running on the node
+	running, err := ctl.ds.GetAllInstancesByNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCh := server.AddEventChan(ssntp.NodeMaintenance)
+	clientCh := client.AddCmdChan(ssntp.DELETE)
+
+	op, err := ctl.SetNodeStatus(client.UUID, types.NodeStatusMaintenance, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = ctl.SetNodeStatus(client.UUID, types.NodeStatusReady, false)
+	}()
+
+	result, err := server.GetEventChanResult(serverCh, ssntp.NodeMaintenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != client.UUID {
+		t.Fatal("Did not get node ID")
+	}
+
+	if !ctl.ds.NodeInMaintenance(client.UUID) || !nodeMaintenanceFlag(client.UUID) {
+		t.Fatal("Node not in maintenance")
+	}
+
+	// the running instances are stopped and started again elsewhere
+	_, err = client.GetCmdChanResult(clientCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range running {
+		if i.State != payloads.Running {
+			continue
+		}
+
+		err = sendStopEvent(client, i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Expected evacuation to succeed: %+v", op)
+	}
+
+	_, entries, err := ctl.ds.GetInstanceHistory(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := false
+	for _, e := range entries {
+		restarted = restarted || (e.Type == types.HistoryCommand && e.Message == "restart")
+	}
+	if !restarted {
+		t.Fatal("Instance not restarted")
+	}
+
+	serverCh = server.AddEventChan(ssntp.NodeMaintenance)
+
+	_, err = ctl.SetNodeStatus(client.UUID, types.NodeStatusReady, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetEventChanResult(serverCh, ssntp.NodeMaintenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctl.ds.NodeInMaintenance(client.UUID) || nodeMaintenanceFlag(client.UUID) {
+		t.Fatal("Node still in maintenance")
+	}
+}
+
 func TestAttachVolume(t *testing.T) {
 	client, err := testutil.NewSsntpTestClientConnection("AttachVolume", ssntp.AGENT, testutil.AgentUUID)
 	if err != nil {
@@ -557,7 +740,7 @@ func TestAttachVolume(t *testing.T) {
 
 	// ok to not send workload first?
 
-	err = ctl.client.attachVolume("volID", "instanceID", client.UUID)
+	err = ctl.client.attachVolume("volID", "instanceID", client.UUID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -581,7 +764,7 @@ func TestAttachVolume(t *testing.T) {
 }
 
 func addTestBlockDevice(t *testing.T, tenantID string) types.Volume {
-	bd, err := ctl.CreateBlockDevice("", "", 0)
+	bd, err := ctl.CreateBlockDevice(context.Background(), "", "", 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -593,9 +776,9 @@ func addTestBlockDevice(t *testing.T, tenantID string) types.Volume {
 		State:       types.Available,
 	}
 
-	err = ctl.ds.AddBlockDevice(data)
+	err = ctl.ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
-		_ = ctl.DeleteBlockDevice(bd.ID)
+		_ = ctl.DeleteBlockDevice(context.Background(), bd.ID)
 		t.Fatal(err)
 	}
 
@@ -631,7 +814,7 @@ func doAttachVolumeCommand(t *testing.T, fail bool) (client *testutil.SsntpTestC
 		}()
 	}
 
-	err := ctl.AttachVolume(tenantID, data.ID, instances[0].ID, "")
+	err := ctl.AttachVolume(context.Background(), tenantID, data.ID, instances[0].ID, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -693,6 +876,59 @@ func TestAttachVolumeFailure(t *testing.T) {
 	client.Ssntp.Close()
 }
 
+func TestAttachVolumeTag(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Ssntp.Close()
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	sendStatsCmd(client, t)
+
+	data := addTestBlockDevice(t, tenantID)
+	other := addTestBlockDevice(t, tenantID)
+
+	err := ctl.AttachVolume(context.Background(), tenantID, other.ID, instanceID, "", "data,serial=x")
+	if err != types.ErrBadVolumeTag {
+		t.Fatalf("Expected %v got %v", types.ErrBadVolumeTag, err)
+	}
+
+	agentCh := client.AddCmdChan(ssntp.AttachVolume)
+
+	err = ctl.AttachVolume(context.Background(), tenantID, data.ID, instanceID, "", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetCmdChanResult(agentCh, ssntp.AttachVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.AttachVolume(context.Background(), tenantID, other.ID, instanceID, "", "data")
+	if err != types.ErrVolumeTagInUse {
+		t.Fatalf("Expected %v got %v", types.ErrVolumeTagInUse, err)
+	}
+
+	sendStatsCmd(client, t)
+
+	s, err := ctl.ShowServerDetails(tenantID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Server.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment got %v", s.Server.Attachments)
+	}
+
+	a := s.Server.Attachments[0]
+	if a.VolumeID != data.ID || a.Tag != "data" || a.Device != "/dev/disk/by-id/virtio-data" {
+		t.Errorf("Unexpected attachment %+v", a)
+	}
+}
+
 func doDetachVolumeCommand(t *testing.T, fail bool) {
 	// attach volume should succeed for this test
 	client, tenantID, volume, instanceID := doAttachVolumeCommand(t, false)
@@ -710,7 +946,7 @@ func doDetachVolumeCommand(t *testing.T, fail bool) {
 	}
 
 	if fail {
-		err := ctl.DetachVolume(tenantID, volume, "")
+		err := ctl.DetachVolume(context.Background(), tenantID, volume, "")
 		if err == nil {
 			t.Fatal("Expected error when detaching volume from active instance")
 
@@ -753,7 +989,7 @@ func doDetachVolumeCommand(t *testing.T, fail bool) {
 			t.Fatal(err)
 		}
 
-		err = ctl.DetachVolume(tenantID, volume, "")
+		err = ctl.DetachVolume(context.Background(), tenantID, volume, "")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -783,7 +1019,7 @@ func TestDetachVolumeByAttachment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = ctl.DetachVolume(tenant.ID, "invalidVolume", "attachmentID")
+	err = ctl.DetachVolume(context.Background(), tenant.ID, "invalidVolume", "attachmentID")
 	if err == nil {
 		t.Fatal("Detach by attachment ID not supported yet")
 	}
@@ -799,7 +1035,7 @@ func TestInstanceDeletedEvent(t *testing.T) {
 
 	serverCh := server.AddCmdChan(ssntp.DELETE)
 
-	err := ctl.deleteInstance(instances[0].ID)
+	err := ctl.deleteInstance(context.Background(), instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -843,6 +1079,120 @@ func TestStartFailure(t *testing.T) {
 	// instance is no longer pending in the database
 }
 
+type testLogEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// testLogger is a CiaoFieldLog that records every message it is given.
+type testLogger struct {
+	entries *[]testLogEntry
+	lock    *sync.Mutex
+	fields  map[string]interface{}
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{
+		entries: &[]testLogEntry{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (l *testLogger) V(level int32) bool {
+	return true
+}
+
+func (l *testLogger) record(level string, format string, v ...interface{}) {
+	l.lock.Lock()
+	*l.entries = append(*l.entries, testLogEntry{
+		level:  level,
+		msg:    fmt.Sprintf(format, v...),
+		fields: l.fields,
+	})
+	l.lock.Unlock()
+}
+
+func (l *testLogger) Infof(format string, v ...interface{}) {
+	l.record("info", format, v...)
+}
+
+func (l *testLogger) Warningf(format string, v ...interface{}) {
+	l.record("warning", format, v...)
+}
+
+func (l *testLogger) Errorf(format string, v ...interface{}) {
+	l.record("error", format, v...)
+}
+
+func (l *testLogger) With(keyvals ...interface{}) clogger.CiaoLog {
+	fields := make(map[string]interface{})
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	return &testLogger{entries: l.entries, lock: l.lock, fields: fields}
+}
+
+func (l *testLogger) getEntries() []testLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]testLogEntry(nil), *l.entries...)
+}
+
+func (l *testLogger) findEntry(level string, fields map[string]interface{}) bool {
+	for _, e := range l.getEntries() {
+		if e.level != level {
+			continue
+		}
+
+		matched := true
+		for k, v := range fields {
+			if e.fields[k] != v {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestStartFailureLogged(t *testing.T) {
+	reason := payloads.FullCloud
+
+	logger := newTestLogger()
+	oldLog := ctl.log
+	ctl.log = logger
+	defer func() { ctl.log = oldLog }()
+
+	client, instances := testStartWorkload(t, 1, true, reason)
+	defer client.Shutdown()
+
+	fields := map[string]interface{}{
+		"instance": instances[0].ID,
+		"reason":   reason.String(),
+	}
+
+	// the failure may be processed by the controller after the agent
+	// has seen it, so allow it some time to show up in the log.
+	timeout := time.After(5 * time.Second)
+	for !logger.findEntry("warning", fields) {
+		select {
+		case <-timeout:
+			t.Fatalf("Start failure of %s not logged with reason %q",
+				instances[0].ID, reason.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func TestStopFailure(t *testing.T) {
 	err := ctl.ds.ClearLog()
 	if err != nil {
@@ -990,7 +1340,7 @@ func testStartTracedWorkload(t *testing.T) *testutil.SsntpTestClient {
 		Instances:  1,
 		TraceLabel: "testtrace",
 	}
-	instances, err := ctl.startWorkload(w)
+	instances, err := ctl.startWorkload(context.Background(), w)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1046,7 +1396,7 @@ func testStartWorkload(t *testing.T, num int, fail bool, reason payloads.StartFa
 		Instances:  num,
 		Name:       "test",
 	}
-	instances, err := ctl.startWorkload(w)
+	instances, err := ctl.startWorkload(context.Background(), w)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1081,7 +1431,7 @@ func startTestWorkload(t *testing.T, instanceCh chan []*types.Instance, workload
 		TenantID:   tenantID,
 		Instances:  num,
 	}
-	instances, err := ctl.startWorkload(w)
+	instances, err := ctl.startWorkload(context.Background(), w)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1096,11 +1446,13 @@ func startTestWorkload(t *testing.T, instanceCh chan []*types.Instance, workload
 func startTenantWorkload(t *testing.T, tenantID string, instanceCh chan []*types.Instance) {
 	wls, err := ctl.ds.GetWorkloads(tenantID)
 	if err != nil {
-		t.Fatal(err)
+		t.Error(err)
+		return
 	}
 
 	if len(wls) == 0 {
-		t.Fatal("No workloads for this tenant")
+		t.Error("No workloads for this tenant")
+		return
 	}
 
 	startTestWorkload(t, instanceCh, wls[0].ID, tenantID, 1)
@@ -1206,7 +1558,7 @@ func TestGetStorageForVolume(t *testing.T) {
 	}
 
 	sourceVolume := addTestBlockDevice(t, tenant.ID)
-	defer func() { _ = ctl.DeleteBlockDevice(sourceVolume.ID) }()
+	defer func() { _ = ctl.DeleteBlockDevice(context.Background(), sourceVolume.ID) }()
 
 	// a temporary in memory filesystem?
 	s := types.StorageResource{
@@ -1217,7 +1569,7 @@ func TestGetStorageForVolume(t *testing.T) {
 		Source:     sourceVolume.ID,
 	}
 
-	pl, err := getStorage(ctl, s, tenant.ID, "")
+	pl, err := getStorage(context.Background(), ctl, s, tenant.ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1251,12 +1603,10 @@ func TestGetStorageForImage(t *testing.T) {
 	}
 
 	// add fake image to images store
-	//
-	tmpfile, err := ioutil.TempFile("", "testImage")
+	image, err := addTestImage(tenant.ID, types.Private)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() { _ = os.Remove(tmpfile.Name()) }()
 
 	// a temporary in memory filesystem?
 	s := types.StorageResource{
@@ -1264,10 +1614,10 @@ func TestGetStorageForImage(t *testing.T) {
 		Bootable:   true,
 		Ephemeral:  false,
 		SourceType: types.ImageService,
-		Source:     filepath.Base(tmpfile.Name()),
+		Source:     image.Name,
 	}
 
-	pl, err := getStorage(ctl, s, tenant.ID, "")
+	pl, err := getStorage(context.Background(), ctl, s, tenant.ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1308,13 +1658,7 @@ func TestStorageConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tmpfile, err := ioutil.TempFile("", "test-image")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = os.Remove(tmpfile.Name()) }()
-
-	info, err := tmpfile.Stat()
+	image, err := addTestImage(tenant.ID, types.Private)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1325,7 +1669,7 @@ func TestStorageConfig(t *testing.T) {
 		Bootable:   true,
 		Ephemeral:  false,
 		SourceType: types.ImageService,
-		Source:     info.Name(),
+		Source:     image.ID,
 	}
 
 	wls[0].Storage = []types.StorageResource{s}
@@ -1334,7 +1678,7 @@ func TestStorageConfig(t *testing.T) {
 
 	ip := net.ParseIP("172.16.0.2")
 
-	_, err = newConfig(ctl, &wls[0], id.String(), tenant.ID, "test", ip)
+	_, err = newConfig(context.Background(), ctl, &wls[0], id.String(), tenant.ID, "test", ip, placement{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1347,7 +1691,7 @@ func createTestVolume(tenantID string, size int, t *testing.T) string {
 		Size: size,
 	}
 
-	vol, err := ctl.CreateVolume(tenantID, req)
+	vol, err := ctl.CreateVolume(context.Background(), tenantID, req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1391,7 +1735,7 @@ func TestCreateImageVolume(t *testing.T) {
 		ImageRef: imageRef,
 	}
 
-	vol, err := ctl.CreateVolume(tenant.ID, req)
+	vol, err := ctl.CreateVolume(context.Background(), tenant.ID, req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1424,7 +1768,7 @@ func TestDeleteVolume(t *testing.T) {
 	}
 
 	// attempt to delete invalid volume
-	err = ctl.DeleteVolume(tenant.ID, "badID")
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, "badID", false)
 	if err != datastore.ErrNoBlockData {
 		t.Fatal("Incorrect error")
 	}
@@ -1436,13 +1780,13 @@ func TestDeleteVolume(t *testing.T) {
 	}
 
 	// attempt to delete with bad tenant ID
-	err = ctl.DeleteVolume(tenant2.ID, volID)
+	err = ctl.DeleteVolume(context.Background(), tenant2.ID, volID, false)
 	if err != api.ErrVolumeOwner {
 		t.Fatal("Incorrect error")
 	}
 
 	// this should work
-	err = ctl.DeleteVolume(tenant.ID, volID)
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, volID, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1501,9 +1845,14 @@ func testAddPool(t *testing.T, name string, subnet *string, ips []string) {
 		t.Fatal("id not set")
 	}
 
+	if pool.CreateTime.IsZero() {
+		t.Fatal("create time not set")
+	}
+
 	expected := types.Pool{
-		ID:   pool.ID,
-		Name: name,
+		ID:         pool.ID,
+		Name:       name,
+		CreateTime: pool.CreateTime,
 	}
 
 	if subnet != nil {
@@ -1562,7 +1911,7 @@ func deletePool(name string) error {
 }
 
 func TestAddPoolWithSubnet(t *testing.T) {
-	subnet := "192.168.0.0/16"
+	subnet := "192.168.0.0/17"
 	testAddPool(t, "test1", &subnet, []string{})
 	err := deletePool("test1")
 	if err != nil {
@@ -1673,6 +2022,84 @@ func TestDeletePool(t *testing.T) {
 	t.Fatal("Could not delete pool")
 }
 
+func TestCheckCNCIOverlap(t *testing.T) {
+	_, cnci, _ := net.ParseCIDR("192.168.128.0/17")
+
+	tests := []struct {
+		name    string
+		subnet  string
+		ips     []string
+		overlap bool
+	}{
+		{"disjoint subnet", "10.3.0.0/24", nil, false},
+		{"cnci subnet", "192.168.0.0/16", nil, true},
+		{"below cnci", "192.168.127.0/24", nil, false},
+		{"cnci address", "", []string{"10.3.0.1", "192.168.128.1"}, true},
+		{"unparsable address", "", []string{"10.1.0"}, false},
+	}
+
+	for _, test := range tests {
+		var subnet *string
+		if test.subnet != "" {
+			subnet = &test.subnet
+		}
+
+		err := checkCNCIOverlap(cnci, subnet, test.ips)
+		if !test.overlap {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+
+		e, ok := err.(*types.RangeOverlapError)
+		if !ok {
+			t.Errorf("%s: expected overlap error, got %v", test.name, err)
+			continue
+		}
+
+		if e.Conflict != cnci.String() || e.Pool != "" {
+			t.Errorf("%s: expected conflict with the CNCI network, got %v", test.name, e)
+		}
+	}
+}
+
+func TestAddPoolOverlap(t *testing.T) {
+	subnet := "10.20.0.0/24"
+	testAddPool(t, "overlap", &subnet, nil)
+	defer func() {
+		err := deletePool("overlap")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	b, err := json.Marshal(types.NewPoolRequest{Name: "overlap2", Subnet: &subnet})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", testutil.ComputeURL+"/pools", http.StatusBadRequest, b, true)
+	if !strings.Contains(string(body), subnet) {
+		t.Fatalf("Conflicting range not named in %s", body)
+	}
+
+	// the rejected pool is not created
+	err = deletePool("overlap2")
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+
+	// nor is one whose own addresses overlap
+	b = []byte(`{"name": "overlap3", "ips": [{"ip": "10.21.0.1"}, {"ip": "10.21.0.1"}]}`)
+	_ = testHTTPRequest(t, "POST", testutil.ComputeURL+"/pools", http.StatusBadRequest, b, true)
+
+	err = deletePool("overlap3")
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
 func TestAddPoolSubnet(t *testing.T) {
 	subnet := "192.168.0.0/24"
 
@@ -1842,7 +2269,7 @@ func TestMapAddress(t *testing.T) {
 		}
 	}
 
-	err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID)
+	err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1866,6 +2293,52 @@ func TestMapAddress(t *testing.T) {
 	}
 }
 
+func TestMapPreferredAddress(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Shutdown()
+
+	poolName := "testmappreferred"
+	testAddPool(t, poolName, nil, []string{"10.10.0.21"})
+
+	err := ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, "10.10.1.21")
+	if err != types.ErrAddressNotInPool {
+		t.Fatalf("Expected %v got %v", types.ErrAddressNotInPool, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(instances))
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ctl.MapAddress(instances[i].TenantID, &poolName, instances[i].ID, "10.10.0.21")
+		}(i)
+	}
+	wg.Wait()
+
+	mapped := 0
+	for _, err := range errs {
+		if err == nil {
+			mapped++
+		} else if _, ok := err.(*types.AddressInUseError); !ok {
+			t.Fatalf("Expected address in use, got %v", err)
+		}
+	}
+	if mapped != 1 {
+		t.Fatalf("Expected the address to be mapped once, mapped %d times", mapped)
+	}
+
+	m, err := ctl.ds.GetMappedIP("10.10.0.21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] == nil && m.InstanceID != instances[0].ID || errs[1] == nil && m.InstanceID != instances[1].ID {
+		t.Fatalf("Address mapped to the wrong instance %s", m.InstanceID)
+	}
+}
+
 func TestMapAddressNoPool(t *testing.T) {
 	var reason payloads.StartFailureReason
 
@@ -1877,7 +2350,7 @@ func TestMapAddressNoPool(t *testing.T) {
 
 	testAddPool(t, poolName, nil, ips)
 
-	err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID)
+	err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1906,6 +2379,109 @@ func TestMapAddressNoPool(t *testing.T) {
 	}
 }
 
+func testListTenantPools(t *testing.T, tenantID string) []types.PoolSummary {
+	url := testutil.ComputeURL + "/" + tenantID + "/pools"
+	body := testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, onBehalfOf(tenantID))
+
+	var resp types.ListPoolsResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Pools
+}
+
+func hasPool(pools []types.PoolSummary, ID string) bool {
+	for _, p := range pools {
+		if p.ID == ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestMapAddressRestrictedPool(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := []string{"10.10.0.3", "10.10.0.4"}
+	poolName := "testrestricted"
+
+	testAddPool(t, poolName, nil, ips)
+
+	var poolID string
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			poolID = pool.ID
+		}
+	}
+
+	err = ctl.SetPoolAccess(poolID, []string{"unknown-tenant"})
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+
+	err = ctl.SetPoolAccess(poolID, []string{tenantID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.MapAddress(tenantID, &poolName, instances[0].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restricting the pool to another tenant leaves the existing
+	// mapping alone but blocks new ones.
+	err = ctl.SetPoolAccess(poolID, []string{other.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappedIPs := ctl.ListMappedAddresses(&tenantID)
+	if len(mappedIPs) != 1 || mappedIPs[0].InstanceID != instances[0].ID {
+		t.Fatalf("Mapped IP lost after restricting pool: %+v", mappedIPs)
+	}
+
+	err = ctl.MapAddress(tenantID, &poolName, instances[0].ID, "")
+	if _, ok := err.(*types.PoolRestrictedError); !ok {
+		t.Fatalf("Expected restricted pool error, got %v", err)
+	}
+
+	if hasPool(testListTenantPools(t, tenantID), poolID) {
+		t.Error("Restricted pool listed for tenant without access")
+	}
+
+	if !hasPool(testListTenantPools(t, other.ID), poolID) {
+		t.Error("Restricted pool not listed for tenant with access")
+	}
+
+	// an empty list makes the pool public again.
+	err = ctl.SetPoolAccess(poolID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasPool(testListTenantPools(t, tenantID), poolID) {
+		t.Error("Public pool not listed")
+	}
+}
+
 func TestListTenants(t *testing.T) {
 	tenants, err := ctl.ds.GetAllTenants()
 	if err != nil {
@@ -2016,12 +2592,12 @@ func TestCreateTenant(t *testing.T) {
 
 	ID := uuid.Generate()
 
-	summary, err := ctl.CreateTenant(ID.String(), config)
+	summary, created, err := ctl.CreateTenant(types.TenantRequest{ID: ID.String(), Config: config})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if summary.Name != "createTenant" || summary.ID != ID.String() {
+	if !created || summary.Name != "createTenant" || summary.ID != ID.String() {
 		t.Fatal(err)
 	}
 
@@ -2038,21 +2614,145 @@ func TestDeleteTenant(t *testing.T) {
 
 	ID := uuid.Generate()
 
-	_, err := ctl.CreateTenant(ID.String(), config)
+	_, _, err := ctl.CreateTenant(types.TenantRequest{ID: ID.String(), Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := deleteTestTenant(t, ID.String(), false)
+	if op.Type != types.DeleteTenantOperation || op.Target != ID.String() {
+		t.Fatalf("Unexpected operation: %+v", op)
+	}
+
+	if tenant, err := ctl.ds.GetTenant(ID.String()); err != nil || tenant != nil {
+		t.Fatalf("Tenant not deleted: %v", err)
+	}
+}
+
+// deleteTestTenant deletes a tenant and waits for the deletion to complete.
+func deleteTestTenant(t *testing.T, tenantID string, force bool) types.Operation {
+	op, err := ctl.DeleteTenant(context.Background(), tenantID, force)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Expected tenant deletion to succeed: %+v", op)
+	}
+
+	return op
+}
+
+func TestDeleteTenantCredentials(t *testing.T) {
+	defer enableTestTokens(t)()
+
+	ID := uuid.Generate().String()
+	req := types.TenantRequest{ID: ID, Config: types.TenantConfig{Name: "deleteTenantCredentials", SubnetBits: 24}}
+
+	if _, _, err := ctl.CreateTenant(req); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := ctl.AddPool("deleteTenantCredentials", nil, []string{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer func() { _ = ctl.DeletePool(pool.ID) }()
+
+	// the tenant may not be deleted while it is the only one allowed to
+	// use the pool
+	if err := ctl.SetPoolAccess(pool.ID, []string{ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl.DeleteTenant(context.Background(), ID, false); errors.Cause(err) != types.ErrTenantOnlyPoolTenant {
+		t.Fatalf("Expected %v, got %v", types.ErrTenantOnlyPoolTenant, err)
+	}
+
+	if err := ctl.SetPoolAccess(pool.ID, []string{ID, other.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	k := createTestAPIKey(t, ID, "instances")
+	token := requestTestToken(t, types.AuthTokenRequest{TenantID: ID}, http.StatusCreated)
+
+	deleteTestTenant(t, ID, false)
+
+	// a tenant created with the same ID inherits nothing
+	if _, _, err := ctl.CreateTenant(req); err != nil {
+		t.Fatal(err)
+	}
+	defer deleteTestTenant(t, ID, false)
+
+	url := testutil.ComputeURL + "/" + ID + "/instances/detail"
+	if status, _ := apiKeyRequest(t, k.Key, "GET", url); status != http.StatusUnauthorized {
+		t.Errorf("Expected API key of deleted tenant to be refused: %d", status)
+	}
+	if status, _ := apiKeyRequest(t, token.Token, "GET", url); status != http.StatusUnauthorized {
+		t.Errorf("Expected token of deleted tenant to be refused: %d", status)
+	}
+
+	if keys, err := ctl.ListAPIKeys(ID); err != nil || len(keys) != 0 {
+		t.Errorf("API keys of deleted tenant kept: %v %v", keys, err)
+	}
 
-	err = ctl.DeleteTenant(ID.String())
+	p, err := ctl.ShowPool(pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if p.Accessible(ID) || !p.Accessible(other.ID) {
+		t.Errorf("Expected pool to be limited to %s: %v", other.ID, p.Tenants)
+	}
+}
+
+func TestDeleteTenantWithInstances(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+
+	_, err := ctl.DeleteTenant(context.Background(), tenantID, false)
+	if err != types.ErrTenantHasInstances {
+		t.Fatalf("Expected %v, got %v", types.ErrTenantHasInstances, err)
+	}
+
+	if _, err := ctl.ds.GetInstance(instances[0].ID); err != nil {
+		t.Fatalf("Instance deleted with tenant: %v", err)
+	}
+}
+
+func TestCheckDepsJSONStdout(t *testing.T) {
+	var buf bytes.Buffer
+	_ = checkDeps(&buf, "-")
+
+	var report osprepare.Report
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Report written to stdout is not JSON: %v\n%s", err, buf.String())
+	}
 }
 
 var ctl *controller
 var server *testutil.SsntpTestServer
 var wrappedClient *ssntpClientWrapper
 
+// setTestConfig changes the configuration of the test controller until the
+// returned function is called.
+func setTestConfig(change func(cfg *controllerConfig)) func() {
+	saved := ctl.config.config()
+	cfg := saved
+	change(&cfg)
+	ctl.config.setConfig(cfg)
+
+	return func() { ctl.config.setConfig(saved) }
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -2060,9 +2760,12 @@ func TestMain(m *testing.M) {
 	server = testutil.StartTestServer()
 
 	ctl = new(controller)
+	ctl.ctx, ctl.stop = context.WithCancel(context.Background())
+	ctl.log = gloginterface.CiaoGlogLogger{}
 	ctl.tenantReadiness = make(map[string]*tenantConfirmMemo)
 	ctl.ds = new(datastore.Datastore)
 	ctl.qs = new(quotas.Quotas)
+	ctl.config = &configLoader{current: defaultConfig()}
 
 	ctl.BlockDriver = func() storage.BlockDriver {
 		return &storage.NoopDriver{}
@@ -2080,9 +2783,16 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	ctl.metrics = newControllerMetrics(defaultConfig().MetricsMaxTenants, defaultConfig().QuotaDenialWindow, time.Now)
+
+	ctl.events = newEventHub()
+
 	dsConfig := datastore.Config{
 		PersistentURI:     "file:memdb1?mode=memory&cache=shared",
 		InitWorkloadsPath: *workloadsPath,
+		EventDropped:      ctl.metrics.eventDropped,
+		EventsLogged:      ctl.events.publishLog,
+		QueryObserved:     ctl.metrics.queryObserved,
 	}
 
 	err = ctl.ds.Init(dsConfig)
@@ -2094,7 +2804,24 @@ func TestMain(m *testing.M) {
 
 	ctl.ds.GenerateCNCIWorkload(4, 128, 128, "")
 
+	// the CNCI boots from an internal image
+	err = ctl.ds.AddImage(types.Image{
+		ID:         "4e16e743-265a-4bf2-9fd1-57ada0b28904",
+		Name:       "cnci",
+		State:      types.Active,
+		Visibility: types.Internal,
+	})
+	if err != nil {
+		_ = f.Close()
+		_ = os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	ctl.webhooks = newWebhookDispatcher(ctl.ds, ctl.events, ctl.log)
+	ctl.webhooks.start()
+
 	ctl.qs.Init()
+	ctl.startQuotaAudit()
 
 	config := &ssntp.Config{
 		URI:    "localhost",
@@ -2107,6 +2834,7 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 	ctl.client = wrappedClient
+	ctl.setActive()
 
 	_, _ = addComputeTestTenant()
 
@@ -2116,12 +2844,14 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	go func() { _ = s.ListenAndServeTLS(httpsCAcert, httpsKey) }()
+	go func() { _ = s.ListenAndServeTLS("", "") }()
 	time.Sleep(1 * time.Second)
 
 	code := m.Run()
 
 	ctl.client.Disconnect()
+	ctl.webhooks.shutdown()
+	ctl.stopQuotaAudit()
 	ctl.ds.Exit()
 	ctl.qs.Shutdown()
 	server.Shutdown()
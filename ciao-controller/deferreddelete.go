@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// deletedInstanceCheckPeriod is how often the instances pending deletion
+// are checked for having reached the end of their grace period.
+const deletedInstanceCheckPeriod = 30 * time.Second
+
+// deletedInstanceState tracks the instances pending deletion which the
+// controller has asked the nodes to delete, so that each is only deleted
+// once and can no longer be restored.
+type deletedInstanceState struct {
+	sync.Mutex
+	deleting map[string]bool
+}
+
+// deferredDeleteGrace returns how long the deleted instances of a tenant
+// are kept before they are deleted, zero if they are deleted immediately.
+func (c *controller) deferredDeleteGrace(tenantID string) time.Duration {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil || tenant == nil {
+		return 0
+	}
+
+	return time.Duration(tenant.DeferredDeleteMinutes) * time.Minute
+}
+
+// deferInstanceDeletion puts an instance into the deleted-pending state
+// until deleteTime.  The instance is left as it is on its node and its
+// resources stay consumed until it is deleted.
+func (c *controller) deferInstanceDeletion(ctx context.Context, i *types.Instance, deleteTime time.Time) error {
+	// an instance with an external IP could not be deleted at the end
+	// of its grace period
+	for _, m := range c.ds.GetMappedIPs(&i.TenantID) {
+		if m.InstanceID == i.ID {
+			return types.ErrInstanceMapped
+		}
+	}
+
+	err := c.ds.DeferInstanceDeletion(ctx, i.ID, deleteTime)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Instance %s will be deleted at %s unless it is restored", i.ID, deleteTime.Format(time.RFC3339))
+	if err := c.ds.LogEvent(i.TenantID, msg); err != nil {
+		c.instanceLog(i).Warningf("Error logging event: %v", err)
+	}
+
+	return nil
+}
+
+// deletePendingInstance asks the nodes to delete an instance pending
+// deletion.  It returns false if the instance is already being deleted or
+// has been restored.
+func (c *controller) deletePendingInstance(ctx context.Context, i *types.Instance) (bool, error) {
+	d := &c.deletedInstances
+	d.Lock()
+	defer d.Unlock()
+
+	if d.deleting[i.ID] || i.State != payloads.DeletePending {
+		return false, nil
+	}
+
+	err := c.deleteInstance(ctx, i.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if d.deleting == nil {
+		d.deleting = make(map[string]bool)
+	}
+	d.deleting[i.ID] = true
+
+	return true, nil
+}
+
+// RestoreServer restores an instance of a tenant which is pending deletion
+// and which the controller has not yet started to delete.
+func (c *controller) RestoreServer(tenant string, ID string) error {
+	i, err := c.ds.GetTenantInstance(tenant, ID)
+	if err != nil {
+		return err
+	}
+
+	d := &c.deletedInstances
+	d.Lock()
+	defer d.Unlock()
+
+	if d.deleting[i.ID] {
+		return types.ErrInstanceChangingState
+	}
+
+	err = c.ds.RestoreInstance(i.ID)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Instance %s restored", i.ID)
+	if err := c.ds.LogEvent(i.TenantID, msg); err != nil {
+		c.instanceLog(i).Warningf("Error logging event: %v", err)
+	}
+
+	return nil
+}
+
+// reapDeletedInstances deletes the instances pending deletion whose grace
+// period has expired by now.  It returns the IDs of the instances it
+// started to delete.
+func (c *controller) reapDeletedInstances(now time.Time) []string {
+	instances, err := c.ds.GetAllInstances()
+	if err != nil {
+		c.log.Warningf("Unable to check instances pending deletion: %v", err)
+		return nil
+	}
+
+	pending := make(map[string]bool)
+	var reaped []string
+	for _, i := range instances {
+		if i.State != payloads.DeletePending {
+			continue
+		}
+
+		pending[i.ID] = true
+		if i.DeleteTime.After(now) {
+			continue
+		}
+
+		deleted, err := c.deletePendingInstance(c.ctx, i)
+		if err != nil {
+			c.instanceLog(i).Warningf("Unable to delete instance pending deletion: %v", err)
+			continue
+		}
+
+		if deleted {
+			reaped = append(reaped, i.ID)
+		}
+	}
+
+	d := &c.deletedInstances
+	d.Lock()
+	for ID := range d.deleting {
+		if !pending[ID] {
+			delete(d.deleting, ID)
+		}
+	}
+	d.Unlock()
+
+	sort.Strings(reaped)
+	return reaped
+}
+
+// watchDeletedInstances periodically deletes the instances whose grace
+// period has expired until the controller is shut down.
+func (c *controller) watchDeletedInstances() {
+	ticker := time.NewTicker(deletedInstanceCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		c.reapDeletedInstances(time.Now())
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestDeferredDelete(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	i := instances[0]
+	err := ctl.PatchTenant(i.TenantID, []byte(`{"deferred_delete_minutes":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteServer(context.Background(), i.TenantID, i.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var s struct {
+		Server api.ServerDetails `json:"server"`
+	}
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.Status != payloads.DeletePending || s.Server.DeleteTime == nil {
+		t.Fatalf("Instance not pending deletion: %+v", s.Server)
+	}
+
+	if err := ctl.StopServer(i.TenantID, i.ID); err != types.ErrInstanceDeletePending {
+		t.Errorf("Expected %v, got %v", types.ErrInstanceDeletePending, err)
+	}
+
+	// nothing is deleted before the end of the grace period
+	if reaped := ctl.reapDeletedInstances(time.Now()); len(reaped) != 0 {
+		t.Fatalf("Unexpected deletion of %v", reaped)
+	}
+
+	err = ctl.RestoreServer(i.TenantID, i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ctl.ds.GetInstance(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.State != payloads.Running || !restored.DeleteTime.IsZero() {
+		t.Fatalf("Instance not restored: %s %v", restored.State, restored.DeleteTime)
+	}
+
+	err = ctl.RestoreServer(i.TenantID, i.ID)
+	if err != types.ErrInstanceNotDeletePending {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceNotDeletePending, err)
+	}
+
+	err = ctl.DeleteServer(context.Background(), i.TenantID, i.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+	reaped := ctl.reapDeletedInstances(time.Now().Add(time.Hour))
+	if len(reaped) != 1 || reaped[0] != i.ID {
+		t.Fatalf("Expected %s to be deleted, got %v", i.ID, reaped)
+	}
+
+	result, err := server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != i.ID {
+		t.Fatal("Did not get correct Instance ID")
+	}
+
+	// the instance is only deleted once and may no longer be restored
+	if reaped := ctl.reapDeletedInstances(time.Now().Add(time.Hour)); len(reaped) != 0 {
+		t.Fatalf("Unexpected second deletion of %v", reaped)
+	}
+
+	err = ctl.RestoreServer(i.TenantID, i.ID)
+	if err != types.ErrInstanceChangingState {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceChangingState, err)
+	}
+
+	ctl.client.RemoveInstance(i.ID)
+}
+
+func TestDeferredDeleteImmediate(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	i := instances[0]
+	err := ctl.PatchTenant(i.TenantID, []byte(`{"deferred_delete_minutes":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteServer(context.Background(), i.TenantID, i.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting an instance pending deletion deletes it straight away
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+	err = ctl.DeleteServer(context.Background(), i.TenantID, i.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != i.ID {
+		t.Fatal("Did not get correct Instance ID")
+	}
+
+	ctl.client.RemoveInstance(i.ID)
+
+	if _, err := ctl.ds.GetInstance(i.ID); err == nil {
+		t.Fatal("Instance not deleted")
+	}
+
+	if reaped := ctl.reapDeletedInstances(time.Now().Add(time.Hour)); len(reaped) != 0 {
+		t.Fatalf("Unexpected deletion of %v", reaped)
+	}
+
+	ctl.deletedInstances.Lock()
+	deleting := ctl.deletedInstances.deleting[i.ID]
+	ctl.deletedInstances.Unlock()
+	if deleting {
+		t.Error("Deleted instance still tracked")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+	"github.com/gorilla/mux"
+)
+
+func ciaoEvent(l *types.LogEntry) types.CiaoEvent {
+	return types.CiaoEvent{
+		ID:         l.ID,
+		Timestamp:  l.Timestamp,
+		TenantID:   l.TenantID,
+		EventType:  l.EventType,
+		Message:    l.Message,
+		ObjectID:   l.ObjectID,
+		Actor:      l.Actor,
+		OnBehalfOf: l.OnBehalfOf,
+	}
+}
+
+func ciaoEvents(logs []*types.LogEntry, filter types.EventFilter) types.CiaoEvents {
+	events := types.NewCiaoEvents()
+
+	for _, l := range logs {
+		events.Events = append(events.Events, ciaoEvent(l))
+	}
+
+	// a full page may be followed by more events
+	if filter.Limit > 0 && len(logs) == filter.Limit {
+		events.NextMarker = strconv.FormatInt(logs[len(logs)-1].ID, 10)
+	}
+
+	return events
+}
+
+// ListEvents returns the logged events of all tenants which match filter.
+func (c *controller) ListEvents(filter types.EventFilter) (types.CiaoEvents, error) {
+	logs, err := c.ds.GetEvents(filter)
+	if err != nil {
+		return types.CiaoEvents{}, err
+	}
+
+	return ciaoEvents(logs, filter), nil
+}
+
+// ListTenantEvents returns the logged events of a tenant which match
+// filter.
+func (c *controller) ListTenantEvents(tenantID string, filter types.EventFilter) (types.CiaoEvents, error) {
+	logs, err := c.ds.GetEventsForTenant(tenantID, filter)
+	if err != nil {
+		return types.CiaoEvents{}, err
+	}
+
+	return ciaoEvents(logs, filter), nil
+}
+
+// requestObjectID returns the value of the last variable, other than the
+// tenant, in the template of the route matched by r.  This identifies the
+// object an API request acts upon, e.g., the instance in
+// /{tenant}/instances/{instance_id}/action.
+func requestObjectID(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+
+	vars := mux.Vars(r)
+	segments := strings.Split(tmpl, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		if !strings.HasPrefix(s, "{") {
+			continue
+		}
+
+		name := strings.SplitN(strings.Trim(s, "{}"), ":", 2)[0]
+		if name != "tenant" {
+			return vars[name]
+		}
+	}
+
+	return ""
+}
+
+// logAction records a successful API request which changes the state of
+// the cluster in the event log of the tenant it applies to, along with the
+// user who made it.
+func (c *controller) logAction(r *http.Request, status int) {
+	if r.Method == "GET" || r.Method == "HEAD" || status >= http.StatusBadRequest {
+		return
+	}
+
+	// clearing the event log leaves it empty
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		return
+	}
+
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	if tenantID == "" {
+		tenantID = vars["for_tenant"]
+	}
+
+	ctx := r.Context()
+	msg := fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+	err := c.ds.LogAction(tenantID, requestObjectID(r), service.GetActor(ctx), service.GetOnBehalfOf(ctx), msg)
+	if err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+}
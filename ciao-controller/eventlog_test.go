@@ -0,0 +1,293 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/gorilla/mux"
+)
+
+func testListTenantEvents(t *testing.T, url string) types.CiaoEvents {
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var events types.CiaoEvents
+	err := json.Unmarshal(body, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestTenantEventIsolation(t *testing.T) {
+	tenantA, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantB, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectA := uuid.Generate().String()
+	objectB := uuid.Generate().String()
+
+	for _, e := range []struct{ tenant, object, msg string }{
+		{tenantA.ID, objectA, "a1"},
+		{tenantB.ID, objectB, "b1"},
+		{tenantA.ID, objectA, "a2"},
+		{tenantB.ID, objectA, "b2"},
+	} {
+		err = ctl.ds.LogAction(e.tenant, e.object, "test", "", e.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	urlA := testutil.ComputeURL + "/" + tenantA.ID + "/events"
+
+	queries := []string{
+		"",
+		"?tenant_id=" + tenantB.ID,
+		"?object_id=" + objectB,
+		"?object_id=" + objectA + "&tenant_id=" + tenantB.ID,
+		"?marker=0&type=action",
+		"?limit=1000",
+	}
+	for _, q := range queries {
+		events := testListTenantEvents(t, urlA+q)
+		for _, e := range events.Events {
+			if e.TenantID != tenantA.ID {
+				t.Errorf("%s: event of another tenant returned: %+v", q, e)
+			}
+		}
+	}
+
+	events := testListTenantEvents(t, urlA+"?object_id="+objectA)
+	if len(events.Events) != 2 || events.Events[0].Message != "a1" || events.Events[1].Message != "a2" {
+		t.Errorf("Unexpected events for object: %+v", events.Events)
+	}
+
+	// follow the markers one event at a time
+	events = testListTenantEvents(t, urlA+"?limit=1")
+	if len(events.Events) != 1 || events.NextMarker == "" {
+		t.Fatalf("Expected a page of one event: %+v", events)
+	}
+	events = testListTenantEvents(t, urlA+"?limit=1&marker="+events.NextMarker)
+	if len(events.Events) != 1 || events.Events[0].Message != "a2" {
+		t.Fatalf("Unexpected second page: %+v", events)
+	}
+	events = testListTenantEvents(t, urlA+"?limit=1&marker="+events.NextMarker)
+	if len(events.Events) != 0 {
+		t.Fatalf("Expected no more events: %+v", events)
+	}
+
+	// admins may see the events of every tenant
+	events = testListTenantEvents(t, testutil.ComputeURL+"/events?tenant_id="+tenantB.ID)
+	if len(events.Events) != 2 || events.Events[0].Message != "b1" {
+		t.Errorf("Unexpected events for tenant: %+v", events.Events)
+	}
+
+	events = testListTenantEvents(t, testutil.ComputeURL+"/events?object_id="+objectA)
+	if len(events.Events) != 3 {
+		t.Errorf("Expected events of both tenants: %+v", events.Events)
+	}
+
+	_ = testHTTPRequest(t, "GET", urlA+"?limit=0", http.StatusBadRequest, nil, true)
+	_ = testHTTPRequest(t, "GET", urlA+"?end=tomorrow", http.StatusBadRequest, nil, true)
+}
+
+func TestActionEvents(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.QuotaUpdateRequest{
+		Quotas: []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 10}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants/" + tenant.ID + "/quotas"
+	_ = testHTTPRequest(t, "PUT", url, http.StatusCreated, b, true)
+
+	events := testListTenantEvents(t, testutil.ComputeURL+"/"+tenant.ID+"/events?type=action")
+	if len(events.Events) != 1 {
+		t.Fatalf("Expected one action: %+v", events.Events)
+	}
+
+	e := events.Events[0]
+	if e.Actor != "admin" || e.Message != "PUT /tenants/"+tenant.ID+"/quotas" {
+		t.Errorf("Unexpected action event: %+v", e)
+	}
+}
+
+// medianLatency returns the median time taken to GET url with client over
+// n requests.
+func medianLatency(client *http.Client, url string, header http.Header, n int) (time.Duration, error) {
+	latencies := make([]time.Duration, n)
+	for i := range latencies {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return 0, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		latencies[i] = time.Since(start)
+
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[n/2], nil
+}
+
+func TestEventFlood(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping event flood in short mode")
+	}
+
+	const events = 50000
+	const errorEvery = 100
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := testHTTPClient(t)
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances/detail"
+	header := onBehalfOf(tenant.ID)
+
+	baseline, err := medianLatency(client, url, header, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	droppedBefore := ctl.metrics.eventsDropped.Value("info")
+	errorsDroppedBefore := ctl.metrics.eventsDropped.Value("error")
+
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		for i := 0; i < events; i++ {
+			if i%errorEvery == 0 {
+				_ = ctl.ds.LogError(tenant.ID, fmt.Sprintf("error %d", i))
+			} else {
+				_ = ctl.ds.LogEvent(tenant.ID, fmt.Sprintf("info %d", i))
+			}
+		}
+		done <- time.Since(start)
+	}()
+
+	var flooded time.Duration
+	var samples []time.Duration
+	for flooded == 0 {
+		latency, err := medianLatency(client, url, header, 5)
+		if err != nil {
+			<-done
+			t.Fatal(err)
+		}
+		samples = append(samples, latency)
+
+		select {
+		case flooded = <-done:
+		default:
+		}
+	}
+
+	// the latencies are only logged as they depend too much on the
+	// machine, and on the race detector, to be checked
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	during := samples[len(samples)/2]
+	t.Logf("%d events logged in %v, API latency %v before and %v during", events, flooded, baseline, during)
+
+	errors, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{Type: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(errors) != events/errorEvery {
+		t.Errorf("Expected %d errors logged got %d", events/errorEvery, len(errors))
+	}
+
+	if dropped := ctl.metrics.eventsDropped.Value("error") - errorsDroppedBefore; dropped != 0 {
+		t.Errorf("%d error events dropped", dropped)
+	}
+
+	infos, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{Type: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := ctl.metrics.eventsDropped.Value("info") - droppedBefore
+	if uint64(len(infos))+dropped != events-events/errorEvery {
+		t.Errorf("%d info events logged and %d dropped out of %d", len(infos), dropped, events-events/errorEvery)
+	}
+}
+
+func TestRequestObjectID(t *testing.T) {
+	tests := []struct {
+		tmpl     string
+		path     string
+		expected string
+	}{
+		{"/{tenant}/instances/{instance_id}/action", "/t/instances/i/action", "i"},
+		{"/tenants/{for_tenant:[a-z]+}/quotas", "/tenants/t/quotas", "t"},
+		{"/{tenant}/instances", "/t/instances", ""},
+		{"/pools", "/pools", ""},
+	}
+
+	for _, tt := range tests {
+		var objectID string
+
+		r := mux.NewRouter()
+		r.HandleFunc(tt.tmpl, func(w http.ResponseWriter, req *http.Request) {
+			objectID = requestObjectID(req)
+		})
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", tt.path, nil))
+
+		if objectID != tt.expected {
+			t.Errorf("%s: expected %q got %q", tt.tmpl, tt.expected, objectID)
+		}
+	}
+}
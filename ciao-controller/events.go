@@ -0,0 +1,207 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// eventHub distributes controller events, and the entries written to the
+// event log, to its subscribers.  Publishing never blocks: when the buffer
+// of a subscriber is full the event is either dropped or, for subscribers
+// which must not miss events, the subscription is closed.
+type eventHub struct {
+	sync.Mutex
+	subscribers    map[chan types.Event]subscription
+	logSubscribers map[chan types.CiaoEvent]subscription
+	closed         bool
+}
+
+// subscription holds the options of a subscriber of the event hub.
+type subscription struct {
+	// tenantID restricts the subscriber to the events of a tenant.  The
+	// events of all tenants are received if it is empty.
+	tenantID string
+
+	// closeSlow closes the channel of the subscriber, rather than
+	// dropping the event, when its buffer is full.  The subscriber
+	// learns that it has fallen behind and can resume from the event
+	// log.
+	closeSlow bool
+}
+
+func (s subscription) wants(tenantID string) bool {
+	return s.tenantID == "" || s.tenantID == tenantID
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers:    make(map[chan types.Event]subscription),
+		logSubscribers: make(map[chan types.CiaoEvent]subscription),
+	}
+}
+
+// subscribe returns a channel on which published events will be received.
+// The channel can buffer up to size events, further events are dropped.
+func (h *eventHub) subscribe(size int) chan types.Event {
+	ch := make(chan types.Event, size)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch
+	}
+
+	h.subscribers[ch] = subscription{}
+
+	return ch
+}
+
+// subscribeLog returns a channel on which the entries written to the event
+// log for tenantID, or for all tenants if tenantID is empty, will be
+// received.  The channel is closed if the subscriber falls more than size
+// entries behind.
+func (h *eventHub) subscribeLog(tenantID string, size int) chan types.CiaoEvent {
+	ch := make(chan types.CiaoEvent, size)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch
+	}
+
+	h.logSubscribers[ch] = subscription{tenantID: tenantID, closeSlow: true}
+
+	return ch
+}
+
+// unsubscribe removes and closes a channel returned by subscribe.
+func (h *eventHub) unsubscribe(ch chan types.Event) {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// unsubscribeLog removes and closes a channel returned by subscribeLog.
+func (h *eventHub) unsubscribeLog(ch chan types.CiaoEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.logSubscribers[ch]; ok {
+		delete(h.logSubscribers, ch)
+		close(ch)
+	}
+}
+
+// publish sends e to all current subscribers.
+func (h *eventHub) publish(e types.Event) {
+	h.Lock()
+	defer h.Unlock()
+
+	for ch, s := range h.subscribers {
+		if !s.wants(e.TenantID) {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+			if s.closeSlow {
+				delete(h.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// publishLog sends the entries written to the event log to all current
+// log subscribers.  It is called by the writer of the event log.
+func (h *eventHub) publishLog(entries []types.LogEntry) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i := range entries {
+		e := ciaoEvent(&entries[i])
+		for ch, s := range h.logSubscribers {
+			if !s.wants(e.TenantID) {
+				continue
+			}
+
+			select {
+			case ch <- e:
+			default:
+				if s.closeSlow {
+					delete(h.logSubscribers, ch)
+					close(ch)
+				}
+			}
+		}
+	}
+}
+
+// close closes all subscriptions, ending the event streams so that the
+// API servers can shut down.  Later subscriptions are closed at once.
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+
+	for ch := range h.logSubscribers {
+		delete(h.logSubscribers, ch)
+		close(ch)
+	}
+
+	h.closed = true
+}
+
+// publishEvent creates a new event and publishes it on the controller's
+// event hub.
+func (c *controller) publishEvent(t types.EventType, tenantID string, msg string, data map[string]string) {
+	if c.events == nil {
+		return
+	}
+
+	c.events.publish(types.Event{
+		ID:        uuid.Generate().String(),
+		Type:      t,
+		TenantID:  tenantID,
+		Timestamp: time.Now(),
+		Message:   msg,
+		Data:      data,
+	})
+}
+
+// quotaExceeded publishes an event describing a denied quota request.
+func (c *controller) quotaExceeded(tenantID string, res quotas.Result) {
+	c.metrics.quotaDenied(tenantID, res.Denied())
+	c.publishEvent(types.QuotaExceededEvent, tenantID, res.Reason(), nil)
+}
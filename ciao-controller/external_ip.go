@@ -16,8 +16,11 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-controller/utils"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
 )
@@ -88,6 +91,50 @@ func (c *controller) makeMappedIPLinks(IP *types.MappedIP, tenant *string) {
 	}
 }
 
+// cnciNetBits is the prefix length of the network, starting at cnciNet,
+// from which the CNCI tunnel addresses are allocated.
+const cnciNetBits = 17
+
+func cnciNetwork() *net.IPNet {
+	mask := net.CIDRMask(cnciNetBits, 32)
+	IP := net.ParseIP(cnciNet.String()).To4()
+	if IP == nil {
+		return nil
+	}
+
+	return &net.IPNet{IP: IP.Mask(mask), Mask: mask}
+}
+
+// checkCNCIOverlap checks that a subnet or list of addresses to be added
+// to a pool does not overlap the CNCI network.  The datastore checks the
+// ranges against those already in the pools as it adds them.  Ranges which
+// cannot be parsed are left for the datastore to reject.
+func checkCNCIOverlap(cnci *net.IPNet, subnet *string, ips []string) error {
+	if cnci == nil {
+		return nil
+	}
+
+	var ranges []string
+	if subnet != nil {
+		ranges = []string{*subnet}
+	} else {
+		ranges = ips
+	}
+
+	for _, r := range ranges {
+		ipNet, err := utils.ParseRange(r)
+		if err != nil {
+			continue
+		}
+
+		if utils.RangesOverlap(ipNet, cnci) {
+			return &types.RangeOverlapError{Range: r, Conflict: cnci.String()}
+		}
+	}
+
+	return nil
+}
+
 func (c *controller) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
 	pools, err := c.ds.GetPools()
 	if err != nil {
@@ -100,9 +147,15 @@ func (c *controller) AddPool(name string, subnet *string, ips []string) (types.P
 		}
 	}
 
+	err = checkCNCIOverlap(cnciNetwork(), subnet, ips)
+	if err != nil {
+		return types.Pool{}, err
+	}
+
 	pool := types.Pool{
-		ID:   uuid.Generate().String(),
-		Name: name,
+		ID:         uuid.Generate().String(),
+		Name:       name,
+		CreateTime: time.Now().UTC(),
 	}
 
 	err = c.ds.AddPool(pool)
@@ -112,6 +165,8 @@ func (c *controller) AddPool(name string, subnet *string, ips []string) (types.P
 
 	err = c.AddAddress(pool.ID, subnet, ips)
 	if err != nil {
+		// a rejected pool is not left behind empty.
+		_ = c.ds.DeletePool(pool.ID)
 		return pool, err
 	}
 
@@ -146,6 +201,11 @@ func (c *controller) ShowPool(ID string) (types.Pool, error) {
 }
 
 func (c *controller) AddAddress(poolID string, subnet *string, ips []string) error {
+	err := checkCNCIOverlap(cnciNetwork(), subnet, ips)
+	if err != nil {
+		return err
+	}
+
 	if subnet != nil {
 		return c.ds.AddExternalSubnet(poolID, *subnet)
 	}
@@ -157,6 +217,22 @@ func (c *controller) DeletePool(ID string) error {
 	return c.ds.DeletePool(ID)
 }
 
+// SetPoolAccess restricts a pool to a list of tenants.  Addresses already
+// mapped from the pool are left alone.
+func (c *controller) SetPoolAccess(ID string, tenants []string) error {
+	for _, tenantID := range tenants {
+		t, err := c.ds.GetTenant(tenantID)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return types.ErrTenantNotFound
+		}
+	}
+
+	return c.ds.SetPoolTenants(ID, tenants)
+}
+
 func (c *controller) RemoveAddress(poolID string, subnetID *string, IPID *string) error {
 	if subnetID != nil {
 		return c.ds.DeleteSubnet(poolID, *subnetID)
@@ -180,7 +256,10 @@ func (c *controller) ListMappedAddresses(tenant *string) []types.MappedIP {
 	return IPs
 }
 
-func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string) (err error) {
+// MapAddress maps an address from a pool to an instance.  The pool is
+// chosen by the controller if poolName is nil and the address if address
+// is empty.
+func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string, address string) (err error) {
 	var m types.MappedIP
 	var i *types.Instance
 
@@ -203,6 +282,7 @@ func (c *controller) MapAddress(tenantID string, poolName *string, instanceID st
 	}()
 
 	if !res.Allowed() {
+		c.quotaExceeded(i.TenantID, res)
 		return types.ErrQuota
 	}
 
@@ -213,13 +293,36 @@ func (c *controller) MapAddress(tenantID string, poolName *string, instanceID st
 
 	err = types.ErrPoolEmpty
 
+	// the admin may map addresses from restricted pools on behalf of
+	// any tenant.
+	if address != "" {
+		err = types.ErrAddressNotInPool
+	}
+
 	for _, pool := range pools {
-		if poolName != nil {
+		accessible := tenantID == "" || pool.Accessible(i.TenantID)
+
+		if address != "" {
+			if (poolName != nil && pool.Name != *poolName) || !pool.Contains(address) {
+				continue
+			}
+
+			if !accessible {
+				err = &types.PoolRestrictedError{Pool: pool.Name}
+				break
+			}
+			m, err = c.ds.MapExternalAddress(pool.ID, instanceID, address)
+			break
+		} else if poolName != nil {
 			if pool.Name == *poolName {
+				if !accessible {
+					err = &types.PoolRestrictedError{Pool: pool.Name}
+					break
+				}
 				m, err = c.ds.MapExternalIP(pool.ID, instanceID)
 				break
 			}
-		} else if pool.Free > 0 {
+		} else if accessible && pool.Free > 0 {
 			m, err = c.ds.MapExternalIP(pool.ID, instanceID)
 			break
 		}
@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+)
+
+// recordHistory adds an entry made on behalf of the user of ctx to the
+// history of an instance.
+func (c *controller) recordHistory(ctx context.Context, i *types.Instance, t types.HistoryEntryType, msg string) {
+	c.addHistory(i, types.InstanceHistoryEntry{
+		Type:       t,
+		Message:    msg,
+		NodeID:     i.NodeID,
+		Actor:      service.GetActor(ctx),
+		OnBehalfOf: service.GetOnBehalfOf(ctx),
+	})
+}
+
+// recordCommand adds a command sent to the nodes to the history of an
+// instance.
+func (c *controller) recordCommand(i *types.Instance, command string) {
+	c.addHistory(i, types.InstanceHistoryEntry{
+		Type:    types.HistoryCommand,
+		Message: command,
+		NodeID:  i.NodeID,
+	})
+}
+
+// recordCreation adds the creation of an instance, and the resources it
+// was given, to its history.
+func (c *controller) recordCreation(i *types.Instance, wl types.Workload, actor string) {
+	msg := fmt.Sprintf("Created from workload %s", wl.ID)
+	if i.Name != "" {
+		msg += fmt.Sprintf(" as %s", i.Name)
+	}
+	if i.CNCI {
+		msg += " (CNCI)"
+	}
+
+	vcpus := i.VCPUs
+	if vcpus == 0 {
+		vcpus = wl.Requirements.VCPUs
+	}
+	memMB := i.MemMB
+	if memMB == 0 {
+		memMB = wl.Requirements.MemMB
+	}
+	msg += fmt.Sprintf(": vcpus %d, mem_mb %d, disk_gb %d", vcpus, memMB, i.EphemeralGB)
+
+	c.addHistory(i, types.InstanceHistoryEntry{
+		Type:    types.HistoryCreated,
+		Message: msg,
+		Actor:   actor,
+	})
+}
+
+func (c *controller) addHistory(i *types.Instance, e types.InstanceHistoryEntry) {
+	err := c.ds.AddInstanceHistory(i.ID, i.TenantID, e)
+	if err != nil {
+		c.instanceLog(i).Warningf("Error recording instance history: %v", err)
+	}
+}
+
+// ShowInstanceHistory returns a page of the history of an instance.  The
+// history of a deleted instance remains available until it is pruned.
+// tenantID is empty for the admin.
+func (c *controller) ShowInstanceHistory(tenantID string, instanceID string, filter types.InstanceHistoryFilter) (types.InstanceHistory, error) {
+	owner, entries, err := c.ds.GetInstanceHistory(instanceID)
+	if err != nil {
+		return types.InstanceHistory{}, err
+	}
+
+	if tenantID != "" && owner != tenantID {
+		return types.InstanceHistory{}, types.ErrInstanceNotFound
+	}
+
+	history := types.InstanceHistory{
+		InstanceID: instanceID,
+		TenantID:   owner,
+		Entries:    []types.InstanceHistoryEntry{},
+	}
+
+	if filter.Marker < len(entries) {
+		entries = entries[filter.Marker:]
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[:filter.Limit]
+			history.NextMarker = strconv.Itoa(filter.Marker + filter.Limit)
+		}
+		history.Entries = entries
+	}
+
+	return history, nil
+}
+
+// pruneInstanceHistory removes the histories of instances which were
+// deleted longer ago than their tenant's trash retention period.
+func (c *controller) pruneInstanceHistory(now time.Time) {
+	pruned, err := c.ds.PruneInstanceHistory(c.trashRetention, now)
+	if err != nil {
+		c.log.Warningf("Unable to prune instance history: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned history of %d instances", pruned)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/service"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func testGetHistory(t *testing.T, url string, header http.Header) types.InstanceHistory {
+	var body []byte
+	if header == nil {
+		body = testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+	} else {
+		body = testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, header)
+	}
+
+	var h types.InstanceHistory
+	err := json.Unmarshal(body, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// checkHistory verifies that expected occurs in entries, in order, with
+// other entries allowed in between.
+func checkHistory(t *testing.T, entries []types.InstanceHistoryEntry, expected []types.InstanceHistoryEntry) {
+	next := 0
+	for _, e := range entries {
+		if next == len(expected) {
+			break
+		}
+		if e.Type == expected[next].Type && strings.Contains(e.Message, expected[next].Message) {
+			next++
+		}
+	}
+
+	if next != len(expected) {
+		t.Errorf("%s %q missing from history: %+v", expected[next].Type, expected[next].Message, entries)
+	}
+}
+
+func TestInstanceHistory(t *testing.T) {
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.TrashRetention = time.Hour
+	})()
+
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	i := instances[0]
+
+	sendStatsCmd(client, t)
+
+	data := addTestBlockDevice(t, i.TenantID)
+	agentCh := client.AddCmdChan(ssntp.AttachVolume)
+	ctx := service.SetActor(context.Background(), "volume-admin")
+	err := ctl.AttachVolume(ctx, i.TenantID, data.ID, i.ID, "/dev/vdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCmdChanResult(agentCh, ssntp.AttachVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop the instance through the API so that the request is audited
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/action"
+	_ = testHTTPRequestWithHeader(t, "POST", url, http.StatusAccepted, []byte(`{"os-stop":null}`), onBehalfOf(i.TenantID))
+	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sendStopEvent(client, i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCh := client.AddCmdChan(ssntp.START)
+	err = ctl.restartInstance(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCmdChanResult(clientCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendStatsCmd(client, t)
+
+	serverCh = server.AddCmdChan(ssntp.DELETE)
+	err = ctl.deleteInstance(context.Background(), i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controllerCh := wrappedClient.addEventChan(ssntp.InstanceDeleted)
+	go client.SendDeleteEvent(i.ID)
+	err = wrappedClient.getEventChan(controllerCh, ssntp.InstanceDeleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ds.GetInstance(i.ID)
+	if err == nil {
+		t.Fatal("Instance not deleted")
+	}
+
+	// the history survives the instance
+	adminURL := testutil.ComputeURL + "/instances/" + i.ID + "/history"
+	h := testGetHistory(t, adminURL, nil)
+	if h.InstanceID != i.ID || h.TenantID != i.TenantID {
+		t.Fatalf("Unexpected history: %+v", h)
+	}
+
+	checkHistory(t, h.Entries, []types.InstanceHistoryEntry{
+		{Type: types.HistoryCreated, Message: "Created from workload"},
+		{Type: types.HistoryCommand, Message: "start"},
+		{Type: types.HistoryPlacement, Message: "initial"},
+		{Type: types.HistoryState, Message: "to active"},
+		{Type: types.HistoryAttach, Message: data.ID},
+		{Type: types.HistoryCommand, Message: "stop"},
+		{Type: types.HistoryState, Message: "to exited"},
+		{Type: types.HistoryCommand, Message: "restart"},
+		{Type: types.HistoryCommand, Message: "delete"},
+		{Type: types.HistoryState, Message: "deleted"},
+	})
+
+	// the event log only records times to the second so its entries
+	// cannot be placed precisely amongst the others.
+	checkHistory(t, h.Entries, []types.InstanceHistoryEntry{
+		{Type: types.HistoryRequest, Message: "POST"},
+		{Type: types.HistoryEvent, Message: "Deleted Instance"},
+	})
+
+	var nodeSeen bool
+	for idx, e := range h.Entries {
+		if idx > 0 && e.Timestamp.Truncate(time.Second).Before(h.Entries[idx-1].Timestamp.Truncate(time.Second)) {
+			t.Errorf("History out of order: %+v", h.Entries)
+		}
+
+		switch e.Type {
+		case types.HistoryAttach:
+			if e.Actor != "volume-admin" {
+				t.Errorf("Attach not attributed to its actor: %+v", e)
+			}
+		case types.HistoryRequest:
+			if e.OnBehalfOf != i.TenantID {
+				t.Errorf("Request not attributed to tenant: %+v", e)
+			}
+		}
+
+		nodeSeen = nodeSeen || e.NodeID != ""
+	}
+	if !nodeSeen {
+		t.Error("No nodes in admin history")
+	}
+
+	// tenants may see the history of their instances but not the nodes
+	tenantURL := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/history"
+	th := testGetHistory(t, tenantURL, onBehalfOf(i.TenantID))
+	if len(th.Entries) != len(h.Entries) {
+		t.Errorf("Expected %d entries, got %d", len(h.Entries), len(th.Entries))
+	}
+	for _, e := range th.Entries {
+		if e.NodeID != "" {
+			t.Errorf("Node %s visible to tenant", e.NodeID)
+		}
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherURL := testutil.ComputeURL + "/" + other.ID + "/instances/" + i.ID + "/history"
+	_ = testHTTPRequestWithHeader(t, "GET", otherURL, http.StatusNotFound, nil, onBehalfOf(other.ID))
+	_ = testHTTPRequestWithHeader(t, "GET", adminURL, http.StatusForbidden, nil, onBehalfOf(i.TenantID))
+
+	// paging through the history returns every entry once, in order
+	var paged []types.InstanceHistoryEntry
+	marker := ""
+	for pages := 0; ; pages++ {
+		if pages > len(h.Entries) {
+			t.Fatal("History does not end")
+		}
+
+		page := testGetHistory(t, adminURL+"?limit=3&marker="+marker, nil)
+		if len(page.Entries) > 3 {
+			t.Fatalf("Page of %d entries exceeds limit", len(page.Entries))
+		}
+		paged = append(paged, page.Entries...)
+
+		if page.NextMarker == "" {
+			break
+		}
+		marker = page.NextMarker
+	}
+	if len(paged) != len(h.Entries) {
+		t.Fatalf("Expected %d entries, got %d", len(h.Entries), len(paged))
+	}
+	for idx := range paged {
+		if paged[idx] != h.Entries[idx] {
+			t.Errorf("Entry %d differs: %+v != %+v", idx, paged[idx], h.Entries[idx])
+		}
+	}
+
+	// the history is pruned once the trash retention period passes
+	ctl.pruneInstanceHistory(time.Now())
+	_ = testGetHistory(t, adminURL, nil)
+
+	ctl.pruneInstanceHistory(time.Now().Add(2 * time.Hour))
+	_ = testHTTPRequest(t, "GET", adminURL, http.StatusNotFound, nil, true)
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/instances/"+uuid.Generate().String()+"/history",
+		http.StatusNotFound, nil, true)
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var (
+	errIdempotencyKeyReused = errors.New("Idempotency key already used for a different request")
+	errIdempotencyKeyBusy   = errors.New("A request with this idempotency key is in progress")
+)
+
+// idempotentRoutes are the templates of the POST routes which create
+// resources and so accept an idempotency key.
+var idempotentRoutes = map[string]bool{
+	"/{tenant}/instances": true,
+	"/{tenant}/volumes":   true,
+	"/external-ips":       true,
+	"/{tenant:" + uuid.UUIDRegex + "}/external-ips": true,
+}
+
+// idempotencyState tracks the idempotency keys of the requests being
+// processed so that concurrent retries are not both executed.
+type idempotencyState struct {
+	sync.Mutex
+	pending map[string]bool
+}
+
+func (s *idempotencyState) begin(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending == nil {
+		s.pending = make(map[string]bool)
+	}
+
+	if s.pending[key] {
+		return false
+	}
+
+	s.pending[key] = true
+	return true
+}
+
+func (s *idempotencyState) end(key string) {
+	s.Lock()
+	delete(s.pending, key)
+	s.Unlock()
+}
+
+// responseRecorder captures the response written by a handler while
+// passing it on to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	_, _ = r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotentRequest returns whether r may carry an idempotency key.
+func idempotentRequest(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	tmpl, err := route.GetPathTemplate()
+	return err == nil && idempotentRoutes[tmpl]
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeIdempotencyError(w http.ResponseWriter, status int, err error) {
+	code := api.HTTPReturnErrorCode{
+		Error: api.HTTPErrorData{
+			Code:    status,
+			Name:    http.StatusText(status),
+			Message: err.Error(),
+		},
+	}
+
+	b, _ := json.Marshal(code)
+	http.Error(w, string(b), status)
+}
+
+// serveIdempotent serves a request carrying an idempotency key.  The first
+// successful response for a key is stored, and replayed to retries of the
+// same request by the same tenant within idempotency_retention.  Reusing
+// the key for a different request is a conflict.  Failed requests are not
+// stored so that they may be retried.  It returns whether the response was
+// replayed.
+func (c *controller) serveIdempotent(w http.ResponseWriter, r *http.Request, key string, next http.Handler) bool {
+	tenantID := mux.Vars(r)["tenant"]
+	if tenantID == "" {
+		tenantID = "admin"
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if tooLarge, ok := err.(*http.MaxBytesError); ok {
+		writeIdempotencyError(w, http.StatusRequestEntityTooLarge, api.BodyTooLargeError(tooLarge.Limit))
+		return false
+	} else if err != nil {
+		writeIdempotencyError(w, http.StatusBadRequest, err)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	hash := requestHash(r, body)
+
+	pending := tenantID + "/" + key
+	if !c.idempotency.begin(pending) {
+		writeIdempotencyError(w, http.StatusConflict, errIdempotencyKeyBusy)
+		return false
+	}
+	defer c.idempotency.end(pending)
+
+	log := c.requestLog(r)
+
+	stored, err := c.ds.GetIdempotentResponse(tenantID, key)
+	if err != nil && err != datastore.ErrNoIdempotencyKey {
+		log.Warningf("Unable to retrieve idempotency key: %v", err)
+		writeIdempotencyError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	retention := c.durationSetting(settingIdempotencyRetention)
+	if err == nil && time.Since(stored.CreateTime) < retention {
+		if stored.RequestHash != hash {
+			writeIdempotencyError(w, http.StatusConflict, errIdempotencyKeyReused)
+			return false
+		}
+
+		if stored.ContentType != "" {
+			w.Header().Set("Content-Type", stored.ContentType)
+		}
+		w.WriteHeader(stored.Status)
+		_, _ = w.Write(stored.Body)
+		return true
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	if rec.status < http.StatusOK || rec.status >= http.StatusMultipleChoices {
+		return false
+	}
+
+	err = c.ds.AddIdempotentResponse(types.IdempotentResponse{
+		TenantID:    tenantID,
+		Key:         key,
+		RequestHash: hash,
+		Status:      rec.status,
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        rec.body.Bytes(),
+		CreateTime:  time.Now(),
+	})
+	if err != nil {
+		log.Warningf("Unable to store idempotency key: %v", err)
+	}
+
+	return false
+}
+
+// pruneIdempotencyKeys removes the responses stored for idempotency keys
+// more than idempotency_retention ago.
+func (c *controller) pruneIdempotencyKeys(cfg controllerConfig) {
+	pruned, err := c.ds.PruneIdempotentResponses(time.Now().Add(-time.Duration(c.configSetting(cfg, settingIdempotencyRetention))))
+	if err != nil {
+		c.log.Warningf("Unable to prune idempotency keys: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d idempotency keys", pruned)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func testIdempotentCreateVolume(t *testing.T, tenantID string, key string, size int, status int) types.Volume {
+	b, err := json.Marshal(api.RequestedVolume{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set(api.IdempotencyKeyHeader, key)
+
+	url := testutil.ComputeURL + "/" + tenantID + "/volumes"
+	body := testHTTPRequestWithHeader(t, "POST", url, status, b, header)
+
+	var vol types.Volume
+	if status == http.StatusAccepted {
+		err = json.Unmarshal(body, &vol)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return vol
+}
+
+func TestIdempotentCreate(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := uuid.Generate().String()
+
+	vol := testIdempotentCreateVolume(t, tenant.ID, key, 1, http.StatusAccepted)
+
+	// a retry returns the volume already created
+	replayed := testIdempotentCreateVolume(t, tenant.ID, key, 1, http.StatusAccepted)
+	if replayed.ID != vol.ID {
+		t.Errorf("Retry created a second volume: %s vs %s", replayed.ID, vol.ID)
+	}
+
+	vols, err := ctl.ListVolumesDetail(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vols) != 1 {
+		t.Errorf("Expected a single volume: %d", len(vols))
+	}
+
+	// the key cannot be reused for a different request
+	_ = testIdempotentCreateVolume(t, tenant.ID, key, 2, http.StatusConflict)
+
+	// keys are scoped by tenant
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherVol := testIdempotentCreateVolume(t, other.ID, key, 1, http.StatusAccepted)
+	if otherVol.ID == vol.ID || otherVol.TenantID != other.ID {
+		t.Errorf("Response replayed to another tenant: %+v", otherVol)
+	}
+
+	// the stored response survives a restart of the controller.  The
+	// restarted datastore shares the database of the test controller
+	// under a different driver name.
+	restarted := new(datastore.Datastore)
+	err = restarted.Init(datastore.Config{
+		PersistentURI:     "file:memdb1?mode=memory&cache=shared&_busy_timeout=5000",
+		InitWorkloadsPath: *workloadsPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := ctl.ds
+	ctl.ds = restarted
+	ctl.idempotency = idempotencyState{}
+	replayed = testIdempotentCreateVolume(t, tenant.ID, key, 1, http.StatusAccepted)
+	_ = testIdempotentCreateVolume(t, tenant.ID, key, 2, http.StatusConflict)
+	ctl.ds = ds
+
+	if replayed.ID != vol.ID {
+		t.Errorf("Retry after restart created a second volume: %s vs %s", replayed.ID, vol.ID)
+	}
+
+	// once the key has expired it may be used again
+	cfg := defaultConfig()
+	cfg.IdempotencyRetention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	ctl.pruneIdempotencyKeys(cfg)
+
+	_, err = ctl.ds.GetIdempotentResponse(tenant.ID, key)
+	if err != datastore.ErrNoIdempotencyKey {
+		t.Fatalf("Idempotency key not pruned: %v", err)
+	}
+
+	newVol := testIdempotentCreateVolume(t, tenant.ID, key, 2, http.StatusAccepted)
+	if newVol.ID == vol.ID {
+		t.Errorf("Expired key replayed")
+	}
+}
+
+func TestIdempotencyKeyIgnored(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := uuid.Generate().String()
+	header := http.Header{}
+	header.Set(api.IdempotencyKeyHeader, key)
+
+	// only requests creating resources accept a key
+	req := types.QuotaUpdateRequest{
+		Quotas: []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 10}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants/" + tenant.ID + "/quotas"
+	_ = testHTTPRequestWithHeader(t, "PUT", url, http.StatusCreated, b, header)
+
+	_, err = ctl.ds.GetIdempotentResponse(tenant.ID, key)
+	if err != datastore.ErrNoIdempotencyKey {
+		t.Errorf("Key stored for request which does not accept one: %v", err)
+	}
+
+	_, err = ctl.ds.GetIdempotentResponse("admin", key)
+	if err != datastore.ErrNoIdempotencyKey {
+		t.Errorf("Key stored for request which does not accept one: %v", err)
+	}
+}
@@ -15,6 +15,9 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,23 +27,23 @@ import (
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
-	"github.com/golang/glog"
 )
 
 // CreateImage will create an empty image in the image datastore.
 func (c *controller) CreateImage(tenantID string, req api.CreateImageRequest) (types.Image, error) {
 	// create an ImageInfo struct and store it in our image
 	// datastore.
-	glog.Infof("Creating Image: %v", req.ID)
+	c.log.Infof("Creating Image: %v", req.ID)
 
 	id := req.ID
 	if id == "" {
 		id = uuid.Generate().String()
 	} else {
 		if _, err := uuid.Parse(id); err != nil {
-			glog.Errorf("Error on parsing UUID: %v", err)
+			c.log.Errorf("Error on parsing UUID: %v", err)
 			return types.Image{}, api.ErrBadUUID
 		}
 	}
@@ -61,75 +64,127 @@ func (c *controller) CreateImage(tenantID string, req api.CreateImageRequest) (t
 
 	err := c.ds.AddImage(i)
 	if err != nil {
-		glog.Errorf("Error adding image to datastore: %v", err)
+		c.log.Errorf("Error adding image to datastore: %v", err)
 		return types.Image{}, err
 	}
 
 	res := <-c.qs.Consume(tenantID, payloads.RequestedResource{Type: payloads.Image, Value: 1})
 	if !res.Allowed() {
+		c.quotaExceeded(tenantID, res)
 		_ = c.ds.DeleteImage(id)
 		c.qs.Release(tenantID, payloads.RequestedResource{Type: payloads.Image, Value: 1})
 		return types.Image{}, api.ErrQuota
 	}
 
-	glog.Infof("Image %v added", id)
+	c.log.Infof("Image %v added", id)
 	return i, nil
 }
 
 // ListImages will return a list of all the images in the datastore.
 func (c *controller) ListImages(tenant string) ([]types.Image, error) {
-	glog.Infof("Listing images from [%v]", tenant)
+	c.log.Infof("Listing images from [%v]", tenant)
 
 	if tenant == "admin" {
-		return c.ds.GetImages("", true)
+		images, err := c.ds.GetImages("", true)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range images {
+			images[i].Seeds = c.imageSeeds(images[i].ID)
+		}
+
+		return images, nil
 	}
 
 	return c.ds.GetImages(tenant, false)
 }
 
-func (c *controller) uploadImage(imageID string, body io.Reader) error {
+// imageVisible returns true if tenantID may see and use image.  Private
+// images are only visible to the tenant that owns them and internal images
+// are reserved for ciao itself.
+func imageVisible(tenantID string, image types.Image) bool {
+	switch image.Visibility {
+	case types.Public:
+		return true
+	case types.Private:
+		return imageOwner(tenantID, image)
+	default:
+		return tenantID == "admin"
+	}
+}
+
+// imageOwner returns true if tenantID may modify image.
+func imageOwner(tenantID string, image types.Image) bool {
+	return tenantID == "admin" || tenantID != "" && tenantID == image.TenantID
+}
+
+// storageImage returns the image from which the storage s of an instance
+// of tenantID is to be created.  Internal images may only be used for
+// internal storage.
+func (c *controller) storageImage(tenantID string, s types.StorageResource) (types.Image, error) {
+	id, err := c.ds.ResolveImage(tenantID, s.Source)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	image, err := c.ds.GetImage(id)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	if !imageVisible(tenantID, image) && !(s.Internal && image.Visibility == types.Internal) {
+		return types.Image{}, api.ErrNoImage
+	}
+
+	return image, nil
+}
+
+func (c *controller) uploadImage(ctx context.Context, imageID string, body io.Reader) (string, error) {
 	f, err := ioutil.TempFile("", "ciao-image")
 	if err != nil {
-		return fmt.Errorf("Error creating temporary image file: %v", err)
+		return "", fmt.Errorf("Error creating temporary image file: %v", err)
 	}
 	defer func() { _ = os.Remove(f.Name()) }()
 
+	h := sha256.New()
 	buf := make([]byte, 1<<16)
-	_, err = io.CopyBuffer(f, body, buf)
+	_, err = io.CopyBuffer(f, io.TeeReader(body, h), buf)
 	if err != nil {
 		_ = f.Close()
-		return fmt.Errorf("Error writing to temporary image file: %v", err)
+		return "", fmt.Errorf("Error writing to temporary image file: %v", err)
 	}
 
 	err = f.Close()
 	if err != nil {
-		return fmt.Errorf("Error closing temporary image file: %v", err)
+		return "", fmt.Errorf("Error closing temporary image file: %v", err)
 	}
 
-	_, err = c.CreateBlockDevice(imageID, f.Name(), 0)
+	_, err = c.CreateBlockDevice(ctx, imageID, f.Name(), 0)
 	if err != nil {
-		return fmt.Errorf("Error creating block device: %v", err)
+		return "", fmt.Errorf("Error creating block device: %v", err)
 	}
 
-	err = c.CreateBlockDeviceSnapshot(imageID, "ciao-image")
+	err = c.CreateBlockDeviceSnapshot(ctx, imageID, "ciao-image")
 	if err != nil {
-		_ = c.DeleteBlockDevice(imageID)
-		return fmt.Errorf("Unable to create snapshot: %v", err)
+		_ = c.DeleteBlockDevice(context.WithoutCancel(ctx), imageID)
+		return "", fmt.Errorf("Unable to create snapshot: %v", err)
 	}
 
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // UploadImage will upload a raw image data and update its status.
-func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error {
-	glog.Infof("Uploading image: %v", imageID)
+func (c *controller) UploadImage(ctx context.Context, tenantID, imageID string, body io.Reader) error {
+	log := clogger.With(c.log, "tenant", tenantID, "image", imageID)
+	log.Infof("Uploading image")
 
 	image, err := c.ds.GetImage(imageID)
 	if err != nil {
 		return err
 	}
 
-	if tenantID != "admin" && image.TenantID != image.TenantID {
+	if !imageOwner(tenantID, image) {
 		return api.ErrNoImage
 	}
 
@@ -139,23 +194,24 @@ func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error
 		return err
 	}
 
-	err = c.uploadImage(imageID, body)
+	checksum, err := c.uploadImage(ctx, imageID, body)
 	if err != nil {
-		glog.Errorf("Error uploading image: %v", err)
+		log.Errorf("Error uploading image: %v", err)
 		image.State = types.Killed
 		_ = c.ds.UpdateImage(image)
 		return api.ErrImageSaving
 	}
 
-	imageSize, err := c.GetBlockDeviceSize(imageID)
+	imageSize, err := c.GetBlockDeviceSize(ctx, imageID)
 	if err != nil {
-		glog.Errorf("Error getting block device size: %v", err)
+		log.Errorf("Error getting block device size: %v", err)
 		image.State = types.Killed
 		_ = c.ds.UpdateImage(image)
 		return api.ErrImageSaving
 	}
 
 	image.Size = imageSize
+	image.Checksum = checksum
 	image.State = types.Active
 
 	err = c.ds.UpdateImage(image)
@@ -163,20 +219,21 @@ func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error
 		return err
 	}
 
-	glog.Infof("Image %v uploaded", imageID)
+	log.Infof("Image uploaded")
 	return nil
 }
 
 // DeleteImage will delete a raw image and its metadata
-func (c *controller) DeleteImage(tenantID, imageID string) error {
-	glog.Infof("Deleting image: %v", imageID)
+func (c *controller) DeleteImage(ctx context.Context, tenantID, imageID string) error {
+	log := clogger.With(c.log, "tenant", tenantID, "image", imageID)
+	log.Infof("Deleting image")
 
 	image, err := c.ds.GetImage(imageID)
 	if err != nil {
 		return err
 	}
 
-	if tenantID != "admin" && image.TenantID != image.TenantID {
+	if !imageOwner(tenantID, image) {
 		return api.ErrNoImage
 	}
 
@@ -185,25 +242,29 @@ func (c *controller) DeleteImage(tenantID, imageID string) error {
 		return err
 	}
 
-	c.qs.Release(tenantID, payloads.RequestedResource{Type: payloads.Image, Value: 1})
+	c.qs.Release(image.TenantID, payloads.RequestedResource{Type: payloads.Image, Value: 1})
+
+	// once forgotten the image must be removed from the storage media
+	// even if the request is abandoned.
+	ctx = context.WithoutCancel(ctx)
 
-	err = c.DeleteBlockDeviceSnapshot(imageID, "ciao-image")
+	err = c.DeleteBlockDeviceSnapshot(ctx, imageID, "ciao-image")
 	if err != nil {
 		return fmt.Errorf("Unable to delete snapshot: %v", err)
 	}
 
-	err = c.DeleteBlockDevice(imageID)
+	err = c.DeleteBlockDevice(ctx, imageID)
 	if err != nil {
 		return fmt.Errorf("Error deleting block device: %v", err)
 	}
 
-	glog.Infof("Image %v deleted", imageID)
+	log.Infof("Image deleted")
 	return nil
 }
 
 // GetImage gets image metadata after checking permissions
 func (c *controller) GetImage(tenantID, imageID string) (types.Image, error) {
-	glog.Infof("Getting Image [%v] from [%v]", imageID, tenantID)
+	c.log.Infof("Getting Image [%v] from [%v]", imageID, tenantID)
 
 	id, err := c.ds.ResolveImage(tenantID, imageID)
 	if err != nil {
@@ -215,10 +276,21 @@ func (c *controller) GetImage(tenantID, imageID string) (types.Image, error) {
 		return types.Image{}, err
 	}
 
-	if tenantID != "admin" && image.TenantID != image.TenantID {
+	if !imageVisible(tenantID, image) {
 		return types.Image{}, api.ErrNoImage
 	}
 
-	glog.Infof("Image %v found", imageID)
+	if tenantID == "admin" {
+		image.Seeds = c.imageSeeds(image.ID)
+	}
+
+	c.log.Infof("Image %v found", imageID)
 	return image, nil
 }
+
+// SetImageVisibility changes the visibility of an image.
+func (c *controller) SetImageVisibility(imageID string, visibility types.Visibility) error {
+	c.log.Infof("Setting visibility of image [%v] to %v", imageID, visibility)
+
+	return c.ds.SetImageVisibility(imageID, visibility)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func addTestImage(tenantID string, visibility types.Visibility) (types.Image, error) {
+	id := uuid.Generate().String()
+
+	image := types.Image{
+		ID:         id,
+		TenantID:   tenantID,
+		State:      types.Active,
+		Name:       "image-" + id[:8],
+		CreateTime: time.Now(),
+		Visibility: visibility,
+	}
+
+	return image, ctl.ds.AddImage(image)
+}
+
+func imageWorkload(tenantID string, source string) types.Workload {
+	return types.Workload{
+		TenantID:   tenantID,
+		FWType:     string(payloads.EFI),
+		VMType:     payloads.QEMU,
+		Config:     "#cloud-config\n",
+		Visibility: types.Private,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 1,
+			MemMB: 256,
+		},
+		Storage: []types.StorageResource{{
+			Bootable:   true,
+			SourceType: types.ImageService,
+			Source:     source,
+		}},
+	}
+}
+
+func TestImageVisibilityMatrix(t *testing.T) {
+	owner, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := addTestImage(owner.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := addTestImage(owner.ID, types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal, err := addTestImage("", types.Internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned := testutil.ComputeURL + "/" + owner.ID + "/images/"
+	notOwned := testutil.ComputeURL + "/" + other.ID + "/images/"
+	admin := testutil.ComputeURL + "/images/"
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{owned + private.ID, http.StatusOK},
+		{owned + public.ID, http.StatusOK},
+		{owned + internal.ID, http.StatusNotFound},
+		{notOwned + private.ID, http.StatusNotFound},
+		{notOwned + public.ID, http.StatusOK},
+		{notOwned + internal.ID, http.StatusNotFound},
+		{admin + private.ID, http.StatusOK},
+		{admin + public.ID, http.StatusOK},
+		{admin + internal.ID, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		_ = testHTTPRequest(t, "GET", tt.url, tt.status, nil, true)
+	}
+
+	// share the private image with everybody
+	b, err := json.Marshal(api.ImageVisibilityRequest{Visibility: types.Public})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "PUT", admin+private.ID+"/visibility", http.StatusNoContent, b, true)
+
+	image, err := ctl.ds.GetImage(private.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Visibility != types.Public {
+		t.Errorf("Visibility not changed: %+v", image)
+	}
+
+	_ = testHTTPRequest(t, "GET", notOwned+private.ID, http.StatusOK, nil, true)
+
+	b = []byte(`{"visibility":"everyone"}`)
+	_ = testHTTPRequest(t, "PUT", admin+private.ID+"/visibility", http.StatusForbidden, b, true)
+
+	// only the owner may delete an image
+	_ = testHTTPRequest(t, "DELETE", notOwned+public.ID, http.StatusNotFound, nil, true)
+
+	for _, i := range []types.Image{private, public, internal} {
+		err = ctl.ds.DeleteImage(i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteImageInUse(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage(tenant.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// private images cannot be used by the workloads of other tenants
+	_, err = ctl.CreateWorkload(imageWorkload(other.ID, image.ID))
+	if err != types.ErrBadRequest {
+		t.Errorf("Expected bad request using another tenant's image: %v", err)
+	}
+
+	wl, err := ctl.CreateWorkload(imageWorkload(tenant.ID, image.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wl.Storage[0].Source != image.ID {
+		t.Errorf("Image name not resolved: %s", wl.Storage[0].Source)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/images/" + image.ID
+	body := testHTTPRequest(t, "DELETE", url, http.StatusForbidden, nil, true)
+	if !strings.Contains(string(body), wl.ID) {
+		t.Errorf("Referencing workload not reported: %s", string(body))
+	}
+
+	_, err = ctl.ds.GetImage(image.ID)
+	if err != nil {
+		t.Fatalf("Image in use was deleted: %v", err)
+	}
+
+	err = ctl.DeleteWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageImageVisibility(t *testing.T) {
+	owner, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := addTestImage(owner.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.ds.DeleteImage(private.ID) }()
+
+	internal, err := addTestImage("", types.Internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.ds.DeleteImage(internal.ID) }()
+
+	tests := []struct {
+		tenantID string
+		source   string
+		internal bool
+		valid    bool
+	}{
+		{owner.ID, private.ID, false, true},
+		{owner.ID, private.Name, false, true},
+		{other.ID, private.ID, false, false},
+		{other.ID, private.Name, false, false},
+		{owner.ID, internal.ID, false, false},
+		{owner.ID, internal.ID, true, true},
+		{owner.ID, uuid.Generate().String(), false, false},
+	}
+
+	for _, tt := range tests {
+		s := types.StorageResource{
+			Bootable:   true,
+			SourceType: types.ImageService,
+			Source:     tt.source,
+			Internal:   tt.internal,
+		}
+
+		image, err := ctl.storageImage(tt.tenantID, s)
+		if tt.valid && (err != nil || image.ID != s.Source && image.Name != s.Source) {
+			t.Errorf("Expected %s to be usable by %s: %v", tt.source, tt.tenantID, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("Expected %s not to be usable by %s", tt.source, tt.tenantID)
+		}
+	}
+}
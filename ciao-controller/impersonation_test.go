@@ -0,0 +1,108 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func onBehalfOf(tenantID string) http.Header {
+	header := http.Header{}
+	header.Set(api.OnBehalfOfHeader, tenantID)
+	return header
+}
+
+func TestImpersonation(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(api.RequestedVolume{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/volumes"
+	_ = testHTTPRequestWithHeader(t, "POST", url, http.StatusAccepted, b, onBehalfOf(tenant.ID))
+
+	// the tenant impersonated is charged for the volume
+	qd := findQuota(ctl.ListQuotas(tenant.ID), "tenant-volumes-quota")
+	if qd == nil || qd.Usage != 1 {
+		t.Errorf("Volume not charged to tenant: %+v", qd)
+	}
+
+	events := testListTenantEvents(t, testutil.ComputeURL+"/"+tenant.ID+"/events?type=action")
+	if len(events.Events) != 1 {
+		t.Fatalf("Expected one action: %+v", events.Events)
+	}
+
+	e := events.Events[0]
+	if e.Actor != "admin" || e.OnBehalfOf != tenant.ID || e.TenantID != tenant.ID {
+		t.Errorf("Action does not record both identities: %+v", e)
+	}
+
+	// the scope is that of the tenant impersonated
+	_ = testHTTPRequestWithHeader(t, "GET", testutil.ComputeURL+"/"+other.ID+"/volumes", http.StatusUnauthorized, nil, onBehalfOf(tenant.ID))
+	_ = testHTTPRequestWithHeader(t, "GET", testutil.ComputeURL+"/tenants", http.StatusForbidden, nil, onBehalfOf(tenant.ID))
+	_ = testHTTPRequestWithHeader(t, "GET", url, http.StatusNotFound, nil, onBehalfOf("no-such-tenant"))
+
+	// impersonation may be disabled
+	restore := setTestConfig(func(cfg *controllerConfig) {
+		cfg.Impersonation = false
+	})
+	_ = testHTTPRequestWithHeader(t, "GET", url, http.StatusForbidden, nil, onBehalfOf(tenant.ID))
+	restore()
+}
+
+func TestImpersonationNotAdmin(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := createTestCA(t, "impersonation CA")
+	registerTestTenantCA(t, tenant.ID, ca, http.StatusCreated)
+	defer func() { _ = ctl.DeleteTenantCA(tenant.ID) }()
+
+	user := certClient(ca.clientCert(t, "user", []string{tenant.ID}))
+
+	for _, id := range []string{other.ID, tenant.ID} {
+		url := testutil.ComputeURL + "/" + id + "/volumes"
+		if status := certRequest(t, user, "GET", url, onBehalfOf(id)); status != http.StatusForbidden {
+			t.Errorf("Expected non-admin impersonating %s to be refused: %d", id, status)
+		}
+	}
+
+	events := testListTenantEvents(t, testutil.ComputeURL+"/"+other.ID+"/events")
+	if len(events.Events) != 0 {
+		t.Errorf("Refused impersonation logged events: %+v", events.Events)
+	}
+}
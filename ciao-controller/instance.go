@@ -17,18 +17,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/ciao-controller/utils"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -39,6 +42,7 @@ type config struct {
 	cnci   bool
 	mac    string
 	ip     string
+	nics   []types.NIC
 }
 
 type instance struct {
@@ -53,26 +57,77 @@ type userData struct {
 	Hostname string `json:"hostname"`
 }
 
+// launchFailure classifies err as a failure to launch an instance, unless
+// the layer which failed has already classified it.
+func launchFailure(code types.LaunchFailureCode, err error) error {
+	if _, ok := errors.Cause(err).(*types.LaunchError); ok {
+		return err
+	}
+	return &types.LaunchError{Code: code, Err: err}
+}
+
+// launchFailureCode returns the classification of a failure to launch an
+// instance, or "" if the failure was not classified.
+func launchFailureCode(err error) types.LaunchFailureCode {
+	if e, ok := errors.Cause(err).(*types.LaunchError); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// networkFull reports whether a tenant IP address could not be allocated
+// because the tenant network has no free addresses.
+func networkFull(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*types.SubnetFullError); ok {
+		return true
+	}
+	return cause == types.ErrSubnetExhausted
+}
+
 func isCNCIWorkload(workload *types.Workload) bool {
 	return workload.Requirements.NetworkNode
 }
 
-func newInstance(ctl *controller, tenantID string, workload *types.Workload,
-	name string, subnet string, IPAddr net.IP) (*instance, error) {
+// workloadVisible reports whether tenantID may launch workload. Internal
+// workloads, such as the CNCI, are only launched by the controller itself onto
+// a given subnet.
+func workloadVisible(workload *types.Workload, tenantID string, subnet string) bool {
+	switch workload.Visibility {
+	case types.Public:
+		return true
+	case types.Internal:
+		return subnet != ""
+	default:
+		return workload.TenantID == tenantID
+	}
+}
+
+func newInstance(ctx context.Context, ctl *controller, tenantID string, workload *types.Workload,
+	name string, subnet string, IPAddr net.IP, p placement) (*instance, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if !workloadVisible(workload, tenantID, subnet) {
+		return nil, launchFailure(types.LaunchInvalidRequest, types.ErrWorkloadNotFound)
+	}
+
 	id := uuid.Generate()
 
-	if name != "" {
+	// CNCIs in the CNCI pool have no tenant whose names they could clash with
+	if name != "" && tenantID != "" {
 		existingID, err := ctl.ds.ResolveInstance(tenantID, name)
 		if err != nil {
-			return nil, errors.Wrap(err, "error trying to resolve name")
+			return nil, launchFailure(types.LaunchInternal, errors.Wrap(err, "error trying to resolve name"))
 		}
 
 		if existingID != "" {
-			return nil, fmt.Errorf("Instance name already in use: %s", name)
+			return nil, launchFailure(types.LaunchInvalidRequest, fmt.Errorf("Instance name already in use: %s", name))
 		}
 	}
 
-	config, err := newConfig(ctl, workload, id.String(), tenantID, name, IPAddr)
+	config, err := newConfig(ctx, ctl, workload, id.String(), tenantID, name, IPAddr, p)
 	if err != nil {
 		return nil, err
 	}
@@ -87,11 +142,18 @@ func newInstance(ctl *controller, tenantID string, workload *types.Workload,
 		VnicUUID:    config.sc.Start.Networking.VnicUUID,
 		Subnet:      config.sc.Start.Networking.Subnet,
 		MACAddress:  config.mac,
+		NICs:        config.nics,
 		CreateTime:  time.Now(),
 		Name:        name,
 		StateChange: sync.NewCond(&sync.Mutex{}),
 	}
 
+	if !config.cnci {
+		newInstance.VCPUs = workload.Requirements.VCPUs
+		newInstance.MemMB = workload.Requirements.MemMB
+		newInstance.EphemeralGB = localStorageSize(config.sc.Start.Storage)
+	}
+
 	if subnet != "" {
 		newInstance.Subnet = subnet
 	}
@@ -105,12 +167,17 @@ func newInstance(ctl *controller, tenantID string, workload *types.Workload,
 	return i, nil
 }
 
-func (i *instance) Add() error {
+func (i *instance) Add(ctx context.Context) error {
 	ds := i.ctl.ds
 	var err error
-	err = ds.AddInstance(i.Instance)
+	err = ds.AddInstance(ctx, i.Instance)
+	if err != nil {
+		return launchFailure(types.LaunchInternal, errors.Wrapf(err, "Error creating instance in datastore"))
+	}
+
+	err = ds.SetLaunchConfig(ctx, i.Instance.ID, i.newConfig.config)
 	if err != nil {
-		return errors.Wrapf(err, "Error creating instance in datastore")
+		return launchFailure(types.LaunchInternal, errors.Wrapf(err, "Error recording instance configuration"))
 	}
 
 	for _, volume := range i.newConfig.sc.Start.Storage {
@@ -120,12 +187,12 @@ func (i *instance) Add() error {
 		}
 		_, err = ds.GetBlockDevice(volume.ID)
 		if err != nil {
-			return fmt.Errorf("Invalid block device mapping.  %s already in use", volume.ID)
+			return launchFailure(types.LaunchStorageError, fmt.Errorf("Invalid block device mapping.  %s already in use", volume.ID))
 		}
 
-		_, err = ds.CreateStorageAttachment(i.Instance.ID, volume)
+		_, err = ds.CreateStorageAttachment(ctx, i.Instance.ID, volume)
 		if err != nil {
-			return errors.Wrap(err, "Error creating storage attachment")
+			return launchFailure(types.LaunchStorageError, errors.Wrap(err, "Error creating storage attachment"))
 		}
 	}
 
@@ -140,23 +207,26 @@ func (i *instance) Clean() error {
 
 	err := i.ctl.ds.ReleaseTenantIP(i.TenantID, i.IPAddress)
 	if err != nil {
-		return errors.Wrap(err, "error releasing tenant IP")
+		return launchFailure(types.LaunchInternal, errors.Wrap(err, "error releasing tenant IP"))
+	}
+
+	for _, nic := range i.NICs {
+		err = i.ctl.ds.ReleaseTenantIP(i.TenantID, nic.IPAddress)
+		if err != nil {
+			return launchFailure(types.LaunchInternal, errors.Wrap(err, "error releasing tenant IP"))
+		}
 	}
 
 	wl, err := i.ctl.ds.GetWorkload(i.WorkloadID)
 	if err != nil {
-		return errors.Wrap(err, "error getting workload from datastore")
+		return launchFailure(types.LaunchInternal, errors.Wrap(err, "error getting workload from datastore"))
 	}
 
-	resources := []payloads.RequestedResource{
-		{Type: payloads.Instance, Value: 1},
-		{Type: payloads.MemMB, Value: wl.Requirements.MemMB},
-		{Type: payloads.VCPUs, Value: wl.Requirements.VCPUs}}
-	i.ctl.qs.Release(i.TenantID, resources...)
+	i.ctl.qs.Release(i.TenantID, instanceResources(i.Instance, &wl)...)
 
 	err = i.ctl.deleteEphemeralStorage(i.ID)
 	if err != nil {
-		return errors.Wrap(err, "error deleting ephemeral strorage")
+		return launchFailure(types.LaunchStorageError, errors.Wrap(err, "error deleting ephemeral strorage"))
 	}
 
 	return nil
@@ -172,19 +242,72 @@ func (i *instance) Allowed() (bool, error) {
 
 	wl, err := ds.GetWorkload(i.WorkloadID)
 	if err != nil {
-		return true, errors.Wrap(err, "error getting workload from datastore")
+		return true, launchFailure(types.LaunchInternal, errors.Wrap(err, "error getting workload from datastore"))
 	}
 
-	resources := []payloads.RequestedResource{
-		{Type: payloads.Instance, Value: 1},
-		{Type: payloads.MemMB, Value: wl.Requirements.MemMB},
-		{Type: payloads.VCPUs, Value: wl.Requirements.VCPUs}}
-	res := <-i.ctl.qs.Consume(i.TenantID, resources...)
+	res := <-i.ctl.qs.Consume(i.TenantID, instanceResources(i.Instance, &wl)...)
+	if !res.Allowed() {
+		i.ctl.quotaExceeded(i.TenantID, res)
+	}
 
 	// Cleanup on disallowed happens in Clean()
 	return res.Allowed(), nil
 }
 
+// instanceResources returns the quota tracked resources held by an instance.
+// Instances record the requirements they were launched with, which may have
+// been overridden; older instances fall back to those of their workload.
+func instanceResources(i *types.Instance, wl *types.Workload) []payloads.RequestedResource {
+	memMB := i.MemMB
+	if memMB == 0 {
+		memMB = wl.Requirements.MemMB
+	}
+
+	vcpus := i.VCPUs
+	if vcpus == 0 {
+		vcpus = wl.Requirements.VCPUs
+	}
+
+	// launcher created storage is charged to the instance as it has no
+	// volume of its own.  The instance always counts against the quota of
+	// its workload, even if none is set, so that releasing it is exact.
+	return []payloads.RequestedResource{
+		{Type: payloads.Instance, Value: 1},
+		{Type: payloads.MemMB, Value: memMB},
+		{Type: payloads.VCPUs, Value: vcpus},
+		{Type: payloads.SharedDiskGiB, Value: i.EphemeralGB},
+		{Type: quotas.WorkloadInstances(wl.ID), Value: 1}}
+}
+
+// instanceRequirements returns the requirements an instance runs with,
+// which may have been overridden when it was launched or changed by a
+// resize.  Older instances fall back to those of their workload.
+func instanceRequirements(i *types.Instance, wl *types.Workload) payloads.WorkloadRequirements {
+	reqs := wl.Requirements
+
+	if i.VCPUs != 0 {
+		reqs.VCPUs = i.VCPUs
+	}
+
+	if i.MemMB != 0 {
+		reqs.MemMB = i.MemMB
+	}
+
+	return reqs
+}
+
+// localStorageSize returns the total size of the storage the launcher will
+// create for an instance.
+func localStorageSize(storage []payloads.StorageResource) int {
+	size := 0
+	for _, s := range storage {
+		if s.ID == "" && s.Local {
+			size += s.Size
+		}
+	}
+	return size
+}
+
 func instanceActive(i *types.Instance) bool {
 	i.StateLock.RLock()
 	defer i.StateLock.RUnlock()
@@ -196,10 +319,62 @@ func instanceActive(i *types.Instance) bool {
 	return false
 }
 
-func getStorage(c *controller, s types.StorageResource, tenant string, instanceID string) (payloads.StorageResource, error) {
+// workloadStorage returns the storage resource an instance is started with
+// for the storage s of its workload, given the ID of the volume created for
+// it, if one is created.
+func workloadStorage(s types.StorageResource, volumeID string) payloads.StorageResource {
 	// storage already exists, use preexisting definition.
 	if s.ID != "" {
-		return payloads.StorageResource{ID: s.ID, Bootable: s.Bootable}, nil
+		return payloads.StorageResource{ID: s.ID, Bootable: s.Bootable, BootIndex: s.BootIndex}
+	}
+
+	// the launcher creates local storage itself.
+	if s.Local {
+		return payloads.StorageResource{Ephemeral: true, Local: true, Size: s.Size, Tag: s.Tag, BootIndex: s.BootIndex}
+	}
+
+	return payloads.StorageResource{ID: volumeID, Bootable: s.Bootable, BootIndex: s.BootIndex, Ephemeral: s.Ephemeral}
+}
+
+// bootRank returns the group a storage resource is sorted into by
+// bootOrder, and its position within the group.
+func bootRank(s types.StorageResource) (int, int) {
+	switch {
+	case s.BootIndex != nil:
+		return 0, *s.BootIndex
+	case s.Bootable:
+		return 1, 0
+	}
+	return 2, 0
+}
+
+// bootOrder returns the order in which the storage of a workload is given
+// to the launcher, as indexes into storage.  Instances whose workload does
+// not index its storage boot from the first disk the launcher attaches, so
+// resources with a boot index come first, in index order, followed by the
+// bootable resource and then the data disks, which keep the order of the
+// workload.
+func bootOrder(storage []types.StorageResource) []int {
+	order := make([]int, len(storage))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		gi, pi := bootRank(storage[order[i]])
+		gj, pj := bootRank(storage[order[j]])
+		if gi != gj {
+			return gi < gj
+		}
+		return pi < pj
+	})
+
+	return order
+}
+
+func getStorage(ctx context.Context, c *controller, s types.StorageResource, tenant string, instanceID string) (payloads.StorageResource, error) {
+	if s.ID != "" || s.Local {
+		return workloadStorage(s, ""), nil
 	}
 
 	var err error
@@ -211,20 +386,32 @@ func getStorage(c *controller, s types.StorageResource, tenant string, instanceI
 
 	switch s.SourceType {
 	case types.ImageService:
-		req.ImageRef = s.Source
+		image, err := c.storageImage(tenant, s)
+		if err != nil {
+			code := types.LaunchInternal
+			if errors.Cause(err) == api.ErrNoImage {
+				code = types.LaunchInvalidRequest
+			}
+			return payloads.StorageResource{}, launchFailure(code, errors.Wrapf(err, "Unable to use image %s", s.Source))
+		}
+		req.ImageRef = image.ID
 	case types.VolumeService:
 		req.SourceVolID = s.Source
 	case types.Empty:
 		break
 	default:
-		return payloads.StorageResource{}, errors.New("Unsupported workload storage variant in getStorage()")
+		return payloads.StorageResource{}, launchFailure(types.LaunchInvalidRequest, errors.New("Unsupported workload storage variant in getStorage()"))
 	}
 
-	volume, err := c.CreateVolume(tenant, req)
+	volume, err := c.CreateVolume(ctx, tenant, req)
 	if err != nil {
-		return payloads.StorageResource{}, errors.Wrap(err, "Error creating volume")
+		code := types.LaunchStorageError
+		if cause := errors.Cause(err); cause == api.ErrQuota || cause == types.ErrQuota {
+			code = types.LaunchQuotaExceeded
+		}
+		return payloads.StorageResource{}, launchFailure(code, errors.Wrap(err, "Error creating volume"))
 	}
-	return payloads.StorageResource{ID: volume.ID, Bootable: s.Bootable, Ephemeral: s.Ephemeral}, nil
+	return workloadStorage(s, volume.ID), nil
 }
 
 func networkConfig(ctl *controller, tenant *types.Tenant, networking *payloads.NetworkResources, cnci bool, ipAddress net.IP) error {
@@ -233,7 +420,7 @@ func networkConfig(ctl *controller, tenant *types.Tenant, networking *payloads.N
 	if cnci {
 		hwaddr, err := utils.NewHardwareAddr()
 		if err != nil {
-			return err
+			return launchFailure(types.LaunchInternal, err)
 		}
 
 		networking.VnicMAC = hwaddr.String()
@@ -253,7 +440,7 @@ func networkConfig(ctl *controller, tenant *types.Tenant, networking *payloads.N
 
 	cnciInstance, err := tenant.CNCIctrl.GetSubnetCNCI(networking.Subnet)
 	if err != nil {
-		return err
+		return launchFailure(types.LaunchNetworkNotReady, err)
 	}
 
 	networking.ConcentratorUUID = cnciInstance.ID
@@ -264,43 +451,175 @@ func networkConfig(ctl *controller, tenant *types.Tenant, networking *payloads.N
 	return nil
 }
 
-func newConfig(ctl *controller, wl *types.Workload, instanceID string, tenantID string,
-	name string, IPaddr net.IP) (config, error) {
-	var metaData userData
-	var config config
-	var networking payloads.NetworkResources
-	var storage []payloads.StorageResource
+// extraNetworkConfig allocates an address and builds the network
+// configuration for each additional network interface of an instance of wl.
+// The addresses are released again if any of them cannot be configured.
+func extraNetworkConfig(ctl *controller, tenant *types.Tenant, wl *types.Workload) ([]payloads.NetworkResources, []types.NIC, error) {
+	var extra []payloads.NetworkResources
+	var nics []types.NIC
 
-	baseConfig := wl.Config
+	release := func() {
+		for _, nic := range nics {
+			_ = ctl.ds.ReleaseTenantIP(tenant.ID, nic.IPAddress)
+		}
+	}
 
-	fwType := wl.FWType
-	config.cnci = isCNCIWorkload(wl)
-	metaData.UUID = instanceID
+	for _, n := range wl.Networks {
+		var IPAddr net.IP
+		var err error
+		if n.Subnet == "" {
+			IPAddr, err = ctl.ds.AllocateTenantIP(tenant.ID)
+		} else {
+			IPAddr, err = ctl.ds.AllocateTenantSubnetIP(tenant.ID, n.Subnet)
+		}
+		if err != nil {
+			release()
+			code := types.LaunchNetworkNotReady
+			if networkFull(err) {
+				code = types.LaunchNetworkFull
+			}
+			return nil, nil, launchFailure(code, errors.Wrap(err, "error allocating tenant IP"))
+		}
 
-	tenant, err := ctl.ds.GetTenant(tenantID)
-	if err != nil {
-		fmt.Println("unable to get tenant")
+		var networking payloads.NetworkResources
+		err = networkConfig(ctl, tenant, &networking, false, IPAddr)
+		if err != nil {
+			_ = ctl.ds.ReleaseTenantIP(tenant.ID, IPAddr.String())
+			release()
+			return nil, nil, err
+		}
+
+		extra = append(extra, networking)
+		nics = append(nics, types.NIC{
+			VnicUUID:   networking.VnicUUID,
+			MACAddress: networking.VnicMAC,
+			Subnet:     networking.Subnet,
+			IPAddress:  networking.PrivateIP,
+		})
 	}
 
-	err = networkConfig(ctl, tenant, &networking, config.cnci, IPaddr)
+	return extra, nics, nil
+}
+
+// nicNetworking returns the network configuration of the additional network
+// interfaces an instance was launched with, such as is needed to start it
+// again.
+func nicNetworking(tenant *types.Tenant, nics []types.NIC) ([]payloads.NetworkResources, error) {
+	var extra []payloads.NetworkResources
+
+	for _, nic := range nics {
+		cnci, err := tenant.CNCIctrl.GetSubnetCNCI(nic.Subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		extra = append(extra, payloads.NetworkResources{
+			VnicMAC:          nic.MACAddress,
+			VnicUUID:         nic.VnicUUID,
+			ConcentratorUUID: cnci.ID,
+			ConcentratorIP:   cnci.IPAddress,
+			Subnet:           nic.Subnet,
+			PrivateIP:        nic.IPAddress,
+		})
+	}
+
+	return extra, nil
+}
+
+// renderedConfig holds the documents an instance is started with.
+type renderedConfig struct {
+	start     string
+	cloudInit string
+	metaData  string
+}
+
+// String joins the documents into the configuration sent to the launcher.
+func (r renderedConfig) String() string {
+	return "---\n" + r.start + "...\n" + r.cloudInit + "---\n" + r.metaData + "\n...\n"
+}
+
+// splitConfig splits the configuration sent to the launcher back into its
+// documents.
+func splitConfig(config string) (renderedConfig, error) {
+	var r renderedConfig
+
+	if !strings.HasPrefix(config, "---\n") || !strings.HasSuffix(config, "\n...\n") {
+		return r, errors.New("Malformed instance configuration")
+	}
+
+	end := strings.Index(config, "\n...\n")
+	r.start = config[len("---\n") : end+1]
+
+	rest := strings.TrimSuffix(config[end+len("\n...\n"):], "\n...\n")
+	meta := strings.LastIndex(rest, "---\n")
+	if meta < 0 {
+		return r, errors.New("Malformed instance configuration")
+	}
+	r.cloudInit = rest[:meta]
+	r.metaData = rest[meta+len("---\n"):]
+
+	return r, nil
+}
+
+// mergeUserData returns the cloud-init config of a workload with the top
+// level keys of an instance's user data added to it, replacing any the
+// workload sets.
+func mergeUserData(config string, userData string) (string, error) {
+	var base, user yaml.MapSlice
+
+	// the launcher ignores anything following the end of the document
+	if end := strings.Index(config, "\n...\n"); end >= 0 {
+		config = config[:end+1]
+	}
+
+	err := yaml.Unmarshal([]byte(config), &base)
 	if err != nil {
-		return config, err
+		return "", errors.Wrap(err, "error parsing workload config")
 	}
 
-	metaData.Hostname = instanceID
-	if name != "" {
-		metaData.Hostname = name
+	err = yaml.Unmarshal([]byte(userData), &user)
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing user data")
 	}
 
-	config.ip = networking.PrivateIP
+	for _, item := range user {
+		i := 0
+		for ; i < len(base); i++ {
+			if base[i].Key == item.Key {
+				base[i].Value = item.Value
+				break
+			}
+		}
 
-	// handle storage resources in workload definition
-	for i := range wl.Storage {
-		workloadStorage, err := getStorage(ctl, wl.Storage[i], tenantID, instanceID)
-		if err != nil {
-			return config, err
+		if i == len(base) {
+			base = append(base, item)
 		}
-		storage = append(storage, workloadStorage)
+	}
+
+	b, err := yaml.Marshal(base)
+	if err != nil {
+		return "", errors.Wrap(err, "error marshalling user data")
+	}
+
+	return "---\n#cloud-config\n" + string(b) + "...\n", nil
+}
+
+// renderConfig renders the START payload and the documents with which an
+// instance of wl is started, given the network and storage resources
+// allocated to it and the nodes on which it is preferably, or must not be,
+// placed.  It has no side effects so that configurations may be
+// previewed as well as launched.
+func renderConfig(wl *types.Workload, instanceID string, tenantID string, name string,
+	networking payloads.NetworkResources, extra []payloads.NetworkResources,
+	storage []payloads.StorageResource, p placement) (payloads.Start, renderedConfig, error) {
+	var r renderedConfig
+
+	metaData := userData{
+		UUID:     instanceID,
+		Hostname: instanceID,
+	}
+	if name != "" {
+		metaData.Hostname = name
 	}
 
 	// hardcode persistence until changes can be made to workload
@@ -309,12 +628,15 @@ func newConfig(ctl *controller, wl *types.Workload, instanceID string, tenantID
 	startCmd := payloads.StartCmd{
 		TenantUUID:          tenantID,
 		InstanceUUID:        instanceID,
-		FWType:              payloads.Firmware(fwType),
+		FWType:              payloads.Firmware(wl.FWType),
 		VMType:              wl.VMType,
 		InstancePersistence: payloads.Host,
 		Networking:          networking,
+		ExtraNetworking:     extra,
 		Storage:             storage,
 		Requirements:        wl.Requirements,
+		PreferredNodes:      p.preferred,
+		AvoidNodes:          p.avoid,
 	}
 
 	if wl.VMType == payloads.Docker {
@@ -324,20 +646,83 @@ func newConfig(ctl *controller, wl *types.Workload, instanceID string, tenantID
 	cmd := payloads.Start{
 		Start: startCmd,
 	}
-	config.sc = cmd
 
-	y, err := yaml.Marshal(&config.sc)
+	y, err := yaml.Marshal(&cmd)
 	if err != nil {
-		glog.Warning("error marshalling config: ", err)
+		return cmd, r, launchFailure(types.LaunchInternal, errors.Wrap(err, "error marshalling config"))
 	}
 
 	b, err := json.MarshalIndent(metaData, "", "\t")
 	if err != nil {
-		glog.Warning("error marshalling user data: ", err)
+		return cmd, r, launchFailure(types.LaunchInternal, errors.Wrap(err, "error marshalling user data"))
+	}
+
+	r.start = string(y)
+	r.cloudInit = wl.Config
+	r.metaData = string(b)
+
+	return cmd, r, nil
+}
+
+func newConfig(ctx context.Context, ctl *controller, wl *types.Workload, instanceID string, tenantID string,
+	name string, IPaddr net.IP, p placement) (config, error) {
+	var config config
+	var networking payloads.NetworkResources
+	var storage []payloads.StorageResource
+
+	config.cnci = isCNCIWorkload(wl)
+
+	// CNCIs in the CNCI pool do not yet belong to a tenant
+	var tenant *types.Tenant
+	var err error
+	if !config.cnci {
+		tenant, err = ctl.ds.GetTenant(tenantID)
+		if err != nil {
+			return config, launchFailure(types.LaunchInternal, errors.Wrap(err, "error getting tenant"))
+		}
+	}
+
+	err = networkConfig(ctl, tenant, &networking, config.cnci, IPaddr)
+	if err != nil {
+		return config, err
+	}
+
+	config.ip = networking.PrivateIP
+
+	// handle storage resources in workload definition
+	for _, i := range bootOrder(wl.Storage) {
+		workloadStorage, err := getStorage(ctx, ctl, wl.Storage[i], tenantID, instanceID)
+		if err != nil {
+			return config, err
+		}
+		storage = append(storage, workloadStorage)
+	}
+
+	var extra []payloads.NetworkResources
+	if !config.cnci && len(wl.Networks) > 0 {
+		extra, config.nics, err = extraNetworkConfig(ctl, tenant, wl)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	// the placement policy of a server group takes precedence over the
+	// preference for nodes which have cached the instance's images
+	if p.preferred == nil {
+		p.preferred = ctl.preferredNodes(tenantID, wl)
+	}
+
+	sc, rendered, err := renderConfig(wl, instanceID, tenantID, name, networking, extra, storage, p)
+	if err != nil {
+		for _, nic := range config.nics {
+			_ = ctl.ds.ReleaseTenantIP(tenantID, nic.IPAddress)
+		}
+		return config, err
 	}
 
-	config.config = "---\n" + string(y) + "...\n" + baseConfig + "---\n" + string(b) + "\n...\n"
+	config.sc = sc
+	config.config = rendered.String()
 	config.mac = networking.VnicMAC
 
-	return config, err
+	return config, nil
 }
@@ -20,9 +20,11 @@
 package datastore
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
 	"sort"
 	"sync"
@@ -30,19 +32,29 @@ import (
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-controller/utils"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
 	"github.com/ciao-project/ciao/uuid"
 	jsonpatch "github.com/evanphx/json-patch"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
 )
 
+// defaultCNCIImage is the image CNCIs are launched from until another is
+// registered.
+const defaultCNCIImage = "4e16e743-265a-4bf2-9fd1-57ada0b28904"
+
 // custom errors
 var (
 	ErrNoTenant            = errors.New("Tenant not found")
 	ErrNoBlockData         = errors.New("Block Device not found")
 	ErrNoStorageAttachment = errors.New("No Volume Attached")
+	ErrNoIdempotencyKey    = errors.New("Idempotency key not found")
+	ErrNoMigration         = errors.New("Instance is not being migrated")
+	ErrDuplicateTenant     = errors.New("Duplicate Tenant ID")
 )
 
 // Config contains configuration information for the datastore.
@@ -50,18 +62,68 @@ type Config struct {
 	DBBackend         persistentStore
 	PersistentURI     string
 	InitWorkloadsPath string
+	Log               clogger.CiaoLog
+
+	// LegacyStatsPath, if set, is the path of a statistics database
+	// written by older controllers.  Its contents are imported into the
+	// persistent database and the file is renamed.
+	LegacyStatsPath string
+
+	// EventDropped, if set, is called with the type of each event
+	// dropped because the event queue was full.
+	EventDropped func(eventType string)
+
+	// EventsLogged, if set, is called with the events written to the
+	// event log, including their IDs, in the order they were written.
+	EventsLogged func(events []types.LogEntry)
+
+	// QueryObserved, if set, is called with the kind of each statement
+	// run against the persistent database, e.g., "select" or "insert",
+	// and how long it took.
+	QueryObserved func(statement string, d time.Duration)
+
+	// Now, if set, replaces time.Now when recording the time at which
+	// billable resources and tenant addresses are released.
+	Now func() time.Time
+
+	// IPAllocation is the strategy with which the addresses of tenant
+	// subnets are given to instances, IPAllocationSequential if empty.
+	IPAllocation string
 }
 
+// Strategies with which the free addresses of a tenant subnet are given
+// to instances.
+const (
+	// IPAllocationSequential gives out the lowest free address.
+	IPAllocationSequential = "sequential"
+
+	// IPAllocationLRU gives out the addresses which have never been
+	// used, then those which were released longest ago, so that freed
+	// addresses are not reused while they may still be cached.
+	IPAllocationLRU = "lru"
+
+	// IPAllocationRandom gives out the free addresses in random order.
+	IPAllocationRandom = "random"
+)
+
 type userEventType string
 
 const (
-	userInfo  userEventType = "info"
-	userError userEventType = "error"
+	userInfo   userEventType = "info"
+	userError  userEventType = "error"
+	userAction userEventType = "action"
+
+	// the state changes of instances, volumes and nodes are logged so
+	// that they can be followed through the event log.
+	instanceState userEventType = "instance_state"
+	volumeState   userEventType = "volume_state"
+	nodeStatus    userEventType = "node_status"
 )
 
 type tenant struct {
 	types.Tenant
 	network   map[uint32]map[uint32]bool
+	released  map[uint32]time.Time
 	instances map[string]*types.Instance
 	devices   map[string]types.Volume
 	workloads []string
@@ -71,6 +133,9 @@ type tenant struct {
 type node struct {
 	types.Node
 	instances map[string]*types.Instance
+
+	// liveness is set when the node has stopped sending stats
+	liveness types.NodeStatusType
 }
 
 type attachment struct {
@@ -83,25 +148,36 @@ type tenantIP struct {
 	host   uint32
 }
 
+// historyOwner identifies the tenant of an instance with a history and
+// when its history was last added to.
+type historyOwner struct {
+	tenantID  string
+	timestamp time.Time
+}
+
 type persistentStore interface {
 	init(config Config) error
 	disconnect()
 
 	// interfaces related to logging
 	logEvent(event types.LogEntry) error
+	// logEvents adds events to the log and sets the IDs they are given.
+	logEvents(events []types.LogEntry) error
 	clearLog() error
 	getEventLog() (logEntries []*types.LogEntry, err error)
+	getEventsForTenant(tenantID string, filter types.EventFilter) ([]*types.LogEntry, error)
 
 	// interfaces related to workloads
 	addWorkload(wl types.Workload) error
+	updateWorkload(wl types.Workload) error
 	deleteWorkload(ID string) error
 	getWorkloads() ([]types.Workload, error)
 
 	// interfaces related to tenants
-	addTenant(id string, config types.TenantConfig) (err error)
+	addTenant(id string, config types.TenantConfig, qds ...types.QuotaDetails) (err error)
 	getTenant(id string) (t *tenant, err error)
 	getTenants() ([]*tenant, error)
-	releaseTenantIP(tenantID string, subnetInt uint32, rest uint32) (err error)
+	releaseTenantIP(tenantID string, subnetInt uint32, rest uint32, released time.Time) (err error)
 	claimTenantIP(tenantID string, subnetInt uint32, rest uint32) (err error)
 	claimTenantIPs(tenantID string, IPs []tenantIP) (err error)
 	updateTenant(tenant *types.Tenant) error
@@ -109,26 +185,52 @@ type persistentStore interface {
 
 	// interfaces related to instances
 	getInstances() (instances []*types.Instance, err error)
-	addInstance(instance *types.Instance) (err error)
+	addInstance(ctx context.Context, instance *types.Instance) (err error)
 	deleteInstance(instanceID string) (err error)
 	updateInstance(instance *types.Instance) (err error)
+	updateInstanceName(instanceID string, name string) error
+	updateInstanceDescription(instanceID string, description string) error
+	updateInstanceDeletionProtection(instanceID string, protected bool) error
+	updateInstanceRequirements(instanceID string, vcpus int, memMB int) error
+	filterInstances(tenantID string, match types.InstanceFilter) ([]string, error)
+	searchWorkloads(tenantID string, search string) ([]string, error)
+	addPlacement(instanceID string, p types.Placement) error
+	updateInstanceNode(instanceID string, nodeID string) error
+	updateInstanceStatusReason(instanceID string, reason string) error
+	updateInstanceDeleteTime(ctx context.Context, instanceID string, deleteTime time.Time) error
+	updateInstanceTenant(instanceID string, tenantID string, subnet string) error
+	getPlacements(instanceID string) ([]types.Placement, error)
+	getInstanceConditions() (map[string][]types.InstanceCondition, error)
+	updateInstanceConditions(instanceID string, conditions []types.InstanceCondition) error
+	getInstanceTags() (map[string]map[string]string, error)
+	setInstanceTag(instanceID string, key string, value string) error
+	deleteInstanceTag(instanceID string, key string) error
+	addHistoryEntry(instanceID string, tenantID string, e types.InstanceHistoryEntry) error
+	getHistory(instanceID string) (string, []types.InstanceHistoryEntry, error)
+	getLastHistoryEntries() (map[string]historyOwner, error)
+	deleteHistory(instanceID string) error
 
 	// interfaces related to statistics
 	addNodeStat(stat payloads.Stat) (err error)
 	addInstanceStats(stats []payloads.InstanceStat, nodeID string) (err error)
 	addFrameStat(stat payloads.FrameTrace) (err error)
 	getBatchFrameSummary() (stats []types.BatchFrameSummary, err error)
+	getNodeInstanceSummary(nodeID string) (types.CiaoNodeSummary, error)
 	getBatchFrameStatistics(label string) (stats []types.BatchFrameStat, err error)
 
 	// storage interfaces
 	getWorkloadStorage(ID string) ([]types.StorageResource, error)
 	getAllBlockData() (map[string]types.Volume, error)
-	addBlockData(data types.Volume) error
-	updateBlockData(data types.Volume) error
-	deleteBlockData(string) error
+	addBlockData(ctx context.Context, data types.Volume) error
+	updateBlockData(ctx context.Context, data types.Volume) error
+	updateBlockDeletionProtection(ctx context.Context, ID string, protected bool) error
+	updateBlockSize(ctx context.Context, ID string, size int) error
+	deleteBlockData(ctx context.Context, ID string) error
 	getTenantDevices(tenantID string) (map[string]types.Volume, error)
-	addStorageAttachment(a types.StorageAttachment) error
+	addStorageAttachment(ctx context.Context, a types.StorageAttachment) error
+	updateStorageAttachmentDevice(ID string, device string) error
 	getAllStorageAttachments() (map[string]types.StorageAttachment, error)
+	getAttachmentDetails(filter types.AttachmentFilter) ([]types.AttachmentDetails, error)
 	deleteStorageAttachment(ID string) error
 
 	// external IP interfaces
@@ -137,7 +239,7 @@ type persistentStore interface {
 	getAllPools() map[string]types.Pool
 	deletePool(ID string) error
 
-	addMappedIP(m types.MappedIP) error
+	addMappedIP(m types.MappedIP, free int) error
 	deleteMappedIP(ID string) error
 	getMappedIPs() map[string]types.MappedIP
 
@@ -149,11 +251,140 @@ type persistentStore interface {
 	updateImage(i types.Image) error
 	deleteImage(ID string) error
 	getImages() ([]types.Image, error)
+
+	// webhooks
+	updateWebhook(w types.Webhook) error
+	deleteWebhook(ID string) error
+	getWebhooks() ([]types.Webhook, error)
+
+	// operations
+	updateOperation(o types.Operation) error
+	deleteOperation(ID string) error
+	getOperations() ([]types.Operation, error)
+
+	// trash
+	addTrashItem(item types.TrashItem) error
+	deleteTrashItem(ID string) error
+	getTrashItems() ([]types.TrashItem, error)
+
+	// CNCI images
+	getCNCIImage() (types.CNCIImage, error)
+	updateCNCIImage(i types.CNCIImage) error
+	getCNCIInstanceImages() (map[string]string, error)
+	updateCNCIInstanceImage(instanceID string, imageID string) error
+	deleteCNCIInstanceImage(instanceID string) error
+
+	// instance launch configs
+	getLaunchConfig(instanceID string) (string, error)
+	updateLaunchConfig(ctx context.Context, instanceID string, config string) error
+	deleteLaunchConfig(instanceID string) error
+
+	// tenant CAs
+	updateTenantCA(ca types.TenantCA) error
+	deleteTenantCA(tenantID string) error
+	getTenantCAs() ([]types.TenantCA, error)
+
+	// launch templates
+	updateLaunchTemplate(t types.LaunchTemplate) error
+	deleteLaunchTemplate(tenantID string, name string) error
+	getLaunchTemplates() ([]types.LaunchTemplate, error)
+
+	// server groups
+	getServerGroups() ([]types.ServerGroup, error)
+	addServerGroup(g types.ServerGroup) error
+	deleteServerGroup(ID string) error
+	addServerGroupMember(groupID string, instanceID string) error
+	deleteServerGroupMember(instanceID string) error
+
+	// snapshot schedules
+	updateSnapshotSchedule(s types.SnapshotSchedule) error
+	deleteSnapshotSchedule(ID string) error
+	getSnapshotSchedules() ([]types.SnapshotSchedule, error)
+	addVolumeSnapshot(s types.VolumeSnapshot) error
+	deleteVolumeSnapshot(ID string) error
+	getVolumeSnapshots() ([]types.VolumeSnapshot, error)
+
+	// image seeds
+	updateImageSeed(imageID string, seed types.ImageSeed) error
+	deleteImageSeeds(imageID string) error
+	getImageSeeds() (map[string][]types.ImageSeed, error)
+
+	// node maintenance
+	updateNodeMaintenance(nodeID string, maintenance bool) error
+	getMaintenanceNodes() ([]string, error)
+
+	// migrations
+	updateMigration(m types.Migration) error
+	deleteMigration(instanceID string) error
+	getMigrations() ([]types.Migration, error)
+
+	// workload policy
+	updatePolicyRule(r types.PolicyRule) error
+	deletePolicyRule(ID string) error
+	getPolicyRules() ([]types.PolicyRule, error)
+
+	// cluster settings
+	updateSetting(s types.SettingValue) error
+	deleteSetting(key string) error
+	getSettings() ([]types.SettingValue, error)
+
+	// launch queue
+	getQueuedLaunches() ([]types.QueuedLaunch, error)
+	addQueuedLaunch(l types.QueuedLaunch) error
+	deleteQueuedLaunch(instanceID string) error
+
+	// API keys
+	getAPIKeys() ([]types.APIKey, error)
+	updateAPIKey(k types.APIKey) error
+	deleteAPIKey(ID string) error
+
+	// bearer tokens
+	getAuthTokens() ([]types.AuthToken, error)
+	addAuthToken(t types.AuthToken) error
+	deleteAuthToken(ID string) error
+
+	// idempotency keys
+	addIdempotentResponse(r types.IdempotentResponse) error
+	getIdempotentResponse(tenantID string, key string) (types.IdempotentResponse, error)
+	pruneIdempotentResponses(before time.Time) (int, error)
+
+	// quota audit
+	addQuotaAudit(records []types.QuotaAuditRecord) error
+	getQuotaAudit(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error)
+	pruneQuotaAudit(before time.Time) (int, error)
+
+	// audit log
+	addAuditRecord(r types.AuditRecord) error
+	getAuditRecords(filter types.AuditFilter) ([]types.AuditRecord, error)
+	pruneAuditRecords(before time.Time) (int, error)
+
+	// usage
+	addReleasedUsage(span types.UsageSpan) error
+	getReleasedUsage() ([]types.UsageSpan, error)
+	pruneReleasedUsage(before time.Time) (int, error)
+	addUsageRecords(records []types.UsageRecord) error
+	getUsageRecords(filter types.UsageFilter) ([]types.UsageRecord, error)
+	lastUsageRecordEnd(granularity types.UsageGranularity) (time.Time, error)
+	pruneUsageRecords(granularity types.UsageGranularity, before time.Time) (int, error)
+
+	// interfaces related to leader election
+	acquireLease(name string, holder string, address string, expiry time.Time, now time.Time) (types.LeaderLease, error)
+	releaseLease(name string, holder string) error
+
+	// interfaces related to maintenance
+	stats() (types.DatabaseStatus, error)
+	compact() error
+	pruneStatistics(before time.Time) (int, error)
 }
 
 // Datastore provides context for the datastore package.
 type Datastore struct {
-	db persistentStore
+	db  persistentStore
+	log clogger.CiaoLog
+	now func() time.Time
+
+	// events holds the events waiting to be written to the event log.
+	events *eventQueue
 
 	nodeLastStat     map[string]types.CiaoNode
 	nodeLastStatLock *sync.RWMutex
@@ -164,7 +395,18 @@ type Datastore struct {
 	tenants     map[string]*tenant
 	tenantsLock *sync.RWMutex
 
-	cnciWorkload types.Workload
+	// ipAllocation is the strategy with which tenant addresses are
+	// allocated.  ipRand orders the free addresses under
+	// IPAllocationRandom and is protected by tenantsLock.
+	ipAllocation string
+	ipRand       *rand.Rand
+
+	// cnciLock protects the CNCI workload and the images CNCIs are
+	// launched from.
+	cnciLock           *sync.RWMutex
+	cnciWorkload       types.Workload
+	cnciImage          types.CNCIImage
+	cnciInstanceImages map[string]string
 
 	nodes     map[string]*node
 	nodesLock *sync.RWMutex
@@ -172,6 +414,15 @@ type Datastore struct {
 	instances     map[string]*types.Instance
 	instancesLock *sync.RWMutex
 
+	// pendingPlacements holds the reason for the next placement of the
+	// instances the controller is moving.  It is protected by
+	// instancesLock.
+	pendingPlacements map[string]types.PlacementReason
+
+	// instanceConditions holds the caveats reported by the launchers for
+	// each instance.  It is protected by instancesLock.
+	instanceConditions map[string][]types.InstanceCondition
+
 	tenantUsage     map[string][]types.CiaoUsage
 	tenantUsageLock *sync.RWMutex
 
@@ -184,11 +435,9 @@ type Datastore struct {
 	// maybe add a map[instanceid][]types.StorageAttachment
 	// to make retrieval of volumes faster.
 
-	pools           map[string]types.Pool
-	externalSubnets map[string]bool
-	externalIPs     map[string]bool
-	mappedIPs       map[string]types.MappedIP
-	poolsLock       *sync.RWMutex
+	pools     map[string]types.Pool
+	mappedIPs map[string]types.MappedIP
+	poolsLock *sync.RWMutex
 
 	imageLock      *sync.RWMutex
 	images         map[string]types.Image
@@ -198,25 +447,64 @@ type Datastore struct {
 	workloadsLock   *sync.RWMutex
 	workloads       map[string]types.Workload
 	publicWorkloads []string
-}
 
-func (ds *Datastore) initExternalIPs() {
-	ds.poolsLock = &sync.RWMutex{}
-	ds.externalSubnets = make(map[string]bool)
-	ds.externalIPs = make(map[string]bool)
+	webhooksLock *sync.RWMutex
+	webhooks     map[string]types.Webhook
 
-	ds.pools = ds.db.getAllPools()
+	tenantCAsLock *sync.RWMutex
+	tenantCAs     map[string]types.TenantCA
+	tenantCAGen   uint64
 
-	for _, pool := range ds.pools {
-		for _, subnet := range pool.Subnets {
-			ds.externalSubnets[subnet.CIDR] = true
-		}
+	launchTemplatesLock *sync.RWMutex
+	launchTemplates     map[string]map[string]types.LaunchTemplate
 
-		for _, IP := range pool.IPs {
-			ds.externalIPs[IP.Address] = true
-		}
-	}
+	// the server group of each member instance is indexed so that it
+	// can leave the group when it is deleted
+	serverGroupsLock     *sync.RWMutex
+	serverGroups         map[string]types.ServerGroup
+	instanceServerGroups map[string]string
+
+	// the snapshots of each volume are kept oldest first
+	snapshotSchedulesLock *sync.RWMutex
+	snapshotSchedules     map[string]types.SnapshotSchedule
+	volumeSnapshots       map[string][]types.VolumeSnapshot
+
+	// the state of each image in the image caches of the nodes, by image
+	// and then by node
+	imageSeedsLock *sync.RWMutex
+	imageSeeds     map[string]map[string]types.ImageSeed
+
+	// the nodes in maintenance, on which no new instances are started
+	nodeMaintenanceLock *sync.RWMutex
+	nodeMaintenance     map[string]bool
+
+	// the live migrations in progress, by instance
+	migrationsLock *sync.RWMutex
+	migrations     map[string]types.Migration
+
+	policyRulesLock *sync.RWMutex
+	policyRules     map[string]types.PolicyRule
 
+	settingsLock *sync.RWMutex
+	settings     map[string]types.SettingValue
+
+	apiKeysLock *sync.RWMutex
+	apiKeys     map[string]types.APIKey
+	apiKeyIDs   map[string]string
+
+	authTokensLock *sync.RWMutex
+	authTokens     map[string]types.AuthToken
+
+	operationsLock *sync.RWMutex
+	operations     map[string]types.Operation
+
+	trashLock *sync.RWMutex
+	trash     map[string]types.TrashItem
+}
+
+func (ds *Datastore) initExternalIPs() {
+	ds.poolsLock = &sync.RWMutex{}
+	ds.pools = ds.db.getAllPools()
 	ds.mappedIPs = ds.db.getMappedIPs()
 }
 
@@ -250,6 +538,328 @@ func (ds *Datastore) initImages() error {
 	return nil
 }
 
+func (ds *Datastore) initWebhooks() error {
+	ds.webhooksLock = &sync.RWMutex{}
+	ds.webhooks = make(map[string]types.Webhook)
+
+	webhooks, err := ds.db.getWebhooks()
+	if err != nil {
+		return errors.Wrap(err, "error getting webhooks from database")
+	}
+
+	for _, w := range webhooks {
+		ds.webhooks[w.ID] = w
+	}
+
+	return nil
+}
+
+func (ds *Datastore) initTenantCAs() error {
+	ds.tenantCAsLock = &sync.RWMutex{}
+	ds.tenantCAs = make(map[string]types.TenantCA)
+
+	cas, err := ds.db.getTenantCAs()
+	if err != nil {
+		return errors.Wrap(err, "error getting tenant CAs from database")
+	}
+
+	for _, ca := range cas {
+		ds.tenantCAs[ca.TenantID] = ca
+	}
+
+	return nil
+}
+
+// initLaunchTemplates loads the tenants' launch templates from the database.
+func (ds *Datastore) initLaunchTemplates() error {
+	ds.launchTemplatesLock = &sync.RWMutex{}
+	ds.launchTemplates = make(map[string]map[string]types.LaunchTemplate)
+
+	templates, err := ds.db.getLaunchTemplates()
+	if err != nil {
+		return errors.Wrap(err, "error getting launch templates from database")
+	}
+
+	for _, t := range templates {
+		if ds.launchTemplates[t.TenantID] == nil {
+			ds.launchTemplates[t.TenantID] = make(map[string]types.LaunchTemplate)
+		}
+		ds.launchTemplates[t.TenantID][t.Name] = t
+	}
+
+	return nil
+}
+
+// initAPIKeys loads the tenants' API keys from the database, indexing them
+// by the hash of the key as well as by ID.
+func (ds *Datastore) initAPIKeys() error {
+	ds.apiKeysLock = &sync.RWMutex{}
+	ds.apiKeys = make(map[string]types.APIKey)
+	ds.apiKeyIDs = make(map[string]string)
+
+	keys, err := ds.db.getAPIKeys()
+	if err != nil {
+		return errors.Wrap(err, "error getting API keys from database")
+	}
+
+	for _, k := range keys {
+		ds.apiKeys[k.ID] = k
+		ds.apiKeyIDs[k.Hash] = k.ID
+	}
+
+	return nil
+}
+
+// initAuthTokens loads the records of the bearer tokens which have been
+// issued and not revoked from the database.
+func (ds *Datastore) initAuthTokens() error {
+	ds.authTokensLock = &sync.RWMutex{}
+	ds.authTokens = make(map[string]types.AuthToken)
+
+	tokens, err := ds.db.getAuthTokens()
+	if err != nil {
+		return errors.Wrap(err, "error getting tokens from database")
+	}
+
+	for _, t := range tokens {
+		ds.authTokens[t.ID] = t
+	}
+
+	return nil
+}
+
+// initServerGroups loads the server groups and their members from the
+// database.
+func (ds *Datastore) initServerGroups() error {
+	ds.serverGroupsLock = &sync.RWMutex{}
+	ds.serverGroups = make(map[string]types.ServerGroup)
+	ds.instanceServerGroups = make(map[string]string)
+
+	groups, err := ds.db.getServerGroups()
+	if err != nil {
+		return errors.Wrap(err, "error getting server groups from database")
+	}
+
+	for _, g := range groups {
+		ds.serverGroups[g.ID] = g
+		for _, instanceID := range g.Members {
+			ds.instanceServerGroups[instanceID] = g.ID
+		}
+	}
+
+	return nil
+}
+
+// initSnapshotSchedules loads the snapshot schedules and the snapshots they
+// have taken from the database.
+func (ds *Datastore) initSnapshotSchedules() error {
+	ds.snapshotSchedulesLock = &sync.RWMutex{}
+	ds.snapshotSchedules = make(map[string]types.SnapshotSchedule)
+	ds.volumeSnapshots = make(map[string][]types.VolumeSnapshot)
+
+	schedules, err := ds.db.getSnapshotSchedules()
+	if err != nil {
+		return errors.Wrap(err, "error getting snapshot schedules from database")
+	}
+
+	for _, s := range schedules {
+		ds.snapshotSchedules[s.ID] = s
+	}
+
+	snapshots, err := ds.db.getVolumeSnapshots()
+	if err != nil {
+		return errors.Wrap(err, "error getting volume snapshots from database")
+	}
+
+	for _, s := range snapshots {
+		ds.volumeSnapshots[s.VolumeID] = append(ds.volumeSnapshots[s.VolumeID], s)
+	}
+
+	for _, snapshots := range ds.volumeSnapshots {
+		sortVolumeSnapshots(snapshots)
+	}
+
+	return nil
+}
+
+// initImageSeeds loads the state of the images in the image caches of the
+// nodes from the database.
+func (ds *Datastore) initImageSeeds() error {
+	ds.imageSeedsLock = &sync.RWMutex{}
+	ds.imageSeeds = make(map[string]map[string]types.ImageSeed)
+
+	seeds, err := ds.db.getImageSeeds()
+	if err != nil {
+		return errors.Wrap(err, "error getting image seeds from database")
+	}
+
+	for imageID, imageSeeds := range seeds {
+		ds.imageSeeds[imageID] = make(map[string]types.ImageSeed)
+		for _, seed := range imageSeeds {
+			ds.imageSeeds[imageID][seed.NodeID] = seed
+		}
+	}
+
+	return nil
+}
+
+// initNodeMaintenance loads the nodes in maintenance from the database.
+func (ds *Datastore) initNodeMaintenance() error {
+	ds.nodeMaintenanceLock = &sync.RWMutex{}
+	ds.nodeMaintenance = make(map[string]bool)
+
+	nodes, err := ds.db.getMaintenanceNodes()
+	if err != nil {
+		return errors.Wrap(err, "error getting nodes in maintenance from database")
+	}
+
+	for _, nodeID := range nodes {
+		ds.nodeMaintenance[nodeID] = true
+	}
+
+	return nil
+}
+
+// initMigrations loads the live migrations in progress from the database
+// and marks the instances being migrated as such.  It must be called once
+// the instances have been loaded.
+func (ds *Datastore) initMigrations() error {
+	ds.migrationsLock = &sync.RWMutex{}
+	ds.migrations = make(map[string]types.Migration)
+
+	migrations, err := ds.db.getMigrations()
+	if err != nil {
+		return errors.Wrap(err, "error getting migrations from database")
+	}
+
+	for _, m := range migrations {
+		i, ok := ds.instances[m.InstanceID]
+		if !ok {
+			continue
+		}
+		i.StateLock.Lock()
+		i.State = payloads.Migrating
+		i.StateLock.Unlock()
+		ds.migrations[m.InstanceID] = m
+	}
+
+	return nil
+}
+
+// initPolicyRules loads the rules of the workload policy from the database.
+func (ds *Datastore) initPolicyRules() error {
+	ds.policyRulesLock = &sync.RWMutex{}
+	ds.policyRules = make(map[string]types.PolicyRule)
+
+	rules, err := ds.db.getPolicyRules()
+	if err != nil {
+		return errors.Wrap(err, "error getting policy rules from database")
+	}
+
+	for _, r := range rules {
+		ds.policyRules[r.ID] = r
+	}
+
+	return nil
+}
+
+// initSettings loads the cluster settings changed by the admin from the
+// database.
+func (ds *Datastore) initSettings() error {
+	ds.settingsLock = &sync.RWMutex{}
+	ds.settings = make(map[string]types.SettingValue)
+
+	settings, err := ds.db.getSettings()
+	if err != nil {
+		return errors.Wrap(err, "error getting settings from database")
+	}
+
+	for _, s := range settings {
+		ds.settings[s.Key] = s
+	}
+
+	return nil
+}
+
+// initTrash loads the tenants' trash from the database.
+func (ds *Datastore) initTrash() error {
+	ds.trashLock = &sync.RWMutex{}
+	ds.trash = make(map[string]types.TrashItem)
+
+	items, err := ds.db.getTrashItems()
+	if err != nil {
+		return errors.Wrap(err, "error getting trash from database")
+	}
+
+	for _, item := range items {
+		ds.trash[item.ID] = item
+	}
+
+	return nil
+}
+
+// initOperations loads the operations from the database.  Operations which
+// were running when the controller stopped will never complete so they are
+// marked as failed.
+func (ds *Datastore) initOperations() error {
+	ds.operationsLock = &sync.RWMutex{}
+	ds.operations = make(map[string]types.Operation)
+
+	operations, err := ds.db.getOperations()
+	if err != nil {
+		return errors.Wrap(err, "error getting operations from database")
+	}
+
+	for _, o := range operations {
+		if !o.Done() {
+			o.State = types.OperationFailed
+			o.Error = "Interrupted by controller restart"
+			o.UpdateTime = time.Now()
+			if err := ds.db.updateOperation(o); err != nil {
+				return errors.Wrap(err, "error updating interrupted operation")
+			}
+		}
+
+		ds.operations[o.ID] = o
+	}
+
+	return nil
+}
+
+// initCNCIImages loads the registered CNCI image and the images the
+// existing CNCIs were launched from.
+func (ds *Datastore) initCNCIImages() error {
+	ds.cnciLock = &sync.RWMutex{}
+
+	image, err := ds.db.getCNCIImage()
+	if err != nil {
+		return errors.Wrap(err, "error getting CNCI image from database")
+	}
+
+	if image.Image == "" {
+		image.Image = defaultCNCIImage
+	}
+	ds.cnciImage = image
+
+	ds.cnciInstanceImages, err = ds.db.getCNCIInstanceImages()
+	if err != nil {
+		return errors.Wrap(err, "error getting CNCI instance images from database")
+	}
+
+	return nil
+}
+
+// checkLoadedWorkload checks a workload read from the database, along with
+// the config read from its YAML file.
+func checkLoadedWorkload(wl *types.Workload) error {
+	var config interface{}
+	if err := yaml.Unmarshal([]byte(wl.Config), &config); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+
+	return wl.Validate()
+}
+
 func (ds *Datastore) initWorkloads() error {
 	ds.workloadsLock = &sync.RWMutex{}
 	ds.workloads = make(map[string]types.Workload)
@@ -259,6 +869,13 @@ func (ds *Datastore) initWorkloads() error {
 	}
 
 	for _, wl := range workloads {
+		// a bad definition, or config file, only loses the workload
+		// rather than keeping the controller from starting.
+		if err := checkLoadedWorkload(&wl); err != nil {
+			ds.log.Warningf("Skipping invalid workload %s: %v", wl.ID, err)
+			continue
+		}
+
 		ds.workloads[wl.ID] = wl
 
 		if wl.Visibility == types.Public {
@@ -283,6 +900,26 @@ func (ds *Datastore) initWorkloads() error {
 // files if this is the first time the database has been
 // created.  The datastore caches are also filled.
 func (ds *Datastore) Init(config Config) error {
+	if config.Log == nil {
+		config.Log = gloginterface.CiaoGlogLogger{}
+	}
+	ds.log = config.Log
+
+	ds.now = config.Now
+	if ds.now == nil {
+		ds.now = time.Now
+	}
+
+	switch config.IPAllocation {
+	case "":
+		ds.ipAllocation = IPAllocationSequential
+	case IPAllocationSequential, IPAllocationLRU, IPAllocationRandom:
+		ds.ipAllocation = config.IPAllocation
+	default:
+		return fmt.Errorf("Unknown IP allocation strategy: %s", config.IPAllocation)
+	}
+	ds.ipRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 	ps := config.DBBackend
 
 	if ps == nil {
@@ -295,7 +932,13 @@ func (ds *Datastore) Init(config Config) error {
 	}
 
 	ds.db = ps
+	ds.events = newEventQueue(ps, ds.log, config.EventDropped, config.EventsLogged)
 
+	return ds.load()
+}
+
+// load fills the datastore caches from the persistent store.
+func (ds *Datastore) load() error {
 	ds.nodeLastStat = make(map[string]types.CiaoNode)
 	ds.nodeLastStatLock = &sync.RWMutex{}
 
@@ -311,6 +954,7 @@ func (ds *Datastore) Init(config Config) error {
 	// cache all our instances prior to getting tenants
 	ds.instancesLock = &sync.RWMutex{}
 	ds.instances = make(map[string]*types.Instance)
+	ds.pendingPlacements = make(map[string]types.PlacementReason)
 
 	instances, err := ds.db.getInstances()
 	if err != nil {
@@ -321,6 +965,22 @@ func (ds *Datastore) Init(config Config) error {
 		ds.instances[instances[i].ID] = instances[i]
 	}
 
+	tags, err := ds.db.getInstanceTags()
+	if err != nil {
+		return errors.Wrap(err, "error getting instance tags from database")
+	}
+
+	for instanceID, t := range tags {
+		if i, ok := ds.instances[instanceID]; ok {
+			i.Tags = t
+		}
+	}
+
+	ds.instanceConditions, err = ds.db.getInstanceConditions()
+	if err != nil {
+		return errors.Wrap(err, "error getting instance conditions from database")
+	}
+
 	// cache our current tenants into a map that we can
 	// quickly index
 	tenants, err := ds.db.getTenants()
@@ -341,46 +1001,125 @@ func (ds *Datastore) Init(config Config) error {
 		return errors.Wrap(err, "error initialising workloads")
 	}
 
-	ds.nodesLock = &sync.RWMutex{}
-	ds.nodes = make(map[string]*node)
-
-	for key, i := range ds.instances {
-		_, ok := ds.nodes[i.NodeID]
-		if !ok {
-			newNode := types.Node{
-				ID: i.NodeID,
-			}
-			n := &node{
-				Node:      newNode,
-				instances: make(map[string]*types.Instance),
-			}
-			ds.nodes[i.NodeID] = n
-		}
-		ds.nodes[i.NodeID].instances[key] = i
-
-		// ds.tenants.instances should point to the same
-		// instances that we have in ds.instances, otherwise they
-		// will not get updated when we get new stats.
-
-		tenant := ds.tenants[i.TenantID]
-		if tenant != nil {
-			tenant.instances[i.ID] = i
-		}
+	err = ds.initWebhooks()
+	if err != nil {
+		return errors.Wrap(err, "error initialising webhooks")
 	}
 
-	ds.tenantUsage = make(map[string][]types.CiaoUsage)
-	ds.tenantUsageLock = &sync.RWMutex{}
+	err = ds.initTenantCAs()
+	if err != nil {
+		return errors.Wrap(err, "error initialising tenant CAs")
+	}
 
-	ds.blockDevices, err = ds.db.getAllBlockData()
+	err = ds.initLaunchTemplates()
 	if err != nil {
-		return errors.Wrap(err, "error getting block devices from database")
+		return errors.Wrap(err, "error initialising launch templates")
 	}
 
-	ds.bdLock = &sync.RWMutex{}
+	err = ds.initServerGroups()
+	if err != nil {
+		return errors.Wrap(err, "error initialising server groups")
+	}
 
-	ds.attachments, err = ds.db.getAllStorageAttachments()
+	err = ds.initSnapshotSchedules()
 	if err != nil {
-		return errors.Wrap(err, "error getting storage attachments from database")
+		return errors.Wrap(err, "error initialising snapshot schedules")
+	}
+
+	err = ds.initImageSeeds()
+	if err != nil {
+		return errors.Wrap(err, "error initialising image seeds")
+	}
+
+	err = ds.initNodeMaintenance()
+	if err != nil {
+		return errors.Wrap(err, "error initialising node maintenance")
+	}
+
+	err = ds.initMigrations()
+	if err != nil {
+		return errors.Wrap(err, "error initialising migrations")
+	}
+
+	err = ds.initAPIKeys()
+	if err != nil {
+		return errors.Wrap(err, "error initialising API keys")
+	}
+
+	err = ds.initAuthTokens()
+	if err != nil {
+		return errors.Wrap(err, "error initialising tokens")
+	}
+
+	err = ds.initPolicyRules()
+	if err != nil {
+		return errors.Wrap(err, "error initialising policy rules")
+	}
+
+	err = ds.initSettings()
+	if err != nil {
+		return errors.Wrap(err, "error initialising settings")
+	}
+
+	err = ds.initOperations()
+	if err != nil {
+		return errors.Wrap(err, "error initialising operations")
+	}
+
+	err = ds.initTrash()
+	if err != nil {
+		return errors.Wrap(err, "error initialising trash")
+	}
+
+	err = ds.initCNCIImages()
+	if err != nil {
+		return errors.Wrap(err, "error initialising CNCI images")
+	}
+
+	ds.nodesLock = &sync.RWMutex{}
+	ds.nodes = make(map[string]*node)
+
+	for key, i := range ds.instances {
+		// ds.tenants.instances should point to the same
+		// instances that we have in ds.instances, otherwise they
+		// will not get updated when we get new stats.
+
+		tenant := ds.tenants[i.TenantID]
+		if tenant != nil {
+			tenant.instances[i.ID] = i
+		}
+
+		if i.NodeID == "" {
+			continue
+		}
+
+		_, ok := ds.nodes[i.NodeID]
+		if !ok {
+			newNode := types.Node{
+				ID: i.NodeID,
+			}
+			n := &node{
+				Node:      newNode,
+				instances: make(map[string]*types.Instance),
+			}
+			ds.nodes[i.NodeID] = n
+		}
+		ds.nodes[i.NodeID].instances[key] = i
+	}
+
+	ds.tenantUsage = make(map[string][]types.CiaoUsage)
+	ds.tenantUsageLock = &sync.RWMutex{}
+
+	ds.blockDevices, err = ds.db.getAllBlockData()
+	if err != nil {
+		return errors.Wrap(err, "error getting block devices from database")
+	}
+
+	ds.bdLock = &sync.RWMutex{}
+
+	ds.attachments, err = ds.db.getAllStorageAttachments()
+	if err != nil {
+		return errors.Wrap(err, "error getting storage attachments from database")
 	}
 
 	ds.instanceVolumes = make(map[attachment]string)
@@ -401,23 +1140,141 @@ func (ds *Datastore) Init(config Config) error {
 	return nil
 }
 
-// Exit will disconnect the backing database.
+// Refresh reloads the datastore caches from the persistent store.  It is
+// used by controllers which are not the leader, and so do not modify the
+// datastore, to pick up the changes made by the leader.  The in memory
+// statistics are not affected.
+func (ds *Datastore) Refresh() error {
+	fresh := &Datastore{
+		db:  ds.db,
+		log: ds.log,
+	}
+
+	err := fresh.load()
+	if err != nil {
+		return errors.Wrap(err, "Error refreshing datastore")
+	}
+
+	ds.tenantsLock.Lock()
+	ds.tenants = fresh.tenants
+	ds.tenantsLock.Unlock()
+
+	ds.instancesLock.Lock()
+	ds.instances = fresh.instances
+	ds.instancesLock.Unlock()
+
+	ds.nodesLock.Lock()
+	ds.nodes = fresh.nodes
+	ds.nodesLock.Unlock()
+
+	ds.bdLock.Lock()
+	ds.blockDevices = fresh.blockDevices
+	ds.bdLock.Unlock()
+
+	ds.attachLock.Lock()
+	ds.attachments = fresh.attachments
+	ds.instanceVolumes = fresh.instanceVolumes
+	ds.attachLock.Unlock()
+
+	ds.poolsLock.Lock()
+	ds.pools = fresh.pools
+	ds.mappedIPs = fresh.mappedIPs
+	ds.poolsLock.Unlock()
+
+	ds.imageLock.Lock()
+	ds.images = fresh.images
+	ds.publicImages = fresh.publicImages
+	ds.internalImages = fresh.internalImages
+	ds.imageLock.Unlock()
+
+	ds.workloadsLock.Lock()
+	ds.workloads = fresh.workloads
+	ds.publicWorkloads = fresh.publicWorkloads
+	ds.workloadsLock.Unlock()
+
+	ds.webhooksLock.Lock()
+	ds.webhooks = fresh.webhooks
+	ds.webhooksLock.Unlock()
+
+	ds.tenantCAsLock.Lock()
+	ds.tenantCAs = fresh.tenantCAs
+	ds.tenantCAGen++
+	ds.tenantCAsLock.Unlock()
+
+	ds.launchTemplatesLock.Lock()
+	ds.launchTemplates = fresh.launchTemplates
+	ds.launchTemplatesLock.Unlock()
+
+	ds.serverGroupsLock.Lock()
+	ds.serverGroups = fresh.serverGroups
+	ds.instanceServerGroups = fresh.instanceServerGroups
+	ds.serverGroupsLock.Unlock()
+
+	ds.snapshotSchedulesLock.Lock()
+	ds.snapshotSchedules = fresh.snapshotSchedules
+	ds.volumeSnapshots = fresh.volumeSnapshots
+	ds.snapshotSchedulesLock.Unlock()
+
+	ds.imageSeedsLock.Lock()
+	ds.imageSeeds = fresh.imageSeeds
+	ds.imageSeedsLock.Unlock()
+
+	ds.migrationsLock.Lock()
+	ds.migrations = fresh.migrations
+	ds.migrationsLock.Unlock()
+
+	ds.apiKeysLock.Lock()
+	ds.apiKeys = fresh.apiKeys
+	ds.apiKeyIDs = fresh.apiKeyIDs
+	ds.apiKeysLock.Unlock()
+
+	ds.policyRulesLock.Lock()
+	ds.policyRules = fresh.policyRules
+	ds.policyRulesLock.Unlock()
+
+	ds.settingsLock.Lock()
+	ds.settings = fresh.settings
+	ds.settingsLock.Unlock()
+
+	return nil
+}
+
+// DatabaseStatus returns the current size of the persistent store.
+func (ds *Datastore) DatabaseStatus() (types.DatabaseStatus, error) {
+	return ds.db.stats()
+}
+
+// Compact returns the free pages of the persistent store to the file
+// system and truncates its write ahead log.
+func (ds *Datastore) Compact() error {
+	return ds.db.compact()
+}
+
+// PruneStatistics removes the node and instance statistics recorded before
+// the given time, keeping the latest statistics of each node and instance,
+// and returns the number removed.
+func (ds *Datastore) PruneStatistics(before time.Time) (int, error) {
+	return ds.db.pruneStatistics(before)
+}
+
+// Exit writes the queued events and disconnects the backing database.
 func (ds *Datastore) Exit() {
+	ds.events.close()
 	ds.db.disconnect()
 }
 
-// AddTenant stores information about a tenant into the datastore.
-// and makes sure that this new tenant is cached.
-func (ds *Datastore) AddTenant(id string, config types.TenantConfig) (*types.Tenant, error) {
+// AddTenant stores information about a tenant, along with its initial
+// quotas, into the datastore and makes sure that this new tenant is cached.
+func (ds *Datastore) AddTenant(id string, config types.TenantConfig, qds ...types.QuotaDetails) (*types.Tenant, error) {
 	ds.tenantsLock.Lock()
 	defer ds.tenantsLock.Unlock()
 
 	t, ok := ds.tenants[id]
 	if ok {
-		return nil, errors.New("Duplicate Tenant ID")
+		return nil, ErrDuplicateTenant
 	}
 
-	err := ds.db.addTenant(id, config)
+	err := ds.db.addTenant(id, config, qds...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error adding tenant (%v) to database", id)
 	}
@@ -446,7 +1303,63 @@ func (ds *Datastore) DeleteTenant(ID string) error {
 
 	delete(ds.tenants, ID)
 
-	return ds.db.deleteTenant(ID)
+	err := ds.db.deleteTenant(ID)
+	if err != nil {
+		return err
+	}
+
+	ds.forgetTenant(ID)
+
+	return nil
+}
+
+// forgetTenant removes the API keys, tokens, server groups and pool grants
+// of a deleted tenant from the caches, as they have been removed from the
+// database along with the tenant.
+func (ds *Datastore) forgetTenant(ID string) {
+	ds.apiKeysLock.Lock()
+	for keyID, k := range ds.apiKeys {
+		if k.TenantID == ID {
+			delete(ds.apiKeys, keyID)
+			delete(ds.apiKeyIDs, k.Hash)
+		}
+	}
+	ds.apiKeysLock.Unlock()
+
+	ds.authTokensLock.Lock()
+	for tokenID, t := range ds.authTokens {
+		if t.TenantID == ID {
+			delete(ds.authTokens, tokenID)
+		}
+	}
+	ds.authTokensLock.Unlock()
+
+	ds.serverGroupsLock.Lock()
+	for groupID, g := range ds.serverGroups {
+		if g.TenantID != ID {
+			continue
+		}
+		for _, instanceID := range g.Members {
+			delete(ds.instanceServerGroups, instanceID)
+		}
+		delete(ds.serverGroups, groupID)
+	}
+	ds.serverGroupsLock.Unlock()
+
+	ds.poolsLock.Lock()
+	for poolID, p := range ds.pools {
+		tenants := make([]string, 0, len(p.Tenants))
+		for _, t := range p.Tenants {
+			if t != ID {
+				tenants = append(tenants, t)
+			}
+		}
+		if len(tenants) != len(p.Tenants) {
+			p.Tenants = tenants
+			ds.pools[poolID] = p
+		}
+	}
+	ds.poolsLock.Unlock()
 }
 
 func (ds *Datastore) getTenant(id string) (*tenant, error) {
@@ -473,6 +1386,19 @@ func (ds *Datastore) GetTenant(id string) (*types.Tenant, error) {
 	return &t.Tenant, nil
 }
 
+// TenantFrozen returns whether a tenant is frozen and why.
+func (ds *Datastore) TenantFrozen(id string) (bool, string) {
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
+
+	t := ds.tenants[id]
+	if t == nil {
+		return false, ""
+	}
+
+	return t.Frozen, t.FreezeReason
+}
+
 // JSONPatchTenant will update a tenant with changes from a json merge patch.
 func (ds *Datastore) JSONPatchTenant(ID string, patch []byte) error {
 	var config types.TenantConfig
@@ -502,6 +1428,29 @@ func (ds *Datastore) JSONPatchTenant(ID string, patch []byte) error {
 		return errors.Wrap(err, "error updating tenant")
 	}
 
+	// the freeze state is only changed through SetTenantFreeze
+	if config.Frozen != oldconfig.Frozen || config.FreezeReason != oldconfig.FreezeReason {
+		return errors.New("Tenant freeze state cannot be patched")
+	}
+
+	if config.MaxSubnets < 0 {
+		return errors.New("max_subnets must not be negative")
+	}
+
+	if config.DeferredDeleteMinutes < 0 {
+		return errors.New("deferred_delete_minutes must not be negative")
+	}
+
+	if size := config.CNCISize; size != nil {
+		if size.VCPUs < 0 || size.MemMB < 0 || size.DiskMB < 0 {
+			return errors.New("cnci_size must not be negative")
+		}
+
+		if *size == (types.CNCISize{}) {
+			config.CNCISize = nil
+		}
+	}
+
 	// SubnetBits must not modified if there are active instances.
 	// for now, the cncis must also be removed. In the future we might
 	// be able to just update the cnci with the new subnet info.
@@ -516,6 +1465,35 @@ func (ds *Datastore) JSONPatchTenant(ID string, patch []byte) error {
 	return ds.db.updateTenant(&tenant.Tenant)
 }
 
+// SetTenantFreeze freezes or unfreezes a tenant, recording why it was frozen.
+func (ds *Datastore) SetTenantFreeze(ID string, frozen bool, reason string) error {
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	tenant, ok := ds.tenants[ID]
+	if !ok {
+		return ErrNoTenant
+	}
+
+	if !frozen {
+		reason = ""
+	}
+
+	updated := tenant.Tenant
+	updated.Frozen = frozen
+	updated.FreezeReason = reason
+
+	err := ds.db.updateTenant(&updated)
+	if err != nil {
+		return errors.Wrap(err, "error updating tenant")
+	}
+
+	tenant.Frozen = frozen
+	tenant.FreezeReason = reason
+
+	return nil
+}
+
 // AddWorkload is used to add a new workload to the datastore.
 // Both cache and persistent store are updated.
 func (ds *Datastore) AddWorkload(w types.Workload) error {
@@ -546,6 +1524,10 @@ func (ds *Datastore) AddWorkload(w types.Workload) error {
 // DeleteWorkload will delete an unused workload from the datastore.
 // workload ID out of the datastore.
 func (ds *Datastore) DeleteWorkload(workloadID string) error {
+	if ds.isCNCIWorkload(workloadID) {
+		return types.ErrCNCIWorkload
+	}
+
 	ds.workloadsLock.Lock()
 	defer ds.workloadsLock.Unlock()
 
@@ -600,10 +1582,63 @@ func (ds *Datastore) DeleteWorkload(workloadID string) error {
 	return nil
 }
 
+// UpdateWorkload replaces the definition of a workload. The owner and
+// visibility of a workload cannot be changed, nor can its requirements
+// while instances of it exist, as those instances were sized by them.
+func (ds *Datastore) UpdateWorkload(w types.Workload) error {
+	if ds.isCNCIWorkload(w.ID) {
+		return types.ErrCNCIWorkload
+	}
+
+	ds.workloadsLock.Lock()
+	defer ds.workloadsLock.Unlock()
+
+	wl, ok := ds.workloads[w.ID]
+	if !ok {
+		return types.ErrWorkloadNotFound
+	}
+
+	ds.instancesLock.RLock()
+	defer ds.instancesLock.RUnlock()
+
+	if w.Requirements.VCPUs != wl.Requirements.VCPUs ||
+		w.Requirements.MemMB != wl.Requirements.MemMB {
+		for _, val := range ds.instances {
+			if val.WorkloadID == w.ID {
+				return types.ErrWorkloadRequirementsInUse
+			}
+		}
+	}
+
+	w.TenantID = wl.TenantID
+	w.Visibility = wl.Visibility
+
+	err := ds.db.updateWorkload(w)
+	if err != nil {
+		return errors.Wrapf(err, "error updating workload (%v) in database", w.ID)
+	}
+
+	ds.workloads[w.ID] = w
+
+	return nil
+}
+
+// isCNCIWorkload returns true if ID is that of the generated CNCI workload.
+func (ds *Datastore) isCNCIWorkload(ID string) bool {
+	ds.cnciLock.RLock()
+	defer ds.cnciLock.RUnlock()
+
+	return ds.cnciWorkload.ID != "" && ds.cnciWorkload.ID == ID
+}
+
 // GetWorkload returns details about a specific workload referenced by id
 func (ds *Datastore) GetWorkload(ID string) (types.Workload, error) {
-	if ID == ds.cnciWorkload.ID {
-		return ds.cnciWorkload, nil
+	ds.cnciLock.RLock()
+	cnciWorkload := ds.cnciWorkload
+	ds.cnciLock.RUnlock()
+
+	if ID == cnciWorkload.ID {
+		return cnciWorkload, nil
 	}
 
 	ds.workloadsLock.RLock()
@@ -657,6 +1692,34 @@ func (ds *Datastore) getWorkloads(tenantID string, includePublic bool) ([]types.
 	return workloads, nil
 }
 
+// SearchWorkloads retrieves the workloads available to a tenant whose
+// description contains search.
+func (ds *Datastore) SearchWorkloads(tenantID string, search string) ([]types.Workload, error) {
+	wls, err := ds.GetWorkloads(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	IDs, err := ds.db.searchWorkloads(tenantID, search)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error searching workloads")
+	}
+
+	found := make(map[string]bool)
+	for _, ID := range IDs {
+		found[ID] = true
+	}
+
+	var workloads []types.Workload
+	for _, wl := range wls {
+		if found[wl.ID] {
+			workloads = append(workloads, wl)
+		}
+	}
+
+	return workloads, nil
+}
+
 // UpdateInstance will update certain fields of an instance
 func (ds *Datastore) UpdateInstance(instance *types.Instance) error {
 	return ds.db.updateInstance(instance)
@@ -699,11 +1762,17 @@ func (ds *Datastore) ReleaseTenantIP(tenantID string, ip string) error {
 	hostInt := binary.BigEndian.Uint32(ipAddr.To4())
 	subnetInt := hostInt & subMask
 
+	released := ds.now().UTC()
+
 	// clear from cache
 	ds.tenantsLock.Lock()
 
 	if ds.tenants[tenantID] != nil {
 		delete(ds.tenants[tenantID].network[subnetInt], hostInt)
+		if ds.tenants[tenantID].released == nil {
+			ds.tenants[tenantID].released = make(map[uint32]time.Time)
+		}
+		ds.tenants[tenantID].released[hostInt] = released
 		network := ds.tenants[tenantID].network
 		i = subnetInt
 
@@ -718,13 +1787,13 @@ func (ds *Datastore) ReleaseTenantIP(tenantID string, ip string) error {
 	if removeSubnet && ds.tenants[tenantID].CNCIctrl != nil {
 		err := ds.tenants[tenantID].CNCIctrl.ScheduleRemoveSubnet(ipNet.String())
 		if err != nil {
-			glog.Warningf("Unable to remove subnet (%v)", err)
+			ds.log.Warningf("Unable to remove subnet (%v)", err)
 		}
 	}
 
 	ds.tenantsLock.Unlock()
 
-	return ds.db.releaseTenantIP(tenantID, subnetInt, hostInt)
+	return ds.db.releaseTenantIP(tenantID, subnetInt, hostInt, released)
 }
 
 // lock for tenant must be held.
@@ -763,53 +1832,213 @@ func (ds *Datastore) activateSubnets(tenantID string, IPs []net.IP) error {
 	return nil
 }
 
-// AllocateTenantIPPool will reserve a pool of IP addresses for the caller.
-func (ds *Datastore) AllocateTenantIPPool(tenantID string, num int) ([]net.IP, error) {
-	var addrs []net.IP
-	var tenantAddrs []tenantIP
-	var retval error
+// TenantSubnet returns a subnet of a tenant's network in CIDR notation.  If
+// subnet is empty the first subnet of the network, from which the tenant's
+// first instances are addressed, is returned.  An error is returned if
+// subnet is not one of the tenant's subnets.
+func (ds *Datastore) TenantSubnet(tenantID string, subnet string) (string, error) {
 	tenant, err := ds.GetTenant(tenantID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	// hardcode start address and max address for tenant network.
-	cidr := fmt.Sprintf("%s/%d", "172.16.0.0", tenant.SubnetBits)
-	IP, ipNet, err := net.ParseCIDR(cidr)
+	if tenant == nil {
+		return "", ErrNoTenant
+	}
+
+	if subnet == "" {
+		subnet = fmt.Sprintf("%s/%d", "172.16.0.0", tenant.SubnetBits)
+	}
+
+	IP, ipNet, err := net.ParseCIDR(subnet)
 	if err != nil {
-		return nil, err
+		return "", errors.Wrapf(err, "invalid subnet %s", subnet)
 	}
 
-	start := binary.BigEndian.Uint32(IP.Mask(ipNet.Mask))
-	end := start >> 20
-	end = end + uint32(1)
-	end = end << 20
+	_, tenantNet, _ := net.ParseCIDR("172.16.0.0/12")
 	ones, bits := ipNet.Mask.Size()
-	hostBits := uint32(bits - ones)
-	maxHosts := (1 << hostBits)
-	mask := binary.BigEndian.Uint32(ipNet.Mask)
+	if bits != 32 || ones != tenant.SubnetBits || !IP.Equal(ipNet.IP) || !tenantNet.Contains(IP) {
+		return "", errors.Errorf("%s is not a subnet of the tenant network", subnet)
+	}
 
-	var hostCount int
+	return ipNet.String(), nil
+}
 
-	ds.tenantsLock.Lock()
-	defer func() {
-		ds.tenantsLock.Unlock()
+// SubnetCapacity returns the number of addresses of a tenant subnet which
+// may be given to instances.  The network, gateway and broadcast addresses
+// are reserved.
+func SubnetCapacity(subnetBits int) int {
+	return (1 << uint(32-subnetBits)) - 3
+}
 
-		// try to start any subnets that need it.
-		// This will modify retval if there was an
-		// error.
+// subnetCIDR returns a tenant subnet in CIDR notation.
+func subnetCIDR(subnet uint32, subnetBits int) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, subnet)
+	return fmt.Sprintf("%s/%d", ip, subnetBits)
+}
+
+// TenantSubnets returns the utilization of the subnets of a tenant's
+// network which have addresses in use, in address order.
+func (ds *Datastore) TenantSubnets(tenantID string) ([]types.TenantSubnet, error) {
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
+
+	t := ds.tenants[tenantID]
+	if t == nil {
+		return nil, ErrNoTenant
+	}
+
+	nums := make([]uint32, 0, len(t.network))
+	for k := range t.network {
+		nums = append(nums, k)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	subnets := make([]types.TenantSubnet, 0, len(nums))
+	for _, k := range nums {
+		subnets = append(subnets, types.TenantSubnet{
+			Subnet:   subnetCIDR(k, t.SubnetBits),
+			Capacity: SubnetCapacity(t.SubnetBits),
+			Used:     len(t.network[k]),
+		})
+	}
+
+	return subnets, nil
+}
+
+// freeHosts returns the free addresses of the tenant subnet which starts
+// at start, in the order in which the IP allocation strategy gives them
+// out.  The network, gateway and broadcast addresses are never free.  Only
+// the first need addresses are returned under IPAllocationSequential, as
+// the others would not be used.
+//
+// lock for tenant must be held.
+func (ds *Datastore) freeHosts(t *tenant, start uint32, maxHosts int, need int) []uint32 {
+	netmap := t.network[start]
+
+	var free []uint32
+	for host := 2; host < maxHosts-1; host++ {
+		addr := start + uint32(host)
+		if netmap[addr] {
+			continue
+		}
+
+		free = append(free, addr)
+		if ds.ipAllocation == IPAllocationSequential && len(free) == need {
+			break
+		}
+	}
+
+	switch ds.ipAllocation {
+	case IPAllocationLRU:
+		// addresses which have never been released have a zero
+		// release time and so come first.
+		sort.SliceStable(free, func(i, j int) bool {
+			return t.released[free[i]].Before(t.released[free[j]])
+		})
+	case IPAllocationRandom:
+		ds.ipRand.Shuffle(len(free), func(i, j int) {
+			free[i], free[j] = free[j], free[i]
+		})
+	}
+
+	return free
+}
+
+// AllocateTenantIPPool will reserve a pool of IP addresses for the caller.
+// A tenant's network grows into a new subnet when its existing subnets are
+// full, unless it already has MaxSubnets subnets in which case a
+// SubnetFullError is returned, or no subnets of its address range are
+// left in which case ErrSubnetExhausted is returned.  The addresses of each subnet are given
+// out in the order of the IP allocation strategy.
+func (ds *Datastore) AllocateTenantIPPool(tenantID string, num int) ([]net.IP, error) {
+	var addrs []net.IP
+	var tenantAddrs []tenantIP
+	var retval error
+	tenant, err := ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// hardcode start address and max address for tenant network.
+	cidr := fmt.Sprintf("%s/%d", "172.16.0.0", tenant.SubnetBits)
+	IP, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	start := binary.BigEndian.Uint32(IP.Mask(ipNet.Mask))
+	end := start >> 20
+	end = end + uint32(1)
+	end = end << 20
+	ones, bits := ipNet.Mask.Size()
+	hostBits := uint32(bits - ones)
+	maxHosts := (1 << hostBits)
+	mask := binary.BigEndian.Uint32(ipNet.Mask)
+	capacity := SubnetCapacity(tenant.SubnetBits)
+
+	var hostCount int
+
+	ds.tenantsLock.Lock()
+	defer func() {
+		ds.tenantsLock.Unlock()
+
+		// try to start any subnets that need it.
+		// This will modify retval if there was an
+		// error.
 		if addrs != nil {
 			retval = ds.activateSubnets(tenantID, addrs)
 		}
 	}()
 
 	subnets := ds.tenants[tenantID].network
+	maxSubnets := ds.tenants[tenantID].MaxSubnets
 
-	// look for any subnets that have available host nums
+	// start from the lowest subnet with available host nums, those
+	// below it are full.
+	free := 0
+	first := end
+	last := start
 	for k, v := range subnets {
-		if len(v) < maxHosts {
-			start = k
-			break
+		if len(v) < capacity {
+			free += capacity - len(v)
+			if k < first {
+				first = k
+			}
+		}
+		if k > last {
+			last = k
+		}
+	}
+
+	// the tenant's network may grow into every subnet of its address
+	// range unless it is limited to fewer.
+	limit := int((end - start) / uint32(maxHosts))
+	limited := maxSubnets > 0 && maxSubnets < limit
+	if limited {
+		limit = maxSubnets
+	}
+
+	if first != end {
+		start = first
+	}
+
+	// fail before claiming any address if the network may not grow
+	// into enough new subnets.
+	growth := limit - len(subnets)
+	if growth < 0 {
+		growth = 0
+	}
+
+	if free+growth*capacity < num {
+		if !limited {
+			return nil, types.ErrSubnetExhausted
+		}
+
+		return nil, &types.SubnetFullError{
+			Subnet:   subnetCIDR(last, tenant.SubnetBits),
+			Capacity: capacity,
 		}
 	}
 
@@ -817,40 +2046,45 @@ func (ds *Datastore) AllocateTenantIPPool(tenantID string, num int) ([]net.IP, e
 		if start >= end {
 			ds.cleanTenantIPs(tenantID, tenantAddrs)
 			addrs = nil
-			return nil, errors.New("out of addrs")
+			return nil, types.ErrSubnetExhausted
 		}
 
 		// if we have not yet allocated out of this subnet,
-		// we need to make a new map to hold the host addrs.
+		// we need to make a new map to hold the host addrs,
+		// unless the network may not grow any further.
 		subnetNum := start & mask
 		if subnets[subnetNum] == nil {
+			if maxSubnets > 0 && len(subnets) >= maxSubnets {
+				start += uint32(maxHosts)
+				continue
+			}
 			subnets[subnetNum] = make(map[uint32]bool)
 		}
 		netmap := subnets[subnetNum]
 
-		// skip network, gateway, and broadcast addrs.
-		for host := 2; host < maxHosts-1; host++ {
-			if netmap[start+uint32(host)] == false {
-				addr := start + uint32(host)
-				netmap[addr] = true
-				newIP := make(net.IP, net.IPv4len)
-				binary.BigEndian.PutUint32(newIP, addr)
-				addrs = append(addrs, newIP)
-				tenantAddrs = append(tenantAddrs, tenantIP{subnetNum, addr})
-				hostCount++
-				if hostCount == num {
-					// attempt bulk db insert here.
-					err := ds.db.claimTenantIPs(tenantID, tenantAddrs)
-					if err != nil {
-						ds.cleanTenantIPs(tenantID, tenantAddrs)
-						addrs = nil
-						return nil, err
-					}
-
-					// go ahead and return the IPs to the
-					// user but possibly with error.
-					return addrs, retval
+		for _, addr := range ds.freeHosts(ds.tenants[tenantID], start, maxHosts, num-hostCount) {
+			netmap[addr] = true
+			newIP := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(newIP, addr)
+			addrs = append(addrs, newIP)
+			tenantAddrs = append(tenantAddrs, tenantIP{subnetNum, addr})
+			hostCount++
+			if hostCount == num {
+				// attempt bulk db insert here.
+				err := ds.db.claimTenantIPs(tenantID, tenantAddrs)
+				if err != nil {
+					ds.cleanTenantIPs(tenantID, tenantAddrs)
+					addrs = nil
+					return nil, err
+				}
+
+				for _, IP := range tenantAddrs {
+					delete(ds.tenants[tenantID].released, IP.host)
 				}
+
+				// go ahead and return the IPs to the
+				// user but possibly with error.
+				return addrs, retval
 			}
 		}
 
@@ -868,6 +2102,74 @@ func (ds *Datastore) AllocateTenantIP(tenantID string) (net.IP, error) {
 	return ips[0], nil
 }
 
+// AllocateTenantSubnetIP will allocate a single IP address for a tenant out
+// of a particular subnet of its network, given in CIDR notation.  A
+// SubnetFullError is returned if the subnet has no free addresses or if the
+// tenant may not grow its network into it.
+func (ds *Datastore) AllocateTenantSubnetIP(tenantID string, subnet string) (net.IP, error) {
+	cidr, err := ds.TenantSubnet(tenantID, subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant, err := ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	IP, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	start := binary.BigEndian.Uint32(IP.Mask(ipNet.Mask))
+	ones, bits := ipNet.Mask.Size()
+	maxHosts := 1 << uint32(bits-ones)
+	capacity := SubnetCapacity(tenant.SubnetBits)
+
+	ds.tenantsLock.Lock()
+
+	t := ds.tenants[tenantID]
+	subnets := t.network
+	if subnets[start] == nil && t.MaxSubnets > 0 && len(subnets) >= t.MaxSubnets {
+		ds.tenantsLock.Unlock()
+		return nil, &types.SubnetFullError{Subnet: cidr, Capacity: capacity}
+	}
+
+	free := ds.freeHosts(t, start, maxHosts, 1)
+	if len(free) == 0 {
+		ds.tenantsLock.Unlock()
+		return nil, &types.SubnetFullError{Subnet: cidr, Capacity: capacity}
+	}
+
+	if subnets[start] == nil {
+		subnets[start] = make(map[uint32]bool)
+	}
+	subnets[start][free[0]] = true
+
+	tenantAddrs := []tenantIP{{start, free[0]}}
+	err = ds.db.claimTenantIPs(tenantID, tenantAddrs)
+	if err != nil {
+		ds.cleanTenantIPs(tenantID, tenantAddrs)
+		ds.tenantsLock.Unlock()
+		return nil, err
+	}
+	delete(t.released, free[0])
+
+	ds.tenantsLock.Unlock()
+
+	newIP := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(newIP, free[0])
+
+	err = ds.activateSubnets(tenantID, []net.IP{newIP})
+	if err != nil {
+		_ = ds.ReleaseTenantIP(tenantID, newIP.String())
+		return nil, err
+	}
+
+	return newIP, nil
+}
+
 func (ds *Datastore) getInstances(cncis bool) ([]*types.Instance, error) {
 	var instances []*types.Instance
 
@@ -884,9 +2186,18 @@ func (ds *Datastore) getInstances(cncis bool) ([]*types.Instance, error) {
 
 	ds.instancesLock.RUnlock()
 
+	sortInstances(instances)
+
 	return instances, nil
 }
 
+// sortInstances puts instances in the order in which lists are returned.
+func sortInstances(instances []*types.Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Cursor().Before(instances[j].Cursor())
+	})
+}
+
 // GetAllInstances retrieves all tenant instances out of the datastore.
 func (ds *Datastore) GetAllInstances() ([]*types.Instance, error) {
 	return ds.getInstances(false)
@@ -946,6 +2257,8 @@ func (ds *Datastore) getTenantInstances(tenantID string, cncis bool) ([]*types.I
 
 		ds.tenantsLock.RUnlock()
 
+		sortInstances(instances)
+
 		return instances, nil
 	}
 
@@ -960,1828 +2273,5116 @@ func (ds *Datastore) GetAllInstancesFromTenant(tenantID string) ([]*types.Instan
 	return ds.getTenantInstances(tenantID, false)
 }
 
-// GetTenantCNCIs will retrieve all CNCI instances belonging to a tenant
-func (ds *Datastore) GetTenantCNCIs(tenantID string) ([]*types.Instance, error) {
-	return ds.getTenantInstances(tenantID, true)
+// instancePage selects the page of a list of instances chosen by a
+// ListFilter.  Instances are added to it in any order and only those which
+// could still be part of the page are kept, so listing a page never needs
+// to sort or copy the whole list.
+type instancePage struct {
+	after     *types.ListCursor
+	limit     int
+	instances []*types.Instance
 }
 
-// GetAllInstancesByNode will retrieve all the instances running on a specific compute Node.
-func (ds *Datastore) GetAllInstancesByNode(nodeID string) ([]*types.Instance, error) {
-	var instances []*types.Instance
-
-	ds.nodesLock.RLock()
+func newInstancePage(filter types.ListFilter) (*instancePage, error) {
+	p := &instancePage{limit: filter.Limit}
 
-	n, ok := ds.nodes[nodeID]
-	if ok {
-		for _, val := range n.instances {
-			if val.CNCI == false {
-				instances = append(instances, val)
-			}
+	if filter.Marker != "" {
+		after, err := types.ParseListMarker(filter.Marker)
+		if err != nil {
+			return nil, err
 		}
+		p.after = &after
 	}
 
-	ds.nodesLock.RUnlock()
-
-	return instances, nil
+	return p, nil
 }
 
-// AddInstance will store a new instance in the datastore.
-// The instance will be updated both in the cache and in the database
-func (ds *Datastore) AddInstance(instance *types.Instance) error {
-	err := ds.db.addInstance(instance)
-
-	if err != nil {
-		return errors.Wrap(err, "Error adding instance to database")
+func (p *instancePage) add(i *types.Instance) {
+	if p.after != nil && !p.after.Before(i.Cursor()) {
+		return
 	}
 
-	// add to cache
-	ds.instancesLock.Lock()
-
-	ds.instances[instance.ID] = instance
+	p.instances = append(p.instances, i)
 
-	instanceStat := types.CiaoServerStats{
-		ID:        instance.ID,
-		TenantID:  instance.TenantID,
-		NodeID:    instance.NodeID,
-		Timestamp: time.Now(),
-		Status:    instance.State,
+	// One instance more than the limit is kept to tell whether another
+	// page follows.  Trimming only once twice that many have been
+	// collected keeps the cost of sorting down.
+	if p.limit > 0 && len(p.instances) > 2*(p.limit+1) {
+		p.trim()
 	}
+}
 
-	ds.instanceLastStatLock.Lock()
-	ds.instanceLastStat[instance.ID] = instanceStat
-	ds.instanceLastStatLock.Unlock()
-
-	ds.instancesLock.Unlock()
+func (p *instancePage) trim() {
+	sortInstances(p.instances)
+	if p.limit > 0 && len(p.instances) > p.limit+1 {
+		p.instances = p.instances[:p.limit+1]
+	}
+}
 
-	ds.tenantsLock.Lock()
-	tenant := ds.tenants[instance.TenantID]
-	if tenant != nil {
-		tenant.instances[instance.ID] = instance
+// page returns the instances of the page and the marker of the next page,
+// which is empty if this is the last one.
+func (p *instancePage) page() ([]*types.Instance, string) {
+	p.trim()
+	if p.limit > 0 && len(p.instances) > p.limit {
+		instances := p.instances[:p.limit]
+		return instances, instances[p.limit-1].Cursor().Marker()
 	}
-	ds.tenantsLock.Unlock()
 
-	return nil
+	return p.instances, ""
 }
 
-// StartFailure will clean up after a failure to start an instance.
-// If an instance was a CNCI, this function will remove the CNCI instance
-// for this tenant. If the instance was a normal tenant instance, the
-// IP address will be released and the instance will be deleted from the
-// datastore.
-//
-// Only instances whose status is pending are removed when a StartFailure event
-// is received.  StartFailure errors may also be generated when restarting an
-// exited instance and we want to make sure that a failure to restart such
-// an instance does not result in it being deleted.
-func (ds *Datastore) StartFailure(instanceID string, reason payloads.StartFailureReason, migration bool, nodeID string) error {
-	i, err := ds.GetInstance(instanceID)
+// ListInstances retrieves the page selected by filter of the instances of
+// a tenant, or of all tenants if tenantID is empty, in the order in which
+// lists are returned, together with the marker of the next page.  Only the
+// instances selected by match are listed, they are looked up in the
+// database so that the whole list need not be examined.  CNCI instances
+// are excluded.
+func (ds *Datastore) ListInstances(tenantID string, match types.InstanceFilter, filter types.ListFilter) ([]*types.Instance, string, error) {
+	p, err := newInstancePage(filter)
 	if err != nil {
-		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+		return nil, "", err
 	}
 
-	if i.CNCI == true {
-		glog.Warning("CNCI ", instanceID, " Failed to start")
-	}
+	// the state is matched against the cached instances as some states,
+	// such as unreachable, migrating and deleted-pending, are never
+	// reported in the instance statistics
+	state := match.State
+	match.State = ""
 
-	if reason.IsFatal() && !migration {
-		if _, err := ds.deleteInstance(instanceID); err != nil {
-			return errors.Wrap(err, "Error deleting instance")
+	var found map[string]bool
+	if match != (types.InstanceFilter{}) {
+		IDs, err := ds.db.filterInstances(tenantID, match)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Error filtering instances")
+		}
+
+		found = make(map[string]bool)
+		for _, ID := range IDs {
+			found[ID] = true
 		}
 	}
 
-	ds.nodesLock.Lock()
-	defer ds.nodesLock.Unlock()
+	add := func(i *types.Instance) {
+		if i.CNCI {
+			return
+		}
 
-	n, ok := ds.nodes[nodeID]
-	if ok {
-		n.TotalFailures++
-		n.StartFailures++
-	}
+		if found != nil && !found[i.ID] {
+			return
+		}
 
-	msg := fmt.Sprintf("Start Failure %s: %s", instanceID, reason.String())
-	e := types.LogEntry{
-		TenantID:  i.TenantID,
-		EventType: string(userError),
-		Message:   msg,
-		NodeID:    nodeID,
-	}
-	return errors.Wrap(ds.db.logEvent(e), "Error logging event")
-}
+		if !matchInstanceState(i, state) {
+			return
+		}
 
-// AttachVolumeFailure will clean up after a failure to attach a volume.
-// The volume state will be changed back to available, and an error message
-// will be logged.
-func (ds *Datastore) AttachVolumeFailure(instanceID string, volumeID string, reason payloads.AttachVolumeFailureReason) error {
-	// update the block data to reflect correct state
-	data, err := ds.GetBlockDevice(volumeID)
-	if err != nil {
-		return errors.Wrapf(err, "error getting block device for volume (%v)", volumeID)
+		p.add(i)
 	}
 
-	oldState := data.State
-	data.State = types.Available
-	err = ds.UpdateBlockDevice(data)
-	if err != nil {
-		data.State = oldState
-		return errors.Wrapf(err, "error updating block device for volume (%v)", volumeID)
+	if tenantID != "" {
+		ds.tenantsLock.RLock()
+		if t, ok := ds.tenants[tenantID]; ok {
+			for _, i := range t.instances {
+				add(i)
+			}
+		}
+		ds.tenantsLock.RUnlock()
+	} else {
+		ds.instancesLock.RLock()
+		for _, i := range ds.instances {
+			add(i)
+		}
+		ds.instancesLock.RUnlock()
 	}
 
-	// get owner of this instance
-	i, err := ds.GetInstance(instanceID)
-	if err != nil {
-		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
-	}
+	instances, next := p.page()
 
-	ds.nodesLock.Lock()
-	defer ds.nodesLock.Unlock()
+	return instances, next, nil
+}
 
-	n, ok := ds.nodes[i.NodeID]
-	if ok {
-		n.TotalFailures++
-		n.AttachVolumeFailures++
+// matchInstanceState returns true if i is in state, or if state is empty.
+func matchInstanceState(i *types.Instance, state string) bool {
+	if state == "" {
+		return true
 	}
 
-	msg := fmt.Sprintf("Attach Volume Failure %s to %s: %s", volumeID, instanceID, reason.String())
-	e := types.LogEntry{
-		TenantID:  i.TenantID,
-		EventType: string(userError),
-		Message:   msg,
-		NodeID:    i.NodeID,
-	}
+	i.StateLock.RLock()
+	defer i.StateLock.RUnlock()
 
-	return errors.Wrap(ds.db.logEvent(e), "Error logging event")
+	return i.State == state
 }
 
-func (ds *Datastore) deleteInstance(instanceID string) (string, error) {
-	if err := ds.db.deleteInstance(instanceID); err != nil {
-		glog.Warningf("error deleting instance (%v): %v", instanceID, err)
-		return "", errors.Wrapf(err, "error deleting instance from database (%v)", instanceID)
-	}
+// renamableStates are the states in which an instance is not being
+// launched, stopped, migrated or deleted and so may be renamed.
+var renamableStates = map[string]bool{
+	payloads.Running:     true,
+	payloads.Exited:      true,
+	payloads.Hung:        true,
+	payloads.Missing:     true,
+	payloads.Unreachable: true,
+}
 
-	ds.instanceLastStatLock.Lock()
-	delete(ds.instanceLastStat, instanceID)
-	ds.instanceLastStatLock.Unlock()
+// UpdateInstanceName renames an instance.  The name must not be used by
+// any other instance of its tenant.  An empty name leaves the instance
+// unnamed.  Instances which are changing state may not be renamed.
+func (ds *Datastore) UpdateInstanceName(instanceID string, name string) error {
+	// Holding the tenants lock ensures no other instance of the tenant
+	// takes the name before this one does.
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
 
 	ds.instancesLock.Lock()
-	i := ds.instances[instanceID]
-	delete(ds.instances, instanceID)
-	ds.instancesLock.Unlock()
+	defer ds.instancesLock.Unlock()
 
-	ds.tenantsLock.Lock()
-	tenant := ds.tenants[i.TenantID]
-	if tenant != nil {
-		delete(tenant.instances, instanceID)
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
 	}
-	ds.tenantsLock.Unlock()
 
-	// we may not have received any node stats for this instance
-	if i.NodeID != "" {
-		ds.nodesLock.Lock()
-		delete(ds.nodes[i.NodeID].instances, instanceID)
-		ds.nodesLock.Unlock()
-	}
+	// Holding the state lock until the name is written ensures the
+	// instance does not start changing state while it is renamed.
+	i.StateLock.RLock()
+	defer i.StateLock.RUnlock()
 
-	var err error
-	if tmpErr := ds.db.deleteInstance(i.ID); tmpErr != nil {
-		glog.Warningf("error deleting instance (%v): %v", i.ID, err)
-		err = errors.Wrapf(tmpErr, "error deleting instance from database (%v)", i.ID)
+	if !renamableStates[i.State] {
+		return types.ErrInstanceChangingState
 	}
 
-	if i.CNCI == false {
-		if tmpErr := ds.ReleaseTenantIP(i.TenantID, i.IPAddress); tmpErr != nil {
-			glog.Warningf("error releasing IP for instance (%v): %v", i.ID, tmpErr)
-			if err == nil {
-				err = errors.Wrapf(err, "error releasing IP for instance (%v)", i.ID)
+	if name != "" {
+		if t, ok := ds.tenants[i.TenantID]; ok {
+			for _, other := range t.instances {
+				if other.ID != instanceID && other.Name == name {
+					return types.ErrInstanceNameInUse
+				}
 			}
 		}
 	}
 
-	ds.updateStorageAttachments(instanceID)
+	err := ds.db.updateInstanceName(instanceID, name)
+	if err != nil {
+		return errors.Wrap(err, "Error updating instance name")
+	}
+
+	i.Name = name
 
-	return i.TenantID, err
+	return nil
 }
 
-// DeleteInstance removes an instance from the datastore.
-func (ds *Datastore) DeleteInstance(instanceID string) error {
-	i, err := ds.GetInstance(instanceID)
+// UpdateInstanceDescription replaces the description of an instance.
+func (ds *Datastore) UpdateInstanceDescription(instanceID string, description string) error {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
+	}
+
+	err := ds.db.updateInstanceDescription(instanceID, description)
 	if err != nil {
-		return errors.Wrapf(err, "error deleting instance")
+		return errors.Wrap(err, "Error updating instance description")
 	}
 
-	nodeID := i.NodeID
+	i.Description = description
 
-	tenantID, err := ds.deleteInstance(instanceID)
+	return nil
+}
+
+// SetInstanceTag tags an instance, replacing the value of the tag if the
+// instance already has one with the same key.
+func (ds *Datastore) SetInstanceTag(instanceID string, key string, value string) error {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
+	}
+
+	if _, ok := i.Tags[key]; !ok && len(i.Tags) >= types.MaxInstanceTags {
+		return types.ErrTooManyInstanceTags
+	}
+
+	err := ds.db.setInstanceTag(instanceID, key, value)
 	if err != nil {
-		return errors.Wrapf(err, "error deleting instance")
+		return errors.Wrap(err, "Error setting instance tag")
 	}
 
-	msg := fmt.Sprintf("Deleted Instance %s", instanceID)
-	e := types.LogEntry{
-		TenantID:  tenantID,
-		EventType: string(userInfo),
-		Message:   msg,
-		NodeID:    nodeID,
+	// the tags are replaced rather than changed in place as they may
+	// still be being read by those who looked up the instance.
+	tags := make(map[string]string, len(i.Tags)+1)
+	for k, v := range i.Tags {
+		tags[k] = v
 	}
-	return errors.Wrap(ds.db.logEvent(e), "Error logging event")
+	tags[key] = value
+	i.Tags = tags
+
+	return nil
 }
 
-func (ds *Datastore) updateInstanceStatus(status, instanceID string) error {
-	stats := []payloads.InstanceStat{
-		{
-			InstanceUUID: instanceID,
-			State:        status,
-		},
+// DeleteInstanceTag removes a tag from an instance.
+func (ds *Datastore) DeleteInstanceTag(instanceID string, key string) error {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
 	}
 
-	err := ds.db.addInstanceStats(stats, "")
+	if _, ok := i.Tags[key]; !ok {
+		return types.ErrInstanceTagNotFound
+	}
+
+	err := ds.db.deleteInstanceTag(instanceID, key)
 	if err != nil {
-		return errors.Wrapf(err, "error adding instance stats to database")
+		return errors.Wrap(err, "Error deleting instance tag")
 	}
 
-	instanceStat := types.CiaoServerStats{
-		ID:        instanceID,
-		Timestamp: time.Now(),
-		Status:    status,
+	var tags map[string]string
+	if len(i.Tags) > 1 {
+		tags = make(map[string]string, len(i.Tags)-1)
+		for k, v := range i.Tags {
+			if k != key {
+				tags[k] = v
+			}
+		}
 	}
-	ds.instanceLastStatLock.Lock()
-	ds.instanceLastStat[instanceID] = instanceStat
-	ds.instanceLastStatLock.Unlock()
+	i.Tags = tags
 
 	return nil
 }
 
-// InstanceRestarting resets a restarting instance's state to pending.
-func (ds *Datastore) InstanceRestarting(instanceID string) error {
-	err := ds.updateInstanceStatus(payloads.Pending, instanceID)
+// UpdateInstanceDeletionProtection sets or clears the deletion protection of
+// an instance.
+func (ds *Datastore) UpdateInstanceDeletionProtection(instanceID string, protected bool) error {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
+	}
+
+	err := ds.db.updateInstanceDeletionProtection(instanceID, protected)
 	if err != nil {
-		return errors.Wrap(err, "Error marking instance as restarting")
+		return errors.Wrap(err, "Error updating instance deletion protection")
 	}
 
-	ds.instancesLock.Lock()
-	i := ds.instances[instanceID]
-	i.State = payloads.Pending
-	ds.instancesLock.Unlock()
+	i.DeletionProtected = protected
 
 	return nil
 }
 
-// InstanceStopped removes the link between an instance and its node
-func (ds *Datastore) InstanceStopped(instanceID string) error {
-	err := ds.updateInstanceStatus(payloads.Exited, instanceID)
+// DeferInstanceDeletion puts an instance into the deleted-pending state, in
+// which it stays until it is restored or is deleted at deleteTime.
+func (ds *Datastore) DeferInstanceDeletion(ctx context.Context, instanceID string, deleteTime time.Time) error {
+	ds.instancesLock.Lock()
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		ds.instancesLock.Unlock()
+		return types.ErrInstanceNotFound
+	}
+
+	err := ds.db.updateInstanceDeleteTime(ctx, instanceID, deleteTime)
 	if err != nil {
-		return errors.Wrap(err, "Error marked instance as stopped")
+		ds.instancesLock.Unlock()
+		return errors.Wrap(err, "Error deferring instance deletion")
 	}
 
-	ds.instancesLock.Lock()
-	i := ds.instances[instanceID]
-	oldNodeID := i.NodeID
-	i.NodeID = ""
-	i.State = payloads.Exited
+	h := stateHistoryEntry(i, payloads.DeletePending, i.NodeID)
+	i.DeleteTime = deleteTime
+	i.StateLock.Lock()
+	i.State = payloads.DeletePending
+	i.StateLock.Unlock()
 	ds.instancesLock.Unlock()
 
-	// we may not have received any node stats for this instance
-	if oldNodeID != "" {
-		ds.nodesLock.Lock()
-		delete(ds.nodes[oldNodeID].instances, instanceID)
-		ds.nodesLock.Unlock()
-	}
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
 
 	return nil
 }
 
-// DeleteNode removes a node from the node cache.
-func (ds *Datastore) DeleteNode(nodeID string) error {
-	ds.nodesLock.Lock()
-	for _, i := range ds.nodes[nodeID].instances {
-		_ = i.TransitionInstanceState(payloads.Missing)
-		i.NodeID = ""
+// RestoreInstance takes an instance out of the deleted-pending state.  It
+// returns to the state its node last reported, or to pending if it has not
+// been reported.
+func (ds *Datastore) RestoreInstance(instanceID string) error {
+	state := payloads.Pending
+	ds.instanceLastStatLock.Lock()
+	if stat, ok := ds.instanceLastStat[instanceID]; ok && stat.Status != "" {
+		state = stat.Status
 	}
-	delete(ds.nodes, nodeID)
-	ds.nodesLock.Unlock()
+	ds.instanceLastStatLock.Unlock()
 
-	ds.nodeLastStatLock.Lock()
-	delete(ds.nodeLastStat, nodeID)
-	ds.nodeLastStatLock.Unlock()
+	ds.instancesLock.Lock()
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		ds.instancesLock.Unlock()
+		return types.ErrInstanceNotFound
+	}
 
-	return nil
-}
+	if i.State != payloads.DeletePending {
+		ds.instancesLock.Unlock()
+		return types.ErrInstanceNotDeletePending
+	}
 
-// AddNode adds a node into the node cache, updating the node's tracked
-// role bitmask if the node is already present to be the superset of all
-// reported roles.
-func (ds *Datastore) AddNode(nodeID string, nodeType payloads.Resource) {
-	var role ssntp.Role
-	switch nodeType {
-	case payloads.ComputeNode:
-		role = ssntp.AGENT
-	case payloads.NetworkNode:
-		role = ssntp.NETAGENT
+	err := ds.db.updateInstanceDeleteTime(context.Background(), instanceID, time.Time{})
+	if err != nil {
+		ds.instancesLock.Unlock()
+		return errors.Wrap(err, "Error restoring instance")
 	}
 
-	ds.nodesLock.Lock()
-	defer ds.nodesLock.Unlock()
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, state, i.NodeID)
+	i.DeleteTime = time.Time{}
+	i.State = state
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
 
-	if ds.nodes[nodeID] != nil {
-		ds.nodes[nodeID].NodeRole |= role
-		return
-	}
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
 
-	n := &node{
-		Node: types.Node{
-			ID:       nodeID,
-			NodeRole: role,
-		},
-		instances: make(map[string]*types.Instance),
-	}
-	ds.nodes[nodeID] = n
+	return nil
 }
 
-// GetNode retrieves a node in the node cache.
-func (ds *Datastore) GetNode(nodeID string) (types.Node, error) {
-	var node types.Node
+// UpdateInstanceRequirements replaces the number of VCPUs and the memory
+// an instance runs with, e.g. when it is resized.
+func (ds *Datastore) UpdateInstanceRequirements(instanceID string, vcpus int, memMB int) error {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
 
-	ds.nodesLock.RLock()
-	defer ds.nodesLock.RUnlock()
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		return types.ErrInstanceNotFound
+	}
 
-	if ds.nodes[nodeID] == nil {
-		return node, fmt.Errorf("node %s not found", nodeID)
+	err := ds.db.updateInstanceRequirements(instanceID, vcpus, memMB)
+	if err != nil {
+		return errors.Wrap(err, "Error updating instance requirements")
 	}
 
-	return ds.nodes[nodeID].Node, nil
+	i.VCPUs = vcpus
+	i.MemMB = memMB
+
+	return nil
 }
 
-// HandleStats makes sure that the data from the stat payload is stored.
-func (ds *Datastore) HandleStats(stat payloads.Stat) error {
-	if stat.Load != -1 {
-		if err := ds.addNodeStat(stat); err != nil {
-			return errors.Wrap(err, "error updating node stats")
+// GetTenantCNCIs will retrieve all CNCI instances belonging to a tenant
+func (ds *Datastore) GetTenantCNCIs(tenantID string) ([]*types.Instance, error) {
+	return ds.getTenantInstances(tenantID, true)
+}
+
+// GetUnassignedCNCIs retrieves the CNCIs which have been launched ahead of
+// demand and not yet assigned to a tenant.
+func (ds *Datastore) GetUnassignedCNCIs() ([]*types.Instance, error) {
+	var instances []*types.Instance
+
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.CNCI && i.TenantID == "" {
+			instances = append(instances, i)
 		}
 	}
+	ds.instancesLock.RUnlock()
 
-	return errors.Wrapf(ds.addInstanceStats(stat.Instances, stat.NodeUUID), "error updating stats")
+	sortInstances(instances)
+
+	return instances, nil
 }
 
-// HandleTraceReport stores the provided trace data in the datastore.
-func (ds *Datastore) HandleTraceReport(trace payloads.Trace) error {
-	var err error
-	for index := range trace.Frames {
-		i := trace.Frames[index]
+// AssignCNCI gives an unassigned CNCI to a tenant to serve one of its
+// subnets.
+func (ds *Datastore) AssignCNCI(instanceID string, tenantID string, subnet string) error {
+	ds.instancesLock.RLock()
+	i, ok := ds.instances[instanceID]
+	ds.instancesLock.RUnlock()
 
-		if tmpErr := ds.db.addFrameStat(i); tmpErr != nil {
-			if err == nil {
-				err = errors.Wrapf(tmpErr, "error adding stats to database")
-			}
-		}
+	if !ok {
+		return types.ErrInstanceNotFound
 	}
 
-	return err
-}
+	if !i.CNCI || i.TenantID != "" {
+		return errors.Errorf("Instance %s is not an unassigned CNCI", instanceID)
+	}
 
-// GetInstanceLastStats retrieves the last instances stats received for this node.
-// It returns it in a format suitable for the compute API.
-func (ds *Datastore) GetInstanceLastStats(nodeID string) types.CiaoServersStats {
-	var serversStats types.CiaoServersStats
+	err := ds.db.updateInstanceTenant(instanceID, tenantID, subnet)
+	if err != nil {
+		return errors.Wrapf(err, "error assigning CNCI (%v) to tenant", instanceID)
+	}
 
-	ds.instanceLastStatLock.RLock()
-	for _, instance := range ds.instanceLastStat {
-		if instance.NodeID != nodeID {
-			continue
-		}
+	ds.instancesLock.Lock()
+	i.TenantID = tenantID
+	i.Subnet = subnet
+	ds.instancesLock.Unlock()
 
-		i, err := ds.GetInstance(instance.ID)
-		if err != nil {
-			glog.Warningf("skipping stat for instance %s: %v", instance.ID, err)
+	ds.tenantsLock.Lock()
+	tenant := ds.tenants[tenantID]
+	if tenant != nil {
+		tenant.instances[instanceID] = i
+	}
+	ds.tenantsLock.Unlock()
+
+	// the CNCI's volumes now belong to the tenant too
+	for _, a := range ds.GetStorageAttachments(instanceID) {
+		ds.bdLock.Lock()
+		device, ok := ds.blockDevices[a.BlockID]
+		ds.bdLock.Unlock()
+		if !ok {
 			continue
 		}
 
-		if i.CNCI != true {
-			serversStats.Servers = append(serversStats.Servers, instance)
+		device.TenantID = tenantID
+		err = ds.AddBlockDevice(context.Background(), device)
+		if err != nil {
+			return errors.Wrapf(err, "error assigning CNCI (%v) volume to tenant", instanceID)
 		}
 	}
-	ds.instanceLastStatLock.RUnlock()
 
-	return serversStats
+	return nil
 }
 
-// GetNodeLastStats retrieves the last nodes' stats received.
-// It returns it in a format suitable for the compute API.
-func (ds *Datastore) GetNodeLastStats() types.CiaoNodes {
-	var nodes types.CiaoNodes
+// GetAllInstancesByNode will retrieve all the instances running on a specific compute Node.
+func (ds *Datastore) GetAllInstancesByNode(nodeID string) ([]*types.Instance, error) {
+	var instances []*types.Instance
 
-	ds.nodeLastStatLock.RLock()
-	for _, node := range ds.nodeLastStat {
+	ds.nodesLock.RLock()
+
+	n, ok := ds.nodes[nodeID]
+	if ok {
+		for _, val := range n.instances {
+			if val.CNCI == false {
+				instances = append(instances, val)
+			}
+		}
+	}
+
+	ds.nodesLock.RUnlock()
+
+	return instances, nil
+}
+
+// AddInstance will store a new instance in the datastore.
+// The instance will be updated both in the cache and in the database
+func (ds *Datastore) AddInstance(ctx context.Context, instance *types.Instance) error {
+	err := ds.db.addInstance(ctx, instance)
+
+	if err != nil {
+		return errors.Wrap(err, "Error adding instance to database")
+	}
+
+	// add to cache
+	ds.instancesLock.Lock()
+
+	ds.instances[instance.ID] = instance
+
+	instanceStat := types.CiaoServerStats{
+		ID:        instance.ID,
+		TenantID:  instance.TenantID,
+		NodeID:    instance.NodeID,
+		Timestamp: time.Now(),
+		Status:    instance.State,
+	}
+
+	ds.instanceLastStatLock.Lock()
+	ds.instanceLastStat[instance.ID] = instanceStat
+	ds.instanceLastStatLock.Unlock()
+
+	ds.instancesLock.Unlock()
+
+	ds.tenantsLock.Lock()
+	tenant := ds.tenants[instance.TenantID]
+	if tenant != nil {
+		tenant.instances[instance.ID] = instance
+	}
+	ds.tenantsLock.Unlock()
+
+	return nil
+}
+
+// StartFailure will clean up after a failure to start an instance.
+// If an instance was a CNCI, this function will remove the CNCI instance
+// for this tenant. If the instance was a normal tenant instance, the
+// IP address will be released and the instance will be deleted from the
+// datastore.
+//
+// Only instances whose status is pending are removed when a StartFailure event
+// is received.  StartFailure errors may also be generated when restarting an
+// exited instance and we want to make sure that a failure to restart such
+// an instance does not result in it being deleted.
+func (ds *Datastore) StartFailure(instanceID string, reason payloads.StartFailureReason, migration bool, nodeID string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	if i.CNCI == true {
+		ds.log.Warningf("CNCI %s Failed to start", instanceID)
+	}
+
+	ds.recordHistory(instanceID, i.TenantID, types.InstanceHistoryEntry{
+		Type:    types.HistoryResult,
+		Message: fmt.Sprintf("Start failed: %s", reason.String()),
+		NodeID:  nodeID,
+	})
+
+	code := types.StartFailureCode(reason)
+	if reason.IsFatal() && !migration {
+		if _, err := ds.deleteInstance(instanceID); err != nil {
+			return errors.Wrap(err, "Error deleting instance")
+		}
+	} else {
+		ds.instancesLock.Lock()
+		i.StatusReason = string(code)
+		ds.instancesLock.Unlock()
+
+		err = ds.db.updateInstanceStatusReason(instanceID, string(code))
+		if err != nil {
+			return errors.Wrap(err, "Error recording instance failure")
+		}
+	}
+
+	ds.nodesLock.Lock()
+	defer ds.nodesLock.Unlock()
+
+	n, ok := ds.nodes[nodeID]
+	if ok {
+		n.TotalFailures++
+		n.StartFailures++
+	}
+
+	msg := fmt.Sprintf("Start Failure %s: %s", instanceID, reason.String())
+	e := types.LogEntry{
+		TenantID:    i.TenantID,
+		EventType:   string(userError),
+		Message:     msg,
+		NodeID:      nodeID,
+		ObjectID:    instanceID,
+		FailureCode: string(code),
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// AttachVolumeFailure will clean up after a failure to attach a volume.
+// The volume state will be changed back to available, and an error message
+// will be logged.
+func (ds *Datastore) AttachVolumeFailure(instanceID string, volumeID string, reason payloads.AttachVolumeFailureReason) error {
+	// update the block data to reflect correct state
+	data, err := ds.GetBlockDevice(volumeID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting block device for volume (%v)", volumeID)
+	}
+
+	oldState := data.State
+	data.State = types.Available
+	err = ds.UpdateBlockDevice(context.Background(), data)
+	if err != nil {
+		data.State = oldState
+		return errors.Wrapf(err, "error updating block device for volume (%v)", volumeID)
+	}
+
+	// get owner of this instance
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	ds.nodesLock.Lock()
+	defer ds.nodesLock.Unlock()
+
+	n, ok := ds.nodes[i.NodeID]
+	if ok {
+		n.TotalFailures++
+		n.AttachVolumeFailures++
+	}
+
+	ds.recordHistory(instanceID, i.TenantID, types.InstanceHistoryEntry{
+		Type:    types.HistoryResult,
+		Message: fmt.Sprintf("Attach of volume %s failed: %s", volumeID, reason.String()),
+		NodeID:  i.NodeID,
+	})
+
+	msg := fmt.Sprintf("Attach Volume Failure %s to %s: %s", volumeID, instanceID, reason.String())
+	e := types.LogEntry{
+		TenantID:  i.TenantID,
+		EventType: string(userError),
+		Message:   msg,
+		NodeID:    i.NodeID,
+		ObjectID:  volumeID,
+	}
+
+	ds.events.add(e)
+	return nil
+}
+
+func (ds *Datastore) deleteInstance(instanceID string) (string, error) {
+	if err := ds.db.deleteInstance(instanceID); err != nil {
+		ds.log.Warningf("error deleting instance (%v): %v", instanceID, err)
+		return "", errors.Wrapf(err, "error deleting instance from database (%v)", instanceID)
+	}
+
+	ds.instanceLastStatLock.Lock()
+	delete(ds.instanceLastStat, instanceID)
+	ds.instanceLastStatLock.Unlock()
+
+	ds.instancesLock.Lock()
+	i := ds.instances[instanceID]
+	delete(ds.instances, instanceID)
+	delete(ds.pendingPlacements, instanceID)
+	delete(ds.instanceConditions, instanceID)
+	ds.instancesLock.Unlock()
+
+	ds.tenantsLock.Lock()
+	tenant := ds.tenants[i.TenantID]
+	if tenant != nil {
+		delete(tenant.instances, instanceID)
+	}
+	ds.tenantsLock.Unlock()
+
+	// we may not have received any node stats for this instance
+	if i.NodeID != "" {
+		ds.nodesLock.Lock()
+		delete(ds.nodes[i.NodeID].instances, instanceID)
+		ds.nodesLock.Unlock()
+	}
+
+	var err error
+	if tmpErr := ds.db.deleteInstance(i.ID); tmpErr != nil {
+		ds.log.Warningf("error deleting instance (%v): %v", i.ID, err)
+		err = errors.Wrapf(tmpErr, "error deleting instance from database (%v)", i.ID)
+	}
+
+	if i.CNCI == false {
+		ds.releaseUsage(types.UsageSpan{
+			TenantID: i.TenantID,
+			ID:       i.ID,
+			Resource: types.UsageInstance,
+			Start:    i.CreateTime,
+		})
+
+		if tmpErr := ds.ReleaseTenantIP(i.TenantID, i.IPAddress); tmpErr != nil {
+			ds.log.Warningf("error releasing IP for instance (%v): %v", i.ID, tmpErr)
+			if err == nil {
+				err = errors.Wrapf(err, "error releasing IP for instance (%v)", i.ID)
+			}
+		}
+
+		for _, nic := range i.NICs {
+			if tmpErr := ds.ReleaseTenantIP(i.TenantID, nic.IPAddress); tmpErr != nil {
+				ds.log.Warningf("error releasing IP %s for instance (%v): %v", nic.IPAddress, i.ID, tmpErr)
+			}
+		}
+	}
+
+	ds.detachInstanceVolumes(instanceID)
+
+	return i.TenantID, err
+}
+
+// DeleteInstance removes an instance from the datastore.
+func (ds *Datastore) DeleteInstance(instanceID string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting instance")
+	}
+
+	nodeID := i.NodeID
+
+	tenantID, err := ds.deleteInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting instance")
+	}
+
+	if i.State == payloads.Queued {
+		err = ds.db.deleteQueuedLaunch(instanceID)
+		if err != nil {
+			return errors.Wrapf(err, "error deleting queued launch")
+		}
+	}
+
+	if i.CNCI {
+		err = ds.deleteCNCIInstanceImage(instanceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ds.db.deleteLaunchConfig(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting launch config")
+	}
+
+	err = ds.removeServerGroupMember(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error leaving server group")
+	}
+
+	ds.recordHistory(instanceID, tenantID, types.InstanceHistoryEntry{
+		Type:    types.HistoryState,
+		Message: "Instance deleted",
+		NodeID:  nodeID,
+	})
+
+	msg := fmt.Sprintf("Deleted Instance %s", instanceID)
+	e := types.LogEntry{
+		TenantID:  tenantID,
+		EventType: string(userInfo),
+		Message:   msg,
+		NodeID:    nodeID,
+		ObjectID:  instanceID,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+func (ds *Datastore) updateInstanceStatus(status, instanceID string) error {
+	stats := []payloads.InstanceStat{
+		{
+			InstanceUUID: instanceID,
+			State:        status,
+		},
+	}
+
+	err := ds.db.addInstanceStats(stats, "")
+	if err != nil {
+		return errors.Wrapf(err, "error adding instance stats to database")
+	}
+
+	instanceStat := types.CiaoServerStats{
+		ID:        instanceID,
+		Timestamp: time.Now(),
+		Status:    status,
+	}
+	ds.instanceLastStatLock.Lock()
+	ds.instanceLastStat[instanceID] = instanceStat
+	ds.instanceLastStatLock.Unlock()
+
+	return nil
+}
+
+// InstanceRestarting resets a restarting instance's state to pending.
+func (ds *Datastore) InstanceRestarting(instanceID string) error {
+	err := ds.updateInstanceStatus(payloads.Pending, instanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error marking instance as restarting")
+	}
+
+	ds.instancesLock.Lock()
+	i := ds.instances[instanceID]
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.Pending, i.NodeID)
+	i.State = payloads.Pending
+	i.StateLock.Unlock()
+	if _, ok := ds.pendingPlacements[instanceID]; !ok {
+		ds.pendingPlacements[instanceID] = types.PlacementReschedule
+	}
+	ds.instancesLock.Unlock()
+
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	return nil
+}
+
+// InstanceStopped removes the link between an instance and its node
+func (ds *Datastore) InstanceStopped(instanceID string) error {
+	err := ds.updateInstanceStatus(payloads.Exited, instanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error marked instance as stopped")
+	}
+
+	ds.instancesLock.Lock()
+	i := ds.instances[instanceID]
+	oldNodeID := i.NodeID
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.Exited, oldNodeID)
+	i.NodeID = ""
+	i.State = payloads.Exited
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	// we may not have received any node stats for this instance
+	if oldNodeID != "" {
+		ds.nodesLock.Lock()
+		delete(ds.nodes[oldNodeID].instances, instanceID)
+		ds.nodesLock.Unlock()
+	}
+
+	return errors.Wrap(ds.db.updateInstanceNode(instanceID, ""), "Error clearing instance node")
+}
+
+// InstanceFailed marks an instance which has been lost by its node as
+// failed, removes the link between the instance and the node and logs the
+// reason for the failure.
+func (ds *Datastore) InstanceFailed(instanceID string, reason string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	err = ds.updateInstanceStatus(payloads.ExitFailed, instanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error marking instance as failed")
+	}
+
+	ds.instancesLock.Lock()
+	oldNodeID := i.NodeID
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.ExitFailed, oldNodeID)
+	h.entry.Message += ": " + reason
+	i.NodeID = ""
+	i.State = payloads.ExitFailed
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	if oldNodeID != "" {
+		ds.nodesLock.Lock()
+		if n, ok := ds.nodes[oldNodeID]; ok {
+			delete(n.instances, instanceID)
+		}
+		ds.nodesLock.Unlock()
+	}
+
+	err = ds.db.updateInstanceNode(instanceID, "")
+	if err != nil {
+		return errors.Wrap(err, "Error clearing instance node")
+	}
+
+	msg := fmt.Sprintf("Instance %s failed: %s", instanceID, reason)
+	e := types.LogEntry{
+		TenantID:  i.TenantID,
+		EventType: string(userError),
+		Message:   msg,
+		NodeID:    oldNodeID,
+		ObjectID:  instanceID,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// AdoptInstance links an instance to the node which reports running it and
+// updates its state.
+func (ds *Datastore) AdoptInstance(instanceID string, nodeID string, state string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	stats := []payloads.InstanceStat{
+		{
+			InstanceUUID: instanceID,
+			State:        state,
+		},
+	}
+
+	err = ds.db.addInstanceStats(stats, nodeID)
+	if err != nil {
+		return errors.Wrapf(err, "error adding instance stats to database")
+	}
+
+	ds.instancesLock.Lock()
+	oldNodeID := i.NodeID
+	var placement *types.Placement
+	if oldNodeID != nodeID {
+		placement = &types.Placement{
+			NodeID:    nodeID,
+			Timestamp: time.Now(),
+			Reason:    ds.placementReason(i),
+		}
+	}
+	var h *instanceHistoryEntry
+	i.StateLock.Lock()
+	if i.State != state {
+		e := stateHistoryEntry(i, state, nodeID)
+		h = &e
+	}
+	i.NodeID = nodeID
+	i.State = state
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	if placement != nil {
+		err = ds.db.addPlacement(instanceID, *placement)
+		if err != nil {
+			return errors.Wrapf(err, "error recording placement of instance (%v)", instanceID)
+		}
+		ds.recordPlacement(instanceID, *placement)
+	}
+
+	if h != nil {
+		ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+	}
+
+	ds.nodesLock.Lock()
+	if n, ok := ds.nodes[oldNodeID]; ok {
+		delete(n.instances, instanceID)
+	}
+	n, ok := ds.nodes[nodeID]
+	if !ok {
+		n = &node{
+			Node: types.Node{
+				ID: nodeID,
+			},
+			instances: make(map[string]*types.Instance),
+		}
+		ds.nodes[nodeID] = n
+	}
+	n.instances[instanceID] = i
+	ds.nodesLock.Unlock()
+
+	msg := fmt.Sprintf("Adopted Instance %s", instanceID)
+	e := types.LogEntry{
+		TenantID:  i.TenantID,
+		EventType: string(userInfo),
+		Message:   msg,
+		NodeID:    nodeID,
+		ObjectID:  instanceID,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// StartMigration records the start of the live migration of an instance
+// and marks the instance as migrating.  Until the migration is completed or
+// aborted the stats reported for the instance do not change its state or
+// node.
+func (ds *Datastore) StartMigration(m types.Migration) error {
+	i, err := ds.GetInstance(m.InstanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", m.InstanceID)
+	}
+
+	ds.migrationsLock.Lock()
+	if _, ok := ds.migrations[m.InstanceID]; ok {
+		ds.migrationsLock.Unlock()
+		return types.ErrInstanceMigrating
+	}
+
+	err = ds.db.updateMigration(m)
+	if err != nil {
+		ds.migrationsLock.Unlock()
+		return errors.Wrap(err, "error adding migration to database")
+	}
+	ds.migrations[m.InstanceID] = m
+	ds.migrationsLock.Unlock()
+
+	ds.instancesLock.Lock()
+	h := stateHistoryEntry(i, payloads.Migrating, m.SourceNodeID)
+	i.StateLock.Lock()
+	i.State = payloads.Migrating
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	return nil
+}
+
+// UpdateMigration records the progress of the live migration of an
+// instance.
+func (ds *Datastore) UpdateMigration(m types.Migration) error {
+	ds.migrationsLock.Lock()
+	defer ds.migrationsLock.Unlock()
+
+	if _, ok := ds.migrations[m.InstanceID]; !ok {
+		return ErrNoMigration
+	}
+
+	err := ds.db.updateMigration(m)
+	if err != nil {
+		return errors.Wrap(err, "error updating migration in database")
+	}
+	ds.migrations[m.InstanceID] = m
+
+	return nil
+}
+
+// GetMigration retrieves the live migration in progress of an instance.
+func (ds *Datastore) GetMigration(instanceID string) (types.Migration, bool) {
+	ds.migrationsLock.RLock()
+	defer ds.migrationsLock.RUnlock()
+
+	m, ok := ds.migrations[instanceID]
+	return m, ok
+}
+
+// GetMigrations retrieves the live migrations in progress, oldest first.
+func (ds *Datastore) GetMigrations() []types.Migration {
+	ds.migrationsLock.RLock()
+	defer ds.migrationsLock.RUnlock()
+
+	migrations := make([]types.Migration, 0, len(ds.migrations))
+	for _, m := range ds.migrations {
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].StartTime.Before(migrations[j].StartTime)
+	})
+
+	return migrations
+}
+
+// removeMigration forgets the live migration of an instance.
+func (ds *Datastore) removeMigration(instanceID string) (types.Migration, error) {
+	ds.migrationsLock.Lock()
+	defer ds.migrationsLock.Unlock()
+
+	m, ok := ds.migrations[instanceID]
+	if !ok {
+		return types.Migration{}, ErrNoMigration
+	}
+
+	err := ds.db.deleteMigration(instanceID)
+	if err != nil {
+		return types.Migration{}, errors.Wrap(err, "error deleting migration from database")
+	}
+	delete(ds.migrations, instanceID)
+
+	return m, nil
+}
+
+// CompleteMigration records that an instance has been live migrated to
+// the target node of its migration, which now runs it.
+func (ds *Datastore) CompleteMigration(instanceID string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	m, err := ds.removeMigration(instanceID)
+	if err != nil {
+		return err
+	}
+
+	stats := []payloads.InstanceStat{
+		{
+			InstanceUUID: instanceID,
+			State:        payloads.Running,
+		},
+	}
+
+	err = ds.db.addInstanceStats(stats, m.TargetNodeID)
+	if err != nil {
+		return errors.Wrapf(err, "error adding instance stats to database")
+	}
+
+	err = ds.db.updateInstanceNode(instanceID, m.TargetNodeID)
+	if err != nil {
+		return errors.Wrap(err, "error updating instance node")
+	}
+
+	placement := types.Placement{
+		NodeID:    m.TargetNodeID,
+		Timestamp: time.Now(),
+		Reason:    types.PlacementLiveMigration,
+	}
+
+	ds.instancesLock.Lock()
+	delete(ds.pendingPlacements, instanceID)
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.Running, m.TargetNodeID)
+	i.NodeID = m.TargetNodeID
+	i.State = payloads.Running
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	err = ds.db.addPlacement(instanceID, placement)
+	if err != nil {
+		return errors.Wrapf(err, "error recording placement of instance (%v)", instanceID)
+	}
+	ds.recordPlacement(instanceID, placement)
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	ds.nodesLock.Lock()
+	if n, ok := ds.nodes[m.SourceNodeID]; ok {
+		delete(n.instances, instanceID)
+	}
+	n, ok := ds.nodes[m.TargetNodeID]
+	if !ok {
+		n = &node{
+			Node: types.Node{
+				ID: m.TargetNodeID,
+			},
+			instances: make(map[string]*types.Instance),
+		}
+		ds.nodes[m.TargetNodeID] = n
+	}
+	n.instances[instanceID] = i
+	ds.nodesLock.Unlock()
+
+	return nil
+}
+
+// AbortMigration forgets the live migration of an instance which has
+// failed and returns the instance, which is still running on its original
+// node, to the running state.
+func (ds *Datastore) AbortMigration(instanceID string) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	m, err := ds.removeMigration(instanceID)
+	if err != nil {
+		return err
+	}
+
+	ds.instancesLock.Lock()
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.Running, m.SourceNodeID)
+	i.State = payloads.Running
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+
+	return nil
+}
+
+// GetNodes retrieves the nodes in the node cache.
+func (ds *Datastore) GetNodes() []types.Node {
+	ds.nodesLock.RLock()
+	defer ds.nodesLock.RUnlock()
+
+	nodes := make([]types.Node, 0, len(ds.nodes))
+	for _, n := range ds.nodes {
+		nodes = append(nodes, n.Node)
+	}
+
+	return nodes
+}
+
+// SetNodeLiveness records whether a node is ready, suspect or down.  When
+// a node goes down its instances are marked as unreachable.
+func (ds *Datastore) SetNodeLiveness(nodeID string, status types.NodeStatusType) error {
+	ds.nodesLock.Lock()
+	defer ds.nodesLock.Unlock()
+
+	n, ok := ds.nodes[nodeID]
+	if !ok {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	from := n.liveness
+	if from == "" {
+		from = types.NodeStatusReady
+	}
+
+	if from != status {
+		ds.events.add(types.LogEntry{
+			EventType: string(nodeStatus),
+			Message:   fmt.Sprintf("Node %s: Status changed from %s to %s", nodeID, from, status),
+			NodeID:    nodeID,
+			ObjectID:  nodeID,
+		})
+	}
+
+	n.liveness = status
+	if status == types.NodeStatusReady {
+		n.liveness = ""
+	}
+
+	if status != types.NodeStatusDown {
+		return nil
+	}
+
+	for _, i := range n.instances {
+		if i.State == payloads.Deleted {
+			continue
+		}
+		_ = i.TransitionInstanceState(payloads.Unreachable)
+	}
+
+	return nil
+}
+
+func (ds *Datastore) nodeLiveness() map[string]types.NodeStatusType {
+	ds.nodesLock.RLock()
+	defer ds.nodesLock.RUnlock()
+
+	liveness := make(map[string]types.NodeStatusType)
+	for ID, n := range ds.nodes {
+		if n.liveness != "" {
+			liveness[ID] = n.liveness
+		}
+	}
+
+	return liveness
+}
+
+// DeleteNode removes a node from the node cache.
+func (ds *Datastore) DeleteNode(nodeID string) error {
+	var lost []string
+
+	ds.nodesLock.Lock()
+	for _, i := range ds.nodes[nodeID].instances {
+		_ = i.TransitionInstanceState(payloads.Missing)
+		i.NodeID = ""
+		lost = append(lost, i.ID)
+	}
+	delete(ds.nodes, nodeID)
+	ds.nodesLock.Unlock()
+
+	for _, instanceID := range lost {
+		if err := ds.db.updateInstanceNode(instanceID, ""); err != nil {
+			ds.log.Warningf("error clearing node of instance (%v): %v", instanceID, err)
+		}
+	}
+
+	ds.nodeLastStatLock.Lock()
+	delete(ds.nodeLastStat, nodeID)
+	ds.nodeLastStatLock.Unlock()
+
+	return nil
+}
+
+// AddNode adds a node into the node cache, updating the node's tracked
+// role bitmask if the node is already present to be the superset of all
+// reported roles.
+func (ds *Datastore) AddNode(nodeID string, nodeType payloads.Resource) {
+	var role ssntp.Role
+	switch nodeType {
+	case payloads.ComputeNode:
+		role = ssntp.AGENT
+	case payloads.NetworkNode:
+		role = ssntp.NETAGENT
+	}
+
+	ds.nodesLock.Lock()
+	defer ds.nodesLock.Unlock()
+
+	if ds.nodes[nodeID] != nil {
+		ds.nodes[nodeID].NodeRole |= role
+		return
+	}
+
+	n := &node{
+		Node: types.Node{
+			ID:       nodeID,
+			NodeRole: role,
+		},
+		instances: make(map[string]*types.Instance),
+	}
+	ds.nodes[nodeID] = n
+}
+
+// GetNode retrieves a node in the node cache.
+func (ds *Datastore) GetNode(nodeID string) (types.Node, error) {
+	var node types.Node
+
+	ds.nodesLock.RLock()
+	defer ds.nodesLock.RUnlock()
+
+	if ds.nodes[nodeID] == nil {
+		return node, fmt.Errorf("node %s not found", nodeID)
+	}
+
+	return ds.nodes[nodeID].Node, nil
+}
+
+// HandleStats makes sure that the data from the stat payload is stored.
+func (ds *Datastore) HandleStats(stat payloads.Stat) error {
+	if stat.Load != -1 {
+		if err := ds.addNodeStat(stat); err != nil {
+			return errors.Wrap(err, "error updating node stats")
+		}
+	}
+
+	return errors.Wrapf(ds.addInstanceStats(stat.Instances, stat.NodeUUID), "error updating stats")
+}
+
+// HandleTraceReport stores the provided trace data in the datastore.
+func (ds *Datastore) HandleTraceReport(trace payloads.Trace) error {
+	var err error
+	for index := range trace.Frames {
+		i := trace.Frames[index]
+
+		if tmpErr := ds.db.addFrameStat(i); tmpErr != nil {
+			if err == nil {
+				err = errors.Wrapf(tmpErr, "error adding stats to database")
+			}
+		}
+	}
+
+	return err
+}
+
+// GetInstanceLastStats retrieves the last instances stats received for this node.
+// It returns it in a format suitable for the compute API.
+func (ds *Datastore) GetInstanceLastStats(nodeID string) types.CiaoServersStats {
+	var serversStats types.CiaoServersStats
+
+	ds.instanceLastStatLock.RLock()
+	for _, instance := range ds.instanceLastStat {
+		if instance.NodeID != nodeID {
+			continue
+		}
+
+		i, err := ds.GetInstance(instance.ID)
+		if err != nil {
+			ds.log.Warningf("skipping stat for instance %s: %v", instance.ID, err)
+			continue
+		}
+
+		if i.CNCI != true {
+			serversStats.Servers = append(serversStats.Servers, instance)
+		}
+	}
+	ds.instanceLastStatLock.RUnlock()
+
+	return serversStats
+}
+
+// GetNodeLastStats retrieves the last nodes' stats received.
+// It returns it in a format suitable for the compute API.
+// The status of nodes which have stopped sending stats is reported as
+// suspect or down rather than the status in their last stats.
+func (ds *Datastore) GetNodeLastStats() types.CiaoNodes {
+	var nodes types.CiaoNodes
+
+	liveness := ds.nodeLiveness()
+
+	ds.nodeLastStatLock.RLock()
+	for _, node := range ds.nodeLastStat {
+		if status, ok := liveness[node.ID]; ok {
+			node.Status = string(status)
+		}
+		node.Maintenance = ds.NodeInMaintenance(node.ID)
 		nodes.Nodes = append(nodes.Nodes, node)
 	}
-	ds.nodeLastStatLock.RUnlock()
+	ds.nodeLastStatLock.RUnlock()
+
+	return nodes
+}
+
+// GetClusterStatus summarises the status of the nodes.  The capacity of
+// nodes which are down is not included.
+func (ds *Datastore) GetClusterStatus() types.CiaoClusterStatus {
+	var cluster types.CiaoClusterStatus
+
+	for _, node := range ds.GetNodeLastStats().Nodes {
+		cluster.Status.TotalNodes++
+
+		status := types.NodeStatusType(node.Status)
+		if node.Maintenance && status == types.NodeStatusReady {
+			status = types.NodeStatusMaintenance
+		}
+
+		switch status {
+		case types.NodeStatusReady:
+			cluster.Status.TotalNodesReady++
+		case types.NodeStatusFull:
+			cluster.Status.TotalNodesFull++
+		case types.NodeStatusMaintenance:
+			cluster.Status.TotalNodesMaintenance++
+		case types.NodeStatusSuspect:
+			cluster.Status.TotalNodesSuspect++
+		case types.NodeStatusDown:
+			cluster.Status.TotalNodesDown++
+			continue
+		}
+
+		cluster.Status.MemTotal += reduceToZero(node.MemTotal)
+		cluster.Status.MemAvailable += reduceToZero(node.MemAvailable)
+		cluster.Status.DiskTotal += reduceToZero(node.DiskTotal)
+		cluster.Status.DiskAvailable += reduceToZero(node.DiskAvailable)
+		cluster.Status.OnlineCPUs += reduceToZero(node.OnlineCPUs)
+	}
+
+	return cluster
+}
+
+func (ds *Datastore) addNodeStat(stat payloads.Stat) error {
+	ds.nodesLock.Lock()
+
+	n, ok := ds.nodes[stat.NodeUUID]
+	if !ok {
+		n = &node{}
+		n.instances = make(map[string]*types.Instance)
+		ds.nodes[stat.NodeUUID] = n
+	}
+
+	n.ID = stat.NodeUUID
+	n.Hostname = stat.NodeHostName
+	n.Labels = stat.Labels
+
+	cnStat := types.CiaoNode{
+		ID:                   stat.NodeUUID,
+		Hostname:             n.Hostname,
+		Timestamp:            time.Now(),
+		Status:               stat.Status,
+		Load:                 stat.Load,
+		MemTotal:             stat.MemTotalMB,
+		MemAvailable:         stat.MemAvailableMB,
+		DiskTotal:            stat.DiskTotalMB,
+		DiskAvailable:        stat.DiskAvailableMB,
+		OnlineCPUs:           stat.CpusOnline,
+		TotalFailures:        n.TotalFailures,
+		StartFailures:        n.StartFailures,
+		AttachVolumeFailures: n.AttachVolumeFailures,
+		DeleteFailures:       n.DeleteFailures,
+		Labels:               stat.Labels,
+	}
+
+	ds.nodesLock.Unlock()
+	ds.nodeLastStatLock.Lock()
+
+	delete(ds.nodeLastStat, stat.NodeUUID)
+	ds.nodeLastStat[stat.NodeUUID] = cnStat
+
+	ds.nodeLastStatLock.Unlock()
+
+	return errors.Wrap(ds.db.addNodeStat(stat), "error adding node stats to database")
+}
+
+var tenantUsagePeriodMinutes float64 = 5
+
+func (ds *Datastore) updateTenantUsageNeeded(delta types.CiaoUsage, tenantID string) bool {
+	if delta.VCPU == 0 &&
+		delta.Memory == 0 &&
+		delta.Disk == 0 {
+		return false
+	}
+
+	return true
+}
+
+func (ds *Datastore) updateTenantUsage(delta types.CiaoUsage, tenantID string) {
+	if ds.updateTenantUsageNeeded(delta, tenantID) == false {
+		return
+	}
+
+	createNewUsage := true
+	lastUsage := types.CiaoUsage{}
+
+	ds.tenantUsageLock.Lock()
+
+	tenantUsage := ds.tenantUsage[tenantID]
+	if len(tenantUsage) != 0 {
+		lastUsage = tenantUsage[len(tenantUsage)-1]
+		// We will not create more than one entry per tenant every tenantUsagePeriodMinutes
+		if time.Since(lastUsage.Timestamp).Minutes() < tenantUsagePeriodMinutes {
+			createNewUsage = false
+		}
+	}
+
+	newUsage := types.CiaoUsage{
+		VCPU:   lastUsage.VCPU + delta.VCPU,
+		Memory: lastUsage.Memory + delta.Memory,
+		Disk:   lastUsage.Disk + delta.Disk,
+	}
+
+	// If we need to create a new usage entry, we timestamp it now.
+	// If not we just update the last entry.
+	if createNewUsage == true {
+		newUsage.Timestamp = time.Now()
+		ds.tenantUsage[tenantID] = append(ds.tenantUsage[tenantID], newUsage)
+	} else {
+		newUsage.Timestamp = lastUsage.Timestamp
+		tenantUsage[len(tenantUsage)-1] = newUsage
+	}
+
+	ds.tenantUsageLock.Unlock()
+}
+
+// GetTenantUsage provides statistics on actual resource usage.
+// Usage is provided between a specified time period.
+func (ds *Datastore) GetTenantUsage(tenantID string, start time.Time, end time.Time) ([]types.CiaoUsage, error) {
+	ds.tenantUsageLock.RLock()
+	defer ds.tenantUsageLock.RUnlock()
+
+	tenantUsage := ds.tenantUsage[tenantID]
+	if tenantUsage == nil || len(tenantUsage) == 0 {
+		return nil, nil
+	}
+
+	historyLength := len(tenantUsage)
+	if tenantUsage[0].Timestamp.After(end) == true ||
+		start.After(tenantUsage[historyLength-1].Timestamp) == true {
+		return nil, nil
+	}
+
+	first := 0
+	last := 0
+	for _, u := range tenantUsage {
+		if start.After(u.Timestamp) == true {
+			first++
+		}
+
+		if end.After(u.Timestamp) == true {
+			last++
+		}
+	}
+
+	return tenantUsage[first:last], nil
+}
+
+func reduceToZero(v int) int {
+	if v < 0 {
+		return 0
+	}
+
+	return v
+}
+
+func (ds *Datastore) addInstanceStats(stats []payloads.InstanceStat, nodeID string) error {
+	placements := make(map[string]types.Placement)
+	var history []instanceHistoryEntry
+
+	for index := range stats {
+		stat := stats[index]
+
+		if stat.VolumeDevices != nil {
+			ds.updateAttachmentDevices(stat.InstanceUUID, stat.VolumeDevices)
+		}
+
+		instanceStat := types.CiaoServerStats{
+			ID:        stat.InstanceUUID,
+			NodeID:    nodeID,
+			Timestamp: time.Now(),
+			Status:    stat.State,
+			VCPUUsage: reduceToZero(stat.CPUUsage),
+			MemUsage:  reduceToZero(stat.MemoryUsageMB),
+			DiskUsage: reduceToZero(stat.DiskUsageMB),
+		}
+
+		ds.instanceLastStatLock.Lock()
+
+		lastInstanceStat := ds.instanceLastStat[stat.InstanceUUID]
+
+		deltaUsage := types.CiaoUsage{
+			VCPU:   instanceStat.VCPUUsage - lastInstanceStat.VCPUUsage,
+			Memory: instanceStat.MemUsage - lastInstanceStat.MemUsage,
+			Disk:   instanceStat.DiskUsage - lastInstanceStat.DiskUsage,
+		}
+
+		ds.updateTenantUsage(deltaUsage, lastInstanceStat.TenantID)
+
+		instanceStat.TenantID = lastInstanceStat.TenantID
+
+		delete(ds.instanceLastStat, stat.InstanceUUID)
+		ds.instanceLastStat[stat.InstanceUUID] = instanceStat
+
+		ds.instanceLastStatLock.Unlock()
+
+		ds.instancesLock.Lock()
+		instance, ok := ds.instances[stat.InstanceUUID]
+		// The node and state of an instance being migrated are only
+		// changed once its migration completes or is aborted.
+		if ok && instance.State != payloads.Migrating {
+			oldNodeID := instance.NodeID
+			if oldNodeID != nodeID {
+				placements[instance.ID] = types.Placement{
+					NodeID:    nodeID,
+					Timestamp: instanceStat.Timestamp,
+					Reason:    ds.placementReason(instance),
+				}
+			}
+
+			// instances pending deletion stay in that state
+			// until they are deleted or restored
+			instance.StateLock.Lock()
+			if instance.State != stat.State && instance.State != payloads.DeletePending {
+				history = append(history, stateHistoryEntry(instance, stat.State, nodeID))
+				instance.State = stat.State
+			}
+			instance.StateLock.Unlock()
+
+			instance.NodeID = nodeID
+			instance.SSHIP = stat.SSHIP
+			instance.SSHPort = stat.SSHPort
+			ds.nodesLock.Lock()
+			if n, ok := ds.nodes[oldNodeID]; ok && oldNodeID != nodeID {
+				delete(n.instances, instance.ID)
+			}
+			ds.nodes[nodeID].instances[instance.ID] = instance
+			ds.nodesLock.Unlock()
+		}
+		ds.instancesLock.Unlock()
+	}
+
+	for instanceID, p := range placements {
+		err := ds.db.addPlacement(instanceID, p)
+		if err != nil {
+			return errors.Wrapf(err, "error recording placement of instance (%v)", instanceID)
+		}
+		ds.recordPlacement(instanceID, p)
+	}
+
+	for _, h := range history {
+		ds.recordHistory(h.instanceID, h.tenantID, h.entry)
+	}
+
+	return errors.Wrapf(ds.db.addInstanceStats(stats, nodeID), "error adding instance stats to database")
+}
+
+// placementReason returns why an instance is being placed on a new node.
+// Instances the controller has not asked to be moved are either being
+// placed for the first time or have been migrated.  It must be called with
+// instancesLock held.
+func (ds *Datastore) placementReason(i *types.Instance) types.PlacementReason {
+	reason, ok := ds.pendingPlacements[i.ID]
+	if ok {
+		delete(ds.pendingPlacements, i.ID)
+		return reason
+	}
+
+	if i.NodeID == "" {
+		return types.PlacementInitial
+	}
+
+	return types.PlacementMigration
+}
+
+// SetNodeMaintenance records whether a node is in maintenance.  The record
+// outlives the connection of the node so that it stays in maintenance when
+// it reconnects.
+func (ds *Datastore) SetNodeMaintenance(nodeID string, maintenance bool) error {
+	ds.nodeMaintenanceLock.Lock()
+	defer ds.nodeMaintenanceLock.Unlock()
+
+	err := ds.db.updateNodeMaintenance(nodeID, maintenance)
+	if err != nil {
+		return errors.Wrapf(err, "error updating maintenance of node (%v)", nodeID)
+	}
+
+	if maintenance {
+		ds.nodeMaintenance[nodeID] = true
+	} else {
+		delete(ds.nodeMaintenance, nodeID)
+	}
+
+	return nil
+}
+
+// NodeInMaintenance reports whether a node is in maintenance.
+func (ds *Datastore) NodeInMaintenance(nodeID string) bool {
+	ds.nodeMaintenanceLock.RLock()
+	defer ds.nodeMaintenanceLock.RUnlock()
+
+	return ds.nodeMaintenance[nodeID]
+}
+
+// GetMaintenanceNodes returns the IDs of the nodes in maintenance, sorted.
+func (ds *Datastore) GetMaintenanceNodes() []string {
+	ds.nodeMaintenanceLock.RLock()
+	nodes := make([]string, 0, len(ds.nodeMaintenance))
+	for nodeID := range ds.nodeMaintenance {
+		nodes = append(nodes, nodeID)
+	}
+	ds.nodeMaintenanceLock.RUnlock()
+
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// EvacuatingNode records that the instances on a node are being evacuated
+// so that their next placements are attributed to the evacuation.
+func (ds *Datastore) EvacuatingNode(nodeID string) {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	for _, i := range ds.instances {
+		if i.NodeID == nodeID {
+			ds.pendingPlacements[i.ID] = types.PlacementEvacuation
+		}
+	}
+}
+
+// GetInstancePlacements returns the node an instance is placed on and the
+// history of its placements.
+func (ds *Datastore) GetInstancePlacements(instanceID string) (types.InstancePlacements, error) {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return types.InstancePlacements{}, err
+	}
+
+	ds.instancesLock.RLock()
+	nodeID := i.NodeID
+	ds.instancesLock.RUnlock()
+
+	placements, err := ds.db.getPlacements(instanceID)
+	if err != nil {
+		return types.InstancePlacements{}, errors.Wrapf(err, "error getting placements of instance (%v)", instanceID)
+	}
+
+	return types.InstancePlacements{
+		InstanceID: instanceID,
+		NodeID:     nodeID,
+		Placements: placements,
+	}, nil
+}
+
+// instanceHistoryEntry is an entry waiting to be added to the history of
+// an instance once instancesLock has been released.
+type instanceHistoryEntry struct {
+	instanceID string
+	tenantID   string
+	entry      types.InstanceHistoryEntry
+}
+
+// stateHistoryEntry describes the transition of an instance to state.  It
+// must be called with instancesLock held.
+func stateHistoryEntry(i *types.Instance, state string, nodeID string) instanceHistoryEntry {
+	msg := fmt.Sprintf("State changed to %s", state)
+	if i.State != "" {
+		msg = fmt.Sprintf("State changed from %s to %s", i.State, state)
+	}
+
+	return instanceHistoryEntry{
+		instanceID: i.ID,
+		tenantID:   i.TenantID,
+		entry: types.InstanceHistoryEntry{
+			Type:    types.HistoryState,
+			Message: msg,
+			NodeID:  nodeID,
+		},
+	}
+}
+
+// recordPlacement adds a placement to the history of an instance.
+func (ds *Datastore) recordPlacement(instanceID string, p types.Placement) {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return
+	}
+
+	ds.recordHistory(instanceID, i.TenantID, types.InstanceHistoryEntry{
+		Timestamp: p.Timestamp,
+		Type:      types.HistoryPlacement,
+		Message:   fmt.Sprintf("Placed on node (%s)", p.Reason),
+		NodeID:    p.NodeID,
+	})
+}
+
+// recordHistory adds an entry to the history of an instance.  The history
+// is informational so failures to record it are logged rather than
+// returned.
+func (ds *Datastore) recordHistory(instanceID string, tenantID string, e types.InstanceHistoryEntry) {
+	if err := ds.AddInstanceHistory(instanceID, tenantID, e); err != nil {
+		ds.log.Warningf("error recording history of instance (%v): %v", instanceID, err)
+	}
+
+	if e.Type == types.HistoryState {
+		ds.events.add(types.LogEntry{
+			TenantID:  tenantID,
+			EventType: string(instanceState),
+			Message:   fmt.Sprintf("Instance %s: %s", instanceID, e.Message),
+			NodeID:    e.NodeID,
+			ObjectID:  instanceID,
+		})
+	}
+}
+
+// AddInstanceHistory adds an entry to the history of an instance.  Entries
+// without a timestamp are stamped with the current time.
+func (ds *Datastore) AddInstanceHistory(instanceID string, tenantID string, e types.InstanceHistoryEntry) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	e.Timestamp = e.Timestamp.UTC()
+
+	return errors.Wrapf(ds.db.addHistoryEntry(instanceID, tenantID, e),
+		"error adding history of instance (%v)", instanceID)
+}
+
+// GetInstanceHistory returns the tenant of an instance and its history,
+// oldest first.  The entries recorded for the instance are combined with
+// the events and API requests logged against it.  The history of an
+// instance outlives the instance itself until it is pruned.
+// ErrInstanceNotFound is returned if nothing has been recorded for the
+// instance and it does not exist.
+func (ds *Datastore) GetInstanceHistory(instanceID string) (string, []types.InstanceHistoryEntry, error) {
+	tenantID, entries, err := ds.db.getHistory(instanceID)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error getting history of instance (%v)", instanceID)
+	}
+
+	// instances created before histories were recorded only have events.
+	if len(entries) == 0 {
+		i, err := ds.GetInstance(instanceID)
+		if err != nil {
+			return "", nil, types.ErrInstanceNotFound
+		}
+		tenantID = i.TenantID
+	}
+
+	ds.events.flush()
+	events, err := ds.db.getEventsForTenant(tenantID, types.EventFilter{ObjectID: instanceID})
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error getting events of instance (%v)", instanceID)
+	}
+
+	for _, e := range events {
+		entry := types.InstanceHistoryEntry{
+			Timestamp: e.Timestamp,
+			Type:      types.HistoryEvent,
+			Message:   e.Message,
+			NodeID:    e.NodeID,
+		}
+		if e.EventType == string(userAction) {
+			entry.Type = types.HistoryRequest
+			entry.Actor = e.Actor
+			entry.OnBehalfOf = e.OnBehalfOf
+		}
+		entries = append(entries, entry)
+	}
+
+	// the event log only records times to the second so its entries
+	// follow the other entries made within the same second.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Truncate(time.Second).Before(entries[j].Timestamp.Truncate(time.Second))
+	})
+
+	return tenantID, entries, nil
+}
+
+// PruneInstanceHistory removes the histories of deleted instances which
+// have not been added to for longer than the retention period of their
+// tenant.  It returns the number of histories removed.
+func (ds *Datastore) PruneInstanceHistory(retention func(tenantID string) time.Duration, now time.Time) (int, error) {
+	last, err := ds.db.getLastHistoryEntries()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting instance histories")
+	}
+
+	pruned := 0
+	for instanceID, o := range last {
+		ds.instancesLock.RLock()
+		_, ok := ds.instances[instanceID]
+		ds.instancesLock.RUnlock()
+		if ok || now.Sub(o.timestamp) < retention(o.tenantID) {
+			continue
+		}
+
+		err = ds.db.deleteHistory(instanceID)
+		if err != nil {
+			return pruned, errors.Wrapf(err, "error deleting history of instance (%v)", instanceID)
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// MaxInstanceConditions is the maximum number of conditions recorded for
+// an instance.  Further warnings are dropped until some are cleared.
+const MaxInstanceConditions = 8
+
+// UpdateInstanceConditions replaces the conditions of an instance with the
+// warnings in its latest stats.  Repeated warnings are recorded once and
+// keep the timestamp at which they were first reported.  It returns the
+// conditions which have been raised and those which have been cleared.
+func (ds *Datastore) UpdateInstanceConditions(instanceID string, warnings []payloads.InstanceWarning) (raised []types.InstanceCondition, cleared []types.InstanceCondition, err error) {
+	ds.instancesLock.Lock()
+	defer ds.instancesLock.Unlock()
+
+	if _, ok := ds.instances[instanceID]; !ok {
+		return nil, nil, types.ErrInstanceNotFound
+	}
+
+	old := ds.instanceConditions[instanceID]
+	existing := make(map[payloads.InstanceWarningType]types.InstanceCondition)
+	for _, c := range old {
+		existing[c.Type] = c
+	}
+
+	now := time.Now()
+	seen := make(map[payloads.InstanceWarningType]bool)
+	var conditions []types.InstanceCondition
+	for _, w := range warnings {
+		if seen[w.Type] || len(conditions) == MaxInstanceConditions {
+			continue
+		}
+		seen[w.Type] = true
+
+		c, ok := existing[w.Type]
+		if !ok || c.Message != w.Message {
+			c = types.InstanceCondition{
+				Type:      w.Type,
+				Message:   w.Message,
+				Timestamp: now,
+			}
+			raised = append(raised, c)
+		}
+		conditions = append(conditions, c)
+	}
+
+	for _, c := range old {
+		if !seen[c.Type] {
+			cleared = append(cleared, c)
+		}
+	}
+
+	if len(raised) == 0 && len(cleared) == 0 {
+		return nil, nil, nil
+	}
+
+	err = ds.db.updateInstanceConditions(instanceID, conditions)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error updating conditions of instance (%v)", instanceID)
+	}
+
+	if len(conditions) == 0 {
+		delete(ds.instanceConditions, instanceID)
+	} else {
+		ds.instanceConditions[instanceID] = conditions
+	}
+
+	return raised, cleared, nil
+}
+
+// GetInstanceConditions returns the conditions of an instance.
+func (ds *Datastore) GetInstanceConditions(instanceID string) []types.InstanceCondition {
+	ds.instancesLock.RLock()
+	defer ds.instancesLock.RUnlock()
+
+	return append([]types.InstanceCondition(nil), ds.instanceConditions[instanceID]...)
+}
+
+// GetTenantCNCISummary retrieves information about a given CNCI id, or all CNCIs
+// If the cnci string is the null string, then this function will retrieve all
+// tenants.  If cnci is not null, it will only provide information about a specific
+// cnci.
+func (ds *Datastore) GetTenantCNCISummary(cnciID string) ([]types.TenantCNCI, error) {
+	var cncis []types.TenantCNCI
+
+	instances, err := ds.GetAllCNCIInstances()
+	if err != nil {
+		return cncis, err
+	}
+
+	for _, i := range instances {
+		if cnciID != "" && cnciID != i.ID {
+			continue
+		}
+
+		cnci := types.TenantCNCI{
+			TenantID:   i.TenantID,
+			IPAddress:  i.IPAddress,
+			MACAddress: i.MACAddress,
+			InstanceID: i.ID,
+		}
+
+		cnci.Subnets = append(cnci.Subnets, i.Subnet)
+
+		cncis = append(cncis, cnci)
+
+		if cnciID != "" {
+			break
+		}
+	}
+
+	return cncis, nil
+}
+
+// GetCNCIWorkloadID returns the UUID of the workload template
+// for the CNCI workload
+func (ds *Datastore) GetCNCIWorkloadID() (string, error) {
+	ds.cnciLock.RLock()
+	defer ds.cnciLock.RUnlock()
+
+	if ds.cnciWorkload.ID == "" {
+		return "", errors.New("No CNCI Workload in datastore")
+	}
+
+	return ds.cnciWorkload.ID, nil
+}
+
+// GetNodeSummary provides a summary the state and count of instances running per node.
+func (ds *Datastore) GetNodeSummary() ([]*types.NodeSummary, error) {
+	var nodes []*types.NodeSummary
+	summaries := make(map[string]*types.NodeSummary)
+
+	ds.nodesLock.RLock()
+	for _, n := range ds.nodes {
+		summary := &types.NodeSummary{
+			NodeID:        n.ID,
+			TotalFailures: n.TotalFailures,
+		}
+		summaries[n.ID] = summary
+		nodes = append(nodes, summary)
+	}
+	ds.nodesLock.RUnlock()
+
+	// the instances are counted by the node they are placed on, which
+	// unlike the node cache is persisted, no CNCI included
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.CNCI || i.NodeID == "" {
+			continue
+		}
+
+		summary, ok := summaries[i.NodeID]
+		if !ok {
+			summary = &types.NodeSummary{NodeID: i.NodeID}
+			summaries[i.NodeID] = summary
+			nodes = append(nodes, summary)
+		}
+
+		summary.TotalInstances++
+
+		switch i.State {
+		case payloads.Pending:
+			summary.TotalPendingInstances++
+		case payloads.Running:
+			summary.TotalRunningInstances++
+		case payloads.Exited:
+			summary.TotalPausedInstances++
+		}
+	}
+	ds.instancesLock.RUnlock()
+
+	return nodes, nil
+}
+
+// GetNodeAllocations sums the resources of the instances placed on each
+// node, indexed by node ID.  Instances which do not record their own
+// requirements are charged those of their workload.
+func (ds *Datastore) GetNodeAllocations() map[string]types.NodeAllocation {
+	type placed struct {
+		nodeID      string
+		workloadID  string
+		pending     bool
+		vcpus       int
+		memMB       int
+		ephemeralGB int
+	}
+
+	var instances []placed
+
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.NodeID == "" || i.State == payloads.Deleted {
+			continue
+		}
+
+		instances = append(instances, placed{
+			nodeID:      i.NodeID,
+			workloadID:  i.WorkloadID,
+			pending:     i.State == payloads.Pending,
+			vcpus:       i.VCPUs,
+			memMB:       i.MemMB,
+			ephemeralGB: i.EphemeralGB,
+		})
+	}
+	ds.instancesLock.RUnlock()
+
+	workloads := make(map[string]types.Workload)
+	allocations := make(map[string]types.NodeAllocation)
+	for _, i := range instances {
+		wl, ok := workloads[i.workloadID]
+		if !ok {
+			wl, _ = ds.GetWorkload(i.workloadID)
+			workloads[i.workloadID] = wl
+		}
+
+		if i.vcpus == 0 {
+			i.vcpus = wl.Requirements.VCPUs
+		}
+		if i.memMB == 0 {
+			i.memMB = wl.Requirements.MemMB
+		}
+
+		a := allocations[i.nodeID]
+		a.Instances++
+		a.VCPUs += i.vcpus
+		if i.pending {
+			a.PendingInstances++
+			a.PendingMemMB += i.memMB
+			a.PendingDiskMB += i.ephemeralGB * 1024
+		}
+		allocations[i.nodeID] = a
+	}
+
+	return allocations
+}
+
+// GetNodeInstanceSummary counts the instances placed on a node by state and
+// totals their usage from the latest stats received for them.  Unlike
+// GetNodeSummary the instances are aggregated by the database rather than
+// from the instance cache.  The time at which the node last sent stats is
+// also returned.  ErrNodeNotFound is returned for nodes which have neither
+// sent stats nor had instances placed on them.
+func (ds *Datastore) GetNodeInstanceSummary(nodeID string) (types.CiaoNodeSummary, error) {
+	summary, err := ds.db.getNodeInstanceSummary(nodeID)
+	if err != nil {
+		return summary, errors.Wrapf(err, "error summarising node %s", nodeID)
+	}
+
+	if summary.LastSeen.IsZero() && summary.TotalInstances == 0 {
+		return summary, types.ErrNodeNotFound
+	}
+
+	return summary, nil
+}
+
+// GetBatchFrameSummary will retieve the count of traces we have for a specific label
+func (ds *Datastore) GetBatchFrameSummary() ([]types.BatchFrameSummary, error) {
+	// until we start caching frame stats, we have to send this
+	// right through to the database.
+	return ds.db.getBatchFrameSummary()
+}
+
+// GetBatchFrameStatistics will show individual trace data per instance for a batch of trace data.
+// The batch is identified by the label.
+func (ds *Datastore) GetBatchFrameStatistics(label string) ([]types.BatchFrameStat, error) {
+	// until we start caching frame stats, we have to send this
+	// right through to the database.
+	return ds.db.getBatchFrameStatistics(label)
+}
+
+// GetEventLog retrieves all the log entries stored in the datastore.
+func (ds *Datastore) GetEventLog() ([]*types.LogEntry, error) {
+	// we don't as of yet cache any of the events that are logged.
+	ds.events.flush()
+	return ds.db.getEventLog()
+}
+
+// GetEventsForTenant retrieves the log entries of a tenant which match
+// filter, in the order in which they were logged.
+func (ds *Datastore) GetEventsForTenant(tenantID string, filter types.EventFilter) ([]*types.LogEntry, error) {
+	if tenantID == "" {
+		return nil, types.ErrTenantNotFound
+	}
+
+	ds.events.flush()
+	return ds.db.getEventsForTenant(tenantID, filter)
+}
+
+// GetEvents retrieves the log entries of all tenants which match filter,
+// in the order in which they were logged.
+func (ds *Datastore) GetEvents(filter types.EventFilter) ([]*types.LogEntry, error) {
+	ds.events.flush()
+	return ds.db.getEventsForTenant("", filter)
+}
+
+// ClearLog will remove all the event entries from the event log
+func (ds *Datastore) ClearLog() error {
+	// we don't as of yet cache any of the events that are logged.
+	ds.events.flush()
+	return ds.db.clearLog()
+}
+
+// LogEvent will add a message to the persistent event log.
+func (ds *Datastore) LogEvent(tenant string, msg string) error {
+	e := types.LogEntry{
+		TenantID:  tenant,
+		EventType: string(userInfo),
+		Message:   msg,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// LogAction will add a record of an action requested through the API by
+// actor to the persistent event log.  onBehalfOf is the tenant an admin
+// actor was impersonating, if any.
+func (ds *Datastore) LogAction(tenant string, objectID string, actor string, onBehalfOf string, msg string) error {
+	e := types.LogEntry{
+		TenantID:   tenant,
+		EventType:  string(userAction),
+		Message:    msg,
+		ObjectID:   objectID,
+		Actor:      actor,
+		OnBehalfOf: onBehalfOf,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// LogError will add a message to the persistent event log as an error
+func (ds *Datastore) LogError(tenant string, msg string) error {
+	e := types.LogEntry{
+		TenantID:  tenant,
+		EventType: string(userError),
+		Message:   msg,
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// LogLaunchFailure will add a failure to launch an instance, and its
+// classification, to the persistent event log as an error.
+func (ds *Datastore) LogLaunchFailure(tenant string, code types.LaunchFailureCode, msg string) error {
+	e := types.LogEntry{
+		TenantID:    tenant,
+		EventType:   string(userError),
+		Message:     msg,
+		FailureCode: string(code),
+	}
+	ds.events.add(e)
+	return nil
+}
+
+// AddBlockDevice will store information about new BlockData into
+// the datastore.
+func (ds *Datastore) AddBlockDevice(ctx context.Context, device types.Volume) error {
+	ds.bdLock.Lock()
+	old, update := ds.blockDevices[device.ID]
+	ds.bdLock.Unlock()
+
+	// store persistently
+	var err error
+	if !update {
+		err = errors.Wrap(ds.db.addBlockData(ctx, device), "Error adding block data to database")
+	} else {
+		err = errors.Wrap(ds.db.updateBlockData(ctx, device), "Error updating block data in database")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ds.bdLock.Lock()
+	ds.blockDevices[device.ID] = device
+	ds.bdLock.Unlock()
+
+	// update tenants cache, CNCIs in the CNCI pool have no tenant
+	ds.tenantsLock.Lock()
+	if tenant := ds.tenants[device.TenantID]; tenant != nil {
+		tenant.devices[device.ID] = device
+	}
+	ds.tenantsLock.Unlock()
+
+	if !update || old.State != device.State {
+		msg := fmt.Sprintf("Volume %s: State changed to %s", device.ID, device.State)
+		if update {
+			msg = fmt.Sprintf("Volume %s: State changed from %s to %s", device.ID, old.State, device.State)
+		}
+
+		ds.events.add(types.LogEntry{
+			TenantID:  device.TenantID,
+			EventType: string(volumeState),
+			Message:   msg,
+			ObjectID:  device.ID,
+		})
+	}
+
+	return nil
+}
+
+// DeleteBlockDevice will delete a volume from the datastore.
+// It also deletes it from the tenant's list of devices.
+func (ds *Datastore) DeleteBlockDevice(ctx context.Context, ID string) error {
+	ds.bdLock.Lock()
+	dev, ok := ds.blockDevices[ID]
+	if !ok {
+
+		ds.bdLock.Unlock()
+		return ErrNoBlockData
+	}
+	ds.bdLock.Unlock()
+
+	err := errors.Wrap(ds.db.deleteBlockData(ctx, ID), "Error deleting block data from database")
+	if err != nil {
+		return err
+	}
+
+	ds.bdLock.Lock()
+	ds.tenantsLock.Lock()
+
+	delete(ds.blockDevices, ID)
+	if tenant := ds.tenants[dev.TenantID]; tenant != nil {
+		delete(tenant.devices, ID)
+	}
+
+	ds.tenantsLock.Unlock()
+	ds.bdLock.Unlock()
+
+	if !dev.Internal {
+		ds.releaseUsage(types.UsageSpan{
+			TenantID: dev.TenantID,
+			ID:       dev.ID,
+			Resource: types.UsageVolume,
+			SizeGB:   dev.Size,
+			Start:    dev.CreateTime,
+		})
+	}
+
+	return nil
+}
+
+// GetBlockDevices will return all the BlockDevices associated with a tenant.
+func (ds *Datastore) GetBlockDevices(tenant string) ([]types.Volume, error) {
+	var devices []types.Volume
+
+	ds.tenantsLock.RLock()
+
+	_, ok := ds.tenants[tenant]
+	if !ok {
+		ds.tenantsLock.RUnlock()
+		return devices, ErrNoTenant
+	}
+
+	for _, value := range ds.tenants[tenant].devices {
+		devices = append(devices, value)
+	}
+
+	ds.tenantsLock.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Cursor().Before(devices[j].Cursor())
+	})
+
+	return devices, nil
+
+}
+
+// GetBlockDevice will return information about a block device from the
+// datastore.
+func (ds *Datastore) GetBlockDevice(ID string) (types.Volume, error) {
+	ds.bdLock.RLock()
+	data, ok := ds.blockDevices[ID]
+	ds.bdLock.RUnlock()
+
+	if !ok {
+		return types.Volume{}, ErrNoBlockData
+	}
+	return data, nil
+}
+
+// UpdateBlockDevice will replace existing information about a block device
+// in the datastore.
+func (ds *Datastore) UpdateBlockDevice(ctx context.Context, data types.Volume) error {
+	ds.bdLock.RLock()
+	_, ok := ds.blockDevices[data.ID]
+	ds.bdLock.RUnlock()
+
+	if !ok {
+		return ErrNoBlockData
+	}
+
+	return errors.Wrapf(ds.AddBlockDevice(ctx, data), "error updating block device (%v)", data.ID)
+}
+
+// UpdateBlockDeviceDeletionProtection sets or clears the deletion protection
+// of a block device.
+func (ds *Datastore) UpdateBlockDeviceDeletionProtection(ctx context.Context, ID string, protected bool) error {
+	ds.bdLock.Lock()
+	defer ds.bdLock.Unlock()
+
+	dev, ok := ds.blockDevices[ID]
+	if !ok {
+		return ErrNoBlockData
+	}
+
+	err := ds.db.updateBlockDeletionProtection(ctx, ID, protected)
+	if err != nil {
+		return errors.Wrap(err, "Error updating block device deletion protection")
+	}
+
+	dev.DeletionProtected = protected
+	ds.blockDevices[ID] = dev
+
+	ds.tenantsLock.Lock()
+	if tenant := ds.tenants[dev.TenantID]; tenant != nil {
+		tenant.devices[ID] = dev
+	}
+	ds.tenantsLock.Unlock()
+
+	return nil
+}
+
+// UpdateBlockDeviceSize records the size in GiB of a block device which has
+// been extended.
+func (ds *Datastore) UpdateBlockDeviceSize(ctx context.Context, ID string, size int) error {
+	ds.bdLock.Lock()
+	defer ds.bdLock.Unlock()
+
+	dev, ok := ds.blockDevices[ID]
+	if !ok {
+		return ErrNoBlockData
+	}
+
+	err := ds.db.updateBlockSize(ctx, ID, size)
+	if err != nil {
+		return errors.Wrap(err, "Error updating block device size")
+	}
+
+	dev.Size = size
+	ds.blockDevices[ID] = dev
+
+	ds.tenantsLock.Lock()
+	if tenant := ds.tenants[dev.TenantID]; tenant != nil {
+		tenant.devices[ID] = dev
+	}
+	ds.tenantsLock.Unlock()
+
+	return nil
+}
+
+// CreateStorageAttachment will associate an instance with a block device in
+// the datastore
+func (ds *Datastore) CreateStorageAttachment(ctx context.Context, instanceID string, volume payloads.StorageResource) (types.StorageAttachment, error) {
+	link := attachment{
+		instanceID: instanceID,
+		volumeID:   volume.ID,
+	}
+
+	a := types.StorageAttachment{
+		InstanceID: instanceID,
+		ID:         uuid.Generate().String(),
+		BlockID:    volume.ID,
+		Ephemeral:  volume.Ephemeral,
+		Boot:       volume.Bootable,
+		Tag:        volume.Tag,
+	}
+
+	err := ds.db.addStorageAttachment(ctx, a)
+	if err != nil {
+		return types.StorageAttachment{}, errors.Wrap(err, "error adding storage attachment to database")
+	}
+
+	// ensure that the volume is marked in use as we have created an attachment
+	bd, err := ds.GetBlockDevice(volume.ID)
+	if err != nil {
+		_ = ds.db.deleteStorageAttachment(a.ID)
+		return types.StorageAttachment{}, errors.Wrapf(err, "error fetching block device (%v)", volume.ID)
+	}
+
+	bd.State = types.InUse
+	err = ds.UpdateBlockDevice(ctx, bd)
+	if err != nil {
+		_ = ds.db.deleteStorageAttachment(a.ID)
+		return types.StorageAttachment{}, errors.Wrapf(err, "error updating block device (%v)", volume.ID)
+	}
+
+	// add it to our links map
+	ds.attachLock.Lock()
+	ds.attachments[a.ID] = a
+	ds.instanceVolumes[link] = a.ID
+	ds.attachLock.Unlock()
+
+	return a, nil
+}
+
+// GetStorageAttachments returns a list of volumes associated with this instance.
+func (ds *Datastore) GetStorageAttachments(instanceID string) []types.StorageAttachment {
+	var links []types.StorageAttachment
+
+	ds.attachLock.RLock()
+	for _, a := range ds.attachments {
+		if a.InstanceID == instanceID {
+			links = append(links, a)
+		}
+	}
+	ds.attachLock.RUnlock()
+
+	return links
+}
+
+// updateAttachmentDevices records the devices at which the volumes attached
+// to an instance were reported inside the instance.
+func (ds *Datastore) updateAttachmentDevices(instanceID string, devices []payloads.VolumeDevice) {
+	ds.attachLock.Lock()
+	defer ds.attachLock.Unlock()
+
+	for _, d := range devices {
+		key := attachment{
+			instanceID: instanceID,
+			volumeID:   d.VolumeUUID,
+		}
+
+		ID, ok := ds.instanceVolumes[key]
+		if !ok {
+			continue
+		}
+
+		a := ds.attachments[ID]
+		if a.Device == d.Device {
+			continue
+		}
+
+		err := ds.db.updateStorageAttachmentDevice(ID, d.Device)
+		if err != nil {
+			ds.log.Warningf("error updating device of storage attachment (%v): %v", ID, err)
+			continue
+		}
+
+		a.Device = d.Device
+		ds.attachments[ID] = a
+	}
+}
+
+// detachInstanceVolumes removes all the storage attachments of a deleted
+// instance and makes its persistent volumes available again.  Ephemeral
+// volumes are deleted by the controller along with the instance and are
+// left alone.
+func (ds *Datastore) detachInstanceVolumes(instanceID string) {
+	var detached []types.StorageAttachment
+
+	ds.attachLock.Lock()
+	for ID, a := range ds.attachments {
+		if a.InstanceID != instanceID {
+			continue
+		}
+
+		err := ds.db.deleteStorageAttachment(ID)
+		if err != nil {
+			ds.log.Warningf("error deleting storage attachment (%v): %v", ID, err)
+			continue
+		}
+
+		key := attachment{
+			instanceID: a.InstanceID,
+			volumeID:   a.BlockID,
+		}
+
+		delete(ds.attachments, ID)
+		if ds.instanceVolumes[key] == ID {
+			delete(ds.instanceVolumes, key)
+		}
+
+		detached = append(detached, a)
+	}
+	ds.attachLock.Unlock()
+
+	for _, a := range detached {
+		if a.Ephemeral {
+			continue
+		}
+
+		bd, err := ds.GetBlockDevice(a.BlockID)
+		if err != nil {
+			ds.log.Warningf("error fetching block device (%v): %v", a.BlockID, err)
+			continue
+		}
+
+		bd.State = types.Available
+		err = ds.UpdateBlockDevice(context.Background(), bd)
+		if err != nil {
+			ds.log.Warningf("error updating block device (%v): %v", a.BlockID, err)
+		}
+	}
+}
+
+// GetOrphanedStorageAttachments returns the storage attachments of
+// instances which are no longer in the datastore, e.g. because the
+// controller stopped while an instance was being deleted.
+func (ds *Datastore) GetOrphanedStorageAttachments() []types.StorageAttachment {
+	var attachments []types.StorageAttachment
+
+	ds.attachLock.RLock()
+	for _, a := range ds.attachments {
+		attachments = append(attachments, a)
+	}
+	ds.attachLock.RUnlock()
+
+	var orphans []types.StorageAttachment
+
+	ds.instancesLock.RLock()
+	for _, a := range attachments {
+		if _, ok := ds.instances[a.InstanceID]; !ok {
+			orphans = append(orphans, a)
+		}
+	}
+	ds.instancesLock.RUnlock()
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].ID < orphans[j].ID
+	})
+
+	return orphans
+}
+
+// ReleaseStorageAttachments deletes the storage attachments of an instance
+// and makes the volumes which were attached to it available.
+func (ds *Datastore) ReleaseStorageAttachments(instanceID string) {
+	ds.detachInstanceVolumes(instanceID)
+}
+
+func (ds *Datastore) getStorageAttachment(instanceID string, volumeID string) (types.StorageAttachment, error) {
+	var a types.StorageAttachment
+
+	key := attachment{
+		instanceID: instanceID,
+		volumeID:   volumeID,
+	}
+
+	ds.attachLock.RLock()
+	id, ok := ds.instanceVolumes[key]
+	if ok {
+		a = ds.attachments[id]
+	}
+	ds.attachLock.RUnlock()
+
+	if !ok {
+		return a, ErrNoStorageAttachment
+	}
+
+	return a, nil
+}
+
+// DeleteStorageAttachment will delete the attachment with the associated ID
+// from the datastore.
+func (ds *Datastore) DeleteStorageAttachment(ID string) error {
+	err := errors.Wrapf(ds.db.deleteStorageAttachment(ID), "error deleting storage attachment (%v) from database", ID)
+	if err != nil {
+		return err
+	}
+
+	ds.attachLock.Lock()
+	a, ok := ds.attachments[ID]
+	if ok {
+		key := attachment{
+			instanceID: a.InstanceID,
+			volumeID:   a.BlockID,
+		}
+
+		delete(ds.attachments, ID)
+		delete(ds.instanceVolumes, key)
+	}
+	ds.attachLock.Unlock()
+
+	if !ok {
+		return ErrNoStorageAttachment
+	}
+
+	return nil
+}
+
+// GetVolumeAttachments will return a list of attachments associated with
+// this volume ID.
+func (ds *Datastore) GetVolumeAttachments(volume string) ([]types.StorageAttachment, error) {
+	var attachments []types.StorageAttachment
+
+	ds.attachLock.RLock()
+
+	for _, a := range ds.attachments {
+		if a.BlockID == volume {
+			attachments = append(attachments, a)
+		}
+	}
+
+	ds.attachLock.RUnlock()
+
+	return attachments, nil
+}
+
+// GetAttachmentDetails returns the storage attachments which match filter,
+// in ID order.  Attachments are filtered by the database rather than from
+// the cache as they are joined with the state of their volumes and the
+// placements of their instances.
+func (ds *Datastore) GetAttachmentDetails(filter types.AttachmentFilter) ([]types.AttachmentDetails, error) {
+	attachments, err := ds.db.getAttachmentDetails(filter)
+	return attachments, errors.Wrap(err, "error getting storage attachments from database")
+}
+
+// GetPool will return an external IP Pool
+func (ds *Datastore) GetPool(ID string) (types.Pool, error) {
+	ds.poolsLock.RLock()
+	p, ok := ds.pools[ID]
+	ds.poolsLock.RUnlock()
+
+	if !ok {
+		return p, types.ErrPoolNotFound
+	}
+
+	return p, nil
+}
+
+// GetPools will return a list of external IP Pools
+func (ds *Datastore) GetPools() ([]types.Pool, error) {
+	var pools []types.Pool
+
+	ds.poolsLock.RLock()
+
+	for _, p := range ds.pools {
+		pools = append(pools, p)
+	}
+
+	ds.poolsLock.RUnlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Cursor().Before(pools[j].Cursor())
+	})
+
+	return pools, nil
+}
+
+// checkPoolRanges checks that the subnets or addresses to be added to a
+// pool overlap neither each other nor the ranges already in the pools.
+// Ranges which cannot be parsed are left for the caller to reject.  lock
+// for the pools must be held by the caller.
+func (ds *Datastore) checkPoolRanges(pool string, ranges []string) error {
+	type poolRange struct {
+		pool  string
+		r     string
+		ipNet *net.IPNet
+	}
+
+	var existing []poolRange
+	add := func(pool string, r string) {
+		ipNet, err := utils.ParseRange(r)
+		if err == nil {
+			existing = append(existing, poolRange{pool, r, ipNet})
+		}
+	}
+
+	for _, p := range ds.pools {
+		for _, sub := range p.Subnets {
+			add(p.Name, sub.CIDR)
+		}
+		for _, IP := range p.IPs {
+			add(p.Name, IP.Address)
+		}
+	}
+
+	for _, r := range ranges {
+		ipNet, err := utils.ParseRange(r)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range existing {
+			if utils.RangesOverlap(ipNet, e.ipNet) {
+				return &types.RangeOverlapError{Range: r, Conflict: e.r, Pool: e.pool}
+			}
+		}
+
+		// later ranges of the request must not overlap this one either
+		existing = append(existing, poolRange{pool, r, ipNet})
+	}
+
+	return nil
+}
+
+// AddPool will add a brand new pool to our datastore.
+func (ds *Datastore) AddPool(pool types.Pool) error {
+	ranges := make([]string, 0, len(pool.Subnets)+len(pool.IPs))
+	for _, subnet := range pool.Subnets {
+		ranges = append(ranges, subnet.CIDR)
+	}
+	for _, IP := range pool.IPs {
+		ranges = append(ranges, IP.Address)
+	}
+
+	ds.poolsLock.Lock()
+
+	// make sure the ranges are valid and not already in use.
+	for _, subnet := range pool.Subnets {
+		_, _, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			ds.poolsLock.Unlock()
+			return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet.CIDR)
+		}
+	}
+
+	for _, IP := range pool.IPs {
+		if net.ParseIP(IP.Address) == nil {
+			ds.poolsLock.Unlock()
+			return types.ErrInvalidIP
+		}
+	}
+
+	err := ds.checkPoolRanges(pool.Name, ranges)
+	if err != nil {
+		ds.poolsLock.Unlock()
+		return err
+	}
+
+	ds.pools[pool.ID] = pool
+	err = ds.db.addPool(pool)
+
+	ds.poolsLock.Unlock()
+
+	if err != nil {
+		// lock must not be held when calling.
+		_ = ds.DeletePool(pool.ID)
+	}
+
+	return errors.Wrap(err, "error adding pool to database")
+}
+
+// DeletePool will delete an unused pool from our datastore.
+func (ds *Datastore) DeletePool(ID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[ID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	// make sure all ips in this pool are not used.
+	if p.Free != p.TotalIPs {
+		return types.ErrPoolNotEmpty
+	}
+
+	// delete from persistent store
+	err := errors.Wrapf(ds.db.deletePool(ID), "error deleting pool (%v) from database", ID)
+
+	// delete the whole pool
+	delete(ds.pools, ID)
+
+	return err
+}
+
+// SetPoolTenants will restrict a pool to a list of tenants.  An empty list
+// makes the pool available to all tenants.
+func (ds *Datastore) SetPoolTenants(poolID string, tenants []string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	p.Tenants = tenants
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// AddExternalSubnet will add a new subnet to an existing pool.
+func (ds *Datastore) AddExternalSubnet(poolID string, subnet string) error {
+	sub := types.ExternalSubnet{
+		ID:   uuid.Generate().String(),
+		CIDR: subnet,
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet)
+	}
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	err = ds.checkPoolRanges(p.Name, []string{subnet})
+	if err != nil {
+		return err
+	}
+
+	ones, bits := ipNet.Mask.Size()
+
+	// intentionally do not support /32 here, user should add by IP address instead
+	// deduct gateway and broadcast
+	newIPs := (1 << uint32(bits-ones)) - 2
+	if newIPs <= 0 {
+		return types.ErrSubnetTooSmall
+	}
+	p.TotalIPs += newIPs
+	p.Free += newIPs
+	p.Subnets = append(p.Subnets, sub)
+
+	err = ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	// we are committed now.
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// AddExternalIPs will add a list of individual IPs to an existing pool.
+func (ds *Datastore) AddExternalIPs(poolID string, IPs []string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	// make sure valid and not duplicate
+	err := ds.checkPoolRanges(p.Name, IPs)
+	if err != nil {
+		return err
+	}
+
+	for _, newIP := range IPs {
+		IP := net.ParseIP(newIP)
+		if IP == nil {
+			return types.ErrInvalidIP
+		}
+
+		ExtIP := types.ExternalIP{
+			ID:      uuid.Generate().String(),
+			Address: IP.String(),
+		}
+
+		p.TotalIPs++
+		p.Free++
+		p.IPs = append(p.IPs, ExtIP)
+	}
+
+	// update persistent store.
+	err = ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	// update cache.
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// DeleteSubnet will remove an unused subnet from an existing pool.
+func (ds *Datastore) DeleteSubnet(poolID string, subnetID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	for i, sub := range p.Subnets {
+		if sub.ID != subnetID {
+			continue
+		}
+
+		// this path will be taken only once.
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", sub.CIDR)
+		}
+
+		// check each address in this subnet is not mapped.
+		for IP := IP.Mask(ipNet.Mask); ipNet.Contains(IP); incrementIP(IP) {
+			_, ok := ds.mappedIPs[IP.String()]
+			if ok {
+				return types.ErrPoolNotEmpty
+			}
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		numIPs := (1 << uint32(bits-ones)) - 2
+		p.TotalIPs -= numIPs
+		p.Free -= numIPs
+		p.Subnets = append(p.Subnets[:i], p.Subnets[i+1:]...)
+
+		err = ds.db.updatePool(p)
+		if err != nil {
+			return errors.Wrap(err, "error updating pool in database")
+		}
+
+		ds.pools[poolID] = p
+
+		return nil
+	}
+
+	return types.ErrInvalidPoolAddress
+}
+
+// DeleteExternalIP will remove an individual IP address from a pool.
+func (ds *Datastore) DeleteExternalIP(poolID string, addrID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	for i, extIP := range p.IPs {
+		if extIP.ID != addrID {
+			continue
+		}
+
+		// this path will be taken only once.
+		// check address is not mapped.
+		_, ok := ds.mappedIPs[extIP.Address]
+		if ok {
+			return types.ErrPoolNotEmpty
+		}
+
+		p.TotalIPs--
+		p.Free--
+		p.IPs = append(p.IPs[:i], p.IPs[i+1:]...)
+
+		err := ds.db.updatePool(p)
+		if err != nil {
+			return errors.Wrap(err, "error updating pool in database")
+		}
+
+		ds.pools[poolID] = p
+
+		return nil
+	}
+
+	return types.ErrInvalidPoolAddress
+}
+
+func incrementIP(IP net.IP) {
+	for i := len(IP) - 1; i >= 0; i-- {
+		IP[i]++
+		if IP[i] > 0 {
+			break
+		}
+	}
+}
+
+// GetMappedIPs will return a list of mapped external IPs by tenant.
+func (ds *Datastore) GetMappedIPs(tenant *string) []types.MappedIP {
+	var mappedIPs []types.MappedIP
+
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	for _, m := range ds.mappedIPs {
+		if tenant != nil {
+			if m.TenantID != *tenant {
+				continue
+			}
+		}
+		mappedIPs = append(mappedIPs, m)
+	}
+
+	sort.Slice(mappedIPs, func(i, j int) bool {
+		return mappedIPs[i].Cursor().Before(mappedIPs[j].Cursor())
+	})
+
+	return mappedIPs
+}
+
+// GetMappedIP will return a MappedIP struct for the given address.
+func (ds *Datastore) GetMappedIP(address string) (types.MappedIP, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	m, ok := ds.mappedIPs[address]
+	if !ok {
+		return types.MappedIP{}, types.ErrAddressNotFound
+	}
+
+	return m, nil
+}
+
+// mapAddress maps address from pool to instance.  The mapping and the
+// reduced count of free addresses in the pool are stored in a single
+// transaction.  poolsLock must be held by the caller.
+func (ds *Datastore) mapAddress(pool types.Pool, instance *types.Instance, address string) (types.MappedIP, error) {
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: address,
+		InternalIP: instance.IPAddress,
+		InstanceID: instance.ID,
+		TenantID:   instance.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		CreateTime: ds.now().UTC(),
+	}
+
+	pool.Free--
+
+	err := ds.db.addMappedIP(m, pool.Free)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
+	}
+
+	ds.mappedIPs[address] = m
+	ds.pools[pool.ID] = pool
+
+	return m, nil
+}
+
+// MapExternalIP will allocate an external IP to an instance from a given pool.
+func (ds *Datastore) MapExternalIP(poolID string, instanceID string) (types.MappedIP, error) {
+	var m types.MappedIP
+
+	instance, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return m, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return m, types.ErrPoolNotFound
+	}
+
+	if pool.Free == 0 {
+		return m, types.ErrPoolEmpty
+	}
+
+	// find a free IP address in any subnet.
+	for _, sub := range pool.Subnets {
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return m, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		initIP := IP.Mask(ipNet.Mask)
+
+		// skip gateway
+		incrementIP(initIP)
+
+		// check each address in this subnet
+		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
+			_, ok := ds.mappedIPs[IP.String()]
+			if !ok {
+				return ds.mapAddress(pool, instance, IP.String())
+			}
+		}
+	}
+
+	// we are still looking. Check our individual IPs
+	for _, IP := range pool.IPs {
+		_, ok := ds.mappedIPs[IP.Address]
+		if !ok {
+			return ds.mapAddress(pool, instance, IP.Address)
+		}
+	}
+
+	// if you got here you are out of luck. But you never should.
+	ds.log.Warningf("Pool reports %d free addresses but none found", pool.Free)
+	return m, types.ErrPoolEmpty
+}
+
+// MapExternalAddress maps a specific address of a pool to an instance.  The
+// address must be free: concurrent requests for the same address are
+// serialized and all but the first fail with an AddressInUseError.
+func (ds *Datastore) MapExternalAddress(poolID string, instanceID string, address string) (types.MappedIP, error) {
+	instance, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.MappedIP{}, types.ErrPoolNotFound
+	}
+
+	if !pool.Contains(address) {
+		return types.MappedIP{}, types.ErrAddressNotInPool
+	}
+
+	// use the canonical form of the address as the key of the mapping
+	address = net.ParseIP(address).String()
+
+	if m, ok := ds.mappedIPs[address]; ok {
+		return types.MappedIP{}, &types.AddressInUseError{Address: address, InstanceID: m.InstanceID}
+	}
+
+	return ds.mapAddress(pool, instance, address)
+}
+
+// UnMapExternalIP will stop associating a given address with an instance.
+func (ds *Datastore) UnMapExternalIP(address string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	m, ok := ds.mappedIPs[address]
+	if !ok {
+		return types.ErrAddressNotFound
+	}
+
+	// get pool and update Free
+	pool, ok := ds.pools[m.PoolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	pool.Free++
+
+	err := ds.db.deleteMappedIP(m.ID)
+	if err != nil {
+		return errors.Wrap(err, "error deleting IP mapping from database")
+	}
+	delete(ds.mappedIPs, address)
+
+	ds.releaseUsage(types.UsageSpan{
+		TenantID: m.TenantID,
+		ID:       m.ID,
+		Resource: types.UsageExternalIP,
+		Start:    m.CreateTime,
+	})
+
+	err = ds.db.updatePool(pool)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[pool.ID] = pool
+
+	return nil
+}
+
+// GenerateCNCIWorkload is used to create a workload definition for the CNCI.
+// This function should be called prior to any workload launch.
+func (ds *Datastore) GenerateCNCIWorkload(vcpus int, memMB int, diskMB int, key string) {
+	// generate the CNCI workload.
+	config := `---
+#cloud-config
+users:
+  - name: cloud-admin
+    gecos: CIAO Cloud Admin
+    lock-passwd: true
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    ssh-authorized-keys:
+    - ` + key + `
+...
+`
+
+	ds.cnciLock.Lock()
+	defer ds.cnciLock.Unlock()
+
+	storage := types.StorageResource{
+		ID:         "",
+		Bootable:   true,
+		Ephemeral:  true,
+		SourceType: types.ImageService,
+		Source:     ds.cnciImage.Image,
+		Internal:   true,
+	}
+
+	// the CNCIs are recognised by their workload ID so it is kept when
+	// the workload is regenerated.
+	ID := ds.cnciWorkload.ID
+	if ID == "" {
+		ID = uuid.Generate().String()
+	}
+
+	wl := types.Workload{
+		ID:          ID,
+		Description: "CNCI",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      config,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs:       vcpus,
+			MemMB:       memMB,
+			NetworkNode: true,
+		},
+		Storage:    []types.StorageResource{storage},
+		Visibility: types.Internal,
+	}
+
+	// for now we have a single global cnci workload.
+	ds.cnciWorkload = wl
+}
+
+// GetCNCIImage returns the image new CNCIs are launched from and the image
+// it replaced.
+func (ds *Datastore) GetCNCIImage() types.CNCIImage {
+	ds.cnciLock.RLock()
+	defer ds.cnciLock.RUnlock()
+
+	return ds.cnciImage
+}
+
+// setCNCIImage launches new CNCIs from image.  The caller must hold
+// cnciLock.
+func (ds *Datastore) setCNCIImage(image types.CNCIImage) error {
+	err := ds.db.updateCNCIImage(image)
+	if err != nil {
+		return errors.Wrap(err, "Error updating CNCI image in database")
+	}
+
+	ds.cnciImage = image
+
+	// the workload is copied by GetWorkload so it must not be modified
+	// in place.
+	wl := ds.cnciWorkload
+	if len(wl.Storage) > 0 {
+		s := wl.Storage[0]
+		s.Source = image.Image
+		wl.Storage = []types.StorageResource{s}
+	}
+	ds.cnciWorkload = wl
+
+	return nil
+}
+
+// RegisterCNCIImage launches new CNCIs from imageID.  The image it
+// replaces is kept for rollback.
+func (ds *Datastore) RegisterCNCIImage(imageID string) (types.CNCIImage, error) {
+	ds.cnciLock.Lock()
+	defer ds.cnciLock.Unlock()
+
+	image := ds.cnciImage
+	if image.Image != imageID {
+		image.PreviousImage = image.Image
+		image.Image = imageID
+	}
+
+	return image, ds.setCNCIImage(image)
+}
+
+// RollbackCNCIImage launches new CNCIs from the image used before the
+// current image was registered.
+func (ds *Datastore) RollbackCNCIImage() (types.CNCIImage, error) {
+	ds.cnciLock.Lock()
+	defer ds.cnciLock.Unlock()
+
+	if ds.cnciImage.PreviousImage == "" {
+		return ds.cnciImage, types.ErrNoPreviousCNCIImage
+	}
+
+	image := types.CNCIImage{
+		Image:         ds.cnciImage.PreviousImage,
+		PreviousImage: ds.cnciImage.Image,
+	}
+
+	return image, ds.setCNCIImage(image)
+}
 
-	return nodes
+// SetLaunchConfig records the configuration an instance is started with.
+func (ds *Datastore) SetLaunchConfig(ctx context.Context, instanceID string, config string) error {
+	return ds.db.updateLaunchConfig(ctx, instanceID, config)
 }
 
-func (ds *Datastore) addNodeStat(stat payloads.Stat) error {
-	ds.nodesLock.Lock()
+// GetLaunchConfig returns the configuration an instance was last started
+// with.
+func (ds *Datastore) GetLaunchConfig(instanceID string) (string, error) {
+	return ds.db.getLaunchConfig(instanceID)
+}
 
-	n, ok := ds.nodes[stat.NodeUUID]
-	if !ok {
-		n = &node{}
-		n.instances = make(map[string]*types.Instance)
-		ds.nodes[stat.NodeUUID] = n
+// SetCNCIInstanceImage records the image a CNCI was launched from.
+func (ds *Datastore) SetCNCIInstanceImage(instanceID string, imageID string) error {
+	ds.cnciLock.Lock()
+	defer ds.cnciLock.Unlock()
+
+	err := ds.db.updateCNCIInstanceImage(instanceID, imageID)
+	if err != nil {
+		return errors.Wrap(err, "Error updating CNCI instance image in database")
 	}
 
-	n.ID = stat.NodeUUID
-	n.Hostname = stat.NodeHostName
+	ds.cnciInstanceImages[instanceID] = imageID
 
-	cnStat := types.CiaoNode{
-		ID:                   stat.NodeUUID,
-		Hostname:             n.Hostname,
-		Status:               stat.Status,
-		Load:                 stat.Load,
-		MemTotal:             stat.MemTotalMB,
-		MemAvailable:         stat.MemAvailableMB,
-		DiskTotal:            stat.DiskTotalMB,
-		DiskAvailable:        stat.DiskAvailableMB,
-		OnlineCPUs:           stat.CpusOnline,
-		TotalFailures:        n.TotalFailures,
-		StartFailures:        n.StartFailures,
-		AttachVolumeFailures: n.AttachVolumeFailures,
-		DeleteFailures:       n.DeleteFailures,
+	return nil
+}
+
+// GetCNCIInstanceImage returns the image a CNCI was launched from, or an
+// empty string if it is not known.
+func (ds *Datastore) GetCNCIInstanceImage(instanceID string) string {
+	ds.cnciLock.RLock()
+	defer ds.cnciLock.RUnlock()
+
+	return ds.cnciInstanceImages[instanceID]
+}
+
+func (ds *Datastore) deleteCNCIInstanceImage(instanceID string) error {
+	ds.cnciLock.Lock()
+	defer ds.cnciLock.Unlock()
+
+	if _, ok := ds.cnciInstanceImages[instanceID]; !ok {
+		return nil
 	}
 
-	ds.nodesLock.Unlock()
-	ds.nodeLastStatLock.Lock()
+	delete(ds.cnciInstanceImages, instanceID)
 
-	delete(ds.nodeLastStat, stat.NodeUUID)
-	ds.nodeLastStat[stat.NodeUUID] = cnStat
+	return errors.Wrap(ds.db.deleteCNCIInstanceImage(instanceID), "Error deleting CNCI instance image from database")
+}
 
-	ds.nodeLastStatLock.Unlock()
+// GetQuotas returns the set of quotas from the database without any caching.
+func (ds *Datastore) GetQuotas(tenantID string) ([]types.QuotaDetails, error) {
+	return ds.db.getQuotas(tenantID)
+}
 
-	return errors.Wrap(ds.db.addNodeStat(stat), "error adding node stats to database")
+// UpdateQuotas updates the quotas for a tenant in the database.
+func (ds *Datastore) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	return ds.db.updateQuotas(tenantID, qds)
 }
 
-var tenantUsagePeriodMinutes float64 = 5
+// ResolveInstance maps an instance name to an uuid, returning "" if not found
+// TODO: Replace this O(n) algorithm with another name to id map.
+func (ds *Datastore) ResolveInstance(tenantID string, name string) (string, error) {
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
 
-func (ds *Datastore) updateTenantUsageNeeded(delta types.CiaoUsage, tenantID string) bool {
-	if delta.VCPU == 0 &&
-		delta.Memory == 0 &&
-		delta.Disk == 0 {
-		return false
+	t, ok := ds.tenants[tenantID]
+	if !ok {
+		return "", fmt.Errorf("Tenant not found: %s", tenantID)
 	}
 
-	return true
+	for _, i := range t.instances {
+		if i.Name == name || i.ID == name {
+			return i.ID, nil
+		}
+	}
+
+	return "", nil
 }
 
-func (ds *Datastore) updateTenantUsage(delta types.CiaoUsage, tenantID string) {
-	if ds.updateTenantUsageNeeded(delta, tenantID) == false {
-		return
+// AddImage adds an image to the datastore and database
+func (ds *Datastore) AddImage(i types.Image) error {
+	ds.imageLock.Lock()
+	defer ds.imageLock.Unlock()
+	if _, ok := ds.images[i.ID]; ok {
+		return api.ErrAlreadyExists
 	}
 
-	createNewUsage := true
-	lastUsage := types.CiaoUsage{}
+	_, err := ds.ResolveImage(i.TenantID, i.Name)
+	if err == nil {
+		return api.ErrAlreadyExists
+	} else if err != api.ErrNoImage {
+		return err
+	}
 
-	ds.tenantUsageLock.Lock()
+	_, err = ds.ResolveImage(i.TenantID, i.ID)
+	if err == nil {
+		return api.ErrAlreadyExists
+	} else if err != api.ErrNoImage {
+		return err
+	}
 
-	tenantUsage := ds.tenantUsage[tenantID]
-	if len(tenantUsage) != 0 {
-		lastUsage = tenantUsage[len(tenantUsage)-1]
-		// We will not create more than one entry per tenant every tenantUsagePeriodMinutes
-		if time.Since(lastUsage.Timestamp).Minutes() < tenantUsagePeriodMinutes {
-			createNewUsage = false
+	err = ds.db.updateImage(i)
+	if err != nil {
+		return errors.Wrap(err, "Unable to add image to database")
+	}
+
+	if i.TenantID != "" {
+		ds.tenantsLock.Lock()
+		if _, ok := ds.tenants[i.TenantID]; !ok {
+			ds.tenantsLock.Unlock()
+			_ = ds.db.deleteImage(i.ID)
+			return types.ErrTenantNotFound
 		}
+
+		ds.tenants[i.TenantID].images = append(ds.tenants[i.TenantID].images, i.ID)
+		ds.tenantsLock.Unlock()
 	}
 
-	newUsage := types.CiaoUsage{
-		VCPU:   lastUsage.VCPU + delta.VCPU,
-		Memory: lastUsage.Memory + delta.Memory,
-		Disk:   lastUsage.Disk + delta.Disk,
+	ds.images[i.ID] = i
+
+	if i.Visibility == types.Public {
+		ds.publicImages = append(ds.publicImages, i.ID)
 	}
 
-	// If we need to create a new usage entry, we timestamp it now.
-	// If not we just update the last entry.
-	if createNewUsage == true {
-		newUsage.Timestamp = time.Now()
-		ds.tenantUsage[tenantID] = append(ds.tenantUsage[tenantID], newUsage)
-	} else {
-		newUsage.Timestamp = lastUsage.Timestamp
-		tenantUsage[len(tenantUsage)-1] = newUsage
+	if i.Visibility == types.Internal {
+		ds.internalImages = append(ds.internalImages, i.ID)
 	}
 
-	ds.tenantUsageLock.Unlock()
+	return nil
 }
 
-// GetTenantUsage provides statistics on actual resource usage.
-// Usage is provided between a specified time period.
-func (ds *Datastore) GetTenantUsage(tenantID string, start time.Time, end time.Time) ([]types.CiaoUsage, error) {
-	ds.tenantUsageLock.RLock()
-	defer ds.tenantUsageLock.RUnlock()
+// UpdateImage updates the image metadate in the datastore and database
+func (ds *Datastore) UpdateImage(i types.Image) error {
+	ds.imageLock.Lock()
+	defer ds.imageLock.Unlock()
 
-	tenantUsage := ds.tenantUsage[tenantID]
-	if tenantUsage == nil || len(tenantUsage) == 0 {
-		return nil, nil
+	oldImage, ok := ds.images[i.ID]
+	if !ok {
+		return api.ErrNoImage
 	}
 
-	historyLength := len(tenantUsage)
-	if tenantUsage[0].Timestamp.After(end) == true ||
-		start.After(tenantUsage[historyLength-1].Timestamp) == true {
-		return nil, nil
+	if oldImage.TenantID != i.TenantID ||
+		oldImage.Visibility != i.Visibility {
+		return errors.New("Changing visibility or tenant for image not permitted")
 	}
 
-	first := 0
-	last := 0
-	for _, u := range tenantUsage {
-		if start.After(u.Timestamp) == true {
-			first++
+	if oldImage.Name != i.Name {
+		_, err := ds.ResolveImage(i.TenantID, i.Name)
+		if err == nil {
+			return api.ErrAlreadyExists
+		} else if err != api.ErrNoImage {
+			return err
 		}
+	}
 
-		if end.After(u.Timestamp) == true {
-			last++
-		}
+	if err := ds.db.updateImage(i); err != nil {
+		return errors.Wrap(err, "Error updating image in database")
 	}
 
-	return tenantUsage[first:last], nil
+	ds.images[i.ID] = i
+
+	return nil
 }
 
-func reduceToZero(v int) int {
-	if v < 0 {
-		return 0
+// GetImage retrieves an image by ID
+func (ds *Datastore) GetImage(ID string) (types.Image, error) {
+	ds.imageLock.RLock()
+	defer ds.imageLock.RUnlock()
+
+	image, ok := ds.images[ID]
+	if !ok {
+		return types.Image{}, api.ErrNoImage
 	}
 
-	return v
+	return image, nil
 }
 
-func (ds *Datastore) addInstanceStats(stats []payloads.InstanceStat, nodeID string) error {
-	for index := range stats {
-		stat := stats[index]
+// ResolveImage retrieves an image by name or ID
+func (ds *Datastore) ResolveImage(tenantID string, name string) (string, error) {
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
 
-		instanceStat := types.CiaoServerStats{
-			ID:        stat.InstanceUUID,
-			NodeID:    nodeID,
-			Timestamp: time.Now(),
-			Status:    stat.State,
-			VCPUUsage: reduceToZero(stat.CPUUsage),
-			MemUsage:  reduceToZero(stat.MemoryUsageMB),
-			DiskUsage: reduceToZero(stat.DiskUsageMB),
+	// admins may refer to any image by ID
+	if tenantID == "admin" {
+		if _, ok := ds.images[name]; ok {
+			return name, nil
+		}
+	}
+
+	if tenantID != "" && tenantID != "admin" {
+		t, ok := ds.tenants[tenantID]
+		if !ok {
+			return "", fmt.Errorf("Tenant not found: %s", tenantID)
+		}
+
+		for _, id := range t.images {
+			i := ds.images[id]
+			if i.Name == name || i.ID == name {
+				return i.ID, nil
+			}
+		}
+	}
+
+	for _, id := range ds.publicImages {
+		i := ds.images[id]
+		if i.Name == name || i.ID == name {
+			return i.ID, nil
+		}
+	}
+
+	for _, id := range ds.internalImages {
+		i := ds.images[id]
+		if i.Name == name || i.ID == name {
+			return i.ID, nil
+		}
+	}
+
+	return "", api.ErrNoImage
+}
+
+// GetImages obtains the images available for the optional tenantID/admin combo
+func (ds *Datastore) GetImages(tenantID string, admin bool) ([]types.Image, error) {
+	ds.imageLock.RLock()
+	defer ds.imageLock.RUnlock()
+
+	images := []types.Image{}
+
+	if tenantID != "" {
+		ds.tenantsLock.RLock()
+		if _, ok := ds.tenants[tenantID]; !ok {
+			ds.tenantsLock.RUnlock()
+			return images, types.ErrTenantNotFound
+		}
+
+		for _, id := range ds.tenants[tenantID].images {
+			// public and internal images are listed below
+			if i := ds.images[id]; i.Visibility == types.Private {
+				images = append(images, i)
+			}
 		}
 
-		ds.instanceLastStatLock.Lock()
-
-		lastInstanceStat := ds.instanceLastStat[stat.InstanceUUID]
+		ds.tenantsLock.RUnlock()
+	}
 
-		deltaUsage := types.CiaoUsage{
-			VCPU:   instanceStat.VCPUUsage - lastInstanceStat.VCPUUsage,
-			Memory: instanceStat.MemUsage - lastInstanceStat.MemUsage,
-			Disk:   instanceStat.DiskUsage - lastInstanceStat.DiskUsage,
+	if admin {
+		for _, id := range ds.internalImages {
+			images = append(images, ds.images[id])
 		}
+	}
 
-		ds.updateTenantUsage(deltaUsage, lastInstanceStat.TenantID)
-
-		instanceStat.TenantID = lastInstanceStat.TenantID
+	for _, id := range ds.publicImages {
+		images = append(images, ds.images[id])
+	}
 
-		delete(ds.instanceLastStat, stat.InstanceUUID)
-		ds.instanceLastStat[stat.InstanceUUID] = instanceStat
+	return images, nil
+}
 
-		ds.instanceLastStatLock.Unlock()
+// DeleteImage deleted the image from the datastore and the database
+func (ds *Datastore) DeleteImage(ID string) error {
+	ds.imageLock.Lock()
+	defer ds.imageLock.Unlock()
 
-		ds.instancesLock.Lock()
-		instance, ok := ds.instances[stat.InstanceUUID]
-		if ok {
-			instance.State = stat.State
-			instance.NodeID = nodeID
-			instance.SSHIP = stat.SSHIP
-			instance.SSHPort = stat.SSHPort
-			ds.nodesLock.Lock()
-			ds.nodes[nodeID].instances[instance.ID] = instance
-			ds.nodesLock.Unlock()
-		}
-		ds.instancesLock.Unlock()
+	image, ok := ds.images[ID]
+	if !ok {
+		return api.ErrNoImage
 	}
 
-	return errors.Wrapf(ds.db.addInstanceStats(stats, nodeID), "error adding instance stats to database")
-}
-
-// GetTenantCNCISummary retrieves information about a given CNCI id, or all CNCIs
-// If the cnci string is the null string, then this function will retrieve all
-// tenants.  If cnci is not null, it will only provide information about a specific
-// cnci.
-func (ds *Datastore) GetTenantCNCISummary(cnciID string) ([]types.TenantCNCI, error) {
-	var cncis []types.TenantCNCI
+	workloads := ds.imageWorkloads(image)
+	if len(workloads) > 0 {
+		return &types.ImageInUseError{ImageID: ID, Workloads: workloads}
+	}
 
-	instances, err := ds.GetAllCNCIInstances()
-	if err != nil {
-		return cncis, err
+	if err := ds.db.deleteImage(ID); err != nil {
+		return errors.Wrapf(err, "error deleting image %v from database", ID)
 	}
 
-	for _, i := range instances {
-		if cnciID != "" && cnciID != i.ID {
-			continue
+	if image.TenantID != "" {
+		ds.tenantsLock.Lock()
+
+		tenant, ok := ds.tenants[image.TenantID]
+		if !ok {
+			ds.tenantsLock.Unlock()
+			return types.ErrTenantNotFound
 		}
 
-		cnci := types.TenantCNCI{
-			TenantID:   i.TenantID,
-			IPAddress:  i.IPAddress,
-			MACAddress: i.MACAddress,
-			InstanceID: i.ID,
+		for i, id := range tenant.images {
+			if id == ID {
+				tenant.images = append(tenant.images[:i], tenant.images[i+1:]...)
+				break
+			}
 		}
 
-		cnci.Subnets = append(cnci.Subnets, i.Subnet)
+		ds.tenantsLock.Unlock()
+	}
 
-		cncis = append(cncis, cnci)
+	ds.internalImages = removeImageID(ds.internalImages, ID)
+	ds.publicImages = removeImageID(ds.publicImages, ID)
 
-		if cnciID != "" {
-			break
-		}
+	ds.imageSeedsLock.Lock()
+	err := ds.db.deleteImageSeeds(ID)
+	if err == nil {
+		delete(ds.imageSeeds, ID)
+	}
+	ds.imageSeedsLock.Unlock()
+	if err != nil {
+		ds.log.Warningf("Unable to forget the seeds of image %s: %v", ID, err)
 	}
 
-	return cncis, nil
+	delete(ds.images, ID)
+
+	return nil
 }
 
-// GetCNCIWorkloadID returns the UUID of the workload template
-// for the CNCI workload
-func (ds *Datastore) GetCNCIWorkloadID() (string, error) {
-	if ds.cnciWorkload.ID == "" {
-		return "", errors.New("No CNCI Workload in datastore")
+func removeImageID(ids []string, ID string) []string {
+	for i, id := range ids {
+		if id == ID {
+			return append(ids[:i], ids[i+1:]...)
+		}
 	}
 
-	return ds.cnciWorkload.ID, nil
+	return ids
 }
 
-// GetNodeSummary provides a summary the state and count of instances running per node.
-func (ds *Datastore) GetNodeSummary() ([]*types.NodeSummary, error) {
-	var nodes []*types.NodeSummary
-
-	ds.nodesLock.RLock()
-
-	for _, n := range ds.nodes {
-		var summary types.NodeSummary
+// imageWorkloads returns the IDs of the workloads whose storage is created
+// from image.  Workloads may refer to an image by name, in which case the
+// image must also be visible to the tenant of the workload.  The caller
+// must hold the image lock.
+func (ds *Datastore) imageWorkloads(image types.Image) []string {
+	var ids []string
 
-		// count the total instances, no CNCI included
-		for _, i := range n.instances {
-			if i.CNCI == true {
+	refers := func(wl types.Workload) bool {
+		for _, s := range wl.Storage {
+			if s.SourceType != types.ImageService {
 				continue
 			}
 
-			summary.TotalInstances++
+			if s.Source == image.ID {
+				return true
+			}
 
-			switch i.State {
-			case payloads.Pending:
-				summary.TotalPendingInstances++
-			case payloads.Running:
-				summary.TotalRunningInstances++
-			case payloads.Exited:
-				summary.TotalPausedInstances++
+			if s.Source == image.Name &&
+				(image.Visibility != types.Private || image.TenantID == wl.TenantID) {
+				return true
 			}
 		}
-
-		summary.NodeID = n.ID
-		summary.TotalFailures = n.TotalFailures
-
-		nodes = append(nodes, &summary)
+		return false
 	}
 
-	ds.nodesLock.RUnlock()
+	ds.cnciLock.RLock()
+	if refers(ds.cnciWorkload) {
+		ids = append(ids, ds.cnciWorkload.ID)
+	}
+	ds.cnciLock.RUnlock()
 
-	return nodes, nil
-}
+	ds.workloadsLock.RLock()
+	defer ds.workloadsLock.RUnlock()
 
-// GetBatchFrameSummary will retieve the count of traces we have for a specific label
-func (ds *Datastore) GetBatchFrameSummary() ([]types.BatchFrameSummary, error) {
-	// until we start caching frame stats, we have to send this
-	// right through to the database.
-	return ds.db.getBatchFrameSummary()
-}
+	for _, wl := range ds.workloads {
+		if refers(wl) {
+			ids = append(ids, wl.ID)
+		}
+	}
 
-// GetBatchFrameStatistics will show individual trace data per instance for a batch of trace data.
-// The batch is identified by the label.
-func (ds *Datastore) GetBatchFrameStatistics(label string) ([]types.BatchFrameStat, error) {
-	// until we start caching frame stats, we have to send this
-	// right through to the database.
-	return ds.db.getBatchFrameStatistics(label)
-}
+	sort.Strings(ids)
 
-// GetEventLog retrieves all the log entries stored in the datastore.
-func (ds *Datastore) GetEventLog() ([]*types.LogEntry, error) {
-	// we don't as of yet cache any of the events that are logged.
-	return ds.db.getEventLog()
+	return ids
 }
 
-// ClearLog will remove all the event entries from the event log
-func (ds *Datastore) ClearLog() error {
-	// we don't as of yet cache any of the events that are logged.
-	return ds.db.clearLog()
-}
+// SetImageVisibility changes the visibility of an image.  Only images
+// which belong to a tenant may be made private.
+func (ds *Datastore) SetImageVisibility(ID string, visibility types.Visibility) error {
+	ds.imageLock.Lock()
+	defer ds.imageLock.Unlock()
 
-// LogEvent will add a message to the persistent event log.
-func (ds *Datastore) LogEvent(tenant string, msg string) error {
-	e := types.LogEntry{
-		TenantID:  tenant,
-		EventType: string(userInfo),
-		Message:   msg,
+	image, ok := ds.images[ID]
+	if !ok {
+		return api.ErrNoImage
 	}
-	return ds.db.logEvent(e)
-}
 
-// LogError will add a message to the persistent event log as an error
-func (ds *Datastore) LogError(tenant string, msg string) error {
-	e := types.LogEntry{
-		TenantID:  tenant,
-		EventType: string(userError),
-		Message:   msg,
+	switch visibility {
+	case types.Public, types.Internal:
+	case types.Private:
+		if image.TenantID == "" {
+			return types.ErrBadRequest
+		}
+	default:
+		return types.ErrBadRequest
 	}
-	return ds.db.logEvent(e)
-}
 
-// AddBlockDevice will store information about new BlockData into
-// the datastore.
-func (ds *Datastore) AddBlockDevice(device types.Volume) error {
-	ds.bdLock.Lock()
-	_, update := ds.blockDevices[device.ID]
-	ds.bdLock.Unlock()
+	if image.Visibility == visibility {
+		return nil
+	}
 
-	// store persistently
-	var err error
-	if !update {
-		err = errors.Wrap(ds.db.addBlockData(device), "Error adding block data to database")
-	} else {
-		err = errors.Wrap(ds.db.updateBlockData(device), "Error updating block data in database")
+	image.Visibility = visibility
+	if err := ds.db.updateImage(image); err != nil {
+		return errors.Wrap(err, "Error updating image in database")
 	}
 
-	if err != nil {
-		return err
+	ds.internalImages = removeImageID(ds.internalImages, ID)
+	ds.publicImages = removeImageID(ds.publicImages, ID)
+
+	switch visibility {
+	case types.Public:
+		ds.publicImages = append(ds.publicImages, ID)
+	case types.Internal:
+		ds.internalImages = append(ds.internalImages, ID)
 	}
 
-	ds.bdLock.Lock()
-	ds.blockDevices[device.ID] = device
-	ds.bdLock.Unlock()
+	ds.images[ID] = image
 
-	// update tenants cache
-	ds.tenantsLock.Lock()
-	devices := ds.tenants[device.TenantID].devices
-	devices[device.ID] = device
-	ds.tenantsLock.Unlock()
 	return nil
 }
 
-// DeleteBlockDevice will delete a volume from the datastore.
-// It also deletes it from the tenant's list of devices.
-func (ds *Datastore) DeleteBlockDevice(ID string) error {
-	ds.bdLock.Lock()
-	dev, ok := ds.blockDevices[ID]
-	if !ok {
+// AddWebhook adds a new webhook subscription to the datastore.
+func (ds *Datastore) AddWebhook(w types.Webhook) error {
+	ds.webhooksLock.Lock()
+	defer ds.webhooksLock.Unlock()
 
-		ds.bdLock.Unlock()
-		return ErrNoBlockData
+	if _, ok := ds.webhooks[w.ID]; ok {
+		return api.ErrAlreadyExists
 	}
-	ds.bdLock.Unlock()
 
-	err := errors.Wrap(ds.db.deleteBlockData(ID), "Error deleting block data from database")
-	if err != nil {
-		return err
+	if err := ds.db.updateWebhook(w); err != nil {
+		return errors.Wrap(err, "Unable to add webhook to database")
 	}
 
-	ds.bdLock.Lock()
-	ds.tenantsLock.Lock()
-
-	delete(ds.blockDevices, ID)
-	delete(ds.tenants[dev.TenantID].devices, ID)
-
-	ds.tenantsLock.Unlock()
-	ds.bdLock.Unlock()
+	ds.webhooks[w.ID] = w
 
 	return nil
 }
 
-// GetBlockDevices will return all the BlockDevices associated with a tenant.
-func (ds *Datastore) GetBlockDevices(tenant string) ([]types.Volume, error) {
-	var devices []types.Volume
-
-	ds.tenantsLock.RLock()
+// UpdateWebhook updates an existing webhook subscription.
+func (ds *Datastore) UpdateWebhook(w types.Webhook) error {
+	ds.webhooksLock.Lock()
+	defer ds.webhooksLock.Unlock()
 
-	_, ok := ds.tenants[tenant]
-	if !ok {
-		ds.tenantsLock.RUnlock()
-		return devices, ErrNoTenant
+	if _, ok := ds.webhooks[w.ID]; !ok {
+		return types.ErrWebhookNotFound
 	}
 
-	for _, value := range ds.tenants[tenant].devices {
-		devices = append(devices, value)
+	if err := ds.db.updateWebhook(w); err != nil {
+		return errors.Wrap(err, "Error updating webhook in database")
 	}
 
-	ds.tenantsLock.RUnlock()
-
-	return devices, nil
+	ds.webhooks[w.ID] = w
 
+	return nil
 }
 
-// GetBlockDevice will return information about a block device from the
-// datastore.
-func (ds *Datastore) GetBlockDevice(ID string) (types.Volume, error) {
-	ds.bdLock.RLock()
-	data, ok := ds.blockDevices[ID]
-	ds.bdLock.RUnlock()
+// GetWebhook retrieves a webhook subscription by ID.
+func (ds *Datastore) GetWebhook(ID string) (types.Webhook, error) {
+	ds.webhooksLock.RLock()
+	defer ds.webhooksLock.RUnlock()
 
+	w, ok := ds.webhooks[ID]
 	if !ok {
-		return types.Volume{}, ErrNoBlockData
+		return types.Webhook{}, types.ErrWebhookNotFound
 	}
-	return data, nil
+
+	return w, nil
 }
 
-// UpdateBlockDevice will replace existing information about a block device
-// in the datastore.
-func (ds *Datastore) UpdateBlockDevice(data types.Volume) error {
-	ds.bdLock.RLock()
-	_, ok := ds.blockDevices[data.ID]
-	ds.bdLock.RUnlock()
+// GetWebhooks retrieves all the webhook subscriptions.
+func (ds *Datastore) GetWebhooks() []types.Webhook {
+	ds.webhooksLock.RLock()
+	defer ds.webhooksLock.RUnlock()
 
-	if !ok {
-		return ErrNoBlockData
+	webhooks := make([]types.Webhook, 0, len(ds.webhooks))
+	for _, w := range ds.webhooks {
+		webhooks = append(webhooks, w)
 	}
 
-	return errors.Wrapf(ds.AddBlockDevice(data), "error updating block device (%v)", data.ID)
+	return webhooks
 }
 
-// CreateStorageAttachment will associate an instance with a block device in
-// the datastore
-func (ds *Datastore) CreateStorageAttachment(instanceID string, volume payloads.StorageResource) (types.StorageAttachment, error) {
-	link := attachment{
-		instanceID: instanceID,
-		volumeID:   volume.ID,
-	}
+// DeleteWebhook removes a webhook subscription from the datastore.
+func (ds *Datastore) DeleteWebhook(ID string) error {
+	ds.webhooksLock.Lock()
+	defer ds.webhooksLock.Unlock()
 
-	a := types.StorageAttachment{
-		InstanceID: instanceID,
-		ID:         uuid.Generate().String(),
-		BlockID:    volume.ID,
-		Ephemeral:  volume.Ephemeral,
-		Boot:       volume.Bootable,
+	if _, ok := ds.webhooks[ID]; !ok {
+		return types.ErrWebhookNotFound
 	}
 
-	err := ds.db.addStorageAttachment(a)
-	if err != nil {
-		return types.StorageAttachment{}, errors.Wrap(err, "error adding storage attachment to database")
+	if err := ds.db.deleteWebhook(ID); err != nil {
+		return errors.Wrap(err, "Error deleting webhook from database")
 	}
 
-	// ensure that the volume is marked in use as we have created an attachment
-	bd, err := ds.GetBlockDevice(volume.ID)
-	if err != nil {
-		_ = ds.db.deleteStorageAttachment(a.ID)
-		return types.StorageAttachment{}, errors.Wrapf(err, "error fetching block device (%v)", volume.ID)
+	delete(ds.webhooks, ID)
+
+	return nil
+}
+
+// UpdateTenantCA registers the client CA of a tenant, replacing any CA
+// registered before.
+func (ds *Datastore) UpdateTenantCA(ca types.TenantCA) error {
+	ds.tenantCAsLock.Lock()
+	defer ds.tenantCAsLock.Unlock()
+
+	if err := ds.db.updateTenantCA(ca); err != nil {
+		return errors.Wrap(err, "Error updating tenant CA in database")
 	}
 
-	bd.State = types.InUse
-	err = ds.UpdateBlockDevice(bd)
-	if err != nil {
-		_ = ds.db.deleteStorageAttachment(a.ID)
-		return types.StorageAttachment{}, errors.Wrapf(err, "error updating block device (%v)", volume.ID)
+	ds.tenantCAs[ca.TenantID] = ca
+	ds.tenantCAGen++
+
+	return nil
+}
+
+// GetTenantCA retrieves the client CA of a tenant.
+func (ds *Datastore) GetTenantCA(tenantID string) (types.TenantCA, error) {
+	ds.tenantCAsLock.RLock()
+	defer ds.tenantCAsLock.RUnlock()
+
+	ca, ok := ds.tenantCAs[tenantID]
+	if !ok {
+		return types.TenantCA{}, types.ErrTenantCANotFound
 	}
 
-	// add it to our links map
-	ds.attachLock.Lock()
-	ds.attachments[a.ID] = a
-	ds.instanceVolumes[link] = a.ID
-	ds.attachLock.Unlock()
-
-	return a, nil
+	return ca, nil
 }
 
-// GetStorageAttachments returns a list of volumes associated with this instance.
-func (ds *Datastore) GetStorageAttachments(instanceID string) []types.StorageAttachment {
-	var links []types.StorageAttachment
+// GetTenantCAs retrieves the client CAs of all tenants along with a
+// generation number which changes whenever the set of CAs changes.
+func (ds *Datastore) GetTenantCAs() ([]types.TenantCA, uint64) {
+	ds.tenantCAsLock.RLock()
+	defer ds.tenantCAsLock.RUnlock()
 
-	ds.attachLock.RLock()
-	for _, a := range ds.attachments {
-		if a.InstanceID == instanceID {
-			links = append(links, a)
-		}
+	cas := make([]types.TenantCA, 0, len(ds.tenantCAs))
+	for _, ca := range ds.tenantCAs {
+		cas = append(cas, ca)
 	}
-	ds.attachLock.RUnlock()
 
-	return links
+	return cas, ds.tenantCAGen
 }
 
-func (ds *Datastore) updateStorageAttachments(instanceID string) {
-	ds.attachLock.Lock()
+// TenantCAGeneration returns the generation number of the set of tenant
+// CAs.
+func (ds *Datastore) TenantCAGeneration() uint64 {
+	ds.tenantCAsLock.RLock()
+	defer ds.tenantCAsLock.RUnlock()
 
-	// check to see if all the attachments we already
-	// know about are in the list.
-	for _, ID := range ds.instanceVolumes {
-		a := ds.attachments[ID]
+	return ds.tenantCAGen
+}
 
-		if a.InstanceID == instanceID {
-			bd, err := ds.GetBlockDevice(a.BlockID)
-			if err != nil {
-				glog.Warningf("error fetching block device (%v): %v", a.BlockID, err)
-				continue
-			}
+// DeleteTenantCA revokes the client CA of a tenant.
+func (ds *Datastore) DeleteTenantCA(tenantID string) error {
+	ds.tenantCAsLock.Lock()
+	defer ds.tenantCAsLock.Unlock()
 
-			// update the state of the volume.
-			bd.State = types.Available
-			err = ds.UpdateBlockDevice(bd)
-			if err != nil {
-				glog.Warningf("error updating block device (%v): %v", a.BlockID, err)
-			}
+	if _, ok := ds.tenantCAs[tenantID]; !ok {
+		return types.ErrTenantCANotFound
+	}
 
-			// delete the attachment.
-			key := attachment{
-				instanceID: a.InstanceID,
-				volumeID:   a.BlockID,
-			}
+	if err := ds.db.deleteTenantCA(tenantID); err != nil {
+		return errors.Wrap(err, "Error deleting tenant CA from database")
+	}
 
-			delete(ds.attachments, ID)
-			delete(ds.instanceVolumes, key)
+	delete(ds.tenantCAs, tenantID)
+	ds.tenantCAGen++
 
-			// update persistent store asynch.
-			// ok for lock to be held here, but
-			// not needed as the db keeps it's
-			// own locks.
-			err = ds.db.deleteStorageAttachment(ID)
-			if err != nil {
-				glog.Warningf("error updating storage attachments: %v", err)
-			}
-		}
+	return nil
+}
+
+// AddOperation records a new operation.
+func (ds *Datastore) AddOperation(o types.Operation) error {
+	ds.operationsLock.Lock()
+	defer ds.operationsLock.Unlock()
+
+	if _, ok := ds.operations[o.ID]; ok {
+		return api.ErrAlreadyExists
 	}
-	ds.attachLock.Unlock()
+
+	if err := ds.db.updateOperation(o); err != nil {
+		return errors.Wrap(err, "Unable to add operation to database")
+	}
+
+	ds.operations[o.ID] = o
+
+	return nil
 }
 
-func (ds *Datastore) getStorageAttachment(instanceID string, volumeID string) (types.StorageAttachment, error) {
-	var a types.StorageAttachment
+// UpdateOperation records the progress of an operation.
+func (ds *Datastore) UpdateOperation(o types.Operation) error {
+	ds.operationsLock.Lock()
+	defer ds.operationsLock.Unlock()
 
-	key := attachment{
-		instanceID: instanceID,
-		volumeID:   volumeID,
+	if _, ok := ds.operations[o.ID]; !ok {
+		return types.ErrOperationNotFound
 	}
 
-	ds.attachLock.RLock()
-	id, ok := ds.instanceVolumes[key]
-	if ok {
-		a = ds.attachments[id]
+	if err := ds.db.updateOperation(o); err != nil {
+		return errors.Wrap(err, "Error updating operation in database")
 	}
-	ds.attachLock.RUnlock()
 
+	ds.operations[o.ID] = o
+
+	return nil
+}
+
+// GetOperation retrieves an operation by ID.
+func (ds *Datastore) GetOperation(ID string) (types.Operation, error) {
+	ds.operationsLock.RLock()
+	defer ds.operationsLock.RUnlock()
+
+	o, ok := ds.operations[ID]
 	if !ok {
-		return a, ErrNoStorageAttachment
+		return types.Operation{}, types.ErrOperationNotFound
 	}
 
-	return a, nil
+	return o, nil
 }
 
-// DeleteStorageAttachment will delete the attachment with the associated ID
-// from the datastore.
-func (ds *Datastore) DeleteStorageAttachment(ID string) error {
-	err := errors.Wrapf(ds.db.deleteStorageAttachment(ID), "error deleting storage attachment (%v) from database", ID)
-	if err != nil {
-		return err
+// GetOperations retrieves the operations of a tenant, or of all tenants if
+// tenantID is empty, oldest first.
+func (ds *Datastore) GetOperations(tenantID string) []types.Operation {
+	ds.operationsLock.RLock()
+	defer ds.operationsLock.RUnlock()
+
+	operations := []types.Operation{}
+	for _, o := range ds.operations {
+		if tenantID == "" || o.TenantID == tenantID {
+			operations = append(operations, o)
+		}
 	}
 
-	ds.attachLock.Lock()
-	a, ok := ds.attachments[ID]
-	if ok {
-		key := attachment{
-			instanceID: a.InstanceID,
-			volumeID:   a.BlockID,
+	sort.Sort(types.SortedOperationsByCreateTime(operations))
+
+	return operations
+}
+
+// PruneOperations removes the operations which finished before the given
+// time and returns the number removed.
+func (ds *Datastore) PruneOperations(before time.Time) (int, error) {
+	ds.operationsLock.Lock()
+	defer ds.operationsLock.Unlock()
+
+	pruned := 0
+	for id, o := range ds.operations {
+		if !o.Done() || !o.UpdateTime.Before(before) {
+			continue
 		}
 
-		delete(ds.attachments, ID)
-		delete(ds.instanceVolumes, key)
+		if err := ds.db.deleteOperation(id); err != nil {
+			return pruned, errors.Wrap(err, "Error deleting operation from database")
+		}
+
+		delete(ds.operations, id)
+		pruned++
 	}
-	ds.attachLock.Unlock()
 
-	if !ok {
-		return ErrNoStorageAttachment
+	return pruned, nil
+}
+
+// AddTrashItem records a deleted instance or volume in its tenant's trash.
+func (ds *Datastore) AddTrashItem(item types.TrashItem) error {
+	ds.trashLock.Lock()
+	defer ds.trashLock.Unlock()
+
+	if err := ds.db.addTrashItem(item); err != nil {
+		return errors.Wrap(err, "Unable to add trash item to database")
 	}
 
+	ds.trash[item.ID] = item
+
 	return nil
 }
 
-// GetVolumeAttachments will return a list of attachments associated with
-// this volume ID.
-func (ds *Datastore) GetVolumeAttachments(volume string) ([]types.StorageAttachment, error) {
-	var attachments []types.StorageAttachment
+// GetTrashItem retrieves an item from the trash of a tenant.
+func (ds *Datastore) GetTrashItem(tenantID string, ID string) (types.TrashItem, error) {
+	ds.trashLock.RLock()
+	defer ds.trashLock.RUnlock()
 
-	ds.attachLock.RLock()
+	item, ok := ds.trash[ID]
+	if !ok || item.TenantID != tenantID {
+		return types.TrashItem{}, types.ErrTrashItemNotFound
+	}
 
-	for _, a := range ds.attachments {
-		if a.BlockID == volume {
-			attachments = append(attachments, a)
+	return item, nil
+}
+
+// GetTrashItems retrieves the trash of a tenant, or of all tenants if
+// tenantID is empty, oldest first.
+func (ds *Datastore) GetTrashItems(tenantID string) []types.TrashItem {
+	ds.trashLock.RLock()
+	defer ds.trashLock.RUnlock()
+
+	items := []types.TrashItem{}
+	for _, item := range ds.trash {
+		if tenantID == "" || item.TenantID == tenantID {
+			items = append(items, item)
 		}
 	}
 
-	ds.attachLock.RUnlock()
+	sort.Sort(types.SortedTrashItemsByDeleteTime(items))
 
-	return attachments, nil
+	return items
 }
 
-// GetPool will return an external IP Pool
-func (ds *Datastore) GetPool(ID string) (types.Pool, error) {
-	ds.poolsLock.RLock()
-	p, ok := ds.pools[ID]
-	ds.poolsLock.RUnlock()
+// DeleteTrashItem removes an item from the trash once it has been restored
+// or purged.
+func (ds *Datastore) DeleteTrashItem(ID string) error {
+	ds.trashLock.Lock()
+	defer ds.trashLock.Unlock()
 
-	if !ok {
-		return p, types.ErrPoolNotFound
+	if _, ok := ds.trash[ID]; !ok {
+		return types.ErrTrashItemNotFound
 	}
 
-	return p, nil
+	if err := ds.db.deleteTrashItem(ID); err != nil {
+		return errors.Wrap(err, "Error deleting trash item from database")
+	}
+
+	delete(ds.trash, ID)
+
+	return nil
 }
 
-// GetPools will return a list of external IP Pools
-func (ds *Datastore) GetPools() ([]types.Pool, error) {
-	var pools []types.Pool
+// AddIdempotentResponse stores the response to a request made with an
+// idempotency key, replacing any response already stored for the key of
+// the tenant.
+func (ds *Datastore) AddIdempotentResponse(r types.IdempotentResponse) error {
+	return ds.db.addIdempotentResponse(r)
+}
 
-	ds.poolsLock.RLock()
+// GetIdempotentResponse retrieves the response stored for the idempotency
+// key of a tenant, returning ErrNoIdempotencyKey if there is none.
+func (ds *Datastore) GetIdempotentResponse(tenantID string, key string) (types.IdempotentResponse, error) {
+	return ds.db.getIdempotentResponse(tenantID, key)
+}
 
-	for _, p := range ds.pools {
-		pools = append(pools, p)
+// PruneIdempotentResponses removes the responses stored before the given
+// time, returning the number removed.
+func (ds *Datastore) PruneIdempotentResponses(before time.Time) (int, error) {
+	return ds.db.pruneIdempotentResponses(before)
+}
+
+// AddQuotaAudit stores records of changes in the consumption of resources
+// subject to quotas.
+func (ds *Datastore) AddQuotaAudit(records []types.QuotaAuditRecord) error {
+	if len(records) == 0 {
+		return nil
 	}
 
-	ds.poolsLock.RUnlock()
+	return ds.db.addQuotaAudit(records)
+}
 
-	return pools, nil
+// GetQuotaAudit retrieves the quota audit records of a tenant selected by
+// filter, oldest first.
+func (ds *Datastore) GetQuotaAudit(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error) {
+	return ds.db.getQuotaAudit(filter)
 }
 
-// lock for the map must be held by caller.
-func (ds *Datastore) isDuplicateSubnet(new *net.IPNet) bool {
-	for s, exists := range ds.externalSubnets {
-		if exists == true {
-			// this will always succeed
-			_, subnet, _ := net.ParseCIDR(s)
+// AddAuditRecord stores the record of a mutating API request.
+func (ds *Datastore) AddAuditRecord(r types.AuditRecord) error {
+	return ds.db.addAuditRecord(r)
+}
 
-			if subnet.Contains(new.IP) || new.Contains(subnet.IP) {
-				return true
-			}
-		}
-	}
+// GetAuditRecords retrieves the audit records selected by filter, oldest
+// first.
+func (ds *Datastore) GetAuditRecords(filter types.AuditFilter) ([]types.AuditRecord, error) {
+	return ds.db.getAuditRecords(filter)
+}
 
-	return false
+// PruneAuditRecords removes the audit records made before the given time
+// and returns the number removed.
+func (ds *Datastore) PruneAuditRecords(before time.Time) (int, error) {
+	return ds.db.pruneAuditRecords(before)
 }
 
-// lock for the map must be held by the caller
-func (ds *Datastore) isDuplicateIP(new net.IP) bool {
-	// first make sure the IP isn't covered by a subnet
-	for s, exists := range ds.externalSubnets {
-		// this will always succeed
-		_, subnet, _ := net.ParseCIDR(s)
+// PruneQuotaAudit removes the quota audit records made before the given
+// time, returning the number removed.
+func (ds *Datastore) PruneQuotaAudit(before time.Time) (int, error) {
+	return ds.db.pruneQuotaAudit(before)
+}
 
-		if exists == true {
-			if subnet.Contains(new) {
-				return true
-			}
-		}
-	}
+// releaseUsage records the lifetime of a billable resource which is being
+// deleted so that its usage can be accounted for once it is gone.  A failure
+// to record it does not prevent the deletion.
+func (ds *Datastore) releaseUsage(span types.UsageSpan) {
+	span.End = ds.now().UTC()
 
-	// next make sure that the IP isn't already in a
-	// different pool
-	return ds.externalIPs[new.String()]
+	err := ds.db.addReleasedUsage(span)
+	if err != nil {
+		ds.log.Warningf("Unable to record usage of %s %s: %v", span.Resource, span.ID, err)
+	}
 }
 
-// AddPool will add a brand new pool to our datastore.
-func (ds *Datastore) AddPool(pool types.Pool) error {
-	ds.poolsLock.Lock()
+// UsageSpans returns the lifetimes of the billable resources of all tenants:
+// those which exist, whose spans have no end, and those released since the
+// released spans were last pruned.  Volumes in the trash are still billed.
+func (ds *Datastore) UsageSpans() ([]types.UsageSpan, error) {
+	var live []types.UsageSpan
 
-	if len(pool.Subnets) > 0 {
-		// check each one to make sure it's not in use.
-		for _, subnet := range pool.Subnets {
-			_, newSubnet, err := net.ParseCIDR(subnet.CIDR)
-			if err != nil {
-				ds.poolsLock.Unlock()
-				return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet.CIDR)
-			}
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.CNCI {
+			continue
+		}
 
-			if ds.isDuplicateSubnet(newSubnet) {
-				ds.poolsLock.Unlock()
-				return types.ErrDuplicateSubnet
-			}
+		live = append(live, types.UsageSpan{
+			TenantID: i.TenantID,
+			ID:       i.ID,
+			Resource: types.UsageInstance,
+			Start:    i.CreateTime,
+		})
+	}
+	ds.instancesLock.RUnlock()
 
-			// update our list of used subnets
-			ds.externalSubnets[subnet.CIDR] = true
+	ds.bdLock.RLock()
+	for _, dev := range ds.blockDevices {
+		if dev.Internal {
+			continue
 		}
-	} else if len(pool.IPs) > 0 {
-		var newIPs []net.IP
 
-		// make sure valid and not duplicate
-		for _, newIP := range pool.IPs {
-			IP := net.ParseIP(newIP.Address)
-			if IP == nil {
-				ds.poolsLock.Unlock()
-				return types.ErrInvalidIP
-			}
+		live = append(live, types.UsageSpan{
+			TenantID: dev.TenantID,
+			ID:       dev.ID,
+			Resource: types.UsageVolume,
+			SizeGB:   dev.Size,
+			Start:    dev.CreateTime,
+		})
+	}
+	ds.bdLock.RUnlock()
 
-			if ds.isDuplicateIP(IP) {
-				ds.poolsLock.Unlock()
-				return types.ErrDuplicateIP
-			}
+	ds.poolsLock.RLock()
+	for _, m := range ds.mappedIPs {
+		live = append(live, types.UsageSpan{
+			TenantID: m.TenantID,
+			ID:       m.ID,
+			Resource: types.UsageExternalIP,
+			Start:    m.CreateTime,
+		})
+	}
+	ds.poolsLock.RUnlock()
 
-			newIPs = append(newIPs, IP)
-		}
+	// the released spans are read last so that a resource released in
+	// the meantime is found in them.
+	spans, err := ds.db.getReleasedUsage()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting released usage from database")
+	}
+
+	released := make(map[string]bool, len(spans))
+	for _, s := range spans {
+		released[string(s.Resource)+"/"+s.ID] = true
+	}
 
-		// now that the whole list is confirmed, we can update
-		for _, IP := range newIPs {
-			ds.externalIPs[IP.String()] = true
+	for _, s := range live {
+		if !released[string(s.Resource)+"/"+s.ID] {
+			spans = append(spans, s)
 		}
 	}
 
-	ds.pools[pool.ID] = pool
-	err := ds.db.addPool(pool)
+	return spans, nil
+}
 
-	ds.poolsLock.Unlock()
+// PruneReleasedUsage removes the spans of the resources released before the
+// given time, returning the number removed.
+func (ds *Datastore) PruneReleasedUsage(before time.Time) (int, error) {
+	return ds.db.pruneReleasedUsage(before)
+}
 
-	if err != nil {
-		// lock must not be held when calling.
-		_ = ds.DeletePool(pool.ID)
+// AddUsageRecords stores usage records, replacing any record of the same
+// tenant and granularity with the same start.
+func (ds *Datastore) AddUsageRecords(records []types.UsageRecord) error {
+	if len(records) == 0 {
+		return nil
 	}
 
-	return errors.Wrap(err, "error adding pool to database")
+	return ds.db.addUsageRecords(records)
 }
 
-// DeletePool will delete an unused pool from our datastore.
-func (ds *Datastore) DeletePool(ID string) error {
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+// GetUsageRecords returns the usage records of a granularity which start
+// within the filter's period, ordered by start and tenant.  A zero start or
+// end leaves the period open.
+func (ds *Datastore) GetUsageRecords(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	return ds.db.getUsageRecords(filter)
+}
 
-	p, ok := ds.pools[ID]
-	if !ok {
-		return types.ErrPoolNotFound
-	}
+// LastUsageRecordEnd returns the end of the latest usage record of a
+// granularity, or the zero time if there are none.
+func (ds *Datastore) LastUsageRecordEnd(granularity types.UsageGranularity) (time.Time, error) {
+	return ds.db.lastUsageRecordEnd(granularity)
+}
 
-	// make sure all ips in this pool are not used.
-	if p.Free != p.TotalIPs {
-		return types.ErrPoolNotEmpty
-	}
+// PruneUsageRecords removes the usage records of a granularity which ended
+// before the given time, returning the number removed.
+func (ds *Datastore) PruneUsageRecords(granularity types.UsageGranularity, before time.Time) (int, error) {
+	return ds.db.pruneUsageRecords(granularity, before)
+}
 
-	// delete from persistent store
-	err := errors.Wrapf(ds.db.deletePool(ID), "error deleting pool (%v) from database", ID)
+// AcquireLease takes or renews the named lease for holder.  The lease is
+// granted if it is free, has expired or is already held by holder.  The
+// current state of the lease is returned whether or not it was granted.
+func (ds *Datastore) AcquireLease(name string, holder string, address string, duration time.Duration) (types.LeaderLease, error) {
+	now := time.Now()
+	return ds.db.acquireLease(name, holder, address, now.Add(duration), now)
+}
+
+// ReleaseLease gives up the named lease if it is held by holder.
+func (ds *Datastore) ReleaseLease(name string, holder string) error {
+	return ds.db.releaseLease(name, holder)
+}
 
-	// delete all subnets
-	for _, subnet := range p.Subnets {
-		delete(ds.externalSubnets, subnet.CIDR)
+// AddLaunchTemplate stores a new launch template for a tenant.
+func (ds *Datastore) AddLaunchTemplate(t types.LaunchTemplate) error {
+	ds.launchTemplatesLock.Lock()
+	defer ds.launchTemplatesLock.Unlock()
+
+	if _, ok := ds.launchTemplates[t.TenantID][t.Name]; ok {
+		return types.ErrLaunchTemplateExists
 	}
 
-	// delete any individual IPs
-	for _, IP := range p.IPs {
-		delete(ds.externalIPs, IP.Address)
+	if err := ds.db.updateLaunchTemplate(t); err != nil {
+		return errors.Wrap(err, "Unable to add launch template to database")
 	}
 
-	// delete the whole pool
-	delete(ds.pools, ID)
+	if ds.launchTemplates[t.TenantID] == nil {
+		ds.launchTemplates[t.TenantID] = make(map[string]types.LaunchTemplate)
+	}
+	ds.launchTemplates[t.TenantID][t.Name] = t
 
-	return err
+	return nil
 }
 
-// AddExternalSubnet will add a new subnet to an existing pool.
-func (ds *Datastore) AddExternalSubnet(poolID string, subnet string) error {
-	sub := types.ExternalSubnet{
-		ID:   uuid.Generate().String(),
-		CIDR: subnet,
+// UpdateLaunchTemplate replaces the launch request of an existing launch
+// template and returns the template with its version incremented.
+func (ds *Datastore) UpdateLaunchTemplate(tenantID string, name string, request []byte) (types.LaunchTemplate, error) {
+	ds.launchTemplatesLock.Lock()
+	defer ds.launchTemplatesLock.Unlock()
+
+	t, ok := ds.launchTemplates[tenantID][name]
+	if !ok {
+		return types.LaunchTemplate{}, types.ErrLaunchTemplateNotFound
 	}
 
-	_, ipNet, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet)
+	t.Request = request
+	t.Version++
+	t.UpdateTime = time.Now()
+
+	if err := ds.db.updateLaunchTemplate(t); err != nil {
+		return types.LaunchTemplate{}, errors.Wrap(err, "Error updating launch template in database")
 	}
 
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+	ds.launchTemplates[tenantID][name] = t
 
-	p, ok := ds.pools[poolID]
+	return t, nil
+}
+
+// GetLaunchTemplate retrieves a launch template of a tenant by name.
+func (ds *Datastore) GetLaunchTemplate(tenantID string, name string) (types.LaunchTemplate, error) {
+	ds.launchTemplatesLock.RLock()
+	defer ds.launchTemplatesLock.RUnlock()
+
+	t, ok := ds.launchTemplates[tenantID][name]
 	if !ok {
-		return types.ErrPoolNotFound
+		return types.LaunchTemplate{}, types.ErrLaunchTemplateNotFound
 	}
 
-	if ds.isDuplicateSubnet(ipNet) {
-		return types.ErrDuplicateSubnet
+	return t, nil
+}
+
+// GetLaunchTemplates retrieves the launch templates of a tenant ordered
+// by name.
+func (ds *Datastore) GetLaunchTemplates(tenantID string) []types.LaunchTemplate {
+	ds.launchTemplatesLock.RLock()
+	defer ds.launchTemplatesLock.RUnlock()
+
+	templates := make([]types.LaunchTemplate, 0, len(ds.launchTemplates[tenantID]))
+	for _, t := range ds.launchTemplates[tenantID] {
+		templates = append(templates, t)
 	}
 
-	ones, bits := ipNet.Mask.Size()
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
 
-	// intentionally do not support /32 here, user should add by IP address instead
-	// deduct gateway and broadcast
-	newIPs := (1 << uint32(bits-ones)) - 2
-	if newIPs <= 0 {
-		return types.ErrSubnetTooSmall
+	return templates
+}
+
+// DeleteLaunchTemplate removes a launch template of a tenant.
+func (ds *Datastore) DeleteLaunchTemplate(tenantID string, name string) error {
+	ds.launchTemplatesLock.Lock()
+	defer ds.launchTemplatesLock.Unlock()
+
+	if _, ok := ds.launchTemplates[tenantID][name]; !ok {
+		return types.ErrLaunchTemplateNotFound
 	}
-	p.TotalIPs += newIPs
-	p.Free += newIPs
-	p.Subnets = append(p.Subnets, sub)
 
-	err = ds.db.updatePool(p)
-	if err != nil {
-		return errors.Wrap(err, "error updating pool in database")
+	if err := ds.db.deleteLaunchTemplate(tenantID, name); err != nil {
+		return errors.Wrap(err, "Error deleting launch template from database")
 	}
 
-	// we are committed now.
-	ds.pools[poolID] = p
-	ds.externalSubnets[sub.CIDR] = true
+	delete(ds.launchTemplates[tenantID], name)
 
 	return nil
 }
 
-// AddExternalIPs will add a list of individual IPs to an existing pool.
-func (ds *Datastore) AddExternalIPs(poolID string, IPs []string) error {
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+// AddAPIKey stores a new API key for a tenant.
+func (ds *Datastore) AddAPIKey(k types.APIKey) error {
+	ds.apiKeysLock.Lock()
+	defer ds.apiKeysLock.Unlock()
 
-	p, ok := ds.pools[poolID]
-	if !ok {
-		return types.ErrPoolNotFound
+	if _, ok := ds.apiKeys[k.ID]; ok {
+		return api.ErrAlreadyExists
 	}
 
-	// sort to allow duplicate detection in IPs
-	sort.Strings(IPs)
+	if err := ds.db.updateAPIKey(k); err != nil {
+		return errors.Wrap(err, "Unable to add API key to database")
+	}
+
+	ds.apiKeys[k.ID] = k
+	ds.apiKeyIDs[k.Hash] = k.ID
+
+	return nil
+}
+
+// GetAPIKeys retrieves the API keys of a tenant ordered by creation time.
+func (ds *Datastore) GetAPIKeys(tenantID string) []types.APIKey {
+	ds.apiKeysLock.RLock()
+	defer ds.apiKeysLock.RUnlock()
 
-	// make sure valid and not duplicate
-	lastIP := ""
-	for _, newIP := range IPs {
-		if lastIP == newIP {
-			return types.ErrDuplicateIP
+	keys := []types.APIKey{}
+	for _, k := range ds.apiKeys {
+		if k.TenantID == tenantID {
+			keys = append(keys, k)
 		}
+	}
 
-		IP := net.ParseIP(newIP)
-		if IP == nil {
-			return types.ErrInvalidIP
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreateTime.Equal(keys[j].CreateTime) {
+			return keys[i].ID < keys[j].ID
 		}
+		return keys[i].CreateTime.Before(keys[j].CreateTime)
+	})
 
-		if ds.isDuplicateIP(IP) {
-			return types.ErrDuplicateIP
-		}
+	return keys
+}
 
-		ExtIP := types.ExternalIP{
-			ID:      uuid.Generate().String(),
-			Address: IP.String(),
-		}
+// GetAPIKeyByHash retrieves the API key with the given hash.
+func (ds *Datastore) GetAPIKeyByHash(hash string) (types.APIKey, error) {
+	ds.apiKeysLock.RLock()
+	defer ds.apiKeysLock.RUnlock()
 
-		p.TotalIPs++
-		p.Free++
-		p.IPs = append(p.IPs, ExtIP)
-		lastIP = newIP
+	ID, ok := ds.apiKeyIDs[hash]
+	if !ok {
+		return types.APIKey{}, types.ErrAPIKeyNotFound
 	}
 
-	// update persistent store.
-	err := ds.db.updatePool(p)
-	if err != nil {
-		return errors.Wrap(err, "error updating pool in database")
+	return ds.apiKeys[ID], nil
+}
+
+// UpdateAPIKeyLastUsed records the time an API key was last used.
+func (ds *Datastore) UpdateAPIKeyLastUsed(ID string, t time.Time) error {
+	ds.apiKeysLock.Lock()
+	defer ds.apiKeysLock.Unlock()
+
+	k, ok := ds.apiKeys[ID]
+	if !ok {
+		return types.ErrAPIKeyNotFound
 	}
 
-	// update cache.
-	for _, IP := range p.IPs {
-		ds.externalIPs[IP.Address] = true
+	k.LastUsedTime = t
+	if err := ds.db.updateAPIKey(k); err != nil {
+		return errors.Wrap(err, "Error updating API key in database")
 	}
-	ds.pools[poolID] = p
+
+	ds.apiKeys[ID] = k
 
 	return nil
 }
 
-// DeleteSubnet will remove an unused subnet from an existing pool.
-func (ds *Datastore) DeleteSubnet(poolID string, subnetID string) error {
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+// DeleteAPIKey revokes an API key of a tenant.
+func (ds *Datastore) DeleteAPIKey(tenantID string, ID string) error {
+	ds.apiKeysLock.Lock()
+	defer ds.apiKeysLock.Unlock()
 
-	p, ok := ds.pools[poolID]
-	if !ok {
-		return types.ErrPoolNotFound
+	k, ok := ds.apiKeys[ID]
+	if !ok || k.TenantID != tenantID {
+		return types.ErrAPIKeyNotFound
 	}
 
-	for i, sub := range p.Subnets {
-		if sub.ID != subnetID {
-			continue
-		}
-
-		// this path will be taken only once.
-		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
-		if err != nil {
-			return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", sub.CIDR)
-		}
+	if err := ds.db.deleteAPIKey(ID); err != nil {
+		return errors.Wrap(err, "Error deleting API key from database")
+	}
 
-		// check each address in this subnet is not mapped.
-		for IP := IP.Mask(ipNet.Mask); ipNet.Contains(IP); incrementIP(IP) {
-			_, ok := ds.mappedIPs[IP.String()]
-			if ok {
-				return types.ErrPoolNotEmpty
-			}
-		}
+	delete(ds.apiKeys, ID)
+	delete(ds.apiKeyIDs, k.Hash)
 
-		ones, bits := ipNet.Mask.Size()
-		numIPs := (1 << uint32(bits-ones)) - 2
-		p.TotalIPs -= numIPs
-		p.Free -= numIPs
-		p.Subnets = append(p.Subnets[:i], p.Subnets[i+1:]...)
+	return nil
+}
 
-		err = ds.db.updatePool(p)
-		if err != nil {
-			return errors.Wrap(err, "error updating pool in database")
-		}
+// AddAuthToken records the issue of a bearer token.
+func (ds *Datastore) AddAuthToken(t types.AuthToken) error {
+	ds.authTokensLock.Lock()
+	defer ds.authTokensLock.Unlock()
 
-		delete(ds.externalSubnets, sub.CIDR)
-		ds.pools[poolID] = p
+	if _, ok := ds.authTokens[t.ID]; ok {
+		return api.ErrAlreadyExists
+	}
 
-		return nil
+	if err := ds.db.addAuthToken(t); err != nil {
+		return errors.Wrap(err, "Unable to add token to database")
 	}
 
-	return types.ErrInvalidPoolAddress
+	ds.authTokens[t.ID] = t
+
+	return nil
 }
 
-// DeleteExternalIP will remove an individual IP address from a pool.
-func (ds *Datastore) DeleteExternalIP(poolID string, addrID string) error {
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+// GetAuthToken retrieves the record of a token which has not been revoked.
+func (ds *Datastore) GetAuthToken(ID string) (types.AuthToken, error) {
+	ds.authTokensLock.RLock()
+	defer ds.authTokensLock.RUnlock()
 
-	p, ok := ds.pools[poolID]
+	t, ok := ds.authTokens[ID]
 	if !ok {
-		return types.ErrPoolNotFound
+		return types.AuthToken{}, types.ErrAuthTokenNotFound
 	}
 
-	for i, extIP := range p.IPs {
-		if extIP.ID != addrID {
-			continue
-		}
+	return t, nil
+}
 
-		// this path will be taken only once.
-		// check address is not mapped.
-		_, ok := ds.mappedIPs[extIP.Address]
-		if ok {
-			return types.ErrPoolNotEmpty
-		}
+// GetAuthTokens retrieves the tokens which have not been revoked ordered by
+// issue time.
+func (ds *Datastore) GetAuthTokens() []types.AuthToken {
+	ds.authTokensLock.RLock()
+	defer ds.authTokensLock.RUnlock()
 
-		p.TotalIPs--
-		p.Free--
-		p.IPs = append(p.IPs[:i], p.IPs[i+1:]...)
+	tokens := make([]types.AuthToken, 0, len(ds.authTokens))
+	for _, t := range ds.authTokens {
+		tokens = append(tokens, t)
+	}
 
-		err := ds.db.updatePool(p)
-		if err != nil {
-			return errors.Wrap(err, "error updating pool in database")
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreateTime.Equal(tokens[j].CreateTime) {
+			return tokens[i].ID < tokens[j].ID
 		}
+		return tokens[i].CreateTime.Before(tokens[j].CreateTime)
+	})
 
-		delete(ds.externalIPs, extIP.Address)
-		ds.pools[poolID] = p
+	return tokens
+}
 
-		return nil
-	}
+// DeleteAuthToken revokes a token.  Requests made with the token are
+// refused from then on.
+func (ds *Datastore) DeleteAuthToken(ID string) error {
+	ds.authTokensLock.Lock()
+	defer ds.authTokensLock.Unlock()
 
-	return types.ErrInvalidPoolAddress
-}
+	if _, ok := ds.authTokens[ID]; !ok {
+		return types.ErrAuthTokenNotFound
+	}
 
-func incrementIP(IP net.IP) {
-	for i := len(IP) - 1; i >= 0; i-- {
-		IP[i]++
-		if IP[i] > 0 {
-			break
-		}
+	if err := ds.db.deleteAuthToken(ID); err != nil {
+		return errors.Wrap(err, "Error deleting token from database")
 	}
+
+	delete(ds.authTokens, ID)
+
+	return nil
 }
 
-// GetMappedIPs will return a list of mapped external IPs by tenant.
-func (ds *Datastore) GetMappedIPs(tenant *string) []types.MappedIP {
-	var mappedIPs []types.MappedIP
+// PruneAuthTokens removes the tokens which expired before the given time,
+// returning the number removed.
+func (ds *Datastore) PruneAuthTokens(before time.Time) (int, error) {
+	ds.authTokensLock.Lock()
+	defer ds.authTokensLock.Unlock()
 
-	ds.poolsLock.RLock()
-	defer ds.poolsLock.RUnlock()
+	pruned := 0
+	for ID, t := range ds.authTokens {
+		if !t.ExpireTime.Before(before) {
+			continue
+		}
 
-	for _, m := range ds.mappedIPs {
-		if tenant != nil {
-			if m.TenantID != *tenant {
-				continue
-			}
+		if err := ds.db.deleteAuthToken(ID); err != nil {
+			return pruned, errors.Wrap(err, "Error deleting token from database")
 		}
-		mappedIPs = append(mappedIPs, m)
+
+		delete(ds.authTokens, ID)
+		pruned++
 	}
 
-	return mappedIPs
+	return pruned, nil
 }
 
-// GetMappedIP will return a MappedIP struct for the given address.
-func (ds *Datastore) GetMappedIP(address string) (types.MappedIP, error) {
-	ds.poolsLock.RLock()
-	defer ds.poolsLock.RUnlock()
+// copyServerGroup returns a copy of a server group whose members may be
+// changed without affecting the datastore's copy.
+func copyServerGroup(g types.ServerGroup) types.ServerGroup {
+	g.Members = append([]string{}, g.Members...)
+	return g
+}
 
-	m, ok := ds.mappedIPs[address]
-	if !ok {
-		return types.MappedIP{}, types.ErrAddressNotFound
+// AddServerGroup stores a new server group for a tenant.
+func (ds *Datastore) AddServerGroup(g types.ServerGroup) error {
+	ds.serverGroupsLock.Lock()
+	defer ds.serverGroupsLock.Unlock()
+
+	if _, ok := ds.serverGroups[g.ID]; ok {
+		return api.ErrAlreadyExists
 	}
 
-	return m, nil
+	if err := ds.db.addServerGroup(g); err != nil {
+		return errors.Wrap(err, "Unable to add server group to database")
+	}
+
+	ds.serverGroups[g.ID] = copyServerGroup(g)
+
+	return nil
 }
 
-// MapExternalIP will allocate an external IP to an instance from a given pool.
-func (ds *Datastore) MapExternalIP(poolID string, instanceID string) (types.MappedIP, error) {
-	var m types.MappedIP
+// GetServerGroup retrieves a server group of a tenant by ID.
+func (ds *Datastore) GetServerGroup(tenantID string, ID string) (types.ServerGroup, error) {
+	ds.serverGroupsLock.RLock()
+	defer ds.serverGroupsLock.RUnlock()
 
-	instance, err := ds.GetInstance(instanceID)
-	if err != nil {
-		return m, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	g, ok := ds.serverGroups[ID]
+	if !ok || g.TenantID != tenantID {
+		return types.ServerGroup{}, types.ErrServerGroupNotFound
 	}
 
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+	return copyServerGroup(g), nil
+}
 
-	pool, ok := ds.pools[poolID]
-	if !ok {
-		return m, types.ErrPoolNotFound
-	}
+// GetServerGroups retrieves the server groups of a tenant, oldest first.
+func (ds *Datastore) GetServerGroups(tenantID string) []types.ServerGroup {
+	ds.serverGroupsLock.RLock()
+	defer ds.serverGroupsLock.RUnlock()
 
-	if pool.Free == 0 {
-		return m, types.ErrPoolEmpty
+	groups := []types.ServerGroup{}
+	for _, g := range ds.serverGroups {
+		if g.TenantID == tenantID {
+			groups = append(groups, copyServerGroup(g))
+		}
 	}
 
-	// find a free IP address in any subnet.
-	for _, sub := range pool.Subnets {
-		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
-		if err != nil {
-			return m, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].CreateTime.Equal(groups[j].CreateTime) {
+			return groups[i].ID < groups[j].ID
 		}
+		return groups[i].CreateTime.Before(groups[j].CreateTime)
+	})
 
-		initIP := IP.Mask(ipNet.Mask)
+	return groups
+}
 
-		// skip gateway
-		incrementIP(initIP)
+// DeleteServerGroup removes a server group of a tenant.  Its members are
+// not affected other than leaving the group.
+func (ds *Datastore) DeleteServerGroup(tenantID string, ID string) error {
+	ds.serverGroupsLock.Lock()
+	defer ds.serverGroupsLock.Unlock()
 
-		// check each address in this subnet
-		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
-			_, ok := ds.mappedIPs[IP.String()]
-			if !ok {
-				m.ID = uuid.Generate().String()
-				m.ExternalIP = IP.String()
-				m.InternalIP = instance.IPAddress
-				m.InstanceID = instanceID
-				m.TenantID = instance.TenantID
-				m.PoolID = pool.ID
-				m.PoolName = pool.Name
+	g, ok := ds.serverGroups[ID]
+	if !ok || g.TenantID != tenantID {
+		return types.ErrServerGroupNotFound
+	}
 
-				pool.Free--
+	if err := ds.db.deleteServerGroup(ID); err != nil {
+		return errors.Wrap(err, "Error deleting server group from database")
+	}
 
-				err = ds.db.addMappedIP(m)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-				}
-				ds.mappedIPs[IP.String()] = m
+	for _, instanceID := range g.Members {
+		delete(ds.instanceServerGroups, instanceID)
+	}
+	delete(ds.serverGroups, ID)
 
-				err = ds.db.updatePool(pool)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-				}
+	return nil
+}
 
-				ds.pools[poolID] = pool
+// AddServerGroupMember adds an instance of a tenant to one of the tenant's
+// server groups.  An instance may only be a member of a single group.
+func (ds *Datastore) AddServerGroupMember(tenantID string, ID string, instanceID string) error {
+	ds.serverGroupsLock.Lock()
+	defer ds.serverGroupsLock.Unlock()
 
-				return m, nil
-			}
-		}
+	g, ok := ds.serverGroups[ID]
+	if !ok || g.TenantID != tenantID {
+		return types.ErrServerGroupNotFound
 	}
 
-	// we are still looking. Check our individual IPs
-	for _, IP := range pool.IPs {
-		_, ok := ds.mappedIPs[IP.Address]
-		if !ok {
-			m.ID = uuid.Generate().String()
-			m.ExternalIP = IP.Address
-			m.InternalIP = instance.IPAddress
-			m.InstanceID = instanceID
-			m.TenantID = instance.TenantID
-			m.PoolID = pool.ID
-			m.PoolName = pool.Name
-
-			pool.Free--
-
-			err = ds.db.addMappedIP(m)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-			}
-			ds.mappedIPs[IP.Address] = m
-
-			err = ds.db.updatePool(pool)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-			}
-
-			ds.pools[poolID] = pool
+	if _, ok := ds.instanceServerGroups[instanceID]; ok {
+		return api.ErrAlreadyExists
+	}
 
-			return m, nil
-		}
+	if err := ds.db.addServerGroupMember(ID, instanceID); err != nil {
+		return errors.Wrap(err, "Error adding server group member to database")
 	}
 
-	// if you got here you are out of luck. But you never should.
-	glog.Warningf("Pool reports %d free addresses but none found", pool.Free)
-	return m, types.ErrPoolEmpty
+	g.Members = append(g.Members, instanceID)
+	ds.serverGroups[ID] = g
+	ds.instanceServerGroups[instanceID] = ID
+
+	return nil
 }
 
-// UnMapExternalIP will stop associating a given address with an instance.
-func (ds *Datastore) UnMapExternalIP(address string) error {
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
+// removeServerGroupMember removes a deleted instance from its server
+// group, if it is a member of one.
+func (ds *Datastore) removeServerGroupMember(instanceID string) error {
+	ds.serverGroupsLock.Lock()
+	defer ds.serverGroupsLock.Unlock()
 
-	m, ok := ds.mappedIPs[address]
+	ID, ok := ds.instanceServerGroups[instanceID]
 	if !ok {
-		return types.ErrAddressNotFound
+		return nil
 	}
 
-	// get pool and update Free
-	pool, ok := ds.pools[m.PoolID]
-	if !ok {
-		return types.ErrPoolNotFound
+	if err := ds.db.deleteServerGroupMember(instanceID); err != nil {
+		return errors.Wrap(err, "Error deleting server group member from database")
 	}
 
-	pool.Free++
-
-	err := ds.db.deleteMappedIP(m.ID)
-	if err != nil {
-		return errors.Wrap(err, "error deleting IP mapping from database")
-	}
-	delete(ds.mappedIPs, address)
+	delete(ds.instanceServerGroups, instanceID)
 
-	err = ds.db.updatePool(pool)
-	if err != nil {
-		return errors.Wrap(err, "error updating pool in database")
+	g := ds.serverGroups[ID]
+	members := make([]string, 0, len(g.Members))
+	for _, m := range g.Members {
+		if m != instanceID {
+			members = append(members, m)
+		}
 	}
-
-	ds.pools[pool.ID] = pool
+	g.Members = members
+	ds.serverGroups[ID] = g
 
 	return nil
 }
 
-// GenerateCNCIWorkload is used to create a workload definition for the CNCI.
-// This function should be called prior to any workload launch.
-func (ds *Datastore) GenerateCNCIWorkload(vcpus int, memMB int, diskMB int, key string) {
-	// generate the CNCI workload.
-	config := `---
-#cloud-config
-users:
-  - name: cloud-admin
-    gecos: CIAO Cloud Admin
-    lock-passwd: true
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    ssh-authorized-keys:
-    - ` + key + `
-...
-`
+// AddSnapshotSchedule stores a new snapshot schedule for a tenant.
+func (ds *Datastore) AddSnapshotSchedule(s types.SnapshotSchedule) error {
+	ds.snapshotSchedulesLock.Lock()
+	defer ds.snapshotSchedulesLock.Unlock()
 
-	storage := types.StorageResource{
-		ID:         "",
-		Bootable:   true,
-		Ephemeral:  true,
-		SourceType: types.ImageService,
-		Source:     "4e16e743-265a-4bf2-9fd1-57ada0b28904",
-		Internal:   true,
+	if _, ok := ds.snapshotSchedules[s.ID]; ok {
+		return api.ErrAlreadyExists
 	}
-
-	wl := types.Workload{
-		ID:          uuid.Generate().String(),
-		Description: "CNCI",
-		FWType:      string(payloads.EFI),
-		VMType:      payloads.QEMU,
-		Config:      config,
-		Requirements: payloads.WorkloadRequirements{
-			VCPUs:       vcpus,
-			MemMB:       memMB,
-			NetworkNode: true,
-		},
-		Storage:    []types.StorageResource{storage},
-		Visibility: types.Internal,
+
+	if err := ds.db.updateSnapshotSchedule(s); err != nil {
+		return errors.Wrap(err, "Unable to add snapshot schedule to database")
 	}
 
-	// for now we have a single global cnci workload.
-	ds.cnciWorkload = wl
+	ds.snapshotSchedules[s.ID] = s
+
+	return nil
 }
 
-// GetQuotas returns the set of quotas from the database without any caching.
-func (ds *Datastore) GetQuotas(tenantID string) ([]types.QuotaDetails, error) {
-	return ds.db.getQuotas(tenantID)
+// UpdateSnapshotSchedule replaces an existing snapshot schedule, e.g. to
+// record a run.
+func (ds *Datastore) UpdateSnapshotSchedule(s types.SnapshotSchedule) error {
+	ds.snapshotSchedulesLock.Lock()
+	defer ds.snapshotSchedulesLock.Unlock()
+
+	if _, ok := ds.snapshotSchedules[s.ID]; !ok {
+		return types.ErrSnapshotScheduleNotFound
+	}
+
+	if err := ds.db.updateSnapshotSchedule(s); err != nil {
+		return errors.Wrap(err, "Error updating snapshot schedule in database")
+	}
+
+	ds.snapshotSchedules[s.ID] = s
+
+	return nil
 }
 
-// UpdateQuotas updates the quotas for a tenant in the database.
-func (ds *Datastore) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
-	return ds.db.updateQuotas(tenantID, qds)
+// GetSnapshotSchedule retrieves a snapshot schedule of a tenant by ID.
+func (ds *Datastore) GetSnapshotSchedule(tenantID string, ID string) (types.SnapshotSchedule, error) {
+	ds.snapshotSchedulesLock.RLock()
+	defer ds.snapshotSchedulesLock.RUnlock()
+
+	s, ok := ds.snapshotSchedules[ID]
+	if !ok || s.TenantID != tenantID {
+		return types.SnapshotSchedule{}, types.ErrSnapshotScheduleNotFound
+	}
+
+	return s, nil
 }
 
-// ResolveInstance maps an instance name to an uuid, returning "" if not found
-// TODO: Replace this O(n) algorithm with another name to id map.
-func (ds *Datastore) ResolveInstance(tenantID string, name string) (string, error) {
-	ds.tenantsLock.RLock()
-	defer ds.tenantsLock.RUnlock()
+// GetSnapshotSchedules retrieves the snapshot schedules of a tenant, or of
+// all tenants if tenantID is empty, oldest first.
+func (ds *Datastore) GetSnapshotSchedules(tenantID string) []types.SnapshotSchedule {
+	ds.snapshotSchedulesLock.RLock()
+	defer ds.snapshotSchedulesLock.RUnlock()
 
-	t, ok := ds.tenants[tenantID]
-	if !ok {
-		return "", fmt.Errorf("Tenant not found: %s", tenantID)
+	schedules := []types.SnapshotSchedule{}
+	for _, s := range ds.snapshotSchedules {
+		if tenantID == "" || s.TenantID == tenantID {
+			schedules = append(schedules, s)
+		}
 	}
 
-	for _, i := range t.instances {
-		if i.Name == name || i.ID == name {
-			return i.ID, nil
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].CreateTime.Equal(schedules[j].CreateTime) {
+			return schedules[i].ID < schedules[j].ID
 		}
+		return schedules[i].CreateTime.Before(schedules[j].CreateTime)
+	})
+
+	return schedules
+}
+
+// DeleteSnapshotSchedule removes a snapshot schedule of a tenant.  The
+// snapshots it has taken are kept.
+func (ds *Datastore) DeleteSnapshotSchedule(tenantID string, ID string) error {
+	ds.snapshotSchedulesLock.Lock()
+	defer ds.snapshotSchedulesLock.Unlock()
+
+	s, ok := ds.snapshotSchedules[ID]
+	if !ok || s.TenantID != tenantID {
+		return types.ErrSnapshotScheduleNotFound
 	}
 
-	return "", nil
+	if err := ds.db.deleteSnapshotSchedule(ID); err != nil {
+		return errors.Wrap(err, "Error deleting snapshot schedule from database")
+	}
+
+	delete(ds.snapshotSchedules, ID)
+
+	return nil
 }
 
-// AddImage adds an image to the datastore and database
-func (ds *Datastore) AddImage(i types.Image) error {
-	ds.imageLock.Lock()
-	defer ds.imageLock.Unlock()
-	if _, ok := ds.images[i.ID]; ok {
-		return api.ErrAlreadyExists
+// UpdateImageSeed records the state of an image in the image cache of a
+// node.
+func (ds *Datastore) UpdateImageSeed(imageID string, seed types.ImageSeed) error {
+	ds.imageSeedsLock.Lock()
+	defer ds.imageSeedsLock.Unlock()
+
+	if err := ds.db.updateImageSeed(imageID, seed); err != nil {
+		return errors.Wrap(err, "Error updating image seed in database")
 	}
 
-	_, err := ds.ResolveImage(i.TenantID, i.Name)
-	if err == nil {
-		return api.ErrAlreadyExists
-	} else if err != api.ErrNoImage {
-		return err
+	if ds.imageSeeds[imageID] == nil {
+		ds.imageSeeds[imageID] = make(map[string]types.ImageSeed)
 	}
+	ds.imageSeeds[imageID][seed.NodeID] = seed
 
-	_, err = ds.ResolveImage(i.TenantID, i.ID)
-	if err == nil {
-		return api.ErrAlreadyExists
-	} else if err != api.ErrNoImage {
-		return err
+	return nil
+}
+
+// GetImageSeed retrieves the state of an image in the image cache of a
+// node.
+func (ds *Datastore) GetImageSeed(imageID string, nodeID string) (types.ImageSeed, bool) {
+	ds.imageSeedsLock.RLock()
+	defer ds.imageSeedsLock.RUnlock()
+
+	seed, ok := ds.imageSeeds[imageID][nodeID]
+	return seed, ok
+}
+
+// GetImageSeeds retrieves the state of an image in the image caches of the
+// nodes, ordered by node.
+func (ds *Datastore) GetImageSeeds(imageID string) []types.ImageSeed {
+	ds.imageSeedsLock.RLock()
+	defer ds.imageSeedsLock.RUnlock()
+
+	seeds := []types.ImageSeed{}
+	for _, seed := range ds.imageSeeds[imageID] {
+		seeds = append(seeds, seed)
 	}
 
-	err = ds.db.updateImage(i)
-	if err != nil {
-		return errors.Wrap(err, "Unable to add image to database")
+	sort.Slice(seeds, func(i, j int) bool {
+		return seeds[i].NodeID < seeds[j].NodeID
+	})
+
+	return seeds
+}
+
+// GetSeededNodes retrieves the nodes which have cached an image, in order.
+func (ds *Datastore) GetSeededNodes(imageID string) []string {
+	var nodes []string
+
+	for _, seed := range ds.GetImageSeeds(imageID) {
+		if seed.State == types.ImageSeeded {
+			nodes = append(nodes, seed.NodeID)
+		}
 	}
 
-	if i.TenantID != "" {
-		ds.tenantsLock.Lock()
-		if _, ok := ds.tenants[i.TenantID]; !ok {
-			ds.tenantsLock.Unlock()
-			_ = ds.db.deleteImage(i.ID)
-			return types.ErrTenantNotFound
+	return nodes
+}
+
+func sortVolumeSnapshots(snapshots []types.VolumeSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].CreateTime.Equal(snapshots[j].CreateTime) {
+			return snapshots[i].ID < snapshots[j].ID
 		}
+		return snapshots[i].CreateTime.Before(snapshots[j].CreateTime)
+	})
+}
 
-		ds.tenants[i.TenantID].images = append(ds.tenants[i.TenantID].images, i.ID)
-		ds.tenantsLock.Unlock()
+// AddVolumeSnapshot records a snapshot taken of a volume.
+func (ds *Datastore) AddVolumeSnapshot(s types.VolumeSnapshot) error {
+	ds.snapshotSchedulesLock.Lock()
+	defer ds.snapshotSchedulesLock.Unlock()
+
+	if err := ds.db.addVolumeSnapshot(s); err != nil {
+		return errors.Wrap(err, "Unable to add volume snapshot to database")
 	}
 
-	ds.images[i.ID] = i
+	snapshots := append(ds.volumeSnapshots[s.VolumeID], s)
+	sortVolumeSnapshots(snapshots)
+	ds.volumeSnapshots[s.VolumeID] = snapshots
 
-	if i.Visibility == types.Public {
-		ds.publicImages = append(ds.publicImages, i.ID)
+	return nil
+}
+
+// GetVolumeSnapshots retrieves the recorded snapshots of a volume, oldest
+// first.
+func (ds *Datastore) GetVolumeSnapshots(volumeID string) []types.VolumeSnapshot {
+	ds.snapshotSchedulesLock.RLock()
+	defer ds.snapshotSchedulesLock.RUnlock()
+
+	snapshots := make([]types.VolumeSnapshot, len(ds.volumeSnapshots[volumeID]))
+	copy(snapshots, ds.volumeSnapshots[volumeID])
+
+	return snapshots
+}
+
+// GetVolumeSnapshot retrieves a snapshot of any volume by its ID.
+func (ds *Datastore) GetVolumeSnapshot(ID string) (types.VolumeSnapshot, error) {
+	ds.snapshotSchedulesLock.RLock()
+	defer ds.snapshotSchedulesLock.RUnlock()
+
+	for _, snapshots := range ds.volumeSnapshots {
+		for _, s := range snapshots {
+			if s.ID == ID {
+				return s, nil
+			}
+		}
 	}
 
-	if i.Visibility == types.Internal {
-		ds.internalImages = append(ds.internalImages, i.ID)
+	return types.VolumeSnapshot{}, types.ErrVolumeSnapshotNotFound
+}
+
+// DeleteVolumeSnapshot forgets a snapshot of a volume.  Forgetting a
+// snapshot which is not recorded is not an error.
+func (ds *Datastore) DeleteVolumeSnapshot(volumeID string, ID string) error {
+	ds.snapshotSchedulesLock.Lock()
+	defer ds.snapshotSchedulesLock.Unlock()
+
+	if err := ds.db.deleteVolumeSnapshot(ID); err != nil {
+		return errors.Wrap(err, "Error deleting volume snapshot from database")
+	}
+
+	snapshots := ds.volumeSnapshots[volumeID]
+	for i := range snapshots {
+		if snapshots[i].ID == ID {
+			snapshots = append(snapshots[:i:i], snapshots[i+1:]...)
+			break
+		}
+	}
+
+	if len(snapshots) == 0 {
+		delete(ds.volumeSnapshots, volumeID)
+	} else {
+		ds.volumeSnapshots[volumeID] = snapshots
 	}
 
 	return nil
 }
 
-// UpdateImage updates the image metadate in the datastore and database
-func (ds *Datastore) UpdateImage(i types.Image) error {
-	ds.imageLock.Lock()
-	defer ds.imageLock.Unlock()
+// AddPolicyRule adds a rule to the workload policy.
+func (ds *Datastore) AddPolicyRule(r types.PolicyRule) error {
+	ds.policyRulesLock.Lock()
+	defer ds.policyRulesLock.Unlock()
 
-	oldImage, ok := ds.images[i.ID]
-	if !ok {
-		return api.ErrNoImage
+	if _, ok := ds.policyRules[r.ID]; ok {
+		return api.ErrAlreadyExists
 	}
 
-	if oldImage.TenantID != i.TenantID ||
-		oldImage.Visibility != i.Visibility {
-		return errors.New("Changing visibility or tenant for image not permitted")
+	if err := ds.db.updatePolicyRule(r); err != nil {
+		return errors.Wrap(err, "Unable to add policy rule to database")
 	}
 
-	if oldImage.Name != i.Name {
-		_, err := ds.ResolveImage(i.TenantID, i.Name)
-		if err == nil {
-			return api.ErrAlreadyExists
-		} else if err != api.ErrNoImage {
-			return err
-		}
+	ds.policyRules[r.ID] = r
+
+	return nil
+}
+
+// UpdatePolicyRule replaces an existing rule of the workload policy.
+func (ds *Datastore) UpdatePolicyRule(r types.PolicyRule) error {
+	ds.policyRulesLock.Lock()
+	defer ds.policyRulesLock.Unlock()
+
+	if _, ok := ds.policyRules[r.ID]; !ok {
+		return types.ErrPolicyRuleNotFound
 	}
 
-	if err := ds.db.updateImage(i); err != nil {
-		return errors.Wrap(err, "Error updating image in database")
+	if err := ds.db.updatePolicyRule(r); err != nil {
+		return errors.Wrap(err, "Error updating policy rule in database")
 	}
 
-	ds.images[i.ID] = i
+	ds.policyRules[r.ID] = r
 
 	return nil
 }
 
-// GetImage retrieves an image by ID
-func (ds *Datastore) GetImage(ID string) (types.Image, error) {
-	ds.imageLock.RLock()
-	defer ds.imageLock.RUnlock()
+// GetPolicyRule retrieves a rule of the workload policy by ID.
+func (ds *Datastore) GetPolicyRule(ID string) (types.PolicyRule, error) {
+	ds.policyRulesLock.RLock()
+	defer ds.policyRulesLock.RUnlock()
 
-	image, ok := ds.images[ID]
+	r, ok := ds.policyRules[ID]
 	if !ok {
-		return types.Image{}, api.ErrNoImage
+		return types.PolicyRule{}, types.ErrPolicyRuleNotFound
 	}
 
-	return image, nil
+	return r, nil
 }
 
-// ResolveImage retrieves an image by name or ID
-func (ds *Datastore) ResolveImage(tenantID string, name string) (string, error) {
-	ds.tenantsLock.RLock()
-	defer ds.tenantsLock.RUnlock()
-
-	if tenantID != "" && tenantID != "admin" {
-		t, ok := ds.tenants[tenantID]
-		if !ok {
-			return "", fmt.Errorf("Tenant not found: %s", tenantID)
-		}
+// GetPolicyRules retrieves the rules of the workload policy, oldest first.
+func (ds *Datastore) GetPolicyRules() []types.PolicyRule {
+	ds.policyRulesLock.RLock()
+	defer ds.policyRulesLock.RUnlock()
 
-		for _, id := range t.images {
-			i := ds.images[id]
-			if i.Name == name || i.ID == name {
-				return i.ID, nil
-			}
-		}
+	rules := make([]types.PolicyRule, 0, len(ds.policyRules))
+	for _, r := range ds.policyRules {
+		rules = append(rules, r)
 	}
 
-	for _, id := range ds.publicImages {
-		i := ds.images[id]
-		if i.Name == name || i.ID == name {
-			return i.ID, nil
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].CreateTime.Equal(rules[j].CreateTime) {
+			return rules[i].ID < rules[j].ID
 		}
+		return rules[i].CreateTime.Before(rules[j].CreateTime)
+	})
+
+	return rules
+}
+
+// DeletePolicyRule removes a rule from the workload policy.
+func (ds *Datastore) DeletePolicyRule(ID string) error {
+	ds.policyRulesLock.Lock()
+	defer ds.policyRulesLock.Unlock()
+
+	if _, ok := ds.policyRules[ID]; !ok {
+		return types.ErrPolicyRuleNotFound
 	}
 
-	for _, id := range ds.internalImages {
-		i := ds.images[id]
-		if i.Name == name || i.ID == name {
-			return i.ID, nil
-		}
+	if err := ds.db.deletePolicyRule(ID); err != nil {
+		return errors.Wrap(err, "Error deleting policy rule from database")
 	}
 
-	return "", api.ErrNoImage
+	delete(ds.policyRules, ID)
+
+	return nil
 }
 
-// GetImages obtains the images available for the optional tenantID/admin combo
-func (ds *Datastore) GetImages(tenantID string, admin bool) ([]types.Image, error) {
-	ds.imageLock.RLock()
-	defer ds.imageLock.RUnlock()
+// UpdateSetting stores the value of a cluster setting changed by the admin.
+func (ds *Datastore) UpdateSetting(s types.SettingValue) error {
+	ds.settingsLock.Lock()
+	defer ds.settingsLock.Unlock()
 
-	images := []types.Image{}
+	if err := ds.db.updateSetting(s); err != nil {
+		return errors.Wrap(err, "Error updating setting in database")
+	}
 
-	if tenantID != "" {
-		ds.tenantsLock.RLock()
-		if _, ok := ds.tenants[tenantID]; !ok {
-			ds.tenantsLock.RUnlock()
-			return images, types.ErrTenantNotFound
-		}
+	ds.settings[s.Key] = s
 
-		for _, id := range ds.tenants[tenantID].images {
-			images = append(images, ds.images[id])
-		}
+	return nil
+}
 
-		ds.tenantsLock.RUnlock()
-	}
+// GetSetting retrieves the value of a cluster setting changed by the admin.
+// false is returned if the setting has its default value.
+func (ds *Datastore) GetSetting(key string) (types.SettingValue, bool) {
+	ds.settingsLock.RLock()
+	defer ds.settingsLock.RUnlock()
 
-	if admin {
-		for _, id := range ds.internalImages {
-			images = append(images, ds.images[id])
-		}
+	s, ok := ds.settings[key]
+	return s, ok
+}
+
+// DeleteSetting forgets the value of a cluster setting changed by the
+// admin, restoring its default.
+func (ds *Datastore) DeleteSetting(key string) error {
+	ds.settingsLock.Lock()
+	defer ds.settingsLock.Unlock()
+
+	if _, ok := ds.settings[key]; !ok {
+		return nil
 	}
 
-	for _, id := range ds.publicImages {
-		images = append(images, ds.images[id])
+	if err := ds.db.deleteSetting(key); err != nil {
+		return errors.Wrap(err, "Error deleting setting from database")
 	}
 
-	return images, nil
-}
+	delete(ds.settings, key)
 
-// DeleteImage deleted the image from the datastore and the database
-func (ds *Datastore) DeleteImage(ID string) error {
-	ds.imageLock.Lock()
-	defer ds.imageLock.Unlock()
+	return nil
+}
 
-	image, ok := ds.images[ID]
-	if !ok {
-		return api.ErrNoImage
+// QueueLaunch records that the launch of an instance already added to the
+// datastore has been queued.
+func (ds *Datastore) QueueLaunch(l types.QueuedLaunch) error {
+	if err := ds.db.addQueuedLaunch(l); err != nil {
+		return errors.Wrap(err, "Error adding queued launch to database")
 	}
 
-	if image.TenantID != "" {
-		ds.tenantsLock.Lock()
+	err := ds.updateInstanceStatus(payloads.Queued, l.InstanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error marking instance as queued")
+	}
 
-		tenant, ok := ds.tenants[image.TenantID]
-		if !ok {
-			ds.tenantsLock.Unlock()
-			return types.ErrTenantNotFound
-		}
+	ds.instancesLock.Lock()
+	if i, ok := ds.instances[l.InstanceID]; ok {
+		i.StateLock.Lock()
+		i.State = payloads.Queued
+		i.StateLock.Unlock()
+	}
+	ds.instancesLock.Unlock()
 
-		for i, id := range tenant.images {
-			if id == ID {
-				tenant.images = append(tenant.images[:i], tenant.images[i+1:]...)
-				break
-			}
-		}
+	return nil
+}
 
-		ds.tenantsLock.Unlock()
+// DequeueLaunch removes the launch of an instance from the launch queue
+// and makes the instance pending, ready for it to be started.
+func (ds *Datastore) DequeueLaunch(instanceID string) error {
+	if err := ds.db.deleteQueuedLaunch(instanceID); err != nil {
+		return errors.Wrap(err, "Error deleting queued launch from database")
 	}
 
-	if image.Visibility == types.Internal {
-		for i, id := range ds.internalImages {
-			if id == ID {
-				ds.internalImages = append(ds.internalImages[:i], ds.internalImages[i+1:]...)
-				break
-			}
-		}
+	err := ds.updateInstanceStatus(payloads.Pending, instanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error marking queued instance as pending")
 	}
 
-	if image.Visibility == types.Public {
-		for i, id := range ds.publicImages {
-			if id == ID {
-				ds.publicImages = append(ds.publicImages[:i], ds.publicImages[i+1:]...)
-				break
-			}
-		}
+	ds.instancesLock.Lock()
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		ds.instancesLock.Unlock()
+		return types.ErrInstanceNotFound
 	}
+	i.StateLock.Lock()
+	h := stateHistoryEntry(i, payloads.Pending, i.NodeID)
+	i.State = payloads.Pending
+	i.StateLock.Unlock()
+	ds.instancesLock.Unlock()
 
-	delete(ds.images, ID)
+	ds.recordHistory(h.instanceID, h.tenantID, h.entry)
 
 	return nil
 }
+
+// GetQueuedLaunches retrieves the queued launches of all tenants in the
+// order in which they were queued.
+func (ds *Datastore) GetQueuedLaunches() ([]types.QueuedLaunch, error) {
+	return ds.db.getQueuedLaunches()
+}
@@ -14,22 +14,25 @@
 // limitations under the License.
 */
 
-package datastore
+package datastore_test
 
 import (
+	"context"
 	"database/sql"
-	"encoding/binary"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"net"
-	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore/datastoretest"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/ciao-controller/utils"
 	"github.com/ciao-project/ciao/ciao-storage"
@@ -38,7 +41,7 @@ import (
 	jsonpatch "github.com/evanphx/json-patch"
 )
 
-func addInstance(tenant *types.Tenant, workload types.Workload, name string) (instance *types.Instance, err error) {
+func addInstance(ds *datastore.Datastore, tenant *types.Tenant, workload types.Workload, name string) (instance *types.Instance, err error) {
 	id := uuid.Generate()
 
 	ip, err := ds.AllocateTenantIP(tenant.ID)
@@ -55,18 +58,19 @@ func addInstance(tenant *types.Tenant, workload types.Workload, name string) (in
 	}
 
 	instance = &types.Instance{
-		TenantID:   tenant.ID,
-		WorkloadID: workload.ID,
-		State:      payloads.Pending,
-		ID:         id.String(),
-		CNCI:       false,
-		IPAddress:  ip.String(),
-		Subnet:     ipnet.String(),
-		MACAddress: mac.String(),
-		Name:       name,
+		TenantID:    tenant.ID,
+		WorkloadID:  workload.ID,
+		State:       payloads.Pending,
+		ID:          id.String(),
+		CNCI:        false,
+		IPAddress:   ip.String(),
+		Subnet:      ipnet.String(),
+		MACAddress:  mac.String(),
+		Name:        name,
+		StateChange: sync.NewCond(&sync.Mutex{}),
 	}
 
-	err = ds.AddInstance(instance)
+	err = ds.AddInstance(context.Background(), instance)
 	if err != nil {
 		return
 	}
@@ -74,14 +78,14 @@ func addInstance(tenant *types.Tenant, workload types.Workload, name string) (in
 	return
 }
 
-func addTestInstance(tenant *types.Tenant, workload types.Workload) (*types.Instance, error) {
-	return addInstance(tenant, workload, "test")
+func addTestInstance(ds *datastore.Datastore, tenant *types.Tenant, workload types.Workload) (*types.Instance, error) {
+	return addInstance(ds, tenant, workload, "test")
 }
 
-func addTestInstances(tenant *types.Tenant, workload types.Workload, count int) ([]*types.Instance, error) {
+func addTestInstances(ds *datastore.Datastore, tenant *types.Tenant, workload types.Workload, count int) ([]*types.Instance, error) {
 	var instances []*types.Instance
 	for i := 0; i < count; i++ {
-		instance, err := addInstance(tenant, workload, fmt.Sprintf("test-%d", i))
+		instance, err := addInstance(ds, tenant, workload, fmt.Sprintf("test-%d", i))
 		if err != nil {
 			return make([]*types.Instance, 0), err
 		}
@@ -90,62 +94,13 @@ func addTestInstances(tenant *types.Tenant, workload types.Workload, count int)
 	return instances, nil
 }
 
-func addTestWorkload(tenantID string) error {
-	testConfig := `
----
-#cloud-config
-users:
-  - name: demouser
-    gecos: CIAO Demo User
-    lock-passwd: false
-    passwd: $6$rounds=4096$w9I3hR4g/hu$AnYjaC2DfznbPSG3vxsgtgAS4mJwWBkcR74Y/KHNB5OsfAlA4gpU5j6CHWMOkkt9j.9d7OYJXJ4icXHzKXTAO.
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    ssh-authorized-keys:
-    - ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDerQfD+qkb0V0XdQs8SBWqy4sQmqYFP96n/kI4Cq162w4UE8pTxy0ozAPldOvBJjljMvgaNKSAddknkhGcrNUvvJsUcZFm2qkafi32WyBdGFvIc45A+8O7vsxPXgHEsS9E3ylEALXAC3D0eX7pPtRiAbasLlY+VcACRqr3bPDSZTfpCmIkV2334uZD9iwOvTVeR+FjGDqsfju4DyzoAIqpPasE0+wk4Vbog7osP+qvn1gj5kQyusmr62+t0wx+bs2dF5QemksnFOswUrv9PGLhZgSMmDQrRYuvEfIAC7IdN/hfjTn0OokzljBiuWQ4WIIba/7xTYLVujJV65qH3heaSMxJJD7eH9QZs9RdbbdTXMFuJFsHV2OF6wZRp18tTNZZJMqiHZZSndC5WP1WrUo3Au/9a+ighSaOiVddHsPG07C/TOEnr3IrwU7c9yIHeeRFHmcQs9K0+n9XtrmrQxDQ9/mLkfje80Ko25VJ/QpAQPzCKh2KfQ4RD+/PxBUScx/lHIHOIhTSCh57ic629zWgk0coSQDi4MKSa5guDr3cuDvt4RihGviDM6V68ewsl0gh6Z9c0Hw7hU0vky4oxak5AiySiPz0FtsOnAzIL0UON+yMuKzrJgLjTKodwLQ0wlBXu43cD+P8VXwQYeqNSzfrhBnHqsrMf4lTLtc7kDDTcw== ciao@ciao
-...
-	`
-
-	storage := types.StorageResource{
-		ID:        "",
-		Ephemeral: true,
-		Size:      20,
-	}
-
-	wl := types.Workload{
-		ID:          uuid.Generate().String(),
-		TenantID:    tenantID,
-		Description: fmt.Sprintf("Private workload for %s", tenantID),
-		FWType:      string(payloads.EFI),
-		VMType:      payloads.QEMU,
-		ImageName:   "",
-		Config:      testConfig,
-		Requirements: payloads.WorkloadRequirements{
-			VCPUs: 2,
-			MemMB: 512,
-		},
-		Storage: []types.StorageResource{storage},
-	}
-
-	return ds.AddWorkload(wl)
-}
-
-func addTestTenant() (tenant *types.Tenant, err error) {
-	/* add a new tenant */
-	tuuid := uuid.Generate()
-
-	config := types.TenantConfig{
-		Name:       "",
-		SubnetBits: 24,
-	}
-
-	tenant, err = ds.AddTenant(tuuid.String(), config)
-	if err != nil {
-		return
-	}
+// addTestTenant adds a tenant with a workload and a running CNCI to ds.
+func addTestTenant(t testing.TB, ds *datastore.Datastore) *types.Tenant {
+	tenant := datastoretest.AddTenant(t, ds)
 
 	mac, err := utils.NewHardwareAddr()
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
 
 	// Add fake CNCI
@@ -158,21 +113,18 @@ func addTestTenant() (tenant *types.Tenant, err error) {
 		MACAddress: mac.String(),
 	}
 
-	err = ds.AddInstance(&CNCI)
+	err = ds.AddInstance(context.Background(), &CNCI)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
 
-	err = addTestWorkload(tuuid.String())
+	datastoretest.AddWorkload(t, ds, tenant.ID)
 
-	return
+	return tenant
 }
 
-func addTestInstanceStats(t *testing.T) ([]*types.Instance, payloads.Stat) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+func addTestInstanceStats(t *testing.T, ds *datastore.Datastore) ([]*types.Instance, payloads.Stat) {
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
@@ -183,7 +135,7 @@ func addTestInstanceStats(t *testing.T) ([]*types.Instance, payloads.Stat) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instances, err := addTestInstances(tenant, wls[0], 10)
+	instances, err := addTestInstances(ds, tenant, wls[0], 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -214,12 +166,7 @@ func addTestInstanceStats(t *testing.T) ([]*types.Instance, payloads.Stat) {
 		Instances:       stats,
 	}
 
-	err = ds.addNodeStat(stat)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = ds.addInstanceStats(stats, stat.NodeUUID)
+	err = ds.HandleStats(stat)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -228,6 +175,8 @@ func addTestInstanceStats(t *testing.T) ([]*types.Instance, payloads.Stat) {
 }
 
 func BenchmarkGetTenantNoCache(b *testing.B) {
+	ds := datastoretest.New(b)
+
 	/* add a new tenant */
 	tuuid := uuid.Generate().String()
 	config := types.TenantConfig{
@@ -242,7 +191,7 @@ func BenchmarkGetTenantNoCache(b *testing.B) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		_, err = ds.db.getTenant(tuuid)
+		err = datastore.GetTenantNoCache(ds, tuuid)
 		if err != nil {
 			b.Error(err)
 		}
@@ -250,6 +199,8 @@ func BenchmarkGetTenantNoCache(b *testing.B) {
 }
 
 func BenchmarkAllocateTenantIP(b *testing.B) {
+	ds := datastoretest.New(b)
+
 	/* add a new tenant */
 	tuuid := uuid.Generate().String()
 	config := types.TenantConfig{
@@ -272,6 +223,8 @@ func BenchmarkAllocateTenantIP(b *testing.B) {
 }
 
 func BenchmarkAllocate1000TenantIP(b *testing.B) {
+	ds := datastoretest.New(b)
+
 	/* add a new tenant */
 	tuuid := uuid.Generate().String()
 	config := types.TenantConfig{
@@ -302,6 +255,8 @@ func BenchmarkAllocate1000TenantIP(b *testing.B) {
 }
 
 func BenchmarkGetAllInstances(b *testing.B) {
+	ds := datastoretest.New(b)
+
 	for n := 0; n < b.N; n++ {
 		_, err := ds.GetAllInstances()
 		if err != nil {
@@ -311,6 +266,10 @@ func BenchmarkGetAllInstances(b *testing.B) {
 }
 
 func TestTenantCreate(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	/* add a new tenant */
 	tuuid := uuid.Generate()
 	config := types.TenantConfig{
@@ -331,12 +290,35 @@ func TestTenantCreate(t *testing.T) {
 	}
 }
 
-func TestAddInstance(t *testing.T) {
-	tenant, err := addTestTenant()
+func TestTenantCreateDuplicate(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tuuid := uuid.Generate().String()
+	config := types.TenantConfig{
+		Name:       "duplicate",
+		SubnetBits: 24,
+	}
+
+	_, err := ds.AddTenant(tuuid, config)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	_, err = ds.AddTenant(tuuid, config)
+	if err != datastore.ErrDuplicateTenant {
+		t.Fatalf("Expected %v got %v", datastore.ErrDuplicateTenant, err)
+	}
+}
+
+func TestAddInstance(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
@@ -346,17 +328,18 @@ func TestAddInstance(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	_, err = addTestInstance(tenant, wls[0])
+	_, err = addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestDeleteInstanceNetwork(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
@@ -367,7 +350,7 @@ func TestDeleteInstanceNetwork(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -377,51 +360,41 @@ func TestDeleteInstanceNetwork(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tenantAfter, err := ds.getTenant(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
-	}
+	IP := net.ParseIP(instance.IPAddress)
 
-	IP, ipNet, err := net.ParseCIDR(instance.Subnet)
+	// confirm that tenant map shows it not used.
+	claimed, err := datastore.TenantIPClaimed(ds, tenant.ID, IP)
 	if err != nil {
 		t.Fatal(err)
 	}
-	mask := binary.BigEndian.Uint32(ipNet.Mask)
-	hostInt := binary.BigEndian.Uint32(IP.To4())
-	subnetInt := hostInt & mask
-
-	// confirm that tenant map shows it not used.
-	if tenantAfter.network[subnetInt][hostInt] != false {
+	if claimed {
 		t.Fatal("IP Address not released from cache")
 	}
 
 	// clear tenant from cache
-	ds.tenantsLock.Lock()
-	delete(ds.tenants, tenant.ID)
-	ds.tenantsLock.Unlock()
+	datastore.EvictTenant(ds, tenant.ID)
 
 	// get updated tenant info - should hit database
-	newTenant, err := ds.getTenant(tenant.ID)
+	claimed, err = datastore.TenantIPClaimed(ds, tenant.ID, IP)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// confirm that tenant map shows it not used.
-	if newTenant.network[subnetInt][hostInt] != false {
+	if claimed {
 		t.Fatal("IP Address not released from database")
 	}
 }
 
 func TestGetAllInstances(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	instancesBefore, err := ds.GetAllInstances()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
@@ -432,7 +405,7 @@ func TestGetAllInstances(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	_, err = addTestInstances(tenant, wls[0], 10)
+	_, err = addTestInstances(ds, tenant, wls[0], 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -448,13 +421,14 @@ func TestGetAllInstances(t *testing.T) {
 }
 
 func TestGetAllInstancesFromTenant(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	var err error
 
 	/* add a new tenant */
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
@@ -465,7 +439,7 @@ func TestGetAllInstancesFromTenant(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	_, err = addTestInstances(tenant, wls[0], 10)
+	_, err = addTestInstances(ds, tenant, wls[0], 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -485,8 +459,82 @@ func TestGetAllInstancesFromTenant(t *testing.T) {
 	}
 }
 
+func TestListInstances(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	_, err = addTestInstances(ds, tenant, wls[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []*types.Instance
+	filter := types.ListFilter{Limit: 3}
+	for {
+		page, next, err := ds.ListInstances(tenant.ID, types.InstanceFilter{}, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page) > filter.Limit {
+			t.Fatalf("Expected at most %d instances, got %d", filter.Limit, len(page))
+		}
+
+		listed = append(listed, page...)
+		if next == "" {
+			break
+		}
+		filter.Marker = next
+	}
+
+	if len(listed) != len(all) {
+		t.Fatalf("Expected %d instances, got %d", len(all), len(listed))
+	}
+
+	for i := range all {
+		if listed[i].ID != all[i].ID {
+			t.Fatalf("Instance %d listed out of order: expected %s, got %s", i, all[i].ID, listed[i].ID)
+		}
+	}
+
+	page, next, err := ds.ListInstances(tenant.ID, types.InstanceFilter{WorkloadID: uuid.Generate().String()}, types.ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 0 || next != "" {
+		t.Fatalf("Expected no instances of unknown workload, got %d", len(page))
+	}
+
+	_, _, err = ds.ListInstances(tenant.ID, types.InstanceFilter{}, types.ListFilter{Marker: "!"})
+	if err == nil {
+		t.Fatal("Expected invalid marker to be rejected")
+	}
+}
+
 func TestGetAllInstancesByNode(t *testing.T) {
-	instances, stat := addTestInstanceStats(t)
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
 	newInstances, err := ds.GetAllInstancesByNode(stat.NodeUUID)
 	if err != nil {
 		t.Fatal(err)
@@ -507,215 +555,204 @@ func TestGetAllInstancesByNode(t *testing.T) {
 	}
 }
 
-func TestGetInstance(t *testing.T) {
-	instances, stat := addTestInstanceStats(t)
-	instance, err := ds.GetInstance(instances[0].ID)
-	if err != nil && err != sql.ErrNoRows {
-		t.Fatal(err)
-	}
+func TestInstanceFailed(t *testing.T) {
+	t.Parallel()
 
-	for instance == nil {
-		instance, err = ds.GetInstance(instances[0].ID)
-		if err != nil && err != sql.ErrNoRows {
-			t.Fatal(err)
-		}
-	}
+	ds := datastoretest.New(t)
 
-	if instance.NodeID != stat.NodeUUID {
-		t.Fatal("retrieved incorrect NodeID")
-	}
+	instances, stat := addTestInstanceStats(t, ds)
 
-	if instance.State != payloads.ComputeStatusRunning {
-		t.Fatal("retrieved incorrect state")
+	err := ds.InstanceFailed(instances[0].ID, "not found on node")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestGetTenantInstance(t *testing.T) {
-	instances, stat := addTestInstanceStats(t)
-	instance, err := ds.GetTenantInstance(instances[0].TenantID, instances[0].ID)
-	if err != nil && err != sql.ErrNoRows {
+	i, err := ds.GetInstance(instances[0].ID)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	for instance == nil {
-		instance, err = ds.GetTenantInstance(instances[0].TenantID, instances[0].ID)
-		if err != nil && err != sql.ErrNoRows {
-			t.Fatal(err)
-		}
+	if i.State != payloads.ExitFailed || i.NodeID != "" {
+		t.Errorf("Expected unassigned failed instance, got %s on %s", i.State, i.NodeID)
 	}
 
-	if instance.NodeID != stat.NodeUUID {
-		t.Fatal("retrieved incorrect NodeID")
+	nodeInstances, err := ds.GetAllInstancesByNode(stat.NodeUUID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if instance.State != payloads.ComputeStatusRunning {
-		t.Fatal("retrieved incorrect state")
+	if len(nodeInstances) != len(instances)-1 {
+		t.Errorf("Expected %d instances on node, got %d", len(instances)-1, len(nodeInstances))
 	}
 }
 
-func TestHandleStats(t *testing.T) {
-	tenant, err := addTestTenant()
+func TestAdoptInstance(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
+
+	newNode := uuid.Generate().String()
+	err := ds.AdoptInstance(instances[0].ID, newNode, payloads.Running)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
+	i, err := ds.GetInstance(instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(wls) == 0 {
-		t.Fatal("No Workloads Found")
+	if i.State != payloads.Running || i.NodeID != newNode {
+		t.Errorf("Expected running instance on %s, got %s on %s", newNode, i.State, i.NodeID)
 	}
 
-	instances, err := addTestInstances(tenant, wls[0], 10)
+	nodeInstances, err := ds.GetAllInstancesByNode(newNode)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var stats []payloads.InstanceStat
-
-	for i := range instances {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  instances[i].ID,
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
-		}
-		stats = append(stats, stat)
-	}
-	stat := payloads.Stat{
-		NodeUUID:        uuid.Generate().String(),
-		MemTotalMB:      256,
-		MemAvailableMB:  256,
-		DiskTotalMB:     1024,
-		DiskAvailableMB: 1024,
-		Load:            20,
-		CpusOnline:      4,
-		NodeHostName:    "test",
-		Instances:       stats,
+	if len(nodeInstances) != 1 || nodeInstances[0].ID != instances[0].ID {
+		t.Errorf("Adopted instance not found on %s", newNode)
 	}
 
-	err = ds.HandleStats(stat)
+	nodeInstances, err = ds.GetAllInstancesByNode(stat.NodeUUID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// check instance stats recorded
-	for i := range stats {
-		id := stats[i].InstanceUUID
-		instance, err := ds.GetInstance(id)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if len(nodeInstances) != len(instances)-1 {
+		t.Errorf("Expected %d instances on old node, got %d", len(instances)-1, len(nodeInstances))
+	}
 
-		if instance.NodeID != stat.NodeUUID {
-			t.Fatal("Incorrect NodeID in stats table")
+	found := false
+	for _, n := range ds.GetNodes() {
+		if n.ID == newNode {
+			found = true
 		}
+	}
 
-		if instance.State != payloads.ComputeStatusRunning {
-			t.Fatal("state not updated")
-		}
+	if !found {
+		t.Errorf("Node %s not found", newNode)
 	}
 }
 
-func TestGetInstanceLastStats(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
+func testStartMigration(t *testing.T, ds *datastore.Datastore) (*types.Instance, types.Migration) {
+	instances, stat := addTestInstanceStats(t, ds)
+
+	m := types.Migration{
+		InstanceID:   instances[0].ID,
+		TenantID:     instances[0].TenantID,
+		SourceNodeID: stat.NodeUUID,
+		TargetNodeID: uuid.Generate().String(),
+		State:        types.MigrationPreparing,
+		StartTime:    time.Now(),
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
+	err := ds.StartMigration(m)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(wls) == 0 {
-		t.Fatal("No Workloads Found")
+	if err = ds.StartMigration(m); err != types.ErrInstanceMigrating {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceMigrating, err)
 	}
 
-	instances, err := addTestInstances(tenant, wls[0], 10)
+	// Stats from either node must not move the instance.
+	testPlacementStat(t, ds, m.InstanceID, m.TargetNodeID)
+
+	i, err := ds.GetInstance(m.InstanceID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var stats []payloads.InstanceStat
+	if i.State != payloads.Migrating || i.NodeID != m.SourceNodeID {
+		t.Fatalf("Expected migrating instance on %s, got %s on %s", m.SourceNodeID, i.State, i.NodeID)
+	}
 
-	for i := range instances {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  instances[i].ID,
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
-		}
-		stats = append(stats, stat)
+	return i, m
+}
+
+func TestCompleteMigration(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	i, m := testStartMigration(t, ds)
+
+	m.State = types.MigrationTransferring
+	err := ds.UpdateMigration(m)
+	if err != nil {
+		t.Fatal(err)
 	}
-	stat := payloads.Stat{
-		NodeUUID:        uuid.Generate().String(),
-		MemTotalMB:      256,
-		MemAvailableMB:  256,
-		DiskTotalMB:     1024,
-		DiskAvailableMB: 1024,
-		Load:            20,
-		CpusOnline:      4,
-		NodeHostName:    "test",
-		Instances:       stats,
+
+	stored, ok := ds.GetMigration(m.InstanceID)
+	if !ok || stored.State != types.MigrationTransferring {
+		t.Fatalf("Migration not updated: %+v", stored)
 	}
 
-	err = ds.HandleStats(stat)
+	err = ds.CompleteMigration(m.InstanceID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	serverStats := ds.GetInstanceLastStats(stat.NodeUUID)
+	if _, ok := ds.GetMigration(m.InstanceID); ok {
+		t.Fatal("Migration not removed")
+	}
 
-	if len(serverStats.Servers) != len(instances) {
-		t.Fatal("Not enough instance stats retrieved")
+	if i.State != payloads.Running || i.NodeID != m.TargetNodeID {
+		t.Errorf("Expected running instance on %s, got %s on %s", m.TargetNodeID, i.State, i.NodeID)
 	}
-}
 
-func TestGetNodeLastStats(t *testing.T) {
-	tenant, err := addTestTenant()
+	nodeInstances, err := ds.GetAllInstancesByNode(m.TargetNodeID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
-	if err != nil {
+	if len(nodeInstances) != 1 || nodeInstances[0].ID != m.InstanceID {
+		t.Errorf("Migrated instance not found on %s", m.TargetNodeID)
+	}
+
+	placements, err := ds.GetInstancePlacements(m.InstanceID)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(wls) == 0 {
-		t.Fatal("No Workloads Found")
+	last := placements.Placements[len(placements.Placements)-1]
+	if last.NodeID != m.TargetNodeID || last.Reason != types.PlacementLiveMigration {
+		t.Errorf("Unexpected placement %+v", last)
+	}
+
+	if err = ds.CompleteMigration(m.InstanceID); err != datastore.ErrNoMigration {
+		t.Errorf("Expected %v, got %v", datastore.ErrNoMigration, err)
 	}
+}
 
-	instances, err := addTestInstances(tenant, wls[0], 10)
+func TestAbortMigration(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	i, m := testStartMigration(t, ds)
+
+	err := ds.AbortMigration(m.InstanceID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var stats []payloads.InstanceStat
+	if _, ok := ds.GetMigration(m.InstanceID); ok {
+		t.Fatal("Migration not removed")
+	}
 
-	for i := range instances {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  instances[i].ID,
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
-		}
-		stats = append(stats, stat)
+	if i.State != payloads.Running || i.NodeID != m.SourceNodeID {
+		t.Errorf("Expected running instance on %s, got %s on %s", m.SourceNodeID, i.State, i.NodeID)
 	}
+}
+
+func testPlacementStat(t *testing.T, ds *datastore.Datastore, instanceID string, nodeID string) {
 	stat := payloads.Stat{
-		NodeUUID:        uuid.Generate().String(),
+		NodeUUID:        nodeID,
 		MemTotalMB:      256,
 		MemAvailableMB:  256,
 		DiskTotalMB:     1024,
@@ -723,610 +760,1821 @@ func TestGetNodeLastStats(t *testing.T) {
 		Load:            20,
 		CpusOnline:      4,
 		NodeHostName:    "test",
-		Instances:       stats,
+		Instances: []payloads.InstanceStat{
+			{
+				InstanceUUID: instanceID,
+				State:        payloads.ComputeStatusRunning,
+			},
+		},
 	}
 
-	err = ds.HandleStats(stat)
+	err := ds.HandleStats(stat)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	computeNodes := ds.GetNodeLastStats()
-
-	// how many compute Nodes should be here?  If we want to
-	// control we need to clear out previous test stats
-	if len(computeNodes.Nodes) == 0 {
-		t.Fatal("Not enough compute Nodes found")
-	}
 }
 
-func createTestFrameTraces(label string) []payloads.FrameTrace {
-	var nodes []payloads.SSNTPNode
-	for i := 0; i < 3; i++ {
-		node := payloads.SSNTPNode{
-			SSNTPUUID:   uuid.Generate().String(),
-			SSNTPRole:   "test",
-			TxTimestamp: time.Now().Format(time.RFC3339Nano),
-			RxTimestamp: time.Now().Format(time.RFC3339Nano),
-		}
-		nodes = append(nodes, node)
+func nodeInstanceCount(t *testing.T, ds *datastore.Datastore, nodeID string) int {
+	summary, err := ds.GetNodeSummary()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	var frames []payloads.FrameTrace
-	for i := 0; i < 3; i++ {
-		stat := payloads.FrameTrace{
-			Label:          label,
-			Type:           "type",
-			Operand:        "operand",
-			StartTimestamp: time.Now().Format(time.RFC3339Nano),
-			EndTimestamp:   time.Now().Format(time.RFC3339Nano),
-			Nodes:          nodes,
+	for _, s := range summary {
+		if s.NodeID == nodeID {
+			return s.TotalInstances
 		}
-		frames = append(frames, stat)
 	}
-	return frames
+
+	return 0
 }
 
-func TestGetBatchFrameStatistics(t *testing.T) {
-	trace := payloads.Trace{
-		Frames: createTestFrameTraces("batch_frame_test"),
-	}
+func TestPlacementHistory(t *testing.T) {
+	t.Parallel()
 
-	err := ds.HandleTraceReport(trace)
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ds.db.getBatchFrameStatistics("batch_frame_test")
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestGetBatchFrameSummary(t *testing.T) {
-	trace := payloads.Trace{
-		Frames: createTestFrameTraces("batch_summary_test"),
-	}
+	node1 := uuid.Generate().String()
+	node2 := uuid.Generate().String()
+	node3 := uuid.Generate().String()
 
-	err := ds.HandleTraceReport(trace)
+	testPlacementStat(t, ds, instance.ID, node1)
+
+	err = ds.InstanceStopped(instance.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ds.db.getBatchFrameSummary()
+	err = ds.InstanceRestarting(instance.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestGetEventLog(t *testing.T) {
-	e := types.LogEntry{
-		TenantID:  "test-tenantID",
-		EventType: "info",
-		Message:   "this is a test",
+	testPlacementStat(t, ds, instance.ID, node2)
+
+	if nodeInstanceCount(t, ds, node1) != 0 || nodeInstanceCount(t, ds, node2) != 1 {
+		t.Errorf("Rescheduled instance not counted on %s", node2)
 	}
-	err := ds.db.logEvent(e)
+
+	ds.EvacuatingNode(node2)
+	testPlacementStat(t, ds, instance.ID, node3)
+
+	node4 := uuid.Generate().String()
+	err = ds.AdoptInstance(instance.ID, node4, payloads.Running)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ds.db.getEventLog()
+	p, err := ds.GetInstancePlacements(instance.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestLogEvent(t *testing.T) {
-	e := types.LogEntry{
-		TenantID:  "test-tenantID",
-		EventType: "info",
-		Message:   "this is a test",
+	if p.InstanceID != instance.ID || p.NodeID != node4 {
+		t.Errorf("Expected instance on %s, got %+v", node4, p)
 	}
-	err := ds.db.logEvent(e)
-	if err != nil {
-		t.Fatal(err)
-	}
-}
 
-func TestClearLog(t *testing.T) {
-	err := ds.db.clearLog()
-	if err != nil {
-		t.Fatal(err)
+	expected := []types.Placement{
+		{NodeID: node1, Reason: types.PlacementInitial},
+		{NodeID: node2, Reason: types.PlacementReschedule},
+		{NodeID: node3, Reason: types.PlacementEvacuation},
+		{NodeID: node4, Reason: types.PlacementMigration},
 	}
-}
 
-func TestAddFrameStat(t *testing.T) {
-	stat := createTestFrameTraces("test")[0]
-	err := ds.db.addFrameStat(stat)
-	if err != nil {
-		t.Fatal(err)
+	if len(p.Placements) != len(expected) {
+		t.Fatalf("Expected %d placements, got %+v", len(expected), p.Placements)
 	}
-}
 
-func TestAddInstanceStats(t *testing.T) {
-	var stats []payloads.InstanceStat
+	for n := range expected {
+		if p.Placements[n].NodeID != expected[n].NodeID ||
+			p.Placements[n].Reason != expected[n].Reason {
+			t.Errorf("Expected placement %+v, got %+v", expected[n], p.Placements[n])
+		}
 
-	for i := 0; i < 3; i++ {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  uuid.Generate().String(),
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
+		if p.Placements[n].Timestamp.IsZero() {
+			t.Errorf("Placement %d has no timestamp", n)
 		}
-		stats = append(stats, stat)
 	}
 
-	nodeID := uuid.Generate().String()
+	// stats from the node an instance is already on add no history
+	testPlacementStat(t, ds, instance.ID, node4)
 
-	err := ds.addInstanceStats(stats, nodeID)
+	p, err = ds.GetInstancePlacements(instance.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	if len(p.Placements) != len(expected) {
+		t.Errorf("Unexpected placement added: %+v", p.Placements)
+	}
 }
 
-func TestAddNodeStats(t *testing.T) {
-	var stats []payloads.InstanceStat
+func TestInstanceConditionsCap(t *testing.T) {
+	t.Parallel()
 
-	for i := 0; i < 3; i++ {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  uuid.Generate().String(),
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
-		}
-		stats = append(stats, stat)
-	}
-	stat := payloads.Stat{
-		NodeUUID:        uuid.Generate().String(),
-		MemTotalMB:      256,
-		MemAvailableMB:  256,
-		DiskTotalMB:     1024,
-		DiskAvailableMB: 1024,
-		Load:            20,
-		CpusOnline:      4,
-		NodeHostName:    "test",
-		Instances:       stats,
-	}
+	ds := datastoretest.New(t)
 
-	err := ds.addNodeStat(stat)
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestAllocateTenantIP(t *testing.T) {
-	/* add a new tenant */
-	tenant, err := addTestTenant()
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	ip, err := ds.AllocateTenantIP(tenant.ID)
+	var warnings []payloads.InstanceWarning
+	for n := 0; n < datastore.MaxInstanceConditions+2; n++ {
+		w := payloads.InstanceWarning{
+			Type:    payloads.InstanceWarningType(fmt.Sprintf("warning-%d", n)),
+			Message: "test",
+		}
+		warnings = append(warnings, w, w)
+	}
+
+	raised, cleared, err := ds.UpdateInstanceConditions(instance.ID, warnings)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// this should hit cache
-	newTenant, err := ds.getTenant(tenant.ID)
+	if len(raised) != datastore.MaxInstanceConditions || len(cleared) != 0 {
+		t.Fatalf("Expected %d conditions raised, got %+v %+v", datastore.MaxInstanceConditions, raised, cleared)
+	}
+
+	conditions := ds.GetInstanceConditions(instance.ID)
+	if len(conditions) != datastore.MaxInstanceConditions {
+		t.Fatalf("Expected %d conditions, got %+v", datastore.MaxInstanceConditions, conditions)
+	}
+
+	raised, cleared, err = ds.UpdateInstanceConditions(instance.ID, warnings[:2])
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	mask := net.CIDRMask(newTenant.SubnetBits, 32)
-	ipNet := net.IPNet{
-		IP:   ip.Mask(mask),
-		Mask: mask,
+	if len(raised) != 0 || len(cleared) != datastore.MaxInstanceConditions-1 {
+		t.Errorf("Unexpected changes: raised %+v, cleared %+v", raised, cleared)
 	}
 
-	subMask := binary.BigEndian.Uint32(ipNet.Mask)
-	hostInt := binary.BigEndian.Uint32(ip.To4())
-	subnetInt := hostInt & subMask
-
-	if newTenant.network[subnetInt][hostInt] != true {
-		t.Fatal("IP Address not claimed in cache")
+	conditions = ds.GetInstanceConditions(instance.ID)
+	if len(conditions) != 1 || conditions[0].Type != warnings[0].Type {
+		t.Errorf("Unexpected conditions: %+v", conditions)
 	}
 
-	// clear out cache
-	ds.tenantsLock.Lock()
-	delete(ds.tenants, tenant.ID)
-	ds.tenantsLock.Unlock()
+	_, _, err = ds.UpdateInstanceConditions(uuid.Generate().String(), warnings)
+	if err != types.ErrInstanceNotFound {
+		t.Errorf("Expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+}
 
-	// this should not hit cache
-	newTenant, err = ds.getTenant(tenant.ID)
+// listInstanceIDs returns the IDs of the instances of a tenant in state.
+func listInstanceIDs(t *testing.T, ds *datastore.Datastore, tenantID string, state string) []string {
+	instances, _, err := ds.ListInstances(tenantID, types.InstanceFilter{State: state}, types.ListFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if newTenant.network[subnetInt][hostInt] != true {
-		t.Fatal("IP Address not claimed in database")
+	IDs := []string{}
+	for _, i := range instances {
+		IDs = append(IDs, i.ID)
 	}
+	sort.Strings(IDs)
+
+	return IDs
 }
 
-func TestGetCNCIWorkloadID(t *testing.T) {
-	_, err := ds.GetCNCIWorkloadID()
+func TestListInstancesCachedStates(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	lost, stat := addTestInstanceStats(t, ds)
+
+	err := ds.SetNodeLiveness(stat.NodeUUID, types.NodeStatusDown)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestGetTenant(t *testing.T) {
-	tenant, err := addTestTenant()
+	var lostIDs []string
+	for _, i := range lost {
+		lostIDs = append(lostIDs, i.ID)
+	}
+	sort.Strings(lostIDs)
+
+	tenantID := lost[0].TenantID
+	if IDs := listInstanceIDs(t, ds, tenantID, payloads.Unreachable); !reflect.DeepEqual(IDs, lostIDs) {
+		t.Errorf("Expected unreachable instances %v, got %v", lostIDs, IDs)
+	}
+	if IDs := listInstanceIDs(t, ds, tenantID, payloads.Running); len(IDs) != 0 {
+		t.Errorf("Expected no running instances, got %v", IDs)
+	}
+
+	instances, stat := addTestInstanceStats(t, ds)
+	tenantID = instances[0].TenantID
+
+	err = ds.StartMigration(types.Migration{
+		InstanceID:   instances[0].ID,
+		TenantID:     tenantID,
+		SourceNodeID: stat.NodeUUID,
+		TargetNodeID: uuid.Generate().String(),
+		State:        types.MigrationPreparing,
+		StartTime:    time.Now(),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	testTenant, err := ds.GetTenant(tenant.ID)
+	err = ds.DeferInstanceDeletion(context.Background(), instances[1].ID, time.Now().Add(time.Hour))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if testTenant.ID != tenant.ID {
-		t.Fatal(err)
+
+	if IDs := listInstanceIDs(t, ds, tenantID, payloads.Migrating); !reflect.DeepEqual(IDs, []string{instances[0].ID}) {
+		t.Errorf("Expected migrating instance %s, got %v", instances[0].ID, IDs)
+	}
+	if IDs := listInstanceIDs(t, ds, tenantID, payloads.DeletePending); !reflect.DeepEqual(IDs, []string{instances[1].ID}) {
+		t.Errorf("Expected deleted-pending instance %s, got %v", instances[1].ID, IDs)
+	}
+	if IDs := listInstanceIDs(t, ds, tenantID, payloads.Running); len(IDs) != len(instances)-2 {
+		t.Errorf("Expected %d running instances, got %v", len(instances)-2, IDs)
 	}
 }
 
-func TestGetAllTenants(t *testing.T) {
-	_, err := ds.GetAllTenants()
+func TestNodeLiveness(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
+
+	before := ds.GetClusterStatus()
+
+	err := ds.SetNodeLiveness(stat.NodeUUID, types.NodeStatusDown)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// for now, just check that the query has no
-	// errors.
-}
 
-func TestUpdateTenant(t *testing.T) {
-	/* add a new tenant without CNCI*/
-	tuuid := uuid.Generate()
+	for _, instance := range instances {
+		i, err := ds.GetInstance(instance.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	initConfig := types.TenantConfig{
-		Name:       "",
-		SubnetBits: 24,
+		if i.State != payloads.Unreachable {
+			t.Errorf("Expected instance %s to be %s, got %s", i.ID, payloads.Unreachable, i.State)
+		}
 	}
 
-	tenant, err := ds.AddTenant(tuuid.String(), initConfig)
-	if err != nil {
-		t.Fatal(err)
+	found := false
+	for _, n := range ds.GetNodeLastStats().Nodes {
+		if n.ID != stat.NodeUUID {
+			continue
+		}
+		found = true
+
+		if n.Status != string(types.NodeStatusDown) {
+			t.Errorf("Expected node status %s, got %s", types.NodeStatusDown, n.Status)
+		}
 	}
 
-	oldconfig := types.TenantConfig{
-		Name:       tenant.Name,
-		SubnetBits: tenant.SubnetBits,
+	if !found {
+		t.Fatalf("Node %s not found", stat.NodeUUID)
 	}
 
-	a, err := json.Marshal(oldconfig)
-	if err != nil {
-		t.Fatal(err)
+	after := ds.GetClusterStatus()
+
+	if after.Status.TotalNodes != before.Status.TotalNodes ||
+		after.Status.TotalNodesDown != before.Status.TotalNodesDown+1 {
+		t.Errorf("Node not counted as down: %+v", after.Status)
 	}
 
-	config := types.TenantConfig{
-		Name:       "name1",
-		SubnetBits: 20,
+	if after.Status.MemTotal != before.Status.MemTotal-stat.MemTotalMB ||
+		after.Status.DiskTotal != before.Status.DiskTotal-stat.DiskTotalMB ||
+		after.Status.OnlineCPUs != before.Status.OnlineCPUs-stat.CpusOnline {
+		t.Errorf("Capacity of down node not removed: %+v", after.Status)
 	}
 
-	b, err := json.Marshal(config)
+	err = ds.SetNodeLiveness(stat.NodeUUID, types.NodeStatusReady)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	merge, err := jsonpatch.CreateMergePatch(a, b)
+	if !reflect.DeepEqual(before, ds.GetClusterStatus()) {
+		t.Errorf("Expected cluster status %+v, got %+v", before, ds.GetClusterStatus())
+	}
+
+	err = ds.SetNodeLiveness(uuid.Generate().String(), types.NodeStatusDown)
+	if err == nil {
+		t.Error("Expected error for unknown node")
+	}
+}
+
+func TestStateChangeEvents(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
+	instance := instances[0]
+
+	events, err := ds.GetEventsForTenant(instance.TenantID, types.EventFilter{
+		Type:     string(datastore.InstanceStateEvent),
+		ObjectID: instance.ID,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = ds.JSONPatchTenant(tenant.ID, merge)
+	if len(events) != 1 || events[0].NodeID != stat.NodeUUID ||
+		!strings.HasSuffix(events[0].Message, "to "+payloads.ComputeStatusRunning) {
+		t.Errorf("Expected instance to be logged running, got %v", events)
+	}
+
+	for _, status := range []types.NodeStatusType{types.NodeStatusSuspect, types.NodeStatusSuspect, types.NodeStatusReady} {
+		err = ds.SetNodeLiveness(stat.NodeUUID, status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err = ds.GetEvents(types.EventFilter{
+		Type:     string(datastore.NodeStatusEvent),
+		ObjectID: stat.NodeUUID,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	testTenant, err := ds.GetTenant(tenant.ID)
+	if len(events) != 2 || events[0].TenantID != "" {
+		t.Errorf("Expected 2 node status changes logged, got %v", events)
+	}
+
+	volume := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+		State:       types.Available,
+		TenantID:    instance.TenantID,
+		CreateTime:  time.Now(),
+	}
+
+	for _, state := range []types.BlockState{types.Available, types.Attaching, types.Attaching, types.InUse} {
+		volume.State = state
+		err = ds.AddBlockDevice(context.Background(), volume)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err = ds.GetEventsForTenant(instance.TenantID, types.EventFilter{
+		Type:     string(datastore.VolumeStateEvent),
+		ObjectID: volume.ID,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if testTenant.Name != "name1" || testTenant.SubnetBits != 20 {
-		t.Fatal("Tenant update not successful")
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 volume state changes logged, got %v", events)
+	}
+
+	for _, e := range events {
+		if e.ID == 0 {
+			t.Errorf("Event %s not given an ID", e.Message)
+		}
 	}
 }
 
-func TestDeleteTenant(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
+func TestGetInstance(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
+	instance, err := ds.GetInstance(instances[0].ID)
+	if err != nil && err != sql.ErrNoRows {
 		t.Fatal(err)
 	}
 
-	err = ds.DeleteTenant(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
+	for instance == nil {
+		instance, err = ds.GetInstance(instances[0].ID)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
 	}
 
-	testTenant, err := ds.GetTenant(tenant.ID)
-	if err == nil || testTenant != nil {
-		t.Fatal("Tenant not deleted")
+	if instance.NodeID != stat.NodeUUID {
+		t.Fatal("retrieved incorrect NodeID")
+	}
+
+	if instance.State != payloads.ComputeStatusRunning {
+		t.Fatal("retrieved incorrect state")
 	}
 }
 
-func TestHandleTraceReport(t *testing.T) {
-	trace := payloads.Trace{
-		Frames: createTestFrameTraces("test"),
+func TestGetTenantInstance(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	instances, stat := addTestInstanceStats(t, ds)
+	instance, err := ds.GetTenantInstance(instances[0].TenantID, instances[0].ID)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+
+	for instance == nil {
+		instance, err = ds.GetTenantInstance(instances[0].TenantID, instances[0].ID)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
+	}
+
+	if instance.NodeID != stat.NodeUUID {
+		t.Fatal("retrieved incorrect NodeID")
+	}
+
+	if instance.State != payloads.ComputeStatusRunning {
+		t.Fatal("retrieved incorrect state")
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	instances, err := addTestInstances(ds, tenant, wls[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats []payloads.InstanceStat
+
+	for i := range instances {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  instances[i].ID,
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+	stat := payloads.Stat{
+		NodeUUID:        uuid.Generate().String(),
+		MemTotalMB:      256,
+		MemAvailableMB:  256,
+		DiskTotalMB:     1024,
+		DiskAvailableMB: 1024,
+		Load:            20,
+		CpusOnline:      4,
+		NodeHostName:    "test",
+		Instances:       stats,
+	}
+
+	err = ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check instance stats recorded
+	for i := range stats {
+		id := stats[i].InstanceUUID
+		instance, err := ds.GetInstance(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if instance.NodeID != stat.NodeUUID {
+			t.Fatal("Incorrect NodeID in stats table")
+		}
+
+		if instance.State != payloads.ComputeStatusRunning {
+			t.Fatal("state not updated")
+		}
+	}
+}
+
+func TestGetInstanceLastStats(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	instances, err := addTestInstances(ds, tenant, wls[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats []payloads.InstanceStat
+
+	for i := range instances {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  instances[i].ID,
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+	stat := payloads.Stat{
+		NodeUUID:        uuid.Generate().String(),
+		MemTotalMB:      256,
+		MemAvailableMB:  256,
+		DiskTotalMB:     1024,
+		DiskAvailableMB: 1024,
+		Load:            20,
+		CpusOnline:      4,
+		NodeHostName:    "test",
+		Instances:       stats,
+	}
+
+	err = ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverStats := ds.GetInstanceLastStats(stat.NodeUUID)
+
+	if len(serverStats.Servers) != len(instances) {
+		t.Fatal("Not enough instance stats retrieved")
+	}
+}
+
+func TestGetNodeLastStats(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	instances, err := addTestInstances(ds, tenant, wls[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats []payloads.InstanceStat
+
+	for i := range instances {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  instances[i].ID,
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+	stat := payloads.Stat{
+		NodeUUID:        uuid.Generate().String(),
+		MemTotalMB:      256,
+		MemAvailableMB:  256,
+		DiskTotalMB:     1024,
+		DiskAvailableMB: 1024,
+		Load:            20,
+		CpusOnline:      4,
+		NodeHostName:    "test",
+		Instances:       stats,
+	}
+
+	err = ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	computeNodes := ds.GetNodeLastStats()
+
+	// how many compute Nodes should be here?  If we want to
+	// control we need to clear out previous test stats
+	if len(computeNodes.Nodes) == 0 {
+		t.Fatal("Not enough compute Nodes found")
+	}
+}
+
+func TestGetBatchFrameStatistics(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	trace := payloads.Trace{
+		Frames: datastore.CreateTestFrameTraces("batch_frame_test"),
+	}
+
+	err := ds.HandleTraceReport(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetBatchFrameStatistics("batch_frame_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBatchFrameSummary(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	trace := payloads.Trace{
+		Frames: datastore.CreateTestFrameTraces("batch_summary_test"),
+	}
+
+	err := ds.HandleTraceReport(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetBatchFrameSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetEventLog(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	err := ds.LogEvent("test-tenantID", "this is a test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogEvent(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	err := ds.LogEvent("test-tenantID", "this is a test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearLog(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	err := ds.ClearLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddFrameStat(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	trace := payloads.Trace{
+		Frames: datastore.CreateTestFrameTraces("test")[:1],
+	}
+
+	err := ds.HandleTraceReport(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddInstanceStats(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	var stats []payloads.InstanceStat
+
+	for i := 0; i < 3; i++ {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  uuid.Generate().String(),
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+
+	// a load of -1 reports the instances alone
+	stat := payloads.Stat{
+		NodeUUID:  uuid.Generate().String(),
+		Load:      -1,
+		Instances: stats,
+	}
+
+	err := ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddNodeStats(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	var stats []payloads.InstanceStat
+
+	for i := 0; i < 3; i++ {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  uuid.Generate().String(),
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+	stat := payloads.Stat{
+		NodeUUID:        uuid.Generate().String(),
+		MemTotalMB:      256,
+		MemAvailableMB:  256,
+		DiskTotalMB:     1024,
+		DiskAvailableMB: 1024,
+		Load:            20,
+		CpusOnline:      4,
+		NodeHostName:    "test",
+		Instances:       stats,
+	}
+
+	err := ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateTenantIP(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	/* add a new tenant */
+	tenant := addTestTenant(t, ds)
+
+	ip, err := ds.AllocateTenantIP(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// this should hit cache
+	claimed, err := datastore.TenantIPClaimed(ds, tenant.ID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !claimed {
+		t.Fatal("IP Address not claimed in cache")
+	}
+
+	// clear out cache
+	datastore.EvictTenant(ds, tenant.ID)
+
+	// this should not hit cache
+	claimed, err = datastore.TenantIPClaimed(ds, tenant.ID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !claimed {
+		t.Fatal("IP Address not claimed in database")
+	}
+}
+
+func TestGetCNCIWorkloadID(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+	ds.GenerateCNCIWorkload(4, 128, 128, "")
+
+	_, err := ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTenant(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	testTenant, err := ds.GetTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testTenant.ID != tenant.ID {
+		t.Fatal(err)
+	}
+}
+
+func TestGetAllTenants(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	_, err := ds.GetAllTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// for now, just check that the query has no
+	// errors.
+}
+
+func TestUpdateTenant(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	/* add a new tenant without CNCI*/
+	tuuid := uuid.Generate()
+
+	initConfig := types.TenantConfig{
+		Name:       "",
+		SubnetBits: 24,
+	}
+
+	tenant, err := ds.AddTenant(tuuid.String(), initConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldconfig := types.TenantConfig{
+		Name:       tenant.Name,
+		SubnetBits: tenant.SubnetBits,
+	}
+
+	a, err := json.Marshal(oldconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := types.TenantConfig{
+		Name:       "name1",
+		SubnetBits: 20,
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge, err := jsonpatch.CreateMergePatch(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.JSONPatchTenant(tenant.ID, merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTenant, err := ds.GetTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testTenant.Name != "name1" || testTenant.SubnetBits != 20 {
+		t.Fatal("Tenant update not successful")
+	}
+}
+
+func TestJSONPatchTenantCNCISize(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant, err := ds.AddTenant(uuid.Generate().String(), types.TenantConfig{SubnetBits: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		patch string
+		size  *types.CNCISize
+		valid bool
+	}{
+		{`{"cnci_size":{"vcpus":8}}`, &types.CNCISize{VCPUs: 8}, true},
+		{`{"cnci_size":{"mem_mb":4096}}`, &types.CNCISize{VCPUs: 8, MemMB: 4096}, true},
+		{`{"cnci_size":{"disk_mb":-1}}`, &types.CNCISize{VCPUs: 8, MemMB: 4096}, false},
+		{`{"cnci_size":{"vcpus":null}}`, &types.CNCISize{MemMB: 4096}, true},
+		{`{"cnci_size":{"mem_mb":0}}`, nil, true},
+		{`{"cnci_size":{"disk_mb":2048}}`, &types.CNCISize{DiskMB: 2048}, true},
+		{`{"cnci_size":null}`, nil, true},
+	}
+
+	for _, test := range tests {
+		err = ds.JSONPatchTenant(tenant.ID, []byte(test.patch))
+		if test.valid != (err == nil) {
+			t.Fatalf("%s: unexpected result %v", test.patch, err)
+		}
+
+		tenant, err = ds.GetTenant(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(tenant.CNCISize, test.size) {
+			t.Fatalf("%s: expected CNCI size %+v, got %+v", test.patch, test.size, tenant.CNCISize)
+		}
+	}
+}
+
+func TestTenantFreeze(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant, err := ds.AddTenant(uuid.Generate().String(), types.TenantConfig{SubnetBits: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.SetTenantFreeze(tenant.ID, true, "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frozen, reason := ds.TenantFrozen(tenant.ID)
+	if !frozen || reason != "migration" {
+		t.Fatalf("Tenant not frozen: %v %q", frozen, reason)
+	}
+
+	err = ds.JSONPatchTenant(tenant.ID, []byte(`{"frozen":false}`))
+	if err == nil {
+		t.Fatal("Freeze state changed by patch")
+	}
+
+	err = ds.SetTenantFreeze(tenant.ID, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frozen, reason = ds.TenantFrozen(tenant.ID)
+	if frozen || reason != "" {
+		t.Fatalf("Tenant still frozen: %v %q", frozen, reason)
+	}
+
+	err = ds.SetTenantFreeze(uuid.Generate().String(), true, "migration")
+	if err != datastore.ErrNoTenant {
+		t.Errorf("Expected %v got %v", datastore.ErrNoTenant, err)
+	}
+}
+
+func TestDeleteTenant(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	err := ds.DeleteTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTenant, err := ds.GetTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testTenant != nil {
+		t.Fatal("Tenant not deleted")
+	}
+}
+
+func TestHandleTraceReport(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	trace := payloads.Trace{
+		Frames: datastore.CreateTestFrameTraces("test"),
+	}
+
+	err := ds.HandleTraceReport(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCNCISummary(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	instances, err := ds.GetTenantCNCIs(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// test without null cnciid
+	for _, i := range instances {
+		_, err = ds.GetTenantCNCISummary(i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// test with null cnciid
+	_, err = ds.GetTenantCNCISummary("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestAssignCNCI(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	CNCI := types.Instance{
+		State:     payloads.Running,
+		ID:        uuid.Generate().String(),
+		CNCI:      true,
+		Subnet:    "pool",
+		IPAddress: "192.168.0.2",
+	}
+
+	err := ds.AddInstance(context.Background(), &CNCI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ds.DeleteInstance(CNCI.ID) }()
+
+	unassigned, err := ds.GetUnassignedCNCIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unassigned) != 1 || unassigned[0].ID != CNCI.ID {
+		t.Fatalf("Expected CNCI %s to be unassigned, got %v", CNCI.ID, unassigned)
+	}
+
+	err = ds.AssignCNCI(CNCI.ID, tenant.ID, "172.16.10.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := ds.GetInstance(CNCI.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.TenantID != tenant.ID || i.Subnet != "172.16.10.0/24" {
+		t.Fatalf("CNCI not assigned: tenant %s subnet %s", i.TenantID, i.Subnet)
+	}
+
+	cncis, err := ds.GetTenantCNCIs(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range cncis {
+		found = found || c.ID == CNCI.ID
+	}
+	if !found {
+		t.Fatal("Assigned CNCI not found for tenant")
+	}
+
+	unassigned, err = ds.GetUnassignedCNCIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unassigned) != 0 {
+		t.Fatalf("Expected no unassigned CNCIs, got %d", len(unassigned))
+	}
+
+	if err := ds.AssignCNCI(CNCI.ID, tenant.ID, "172.16.11.0/24"); err == nil {
+		t.Fatal("Expected assigning an assigned CNCI to fail")
+	}
+}
+
+func TestQueueLaunch(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	instances := make([]*types.Instance, 2)
+	for i := range instances {
+		ip, err := ds.AllocateTenantIP(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		instances[i] = &types.Instance{
+			TenantID:    tenant.ID,
+			State:       payloads.Queued,
+			ID:          uuid.Generate().String(),
+			IPAddress:   ip.String(),
+			MACAddress:  utils.NewTenantHardwareAddr(ip).String(),
+			StateChange: sync.NewCond(&sync.Mutex{}),
+		}
+
+		err = ds.AddInstance(context.Background(), instances[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ds.QueueLaunch(types.QueuedLaunch{
+			InstanceID: instances[i].ID,
+			TenantID:   tenant.ID,
+			Sequence:   int64(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ds.DequeueLaunch(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.Pending {
+		t.Fatalf("Expected dequeued instance to be %s, got %s", payloads.Pending, i.State)
+	}
+
+	err = ds.DeleteInstance(instances[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = ds.DeleteInstance(instances[0].ID)
+}
+
+func TestReleaseTenantIP(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	/* add a new tenant */
+	tenant := addTestTenant(t, ds)
+
+	ip, err := ds.AllocateTenantIP(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get updated tenant info
+	claimed, err := datastore.TenantIPClaimed(ds, tenant.ID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// confirm that tenant map shows it used.
+	if !claimed {
+		t.Fatal("IP Address not marked Used")
+	}
+
+	err = ds.ReleaseTenantIP(tenant.ID, ip.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get updated tenant info - should hit cache
+	claimed, err = datastore.TenantIPClaimed(ds, tenant.ID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// confirm that tenant map shows it not used.
+	if claimed {
+		t.Fatal("IP Address not released from cache")
+	}
+
+	// clear tenant from cache
+	datastore.EvictTenant(ds, tenant.ID)
+
+	// get updated tenant info - should hit database
+	claimed, err = datastore.TenantIPClaimed(ds, tenant.ID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// confirm that tenant map shows it not used.
+	if claimed {
+		t.Fatal("IP Address not released from database")
+	}
+}
+
+func TestStartFailureFullCloud(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(ds, tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reason := payloads.FullCloud
+
+	err = ds.StartFailure(instance.ID, reason, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetInstance(instance.ID)
+	if err == nil {
+		t.Fatal("Expected instance not to be present")
+	}
+}
+
+func TestStartFailureClassified(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		reason payloads.StartFailureReason
+		code   types.LaunchFailureCode
+	}{
+		{payloads.FullCloud, types.LaunchNoCapacity},
+		{payloads.NetworkFailure, types.LaunchNetworkNotReady},
+		{payloads.ImageFailure, types.LaunchStorageError},
+		{payloads.InvalidData, types.LaunchInvalidRequest},
+		{payloads.InstanceExists, types.LaunchNodeError},
+	}
+
+	for _, tt := range tests {
+		instance, err := addTestInstance(ds, tenant, wls[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ds.StartFailure(instance.ID, tt.reason, false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := ds.GetEventsForTenant(tenant.ID, types.EventFilter{ObjectID: instance.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(events) != 1 || events[0].FailureCode != string(tt.code) {
+			t.Errorf("%s: expected an event with failure code %s, got %v", tt.reason, tt.code, events)
+		}
+
+		if tt.reason.IsFatal() {
+			continue
+		}
+
+		i, err := ds.GetInstance(instance.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i.StatusReason != string(tt.code) {
+			t.Errorf("%s: expected status reason %s, got %q", tt.reason, tt.code, i.StatusReason)
+		}
+	}
+}
+
+func TestAttachVolumeFailure(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	newTenant := addTestTenant(t, ds)
+
+	// add test instances
+	wls, err := ds.GetWorkloads(newTenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(ds, newTenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add test block data
+	blockDevice := storage.BlockDevice{
+		ID: "validID",
+	}
+
+	data := types.Volume{
+		BlockDevice: blockDevice,
+		State:       types.Available,
+		TenantID:    newTenant.ID,
+		CreateTime:  time.Now(),
+	}
+
+	err = ds.AddBlockDevice(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// update block data to indicate it is attaching
+	data.State = types.Attaching
+
+	err = ds.UpdateBlockDevice(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend we got a failure to attach.
+	err = ds.AttachVolumeFailure(instance.ID, data.ID, payloads.AttachVolumeAlreadyAttached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure state has been switched to Available again.
+	bd, err := ds.GetBlockDevice(data.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bd.State != types.Available {
+		t.Fatalf("expected state: %s, got %s\n", types.Available, bd.State)
+	}
+}
+
+func testAllocateTenantIPs(t *testing.T, ds *datastore.Datastore, nIPs int) {
+	newTenant := addTestTenant(t, ds)
+
+	_, ipNet, err := net.ParseCIDR(fmt.Sprintf("172.16.0.0/%d", newTenant.SubnetBits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, bits := ipNet.Mask.Size()
+
+	// deduct .0 and .1, and .255
+	nIPsPerSubnet := (1 << uint32(bits-ones)) - 3
+	if nIPsPerSubnet <= 0 {
+		t.Fatal("Invalid tenant config")
+	}
+
+	// make this tenant have some network hosts assigned to them.
+	// switch this to use pool
+	IPs, err := ds.AllocateTenantIPPool(newTenant.ID, nIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(IPs) != nIPs {
+		t.Fatalf("expected %d IPs allocated, got %d\n", nIPs, len(IPs))
+	}
+
+	// get private tenant type
+	hosts, err := datastore.TenantSubnetHosts(ds, newTenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expSubnets int
+	expSubnets = (nIPs / nIPsPerSubnet)
+	remain := nIPs % nIPsPerSubnet
+	if remain > 0 {
+		expSubnets++
+	}
+
+	if len(hosts) != expSubnets {
+		t.Fatalf("expected %d subnets, got %d", expSubnets, len(hosts))
+	}
+
+	for i := range hosts {
+		var expHosts int
+
+		if ((int(i) + 1) * nIPsPerSubnet) < nIPs {
+			expHosts = nIPsPerSubnet
+		} else {
+			expHosts = nIPs % nIPsPerSubnet
+			if expHosts == 0 {
+				expHosts++
+			}
+		}
+
+		if hosts[i] != expHosts {
+			t.Fatalf("Missing IPs: expected %d, got %d", expHosts, hosts[i])
+		}
+	}
+}
+
+func TestAllocate100IPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	testAllocateTenantIPs(t, ds, 100)
+}
+
+func TestAllocate1024IPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	testAllocateTenantIPs(t, ds, 1024)
+}
+
+func addSubnetTestTenant(t *testing.T, ds *datastore.Datastore, maxSubnets int) string {
+	tuuid := uuid.Generate().String()
+	config := types.TenantConfig{
+		SubnetBits: 29,
+		MaxSubnets: maxSubnets,
 	}
 
-	err := ds.HandleTraceReport(trace)
+	_, err := ds.AddTenant(tuuid, config)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	return tuuid
 }
 
-func TestGetCNCISummary(t *testing.T) {
-	tenant, err := addTestTenant()
+func TestAllocateTenantIPPoolGrowsSubnets(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenantID := addSubnetTestTenant(t, ds, 0)
+
+	// a /29 has room for 5 instances
+	_, err := ds.AllocateTenantIPPool(tenantID, 5)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instances, err := ds.GetTenantCNCIs(tenant.ID)
+	IPs, err := ds.AllocateTenantIPPool(tenantID, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// test without null cnciid
-	for _, i := range instances {
-		_, err = ds.GetTenantCNCISummary(i.ID)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if IPs[0].String() != "172.16.0.10" {
+		t.Fatalf("expected 172.16.0.10, got %s", IPs[0])
 	}
 
-	// test with null cnciid
-	_, err = ds.GetTenantCNCISummary("")
+	subnets, err := ds.TenantSubnets(tenantID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	exp := []types.TenantSubnet{
+		{Subnet: "172.16.0.0/29", Capacity: 5, Used: 5},
+		{Subnet: "172.16.0.8/29", Capacity: 5, Used: 1},
+	}
+	if !reflect.DeepEqual(subnets, exp) {
+		t.Fatalf("expected %v, got %v", exp, subnets)
+	}
 }
 
-func TestReleaseTenantIP(t *testing.T) {
-	/* add a new tenant */
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestAllocateTenantIPPoolMaxSubnets(t *testing.T) {
+	t.Parallel()
 
-	ip, err := ds.AllocateTenantIP(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	mask := net.CIDRMask(tenant.SubnetBits, 32)
-	ipNet := net.IPNet{
-		IP:   ip.Mask(mask),
-		Mask: mask,
-	}
+	ds := datastoretest.New(t)
 
-	subMask := binary.BigEndian.Uint32(ipNet.Mask)
-	hostInt := binary.BigEndian.Uint32(ip.To4())
-	subnetInt := hostInt & subMask
+	tenantID := addSubnetTestTenant(t, ds, 1)
 
-	// get updated tenant info
-	newTenant, err := ds.getTenant(tenant.ID)
+	_, err := ds.AllocateTenantIPPool(tenantID, 4)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// confirm that tenant map shows it used.
-	if newTenant.network[subnetInt][hostInt] != true {
-		t.Fatal("IP Address not marked Used")
+	_, err = ds.AllocateTenantIPPool(tenantID, 2)
+	fullErr, ok := err.(*types.SubnetFullError)
+	if !ok {
+		t.Fatalf("expected SubnetFullError, got %v", err)
 	}
 
-	err = ds.ReleaseTenantIP(tenant.ID, ip.String())
-	if err != nil {
-		t.Fatal(err)
+	if fullErr.Subnet != "172.16.0.0/29" || fullErr.Capacity != 5 {
+		t.Fatalf("unexpected error %v", fullErr)
 	}
 
-	// get updated tenant info - should hit cache
-	newTenant, err = ds.getTenant(tenant.ID)
+	// nothing may have been claimed by the failed allocation
+	subnets, err := ds.TenantSubnets(tenantID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// confirm that tenant map shows it not used.
-	if newTenant.network[subnetInt][hostInt] != false {
-		t.Fatal("IP Address not released from cache")
+	if len(subnets) != 1 || subnets[0].Used != 4 {
+		t.Fatalf("expected one subnet with 4 addresses used, got %v", subnets)
 	}
 
-	// clear tenant from cache
-	ds.tenantsLock.Lock()
-	delete(ds.tenants, tenant.ID)
-	ds.tenantsLock.Unlock()
-
-	// get updated tenant info - should hit database
-	newTenant, err = ds.getTenant(tenant.ID)
+	_, err = ds.AllocateTenantIPPool(tenantID, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// confirm that tenant map shows it not used.
-	if newTenant.network[subnetInt][hostInt] != false {
-		t.Fatal("IP Address not released from database")
+	_, err = ds.AllocateTenantIPPool(tenantID, 1)
+	if _, ok := err.(*types.SubnetFullError); !ok {
+		t.Fatalf("expected SubnetFullError, got %v", err)
 	}
 }
 
-func TestStartFailureFullCloud(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestAllocateTenantIPPoolExhausted(t *testing.T) {
+	t.Parallel()
 
-	wls, err := ds.GetWorkloads(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ds := datastoretest.New(t)
 
-	instance, err := addTestInstance(tenant, wls[0])
-	if err != nil {
-		t.Fatal(err)
-	}
+	// a tenant range of /29 subnets has room for 5 instances in each
+	// of its 1 << 17 subnets, however many subnets it may have
+	for _, maxSubnets := range []int{0, 1 << 18} {
+		tenantID := addSubnetTestTenant(t, ds, maxSubnets)
 
-	reason := payloads.FullCloud
+		_, err := ds.AllocateTenantIPPool(tenantID, 5<<17+1)
+		if err != types.ErrSubnetExhausted {
+			t.Fatalf("expected %v, got %v", types.ErrSubnetExhausted, err)
+		}
 
-	err = ds.StartFailure(instance.ID, reason, false, "")
-	if err != nil {
-		t.Fatal(err)
-	}
+		subnets, err := ds.TenantSubnets(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	_, err = ds.GetInstance(instance.ID)
-	if err == nil {
-		t.Fatal("Expected instance not to be present")
+		if len(subnets) != 0 {
+			t.Fatalf("expected no subnets, got %v", subnets)
+		}
 	}
 }
 
-func TestAttachVolumeFailure(t *testing.T) {
-	newTenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestAllocateTenantSubnetIP(t *testing.T) {
+	t.Parallel()
 
-	// add test instances
-	wls, err := ds.GetWorkloads(newTenant.ID)
+	ds := datastoretest.New(t)
+
+	tenantID := addSubnetTestTenant(t, ds, 2)
+
+	_, err := ds.AllocateTenantIP(tenantID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(newTenant, wls[0])
+	IP, err := ds.AllocateTenantSubnetIP(tenantID, "172.16.0.16/29")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// add test block data
-	blockDevice := storage.BlockDevice{
-		ID: "validID",
+	if IP.String() != "172.16.0.18" {
+		t.Fatalf("expected 172.16.0.18, got %s", IP)
 	}
 
-	data := types.Volume{
-		BlockDevice: blockDevice,
-		State:       types.Available,
-		TenantID:    newTenant.ID,
-		CreateTime:  time.Now(),
+	_, err = ds.AllocateTenantSubnetIP(tenantID, "172.16.0.17/29")
+	if err == nil {
+		t.Fatal("expected allocation from an invalid subnet to fail")
 	}
 
-	err = ds.AddBlockDevice(data)
-	if err != nil {
-		t.Fatal(err)
+	// the network already has its two subnets
+	_, err = ds.AllocateTenantSubnetIP(tenantID, "172.16.0.8/29")
+	if _, ok := err.(*types.SubnetFullError); !ok {
+		t.Fatalf("expected SubnetFullError, got %v", err)
 	}
 
-	// update block data to indicate it is attaching
-	data.State = types.Attaching
+	for i := 0; i < 4; i++ {
+		_, err = ds.AllocateTenantSubnetIP(tenantID, "172.16.0.16/29")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	err = ds.UpdateBlockDevice(data)
-	if err != nil {
-		t.Fatal(err)
+	_, err = ds.AllocateTenantSubnetIP(tenantID, "172.16.0.16/29")
+	if _, ok := err.(*types.SubnetFullError); !ok {
+		t.Fatalf("expected SubnetFullError, got %v", err)
 	}
 
-	// pretend we got a failure to attach.
-	err = ds.AttachVolumeFailure(instance.ID, data.ID, payloads.AttachVolumeAlreadyAttached)
+	err = ds.ReleaseTenantIP(tenantID, IP.String())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// make sure state has been switched to Available again.
-	bd, err := ds.GetBlockDevice(data.ID)
+	subnets, err := ds.TenantSubnets(tenantID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if bd.State != types.Available {
-		t.Fatalf("expected state: %s, got %s\n", types.Available, bd.State)
+	exp := []types.TenantSubnet{
+		{Subnet: "172.16.0.0/29", Capacity: 5, Used: 1},
+		{Subnet: "172.16.0.16/29", Capacity: 5, Used: 4},
+	}
+	if !reflect.DeepEqual(subnets, exp) {
+		t.Fatalf("expected %v, got %v", exp, subnets)
 	}
 }
 
-func testAllocateTenantIPs(t *testing.T, nIPs int) {
-	newTenant, err := addTestTenant()
+// openAllocationTestStore opens a datastore backed by the database at uri
+// which gives out tenant addresses with strategy.
+func openAllocationTestStore(t *testing.T, uri string, strategy string, now func() time.Time) *datastore.Datastore {
+	d := &datastore.Datastore{}
+	err := d.Init(datastore.Config{
+		PersistentURI:     uri,
+		InitWorkloadsPath: filepath.Join(t.TempDir(), "workloads"),
+		IPAllocation:      strategy,
+		Now:               now,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, ipNet, err := net.ParseCIDR(fmt.Sprintf("172.16.0.0/%d", newTenant.SubnetBits))
+	return d
+}
+
+func allocateTestIPs(t *testing.T, d *datastore.Datastore, tenantID string, num int) []string {
+	IPs, err := d.AllocateTenantIPPool(tenantID, num)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ones, bits := ipNet.Mask.Size()
 
-	// deduct .0 and .1, and .255
-	nIPsPerSubnet := (1 << uint32(bits-ones)) - 3
-	if nIPsPerSubnet <= 0 {
-		t.Fatal("Invalid tenant config")
+	addrs := make([]string, 0, len(IPs))
+	for _, IP := range IPs {
+		addrs = append(addrs, IP.String())
 	}
 
-	// make this tenant have some network hosts assigned to them.
-	// switch this to use pool
-	IPs, err := ds.AllocateTenantIPPool(newTenant.ID, nIPs)
-	if err != nil {
-		t.Fatal(err)
-	}
+	return addrs
+}
 
-	if len(IPs) != nIPs {
-		t.Fatalf("expected %d IPs allocated, got %d\n", nIPs, len(IPs))
+func TestAllocateTenantIPStrategies(t *testing.T) {
+	t.Parallel()
+
+	for _, strategy := range []string{datastore.IPAllocationSequential, datastore.IPAllocationLRU, datastore.IPAllocationRandom} {
+		t.Run(strategy, func(t *testing.T) {
+			uri := "file:" + filepath.Join(t.TempDir(), "ciao-controller.db")
+			d := openAllocationTestStore(t, uri, strategy, nil)
+			defer d.Exit()
+
+			tenantID := uuid.Generate().String()
+			_, err := d.AddTenant(tenantID, types.TenantConfig{SubnetBits: 29, MaxSubnets: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// each of the 5 addresses of a /29 is given out once
+			var addrs []string
+			for i := 0; i < 5; i++ {
+				addrs = append(addrs, allocateTestIPs(t, d, tenantID, 1)...)
+			}
+
+			sort.Strings(addrs)
+			exp := []string{"172.16.0.2", "172.16.0.3", "172.16.0.4", "172.16.0.5", "172.16.0.6"}
+			if !reflect.DeepEqual(addrs, exp) {
+				t.Fatalf("expected %v, got %v", exp, addrs)
+			}
+
+			_, err = d.AllocateTenantIPPool(tenantID, 1)
+			if _, ok := err.(*types.SubnetFullError); !ok {
+				t.Fatalf("expected SubnetFullError, got %v", err)
+			}
+
+			err = d.ReleaseTenantIP(tenantID, "172.16.0.4")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addrs = allocateTestIPs(t, d, tenantID, 1)
+			if addrs[0] != "172.16.0.4" {
+				t.Fatalf("expected 172.16.0.4, got %s", addrs[0])
+			}
+		})
 	}
+}
 
-	// get private tenant type
-	tenant, err := ds.getTenant(newTenant.ID)
+func TestAllocateTenantIPLRU(t *testing.T) {
+	t.Parallel()
+
+	clock := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	now := func() time.Time { return clock }
+
+	uri := "file:" + filepath.Join(t.TempDir(), "ciao-controller.db")
+	d := openAllocationTestStore(t, uri, datastore.IPAllocationLRU, now)
+
+	tenantID := uuid.Generate().String()
+	_, err := d.AddTenant(tenantID, types.TenantConfig{SubnetBits: 29, MaxSubnets: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
-	ds.tenantsLock.Lock()
-	defer ds.tenantsLock.Unlock()
 
-	var expSubnets int
-	expSubnets = (nIPs / nIPsPerSubnet)
-	remain := nIPs % nIPsPerSubnet
-	if remain > 0 {
-		expSubnets++
+	release := func(d *datastore.Datastore, addrs ...string) {
+		for _, addr := range addrs {
+			clock = clock.Add(time.Minute)
+			err := d.ReleaseTenantIP(tenantID, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
 	}
 
-	if len(tenant.network) != expSubnets {
-		t.Fatalf("expected %d subnets, got %d", expSubnets, len(tenant.network))
+	check := func(d *datastore.Datastore, num int, exp ...string) {
+		addrs := allocateTestIPs(t, d, tenantID, num)
+		if !reflect.DeepEqual(addrs, exp) {
+			t.Fatalf("expected %v, got %v", exp, addrs)
+		}
 	}
 
-	var subnets []uint32
-	for k := range tenant.network {
-		subnets = append(subnets, k)
-	}
+	check(d, 3, "172.16.0.2", "172.16.0.3", "172.16.0.4")
 
-	sort.Slice(subnets, func(i, j int) bool { return subnets[i] < subnets[j] })
+	// addresses which have never been used are given out before those
+	// which have been released, oldest first.
+	release(d, "172.16.0.3", "172.16.0.2")
+	check(d, 3, "172.16.0.5", "172.16.0.6", "172.16.0.3")
 
-	for i, subnet := range subnets {
-		var expHosts int
+	release(d, "172.16.0.6", "172.16.0.4", "172.16.0.5")
 
-		if ((int(i) + 1) * nIPsPerSubnet) < nIPs {
-			expHosts = nIPsPerSubnet
-		} else {
-			expHosts = nIPs % nIPsPerSubnet
-			if expHosts == 0 {
-				expHosts++
-			}
-		}
+	// the release times survive a restart.  The driver is registered
+	// per URI so the database is reopened under a different one.
+	d.Exit()
+	d = openAllocationTestStore(t, uri+"?mode=rw", datastore.IPAllocationLRU, now)
 
-		if len(tenant.network[subnet]) != expHosts {
-			t.Fatalf("Missing IPs: expected %d, got %d", expHosts, len(tenant.network[subnet]))
-		}
-	}
-}
+	check(d, 2, "172.16.0.2", "172.16.0.6")
 
-func TestAllocate100IPs(t *testing.T) {
-	testAllocateTenantIPs(t, 100)
-}
+	// and addresses given out are no longer remembered as released
+	release(d, "172.16.0.2")
 
-func TestAllocate1024IPs(t *testing.T) {
-	testAllocateTenantIPs(t, 1024)
+	d.Exit()
+	d = openAllocationTestStore(t, uri+"?mode=rwc", datastore.IPAllocationLRU, now)
+	defer d.Exit()
+
+	check(d, 3, "172.16.0.4", "172.16.0.5", "172.16.0.2")
 }
 
 func TestAddBlockDevice(t *testing.T) {
-	newTenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	newTenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1339,7 +2587,7 @@ func TestAddBlockDevice(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1364,10 +2612,11 @@ func TestAddBlockDevice(t *testing.T) {
 }
 
 func TestDeleteBlockDevice(t *testing.T) {
-	newTenant, err := addTestTenant()
-	if err != nil {
-		t.Error(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	newTenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1380,7 +2629,7 @@ func TestDeleteBlockDevice(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1392,7 +2641,7 @@ func TestDeleteBlockDevice(t *testing.T) {
 	}
 
 	// remove the block device
-	err = ds.DeleteBlockDevice(data.ID)
+	err = ds.DeleteBlockDevice(context.Background(), data.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1404,17 +2653,18 @@ func TestDeleteBlockDevice(t *testing.T) {
 	}
 
 	// attempt to delete a non-existing block device
-	err = ds.DeleteBlockDevice("unknownID")
-	if err != ErrNoBlockData {
-		t.Fatalf("expecting %s error, received %s\n", ErrNoBlockData, err)
+	err = ds.DeleteBlockDevice(context.Background(), "unknownID")
+	if err != datastore.ErrNoBlockData {
+		t.Fatalf("expecting %s error, received %s\n", datastore.ErrNoBlockData, err)
 	}
 }
 
 func TestUpdateBlockDevice(t *testing.T) {
-	newTenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	newTenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
@@ -1427,7 +2677,7 @@ func TestUpdateBlockDevice(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1441,7 +2691,7 @@ func TestUpdateBlockDevice(t *testing.T) {
 	// update the state of the block device.
 	data.State = types.Attaching
 
-	err = ds.UpdateBlockDevice(data)
+	err = ds.UpdateBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1458,26 +2708,35 @@ func TestUpdateBlockDevice(t *testing.T) {
 }
 
 func TestGetBlockDevicesErr(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	// confirm that sending a bad tenant id results in error
 	_, err := ds.GetBlockDevices("badID")
-	if err != ErrNoTenant {
+	if err != datastore.ErrNoTenant {
 		t.Fatal(err)
 	}
 }
 
 func TestGetBlockDeviceErr(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	// confirm that we get the correct error for missing id
 	_, err := ds.GetBlockDevice("badID")
-	if err != ErrNoBlockData {
+	if err != datastore.ErrNoBlockData {
 		t.Fatal(err)
 	}
 }
 
 func TestUpdateBlockDeviceErr(t *testing.T) {
-	newTenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	newTenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
@@ -1491,17 +2750,18 @@ func TestUpdateBlockDeviceErr(t *testing.T) {
 	}
 
 	// confirm that we get the correct error for missing id
-	err = ds.UpdateBlockDevice(data)
-	if err != ErrNoBlockData {
+	err := ds.UpdateBlockDevice(context.Background(), data)
+	if err != datastore.ErrNoBlockData {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateStorageAttachment(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1514,7 +2774,7 @@ func TestCreateStorageAttachment(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1528,7 +2788,7 @@ func TestCreateStorageAttachment(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1538,7 +2798,7 @@ func TestCreateStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1556,10 +2816,11 @@ func TestCreateStorageAttachment(t *testing.T) {
 }
 
 func TestUpdateStorageAttachmentDeleted(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1572,43 +2833,141 @@ func TestUpdateStorageAttachmentDeleted(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
-	if err != nil {
-		t.Fatal(err)
+	err := ds.AddBlockDevice(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	instance, err := addTestInstance(ds, tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := payloads.StorageResource{
+		ID:        data.ID,
+		Ephemeral: false,
+		Bootable:  false,
+	}
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	datastore.DetachInstanceVolumes(ds, instance.ID)
+}
+
+func TestDeleteInstanceStorageAttachments(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatal("No Workloads Found")
+	}
+
+	instance, err := addTestInstance(ds, tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volumes := []payloads.StorageResource{
+		{ID: uuid.Generate().String(), Ephemeral: true},
+		{ID: uuid.Generate().String()},
+		{ID: uuid.Generate().String()},
+	}
+
+	for _, v := range volumes {
+		data := types.Volume{
+			BlockDevice: storage.BlockDevice{ID: v.ID},
+			State:       types.Available,
+			TenantID:    tenant.ID,
+			CreateTime:  time.Now(),
+		}
+
+		err = ds.AddBlockDevice(context.Background(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(ds.GetStorageAttachments(instance.ID)) != len(volumes) {
+		t.Fatal("Storage attachments not created")
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
+	err = ds.DeleteInstance(instance.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(wls) == 0 {
-		t.Fatal("No Workloads Found")
+	if len(ds.GetStorageAttachments(instance.ID)) != 0 {
+		t.Fatal("Storage attachments not deleted with instance")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	attachments, err := datastore.GetAllStorageAttachments(ds)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	volume := payloads.StorageResource{
-		ID:        data.ID,
-		Ephemeral: false,
-		Bootable:  false,
-	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
-	if err != nil {
-		t.Fatal(err)
+	for _, a := range attachments {
+		if a.InstanceID == instance.ID {
+			t.Fatalf("Storage attachment %s not deleted from database", a.ID)
+		}
 	}
 
-	ds.updateStorageAttachments(instance.ID)
+	for _, v := range volumes {
+		bd, err := ds.GetBlockDevice(v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := ds.GetVolumeAttachments(v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(a) != 0 {
+			t.Fatalf("Volume %s still attached", v.ID)
+		}
+
+		// ephemeral volumes are deleted by the controller, not
+		// made available.
+		if v.Ephemeral {
+			if bd.State != types.InUse {
+				t.Fatalf("Ephemeral volume %s state %s", v.ID, bd.State)
+			}
+		} else if bd.State != types.Available {
+			t.Fatalf("Volume %s not available: %s", v.ID, bd.State)
+		}
+	}
 }
 
 func TestGetStorageAttachment(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1621,7 +2980,7 @@ func TestGetStorageAttachment(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1635,7 +2994,7 @@ func TestGetStorageAttachment(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1645,12 +3004,12 @@ func TestGetStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	a, err := ds.getStorageAttachment(instance.ID, data.ID)
+	a, err := datastore.GetStorageAttachment(ds, instance.ID, data.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1661,10 +3020,11 @@ func TestGetStorageAttachment(t *testing.T) {
 }
 
 func TestGetStorageAttachmentError(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1677,7 +3037,7 @@ func TestGetStorageAttachmentError(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1691,22 +3051,23 @@ func TestGetStorageAttachmentError(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ds.getStorageAttachment(instance.ID, data.ID)
-	if err != ErrNoStorageAttachment {
+	_, err = datastore.GetStorageAttachment(ds, instance.ID, data.ID)
+	if err != datastore.ErrNoStorageAttachment {
 		t.Fatal(err)
 	}
 }
 
 func TestDeleteStorageAttachment(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1719,7 +3080,7 @@ func TestDeleteStorageAttachment(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1733,7 +3094,7 @@ func TestDeleteStorageAttachment(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1743,12 +3104,12 @@ func TestDeleteStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	a, err := ds.getStorageAttachment(instance.ID, data.ID)
+	a, err := datastore.GetStorageAttachment(ds, instance.ID, data.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1762,17 +3123,18 @@ func TestDeleteStorageAttachment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ds.getStorageAttachment(instance.ID, data.ID)
-	if err != ErrNoStorageAttachment {
+	_, err = datastore.GetStorageAttachment(ds, instance.ID, data.ID)
+	if err != datastore.ErrNoStorageAttachment {
 		t.Fatal(err)
 	}
 }
 
 func TestDeleteStorageAttachmentError(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: "validID",
@@ -1785,7 +3147,7 @@ func TestDeleteStorageAttachmentError(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1799,7 +3161,7 @@ func TestDeleteStorageAttachmentError(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1809,12 +3171,12 @@ func TestDeleteStorageAttachmentError(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	a, err := ds.getStorageAttachment(instance.ID, data.ID)
+	a, err := datastore.GetStorageAttachment(ds, instance.ID, data.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1828,22 +3190,23 @@ func TestDeleteStorageAttachmentError(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ds.getStorageAttachment(instance.ID, data.ID)
-	if err != ErrNoStorageAttachment {
+	_, err = datastore.GetStorageAttachment(ds, instance.ID, data.ID)
+	if err != datastore.ErrNoStorageAttachment {
 		t.Fatal(err)
 	}
 
 	err = ds.DeleteStorageAttachment(a.ID)
-	if err != ErrNoStorageAttachment {
+	if err != datastore.ErrNoStorageAttachment {
 		t.Fatal(err)
 	}
 }
 
 func TestGetVolumeAttachments(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
@@ -1856,7 +3219,7 @@ func TestGetVolumeAttachments(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = ds.AddBlockDevice(data)
+	err := ds.AddBlockDevice(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1870,7 +3233,7 @@ func TestGetVolumeAttachments(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1880,7 +3243,7 @@ func TestGetVolumeAttachments(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(context.Background(), instance.ID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1902,6 +3265,10 @@ func TestGetVolumeAttachments(t *testing.T) {
 }
 
 func TestAddPool(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -1942,7 +3309,7 @@ func TestAddPool(t *testing.T) {
 	}
 
 	err = ds.AddPool(pool3)
-	if err != types.ErrDuplicateSubnet {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("Duplicate subnet allowed")
 	}
 
@@ -1976,7 +3343,7 @@ func TestAddPool(t *testing.T) {
 	}
 
 	err = ds.AddPool(pool5)
-	if err != types.ErrDuplicateIP {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("Duplicate IP allowed")
 	}
 
@@ -1984,7 +3351,7 @@ func TestAddPool(t *testing.T) {
 	addr.Address = "192.168.0.1"
 	pool5.IPs = []types.ExternalIP{addr}
 	err = ds.AddPool(pool5)
-	if err != types.ErrDuplicateIP {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("Duplicate IP allowed")
 	}
 
@@ -2003,6 +3370,10 @@ func TestAddPool(t *testing.T) {
 }
 
 func TestGetPool(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2035,6 +3406,10 @@ func TestGetPool(t *testing.T) {
 }
 
 func TestAddExternalSubnet(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2069,7 +3444,7 @@ func TestAddExternalSubnet(t *testing.T) {
 	// try to add an overlapping subnet
 	overlap := "192.168.0.0/8"
 	err = ds.AddExternalSubnet(orig.ID, overlap)
-	if err != types.ErrDuplicateSubnet {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("overlapping subnet allowed")
 	}
 
@@ -2088,6 +3463,10 @@ func TestAddExternalSubnet(t *testing.T) {
 }
 
 func TestAddExternalIPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2123,14 +3502,14 @@ func TestAddExternalIPs(t *testing.T) {
 	// add a duplicate IP
 	IPs = []string{"192.168.0.1"}
 	err = ds.AddExternalIPs(orig.ID, IPs)
-	if err != types.ErrDuplicateIP {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("duplicate IP allowed")
 	}
 
 	// add duplicate in set
 	IPs = []string{"192.168.0.2", "192.168.0.2"}
 	err = ds.AddExternalIPs(orig.ID, IPs)
-	if err != types.ErrDuplicateIP {
+	if _, ok := err.(*types.RangeOverlapError); !ok {
 		t.Fatal("duplicate IP allowed")
 	}
 
@@ -2148,7 +3527,138 @@ func TestAddExternalIPs(t *testing.T) {
 	}
 }
 
+func TestAddPoolRangeOverlap(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	pools := []types.Pool{
+		{
+			ID:   uuid.Generate().String(),
+			Name: "subnets",
+			Subnets: []types.ExternalSubnet{
+				{ID: uuid.Generate().String(), CIDR: "10.1.0.0/24"},
+				{ID: uuid.Generate().String(), CIDR: "10.1.1.4/30"},
+			},
+		},
+		{
+			ID:   uuid.Generate().String(),
+			Name: "addresses",
+			IPs: []types.ExternalIP{
+				{ID: uuid.Generate().String(), Address: "10.2.0.1"},
+				{ID: uuid.Generate().String(), Address: "10.2.0.9"},
+			},
+		},
+	}
+
+	for _, pool := range pools {
+		err := ds.AddPool(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		subnet   string
+		ips      []string
+		conflict string
+		pool     string
+	}{
+		{"disjoint subnet", "10.3.0.0/24", nil, "", ""},
+		{"same subnet", "10.1.0.0/24", nil, "10.1.0.0/24", "subnets"},
+		{"enclosing subnet", "10.1.0.0/16", nil, "10.1.0.0/24", "subnets"},
+		{"enclosed subnet", "10.1.0.128/25", nil, "10.1.0.0/24", "subnets"},
+		{"enclosed /31", "10.1.1.6/31", nil, "10.1.1.4/30", "subnets"},
+		{"subnet with address", "10.2.0.8/30", nil, "10.2.0.9", "addresses"},
+		{"subnet without address", "10.2.0.4/30", nil, "", ""},
+		{"address in subnet", "", []string{"10.3.0.1", "10.1.0.255"}, "10.1.0.0/24", "subnets"},
+		{"address on /30", "", []string{"10.1.1.7"}, "10.1.1.4/30", "subnets"},
+		{"duplicate address", "", []string{"10.2.0.1"}, "10.2.0.1", "addresses"},
+		{"disjoint addresses", "", []string{"10.3.0.1", "10.3.0.2"}, "", ""},
+		{"repeated address", "", []string{"10.3.0.1", "10.3.0.1"}, "10.3.0.1", "new"},
+		{"address in new subnet", "", []string{"10.3.0.0/24", "10.3.0.5"}, "10.3.0.0/24", "new"},
+	}
+
+	for _, test := range tests {
+		pool := types.Pool{
+			ID:   uuid.Generate().String(),
+			Name: "new",
+		}
+
+		err := ds.AddPool(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.subnet != "" {
+			err = ds.AddExternalSubnet(pool.ID, test.subnet)
+		} else {
+			err = ds.AddExternalIPs(pool.ID, test.ips)
+		}
+
+		if test.conflict == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if e, ok := err.(*types.RangeOverlapError); !ok {
+			t.Errorf("%s: expected overlap error, got %v", test.name, err)
+		} else if e.Conflict != test.conflict || e.Pool != test.pool {
+			t.Errorf("%s: expected conflict with %s in %s, got %s in %s",
+				test.name, test.conflict, test.pool, e.Conflict, e.Pool)
+		}
+
+		err = ds.DeletePool(pool.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddExternalSubnetConcurrent(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	const count = 8
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		pool := types.Pool{
+			ID:   uuid.Generate().String(),
+			Name: fmt.Sprintf("pool%d", i),
+		}
+
+		err := ds.AddPool(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func(ID string) {
+			errs <- ds.AddExternalSubnet(ID, "10.4.0.0/24")
+		}(pool.ID)
+	}
+
+	added := 0
+	for i := 0; i < count; i++ {
+		err := <-errs
+		if err == nil {
+			added++
+		} else if _, ok := err.(*types.RangeOverlapError); !ok {
+			t.Errorf("Expected overlap error, got %v", err)
+		}
+	}
+
+	if added != 1 {
+		t.Errorf("Subnet added to %d pools", added)
+	}
+}
+
 func TestDeleteExternalSubnet(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2189,17 +3699,14 @@ func TestDeleteExternalSubnet(t *testing.T) {
 	}
 
 	// try to delete a mapped subnet
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2234,6 +3741,10 @@ func TestDeleteExternalSubnet(t *testing.T) {
 }
 
 func TestDeleteExternalIPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2268,17 +3779,14 @@ func TestDeleteExternalIPs(t *testing.T) {
 	}
 
 	// try to delete a mapped address
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2312,6 +3820,10 @@ func TestDeleteExternalIPs(t *testing.T) {
 }
 
 func TestMapIPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2334,17 +3846,14 @@ func TestMapIPs(t *testing.T) {
 	}
 
 	// prepare for map
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2396,7 +3905,104 @@ func TestMapIPs(t *testing.T) {
 	}
 }
 
+func TestMapExternalAddress(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	orig := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err := ds.AddPool(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(orig.ID, []string{"192.168.0.1", "192.168.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instances []*types.Instance
+	for i := 0; i < 2; i++ {
+		instance, err := addTestInstance(ds, tenant, wls[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, instance)
+	}
+
+	_, err = ds.MapExternalAddress(orig.ID, instances[0].ID, "192.168.1.2")
+	if err != types.ErrAddressNotInPool {
+		t.Fatalf("Expected %v got %v", types.ErrAddressNotInPool, err)
+	}
+
+	// two concurrent requests for the same address
+	var wg sync.WaitGroup
+	maps := make([]types.MappedIP, len(instances))
+	errs := make([]error, len(instances))
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			maps[i], errs[i] = ds.MapExternalAddress(orig.ID, instances[i].ID, "192.168.0.2")
+		}(i)
+	}
+	wg.Wait()
+
+	winner, loser := 0, 1
+	if errs[0] != nil {
+		winner, loser = 1, 0
+	}
+
+	if errs[winner] != nil {
+		t.Fatal(errs[winner])
+	}
+	if maps[winner].ExternalIP != "192.168.0.2" || maps[winner].InstanceID != instances[winner].ID {
+		t.Fatalf("Unexpected mapping %+v", maps[winner])
+	}
+
+	inUse, ok := errs[loser].(*types.AddressInUseError)
+	if !ok {
+		t.Fatalf("Expected address in use, got %v", errs[loser])
+	}
+	if inUse.InstanceID != instances[winner].ID {
+		t.Fatalf("Expected address to be mapped to %s, got %s", instances[winner].ID, inUse.InstanceID)
+	}
+
+	pool, err := ds.GetPool(orig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Free != 1 {
+		t.Fatalf("Expected 1 free address, got %d", pool.Free)
+	}
+
+	err = ds.UnMapExternalIP(maps[winner].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeletePool(orig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetMappedIPs(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
@@ -2419,17 +4025,14 @@ func TestGetMappedIPs(t *testing.T) {
 	}
 
 	// prepare for map
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2477,17 +4080,18 @@ func TestGetMappedIPs(t *testing.T) {
 }
 
 func TestDeleteWorkload(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	instance, err := addTestInstance(ds, tenant, wls[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2510,11 +4114,114 @@ func TestDeleteWorkload(t *testing.T) {
 	}
 }
 
+func TestCheckLoadedWorkload(t *testing.T) {
+	t.Parallel()
+
+	wl := types.Workload{
+		VMType:    payloads.Docker,
+		ImageName: "ubuntu:latest",
+		Config:    "---\n#cloud-config\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			MemMB: 128,
+		},
+	}
+
+	if err := datastore.CheckLoadedWorkload(&wl); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := wl
+	bad.Config = "users: [demouser\n"
+	if err := datastore.CheckLoadedWorkload(&bad); err == nil {
+		t.Fatal("Expected workload with invalid config to be rejected")
+	}
+
+	bad = wl
+	bad.Requirements.MemMB = 0
+	if _, ok := datastore.CheckLoadedWorkload(&bad).(*types.WorkloadValidationError); !ok {
+		t.Fatal("Expected invalid workload to be rejected")
+	}
+}
+
+func TestUpdateWorkload(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+	ds.GenerateCNCIWorkload(4, 128, 128, "")
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(ds, tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the config of a workload in use may be fixed
+	wl := wls[0]
+	wl.Config = wl.Config + "\n# fixed\n"
+	err = ds.UpdateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := ds.GetWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Config != wl.Config {
+		t.Fatal("Workload config not updated")
+	}
+
+	// but not its requirements
+	wl.Requirements.VCPUs++
+	err = ds.UpdateWorkload(wl)
+	if err != types.ErrWorkloadRequirementsInUse {
+		t.Fatalf("Expected %v, got %v", types.ErrWorkloadRequirementsInUse, err)
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.UpdateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciID, err := ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnci, err := ds.GetWorkload(cnciID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.UpdateWorkload(cnci)
+	if err != types.ErrCNCIWorkload {
+		t.Fatalf("Expected %v, got %v", types.ErrCNCIWorkload, err)
+	}
+
+	err = ds.DeleteWorkload(cnciID)
+	if err != types.ErrCNCIWorkload {
+		t.Fatalf("Expected %v, got %v", types.ErrCNCIWorkload, err)
+	}
+}
+
 func TestAddNamedInstance(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	wls, err := ds.GetWorkloads(tenant.ID)
 	if err != nil {
@@ -2525,7 +4232,7 @@ func TestAddNamedInstance(t *testing.T) {
 		t.Fatal("No Workloads Found")
 	}
 
-	_, err = addInstance(tenant, wls[0], "test-instance")
+	_, err = addInstance(ds, tenant, wls[0], "test-instance")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2554,10 +4261,11 @@ func TestAddNamedInstance(t *testing.T) {
 }
 
 func TestAddRemoveImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2566,7 +4274,7 @@ func TestAddRemoveImage(t *testing.T) {
 		TenantID:   tenant.ID,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2592,10 +4300,11 @@ func TestAddRemoveImage(t *testing.T) {
 }
 
 func TestAddRemovePublicImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2603,7 +4312,7 @@ func TestAddRemovePublicImage(t *testing.T) {
 		Visibility: types.Public,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2640,10 +4349,11 @@ func TestAddRemovePublicImage(t *testing.T) {
 }
 
 func TestAddRemoveInternalImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2651,7 +4361,7 @@ func TestAddRemoveInternalImage(t *testing.T) {
 		Visibility: types.Internal,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2696,10 +4406,11 @@ func TestAddRemoveInternalImage(t *testing.T) {
 }
 
 func TestAddRemoveDuplicateImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2708,7 +4419,7 @@ func TestAddRemoveDuplicateImage(t *testing.T) {
 		TenantID:   tenant.ID,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2735,10 +4446,11 @@ func TestAddRemoveDuplicateImage(t *testing.T) {
 }
 
 func TestAddRemoveDuplicateNameImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2747,7 +4459,7 @@ func TestAddRemoveDuplicateNameImage(t *testing.T) {
 		TenantID:   tenant.ID,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2776,10 +4488,11 @@ func TestAddRemoveDuplicateNameImage(t *testing.T) {
 }
 
 func TestResolveImage(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
 
 	i := types.Image{
 		ID:         uuid.Generate().String(),
@@ -2788,7 +4501,7 @@ func TestResolveImage(t *testing.T) {
 		TenantID:   tenant.ID,
 	}
 
-	err = ds.AddImage(i)
+	err := ds.AddImage(i)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2808,32 +4521,420 @@ func TestResolveImage(t *testing.T) {
 	}
 }
 
-var ds *Datastore
+func imageIDs(images []types.Image) map[string]bool {
+	ids := make(map[string]bool)
+	for _, i := range images {
+		ids[i.ID] = true
+	}
+	return ids
+}
+
+func TestImageVisibility(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenantA := addTestTenant(t, ds)
+
+	tenantB := addTestTenant(t, ds)
+
+	private := types.Image{
+		ID:         uuid.Generate().String(),
+		Name:       "private-image",
+		Visibility: types.Private,
+		TenantID:   tenantA.ID,
+	}
+	public := types.Image{
+		ID:         uuid.Generate().String(),
+		Name:       "public-image",
+		Visibility: types.Public,
+		TenantID:   tenantA.ID,
+	}
+	internal := types.Image{
+		ID:         uuid.Generate().String(),
+		Name:       "internal-image",
+		Visibility: types.Internal,
+	}
+
+	for _, i := range []types.Image{private, public, internal} {
+		err := ds.AddImage(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		tenantID string
+		admin    bool
+		visible  map[string]bool
+	}{
+		{tenantA.ID, false, map[string]bool{private.ID: true, public.ID: true}},
+		{tenantB.ID, false, map[string]bool{public.ID: true}},
+		{"", true, map[string]bool{public.ID: true, internal.ID: true}},
+	}
+
+	check := func() {
+		for _, tt := range tests {
+			images, err := ds.GetImages(tt.tenantID, tt.admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := imageIDs(images)
+			if len(ids) != len(images) {
+				t.Errorf("Duplicate images listed for %q: %v", tt.tenantID, images)
+			}
+
+			for _, i := range []types.Image{private, public, internal} {
+				if ids[i.ID] != tt.visible[i.ID] {
+					t.Errorf("Image %s visible to %q: %v, expected %v",
+						i.Name, tt.tenantID, ids[i.ID], tt.visible[i.ID])
+				}
+			}
+		}
+	}
+
+	check()
+
+	// share the private image and hide the public one
+	err := ds.SetImageVisibility(private.ID, types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := ds.GetImage(private.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Visibility != types.Public {
+		t.Errorf("Visibility not updated: %v", image.Visibility)
+	}
+
+	err = ds.SetImageVisibility(public.ID, types.Internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests = []struct {
+		tenantID string
+		admin    bool
+		visible  map[string]bool
+	}{
+		{tenantA.ID, false, map[string]bool{private.ID: true}},
+		{tenantB.ID, false, map[string]bool{private.ID: true}},
+		{"", true, map[string]bool{private.ID: true, public.ID: true, internal.ID: true}},
+	}
+
+	check()
+
+	// images without an owner cannot be made private
+	err = ds.SetImageVisibility(internal.ID, types.Private)
+	if err != types.ErrBadRequest {
+		t.Errorf("Expected bad request making unowned image private: %v", err)
+	}
+
+	err = ds.SetImageVisibility(internal.ID, types.Visibility("everyone"))
+	if err != types.ErrBadRequest {
+		t.Errorf("Expected bad request for invalid visibility: %v", err)
+	}
+
+	err = ds.SetImageVisibility(uuid.Generate().String(), types.Public)
+	if err != api.ErrNoImage {
+		t.Errorf("Expected image not found: %v", err)
+	}
+
+	for _, i := range []types.Image{private, public, internal} {
+		err = ds.DeleteImage(i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteImageInUse(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	i := types.Image{
+		ID:         uuid.Generate().String(),
+		Name:       "used-image",
+		Visibility: types.Private,
+		TenantID:   tenant.ID,
+	}
+
+	err := ds.AddImage(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, source := range []string{i.ID, i.Name} {
+		wl := types.Workload{
+			ID:       uuid.Generate().String(),
+			TenantID: tenant.ID,
+			VMType:   payloads.QEMU,
+			Storage: []types.StorageResource{{
+				Bootable:   true,
+				SourceType: types.ImageService,
+				Source:     source,
+			}},
+		}
 
-var workloadsPath = flag.String("workloads_path", "../../workloads", "path to yaml files")
+		err = ds.AddWorkload(wl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, wl.ID)
+	}
+	sort.Strings(ids)
 
-func TestMain(m *testing.M) {
-	flag.Parse()
+	err = ds.DeleteImage(i.ID)
+	inUse, ok := err.(*types.ImageInUseError)
+	if !ok {
+		t.Fatalf("Expected image in use error: %v", err)
+	}
+	if !reflect.DeepEqual(inUse.Workloads, ids) {
+		t.Errorf("Expected workloads %v got %v", ids, inUse.Workloads)
+	}
 
-	ds = new(Datastore)
+	if _, err = ds.GetImage(i.ID); err != nil {
+		t.Fatalf("Image in use was deleted: %v", err)
+	}
 
-	dsConfig := Config{
-		DBBackend:         &MemoryDB{},
-		PersistentURI:     "file:memdb1?mode=memory&cache=shared",
-		InitWorkloadsPath: *workloadsPath,
+	for _, id := range ids {
+		err = ds.DeleteWorkload(id)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	err := ds.Init(dsConfig)
+	err = ds.DeleteImage(i.ID)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
+		t.Fatal(err)
 	}
+}
 
+func TestCNCIImageRollback(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
 	ds.GenerateCNCIWorkload(4, 128, 128, "")
 
-	code := m.Run()
+	orig := ds.GetCNCIImage()
+
+	imageID := uuid.Generate().String()
+	image, err := ds.RegisterCNCIImage(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Image != imageID || image.PreviousImage != orig.Image {
+		t.Fatalf("Unexpected CNCI image %+v", image)
+	}
+
+	workloadID, err := ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ds.GetWorkload(workloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wl.Storage[0].Source != imageID {
+		t.Fatalf("CNCI workload not updated: %s", wl.Storage[0].Source)
+	}
+
+	image, err = ds.RollbackCNCIImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Image != orig.Image || image.PreviousImage != imageID {
+		t.Fatalf("Unexpected CNCI image after rollback %+v", image)
+	}
+
+	if ds.GetCNCIImage() != image {
+		t.Fatalf("Rollback not applied: %+v", ds.GetCNCIImage())
+	}
+}
+
+func TestAddDeleteWebhook(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	w := types.Webhook{
+		ID:    uuid.Generate().String(),
+		URL:   "https://example.com/hook",
+		State: types.WebhookActive,
+	}
+
+	err := ds.AddWebhook(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddWebhook(w)
+	if err != api.ErrAlreadyExists {
+		t.Fatal("Expected error when adding duplicate")
+	}
+
+	w.State = types.WebhookDeadLetter
+	err = ds.UpdateWebhook(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := ds.GetWebhook(w.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w2.State != types.WebhookDeadLetter {
+		t.Fatalf("Expected state %s got %s", types.WebhookDeadLetter, w2.State)
+	}
+
+	err = ds.DeleteWebhook(w.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetWebhook(w.ID)
+	if err != types.ErrWebhookNotFound {
+		t.Fatal("Expected error on retrieval of deleted webhook")
+	}
+
+	err = ds.UpdateWebhook(w)
+	if err != types.ErrWebhookNotFound {
+		t.Fatal("Expected error on update of deleted webhook")
+	}
+}
+
+// usageSpansOf returns the usage spans of a tenant keyed by resource ID.
+func usageSpansOf(t *testing.T, ds *datastore.Datastore, tenantID string) map[string]types.UsageSpan {
+	spans, err := ds.UsageSpans()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantSpans := make(map[string]types.UsageSpan)
+	for _, s := range spans {
+		if s.TenantID != tenantID {
+			continue
+		}
+
+		if _, ok := tenantSpans[s.ID]; ok {
+			t.Fatalf("Duplicate span for %s", s.ID)
+		}
+		tenantSpans[s.ID] = s
+	}
+
+	return tenantSpans
+}
+
+func TestUsageSpans(t *testing.T) {
+	t.Parallel()
+
+	ds := datastoretest.New(t)
+
+	tenant := addTestTenant(t, ds)
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(ds, tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.CreateTime = time.Now().Add(-time.Hour)
+
+	volume := types.Volume{
+		BlockDevice: storage.BlockDevice{
+			ID:   uuid.Generate().String(),
+			Size: 20,
+		},
+		State:      types.Available,
+		TenantID:   tenant.ID,
+		CreateTime: time.Now().Add(-2 * time.Hour),
+	}
+
+	err = ds.AddBlockDevice(context.Background(), volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal := volume
+	internal.ID = uuid.Generate().String()
+	internal.Internal = true
+
+	err = ds.AddBlockDevice(context.Background(), internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tenant's CNCI and internal volumes are not billed
+	spans := usageSpansOf(t, ds, tenant.ID)
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans got %+v", spans)
+	}
+
+	s := spans[instance.ID]
+	if s.Resource != types.UsageInstance || !s.Start.Equal(instance.CreateTime) || !s.End.IsZero() {
+		t.Fatalf("Unexpected instance span %+v", s)
+	}
+
+	s = spans[volume.ID]
+	if s.Resource != types.UsageVolume || s.SizeGB != 20 || !s.Start.Equal(volume.CreateTime) || !s.End.IsZero() {
+		t.Fatalf("Unexpected volume span %+v", s)
+	}
+
+	before := time.Now()
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteBlockDevice(context.Background(), volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteBlockDevice(context.Background(), internal.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// released resources keep their spans until they are pruned
+	spans = usageSpansOf(t, ds, tenant.ID)
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans got %+v", spans)
+	}
+
+	for _, s := range spans {
+		if s.End.Before(before) || s.End.After(time.Now()) {
+			t.Fatalf("Unexpected end of released span %+v", s)
+		}
+	}
+
+	if spans[volume.ID].SizeGB != 20 || !spans[instance.ID].Start.Equal(instance.CreateTime) {
+		t.Fatalf("Unexpected released spans %+v", spans)
+	}
 
-	ds.Exit()
+	_, err = ds.PruneReleasedUsage(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	os.Exit(code)
+	spans = usageSpansOf(t, ds, tenant.ID)
+	if len(spans) != 0 {
+		t.Fatalf("Unexpected spans after pruning %+v", spans)
+	}
 }
@@ -0,0 +1,113 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package datastoretest provides fixtures for tests which need a Datastore.
+// Each Datastore is backed by its own in-memory sqlite database so tests
+// using them can run in any order and in parallel.
+package datastoretest
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// TestConfig is the cloud-config used by workloads created by AddWorkload.
+const TestConfig = `---
+#cloud-config
+users:
+  - name: demouser
+    gecos: CIAO Demo User
+    lock-passwd: false
+    sudo: ALL=(ALL) NOPASSWD:ALL
+...
+`
+
+// New returns an empty Datastore backed by a private in-memory database.
+// The Datastore is shut down when the test completes.
+func New(t testing.TB) *datastore.Datastore {
+	return NewWithClock(t, nil)
+}
+
+// NewWithClock is New with a clock replacing time.Now when the Datastore
+// records the release of billable resources.
+func NewWithClock(t testing.TB, now func() time.Time) *datastore.Datastore {
+	ds := &datastore.Datastore{}
+	config := datastore.Config{
+		PersistentURI:     fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.Generate()),
+		InitWorkloadsPath: filepath.Join(t.TempDir(), "workloads"),
+		Now:               now,
+	}
+
+	err := ds.Init(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ds.Exit)
+
+	return ds
+}
+
+// AddTenant adds a tenant with a /24 subnet and no CNCI to ds.
+func AddTenant(t testing.TB, ds *datastore.Datastore) *types.Tenant {
+	config := types.TenantConfig{
+		Name:       "test tenant",
+		SubnetBits: 24,
+	}
+
+	tenant, err := ds.AddTenant(uuid.Generate().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tenant
+}
+
+// AddWorkload adds a private VM workload for tenantID to ds. The workload
+// requires 2 VCPUs and 512MB and has an empty 20GB ephemeral volume.
+func AddWorkload(t testing.TB, ds *datastore.Datastore, tenantID string) types.Workload {
+	wl := types.Workload{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		Description: fmt.Sprintf("Private workload for %s", tenantID),
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      TestConfig,
+		Visibility:  types.Private,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Storage: []types.StorageResource{
+			{
+				Ephemeral:  true,
+				Size:       20,
+				SourceType: types.Empty,
+			},
+		},
+	}
+
+	err := ds.AddWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wl
+}
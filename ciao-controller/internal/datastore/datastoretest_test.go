@@ -0,0 +1,52 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore/datastoretest"
+)
+
+func TestFixturesIsolated(t *testing.T) {
+	t.Parallel()
+
+	a := datastoretest.New(t)
+	b := datastoretest.New(t)
+
+	tenant := datastoretest.AddTenant(t, a)
+	wl := datastoretest.AddWorkload(t, a, tenant.ID)
+
+	tenants, err := b.GetAllTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 0 {
+		t.Fatalf("Tenants leaked between fixtures: %v", tenants)
+	}
+
+	_, err = b.GetWorkload(wl.ID)
+	if err == nil {
+		t.Fatal("Workload leaked between fixtures")
+	}
+
+	got, err := a.GetWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TenantID != tenant.ID || got.Requirements != wl.Requirements {
+		t.Fatalf("Unexpected workload %+v", got)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+)
+
+// eventQueueSize is the maximum number of events waiting to be written to
+// the event log.  When the queue is full the events of the lowest severity
+// are dropped to make room for more severe ones.
+var eventQueueSize = 4096
+
+// eventFlushInterval is the minimum time between two writes of queued
+// events, which bounds the rate of transactions a burst of events causes.
+var eventFlushInterval = 100 * time.Millisecond
+
+// numSeverities is the number of event severities, see eventSeverity.
+const numSeverities = 3
+
+// eventSeverity ranks the types of event.  Errors are the most severe,
+// followed by the actions of users and then informational events.
+func eventSeverity(eventType string) int {
+	switch userEventType(eventType) {
+	case userError:
+		return 2
+	case userAction:
+		return 1
+	}
+	return 0
+}
+
+type queuedEvent struct {
+	seq   uint64
+	entry types.LogEntry
+}
+
+// eventQueue buffers the events to be added to the event log so that the
+// callers logging them do not wait for the persistent store.  The events
+// are written in batches, one transaction per batch, by a dedicated
+// goroutine.
+type eventQueue struct {
+	db      persistentStore
+	log     clogger.CiaoLog
+	dropped func(eventType string)
+	logged  func(events []types.LogEntry)
+
+	// lock protects pending, count and seq.  pending holds the queued
+	// events of each severity in the order they were queued.
+	lock    sync.Mutex
+	pending [numSeverities][]queuedEvent
+	count   int
+	seq     uint64
+
+	// flushLock serialises the writes so that the events are added to
+	// the log in the order they were queued.
+	flushLock sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newEventQueue(db persistentStore, log clogger.CiaoLog, dropped func(eventType string),
+	logged func(events []types.LogEntry)) *eventQueue {
+	q := &eventQueue{
+		db:      db,
+		log:     log,
+		dropped: dropped,
+		logged:  logged,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// add queues an event for the event log.  It never blocks on the
+// persistent store.  If the queue is full the oldest of the queued events
+// which are less severe than e is dropped, or e itself if there are none.
+func (q *eventQueue) add(e types.LogEntry) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	severity := eventSeverity(e.EventType)
+	dropped := ""
+
+	q.lock.Lock()
+	if q.count >= eventQueueSize {
+		victim := severity
+		for s := 0; s < severity; s++ {
+			if len(q.pending[s]) > 0 {
+				victim = s
+				break
+			}
+		}
+
+		if victim == severity {
+			q.lock.Unlock()
+			q.drop(e.EventType)
+			return
+		}
+
+		dropped = q.pending[victim][0].entry.EventType
+		q.pending[victim] = q.pending[victim][1:]
+		q.count--
+	}
+
+	q.seq++
+	q.pending[severity] = append(q.pending[severity], queuedEvent{seq: q.seq, entry: e})
+	q.count++
+	q.lock.Unlock()
+
+	if dropped != "" {
+		q.drop(dropped)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) drop(eventType string) {
+	if q.dropped != nil {
+		q.dropped(eventType)
+	}
+}
+
+// take removes all the queued events, in the order they were queued.
+func (q *eventQueue) take() []types.LogEntry {
+	q.lock.Lock()
+	var queued []queuedEvent
+	for s := range q.pending {
+		queued = append(queued, q.pending[s]...)
+		q.pending[s] = nil
+	}
+	q.count = 0
+	q.lock.Unlock()
+
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].seq < queued[j].seq
+	})
+
+	events := make([]types.LogEntry, len(queued))
+	for i := range queued {
+		events[i] = queued[i].entry
+	}
+
+	return events
+}
+
+// flush writes the queued events to the event log.  It is called by the
+// writer and before the event log is read so that readers see the events
+// logged before they started.
+func (q *eventQueue) flush() {
+	q.flushLock.Lock()
+	defer q.flushLock.Unlock()
+
+	events := q.take()
+	if len(events) == 0 {
+		return
+	}
+
+	if err := q.db.logEvents(events); err != nil {
+		q.log.Warningf("Unable to write %d events to the event log: %v", len(events), err)
+		return
+	}
+
+	if q.logged != nil {
+		q.logged(events)
+	}
+}
+
+// run writes the queued events at most once per eventFlushInterval until
+// the queue is closed.
+func (q *eventQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			q.flush()
+			return
+		}
+
+		q.flush()
+
+		select {
+		case <-time.After(eventFlushInterval):
+		case <-q.stop:
+			q.flush()
+			return
+		}
+	}
+}
+
+// close stops the writer once it has written all the queued events.
+func (q *eventQueue) close() {
+	close(q.stop)
+	<-q.done
+}
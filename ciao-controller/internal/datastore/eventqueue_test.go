@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+func TestEventQueueDropsLowestSeverity(t *testing.T) {
+	saved := eventQueueSize
+	eventQueueSize = 4
+	defer func() { eventQueueSize = saved }()
+
+	var dropped []string
+
+	// the writer is not started so nothing leaves the queue until it
+	// is taken.
+	q := &eventQueue{
+		db:      &MemoryDB{},
+		dropped: func(eventType string) { dropped = append(dropped, eventType) },
+		wake:    make(chan struct{}, 1),
+	}
+
+	for _, e := range []struct {
+		t   userEventType
+		msg string
+	}{
+		{userInfo, "info1"},
+		{userInfo, "info2"},
+		{userAction, "action1"},
+		{userError, "error1"},
+		{userError, "error2"},
+		{userAction, "action2"},
+		{userInfo, "info3"},
+		{userError, "error3"},
+	} {
+		q.add(types.LogEntry{EventType: string(e.t), Message: e.msg})
+	}
+
+	expectedDropped := []string{"info", "info", "info", "action"}
+	if !reflect.DeepEqual(dropped, expectedDropped) {
+		t.Errorf("Expected %v dropped got %v", expectedDropped, dropped)
+	}
+
+	var messages []string
+	for _, e := range q.take() {
+		messages = append(messages, e.Message)
+		if e.Timestamp.IsZero() {
+			t.Errorf("Event %s has no timestamp", e.Message)
+		}
+	}
+
+	expected := []string{"error1", "error2", "action2", "error3"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v queued got %v", expected, messages)
+	}
+
+	if len(q.take()) != 0 {
+		t.Errorf("Events left in queue")
+	}
+}
+
+func TestEventQueueDrainOnClose(t *testing.T) {
+	db := &MemoryDB{}
+	q := newEventQueue(db, nil, nil, nil)
+
+	for i := 0; i < 1000; i++ {
+		q.add(types.LogEntry{EventType: string(userInfo), Message: fmt.Sprintf("%d", i)})
+	}
+
+	q.close()
+
+	if len(db.logEntries) != 1000 {
+		t.Fatalf("Expected 1000 events written got %d", len(db.logEntries))
+	}
+
+	for i, e := range db.logEntries {
+		if e.Message != fmt.Sprintf("%d", i) {
+			t.Fatalf("Expected event %d got %s", i, e.Message)
+		}
+	}
+}
+
+func TestEventQueueLogged(t *testing.T) {
+	logged := make(chan []types.LogEntry, 10)
+
+	db := &MemoryDB{}
+	q := newEventQueue(db, nil, nil, func(events []types.LogEntry) { logged <- events })
+
+	q.add(types.LogEntry{EventType: string(userInfo), Message: "first"})
+	q.flush()
+	q.add(types.LogEntry{EventType: string(userInfo), Message: "second"})
+	q.close()
+	close(logged)
+
+	var IDs []int64
+	for events := range logged {
+		for _, e := range events {
+			IDs = append(IDs, e.ID)
+		}
+	}
+
+	if !reflect.DeepEqual(IDs, []int64{1, 2}) {
+		t.Fatalf("Expected events 1 and 2 reported logged got %v", IDs)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package datastore
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+const (
+	InstanceStateEvent = instanceState
+	VolumeStateEvent   = volumeState
+	NodeStatusEvent    = nodeStatus
+)
+
+var CreateTestFrameTraces = createTestFrameTraces
+var CheckLoadedWorkload = checkLoadedWorkload
+
+var GetStorageAttachment = (*Datastore).getStorageAttachment
+var DetachInstanceVolumes = (*Datastore).detachInstanceVolumes
+
+// GetAllStorageAttachments returns the storage attachments recorded in the
+// database.
+func GetAllStorageAttachments(ds *Datastore) (map[string]types.StorageAttachment, error) {
+	return ds.db.getAllStorageAttachments()
+}
+
+// GetTenantNoCache reads a tenant from the database.
+func GetTenantNoCache(ds *Datastore, tenantID string) error {
+	_, err := ds.db.getTenant(tenantID)
+	return err
+}
+
+// EvictTenant drops a tenant from the cache so that it is read from the
+// database.
+func EvictTenant(ds *Datastore, tenantID string) {
+	ds.tenantsLock.Lock()
+	delete(ds.tenants, tenantID)
+	ds.tenantsLock.Unlock()
+}
+
+// TenantIPClaimed reports whether ip is marked in use in the network of a
+// tenant.
+func TenantIPClaimed(ds *Datastore, tenantID string, ip net.IP) (bool, error) {
+	t, err := ds.getTenant(tenantID)
+	if err != nil {
+		return false, err
+	}
+
+	mask := binary.BigEndian.Uint32(net.CIDRMask(t.SubnetBits, 32))
+	hostInt := binary.BigEndian.Uint32(ip.To4())
+
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
+
+	return t.network[hostInt&mask][hostInt], nil
+}
+
+// TenantSubnetHosts returns the number of hosts in each subnet of the
+// network of a tenant, in subnet order.
+func TenantSubnetHosts(ds *Datastore, tenantID string) ([]int, error) {
+	t, err := ds.getTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
+
+	var subnets []uint32
+	for k := range t.network {
+		subnets = append(subnets, k)
+	}
+
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i] < subnets[j] })
+
+	hosts := make([]int, len(subnets))
+	for i, subnet := range subnets {
+		hosts[i] = len(t.network[subnet])
+	}
+
+	return hosts, nil
+}
@@ -16,7 +16,11 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
@@ -31,7 +35,21 @@ type MemoryDB struct {
 	blockDevices    map[string]types.Volume
 	attachments     map[string]types.StorageAttachment
 	instanceVolumes map[attachment]string
-	logEntries      []*types.LogEntry
+	placements      map[string][]types.Placement
+	conditions      map[string][]types.InstanceCondition
+	instanceTags    map[string]map[string]string
+	history         map[string][]types.InstanceHistoryEntry
+	historyOwners   map[string]string
+
+	// logLock protects the event log, which is written by the event
+	// queue's writer.
+	logLock    sync.Mutex
+	logEntries []*types.LogEntry
+	lastLogID  int64
+
+	usageLock     sync.Mutex
+	usageReleased map[string]types.UsageSpan
+	usageRecords  map[string]types.UsageRecord
 
 	workloadsPath string
 }
@@ -54,6 +72,13 @@ func (db *MemoryDB) init(config Config) error {
 	db.blockDevices = make(map[string]types.Volume)
 	db.attachments = make(map[string]types.StorageAttachment)
 	db.instanceVolumes = make(map[attachment]string)
+	db.placements = make(map[string][]types.Placement)
+	db.conditions = make(map[string][]types.InstanceCondition)
+	db.instanceTags = make(map[string]map[string]string)
+	db.history = make(map[string][]types.InstanceHistoryEntry)
+	db.historyOwners = make(map[string]string)
+	db.usageReleased = make(map[string]types.UsageSpan)
+	db.usageRecords = make(map[string]types.UsageRecord)
 
 	db.workloadsPath = config.InitWorkloadsPath
 	return db.fillWorkloads()
@@ -64,27 +89,82 @@ func (db *MemoryDB) disconnect() {
 }
 
 func (db *MemoryDB) logEvent(entry types.LogEntry) error {
+	db.logLock.Lock()
+	defer db.logLock.Unlock()
+
+	db.appendLogEntry(entry)
+	return nil
+}
+
+func (db *MemoryDB) appendLogEntry(entry types.LogEntry) {
+	db.lastLogID++
+	entry.ID = db.lastLogID
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
 	db.logEntries = append(db.logEntries, &entry)
+}
+
+func (db *MemoryDB) logEvents(events []types.LogEntry) error {
+	db.logLock.Lock()
+	defer db.logLock.Unlock()
+
+	for i := range events {
+		db.appendLogEntry(events[i])
+		events[i].ID = db.lastLogID
+	}
 
 	return nil
 }
 
 func (db *MemoryDB) clearLog() error {
+	db.logLock.Lock()
 	db.logEntries = nil
+	db.logLock.Unlock()
 	return nil
 }
 
 func (db *MemoryDB) getEventLog() ([]*types.LogEntry, error) {
-	return db.logEntries, nil
+	db.logLock.Lock()
+	defer db.logLock.Unlock()
+
+	return append([]*types.LogEntry(nil), db.logEntries...), nil
 }
 
-func (db *MemoryDB) addTenant(id string, config types.TenantConfig) error {
+func (db *MemoryDB) getEventsForTenant(tenantID string, filter types.EventFilter) ([]*types.LogEntry, error) {
+	db.logLock.Lock()
+	defer db.logLock.Unlock()
+
+	logEntries := make([]*types.LogEntry, 0)
+
+	for _, e := range db.logEntries {
+		if tenantID != "" && e.TenantID != tenantID ||
+			e.ID <= filter.Marker ||
+			!filter.Start.IsZero() && e.Timestamp.Before(filter.Start) ||
+			!filter.End.IsZero() && !e.Timestamp.Before(filter.End) ||
+			filter.Type != "" && e.EventType != filter.Type ||
+			filter.ObjectID != "" && e.ObjectID != filter.ObjectID {
+			continue
+		}
+
+		logEntries = append(logEntries, e)
+		if filter.Limit > 0 && len(logEntries) >= filter.Limit {
+			break
+		}
+	}
+
+	return logEntries, nil
+}
+
+func (db *MemoryDB) addTenant(id string, config types.TenantConfig, qds ...types.QuotaDetails) error {
 	t := &tenant{
 		Tenant: types.Tenant{
 			ID: id,
 			TenantConfig: types.TenantConfig{
 				Name:       config.Name,
 				SubnetBits: config.SubnetBits,
+				MaxSubnets: config.MaxSubnets,
+				CNCISize:   config.CNCISize,
 			},
 		},
 		network:   make(map[uint32]map[uint32]bool),
@@ -111,7 +191,7 @@ func (db *MemoryDB) getTenants() ([]*tenant, error) {
 	return tenants, nil
 }
 
-func (db *MemoryDB) releaseTenantIP(tenantID string, subnetInt uint32, rest uint32) error {
+func (db *MemoryDB) releaseTenantIP(tenantID string, subnetInt uint32, rest uint32, released time.Time) error {
 	return nil
 }
 
@@ -131,11 +211,107 @@ func (db *MemoryDB) getInstances() ([]*types.Instance, error) {
 	return instances, nil
 }
 
-func (db *MemoryDB) addInstance(instance *types.Instance) error {
-	return nil
+func (db *MemoryDB) addInstance(ctx context.Context, instance *types.Instance) error {
+	return ctx.Err()
 }
 
 func (db *MemoryDB) deleteInstance(instanceID string) error {
+	delete(db.placements, instanceID)
+	delete(db.conditions, instanceID)
+	delete(db.instanceTags, instanceID)
+	return nil
+}
+
+func (db *MemoryDB) addPlacement(instanceID string, p types.Placement) error {
+	db.placements[instanceID] = append(db.placements[instanceID], p)
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceNode(instanceID string, nodeID string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceStatusReason(instanceID string, reason string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceDeleteTime(ctx context.Context, instanceID string, deleteTime time.Time) error {
+	return ctx.Err()
+}
+
+func (db *MemoryDB) updateInstanceTenant(instanceID string, tenantID string, subnet string) error {
+	return nil
+}
+
+func (db *MemoryDB) getPlacements(instanceID string) ([]types.Placement, error) {
+	return append([]types.Placement{}, db.placements[instanceID]...), nil
+}
+
+func (db *MemoryDB) getInstanceConditions() (map[string][]types.InstanceCondition, error) {
+	conditions := make(map[string][]types.InstanceCondition)
+	for k, v := range db.conditions {
+		conditions[k] = append([]types.InstanceCondition(nil), v...)
+	}
+	return conditions, nil
+}
+
+func (db *MemoryDB) getInstanceTags() (map[string]map[string]string, error) {
+	tags := make(map[string]map[string]string)
+	for instanceID, t := range db.instanceTags {
+		tags[instanceID] = make(map[string]string)
+		for k, v := range t {
+			tags[instanceID][k] = v
+		}
+	}
+	return tags, nil
+}
+
+func (db *MemoryDB) setInstanceTag(instanceID string, key string, value string) error {
+	if db.instanceTags[instanceID] == nil {
+		db.instanceTags[instanceID] = make(map[string]string)
+	}
+	db.instanceTags[instanceID][key] = value
+	return nil
+}
+
+func (db *MemoryDB) deleteInstanceTag(instanceID string, key string) error {
+	delete(db.instanceTags[instanceID], key)
+	return nil
+}
+
+func (db *MemoryDB) addHistoryEntry(instanceID string, tenantID string, e types.InstanceHistoryEntry) error {
+	db.history[instanceID] = append(db.history[instanceID], e)
+	db.historyOwners[instanceID] = tenantID
+	return nil
+}
+
+func (db *MemoryDB) getHistory(instanceID string) (string, []types.InstanceHistoryEntry, error) {
+	return db.historyOwners[instanceID], append([]types.InstanceHistoryEntry{}, db.history[instanceID]...), nil
+}
+
+func (db *MemoryDB) getLastHistoryEntries() (map[string]historyOwner, error) {
+	last := make(map[string]historyOwner)
+	for instanceID, entries := range db.history {
+		last[instanceID] = historyOwner{
+			tenantID:  db.historyOwners[instanceID],
+			timestamp: entries[len(entries)-1].Timestamp,
+		}
+	}
+	return last, nil
+}
+
+func (db *MemoryDB) deleteHistory(instanceID string) error {
+	delete(db.history, instanceID)
+	delete(db.historyOwners, instanceID)
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceConditions(instanceID string, conditions []types.InstanceCondition) error {
+	if len(conditions) == 0 {
+		delete(db.conditions, instanceID)
+		return nil
+	}
+	db.conditions[instanceID] = append([]types.InstanceCondition(nil), conditions...)
 	return nil
 }
 
@@ -155,6 +331,10 @@ func (db *MemoryDB) getBatchFrameSummary() ([]types.BatchFrameSummary, error) {
 	return nil, nil
 }
 
+func (db *MemoryDB) getNodeInstanceSummary(nodeID string) (types.CiaoNodeSummary, error) {
+	return types.CiaoNodeSummary{ID: nodeID}, nil
+}
+
 func (db *MemoryDB) getBatchFrameStatistics(label string) ([]types.BatchFrameStat, error) {
 	return nil, nil
 }
@@ -167,23 +347,35 @@ func (db *MemoryDB) getAllBlockData() (map[string]types.Volume, error) {
 	return db.blockDevices, nil
 }
 
-func (db *MemoryDB) addBlockData(data types.Volume) error {
-	return nil
+func (db *MemoryDB) addBlockData(ctx context.Context, data types.Volume) error {
+	return ctx.Err()
 }
 
-func (db *MemoryDB) updateBlockData(types.Volume) error {
-	return nil
+func (db *MemoryDB) updateBlockData(ctx context.Context, data types.Volume) error {
+	return ctx.Err()
 }
 
-func (db *MemoryDB) deleteBlockData(string) error {
-	return nil
+func (db *MemoryDB) updateBlockDeletionProtection(ctx context.Context, ID string, protected bool) error {
+	return ctx.Err()
+}
+
+func (db *MemoryDB) updateBlockSize(ctx context.Context, ID string, size int) error {
+	return ctx.Err()
+}
+
+func (db *MemoryDB) deleteBlockData(ctx context.Context, ID string) error {
+	return ctx.Err()
 }
 
 func (db *MemoryDB) getTenantDevices(tenantID string) (map[string]types.Volume, error) {
 	return nil, nil
 }
 
-func (db *MemoryDB) addStorageAttachment(a types.StorageAttachment) error {
+func (db *MemoryDB) addStorageAttachment(ctx context.Context, a types.StorageAttachment) error {
+	return ctx.Err()
+}
+
+func (db *MemoryDB) updateStorageAttachmentDevice(ID string, device string) error {
 	return nil
 }
 
@@ -191,6 +383,10 @@ func (db *MemoryDB) getAllStorageAttachments() (map[string]types.StorageAttachme
 	return db.attachments, nil
 }
 
+func (db *MemoryDB) getAttachmentDetails(filter types.AttachmentFilter) ([]types.AttachmentDetails, error) {
+	return []types.AttachmentDetails{}, nil
+}
+
 func (db *MemoryDB) deleteStorageAttachment(ID string) error {
 	return nil
 }
@@ -211,7 +407,7 @@ func (db *MemoryDB) getAllPools() map[string]types.Pool {
 	return make(map[string]types.Pool)
 }
 
-func (db *MemoryDB) addMappedIP(m types.MappedIP) error {
+func (db *MemoryDB) addMappedIP(m types.MappedIP, free int) error {
 	return nil
 }
 
@@ -227,6 +423,10 @@ func (db *MemoryDB) addWorkload(wl types.Workload) error {
 	return nil
 }
 
+func (db *MemoryDB) updateWorkload(wl types.Workload) error {
+	return nil
+}
+
 func (db *MemoryDB) deleteWorkload(ID string) error {
 	return nil
 }
@@ -247,6 +447,30 @@ func (db *MemoryDB) updateInstance(instance *types.Instance) error {
 	return nil
 }
 
+func (db *MemoryDB) updateInstanceName(instanceID string, name string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceDescription(instanceID string, description string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceDeletionProtection(instanceID string, protected bool) error {
+	return nil
+}
+
+func (db *MemoryDB) updateInstanceRequirements(instanceID string, vcpus int, memMB int) error {
+	return nil
+}
+
+func (db *MemoryDB) filterInstances(tenantID string, match types.InstanceFilter) ([]string, error) {
+	return nil, nil
+}
+
+func (db *MemoryDB) searchWorkloads(tenantID string, search string) ([]string, error) {
+	return nil, nil
+}
+
 func (db *MemoryDB) updateTenant(tenant *types.Tenant) error {
 	return nil
 }
@@ -267,3 +491,388 @@ func (db *MemoryDB) updateImage(i types.Image) error {
 func (db *MemoryDB) deleteImage(ID string) error {
 	return nil
 }
+
+func (db *MemoryDB) getWebhooks() ([]types.Webhook, error) {
+	return []types.Webhook{}, nil
+}
+
+func (db *MemoryDB) updateWebhook(w types.Webhook) error {
+	return nil
+}
+
+func (db *MemoryDB) acquireLease(name string, holder string, address string, expiry time.Time, now time.Time) (types.LeaderLease, error) {
+	return types.LeaderLease{
+		Name:    name,
+		Holder:  holder,
+		Address: address,
+		Expiry:  expiry,
+	}, nil
+}
+
+func (db *MemoryDB) releaseLease(name string, holder string) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteWebhook(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getOperations() ([]types.Operation, error) {
+	return []types.Operation{}, nil
+}
+
+func (db *MemoryDB) updateOperation(o types.Operation) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteOperation(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getTrashItems() ([]types.TrashItem, error) {
+	return []types.TrashItem{}, nil
+}
+
+func (db *MemoryDB) addTrashItem(item types.TrashItem) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteTrashItem(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getCNCIImage() (types.CNCIImage, error) {
+	return types.CNCIImage{}, nil
+}
+
+func (db *MemoryDB) updateCNCIImage(i types.CNCIImage) error {
+	return nil
+}
+
+func (db *MemoryDB) getCNCIInstanceImages() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (db *MemoryDB) updateCNCIInstanceImage(instanceID string, imageID string) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteCNCIInstanceImage(instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getLaunchConfig(instanceID string) (string, error) {
+	return "", types.ErrLaunchConfigNotFound
+}
+
+func (db *MemoryDB) updateLaunchConfig(ctx context.Context, instanceID string, config string) error {
+	return ctx.Err()
+}
+
+func (db *MemoryDB) deleteLaunchConfig(instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateTenantCA(ca types.TenantCA) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteTenantCA(tenantID string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateLaunchTemplate(t types.LaunchTemplate) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteLaunchTemplate(tenantID string, name string) error {
+	return nil
+}
+
+func (db *MemoryDB) getLaunchTemplates() ([]types.LaunchTemplate, error) {
+	return []types.LaunchTemplate{}, nil
+}
+
+func (db *MemoryDB) getServerGroups() ([]types.ServerGroup, error) {
+	return []types.ServerGroup{}, nil
+}
+
+func (db *MemoryDB) addServerGroup(g types.ServerGroup) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteServerGroup(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) addServerGroupMember(groupID string, instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteServerGroupMember(instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateSnapshotSchedule(s types.SnapshotSchedule) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteSnapshotSchedule(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getSnapshotSchedules() ([]types.SnapshotSchedule, error) {
+	return []types.SnapshotSchedule{}, nil
+}
+
+func (db *MemoryDB) addVolumeSnapshot(s types.VolumeSnapshot) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteVolumeSnapshot(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getVolumeSnapshots() ([]types.VolumeSnapshot, error) {
+	return []types.VolumeSnapshot{}, nil
+}
+
+func (db *MemoryDB) updateImageSeed(imageID string, seed types.ImageSeed) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteImageSeeds(imageID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getImageSeeds() (map[string][]types.ImageSeed, error) {
+	return map[string][]types.ImageSeed{}, nil
+}
+
+func (db *MemoryDB) updateNodeMaintenance(nodeID string, maintenance bool) error {
+	return nil
+}
+
+func (db *MemoryDB) getMaintenanceNodes() ([]string, error) {
+	return []string{}, nil
+}
+
+func (db *MemoryDB) updateMigration(m types.Migration) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteMigration(instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getMigrations() ([]types.Migration, error) {
+	return []types.Migration{}, nil
+}
+
+func (db *MemoryDB) updatePolicyRule(r types.PolicyRule) error {
+	return nil
+}
+
+func (db *MemoryDB) deletePolicyRule(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getPolicyRules() ([]types.PolicyRule, error) {
+	return []types.PolicyRule{}, nil
+}
+
+func (db *MemoryDB) updateSetting(s types.SettingValue) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteSetting(key string) error {
+	return nil
+}
+
+func (db *MemoryDB) getSettings() ([]types.SettingValue, error) {
+	return []types.SettingValue{}, nil
+}
+
+func (db *MemoryDB) getQueuedLaunches() ([]types.QueuedLaunch, error) {
+	return []types.QueuedLaunch{}, nil
+}
+
+func (db *MemoryDB) addQueuedLaunch(l types.QueuedLaunch) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteQueuedLaunch(instanceID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getAPIKeys() ([]types.APIKey, error) {
+	return []types.APIKey{}, nil
+}
+
+func (db *MemoryDB) updateAPIKey(k types.APIKey) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteAPIKey(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getAuthTokens() ([]types.AuthToken, error) {
+	return []types.AuthToken{}, nil
+}
+
+func (db *MemoryDB) addAuthToken(t types.AuthToken) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteAuthToken(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getTenantCAs() ([]types.TenantCA, error) {
+	return []types.TenantCA{}, nil
+}
+
+func (db *MemoryDB) addIdempotentResponse(r types.IdempotentResponse) error {
+	return nil
+}
+
+func (db *MemoryDB) getIdempotentResponse(tenantID string, key string) (types.IdempotentResponse, error) {
+	return types.IdempotentResponse{}, ErrNoIdempotencyKey
+}
+
+func (db *MemoryDB) pruneIdempotentResponses(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (db *MemoryDB) addQuotaAudit(records []types.QuotaAuditRecord) error {
+	return nil
+}
+
+func (db *MemoryDB) getQuotaAudit(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error) {
+	return []types.QuotaAuditRecord{}, nil
+}
+
+func (db *MemoryDB) pruneQuotaAudit(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (db *MemoryDB) addAuditRecord(r types.AuditRecord) error {
+	return nil
+}
+
+func (db *MemoryDB) getAuditRecords(filter types.AuditFilter) ([]types.AuditRecord, error) {
+	return []types.AuditRecord{}, nil
+}
+
+func (db *MemoryDB) pruneAuditRecords(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (db *MemoryDB) addReleasedUsage(span types.UsageSpan) error {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	db.usageReleased[string(span.Resource)+"/"+span.ID] = span
+	return nil
+}
+
+func (db *MemoryDB) getReleasedUsage() ([]types.UsageSpan, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	var spans []types.UsageSpan
+	for _, s := range db.usageReleased {
+		spans = append(spans, s)
+	}
+	return spans, nil
+}
+
+func (db *MemoryDB) pruneReleasedUsage(before time.Time) (int, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	pruned := 0
+	for k, s := range db.usageReleased {
+		if s.End.Before(before) {
+			delete(db.usageReleased, k)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (db *MemoryDB) addUsageRecords(records []types.UsageRecord) error {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	for _, r := range records {
+		key := fmt.Sprintf("%s/%s/%d", r.TenantID, r.Granularity, r.Start.UnixNano())
+		db.usageRecords[key] = r
+	}
+	return nil
+}
+
+func (db *MemoryDB) getUsageRecords(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	records := []types.UsageRecord{}
+	for _, r := range db.usageRecords {
+		if r.Granularity != filter.Granularity ||
+			(filter.TenantID != "" && r.TenantID != filter.TenantID) ||
+			(!filter.Start.IsZero() && r.Start.Before(filter.Start)) ||
+			(!filter.End.IsZero() && !r.Start.Before(filter.End)) {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Start.Equal(records[j].Start) {
+			return records[i].Start.Before(records[j].Start)
+		}
+		return records[i].TenantID < records[j].TenantID
+	})
+
+	return records, nil
+}
+
+func (db *MemoryDB) lastUsageRecordEnd(granularity types.UsageGranularity) (time.Time, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	var end time.Time
+	for _, r := range db.usageRecords {
+		if r.Granularity == granularity && r.End.After(end) {
+			end = r.End
+		}
+	}
+	return end, nil
+}
+
+func (db *MemoryDB) pruneUsageRecords(granularity types.UsageGranularity, before time.Time) (int, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	pruned := 0
+	for k, r := range db.usageRecords {
+		if r.Granularity == granularity && r.End.Before(before) {
+			delete(db.usageRecords, k)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (db *MemoryDB) stats() (types.DatabaseStatus, error) {
+	return types.DatabaseStatus{}, nil
+}
+
+func (db *MemoryDB) compact() error {
+	return nil
+}
+
+func (db *MemoryDB) pruneStatistics(before time.Time) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+)
+
+// queryObserver is called with the kind of each statement run against the
+// database and how long it took.
+type queryObserver func(statement string, d time.Duration)
+
+// statementKind returns the kind of a statement, the lower case keyword it
+// starts with, grouping the statements the datastore rarely runs as
+// "other" so that the kinds can be used as metric labels.
+func statementKind(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	kind := strings.ToLower(fields[0])
+	switch kind {
+	case "select", "insert", "update", "delete", "replace":
+		return kind
+	}
+
+	return "other"
+}
+
+// timedDriver wraps a driver so that every statement run on its
+// connections is reported to observe.
+type timedDriver struct {
+	driver  driver.Driver
+	observe queryObserver
+}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &timedConn{Conn: conn, observe: d.observe}, nil
+}
+
+// timedConn times the statements run on a connection.  Queries are timed
+// until their rows are closed as sqlite only runs a query as its rows are
+// read.
+type timedConn struct {
+	driver.Conn
+	observe queryObserver
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := execer.ExecContext(ctx, query, args)
+	c.observe(statementKind(query), time.Since(start))
+
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		c.observe(statementKind(query), time.Since(start))
+		return nil, err
+	}
+
+	return &timedRows{Rows: rows, kind: statementKind(query), start: start, observe: c.observe}, nil
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// statements which cannot be run with a context are not timed
+	if _, ok := stmt.(driver.StmtExecContext); !ok {
+		return stmt, nil
+	}
+	if _, ok := stmt.(driver.StmtQueryContext); !ok {
+		return stmt, nil
+	}
+
+	return &timedStmt{Stmt: stmt, kind: statementKind(query), observe: c.observe}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// timedStmt times the runs of a prepared statement, which must support
+// contexts.
+type timedStmt struct {
+	driver.Stmt
+	kind    string
+	observe queryObserver
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	s.observe(s.kind, time.Since(start))
+
+	return res, err
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		s.observe(s.kind, time.Since(start))
+		return nil, err
+	}
+
+	return &timedRows{Rows: rows, kind: s.kind, start: start, observe: s.observe}, nil
+}
+
+// timedRows reports the time taken by a query when its rows are closed.
+type timedRows struct {
+	driver.Rows
+	kind    string
+	start   time.Time
+	observe queryObserver
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.observe(r.kind, time.Since(r.start))
+	return err
+}
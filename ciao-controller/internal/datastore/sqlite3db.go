@@ -16,7 +16,9 @@
 package datastore
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,19 +31,23 @@ import (
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
 	"github.com/ciao-project/ciao/payloads"
-	"github.com/golang/glog"
 	sqlite3 "github.com/mattn/go-sqlite3"
 
 	"github.com/pkg/errors"
 )
 
 type sqliteDB struct {
+	log           clogger.CiaoLog
 	db            *sql.DB
 	dbName        string
+	dbPath        string
 	tables        []persistentData
 	workloadsPath string
 	dbLock        *sync.Mutex
+	queryObserved queryObserver
 }
 
 type persistentData interface {
@@ -82,9 +88,33 @@ func (d logData) Init() error {
 		node_id varchar(32),
 		type string,
 		message string,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		object_id varchar(32) DEFAULT '' NOT NULL,
+		actor string DEFAULT '' NOT NULL,
+		on_behalf_of varchar(32) DEFAULT '' NOT NULL,
+		failure_code string DEFAULT '' NOT NULL
 		);`
 
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// logs created by older controllers lack the object, actor,
+	// impersonated tenant and failure classification
+	err = d.ds.addColumns(d.db, "log", []string{
+		"object_id varchar(32) DEFAULT '' NOT NULL",
+		"actor string DEFAULT '' NOT NULL",
+		"on_behalf_of varchar(32) DEFAULT '' NOT NULL",
+		"failure_code string DEFAULT '' NOT NULL",
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd = `CREATE INDEX IF NOT EXISTS log_tenant_id ON log (tenant_id, id);
+		CREATE INDEX IF NOT EXISTS log_object_id ON log (object_id, id);`
+
 	return d.ds.exec(d.db, cmd)
 }
 
@@ -104,6 +134,25 @@ func (d subnetData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+// releasedIPData records when the free addresses of the tenant networks
+// were last released.
+type releasedIPData struct {
+	namedData
+}
+
+func (d releasedIPData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS tenant_ip_released
+		(
+		tenant_id varchar(32),
+		subnet unsigned int,
+		rest unsigned int,
+		release_time DATETIME,
+		primary key(tenant_id, rest)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 // Handling of Instance specific data
 type instanceData struct {
 	namedData
@@ -122,11 +171,124 @@ func (d instanceData) Init() error {
 		create_time DATETIME,
 		name string,
 		cnci int,
+		vcpus int DEFAULT 0 NOT NULL,
+		mem_mb int DEFAULT 0 NOT NULL,
+		ephemeral_gb int DEFAULT 0 NOT NULL,
+		node_id varchar(32) DEFAULT '' NOT NULL,
+		description text DEFAULT '' NOT NULL,
+		template_name text DEFAULT '' NOT NULL,
+		template_version int DEFAULT 0 NOT NULL,
+		status_reason text DEFAULT '' NOT NULL,
+		deletion_protected int DEFAULT 0 NOT NULL,
+		nics text DEFAULT '' NOT NULL,
+		user_data text DEFAULT '' NOT NULL,
+		delete_time DATETIME,
 		foreign key(tenant_id) references tenants(id),
 		foreign key(workload_id) references workload_template(id),
 		unique(tenant_id, ip, mac_address)
 		);`
 
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// instances created by older controllers did not record their
+	// resources, descriptions, launch templates, failures, protection,
+	// additional network interfaces, user data or deferred deletions
+	return d.ds.addColumns(d.db, "instances", []string{
+		"vcpus int DEFAULT 0 NOT NULL",
+		"mem_mb int DEFAULT 0 NOT NULL",
+		"ephemeral_gb int DEFAULT 0 NOT NULL",
+		"node_id varchar(32) DEFAULT '' NOT NULL",
+		"description text DEFAULT '' NOT NULL",
+		"template_name text DEFAULT '' NOT NULL",
+		"template_version int DEFAULT 0 NOT NULL",
+		"status_reason text DEFAULT '' NOT NULL",
+		"deletion_protected int DEFAULT 0 NOT NULL",
+		"nics text DEFAULT '' NOT NULL",
+		"user_data text DEFAULT '' NOT NULL",
+		"delete_time DATETIME",
+	})
+}
+
+// placementData records the nodes instances have been placed on.
+type placementData struct {
+	namedData
+}
+
+func (d placementData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS instance_placements
+		(
+			instance_id varchar(32),
+			node_id varchar(32),
+			timestamp DATETIME,
+			reason string
+		);`
+
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// the latest placement of an instance is looked up when listing
+	// attachments by node
+	return d.ds.exec(d.db, "CREATE INDEX IF NOT EXISTS instance_placements_instance_id ON instance_placements (instance_id)")
+}
+
+// conditionData records the caveats with which instances are running.
+type conditionData struct {
+	namedData
+}
+
+func (d conditionData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS instance_conditions
+		(
+			instance_id varchar(32),
+			type string,
+			message string,
+			timestamp DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// instanceTagData records the tags of instances.
+type instanceTagData struct {
+	namedData
+}
+
+func (d instanceTagData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS instance_tags
+		(
+			instance_id varchar(32),
+			key text,
+			value text,
+			primary key(instance_id, key)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// historyData records the lifecycle of instances.  Entries outlive the
+// instances they describe.
+type historyData struct {
+	namedData
+}
+
+func (d historyData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS instance_history
+		(
+			id integer primary key,
+			instance_id varchar(32),
+			tenant_id varchar(32),
+			timestamp DATETIME,
+			type string,
+			message string,
+			node_id varchar(32) DEFAULT '' NOT NULL,
+			actor string DEFAULT '' NOT NULL
+		);`
+
 	return d.ds.exec(d.db, cmd)
 }
 
@@ -146,10 +308,33 @@ func (d blockData) Init() error {
 		name string,
 		description string,
 		internal int,
+		state_time DATETIME,
+		deletion_protected int DEFAULT 0 NOT NULL,
 		foreign key(tenant_id) references tenants(id)
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// older controllers did not record when volumes changed state or
+	// whether they were protected
+	err = d.ds.addColumns(d.db, "block_data", []string{
+		"state_time DATETIME",
+		"deletion_protected int DEFAULT 0 NOT NULL",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = d.ds.exec(d.db, "UPDATE block_data SET state_time = create_time WHERE state_time IS NULL")
+	if err != nil {
+		return err
+	}
+
+	// attachments are listed by the state of their volumes
+	return d.ds.exec(d.db, "CREATE INDEX IF NOT EXISTS block_data_state ON block_data (state)")
 }
 
 type attachments struct {
@@ -164,10 +349,29 @@ func (d attachments) Init() error {
 		block_id string,
 		ephemeral int,
 		boot int,
+		tag text DEFAULT '' NOT NULL,
+		device text DEFAULT '' NOT NULL,
 		foreign key(instance_id) references instances(id),
 		foreign key(block_id) references block_data(id)
 		);`
 
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// attachments made by older controllers had no tags or devices
+	err = d.ds.addColumns(d.db, "attachments", []string{
+		"tag text DEFAULT '' NOT NULL",
+		"device text DEFAULT '' NOT NULL",
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd = `CREATE INDEX IF NOT EXISTS attachments_block_id ON attachments (block_id);
+		CREATE INDEX IF NOT EXISTS attachments_instance_id ON attachments (instance_id);`
+
 	return d.ds.exec(d.db, cmd)
 }
 
@@ -188,11 +392,22 @@ func (d workloadStorage) Init() error {
 		source_type string,
 		source_id string,
 		tag string,
+		local int DEFAULT 0 NOT NULL,
+		boot_index int,
 		foreign key(workload_id) references workloads(id),
 		foreign key(volume_id) references block_data(id)
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// storage defined by older controllers was never launcher local
+	return d.ds.addColumns(d.db, "workload_storage", []string{
+		"local int DEFAULT 0 NOT NULL",
+		"boot_index int",
+	})
 }
 
 // Tenants data
@@ -206,10 +421,34 @@ func (d tenantData) Init() error {
 		id varchar(32) primary key,
 		name text,
 		subnet_bits int,
-		permissions text
+		permissions text,
+		frozen int DEFAULT 0 NOT NULL,
+		freeze_reason text DEFAULT '' NOT NULL,
+		preprovision_network int DEFAULT 0 NOT NULL,
+		trash_retention int DEFAULT 0 NOT NULL,
+		deferred_delete int DEFAULT 0 NOT NULL,
+		max_subnets int DEFAULT 0 NOT NULL,
+		cnci_vcpus int DEFAULT 0 NOT NULL,
+		cnci_mem_mb int DEFAULT 0 NOT NULL,
+		cnci_disk_mb int DEFAULT 0 NOT NULL
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	return d.ds.addColumns(d.db, "tenants", []string{
+		"frozen int DEFAULT 0 NOT NULL",
+		"freeze_reason text DEFAULT '' NOT NULL",
+		"preprovision_network int DEFAULT 0 NOT NULL",
+		"trash_retention int DEFAULT 0 NOT NULL",
+		"deferred_delete int DEFAULT 0 NOT NULL",
+		"max_subnets int DEFAULT 0 NOT NULL",
+		"cnci_vcpus int DEFAULT 0 NOT NULL",
+		"cnci_mem_mb int DEFAULT 0 NOT NULL",
+		"cnci_disk_mb int DEFAULT 0 NOT NULL",
+	})
 }
 
 // workload template data
@@ -228,10 +467,26 @@ func (d workloadTemplateData) Init() error {
 		vm_type text,
 		image_name text,
 		visibility text,
-		requirements text
+		requirements text,
+		bounds text DEFAULT '' NOT NULL,
+		networks text DEFAULT '' NOT NULL
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	err = d.ds.addColumns(d.db, "workload_template", []string{
+		"bounds text DEFAULT '' NOT NULL",
+		"networks text DEFAULT '' NOT NULL",
+	})
+	if err != nil {
+		return err
+	}
+
+	// workloads are listed by visibility and owning tenant
+	return d.ds.exec(d.db, "CREATE INDEX IF NOT EXISTS workload_template_visibility ON workload_template (visibility, tenant_id)")
 }
 
 // statistics
@@ -325,10 +580,19 @@ func (d poolData) Init() error {
 			name string,
 			free int,
 			total int,
+			create_time DATETIME,
 			PRIMARY KEY(id, name)
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// pools created by older controllers did not record when
+	return d.ds.addColumns(d.db, "pools", []string{
+		"create_time DATETIME",
+	})
 }
 
 type subnetPoolData struct {
@@ -346,6 +610,21 @@ func (d subnetPoolData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+type poolTenantData struct {
+	namedData
+}
+
+func (d poolTenantData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_tenants
+		(
+			pool_id varchar(32),
+			tenant_id varchar(32),
+			PRIMARY KEY(pool_id, tenant_id)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 type addressData struct {
 	namedData
 }
@@ -371,10 +650,19 @@ func (d mappedIPData) Init() error {
 			id varchar(32) primary key,
 			external_ip string,
 			instance_id varchar(32),
-			pool_id varchar(32)
+			pool_id varchar(32),
+			create_time DATETIME
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// addresses mapped by older controllers did not record when
+	return d.ds.addColumns(d.db, "mapped_ips", []string{
+		"create_time DATETIME",
+	})
 }
 
 type quotaData struct {
@@ -406,1820 +694,5513 @@ func (d imageData) Init() error {
 			name string,
 			createtime DATETIME,
 			size int,
-			visibility string
+			visibility string,
+			checksum string DEFAULT '' NOT NULL
+		);`
+
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// images created by older controllers lack the checksum
+	return d.ds.addColumns(d.db, "images", []string{
+		"checksum string DEFAULT '' NOT NULL",
+	})
+}
+
+type webhookData struct {
+	namedData
+}
+
+func (d webhookData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS webhooks
+		(
+			id varchar(32) primary key,
+			url string,
+			secret string,
+			event_types string,
+			tenant_id string,
+			state string,
+			createtime DATETIME
 		);`
 
 	return d.ds.exec(d.db, cmd)
 }
 
-func (ds *sqliteDB) exec(db *sql.DB, cmd string) error {
-	glog.V(2).Info("exec: ", cmd)
+type operationData struct {
+	namedData
+}
 
-	_, err := db.Exec(cmd)
+func (d operationData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS operations
+		(
+			id varchar(32) primary key,
+			tenant_id string,
+			type string,
+			target string,
+			result string,
+			state string,
+			progress int,
+			error string,
+			createtime DATETIME,
+			updatetime DATETIME
+		);`
 
-	return err
+	return d.ds.exec(d.db, cmd)
 }
 
-// This function is deprecated and will be removed soon. It should not be used
-// for newly written or updated code.
-func (ds *sqliteDB) create(tableName string, record ...interface{}) error {
-	// get database location of this table
-	db := ds.getTableDB(tableName)
+type trashData struct {
+	namedData
+}
 
-	if db == nil {
-		return errors.New("Bad table name")
-	}
+func (d trashData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS trash
+		(
+			id varchar(32) primary key,
+			tenant_id string,
+			type string,
+			name string,
+			deletetime DATETIME,
+			purgetime DATETIME,
+			workload_id string,
+			vcpus int,
+			mem_mb int,
+			ephemeral_gb int,
+			volumes string
+		);`
 
-	var values []string
-	for _, val := range record {
-		v := reflect.ValueOf(val)
+	return d.ds.exec(d.db, cmd)
+}
 
-		var newval string
+type cnciImageData struct {
+	namedData
+}
 
-		// enclose strings in quotes to not confuse sqlite
-		if v.Kind() == reflect.String {
-			newval = fmt.Sprintf("'%v'", val)
-		} else if v.Kind() == reflect.Bool {
-			if val.(bool) {
-				newval = "1"
-			} else {
-				newval = "0"
-			}
-		} else {
-			newval = fmt.Sprintf("%v", val)
-		}
+func (d cnciImageData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS cnci_image
+		(
+			id int primary key,
+			image_id string,
+			previous_image_id string
+		);`
 
-		values = append(values, newval)
-	}
+	return d.ds.exec(d.db, cmd)
+}
 
-	args := strings.Join(values, ",")
-	cmd := "INSERT into " + tableName + " VALUES (" + args + ");"
+type cnciInstanceImageData struct {
+	namedData
+}
 
-	return ds.exec(db, cmd)
+func (d cnciInstanceImageData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS cnci_instance_images
+		(
+			instance_id varchar(32) primary key,
+			image_id string
+		);`
+
+	return d.ds.exec(d.db, cmd)
 }
 
-func (ds *sqliteDB) getTableDB(name string) *sql.DB {
-	for _, table := range ds.tables {
-		n := table.Name()
-		if n == name {
-			return table.DB()
-		}
-	}
-	return nil
+// launchConfigData holds the configuration each instance was last started
+// with.
+type launchConfigData struct {
+	namedData
 }
 
-// init initializes the private data for the database object.
-// The datastore caches are also filled.
-func (ds *sqliteDB) init(config Config) error {
-	u, err := url.Parse(config.PersistentURI)
-	if err != nil {
-		return fmt.Errorf("Invalid URL (%s) for persistent data store: %v", config.PersistentURI, err)
-	}
+func (d launchConfigData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS launch_configs
+		(
+			instance_id varchar(32) primary key,
+			config string
+		);`
 
-	if u.Scheme == "file" {
-		dbDir := filepath.Dir(u.Path)
-		err = os.MkdirAll(dbDir, 0755)
-		if err != nil && dbDir != "." {
-			return fmt.Errorf("Unable to create db directory (%s) %v", dbDir, err)
-		}
-	}
+	return d.ds.exec(d.db, cmd)
+}
 
-	err = ds.Connect(config.PersistentURI)
-	if err != nil {
-		return err
-	}
+type tenantCAData struct {
+	namedData
+}
 
-	ds.dbLock = &sync.Mutex{}
+func (d tenantCAData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS tenant_cas
+		(
+			tenant_id varchar(32) primary key,
+			certificate string,
+			subject string,
+			fingerprint string,
+			not_after DATETIME,
+			createtime DATETIME
+		);`
 
-	ds.tables = []persistentData{
-		tenantData{namedData{ds: ds, name: "tenants", db: ds.db}},
-		instanceData{namedData{ds: ds, name: "instances", db: ds.db}},
-		workloadTemplateData{namedData{ds: ds, name: "workload_template", db: ds.db}},
-		nodeStatisticsData{namedData{ds: ds, name: "node_statistics", db: ds.db}},
-		logData{namedData{ds: ds, name: "log", db: ds.db}},
-		subnetData{namedData{ds: ds, name: "tenant_network", db: ds.db}},
-		instanceStatisticsData{namedData{ds: ds, name: "instance_statistics", db: ds.db}},
-		frameStatisticsData{namedData{ds: ds, name: "frame_statistics", db: ds.db}},
+	return d.ds.exec(d.db, cmd)
+}
+
+type launchTemplateData struct {
+	namedData
+}
+
+func (d launchTemplateData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS launch_templates
+		(
+			tenant_id varchar(32),
+			name string,
+			version int,
+			request string,
+			createtime DATETIME,
+			updatetime DATETIME,
+			primary key(tenant_id, name)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type serverGroupData struct {
+	namedData
+}
+
+func (d serverGroupData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS server_groups
+		(
+			id varchar(32) primary key,
+			tenant_id varchar(32),
+			name string,
+			policy string,
+			soft int,
+			createtime DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type serverGroupMemberData struct {
+	namedData
+}
+
+func (d serverGroupMemberData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS server_group_members
+		(
+			id integer primary key autoincrement,
+			group_id varchar(32),
+			instance_id varchar(32) unique
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type snapshotScheduleData struct {
+	namedData
+}
+
+func (d snapshotScheduleData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS snapshot_schedules
+		(
+			id varchar(32) primary key,
+			tenant_id varchar(32),
+			volume_id varchar(32),
+			tag string,
+			interval_minutes int,
+			offset_minutes int,
+			retention int,
+			createtime DATETIME,
+			last_run DATETIME,
+			next_run DATETIME,
+			last_error string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type imageSeedData struct {
+	namedData
+}
+
+func (d imageSeedData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS image_seeds
+		(
+			image_id varchar(32),
+			node_id varchar(32),
+			state string,
+			error string,
+			updatetime DATETIME,
+			primary key(image_id, node_id)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type nodeMaintenanceData struct {
+	namedData
+}
+
+func (d nodeMaintenanceData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS node_maintenance
+		(
+			node_id varchar(32) primary key
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type migrationData struct {
+	namedData
+}
+
+func (d migrationData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS migrations
+		(
+			instance_id varchar(32) primary key,
+			tenant_id varchar(32),
+			source_node_id varchar(32),
+			target_node_id varchar(32),
+			state string,
+			starttime DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type volumeSnapshotData struct {
+	namedData
+}
+
+func (d volumeSnapshotData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS volume_snapshots
+		(
+			id varchar(32) primary key,
+			volume_id varchar(32),
+			tenant_id varchar(32),
+			schedule_id varchar(32),
+			name string DEFAULT '' NOT NULL,
+			attached int DEFAULT 0 NOT NULL,
+			createtime DATETIME
+		);`
+
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// snapshots recorded by older controllers were all taken by schedules
+	return d.ds.addColumns(d.db, "volume_snapshots", []string{
+		"name string DEFAULT '' NOT NULL",
+		"attached int DEFAULT 0 NOT NULL",
+	})
+}
+
+type policyRuleData struct {
+	namedData
+}
+
+func (d policyRuleData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS policy_rules
+		(
+			id varchar(32) primary key,
+			description string,
+			severity string,
+			image_pattern string,
+			vm_type string,
+			fw_type string,
+			min_vcpus int,
+			min_mem_mb int,
+			createtime DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// settingData holds the cluster settings changed by the admin.  Settings
+// which are not present have their default values.
+type settingData struct {
+	namedData
+}
+
+func (d settingData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS settings
+		(
+			key string primary key,
+			value string,
+			update_time DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// launchQueueData holds the launches held back by the per tenant launch
+// limit so that they are not lost when the controller restarts.
+type launchQueueData struct {
+	namedData
+}
+
+func (d launchQueueData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS launch_queue
+		(
+			instance_id varchar(32) primary key,
+			tenant_id varchar(32),
+			sequence int,
+			config string,
+			trace_label string,
+			queue_time DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// apiKeyData holds the tenants' API keys.  Only the hash of each key is
+// stored.
+type apiKeyData struct {
+	namedData
+}
+
+func (d apiKeyData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS api_keys
+		(
+			id varchar(32) primary key,
+			tenant_id varchar(32),
+			name string,
+			scopes string,
+			hash string,
+			expire_time DATETIME,
+			last_used_time DATETIME,
+			createtime DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// authTokenData holds the records of the bearer tokens which have been
+// issued and not revoked.
+type authTokenData struct {
+	namedData
+}
+
+func (d authTokenData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS tokens
+		(
+			id varchar(32) primary key,
+			subject string,
+			tenant_id varchar(32),
+			role string,
+			expire_time DATETIME,
+			createtime DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type idempotencyData struct {
+	namedData
+}
+
+func (d idempotencyData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS idempotency_keys
+		(
+			tenant_id string,
+			key string,
+			request_hash string,
+			status int,
+			content_type string,
+			body blob,
+			createtime DATETIME,
+			primary key(tenant_id, key)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// quotaAuditData records the changes in the consumption of the resources
+// subject to quotas.
+type quotaAuditData struct {
+	namedData
+}
+
+func (d quotaAuditData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS quota_audit
+		(
+			id integer primary key,
+			tenant_id varchar(32),
+			resource string,
+			delta int,
+			usage int,
+			allowed int,
+			timestamp DATETIME
+		);`
+
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	return d.ds.exec(d.db, "CREATE INDEX IF NOT EXISTS quota_audit_tenant_id ON quota_audit (tenant_id, id)")
+}
+
+// auditData records the API requests which may have changed the state of
+// the cluster.
+type auditData struct {
+	namedData
+}
+
+func (d auditData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS audit
+		(
+			id integer primary key,
+			timestamp DATETIME,
+			request_id varchar(32),
+			tenant_id varchar(32),
+			actor string,
+			on_behalf_of varchar(32),
+			method string,
+			resource string,
+			status int,
+			body blob,
+			body_size int
+		);`
+
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	return d.ds.exec(d.db, "CREATE INDEX IF NOT EXISTS audit_timestamp ON audit (timestamp)")
+}
+
+type usageReleasedData struct {
+	namedData
+}
+
+func (d usageReleasedData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS usage_released
+		(
+			resource string,
+			id string,
+			tenant_id string,
+			size_gb int,
+			start_time DATETIME,
+			end_time DATETIME,
+			primary key(resource, id)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type usageRecordData struct {
+	namedData
+}
+
+func (d usageRecordData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS usage_records
+		(
+			tenant_id string,
+			granularity string,
+			start_time DATETIME,
+			end_time DATETIME,
+			instance_hours real,
+			volume_gb_hours real,
+			external_ip_hours real,
+			primary key(tenant_id, granularity, start_time)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type leaseData struct {
+	namedData
+}
+
+func (d leaseData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS leases
+		(
+			name string primary key,
+			holder string,
+			address string,
+			expiry integer
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+func (ds *sqliteDB) exec(db *sql.DB, cmd string) error {
+	if ds.log.V(2) {
+		ds.log.Infof("exec: %s", cmd)
+	}
+
+	_, err := db.Exec(cmd)
+
+	return err
+}
+
+// addColumns adds the columns, given as column definitions, to table
+// unless a column of the same name already exists.
+func (ds *sqliteDB) addColumns(db *sql.DB, table string, columns []string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notNull, pk int
+		var dflt sql.NullString
+
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range columns {
+		if existing[strings.Fields(c)[0]] {
+			continue
+		}
+
+		err = ds.exec(db, "ALTER TABLE "+table+" ADD COLUMN "+c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// This function is deprecated and will be removed soon. It should not be used
+// for newly written or updated code.
+func (ds *sqliteDB) create(tableName string, record ...interface{}) error {
+	// get database location of this table
+	db := ds.getTableDB(tableName)
+
+	if db == nil {
+		return errors.New("Bad table name")
+	}
+
+	var values []string
+	for _, val := range record {
+		v := reflect.ValueOf(val)
+
+		var newval string
+
+		// enclose strings in quotes to not confuse sqlite
+		if v.Kind() == reflect.String {
+			newval = fmt.Sprintf("'%v'", val)
+		} else if v.Kind() == reflect.Bool {
+			if val.(bool) {
+				newval = "1"
+			} else {
+				newval = "0"
+			}
+		} else {
+			newval = fmt.Sprintf("%v", val)
+		}
+
+		values = append(values, newval)
+	}
+
+	args := strings.Join(values, ",")
+	cmd := "INSERT into " + tableName + " VALUES (" + args + ");"
+
+	return ds.exec(db, cmd)
+}
+
+func (ds *sqliteDB) getTableDB(name string) *sql.DB {
+	for _, table := range ds.tables {
+		n := table.Name()
+		if n == name {
+			return table.DB()
+		}
+	}
+	return nil
+}
+
+// init initializes the private data for the database object.
+// The datastore caches are also filled.
+func (ds *sqliteDB) init(config Config) error {
+	ds.log = config.Log
+	if ds.log == nil {
+		ds.log = gloginterface.CiaoGlogLogger{}
+	}
+	ds.queryObserved = config.QueryObserved
+
+	u, err := url.Parse(config.PersistentURI)
+	if err != nil {
+		return fmt.Errorf("Invalid URL (%s) for persistent data store: %v", config.PersistentURI, err)
+	}
+
+	if u.Scheme == "file" && u.Query().Get("mode") != "memory" {
+		ds.dbPath = u.Path
+	}
+
+	if u.Scheme == "file" {
+		dbDir := filepath.Dir(u.Path)
+		err = os.MkdirAll(dbDir, 0755)
+		if err != nil && dbDir != "." {
+			return fmt.Errorf("Unable to create db directory (%s) %v", dbDir, err)
+		}
+	}
+
+	err = ds.Connect(config.PersistentURI)
+	if err != nil {
+		return err
+	}
+
+	ds.dbLock = &sync.Mutex{}
+
+	ds.tables = []persistentData{
+		tenantData{namedData{ds: ds, name: "tenants", db: ds.db}},
+		instanceData{namedData{ds: ds, name: "instances", db: ds.db}},
+		placementData{namedData{ds: ds, name: "instance_placements", db: ds.db}},
+		conditionData{namedData{ds: ds, name: "instance_conditions", db: ds.db}},
+		instanceTagData{namedData{ds: ds, name: "instance_tags", db: ds.db}},
+		historyData{namedData{ds: ds, name: "instance_history", db: ds.db}},
+		workloadTemplateData{namedData{ds: ds, name: "workload_template", db: ds.db}},
+		nodeStatisticsData{namedData{ds: ds, name: "node_statistics", db: ds.db}},
+		logData{namedData{ds: ds, name: "log", db: ds.db}},
+		subnetData{namedData{ds: ds, name: "tenant_network", db: ds.db}},
+		releasedIPData{namedData{ds: ds, name: "tenant_ip_released", db: ds.db}},
+		instanceStatisticsData{namedData{ds: ds, name: "instance_statistics", db: ds.db}},
+		frameStatisticsData{namedData{ds: ds, name: "frame_statistics", db: ds.db}},
 		traceData{namedData{ds: ds, name: "trace_data", db: ds.db}},
 		blockData{namedData{ds: ds, name: "block_data", db: ds.db}},
 		attachments{namedData{ds: ds, name: "attachments", db: ds.db}},
 		workloadStorage{namedData{ds: ds, name: "workload_storage", db: ds.db}},
 		poolData{namedData{ds: ds, name: "pools", db: ds.db}},
 		subnetPoolData{namedData{ds: ds, name: "subnet_pool", db: ds.db}},
+		poolTenantData{namedData{ds: ds, name: "pool_tenants", db: ds.db}},
 		addressData{namedData{ds: ds, name: "address_pool", db: ds.db}},
 		mappedIPData{namedData{ds: ds, name: "mapped_ips", db: ds.db}},
 		quotaData{namedData{ds: ds, name: "quotas", db: ds.db}},
 		imageData{namedData{ds: ds, name: "images", db: ds.db}},
+		webhookData{namedData{ds: ds, name: "webhooks", db: ds.db}},
+		operationData{namedData{ds: ds, name: "operations", db: ds.db}},
+		trashData{namedData{ds: ds, name: "trash", db: ds.db}},
+		idempotencyData{namedData{ds: ds, name: "idempotency_keys", db: ds.db}},
+		quotaAuditData{namedData{ds: ds, name: "quota_audit", db: ds.db}},
+		auditData{namedData{ds: ds, name: "audit", db: ds.db}},
+		usageReleasedData{namedData{ds: ds, name: "usage_released", db: ds.db}},
+		usageRecordData{namedData{ds: ds, name: "usage_records", db: ds.db}},
+		cnciImageData{namedData{ds: ds, name: "cnci_image", db: ds.db}},
+		cnciInstanceImageData{namedData{ds: ds, name: "cnci_instance_images", db: ds.db}},
+		launchConfigData{namedData{ds: ds, name: "launch_configs", db: ds.db}},
+		tenantCAData{namedData{ds: ds, name: "tenant_cas", db: ds.db}},
+		launchTemplateData{namedData{ds: ds, name: "launch_templates", db: ds.db}},
+		serverGroupData{namedData{ds: ds, name: "server_groups", db: ds.db}},
+		serverGroupMemberData{namedData{ds: ds, name: "server_group_members", db: ds.db}},
+		snapshotScheduleData{namedData{ds: ds, name: "snapshot_schedules", db: ds.db}},
+		volumeSnapshotData{namedData{ds: ds, name: "volume_snapshots", db: ds.db}},
+		imageSeedData{namedData{ds: ds, name: "image_seeds", db: ds.db}},
+		nodeMaintenanceData{namedData{ds: ds, name: "node_maintenance", db: ds.db}},
+		migrationData{namedData{ds: ds, name: "migrations", db: ds.db}},
+		policyRuleData{namedData{ds: ds, name: "policy_rules", db: ds.db}},
+		settingData{namedData{ds: ds, name: "settings", db: ds.db}},
+		launchQueueData{namedData{ds: ds, name: "launch_queue", db: ds.db}},
+		apiKeyData{namedData{ds: ds, name: "api_keys", db: ds.db}},
+		authTokenData{namedData{ds: ds, name: "tokens", db: ds.db}},
+		leaseData{namedData{ds: ds, name: "leases", db: ds.db}},
+	}
+
+	ds.workloadsPath = config.InitWorkloadsPath
+	if err := os.MkdirAll(ds.workloadsPath, 0755); err != nil {
+		return errors.Wrap(err, "Error creating workload directory")
+	}
+
+	for _, table := range ds.tables {
+		err = table.Init()
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.LegacyStatsPath != "" {
+		return ds.migrateLegacyStats(config.LegacyStatsPath)
+	}
+
+	return nil
+}
+
+var pSQLLiteConfig = []string{
+	"PRAGMA page_size = 32768",
+	"PRAGMA synchronous = OFF",
+	"PRAGMA temp_store = MEMORY",
+	"PRAGMA busy_timeout = 1000",
+	"PRAGMA journal_mode=WAL",
+}
+
+func (ds *sqliteDB) sqliteConnect(name string, URI string, config []string) (*sql.DB, error) {
+	db, err := sql.Open(name, URI)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config {
+		_, err = db.Exec(config[i])
+		if err != nil {
+			ds.log.Warningf("%v", err)
+		}
+	}
+
+	err = db.Ping()
+	if err != nil {
+		ds.log.Warningf("%v", err)
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (ds *sqliteDB) Connect(persistentURI string) error {
+	var d driver.Driver = &sqlite3.SQLiteDriver{}
+	if ds.queryObserved != nil {
+		d = timedDriver{driver: d, observe: ds.queryObserved}
+	}
+	sql.Register(persistentURI, d)
+
+	db, err := ds.sqliteConnect(persistentURI, persistentURI, pSQLLiteConfig)
+	if err != nil {
+		return err
+	}
+
+	ds.db = db
+	ds.dbName = persistentURI
+
+	return err
+}
+
+// Disconnect is used to close the connection to the sql database
+func (ds *sqliteDB) disconnect() {
+	_ = ds.db.Close()
+}
+
+func (ds *sqliteDB) logEvent(event types.LogEntry) error {
+	db := ds.getTableDB("log")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO log (tenant_id, node_id, type, message, object_id, actor, on_behalf_of, failure_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		event.TenantID, event.NodeID, event.EventType, event.Message, event.ObjectID, event.Actor, event.OnBehalfOf, event.FailureCode)
+
+	return err
+}
+
+// logEvents adds a batch of events to the event log in a single
+// transaction.  The events keep the time at which they were queued.
+func (ds *sqliteDB) logEvents(events []types.LogEntry) error {
+	db := ds.getTableDB("log")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO log (tenant_id, node_id, type, message, object_id, actor, on_behalf_of, failure_code, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	IDs := make([]int64, len(events))
+	for i, e := range events {
+		res, err := stmt.Exec(e.TenantID, e.NodeID, e.EventType, e.Message, e.ObjectID, e.Actor, e.OnBehalfOf, e.FailureCode, e.Timestamp.UTC().Format(sqliteTimeFormat))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		IDs[i], err = res.LastInsertId()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// the events are only given their IDs once the transaction commits
+	for i := range events {
+		events[i].ID = IDs[i]
+	}
+
+	return nil
+}
+
+// ClearLog will remove all the event entries from the event log
+func (ds *sqliteDB) clearLog() error {
+	db := ds.getTableDB("log")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM log")
+
+	return err
+}
+
+func (ds *sqliteDB) getConfig(ID string) (string, error) {
+	var configFile string
+
+	db := ds.getTableDB("workload_template")
+
+	err := db.QueryRow("SELECT filename FROM workload_template where id = ?", ID).Scan(&configFile)
+
+	if err != nil {
+		return "", err
+	}
+
+	path := fmt.Sprintf("%s/%s", ds.workloadsPath, configFile)
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	config := string(bytes)
+
+	return config, nil
+}
+
+// lock must be held by caller
+func (ds *sqliteDB) createWorkloadStorage(tx *sql.Tx, workloadID string, storage *types.StorageResource) error {
+	_, err := tx.Exec("INSERT INTO workload_storage (workload_id, volume_id, bootable, ephemeral, size, source_type, source_id, tag, local, boot_index) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", workloadID, storage.ID, storage.Bootable, storage.Ephemeral, storage.Size, string(storage.SourceType), storage.Source, storage.Tag, storage.Local, storage.BootIndex)
+
+	return err
+}
+
+// lock must be held by caller
+func (ds *sqliteDB) deleteWorkloadStorage(tx *sql.Tx, workloadID string) error {
+	_, err := tx.Exec("DELETE FROM workload_storage WHERE workload_id = ?", workloadID)
+
+	return err
+}
+
+func (ds *sqliteDB) getWorkloadStorage(ID string) ([]types.StorageResource, error) {
+	query := `SELECT volume_id, bootable, ephemeral, size,
+			 source_type, source_id, tag, local, boot_index
+		  FROM 	workload_storage
+		  WHERE workload_id = ?
+		  ORDER BY rowid`
+
+	rows, err := ds.db.Query(query, ID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	res := []types.StorageResource{}
+	var sourceType string
+
+	for rows.Next() {
+		var r types.StorageResource
+		var bootIndex sql.NullInt64
+		err := rows.Scan(&r.ID, &r.Bootable, &r.Ephemeral, &r.Size, &sourceType, &r.Source, &r.Tag, &r.Local, &bootIndex)
+
+		if err != nil {
+			return []types.StorageResource{}, err
+		}
+		r.SourceType = types.SourceType(sourceType)
+		if bootIndex.Valid {
+			index := int(bootIndex.Int64)
+			r.BootIndex = &index
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// addTenant inserts a tenant and its initial quotas in a single transaction
+// so that a failure leaves neither behind.
+func (ds *sqliteDB) addTenant(ID string, config types.TenantConfig, qds ...types.QuotaDetails) error {
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	perms, err := json.Marshal(config.Permissions)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling permissions")
+	}
+
+	db := ds.getTableDB("tenants")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction for tenant creation")
+	}
+
+	size := tenantCNCISize(config)
+	_, err = tx.Exec("INSERT INTO tenants (id, name, subnet_bits, permissions, frozen, freeze_reason, preprovision_network, trash_retention, deferred_delete, max_subnets, cnci_vcpus, cnci_mem_mb, cnci_disk_mb) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", ID, config.Name, config.SubnetBits, string(perms), config.Frozen, config.FreezeReason, config.PreprovisionNetwork, config.TrashRetentionMinutes, config.DeferredDeleteMinutes, config.MaxSubnets, size.VCPUs, size.MemMB, size.DiskMB)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for i := range qds {
+		_, err = tx.Exec("REPLACE INTO quotas (tenant_id, name, value) VALUES (?, ?, ?)", ID, qds[i].Name, qds[i].Value)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Wrap(err, "error adding tenant quotas")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tenantCNCISize returns the CNCI size stored in the tenants table for a
+// tenant, zero where the cluster's size is in effect.
+func tenantCNCISize(config types.TenantConfig) types.CNCISize {
+	if config.CNCISize == nil {
+		return types.CNCISize{}
+	}
+
+	return *config.CNCISize
+}
+
+// cnciSizeOverride returns the CNCI size read from the tenants table, nil
+// if the tenant does not override the cluster's size.
+func cnciSizeOverride(size types.CNCISize) *types.CNCISize {
+	if size == (types.CNCISize{}) {
+		return nil
+	}
+
+	return &size
+}
+
+func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
+	query := `SELECT	tenants.id,
+				tenants.name,
+				tenants.subnet_bits,
+				tenants.permissions,
+				tenants.frozen,
+				tenants.freeze_reason,
+				tenants.preprovision_network,
+				tenants.trash_retention,
+				tenants.deferred_delete,
+				tenants.max_subnets,
+				tenants.cnci_vcpus,
+				tenants.cnci_mem_mb,
+				tenants.cnci_disk_mb
+		  FROM tenants
+		  WHERE tenants.id = ?`
+
+	db := ds.db
+
+	row := db.QueryRow(query, ID)
+
+	t := &tenant{}
+
+	var perms []byte
+	var size types.CNCISize
+	err := row.Scan(&t.ID, &t.Name, &t.SubnetBits, &perms, &t.Frozen, &t.FreezeReason, &t.PreprovisionNetwork, &t.TrashRetentionMinutes, &t.DeferredDeleteMinutes, &t.MaxSubnets, &size.VCPUs, &size.MemMB, &size.DiskMB)
+	if err != nil {
+		ds.log.Warningf("unable to retrieve tenant from tenants: %v", err)
+
+		if err == sql.ErrNoRows {
+			// not an error, it's just not there.
+			err = nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(perms, &t.Permissions); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling permissions")
+	}
+
+	t.CNCISize = cnciSizeOverride(size)
+
+	// for these items below, its ok to get err returned
+	// because a tenant could simply not have used any
+	// resources or networks yet.
+	err = ds.getTenantNetwork(t)
+	if err != nil {
+		if ds.log.V(2) {
+			ds.log.Infof("%v", err)
+		}
+	}
+
+	t.instances, err = ds.getTenantInstances(t.ID)
+	if err != nil {
+		if ds.log.V(2) {
+			ds.log.Infof("%v", err)
+		}
+	}
+
+	t.devices, err = ds.getTenantDevices(t.ID)
+	if err != nil {
+		if ds.log.V(2) {
+			ds.log.Infof("%v", err)
+		}
+	}
+
+	return t, err
+}
+
+func (ds *sqliteDB) getWorkloads() ([]types.Workload, error) {
+	var workloads []types.Workload
+
+	db := ds.db
+
+	query := `SELECT id,
+			 tenant_id,
+			 description,
+			 fw_type,
+			 vm_type,
+			 image_name,
+			 visibility,
+			 requirements,
+			 bounds,
+			 networks
+		  FROM workload_template
+		  WHERE visibility != ?`
+
+	rows, err := db.Query(query, types.Internal)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var wl types.Workload
+
+		var VMType string
+		var visibility string
+		var requirements []byte
+		var bounds []byte
+		var networks []byte
+
+		err = rows.Scan(&wl.ID, &wl.TenantID, &wl.Description, &wl.FWType, &VMType, &wl.ImageName, &visibility, &requirements, &bounds, &networks)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(networks) > 0 {
+			err = json.Unmarshal(networks, &wl.Networks)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = json.Unmarshal(requirements, &wl.Requirements)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bounds) > 0 {
+			wl.Bounds = &types.WorkloadBounds{}
+			err = json.Unmarshal(bounds, wl.Bounds)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		wl.Visibility = types.Visibility(visibility)
+
+		wl.Config, err = ds.getConfig(wl.ID)
+		if err != nil {
+			ds.log.Warningf("Skipping workload %s: unable to read config: %v", wl.ID, err)
+			continue
+		}
+
+		wl.Storage, err = ds.getWorkloadStorage(wl.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		wl.VMType = payloads.Hypervisor(VMType)
+
+		workloads = append(workloads, wl)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return workloads, nil
+}
+
+func (ds *sqliteDB) addWorkload(w types.Workload) error {
+	return ds.storeWorkload(w, "INSERT")
+}
+
+func (ds *sqliteDB) updateWorkload(w types.Workload) error {
+	return ds.storeWorkload(w, "REPLACE")
+}
+
+// storeWorkload writes a workload, its storage and its config file. verb is
+// INSERT for new workloads and REPLACE for updated ones.
+func (ds *sqliteDB) storeWorkload(w types.Workload, verb string) error {
+	db := ds.getTableDB("workload_template")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = ds.deleteWorkloadStorage(tx, w.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// add in any workload storage resources
+	for i := range w.Storage {
+		err := ds.createWorkloadStorage(tx, w.ID, &w.Storage[i])
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// write config to a temporary file which only replaces the config
+	// of the workload once the database has been updated, so that a
+	// failed update leaves the old definition intact.
+	filename := fmt.Sprintf("%s_config.yaml", w.ID)
+	path := filepath.Join(ds.workloadsPath, filename)
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, []byte(w.Config), 0644)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	requirements, err := json.Marshal(w.Requirements)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var bounds []byte
+	if w.Bounds != nil {
+		bounds, err = json.Marshal(w.Bounds)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	var networks []byte
+	if len(w.Networks) > 0 {
+		networks, err = json.Marshal(w.Networks)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(verb+" INTO workload_template (id, tenant_id, description, filename, fw_type, vm_type, image_name, visibility, requirements, bounds, networks) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", w.ID, w.TenantID, w.Description, filename, w.FWType, string(w.VMType), w.ImageName, w.Visibility, string(requirements), string(bounds), string(networks))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (ds *sqliteDB) deleteWorkload(ID string) error {
+	db := ds.getTableDB("workload_template")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = ds.deleteWorkloadStorage(tx, ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM workload_template WHERE id = ?", ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	filename := fmt.Sprintf("%s_config.yaml", ID)
+	path := filepath.Join(ds.workloadsPath, filename)
+	err = os.Remove(path)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	return err
+}
+
+func (ds *sqliteDB) getTenants() ([]*tenant, error) {
+	var tenants []*tenant
+
+	db := ds.getTableDB("tenants")
+
+	query := `SELECT	tenants.id,
+				tenants.name,
+				tenants.subnet_bits,
+				tenants.permissions,
+				tenants.frozen,
+				tenants.freeze_reason,
+				tenants.preprovision_network,
+				tenants.trash_retention,
+				tenants.deferred_delete,
+				tenants.max_subnets,
+				tenants.cnci_vcpus,
+				tenants.cnci_mem_mb,
+				tenants.cnci_disk_mb
+		  FROM tenants `
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var id sql.NullString
+		var name sql.NullString
+		var perms []byte
+		var size types.CNCISize
+
+		t := new(tenant)
+		err = rows.Scan(&id, &name, &t.SubnetBits, &perms, &t.Frozen, &t.FreezeReason, &t.PreprovisionNetwork, &t.TrashRetentionMinutes, &t.DeferredDeleteMinutes, &t.MaxSubnets, &size.VCPUs, &size.MemMB, &size.DiskMB)
+		if err != nil {
+			return nil, err
+		}
+
+		if id.Valid {
+			t.ID = id.String
+		}
+
+		if name.Valid {
+			t.Name = name.String
+		}
+
+		if err := json.Unmarshal(perms, &t.Permissions); err != nil {
+			return nil, errors.Wrap(err, "Error getting unmarshalling permissions")
+		}
+
+		t.CNCISize = cnciSizeOverride(size)
+
+		err = ds.getTenantNetwork(t)
+		if err != nil {
+			return nil, err
+		}
+
+		t.instances, err = ds.getTenantInstances(t.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		t.devices, err = ds.getTenantDevices(t.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		tenants = append(tenants, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+func (ds *sqliteDB) claimTenantIP(tenantID string, subnetInt uint32, rest uint32) error {
+	return ds.claimTenantIPs(tenantID, []tenantIP{{subnetInt, rest}})
+}
+
+// claimTenantIPs adds IPs to the tenant's network and removes them from
+// its released addresses.
+func (ds *sqliteDB) claimTenantIPs(tenantID string, IPs []tenantIP) error {
+	db := ds.getTableDB("tenant_network")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	cmd := `INSERT INTO tenant_network VALUES(?, ?, ?)`
+
+	stmt, err := tx.Prepare(cmd)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	for _, ip := range IPs {
+		_, err = stmt.Exec(tenantID, ip.subnet, ip.host)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM tenant_ip_released WHERE tenant_id = ? AND rest = ?", tenantID, ip.host)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// releaseTenantIP removes an address from the tenant's network and
+// records when it was released.
+func (ds *sqliteDB) releaseTenantIP(tenantID string, subnetInt uint32, rest uint32, released time.Time) error {
+	db := ds.getTableDB("tenant_network")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tenant_network WHERE tenant_id = ? AND subnet = ? AND rest = ?", tenantID, subnetInt, rest)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("REPLACE INTO tenant_ip_released (tenant_id, subnet, rest, release_time) VALUES (?, ?, ?, ?)",
+		tenantID, subnetInt, rest, released.UTC())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ds *sqliteDB) getTenantNetwork(tenant *tenant) error {
+	tenant.network = make(map[uint32]map[uint32]bool)
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	db := ds.getTableDB("tenant_network")
+
+	// get all subnet,rest values for this tenant
+	query := `SELECT subnet, rest
+		  FROM tenant_network
+		  WHERE tenant_id = ?`
+
+	rows, err := db.Query(query, tenant.ID)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var subnetInt uint32
+		var rest uint32
+
+		err = rows.Scan(&subnetInt, &rest)
+		if err != nil {
+			return err
+		}
+
+		_, ok := tenant.network[subnetInt]
+		if !ok {
+			sub := make(map[uint32]bool)
+			tenant.network[subnetInt] = sub
+		}
+
+		tenant.network[subnetInt][rest] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	tenant.released = make(map[uint32]time.Time)
+
+	releasedRows, err := db.Query("SELECT rest, release_time FROM tenant_ip_released WHERE tenant_id = ?", tenant.ID)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = releasedRows.Close() }()
+
+	for releasedRows.Next() {
+		var rest uint32
+		var released time.Time
+
+		err = releasedRows.Scan(&rest, &released)
+		if err != nil {
+			return err
+		}
+
+		tenant.released[rest] = released
+	}
+
+	return releasedRows.Err()
+}
+
+func (ds *sqliteDB) updateTenant(tenant *types.Tenant) error {
+	db := ds.getTableDB("tenants")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	perms, err := json.Marshal(tenant.Permissions)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling permissions")
+	}
+
+	size := tenantCNCISize(tenant.TenantConfig)
+	_, err = db.Exec("UPDATE tenants SET name = ?, subnet_bits = ?, permissions = ?, frozen = ?, freeze_reason = ?, preprovision_network = ?, trash_retention = ?, deferred_delete = ?, max_subnets = ?, cnci_vcpus = ?, cnci_mem_mb = ?, cnci_disk_mb = ? WHERE id = ?", tenant.Name, tenant.SubnetBits, string(perms), tenant.Frozen, tenant.FreezeReason, tenant.PreprovisionNetwork, tenant.TrashRetentionMinutes, tenant.DeferredDeleteMinutes, tenant.MaxSubnets, size.VCPUs, size.MemMB, size.DiskMB, tenant.ID)
+
+	return err
+}
+
+func (ds *sqliteDB) deleteTenant(tenantID string) error {
+	db := ds.getTableDB("tenants")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// first delete any quotas associated with this tenant
+	_, err = tx.Exec("DELETE FROM quotas WHERE tenant_id = ?", tenantID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tenant_ip_released WHERE tenant_id = ?", tenantID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// the usage of a deleted tenant is no longer reported
+	_, err = tx.Exec("DELETE FROM usage_released WHERE tenant_id = ?", tenantID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM usage_records WHERE tenant_id = ?", tenantID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// the credentials and grants of the tenant would be honoured again
+	// if a tenant were created with the same ID
+	cascade := []string{
+		"DELETE FROM api_keys WHERE tenant_id = ?",
+		"DELETE FROM tokens WHERE tenant_id = ?",
+		"DELETE FROM pool_tenants WHERE tenant_id = ?",
+		"DELETE FROM idempotency_keys WHERE tenant_id = ?",
+		"DELETE FROM server_group_members WHERE group_id IN (SELECT id FROM server_groups WHERE tenant_id = ?)",
+		"DELETE FROM server_groups WHERE tenant_id = ?",
+	}
+	for _, cmd := range cascade {
+		_, err = tx.Exec(cmd, tenantID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM tenants WHERE id = ?", tenantID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+
+	return err
+}
+
+func (ds *sqliteDB) getInstances() ([]*types.Instance, error) {
+	var instances []*types.Instance
+
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `
+	WITH latest AS
+	(
+		SELECT 	max(instance_statistics.timestamp),
+			instance_statistics.instance_id,
+			instance_statistics.state,
+			instance_statistics.ssh_ip,
+			instance_statistics.ssh_port,
+			instance_statistics.node_id
+		FROM instance_statistics
+		GROUP BY instance_statistics.instance_id
+	)
+	SELECT	instances.id,
+		instances.tenant_id,
+		IFNULL(latest.state, "` + payloads.ComputeStatusPending + `") AS state,
+		workload_id,
+		IFNULL(latest.ssh_ip, "Not Assigned") as ssh_ip,
+		latest.ssh_port as ssh_port,
+		COALESCE(NULLIF(instances.node_id, ''), latest.node_id, '') AS node_id,
+		mac_address,
+		vnic_uuid,
+		subnet,
+		ip,
+		name,
+		cnci,
+		vcpus,
+		mem_mb,
+		ephemeral_gb,
+		description,
+		template_name,
+		template_version,
+		status_reason,
+		deletion_protected,
+		nics,
+		user_data,
+		instances.create_time,
+		instances.delete_time
+	FROM instances
+	LEFT JOIN latest
+	ON instances.id = latest.instance_id
+	ORDER BY instances.create_time, instances.id
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var i types.Instance
+
+		var sshPort sql.NullInt64
+		var createTime sql.NullTime
+		var deleteTime sql.NullTime
+		var nics []byte
+
+		err = rows.Scan(&i.ID, &i.TenantID, &i.State, &i.WorkloadID, &i.SSHIP, &sshPort, &i.NodeID, &i.MACAddress, &i.VnicUUID, &i.Subnet, &i.IPAddress, &i.Name, &i.CNCI, &i.VCPUs, &i.MemMB, &i.EphemeralGB, &i.Description, &i.Template, &i.TemplateVersion, &i.StatusReason, &i.DeletionProtected, &nics, &i.UserData, &createTime, &deleteTime)
+		if err != nil {
+			return nil, err
+		}
+
+		i.NICs, err = unmarshalNICs(nics)
+		if err != nil {
+			return nil, err
+		}
+
+		if sshPort.Valid {
+			i.SSHPort = int(sshPort.Int64)
+		}
+		i.CreateTime = createTime.Time
+		setDeletePending(&i, deleteTime)
+
+		i.StateChange = sync.NewCond(&sync.Mutex{})
+
+		instances = append(instances, &i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+func (ds *sqliteDB) getTenantInstances(tenantID string) (map[string]*types.Instance, error) {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `
+	WITH latest AS
+	(
+		SELECT 	max(instance_statistics.timestamp),
+			instance_statistics.instance_id,
+			instance_statistics.state,
+			instance_statistics.ssh_ip,
+			instance_statistics.ssh_port,
+			instance_statistics.node_id
+		FROM instance_statistics
+		GROUP BY instance_statistics.instance_id
+	)
+	SELECT	instances.id,
+		instances.tenant_id,
+		IFNULL(latest.state, "` + payloads.ComputeStatusPending + `") AS state,
+		IFNULL(latest.ssh_ip, "Not Assigned") AS ssh_ip,
+		latest.ssh_port AS ssh_port,
+		workload_id,
+		COALESCE(NULLIF(instances.node_id, ''), latest.node_id, '') AS node_id,
+		mac_address,
+		vnic_uuid,
+		subnet,
+		ip,
+		name,
+		cnci,
+		vcpus,
+		mem_mb,
+		ephemeral_gb,
+		description,
+		template_name,
+		template_version,
+		status_reason,
+		deletion_protected,
+		nics,
+		user_data,
+		delete_time
+	FROM instances
+	LEFT JOIN latest
+	ON instances.id = latest.instance_id
+	WHERE instances.tenant_id = ?
+	`
+
+	rows, err := db.Query(query, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	instances := make(map[string]*types.Instance)
+	for rows.Next() {
+		var nodeID sql.NullString
+		var sshIP sql.NullString
+		var sshPort sql.NullInt64
+		var deleteTime sql.NullTime
+		var nics []byte
+
+		i := &types.Instance{}
+
+		err = rows.Scan(&i.ID, &i.TenantID, &i.State, &sshIP, &sshPort, &i.WorkloadID, &nodeID, &i.MACAddress, &i.VnicUUID, &i.Subnet, &i.IPAddress, &i.Name, &i.CNCI, &i.VCPUs, &i.MemMB, &i.EphemeralGB, &i.Description, &i.Template, &i.TemplateVersion, &i.StatusReason, &i.DeletionProtected, &nics, &i.UserData, &deleteTime)
+		if err != nil {
+			return nil, err
+		}
+
+		i.NICs, err = unmarshalNICs(nics)
+		if err != nil {
+			return nil, err
+		}
+
+		if nodeID.Valid {
+			i.NodeID = nodeID.String
+		}
+
+		if sshIP.Valid {
+			i.SSHIP = sshIP.String
+		}
+
+		if sshPort.Valid {
+			i.SSHPort = int(sshPort.Int64)
+		}
+		setDeletePending(i, deleteTime)
+
+		i.StateChange = sync.NewCond(&sync.Mutex{})
+
+		instances[i.ID] = i
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// setDeletePending puts an instance whose deletion has been deferred back
+// into the deleted-pending state, whatever its node last reported.
+func setDeletePending(i *types.Instance, deleteTime sql.NullTime) {
+	if deleteTime.Valid {
+		i.DeleteTime = deleteTime.Time
+		i.State = payloads.DeletePending
+	}
+}
+
+// unmarshalNICs decodes the additional network interfaces of an instance,
+// which instances with only a primary interface do not record.
+func unmarshalNICs(data []byte) ([]types.NIC, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var nics []types.NIC
+	err := json.Unmarshal(data, &nics)
+	return nics, err
+}
+
+func (ds *sqliteDB) addInstance(ctx context.Context, instance *types.Instance) error {
+	var nics []byte
+	if len(instance.NICs) > 0 {
+		var err error
+		nics, err = json.Marshal(instance.NICs)
+		if err != nil {
+			return err
+		}
+	}
+
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, "INSERT INTO instances (id, tenant_id, workload_id, mac_address, vnic_uuid, subnet, ip, create_time, name, cnci, vcpus, mem_mb, ephemeral_gb, description, template_name, template_version, deletion_protected, nics, user_data) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", instance.ID, instance.TenantID, instance.WorkloadID, instance.MACAddress, instance.VnicUUID, instance.Subnet, instance.IPAddress, instance.CreateTime.Format(time.RFC3339Nano), instance.Name, instance.CNCI, instance.VCPUs, instance.MemMB, instance.EphemeralGB, instance.Description, instance.Template, instance.TemplateVersion, instance.DeletionProtected, string(nics), instance.UserData)
+
+	return err
+}
+
+func (ds *sqliteDB) deleteInstance(instanceID string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM instance_placements WHERE instance_id = ?", instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM instance_conditions WHERE instance_id = ?", instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM instance_tags WHERE instance_id = ?", instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM instances WHERE id = ?", instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addPlacement records an instance being placed on a node and makes the
+// node the instance's current node.
+func (ds *sqliteDB) addPlacement(instanceID string, p types.Placement) error {
+	db := ds.getTableDB("instance_placements")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO instance_placements (instance_id, node_id, timestamp, reason) VALUES (?, ?, ?, ?)", instanceID, p.NodeID, p.Timestamp, string(p.Reason))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE instances SET node_id = ? WHERE id = ?", p.NodeID, instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateInstanceNode sets the node an instance is currently placed on, or
+// clears it if nodeID is empty.
+func (ds *sqliteDB) updateInstanceNode(instanceID string, nodeID string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET node_id = ? WHERE id = ?", nodeID, instanceID)
+
+	return err
+}
+
+// updateInstanceStatusReason records why the last launch of an instance
+// failed.
+func (ds *sqliteDB) updateInstanceStatusReason(instanceID string, reason string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET status_reason = ? WHERE id = ?", reason, instanceID)
+
+	return err
+}
+
+// updateInstanceDeleteTime records when an instance whose deletion has been
+// deferred is to be deleted, or clears the time if deleteTime is zero.
+func (ds *sqliteDB) updateInstanceDeleteTime(ctx context.Context, instanceID string, deleteTime time.Time) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var t interface{}
+	if !deleteTime.IsZero() {
+		t = deleteTime.Format(time.RFC3339Nano)
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE instances SET delete_time = ? WHERE id = ?", t, instanceID)
+
+	return err
+}
+
+// updateInstanceTenant records the tenant and subnet a CNCI launched ahead
+// of demand has been assigned to.
+func (ds *sqliteDB) updateInstanceTenant(instanceID string, tenantID string, subnet string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET tenant_id = ?, subnet = ? WHERE id = ?", tenantID, subnet, instanceID)
+
+	return err
+}
+
+// getPlacements returns the placements of an instance, oldest first.
+func (ds *sqliteDB) getPlacements(instanceID string) ([]types.Placement, error) {
+	placements := []types.Placement{}
+
+	db := ds.getTableDB("instance_placements")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT node_id, timestamp, reason FROM instance_placements WHERE instance_id = ? ORDER BY rowid", instanceID)
+	if err != nil {
+		return placements, errors.Wrap(err, "error getting placements from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var p types.Placement
+		var reason string
+
+		err = rows.Scan(&p.NodeID, &p.Timestamp, &reason)
+		if err != nil {
+			return []types.Placement{}, errors.Wrap(err, "error reading placement row from database")
+		}
+
+		p.Reason = types.PlacementReason(reason)
+		placements = append(placements, p)
+	}
+
+	return placements, rows.Err()
+}
+
+// getInstanceConditions returns the conditions of all instances, keyed by
+// instance, in the order in which they were reported.
+func (ds *sqliteDB) getInstanceConditions() (map[string][]types.InstanceCondition, error) {
+	conditions := make(map[string][]types.InstanceCondition)
+
+	db := ds.getTableDB("instance_conditions")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT instance_id, type, message, timestamp FROM instance_conditions ORDER BY rowid")
+	if err != nil {
+		return conditions, errors.Wrap(err, "error getting instance conditions from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var instanceID string
+		var conditionType string
+		var c types.InstanceCondition
+
+		err = rows.Scan(&instanceID, &conditionType, &c.Message, &c.Timestamp)
+		if err != nil {
+			return conditions, errors.Wrap(err, "error reading instance condition row from database")
+		}
+
+		c.Type = payloads.InstanceWarningType(conditionType)
+		conditions[instanceID] = append(conditions[instanceID], c)
+	}
+
+	return conditions, rows.Err()
+}
+
+// updateInstanceConditions replaces the conditions of an instance.
+func (ds *sqliteDB) updateInstanceConditions(instanceID string, conditions []types.InstanceCondition) error {
+	db := ds.getTableDB("instance_conditions")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM instance_conditions WHERE instance_id = ?", instanceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, c := range conditions {
+		_, err = tx.Exec("INSERT INTO instance_conditions (instance_id, type, message, timestamp) VALUES (?, ?, ?, ?)", instanceID, string(c.Type), c.Message, c.Timestamp)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getInstanceTags returns the tags of all instances, keyed by instance.
+func (ds *sqliteDB) getInstanceTags() (map[string]map[string]string, error) {
+	tags := make(map[string]map[string]string)
+
+	db := ds.getTableDB("instance_tags")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT instance_id, key, value FROM instance_tags")
+	if err != nil {
+		return tags, errors.Wrap(err, "error getting instance tags from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var instanceID, key, value string
+
+		err = rows.Scan(&instanceID, &key, &value)
+		if err != nil {
+			return tags, errors.Wrap(err, "error reading instance tag row from database")
+		}
+
+		if tags[instanceID] == nil {
+			tags[instanceID] = make(map[string]string)
+		}
+		tags[instanceID][key] = value
+	}
+
+	return tags, rows.Err()
+}
+
+// setInstanceTag adds a tag to an instance or replaces its value.
+func (ds *sqliteDB) setInstanceTag(instanceID string, key string, value string) error {
+	db := ds.getTableDB("instance_tags")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("REPLACE INTO instance_tags (instance_id, key, value) VALUES (?, ?, ?)", instanceID, key, value)
+
+	return err
+}
+
+func (ds *sqliteDB) deleteInstanceTag(instanceID string, key string) error {
+	db := ds.getTableDB("instance_tags")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM instance_tags WHERE instance_id = ? AND key = ?", instanceID, key)
+
+	return err
+}
+
+// addHistoryEntry records an entry in the history of an instance.
+func (ds *sqliteDB) addHistoryEntry(instanceID string, tenantID string, e types.InstanceHistoryEntry) error {
+	db := ds.getTableDB("instance_history")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO instance_history (instance_id, tenant_id, timestamp, type, message, node_id, actor) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		instanceID, tenantID, e.Timestamp, string(e.Type), e.Message, e.NodeID, e.Actor)
+
+	return err
+}
+
+// getHistory returns the tenant of an instance and the entries in its
+// history, oldest first.
+func (ds *sqliteDB) getHistory(instanceID string) (string, []types.InstanceHistoryEntry, error) {
+	var tenantID string
+	entries := []types.InstanceHistoryEntry{}
+
+	db := ds.getTableDB("instance_history")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT tenant_id, timestamp, type, message, node_id, actor FROM instance_history WHERE instance_id = ? ORDER BY id", instanceID)
+	if err != nil {
+		return "", entries, errors.Wrap(err, "error getting instance history from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var e types.InstanceHistoryEntry
+		var entryType string
+
+		err = rows.Scan(&tenantID, &e.Timestamp, &entryType, &e.Message, &e.NodeID, &e.Actor)
+		if err != nil {
+			return "", []types.InstanceHistoryEntry{}, errors.Wrap(err, "error reading instance history row from database")
+		}
+
+		e.Type = types.HistoryEntryType(entryType)
+		entries = append(entries, e)
+	}
+
+	return tenantID, entries, rows.Err()
+}
+
+// getLastHistoryEntries returns the most recent entry in the history of
+// each instance, keyed by instance, along with the instance's tenant.
+func (ds *sqliteDB) getLastHistoryEntries() (map[string]historyOwner, error) {
+	last := make(map[string]historyOwner)
+
+	db := ds.getTableDB("instance_history")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `SELECT instance_id, tenant_id, timestamp
+		  FROM instance_history
+		  WHERE id IN (SELECT MAX(id) FROM instance_history GROUP BY instance_id)`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return last, errors.Wrap(err, "error getting instance history from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var instanceID string
+		var o historyOwner
+
+		err = rows.Scan(&instanceID, &o.tenantID, &o.timestamp)
+		if err != nil {
+			return last, errors.Wrap(err, "error reading instance history row from database")
+		}
+
+		last[instanceID] = o
+	}
+
+	return last, rows.Err()
+}
+
+// deleteHistory removes the history of an instance.
+func (ds *sqliteDB) deleteHistory(instanceID string) error {
+	db := ds.getTableDB("instance_history")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM instance_history WHERE instance_id = ?", instanceID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateInstance(instance *types.Instance) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET mac_address = ?, ip = ? WHERE id = ?", instance.MACAddress, instance.IPAddress, instance.ID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateInstanceName(instanceID string, name string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET name = ? WHERE id = ?", name, instanceID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateInstanceDescription(instanceID string, description string) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET description = ? WHERE id = ?", description, instanceID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateInstanceDeletionProtection(instanceID string, protected bool) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET deletion_protected = ? WHERE id = ?", protected, instanceID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateInstanceRequirements(instanceID string, vcpus int, memMB int) error {
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE instances SET vcpus = ?, mem_mb = ? WHERE id = ?", vcpus, memMB, instanceID)
+
+	return err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern returns a pattern, for LIKE comparisons escaped with \,
+// which matches text containing s.  The wildcards in s match only
+// themselves.
+func likePattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// queryIDs returns the IDs selected by query.
+func (ds *sqliteDB) queryIDs(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var IDs []string
+	for rows.Next() {
+		var ID string
+
+		err = rows.Scan(&ID)
+		if err != nil {
+			return nil, err
+		}
+
+		IDs = append(IDs, ID)
+	}
+
+	return IDs, rows.Err()
+}
+
+// filterInstances returns the IDs of the instances of a tenant, or of all
+// tenants if tenantID is empty, selected by match.  The node of an
+// instance is taken from its latest statistics, as when the instances are
+// loaded.  The state is not matched as some states are only known to the
+// datastore's cache.
+func (ds *sqliteDB) filterInstances(tenantID string, match types.InstanceFilter) ([]string, error) {
+	var where []string
+	var args []interface{}
+
+	if tenantID != "" {
+		where = append(where, "instances.tenant_id = ?")
+		args = append(args, tenantID)
+	}
+
+	if match.WorkloadID != "" {
+		where = append(where, "instances.workload_id = ?")
+		args = append(args, match.WorkloadID)
+	}
+
+	if match.NodeID != "" {
+		where = append(where, "COALESCE(NULLIF(instances.node_id, ''), latest.node_id, '') = ?")
+		args = append(args, match.NodeID)
+	}
+
+	if match.Name != "" {
+		where = append(where, "instances.name = ?")
+		args = append(args, match.Name)
+	}
+
+	if match.Search != "" {
+		pattern := likePattern(match.Search)
+		where = append(where, `(instances.name LIKE ? ESCAPE '\' OR instances.description LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+
+	if match.TagKey != "" {
+		where = append(where, "instances.id IN (SELECT instance_id FROM instance_tags WHERE key = ? AND value = ?)")
+		args = append(args, match.TagKey, match.TagValue)
+	}
+
+	query := "SELECT instances.id FROM instances"
+
+	// the latest statistics are only needed to filter by node.  They
+	// are found by ID as the timestamps of statistics recorded within
+	// the same second are equal.
+	if match.NodeID != "" {
+		query = `
+		WITH latest AS
+		(
+			SELECT	instance_id, node_id
+			FROM instance_statistics
+			WHERE id IN
+			(
+				SELECT max(id) FROM instance_statistics
+				GROUP BY instance_id
+			)
+		)
+		SELECT instances.id FROM instances
+		LEFT JOIN latest
+		ON instances.id = latest.instance_id`
+	}
+
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return ds.queryIDs(ds.getTableDB("instances"), query, args...)
+}
+
+// searchWorkloads returns the IDs of the workloads available to a tenant
+// whose description contains search.
+func (ds *sqliteDB) searchWorkloads(tenantID string, search string) ([]string, error) {
+	query := `SELECT id FROM workload_template
+		  WHERE (tenant_id = ? OR visibility = ?)
+		  AND description LIKE ? ESCAPE '\'`
+
+	return ds.queryIDs(ds.getTableDB("workload_template"), query, tenantID, string(types.Public), likePattern(search))
+}
+
+func (ds *sqliteDB) addNodeStat(stat payloads.Stat) error {
+	db := ds.getTableDB("node_statistics")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO node_statistics (node_id, mem_total_mb, mem_available_mb, disk_total_mb, disk_available_mb, load, cpus_online) VALUES(?, ?, ?, ?, ?, ?, ?)", stat.NodeUUID, stat.MemTotalMB, stat.MemAvailableMB, stat.DiskTotalMB, stat.DiskAvailableMB, stat.Load, stat.CpusOnline)
+
+	return err
+}
+
+func (ds *sqliteDB) addInstanceStats(stats []payloads.InstanceStat, nodeID string) error {
+	db := ds.getTableDB("instance_statistics")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	cmd := `INSERT INTO instance_statistics (instance_id, memory_usage_mb, disk_usage_mb, cpu_usage, state, node_id, ssh_ip, ssh_port)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := tx.Prepare(cmd)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	defer func() { _ = stmt.Close() }()
+
+	for index := range stats {
+		stat := stats[index]
+
+		_, err = stmt.Exec(stat.InstanceUUID, stat.MemoryUsageMB, stat.DiskUsageMB, stat.CPUUsage, stat.State, nodeID, stat.SSHIP, stat.SSHPort)
+		if err != nil {
+			ds.log.Warningf("%v", err)
+			// but keep going
+		}
+	}
+
+	err = tx.Commit()
+
+	return err
+}
+
+func (ds *sqliteDB) addFrameStat(stat payloads.FrameTrace) error {
+	db := ds.getTableDB("frame_statistics")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO frame_statistics (label, type, operand, start_timestamp, end_timestamp)
+		  VALUES(?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(query, stat.Label, stat.Type, stat.Operand, stat.StartTimestamp, stat.EndTimestamp)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var id int
+
+	err = tx.QueryRow("SELECT last_insert_rowid();").Scan(&id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for index := range stat.Nodes {
+		t := stat.Nodes[index]
+
+		cmd := `INSERT INTO trace_data (frame_id, ssntp_uuid, tx_timestamp, rx_timestamp)
+			VALUES(?, ?, ?, ?);`
+
+		_, err = tx.Exec(cmd, id, t.SSNTPUUID, t.TxTimestamp, t.RxTimestamp)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+
+	return err
+}
+
+// GetEventLog retrieves all the log entries stored in the datastore.
+func (ds *sqliteDB) getEventLog() ([]*types.LogEntry, error) {
+	var logEntries []*types.LogEntry
+
+	db := ds.getTableDB("log")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT id, timestamp, tenant_id, node_id, type, message, object_id, actor, on_behalf_of, failure_code FROM log")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	logEntries = make([]*types.LogEntry, 0)
+	for rows.Next() {
+		var e types.LogEntry
+		err = rows.Scan(&e.ID, &e.Timestamp, &e.TenantID, &e.NodeID, &e.EventType, &e.Message, &e.ObjectID, &e.Actor, &e.OnBehalfOf, &e.FailureCode)
+		if err != nil {
+			return nil, err
+		}
+		logEntries = append(logEntries, &e)
+	}
+
+	return logEntries, err
+}
+
+// sqliteTimeFormat is the format of the timestamps stored by sqlite for
+// CURRENT_TIMESTAMP, which are in UTC.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// getEventsForTenant retrieves the log entries of a tenant which match
+// filter, in the order in which they were logged.  The entries of all
+// tenants are retrieved if tenantID is empty.
+func (ds *sqliteDB) getEventsForTenant(tenantID string, filter types.EventFilter) ([]*types.LogEntry, error) {
+	var where []string
+	var args []interface{}
+
+	if tenantID != "" {
+		where = append(where, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+
+	if filter.Marker > 0 {
+		where = append(where, "id > ?")
+		args = append(args, filter.Marker)
+	}
+
+	if !filter.Start.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, filter.Start.UTC().Format(sqliteTimeFormat))
+	}
+
+	if !filter.End.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, filter.End.UTC().Format(sqliteTimeFormat))
+	}
+
+	if filter.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, filter.Type)
+	}
+
+	if filter.ObjectID != "" {
+		where = append(where, "object_id = ?")
+		args = append(args, filter.ObjectID)
+	}
+
+	query := "SELECT id, timestamp, tenant_id, node_id, type, message, object_id, actor, on_behalf_of, failure_code FROM log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id"
+
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	db := ds.getTableDB("log")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	logEntries := make([]*types.LogEntry, 0)
+	for rows.Next() {
+		var e types.LogEntry
+		err = rows.Scan(&e.ID, &e.Timestamp, &e.TenantID, &e.NodeID, &e.EventType, &e.Message, &e.ObjectID, &e.Actor, &e.OnBehalfOf, &e.FailureCode)
+		if err != nil {
+			return nil, err
+		}
+		logEntries = append(logEntries, &e)
+	}
+
+	return logEntries, rows.Err()
+}
+
+// getNodeInstanceSummary aggregates the latest stats of the instances placed
+// on a node by state.  Instances which have yet to report stats are pending.
+// Unknown usage is reported as negative by the nodes and is not counted.
+func (ds *sqliteDB) getNodeInstanceSummary(nodeID string) (types.CiaoNodeSummary, error) {
+	summary := types.CiaoNodeSummary{ID: nodeID}
+
+	db := ds.getTableDB("instances")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `
+	WITH latest AS
+	(
+		SELECT	instance_statistics.instance_id,
+			instance_statistics.state,
+			instance_statistics.node_id,
+			instance_statistics.memory_usage_mb,
+			instance_statistics.disk_usage_mb
+		FROM instance_statistics
+		WHERE instance_statistics.id IN
+			(SELECT max(id) FROM instance_statistics GROUP BY instance_id)
+	)
+	SELECT	IFNULL(latest.state, "` + payloads.ComputeStatusPending + `") AS state,
+		count(instances.id),
+		IFNULL(sum(max(latest.memory_usage_mb, 0)), 0),
+		IFNULL(sum(max(latest.disk_usage_mb, 0)), 0)
+	FROM instances
+	LEFT JOIN latest
+	ON instances.id = latest.instance_id
+	WHERE COALESCE(NULLIF(instances.node_id, ''), latest.node_id, '') = ?
+	AND instances.cnci = 0
+	GROUP BY state
+	`
+
+	rows, err := db.Query(query, nodeID)
+	if err != nil {
+		return summary, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var state string
+		var count, mem, disk int
+
+		err = rows.Scan(&state, &count, &mem, &disk)
+		if err != nil {
+			return summary, err
+		}
+
+		summary.TotalInstances += count
+		summary.MemUsage += mem
+		summary.DiskUsage += disk
+
+		switch state {
+		case payloads.Pending:
+			summary.TotalPendingInstances += count
+		case payloads.Running:
+			summary.TotalRunningInstances += count
+		case payloads.Exited:
+			summary.TotalExitedInstances += count
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return summary, err
+	}
+
+	var lastSeen sql.NullString
+	err = ds.getTableDB("node_statistics").QueryRow(`SELECT max(timestamp)
+		FROM node_statistics
+		WHERE node_id = ?`, nodeID).Scan(&lastSeen)
+	if err != nil {
+		return summary, err
+	}
+
+	if lastSeen.Valid {
+		summary.LastSeen, err = time.ParseInLocation(sqliteTimeFormat, lastSeen.String, time.UTC)
+	}
+
+	return summary, err
+}
+
+// GetBatchFrameSummary will retieve the count of traces we have for a specific label
+func (ds *sqliteDB) getBatchFrameSummary() ([]types.BatchFrameSummary, error) {
+	var stats []types.BatchFrameSummary
+
+	db := ds.getTableDB("frame_statistics")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `SELECT label, count(id)
+		  FROM frame_statistics
+		  GROUP BY label;`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	stats = make([]types.BatchFrameSummary, 0)
+
+	for rows.Next() {
+		var stat types.BatchFrameSummary
+
+		err = rows.Scan(&stat.BatchID, &stat.NumInstances)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, err
+}
+
+// GetBatchFrameStatistics will show individual trace data per instance for a batch of trace data.
+// The batch is identified by the label.
+func (ds *sqliteDB) getBatchFrameStatistics(label string) ([]types.BatchFrameStat, error) {
+	var stats []types.BatchFrameStat
+
+	db := ds.getTableDB("frame_statistics")
+
+	query := `WITH total AS
+		 (
+			SELECT	id,
+				start_timestamp,
+				end_timestamp,
+				(julianday(end_timestamp) - julianday(start_timestamp)) * 24 * 60 * 60 AS total_elapsed
+			FROM frame_statistics
+			WHERE label = ?
+		),
+		total_start AS
+		(
+			SELECT	trace_data.frame_id,
+				trace_data.ssntp_uuid,
+				(julianday(trace_data.tx_timestamp) - julianday(total.start_timestamp)) * 24 * 60 * 60 AS total_elapsed
+			FROM trace_data
+			JOIN total
+			WHERE rx_timestamp = '' and trace_data.frame_id = total.id
+		),
+		total_end AS
+		(
+			SELECT 	trace_data.frame_id,
+				trace_data.ssntp_uuid,
+				(julianday(total.end_timestamp) - julianday(trace_data.rx_timestamp)) * 24 * 60 * 60 AS total_elapsed
+			FROM trace_data
+			JOIN total
+			WHERE tx_timestamp = '' and trace_data.frame_id = total.id
+		),
+		total_per_node AS
+		(
+			SELECT	trace_data.frame_id,
+				trace_data.ssntp_uuid,
+				(julianday(trace_data.tx_timestamp) - julianday(trace_data.rx_timestamp)) * 24 * 60 *60 AS total_elapsed
+			FROM trace_data
+			WHERE tx_timestamp != '' and rx_timestamp != ''
+		),
+		diffs AS
+		(
+			SELECT 	total.id AS id,
+				total.total_elapsed AS total_elapsed,
+				total_start.total_elapsed AS controller_elapsed,
+				total_end.total_elapsed AS launcher_elapsed,
+				total_per_node.total_elapsed AS scheduler_elapsed
+			FROM total
+			LEFT JOIN total_start
+			ON total.id = total_start.frame_id
+			LEFT JOIN total_end
+			ON total_start.frame_id = total_end.frame_id
+			LEFT JOIN total_per_node
+			ON total_start.frame_id = total_per_node.frame_id
+		),
+		averages AS
+		(
+			SELECT	avg(diffs.total_elapsed) AS avg_total_elapsed,
+				avg(diffs.controller_elapsed) AS avg_controller,
+				avg(diffs.launcher_elapsed) AS avg_launcher,
+				avg(diffs.scheduler_elapsed) AS avg_scheduler
+			FROM diffs
+		),
+		variance AS
+		(
+			SELECT	avg((total_start.total_elapsed - averages.avg_controller) * (total_start.total_elapsed - averages.avg_controller)) AS controller,
+				avg((total_end.total_elapsed - averages.avg_launcher) * (total_end.total_elapsed - averages.avg_launcher)) AS launcher,
+				avg((total_per_node.total_elapsed - averages.avg_scheduler) * (total_per_node.total_elapsed - averages.avg_scheduler)) AS scheduler
+			FROM total_start
+			LEFT JOIN total_end
+			ON total_start.frame_id = total_end.frame_id
+			LEFT JOIN total_per_node
+			ON total_start.frame_id = total_per_node.frame_id
+			JOIN averages
+		)
+		SELECT	count(total.id) AS num_instances,
+			(julianday(max(total.end_timestamp)) - julianday(min(total.start_timestamp))) * 24 * 60 * 60 AS total_elapsed,
+			averages.avg_total_elapsed AS average_total_elapsed,
+			averages.avg_controller AS average_controller_elapsed,
+			averages.avg_launcher AS average_launcher_elapsed,
+			averages.avg_scheduler AS average_scheduler_elapsed,
+			variance.controller AS controller_variance,
+			variance.launcher AS launcher_variance,
+			variance.scheduler AS scheduler_variance
+		FROM variance
+		JOIN total
+		JOIN averages;`
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, label)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	stats = make([]types.BatchFrameStat, 0)
+
+	for rows.Next() {
+		var stat types.BatchFrameStat
+		var numInstances sql.NullInt64
+		var totalElapsed sql.NullFloat64
+		var averageElapsed sql.NullFloat64
+		var averageControllerElapsed sql.NullFloat64
+		var averageLauncherElapsed sql.NullFloat64
+		var averageSchedulerElapsed sql.NullFloat64
+		var varianceController sql.NullFloat64
+		var varianceLauncher sql.NullFloat64
+		var varianceScheduler sql.NullFloat64
+
+		err = rows.Scan(&numInstances, &totalElapsed, &averageElapsed, &averageControllerElapsed, &averageLauncherElapsed, &averageSchedulerElapsed, &varianceController, &varianceLauncher, &varianceScheduler)
+		if err != nil {
+			return nil, err
+		}
+
+		if numInstances.Valid {
+			stat.NumInstances = int(numInstances.Int64)
+		}
+
+		if totalElapsed.Valid {
+			stat.TotalElapsed = totalElapsed.Float64
+		}
+
+		if averageElapsed.Valid {
+			stat.AverageElapsed = averageElapsed.Float64
+		}
+
+		if averageControllerElapsed.Valid {
+			stat.AverageControllerElapsed = averageControllerElapsed.Float64
+		}
+
+		if averageLauncherElapsed.Valid {
+			stat.AverageLauncherElapsed = averageLauncherElapsed.Float64
+		}
+
+		if averageSchedulerElapsed.Valid {
+			stat.AverageSchedulerElapsed = averageSchedulerElapsed.Float64
+		}
+
+		if varianceController.Valid {
+			stat.VarianceController = varianceController.Float64
+		}
+
+		if varianceLauncher.Valid {
+			stat.VarianceLauncher = varianceLauncher.Float64
+		}
+
+		if varianceScheduler.Valid {
+			stat.VarianceScheduler = varianceScheduler.Float64
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, err
+}
+
+func (ds *sqliteDB) getTenantDevices(tenantID string) (map[string]types.Volume, error) {
+	devices := make(map[string]types.Volume)
+
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	query := `SELECT	block_data.id,
+				block_data.tenant_id,
+				block_data.size,
+				block_data.state,
+				block_data.create_time,
+				block_data.name,
+				block_data.description,
+				block_data.internal,
+				block_data.deletion_protected
+		  FROM	block_data
+		  WHERE block_data.tenant_id = ?`
+
+	rows, err := db.Query(query, tenantID)
+	if err != nil {
+		return devices, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var state string
+		var data types.Volume
+
+		err = rows.Scan(&data.ID, &data.TenantID, &data.Size, &state, &data.CreateTime, &data.Name, &data.Description, &data.Internal, &data.DeletionProtected)
+		if err != nil {
+			continue
+		}
+
+		data.State = types.BlockState(state)
+		devices[data.ID] = data
+	}
+
+	if err = rows.Err(); err != nil {
+		return devices, err
+	}
+
+	return devices, nil
+}
+
+func (ds *sqliteDB) getAllBlockData() (map[string]types.Volume, error) {
+	devices := make(map[string]types.Volume)
+
+	db := ds.getTableDB("block_data")
+
+	query := `SELECT	block_data.id,
+				block_data.tenant_id,
+				block_data.size,
+				block_data.state,
+				block_data.create_time,
+				block_data.name,
+				block_data.description,
+				block_data.internal,
+				block_data.deletion_protected
+		  FROM	block_data
+		  ORDER BY block_data.create_time, block_data.id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var data types.Volume
+		var state string
+
+		err = rows.Scan(&data.ID, &data.TenantID, &data.Size, &state, &data.CreateTime, &data.Name, &data.Description, &data.Internal, &data.DeletionProtected)
+		if err != nil {
+			continue
+		}
+
+		data.State = types.BlockState(state)
+		devices[data.ID] = data
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+func (ds *sqliteDB) addBlockData(ctx context.Context, data types.Volume) error {
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	createTime := data.CreateTime.Format(time.RFC3339Nano)
+
+	_, err := db.ExecContext(ctx, `INSERT INTO block_data
+		(id, tenant_id, size, state, create_time, name, description, internal, state_time, deletion_protected)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		data.ID, data.TenantID, data.Size, string(data.State),
+		createTime, data.Name, data.Description, data.Internal, createTime, data.DeletionProtected)
+
+	return err
+}
+
+// For now we only support updating the state.  The time of the update is
+// recorded if the state changes.
+func (ds *sqliteDB) updateBlockData(ctx context.Context, data types.Volume) error {
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, `UPDATE block_data
+		SET state_time = CASE WHEN state = ? THEN state_time ELSE ? END, state = ?
+		WHERE id = ?`,
+		string(data.State), time.Now().Format(time.RFC3339Nano), string(data.State), data.ID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateBlockDeletionProtection(ctx context.Context, ID string, protected bool) error {
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, "UPDATE block_data SET deletion_protected = ? WHERE id = ?", protected, ID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateBlockSize(ctx context.Context, ID string, size int) error {
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, "UPDATE block_data SET size = ? WHERE id = ?", size, ID)
+
+	return err
+}
+
+func (ds *sqliteDB) deleteBlockData(ctx context.Context, ID string) error {
+	db := ds.getTableDB("block_data")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM block_data WHERE id = ?", ID)
+
+	return err
+}
+
+func (ds *sqliteDB) addStorageAttachment(ctx context.Context, a types.StorageAttachment) error {
+	db := ds.getTableDB("attachments")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.ExecContext(ctx, "INSERT INTO attachments (id, instance_id, block_id, ephemeral, boot, tag, device) VALUES (?, ?, ?, ?, ?, ?, ?)", a.ID, a.InstanceID, a.BlockID, a.Ephemeral, a.Boot, a.Tag, a.Device)
+
+	return err
+}
+
+func (ds *sqliteDB) updateStorageAttachmentDevice(ID string, device string) error {
+	db := ds.getTableDB("attachments")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE attachments SET device = ? WHERE id = ?", device, ID)
+
+	return err
+}
+
+func (ds *sqliteDB) getAllStorageAttachments() (map[string]types.StorageAttachment, error) {
+	attachments := make(map[string]types.StorageAttachment)
+
+	db := ds.getTableDB("attachments")
+
+	query := `SELECT	attachments.id,
+				attachments.instance_id,
+				attachments.block_id,
+				attachments.ephemeral,
+				attachments.boot,
+				attachments.tag,
+				attachments.device
+		  FROM	attachments `
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return attachments, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var a types.StorageAttachment
+
+		err = rows.Scan(&a.ID, &a.InstanceID, &a.BlockID, &a.Ephemeral, &a.Boot, &a.Tag, &a.Device)
+		if err != nil {
+			continue
+		}
+		attachments[a.ID] = a
+	}
+
+	if err = rows.Err(); err != nil {
+		return attachments, err
+	}
+
+	return attachments, nil
+}
+
+// getAttachmentDetails retrieves the storage attachments which match filter
+// in ID order.  The node of an attachment is that of the latest placement of
+// its instance.
+func (ds *sqliteDB) getAttachmentDetails(filter types.AttachmentFilter) ([]types.AttachmentDetails, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.TenantID != "" {
+		where = append(where, "block_data.tenant_id = ?")
+		args = append(args, filter.TenantID)
+	}
+
+	if filter.InstanceID != "" {
+		where = append(where, "attachments.instance_id = ?")
+		args = append(args, filter.InstanceID)
+	}
+
+	if filter.VolumeID != "" {
+		where = append(where, "attachments.block_id = ?")
+		args = append(args, filter.VolumeID)
+	}
+
+	if filter.NodeID != "" {
+		where = append(where, "instance_placements.node_id = ?")
+		args = append(args, filter.NodeID)
+	}
+
+	if filter.State != "" {
+		where = append(where, "block_data.state = ?")
+		args = append(args, string(filter.State))
+	}
+
+	if filter.Marker != "" {
+		where = append(where, "attachments.id > ?")
+		args = append(args, filter.Marker)
+	}
+
+	query := `SELECT	attachments.id,
+				block_data.tenant_id,
+				attachments.instance_id,
+				attachments.block_id,
+				COALESCE(instance_placements.node_id, ''),
+				block_data.state,
+				block_data.state_time,
+				attachments.boot,
+				attachments.ephemeral,
+				attachments.tag,
+				attachments.device
+		  FROM	attachments
+		  JOIN	block_data ON block_data.id = attachments.block_id
+		  LEFT JOIN instance_placements ON instance_placements.rowid =
+			(SELECT MAX(rowid) FROM instance_placements
+			 WHERE instance_placements.instance_id = attachments.instance_id)`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY attachments.id"
+
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	db := ds.getTableDB("attachments")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	attachments := []types.AttachmentDetails{}
+	for rows.Next() {
+		var a types.AttachmentDetails
+		var state string
+
+		err = rows.Scan(&a.ID, &a.TenantID, &a.InstanceID, &a.VolumeID, &a.NodeID, &state,
+			&a.StateTime, &a.Boot, &a.Ephemeral, &a.Tag, &a.Device)
+		if err != nil {
+			return nil, err
+		}
+
+		a.State = types.BlockState(state)
+		attachments = append(attachments, a)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (ds *sqliteDB) deleteStorageAttachment(ID string) error {
+	db := ds.getTableDB("attachments")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM attachments WHERE id = ?", ID)
+
+	return err
+}
+
+// this is here just for readability.
+func (ds *sqliteDB) addPool(pool types.Pool) error {
+	return ds.updatePool(pool)
+}
+
+// lock must be held by caller. Any rollbacks will need to be handled
+// by caller.
+func (ds *sqliteDB) updateSubnets(tx *sql.Tx, pool types.Pool) error {
+	// get currently known subnets.
+	subnets, err := ds.getPoolSubnets(pool.ID)
+	if err != nil {
+		// TBD: what about row not found?
+		return err
+	}
+
+	// make a map of pool subnets by ID
+	subMap := make(map[string]bool)
+	for _, sub := range pool.Subnets {
+		subMap[sub.ID] = true
+	}
+
+	// do we have any subnets that need deleting?
+	for _, sub := range subnets {
+		_, ok := subMap[sub.ID]
+		if !ok {
+			_, err = tx.Exec("DELETE FROM subnet_pool WHERE id = ?", sub.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// any subnets that already exist in the table will be ignored,
+	// new ones will be added.
+	for _, subnet := range pool.Subnets {
+		_, err = tx.Exec("INSERT OR IGNORE INTO subnet_pool (id, pool_id, cidr) VALUES (?, ?, ?)", subnet.ID, pool.ID, subnet.CIDR)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lock must be held by caller. Any rollbacks will need to be handled
+// by caller.
+func (ds *sqliteDB) updatePoolTenants(tx *sql.Tx, pool types.Pool) error {
+	_, err := tx.Exec("DELETE FROM pool_tenants WHERE pool_id = ?", pool.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, tenantID := range pool.Tenants {
+		_, err = tx.Exec("INSERT INTO pool_tenants (pool_id, tenant_id) VALUES (?, ?)", pool.ID, tenantID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lock must be held by caller. Any rollbacks will need to be handled
+// by caller.
+func (ds *sqliteDB) updateAddresses(tx *sql.Tx, pool types.Pool) error {
+	// get currently known individual addresses.
+	addresses, err := ds.getPoolAddresses(pool.ID)
+	if err != nil {
+		// TBD: what about row not found?
+		return err
+	}
+
+	// make a map of pool addresses by ID
+	addrMap := make(map[string]bool)
+	for _, addr := range pool.IPs {
+		addrMap[addr.ID] = true
+	}
+
+	// do we have any individual IPs that need deleting?
+	for _, addr := range addresses {
+		_, ok := addrMap[addr.ID]
+		if !ok {
+			_, err = tx.Exec("DELETE FROM address_pool WHERE id = ?", addr.ID)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	// any addresses that already exist in the table will be ignored,
+	// new ones will be added.
+	for _, IP := range pool.IPs {
+		_, err = tx.Exec("INSERT OR IGNORE INTO address_pool (id, pool_id, address) VALUES (?, ?, ?)", IP.ID, pool.ID, IP.Address)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updatePool is used to update all pool related fields even if they
+// are in different tables.
+func (ds *sqliteDB) updatePool(pool types.Pool) error {
+	db := ds.getTableDB("pools")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	pools := ds.getAllPools()
+
+	// do the below as a single transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = ds.updateSubnets(tx, pool)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = ds.updateAddresses(tx, pool)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = ds.updatePoolTenants(tx, pool)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// if this is a new pool, put it in, otherwise just update.
+	_, ok := pools[pool.ID]
+	if !ok {
+		_, err = tx.Exec("INSERT INTO pools (id, name, free, total, create_time) VALUES (?, ?, ?, ?, ?)", pool.ID, pool.Name, pool.Free, pool.TotalIPs, pool.CreateTime)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	} else {
+		// update free and total counts.
+		_, err = tx.Exec("UPDATE pools SET free = ?, total = ? WHERE id = ?", pool.Free, pool.TotalIPs, pool.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+
+	return err
+}
+
+func (ds *sqliteDB) getAllPools() map[string]types.Pool {
+	pools := make(map[string]types.Pool)
+
+	db := ds.getTableDB("pools")
+
+	query := `SELECT	id,
+				name,
+				free,
+				total,
+				create_time
+		  FROM	pools
+		  ORDER BY create_time, id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var pool types.Pool
+		var createTime sql.NullTime
+
+		err = rows.Scan(&pool.ID, &pool.Name, &pool.Free, &pool.TotalIPs, &createTime)
+		if err != nil {
+			continue
+		}
+		pool.CreateTime = createTime.Time
+
+		pool.Subnets, err = ds.getPoolSubnets(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		pool.IPs, err = ds.getPoolAddresses(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		pool.Tenants, err = ds.getPoolTenants(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		pools[pool.ID] = pool
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil
+	}
+
+	return pools
+}
+
+func (ds *sqliteDB) deletePool(ID string) error {
+	db := ds.getTableDB("pools")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// lock is held here and ok because the
+	// get functions don't hold a lock.
+	subnets, err := ds.getPoolSubnets(ID)
+	if err != nil {
+		return err
+	}
+
+	IPs, err := ds.getPoolAddresses(ID)
+	if err != nil {
+		return err
+	}
+
+	for _, subnet := range subnets {
+		_, err = tx.Exec("DELETE FROM subnet_pool WHERE id = ?", subnet.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	for _, addr := range IPs {
+		_, err = tx.Exec("DELETE FROM address_pool WHERE id = ?", addr.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM pool_tenants WHERE pool_id = ?", ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pools WHERE id = ?", ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+
+	return err
+}
+
+func (ds *sqliteDB) getPoolSubnets(poolID string) ([]types.ExternalSubnet, error) {
+	var subnets []types.ExternalSubnet
+
+	db := ds.getTableDB("subnet_pool")
+
+	query := `SELECT	id,
+				cidr
+		  FROM	subnet_pool
+		  WHERE pool_id = ?`
+
+	rows, err := db.Query(query, poolID)
+	if err != nil {
+		return subnets, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var subnet types.ExternalSubnet
+
+		err = rows.Scan(&subnet.ID, &subnet.CIDR)
+		if err != nil {
+			continue
+		}
+
+		subnets = append(subnets, subnet)
+	}
+
+	if err = rows.Err(); err != nil {
+		return subnets, err
+	}
+
+	return subnets, nil
+}
+
+func (ds *sqliteDB) getPoolTenants(poolID string) ([]string, error) {
+	var tenants []string
+
+	db := ds.getTableDB("pool_tenants")
+
+	query := `SELECT	tenant_id
+		  FROM	pool_tenants
+		  WHERE pool_id = ?`
+
+	rows, err := db.Query(query, poolID)
+	if err != nil {
+		return tenants, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var tenantID string
+
+		err = rows.Scan(&tenantID)
+		if err != nil {
+			continue
+		}
+
+		tenants = append(tenants, tenantID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tenants, err
+	}
+
+	return tenants, nil
+}
+
+func (ds *sqliteDB) getPoolAddresses(poolID string) ([]types.ExternalIP, error) {
+	var IPs []types.ExternalIP
+
+	db := ds.getTableDB("address_pool")
+
+	query := `SELECT	id,
+				address
+		  FROM	address_pool
+		  WHERE pool_id = ?`
+
+	rows, err := db.Query(query, poolID)
+	if err != nil {
+		return IPs, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var IP types.ExternalIP
+
+		err = rows.Scan(&IP.ID, &IP.Address)
+		if err != nil {
+			continue
+		}
+
+		IPs = append(IPs, IP)
+	}
+
+	if err = rows.Err(); err != nil {
+		return IPs, err
+	}
+
+	return IPs, nil
+}
+
+// addMappedIP adds a mapping and records the number of addresses left free
+// in its pool as a single transaction.
+func (ds *sqliteDB) addMappedIP(m types.MappedIP, free int) error {
+	db := ds.getTableDB("mapped_ips")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO mapped_ips (id, pool_id, external_ip, instance_id, create_time) VALUES (?, ?, ?, ?, ?)", m.ID, m.PoolID, m.ExternalIP, m.InstanceID, m.CreateTime)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE pools SET free = ? WHERE id = ?", free, m.PoolID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	ds.workloadsPath = config.InitWorkloadsPath
-	if err := os.MkdirAll(ds.workloadsPath, 0755); err != nil {
-		return errors.Wrap(err, "Error creating workload directory")
+	return tx.Commit()
+}
+
+func (ds *sqliteDB) deleteMappedIP(ID string) error {
+	db := ds.getTableDB("mapped_ips")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM mapped_ips WHERE id = ?", ID)
+
+	return err
+}
+
+func (ds *sqliteDB) getMappedIPs() map[string]types.MappedIP {
+	IPs := make(map[string]types.MappedIP)
+
+	db := ds.getTableDB("mapped_ips")
+
+	query := `SELECT	mapped_ips.id,
+				mapped_ips.pool_id,
+				mapped_ips.external_ip,
+				mapped_ips.instance_id,
+				instances.ip,
+				instances.tenant_id,
+				pools.name,
+				mapped_ips.create_time
+		  FROM	mapped_ips
+		  JOIN instances
+		  ON instances.id = mapped_ips.instance_id
+		  JOIN pools
+		  ON pools.id = mapped_ips.pool_id
+		  ORDER BY mapped_ips.create_time, mapped_ips.id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		fmt.Println(err)
+		return IPs
 	}
+	defer func() { _ = rows.Close() }()
 
-	for _, table := range ds.tables {
-		err = table.Init()
+	for rows.Next() {
+		var IP types.MappedIP
+		var createTime sql.NullTime
+
+		err = rows.Scan(&IP.ID, &IP.PoolID, &IP.ExternalIP, &IP.InstanceID, &IP.InternalIP, &IP.TenantID, &IP.PoolName, &createTime)
 		if err != nil {
-			return err
+			continue
 		}
+		IP.CreateTime = createTime.Time
+
+		IPs[IP.ExternalIP] = IP
 	}
 
-	return nil
-}
+	if err = rows.Err(); err != nil {
+		fmt.Println(err)
+	}
 
-var pSQLLiteConfig = []string{
-	"PRAGMA page_size = 32768",
-	"PRAGMA synchronous = OFF",
-	"PRAGMA temp_store = MEMORY",
-	"PRAGMA busy_timeout = 1000",
-	"PRAGMA journal_mode=WAL",
+	return IPs
 }
 
-func (ds *sqliteDB) sqliteConnect(name string, URI string, config []string) (*sql.DB, error) {
-	db, err := sql.Open(name, URI)
+func (ds *sqliteDB) updateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	db := ds.getTableDB("quotas")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "error starting transaction for quota update")
 	}
 
-	for i := range config {
-		_, err = db.Exec(config[i])
+	for i := range qds {
+		_, err = tx.Exec("REPLACE INTO quotas (tenant_id, name, value) VALUES (?, ?, ?)", tenantID, qds[i].Name, qds[i].Value)
 		if err != nil {
-			glog.Warning(err)
+			_ = tx.Rollback()
+			return errors.Wrap(err, "error executing query for quota update")
 		}
 	}
 
-	err = db.Ping()
+	err = tx.Commit()
+
+	return errors.Wrap(err, "error committing transaction for quotas update")
+}
+
+func (ds *sqliteDB) getQuotas(tenantID string) ([]types.QuotaDetails, error) {
+	query := `SELECT name, value from quotas WHERE tenant_id = ?`
+
+	db := ds.getTableDB("quotas")
+
+	rows, err := db.Query(query, tenantID)
 	if err != nil {
-		glog.Warning(err)
-		return nil, err
+		return nil, errors.Wrap(err, "error getting quotas from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	return db, nil
+	results := []types.QuotaDetails{}
+	for rows.Next() {
+		var name string
+		var value int
+
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading quota row from database")
+		}
+
+		q := types.QuotaDetails{Name: name, Value: value}
+		results = append(results, q)
+	}
+
+	return results, nil
 }
 
-func (ds *sqliteDB) Connect(persistentURI string) error {
-	sql.Register(persistentURI, &sqlite3.SQLiteDriver{})
+func (ds *sqliteDB) getImages() ([]types.Image, error) {
+	images := []types.Image{}
 
-	db, err := ds.sqliteConnect(persistentURI, persistentURI, pSQLLiteConfig)
+	query := `SELECT id, state, tenant_id, name, createtime, size, visibility, checksum FROM images`
+
+	db := ds.getTableDB("images")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
 	if err != nil {
-		return err
+		return images, errors.Wrap(err, "error getting images from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	ds.db = db
-	ds.dbName = persistentURI
+	for rows.Next() {
+		i := types.Image{}
+		var state, visibility string
 
-	return err
-}
+		err = rows.Scan(&i.ID, &state, &i.TenantID, &i.Name, &i.CreateTime, &i.Size, &visibility, &i.Checksum)
+		if err != nil {
+			return []types.Image{}, errors.Wrap(err, "error reading image row from database")
+		}
 
-// Disconnect is used to close the connection to the sql database
-func (ds *sqliteDB) disconnect() {
-	_ = ds.db.Close()
+		i.State = types.ImageState(state)
+		i.Visibility = types.Visibility(visibility)
+
+		images = append(images, i)
+	}
+
+	return images, nil
 }
 
-func (ds *sqliteDB) logEvent(event types.LogEntry) error {
-	db := ds.getTableDB("log")
+func (ds *sqliteDB) updateImage(i types.Image) error {
+	query := `REPLACE INTO images (id, state, tenant_id, name, createtime, size, visibility, checksum) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 
+	db := ds.getTableDB("images")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO log (tenant_id, node_id, type, message) VALUES (?, ?, ?, ?)", event.TenantID, event.NodeID, event.EventType, event.Message)
+	_, err := db.Exec(query, i.ID, i.State, i.TenantID, i.Name, i.CreateTime, i.Size, i.Visibility, i.Checksum)
 
-	return err
+	return errors.Wrap(err, "Error updatiing image into database")
 }
 
-// ClearLog will remove all the event entries from the event log
-func (ds *sqliteDB) clearLog() error {
-	db := ds.getTableDB("log")
+func (ds *sqliteDB) deleteImage(ID string) error {
+	query := `DELETE FROM images WHERE id = ?`
 
+	db := ds.getTableDB("images")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("DELETE FROM log")
+	_, err := db.Exec(query, ID)
 
-	return err
+	return errors.Wrap(err, "Error deleting image from database")
 }
 
-func (ds *sqliteDB) getConfig(ID string) (string, error) {
-	var configFile string
+func (ds *sqliteDB) getWebhooks() ([]types.Webhook, error) {
+	webhooks := []types.Webhook{}
 
-	db := ds.getTableDB("workload_template")
+	query := `SELECT id, url, secret, event_types, tenant_id, state, createtime FROM webhooks`
 
-	err := db.QueryRow("SELECT filename FROM workload_template where id = ?", ID).Scan(&configFile)
+	db := ds.getTableDB("webhooks")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
+	rows, err := db.Query(query)
 	if err != nil {
-		return "", err
+		return webhooks, errors.Wrap(err, "error getting webhooks from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	path := fmt.Sprintf("%s/%s", ds.workloadsPath, configFile)
-	bytes, err := ioutil.ReadFile(path)
+	for rows.Next() {
+		w := types.Webhook{}
+		var state, eventTypes string
+
+		err = rows.Scan(&w.ID, &w.URL, &w.Secret, &eventTypes, &w.TenantID, &state, &w.CreateTime)
+		if err != nil {
+			return []types.Webhook{}, errors.Wrap(err, "error reading webhook row from database")
+		}
+
+		err = json.Unmarshal([]byte(eventTypes), &w.EventTypes)
+		if err != nil {
+			return []types.Webhook{}, errors.Wrap(err, "error unmarshalling webhook event types")
+		}
+
+		w.State = types.WebhookState(state)
+
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, nil
+}
+
+func (ds *sqliteDB) updateWebhook(w types.Webhook) error {
+	query := `REPLACE INTO webhooks (id, url, secret, event_types, tenant_id, state, createtime) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	eventTypes, err := json.Marshal(w.EventTypes)
 	if err != nil {
-		return "", err
+		return errors.Wrap(err, "Error marshalling webhook event types")
 	}
 
-	config := string(bytes)
+	db := ds.getTableDB("webhooks")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	return config, nil
+	_, err = db.Exec(query, w.ID, w.URL, w.Secret, string(eventTypes), w.TenantID, w.State, w.CreateTime)
+
+	return errors.Wrap(err, "Error updating webhook in database")
 }
 
-// lock must be held by caller
-func (ds *sqliteDB) createWorkloadStorage(tx *sql.Tx, workloadID string, storage *types.StorageResource) error {
-	_, err := tx.Exec("INSERT INTO workload_storage (workload_id, volume_id, bootable, ephemeral, size, source_type, source_id, tag) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", workloadID, storage.ID, storage.Bootable, storage.Ephemeral, storage.Size, string(storage.SourceType), storage.Source, storage.Tag)
+func (ds *sqliteDB) deleteWebhook(ID string) error {
+	query := `DELETE FROM webhooks WHERE id = ?`
 
-	return err
-}
+	db := ds.getTableDB("webhooks")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-// lock must be held by caller
-func (ds *sqliteDB) deleteWorkloadStorage(tx *sql.Tx, workloadID string) error {
-	_, err := tx.Exec("DELETE FROM workload_storage WHERE workload_id = ?", workloadID)
+	_, err := db.Exec(query, ID)
 
-	return err
+	return errors.Wrap(err, "Error deleting webhook from database")
 }
 
-func (ds *sqliteDB) getWorkloadStorage(ID string) ([]types.StorageResource, error) {
-	query := `SELECT volume_id, bootable, ephemeral, size,
-			 source_type, source_id, tag
-		  FROM 	workload_storage
-		  WHERE workload_id = ?`
+func (ds *sqliteDB) getOperations() ([]types.Operation, error) {
+	operations := []types.Operation{}
 
-	rows, err := ds.db.Query(query, ID)
+	query := `SELECT id, tenant_id, type, target, result, state, progress, error, createtime, updatetime FROM operations`
+
+	db := ds.getTableDB("operations")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return operations, errors.Wrap(err, "error getting operations from database")
 	}
 	defer func() { _ = rows.Close() }()
 
-	res := []types.StorageResource{}
-	var sourceType string
-
 	for rows.Next() {
-		var r types.StorageResource
-		err := rows.Scan(&r.ID, &r.Bootable, &r.Ephemeral, &r.Size, &sourceType, &r.Source, &r.Tag)
+		o := types.Operation{}
+		var opType, state string
 
+		err = rows.Scan(&o.ID, &o.TenantID, &opType, &o.Target, &o.Result, &state, &o.Progress, &o.Error, &o.CreateTime, &o.UpdateTime)
 		if err != nil {
-			return []types.StorageResource{}, err
+			return []types.Operation{}, errors.Wrap(err, "error reading operation row from database")
 		}
-		r.SourceType = types.SourceType(sourceType)
-		res = append(res, r)
+
+		o.Type = types.OperationType(opType)
+		o.State = types.OperationState(state)
+
+		operations = append(operations, o)
 	}
-	return res, nil
+
+	return operations, nil
 }
 
-func (ds *sqliteDB) addTenant(ID string, config types.TenantConfig) error {
+func (ds *sqliteDB) updateOperation(o types.Operation) error {
+	query := `REPLACE INTO operations (id, tenant_id, type, target, result, state, progress, error, createtime, updatetime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("operations")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	perms, err := json.Marshal(config.Permissions)
+	_, err := db.Exec(query, o.ID, o.TenantID, string(o.Type), o.Target, o.Result, string(o.State), o.Progress, o.Error, o.CreateTime, o.UpdateTime)
+
+	return errors.Wrap(err, "Error updating operation in database")
+}
+
+func (ds *sqliteDB) deleteOperation(ID string) error {
+	query := `DELETE FROM operations WHERE id = ?`
+
+	db := ds.getTableDB("operations")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec(query, ID)
+
+	return errors.Wrap(err, "Error deleting operation from database")
+}
+
+func (ds *sqliteDB) getTrashItems() ([]types.TrashItem, error) {
+	items := []types.TrashItem{}
+
+	query := `SELECT id, tenant_id, type, name, deletetime, purgetime, workload_id, vcpus, mem_mb, ephemeral_gb, volumes FROM trash`
+
+	db := ds.getTableDB("trash")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
 	if err != nil {
-		return errors.Wrap(err, "Error marshalling permissions")
+		return items, errors.Wrap(err, "error getting trash from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		item := types.TrashItem{}
+		var itemType, volumes string
+
+		err = rows.Scan(&item.ID, &item.TenantID, &itemType, &item.Name, &item.DeleteTime, &item.PurgeTime,
+			&item.WorkloadID, &item.VCPUs, &item.MemMB, &item.EphemeralGB, &volumes)
+		if err != nil {
+			return []types.TrashItem{}, errors.Wrap(err, "error reading trash row from database")
+		}
+
+		item.Type = types.TrashItemType(itemType)
+		if volumes != "" {
+			item.Volumes = strings.Split(volumes, ",")
+		}
+
+		items = append(items, item)
 	}
 
-	err = ds.create("tenants", ID, config.Name, config.SubnetBits, string(perms))
+	return items, nil
+}
+
+func (ds *sqliteDB) addTrashItem(item types.TrashItem) error {
+	query := `REPLACE INTO trash (id, tenant_id, type, name, deletetime, purgetime, workload_id, vcpus, mem_mb, ephemeral_gb, volumes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("trash")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec(query, item.ID, item.TenantID, string(item.Type), item.Name, item.DeleteTime, item.PurgeTime,
+		item.WorkloadID, item.VCPUs, item.MemMB, item.EphemeralGB, strings.Join(item.Volumes, ","))
 
-	return err
+	return errors.Wrap(err, "Error adding trash item to database")
 }
 
-func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
-	query := `SELECT	tenants.id,
-				tenants.name,
-				tenants.subnet_bits,
-				tenants.permissions
-		  FROM tenants
-		  WHERE tenants.id = ?`
+func (ds *sqliteDB) deleteTrashItem(ID string) error {
+	query := `DELETE FROM trash WHERE id = ?`
 
-	db := ds.db
+	db := ds.getTableDB("trash")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	row := db.QueryRow(query, ID)
+	_, err := db.Exec(query, ID)
 
-	t := &tenant{}
+	return errors.Wrap(err, "Error deleting trash item from database")
+}
 
-	var perms []byte
-	err := row.Scan(&t.ID, &t.Name, &t.SubnetBits, &perms)
-	if err != nil {
-		glog.Warning("unable to retrieve tenant from tenants")
+func (ds *sqliteDB) getCNCIImage() (types.CNCIImage, error) {
+	var image types.CNCIImage
 
-		if err == sql.ErrNoRows {
-			// not an error, it's just not there.
-			err = nil
-		}
+	query := `SELECT image_id, previous_image_id FROM cnci_image WHERE id = 0`
 
-		return nil, err
-	}
+	db := ds.getTableDB("cnci_image")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	if err := json.Unmarshal(perms, &t.Permissions); err != nil {
-		return nil, errors.Wrap(err, "Error unmarshalling permissions")
+	err := db.QueryRow(query).Scan(&image.Image, &image.PreviousImage)
+	if err == sql.ErrNoRows {
+		return image, nil
 	}
 
-	// for these items below, its ok to get err returned
-	// because a tenant could simply not have used any
-	// resources or networks yet.
-	err = ds.getTenantNetwork(t)
-	if err != nil {
-		glog.V(2).Info(err)
-	}
+	return image, errors.Wrap(err, "Error reading CNCI image from database")
+}
 
-	t.instances, err = ds.getTenantInstances(t.ID)
-	if err != nil {
-		glog.V(2).Info(err)
-	}
+func (ds *sqliteDB) updateCNCIImage(i types.CNCIImage) error {
+	query := `REPLACE INTO cnci_image (id, image_id, previous_image_id) VALUES (0, ?, ?)`
 
-	t.devices, err = ds.getTenantDevices(t.ID)
-	if err != nil {
-		glog.V(2).Info(err)
-	}
+	db := ds.getTableDB("cnci_image")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	return t, err
+	_, err := db.Exec(query, i.Image, i.PreviousImage)
+
+	return errors.Wrap(err, "Error updating CNCI image in database")
 }
 
-func (ds *sqliteDB) getWorkloads() ([]types.Workload, error) {
-	var workloads []types.Workload
+func (ds *sqliteDB) getCNCIInstanceImages() (map[string]string, error) {
+	images := make(map[string]string)
 
-	db := ds.db
+	query := `SELECT instance_id, image_id FROM cnci_instance_images`
 
-	query := `SELECT id,
-			 tenant_id,
-			 description,
-			 fw_type,
-			 vm_type,
-			 image_name,
-			 visibility,
-			 requirements
-		  FROM workload_template`
+	db := ds.getTableDB("cnci_instance_images")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
 	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return images, errors.Wrap(err, "Error getting CNCI instance images from database")
 	}
 	defer func() { _ = rows.Close() }()
 
 	for rows.Next() {
-		var wl types.Workload
-
-		var VMType string
-		var visibility string
-		var requirements []byte
-
-		err = rows.Scan(&wl.ID, &wl.TenantID, &wl.Description, &wl.FWType, &VMType, &wl.ImageName, &visibility, &requirements)
-		if err != nil {
-			return nil, err
-		}
+		var instanceID, imageID string
 
-		err = json.Unmarshal(requirements, &wl.Requirements)
+		err = rows.Scan(&instanceID, &imageID)
 		if err != nil {
-			return nil, err
-		}
-
-		wl.Visibility = types.Visibility(visibility)
-
-		if wl.Visibility == types.Internal {
-			continue
+			return map[string]string{}, errors.Wrap(err, "Error reading CNCI instance image row from database")
 		}
 
-		wl.Config, err = ds.getConfig(wl.ID)
-		if err != nil {
-			return nil, err
-		}
+		images[instanceID] = imageID
+	}
 
-		wl.Storage, err = ds.getWorkloadStorage(wl.ID)
-		if err != nil {
-			return nil, err
-		}
+	return images, nil
+}
 
-		wl.VMType = payloads.Hypervisor(VMType)
+func (ds *sqliteDB) updateCNCIInstanceImage(instanceID string, imageID string) error {
+	query := `REPLACE INTO cnci_instance_images (instance_id, image_id) VALUES (?, ?)`
 
-		workloads = append(workloads, wl)
-	}
+	db := ds.getTableDB("cnci_instance_images")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
+	_, err := db.Exec(query, instanceID, imageID)
 
-	return workloads, nil
+	return errors.Wrap(err, "Error updating CNCI instance image in database")
 }
 
-func (ds *sqliteDB) addWorkload(w types.Workload) error {
-	db := ds.getTableDB("workload_template")
+func (ds *sqliteDB) deleteCNCIInstanceImage(instanceID string) error {
+	query := `DELETE FROM cnci_instance_images WHERE instance_id = ?`
 
+	db := ds.getTableDB("cnci_instance_images")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+	_, err := db.Exec(query, instanceID)
 
-	// add in any workload storage resources
-	for i := range w.Storage {
-		err := ds.createWorkloadStorage(tx, w.ID, &w.Storage[i])
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	}
+	return errors.Wrap(err, "Error deleting CNCI instance image from database")
+}
 
-	// write config to file.
-	filename := fmt.Sprintf("%s_config.yaml", w.ID)
-	path := filepath.Join(ds.workloadsPath, filename)
-	err = ioutil.WriteFile(path, []byte(w.Config), 0644)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+func (ds *sqliteDB) getLaunchConfig(instanceID string) (string, error) {
+	var config string
 
-	requirements, err := json.Marshal(w.Requirements)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+	query := `SELECT config FROM launch_configs WHERE instance_id = ?`
 
-	_, err = tx.Exec("INSERT INTO workload_template (id, tenant_id, description, filename, fw_type, vm_type, image_name, visibility, requirements) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", w.ID, w.TenantID, w.Description, filename, w.FWType, string(w.VMType), w.ImageName, w.Visibility, string(requirements))
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+	db := ds.getTableDB("launch_configs")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	err := db.QueryRow(query, instanceID).Scan(&config)
+	if err == sql.ErrNoRows {
+		return "", types.ErrLaunchConfigNotFound
 	}
 
-	err = tx.Commit()
-	return err
+	return config, errors.Wrap(err, "Error getting launch config from database")
 }
 
-func (ds *sqliteDB) deleteWorkload(ID string) error {
-	db := ds.getTableDB("workload_template")
+func (ds *sqliteDB) updateLaunchConfig(ctx context.Context, instanceID string, config string) error {
+	query := `REPLACE INTO launch_configs (instance_id, config) VALUES (?, ?)`
 
+	db := ds.getTableDB("launch_configs")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+	_, err := db.ExecContext(ctx, query, instanceID, config)
 
-	err = ds.deleteWorkloadStorage(tx, ID)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+	return errors.Wrap(err, "Error updating launch config in database")
+}
 
-	_, err = tx.Exec("DELETE FROM workload_template WHERE id = ?", ID)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+func (ds *sqliteDB) deleteLaunchConfig(instanceID string) error {
+	query := `DELETE FROM launch_configs WHERE instance_id = ?`
 
-	filename := fmt.Sprintf("%s_config.yaml", ID)
-	path := filepath.Join(ds.workloadsPath, filename)
-	err = os.Remove(path)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+	db := ds.getTableDB("launch_configs")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	err = tx.Commit()
-	return err
+	_, err := db.Exec(query, instanceID)
+
+	return errors.Wrap(err, "Error deleting launch config from database")
 }
 
-func (ds *sqliteDB) getTenants() ([]*tenant, error) {
-	var tenants []*tenant
+func (ds *sqliteDB) getTenantCAs() ([]types.TenantCA, error) {
+	cas := []types.TenantCA{}
 
-	db := ds.getTableDB("tenants")
+	query := `SELECT tenant_id, certificate, subject, fingerprint, not_after, createtime FROM tenant_cas`
 
-	query := `SELECT	tenants.id,
-				tenants.name,
-				tenants.subnet_bits,
-				tenants.permissions
-		  FROM tenants `
+	db := ds.getTableDB("tenant_cas")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
 	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return cas, errors.Wrap(err, "error getting tenant CAs from database")
 	}
 	defer func() { _ = rows.Close() }()
 
 	for rows.Next() {
-		var id sql.NullString
-		var name sql.NullString
-		var perms []byte
+		ca := types.TenantCA{}
 
-		t := new(tenant)
-		err = rows.Scan(&id, &name, &t.SubnetBits, &perms)
+		err = rows.Scan(&ca.TenantID, &ca.Certificate, &ca.Subject, &ca.Fingerprint, &ca.NotAfter, &ca.CreateTime)
 		if err != nil {
-			return nil, err
-		}
-
-		if id.Valid {
-			t.ID = id.String
-		}
-
-		if name.Valid {
-			t.Name = name.String
+			return []types.TenantCA{}, errors.Wrap(err, "error reading tenant CA row from database")
 		}
 
-		if err := json.Unmarshal(perms, &t.Permissions); err != nil {
-			return nil, errors.Wrap(err, "Error getting unmarshalling permissions")
-		}
+		cas = append(cas, ca)
+	}
 
-		err = ds.getTenantNetwork(t)
-		if err != nil {
-			return nil, err
-		}
+	return cas, nil
+}
 
-		t.instances, err = ds.getTenantInstances(t.ID)
-		if err != nil {
-			return nil, err
-		}
+func (ds *sqliteDB) updateTenantCA(ca types.TenantCA) error {
+	query := `REPLACE INTO tenant_cas (tenant_id, certificate, subject, fingerprint, not_after, createtime) VALUES (?, ?, ?, ?, ?, ?)`
 
-		t.devices, err = ds.getTenantDevices(t.ID)
-		if err != nil {
-			return nil, err
-		}
+	db := ds.getTableDB("tenant_cas")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-		tenants = append(tenants, t)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
+	_, err := db.Exec(query, ca.TenantID, ca.Certificate, ca.Subject, ca.Fingerprint, ca.NotAfter, ca.CreateTime)
 
-	return tenants, nil
+	return errors.Wrap(err, "Error updating tenant CA in database")
 }
 
-func (ds *sqliteDB) claimTenantIP(tenantID string, subnetInt uint32, rest uint32) error {
-	db := ds.getTableDB("tenant_network")
+func (ds *sqliteDB) deleteTenantCA(tenantID string) error {
+	query := `DELETE FROM tenant_cas WHERE tenant_id = ?`
 
+	db := ds.getTableDB("tenant_cas")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO tenant_network VALUES(?, ?, ?)", tenantID, subnetInt, rest)
+	_, err := db.Exec(query, tenantID)
 
-	return err
+	return errors.Wrap(err, "Error deleting tenant CA from database")
 }
 
-func (ds *sqliteDB) claimTenantIPs(tenantID string, IPs []tenantIP) error {
-	db := ds.getTableDB("tenant_network")
+func (ds *sqliteDB) getLaunchTemplates() ([]types.LaunchTemplate, error) {
+	templates := []types.LaunchTemplate{}
+
+	query := `SELECT tenant_id, name, version, request, createtime, updatetime FROM launch_templates`
 
+	db := ds.getTableDB("launch_templates")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-
-	cmd := `INSERT INTO tenant_network VALUES(?, ?, ?)`
-
-	stmt, err := tx.Prepare(cmd)
+	rows, err := db.Query(query)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return templates, errors.Wrap(err, "error getting launch templates from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	defer stmt.Close()
+	for rows.Next() {
+		t := types.LaunchTemplate{}
+		var request string
 
-	for _, ip := range IPs {
-		_, err = stmt.Exec(tenantID, ip.subnet, ip.host)
+		err = rows.Scan(&t.TenantID, &t.Name, &t.Version, &request, &t.CreateTime, &t.UpdateTime)
 		if err != nil {
-			tx.Rollback()
-			return err
+			return []types.LaunchTemplate{}, errors.Wrap(err, "error reading launch template row from database")
 		}
+
+		t.Request = json.RawMessage(request)
+
+		templates = append(templates, t)
 	}
 
-	return tx.Commit()
+	return templates, nil
 }
 
-func (ds *sqliteDB) releaseTenantIP(tenantID string, subnetInt uint32, rest uint32) error {
-	db := ds.getTableDB("tenant_network")
+func (ds *sqliteDB) updateLaunchTemplate(t types.LaunchTemplate) error {
+	query := `REPLACE INTO launch_templates (tenant_id, name, version, request, createtime, updatetime) VALUES (?, ?, ?, ?, ?, ?)`
 
+	db := ds.getTableDB("launch_templates")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("DELETE FROM tenant_network WHERE tenant_id = ? AND subnet = ? AND rest = ?", tenantID, subnetInt, rest)
+	_, err := db.Exec(query, t.TenantID, t.Name, t.Version, string(t.Request), t.CreateTime, t.UpdateTime)
 
-	return err
+	return errors.Wrap(err, "Error updating launch template in database")
 }
 
-func (ds *sqliteDB) getTenantNetwork(tenant *tenant) error {
-	tenant.network = make(map[uint32]map[uint32]bool)
+func (ds *sqliteDB) deleteLaunchTemplate(tenantID string, name string) error {
+	query := `DELETE FROM launch_templates WHERE tenant_id = ? AND name = ?`
 
+	db := ds.getTableDB("launch_templates")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	db := ds.getTableDB("tenant_network")
+	_, err := db.Exec(query, tenantID, name)
 
-	// get all subnet,rest values for this tenant
-	query := `SELECT subnet, rest
-		  FROM tenant_network
-		  WHERE tenant_id = ?`
+	return errors.Wrap(err, "Error deleting launch template from database")
+}
+
+// getServerGroups returns the server groups along with their members, in
+// the order in which they joined.
+func (ds *sqliteDB) getServerGroups() ([]types.ServerGroup, error) {
+	groups := []types.ServerGroup{}
+
+	query := `SELECT id, tenant_id, name, policy, soft, createtime FROM server_groups`
+
+	db := ds.getTableDB("server_groups")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return groups, errors.Wrap(err, "error getting server groups from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	index := make(map[string]int)
+	for rows.Next() {
+		g := types.ServerGroup{}
+
+		err = rows.Scan(&g.ID, &g.TenantID, &g.Name, &g.Policy, &g.Soft, &g.CreateTime)
+		if err != nil {
+			return []types.ServerGroup{}, errors.Wrap(err, "error reading server group row from database")
+		}
 
-	rows, err := db.Query(query, tenant.ID)
+		index[g.ID] = len(groups)
+		groups = append(groups, g)
+	}
+
+	query = `SELECT group_id, instance_id FROM server_group_members ORDER BY id`
+
+	members, err := db.Query(query)
 	if err != nil {
-		return err
+		return []types.ServerGroup{}, errors.Wrap(err, "error getting server group members from database")
 	}
-	defer func() { _ = rows.Close() }()
+	defer func() { _ = members.Close() }()
 
-	for rows.Next() {
-		var subnetInt uint32
-		var rest uint32
+	for members.Next() {
+		var groupID, instanceID string
 
-		err = rows.Scan(&subnetInt, &rest)
+		err = members.Scan(&groupID, &instanceID)
 		if err != nil {
-			return err
+			return []types.ServerGroup{}, errors.Wrap(err, "error reading server group member row from database")
 		}
 
-		_, ok := tenant.network[subnetInt]
+		i, ok := index[groupID]
 		if !ok {
-			sub := make(map[uint32]bool)
-			tenant.network[subnetInt] = sub
+			continue
 		}
-
-		tenant.network[subnetInt][rest] = true
+		groups[i].Members = append(groups[i].Members, instanceID)
 	}
 
-	return err
+	return groups, nil
 }
 
-func (ds *sqliteDB) updateTenant(tenant *types.Tenant) error {
-	db := ds.getTableDB("tenants")
+func (ds *sqliteDB) addServerGroup(g types.ServerGroup) error {
+	query := `INSERT INTO server_groups (id, tenant_id, name, policy, soft, createtime) VALUES (?, ?, ?, ?, ?, ?)`
 
+	db := ds.getTableDB("server_groups")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	perms, err := json.Marshal(tenant.Permissions)
-	if err != nil {
-		return errors.Wrap(err, "Error marshalling permissions")
-	}
-
-	_, err = db.Exec("UPDATE tenants SET name = ?, subnet_bits = ?, permissions = ? WHERE id = ?", tenant.Name, tenant.SubnetBits, string(perms), tenant.ID)
+	_, err := db.Exec(query, g.ID, g.TenantID, g.Name, string(g.Policy), g.Soft, g.CreateTime)
 
-	return err
+	return errors.Wrap(err, "Error adding server group to database")
 }
 
-func (ds *sqliteDB) deleteTenant(tenantID string) error {
-	db := ds.getTableDB("tenants")
-
+// deleteServerGroup removes a server group along with its memberships.
+func (ds *sqliteDB) deleteServerGroup(ID string) error {
+	db := ds.getTableDB("server_groups")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return errors.Wrap(err, "Error beginning transaction")
 	}
 
-	// first delete any quotas associated with this tenant
-	_, err = tx.Exec("DELETE FROM quotas WHERE tenant_id = ?", tenantID)
+	_, err = tx.Exec(`DELETE FROM server_group_members WHERE group_id = ?`, ID)
 	if err != nil {
 		_ = tx.Rollback()
-		return err
+		return errors.Wrap(err, "Error deleting server group members from database")
 	}
 
-	_, err = tx.Exec("DELETE FROM tenants WHERE id = ?", tenantID)
+	_, err = tx.Exec(`DELETE FROM server_groups WHERE id = ?`, ID)
 	if err != nil {
 		_ = tx.Rollback()
-		return err
+		return errors.Wrap(err, "Error deleting server group from database")
 	}
 
-	err = tx.Commit()
-
-	return err
+	return errors.Wrap(tx.Commit(), "Error committing server group deletion")
 }
 
-func (ds *sqliteDB) getInstances() ([]*types.Instance, error) {
-	var instances []*types.Instance
-
-	db := ds.getTableDB("instances")
+func (ds *sqliteDB) addServerGroupMember(groupID string, instanceID string) error {
+	query := `INSERT INTO server_group_members (group_id, instance_id) VALUES (?, ?)`
 
+	db := ds.getTableDB("server_group_members")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	query := `
-	WITH latest AS
-	(
-		SELECT 	max(instance_statistics.timestamp),
-			instance_statistics.instance_id,
-			instance_statistics.state,
-			instance_statistics.ssh_ip,
-			instance_statistics.ssh_port,
-			instance_statistics.node_id
-		FROM instance_statistics
-		GROUP BY instance_statistics.instance_id
-	)
-	SELECT	instances.id,
-		instances.tenant_id,
-		IFNULL(latest.state, "` + payloads.ComputeStatusPending + `") AS state,
-		workload_id,
-		IFNULL(latest.ssh_ip, "Not Assigned") as ssh_ip,
-		latest.ssh_port as ssh_port,
-		IFNULL(latest.node_id, "Not Assigned") as node_id,
-		mac_address,
-		vnic_uuid,
-		subnet,
-		ip,
-		name,
-		cnci
-	FROM instances
-	LEFT JOIN latest
-	ON instances.id = latest.instance_id
-	`
-
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = rows.Close() }()
-
-	for rows.Next() {
-		var i types.Instance
-
-		var sshPort sql.NullInt64
-
-		err = rows.Scan(&i.ID, &i.TenantID, &i.State, &i.WorkloadID, &i.SSHIP, &sshPort, &i.NodeID, &i.MACAddress, &i.VnicUUID, &i.Subnet, &i.IPAddress, &i.Name, &i.CNCI)
-		if err != nil {
-			return nil, err
-		}
+	_, err := db.Exec(query, groupID, instanceID)
 
-		if sshPort.Valid {
-			i.SSHPort = int(sshPort.Int64)
-		}
+	return errors.Wrap(err, "Error adding server group member to database")
+}
 
-		i.StateChange = sync.NewCond(&sync.Mutex{})
+func (ds *sqliteDB) deleteServerGroupMember(instanceID string) error {
+	query := `DELETE FROM server_group_members WHERE instance_id = ?`
 
-		instances = append(instances, &i)
-	}
+	db := ds.getTableDB("server_group_members")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
+	_, err := db.Exec(query, instanceID)
 
-	return instances, nil
+	return errors.Wrap(err, "Error deleting server group member from database")
 }
 
-func (ds *sqliteDB) getTenantInstances(tenantID string) (map[string]*types.Instance, error) {
-	db := ds.getTableDB("instances")
+func (ds *sqliteDB) getSnapshotSchedules() ([]types.SnapshotSchedule, error) {
+	schedules := []types.SnapshotSchedule{}
+
+	query := `SELECT id, tenant_id, volume_id, tag, interval_minutes, offset_minutes, retention, createtime, last_run, next_run, last_error FROM snapshot_schedules`
 
+	db := ds.getTableDB("snapshot_schedules")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	query := `
-	WITH latest AS
-	(
-		SELECT 	max(instance_statistics.timestamp),
-			instance_statistics.instance_id,
-			instance_statistics.state,
-			instance_statistics.ssh_ip,
-			instance_statistics.ssh_port,
-			instance_statistics.node_id
-		FROM instance_statistics
-		GROUP BY instance_statistics.instance_id
-	)
-	SELECT	instances.id,
-		instances.tenant_id,
-		IFNULL(latest.state, "` + payloads.ComputeStatusPending + `") AS state,
-		IFNULL(latest.ssh_ip, "Not Assigned") AS ssh_ip,
-		latest.ssh_port AS ssh_port,
-		workload_id,
-		latest.node_id,
-		mac_address,
-		vnic_uuid,
-		subnet,
-		ip,
-		name,
-		cnci
-	FROM instances
-	LEFT JOIN latest
-	ON instances.id = latest.instance_id
-	WHERE instances.tenant_id = ?
-	`
-
-	rows, err := db.Query(query, tenantID)
+	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return schedules, errors.Wrap(err, "error getting snapshot schedules from database")
 	}
 	defer func() { _ = rows.Close() }()
 
-	instances := make(map[string]*types.Instance)
 	for rows.Next() {
-		var nodeID sql.NullString
-		var sshIP sql.NullString
-		var sshPort sql.NullInt64
+		s := types.SnapshotSchedule{}
 
-		i := &types.Instance{}
-
-		err = rows.Scan(&i.ID, &i.TenantID, &i.State, &sshIP, &sshPort, &i.WorkloadID, &nodeID, &i.MACAddress, &i.VnicUUID, &i.Subnet, &i.IPAddress, &i.Name, &i.CNCI)
+		err = rows.Scan(&s.ID, &s.TenantID, &s.VolumeID, &s.Tag, &s.IntervalMinutes, &s.OffsetMinutes, &s.Retention, &s.CreateTime, &s.LastRun, &s.NextRun, &s.LastError)
 		if err != nil {
-			return nil, err
-		}
-
-		if nodeID.Valid {
-			i.NodeID = nodeID.String
+			return []types.SnapshotSchedule{}, errors.Wrap(err, "error reading snapshot schedule row from database")
 		}
 
-		if sshIP.Valid {
-			i.SSHIP = sshIP.String
-		}
+		schedules = append(schedules, s)
+	}
 
-		if sshPort.Valid {
-			i.SSHPort = int(sshPort.Int64)
-		}
+	return schedules, nil
+}
 
-		i.StateChange = sync.NewCond(&sync.Mutex{})
+func (ds *sqliteDB) updateSnapshotSchedule(s types.SnapshotSchedule) error {
+	query := `REPLACE INTO snapshot_schedules (id, tenant_id, volume_id, tag, interval_minutes, offset_minutes, retention, createtime, last_run, next_run, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-		instances[i.ID] = i
-	}
+	db := ds.getTableDB("snapshot_schedules")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
+	_, err := db.Exec(query, s.ID, s.TenantID, s.VolumeID, s.Tag, s.IntervalMinutes, s.OffsetMinutes, s.Retention, s.CreateTime, s.LastRun, s.NextRun, s.LastError)
 
-	return instances, nil
+	return errors.Wrap(err, "Error updating snapshot schedule in database")
 }
 
-func (ds *sqliteDB) addInstance(instance *types.Instance) error {
-	db := ds.getTableDB("instances")
+func (ds *sqliteDB) deleteSnapshotSchedule(ID string) error {
+	query := `DELETE FROM snapshot_schedules WHERE id = ?`
 
+	db := ds.getTableDB("snapshot_schedules")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO instances VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", instance.ID, instance.TenantID, instance.WorkloadID, instance.MACAddress, instance.VnicUUID, instance.Subnet, instance.IPAddress, instance.CreateTime.Format(time.RFC3339Nano), instance.Name, instance.CNCI)
+	_, err := db.Exec(query, ID)
 
-	return err
+	return errors.Wrap(err, "Error deleting snapshot schedule from database")
 }
 
-func (ds *sqliteDB) deleteInstance(instanceID string) error {
-	db := ds.getTableDB("instances")
+func (ds *sqliteDB) getVolumeSnapshots() ([]types.VolumeSnapshot, error) {
+	snapshots := []types.VolumeSnapshot{}
+
+	query := `SELECT id, volume_id, tenant_id, schedule_id, name, attached, createtime FROM volume_snapshots`
 
+	db := ds.getTableDB("volume_snapshots")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("DELETE FROM instances WHERE id = ?", instanceID)
+	rows, err := db.Query(query)
+	if err != nil {
+		return snapshots, errors.Wrap(err, "error getting volume snapshots from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		s := types.VolumeSnapshot{}
+
+		err = rows.Scan(&s.ID, &s.VolumeID, &s.TenantID, &s.ScheduleID, &s.Name, &s.Attached, &s.CreateTime)
+		if err != nil {
+			return []types.VolumeSnapshot{}, errors.Wrap(err, "error reading volume snapshot row from database")
+		}
 
-	return err
+		snapshots = append(snapshots, s)
+	}
+
+	return snapshots, nil
 }
 
-func (ds *sqliteDB) updateInstance(instance *types.Instance) error {
-	db := ds.getTableDB("instances")
+func (ds *sqliteDB) addVolumeSnapshot(s types.VolumeSnapshot) error {
+	query := `INSERT INTO volume_snapshots (id, volume_id, tenant_id, schedule_id, name, attached, createtime) VALUES (?, ?, ?, ?, ?, ?, ?)`
 
+	db := ds.getTableDB("volume_snapshots")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("UPDATE instances SET mac_address = ?, ip = ? WHERE id = ?", instance.MACAddress, instance.IPAddress, instance.ID)
+	_, err := db.Exec(query, s.ID, s.VolumeID, s.TenantID, s.ScheduleID, s.Name, s.Attached, s.CreateTime)
 
-	return err
+	return errors.Wrap(err, "Error adding volume snapshot to database")
 }
 
-func (ds *sqliteDB) addNodeStat(stat payloads.Stat) error {
-	db := ds.getTableDB("node_statistics")
+func (ds *sqliteDB) deleteVolumeSnapshot(ID string) error {
+	query := `DELETE FROM volume_snapshots WHERE id = ?`
 
+	db := ds.getTableDB("volume_snapshots")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO node_statistics (node_id, mem_total_mb, mem_available_mb, disk_total_mb, disk_available_mb, load, cpus_online) VALUES(?, ?, ?, ?, ?, ?, ?)", stat.NodeUUID, stat.MemTotalMB, stat.MemAvailableMB, stat.DiskTotalMB, stat.DiskAvailableMB, stat.Load, stat.CpusOnline)
+	_, err := db.Exec(query, ID)
 
-	return err
+	return errors.Wrap(err, "Error deleting volume snapshot from database")
 }
 
-func (ds *sqliteDB) addInstanceStats(stats []payloads.InstanceStat, nodeID string) error {
-	db := ds.getTableDB("instance_statistics")
+func (ds *sqliteDB) getImageSeeds() (map[string][]types.ImageSeed, error) {
+	seeds := make(map[string][]types.ImageSeed)
+
+	query := `SELECT image_id, node_id, state, error, updatetime FROM image_seeds`
 
+	db := ds.getTableDB("image_seeds")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
+	rows, err := db.Query(query)
 	if err != nil {
-		return err
+		return seeds, errors.Wrap(err, "error getting image seeds from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	cmd := `INSERT INTO instance_statistics (instance_id, memory_usage_mb, disk_usage_mb, cpu_usage, state, node_id, ssh_ip, ssh_port)
-		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+	for rows.Next() {
+		var imageID, state string
+		seed := types.ImageSeed{}
 
-	stmt, err := tx.Prepare(cmd)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+		err = rows.Scan(&imageID, &seed.NodeID, &state, &seed.Error, &seed.UpdateTime)
+		if err != nil {
+			return map[string][]types.ImageSeed{}, errors.Wrap(err, "error reading image seed row from database")
+		}
+
+		seed.State = types.ImageSeedState(state)
+		seeds[imageID] = append(seeds[imageID], seed)
 	}
 
-	defer func() { _ = stmt.Close() }()
+	return seeds, nil
+}
 
-	for index := range stats {
-		stat := stats[index]
+func (ds *sqliteDB) updateImageSeed(imageID string, seed types.ImageSeed) error {
+	query := `REPLACE INTO image_seeds (image_id, node_id, state, error, updatetime) VALUES (?, ?, ?, ?, ?)`
 
-		_, err = stmt.Exec(stat.InstanceUUID, stat.MemoryUsageMB, stat.DiskUsageMB, stat.CPUUsage, stat.State, nodeID, stat.SSHIP, stat.SSHPort)
-		if err != nil {
-			glog.Warning(err)
-			// but keep going
-		}
-	}
+	db := ds.getTableDB("image_seeds")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	err = tx.Commit()
+	_, err := db.Exec(query, imageID, seed.NodeID, string(seed.State), seed.Error, seed.UpdateTime)
 
-	return err
+	return errors.Wrap(err, "Error updating image seed in database")
 }
 
-func (ds *sqliteDB) addFrameStat(stat payloads.FrameTrace) error {
-	db := ds.getTableDB("frame_statistics")
+func (ds *sqliteDB) deleteImageSeeds(imageID string) error {
+	query := `DELETE FROM image_seeds WHERE image_id = ?`
 
+	db := ds.getTableDB("image_seeds")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+	_, err := db.Exec(query, imageID)
 
-	query := `INSERT INTO frame_statistics (label, type, operand, start_timestamp, end_timestamp)
-		  VALUES(?, ?, ?, ?, ?)`
+	return errors.Wrap(err, "Error deleting image seeds from database")
+}
 
-	_, err = tx.Exec(query, stat.Label, stat.Type, stat.Operand, stat.StartTimestamp, stat.EndTimestamp)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+func (ds *sqliteDB) updateNodeMaintenance(nodeID string, maintenance bool) error {
+	query := `DELETE FROM node_maintenance WHERE node_id = ?`
+	if maintenance {
+		query = `REPLACE INTO node_maintenance (node_id) VALUES (?)`
 	}
 
-	var id int
+	db := ds.getTableDB("node_maintenance")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	err = tx.QueryRow("SELECT last_insert_rowid();").Scan(&id)
+	_, err := db.Exec(query, nodeID)
+
+	return errors.Wrap(err, "Error updating node maintenance in database")
+}
+
+func (ds *sqliteDB) getMaintenanceNodes() ([]string, error) {
+	var nodes []string
+
+	query := `SELECT node_id FROM node_maintenance ORDER BY node_id`
+
+	db := ds.getTableDB("node_maintenance")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		return nodes, errors.Wrap(err, "error getting nodes in maintenance from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	for index := range stat.Nodes {
-		t := stat.Nodes[index]
-
-		cmd := `INSERT INTO trace_data (frame_id, ssntp_uuid, tx_timestamp, rx_timestamp)
-			VALUES(?, ?, ?, ?);`
+	for rows.Next() {
+		var nodeID string
 
-		_, err = tx.Exec(cmd, id, t.SSNTPUUID, t.TxTimestamp, t.RxTimestamp)
-		if err != nil {
-			_ = tx.Rollback()
-			return err
+		err = rows.Scan(&nodeID)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading node maintenance row from database")
 		}
-	}
 
-	err = tx.Commit()
+		nodes = append(nodes, nodeID)
+	}
 
-	return err
+	return nodes, nil
 }
 
-// GetEventLog retrieves all the log entries stored in the datastore.
-func (ds *sqliteDB) getEventLog() ([]*types.LogEntry, error) {
-	var logEntries []*types.LogEntry
+func (ds *sqliteDB) getMigrations() ([]types.Migration, error) {
+	migrations := []types.Migration{}
 
-	db := ds.getTableDB("log")
+	query := `SELECT instance_id, tenant_id, source_node_id, target_node_id, state, starttime FROM migrations`
 
+	db := ds.getTableDB("migrations")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	rows, err := db.Query("SELECT timestamp, tenant_id, node_id, type, message FROM log")
+	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return migrations, errors.Wrap(err, "error getting migrations from database")
 	}
 	defer func() { _ = rows.Close() }()
 
-	logEntries = make([]*types.LogEntry, 0)
 	for rows.Next() {
-		var e types.LogEntry
-		err = rows.Scan(&e.Timestamp, &e.TenantID, &e.NodeID, &e.EventType, &e.Message)
+		var state string
+		m := types.Migration{}
+
+		err = rows.Scan(&m.InstanceID, &m.TenantID, &m.SourceNodeID, &m.TargetNodeID, &state, &m.StartTime)
 		if err != nil {
-			return nil, err
+			return []types.Migration{}, errors.Wrap(err, "error reading migration row from database")
 		}
-		logEntries = append(logEntries, &e)
+
+		m.State = types.MigrationState(state)
+		migrations = append(migrations, m)
 	}
 
-	return logEntries, err
+	return migrations, nil
 }
 
-// GetBatchFrameSummary will retieve the count of traces we have for a specific label
-func (ds *sqliteDB) getBatchFrameSummary() ([]types.BatchFrameSummary, error) {
-	var stats []types.BatchFrameSummary
+func (ds *sqliteDB) updateMigration(m types.Migration) error {
+	query := `REPLACE INTO migrations (instance_id, tenant_id, source_node_id, target_node_id, state, starttime) VALUES (?, ?, ?, ?, ?, ?)`
 
-	db := ds.getTableDB("frame_statistics")
+	db := ds.getTableDB("migrations")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec(query, m.InstanceID, m.TenantID, m.SourceNodeID, m.TargetNodeID, string(m.State), m.StartTime)
+
+	return errors.Wrap(err, "Error updating migration in database")
+}
 
+func (ds *sqliteDB) deleteMigration(instanceID string) error {
+	query := `DELETE FROM migrations WHERE instance_id = ?`
+
+	db := ds.getTableDB("migrations")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	query := `SELECT label, count(id)
-		  FROM frame_statistics
-		  GROUP BY label;`
+	_, err := db.Exec(query, instanceID)
+
+	return errors.Wrap(err, "Error deleting migration from database")
+}
+
+func (ds *sqliteDB) getPolicyRules() ([]types.PolicyRule, error) {
+	rules := []types.PolicyRule{}
+
+	query := `SELECT id, description, severity, image_pattern, vm_type, fw_type, min_vcpus, min_mem_mb, createtime FROM policy_rules`
+
+	db := ds.getTableDB("policy_rules")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
 	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return rules, errors.Wrap(err, "error getting policy rules from database")
 	}
 	defer func() { _ = rows.Close() }()
 
-	stats = make([]types.BatchFrameSummary, 0)
-
 	for rows.Next() {
-		var stat types.BatchFrameSummary
+		r := types.PolicyRule{}
+		var severity, vmType string
 
-		err = rows.Scan(&stat.BatchID, &stat.NumInstances)
+		err = rows.Scan(&r.ID, &r.Description, &severity, &r.ImagePattern, &vmType, &r.FWType, &r.MinVCPUs, &r.MinMemMB, &r.CreateTime)
 		if err != nil {
-			return nil, err
+			return []types.PolicyRule{}, errors.Wrap(err, "error reading policy rule row from database")
 		}
 
-		stats = append(stats, stat)
+		r.Severity = types.PolicySeverity(severity)
+		r.VMType = payloads.Hypervisor(vmType)
+
+		rules = append(rules, r)
 	}
 
-	return stats, err
+	return rules, nil
 }
 
-// GetBatchFrameStatistics will show individual trace data per instance for a batch of trace data.
-// The batch is identified by the label.
-func (ds *sqliteDB) getBatchFrameStatistics(label string) ([]types.BatchFrameStat, error) {
-	var stats []types.BatchFrameStat
+func (ds *sqliteDB) updatePolicyRule(r types.PolicyRule) error {
+	query := `REPLACE INTO policy_rules (id, description, severity, image_pattern, vm_type, fw_type, min_vcpus, min_mem_mb, createtime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	db := ds.getTableDB("frame_statistics")
+	db := ds.getTableDB("policy_rules")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	query := `WITH total AS
-		 (
-			SELECT	id,
-				start_timestamp,
-				end_timestamp,
-				(julianday(end_timestamp) - julianday(start_timestamp)) * 24 * 60 * 60 AS total_elapsed
-			FROM frame_statistics
-			WHERE label = ?
-		),
-		total_start AS
-		(
-			SELECT	trace_data.frame_id,
-				trace_data.ssntp_uuid,
-				(julianday(trace_data.tx_timestamp) - julianday(total.start_timestamp)) * 24 * 60 * 60 AS total_elapsed
-			FROM trace_data
-			JOIN total
-			WHERE rx_timestamp = '' and trace_data.frame_id = total.id
-		),
-		total_end AS
-		(
-			SELECT 	trace_data.frame_id,
-				trace_data.ssntp_uuid,
-				(julianday(total.end_timestamp) - julianday(trace_data.rx_timestamp)) * 24 * 60 * 60 AS total_elapsed
-			FROM trace_data
-			JOIN total
-			WHERE tx_timestamp = '' and trace_data.frame_id = total.id
-		),
-		total_per_node AS
-		(
-			SELECT	trace_data.frame_id,
-				trace_data.ssntp_uuid,
-				(julianday(trace_data.tx_timestamp) - julianday(trace_data.rx_timestamp)) * 24 * 60 *60 AS total_elapsed
-			FROM trace_data
-			WHERE tx_timestamp != '' and rx_timestamp != ''
-		),
-		diffs AS
-		(
-			SELECT 	total.id AS id,
-				total.total_elapsed AS total_elapsed,
-				total_start.total_elapsed AS controller_elapsed,
-				total_end.total_elapsed AS launcher_elapsed,
-				total_per_node.total_elapsed AS scheduler_elapsed
-			FROM total
-			LEFT JOIN total_start
-			ON total.id = total_start.frame_id
-			LEFT JOIN total_end
-			ON total_start.frame_id = total_end.frame_id
-			LEFT JOIN total_per_node
-			ON total_start.frame_id = total_per_node.frame_id
-		),
-		averages AS
-		(
-			SELECT	avg(diffs.total_elapsed) AS avg_total_elapsed,
-				avg(diffs.controller_elapsed) AS avg_controller,
-				avg(diffs.launcher_elapsed) AS avg_launcher,
-				avg(diffs.scheduler_elapsed) AS avg_scheduler
-			FROM diffs
-		),
-		variance AS
-		(
-			SELECT	avg((total_start.total_elapsed - averages.avg_controller) * (total_start.total_elapsed - averages.avg_controller)) AS controller,
-				avg((total_end.total_elapsed - averages.avg_launcher) * (total_end.total_elapsed - averages.avg_launcher)) AS launcher,
-				avg((total_per_node.total_elapsed - averages.avg_scheduler) * (total_per_node.total_elapsed - averages.avg_scheduler)) AS scheduler
-			FROM total_start
-			LEFT JOIN total_end
-			ON total_start.frame_id = total_end.frame_id
-			LEFT JOIN total_per_node
-			ON total_start.frame_id = total_per_node.frame_id
-			JOIN averages
-		)
-		SELECT	count(total.id) AS num_instances,
-			(julianday(max(total.end_timestamp)) - julianday(min(total.start_timestamp))) * 24 * 60 * 60 AS total_elapsed,
-			averages.avg_total_elapsed AS average_total_elapsed,
-			averages.avg_controller AS average_controller_elapsed,
-			averages.avg_launcher AS average_launcher_elapsed,
-			averages.avg_scheduler AS average_scheduler_elapsed,
-			variance.controller AS controller_variance,
-			variance.launcher AS launcher_variance,
-			variance.scheduler AS scheduler_variance
-		FROM variance
-		JOIN total
-		JOIN averages;`
+	_, err := db.Exec(query, r.ID, r.Description, string(r.Severity), r.ImagePattern, string(r.VMType), r.FWType, r.MinVCPUs, r.MinMemMB, r.CreateTime)
+
+	return errors.Wrap(err, "Error updating policy rule in database")
+}
+
+func (ds *sqliteDB) deletePolicyRule(ID string) error {
+	query := `DELETE FROM policy_rules WHERE id = ?`
 
+	db := ds.getTableDB("policy_rules")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	rows, err := db.Query(query, label)
+	_, err := db.Exec(query, ID)
+
+	return errors.Wrap(err, "Error deleting policy rule from database")
+}
+
+func (ds *sqliteDB) getSettings() ([]types.SettingValue, error) {
+	settings := []types.SettingValue{}
+
+	db := ds.getTableDB("settings")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT key, value, update_time FROM settings")
 	if err != nil {
-		return nil, err
+		return settings, errors.Wrap(err, "error getting settings from database")
 	}
 	defer func() { _ = rows.Close() }()
 
-	stats = make([]types.BatchFrameStat, 0)
-
 	for rows.Next() {
-		var stat types.BatchFrameStat
-		var numInstances sql.NullInt64
-		var totalElapsed sql.NullFloat64
-		var averageElapsed sql.NullFloat64
-		var averageControllerElapsed sql.NullFloat64
-		var averageLauncherElapsed sql.NullFloat64
-		var averageSchedulerElapsed sql.NullFloat64
-		var varianceController sql.NullFloat64
-		var varianceLauncher sql.NullFloat64
-		var varianceScheduler sql.NullFloat64
+		var s types.SettingValue
 
-		err = rows.Scan(&numInstances, &totalElapsed, &averageElapsed, &averageControllerElapsed, &averageLauncherElapsed, &averageSchedulerElapsed, &varianceController, &varianceLauncher, &varianceScheduler)
+		err = rows.Scan(&s.Key, &s.Value, &s.UpdateTime)
 		if err != nil {
-			return nil, err
+			return []types.SettingValue{}, errors.Wrap(err, "error reading setting row from database")
 		}
 
-		if numInstances.Valid {
-			stat.NumInstances = int(numInstances.Int64)
-		}
+		settings = append(settings, s)
+	}
 
-		if totalElapsed.Valid {
-			stat.TotalElapsed = totalElapsed.Float64
-		}
+	return settings, rows.Err()
+}
 
-		if averageElapsed.Valid {
-			stat.AverageElapsed = averageElapsed.Float64
-		}
+func (ds *sqliteDB) updateSetting(s types.SettingValue) error {
+	db := ds.getTableDB("settings")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-		if averageControllerElapsed.Valid {
-			stat.AverageControllerElapsed = averageControllerElapsed.Float64
-		}
+	_, err := db.Exec("REPLACE INTO settings (key, value, update_time) VALUES (?, ?, ?)", s.Key, s.Value, s.UpdateTime)
 
-		if averageLauncherElapsed.Valid {
-			stat.AverageLauncherElapsed = averageLauncherElapsed.Float64
-		}
+	return errors.Wrap(err, "Error updating setting in database")
+}
 
-		if averageSchedulerElapsed.Valid {
-			stat.AverageSchedulerElapsed = averageSchedulerElapsed.Float64
-		}
+func (ds *sqliteDB) deleteSetting(key string) error {
+	db := ds.getTableDB("settings")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-		if varianceController.Valid {
-			stat.VarianceController = varianceController.Float64
-		}
+	_, err := db.Exec("DELETE FROM settings WHERE key = ?", key)
 
-		if varianceLauncher.Valid {
-			stat.VarianceLauncher = varianceLauncher.Float64
-		}
+	return errors.Wrap(err, "Error deleting setting from database")
+}
 
-		if varianceScheduler.Valid {
-			stat.VarianceScheduler = varianceScheduler.Float64
+func (ds *sqliteDB) getQueuedLaunches() ([]types.QueuedLaunch, error) {
+	launches := []types.QueuedLaunch{}
+
+	db := ds.getTableDB("launch_queue")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query("SELECT instance_id, tenant_id, sequence, config, trace_label, queue_time FROM launch_queue ORDER BY sequence")
+	if err != nil {
+		return launches, errors.Wrap(err, "error getting launch queue from database")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var l types.QueuedLaunch
+
+		err = rows.Scan(&l.InstanceID, &l.TenantID, &l.Sequence, &l.Config, &l.TraceLabel, &l.QueueTime)
+		if err != nil {
+			return []types.QueuedLaunch{}, errors.Wrap(err, "error reading launch queue row from database")
 		}
 
-		stats = append(stats, stat)
+		launches = append(launches, l)
 	}
 
-	return stats, err
+	return launches, rows.Err()
 }
 
-func (ds *sqliteDB) getTenantDevices(tenantID string) (map[string]types.Volume, error) {
-	devices := make(map[string]types.Volume)
+func (ds *sqliteDB) addQueuedLaunch(l types.QueuedLaunch) error {
+	db := ds.getTableDB("launch_queue")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	db := ds.getTableDB("block_data")
+	_, err := db.Exec("REPLACE INTO launch_queue (instance_id, tenant_id, sequence, config, trace_label, queue_time) VALUES (?, ?, ?, ?, ?, ?)",
+		l.InstanceID, l.TenantID, l.Sequence, l.Config, l.TraceLabel, l.QueueTime)
 
+	return errors.Wrap(err, "Error adding queued launch to database")
+}
+
+func (ds *sqliteDB) deleteQueuedLaunch(instanceID string) error {
+	db := ds.getTableDB("launch_queue")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	query := `SELECT	block_data.id,
-				block_data.tenant_id,
-				block_data.size,
-				block_data.state,
-				block_data.create_time,
-				block_data.name,
-				block_data.description,
-				block_data.internal
-		  FROM	block_data
-		  WHERE block_data.tenant_id = ?`
+	_, err := db.Exec("DELETE FROM launch_queue WHERE instance_id = ?", instanceID)
 
-	rows, err := db.Query(query, tenantID)
+	return errors.Wrap(err, "Error deleting queued launch from database")
+}
+
+func (ds *sqliteDB) getAPIKeys() ([]types.APIKey, error) {
+	keys := []types.APIKey{}
+
+	query := `SELECT id, tenant_id, name, scopes, hash, expire_time, last_used_time, createtime FROM api_keys`
+
+	db := ds.getTableDB("api_keys")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query)
 	if err != nil {
-		return devices, err
+		return keys, errors.Wrap(err, "error getting API keys from database")
 	}
 	defer func() { _ = rows.Close() }()
 
 	for rows.Next() {
-		var state string
-		var data types.Volume
+		var k types.APIKey
+		var scopes string
 
-		err = rows.Scan(&data.ID, &data.TenantID, &data.Size, &state, &data.CreateTime, &data.Name, &data.Description, &data.Internal)
+		err = rows.Scan(&k.ID, &k.TenantID, &k.Name, &scopes, &k.Hash, &k.ExpireTime, &k.LastUsedTime, &k.CreateTime)
 		if err != nil {
-			continue
+			return []types.APIKey{}, errors.Wrap(err, "error reading API key row from database")
 		}
 
-		data.State = types.BlockState(state)
-		devices[data.ID] = data
-	}
+		err = json.Unmarshal([]byte(scopes), &k.Scopes)
+		if err != nil {
+			return []types.APIKey{}, errors.Wrap(err, "error unmarshalling API key scopes")
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (ds *sqliteDB) updateAPIKey(k types.APIKey) error {
+	query := `REPLACE INTO api_keys (id, tenant_id, name, scopes, hash, expire_time, last_used_time, createtime) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	scopes, err := json.Marshal(k.Scopes)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling API key scopes")
+	}
+
+	db := ds.getTableDB("api_keys")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err = db.Exec(query, k.ID, k.TenantID, k.Name, string(scopes), k.Hash, k.ExpireTime, k.LastUsedTime, k.CreateTime)
+
+	return errors.Wrap(err, "Error updating API key in database")
+}
+
+func (ds *sqliteDB) deleteAPIKey(ID string) error {
+	db := ds.getTableDB("api_keys")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	if err = rows.Err(); err != nil {
-		return devices, err
-	}
+	_, err := db.Exec("DELETE FROM api_keys WHERE id = ?", ID)
 
-	return devices, nil
+	return errors.Wrap(err, "Error deleting API key from database")
 }
 
-func (ds *sqliteDB) getAllBlockData() (map[string]types.Volume, error) {
-	devices := make(map[string]types.Volume)
+func (ds *sqliteDB) getAuthTokens() ([]types.AuthToken, error) {
+	tokens := []types.AuthToken{}
 
-	db := ds.getTableDB("block_data")
+	query := `SELECT id, subject, tenant_id, role, expire_time, createtime FROM tokens`
 
-	query := `SELECT	block_data.id,
-				block_data.tenant_id,
-				block_data.size,
-				block_data.state,
-				block_data.create_time,
-				block_data.name,
-				block_data.description,
-				block_data.internal
-		  FROM	block_data `
+	db := ds.getTableDB("tokens")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
 	rows, err := db.Query(query)
 	if err != nil {
-		return nil, err
+		return tokens, errors.Wrap(err, "error getting tokens from database")
 	}
 	defer func() { _ = rows.Close() }()
 
 	for rows.Next() {
-		var data types.Volume
-		var state string
+		var t types.AuthToken
 
-		err = rows.Scan(&data.ID, &data.TenantID, &data.Size, &state, &data.CreateTime, &data.Name, &data.Description, &data.Internal)
+		err = rows.Scan(&t.ID, &t.Subject, &t.TenantID, &t.Role, &t.ExpireTime, &t.CreateTime)
 		if err != nil {
-			continue
+			return []types.AuthToken{}, errors.Wrap(err, "error reading token row from database")
 		}
 
-		data.State = types.BlockState(state)
-		devices[data.ID] = data
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+		tokens = append(tokens, t)
 	}
 
-	return devices, nil
+	return tokens, rows.Err()
 }
 
-func (ds *sqliteDB) addBlockData(data types.Volume) error {
+func (ds *sqliteDB) addAuthToken(t types.AuthToken) error {
+	query := `INSERT INTO tokens (id, subject, tenant_id, role, expire_time, createtime) VALUES (?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("tokens")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	err := ds.create("block_data", data.ID, data.TenantID, data.Size, string(data.State), data.CreateTime.Format(time.RFC3339Nano), data.Name, data.Description, data.Internal)
+	_, err := db.Exec(query, t.ID, t.Subject, t.TenantID, t.Role, t.ExpireTime, t.CreateTime)
 
-	return err
+	return errors.Wrap(err, "Error adding token to database")
 }
 
-// For now we only support updating the state.
-func (ds *sqliteDB) updateBlockData(data types.Volume) error {
-	db := ds.getTableDB("block_data")
+func (ds *sqliteDB) deleteAuthToken(ID string) error {
+	db := ds.getTableDB("tokens")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM tokens WHERE id = ?", ID)
+
+	return errors.Wrap(err, "Error deleting token from database")
+}
 
+func (ds *sqliteDB) addIdempotentResponse(r types.IdempotentResponse) error {
+	query := `REPLACE INTO idempotency_keys (tenant_id, key, request_hash, status, content_type, body, createtime) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("idempotency_keys")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("UPDATE block_data SET state = ? WHERE id = ?", string(data.State), data.ID)
+	_, err := db.Exec(query, r.TenantID, r.Key, r.RequestHash, r.Status, r.ContentType, r.Body, r.CreateTime)
 
-	return err
+	return errors.Wrap(err, "Error adding idempotency key to database")
 }
 
-func (ds *sqliteDB) deleteBlockData(ID string) error {
-	db := ds.getTableDB("block_data")
+func (ds *sqliteDB) getIdempotentResponse(tenantID string, key string) (types.IdempotentResponse, error) {
+	query := `SELECT request_hash, status, content_type, body, createtime FROM idempotency_keys WHERE tenant_id = ? AND key = ?`
+
+	r := types.IdempotentResponse{
+		TenantID: tenantID,
+		Key:      key,
+	}
 
+	db := ds.getTableDB("idempotency_keys")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("DELETE FROM block_data WHERE id = ?", ID)
+	err := db.QueryRow(query, tenantID, key).Scan(&r.RequestHash, &r.Status, &r.ContentType, &r.Body, &r.CreateTime)
+	if err == sql.ErrNoRows {
+		return r, ErrNoIdempotencyKey
+	} else if err != nil {
+		return r, errors.Wrap(err, "Error reading idempotency key from database")
+	}
 
-	return err
+	return r, nil
 }
 
-func (ds *sqliteDB) addStorageAttachment(a types.StorageAttachment) error {
-	db := ds.getTableDB("attachments")
+func (ds *sqliteDB) pruneIdempotentResponses(before time.Time) (int, error) {
+	query := `DELETE FROM idempotency_keys WHERE createtime < ?`
 
+	db := ds.getTableDB("idempotency_keys")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO attachments (id, instance_id, block_id, ephemeral, boot) VALUES (?, ?, ?, ?, ?)", a.ID, a.InstanceID, a.BlockID, a.Ephemeral, a.Boot)
+	res, err := db.Exec(query, before)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning idempotency keys from database")
+	}
 
-	return err
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning idempotency keys from database")
+	}
+
+	return int(n), nil
 }
 
-func (ds *sqliteDB) getAllStorageAttachments() (map[string]types.StorageAttachment, error) {
-	attachments := make(map[string]types.StorageAttachment)
+func (ds *sqliteDB) addQuotaAudit(records []types.QuotaAuditRecord) error {
+	query := `INSERT INTO quota_audit (tenant_id, resource, delta, usage, allowed, timestamp) VALUES (?, ?, ?, ?, ?, ?)`
 
-	db := ds.getTableDB("attachments")
+	db := ds.getTableDB("quota_audit")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	query := `SELECT	attachments.id,
-				attachments.instance_id,
-				attachments.block_id,
-				attachments.ephemeral,
-				attachments.boot
-		  FROM	attachments `
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Error adding quota audit records to database")
+	}
 
-	rows, err := db.Query(query)
+	for _, r := range records {
+		_, err = tx.Exec(query, r.TenantID, r.Resource, r.Delta, r.Usage, r.Allowed, r.Timestamp.UTC())
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Wrap(err, "Error adding quota audit record to database")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "Error adding quota audit records to database")
+}
+
+func (ds *sqliteDB) getQuotaAudit(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error) {
+	query := `SELECT resource, delta, usage, allowed, timestamp FROM quota_audit WHERE tenant_id = ?`
+	args := []interface{}{filter.TenantID}
+
+	if filter.Resource != "" {
+		query += ` AND resource = ?`
+		args = append(args, filter.Resource)
+	}
+
+	if !filter.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, filter.Since.UTC())
+	}
+
+	query += ` ORDER BY id`
+
+	db := ds.getTableDB("quota_audit")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return attachments, err
+		return nil, errors.Wrap(err, "Error getting quota audit records from database")
 	}
 	defer func() { _ = rows.Close() }()
 
+	records := []types.QuotaAuditRecord{}
 	for rows.Next() {
-		var a types.StorageAttachment
+		r := types.QuotaAuditRecord{TenantID: filter.TenantID}
 
-		err = rows.Scan(&a.ID, &a.InstanceID, &a.BlockID, &a.Ephemeral, &a.Boot)
+		err = rows.Scan(&r.Resource, &r.Delta, &r.Usage, &r.Allowed, &r.Timestamp)
 		if err != nil {
-			continue
+			return nil, errors.Wrap(err, "Error reading quota audit row from database")
 		}
-		attachments[a.ID] = a
-	}
 
-	if err = rows.Err(); err != nil {
-		return attachments, err
+		records = append(records, r)
 	}
 
-	return attachments, nil
+	return records, rows.Err()
 }
 
-func (ds *sqliteDB) deleteStorageAttachment(ID string) error {
-	db := ds.getTableDB("attachments")
+func (ds *sqliteDB) pruneQuotaAudit(before time.Time) (int, error) {
+	query := `DELETE FROM quota_audit WHERE timestamp < ?`
 
+	db := ds.getTableDB("quota_audit")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("DELETE FROM attachments WHERE id = ?", ID)
+	res, err := db.Exec(query, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning quota audit records from database")
+	}
 
-	return err
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning quota audit records from database")
+	}
+
+	return int(n), nil
 }
 
-// this is here just for readability.
-func (ds *sqliteDB) addPool(pool types.Pool) error {
-	return ds.updatePool(pool)
+func (ds *sqliteDB) addAuditRecord(r types.AuditRecord) error {
+	query := `INSERT INTO audit (timestamp, request_id, tenant_id, actor, on_behalf_of, method, resource, status, body, body_size) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("audit")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec(query, r.Timestamp.UTC(), r.RequestID, r.TenantID, r.Actor, r.OnBehalfOf,
+		r.Method, r.Resource, r.Status, r.Body, r.BodySize)
+
+	return errors.Wrap(err, "Error adding audit record to database")
 }
 
-// lock must be held by caller. Any rollbacks will need to be handled
-// by caller.
-func (ds *sqliteDB) updateSubnets(tx *sql.Tx, pool types.Pool) error {
-	// get currently known subnets.
-	subnets, err := ds.getPoolSubnets(pool.ID)
-	if err != nil {
-		// TBD: what about row not found?
-		return err
-	}
+func (ds *sqliteDB) getAuditRecords(filter types.AuditFilter) ([]types.AuditRecord, error) {
+	var where []string
+	var args []interface{}
 
-	// make a map of pool subnets by ID
-	subMap := make(map[string]bool)
-	for _, sub := range pool.Subnets {
-		subMap[sub.ID] = true
+	if filter.TenantID != "" {
+		where = append(where, "tenant_id = ?")
+		args = append(args, filter.TenantID)
 	}
 
-	// do we have any subnets that need deleting?
-	for _, sub := range subnets {
-		_, ok := subMap[sub.ID]
-		if !ok {
-			_, err = tx.Exec("DELETE FROM subnet_pool WHERE id = ?", sub.ID)
-			if err != nil {
-				return err
-			}
-		}
+	if filter.Marker > 0 {
+		where = append(where, "id > ?")
+		args = append(args, filter.Marker)
 	}
 
-	// any subnets that already exist in the table will be ignored,
-	// new ones will be added.
-	for _, subnet := range pool.Subnets {
-		_, err = tx.Exec("INSERT OR IGNORE INTO subnet_pool (id, pool_id, cidr) VALUES (?, ?, ?)", subnet.ID, pool.ID, subnet.CIDR)
-		if err != nil {
-			return err
-		}
+	if !filter.Start.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, filter.Start.UTC())
 	}
 
-	return nil
-}
+	if !filter.End.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, filter.End.UTC())
+	}
 
-// lock must be held by caller. Any rollbacks will need to be handled
-// by caller.
-func (ds *sqliteDB) updateAddresses(tx *sql.Tx, pool types.Pool) error {
-	// get currently known individual addresses.
-	addresses, err := ds.getPoolAddresses(pool.ID)
-	if err != nil {
-		// TBD: what about row not found?
-		return err
+	query := `SELECT id, timestamp, request_id, tenant_id, actor, on_behalf_of, method, resource, status, body, body_size FROM audit`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
 	}
+	query += " ORDER BY id"
 
-	// make a map of pool addresses by ID
-	addrMap := make(map[string]bool)
-	for _, addr := range pool.IPs {
-		addrMap[addr.ID] = true
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
 	}
 
-	// do we have any individual IPs that need deleting?
-	for _, addr := range addresses {
-		_, ok := addrMap[addr.ID]
-		if !ok {
-			_, err = tx.Exec("DELETE FROM address_pool WHERE id = ?", addr.ID)
-			if err != nil {
-				_ = tx.Rollback()
-				return err
-			}
-		}
+	db := ds.getTableDB("audit")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting audit records from database")
 	}
+	defer func() { _ = rows.Close() }()
 
-	// any addresses that already exist in the table will be ignored,
-	// new ones will be added.
-	for _, IP := range pool.IPs {
-		_, err = tx.Exec("INSERT OR IGNORE INTO address_pool (id, pool_id, address) VALUES (?, ?, ?)", IP.ID, pool.ID, IP.Address)
+	records := []types.AuditRecord{}
+	for rows.Next() {
+		var r types.AuditRecord
+
+		err = rows.Scan(&r.ID, &r.Timestamp, &r.RequestID, &r.TenantID, &r.Actor, &r.OnBehalfOf,
+			&r.Method, &r.Resource, &r.Status, &r.Body, &r.BodySize)
 		if err != nil {
-			_ = tx.Rollback()
-			return err
+			return nil, errors.Wrap(err, "Error reading audit row from database")
 		}
+
+		records = append(records, r)
 	}
 
-	return nil
+	return records, rows.Err()
 }
 
-// updatePool is used to update all pool related fields even if they
-// are in different tables.
-func (ds *sqliteDB) updatePool(pool types.Pool) error {
-	db := ds.getTableDB("pools")
+func (ds *sqliteDB) pruneAuditRecords(before time.Time) (int, error) {
+	query := `DELETE FROM audit WHERE timestamp < ?`
 
+	db := ds.getTableDB("audit")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	pools := ds.getAllPools()
-
-	// do the below as a single transaction.
-	tx, err := db.Begin()
+	res, err := db.Exec(query, before.UTC())
 	if err != nil {
-		return err
+		return 0, errors.Wrap(err, "Error pruning audit records from database")
 	}
 
-	err = ds.updateSubnets(tx, pool)
+	n, err := res.RowsAffected()
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		return 0, errors.Wrap(err, "Error pruning audit records from database")
 	}
 
-	err = ds.updateAddresses(tx, pool)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+	return int(n), nil
+}
 
-	// if this is a new pool, put it in, otherwise just update.
-	_, ok := pools[pool.ID]
-	if !ok {
-		_, err = tx.Exec("INSERT INTO pools (id, name, free, total) VALUES (?, ?, ?, ?)", pool.ID, pool.Name, pool.Free, pool.TotalIPs)
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	} else {
-		// update free and total counts.
-		_, err = tx.Exec("UPDATE pools SET free = ?, total = ? WHERE id = ?", pool.Free, pool.TotalIPs, pool.ID)
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	}
+func (ds *sqliteDB) addReleasedUsage(span types.UsageSpan) error {
+	query := `REPLACE INTO usage_released (resource, id, tenant_id, size_gb, start_time, end_time) VALUES (?, ?, ?, ?, ?, ?)`
 
-	err = tx.Commit()
+	db := ds.getTableDB("usage_released")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	return err
-}
+	_, err := db.Exec(query, string(span.Resource), span.ID, span.TenantID, span.SizeGB, span.Start.UTC(), span.End.UTC())
 
-func (ds *sqliteDB) getAllPools() map[string]types.Pool {
-	pools := make(map[string]types.Pool)
+	return errors.Wrap(err, "Error adding released usage to database")
+}
 
-	db := ds.getTableDB("pools")
+func (ds *sqliteDB) getReleasedUsage() ([]types.UsageSpan, error) {
+	query := `SELECT resource, id, tenant_id, size_gb, start_time, end_time FROM usage_released`
 
-	query := `SELECT	id,
-				name,
-				free,
-				total
-		  FROM	pools`
+	db := ds.getTableDB("usage_released")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
 	rows, err := db.Query(query)
 	if err != nil {
-		return nil
+		return nil, errors.Wrap(err, "Error getting released usage from database")
 	}
 	defer func() { _ = rows.Close() }()
 
+	var spans []types.UsageSpan
 	for rows.Next() {
-		var pool types.Pool
-
-		err = rows.Scan(&pool.ID, &pool.Name, &pool.Free, &pool.TotalIPs)
-		if err != nil {
-			continue
-		}
-
-		pool.Subnets, err = ds.getPoolSubnets(pool.ID)
-		if err != nil {
-			continue
-		}
+		var s types.UsageSpan
+		var resource string
 
-		pool.IPs, err = ds.getPoolAddresses(pool.ID)
+		err = rows.Scan(&resource, &s.ID, &s.TenantID, &s.SizeGB, &s.Start, &s.End)
 		if err != nil {
-			continue
+			return nil, errors.Wrap(err, "Error reading released usage row from database")
 		}
 
-		pools[pool.ID] = pool
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil
+		s.Resource = types.UsageResource(resource)
+		spans = append(spans, s)
 	}
 
-	return pools
+	return spans, rows.Err()
 }
 
-func (ds *sqliteDB) deletePool(ID string) error {
-	db := ds.getTableDB("pools")
+func (ds *sqliteDB) pruneReleasedUsage(before time.Time) (int, error) {
+	query := `DELETE FROM usage_released WHERE end_time < ?`
 
+	db := ds.getTableDB("usage_released")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
+	res, err := db.Exec(query, before.UTC())
 	if err != nil {
-		return err
+		return 0, errors.Wrap(err, "Error pruning released usage from database")
 	}
 
-	// lock is held here and ok because the
-	// get functions don't hold a lock.
-	subnets, err := ds.getPoolSubnets(ID)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return err
+		return 0, errors.Wrap(err, "Error pruning released usage from database")
 	}
 
-	IPs, err := ds.getPoolAddresses(ID)
+	return int(n), nil
+}
+
+func (ds *sqliteDB) addUsageRecords(records []types.UsageRecord) error {
+	query := `REPLACE INTO usage_records (tenant_id, granularity, start_time, end_time, instance_hours, volume_gb_hours, external_ip_hours) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	db := ds.getTableDB("usage_records")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return errors.Wrap(err, "Error starting transaction for usage records")
 	}
 
-	for _, subnet := range subnets {
-		_, err = tx.Exec("DELETE FROM subnet_pool WHERE id = ?", subnet.ID)
+	for _, r := range records {
+		_, err = tx.Exec(query, r.TenantID, string(r.Granularity), r.Start.UTC(), r.End.UTC(),
+			r.InstanceHours, r.VolumeGBHours, r.ExternalIPHours)
 		if err != nil {
 			_ = tx.Rollback()
-			return err
+			return errors.Wrap(err, "Error adding usage record to database")
 		}
 	}
 
-	for _, addr := range IPs {
-		_, err = tx.Exec("DELETE FROM address_pool WHERE id = ?", addr.ID)
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	}
+	return errors.Wrap(tx.Commit(), "Error adding usage records to database")
+}
 
-	_, err = tx.Exec("DELETE FROM pools WHERE id = ?", ID)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+func (ds *sqliteDB) getUsageRecords(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	query := `SELECT tenant_id, start_time, end_time, instance_hours, volume_gb_hours, external_ip_hours FROM usage_records WHERE granularity = ?`
+	args := []interface{}{string(filter.Granularity)}
 
-	err = tx.Commit()
+	if filter.TenantID != "" {
+		query += ` AND tenant_id = ?`
+		args = append(args, filter.TenantID)
+	}
 
-	return err
-}
+	if !filter.Start.IsZero() {
+		query += ` AND start_time >= ?`
+		args = append(args, filter.Start.UTC())
+	}
 
-func (ds *sqliteDB) getPoolSubnets(poolID string) ([]types.ExternalSubnet, error) {
-	var subnets []types.ExternalSubnet
+	if !filter.End.IsZero() {
+		query += ` AND start_time < ?`
+		args = append(args, filter.End.UTC())
+	}
 
-	db := ds.getTableDB("subnet_pool")
+	query += ` ORDER BY start_time, tenant_id`
 
-	query := `SELECT	id,
-				cidr
-		  FROM	subnet_pool
-		  WHERE pool_id = ?`
+	db := ds.getTableDB("usage_records")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	rows, err := db.Query(query, poolID)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return subnets, err
+		return nil, errors.Wrap(err, "Error getting usage records from database")
 	}
 	defer func() { _ = rows.Close() }()
 
+	records := []types.UsageRecord{}
 	for rows.Next() {
-		var subnet types.ExternalSubnet
+		r := types.UsageRecord{Granularity: filter.Granularity}
 
-		err = rows.Scan(&subnet.ID, &subnet.CIDR)
+		err = rows.Scan(&r.TenantID, &r.Start, &r.End, &r.InstanceHours, &r.VolumeGBHours, &r.ExternalIPHours)
 		if err != nil {
-			continue
+			return nil, errors.Wrap(err, "Error reading usage record row from database")
 		}
 
-		subnets = append(subnets, subnet)
+		records = append(records, r)
 	}
 
-	if err = rows.Err(); err != nil {
-		return subnets, err
+	return records, rows.Err()
+}
+
+func (ds *sqliteDB) lastUsageRecordEnd(granularity types.UsageGranularity) (time.Time, error) {
+	query := `SELECT end_time FROM usage_records WHERE granularity = ? ORDER BY end_time DESC LIMIT 1`
+
+	db := ds.getTableDB("usage_records")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var end time.Time
+	err := db.QueryRow(query, string(granularity)).Scan(&end)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
 	}
 
-	return subnets, nil
+	return end, errors.Wrap(err, "Error reading usage records from database")
 }
 
-func (ds *sqliteDB) getPoolAddresses(poolID string) ([]types.ExternalIP, error) {
-	var IPs []types.ExternalIP
+func (ds *sqliteDB) pruneUsageRecords(granularity types.UsageGranularity, before time.Time) (int, error) {
+	query := `DELETE FROM usage_records WHERE granularity = ? AND end_time < ?`
 
-	db := ds.getTableDB("address_pool")
+	db := ds.getTableDB("usage_records")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
 
-	query := `SELECT	id,
-				address
-		  FROM	address_pool
-		  WHERE pool_id = ?`
+	res, err := db.Exec(query, string(granularity), before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning usage records from database")
+	}
 
-	rows, err := db.Query(query, poolID)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return IPs, err
+		return 0, errors.Wrap(err, "Error pruning usage records from database")
 	}
-	defer func() { _ = rows.Close() }()
 
-	for rows.Next() {
-		var IP types.ExternalIP
+	return int(n), nil
+}
 
-		err = rows.Scan(&IP.ID, &IP.Address)
-		if err != nil {
-			continue
-		}
+// acquireLease takes or renews the lease if it is free, has expired or is
+// already held by holder.  Each statement is atomic so that competing
+// controllers sharing the database cannot both hold the lease.  The
+// current lease is returned, whoever holds it.
+func (ds *sqliteDB) acquireLease(name string, holder string, address string, expiry time.Time, now time.Time) (types.LeaderLease, error) {
+	lease := types.LeaderLease{Name: name}
 
-		IPs = append(IPs, IP)
+	db := ds.getTableDB("leases")
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec(`INSERT OR IGNORE INTO leases (name, holder, address, expiry) VALUES (?, ?, ?, ?)`,
+		name, holder, address, expiry.UnixNano())
+	if err != nil {
+		return lease, errors.Wrap(err, "Error inserting lease")
 	}
 
-	if err = rows.Err(); err != nil {
-		return IPs, err
+	_, err = db.Exec(`UPDATE leases SET holder = ?, address = ?, expiry = ? WHERE name = ? AND (holder = ? OR expiry < ?)`,
+		holder, address, expiry.UnixNano(), name, holder, now.UnixNano())
+	if err != nil {
+		return lease, errors.Wrap(err, "Error updating lease")
 	}
 
-	return IPs, nil
-}
+	var nsec int64
+	err = db.QueryRow(`SELECT holder, address, expiry FROM leases WHERE name = ?`, name).Scan(&lease.Holder, &lease.Address, &nsec)
+	if err != nil {
+		return lease, errors.Wrap(err, "Error reading lease")
+	}
+	lease.Expiry = time.Unix(0, nsec)
 
-func (ds *sqliteDB) addMappedIP(m types.MappedIP) error {
-	db := ds.getTableDB("mapped_ips")
+	return lease, nil
+}
 
+func (ds *sqliteDB) releaseLease(name string, holder string) error {
+	db := ds.getTableDB("leases")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO mapped_ips (id, pool_id, external_ip, instance_id) VALUES (?, ?, ?, ?)", m.ID, m.PoolID, m.ExternalIP, m.InstanceID)
+	_, err := db.Exec(`DELETE FROM leases WHERE name = ? AND holder = ?`, name, holder)
 
-	return err
+	return errors.Wrap(err, "Error releasing lease")
 }
 
-func (ds *sqliteDB) deleteMappedIP(ID string) error {
-	db := ds.getTableDB("mapped_ips")
+// fileSize returns the size of the file at path, or zero if it does not
+// exist.
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
 
-	ds.dbLock.Lock()
-	defer ds.dbLock.Unlock()
+	return fi.Size(), nil
+}
 
-	_, err := db.Exec("DELETE FROM mapped_ips WHERE id = ?", ID)
+func (ds *sqliteDB) stats() (types.DatabaseStatus, error) {
+	var s types.DatabaseStatus
 
-	return err
-}
+	pragmas := []struct {
+		name string
+		dst  *int64
+	}{
+		{"page_size", &s.PageSize},
+		{"page_count", &s.PageCount},
+		{"freelist_count", &s.FreelistPages},
+	}
 
-func (ds *sqliteDB) getMappedIPs() map[string]types.MappedIP {
-	IPs := make(map[string]types.MappedIP)
+	for _, p := range pragmas {
+		err := ds.db.QueryRow("PRAGMA " + p.name).Scan(p.dst)
+		if err != nil {
+			return s, errors.Wrapf(err, "Error reading %s", p.name)
+		}
+	}
 
-	db := ds.getTableDB("mapped_ips")
+	if ds.dbPath == "" {
+		return s, nil
+	}
 
-	query := `SELECT	mapped_ips.id,
-				mapped_ips.pool_id,
-				mapped_ips.external_ip,
-				mapped_ips.instance_id,
-				instances.ip,
-				instances.tenant_id,
-				pools.name
-		  FROM	mapped_ips
-		  JOIN instances
-		  ON instances.id = mapped_ips.instance_id
-		  JOIN pools
-		  ON pools.id = mapped_ips.pool_id`
+	var err error
+	s.FileSize, err = fileSize(ds.dbPath)
+	if err != nil {
+		return s, errors.Wrap(err, "Error reading database size")
+	}
 
-	rows, err := db.Query(query)
+	s.WALSize, err = fileSize(ds.dbPath + "-wal")
 	if err != nil {
-		fmt.Println(err)
-		return IPs
+		return s, errors.Wrap(err, "Error reading write ahead log size")
+	}
+
+	return s, nil
+}
+
+// pragma runs a pragma statement, stepping through any rows it returns.
+// Some pragmas, such as incremental_vacuum, only complete once all their
+// rows have been read.
+func pragma(ctx context.Context, conn *sql.Conn, stmt string) error {
+	rows, err := conn.QueryContext(ctx, "PRAGMA "+stmt)
+	if err != nil {
+		return errors.Wrapf(err, "Error running PRAGMA %s", stmt)
 	}
 	defer func() { _ = rows.Close() }()
 
 	for rows.Next() {
-		var IP types.MappedIP
+	}
 
-		err = rows.Scan(&IP.ID, &IP.PoolID, &IP.ExternalIP, &IP.InstanceID, &IP.InternalIP, &IP.TenantID, &IP.PoolName)
-		if err != nil {
-			continue
-		}
+	return errors.Wrapf(rows.Err(), "Error running PRAGMA %s", stmt)
+}
 
-		IPs[IP.ExternalIP] = IP
+// compact releases the free pages in the database and truncates the write
+// ahead log.  Databases created without incremental auto vacuum are
+// converted by a full VACUUM the first time they are compacted.  Writers
+// are blocked while the database is compacted.
+func (ds *sqliteDB) compact() error {
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	ctx := context.Background()
+
+	// A change to auto_vacuum only takes effect when it is followed by
+	// a VACUUM on the same connection.
+	conn, err := ds.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Error getting database connection")
 	}
+	defer func() { _ = conn.Close() }()
 
-	if err = rows.Err(); err != nil {
-		fmt.Println(err)
+	var mode int
+	err = conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode)
+	if err != nil {
+		return errors.Wrap(err, "Error reading auto_vacuum mode")
 	}
 
-	return IPs
-}
+	const incremental = 2
+	if mode != incremental {
+		err = pragma(ctx, conn, "auto_vacuum = INCREMENTAL")
+		if err != nil {
+			return err
+		}
 
-func (ds *sqliteDB) updateQuotas(tenantID string, qds []types.QuotaDetails) error {
-	db := ds.getTableDB("quotas")
+		_, err = conn.ExecContext(ctx, "VACUUM")
+		if err != nil {
+			return errors.Wrap(err, "Error running VACUUM")
+		}
+	} else {
+		err = pragma(ctx, conn, "incremental_vacuum")
+		if err != nil {
+			return err
+		}
+	}
+
+	return pragma(ctx, conn, "wal_checkpoint(TRUNCATE)")
+}
 
+// pruneStatistics removes the node and instance statistics recorded before
+// the given time, returning the number of rows removed.  The latest
+// statistics of each node and instance are kept as they hold the last known
+// state of the instances, unless the instance no longer exists.
+func (ds *sqliteDB) pruneStatistics(before time.Time) (int, error) {
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	tx, err := db.Begin()
+	ts := before.UTC().Format(sqliteTimeFormat)
+
+	tx, err := ds.db.Begin()
 	if err != nil {
-		return errors.Wrap(err, "error starting transaction for quota update")
+		return 0, errors.Wrap(err, "Error starting transaction for statistics pruning")
 	}
 
-	for i := range qds {
-		_, err = tx.Exec("REPLACE INTO quotas (tenant_id, name, value) VALUES (?, ?, ?)", tenantID, qds[i].Name, qds[i].Value)
+	queries := []string{
+		`DELETE FROM instance_statistics
+		 WHERE timestamp < ?
+		 AND (instance_id NOT IN (SELECT id FROM instances)
+		      OR id NOT IN (SELECT MAX(id) FROM instance_statistics GROUP BY instance_id))`,
+		`DELETE FROM node_statistics
+		 WHERE timestamp < ?
+		 AND id NOT IN (SELECT MAX(id) FROM node_statistics GROUP BY node_id)`,
+	}
+
+	pruned := 0
+	for _, q := range queries {
+		res, err := tx.Exec(q, ts)
 		if err != nil {
 			_ = tx.Rollback()
-			return errors.Wrap(err, "error executing query for quota update")
+			return 0, errors.Wrap(err, "Error pruning statistics from database")
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrap(err, "Error pruning statistics from database")
 		}
+		pruned += int(n)
 	}
 
 	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error pruning statistics from database")
+	}
 
-	return errors.Wrap(err, "error committing transaction for quotas update")
+	return pruned, nil
 }
 
-func (ds *sqliteDB) getQuotas(tenantID string) ([]types.QuotaDetails, error) {
-	query := `SELECT name, value from quotas WHERE tenant_id = ?`
+// legacyStatsTables are the tables older controllers kept in a separate
+// statistics database, in the order they are migrated.
+var legacyStatsTables = []string{
+	"log",
+	"node_statistics",
+	"instance_statistics",
+	"frame_statistics",
+	"trace_data",
+}
 
-	db := ds.getTableDB("quotas")
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
 
-	rows, err := db.Query(query, tenantID)
+// tableColumns returns the names of the columns of a table of the given
+// schema, or none if the table does not exist.
+func tableColumns(ctx context.Context, q sqlQueryer, schema string, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "PRAGMA "+schema+".table_info("+table+")")
 	if err != nil {
-		return nil, errors.Wrap(err, "error getting quotas from database")
+		return nil, err
 	}
 	defer func() { _ = rows.Close() }()
 
-	results := []types.QuotaDetails{}
+	var columns []string
 	for rows.Next() {
-		var name string
-		var value int
+		var cid int
+		var name, colType string
+		var notNull, pk int
+		var dflt sql.NullString
 
-		err = rows.Scan(&name, &value)
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
 		if err != nil {
-			return nil, errors.Wrap(err, "error reading quota row from database")
+			return nil, err
 		}
-
-		q := types.QuotaDetails{Name: name, Value: value}
-		results = append(results, q)
+		columns = append(columns, name)
 	}
 
-	return results, nil
+	return columns, rows.Err()
 }
 
-func (ds *sqliteDB) getImages() ([]types.Image, error) {
-	images := []types.Image{}
-
-	query := `SELECT id, state, tenant_id, name, createtime, size, visibility FROM images`
-
-	db := ds.getTableDB("images")
-	ds.dbLock.Lock()
-	defer ds.dbLock.Unlock()
+// copyLegacyTable copies the rows of a table of the attached legacy
+// database into the same table of the main database.  Only the columns
+// both tables have are copied.  Row IDs are allocated afresh unless an
+// expression computing them is given in exprs, which maps columns to the
+// expressions their values are copied from.
+func copyLegacyTable(ctx context.Context, tx *sql.Tx, table string, exprs map[string]string) (int, error) {
+	legacy, err := tableColumns(ctx, tx, "legacy", table)
+	if err != nil || len(legacy) == 0 {
+		return 0, err
+	}
 
-	rows, err := db.Query(query)
+	current, err := tableColumns(ctx, tx, "main", table)
 	if err != nil {
-		return images, errors.Wrap(err, "error getting images from database")
+		return 0, err
 	}
-	defer func() { _ = rows.Close() }()
 
-	for rows.Next() {
-		i := types.Image{}
-		var state, visibility string
+	known := make(map[string]bool)
+	for _, c := range current {
+		known[c] = true
+	}
 
-		err = rows.Scan(&i.ID, &state, &i.TenantID, &i.Name, &i.CreateTime, &i.Size, &visibility)
-		if err != nil {
-			return []types.Image{}, errors.Wrap(err, "error reading image row from database")
+	var columns, values []string
+	for _, c := range legacy {
+		expr, ok := exprs[c]
+		if !known[c] || (c == "id" && !ok) {
+			continue
 		}
 
-		i.State = types.ImageState(state)
-		i.Visibility = types.Visibility(visibility)
+		if !ok {
+			expr = c
+		}
 
-		images = append(images, i)
+		columns = append(columns, c)
+		values = append(values, expr)
 	}
 
-	return images, nil
+	if len(columns) == 0 {
+		return 0, nil
+	}
+
+	query := fmt.Sprintf("INSERT INTO main.%s (%s) SELECT %s FROM legacy.%s",
+		table, strings.Join(columns, ", "), strings.Join(values, ", "), table)
+	res, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Error copying legacy %s", table)
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
 }
 
-func (ds *sqliteDB) updateImage(i types.Image) error {
-	query := `REPLACE INTO images (id, state, tenant_id, name, createtime, size, visibility) VALUES (?, ?, ?, ?, ?, ?, ?)`
+// migrateLegacyStats imports the statistics, traces and event log of a
+// statistics database written by older controllers, which kept them apart
+// from the persistent database.  The import is a single transaction, after
+// which the legacy database is renamed so that it is only imported once.
+func (ds *sqliteDB) migrateLegacyStats(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "Unable to read legacy statistics database %s", path)
+	}
 
-	db := ds.getTableDB("images")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec(query, i.ID, i.State, i.TenantID, i.Name, i.CreateTime, i.Size, i.Visibility)
+	ctx := context.Background()
 
-	return errors.Wrap(err, "Error updatiing image into database")
+	// the legacy database is only attached to this connection
+	conn, err := ds.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Error getting database connection")
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS legacy", path)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to attach legacy statistics database %s", path)
+	}
+
+	migrated, err := ds.copyLegacyStats(ctx, conn)
+
+	_, detachErr := conn.ExecContext(ctx, "DETACH DATABASE legacy")
+	if err != nil {
+		return errors.Wrapf(err, "Unable to migrate legacy statistics database %s", path)
+	}
+	if detachErr != nil {
+		return errors.Wrapf(detachErr, "Unable to detach legacy statistics database %s", path)
+	}
+
+	err = os.Rename(path, path+".migrated")
+	if err != nil {
+		return errors.Wrapf(err, "Unable to rename legacy statistics database %s", path)
+	}
+
+	ds.log.Infof("Migrated %d rows from legacy statistics database %s", migrated, path)
+
+	return nil
 }
 
-func (ds *sqliteDB) deleteImage(ID string) error {
-	query := `DELETE FROM images WHERE id = ?`
+func (ds *sqliteDB) copyLegacyStats(ctx context.Context, conn *sql.Conn) (int, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
 
-	db := ds.getTableDB("images")
-	ds.dbLock.Lock()
-	defer ds.dbLock.Unlock()
+	// trace data refers to its frame by ID so the IDs of the imported
+	// frames are offset past those of the existing frames.
+	var frameOffset int64
+	err = tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(id), 0) FROM main.frame_statistics").Scan(&frameOffset)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
 
-	_, err := db.Exec(query, ID)
+	migrated := 0
+	for _, table := range legacyStatsTables {
+		var exprs map[string]string
+		switch table {
+		case "frame_statistics":
+			exprs = map[string]string{"id": fmt.Sprintf("id + %d", frameOffset)}
+		case "trace_data":
+			exprs = map[string]string{"frame_id": fmt.Sprintf("frame_id + %d", frameOffset)}
+		}
 
-	return errors.Wrap(err, "Error deleting image from database")
+		n, err := copyLegacyTable(ctx, tx, table, exprs)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		migrated += n
+	}
+
+	return migrated, tx.Commit()
 }
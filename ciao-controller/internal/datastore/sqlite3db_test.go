@@ -15,9 +15,15 @@
 package datastore
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,38 +33,52 @@ import (
 	"github.com/ciao-project/ciao/uuid"
 )
 
-var dbCount = 1
-
-func getPersistentStore() (persistentStore, error) {
-	ps := &sqliteDB{}
+// newTestStoreURI returns a sqliteDB for the database at uri with its own
+// workloads directory. The database is disconnected when the test completes.
+func newTestStoreURI(t *testing.T, uri string) *sqliteDB {
+	db := &sqliteDB{}
 	config := Config{
-		PersistentURI:     fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", dbCount),
-		InitWorkloadsPath: *workloadsPath,
+		PersistentURI:     uri,
+		InitWorkloadsPath: filepath.Join(t.TempDir(), "workloads"),
 	}
-	err := ps.init(config)
-	dbCount = dbCount + 2
-	return ps, err
-}
 
-func TestSQLiteDBGetWorkloadStorage(t *testing.T) {
-	db, err := getPersistentStore()
+	err := db.init(config)
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(db.disconnect)
 
-	_, err = db.getWorkloadStorage("validid")
-	if err != nil {
-		t.Fatal(err)
-	}
+	return db
+}
 
-	db.disconnect()
+// newTestStore returns a sqliteDB backed by an in-memory database private to
+// the test. The database is discarded when the test completes.
+func newTestStore(t *testing.T) *sqliteDB {
+	uri := fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.Generate())
+	return newTestStoreURI(t, uri)
 }
 
-func TestSQLiteDBGetTenantDevices(t *testing.T) {
-	db, err := getPersistentStore()
+// newTestFileStore returns a sqliteDB backed by a database file in a
+// temporary directory which is removed when the test completes.
+func newTestFileStore(t *testing.T) *sqliteDB {
+	return newTestStoreURI(t, "file:"+filepath.Join(t.TempDir(), "ciao-controller.db"))
+}
+
+func TestSQLiteDBGetWorkloadStorage(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	_, err := db.getWorkloadStorage("validid")
 	if err != nil {
 		t.Fatal(err)
 	}
+}
+
+func TestSQLiteDBGetTenantDevices(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
@@ -71,7 +91,7 @@ func TestSQLiteDBGetTenantDevices(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = db.addBlockData(data)
+	err := db.addBlockData(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,15 +106,12 @@ func TestSQLiteDBGetTenantDevices(t *testing.T) {
 	if !ok {
 		t.Fatal("device not in map")
 	}
-
-	db.disconnect()
 }
 
 func TestSQLiteDBGetTenantWithStorage(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	// add a tenant.
 	tenantID := uuid.Generate().String()
@@ -103,7 +120,7 @@ func TestSQLiteDBGetTenantWithStorage(t *testing.T) {
 		SubnetBits: 24,
 	}
 
-	err = db.addTenant(tenantID, config)
+	err := db.addTenant(tenantID, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,7 +136,7 @@ func TestSQLiteDBGetTenantWithStorage(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = db.addBlockData(data)
+	err = db.addBlockData(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,15 +155,12 @@ func TestSQLiteDBGetTenantWithStorage(t *testing.T) {
 	if d.ID != data.ID {
 		t.Fatal("device not correct")
 	}
-
-	db.disconnect()
 }
 
 func TestSQLiteDBGetAllBlockData(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
@@ -160,7 +174,7 @@ func TestSQLiteDBGetAllBlockData(t *testing.T) {
 		Internal:    true,
 	}
 
-	err = db.addBlockData(data)
+	err := db.addBlockData(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,16 +192,45 @@ func TestSQLiteDBGetAllBlockData(t *testing.T) {
 	if reflect.DeepEqual(devices[data.ID], data) {
 		t.Fatal("Retrieved block device does not match added")
 	}
-
-	db.disconnect()
 }
 
-func TestSQLiteDBDeleteBlockData(t *testing.T) {
-	db, err := getPersistentStore()
+func TestSQLiteDBUpdateBlockSize(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	data := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String(), Size: 1},
+		State:       types.Available,
+		TenantID:    uuid.Generate().String(),
+		CreateTime:  time.Now(),
+	}
+
+	err := db.addBlockData(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.updateBlockSize(context.Background(), data.ID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := db.getAllBlockData()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if devices[data.ID].Size != 4 {
+		t.Fatalf("Block device size not updated: %d", devices[data.ID].Size)
+	}
+}
+
+func TestSQLiteDBDeleteBlockData(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	blockDevice := storage.BlockDevice{
 		ID: uuid.Generate().String(),
 	}
@@ -199,12 +242,12 @@ func TestSQLiteDBDeleteBlockData(t *testing.T) {
 		CreateTime:  time.Now(),
 	}
 
-	err = db.addBlockData(data)
+	err := db.addBlockData(context.Background(), data)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = db.deleteBlockData(data.ID)
+	err = db.deleteBlockData(context.Background(), data.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -218,16 +261,43 @@ func TestSQLiteDBDeleteBlockData(t *testing.T) {
 	if ok {
 		t.Fatal("block devices not deleted")
 	}
-
-	db.disconnect()
 }
 
-func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
-	db, err := getPersistentStore()
+func TestSQLiteDBBlockDataCancelled(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	data := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+		State:       types.Available,
+		TenantID:    uuid.Generate().String(),
+		CreateTime:  time.Now(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := db.addBlockData(ctx, data)
+	if err != context.Canceled {
+		t.Fatalf("Expected %v got %v", context.Canceled, err)
+	}
+
+	devices, err := db.getAllBlockData()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if _, ok := devices[data.ID]; ok {
+		t.Fatal("block data added by cancelled request")
+	}
+}
+
+func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	a := types.StorageAttachment{
 		ID:         uuid.Generate().String(),
 		InstanceID: uuid.Generate().String(),
@@ -235,7 +305,7 @@ func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
 		Ephemeral:  false,
 	}
 
-	err = db.addStorageAttachment(a)
+	err := db.addStorageAttachment(context.Background(), a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -260,9 +330,16 @@ func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
 		InstanceID: uuid.Generate().String(),
 		BlockID:    uuid.Generate().String(),
 		Ephemeral:  true,
+		Tag:        "data",
+	}
+
+	err = db.addStorageAttachment(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = db.addStorageAttachment(b)
+	b.Device = "/dev/disk/by-id/virtio-data"
+	err = db.updateStorageAttachmentDevice(b.ID, b.Device)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -295,21 +372,19 @@ func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
 	if beta != b {
 		t.Fatal("Attachment from DB doesn't match original attachment")
 	}
-	db.disconnect()
 }
 
 func TestCreatePool(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
 	}
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -323,22 +398,19 @@ func TestCreatePool(t *testing.T) {
 	if !ok || (p.Name != "test") {
 		t.Fatal("pool not stored")
 	}
-
-	db.disconnect()
 }
 
 func TestUpdatePool(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
 	}
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -360,22 +432,19 @@ func TestUpdatePool(t *testing.T) {
 	if !ok || p.Free != 2 || p.TotalIPs != 10 {
 		t.Fatal("pool not updated")
 	}
-
-	db.disconnect()
 }
 
 func TestDeletePool(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
 	}
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -404,22 +473,76 @@ func TestDeletePool(t *testing.T) {
 	if ok {
 		t.Fatal("pool not deleted")
 	}
-
-	db.disconnect()
 }
 
-func TestCreateSubnet(t *testing.T) {
-	db, err := getPersistentStore()
+func TestPoolTenants(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err := db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Tenants = []string{"tenant1", "tenant2"}
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := db.getAllPools()[pool.ID]
+	if !ok || len(p.Tenants) != 2 {
+		t.Fatalf("pool tenants not stored: %+v", p)
+	}
+
+	pool.Tenants = nil
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if len(p.Tenants) != 0 {
+		t.Fatalf("pool tenants not removed: %+v", p.Tenants)
+	}
+
+	pool.Tenants = []string{"tenant1"}
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.deletePool(pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	tenants, err := db.getPoolTenants(pool.ID)
+	if err != nil || len(tenants) != 0 {
+		t.Fatalf("pool tenants not deleted: %v %v", tenants, err)
+	}
+}
+
+func TestCreateSubnet(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
 	}
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -454,15 +577,12 @@ func TestCreateSubnet(t *testing.T) {
 	if subs[0].CIDR != subnet.CIDR || subs[0].ID != subnet.ID {
 		t.Fatal("subnet not saved correctly")
 	}
-
-	db.disconnect()
 }
 
 func TestDeleteSubnet(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
@@ -476,7 +596,7 @@ func TestDeleteSubnet(t *testing.T) {
 
 	pool.Subnets = append(pool.Subnets, subnet)
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -501,15 +621,12 @@ func TestDeleteSubnet(t *testing.T) {
 	if len(subs) != 0 {
 		t.Fatal("subnet not deleted")
 	}
-
-	db.disconnect()
 }
 
 func TestCreateAddress(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
@@ -523,7 +640,7 @@ func TestCreateAddress(t *testing.T) {
 
 	pool.IPs = append(pool.IPs, IP)
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -542,15 +659,12 @@ func TestCreateAddress(t *testing.T) {
 	if len(addrs) != 1 || addrs[0].ID != IP.ID || addrs[0].Address != IP.Address {
 		t.Fatal("address not stored correctly")
 	}
-
-	db.disconnect()
 }
 
 func TestDeleteAddress(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
@@ -564,7 +678,7 @@ func TestDeleteAddress(t *testing.T) {
 
 	pool.IPs = append(pool.IPs, IP)
 
-	err = db.addPool(pool)
+	err := db.addPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -590,15 +704,12 @@ func TestDeleteAddress(t *testing.T) {
 	if len(addrs) != 0 {
 		t.Fatal("address not deleted")
 	}
-
-	db.disconnect()
 }
 
 func TestCreateMappedIP(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	i := types.Instance{
 		ID:         uuid.Generate().String(),
@@ -607,7 +718,7 @@ func TestCreateMappedIP(t *testing.T) {
 		IPAddress:  "172.16.0.2",
 	}
 
-	err = db.addInstance(&i)
+	err := db.addInstance(context.Background(), &i)
 	if err != nil {
 		t.Fatalf("unable to store instance: %v\n", err)
 	}
@@ -618,8 +729,10 @@ func TestCreateMappedIP(t *testing.T) {
 	}
 
 	pool := types.Pool{
-		ID:   uuid.Generate().String(),
-		Name: "test",
+		ID:       uuid.Generate().String(),
+		Name:     "test",
+		Free:     2,
+		TotalIPs: 2,
 	}
 
 	err = db.addPool(pool)
@@ -637,7 +750,7 @@ func TestCreateMappedIP(t *testing.T) {
 		PoolName:   pool.Name,
 	}
 
-	err = db.addMappedIP(m)
+	err = db.addMappedIP(m, pool.Free-1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -650,14 +763,51 @@ func TestCreateMappedIP(t *testing.T) {
 	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
 		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
 	}
+
+	// the free addresses of the pool are updated with the mapping
+	if free := db.getAllPools()[pool.ID].Free; free != pool.Free-1 {
+		t.Fatalf("expected %d free addresses, got %d", pool.Free-1, free)
+	}
 }
 
-func TestDeleteMappedIP(t *testing.T) {
-	db, err := getPersistentStore()
+func TestSQLiteDBUpdateInstanceName(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+		Name:       "web",
+	}
+
+	err := db.addInstance(context.Background(), &i)
+	if err != nil {
+		t.Fatalf("unable to store instance: %v\n", err)
+	}
+
+	err = db.updateInstanceName(i.ID, "frontend")
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
+		t.Fatal(err)
+	}
+
+	if instances[0].Name != "frontend" {
+		t.Fatalf("Expected name frontend, got %s", instances[0].Name)
+	}
+}
+
+func TestDeleteMappedIP(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	i := types.Instance{
 		ID:         uuid.Generate().String(),
 		TenantID:   uuid.Generate().String(),
@@ -665,7 +815,7 @@ func TestDeleteMappedIP(t *testing.T) {
 		IPAddress:  "172.16.0.2",
 	}
 
-	err = db.addInstance(&i)
+	err := db.addInstance(context.Background(), &i)
 	if err != nil {
 		t.Fatalf("unable to store instance: %v\n", err)
 	}
@@ -695,7 +845,7 @@ func TestDeleteMappedIP(t *testing.T) {
 		PoolName:   pool.Name,
 	}
 
-	err = db.addMappedIP(m)
+	err = db.addMappedIP(m, pool.Free)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -751,10 +901,9 @@ func createTestTenant(db persistentStore, t *testing.T) *tenant {
 }
 
 func TestSQLiteDBTestTenants(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tns, err := db.getTenants()
 	if err != nil {
@@ -788,11 +937,37 @@ func TestSQLiteDBTestTenants(t *testing.T) {
 	}
 }
 
-func TestSQLiteDBGetBatchFrameStatistics(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
+func createTestFrameTraces(label string) []payloads.FrameTrace {
+	var nodes []payloads.SSNTPNode
+	for i := 0; i < 3; i++ {
+		node := payloads.SSNTPNode{
+			SSNTPUUID:   uuid.Generate().String(),
+			SSNTPRole:   "test",
+			TxTimestamp: time.Now().Format(time.RFC3339Nano),
+			RxTimestamp: time.Now().Format(time.RFC3339Nano),
+		}
+		nodes = append(nodes, node)
+	}
+
+	var frames []payloads.FrameTrace
+	for i := 0; i < 3; i++ {
+		stat := payloads.FrameTrace{
+			Label:          label,
+			Type:           "type",
+			Operand:        "operand",
+			StartTimestamp: time.Now().Format(time.RFC3339Nano),
+			EndTimestamp:   time.Now().Format(time.RFC3339Nano),
+			Nodes:          nodes,
+		}
+		frames = append(frames, stat)
 	}
+	return frames
+}
+
+func TestSQLiteDBGetBatchFrameStatistics(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	frames := createTestFrameTraces("batch_frame_test")
 	for _, frame := range frames {
@@ -802,17 +977,16 @@ func TestSQLiteDBGetBatchFrameStatistics(t *testing.T) {
 		}
 	}
 
-	_, err = db.getBatchFrameStatistics("batch_frame_test")
+	_, err := db.getBatchFrameStatistics("batch_frame_test")
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestSQLiteDBGetBatchFrameSummary(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	frames := createTestFrameTraces("batch_summary_test")
 	for _, frame := range frames {
@@ -822,17 +996,16 @@ func TestSQLiteDBGetBatchFrameSummary(t *testing.T) {
 		}
 	}
 
-	_, err = db.getBatchFrameSummary()
+	_, err := db.getBatchFrameSummary()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestSQLiteDBEventLog(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	log, err := db.getEventLog()
 	if err != nil {
@@ -892,61 +1065,223 @@ func TestSQLiteDBEventLog(t *testing.T) {
 	}
 }
 
-func TestSQLiteDBInstanceStats(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestSQLiteDBLogEvents(t *testing.T) {
+	t.Parallel()
 
-	var stats []payloads.InstanceStat
+	db := newTestStore(t)
 
-	for i := 0; i < 3; i++ {
-		stat := payloads.InstanceStat{
-			InstanceUUID:  uuid.Generate().String(),
-			State:         payloads.ComputeStatusRunning,
-			SSHIP:         "192.168.0.1",
-			SSHPort:       34567,
-			MemoryUsageMB: 0,
-			DiskUsageMB:   0,
-			CPUUsage:      0,
+	queued := time.Now().Add(-time.Hour)
+	events := make([]types.LogEntry, 100)
+	for i := range events {
+		events[i] = types.LogEntry{
+			TenantID:  "tenant",
+			EventType: string(userInfo),
+			Message:   fmt.Sprintf("%d", i),
+			Timestamp: queued,
 		}
-		stats = append(stats, stat)
 	}
 
-	nodeID := uuid.Generate().String()
-
-	err = db.addInstanceStats(stats, nodeID)
+	err := db.logEvents(events)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestSQLiteDBUpdateDeleteWorkload(t *testing.T) {
-	db, err := getPersistentStore()
+	log, err := db.getEventsForTenant("tenant", types.EventFilter{End: queued.Add(time.Second)})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tn := createTestTenant(db, t)
+	if len(log) != len(events) {
+		t.Fatalf("Expected %d events got %d", len(events), len(log))
+	}
 
-	testConfig := `
----
-#cloud-config
-users:
-  - name: demouser
-    gecos: CIAO Demo User
-    lock-passwd: false
-    passwd: $6$rounds=4096$w9I3hR4g/hu$AnYjaC2DfznbPSG3vxsgtgAS4mJwWBkcR74Y/KHNB5OsfAlA4gpU5j6CHWMOkkt9j.9d7OYJXJ4icXHzKXTAO.
-    sudo: ALL=(ALL) NOPASSWD:ALL
+	for i, e := range log {
+		if e.Message != events[i].Message {
+			t.Fatalf("Expected event %s got %s", events[i].Message, e.Message)
+		}
+
+		if e.ID != events[i].ID {
+			t.Fatalf("Expected event %s to be given ID %d got %d", e.Message, e.ID, events[i].ID)
+		}
+
+		if !e.Timestamp.Equal(queued.Truncate(time.Second)) {
+			t.Fatalf("Expected time %v got %v", queued, e.Timestamp)
+		}
+	}
+}
+
+func TestSQLiteDBEventsForTenant(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantA := uuid.Generate().String()
+	tenantB := uuid.Generate().String()
+	instanceA := uuid.Generate().String()
+	instanceB := uuid.Generate().String()
+
+	entries := []types.LogEntry{
+		{TenantID: tenantA, EventType: string(userInfo), ObjectID: instanceA, Message: "a1"},
+		{TenantID: tenantB, EventType: string(userInfo), ObjectID: instanceB, Message: "b1"},
+		{TenantID: tenantA, EventType: string(userAction), ObjectID: instanceA, Actor: "alice", OnBehalfOf: tenantA, Message: "a2"},
+		{TenantID: tenantB, EventType: string(userAction), ObjectID: instanceA, Actor: "bob", Message: "b2"},
+		{TenantID: tenantA, EventType: string(userError), Message: "a3"},
+	}
+	for _, e := range entries {
+		err := db.logEvent(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := func(tenantID string, filter types.EventFilter) string {
+		log, err := db.getEventsForTenant(tenantID, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var m []string
+		for _, e := range log {
+			m = append(m, e.Message)
+		}
+		return strings.Join(m, ",")
+	}
+
+	all, err := db.getEventsForTenant(tenantA, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[1].Actor != "alice" || all[1].ObjectID != instanceA || all[1].OnBehalfOf != tenantA {
+		t.Fatalf("Unexpected events for tenant: %+v", all)
+	}
+
+	tests := []struct {
+		name     string
+		tenantID string
+		filter   types.EventFilter
+		expected string
+	}{
+		{"all tenants", "", types.EventFilter{}, "a1,b1,a2,b2,a3"},
+		{"tenant", tenantB, types.EventFilter{}, "b1,b2"},
+		{"type", tenantA, types.EventFilter{Type: string(userAction)}, "a2"},
+		{"object", tenantA, types.EventFilter{ObjectID: instanceA}, "a1,a2"},
+		{"object of other tenant", tenantA, types.EventFilter{ObjectID: instanceB}, ""},
+		{"shared object", tenantB, types.EventFilter{ObjectID: instanceA}, "b2"},
+		{"limit", tenantA, types.EventFilter{Limit: 2}, "a1,a2"},
+		{"marker", tenantA, types.EventFilter{Marker: all[0].ID, Limit: 1}, "a2"},
+		{"marker of other tenant", tenantA, types.EventFilter{Marker: all[2].ID}, ""},
+		{"start", tenantA, types.EventFilter{Start: time.Now().Add(time.Hour)}, ""},
+		{"end", tenantA, types.EventFilter{End: time.Now().Add(-time.Hour)}, ""},
+		{"range", tenantA, types.EventFilter{
+			Start: time.Now().Add(-time.Hour),
+			End:   time.Now().Add(time.Hour),
+		}, "a1,a2,a3"},
+	}
+
+	for _, tt := range tests {
+		if m := messages(tt.tenantID, tt.filter); m != tt.expected {
+			t.Errorf("%s: expected %q got %q", tt.name, tt.expected, m)
+		}
+	}
+}
+
+func TestSQLiteDBLogMigration(t *testing.T) {
+	t.Parallel()
+
+	uri := "file:" + filepath.Join(t.TempDir(), "ciao-controller.db")
+
+	old, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = old.Exec(`CREATE TABLE log
+		(
+		id integer primary key,
+		tenant_id varchar(32),
+		node_id varchar(32),
+		type string,
+		message string,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+		);
+		INSERT INTO log (tenant_id, node_id, type, message) VALUES ('tenant', 'node', 'info', 'old');`)
+	_ = old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newTestStoreURI(t, uri)
+
+	err = db.logEvent(types.LogEntry{TenantID: "tenant", EventType: "action", Actor: "admin", OnBehalfOf: "tenant", Message: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := db.getEventsForTenant("tenant", types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log) != 2 || log[0].Actor != "" || log[1].Actor != "admin" || log[1].OnBehalfOf != "tenant" {
+		t.Fatalf("Unexpected events after migration: %+v", log)
+	}
+}
+
+func TestSQLiteDBInstanceStats(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	var stats []payloads.InstanceStat
+
+	for i := 0; i < 3; i++ {
+		stat := payloads.InstanceStat{
+			InstanceUUID:  uuid.Generate().String(),
+			State:         payloads.ComputeStatusRunning,
+			SSHIP:         "192.168.0.1",
+			SSHPort:       34567,
+			MemoryUsageMB: 0,
+			DiskUsageMB:   0,
+			CPUUsage:      0,
+		}
+		stats = append(stats, stat)
+	}
+
+	nodeID := uuid.Generate().String()
+
+	err := db.addInstanceStats(stats, nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteDBUpdateDeleteWorkload(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tn := createTestTenant(db, t)
+
+	testConfig := `
+---
+#cloud-config
+users:
+  - name: demouser
+    gecos: CIAO Demo User
+    lock-passwd: false
+    passwd: $6$rounds=4096$w9I3hR4g/hu$AnYjaC2DfznbPSG3vxsgtgAS4mJwWBkcR74Y/KHNB5OsfAlA4gpU5j6CHWMOkkt9j.9d7OYJXJ4icXHzKXTAO.
+    sudo: ALL=(ALL) NOPASSWD:ALL
     ssh-authorized-keys:
     - ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDerQfD+qkb0V0XdQs8SBWqy4sQmqYFP96n/kI4Cq162w4UE8pTxy0ozAPldOvBJjljMvgaNKSAddknkhGcrNUvvJsUcZFm2qkafi32WyBdGFvIc45A+8O7vsxPXgHEsS9E3ylEALXAC3D0eX7pPtRiAbasLlY+VcACRqr3bPDSZTfpCmIkV2334uZD9iwOvTVeR+FjGDqsfju4DyzoAIqpPasE0+wk4Vbog7osP+qvn1gj5kQyusmr62+t0wx+bs2dF5QemksnFOswUrv9PGLhZgSMmDQrRYuvEfIAC7IdN/hfjTn0OokzljBiuWQ4WIIba/7xTYLVujJV65qH3heaSMxJJD7eH9QZs9RdbbdTXMFuJFsHV2OF6wZRp18tTNZZJMqiHZZSndC5WP1WrUo3Au/9a+ighSaOiVddHsPG07C/TOEnr3IrwU7c9yIHeeRFHmcQs9K0+n9XtrmrQxDQ9/mLkfje80Ko25VJ/QpAQPzCKh2KfQ4RD+/PxBUScx/lHIHOIhTSCh57ic629zWgk0coSQDi4MKSa5guDr3cuDvt4RihGviDM6V68ewsl0gh6Z9c0Hw7hU0vky4oxak5AiySiPz0FtsOnAzIL0UON+yMuKzrJgLjTKodwLQ0wlBXu43cD+P8VXwQYeqNSzfrhBnHqsrMf4lTLtc7kDDTcw== ciao@ciao
 ...
 	`
 
+	bootIndex := 0
 	storage := types.StorageResource{
 		ID:        "",
 		Ephemeral: false,
 		Size:      20,
+		BootIndex: &bootIndex,
 	}
 
 	wl := types.Workload{
@@ -961,14 +1296,27 @@ users:
 			VCPUs: 2,
 			MemMB: 512,
 		},
-		Storage: []types.StorageResource{storage},
+		Storage: []types.StorageResource{
+			storage,
+			{
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.Empty,
+				Local:      true,
+			},
+		},
+		Bounds: &types.WorkloadBounds{
+			MaxVCPUs: 4,
+			MinMemMB: 256,
+			MaxMemMB: 1024,
+		},
+		Networks: []types.NetworkRequirement{
+			{Subnet: "172.16.1.0/24"},
+			{},
+		},
 	}
 
-	// file will be added, so we will want to remove it.
-	filename := fmt.Sprintf("%s/%s_config.yaml", *workloadsPath, wl.ID)
-	defer func() { _ = os.Remove(filename) }()
-
-	err = db.addWorkload(wl)
+	err := db.addWorkload(wl)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -992,6 +1340,32 @@ users:
 		t.Fatal("Expected workload equality")
 	}
 
+	// update the config and description in place
+	wl.Description = "updatedWorkload"
+	wl.Config = testConfig + "\n# updated\n"
+	err = db.updateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workloads, err = db.getWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(workloads) != 1 || !reflect.DeepEqual(wl, workloads[0]) {
+		t.Fatalf("Expected updated workload %v, got %v", wl, workloads)
+	}
+
+	tmpFiles, err := filepath.Glob(filepath.Join(db.workloadsPath, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tmpFiles) != 0 {
+		t.Fatalf("Temporary config files left behind: %v", tmpFiles)
+	}
+
 	// now try to delete the workload
 	err = db.deleteWorkload(wl.ID)
 	if err != nil {
@@ -1006,8 +1380,112 @@ users:
 	if len(workloads) != 0 {
 		t.Fatal("Expected no workloads")
 	}
+}
 
-	db.disconnect()
+func TestSQLiteDBWorkloadVisibility(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tn := createTestTenant(db, t)
+
+	workloads := map[types.Visibility]types.Workload{}
+	for _, v := range []types.Visibility{types.Public, types.Private, types.Internal} {
+		wl := types.Workload{
+			ID:          uuid.Generate().String(),
+			TenantID:    tn.ID,
+			Description: string(v),
+			VMType:      payloads.Docker,
+			ImageName:   "ubuntu:latest",
+			Config:      "---\n...\n",
+			Visibility:  v,
+			Storage:     []types.StorageResource{},
+		}
+
+		err := db.addWorkload(wl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workloads[v] = wl
+	}
+
+	// internal workloads are never loaded
+	wls, err := db.getWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wls) != 2 {
+		t.Fatalf("Expected public and private workloads only: %+v", wls)
+	}
+	for _, wl := range wls {
+		if wl.Visibility == types.Internal {
+			t.Fatalf("Internal workload loaded: %+v", wl)
+		}
+	}
+
+	private := workloads[types.Private]
+	private.Description = "updated"
+	private.Config = "---\nupdated\n...\n"
+	private.Storage = []types.StorageResource{{Ephemeral: true, Size: 10, SourceType: types.Empty}}
+
+	err = db.updateWorkload(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err = db.getWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wl := range wls {
+		if wl.ID == private.ID && !reflect.DeepEqual(wl, private) {
+			t.Fatalf("Workload not updated: expected %+v got %+v", private, wl)
+		}
+	}
+}
+
+func TestSQLiteDBWorkloadMissingConfig(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tn := createTestTenant(db, t)
+
+	var IDs []string
+	for i := 0; i < 2; i++ {
+		wl := types.Workload{
+			ID:          uuid.Generate().String(),
+			TenantID:    tn.ID,
+			Description: "config",
+			VMType:      payloads.Docker,
+			ImageName:   "ubuntu:latest",
+			Config:      "---\n...\n",
+			Visibility:  types.Private,
+			Storage:     []types.StorageResource{},
+		}
+
+		err := db.addWorkload(wl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		IDs = append(IDs, wl.ID)
+	}
+
+	err := os.Remove(filepath.Join(db.workloadsPath, IDs[0]+"_config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a workload whose config cannot be read is skipped
+	wls, err := db.getWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) != 1 || wls[0].ID != IDs[1] {
+		t.Fatalf("Expected only workload %s, got %+v", IDs[1], wls)
+	}
 }
 
 func findQuota(qds []types.QuotaDetails, name string, value int) bool {
@@ -1021,10 +1499,9 @@ func findQuota(qds []types.QuotaDetails, name string, value int) bool {
 }
 
 func TestSQLiteDBAddQuotas(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	qds, err := db.getQuotas("test-tenand-id")
 	if err != nil {
@@ -1069,10 +1546,9 @@ func TestSQLiteDBAddQuotas(t *testing.T) {
 }
 
 func TestSQLiteDBUpdateQuotas(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	qds, err := db.getQuotas("test-tenand-id")
 	if err != nil {
@@ -1116,13 +1592,58 @@ func TestSQLiteDBUpdateQuotas(t *testing.T) {
 	}
 }
 
-func TestInstanceNameConstraint(t *testing.T) {
-	t.Skip("Name constraint not currently enforced #1365")
-	db, err := getPersistentStore()
+func TestSQLiteDBAddTenantWithQuotas(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	config := types.TenantConfig{
+		Name:       "quotas",
+		SubnetBits: 24,
+	}
+
+	err := db.addTenant(tenantID, config,
+		types.QuotaDetails{Name: "tenant-instances-quota", Value: 10},
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qds, err := db.getQuotas(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(qds) != 2 || !findQuota(qds, "tenant-instances-quota", 10) ||
+		!findQuota(qds, "tenant-vcpu-quota", 20) {
+		t.Fatalf("Expected tenant quotas got %v", qds)
+	}
+
+	// a failed creation must not leave its quotas behind
+	err = db.addTenant(tenantID, config,
+		types.QuotaDetails{Name: "tenant-instances-quota", Value: 1},
+		types.QuotaDetails{Name: "tenant-mem-quota", Value: 1})
+	if err == nil {
+		t.Fatal("Expected duplicate tenant to fail")
+	}
+
+	qds, err = db.getQuotas(tenantID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if len(qds) != 2 || !findQuota(qds, "tenant-instances-quota", 10) {
+		t.Fatalf("Expected quotas to be unchanged got %v", qds)
+	}
+}
+
+func TestInstanceNameConstraint(t *testing.T) {
+	t.Skip("Name constraint not currently enforced #1365")
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	tenantID := uuid.Generate().String()
 	i := types.Instance{
 		ID:         uuid.Generate().String(),
@@ -1132,7 +1653,7 @@ func TestInstanceNameConstraint(t *testing.T) {
 		Name:       "test",
 	}
 
-	err = db.addInstance(&i)
+	err := db.addInstance(context.Background(), &i)
 	if err != nil {
 		t.Fatalf("unable to store instance %v\n", err)
 	}
@@ -1145,7 +1666,7 @@ func TestInstanceNameConstraint(t *testing.T) {
 		Name:       "test",
 	}
 
-	err = db.addInstance(&i2)
+	err = db.addInstance(context.Background(), &i2)
 
 	if err == nil {
 		t.Fatal("Expected instance add to fail (duplicate name)")
@@ -1153,10 +1674,9 @@ func TestInstanceNameConstraint(t *testing.T) {
 }
 
 func TestAddCNCIInstance(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tenantID := uuid.Generate().String()
 	i := types.Instance{
@@ -1168,7 +1688,7 @@ func TestAddCNCIInstance(t *testing.T) {
 		CNCI:       true,
 	}
 
-	err = db.addInstance(&i)
+	err := db.addInstance(context.Background(), &i)
 	if err != nil {
 		t.Fatalf("unable to store instance %v\n", err)
 	}
@@ -1181,67 +1701,393 @@ func TestAddCNCIInstance(t *testing.T) {
 	if instances[0].CNCI != true {
 		t.Fatal("CNCI Instance not properly stored")
 	}
-
-	db.disconnect()
 }
 
-func TestSQLiteDBUpdateTenant(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestSQLiteDBInstanceResources(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tenantID := uuid.Generate().String()
-	config := types.TenantConfig{
-		Name:       "name1",
-		SubnetBits: 24,
+	i := types.Instance{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		WorkloadID:  uuid.Generate().String(),
+		IPAddress:   "172.16.0.2",
+		Name:        "test",
+		VCPUs:       4,
+		MemMB:       2048,
+		EphemeralGB: 30,
 	}
 
-	err = db.addTenant(tenantID, config)
+	err := db.addInstance(context.Background(), &i)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("unable to store instance %v\n", err)
 	}
 
-	tenant, err := db.getTenant(tenantID)
-	if err != nil {
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
 		t.Fatal(err)
 	}
 
-	tenant.Name = "name2"
-	tenant.SubnetBits = 20
-	tenant.Permissions.PrivilegedContainers = true
+	if instances[0].VCPUs != 4 || instances[0].MemMB != 2048 || instances[0].EphemeralGB != 30 {
+		t.Fatalf("Instance resources not properly stored: %v", instances[0])
+	}
 
-	err = db.updateTenant(&tenant.Tenant)
+	err = db.updateInstanceRequirements(i.ID, 8, 4096)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("unable to update instance requirements %v\n", err)
 	}
 
-	tenant, err = db.getTenant(tenantID)
-	if err != nil {
+	instances, err = db.getInstances()
+	if err != nil || len(instances) != 1 {
 		t.Fatal(err)
 	}
 
-	if tenant.Name != "name2" || tenant.SubnetBits != 20 || tenant.Permissions.PrivilegedContainers != true {
-		t.Fatal("update not successful")
+	if instances[0].VCPUs != 8 || instances[0].MemMB != 4096 || instances[0].EphemeralGB != 30 {
+		t.Fatalf("Instance requirements not properly updated: %v", instances[0])
 	}
-
-	db.disconnect()
 }
 
-func TestSQLiteDBTenantPermissions(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestSQLiteDBInstanceNICs(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tenantID := uuid.Generate().String()
-	config := types.TenantConfig{
-		Name:       "name1",
-		SubnetBits: 24,
+	nics := []types.NIC{
+		{
+			VnicUUID:   uuid.Generate().String(),
+			MACAddress: "02:00:ac:10:00:0a",
+			Subnet:     "172.16.0.8/29",
+			IPAddress:  "172.16.0.10",
+		},
+	}
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+		Name:       "test",
+		NICs:       nics,
 	}
-	config.Permissions.PrivilegedContainers = true
 
-	err = db.addTenant(tenantID, config)
+	err := db.addInstance(context.Background(), &i)
+	if err != nil {
+		t.Fatalf("unable to store instance %v\n", err)
+	}
+
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(instances[0].NICs, nics) {
+		t.Fatalf("expected NICs %v, got %v", nics, instances[0].NICs)
+	}
+
+	tenantInstances, err := db.getTenantInstances(tenantID)
+	if err != nil || len(tenantInstances) != 1 {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tenantInstances[i.ID].NICs, nics) {
+		t.Fatalf("expected NICs %v, got %v", nics, tenantInstances[i.ID].NICs)
+	}
+}
+
+func TestSQLiteDBInstancePlacements(t *testing.T) {
+	t.Parallel()
+
+	uri := "file:" + filepath.Join(t.TempDir(), "ciao-controller.db")
+	db := newTestStoreURI(t, uri)
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+		Name:       "test",
+	}
+
+	err := db.addInstance(context.Background(), &i)
+	if err != nil {
+		t.Fatalf("unable to store instance %v\n", err)
+	}
+
+	node1 := uuid.Generate().String()
+	node2 := uuid.Generate().String()
+	placements := []types.Placement{
+		{NodeID: node1, Timestamp: time.Now().UTC(), Reason: types.PlacementInitial},
+		{NodeID: node2, Timestamp: time.Now().UTC(), Reason: types.PlacementReschedule},
+	}
+
+	for _, p := range placements {
+		err = db.addPlacement(i.ID, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restarted controller must find the node and history again, the
+	// driver is registered per URI so the database is reopened read-write
+	// under a different one
+	db.disconnect()
+	db = newTestStoreURI(t, uri+"?mode=rw")
+
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
+		t.Fatal(err)
+	}
+
+	if instances[0].NodeID != node2 {
+		t.Errorf("Expected instance on %s, got %s", node2, instances[0].NodeID)
+	}
+
+	stored, err := db.getPlacements(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != len(placements) {
+		t.Fatalf("Expected %d placements, got %+v", len(placements), stored)
+	}
+
+	for n := range placements {
+		if stored[n].NodeID != placements[n].NodeID || stored[n].Reason != placements[n].Reason {
+			t.Errorf("Expected placement %+v, got %+v", placements[n], stored[n])
+		}
+	}
+
+	err = db.updateInstanceNode(i.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.deleteInstance(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = db.getPlacements(i.ID)
+	if err != nil || len(stored) != 0 {
+		t.Errorf("Placements not deleted with instance: %+v %v", stored, err)
+	}
+}
+
+func TestSQLiteDBInstanceHistory(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	instanceID := uuid.Generate().String()
+	tenantID := uuid.Generate().String()
+	now := time.Now().UTC()
+	entries := []types.InstanceHistoryEntry{
+		{Timestamp: now, Type: types.HistoryCreated, Message: "Created", Actor: "admin"},
+		{Timestamp: now, Type: types.HistoryPlacement, Message: "Placed", NodeID: "node"},
+		{Timestamp: now.Add(time.Second), Type: types.HistoryCommand, Message: "delete"},
+	}
+
+	for _, e := range entries {
+		err := db.addHistoryEntry(instanceID, tenantID, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting the instance leaves its history alone
+	err := db.deleteInstance(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, stored, err := db.getHistory(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner != tenantID || len(stored) != len(entries) {
+		t.Fatalf("Expected %d entries of %s, got %s %+v", len(entries), tenantID, owner, stored)
+	}
+
+	for n := range entries {
+		if !stored[n].Timestamp.Equal(entries[n].Timestamp) || stored[n].Type != entries[n].Type ||
+			stored[n].Message != entries[n].Message || stored[n].NodeID != entries[n].NodeID ||
+			stored[n].Actor != entries[n].Actor {
+			t.Errorf("Expected entry %+v, got %+v", entries[n], stored[n])
+		}
+	}
+
+	last, err := db.getLastHistoryEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o, ok := last[instanceID]; !ok || o.tenantID != tenantID || !o.timestamp.Equal(entries[2].Timestamp) {
+		t.Errorf("Unexpected last entry: %+v", last)
+	}
+
+	err = db.deleteHistory(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stored, err = db.getHistory(instanceID)
+	if err != nil || len(stored) != 0 {
+		t.Errorf("History not deleted: %+v %v", stored, err)
+	}
+}
+
+func TestSQLiteDBInstanceConditions(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	instanceID := uuid.Generate().String()
+	conditions := []types.InstanceCondition{
+		{Type: payloads.SoftwareVirtualization, Message: "KVM unavailable", Timestamp: time.Now().UTC()},
+		{Type: payloads.NoHugepages, Message: "Using regular pages", Timestamp: time.Now().UTC()},
+	}
+
+	err := db.updateInstanceConditions(instanceID, conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.getInstanceConditions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored[instanceID]) != len(conditions) {
+		t.Fatalf("Expected %d conditions, got %+v", len(conditions), stored)
+	}
+
+	for n := range conditions {
+		if stored[instanceID][n].Type != conditions[n].Type ||
+			stored[instanceID][n].Message != conditions[n].Message ||
+			!stored[instanceID][n].Timestamp.Equal(conditions[n].Timestamp) {
+			t.Errorf("Expected condition %+v, got %+v", conditions[n], stored[instanceID][n])
+		}
+	}
+
+	err = db.updateInstanceConditions(instanceID, conditions[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = db.getInstanceConditions()
+	if err != nil || len(stored[instanceID]) != 1 {
+		t.Fatalf("Conditions not replaced: %+v %v", stored, err)
+	}
+
+	err = db.deleteInstance(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = db.getInstanceConditions()
+	if err != nil || len(stored[instanceID]) != 0 {
+		t.Errorf("Conditions not deleted with instance: %+v %v", stored, err)
+	}
+}
+
+func TestSQLiteDBUpdateTenant(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	config := types.TenantConfig{
+		Name:       "name1",
+		SubnetBits: 24,
+	}
+
+	err := db.addTenant(tenantID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := db.getTenant(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant.Name = "name2"
+	tenant.SubnetBits = 20
+	tenant.Permissions.PrivilegedContainers = true
+	tenant.Frozen = true
+	tenant.FreezeReason = "migration"
+	tenant.PreprovisionNetwork = true
+	tenant.TrashRetentionMinutes = 90
+	tenant.MaxSubnets = 3
+	tenant.CNCISize = &types.CNCISize{VCPUs: 8, DiskMB: 4096}
+
+	err = db.updateTenant(&tenant.Tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err = db.getTenant(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tenant.Name != "name2" || tenant.SubnetBits != 20 || tenant.Permissions.PrivilegedContainers != true {
+		t.Fatal("update not successful")
+	}
+
+	if !tenant.Frozen || tenant.FreezeReason != "migration" {
+		t.Fatal("freeze state not updated")
+	}
+
+	if !tenant.PreprovisionNetwork {
+		t.Fatal("network pre-provisioning not updated")
+	}
+
+	if tenant.TrashRetentionMinutes != 90 {
+		t.Fatal("trash retention not updated")
+	}
+
+	if tenant.MaxSubnets != 3 {
+		t.Fatal("max subnets not updated")
+	}
+
+	if tenant.CNCISize == nil || *tenant.CNCISize != (types.CNCISize{VCPUs: 8, DiskMB: 4096}) {
+		t.Fatalf("CNCI size not updated: %+v", tenant.CNCISize)
+	}
+
+	tenant.CNCISize = nil
+
+	err = db.updateTenant(&tenant.Tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err = db.getTenant(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tenant.CNCISize != nil {
+		t.Fatalf("CNCI size not cleared: %+v", tenant.CNCISize)
+	}
+}
+
+func TestSQLiteDBTenantPermissions(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	config := types.TenantConfig{
+		Name:       "name1",
+		SubnetBits: 24,
+	}
+	config.Permissions.PrivilegedContainers = true
+
+	err := db.addTenant(tenantID, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1272,15 +2118,12 @@ func TestSQLiteDBTenantPermissions(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	db.disconnect()
 }
 
 func TestSQLiteDBDeleteTenant(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tenantID := uuid.Generate().String()
 	config := types.TenantConfig{
@@ -1288,7 +2131,7 @@ func TestSQLiteDBDeleteTenant(t *testing.T) {
 		SubnetBits: 24,
 	}
 
-	err = db.addTenant(tenantID, config)
+	err := db.addTenant(tenantID, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1298,6 +2141,29 @@ func TestSQLiteDBDeleteTenant(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	now := time.Now().UTC()
+	err = db.addReleasedUsage(types.UsageSpan{
+		TenantID: tenantID,
+		ID:       uuid.Generate().String(),
+		Resource: types.UsageInstance,
+		Start:    now.Add(-time.Hour),
+		End:      now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.addUsageRecords([]types.UsageRecord{{
+		TenantID:      tenantID,
+		Granularity:   types.UsageHourly,
+		Start:         now.Add(-time.Hour),
+		End:           now,
+		InstanceHours: 1,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	err = db.deleteTenant(tenantID)
 	if err != nil {
 		t.Fatal(err)
@@ -1311,20 +2177,48 @@ func TestSQLiteDBDeleteTenant(t *testing.T) {
 	if tenant != nil {
 		t.Fatal("Tenant Delete not successful")
 	}
-}
 
-func TestSQLiteDBAddRemoveImages(t *testing.T) {
-	db, err := getPersistentStore()
+	quotas, err := db.getQuotas(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(quotas) != 0 {
+		t.Fatalf("Expected quotas of tenant to be deleted, found %d", len(quotas))
+	}
+
+	spans, err := db.getReleasedUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range spans {
+		if s.TenantID == tenantID {
+			t.Fatal("Expected released usage of tenant to be deleted")
+		}
+	}
+
+	records, err := db.getUsageRecords(types.UsageFilter{TenantID: tenantID, Granularity: types.UsageHourly})
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if len(records) != 0 {
+		t.Fatalf("Expected usage records of tenant to be deleted, found %d", len(records))
+	}
+}
+
+func TestSQLiteDBAddRemoveImages(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
 	tenantID := uuid.Generate().String()
 	config := types.TenantConfig{
 		Name: "name1",
 	}
 
-	err = db.addTenant(tenantID, config)
+	err := db.addTenant(tenantID, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1345,6 +2239,7 @@ func TestSQLiteDBAddRemoveImages(t *testing.T) {
 		Name:       "test-image",
 		Size:       1234567,
 		Visibility: types.Public,
+		Checksum:   "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c",
 	}
 
 	err = db.updateImage(i)
@@ -1404,17 +2299,16 @@ func TestSQLiteDBAddRemoveImages(t *testing.T) {
 }
 
 func TestSQLiteDBUpdateImage(t *testing.T) {
-	db, err := getPersistentStore()
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Parallel()
+
+	db := newTestStore(t)
 
 	tenantID := uuid.Generate().String()
 	config := types.TenantConfig{
 		Name: "name1",
 	}
 
-	err = db.addTenant(tenantID, config)
+	err := db.addTenant(tenantID, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1475,3 +2369,2538 @@ func TestSQLiteDBUpdateImage(t *testing.T) {
 		t.Fatalf("Returned image not as expected %v vs %v", images[0], i)
 	}
 }
+
+func TestSQLiteDBUpdateDeleteWebhook(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	w := types.Webhook{
+		ID:         uuid.Generate().String(),
+		URL:        "https://example.com/hook",
+		Secret:     "secret",
+		EventTypes: []types.EventType{types.InstanceFailedEvent},
+		TenantID:   uuid.Generate().String(),
+		State:      types.WebhookActive,
+	}
+
+	err := db.updateWebhook(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := db.getWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhooks) != 1 {
+		t.Fatalf("Unexpected webhook count: %d vs 1", len(webhooks))
+	}
+
+	if !reflect.DeepEqual(webhooks[0], w) {
+		t.Fatalf("Returned webhook not as expected %v vs %v", webhooks[0], w)
+	}
+
+	w.State = types.WebhookDeadLetter
+
+	err = db.updateWebhook(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err = db.getWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhooks) != 1 || webhooks[0].State != types.WebhookDeadLetter {
+		t.Fatalf("Webhook state not updated: %v", webhooks)
+	}
+
+	err = db.deleteWebhook(w.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err = db.getWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhooks) != 0 {
+		t.Fatalf("Unexpected webhook count: %d vs 0", len(webhooks))
+	}
+}
+
+func TestSQLiteDBOperations(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	now := time.Now().Round(time.Second)
+	running := types.Operation{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		Type:       types.CreateVolumeOperation,
+		Target:     uuid.Generate().String(),
+		State:      types.OperationRunning,
+		Progress:   50,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	succeeded := running
+	succeeded.ID = uuid.Generate().String()
+	succeeded.State = types.OperationSucceeded
+	succeeded.Progress = 100
+	succeeded.Result = uuid.Generate().String()
+	succeeded.UpdateTime = now.Add(-time.Hour)
+
+	for _, o := range []types.Operation{running, succeeded} {
+		err := db.updateOperation(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// operations left running by a previous controller have failed
+	ds := &Datastore{db: db}
+	err := ds.initOperations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := ds.GetOperation(running.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.State != types.OperationFailed || o.Error == "" {
+		t.Fatalf("Interrupted operation not failed: %+v", o)
+	}
+
+	o, err = ds.GetOperation(succeeded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !o.CreateTime.Equal(succeeded.CreateTime) || o.Result != succeeded.Result || o.State != types.OperationSucceeded {
+		t.Fatalf("Returned operation not as expected %+v vs %+v", o, succeeded)
+	}
+
+	// the interrupted operation has only just completed
+	pruned, err := ds.PruneOperations(now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 1 {
+		t.Fatalf("Expected to prune the completed operation only: %d", pruned)
+	}
+
+	operations, err := db.getOperations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != 1 || operations[0].ID != running.ID {
+		t.Fatalf("Unexpected operations after pruning: %+v", operations)
+	}
+}
+
+func TestSQLiteDBTrash(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	now := time.Now().Round(time.Second)
+	volume := types.TrashItem{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		Type:       types.TrashVolume,
+		Name:       "data",
+		DeleteTime: now,
+		PurgeTime:  now.Add(time.Hour),
+	}
+
+	instance := volume
+	instance.ID = uuid.Generate().String()
+	instance.Type = types.TrashInstance
+	instance.Name = "web"
+	instance.DeleteTime = now.Add(-time.Minute)
+	instance.WorkloadID = uuid.Generate().String()
+	instance.VCPUs = 2
+	instance.MemMB = 512
+	instance.EphemeralGB = 10
+	instance.Volumes = []string{uuid.Generate().String(), uuid.Generate().String()}
+
+	for _, item := range []types.TrashItem{volume, instance} {
+		err := db.addTrashItem(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds := &Datastore{db: db}
+	err := ds.initTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := ds.GetTrashItems(volume.TenantID)
+	if len(items) != 2 || items[0].ID != instance.ID || items[1].ID != volume.ID {
+		t.Fatalf("Unexpected trash: %+v", items)
+	}
+
+	item := items[0]
+	if !item.PurgeTime.Equal(instance.PurgeTime) || item.WorkloadID != instance.WorkloadID ||
+		item.VCPUs != 2 || item.MemMB != 512 || item.EphemeralGB != 10 ||
+		len(item.Volumes) != 2 || item.Volumes[1] != instance.Volumes[1] {
+		t.Fatalf("Returned trash item not as expected %+v vs %+v", item, instance)
+	}
+
+	if items[1].Volumes != nil {
+		t.Errorf("Unexpected volumes for trashed volume: %+v", items[1])
+	}
+
+	_, err = ds.GetTrashItem(uuid.Generate().String(), volume.ID)
+	if err != types.ErrTrashItemNotFound {
+		t.Errorf("Trash item visible to another tenant: %v", err)
+	}
+
+	err = ds.DeleteTrashItem(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.getTrashItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || stored[0].ID != instance.ID {
+		t.Fatalf("Unexpected trash after delete: %+v", stored)
+	}
+}
+
+func TestSQLiteDBIdempotencyKeys(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	now := time.Now()
+	r := types.IdempotentResponse{
+		TenantID:    uuid.Generate().String(),
+		Key:         "key",
+		RequestHash: "hash",
+		Status:      202,
+		ContentType: "application/json",
+		Body:        []byte(`{"id":"volume"}`),
+		CreateTime:  now.Add(-time.Hour),
+	}
+
+	err := db.addIdempotentResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.getIdempotentResponse(r.TenantID, r.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stored.CreateTime.Equal(r.CreateTime) {
+		t.Fatalf("Unexpected create time %v vs %v", stored.CreateTime, r.CreateTime)
+	}
+	stored.CreateTime = r.CreateTime
+
+	if !reflect.DeepEqual(stored, r) {
+		t.Fatalf("Returned response not as expected %+v vs %+v", stored, r)
+	}
+
+	// keys are scoped by tenant
+	_, err = db.getIdempotentResponse(uuid.Generate().String(), r.Key)
+	if err != ErrNoIdempotencyKey {
+		t.Fatalf("Expected ErrNoIdempotencyKey: %v", err)
+	}
+
+	recent := r
+	recent.Key = "recent"
+	recent.CreateTime = now
+	err = db.addIdempotentResponse(recent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := db.pruneIdempotentResponses(now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 1 {
+		t.Fatalf("Expected to prune one key: %d", pruned)
+	}
+
+	_, err = db.getIdempotentResponse(r.TenantID, r.Key)
+	if err != ErrNoIdempotencyKey {
+		t.Fatalf("Expired key not pruned: %v", err)
+	}
+
+	_, err = db.getIdempotentResponse(recent.TenantID, recent.Key)
+	if err != nil {
+		t.Fatalf("Recent key pruned: %v", err)
+	}
+}
+
+func TestSQLiteDBCNCIImages(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	image := types.CNCIImage{
+		Image:         uuid.Generate().String(),
+		PreviousImage: uuid.Generate().String(),
+	}
+
+	for i := 0; i < 2; i++ {
+		err := db.updateCNCIImage(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := db.getCNCIImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored != image {
+		t.Fatalf("Returned image not as expected %+v vs %+v", stored, image)
+	}
+
+	instanceID := uuid.Generate().String()
+	for _, imageID := range []string{image.PreviousImage, image.Image} {
+		err = db.updateCNCIInstanceImage(instanceID, imageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := db.getCNCIInstanceImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if images[instanceID] != image.Image {
+		t.Fatalf("Instance image not updated: %s", images[instanceID])
+	}
+
+	err = db.deleteCNCIInstanceImage(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err = db.getCNCIInstanceImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := images[instanceID]; ok {
+		t.Fatal("Instance image not deleted")
+	}
+}
+
+func TestSQLiteDBTenantCAs(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	ca := types.TenantCA{
+		TenantID:    uuid.Generate().String(),
+		Certificate: "certificate",
+		Subject:     "CN=tenant CA",
+		Fingerprint: "fingerprint",
+		NotAfter:    time.Now().Add(time.Hour).UTC(),
+		CreateTime:  time.Now().UTC(),
+	}
+
+	err := db.updateTenantCA(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca.Certificate = "replacement"
+	err = db.updateTenantCA(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cas, err := db.getTenantCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, stored := range cas {
+		if stored.TenantID != ca.TenantID {
+			continue
+		}
+
+		found = true
+		if stored.Certificate != ca.Certificate || !stored.NotAfter.Equal(ca.NotAfter) {
+			t.Fatalf("Returned CA not as expected %+v vs %+v", stored, ca)
+		}
+	}
+
+	if !found {
+		t.Fatal("Tenant CA not found")
+	}
+
+	err = db.deleteTenantCA(ca.TenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cas, err = db.getTenantCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range cas {
+		if stored.TenantID == ca.TenantID {
+			t.Fatal("Tenant CA not deleted")
+		}
+	}
+}
+
+func TestSQLiteDBLease(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	now := time.Now()
+	expiry := now.Add(time.Minute)
+
+	lease, err := db.acquireLease("leader", "a", "https://a", expiry, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "a" || lease.Address != "https://a" || !lease.Expiry.Equal(expiry) {
+		t.Fatalf("Unexpected lease: %+v", lease)
+	}
+
+	// lease is held by a so b must not get it
+	lease, err = db.acquireLease("leader", "b", "https://b", expiry, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "a" {
+		t.Fatalf("Lease held by a taken by %s", lease.Holder)
+	}
+
+	// a renews its lease
+	renewed := expiry.Add(time.Minute)
+	lease, err = db.acquireLease("leader", "a", "https://a", renewed, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "a" || !lease.Expiry.Equal(renewed) {
+		t.Fatalf("Lease not renewed: %+v", lease)
+	}
+
+	// once the lease has expired b can take it
+	later := renewed.Add(time.Second)
+	lease, err = db.acquireLease("leader", "b", "https://b", later.Add(time.Minute), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "b" {
+		t.Fatalf("Expired lease not taken over: %+v", lease)
+	}
+
+	// releasing a lease held by somebody else does nothing
+	err = db.releaseLease("leader", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err = db.acquireLease("leader", "a", "https://a", expiry, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "b" {
+		t.Fatalf("Lease released by non holder: %+v", lease)
+	}
+
+	err = db.releaseLease("leader", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err = db.acquireLease("leader", "a", "https://a", expiry, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.Holder != "a" {
+		t.Fatalf("Released lease not acquired: %+v", lease)
+	}
+}
+
+func TestSQLiteDBCompact(t *testing.T) {
+	t.Parallel()
+
+	db := newTestFileStore(t)
+
+	message := strings.Repeat("x", 4096)
+	for i := 0; i < 4000; i++ {
+		err := db.logEvent(types.LogEntry{
+			TenantID:  uuid.Generate().String(),
+			EventType: "info",
+			Message:   message,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := db.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if full.FileSize < 4000*4096 {
+		t.Fatalf("Expected database to hold the log entries: %+v", full)
+	}
+
+	err = db.clearLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := db.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if compacted.FileSize >= full.FileSize/4 {
+		t.Errorf("Database did not shrink: before %+v after %+v", full, compacted)
+	}
+
+	if compacted.FreelistPages != 0 || compacted.WALSize != 0 {
+		t.Errorf("Expected no free pages and an empty log: %+v", compacted)
+	}
+}
+
+func findTestInstance(t *testing.T, db *sqliteDB, instanceID string) *types.Instance {
+	instances, err := db.getInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range instances {
+		if i.ID == instanceID {
+			return i
+		}
+	}
+
+	t.Fatalf("Instance %s not found", instanceID)
+	return nil
+}
+
+func countRows(t *testing.T, db *sqliteDB, query string, args ...interface{}) int {
+	var n int
+	err := db.db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteDBInstanceStateSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ciao-controller.db")
+	db := newTestStoreURI(t, "file:"+path)
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+		Name:       "restart",
+	}
+
+	err := db.addInstance(context.Background(), &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeID := uuid.Generate().String()
+	for _, state := range []string{payloads.ComputeStatusPending, payloads.ComputeStatusRunning} {
+		stat := payloads.InstanceStat{
+			InstanceUUID: i.ID,
+			State:        state,
+			SSHIP:        "192.168.0.1",
+			SSHPort:      34567,
+		}
+
+		err = db.addInstanceStats([]payloads.InstanceStat{stat}, nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// even once the older statistics have been pruned
+	_, err = db.pruneStatistics(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+
+	db = newTestStoreURI(t, "file:"+path+"?cache=private")
+
+	restarted := findTestInstance(t, db, i.ID)
+	if restarted.State != payloads.ComputeStatusRunning || restarted.NodeID != nodeID ||
+		restarted.SSHIP != "192.168.0.1" || restarted.SSHPort != 34567 {
+		t.Fatalf("Instance state lost on restart: %+v", restarted)
+	}
+}
+
+func TestSQLiteDBNodeInstanceSummary(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	nodeID := uuid.Generate().String()
+	otherNodeID := uuid.Generate().String()
+
+	var ids []string
+	for n := 0; n < 5; n++ {
+		i := types.Instance{
+			ID:         uuid.Generate().String(),
+			TenantID:   uuid.Generate().String(),
+			WorkloadID: uuid.Generate().String(),
+			IPAddress:  fmt.Sprintf("172.16.0.%d", n+2),
+			Name:       fmt.Sprintf("summary-%d", n),
+			CNCI:       n == 3,
+		}
+
+		err := db.addInstance(context.Background(), &i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, i.ID)
+	}
+
+	summary, err := db.getNodeInstanceSummary(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalInstances != 0 || !summary.LastSeen.IsZero() {
+		t.Fatalf("Unexpected summary of unknown node: %+v", summary)
+	}
+
+	// the first instance is placed but has yet to report, the second
+	// runs and the third has exited with unknown memory usage.  The CNCI
+	// and the instance on the other node are not counted.
+	err = db.updateInstanceNode(ids[0], nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := [][]payloads.InstanceStat{
+		{
+			{InstanceUUID: ids[1], State: payloads.ComputeStatusPending, MemoryUsageMB: 10, DiskUsageMB: 1},
+			{InstanceUUID: ids[2], State: payloads.ComputeStatusRunning, MemoryUsageMB: 50, DiskUsageMB: 5},
+			{InstanceUUID: ids[3], State: payloads.ComputeStatusRunning, MemoryUsageMB: 1000, DiskUsageMB: 1000},
+		},
+		{
+			{InstanceUUID: ids[1], State: payloads.ComputeStatusRunning, MemoryUsageMB: 256, DiskUsageMB: 20},
+			{InstanceUUID: ids[2], State: payloads.ComputeStatusStopped, MemoryUsageMB: -1, DiskUsageMB: 10},
+		},
+	}
+	for _, s := range stats {
+		err = db.addInstanceStats(s, nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.addInstanceStats([]payloads.InstanceStat{
+		{InstanceUUID: ids[4], State: payloads.ComputeStatusRunning, MemoryUsageMB: 1000, DiskUsageMB: 1000},
+	}, otherNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.addNodeStat(payloads.Stat{NodeUUID: nodeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err = db.getNodeInstanceSummary(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.CiaoNodeSummary{
+		ID:                    nodeID,
+		TotalInstances:        3,
+		TotalRunningInstances: 1,
+		TotalPendingInstances: 1,
+		TotalExitedInstances:  1,
+		MemUsage:              256,
+		DiskUsage:             30,
+		LastSeen:              summary.LastSeen,
+	}
+	if summary != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, summary)
+	}
+
+	if time.Since(summary.LastSeen) > time.Minute || time.Since(summary.LastSeen) < -time.Minute {
+		t.Fatalf("Unexpected last seen time %v", summary.LastSeen)
+	}
+}
+
+func TestSQLiteDBPruneStatistics(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.3",
+		Name:       "prune",
+	}
+
+	err := db.addInstance(context.Background(), &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deletedID := uuid.Generate().String()
+	nodeID := uuid.Generate().String()
+
+	for n := 0; n < 3; n++ {
+		stats := []payloads.InstanceStat{
+			{InstanceUUID: i.ID, State: payloads.ComputeStatusRunning},
+			{InstanceUUID: deletedID, State: payloads.ComputeStatusRunning},
+		}
+
+		err = db.addInstanceStats(stats, nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.addNodeStat(payloads.Stat{NodeUUID: nodeID, MemAvailableMB: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is old enough to be pruned
+	pruned, err := db.pruneStatistics(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 0 {
+		t.Fatalf("Expected nothing pruned got %d", pruned)
+	}
+
+	pruned, err = db.pruneStatistics(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all the statistics of the deleted instance and all but the latest
+	// of the instance and the node
+	if pruned != 3+2+2 {
+		t.Fatalf("Expected 7 statistics pruned got %d", pruned)
+	}
+
+	if countRows(t, db, "SELECT COUNT(*) FROM instance_statistics WHERE instance_id = ?", i.ID) != 1 {
+		t.Fatal("Expected latest instance statistics to be kept")
+	}
+
+	if countRows(t, db, "SELECT COUNT(*) FROM node_statistics WHERE node_id = ? AND mem_available_mb = 2", nodeID) != 1 {
+		t.Fatal("Expected latest node statistics to be kept")
+	}
+}
+
+func TestSQLiteDBMigrateLegacyStats(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "ciao-controller-stats.db")
+
+	// the legacy database held the same tables as the persistent one
+	legacy := newTestStoreURI(t, "file:"+legacyPath)
+
+	instanceID := uuid.Generate().String()
+	nodeID := uuid.Generate().String()
+
+	err := legacy.addInstanceStats([]payloads.InstanceStat{
+		{InstanceUUID: instanceID, State: payloads.ComputeStatusRunning},
+	}, nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = legacy.addNodeStat(payloads.Stat{NodeUUID: nodeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = legacy.logEvent(types.LogEntry{TenantID: "legacy", EventType: "info", Message: "legacy event"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = legacy.db.Exec("INSERT INTO frame_statistics (id, label, type, operand) VALUES (1, 'legacy', 'type', 'operand')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = legacy.db.Exec("INSERT INTO trace_data (frame_id, ssntp_uuid) VALUES (1, 'legacy')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy.disconnect()
+
+	db := &sqliteDB{}
+	config := Config{
+		PersistentURI:     "file:" + filepath.Join(dir, "ciao-controller.db"),
+		InitWorkloadsPath: filepath.Join(dir, "workloads"),
+		LegacyStatsPath:   legacyPath,
+	}
+
+	// an existing frame which the imported trace data must not refer to
+	frameDB := newTestStoreURI(t, config.PersistentURI)
+	_, err = frameDB.db.Exec("INSERT INTO frame_statistics (label, type, operand) VALUES ('current', 'type', 'operand')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameDB.disconnect()
+
+	config.PersistentURI += "?cache=private"
+	err = db.init(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.disconnect)
+
+	if countRows(t, db, "SELECT COUNT(*) FROM instance_statistics WHERE instance_id = ? AND node_id = ?", instanceID, nodeID) != 1 {
+		t.Error("Instance statistics not migrated")
+	}
+
+	if countRows(t, db, "SELECT COUNT(*) FROM node_statistics WHERE node_id = ?", nodeID) != 1 {
+		t.Error("Node statistics not migrated")
+	}
+
+	if countRows(t, db, "SELECT COUNT(*) FROM log WHERE tenant_id = 'legacy' AND message = 'legacy event'") != 1 {
+		t.Error("Event log not migrated")
+	}
+
+	if countRows(t, db, `SELECT COUNT(*) FROM trace_data
+			     JOIN frame_statistics ON trace_data.frame_id = frame_statistics.id
+			     WHERE frame_statistics.label = 'legacy' AND trace_data.ssntp_uuid = 'legacy'`) != 1 {
+		t.Error("Trace data not migrated with its frame")
+	}
+
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Errorf("Legacy database not renamed: %v", err)
+	}
+
+	if _, err := os.Stat(legacyPath + ".migrated"); err != nil {
+		t.Errorf("Migrated legacy database missing: %v", err)
+	}
+}
+
+func TestSQLiteDBUsageRecords(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	start := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	tenantA := uuid.Generate().String()
+	tenantB := uuid.Generate().String()
+
+	// records are returned in order of start and tenant
+	if tenantB < tenantA {
+		tenantA, tenantB = tenantB, tenantA
+	}
+
+	var records []types.UsageRecord
+	for i := 0; i < 3; i++ {
+		for _, tenantID := range []string{tenantA, tenantB} {
+			records = append(records, types.UsageRecord{
+				TenantID:        tenantID,
+				Granularity:     types.UsageSample,
+				Start:           start.Add(time.Duration(i) * 20 * time.Minute),
+				End:             start.Add(time.Duration(i+1) * 20 * time.Minute),
+				InstanceHours:   float64(i) / 3,
+				VolumeGBHours:   10,
+				ExternalIPHours: 0.25,
+			})
+		}
+	}
+
+	err := db.addUsageRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// records are replaced rather than duplicated
+	records[0].InstanceHours = 1
+	err = db.addUsageRecords(records[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.getUsageRecords(types.UsageFilter{Granularity: types.UsageSample})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(records) {
+		t.Fatalf("Expected %d records got %d", len(records), len(got))
+	}
+
+	for i := range got {
+		if !got[i].Start.Equal(records[i].Start) || !got[i].End.Equal(records[i].End) {
+			t.Fatalf("Unexpected period of record %d: %+v", i, got[i])
+		}
+		got[i].Start = records[i].Start
+		got[i].End = records[i].End
+	}
+
+	if !reflect.DeepEqual(got, records) {
+		t.Fatalf("Returned records not as expected %+v vs %+v", got, records)
+	}
+
+	got, err = db.getUsageRecords(types.UsageFilter{
+		TenantID:    tenantB,
+		Granularity: types.UsageSample,
+		Start:       start.Add(20 * time.Minute),
+		End:         start.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0].TenantID != tenantB || !got[0].Start.Equal(start.Add(20*time.Minute)) {
+		t.Fatalf("Unexpected filtered records %+v", got)
+	}
+
+	got, err = db.getUsageRecords(types.UsageFilter{Granularity: types.UsageHourly})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 0 {
+		t.Fatalf("Unexpected hourly records %+v", got)
+	}
+
+	end, err := db.lastUsageRecordEnd(types.UsageSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !end.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Unexpected end of last record %v", end)
+	}
+
+	end, err = db.lastUsageRecordEnd(types.UsageDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !end.IsZero() {
+		t.Fatalf("Unexpected end of last daily record %v", end)
+	}
+
+	pruned, err := db.pruneUsageRecords(types.UsageSample, start.Add(40*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 2 {
+		t.Fatalf("Expected 2 records pruned got %d", pruned)
+	}
+}
+
+func TestSQLiteDBReleasedUsage(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	start := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	spans := []types.UsageSpan{
+		{
+			TenantID: uuid.Generate().String(),
+			ID:       uuid.Generate().String(),
+			Resource: types.UsageVolume,
+			SizeGB:   20,
+			Start:    start,
+			End:      start.Add(90 * time.Minute),
+		},
+		{
+			TenantID: uuid.Generate().String(),
+			ID:       uuid.Generate().String(),
+			Resource: types.UsageInstance,
+			Start:    start,
+			End:      start.Add(3 * time.Hour),
+		},
+	}
+
+	for _, s := range spans {
+		err := db.addReleasedUsage(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := db.pruneReleasedUsage(start.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 1 {
+		t.Fatalf("Expected 1 span pruned got %d", pruned)
+	}
+
+	got, err := db.getReleasedUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || !got[0].Start.Equal(spans[1].Start) || !got[0].End.Equal(spans[1].End) {
+		t.Fatalf("Unexpected released usage %+v", got)
+	}
+
+	got[0].Start = spans[1].Start
+	got[0].End = spans[1].End
+	if !reflect.DeepEqual(got[0], spans[1]) {
+		t.Fatalf("Returned span not as expected %+v vs %+v", got[0], spans[1])
+	}
+}
+
+func TestSQLiteDBQuotaAudit(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	start := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	records := []types.QuotaAuditRecord{
+		{TenantID: tenantID, Resource: "instance", Delta: 1, Usage: 1, Allowed: true, Timestamp: start},
+		{TenantID: tenantID, Resource: "vcpus", Delta: 2, Usage: 2, Allowed: true, Timestamp: start},
+		{TenantID: tenantID, Resource: "instance", Delta: 1, Usage: 2, Allowed: false, Timestamp: start.Add(time.Hour)},
+		{TenantID: uuid.Generate().String(), Resource: "instance", Delta: 1, Usage: 1, Allowed: true, Timestamp: start.Add(time.Hour)},
+		{TenantID: tenantID, Resource: "instance", Delta: -1, Usage: 1, Allowed: true, Timestamp: start.Add(2 * time.Hour)},
+	}
+
+	err := db.addQuotaAudit(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.getQuotaAudit(types.QuotaAuditFilter{TenantID: tenantID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("Expected 4 records got %d", len(got))
+	}
+
+	got, err = db.getQuotaAudit(types.QuotaAuditFilter{
+		TenantID: tenantID,
+		Resource: "instance",
+		Since:    start.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || !got[0].Timestamp.Equal(records[2].Timestamp) {
+		t.Fatalf("Unexpected quota audit records %+v", got)
+	}
+
+	got[0].Timestamp = records[2].Timestamp
+	if got[0] != records[2] {
+		t.Fatalf("Returned record not as expected %+v vs %+v", got[0], records[2])
+	}
+
+	pruned, err := db.pruneQuotaAudit(start.Add(90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 4 {
+		t.Fatalf("Expected 4 records pruned got %d", pruned)
+	}
+
+	got, err = db.getQuotaAudit(types.QuotaAuditFilter{TenantID: tenantID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0].Delta != -1 {
+		t.Fatalf("Unexpected quota audit records after pruning %+v", got)
+	}
+}
+
+func TestSQLiteDBAudit(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	start := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	records := []types.AuditRecord{
+		{Timestamp: start, TenantID: tenantID, Actor: "user", Method: "POST", Resource: "/instances", Status: 202, Body: "{}", BodySize: 2},
+		{Timestamp: start, Actor: "admin", Method: "PUT", Resource: "/settings/trash_retention", Status: 400},
+		{Timestamp: start.Add(time.Hour), TenantID: tenantID, Actor: "user", Method: "DELETE", Resource: "/instances/1", Status: 202},
+		{Timestamp: start.Add(2 * time.Hour), TenantID: tenantID, Actor: "user", Method: "POST", Resource: "/volumes", Status: 403, BodySize: 1 << 20},
+	}
+
+	for _, r := range records {
+		err := db.addAuditRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.getAuditRecords(types.AuditFilter{TenantID: tenantID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 records got %d", len(got))
+	}
+
+	got[0].ID = 0
+	got[0].Timestamp = records[0].Timestamp
+	if got[0] != records[0] {
+		t.Fatalf("Returned record not as expected %+v vs %+v", got[0], records[0])
+	}
+
+	got, err = db.getAuditRecords(types.AuditFilter{
+		Start: start.Add(time.Hour),
+		End:   start.Add(2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0].Method != "DELETE" {
+		t.Fatalf("Unexpected audit records %+v", got)
+	}
+
+	got, err = db.getAuditRecords(types.AuditFilter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 records got %d", len(got))
+	}
+
+	got, err = db.getAuditRecords(types.AuditFilter{Marker: got[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0].Method != "DELETE" {
+		t.Fatalf("Unexpected audit records after marker %+v", got)
+	}
+
+	pruned, err := db.pruneAuditRecords(start.Add(90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 3 {
+		t.Fatalf("Expected 3 records pruned got %d", pruned)
+	}
+}
+
+func TestSQLiteDBSearchInstances(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantA := uuid.Generate().String()
+	tenantB := uuid.Generate().String()
+
+	instances := []*types.Instance{
+		{ID: "a-web", TenantID: tenantA, Name: "web", Description: "frontend"},
+		{ID: "a-db", TenantID: tenantA, Name: "db", Description: "100% backend"},
+		{ID: "a-cache", TenantID: tenantA, Name: "cache_1", Description: "1000 backends"},
+		{ID: "b-web", TenantID: tenantB, Name: "other", Description: "frontend"},
+	}
+
+	for n, i := range instances {
+		i.IPAddress = fmt.Sprintf("172.16.0.%d", n+2)
+		err := db.addInstance(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.updateInstanceDescription("a-web", "public frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tenantID string
+		search   string
+		expected []string
+	}{
+		{tenantA, "", []string{"a-cache", "a-db", "a-web"}},
+		{tenantA, "front", []string{"a-web"}},
+		{tenantA, "public", []string{"a-web"}},
+		{tenantA, "DB", []string{"a-db"}},
+		{tenantA, "0%", []string{"a-db"}},
+		{tenantA, "e_", []string{"a-cache"}},
+		{tenantA, "missing", nil},
+		{"", "frontend", []string{"a-web", "b-web"}},
+	}
+
+	for _, test := range tests {
+		IDs, err := db.filterInstances(test.tenantID, types.InstanceFilter{Search: test.search})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(IDs)
+		if !reflect.DeepEqual(IDs, test.expected) {
+			t.Errorf("Search %q of tenant %q: expected %v got %v",
+				test.search, test.tenantID, test.expected, IDs)
+		}
+	}
+}
+
+// matchInstance selects instances in the same way as filterInstances, from
+// the instances loaded into the datastore's cache.
+func matchInstance(i *types.Instance, match types.InstanceFilter) bool {
+	search := strings.ToLower(match.Search)
+
+	return (match.WorkloadID == "" || i.WorkloadID == match.WorkloadID) &&
+		(match.State == "" || i.State == match.State) &&
+		(match.NodeID == "" || i.NodeID == match.NodeID) &&
+		(match.Name == "" || i.Name == match.Name) &&
+		(search == "" || strings.Contains(strings.ToLower(i.Name), search) ||
+			strings.Contains(strings.ToLower(i.Description), search))
+}
+
+func TestSQLiteDBFilterInstances(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	workloadA := uuid.Generate().String()
+	workloadB := uuid.Generate().String()
+	nodeA := uuid.Generate().String()
+	nodeB := uuid.Generate().String()
+
+	instances := []*types.Instance{
+		{ID: "web-1", WorkloadID: workloadA, Name: "web"},
+		{ID: "web-2", WorkloadID: workloadA, Name: "web", Description: "Canary"},
+		{ID: "db-1", WorkloadID: workloadB, Name: "db"},
+		{ID: "db-2", WorkloadID: workloadB, Name: "db", NodeID: nodeB},
+		{ID: "new", WorkloadID: workloadB},
+		{ID: "lost", WorkloadID: workloadA},
+		{ID: "moving", WorkloadID: workloadA},
+		{ID: "leaving", WorkloadID: workloadB},
+	}
+
+	for n, i := range instances {
+		i.TenantID = tenantID
+		i.IPAddress = fmt.Sprintf("172.16.0.%d", n+2)
+		err := db.addInstance(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.addInstanceStats([]payloads.InstanceStat{
+		{InstanceUUID: "web-1", State: payloads.ComputeStatusRunning},
+		{InstanceUUID: "web-2", State: payloads.ComputeStatusRunning},
+		{InstanceUUID: "db-1", State: payloads.ComputeStatusStopped},
+		{InstanceUUID: "lost", State: payloads.ComputeStatusRunning},
+		{InstanceUUID: "moving", State: payloads.ComputeStatusRunning},
+		{InstanceUUID: "leaving", State: payloads.ComputeStatusRunning},
+	}, nodeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.addInstanceStats([]payloads.InstanceStat{
+		{InstanceUUID: "db-2", State: payloads.ComputeStatusRunning},
+	}, nodeB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another tenant's instance is never selected
+	err = db.addInstance(context.Background(), &types.Instance{
+		ID:         "other",
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: workloadA,
+		Name:       "web",
+		IPAddress:  "172.16.1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		match    types.InstanceFilter
+		expected []string
+	}{
+		{types.InstanceFilter{}, []string{"db-1", "db-2", "leaving", "lost", "moving", "new", "web-1", "web-2"}},
+		{types.InstanceFilter{State: payloads.ComputeStatusRunning}, []string{"db-2", "web-1", "web-2"}},
+		{types.InstanceFilter{State: payloads.ComputeStatusStopped}, []string{"db-1"}},
+		{types.InstanceFilter{State: payloads.ComputeStatusPending}, []string{"new"}},
+		{types.InstanceFilter{State: payloads.Unreachable}, []string{"lost"}},
+		{types.InstanceFilter{State: payloads.Migrating}, []string{"moving"}},
+		{types.InstanceFilter{State: payloads.DeletePending}, []string{"leaving"}},
+		{types.InstanceFilter{WorkloadID: workloadA, State: payloads.Migrating}, []string{"moving"}},
+		{types.InstanceFilter{WorkloadID: workloadB}, []string{"db-1", "db-2", "leaving", "new"}},
+		{types.InstanceFilter{NodeID: nodeA}, []string{"db-1", "leaving", "lost", "moving", "web-1", "web-2"}},
+		{types.InstanceFilter{NodeID: nodeB}, []string{"db-2"}},
+		{types.InstanceFilter{Name: "web"}, []string{"web-1", "web-2"}},
+		{types.InstanceFilter{Name: "web", Search: "canary"}, []string{"web-2"}},
+		{types.InstanceFilter{WorkloadID: workloadB, State: payloads.ComputeStatusRunning}, []string{"db-2"}},
+		{types.InstanceFilter{NodeID: nodeA, State: payloads.ComputeStatusPending}, nil},
+	}
+
+	cached, err := db.getInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// these states are only ever set on the cached instances, the
+	// statistics of the instances still report them running
+	cachedStates := map[string]string{
+		"lost":    payloads.Unreachable,
+		"moving":  payloads.Migrating,
+		"leaving": payloads.DeletePending,
+	}
+	for _, i := range cached {
+		if state, ok := cachedStates[i.ID]; ok {
+			i.State = state
+		}
+	}
+
+	for _, test := range tests {
+		// the state is matched against the cache, as by ListInstances
+		match := test.match
+		match.State = ""
+
+		selected, err := db.filterInstances(tenantID, match)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := make(map[string]bool)
+		for _, ID := range selected {
+			found[ID] = true
+		}
+
+		var IDs, matched []string
+		for _, i := range cached {
+			if found[i.ID] && matchInstanceState(i, test.match.State) {
+				IDs = append(IDs, i.ID)
+			}
+			if i.TenantID == tenantID && matchInstance(i, test.match) {
+				matched = append(matched, i.ID)
+			}
+		}
+
+		sort.Strings(IDs)
+		sort.Strings(matched)
+		if !reflect.DeepEqual(IDs, test.expected) {
+			t.Errorf("Filter %+v: expected %v got %v", test.match, test.expected, IDs)
+		}
+
+		if !reflect.DeepEqual(IDs, matched) {
+			t.Errorf("Filter %+v: database selected %v, cache selected %v", test.match, IDs, matched)
+		}
+	}
+}
+
+func TestSQLiteDBInstanceTags(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	for n, ID := range []string{"web", "db"} {
+		err := db.addInstance(context.Background(), &types.Instance{
+			ID:        ID,
+			TenantID:  tenantID,
+			IPAddress: fmt.Sprintf("172.16.0.%d", n+2),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags := []struct {
+		instanceID string
+		key        string
+		value      string
+	}{
+		{"web", "role", "frontend"},
+		{"web", "env", "prod"},
+		{"db", "role", "backend"},
+		{"db", "env", "prod"},
+		{"db", "env", "staging"},
+	}
+
+	for _, tag := range tags {
+		err := db.setInstanceTag(tag.instanceID, tag.key, tag.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.deleteInstanceTag("web", "role")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]string{
+		"web": {"env": "prod"},
+		"db":  {"role": "backend", "env": "staging"},
+	}
+
+	found, err := db.getInstanceTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Expected %v, got %v", expected, found)
+	}
+
+	IDs, err := db.filterInstances(tenantID, types.InstanceFilter{TagKey: "env", TagValue: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(IDs, []string{"web"}) {
+		t.Fatalf("Expected [web], got %v", IDs)
+	}
+
+	// the tags of deleted instances are deleted with them
+	err = db.deleteInstance("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = db.getInstanceTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := found["db"]; ok {
+		t.Fatalf("Tags of deleted instance not deleted: %v", found)
+	}
+}
+
+func TestSQLiteDBLaunchTemplates(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	lt := types.LaunchTemplate{
+		TenantID:   uuid.Generate().String(),
+		Name:       "web",
+		Version:    1,
+		Request:    []byte(`{"server":{"workload_id":"wl","vcpus":2}}`),
+		CreateTime: time.Now().UTC(),
+		UpdateTime: time.Now().UTC(),
+	}
+
+	err := db.updateLaunchTemplate(lt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt.Version = 2
+	lt.Request = []byte(`{"server":{"workload_id":"wl","vcpus":4}}`)
+	err = db.updateLaunchTemplate(lt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := db.getLaunchTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(templates) != 1 {
+		t.Fatalf("Unexpected launch template count: %d vs 1", len(templates))
+	}
+
+	stored := templates[0]
+	if stored.Version != 2 || string(stored.Request) != string(lt.Request) ||
+		!stored.CreateTime.Equal(lt.CreateTime) {
+		t.Fatalf("Returned launch template not as expected %+v vs %+v", stored, lt)
+	}
+
+	i := &types.Instance{
+		ID:              uuid.Generate().String(),
+		TenantID:        lt.TenantID,
+		IPAddress:       "172.16.0.2",
+		Template:        lt.Name,
+		TemplateVersion: lt.Version,
+	}
+
+	err = db.addInstance(context.Background(), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := db.getTenantInstances(lt.TenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := instances[i.ID]; got == nil || got.Template != "web" || got.TemplateVersion != 2 {
+		t.Fatalf("Instance launch template not recorded: %+v", got)
+	}
+
+	err = db.deleteLaunchTemplate(lt.TenantID, lt.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err = db.getLaunchTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(templates) != 0 {
+		t.Fatalf("Launch template not deleted: %v", templates)
+	}
+}
+
+func TestSQLiteDBPolicyRules(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	r := types.PolicyRule{
+		ID:           uuid.Generate().String(),
+		Description:  "No legacy firmware",
+		Severity:     types.PolicyDeny,
+		ImagePattern: "ubuntu-*",
+		VMType:       payloads.QEMU,
+		FWType:       "legacy",
+		MinVCPUs:     2,
+		MinMemMB:     1024,
+		CreateTime:   time.Now().UTC(),
+	}
+
+	err := db.updatePolicyRule(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Severity = types.PolicyWarn
+	err = db.updatePolicyRule(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := db.getPolicyRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 1 {
+		t.Fatalf("Unexpected policy rule count: %d vs 1", len(rules))
+	}
+
+	stored := rules[0]
+	if !stored.CreateTime.Equal(r.CreateTime) {
+		t.Fatalf("Returned policy rule create time not as expected %v vs %v", stored.CreateTime, r.CreateTime)
+	}
+
+	stored.CreateTime = r.CreateTime
+	if stored != r {
+		t.Fatalf("Returned policy rule not as expected %+v vs %+v", stored, r)
+	}
+
+	err = db.deletePolicyRule(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err = db.getPolicyRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 0 {
+		t.Fatalf("Policy rule not deleted: %+v", rules)
+	}
+}
+
+func TestSQLiteDBSettings(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	v := types.SettingValue{
+		Key:        "pending_instance_timeout",
+		Value:      "5m0s",
+		UpdateTime: time.Now().UTC(),
+	}
+
+	err := db.updateSetting(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Value = "1m0s"
+	err = db.updateSetting(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := db.getSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(settings) != 1 {
+		t.Fatalf("Unexpected setting count: %d vs 1", len(settings))
+	}
+
+	stored := settings[0]
+	if !stored.UpdateTime.Equal(v.UpdateTime) {
+		t.Fatalf("Returned setting update time not as expected %v vs %v", stored.UpdateTime, v.UpdateTime)
+	}
+
+	stored.UpdateTime = v.UpdateTime
+	if stored != v {
+		t.Fatalf("Returned setting not as expected %+v vs %+v", stored, v)
+	}
+
+	err = db.deleteSetting(v.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err = db.getSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(settings) != 0 {
+		t.Fatalf("Setting not deleted: %+v", settings)
+	}
+}
+
+func TestSQLiteDBLaunchQueue(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tenantID := uuid.Generate().String()
+	var queued []types.QueuedLaunch
+	for i := 3; i > 0; i-- {
+		l := types.QueuedLaunch{
+			InstanceID: uuid.Generate().String(),
+			TenantID:   tenantID,
+			Sequence:   int64(i),
+			Config:     fmt.Sprintf("config %d", i),
+			TraceLabel: "label",
+			QueueTime:  time.Now().UTC(),
+		}
+
+		err := db.addQueuedLaunch(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued = append([]types.QueuedLaunch{l}, queued...)
+	}
+
+	launches, err := db.getQueuedLaunches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(launches) != len(queued) {
+		t.Fatalf("Unexpected queued launch count: %d vs %d", len(launches), len(queued))
+	}
+
+	for i, l := range launches {
+		if !l.QueueTime.Equal(queued[i].QueueTime) {
+			t.Fatalf("Returned queue time not as expected %v vs %v", l.QueueTime, queued[i].QueueTime)
+		}
+
+		l.QueueTime = queued[i].QueueTime
+		if l != queued[i] {
+			t.Fatalf("Returned queued launch not as expected %+v vs %+v", l, queued[i])
+		}
+	}
+
+	err = db.deleteQueuedLaunch(queued[0].InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	launches, err = db.getQueuedLaunches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(launches) != 2 || launches[0].InstanceID != queued[1].InstanceID {
+		t.Fatalf("Queued launch not deleted: %+v", launches)
+	}
+}
+
+func TestSQLiteDBLaunchConfigs(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	instanceID := uuid.Generate().String()
+	if _, err := db.getLaunchConfig(instanceID); err != types.ErrLaunchConfigNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrLaunchConfigNotFound, err)
+	}
+
+	for _, config := range []string{"---\nstart: {}\n...\n", "---\nstart:\n  vcpus: 2\n...\n"} {
+		err := db.updateLaunchConfig(context.Background(), instanceID, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := db.getLaunchConfig(instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored != config {
+			t.Fatalf("Expected launch config %q, got %q", config, stored)
+		}
+	}
+
+	err := db.deleteLaunchConfig(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.getLaunchConfig(instanceID); err != types.ErrLaunchConfigNotFound {
+		t.Fatalf("Launch config not deleted: %v", err)
+	}
+}
+
+func TestSQLiteDBAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	k := types.APIKey{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		Name:       "ci",
+		Scopes:     []string{"instances", "workloads"},
+		Hash:       "0123456789abcdef",
+		ExpireTime: time.Now().Add(time.Hour).UTC(),
+		CreateTime: time.Now().UTC(),
+	}
+
+	err := db.updateAPIKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.LastUsedTime = time.Now().UTC()
+	err = db.updateAPIKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.getAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 {
+		t.Fatalf("Unexpected API key count: %d", len(keys))
+	}
+
+	if !keys[0].LastUsedTime.Equal(k.LastUsedTime) || !keys[0].ExpireTime.Equal(k.ExpireTime) ||
+		!keys[0].CreateTime.Equal(k.CreateTime) {
+		t.Fatalf("Returned API key times not as expected %+v vs %+v", keys[0], k)
+	}
+
+	keys[0].LastUsedTime = k.LastUsedTime
+	keys[0].ExpireTime = k.ExpireTime
+	keys[0].CreateTime = k.CreateTime
+	if !reflect.DeepEqual(keys[0], k) {
+		t.Fatalf("Returned API key not as expected %+v vs %+v", keys[0], k)
+	}
+
+	err = db.deleteAPIKey(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err = db.getAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 0 {
+		t.Fatalf("API key not deleted: %+v", keys)
+	}
+}
+
+func TestSQLiteDBAuthTokens(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	tok := types.AuthToken{
+		ID:         uuid.Generate().String(),
+		Subject:    "user",
+		TenantID:   uuid.Generate().String(),
+		Role:       "tenant",
+		ExpireTime: time.Now().Add(time.Hour).UTC(),
+		CreateTime: time.Now().UTC(),
+	}
+
+	err := db.addAuthToken(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := db.getAuthTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 1 {
+		t.Fatalf("Unexpected token count: %d", len(tokens))
+	}
+
+	if !tokens[0].ExpireTime.Equal(tok.ExpireTime) || !tokens[0].CreateTime.Equal(tok.CreateTime) {
+		t.Fatalf("Returned token times not as expected %+v vs %+v", tokens[0], tok)
+	}
+
+	tokens[0].ExpireTime = tok.ExpireTime
+	tokens[0].CreateTime = tok.CreateTime
+	if !reflect.DeepEqual(tokens[0], tok) {
+		t.Fatalf("Returned token not as expected %+v vs %+v", tokens[0], tok)
+	}
+
+	err = db.deleteAuthToken(tok.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = db.getAuthTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 0 {
+		t.Fatalf("Token not deleted: %+v", tokens)
+	}
+}
+
+func TestSQLiteDBAttachmentDetails(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+	ctx := context.Background()
+
+	tenants := []string{uuid.Generate().String(), uuid.Generate().String()}
+	nodes := []string{uuid.Generate().String(), uuid.Generate().String(), uuid.Generate().String()}
+	states := []types.BlockState{types.Available, types.Attaching, types.InUse, types.Detaching}
+
+	expected := make(map[string]types.AttachmentDetails)
+	for i := 0; i < 300; i++ {
+		v := types.Volume{
+			BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+			TenantID:    tenants[i%len(tenants)],
+			State:       states[i%len(states)],
+			CreateTime:  time.Now(),
+		}
+
+		err := db.addBlockData(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := types.StorageAttachment{
+			ID:         uuid.Generate().String(),
+			InstanceID: uuid.Generate().String(),
+			BlockID:    v.ID,
+		}
+
+		err = db.addStorageAttachment(context.Background(), a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// some instances have moved, the latest placement counts
+		node := nodes[i%len(nodes)]
+		err = db.addPlacement(a.InstanceID, types.Placement{NodeID: node, Timestamp: time.Now(), Reason: types.PlacementInitial})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i%5 == 0 {
+			node = nodes[(i+1)%len(nodes)]
+			err = db.addPlacement(a.InstanceID, types.Placement{NodeID: node, Timestamp: time.Now(), Reason: types.PlacementMigration})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected[a.ID] = types.AttachmentDetails{
+			ID:         a.ID,
+			TenantID:   v.TenantID,
+			InstanceID: a.InstanceID,
+			VolumeID:   v.ID,
+			NodeID:     node,
+			State:      v.State,
+		}
+	}
+
+	var some types.AttachmentDetails
+	for _, a := range expected {
+		some = a
+		break
+	}
+
+	filters := []types.AttachmentFilter{
+		{},
+		{TenantID: tenants[1]},
+		{State: types.Attaching},
+		{NodeID: nodes[2]},
+		{NodeID: nodes[0], State: types.Attaching, TenantID: tenants[1]},
+		{InstanceID: some.InstanceID},
+		{VolumeID: some.VolumeID},
+	}
+
+	for _, f := range filters {
+		want := 0
+		for _, a := range expected {
+			if (f.TenantID == "" || f.TenantID == a.TenantID) &&
+				(f.InstanceID == "" || f.InstanceID == a.InstanceID) &&
+				(f.VolumeID == "" || f.VolumeID == a.VolumeID) &&
+				(f.NodeID == "" || f.NodeID == a.NodeID) &&
+				(f.State == "" || f.State == a.State) {
+				want++
+			}
+		}
+
+		// page through the attachments to check the markers
+		var got []types.AttachmentDetails
+		f.Limit = 16
+		for {
+			page, err := db.getAttachmentDetails(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, page...)
+
+			if len(page) < f.Limit {
+				break
+			}
+			f.Marker = page[len(page)-1].ID
+		}
+
+		if len(got) != want {
+			t.Fatalf("%+v: expected %d attachments, got %d", f, want, len(got))
+		}
+
+		for i, a := range got {
+			if i > 0 && got[i-1].ID >= a.ID {
+				t.Fatalf("%+v: attachments not in ID order", f)
+			}
+
+			e := expected[a.ID]
+			if a.StateTime.IsZero() {
+				t.Fatalf("State time of attachment %s not set", a.ID)
+			}
+
+			a.StateTime = e.StateTime
+			if a != e {
+				t.Fatalf("Attachment not as expected %+v vs %+v", a, e)
+			}
+		}
+	}
+}
+
+func TestSQLiteDBBlockDataStateTime(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+	ctx := context.Background()
+
+	v := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+		TenantID:    uuid.Generate().String(),
+		State:       types.Available,
+		CreateTime:  time.Now().Add(-time.Hour),
+	}
+
+	err := db.addBlockData(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := types.StorageAttachment{
+		ID:         uuid.Generate().String(),
+		InstanceID: uuid.Generate().String(),
+		BlockID:    v.ID,
+	}
+
+	err = db.addStorageAttachment(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateTime := func() time.Time {
+		attachments, err := db.getAttachmentDetails(types.AttachmentFilter{VolumeID: v.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(attachments) != 1 {
+			t.Fatalf("Expected 1 attachment, got %d", len(attachments))
+		}
+
+		return attachments[0].StateTime
+	}
+
+	if st := stateTime(); !st.Equal(v.CreateTime) {
+		t.Fatalf("Expected state time %v, got %v", v.CreateTime, st)
+	}
+
+	// rewriting the same state does not count as a transition
+	err = db.updateBlockData(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := stateTime(); !st.Equal(v.CreateTime) {
+		t.Fatalf("Expected state time %v, got %v", v.CreateTime, st)
+	}
+
+	v.State = types.Attaching
+	err = db.updateBlockData(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := stateTime(); !st.After(v.CreateTime) {
+		t.Fatalf("State time %v not updated", st)
+	}
+}
+
+func TestSQLiteDBServerGroups(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	g := types.ServerGroup{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		Name:       "web",
+		Policy:     types.ServerGroupAntiAffinity,
+		Soft:       true,
+		CreateTime: time.Now().UTC(),
+	}
+
+	err := db.addServerGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []string{uuid.Generate().String(), uuid.Generate().String(), uuid.Generate().String()}
+	for _, instanceID := range members {
+		err = db.addServerGroupMember(g.ID, instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.deleteServerGroupMember(members[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := db.getServerGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 {
+		t.Fatalf("Unexpected server group count: %d vs 1", len(groups))
+	}
+
+	stored := groups[0]
+	if stored.ID != g.ID || stored.TenantID != g.TenantID || stored.Name != g.Name ||
+		stored.Policy != g.Policy || !stored.Soft || !stored.CreateTime.Equal(g.CreateTime) {
+		t.Fatalf("Returned server group not as expected %+v vs %+v", stored, g)
+	}
+
+	if len(stored.Members) != 2 || stored.Members[0] != members[0] || stored.Members[1] != members[2] {
+		t.Fatalf("Returned server group members not as expected %v", stored.Members)
+	}
+
+	err = db.deleteServerGroup(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err = db.getServerGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 0 {
+		t.Fatalf("Server group not deleted: %v", groups)
+	}
+
+	// the memberships of a deleted group are deleted along with it
+	err = db.addServerGroupMember(uuid.Generate().String(), members[0])
+	if err != nil {
+		t.Fatalf("Membership of deleted group not deleted: %v", err)
+	}
+}
+
+func TestSQLiteDBSnapshotSchedules(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	now := time.Now().UTC()
+	s := types.SnapshotSchedule{
+		ID:              uuid.Generate().String(),
+		TenantID:        uuid.Generate().String(),
+		Tag:             "data",
+		IntervalMinutes: 1440,
+		OffsetMinutes:   120,
+		Retention:       7,
+		CreateTime:      now,
+		NextRun:         now.Add(time.Hour),
+	}
+
+	err := db.updateSnapshotSchedule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.LastRun = s.NextRun
+	s.NextRun = s.NextRun.Add(24 * time.Hour)
+	s.LastError = "volume busy"
+	err = db.updateSnapshotSchedule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedules, err := db.getSnapshotSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schedules) != 1 {
+		t.Fatalf("Unexpected snapshot schedule count: %d vs 1", len(schedules))
+	}
+
+	stored := schedules[0]
+	if stored.Tag != s.Tag || stored.Retention != s.Retention || stored.OffsetMinutes != s.OffsetMinutes ||
+		!stored.LastRun.Equal(s.LastRun) || !stored.NextRun.Equal(s.NextRun) || stored.LastError != s.LastError {
+		t.Fatalf("Returned snapshot schedule not as expected %+v vs %+v", stored, s)
+	}
+
+	snap := types.VolumeSnapshot{
+		ID:         uuid.Generate().String(),
+		VolumeID:   uuid.Generate().String(),
+		TenantID:   s.TenantID,
+		ScheduleID: s.ID,
+		CreateTime: now,
+	}
+
+	manual := types.VolumeSnapshot{
+		ID:         uuid.Generate().String(),
+		VolumeID:   snap.VolumeID,
+		TenantID:   s.TenantID,
+		Name:       "before upgrade",
+		Attached:   true,
+		CreateTime: now.Add(time.Minute),
+	}
+
+	err = db.addVolumeSnapshot(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := db.getVolumeSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 1 || snapshots[0].ID != snap.ID || snapshots[0].ScheduleID != s.ID ||
+		!snapshots[0].CreateTime.Equal(snap.CreateTime) || snapshots[0].Attached {
+		t.Fatalf("Returned volume snapshots not as expected %+v vs %+v", snapshots, snap)
+	}
+
+	err = db.addVolumeSnapshot(manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err = db.getVolumeSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, stored := range snapshots {
+		if stored.ID == manual.ID {
+			found = stored.Name == manual.Name && stored.Attached && stored.ScheduleID == ""
+		}
+	}
+	if !found {
+		t.Fatalf("Returned volume snapshots not as expected %+v vs %+v", snapshots, manual)
+	}
+
+	for _, ID := range []string{snap.ID, manual.ID} {
+		err = db.deleteVolumeSnapshot(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.deleteSnapshotSchedule(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedules, err = db.getSnapshotSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err = db.getVolumeSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schedules) != 0 || len(snapshots) != 0 {
+		t.Fatalf("Snapshot schedule not deleted: %v %v", schedules, snapshots)
+	}
+}
+
+func TestSQLiteDBImageSeeds(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	imageID := uuid.Generate().String()
+	seed := types.ImageSeed{
+		NodeID:     uuid.Generate().String(),
+		State:      types.ImageSeeding,
+		UpdateTime: time.Now().UTC(),
+	}
+
+	err := db.updateImageSeed(imageID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed.State = types.ImageSeedFailed
+	seed.Error = "No space left on device"
+	err = db.updateImageSeed(imageID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err := db.getImageSeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seeds[imageID]) != 1 {
+		t.Fatalf("Unexpected image seed count: %d vs 1", len(seeds[imageID]))
+	}
+
+	stored := seeds[imageID][0]
+	if stored.NodeID != seed.NodeID || stored.State != seed.State || stored.Error != seed.Error ||
+		!stored.UpdateTime.Equal(seed.UpdateTime) {
+		t.Fatalf("Returned image seed not as expected %+v vs %+v", stored, seed)
+	}
+
+	err = db.deleteImageSeeds(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err = db.getImageSeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seeds[imageID]) != 0 {
+		t.Fatalf("Image seeds not deleted: %+v", seeds[imageID])
+	}
+}
+
+func TestSQLiteDBNodeMaintenance(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	nodes := []string{uuid.Generate().String(), uuid.Generate().String()}
+	sort.Strings(nodes)
+
+	for _, nodeID := range nodes {
+		// repeating the update does not add the node twice
+		for i := 0; i < 2; i++ {
+			err := db.updateNodeMaintenance(nodeID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stored, err := db.getMaintenanceNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(stored, nodes) {
+		t.Fatalf("Nodes in maintenance not as expected %v vs %v", stored, nodes)
+	}
+
+	err = db.updateNodeMaintenance(nodes[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = db.getMaintenanceNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || stored[0] != nodes[1] {
+		t.Fatalf("Node not taken out of maintenance: %v", stored)
+	}
+}
+
+func TestSQLiteDBMigrations(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	m := types.Migration{
+		InstanceID:   uuid.Generate().String(),
+		TenantID:     uuid.Generate().String(),
+		SourceNodeID: uuid.Generate().String(),
+		TargetNodeID: uuid.Generate().String(),
+		State:        types.MigrationPreparing,
+		StartTime:    time.Now().UTC(),
+	}
+
+	err := db.updateMigration(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.State = types.MigrationTransferring
+	err = db.updateMigration(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := db.getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 1 {
+		t.Fatalf("Unexpected migration count: %d vs 1", len(migrations))
+	}
+
+	stored := migrations[0]
+	if stored.InstanceID != m.InstanceID || stored.TenantID != m.TenantID ||
+		stored.SourceNodeID != m.SourceNodeID || stored.TargetNodeID != m.TargetNodeID ||
+		stored.State != m.State || !stored.StartTime.Equal(m.StartTime) {
+		t.Fatalf("Returned migration not as expected %+v vs %+v", stored, m)
+	}
+
+	err = db.deleteMigration(m.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err = db.getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 0 {
+		t.Fatalf("Migrations not deleted: %+v", migrations)
+	}
+}
+
+func TestSQLiteDBInstanceDeleteTime(t *testing.T) {
+	t.Parallel()
+
+	db := newTestStore(t)
+
+	i := &types.Instance{
+		ID:       uuid.Generate().String(),
+		TenantID: uuid.Generate().String(),
+		State:    payloads.Running,
+	}
+	err := db.addInstance(context.Background(), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteTime := time.Now().Add(time.Hour).UTC()
+	err = db.updateInstanceDeleteTime(context.Background(), i.ID, deleteTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := db.getInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 1 || instances[0].State != payloads.DeletePending ||
+		!instances[0].DeleteTime.Equal(deleteTime) {
+		t.Fatalf("Instance not pending deletion: %+v", instances)
+	}
+
+	err = db.updateInstanceDeleteTime(context.Background(), i.ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantInstances, err := db.getTenantInstances(i.TenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := tenantInstances[i.ID]
+	if found == nil || found.State == payloads.DeletePending || !found.DeleteTime.IsZero() {
+		t.Fatalf("Instance still pending deletion: %+v", found)
+	}
+}
+
+func TestSQLiteDBQueryObserved(t *testing.T) {
+	t.Parallel()
+
+	var lock sync.Mutex
+	observed := make(map[string]int)
+
+	db := &sqliteDB{}
+	config := Config{
+		PersistentURI:     fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.Generate()),
+		InitWorkloadsPath: filepath.Join(t.TempDir(), "workloads"),
+		QueryObserved: func(statement string, d time.Duration) {
+			lock.Lock()
+			observed[statement]++
+			lock.Unlock()
+		},
+	}
+
+	if err := db.init(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.disconnect)
+
+	tok := types.AuthToken{
+		ID:         uuid.Generate().String(),
+		Subject:    "user",
+		Role:       "admin",
+		ExpireTime: time.Now().Add(time.Hour).UTC(),
+		CreateTime: time.Now().UTC(),
+	}
+
+	lock.Lock()
+	before := observed["insert"] + observed["replace"]
+	lock.Unlock()
+
+	if err := db.addAuthToken(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.getAuthTokens(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if observed["insert"]+observed["replace"] <= before {
+		t.Errorf("Token insertion not observed: %v", observed)
+	}
+	if observed["select"] == 0 {
+		t.Errorf("Token query not observed: %v", observed)
+	}
+}
+
+func TestStatementKind(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT id FROM tenants", "select"},
+		{"\n\t\tinsert into log VALUES (?)", "insert"},
+		{"UPDATE instances SET state = ?", "update"},
+		{"DELETE FROM tokens", "delete"},
+		{"REPLACE INTO tokens VALUES (?)", "replace"},
+		{"PRAGMA journal_mode=WAL", "other"},
+		{"", "other"},
+	}
+
+	for _, tt := range tests {
+		if k := statementKind(tt.query); k != tt.expected {
+			t.Errorf("%q: expected %s got %s", tt.query, tt.expected, k)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides the counters and gauges exported by the
+// controller in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4"
+
+// OtherLabel is the label value used once a LabelLimiter is full.
+const OtherLabel = "other"
+
+// CounterVec is a set of counters sharing a name and label names, with one
+// counter for each combination of label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*counter
+}
+
+type counter struct {
+	labels []string
+	value  uint64
+}
+
+// NewCounterVec creates a new set of counters.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counter),
+	}
+}
+
+func (v *CounterVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// Inc increments the counter with the given label values.
+func (v *CounterVec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Add adds n to the counter with the given label values.
+func (v *CounterVec) Add(n uint64, values ...string) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	c, ok := v.values[key]
+	if !ok {
+		c = &counter{labels: append([]string(nil), values...)}
+		v.values[key] = c
+	}
+	c.value += n
+}
+
+// Value returns the value of the counter with the given label values.
+func (v *CounterVec) Value(values ...string) uint64 {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if c, ok := v.values[key]; ok {
+		return c.value
+	}
+	return 0
+}
+
+// Total returns the sum of all the counters.
+func (v *CounterVec) Total() uint64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var total uint64
+	for _, c := range v.values {
+		total += c.value
+	}
+	return total
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func (v *CounterVec) write(w io.Writer) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, helpEscaper.Replace(v.help), v.name)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		c := v.values[k]
+
+		_, err = fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, c.labels), c.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, l := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Gauge is a single value which can go up and down.
+type Gauge struct {
+	name string
+	help string
+
+	lock  sync.Mutex
+	value int64
+}
+
+// NewGauge creates a new gauge.
+func NewGauge(name string, help string) *Gauge {
+	return &Gauge{
+		name: name,
+		help: help,
+	}
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(value int64) {
+	g.lock.Lock()
+	g.value = value
+	g.lock.Unlock()
+}
+
+// Value returns the value of the gauge.
+func (g *Gauge) Value() int64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.name, helpEscaper.Replace(g.help), g.name, g.name, g.Value())
+	return err
+}
+
+// GaugeVec is a set of gauges sharing a name and label names, with one
+// gauge for each combination of label values.  Unlike counters, the set
+// of gauges is usually replaced as a whole.
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*gauge
+}
+
+type gauge struct {
+	labels []string
+	value  int64
+}
+
+// NewGaugeVec creates a new set of gauges.
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*gauge),
+	}
+}
+
+func (v *GaugeVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// Set sets the value of the gauge with the given label values.
+func (v *GaugeVec) Set(value int64, values ...string) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.values[key] = &gauge{labels: append([]string(nil), values...), value: value}
+}
+
+// Value returns the value of the gauge with the given label values and
+// whether it has been set.
+func (v *GaugeVec) Value(values ...string) (int64, bool) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	g, ok := v.values[key]
+	if !ok {
+		return 0, false
+	}
+	return g.value, true
+}
+
+// Reset removes all the gauges.
+func (v *GaugeVec) Reset() {
+	v.lock.Lock()
+	v.values = make(map[string]*gauge)
+	v.lock.Unlock()
+}
+
+func (v *GaugeVec) write(w io.Writer) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", v.name, helpEscaper.Replace(v.help), v.name)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		g := v.values[k]
+
+		_, err = fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, g.labels), g.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms.
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec is a set of histograms sharing a name, buckets and label
+// names, with one histogram for each combination of label values.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a new set of histograms whose buckets have the
+// given upper bounds, in increasing order.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (v *HistogramVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// Observe adds value to the histogram with the given label values.
+func (v *HistogramVec) Observe(value float64, values ...string) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{
+			labels: append([]string(nil), values...),
+			counts: make([]uint64, len(v.buckets)),
+		}
+		v.values[key] = h
+	}
+
+	for i, b := range v.buckets {
+		if value <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Count returns the number of values observed by the histogram with the
+// given label values.
+func (v *HistogramVec) Count(values ...string) uint64 {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if h, ok := v.values[key]; ok {
+		return h.count
+	}
+	return 0
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, helpEscaper.Replace(v.help), v.name)
+	if err != nil {
+		return err
+	}
+
+	names := append(append([]string(nil), v.labels...), "le")
+	for _, k := range keys {
+		h := v.values[k]
+		values := append(append([]string(nil), h.labels...), "")
+
+		// the buckets of the exposition format are cumulative
+		var cumulative uint64
+		for i, b := range v.buckets {
+			cumulative += h.counts[i]
+			values[len(values)-1] = strconv.FormatFloat(b, 'g', -1, 64)
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, values), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		values[len(values)-1] = "+Inf"
+		labels := formatLabels(v.labels, h.labels)
+		_, err = fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			v.name, formatLabels(names, values), h.count,
+			v.name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64),
+			v.name, labels, h.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Collector is a metric which can be exported by a Registry.
+type Collector interface {
+	write(w io.Writer) error
+}
+
+// Registry is a collection of metrics which are exported together.
+type Registry struct {
+	lock       sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds metrics to the registry.
+func (r *Registry) Register(collectors ...Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write writes all the registered metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		if err := c.write(bw); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the registered metrics to a Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+// LabelLimiter bounds the number of distinct values used for a label.  The
+// first max values seen are used as they are and any further values are
+// replaced by OtherLabel.
+type LabelLimiter struct {
+	max int
+
+	lock sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewLabelLimiter creates a LabelLimiter allowing max distinct values.
+func NewLabelLimiter(max int) *LabelLimiter {
+	return &LabelLimiter{
+		max:  max,
+		seen: make(map[string]struct{}),
+	}
+}
+
+// Label returns the label value to be used for value.
+func (l *LabelLimiter) Label(value string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.seen[value]; ok {
+		return value
+	}
+
+	if len(l.seen) >= l.max {
+		return OtherLabel
+	}
+
+	l.seen[value] = struct{}{}
+	return value
+}
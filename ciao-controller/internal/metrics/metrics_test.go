@@ -0,0 +1,192 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_total", "Test counter", "tenant", "resource")
+
+	v.Inc("a", "vcpus")
+	v.Inc("a", "vcpus")
+	v.Add(3, "b", "mem_mb")
+
+	if v.Value("a", "vcpus") != 2 {
+		t.Errorf("Expected 2, got %d", v.Value("a", "vcpus"))
+	}
+
+	if v.Value("a", "mem_mb") != 0 {
+		t.Errorf("Expected 0, got %d", v.Value("a", "mem_mb"))
+	}
+
+	if v.Total() != 5 {
+		t.Errorf("Expected total of 5, got %d", v.Total())
+	}
+}
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	v := NewCounterVec("test_total", "Test counter", "route")
+	g := NewGauge("test_bytes", "Test gauge")
+	r.Register(v, g)
+
+	v.Inc(`/a"b`)
+	v.Inc("/c")
+	g.Set(42)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_total Test counter
+# TYPE test_total counter
+test_total{route="/a\"b"} 1
+test_total{route="/c"} 1
+# HELP test_bytes Test gauge
+# TYPE test_bytes gauge
+test_bytes 42
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("Unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	if w.Body.String() != expected {
+		t.Errorf("Unexpected response:\n%s", w.Body.String())
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	r := NewRegistry()
+	v := NewGaugeVec("test_offset", "Test gauge vector", "node")
+	r.Register(v)
+
+	v.Set(-5, "b")
+	v.Set(10, "a")
+
+	if value, ok := v.Value("a"); !ok || value != 10 {
+		t.Errorf("Expected 10, got %d", value)
+	}
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_offset Test gauge vector
+# TYPE test_offset gauge
+test_offset{node="a"} 10
+test_offset{node="b"} -5
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+
+	v.Reset()
+	if _, ok := v.Value("a"); ok {
+		t.Error("Gauge not removed by reset")
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	v := NewHistogramVec("test_seconds", "Test histogram", []float64{0.1, 1}, "route")
+	r.Register(v)
+
+	v.Observe(0.05, "/a")
+	v.Observe(0.5, "/a")
+	v.Observe(2, "/a")
+
+	if v.Count("/a") != 3 || v.Count("/b") != 0 {
+		t.Errorf("Unexpected counts %d %d", v.Count("/a"), v.Count("/b"))
+	}
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_seconds Test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="0.1"} 1
+test_seconds_bucket{route="/a",le="1"} 2
+test_seconds_bucket{route="/a",le="+Inf"} 3
+test_seconds_sum{route="/a"} 2.55
+test_seconds_count{route="/a"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestLabelLimiter(t *testing.T) {
+	l := NewLabelLimiter(2)
+
+	for _, v := range []string{"a", "b", "a"} {
+		if l.Label(v) != v {
+			t.Errorf("Expected %s to be kept", v)
+		}
+	}
+
+	if l.Label("c") != OtherLabel {
+		t.Errorf("Expected c to be replaced by %s", OtherLabel)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := NewWindow(time.Hour, 6, func() time.Time { return now })
+
+	w.Add("a")
+	w.Add("b")
+	w.Add("b")
+
+	now = now.Add(30 * time.Minute)
+	w.Add("c")
+	w.Add("c")
+	w.Add("c")
+
+	expected := []KeyCount{{"c", 3}, {"b", 2}, {"a", 1}}
+	if top := w.Top(0); !reflect.DeepEqual(top, expected) {
+		t.Errorf("Expected %v, got %v", expected, top)
+	}
+
+	if top := w.Top(1); !reflect.DeepEqual(top, expected[:1]) {
+		t.Errorf("Expected %v, got %v", expected[:1], top)
+	}
+
+	// the first events drop out of the window
+	now = now.Add(40 * time.Minute)
+	expected = []KeyCount{{"c", 3}}
+	if top := w.Top(0); !reflect.DeepEqual(top, expected) {
+		t.Errorf("Expected %v, got %v", expected, top)
+	}
+
+	now = now.Add(time.Hour)
+	if top := w.Top(0); len(top) != 0 {
+		t.Errorf("Expected an empty window, got %v", top)
+	}
+}
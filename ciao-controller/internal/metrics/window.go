@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyCount is the number of events recorded for a key.
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+type windowBucket struct {
+	epoch  int64
+	counts map[string]int
+}
+
+// Window counts events by key over a sliding window of time.  The window
+// is divided into buckets and events expire a bucket at a time, so the
+// counts cover between length-length/buckets and length of history.
+type Window struct {
+	length time.Duration
+	width  time.Duration
+	now    func() time.Time
+
+	lock    sync.Mutex
+	buckets []windowBucket
+}
+
+// NewWindow creates a Window of the given length divided into buckets.
+// The current time is obtained by calling now.
+func NewWindow(length time.Duration, buckets int, now func() time.Time) *Window {
+	width := length / time.Duration(buckets)
+	if width <= 0 {
+		width = 1
+	}
+
+	return &Window{
+		length:  length,
+		width:   width,
+		now:     now,
+		buckets: make([]windowBucket, buckets),
+	}
+}
+
+// Length returns the length of the window.
+func (w *Window) Length() time.Duration {
+	return w.length
+}
+
+func (w *Window) epoch() int64 {
+	return w.now().UnixNano() / int64(w.width)
+}
+
+// Add records an event for key.
+func (w *Window) Add(key string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	epoch := w.epoch()
+	b := &w.buckets[epoch%int64(len(w.buckets))]
+	if b.epoch != epoch || b.counts == nil {
+		b.epoch = epoch
+		b.counts = make(map[string]int)
+	}
+	b.counts[key]++
+}
+
+// Top returns the n keys with the most events in the window, in
+// decreasing order of count.  If n is zero all the keys are returned.
+func (w *Window) Top(n int) []KeyCount {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	epoch := w.epoch()
+	oldest := epoch - int64(len(w.buckets)) + 1
+
+	totals := make(map[string]int)
+	for _, b := range w.buckets {
+		if b.epoch < oldest || b.epoch > epoch {
+			continue
+		}
+
+		for k, c := range b.counts {
+			totals[k] += c
+		}
+	}
+
+	top := make([]KeyCount, 0, len(totals))
+	for k, c := range totals {
+		top = append(top, KeyCount{Key: k, Count: c})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
@@ -15,8 +15,12 @@
 package quotas
 
 import (
+	"strings"
+	"time"
+
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
 )
 
 type quota struct {
@@ -42,6 +46,7 @@ type Result interface {
 	Allowed() bool
 	Reason() string
 	Resources() []payloads.RequestedResource
+	Denied() []payloads.Resource
 }
 
 type consumeOp struct {
@@ -66,15 +71,32 @@ type dumpOp struct {
 	ch       chan []types.QuotaDetails
 }
 
+type headroomOp struct {
+	tenantID  string
+	resources []payloads.RequestedResource
+	ch        chan int
+}
+
 type deleteTenantOp struct {
 	tenantID string
 	doneCh   chan struct{}
 }
 
+type auditorOp struct {
+	auditor Auditor
+	doneCh  chan struct{}
+}
+
+// Auditor is given a record of every change in the consumption of a
+// resource subject to a quota.  It is called by the goroutine of the quota
+// service so it must not block.
+type Auditor func(record types.QuotaAuditRecord)
+
 type result struct {
 	allowed   bool
 	reason    string
 	resources []payloads.RequestedResource
+	denied    []payloads.Resource
 }
 
 var supportedResources = [...]payloads.Resource{
@@ -87,6 +109,53 @@ var supportedResources = [...]payloads.Resource{
 	payloads.ExternalIP,
 }
 
+const (
+	workloadScopePrefix    = "workload:"
+	workloadInstanceSuffix = ":instances"
+)
+
+// WorkloadInstances returns the resource which counts the instances of the
+// workload workloadID.  Its quota, named in the same way, limits how many
+// instances of the workload a tenant may run.
+func WorkloadInstances(workloadID string) payloads.Resource {
+	return payloads.Resource(workloadScopePrefix + workloadID + workloadInstanceSuffix)
+}
+
+// WorkloadResource reports whether r is scoped to a workload, as returned by
+// WorkloadInstances, and if so the ID of that workload.
+func WorkloadResource(r payloads.Resource) (string, bool) {
+	name := string(r)
+	if !strings.HasPrefix(name, workloadScopePrefix) ||
+		!strings.HasSuffix(name, workloadInstanceSuffix) {
+		return "", false
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(name, workloadScopePrefix), workloadInstanceSuffix)
+	u, err := uuid.Parse(id)
+	if err != nil || u.String() != id {
+		return "", false
+	}
+
+	return id, true
+}
+
+// getQuota returns the quota of a tenant for resource r.  The quotas of
+// resources scoped to a workload are only created when create is true.
+func getQuota(td *tenantData, r payloads.Resource, create bool) (*quota, bool) {
+	q, ok := td.quotas[r]
+	if ok || !create {
+		return q, ok
+	}
+
+	if _, scoped := WorkloadResource(r); !scoped {
+		return nil, false
+	}
+
+	q = &quota{-1, 0}
+	td.quotas[r] = q
+	return q, true
+}
+
 func makeTentantData() *tenantData {
 	td := tenantData{}
 	td.quotas = make(map[payloads.Resource]*quota)
@@ -114,22 +183,21 @@ func getTenantData(tenantDetails map[string]*tenantData, tenantID string) *tenan
 
 func consumeQuota(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 	td := getTenantData(tenantDetails, op.tenantID)
-	allowed := true
+	res := &result{resources: op.resources}
 
 	for _, r := range op.resources {
-		q, ok := td.quotas[r.Type]
+		q, ok := getQuota(td, r.Type, true)
 
 		if ok {
 			q.consumed += r.Value
 			if q.limit > -1 && q.consumed > q.limit {
-				allowed = false
+				res.denied = append(res.denied, r.Type)
 			}
 		}
 	}
 
-	res := &result{resources: op.resources}
-	res.allowed = allowed
-	if !allowed {
+	res.allowed = len(res.denied) == 0
+	if !res.allowed {
 		// TODO: produce more precise reason
 		res.reason = "Over quota"
 	}
@@ -138,38 +206,79 @@ func consumeQuota(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 
 func checkLimit(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 	td := getTenantData(tenantDetails, op.tenantID)
+	res := &result{resources: op.resources}
 
-	allowed := true
 	for _, r := range op.resources {
+		limit := -1
 		switch r.Type {
 		case payloads.VCPUs:
-			if td.perInstanceVCPUs > -1 && r.Value > td.perInstanceVCPUs {
-				allowed = false
-			}
+			limit = td.perInstanceVCPUs
 		case payloads.MemMB:
-			if td.perInstanceMemory > -1 && r.Value > td.perInstanceMemory {
-				allowed = false
-			}
+			limit = td.perInstanceMemory
 		case payloads.SharedDiskGiB:
-			if td.perVolumeSize > -1 && r.Value > td.perVolumeSize {
-				allowed = false
-			}
+			limit = td.perVolumeSize
+		}
+
+		if limit > -1 && r.Value > limit {
+			res.denied = append(res.denied, r.Type)
 		}
 	}
-	res := &result{resources: op.resources}
-	res.allowed = allowed
-	if !allowed {
+
+	res.allowed = len(res.denied) == 0
+	if !res.allowed {
 		// TODO: produce more precise reason
 		res.reason = "Over limit"
 	}
 	return res
 }
 
+func headroom(tenantDetails map[string]*tenantData, op *headroomOp) int {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	needed := make(map[payloads.Resource]int)
+	for _, r := range op.resources {
+		limit := -1
+		switch r.Type {
+		case payloads.VCPUs:
+			limit = td.perInstanceVCPUs
+		case payloads.MemMB:
+			limit = td.perInstanceMemory
+		case payloads.SharedDiskGiB:
+			limit = td.perVolumeSize
+		}
+
+		if limit > -1 && r.Value > limit {
+			return 0
+		}
+
+		needed[r.Type] += r.Value
+	}
+
+	count := -1
+	for r, value := range needed {
+		q, ok := td.quotas[r]
+		if !ok || q.limit < 0 || value <= 0 {
+			continue
+		}
+
+		n := 0
+		if q.consumed < q.limit {
+			n = (q.limit - q.consumed) / value
+		}
+
+		if count < 0 || n < count {
+			count = n
+		}
+	}
+
+	return count
+}
+
 func release(tenantDetails map[string]*tenantData, op *releaseOp) {
 	td := getTenantData(tenantDetails, op.tenantID)
 
 	for _, r := range op.resources {
-		q, ok := td.quotas[r.Type]
+		q, ok := getQuota(td, r.Type, false)
 
 		if ok {
 			q.consumed -= r.Value
@@ -180,6 +289,52 @@ func release(tenantDetails map[string]*tenantData, op *releaseOp) {
 	}
 }
 
+// audit passes the records of the consumption or release of resources by
+// a tenant to the auditor, if there is one.  sign is 1 when the resources
+// are consumed and -1 when they are released.
+func audit(auditor Auditor, tenantDetails map[string]*tenantData, tenantID string,
+	resources []payloads.RequestedResource, sign int, allowed bool) {
+	if auditor == nil {
+		return
+	}
+
+	td := getTenantData(tenantDetails, tenantID)
+	now := time.Now()
+
+	for _, r := range resources {
+		q, ok := td.quotas[r.Type]
+		if !ok || r.Value == 0 {
+			continue
+		}
+
+		auditor(types.QuotaAuditRecord{
+			TenantID:  tenantID,
+			Resource:  string(r.Type),
+			Delta:     sign * r.Value,
+			Usage:     q.consumed,
+			Allowed:   allowed,
+			Timestamp: now,
+		})
+	}
+}
+
+// AuditResource returns the resource subject to a quota which is named
+// name, or by its plural, e.g., "instance" or "instances".  Resources scoped
+// to a workload are named as their quota.
+func AuditResource(name string) (payloads.Resource, bool) {
+	if _, ok := WorkloadResource(payloads.Resource(name)); ok {
+		return payloads.Resource(name), true
+	}
+
+	for _, r := range supportedResources {
+		if name == string(r) || name == string(r)+"s" {
+			return r, true
+		}
+	}
+
+	return "", false
+}
+
 func quotaNameToResource(name string) payloads.Resource {
 	switch name {
 	case "tenant-vcpu-quota":
@@ -198,6 +353,10 @@ func quotaNameToResource(name string) payloads.Resource {
 		return payloads.ExternalIP
 	}
 
+	if _, ok := WorkloadResource(payloads.Resource(name)); ok {
+		return payloads.Resource(name)
+	}
+
 	return ""
 }
 
@@ -218,9 +377,26 @@ func resourceToQuotaName(r payloads.Resource) string {
 	case payloads.ExternalIP:
 		return "tenant-external-ips-quota"
 	}
+
+	if _, ok := WorkloadResource(r); ok {
+		return string(r)
+	}
+
 	return ""
 }
 
+// ValidName reports whether name is the name of a quota or limit.
+func ValidName(name string) bool {
+	switch name {
+	case "tenant-vcpu-per-instance-limit",
+		"tenant-mem-per-instance-limit",
+		"tenant-volume-size-limit":
+		return true
+	}
+
+	return quotaNameToResource(name) != ""
+}
+
 func update(tenantDetails map[string]*tenantData, op *updateOp) {
 	td := getTenantData(tenantDetails, op.tenantID)
 
@@ -228,7 +404,8 @@ func update(tenantDetails map[string]*tenantData, op *updateOp) {
 		r := quotaNameToResource(q.Name)
 
 		if r != "" {
-			td.quotas[r].limit = q.Value
+			quota, _ := getQuota(td, r, true)
+			quota.limit = q.Value
 		}
 
 		switch q.Name {
@@ -252,6 +429,11 @@ func dump(tenantDetails map[string]*tenantData, op *dumpOp) []types.QuotaDetails
 	qds := []types.QuotaDetails{}
 
 	for r, q := range td.quotas {
+		// The quotas of workloads are only listed once they are set
+		if _, scoped := WorkloadResource(r); scoped && q.limit < 0 {
+			continue
+		}
+
 		name := resourceToQuotaName(r)
 		if name != "" {
 			qd := types.QuotaDetails{
@@ -288,6 +470,7 @@ func (qs *Quotas) Init() {
 
 	go func() {
 		tenantDetails := make(map[string]*tenantData)
+		var auditor Auditor
 
 		for {
 			data, more := <-qs.ch
@@ -299,17 +482,20 @@ func (qs *Quotas) Init() {
 
 			case *consumeOp:
 				res := consumeQuota(tenantDetails, op)
-				if !res.Allowed() {
-					op.ch <- res
-					close(op.ch)
-					continue
+				if res.Allowed() {
+					res = checkLimit(tenantDetails, op)
 				}
-				res = checkLimit(tenantDetails, op)
+				audit(auditor, tenantDetails, op.tenantID, op.resources, 1, res.Allowed())
 				op.ch <- res
 				close(op.ch)
 
 			case *releaseOp:
 				release(tenantDetails, op)
+				audit(auditor, tenantDetails, op.tenantID, op.resources, -1, true)
+
+			case *auditorOp:
+				auditor = op.auditor
+				close(op.doneCh)
 
 			case *updateOp:
 				update(tenantDetails, op)
@@ -319,6 +505,10 @@ func (qs *Quotas) Init() {
 				op.ch <- dump(tenantDetails, op)
 				close(op.ch)
 
+			case *headroomOp:
+				op.ch <- headroom(tenantDetails, op)
+				close(op.ch)
+
 			case *deleteTenantOp:
 				deleteTenant(tenantDetails, op)
 				close(op.doneCh)
@@ -388,6 +578,16 @@ func (qs *Quotas) DeleteTenant(tenantID string) {
 	<-ch
 }
 
+// SetAuditor makes the quota service pass a record of every subsequent
+// consumption and release of resources subject to a quota to auditor.  A
+// nil auditor stops the records being made.
+func (qs *Quotas) SetAuditor(auditor Auditor) {
+	ch := make(chan struct{})
+	op := &auditorOp{auditor, ch}
+	qs.ch <- op
+	<-ch
+}
+
 // DumpQuotas provides the list of quotas and limits along with usage
 // for a given tenant
 func (qs *Quotas) DumpQuotas(tenantID string) []types.QuotaDetails {
@@ -398,6 +598,16 @@ func (qs *Quotas) DumpQuotas(tenantID string) []types.QuotaDetails {
 	return qds
 }
 
+// Headroom returns how many more times the tenant could consume resources
+// without exceeding its quotas or limits.  -1 is returned when none of the
+// resources are subject to a quota.
+func (qs *Quotas) Headroom(tenantID string, resources ...payloads.RequestedResource) int {
+	ch := make(chan int, 1)
+	op := &headroomOp{tenantID, copyResources(resources), ch}
+	qs.ch <- op
+	return <-ch
+}
+
 // Allowed indicates whether the desired consumption should be permitted.
 func (r *result) Allowed() bool {
 	return r.allowed
@@ -413,3 +623,9 @@ func (r *result) Reason() string {
 func (r *result) Resources() []payloads.RequestedResource {
 	return r.resources
 }
+
+// Denied gives the types of the resources which caused the request to be
+// denied.
+func (r *result) Denied() []payloads.Resource {
+	return r.denied
+}
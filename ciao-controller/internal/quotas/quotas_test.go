@@ -45,6 +45,9 @@ func TestConsumeAndRelease(t *testing.T) {
 	if res2.Allowed() {
 		t.Fatal("Expected to be denied")
 	}
+	if !reflect.DeepEqual(res2.Denied(), []payloads.Resource{payloads.VCPUs}) {
+		t.Fatalf("Expected vcpus to be denied, got %v", res2.Denied())
+	}
 	// If denied we are responsible for releasing
 	qs.Release("test-tenant-1", res2.Resources()...)
 
@@ -61,6 +64,66 @@ func TestConsumeAndRelease(t *testing.T) {
 	qs.Shutdown()
 }
 
+func TestWorkloadQuota(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+	defer qs.Shutdown()
+
+	wl := WorkloadInstances("b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b")
+	other := WorkloadInstances("e35ed972-c46c-4aad-a1e7-ef103ae079a2")
+
+	// Instances of a workload are not limited until its quota is set
+	res := <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: wl, Value: 1})
+	if !res.Allowed() {
+		t.Fatal("Expected to be allowed")
+	}
+
+	for _, qd := range qs.DumpQuotas("test-tenant-1") {
+		if qd.Name == string(wl) {
+			t.Fatalf("Unset workload quota listed: %+v", qd)
+		}
+	}
+
+	qs.Update("test-tenant-1", []types.QuotaDetails{{Name: string(wl), Value: 2}})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"), types.QuotaDetails{Name: string(wl), Value: 2, Usage: 1})
+
+	res = <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: wl, Value: 1})
+	if !res.Allowed() {
+		t.Fatal("Expected to be allowed")
+	}
+
+	res = <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: wl, Value: 1})
+	if res.Allowed() {
+		t.Fatal("Expected to be denied")
+	}
+	if !reflect.DeepEqual(res.Denied(), []payloads.Resource{wl}) {
+		t.Fatalf("Expected workload instances to be denied, got %v", res.Denied())
+	}
+	qs.Release("test-tenant-1", res.Resources()...)
+
+	// Other workloads and tenants are not affected
+	res = <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: other, Value: 1})
+	if !res.Allowed() {
+		t.Fatal("Expected other workload to be allowed")
+	}
+	res = <-qs.Consume("test-tenant-2", payloads.RequestedResource{Type: wl, Value: 1})
+	if !res.Allowed() {
+		t.Fatal("Expected other tenant to be allowed")
+	}
+
+	if n := qs.Headroom("test-tenant-1", payloads.RequestedResource{Type: wl, Value: 1}); n != 0 {
+		t.Fatalf("Expected no headroom, got %d", n)
+	}
+
+	qs.Release("test-tenant-1", payloads.RequestedResource{Type: wl, Value: 1})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"), types.QuotaDetails{Name: string(wl), Value: 2, Usage: 1})
+
+	// Releasing a workload which was never consumed does not create its quota
+	qs.Release("test-tenant-3", payloads.RequestedResource{Type: wl, Value: 1})
+	qs.Update("test-tenant-3", []types.QuotaDetails{{Name: string(wl), Value: 1}})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-3"), types.QuotaDetails{Name: string(wl), Value: 1, Usage: 0})
+}
+
 func testHasQuota(t *testing.T, qds []types.QuotaDetails, qd types.QuotaDetails) {
 	for i := range qds {
 		if reflect.DeepEqual(qd, qds[i]) {
@@ -177,6 +240,29 @@ func TestResourceQuotaMapping(t *testing.T) {
 	}
 }
 
+func TestValidName(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+	defer qs.Shutdown()
+
+	for _, qd := range qs.DumpQuotas("test-tenant-1") {
+		if !ValidName(qd.Name) {
+			t.Errorf("Expected %s to be valid", qd.Name)
+		}
+	}
+
+	if !ValidName(string(WorkloadInstances("b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b"))) {
+		t.Error("Expected workload instances quota to be valid")
+	}
+
+	for _, name := range []string{"", "tenant-vcpu", "tenant-bogus-quota",
+		"workload:b4f8a7ab:instances", "workload:b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b:vcpus"} {
+		if ValidName(name) {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
+
 func TestAllLimits(t *testing.T) {
 	qs := &Quotas{}
 	qs.Init()
@@ -216,6 +302,9 @@ func TestAllLimits(t *testing.T) {
 		if r.Allowed() && r.Reason() != "Over limit" {
 			t.Fatalf("Expected to be over limit for: %s", rr.Type)
 		}
+		if !reflect.DeepEqual(r.Denied(), []payloads.Resource{rr.Type}) {
+			t.Fatalf("Expected %s to be denied, got %v", rr.Type, r.Denied())
+		}
 	}
 
 	// Under limit tests
@@ -240,3 +329,122 @@ func TestAllLimits(t *testing.T) {
 		}
 	}
 }
+
+func TestHeadroom(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	instance := []payloads.RequestedResource{
+		{Type: payloads.Instance, Value: 1},
+		{Type: payloads.VCPUs, Value: 2},
+		{Type: payloads.MemMB, Value: 256},
+	}
+
+	if n := qs.Headroom("test-tenant-1", instance...); n != -1 {
+		t.Fatalf("Expected unlimited headroom, got %d", n)
+	}
+
+	quotas := []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 10},
+		{Name: "tenant-vcpu-quota", Value: 9},
+	}
+	qs.Update("test-tenant-1", quotas)
+
+	if n := qs.Headroom("test-tenant-1", instance...); n != 4 {
+		t.Fatalf("Expected headroom of 4, got %d", n)
+	}
+
+	<-qs.Consume("test-tenant-1", instance...)
+	if n := qs.Headroom("test-tenant-1", instance...); n != 3 {
+		t.Fatalf("Expected headroom of 3, got %d", n)
+	}
+
+	// resources of the same type are summed
+	twice := append(instance, payloads.RequestedResource{Type: payloads.VCPUs, Value: 2})
+	if n := qs.Headroom("test-tenant-1", twice...); n != 1 {
+		t.Fatalf("Expected headroom of 1, got %d", n)
+	}
+
+	qs.Update("test-tenant-1", []types.QuotaDetails{
+		{Name: "tenant-mem-per-instance-limit", Value: 128},
+	})
+	if n := qs.Headroom("test-tenant-1", instance...); n != 0 {
+		t.Fatalf("Expected no headroom over limit, got %d", n)
+	}
+
+	qs.Shutdown()
+}
+
+func TestAuditor(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+	defer qs.Shutdown()
+
+	var records []types.QuotaAuditRecord
+	qs.SetAuditor(func(r types.QuotaAuditRecord) {
+		records = append(records, r)
+	})
+
+	qs.Update("test-tenant-1", []types.QuotaDetails{{Name: "tenant-instances-quota", Value: 1}})
+
+	res := <-qs.Consume("test-tenant-1",
+		payloads.RequestedResource{Type: payloads.Instance, Value: 1},
+		payloads.RequestedResource{Type: payloads.NetworkNode, Value: 0})
+	if !res.Allowed() {
+		t.Fatal("Expected to be allowed")
+	}
+
+	res = <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: payloads.Instance, Value: 1})
+	if res.Allowed() {
+		t.Fatal("Expected to be denied")
+	}
+	qs.Release("test-tenant-1", res.Resources()...)
+
+	qs.SetAuditor(nil)
+	qs.Release("test-tenant-1", payloads.RequestedResource{Type: payloads.Instance, Value: 1})
+
+	expected := []types.QuotaAuditRecord{
+		{TenantID: "test-tenant-1", Resource: "instance", Delta: 1, Usage: 1, Allowed: true},
+		{TenantID: "test-tenant-1", Resource: "instance", Delta: 1, Usage: 2, Allowed: false},
+		{TenantID: "test-tenant-1", Resource: "instance", Delta: -1, Usage: 1, Allowed: true},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d audit records, got %d: %+v", len(expected), len(records), records)
+	}
+
+	for i := range records {
+		if records[i].Timestamp.IsZero() {
+			t.Errorf("Audit record %d has no timestamp", i)
+		}
+		records[i].Timestamp = expected[i].Timestamp
+		if records[i] != expected[i] {
+			t.Errorf("Expected audit record %+v, got %+v", expected[i], records[i])
+		}
+	}
+}
+
+func TestAuditResource(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource payloads.Resource
+		ok       bool
+	}{
+		{"instance", payloads.Instance, true},
+		{"instances", payloads.Instance, true},
+		{"vcpus", payloads.VCPUs, true},
+		{"external_ips", payloads.ExternalIP, true},
+		{"workload:b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b:instances",
+			WorkloadInstances("b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b"), true},
+		{"workload:bogus:instances", "", false},
+		{"network_node", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		r, ok := AuditResource(test.name)
+		if r != test.resource || ok != test.ok {
+			t.Errorf("AuditResource(%q) = %q, %v: expected %q, %v", test.name, r, ok, test.resource, test.ok)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func testLaunchFailure(t *testing.T, w types.WorkloadRequest, expected types.LaunchFailureCode) {
+	_, err := ctl.startWorkload(context.Background(), w)
+	if err == nil {
+		t.Fatalf("Expected launch to fail with %s", expected)
+	}
+
+	if code := launchFailureCode(err); code != expected {
+		t.Fatalf("Expected failure code %s, got %q: %v", expected, code, err)
+	}
+}
+
+func launchFailureRequest(t *testing.T, tenant *types.Tenant) types.WorkloadRequest {
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	return types.WorkloadRequest{
+		WorkloadID: wls[0].ID,
+		TenantID:   tenant.ID,
+		Instances:  1,
+	}
+}
+
+func TestLaunchFailureQuotaExceeded(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 0},
+	})
+	defer ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: -1},
+	})
+
+	testLaunchFailure(t, launchFailureRequest(t, tenant), types.LaunchQuotaExceeded)
+}
+
+func TestLaunchFailureInvalidRequest(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := launchFailureRequest(t, tenant)
+	w.Instances = 0
+	testLaunchFailure(t, w, types.LaunchInvalidRequest)
+
+	w = launchFailureRequest(t, tenant)
+	w.Instances = 2
+	w.Volumes = []string{uuid.Generate().String()}
+	testLaunchFailure(t, w, types.LaunchInvalidRequest)
+
+	w = launchFailureRequest(t, tenant)
+	w.Name = "launch-failure"
+	_, err = ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLaunchFailure(t, w, types.LaunchInvalidRequest)
+}
+
+func TestLaunchFailureStorageError(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := launchFailureRequest(t, tenant)
+	w.Volumes = []string{uuid.Generate().String()}
+	testLaunchFailure(t, w, types.LaunchStorageError)
+}
+
+func TestLaunchFailureNetworkNotReady(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no CNCI has been launched for the subnet of the address
+	var networking payloads.NetworkResources
+	err = networkConfig(ctl, tenant, &networking, false, net.ParseIP("172.16.0.2"))
+	if code := launchFailureCode(err); code != types.LaunchNetworkNotReady {
+		t.Fatalf("Expected failure code %s, got %q: %v", types.LaunchNetworkNotReady, code, err)
+	}
+}
+
+func TestLaunchFailureNetworkFull(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.ds.JSONPatchTenant(tenant.ID, []byte(`{"max_subnets":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tenant's single /24 has room for 253 instances
+	w := launchFailureRequest(t, tenant)
+	w.Instances = 254
+	testLaunchFailure(t, w, types.LaunchNetworkFull)
+}
+
+func TestLaunchFailureLogged(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 0},
+	})
+	defer ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: -1},
+	})
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	var req api.CreateServerRequest
+	req.Server.WorkloadID = wls[0].ID
+	_, err = ctl.CreateServer(context.Background(), tenant.ID, req)
+	if launchFailureCode(err) != types.LaunchQuotaExceeded {
+		t.Fatalf("Expected quota failure, got %v", err)
+	}
+
+	events, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events {
+		if e.FailureCode == string(types.LaunchQuotaExceeded) {
+			return
+		}
+	}
+	t.Fatal("Launch failure not logged with its failure code")
+}
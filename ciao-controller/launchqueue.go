@@ -0,0 +1,338 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
+
+// launchQueueCheckPeriod is how often the launch queues are drained, in
+// addition to whenever the launches in progress may have changed.
+const launchQueueCheckPeriod = 30 * time.Second
+
+// launchQueueState holds, for each tenant, the launches held back by the
+// tenant launch limit in the order in which they were made.  starting
+// counts the launches admitted which are not yet pending in the datastore,
+// so that concurrent launches cannot together exceed the limit.
+type launchQueueState struct {
+	sync.Mutex
+	queues   map[string][]types.QueuedLaunch
+	starting map[string]int
+	sequence int64
+	wakeCh   chan struct{}
+}
+
+func (q *launchQueueState) init() {
+	if q.queues == nil {
+		q.queues = make(map[string][]types.QueuedLaunch)
+		q.starting = make(map[string]int)
+	}
+}
+
+func (q *launchQueueState) wakeChannel() chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.wakeCh == nil {
+		q.wakeCh = make(chan struct{}, 1)
+	}
+	return q.wakeCh
+}
+
+// wake makes the launch queues be drained straight away, e.g. because a
+// launch has completed or the launch limit has changed.
+func (q *launchQueueState) wake() {
+	select {
+	case q.wakeChannel() <- struct{}{}:
+	default:
+	}
+}
+
+// loadLaunchQueue restores the launch queues from the datastore when the
+// controller starts.
+func (c *controller) loadLaunchQueue() error {
+	launches, err := c.ds.GetQueuedLaunches()
+	if err != nil {
+		return errors.Wrap(err, "Error getting queued launches")
+	}
+
+	q := &c.launchQueue
+	q.Lock()
+	defer q.Unlock()
+
+	q.init()
+	q.queues = make(map[string][]types.QueuedLaunch)
+	for _, l := range launches {
+		q.queues[l.TenantID] = append(q.queues[l.TenantID], l)
+		if l.Sequence > q.sequence {
+			q.sequence = l.Sequence
+		}
+	}
+
+	return nil
+}
+
+// launchesInProgress returns the number of launches of a tenant which have
+// yet to complete.  The caller must hold the launch queue lock.
+func (c *controller) launchesInProgress(tenantID string) (int, error) {
+	instances, err := c.ds.GetAllInstancesFromTenant(tenantID)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error getting tenant instances")
+	}
+
+	n := c.launchQueue.starting[tenantID]
+	for _, i := range instances {
+		if i.State == payloads.Pending {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// admitLaunch decides whether an instance may be started straight away or
+// must wait for earlier launches of its tenant to complete.  An instance
+// which must wait is added to the datastore and queued, or rejected if the
+// launch queue is disabled.  admitLaunch returns true if the instance was
+// queued.  Otherwise the caller must call launchStarted once the instance
+// has been added to the datastore.
+func (c *controller) admitLaunch(ctx context.Context, i *instance, traceLabel string) (bool, error) {
+	// CNCIs are launched by the controller itself and are not limited.
+	if i.CNCI {
+		return false, nil
+	}
+
+	limit := c.intSetting(settingTenantLaunchLimit)
+
+	q := &c.launchQueue
+	q.Lock()
+	defer q.Unlock()
+
+	q.init()
+	if limit == 0 {
+		q.starting[i.TenantID]++
+		return false, nil
+	}
+
+	inProgress, err := c.launchesInProgress(i.TenantID)
+	if err != nil {
+		return false, launchFailure(types.LaunchInternal, err)
+	}
+
+	// launches are not admitted ahead of those already queued
+	if len(q.queues[i.TenantID]) == 0 && inProgress < limit {
+		q.starting[i.TenantID]++
+		return false, nil
+	}
+
+	if !c.boolSetting(settingTenantLaunchQueue) {
+		return false, launchFailure(types.LaunchLimitExceeded, types.ErrLaunchLimit)
+	}
+
+	i.State = payloads.Queued
+	err = i.Add(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	l := types.QueuedLaunch{
+		InstanceID: i.ID,
+		TenantID:   i.TenantID,
+		Sequence:   q.sequence + 1,
+		Config:     i.newConfig.config,
+		TraceLabel: traceLabel,
+		QueueTime:  i.startTime,
+	}
+
+	err = c.ds.QueueLaunch(l)
+	if err != nil {
+		// the ephemeral volumes must be deleted while their
+		// attachments still identify them.
+		_ = c.deleteEphemeralStorage(i.ID)
+		_ = c.ds.DeleteInstance(i.ID)
+		return false, launchFailure(types.LaunchInternal, errors.Wrap(err, "Error queueing launch"))
+	}
+
+	q.sequence = l.Sequence
+	q.queues[i.TenantID] = append(q.queues[i.TenantID], l)
+
+	msg := fmt.Sprintf("Launch of instance %s queued at position %d", i.ID, len(q.queues[i.TenantID]))
+	if err := c.ds.LogEvent(i.TenantID, msg); err != nil {
+		c.instanceLog(i.Instance).Warningf("Error logging event: %v", err)
+	}
+
+	return true, nil
+}
+
+// launchStarted records that an admitted instance of a tenant has been
+// added to the datastore, or has failed to be.
+func (c *controller) launchStarted(tenantID string) {
+	q := &c.launchQueue
+	q.Lock()
+	defer q.Unlock()
+
+	q.init()
+	if q.starting[tenantID]--; q.starting[tenantID] <= 0 {
+		delete(q.starting, tenantID)
+	}
+}
+
+// launchQueuePosition returns the position, starting at 1, of the launch of
+// an instance in its tenant's launch queue, or 0 if it is not queued.
+func (c *controller) launchQueuePosition(i *types.Instance) int {
+	q := &c.launchQueue
+	q.Lock()
+	defer q.Unlock()
+
+	for pos, l := range q.queues[i.TenantID] {
+		if l.InstanceID == i.ID {
+			return pos + 1
+		}
+	}
+
+	return 0
+}
+
+// cancelQueuedLaunch removes the launch of an instance from its tenant's
+// launch queue, returning false if it is no longer queued.
+func (c *controller) cancelQueuedLaunch(i *types.Instance) bool {
+	q := &c.launchQueue
+	q.Lock()
+	defer q.Unlock()
+
+	queue := q.queues[i.TenantID]
+	for pos, l := range queue {
+		if l.InstanceID == i.ID {
+			q.queues[i.TenantID] = append(queue[:pos:pos], queue[pos+1:]...)
+			if len(q.queues[i.TenantID]) == 0 {
+				delete(q.queues, i.TenantID)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// startQueuedLaunch starts an instance whose launch has left the queue.
+// An instance which cannot be started is removed along with its resources.
+func (c *controller) startQueuedLaunch(l types.QueuedLaunch) error {
+	i, err := c.ds.GetInstance(l.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.DequeueLaunch(l.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	if l.TraceLabel == "" {
+		err = c.client.StartWorkload(l.Config)
+	} else {
+		err = c.client.StartTracedWorkload(l.Config, l.QueueTime, l.TraceLabel)
+	}
+
+	if err != nil {
+		c.addHistory(i, types.InstanceHistoryEntry{
+			Type:    types.HistoryResult,
+			Message: fmt.Sprintf("Start failed: %v", err),
+		})
+		c.client.RemoveInstance(i.ID)
+		return errors.Wrap(err, "Error starting workload")
+	}
+
+	c.recordCommand(i, "start")
+
+	return nil
+}
+
+// startQueuedLaunches starts, oldest first, the queued launches of each
+// tenant for which the tenant has room within its launch limit.  Launches
+// are started for every tenant on each pass so that one tenant's queue does
+// not hold up another's.  It returns the number of launches started.
+func (c *controller) startQueuedLaunches() int {
+	limit := c.intSetting(settingTenantLaunchLimit)
+
+	q := &c.launchQueue
+	q.Lock()
+	q.init()
+
+	tenants := make([]string, 0, len(q.queues))
+	for tenantID := range q.queues {
+		tenants = append(tenants, tenantID)
+	}
+	sort.Strings(tenants)
+
+	var launches []types.QueuedLaunch
+	for _, tenantID := range tenants {
+		inProgress, err := c.launchesInProgress(tenantID)
+		if err != nil {
+			c.log.Warningf("Unable to drain launch queue of tenant %s: %v", tenantID, err)
+			continue
+		}
+
+		queue := q.queues[tenantID]
+		n := 0
+		for ; n < len(queue) && (limit == 0 || inProgress+n < limit); n++ {
+			launches = append(launches, queue[n])
+		}
+
+		q.starting[tenantID] += n
+		if n == len(queue) {
+			delete(q.queues, tenantID)
+		} else {
+			q.queues[tenantID] = queue[n:]
+		}
+	}
+
+	q.Unlock()
+
+	for _, l := range launches {
+		err := c.startQueuedLaunch(l)
+		if err != nil {
+			c.log.Warningf("Unable to start queued instance %s: %v", l.InstanceID, err)
+		}
+		c.launchStarted(l.TenantID)
+	}
+
+	return len(launches)
+}
+
+// drainLaunchQueues starts queued launches as earlier launches complete
+// until the controller is shut down.
+func (c *controller) drainLaunchQueues() {
+	ticker := time.NewTicker(launchQueueCheckPeriod)
+	defer ticker.Stop()
+
+	wakeCh := c.launchQueue.wakeChannel()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wakeCh:
+		case <-c.ctx.Done():
+			return
+		}
+		c.startQueuedLaunches()
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func setTestLaunchLimit(t *testing.T, limit string, queue string) {
+	for key, value := range map[string]string{
+		settingTenantLaunchLimit: limit,
+		settingTenantLaunchQueue: queue,
+	} {
+		if _, err := ctl.UpdateSetting(context.Background(), key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func resetTestLaunchLimit(t *testing.T) {
+	resetTestSetting(t, settingTenantLaunchLimit)
+	resetTestSetting(t, settingTenantLaunchQueue)
+}
+
+// launchTestInstances launches num instances of the tenant's workload one
+// at a time so that they are queued in order.
+func launchTestInstances(t *testing.T, tenant *types.Tenant, num int) []*types.Instance {
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instances []*types.Instance
+	for i := 0; i < num; i++ {
+		launched, err := ctl.startWorkload(context.Background(), types.WorkloadRequest{
+			WorkloadID: wls[0].ID,
+			TenantID:   tenant.ID,
+			Instances:  1,
+			Name:       fmt.Sprintf("queue-%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, launched...)
+	}
+
+	return instances
+}
+
+// expectLaunchStates checks the state and the queue position of each
+// instance, a position of 0 meaning the instance is pending.
+func expectLaunchStates(t *testing.T, instances []*types.Instance, positions []int) {
+	for n, i := range instances {
+		i, err := ctl.ds.GetInstance(i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server, err := instanceToServer(ctl, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state := payloads.Pending
+		if positions[n] != 0 {
+			state = payloads.Queued
+		}
+
+		if server.Status != state || server.QueuePosition != positions[n] {
+			t.Fatalf("Expected instance %d to be %s at position %d, got %s at %d",
+				n, state, positions[n], server.Status, server.QueuePosition)
+		}
+	}
+}
+
+func TestLaunchQueueFairness(t *testing.T) {
+	setTestLaunchLimit(t, "2", "true")
+	defer resetTestLaunchLimit(t)
+
+	client, err := testutil.NewSsntpTestClientConnection("LaunchQueue", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	busy, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quiet, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busyInstances := launchTestInstances(t, busy, 5)
+	expectLaunchStates(t, busyInstances, []int{0, 0, 1, 2, 3})
+
+	// the other tenant's launches are not held up by the busy queue
+	quietInstances := launchTestInstances(t, quiet, 3)
+	expectLaunchStates(t, quietInstances, []int{0, 0, 1})
+
+	if n := ctl.startQueuedLaunches(); n != 0 {
+		t.Fatalf("Expected no launches to be started, got %d", n)
+	}
+
+	// a completed launch lets each tenant start the next in its queue
+	for _, i := range []*types.Instance{busyInstances[0], quietInstances[0]} {
+		err = ctl.ds.AdoptInstance(i.ID, testutil.AgentUUID, payloads.Running)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := ctl.startQueuedLaunches(); n != 2 {
+		t.Fatalf("Expected 2 launches to be started, got %d", n)
+	}
+
+	expectLaunchStates(t, busyInstances[1:], []int{0, 0, 1, 2})
+	expectLaunchStates(t, quietInstances[1:], []int{0, 0})
+}
+
+func TestLaunchQueueDrainOrder(t *testing.T) {
+	setTestLaunchLimit(t, "1", "true")
+	defer resetTestLaunchLimit(t)
+
+	client, err := testutil.NewSsntpTestClientConnection("LaunchQueue", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances := launchTestInstances(t, tenant, 4)
+	expectLaunchStates(t, instances, []int{0, 1, 2, 3})
+
+	// the queue survives a restart of the controller
+	ctl.launchQueue.Lock()
+	ctl.launchQueue.queues = nil
+	ctl.launchQueue.Unlock()
+
+	err = ctl.loadLaunchQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLaunchStates(t, instances, []int{0, 1, 2, 3})
+
+	err = ctl.ds.AdoptInstance(instances[0].ID, testutil.AgentUUID, payloads.Running)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ctl.startQueuedLaunches(); n != 1 {
+		t.Fatalf("Expected 1 launch to be started, got %d", n)
+	}
+	expectLaunchStates(t, instances[1:], []int{0, 1, 2})
+
+	// a failed launch also makes room for the next
+	err = ctl.ds.StartFailure(instances[1].ID, payloads.FullCloud, false, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ctl.startQueuedLaunches(); n != 1 {
+		t.Fatalf("Expected 1 launch to be started, got %d", n)
+	}
+	expectLaunchStates(t, instances[2:], []int{0, 1})
+
+	// deleting a queued instance removes it from the queue
+	err = ctl.deleteInstance(context.Background(), instances[3].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := ctl.ds.GetInstance(instances[3].ID); err != nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Queued instance was not deleted")
+		}
+	}
+
+	if pos := ctl.launchQueuePosition(instances[3]); pos != 0 {
+		t.Fatalf("Deleted instance still queued at position %d", pos)
+	}
+
+	launches, err := ctl.ds.GetQueuedLaunches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range launches {
+		if l.TenantID == tenant.ID {
+			t.Fatalf("Launch of instance %s still queued in the datastore", l.InstanceID)
+		}
+	}
+}
+
+func TestLaunchLimitReject(t *testing.T) {
+	setTestLaunchLimit(t, "1", "false")
+	defer resetTestLaunchLimit(t)
+
+	client, err := testutil.NewSsntpTestClientConnection("LaunchQueue", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	launchTestInstances(t, tenant, 1)
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.startWorkload(context.Background(), types.WorkloadRequest{
+		WorkloadID: wls[0].ID,
+		TenantID:   tenant.ID,
+		Instances:  1,
+	})
+	if code := launchFailureCode(err); code != types.LaunchLimitExceeded {
+		t.Fatalf("Expected launch to fail with %s, got %s: %v", types.LaunchLimitExceeded, code, err)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+)
+
+// launch template names follow the rules for instance names.
+var launchTemplateNameRegexp = regexp.MustCompile("^[a-z0-9-]{1,64}$")
+
+// decodeLaunchRequest decodes the body of an instance create request
+// rejecting fields which are not part of it.
+func decodeLaunchRequest(request []byte) (api.CreateServerRequest, error) {
+	var req api.CreateServerRequest
+
+	dec := json.NewDecoder(bytes.NewReader(request))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	return req, nil
+}
+
+// validateLaunchRequest checks that the launch request of a template could
+// be used by the tenant to create instances.  The workload must be visible
+// to the tenant and the requirement overrides must lie within its bounds.
+// Quotas and capacity are only checked when instances are created.
+func (c *controller) validateLaunchRequest(tenantID string, request []byte) error {
+	req, err := decodeLaunchRequest(request)
+	if err != nil {
+		return err
+	}
+
+	if err := validateServerRequest(req); err != nil {
+		return &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	if req.Server.WorkloadID == "" {
+		return &types.LaunchRequestError{Reason: "workload_id is required"}
+	}
+
+	wl, err := c.ShowWorkload(tenantID, req.Server.WorkloadID)
+	if err != nil {
+		return &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	if _, err := applyOverrides(wl, serverOverrides(req)); err != nil {
+		return &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	return nil
+}
+
+// ListLaunchTemplates returns the launch templates of a tenant.
+func (c *controller) ListLaunchTemplates(tenantID string) ([]types.LaunchTemplate, error) {
+	return c.ds.GetLaunchTemplates(tenantID), nil
+}
+
+// CreateLaunchTemplate validates and stores a new launch template.
+func (c *controller) CreateLaunchTemplate(tenantID string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error) {
+	if !launchTemplateNameRegexp.MatchString(req.Name) {
+		return types.LaunchTemplate{}, types.ErrBadName
+	}
+
+	if err := c.validateLaunchRequest(tenantID, req.Request); err != nil {
+		return types.LaunchTemplate{}, err
+	}
+
+	now := time.Now()
+	t := types.LaunchTemplate{
+		TenantID:   tenantID,
+		Name:       req.Name,
+		Version:    1,
+		Request:    req.Request,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	if err := c.ds.AddLaunchTemplate(t); err != nil {
+		return types.LaunchTemplate{}, err
+	}
+
+	return t, nil
+}
+
+// ShowLaunchTemplate returns a launch template of a tenant.
+func (c *controller) ShowLaunchTemplate(tenantID string, name string) (types.LaunchTemplate, error) {
+	return c.ds.GetLaunchTemplate(tenantID, name)
+}
+
+// UpdateLaunchTemplate validates and replaces the launch request of a
+// template, incrementing its version.  The name in the request, if any,
+// must match the template's.
+func (c *controller) UpdateLaunchTemplate(tenantID string, name string, req types.LaunchTemplateRequest) (types.LaunchTemplate, error) {
+	if req.Name != "" && req.Name != name {
+		return types.LaunchTemplate{}, types.ErrBadRequest
+	}
+
+	if _, err := c.ds.GetLaunchTemplate(tenantID, name); err != nil {
+		return types.LaunchTemplate{}, err
+	}
+
+	if err := c.validateLaunchRequest(tenantID, req.Request); err != nil {
+		return types.LaunchTemplate{}, err
+	}
+
+	return c.ds.UpdateLaunchTemplate(tenantID, name, req.Request)
+}
+
+// DeleteLaunchTemplate removes a launch template.  Instances launched from
+// it are not affected.
+func (c *controller) DeleteLaunchTemplate(tenantID string, name string) error {
+	return c.ds.DeleteLaunchTemplate(tenantID, name)
+}
+
+// CreateServerFromTemplate creates instances from the launch request of a
+// template.  The overrides, a server object in the form of the body of an
+// instance create request, are merged on top of the template's as a JSON
+// merge patch so the fields present in the overrides take precedence.
+func (c *controller) CreateServerFromTemplate(ctx context.Context, tenantID string, name string, overrides []byte, actor string) (interface{}, error) {
+	t, err := c.ds.GetLaunchTemplate(tenantID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	request := []byte(t.Request)
+	if len(overrides) > 0 && !bytes.Equal(overrides, []byte("null")) {
+		patch, err := json.Marshal(struct {
+			Server json.RawMessage `json:"server"`
+		}{overrides})
+		if err != nil {
+			return nil, errors.Wrap(err, "Error applying launch template overrides")
+		}
+
+		request, err = jsonpatch.MergePatch(request, patch)
+		if err != nil {
+			return nil, types.ErrBadRequest
+		}
+	}
+
+	req, err := decodeLaunchRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Actor = actor
+	req.Template = t.Name
+	req.TemplateVersion = t.Version
+
+	return c.CreateServer(ctx, tenantID, req)
+}
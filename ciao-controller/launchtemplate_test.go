@@ -0,0 +1,247 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
+)
+
+func launchTemplateRequest(t *testing.T, workloadID string, server string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"server":{"workload_id":%q%s}}`, workloadID, server))
+}
+
+func createFromTemplate(t *testing.T, tenantID string, name string, overrides string) *types.Instance {
+	resp, err := ctl.CreateServerFromTemplate(context.Background(), tenantID, name, []byte(overrides), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var servers api.Servers
+	err = json.Unmarshal(b, &servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers.Servers) != 1 {
+		t.Fatalf("Expected 1 server got %d", len(servers.Servers))
+	}
+
+	i, err := ctl.ds.GetInstance(servers.Servers[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func TestLaunchTemplateValidation(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, tenant.ID)
+	hidden := addBoundedWorkload(t, other.ID)
+
+	tests := []struct {
+		name    string
+		request json.RawMessage
+	}{
+		{"unknown-field", launchTemplateRequest(t, wl.ID, `,"flavor":"large"`)},
+		{"out-of-bounds", launchTemplateRequest(t, wl.ID, `,"vcpus":16`)},
+		{"bad-instance-name", launchTemplateRequest(t, wl.ID, `,"name":"Web_1"`)},
+		{"hidden-workload", launchTemplateRequest(t, hidden.ID, ``)},
+		{"no-workload", json.RawMessage(`{"server":{"vcpus":4}}`)},
+	}
+
+	for _, test := range tests {
+		req := types.LaunchTemplateRequest{Name: test.name, Request: test.request}
+		_, err := ctl.CreateLaunchTemplate(tenant.ID, req)
+		if _, ok := errors.Cause(err).(*types.LaunchRequestError); !ok {
+			t.Errorf("Expected launch request error for %s got %v", test.name, err)
+		}
+	}
+
+	req := types.LaunchTemplateRequest{Name: "Web", Request: launchTemplateRequest(t, wl.ID, ``)}
+	if _, err := ctl.CreateLaunchTemplate(tenant.ID, req); err != types.ErrBadName {
+		t.Errorf("Expected bad name error got %v", err)
+	}
+
+	req.Name = "web"
+	tmpl, err := ctl.CreateLaunchTemplate(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tmpl.Version != 1 {
+		t.Errorf("Expected version 1 got %d", tmpl.Version)
+	}
+
+	if _, err := ctl.CreateLaunchTemplate(tenant.ID, req); err != types.ErrLaunchTemplateExists {
+		t.Errorf("Expected template exists error got %v", err)
+	}
+
+	// template names are scoped to the tenant
+	if _, err := ctl.ShowLaunchTemplate(other.ID, "web"); err != types.ErrLaunchTemplateNotFound {
+		t.Errorf("Expected template not found error got %v", err)
+	}
+
+	req.Request = launchTemplateRequest(t, wl.ID, `,"mem_mb":8192`)
+	if _, err := ctl.UpdateLaunchTemplate(tenant.ID, "web", req); err == nil {
+		t.Errorf("Expected invalid update to fail")
+	}
+
+	tmpl, err = ctl.ShowLaunchTemplate(tenant.ID, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tmpl.Version != 1 {
+		t.Errorf("Invalid update changed template version to %d", tmpl.Version)
+	}
+}
+
+func TestDeleteTenantLaunchTemplates(t *testing.T) {
+	config := types.TenantConfig{
+		Name:       "deleteTenantLaunchTemplates",
+		SubnetBits: 24,
+	}
+
+	ID := uuid.Generate().String()
+
+	_, _, err := ctl.CreateTenant(types.TenantRequest{ID: ID, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, ID)
+
+	req := types.LaunchTemplateRequest{Name: "web", Request: launchTemplateRequest(t, wl.ID, ``)}
+	_, err = ctl.CreateLaunchTemplate(ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteTestTenant(t, ID, false)
+
+	if templates := ctl.ds.GetLaunchTemplates(ID); len(templates) != 0 {
+		t.Errorf("Templates of deleted tenant not removed: %v", templates)
+	}
+}
+
+func TestLaunchTemplateMergePrecedence(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, tenant.ID)
+
+	req := types.LaunchTemplateRequest{
+		Name:    "web",
+		Request: launchTemplateRequest(t, wl.ID, `,"name":"web","description":"frontend","vcpus":4,"mem_mb":1024`),
+	}
+	_, err = ctl.CreateLaunchTemplate(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overrides replace the fields they contain, null removes a field
+	// and the fields they do not contain are taken from the template.
+	i := createFromTemplate(t, tenant.ID, "web", `{"name":"web-1","vcpus":6,"description":null}`)
+	if i.Name != "web-1" || i.VCPUs != 6 || i.MemMB != 1024 || i.Description != "" {
+		t.Errorf("Overrides not merged: name %s vcpus %d mem %d description %q",
+			i.Name, i.VCPUs, i.MemMB, i.Description)
+	}
+
+	if i.Template != "web" || i.TemplateVersion != 1 {
+		t.Errorf("Template not recorded: %s version %d", i.Template, i.TemplateVersion)
+	}
+
+	// overrides are checked against the workload like any other request
+	_, err = ctl.CreateServerFromTemplate(context.Background(), tenant.ID, "web", []byte(`{"name":"web-2","vcpus":16}`), "")
+	if _, ok := errors.Cause(err).(*types.RequirementsBoundError); !ok {
+		t.Errorf("Expected bound error got %v", err)
+	}
+
+	_, err = ctl.CreateServerFromTemplate(context.Background(), tenant.ID, "web", []byte(`{"flavor":"large"}`), "")
+	if _, ok := errors.Cause(err).(*types.LaunchRequestError); !ok {
+		t.Errorf("Expected launch request error got %v", err)
+	}
+
+	req.Request = launchTemplateRequest(t, wl.ID, `,"vcpus":2,"mem_mb":2048`)
+	tmpl, err := ctl.UpdateLaunchTemplate(tenant.ID, "web", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tmpl.Version != 2 {
+		t.Errorf("Expected version 2 got %d", tmpl.Version)
+	}
+
+	j := createFromTemplate(t, tenant.ID, "web", `{"name":"web-2"}`)
+	if j.VCPUs != 2 || j.MemMB != 2048 || j.TemplateVersion != 2 {
+		t.Errorf("Updated template not used: vcpus %d mem %d version %d",
+			j.VCPUs, j.MemMB, j.TemplateVersion)
+	}
+
+	// instances launched before the update are not affected by it
+	s, err := ctl.ShowServerDetails(tenant.ID, i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.Template != "web" || s.Server.TemplateVersion != 1 {
+		t.Errorf("Template of existing instance changed: %s version %d",
+			s.Server.Template, s.Server.TemplateVersion)
+	}
+
+	i, err = ctl.ds.GetInstance(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.VCPUs != 6 || i.MemMB != 1024 {
+		t.Errorf("Resources of existing instance changed: vcpus %d mem %d", i.VCPUs, i.MemMB)
+	}
+
+	err = ctl.DeleteLaunchTemplate(tenant.ID, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.CreateServerFromTemplate(context.Background(), tenant.ID, "web", nil, "")
+	if err != types.ErrLaunchTemplateNotFound {
+		t.Errorf("Expected template not found error got %v", err)
+	}
+}
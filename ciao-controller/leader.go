@@ -0,0 +1,226 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+)
+
+// leaderLeaseName is the name of the lease record in the datastore.
+const leaderLeaseName = "controller"
+
+type leaseStore interface {
+	AcquireLease(name string, holder string, address string, duration time.Duration) (types.LeaderLease, error)
+	ReleaseLease(name string, holder string) error
+}
+
+// leaderElector competes for the leadership of the controllers sharing a
+// datastore.  The leader holds a lease in the datastore which it renews
+// several times per lease duration.  If the leader stops renewing the lease
+// another controller takes it over once it expires.
+//
+// The clocks of the controllers are assumed to be synchronised.
+type leaderElector struct {
+	store    leaseStore
+	id       string
+	address  string
+	duration time.Duration
+	log      clogger.CiaoLog
+
+	lock     sync.Mutex
+	leader   bool
+	current  types.LeaderLease
+	renewed  time.Time
+	elected  chan struct{}
+	lost     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newLeaderElector(store leaseStore, id string, address string, duration time.Duration, log clogger.CiaoLog) *leaderElector {
+	return &leaderElector{
+		store:    store,
+		id:       id,
+		address:  address,
+		duration: duration,
+		log:      clogger.With(log, "elector", id),
+		elected:  make(chan struct{}),
+		lost:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+// start begins competing for the leadership.  The channel returned by
+// elected is closed when the leadership is won and the one returned by
+// lost is closed if it is subsequently lost.  Leadership is never regained
+// once lost.
+func (e *leaderElector) start() {
+	e.wg.Add(1)
+	go e.run()
+}
+
+// shutdown stops competing for the leadership.  If release is true and the
+// leadership is held, the lease is released so that another controller can
+// take over without waiting for the lease to expire.
+func (e *leaderElector) shutdown(release bool) {
+	e.stopOnce.Do(func() { close(e.stop) })
+	e.wg.Wait()
+
+	if !release || !e.isLeader() {
+		return
+	}
+
+	err := e.store.ReleaseLease(leaderLeaseName, e.id)
+	if err != nil {
+		e.log.Warningf("Unable to release leadership: %v", err)
+	}
+}
+
+func (e *leaderElector) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		if !e.renew() {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// renew tries to acquire or renew the lease.  It returns false once the
+// leadership has been lost.
+func (e *leaderElector) renew() bool {
+	now := time.Now()
+	lease, err := e.store.AcquireLease(leaderLeaseName, e.id, e.address, e.duration)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err != nil {
+		e.log.Warningf("Unable to renew leadership lease: %v", err)
+		if e.leader && now.Sub(e.renewed) >= e.duration {
+			e.log.Errorf("Leadership lease expired")
+			e.leader = false
+			close(e.lost)
+			return false
+		}
+		return true
+	}
+
+	e.current = lease
+
+	if lease.Holder != e.id {
+		if e.leader {
+			e.log.Errorf("Leadership taken over by %s", lease.Holder)
+			e.leader = false
+			close(e.lost)
+			return false
+		}
+		return true
+	}
+
+	e.renewed = now
+	if !e.leader {
+		e.log.Infof("Elected leader")
+		e.leader = true
+		close(e.elected)
+	}
+
+	return true
+}
+
+// isLeader returns true if the lease is currently held.
+func (e *leaderElector) isLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.leader
+}
+
+// leaderAddress returns the API URL of the current leader or an empty
+// string if it is not known.
+func (e *leaderElector) leaderAddress() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.current.Holder == "" || time.Now().After(e.current.Expiry) {
+		return ""
+	}
+
+	return e.current.Address
+}
+
+// setActive marks the controller as able to accept mutating requests.  A
+// controller only becomes active once it has reconciled the datastore with
+// the compute nodes and, if it is a newly elected leader, finished taking
+// over from the previous leader.
+func (c *controller) setActive() {
+	atomic.StoreInt32(&c.active, 1)
+}
+
+func (c *controller) isActive() bool {
+	return atomic.LoadInt32(&c.active) == 1
+}
+
+// leaderHandler only passes mutating requests on to the API handlers if the
+// controller is active.  Followers redirect them to the leader, other
+// controllers fail them as not ready, while read-only requests are always
+// served from the controller's copy of the datastore.
+type leaderHandler struct {
+	Controller *controller
+	Next       http.Handler
+}
+
+func (h *leaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the events are only logged, and so streamed, by the leader
+	if readOnlyRequest(r) && !streamPath(r.URL.Path) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	c := h.Controller
+	if c.isActive() {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	if c.elector == nil {
+		http.Error(w, "Controller not ready to accept changes", http.StatusServiceUnavailable)
+		return
+	}
+
+	leader := c.elector.leaderAddress()
+	if leader == "" || c.elector.isLeader() {
+		http.Error(w, "Controller not ready to accept changes", http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/uuid"
+)
+
+const testLeaseDuration = 300 * time.Millisecond
+
+// newTestLeaderController returns a controller sharing the datastore of
+// the test controller and competing for the leadership with address.
+func newTestLeaderController(address string) *controller {
+	c := &controller{
+		ds:  ctl.ds,
+		log: ctl.log,
+	}
+	c.elector = newLeaderElector(ctl.ds, uuid.Generate().String(), address,
+		testLeaseDuration, ctl.log)
+
+	return c
+}
+
+func waitForElection(t *testing.T, e *leaderElector, timeout time.Duration) time.Duration {
+	start := time.Now()
+
+	select {
+	case <-e.elected:
+	case <-time.After(timeout):
+		t.Fatalf("%s not elected within %s", e.id, timeout)
+	}
+
+	return time.Since(start)
+}
+
+func testLeaderRequest(c *controller, method string) *httptest.ResponseRecorder {
+	h := &leaderHandler{
+		Controller: c,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	req := httptest.NewRequest(method, "/tenants?limit=1", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c1 := newTestLeaderController("https://controller1:8889")
+	c1.elector.start()
+	defer c1.elector.shutdown(true)
+
+	waitForElection(t, c1.elector, testLeaseDuration)
+
+	// elected but still taking over so not accepting changes
+	if rr := testLeaderRequest(c1, "POST"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d from inactive leader, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	c1.setActive()
+
+	c2 := newTestLeaderController("https://controller2:8889")
+	c2.elector.start()
+	defer c2.elector.shutdown(true)
+
+	time.Sleep(testLeaseDuration)
+	if c2.elector.isLeader() {
+		t.Fatal("Follower elected while leader holds the lease")
+	}
+
+	if rr := testLeaderRequest(c1, "POST"); rr.Code != http.StatusOK {
+		t.Errorf("Expected %d from leader, got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr := testLeaderRequest(c2, "GET"); rr.Code != http.StatusOK {
+		t.Errorf("Expected %d for read on follower, got %d", http.StatusOK, rr.Code)
+	}
+
+	rr := testLeaderRequest(c2, "DELETE")
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected %d for write on follower, got %d", http.StatusTemporaryRedirect, rr.Code)
+	}
+
+	location := rr.Header().Get("Location")
+	if location != "https://controller1:8889/tenants?limit=1" {
+		t.Errorf("Unexpected redirect location: %s", location)
+	}
+
+	// kill the leader without releasing the lease
+	c1.elector.shutdown(false)
+
+	// the lease is renewed every third of its duration so the follower
+	// must take over within a lease duration and a renewal period
+	elapsed := waitForElection(t, c2.elector, 2*testLeaseDuration)
+	t.Logf("Follower elected after %s", elapsed)
+
+	if c2.elector.leaderAddress() != "https://controller2:8889" {
+		t.Errorf("Unexpected leader address: %s", c2.elector.leaderAddress())
+	}
+}
+
+func TestLeaderRelease(t *testing.T) {
+	c1 := newTestLeaderController("https://controller1:8889")
+	c1.elector.start()
+	waitForElection(t, c1.elector, testLeaseDuration)
+
+	c2 := newTestLeaderController("https://controller2:8889")
+	c2.elector.start()
+	defer c2.elector.shutdown(true)
+
+	c1.elector.shutdown(true)
+
+	// a released lease is taken over at the next renewal
+	waitForElection(t, c2.elector, testLeaseDuration)
+}
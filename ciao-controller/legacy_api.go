@@ -20,8 +20,8 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/service"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
@@ -46,6 +46,11 @@ func (h legacyAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := h.Handler(h.controller, w, r)
 	if err != nil {
+		if tooLarge, ok := err.(*http.MaxBytesError); ok {
+			resp = APIResponse{http.StatusRequestEntityTooLarge, nil}
+			err = api.BodyTooLargeError(tooLarge.Limit)
+		}
+
 		data := HTTPErrorData{
 			Code:    resp.status,
 			Name:    http.StatusText(resp.status),
@@ -56,7 +61,7 @@ func (h legacyAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Error: data,
 		}
 
-		glog.Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
+		h.requestLog(r).Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
 
 		b, err := json.Marshal(code)
 		if err != nil {
@@ -107,6 +112,14 @@ func legacyListNetworkNodes(c *controller, w http.ResponseWriter, r *http.Reques
 	return listNetworkNodes(c, w, r)
 }
 
+func legacyNodesSummary(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	return nodesSummary(c, w, r)
+}
+
+func legacyNodeSummary(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	return nodeSummary(c, w, r)
+}
+
 func legacyListNodeServers(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
 	return listNodeServers(c, w, r)
 }
@@ -151,6 +164,10 @@ func legacyComputeRoutes(ctl *controller, r *mux.Router) *mux.Router {
 
 	r.Handle("/v2.1/nodes",
 		legacyAPIHandler{ctl, legacyListNodes, true}).Methods("GET")
+	r.Handle("/v2.1/nodes/summary",
+		legacyAPIHandler{ctl, legacyNodesSummary, true}).Methods("GET")
+	r.Handle("/v2.1/nodes/{node}/summary",
+		legacyAPIHandler{ctl, legacyNodeSummary, true}).Methods("GET")
 	r.Handle("/v2.1/nodes/{node}/servers/detail",
 		legacyAPIHandler{ctl, legacyListNodeServers, true}).Methods("GET")
 	r.Handle("/v2.1/nodes/compute",
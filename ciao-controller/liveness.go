@@ -0,0 +1,250 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+)
+
+// livenessCheckPeriod is how often the nodes are checked for missed stats.
+const livenessCheckPeriod = time.Second
+
+// livenessThresholds control when nodes change liveness status.
+type livenessThresholds struct {
+	// suspect is how long a node may go without sending stats before
+	// it becomes suspect
+	suspect time.Duration
+
+	// down is how long a node may go without sending stats before it
+	// is declared down
+	down time.Duration
+
+	// recovery is how long a suspect or down node must keep sending
+	// stats before it is ready again
+	recovery time.Duration
+}
+
+// nodeHealth is the liveness state of a single node.
+type nodeHealth struct {
+	status       types.NodeStatusType
+	lastSeen     time.Time
+	healthySince time.Time
+}
+
+// nodeTransition describes a change in the liveness status of a node.
+type nodeTransition struct {
+	nodeID string
+	from   types.NodeStatusType
+	to     types.NodeStatusType
+}
+
+func (t nodeTransition) String() string {
+	return fmt.Sprintf("Node %s changed from %s to %s", t.nodeID, t.from, t.to)
+}
+
+// livenessTracker follows the stats sent by the nodes.  A node which
+// stops sending stats becomes suspect and then down.  To avoid flapping a
+// node only returns to ready once it has been sending stats without a gap
+// for the recovery period.
+type livenessTracker struct {
+	now   func() time.Time
+	lock  sync.Mutex
+	nodes map[string]*nodeHealth
+}
+
+func newLivenessTracker(now func() time.Time) *livenessTracker {
+	return &livenessTracker{
+		now:   now,
+		nodes: make(map[string]*nodeHealth),
+	}
+}
+
+// heartbeat records that stats have been received from a node.
+func (t *livenessTracker) heartbeat(nodeID string, th livenessThresholds) []nodeTransition {
+	return t.heartbeatAt(nodeID, t.now(), th)
+}
+
+// heartbeatAt records that stats sent by a node at sent, according to the
+// controller's clock, have been received.  Stats which were sent longer
+// ago than the suspect timeout, e.g. because they were delayed, do not
+// show that the node is alive.
+func (t *livenessTracker) heartbeatAt(nodeID string, sent time.Time, th livenessThresholds) []nodeTransition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if sent.After(now) {
+		sent = now
+	}
+
+	h, ok := t.nodes[nodeID]
+	if now.Sub(sent) >= th.suspect {
+		if !ok {
+			return nil
+		}
+		return h.evaluate(nodeID, now, th)
+	}
+
+	if !ok {
+		t.nodes[nodeID] = &nodeHealth{
+			status:   types.NodeStatusReady,
+			lastSeen: sent,
+		}
+		return nil
+	}
+
+	if sent.Before(h.lastSeen) {
+		return h.evaluate(nodeID, now, th)
+	}
+
+	if h.status != types.NodeStatusReady &&
+		(h.healthySince.IsZero() || sent.Sub(h.lastSeen) >= th.suspect) {
+		h.healthySince = sent
+	}
+	h.lastSeen = sent
+
+	return h.evaluate(nodeID, now, th)
+}
+
+// check looks for nodes which have missed their stats or have recovered.
+func (t *livenessTracker) check(th livenessThresholds) []nodeTransition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+
+	var IDs []string
+	for ID := range t.nodes {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	var transitions []nodeTransition
+	for _, ID := range IDs {
+		transitions = append(transitions, t.nodes[ID].evaluate(ID, now, th)...)
+	}
+
+	return transitions
+}
+
+// remove stops tracking a node which has disconnected.
+func (t *livenessTracker) remove(nodeID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.nodes, nodeID)
+}
+
+func (h *nodeHealth) evaluate(nodeID string, now time.Time, th livenessThresholds) []nodeTransition {
+	silence := now.Sub(h.lastSeen)
+	to := h.status
+
+	switch {
+	case silence >= th.down:
+		to = types.NodeStatusDown
+		h.healthySince = time.Time{}
+	case silence >= th.suspect:
+		if h.status == types.NodeStatusReady {
+			to = types.NodeStatusSuspect
+		}
+		h.healthySince = time.Time{}
+	case h.status != types.NodeStatusReady && !h.healthySince.IsZero() &&
+		now.Sub(h.healthySince) >= th.recovery:
+		to = types.NodeStatusReady
+	}
+
+	if to == h.status {
+		return nil
+	}
+
+	tr := nodeTransition{nodeID: nodeID, from: h.status, to: to}
+	h.status = to
+
+	return []nodeTransition{tr}
+}
+
+func (c *controller) livenessThresholds() livenessThresholds {
+	return livenessThresholds{
+		suspect:  c.durationSetting(settingNodeSuspectTimeout),
+		down:     c.durationSetting(settingNodeDownTimeout),
+		recovery: c.durationSetting(settingNodeRecoveryPeriod),
+	}
+}
+
+// nodeHeartbeat is called when stats are received from a node.  If the
+// node timestamped the stats, the time at which they were sent, corrected
+// for the node's clock offset, is used to decide whether they are stale.
+func (c *controller) nodeHeartbeat(nodeID string, timestamp int64) {
+	var sent time.Time
+	if timestamp != 0 && c.clockSkew != nil {
+		sent = c.nodeClockSample(nodeID, time.Unix(0, timestamp))
+	}
+
+	if c.liveness == nil {
+		return
+	}
+
+	if sent.IsZero() {
+		c.applyNodeTransitions(c.liveness.heartbeat(nodeID, c.livenessThresholds()))
+		return
+	}
+
+	c.applyNodeTransitions(c.liveness.heartbeatAt(nodeID, sent, c.livenessThresholds()))
+}
+
+// monitorLiveness periodically checks the nodes for missed stats.
+func (c *controller) monitorLiveness() {
+	ticker := time.NewTicker(livenessCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.applyNodeTransitions(c.liveness.check(c.livenessThresholds()))
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *controller) applyNodeTransitions(transitions []nodeTransition) {
+	for _, t := range transitions {
+		log := clogger.With(c.log, "node", t.nodeID)
+
+		err := c.ds.SetNodeLiveness(t.nodeID, t.to)
+		if err != nil {
+			log.Warningf("Unable to update node status: %v", err)
+			continue
+		}
+
+		if t.to == types.NodeStatusReady {
+			log.Infof("%s", t)
+		} else {
+			log.Warningf("%s", t)
+		}
+
+		c.publishEvent(types.NodeStatusEvent, "", t.String(), map[string]string{
+			"node_id": t.nodeID,
+			"from":    string(t.from),
+			"to":      string(t.to),
+		})
+	}
+}
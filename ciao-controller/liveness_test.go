@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+var testThresholds = livenessThresholds{
+	suspect:  30 * time.Second,
+	down:     2 * time.Minute,
+	recovery: time.Minute,
+}
+
+func expectTransitions(t *testing.T, step string, got []nodeTransition, expected ...types.NodeStatusType) {
+	var to []types.NodeStatusType
+	for _, tr := range got {
+		to = append(to, tr.to)
+	}
+
+	if !reflect.DeepEqual(to, expected) {
+		t.Fatalf("%s: expected transitions to %v, got %v", step, expected, got)
+	}
+}
+
+func TestLivenessStateMachine(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLivenessTracker(clock.Now)
+
+	expectTransitions(t, "first stats", l.heartbeat("node", testThresholds))
+
+	clock.advance(20 * time.Second)
+	expectTransitions(t, "within suspect timeout", l.check(testThresholds))
+
+	clock.advance(10 * time.Second)
+	expectTransitions(t, "suspect timeout", l.check(testThresholds), types.NodeStatusSuspect)
+
+	clock.advance(time.Minute)
+	expectTransitions(t, "still suspect", l.check(testThresholds))
+
+	clock.advance(30 * time.Second)
+	expectTransitions(t, "down timeout", l.check(testThresholds), types.NodeStatusDown)
+
+	clock.advance(time.Minute)
+	expectTransitions(t, "still down", l.check(testThresholds))
+
+	// a node must report for the recovery period before it is ready
+	for i := 0; i < 6; i++ {
+		expectTransitions(t, "recovering", l.heartbeat("node", testThresholds))
+		expectTransitions(t, "recovering", l.check(testThresholds))
+		clock.advance(10 * time.Second)
+	}
+
+	expectTransitions(t, "recovered", l.heartbeat("node", testThresholds), types.NodeStatusReady)
+}
+
+func TestLivenessDamping(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLivenessTracker(clock.Now)
+
+	l.heartbeat("node", testThresholds)
+	clock.advance(testThresholds.suspect)
+	expectTransitions(t, "suspect", l.check(testThresholds), types.NodeStatusSuspect)
+
+	// flapping: stats arrive but with gaps longer than the suspect
+	// timeout, so the recovery period keeps being restarted
+	for i := 0; i < 4; i++ {
+		expectTransitions(t, "flapping", l.heartbeat("node", testThresholds))
+		clock.advance(testThresholds.suspect)
+	}
+
+	expectTransitions(t, "flapping", l.check(testThresholds))
+
+	// stats arriving on time eventually bring the node back
+	for i := 0; i < 3; i++ {
+		expectTransitions(t, "recovering", l.heartbeat("node", testThresholds))
+		clock.advance(testThresholds.recovery / 3)
+	}
+
+	expectTransitions(t, "recovered", l.heartbeat("node", testThresholds), types.NodeStatusReady)
+}
+
+func TestLivenessRemove(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLivenessTracker(clock.Now)
+
+	l.heartbeat("node", testThresholds)
+	l.remove("node")
+
+	clock.advance(testThresholds.down)
+	expectTransitions(t, "removed", l.check(testThresholds))
+}
+
+func TestNodeMarkDown(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	ctl.applyNodeTransitions([]nodeTransition{
+		{nodeID: testutil.AgentUUID, from: types.NodeStatusSuspect, to: types.NodeStatusDown},
+	})
+
+	i, err := ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.State != payloads.Unreachable {
+		t.Errorf("Expected instance to be %s, got %s", payloads.Unreachable, i.State)
+	}
+
+	for _, n := range ctl.ds.GetNodeLastStats().Nodes {
+		if n.ID == testutil.AgentUUID && n.Status != string(types.NodeStatusDown) {
+			t.Errorf("Expected node status %s, got %s", types.NodeStatusDown, n.Status)
+		}
+	}
+
+	ctl.applyNodeTransitions([]nodeTransition{
+		{nodeID: testutil.AgentUUID, from: types.NodeStatusDown, to: types.NodeStatusReady},
+	})
+
+	// the next stats report the real state of the instance
+	sendStatsCmd(client, t)
+
+	i, err = ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.State != payloads.Running {
+		t.Errorf("Expected instance to be %s, got %s", payloads.Running, i.State)
+	}
+}
@@ -18,27 +18,33 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
 	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/clogger/jsoninterface"
 	"github.com/ciao-project/ciao/database"
 	"github.com/ciao-project/ciao/osprepare"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/service"
 	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/golang/glog"
-	"github.com/pkg/errors"
 )
 
 type tenantConfirmMemo struct {
@@ -55,6 +61,138 @@ type controller struct {
 	tenantReadinessLock sync.Mutex
 	qs                  *quotas.Quotas
 	httpServers         []*http.Server
+	metricsServer       *http.Server
+	log                 clogger.CiaoLog
+	events              *eventHub
+	webhooks            *webhookDispatcher
+	config              *configLoader
+	elector             *leaderElector
+	active              int32
+	inventories         inventoryRequests
+	consoleLogs         consoleLogRequests
+	resizes             resizeRequests
+	volumeRequests      volumeAttachRequests
+	migrations          migrationRequests
+	liveness            *livenessTracker
+	clockSkew           *clockSkewTracker
+	metrics             *controllerMetrics
+	inFlight            int64
+	maintenance         maintenanceState
+	idempotency         idempotencyState
+	cnciRollout         int32
+	clientCAs           clientCAState
+	serverCert          serverCertState
+	auditFile           auditFile
+	settings            settingsState
+	pendingInstances    pendingInstanceState
+	deletedInstances    deletedInstanceState
+	cnciPool            cnciPoolState
+	launchQueue         launchQueueState
+	degradedTenants     degradedTenantState
+	tenantDeletions     tenantDeletions
+	rateLimits          rateLimitState
+	quotaAudit          *quotaAuditor
+
+	// ctx is the root of the contexts of the work carried out in the
+	// background, it is cancelled by stop when the controller shuts down.
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// instanceLog returns a logger which adds the tenant and instance IDs of i
+// to every message.
+func (c *controller) instanceLog(i *types.Instance) clogger.CiaoLog {
+	return clogger.With(c.log, "tenant", i.TenantID, "instance", i.ID)
+}
+
+// requestLog returns a logger which adds the request and tenant IDs
+// associated with r to every message.
+func (c *controller) requestLog(r *http.Request) clogger.CiaoLog {
+	log := clogger.With(c.log, "request", service.GetRequestID(r.Context()))
+	if tenantID, err := service.GetTenantID(r.Context()); err == nil && tenantID != "" {
+		log = clogger.With(log, "tenant", tenantID)
+	}
+	return log
+}
+
+// fatalf logs an error and terminates the controller.
+func (c *controller) fatalf(format string, args ...interface{}) {
+	c.log.Errorf(format, args...)
+	glog.Flush()
+	os.Exit(1)
+}
+
+type prepareFlag string
+
+const (
+	prepareInstall prepareFlag = "install"
+	prepareCheck   prepareFlag = "check"
+)
+
+func (p *prepareFlag) String() string {
+	return string(*p)
+}
+
+// Set accepts -osprepare, which installs the dependencies, and
+// -osprepare=check which only reports on them.
+func (p *prepareFlag) Set(val string) error {
+	switch val {
+	case "true", string(prepareInstall):
+		*p = prepareInstall
+	case string(prepareCheck):
+		*p = prepareCheck
+	case "false":
+		*p = ""
+	default:
+		return fmt.Errorf("Unknown osprepare mode: %s", val)
+	}
+
+	return nil
+}
+
+func (p *prepareFlag) IsBoolFlag() bool {
+	return true
+}
+
+// checkDeps writes a report of the installed and missing dependencies of
+// the controller to w and, if jsonPath is set, as JSON to that file.  If
+// jsonPath is - only the JSON report is written to w so that it can be
+// parsed.  It returns true if nothing is missing.
+func checkDeps(w io.Writer, jsonPath string) bool {
+	report := osprepare.Check(osprepare.BootstrapRequirements, controllerDeps)
+
+	if jsonPath == "-" {
+		if err := report.WriteJSON(w); err != nil {
+			glog.Errorf("Unable to write JSON report: %v", err)
+			return false
+		}
+
+		return report.OK()
+	}
+
+	if err := report.WriteTable(w); err != nil {
+		glog.Errorf("Unable to write report: %v", err)
+		return false
+	}
+
+	if jsonPath != "" {
+		f, err := os.Create(jsonPath)
+		if err != nil {
+			glog.Errorf("Unable to create JSON report: %v", err)
+			return false
+		}
+
+		err = report.WriteJSON(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			glog.Errorf("Unable to write JSON report: %v", err)
+			return false
+		}
+	}
+
+	return report.OK()
 }
 
 type cnciNetFlag string
@@ -74,20 +212,33 @@ func (c *cnciNetFlag) Set(val string) error {
 	return nil
 }
 
-var cert = flag.String("cert", "", "Client certificate")
-var caCert = flag.String("cacert", "", "CA certificate")
-var serverURL = flag.String("url", "", "Server URL")
-var prepare = flag.Bool("osprepare", false, "Install dependencies")
+var prepare prepareFlag
+var prepareJSON = flag.String("osprepare_json", "", "write the -osprepare=check report as JSON to this file, - for stdout instead of the table")
 var controllerAPIPort = api.Port
 var httpsCAcert = "/etc/pki/ciao/ciao-controller-cacert.pem"
 var httpsKey = "/etc/pki/ciao/ciao-controller-key.pem"
-var workloadsPath = flag.String("workloads_path", "/var/lib/ciao/data/controller/workloads", "path to yaml files")
-var persistentDatastoreLocation = flag.String("database_path", "/var/lib/ciao/data/controller/ciao-controller.db", "path to persistent database")
+var workloadsPath = flag.String("workloads_path", defaultConfig().WorkloadsPath, "path to yaml files")
 var logDir = "/var/lib/ciao/logs/controller"
 
 var clientCertCAPath = "/etc/pki/ciao/auth-CA.pem"
 
-var cephID = flag.String("ceph_id", "", "ceph client id")
+var configFile = flag.String("config", "", "path to controller configuration file")
+
+func init() {
+	flag.Var(&prepare, "osprepare", "Install dependencies, or with -osprepare=check report missing dependencies")
+
+	// The values of these flags are read by the configLoader, which
+	// uses the flag names as configuration keys.
+	flag.String("cert", "", "Client certificate")
+	flag.String("cacert", "", "CA certificate")
+	flag.String("url", "", "Server URL")
+	flag.String("database_path", defaultConfig().DatabasePath, "path to persistent database")
+	flag.String("ceph_id", "", "ceph client id")
+	flag.Duration("connect_timeout", defaultConfig().ConnectTimeout, "how long to keep trying to connect to the scheduler")
+	flag.String("log_format", defaultConfig().LogFormat, "log output format: glog or json")
+	flag.Int("log_verbosity", 0, "verbosity level used by the json log format")
+	flag.String("metrics_addr", "", "address, e.g., 127.0.0.1:9101, on which to export metrics without authentication; the API only exports them to admins")
+}
 
 var adminSSHKey = ""
 
@@ -95,10 +246,11 @@ var adminSSHKey = ""
 // of the 192.168.0.0/16 private address space.
 var cnciNet cnciNetFlag = "192.168.128.0"
 
-func init() {
-	flag.Parse()
-
-	if *prepare {
+// setupLogging configures glog after the command line flags have been
+// parsed.  It is not run from init as that would parse the flags before
+// those of any test binary have been registered.
+func setupLogging() {
+	if prepare != "" {
 		logToStderr := flag.Lookup("logtostderr")
 		if logToStderr != nil {
 			logToStderr.Value.Set("true")
@@ -125,160 +277,453 @@ func init() {
 	}
 }
 
-func getNameFromCert(httpsCAcert, httpsKey string) (string, error) {
-	cert, err := tls.LoadX509KeyPair(httpsCAcert, httpsKey)
+// newLogger returns the logger used by the controller for the given format.
+// The glog format preserves the controller's traditional log output while
+// the json format writes one structured JSON object per line to stderr.
+func newLogger(format string, verbosity int32) (clogger.CiaoLog, error) {
+	switch format {
+	case "glog":
+		return gloginterface.CiaoGlogLogger{}, nil
+	case "json":
+		return jsoninterface.NewCiaoJSONLogger(os.Stderr, verbosity), nil
+	}
+
+	return nil, fmt.Errorf("Unknown log format: %s", format)
+}
+
+// reloadConfig re-reads the configuration file and applies the settings
+// which can be changed while the controller is running.
+func (c *controller) reloadConfig() {
+	cfg, changes, err := c.config.reload()
 	if err != nil {
-		return "", errors.Wrap(err, "Error loading certificate pair")
+		c.log.Errorf("Unable to reload configuration, keeping previous configuration: %v", err)
+		return
+	}
+
+	if len(changes) == 0 {
+		c.log.Infof("Configuration reloaded: no changes")
+		return
+	}
+
+	for _, change := range changes {
+		if change.reloaded {
+			c.log.Infof("Configuration reloaded: %s", change)
+		} else {
+			c.log.Warningf("Configuration change ignored until restart: %s", change)
+		}
+	}
+
+	c.applyConfig(cfg)
+}
+
+// applyConfig applies the settings which can be reloaded.
+func (c *controller) applyConfig(cfg controllerConfig) {
+	if l, ok := c.log.(interface {
+		SetVerbosity(int32)
+	}); ok {
+		l.SetVerbosity(int32(cfg.LogVerbosity))
+	}
+
+	c.configureWebhooks()
+	c.applyCertificates(cfg)
+
+	// the audit file is reopened so that it may be rotated
+	c.auditFile.close()
+
+	// CNCIs launched from now on use the new size and key, the CNCIs
+	// which are already running are left alone.
+	adminSSHKey = cfg.AdminSSHKey
+	c.ds.GenerateCNCIWorkload(cfg.CNCIVcpus, cfg.CNCIMem, cfg.CNCIDisk, adminSSHKey)
+}
+
+// applyCertificates reloads the certificates of the API servers, if they
+// are running, so that new connections use the certificates named in cfg.
+// Certificates which cannot be loaded are reported and the previous ones
+// are kept.
+func (c *controller) applyCertificates(cfg controllerConfig) {
+	httpsCAcert = cfg.HTTPSCACert
+	httpsKey = cfg.HTTPSKey
+	clientCertCAPath = cfg.ClientAuthCACertPath
+
+	if len(c.httpServers) == 0 {
+		return
 	}
 
-	// leaf is first
-	if len(cert.Certificate) == 0 {
-		return "", errors.New("Expected at least one certificate in encoded data")
+	if err := c.loadServerCert(cfg.HTTPSCACert, cfg.HTTPSKey); err != nil {
+		c.log.Errorf("Keeping previous server certificate: %v", err)
 	}
 
-	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err := c.loadClientCAs(cfg.ClientAuthCACertPath); err != nil {
+		c.log.Errorf("Keeping previous client CA: %v", err)
+	}
+}
+
+// updateClusterConfig applies a cluster configuration sent by the
+// scheduler while the controller is running.  Changes to the settings
+// which cannot be applied live are logged and take effect on restart.
+func (c *controller) updateClusterConfig(clusterConfig payloads.Configure) {
+	cfg, changes, err := c.config.updateClusterConfig(clusterConfig)
 	if err != nil {
-		return "", errors.Wrap(err, "Error parsing certificate")
+		c.log.Errorf("Unable to apply cluster configuration, keeping previous configuration: %v", err)
+		return
 	}
 
-	glog.Infof("Got name from certificate: %s", c.Subject.CommonName)
-	return c.Subject.CommonName, nil
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, change := range changes {
+		if change.reloaded {
+			c.log.Infof("Cluster configuration updated: %s", change)
+		} else {
+			c.log.Warningf("Cluster configuration change deferred until restart: %s", change)
+		}
+	}
+
+	c.applyConfig(cfg)
+}
+
+// configureWebhooks applies the webhook delivery settings.
+func (c *controller) configureWebhooks() {
+	if c.webhooks != nil {
+		c.webhooks.configure(c.intSetting(settingWebhookMaxAttempts),
+			c.durationSetting(settingWebhookBackoff), c.durationSetting(settingWebhookTimeout))
+	}
+}
+
+// applySetting applies a cluster setting changed by the admin to the
+// components which do not read it each time they use it.
+func (c *controller) applySetting(key string) {
+	switch key {
+	case settingWebhookMaxAttempts, settingWebhookBackoff, settingWebhookTimeout:
+		c.configureWebhooks()
+	case settingPendingInstanceTimeout:
+		c.pendingInstances.wake()
+	case settingCNCIPoolEnabled, settingCNCIPoolSize, settingCNCIPoolConcurrency, settingCNCIPoolClaimTimeout:
+		c.cnciPool.wake()
+	case settingTenantLaunchLimit, settingTenantLaunchQueue:
+		c.launchQueue.wake()
+	}
 }
 
 func main() {
-	if *prepare {
+	flag.Parse()
+	setupLogging()
+
+	switch prepare {
+	case prepareInstall:
 		logger := gloginterface.CiaoGlogLogger{}
 		osprepare.Bootstrap(context.TODO(), logger)
 		osprepare.InstallDeps(context.TODO(), controllerDeps, logger)
 		return
+	case prepareCheck:
+		if !checkDeps(os.Stdout, *prepareJSON) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	var wg sync.WaitGroup
 	var err error
 
 	ctl := new(controller)
+	ctl.ctx, ctl.stop = context.WithCancel(context.Background())
+	ctl.config, err = newConfigLoader(*configFile, flag.CommandLine)
+	if err != nil {
+		glog.Fatalf("Unable to load configuration: %v", err)
+		return
+	}
+	cfg := ctl.config.config()
+
+	ctl.log, err = newLogger(cfg.LogFormat, int32(cfg.LogVerbosity))
+	if err != nil {
+		glog.Fatalf("Unable to create logger: %v", err)
+		return
+	}
 	ctl.tenantReadiness = make(map[string]*tenantConfirmMemo)
 	ctl.ds = new(datastore.Datastore)
 	ctl.qs = new(quotas.Quotas)
 
+	ctl.metrics = newControllerMetrics(cfg.MetricsMaxTenants, cfg.QuotaDenialWindow, time.Now)
+	ctl.events = newEventHub()
+
 	dsConfig := datastore.Config{
-		PersistentURI:     "file:" + *persistentDatastoreLocation,
-		InitWorkloadsPath: *workloadsPath,
+		PersistentURI:     "file:" + cfg.DatabasePath,
+		InitWorkloadsPath: cfg.WorkloadsPath,
+		LegacyStatsPath:   cfg.LegacyStatsPath,
+		Log:               ctl.log,
+		IPAllocation:      cfg.TenantIPAllocation,
+		EventDropped:      ctl.metrics.eventDropped,
+		EventsLogged:      ctl.events.publishLog,
+		QueryObserved:     ctl.metrics.queryObserved,
 	}
 
 	err = ctl.ds.Init(dsConfig)
 	if err != nil {
-		glog.Fatalf("unable to Init datastore: %s", err)
-		return
+		ctl.fatalf("unable to Init datastore: %s", err)
 	}
 
-	ctl.qs.Init()
-	err = populateQuotasFromDatastore(ctl.qs, ctl.ds)
-	if err != nil {
-		glog.Fatalf("Error populating quotas from datastore: %v", err)
-		return
+	database.Logger = ctl.log
+
+	ctl.webhooks = newWebhookDispatcher(ctl.ds, ctl.events, ctl.log)
+	ctl.configureWebhooks()
+	ctl.settings.watch(ctl.applySetting)
+	ctl.liveness = newLivenessTracker(time.Now)
+	ctl.clockSkew = newClockSkewTracker(time.Now)
+
+	// the metrics of standby controllers are exported too
+	if cfg.MetricsAddr != "" {
+		ctl.startMetricsServer(cfg.MetricsAddr, &wg)
 	}
 
-	config := &ssntp.Config{
-		URI:    *serverURL,
-		CAcert: *caCert,
-		Cert:   *cert,
-		Log:    ssntp.Log,
+	if cfg.LeaderElection {
+		// The API is served before the cluster configuration has been
+		// retrieved so the API settings must come from the
+		// configuration file or the defaults.
+		ctl.setAPIConfig(cfg)
+		ctl.startHTTPServer(&wg)
+
+		address := cfg.AdvertiseURL
+		if address == "" {
+			address = ctl.apiURL
+		}
+
+		ctl.elector = newLeaderElector(ctl.ds, uuid.Generate().String(), address, cfg.LeaderLease, ctl.log)
+		ctl.elector.start()
+		ctl.handleSignals()
+
+		if !ctl.followLeader(cfg.LeaderLease) {
+			wg.Wait()
+			ctl.log.Warningf("Controller shutdown initiated")
+			ctl.ds.Exit()
+			glog.Flush()
+			return
+		}
+
+		go func() {
+			<-ctl.elector.lost
+			ctl.fatalf("Leadership lost, exiting")
+		}()
+
+		ctl.activate()
+	} else {
+		ctl.activate()
+		ctl.setAPIConfig(ctl.config.config())
+		ctl.startHTTPServer(&wg)
+		ctl.handleSignals()
 	}
 
-	ctl.client, err = newSSNTPClient(ctl, config)
-	if err != nil {
-		// spawn some retry routine?
-		glog.Fatalf("unable to connect to SSNTP server")
-		return
+	// Changes are refused until the datastore has been brought in line
+	// with the instances actually present on the compute nodes.
+	cfg = ctl.config.config()
+	ctl.reconcile(cfg.ReconcileTimeout, cfg.ReconcilePendingAge)
+	ctl.resumeMigrations()
+
+	ctl.setActive()
+	ctl.log.Infof("Controller active")
+
+	go ctl.monitorLiveness()
+	go ctl.monitorCNCIHealth()
+	go ctl.watchPendingInstances()
+	go ctl.watchDeletedInstances()
+	go ctl.summarizeQuotaDenials(ctl.config.config().QuotaDenialSummaryInterval)
+	go ctl.maintainDatastore()
+	go ctl.recordUsage()
+	go ctl.maintainCNCIPool()
+	go ctl.drainLaunchQueues()
+	go ctl.takeScheduledSnapshots()
+
+	wg.Wait()
+	ctl.log.Warningf("Controller shutdown initiated")
+	ctl.webhooks.shutdown()
+	ctl.stopQuotaAudit()
+	ctl.qs.Shutdown()
+	ctl.ds.Exit()
+	if ctl.client != nil {
+		ctl.client.Disconnect()
+	}
+	glog.Flush()
+}
+
+// handleSignals shuts the controller down on SIGTERM or SIGINT and reloads
+// the configuration on SIGHUP.
+func (c *controller) handleSignals() {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-signalCh
+		c.log.Warningf("Received signal: %s", s)
+		c.stop()
+		if c.elector != nil {
+			c.elector.shutdown(true)
+		}
+		c.events.close()
+		c.ShutdownHTTPServers()
+		if c.isActive() {
+			shutdownCNCICtrls(c)
+		}
+	}()
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			c.reloadConfig()
+		}
+	}()
+}
+
+// followLeader serves read-only requests until the controller is elected
+// leader.  The datastore caches are refreshed periodically to pick up the
+// changes made by the current leader and once more after the election so
+// that the new leader starts from the latest state.  It returns false if
+// the controller is shut down before being elected.
+func (c *controller) followLeader(interval time.Duration) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.elector.elected:
+			if err := c.ds.Refresh(); err != nil {
+				c.fatalf("Unable to refresh datastore: %v", err)
+			}
+			return true
+		case <-c.elector.stop:
+			return false
+		case <-ticker.C:
+			if err := c.ds.Refresh(); err != nil {
+				c.log.Warningf("Unable to refresh datastore: %v", err)
+			}
+		}
 	}
+}
+
+// activate connects to the scheduler and starts the services which may
+// only be run by a single controller at a time.
+func (c *controller) activate() {
+	cfg := c.config.config()
 
-	ssntpClient := ctl.client.ssntpClient()
-	clusterConfig, err := ssntpClient.ClusterConfiguration()
+	c.webhooks.start()
+
+	c.qs.Init()
+	err := populateQuotasFromDatastore(c.qs, c.ds)
 	if err != nil {
-		glog.Fatalf("Unable to retrieve Cluster Configuration: %v", err)
-		return
+		c.fatalf("Error populating quotas from datastore: %v", err)
 	}
 
-	controllerAPIPort = clusterConfig.Configure.Controller.CiaoPort
-	httpsCAcert = clusterConfig.Configure.Controller.HTTPSCACert
-	httpsKey = clusterConfig.Configure.Controller.HTTPSKey
-	if *cephID == "" {
-		*cephID = clusterConfig.Configure.Storage.CephID
+	// the consumption of the resources which already exist is not audited
+	if cfg.QuotaAudit {
+		c.startQuotaAudit()
 	}
 
-	cnciVCPUs := clusterConfig.Configure.Controller.CNCIVcpus
-	cnciMem := clusterConfig.Configure.Controller.CNCIMem
-	cnciDisk := clusterConfig.Configure.Controller.CNCIDisk
+	c.pruneAudit(cfg, time.Now())
 
-	adminSSHKey = clusterConfig.Configure.Controller.AdminSSHKey
+	config := &ssntp.Config{
+		URI:    cfg.ServerURL,
+		CAcert: cfg.CACert,
+		Cert:   cfg.Cert,
+		Log:    ssntp.Log,
+	}
 
-	if clusterConfig.Configure.Controller.ClientAuthCACertPath != "" {
-		clientCertCAPath = clusterConfig.Configure.Controller.ClientAuthCACertPath
+	var clusterConfig payloads.Configure
+	c.client, clusterConfig, err = newSSNTPClient(c, config, cfg.ConnectTimeout)
+	if err != nil {
+		c.fatalf("unable to connect to SSNTP server: %v", err)
 	}
 
-	if clusterConfig.Configure.Controller.CNCINet != "" {
-		err = cnciNet.Set(clusterConfig.Configure.Controller.CNCINet)
-		if err != nil {
-			glog.Fatalf("Invalid CNCI Net cluster configuration: %v", err)
-			return
-		}
+	cfg, err = c.config.setClusterConfig(clusterConfig)
+	if err != nil {
+		c.fatalf("Invalid cluster configuration: %v", err)
 	}
 
-	ctl.ds.GenerateCNCIWorkload(cnciVCPUs, cnciMem, cnciDisk, adminSSHKey)
+	adminSSHKey = cfg.AdminSSHKey
 
-	database.Logger = gloginterface.CiaoGlogLogger{}
+	err = cnciNet.Set(cfg.CNCINet)
+	if err != nil {
+		c.fatalf("Invalid CNCI Net configuration: %v", err)
+	}
+
+	c.ds.GenerateCNCIWorkload(cfg.CNCIVcpus, cfg.CNCIMem, cfg.CNCIDisk, adminSSHKey)
 
-	ctl.BlockDriver = func() storage.BlockDriver {
+	c.BlockDriver = func() storage.BlockDriver {
 		driver := storage.CephDriver{
-			ID: *cephID,
+			ID: cfg.CephID,
 		}
 		return driver
 	}()
 
-	err = initializeCNCICtrls(ctl)
+	// tenants whose CNCI controllers fail to initialize are reported
+	// as degraded rather than preventing the controller from starting.
+	err = initializeCNCICtrls(c)
 	if err != nil {
-		glog.Fatal("Unable to initialize CNCI controllers: ", err)
-		return
+		c.fatalf("Unable to initialize CNCI controllers: %v", err)
 	}
 
-	host, err := getNameFromCert(httpsCAcert, httpsKey)
+	err = c.loadCNCIPool()
 	if err != nil {
-		glog.Warningf("Unable to get name from certificate: %s", err)
-		host, _ = os.Hostname()
+		c.fatalf("Unable to load CNCI pool: %v", err)
 	}
 
-	ctl.apiURL = fmt.Sprintf("https://%s:%d", host, controllerAPIPort)
-
-	server, err := ctl.createCiaoServer()
+	err = c.loadLaunchQueue()
 	if err != nil {
-		glog.Fatalf("Error creating ciao server: %v", err)
+		c.fatalf("Unable to load launch queue: %v", err)
 	}
-	ctl.httpServers = append(ctl.httpServers, server)
+}
 
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+// setAPIConfig sets up the address and certificates of the API server.
+func (c *controller) setAPIConfig(cfg controllerConfig) {
+	controllerAPIPort = cfg.APIPort
+	httpsCAcert = cfg.HTTPSCACert
+	httpsKey = cfg.HTTPSKey
+	clientCertCAPath = cfg.ClientAuthCACertPath
+
+	host := cfg.APIHostname
+	if host == "" {
+		var err error
+		host, err = getNameFromCert(httpsCAcert, httpsKey, parseNameOrder(cfg.APINameOrder))
+		if err != nil {
+			host, _ = os.Hostname()
+			c.log.Warningf("Unable to get name from certificate, using %s: %s", host, err)
+		} else {
+			c.log.Infof("Got name from certificate: %s", host)
+		}
+	}
+
+	// IPv6 addresses from the certificate must be bracketed in the URL
+	c.apiURL = "https://" + net.JoinHostPort(host, strconv.Itoa(controllerAPIPort))
+}
+
+// startMetricsServer exports the controller metrics over plain HTTP on
+// addr.  wg is marked done once the server has been shut down.
+func (c *controller) startMetricsServer(addr string, wg *sync.WaitGroup) {
+	c.metricsServer = c.createMetricsServer(addr)
+
+	wg.Add(1)
 	go func() {
-		s := <-signalCh
-		glog.Warningf("Received signal: %s", s)
-		ctl.ShutdownHTTPServers()
-		shutdownCNCICtrls(ctl)
+		if err := c.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			c.log.Errorf("Error from metrics server: %v", err)
+		}
+		wg.Done()
 	}()
+}
 
-	for _, server := range ctl.httpServers {
-		wg.Add(1)
-		go func(server *http.Server) {
-			if err := server.ListenAndServeTLS(httpsCAcert, httpsKey); err != http.ErrServerClosed {
-				glog.Errorf("Error from HTTP server: %v", err)
-			}
-			wg.Done()
-		}(server)
+// startHTTPServer creates the API server and starts serving requests.  wg
+// is marked done once the server has been shut down.
+func (c *controller) startHTTPServer(wg *sync.WaitGroup) {
+	server, err := c.createCiaoServer()
+	if err != nil {
+		c.fatalf("Error creating ciao server: %v", err)
 	}
+	c.httpServers = append(c.httpServers, server)
 
-	wg.Wait()
-	glog.Warning("Controller shutdown initiated")
-	ctl.qs.Shutdown()
-	ctl.ds.Exit()
-	ctl.client.Disconnect()
-	glog.Flush()
+	wg.Add(1)
+	go func() {
+		// the certificate is provided by the server's GetCertificate
+		// callback so that it can be replaced while serving.
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			c.log.Errorf("Error from HTTP server: %v", err)
+		}
+		wg.Done()
+	}()
 }
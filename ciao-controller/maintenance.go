@@ -0,0 +1,187 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// maintenanceCheckPeriod is how often the database size is sampled and
+// postponed maintenance is retried.
+const maintenanceCheckPeriod = time.Minute
+
+// maintenanceState records the outcome of the database maintenance.
+type maintenanceState struct {
+	sync.Mutex
+	last        *types.DatabaseMaintenance
+	sizeWarning bool
+}
+
+// maintenanceBlocked returns the reason the database maintenance cannot
+// run now, or an empty string if it can.  Maintenance is only run by the
+// active controller, when few API requests are in flight and never while
+// the backup lock file exists.
+func (c *controller) maintenanceBlocked(cfg controllerConfig) string {
+	if !cfg.DBMaintenance {
+		return "disabled by configuration"
+	}
+
+	if !c.isActive() {
+		return "controller not active"
+	}
+
+	if cfg.DBBackupLock != "" {
+		if _, err := os.Stat(cfg.DBBackupLock); err == nil {
+			return "backup in progress"
+		}
+	}
+
+	if atomic.LoadInt64(&c.inFlight) > int64(cfg.DBMaintenanceMaxRequests) {
+		return "API requests in flight"
+	}
+
+	return ""
+}
+
+// pruneStatistics removes the node and instance statistics older than
+// stats_retention.
+func (c *controller) pruneStatistics(cfg controllerConfig, now time.Time) {
+	pruned, err := c.ds.PruneStatistics(now.Add(-cfg.StatsRetention))
+	if err != nil {
+		c.log.Warningf("Unable to prune statistics: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d statistics", pruned)
+	}
+}
+
+// maintainDatastore periodically samples the size of the database, prunes
+// old operations, idempotency keys, statistics, quota audit and audit
+// records, purges expired trash and compacts the database once every
+// db_maintenance_interval.
+func (c *controller) maintainDatastore() {
+	ticker := time.NewTicker(maintenanceCheckPeriod)
+	defer ticker.Stop()
+
+	due := time.Now().Add(c.config.config().DBMaintenanceInterval)
+
+	// the database metrics are only refreshed here, not when scraped.
+	_ = c.databaseStatus(c.config.config())
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		cfg := c.config.config()
+		_ = c.databaseStatus(cfg)
+		c.refreshInstanceMetrics()
+		c.rateLimits.prune(cfg, now)
+
+		if c.isActive() {
+			c.pruneOperations(cfg)
+			c.pruneIdempotencyKeys(cfg)
+			c.pruneAuthTokens(now)
+			c.purgeTrash(now)
+			c.pruneInstanceHistory(now)
+			c.pruneStatistics(cfg, now)
+			c.pruneQuotaAudit(cfg, now)
+			c.pruneAudit(cfg, now)
+		}
+
+		if now.Before(due) {
+			continue
+		}
+
+		if reason := c.maintenanceBlocked(cfg); reason != "" {
+			if c.log.V(1) {
+				c.log.Infof("Datastore maintenance postponed: %s", reason)
+			}
+			continue
+		}
+
+		c.compactDatastore()
+		due = now.Add(cfg.DBMaintenanceInterval)
+	}
+}
+
+// compactDatastore releases the free space in the database and records the
+// size of the database before and after.
+func (c *controller) compactDatastore() types.DatabaseMaintenance {
+	m := types.DatabaseMaintenance{Time: time.Now()}
+
+	before, err := c.ds.DatabaseStatus()
+	if err != nil {
+		c.log.Warningf("Unable to read database size: %v", err)
+	}
+	m.SizeBefore = before.FileSize + before.WALSize
+
+	err = c.ds.Compact()
+	c.metrics.databaseMaintained(err)
+	if err != nil {
+		m.Error = err.Error()
+		c.log.Errorf("Datastore maintenance failed: %v", err)
+	}
+
+	after, err := c.ds.DatabaseStatus()
+	if err != nil {
+		c.log.Warningf("Unable to read database size: %v", err)
+	}
+	m.SizeAfter = after.FileSize + after.WALSize
+
+	if m.Error == "" {
+		c.log.Infof("Datastore maintenance complete: %d bytes before, %d bytes after",
+			m.SizeBefore, m.SizeAfter)
+	}
+
+	c.maintenance.Lock()
+	c.maintenance.last = &m
+	c.maintenance.Unlock()
+
+	return m
+}
+
+// databaseStatus returns the size of the database, updating the metrics
+// and warning when the database grows beyond db_size_warning_mb.
+func (c *controller) databaseStatus(cfg controllerConfig) types.DatabaseStatus {
+	s, err := c.ds.DatabaseStatus()
+	if err != nil {
+		c.log.Warningf("Unable to read database size: %v", err)
+	}
+
+	size := s.FileSize + s.WALSize
+	s.SizeWarning = cfg.DBSizeWarning > 0 && size > int64(cfg.DBSizeWarning)<<20
+
+	c.maintenance.Lock()
+	if s.SizeWarning && !c.maintenance.sizeWarning {
+		c.log.Warningf("Database size %d bytes exceeds %d MB", size, cfg.DBSizeWarning)
+	}
+	c.maintenance.sizeWarning = s.SizeWarning
+	s.LastMaintenance = c.maintenance.last
+	c.maintenance.Unlock()
+
+	c.metrics.databaseStatus(s)
+
+	return s
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestMaintenanceBlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller_maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg := defaultConfig()
+	cfg.DBBackupLock = filepath.Join(dir, "backup.lock")
+
+	if reason := ctl.maintenanceBlocked(cfg); reason != "" {
+		t.Fatalf("Maintenance unexpectedly blocked: %s", reason)
+	}
+
+	disabled := cfg
+	disabled.DBMaintenance = false
+	if ctl.maintenanceBlocked(disabled) == "" {
+		t.Error("Maintenance not blocked when disabled")
+	}
+
+	atomic.AddInt64(&ctl.inFlight, int64(cfg.DBMaintenanceMaxRequests)+1)
+	reason := ctl.maintenanceBlocked(cfg)
+	atomic.AddInt64(&ctl.inFlight, -int64(cfg.DBMaintenanceMaxRequests)-1)
+	if reason == "" {
+		t.Error("Maintenance not blocked by requests in flight")
+	}
+
+	err = ioutil.WriteFile(cfg.DBBackupLock, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctl.maintenanceBlocked(cfg) == "" {
+		t.Error("Maintenance not blocked by backup")
+	}
+}
+
+func TestCompactDatastore(t *testing.T) {
+	m := ctl.compactDatastore()
+	if m.Error != "" {
+		t.Fatalf("Maintenance failed: %s", m.Error)
+	}
+
+	s := ctl.databaseStatus(defaultConfig())
+	if s.LastMaintenance == nil || !s.LastMaintenance.Time.Equal(m.Time) {
+		t.Errorf("Maintenance not recorded in status: %+v", s)
+	}
+
+	body := testHTTPRequest(t, "GET", testutil.ComputeURL+"/metrics", http.StatusOK, nil, true)
+
+	expected := []string{
+		`ciao_controller_db_maintenance_total{result="completed"} `,
+		"ciao_controller_db_freelist_pages ",
+		"ciao_controller_db_size_warning 0",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("Expected %q in metrics:\n%s", e, body)
+		}
+	}
+}
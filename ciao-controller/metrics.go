@@ -0,0 +1,502 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/metrics"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/service"
+	"github.com/gorilla/mux"
+)
+
+// quotaDenialBuckets is the number of buckets the quota denial window is
+// divided into.
+const quotaDenialBuckets = 60
+
+// clockSkewMetricNodes is the number of nodes whose clock offsets are
+// exported.
+const clockSkewMetricNodes = 10
+
+// quotaDenialSummaryTenants is the number of tenants included in the
+// periodic quota denial summary event.
+const quotaDenialSummaryTenants = 10
+
+// controllerMetrics holds the counters exported on the /metrics endpoint.
+// Tenant labels are limited to the first maxTenants tenants seen; the
+// denials of any other tenants are counted under "other".
+type controllerMetrics struct {
+	registry       *metrics.Registry
+	tenants        *metrics.LabelLimiter
+	quotaDenials   *metrics.CounterVec
+	apiRequests    *metrics.CounterVec
+	apiLatency     *metrics.HistogramVec
+	apiErrors      *metrics.CounterVec
+	launchFailures *metrics.CounterVec
+	eventsDropped  *metrics.CounterVec
+	policyChecks   *metrics.CounterVec
+	denialWindow   *metrics.Window
+
+	dbFileSize      *metrics.Gauge
+	dbWALSize       *metrics.Gauge
+	dbFreelistPages *metrics.Gauge
+	dbSizeWarning   *metrics.Gauge
+	dbMaintenance   *metrics.CounterVec
+
+	nodeClockOffsets *metrics.GaugeVec
+	nodesClockSkewed *metrics.Gauge
+
+	ssntpFrames   *metrics.CounterVec
+	dbQueries     *metrics.HistogramVec
+	instances     *metrics.GaugeVec
+	cnciFailovers *metrics.CounterVec
+}
+
+func newControllerMetrics(maxTenants int, window time.Duration, now func() time.Time) *controllerMetrics {
+	m := &controllerMetrics{
+		registry: metrics.NewRegistry(),
+		tenants:  metrics.NewLabelLimiter(maxTenants),
+		quotaDenials: metrics.NewCounterVec("ciao_controller_quota_denials_total",
+			"Requests denied because they exceeded a tenant quota or limit", "tenant", "resource"),
+		apiRequests: metrics.NewCounterVec("ciao_controller_api_requests_total",
+			"API requests served", "route", "method", "code"),
+		apiLatency: metrics.NewHistogramVec("ciao_controller_api_request_duration_seconds",
+			"Time taken to serve API requests", metrics.LatencyBuckets, "route", "method"),
+		apiErrors: metrics.NewCounterVec("ciao_controller_api_errors_total",
+			"API requests which returned a 4xx or 5xx status", "route", "code"),
+		launchFailures: metrics.NewCounterVec("ciao_controller_launch_failures_total",
+			"Instances which failed to start", "reason_class"),
+		eventsDropped: metrics.NewCounterVec("ciao_controller_events_dropped_total",
+			"Events dropped because the event log queue was full", "type"),
+		policyChecks: metrics.NewCounterVec("ciao_controller_policy_evaluations_total",
+			"Evaluations of workloads against the workload policy", "stage", "result"),
+		denialWindow: metrics.NewWindow(window, quotaDenialBuckets, now),
+
+		dbFileSize: metrics.NewGauge("ciao_controller_db_file_bytes",
+			"Size of the controller database file"),
+		dbWALSize: metrics.NewGauge("ciao_controller_db_wal_bytes",
+			"Size of the controller database write ahead log"),
+		dbFreelistPages: metrics.NewGauge("ciao_controller_db_freelist_pages",
+			"Unused pages in the controller database"),
+		dbSizeWarning: metrics.NewGauge("ciao_controller_db_size_warning",
+			"1 if the controller database is larger than db_size_warning_mb"),
+		dbMaintenance: metrics.NewCounterVec("ciao_controller_db_maintenance_total",
+			"Controller database maintenance passes", "result"),
+
+		nodeClockOffsets: metrics.NewGaugeVec("ciao_controller_node_clock_offset_ms",
+			"Clock offsets of the nodes furthest from the controller's clock", "node"),
+		nodesClockSkewed: metrics.NewGauge("ciao_controller_nodes_clock_skewed",
+			"Nodes whose clock is further than clock_skew_threshold from the controller's"),
+
+		ssntpFrames: metrics.NewCounterVec("ciao_controller_ssntp_frames_total",
+			"SSNTP frames received from the scheduler", "kind", "type"),
+		dbQueries: metrics.NewHistogramVec("ciao_controller_db_query_duration_seconds",
+			"Time taken by the statements run against the controller database", metrics.LatencyBuckets, "statement"),
+		instances: metrics.NewGaugeVec("ciao_controller_instances",
+			"Tenant instances by state", "state"),
+		cnciFailovers: metrics.NewCounterVec("ciao_controller_cnci_failovers_total",
+			"Failovers of CNCIs which stopped being reported running", "result"),
+	}
+
+	m.registry.Register(m.quotaDenials, m.apiRequests, m.apiLatency, m.apiErrors, m.launchFailures,
+		m.eventsDropped, m.policyChecks,
+		m.dbFileSize, m.dbWALSize, m.dbFreelistPages, m.dbSizeWarning, m.dbMaintenance,
+		m.nodeClockOffsets, m.nodesClockSkewed,
+		m.ssntpFrames, m.dbQueries, m.instances, m.cnciFailovers)
+
+	return m
+}
+
+// quotaDenied records a request denied for tenantID because of resources.
+func (m *controllerMetrics) quotaDenied(tenantID string, resources []payloads.Resource) {
+	if m == nil {
+		return
+	}
+
+	tenant := m.tenants.Label(tenantID)
+	for _, r := range resources {
+		// workloads are not used as labels as there is no bound on them
+		label := string(r)
+		if _, ok := quotas.WorkloadResource(r); ok {
+			label = "workload_instances"
+		}
+		m.quotaDenials.Inc(tenant, label)
+	}
+	m.denialWindow.Add(tenantID)
+}
+
+// apiRequest records the status of an API request and how long it took to
+// serve.  Errors are also counted on their own.
+func (m *controllerMetrics) apiRequest(route string, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	status := strconv.Itoa(code)
+	m.apiRequests.Inc(route, method, status)
+	m.apiLatency.Observe(d.Seconds(), route, method)
+
+	if code >= http.StatusBadRequest {
+		m.apiErrors.Inc(route, status)
+	}
+}
+
+// ssntpFrame records a frame received from the scheduler, of kind command,
+// event, status or error.
+func (m *controllerMetrics) ssntpFrame(kind string, frameType string) {
+	if m == nil {
+		return
+	}
+
+	m.ssntpFrames.Inc(kind, frameType)
+}
+
+// queryObserved records how long a statement run against the controller
+// database took.
+func (m *controllerMetrics) queryObserved(statement string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.dbQueries.Observe(d.Seconds(), statement)
+}
+
+// instanceStates records the number of tenant instances in each state.
+// States without any instances are not exported.
+func (m *controllerMetrics) instanceStates(instances []*types.Instance) {
+	if m == nil {
+		return
+	}
+
+	counts := make(map[string]int64)
+	for _, i := range instances {
+		i.StateLock.RLock()
+		counts[i.State]++
+		i.StateLock.RUnlock()
+	}
+
+	m.instances.Reset()
+	for state, n := range counts {
+		m.instances.Set(n, state)
+	}
+}
+
+// cnciFailedOver records the result of the failover of a CNCI.
+func (m *controllerMetrics) cnciFailedOver(err error) {
+	if m == nil {
+		return
+	}
+
+	result := "completed"
+	if err != nil {
+		result = "failed"
+	}
+	m.cnciFailovers.Inc(result)
+}
+
+// launchFailed records an instance which failed to start.
+func (m *controllerMetrics) launchFailed(reason payloads.StartFailureReason) {
+	if m == nil {
+		return
+	}
+
+	m.launchFailures.Inc(launchFailureClass(reason))
+}
+
+// eventDropped records an event dropped from the full event log queue.
+func (m *controllerMetrics) eventDropped(eventType string) {
+	if m == nil {
+		return
+	}
+
+	m.eventsDropped.Inc(eventType)
+}
+
+// policyEvaluated records the result, allow, warn or deny, of evaluating a
+// workload against the workload policy when it is created or updated, the
+// ingest stage, or when it is launched.
+func (m *controllerMetrics) policyEvaluated(stage string, result string) {
+	if m == nil {
+		return
+	}
+
+	m.policyChecks.Inc(stage, result)
+}
+
+// databaseStatus records the size of the controller database.
+func (m *controllerMetrics) databaseStatus(s types.DatabaseStatus) {
+	if m == nil {
+		return
+	}
+
+	m.dbFileSize.Set(s.FileSize)
+	m.dbWALSize.Set(s.WALSize)
+	m.dbFreelistPages.Set(s.FreelistPages)
+
+	warning := int64(0)
+	if s.SizeWarning {
+		warning = 1
+	}
+	m.dbSizeWarning.Set(warning)
+}
+
+// databaseMaintained records the result of a database maintenance pass.
+func (m *controllerMetrics) databaseMaintained(err error) {
+	if m == nil {
+		return
+	}
+
+	result := "completed"
+	if err != nil {
+		result = "failed"
+	}
+	m.dbMaintenance.Inc(result)
+}
+
+// clockOffsets records the clock offsets of the nodes, given furthest
+// from the controller's clock first.  Only the clockSkewMetricNodes
+// furthest nodes are exported individually.
+func (m *controllerMetrics) clockOffsets(offsets []nodeClockOffset) {
+	if m == nil {
+		return
+	}
+
+	m.nodeClockOffsets.Reset()
+
+	skewed := int64(0)
+	for i, o := range offsets {
+		if i < clockSkewMetricNodes {
+			m.nodeClockOffsets.Set(int64(o.offset/time.Millisecond), o.nodeID)
+		}
+		if o.skewed {
+			skewed++
+		}
+	}
+	m.nodesClockSkewed.Set(skewed)
+}
+
+// launchFailureClass groups the start failure reasons reported by the
+// scheduler and launcher.
+func launchFailureClass(reason payloads.StartFailureReason) string {
+	switch reason {
+	case payloads.FullCloud, payloads.FullComputeNode, payloads.NodeInMaintenance,
+		payloads.NoComputeNodes, payloads.NoNetworkNodes:
+		return "capacity"
+	case payloads.InvalidPayload, payloads.InvalidData:
+		return "payload"
+	case payloads.AlreadyRunning, payloads.InstanceExists:
+		return "conflict"
+	case payloads.ImageFailure, payloads.LaunchFailure, payloads.NetworkFailure:
+		return "launcher"
+	}
+
+	return "unknown"
+}
+
+// topQuotaDenials returns the limit tenants with the most quota denials in
+// the window.
+func (m *controllerMetrics) topQuotaDenials(limit int) types.QuotaDenialsResponse {
+	resp := types.QuotaDenialsResponse{Tenants: []types.TenantQuotaDenials{}}
+	if m == nil {
+		return resp
+	}
+
+	resp.Window = m.denialWindow.Length().String()
+	for _, kc := range m.denialWindow.Top(limit) {
+		resp.Tenants = append(resp.Tenants, types.TenantQuotaDenials{
+			TenantID: kc.Key,
+			Denials:  kc.Count,
+		})
+	}
+
+	return resp
+}
+
+// ListQuotaDenials returns the tenants with the most quota denials in the
+// quota denial window.
+func (c *controller) ListQuotaDenials(limit int) types.QuotaDenialsResponse {
+	return c.metrics.topQuotaDenials(limit)
+}
+
+// serveMetrics exports the controller metrics on the /metrics route of the
+// API.  Like the rest of the API the route requires a client certificate,
+// and the metrics are only exported to admins.  Scrapers which cannot
+// authenticate as an admin must use the metrics_addr listener instead.
+func (c *controller) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !service.GetPrivilege(r.Context()) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	c.writeMetrics(w, r)
+}
+
+// writeMetrics writes the current metrics.  Scrapes do not query the
+// datastore; the gauges read from it are refreshed by the maintenance
+// ticker.
+func (c *controller) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	c.metrics.registry.ServeHTTP(w, r)
+}
+
+// createMetricsServer returns a server exporting the controller metrics on
+// addr without requiring clients to authenticate, for scrapers which hold
+// no client certificate.  Binding addr to the loopback interface limits
+// the metrics to local scrapers.
+func (c *controller) createMetricsServer(addr string) *http.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics", c.writeMetrics).Methods("GET")
+
+	return &http.Server{
+		Handler: r,
+		Addr:    addr,
+	}
+}
+
+// refreshInstanceMetrics records the number of tenant instances in each
+// state.
+func (c *controller) refreshInstanceMetrics() {
+	instances, err := c.ds.GetAllInstances()
+	if err != nil {
+		c.log.Warningf("Unable to count instances: %v", err)
+		return
+	}
+
+	c.metrics.instanceStates(instances)
+}
+
+// summarizeQuotaDenials periodically publishes an event listing the
+// tenants with the most quota denials.
+func (c *controller) summarizeQuotaDenials(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.publishQuotaDenialSummary()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *controller) publishQuotaDenialSummary() {
+	summary := c.metrics.topQuotaDenials(quotaDenialSummaryTenants)
+	if len(summary.Tenants) == 0 {
+		return
+	}
+
+	data := make(map[string]string)
+	for _, t := range summary.Tenants {
+		data[t.TenantID] = strconv.Itoa(t.Denials)
+	}
+
+	msg := fmt.Sprintf("%d tenants had quota denials in the last %s", len(summary.Tenants), summary.Window)
+	c.publishEvent(types.QuotaDenialSummaryEvent, "", msg, data)
+}
+
+// statusRecorder remembers the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends any buffered data to the client so that streamed responses
+// are not held back by the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsHandler counts the API requests in flight and those served, and
+// times them, labelled by the template of the route they matched.
+type metricsHandler struct {
+	Controller *controller
+	Router     *mux.Router
+	Next       http.Handler
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&h.Controller.inFlight, 1)
+	defer atomic.AddInt64(&h.Controller.inFlight, -1)
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.Next.ServeHTTP(rec, r)
+	d := time.Since(start)
+
+	route := "unmatched"
+	var match mux.RouteMatch
+	if h.Router.Match(r, &match) {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			route = routeLabel(tmpl)
+		}
+	}
+
+	h.Controller.metrics.apiRequest(route, methodLabel(r.Method), rec.status, d)
+}
+
+// methodLabel returns the method of a request, or "other" for methods the
+// API does not serve as there is no bound on them.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// routeLabel strips the regular expressions from the variables in a route
+// template, e.g., /{tenant:[0-9a-f-]+}/instances becomes
+// /{tenant}/instances.
+func routeLabel(tmpl string) string {
+	var b bytes.Buffer
+
+	depth := 0
+	skip := false
+	for _, ch := range tmpl {
+		switch {
+		case ch == '{':
+			depth++
+		case ch == '}':
+			depth--
+			if depth == 0 {
+				skip = false
+			}
+		case ch == ':' && depth == 1:
+			skip = true
+		}
+
+		if !skip {
+			b.WriteRune(ch)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/metrics"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestRouteLabel(t *testing.T) {
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{"/metrics", "/metrics"},
+		{"/{tenant}/instances", "/{tenant}/instances"},
+		{"/tenants/{tenant:[0-9a-f]{8}-[0-9a-f]{4}}/quotas", "/tenants/{tenant}/quotas"},
+		{"/{tenant:[a-z]+}/volumes/{volume_id}", "/{tenant}/volumes/{volume_id}"},
+	}
+
+	for _, tt := range tests {
+		if l := routeLabel(tt.tmpl); l != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.tmpl, tt.expected, l)
+		}
+	}
+}
+
+func TestMetricsTenantLimit(t *testing.T) {
+	m := newControllerMetrics(1, time.Hour, time.Now)
+
+	m.quotaDenied("tenant1", []payloads.Resource{payloads.Instance})
+	m.quotaDenied("tenant2", []payloads.Resource{payloads.Instance, payloads.MemMB})
+	m.quotaDenied("tenant3", []payloads.Resource{payloads.Instance})
+
+	if v := m.quotaDenials.Value("tenant1", string(payloads.Instance)); v != 1 {
+		t.Errorf("Expected 1 denial for tenant1, got %d", v)
+	}
+
+	if v := m.quotaDenials.Value(metrics.OtherLabel, string(payloads.Instance)); v != 2 {
+		t.Errorf("Expected 2 denials for other tenants, got %d", v)
+	}
+
+	// the window is not limited as it is not exported as a label
+	if top := m.topQuotaDenials(0); len(top.Tenants) != 3 {
+		t.Errorf("Expected 3 tenants, got %v", top.Tenants)
+	}
+
+	m.quotaDenied("tenant1", []payloads.Resource{quotas.WorkloadInstances("b4f8a7ab-4fe6-4c0b-a1c2-8a9d73fc0e0b")})
+	if v := m.quotaDenials.Value("tenant1", "workload_instances"); v != 1 {
+		t.Errorf("Expected 1 workload instances denial for tenant1, got %d", v)
+	}
+}
+
+func TestQuotaDenialMetrics(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 0},
+	})
+	defer ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: -1},
+	})
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	var server api.CreateServerRequest
+	server.Server.MaxInstances = 1
+	server.Server.WorkloadID = wls[0].ID
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances"
+	for i := 0; i < 2; i++ {
+		_ = testHTTPRequest(t, "POST", url, http.StatusForbidden, b, true)
+	}
+
+	body := testHTTPRequest(t, "GET", testutil.ComputeURL+"/metrics", http.StatusOK, nil, true)
+
+	expected := []string{
+		fmt.Sprintf(`ciao_controller_quota_denials_total{tenant="%s",resource="instance"} 2`, tenant.ID),
+		`ciao_controller_api_errors_total{route="/{tenant}/instances",code="403"} `,
+		`ciao_controller_api_requests_total{route="/{tenant}/instances",method="POST",code="403"} `,
+		`ciao_controller_api_request_duration_seconds_count{route="/{tenant}/instances",method="POST"} `,
+		`ciao_controller_db_query_duration_seconds_count{statement="select"} `,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("Expected %q in metrics:\n%s", e, body)
+		}
+	}
+
+	body = testHTTPRequest(t, "GET", testutil.ComputeURL+"/tenants/quotas/denials?limit=100", http.StatusOK, nil, true)
+
+	var resp types.QuotaDenialsResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, td := range resp.Tenants {
+		if td.TenantID == tenant.ID {
+			found = td.Denials == 2
+		}
+	}
+	if !found {
+		t.Errorf("Expected 2 denials for tenant %s: %v", tenant.ID, resp.Tenants)
+	}
+}
+
+func TestQuotaDenialSummary(t *testing.T) {
+	ch := ctl.events.subscribe(10)
+	defer ctl.events.unsubscribe(ch)
+
+	ctl.metrics.quotaDenied("summary-tenant", []payloads.Resource{payloads.VCPUs})
+	ctl.publishQuotaDenialSummary()
+
+	select {
+	case e := <-ch:
+		if e.Type != types.QuotaDenialSummaryEvent {
+			t.Fatalf("Unexpected event type %s", e.Type)
+		}
+		if e.Data["summary-tenant"] == "" {
+			t.Errorf("Tenant missing from summary: %v", e.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No summary event published")
+	}
+}
+
+func TestLaunchFailureMetrics(t *testing.T) {
+	before := ctl.metrics.launchFailures.Value("capacity")
+
+	client, _ := testStartWorkload(t, 1, true, payloads.FullCloud)
+	defer client.Shutdown()
+
+	for i := 0; i < 50; i++ {
+		if ctl.metrics.launchFailures.Value("capacity") > before {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Error("Launch failure not counted")
+}
+
+func TestControllerMetrics(t *testing.T) {
+	m := newControllerMetrics(1, time.Hour, time.Now)
+
+	m.apiRequest("/tenants", "GET", http.StatusOK, time.Millisecond)
+	m.apiRequest("/tenants", "GET", http.StatusNotFound, time.Millisecond)
+
+	if v := m.apiRequests.Value("/tenants", "GET", "200"); v != 1 {
+		t.Errorf("Expected 1 successful request, got %d", v)
+	}
+	if v := m.apiLatency.Count("/tenants", "GET"); v != 2 {
+		t.Errorf("Expected 2 timed requests, got %d", v)
+	}
+	if v := m.apiErrors.Total(); v != 1 {
+		t.Errorf("Expected 1 error, got %d", v)
+	}
+
+	m.cnciFailedOver(nil)
+	m.cnciFailedOver(errors.New("failed"))
+	if m.cnciFailovers.Value("completed") != 1 || m.cnciFailovers.Value("failed") != 1 {
+		t.Errorf("Unexpected failover counts: %d completed %d failed",
+			m.cnciFailovers.Value("completed"), m.cnciFailovers.Value("failed"))
+	}
+
+	m.instanceStates([]*types.Instance{
+		{State: payloads.Running},
+		{State: payloads.Running},
+		{State: payloads.Exited},
+	})
+	m.instanceStates([]*types.Instance{
+		{State: payloads.Running},
+	})
+
+	if v, ok := m.instances.Value(payloads.Running); !ok || v != 1 {
+		t.Errorf("Expected 1 running instance, got %d", v)
+	}
+	if _, ok := m.instances.Value(payloads.Exited); ok {
+		t.Errorf("Expected state without instances to be dropped")
+	}
+
+	if methodLabel("BREW") != "other" || methodLabel("DELETE") != "DELETE" {
+		t.Errorf("Unexpected method labels")
+	}
+
+	var nilMetrics *controllerMetrics
+	nilMetrics.apiRequest("/tenants", "GET", http.StatusOK, time.Millisecond)
+	nilMetrics.queryObserved("select", time.Millisecond)
+}
+
+func TestSSNTPFrameMetrics(t *testing.T) {
+	before := ctl.metrics.ssntpFrames.Value("status", ssntp.READY.String())
+
+	ctl.client.StatusNotify(ssntp.READY, &ssntp.Frame{})
+
+	if v := ctl.metrics.ssntpFrames.Value("status", ssntp.READY.String()); v != before+1 {
+		t.Errorf("Expected %d status frames, got %d", before+1, v)
+	}
+}
+
+func TestServeMetricsAdminOnly(t *testing.T) {
+	// the request carries no privilege, as if made by a tenant
+	rec := httptest.NewRecorder()
+	ctl.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	server := httptest.NewServer(ctl.createMetricsServer("127.0.0.1:0").Handler)
+	defer server.Close()
+
+	// no client certificate is presented
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "ciao_controller_api_requests_total") {
+		t.Errorf("Unexpected metrics response %d:\n%s", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(server.URL + "/tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected only the metrics to be served, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// pendingMigration is a migration whose operation is waiting for the
+// nodes involved to report its progress.
+type pendingMigration struct {
+	prepared chan struct{}
+	result   chan error
+}
+
+// migrationRequests routes the progress of the migrations reported by the
+// nodes to the operations waiting for them.  An instance may only be
+// migrated once at a time.
+type migrationRequests struct {
+	lock    sync.Mutex
+	pending map[string]pendingMigration
+}
+
+func (r *migrationRequests) add(instanceID string) pendingMigration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]pendingMigration)
+	}
+
+	p := pendingMigration{
+		prepared: make(chan struct{}, 1),
+		result:   make(chan error, 1),
+	}
+	r.pending[instanceID] = p
+
+	return p
+}
+
+// remove forgets the migration p of an instance, unless a later migration
+// of the instance has already replaced it.
+func (r *migrationRequests) remove(instanceID string, p pendingMigration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending[instanceID].result == p.result {
+		delete(r.pending, instanceID)
+	}
+}
+
+// prepared tells the operation migrating an instance, if any, that the
+// target node is ready to receive it.
+func (r *migrationRequests) prepared(instanceID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if p, ok := r.pending[instanceID]; ok {
+		select {
+		case p.prepared <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// done passes the outcome of the migration of an instance on to the
+// operation waiting for it, if any.
+func (r *migrationRequests) done(instanceID string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if p, ok := r.pending[instanceID]; ok {
+		select {
+		case p.result <- err:
+		default:
+		}
+	}
+}
+
+// MigrateInstance live migrates a running VM instance to another compute
+// node.  The target node is first asked to get ready to receive the
+// instance, reattaching its volumes, and once it is ready the node running
+// the instance is asked to transfer it.  The instance keeps running on its
+// node until the transfer completes and is left there if either node
+// fails.  The migration is tracked by the operation which is returned, whose
+// result is the target node, and its outcome is also published as an event.
+func (c *controller) MigrateInstance(tenantID string, instanceID string, targetNodeID string) (types.Operation, error) {
+	i, err := c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	i.StateLock.RLock()
+	state := i.State
+	i.StateLock.RUnlock()
+
+	if state == payloads.Migrating {
+		return types.Operation{}, types.ErrInstanceMigrating
+	}
+
+	if i.CNCI || state != payloads.Running || i.NodeID == "" {
+		return types.Operation{}, types.ErrInstanceNotMigratable
+	}
+
+	w, err := c.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if w.VMType == payloads.Docker {
+		return types.Operation{}, types.ErrInstanceNotMigratable
+	}
+
+	target, err := c.ds.GetNode(targetNodeID)
+	if err != nil || !target.NodeRole.IsAgent() || target.ID == i.NodeID {
+		return types.Operation{}, types.ErrBadMigration
+	}
+
+	t, err := c.ds.GetTenant(i.TenantID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	cnci, err := t.CNCIctrl.GetInstanceCNCI(i.ID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	extra, err := nicNetworking(t, i.NICs)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	m := types.Migration{
+		InstanceID:   i.ID,
+		TenantID:     i.TenantID,
+		SourceNodeID: i.NodeID,
+		TargetNodeID: target.ID,
+		State:        types.MigrationPreparing,
+		StartTime:    time.Now(),
+	}
+
+	err = c.ds.StartMigration(m)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	c.recordCommand(i, "migrate")
+
+	cmd := payloads.PrepareMigrationCmd{
+		InstanceUUID:      i.ID,
+		TenantUUID:        i.TenantID,
+		WorkloadAgentUUID: m.TargetNodeID,
+		SourceAgentUUID:   m.SourceNodeID,
+		Requirements:      instanceRequirements(i, &w),
+		Networking: payloads.NetworkResources{
+			VnicMAC:          i.MACAddress,
+			VnicUUID:         i.VnicUUID,
+			ConcentratorUUID: cnci.ID,
+			ConcentratorIP:   cnci.IPAddress,
+			Subnet:           i.Subnet,
+			PrivateIP:        i.IPAddress,
+		},
+		ExtraNetworking: extra,
+	}
+
+	// The volumes of the instance, which are held in ceph, are attached
+	// to it again on the target node.
+	for _, a := range c.ds.GetStorageAttachments(i.ID) {
+		cmd.Storage = append(cmd.Storage, payloads.StorageResource{
+			ID:        a.BlockID,
+			Bootable:  a.Boot,
+			Ephemeral: a.Ephemeral,
+			Tag:       a.Tag,
+		})
+	}
+
+	p := c.migrations.add(i.ID)
+	op, err := c.startOperation(i.TenantID, types.MigrateInstanceOperation, i.ID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			defer c.migrations.remove(i.ID, p)
+
+			if err := c.client.prepareMigration(cmd); err != nil {
+				reason := fmt.Sprintf("unable to prepare node %s: %v", m.TargetNodeID, err)
+				c.migrationFailed(m, reason)
+				return "", errors.New(reason)
+			}
+
+			for {
+				select {
+				case <-p.prepared:
+					progress(50)
+				case err := <-p.result:
+					if err != nil {
+						return "", err
+					}
+					return m.TargetNodeID, nil
+				case <-ctx.Done():
+					return "", ctx.Err()
+				}
+			}
+		})
+	if err != nil {
+		c.migrations.remove(i.ID, p)
+		if dsErr := c.ds.AbortMigration(i.ID); dsErr != nil {
+			c.instanceLog(i).Errorf("Error rolling back migration: %v", dsErr)
+		}
+		return types.Operation{}, err
+	}
+
+	return op, nil
+}
+
+// migrationPrepared asks the node running an instance to transfer it once
+// the target node of its migration is ready to receive it.
+func (c *controller) migrationPrepared(event payloads.MigrationPreparedEvent) {
+	m, ok := c.ds.GetMigration(event.InstanceUUID)
+	if !ok || m.TargetNodeID != event.NodeUUID || m.State != types.MigrationPreparing {
+		c.log.Warningf("Unexpected migration of instance %s prepared by node %s", event.InstanceUUID, event.NodeUUID)
+		return
+	}
+
+	m.State = types.MigrationTransferring
+	err := c.ds.UpdateMigration(m)
+	if err != nil {
+		c.log.Warningf("Unable to update migration of instance %s: %v", m.InstanceID, err)
+		return
+	}
+
+	c.migrations.prepared(m.InstanceID)
+
+	err = c.client.migrateInstance(m.InstanceID, m.SourceNodeID, m.TargetNodeID, event.Address)
+	if err != nil {
+		c.abortMigration(m, fmt.Sprintf("unable to start transfer from node %s: %v", m.SourceNodeID, err))
+	}
+}
+
+// instanceMigrated completes the migration of an instance transferred to
+// its target node.
+func (c *controller) instanceMigrated(event payloads.InstanceMigratedEvent) {
+	m, ok := c.ds.GetMigration(event.InstanceUUID)
+	if !ok || m.TargetNodeID != event.TargetNodeUUID {
+		c.log.Warningf("Unexpected migration of instance %s to node %s", event.InstanceUUID, event.TargetNodeUUID)
+		return
+	}
+
+	c.migrationCompleted(m)
+}
+
+// migrationFailure rolls back the migration of an instance which either
+// of the nodes involved was unable to carry out.
+func (c *controller) migrationFailure(failure payloads.ErrorMigrationFailure) {
+	m, ok := c.ds.GetMigration(failure.InstanceUUID)
+	if !ok {
+		c.log.Warningf("Migration failure from node %s for instance %s which is not being migrated",
+			failure.NodeUUID, failure.InstanceUUID)
+		return
+	}
+
+	reason := fmt.Sprintf("node %s: %s", failure.NodeUUID, failure.Reason.String())
+	if failure.NodeUUID == m.TargetNodeID && m.State == types.MigrationPreparing {
+		c.migrationFailed(m, reason)
+		return
+	}
+
+	c.abortMigration(m, reason)
+}
+
+// migrationStats resolves the migrations whose outcome is known from the
+// stats of their target node.  This allows migrations which were being
+// transferred when the controller restarted, or whose events were lost, to
+// complete.  An instance which has disappeared from the target node
+// during its transfer was not received.
+func (c *controller) migrationStats(stats payloads.Stat) {
+	for _, m := range c.ds.GetMigrations() {
+		if m.TargetNodeID != stats.NodeUUID {
+			continue
+		}
+
+		state := ""
+		for _, i := range stats.Instances {
+			if i.InstanceUUID == m.InstanceID {
+				state = i.State
+				break
+			}
+		}
+
+		switch {
+		case state == payloads.Running:
+			c.migrationCompleted(m)
+		case state == "" && m.State == types.MigrationTransferring:
+			c.migrationFailed(m, fmt.Sprintf("instance not found on node %s", m.TargetNodeID))
+		}
+	}
+}
+
+// resumeMigrations deals with the migrations which were in progress when
+// the controller stopped.  Migrations which were still being prepared are
+// aborted as the controller cannot tell whether the target node is ready.
+// Transfers are left to complete and are resolved by the events or the
+// stats of their target nodes.
+func (c *controller) resumeMigrations() {
+	for _, m := range c.ds.GetMigrations() {
+		if m.State == types.MigrationPreparing {
+			c.abortMigration(m, "controller restarted")
+		}
+	}
+}
+
+// abortMigration asks the target node of a migration to discard the
+// instance it was ready to receive and rolls the migration back.
+func (c *controller) abortMigration(m types.Migration, reason string) {
+	err := c.client.abortMigration(m.InstanceID, m.TargetNodeID)
+	if err != nil {
+		c.log.Warningf("Unable to abort migration of instance %s on node %s: %v", m.InstanceID, m.TargetNodeID, err)
+	}
+
+	c.migrationFailed(m, reason)
+}
+
+func (c *controller) migrationCompleted(m types.Migration) {
+	log := clogger.With(c.log, "tenant", m.TenantID, "instance", m.InstanceID)
+
+	err := c.ds.CompleteMigration(m.InstanceID)
+	if err != nil {
+		log.Warningf("Unable to complete migration: %v", err)
+		return
+	}
+
+	msg := fmt.Sprintf("Instance %s migrated from node %s to node %s", m.InstanceID, m.SourceNodeID, m.TargetNodeID)
+	log.Infof("%s", msg)
+	if err := c.ds.LogEvent(m.TenantID, msg); err != nil {
+		log.Warningf("Error logging event: %v", err)
+	}
+
+	c.publishEvent(types.InstanceMigratedEvent, m.TenantID, msg, map[string]string{
+		"instance":    m.InstanceID,
+		"source_node": m.SourceNodeID,
+		"target_node": m.TargetNodeID,
+	})
+
+	c.migrations.done(m.InstanceID, nil)
+}
+
+func (c *controller) migrationFailed(m types.Migration, reason string) {
+	log := clogger.With(c.log, "tenant", m.TenantID, "instance", m.InstanceID)
+
+	// the operation fails even if the migration cannot be rolled back
+	defer c.migrations.done(m.InstanceID, errors.New(reason))
+
+	err := c.ds.AbortMigration(m.InstanceID)
+	if err != nil {
+		log.Warningf("Unable to roll back migration: %v", err)
+		return
+	}
+
+	msg := fmt.Sprintf("Migration of instance %s to node %s failed: %s", m.InstanceID, m.TargetNodeID, reason)
+	log.Warningf("%s", msg)
+	if err := c.ds.LogError(m.TenantID, msg); err != nil {
+		log.Warningf("Error logging error: %v", err)
+	}
+
+	c.publishEvent(types.InstanceMigrationFailedEvent, m.TenantID, msg, map[string]string{
+		"instance":    m.InstanceID,
+		"source_node": m.SourceNodeID,
+		"target_node": m.TargetNodeID,
+		"reason":      reason,
+	})
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// addMigrationTestAgent connects a compute node to which instances can be
+// migrated and makes the controller aware of it.
+func addMigrationTestAgent(t *testing.T) *testutil.SsntpTestClient {
+	client, err := testutil.NewSsntpTestClientConnection("Migration", ssntp.AGENT, uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.ds.AddNode(client.UUID, payloads.ComputeNode)
+	sendStatsCmd(client, t)
+
+	return client
+}
+
+// startMigrationTestInstance starts an instance on the source node and
+// connects a target node.
+func startMigrationTestInstance(t *testing.T) (*testutil.SsntpTestClient, *testutil.SsntpTestClient, *types.Instance) {
+	var reason payloads.StartFailureReason
+
+	source, instances := testStartWorkload(t, 1, false, reason)
+	sendStatsCmd(source, t)
+
+	i, err := ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.Running || i.NodeID != source.UUID {
+		t.Fatalf("Expected instance running on %s, got %s on %s", source.UUID, i.State, i.NodeID)
+	}
+
+	return source, addMigrationTestAgent(t), i
+}
+
+// waitMigrationResolved waits until an instance is no longer being
+// migrated.
+func waitMigrationResolved(t *testing.T, instanceID string) {
+	for i := 0; i < 50; i++ {
+		if _, ok := ctl.ds.GetMigration(instanceID); !ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Instance %s still being migrated", instanceID)
+}
+
+// checkMigrationOperation waits for the operation migrating an instance to
+// complete and checks its outcome.  A migration which got as far as the
+// transfer has its progress at least half way.
+func checkMigrationOperation(t *testing.T, op types.Operation, i *types.Instance, expected types.OperationState, minProgress int) types.Operation {
+	if op.Type != types.MigrateInstanceOperation || op.Target != i.ID || op.TenantID != i.TenantID {
+		t.Fatalf("Unexpected migration operation %+v", op)
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/operations/"+op.ID)
+	if op.State != expected || op.Progress < minProgress {
+		t.Fatalf("Expected operation %s with progress of at least %d, got %+v", expected, minProgress, op)
+	}
+
+	return op
+}
+
+func checkInstanceNode(t *testing.T, instanceID string, nodeID string) {
+	i, err := ctl.ds.GetInstance(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.State != payloads.Running || i.NodeID != nodeID {
+		t.Fatalf("Expected instance running on %s, got %s on %s", nodeID, i.State, i.NodeID)
+	}
+}
+
+func TestMigrateInstance(t *testing.T) {
+	source, target, i := startMigrationTestInstance(t)
+	defer source.Shutdown()
+	defer target.Shutdown()
+
+	prepareCh := target.AddCmdChan(ssntp.PrepareMigration)
+	migrateCh := source.AddCmdChan(ssntp.MigrateInstance)
+	migratedCh := wrappedClient.addEventChan(ssntp.InstanceMigrated)
+
+	b, err := json.Marshal(types.InstanceMigrateRequest{
+		Migrate: types.InstanceMigrateTarget{NodeID: target.UUID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/action"
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, b, true)
+
+	var op types.Operation
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := target.GetCmdChanResult(prepareCh, ssntp.PrepareMigration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != i.ID || result.TenantUUID != i.TenantID {
+		t.Fatalf("Unexpected instance %s of tenant %s prepared", result.InstanceUUID, result.TenantUUID)
+	}
+
+	_, err = source.GetCmdChanResult(migrateCh, ssntp.MigrateInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wrappedClient.getEventChan(migratedCh, ssntp.InstanceMigrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ctl.ds.GetMigration(i.ID); ok {
+		t.Fatal("Migration not completed")
+	}
+	checkInstanceNode(t, i.ID, target.UUID)
+
+	placements, err := ctl.ds.GetInstancePlacements(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := placements.Placements[len(placements.Placements)-1]
+	if last.NodeID != target.UUID || last.Reason != types.PlacementLiveMigration {
+		t.Fatalf("Unexpected placement %+v", last)
+	}
+
+	op = checkMigrationOperation(t, op, i, types.OperationSucceeded, 100)
+	if op.Result != target.UUID {
+		t.Fatalf("Expected result %s got %s", target.UUID, op.Result)
+	}
+
+	// the instance may not be migrated back to the node running it
+	_, err = ctl.MigrateInstance(i.TenantID, i.ID, target.UUID)
+	if err != types.ErrBadMigration {
+		t.Fatalf("Expected %v, got %v", types.ErrBadMigration, err)
+	}
+}
+
+func TestMigrateInstanceRejected(t *testing.T) {
+	source, target, i := startMigrationTestInstance(t)
+	defer source.Shutdown()
+	defer target.Shutdown()
+
+	target.MigrationFail = true
+	target.MigrationFailReason = payloads.MigrationFullComputeNode
+
+	failureCh := wrappedClient.addErrorChan(ssntp.MigrationFailure)
+
+	op, err := ctl.MigrateInstance(i.TenantID, i.ID, target.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wrappedClient.getErrorChan(failureCh, ssntp.MigrationFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ctl.ds.GetMigration(i.ID); ok {
+		t.Fatal("Migration not rolled back")
+	}
+	checkInstanceNode(t, i.ID, source.UUID)
+
+	// the target node was never prepared
+	op = checkMigrationOperation(t, op, i, types.OperationFailed, 0)
+	if op.Progress != 0 || !strings.Contains(op.Error, target.MigrationFailReason.String()) {
+		t.Fatalf("Unexpected failed operation %+v", op)
+	}
+}
+
+func TestMigrateInstanceTransferFailure(t *testing.T) {
+	source, target, i := startMigrationTestInstance(t)
+	defer source.Shutdown()
+	defer target.Shutdown()
+
+	source.MigrationFail = true
+	source.MigrationFailReason = payloads.MigrationTransferFailure
+
+	abortCh := target.AddCmdChan(ssntp.AbortMigration)
+	failureCh := wrappedClient.addErrorChan(ssntp.MigrationFailure)
+
+	op, err := ctl.MigrateInstance(i.TenantID, i.ID, target.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wrappedClient.getErrorChan(failureCh, ssntp.MigrationFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := target.GetCmdChanResult(abortCh, ssntp.AbortMigration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != i.ID {
+		t.Fatalf("Migration of %s aborted instead of %s", result.InstanceUUID, i.ID)
+	}
+
+	if _, ok := ctl.ds.GetMigration(i.ID); ok {
+		t.Fatal("Migration not rolled back")
+	}
+	checkInstanceNode(t, i.ID, source.UUID)
+
+	// the target node was prepared before the transfer failed
+	op = checkMigrationOperation(t, op, i, types.OperationFailed, 50)
+	if !strings.Contains(op.Error, source.MigrationFailReason.String()) {
+		t.Fatalf("Unexpected failed operation %+v", op)
+	}
+}
+
+// A transfer the controller has not heard the outcome of, for example
+// because it restarted, is completed once the target node reports the
+// instance running.
+func TestMigrateInstanceStats(t *testing.T) {
+	source, target, i := startMigrationTestInstance(t)
+	defer source.Shutdown()
+	defer target.Shutdown()
+
+	m := types.Migration{
+		InstanceID:   i.ID,
+		TenantID:     i.TenantID,
+		SourceNodeID: source.UUID,
+		TargetNodeID: target.UUID,
+		State:        types.MigrationTransferring,
+		StartTime:    time.Now(),
+	}
+
+	err := ctl.ds.StartMigration(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.stopInstance(i.ID)
+	if err != types.ErrInstanceMigrating {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceMigrating, err)
+	}
+
+	// stats from the source node do not resolve the migration
+	sendStatsCmd(source, t)
+	if _, ok := ctl.ds.GetMigration(i.ID); !ok {
+		t.Fatal("Migration resolved by source node")
+	}
+
+	// the target node receives the instance
+	prepareCh := target.AddCmdChan(ssntp.PrepareMigration)
+	err = ctl.client.prepareMigration(payloads.PrepareMigrationCmd{
+		InstanceUUID:      i.ID,
+		TenantUUID:        i.TenantID,
+		WorkloadAgentUUID: target.UUID,
+		SourceAgentUUID:   source.UUID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = target.GetCmdChanResult(prepareCh, ssntp.PrepareMigration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while the instance is being transferred the target node reports it
+	// as migrating
+	sendStatsCmd(target, t)
+	if _, ok := ctl.ds.GetMigration(i.ID); !ok {
+		t.Fatal("Migration resolved before transfer completed")
+	}
+
+	target.FinishMigration(i.ID)
+	sendStatsCmd(target, t)
+
+	waitMigrationResolved(t, i.ID)
+	checkInstanceNode(t, i.ID, target.UUID)
+}
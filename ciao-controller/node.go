@@ -14,13 +14,24 @@
 
 package main
 
-import "github.com/golang/glog"
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
 
 func (c *controller) EvacuateNode(nodeID string) error {
 	// should I bother to see if nodeID is valid?
+	c.ds.EvacuatingNode(nodeID)
+
 	go func() {
 		if err := c.client.EvacuateNode(nodeID); err != nil {
-			glog.Warningf("Error evacuating node")
+			clogger.With(c.log, "node", nodeID).Warningf("Error evacuating node: %v", err)
 		}
 	}()
 	return nil
@@ -29,8 +40,128 @@ func (c *controller) EvacuateNode(nodeID string) error {
 func (c *controller) RestoreNode(nodeID string) error {
 	go func() {
 		if err := c.client.RestoreNode(nodeID); err != nil {
-			glog.Warning("Error restoring node")
+			clogger.With(c.log, "node", nodeID).Warningf("Error restoring node: %v", err)
 		}
 	}()
 	return nil
 }
+
+// evacuationStopTimeout is how long the instances being evacuated from a node
+// may take to stop before they are given up on.
+const evacuationStopTimeout = 2 * time.Minute
+
+// SetNodeStatus puts a node into maintenance, so that the scheduler starts
+// no new instances on it, or returns it to service.  The instances running
+// on a node put into maintenance are restarted on other nodes if evacuate
+// is set, by an operation which is returned.
+func (c *controller) SetNodeStatus(nodeID string, status types.NodeStatusType, evacuate bool) (types.Operation, error) {
+	var maintenance bool
+
+	switch status {
+	case types.NodeStatusMaintenance:
+		maintenance = true
+	case types.NodeStatusReady:
+		if evacuate {
+			return types.Operation{}, types.ErrBadNodeStatus
+		}
+	default:
+		return types.Operation{}, types.ErrBadNodeStatus
+	}
+
+	// nodes in maintenance may have disconnected
+	if _, err := c.ds.GetNode(nodeID); err != nil && !c.ds.NodeInMaintenance(nodeID) {
+		return types.Operation{}, types.ErrNodeNotFound
+	}
+
+	err := c.ds.SetNodeMaintenance(nodeID, maintenance)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	// the scheduler is told again when the controller reconnects to it
+	if err := c.client.nodeMaintenance(nodeID, maintenance); err != nil {
+		clogger.With(c.log, "node", nodeID).Warningf("Error sending node maintenance: %v", err)
+	}
+
+	if !evacuate {
+		return types.Operation{}, nil
+	}
+
+	return c.startOperation("", types.EvacuateNodeOperation, nodeID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			return "", c.evacuateNode(ctx, nodeID, progress)
+		})
+}
+
+// evacuateNode stops the instances running on a node and restarts each
+// once it has exited, which the scheduler does on other nodes as the node
+// is in maintenance.
+func (c *controller) evacuateNode(ctx context.Context, nodeID string, progress operationProgress) error {
+	instances, err := c.ds.GetAllInstancesByNode(nodeID)
+	if err != nil {
+		return errors.Wrapf(err, "Error getting instances of node %s", nodeID)
+	}
+
+	var stopped []*types.Instance
+	running, failed := 0, 0
+	for _, i := range instances {
+		if i.State != payloads.Running {
+			continue
+		}
+
+		running++
+
+		if err := c.stopInstance(i.ID); err != nil {
+			c.instanceLog(i).Warningf("Unable to evacuate instance: %v", err)
+			failed++
+			continue
+		}
+		stopped = append(stopped, i)
+	}
+
+	c.ds.EvacuatingNode(nodeID)
+
+	ctx, cancel := context.WithTimeout(ctx, evacuationStopTimeout)
+	defer cancel()
+
+	for n, i := range stopped {
+		err := c.waitInstanceExited(ctx, i.ID)
+		if err == nil {
+			err = c.restartInstance(i.ID)
+		}
+		if err != nil {
+			c.instanceLog(i).Warningf("Unable to evacuate instance: %v", err)
+			failed++
+		}
+		progress((n + 1) * 100 / len(stopped))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Unable to evacuate %d of %d instances", failed, running)
+	}
+
+	return nil
+}
+
+func (c *controller) waitInstanceExited(ctx context.Context, instanceID string) error {
+	for {
+		i, err := c.ds.GetInstance(instanceID)
+		if err != nil {
+			return err
+		}
+
+		i.StateLock.RLock()
+		exited := i.State == payloads.Exited
+		i.StateLock.RUnlock()
+
+		if exited {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.New("Timed out waiting for instance to stop")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// operationProgress is called by the worker of an operation to report the
+// percentage of the operation completed.
+type operationProgress func(progress int)
+
+// operationWorker performs the work of an operation and returns the ID of
+// the object it created, if any.  The work outlives the request which
+// started it and is only abandoned when ctx, that of the controller, is
+// cancelled on shutdown.
+type operationWorker func(ctx context.Context, progress operationProgress) (string, error)
+
+// startOperation records an operation of opType on target for tenantID and
+// runs work in the background.  The operation is returned as soon as it is
+// recorded so that the client can poll it.
+func (c *controller) startOperation(tenantID string, opType types.OperationType, target string, work operationWorker) (types.Operation, error) {
+	now := time.Now()
+	op := types.Operation{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		Type:       opType,
+		Target:     target,
+		State:      types.OperationRunning,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	err := c.ds.AddOperation(op)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	go c.runOperation(op, work)
+
+	return op, nil
+}
+
+func (c *controller) runOperation(op types.Operation, work operationWorker) {
+	log := clogger.With(c.log, "tenant", op.TenantID, "operation", op.ID)
+
+	update := func() {
+		op.UpdateTime = time.Now()
+		if err := c.ds.UpdateOperation(op); err != nil {
+			log.Warningf("Unable to update operation: %v", err)
+		}
+	}
+
+	result, err := work(c.ctx, func(progress int) {
+		op.Progress = progress
+		update()
+	})
+
+	if err != nil {
+		log.Warningf("Operation %s on %s failed: %v", op.Type, op.Target, err)
+		op.State = types.OperationFailed
+		op.Error = err.Error()
+	} else {
+		op.State = types.OperationSucceeded
+		op.Progress = 100
+		op.Result = result
+	}
+
+	update()
+}
+
+// ShowOperation returns an operation of tenantID.  Admins may see the
+// operations of all tenants.
+func (c *controller) ShowOperation(tenantID string, operationID string) (types.Operation, error) {
+	op, err := c.ds.GetOperation(operationID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if tenantID != "admin" && op.TenantID != tenantID {
+		return types.Operation{}, types.ErrOperationNotFound
+	}
+
+	return op, nil
+}
+
+// ListOperations returns the operations of tenantID, or of all tenants for
+// admins.
+func (c *controller) ListOperations(tenantID string) ([]types.Operation, error) {
+	if tenantID == "admin" {
+		tenantID = ""
+	}
+
+	return c.ds.GetOperations(tenantID), nil
+}
+
+// pruneOperations removes the operations which finished more than
+// operation_retention ago.
+func (c *controller) pruneOperations(cfg controllerConfig) {
+	pruned, err := c.ds.PruneOperations(time.Now().Add(-time.Duration(c.configSetting(cfg, settingOperationRetention))))
+	if err != nil {
+		c.log.Warningf("Unable to prune operations: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d completed operations", pruned)
+	}
+}
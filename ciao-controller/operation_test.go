@@ -0,0 +1,218 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func pollOperation(t *testing.T, url string) types.Operation {
+	var op types.Operation
+
+	for i := 0; i < 50; i++ {
+		body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+		err := json.Unmarshal(body, &op)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if op.Done() {
+			return op
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Operation did not complete: %+v", op)
+	return op
+}
+
+func TestCreateVolumeFromImageOperation(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage(tenant.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.ds.DeleteImage(image.ID) }()
+
+	req := api.RequestedVolume{
+		Size:     1,
+		ImageRef: image.Name,
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/volumes"
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, b, true)
+
+	var op types.Operation
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Type != types.CreateVolumeOperation || op.Target != image.ID || op.TenantID != tenant.ID {
+		t.Fatalf("Unexpected operation: %+v", op)
+	}
+
+	opURL := testutil.ComputeURL + "/" + tenant.ID + "/operations/" + op.ID
+	op = pollOperation(t, opURL)
+	if op.State != types.OperationSucceeded || op.Progress != 100 {
+		t.Fatalf("Expected operation to succeed: %+v", op)
+	}
+
+	vol, err := ctl.ds.GetBlockDevice(op.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vol.Bootable || vol.TenantID != tenant.ID {
+		t.Errorf("Unexpected volume created: %+v", vol)
+	}
+
+	// operations are only visible to their tenant and the admin
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/"+other.ID+"/operations/"+op.ID, http.StatusNotFound, nil, true)
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/operations/"+op.ID, http.StatusOK, nil, true)
+
+	body = testHTTPRequest(t, "GET", testutil.ComputeURL+"/"+other.ID+"/operations", http.StatusOK, nil, true)
+	var ops types.ListOperationsResponse
+	err = json.Unmarshal(body, &ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops.Operations) != 0 {
+		t.Errorf("Operations of another tenant listed: %+v", ops.Operations)
+	}
+}
+
+func TestFailingOperation(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage(tenant.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.ds.DeleteImage(image.ID) }()
+
+	qreq := types.QuotaUpdateRequest{
+		Quotas: []types.QuotaDetails{{Name: "tenant-volumes-quota", Value: 0}},
+	}
+	b, err := json.Marshal(qreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "PUT", testutil.ComputeURL+"/tenants/"+tenant.ID+"/quotas", http.StatusCreated, b, true)
+
+	b, err = json.Marshal(api.RequestedVolume{ImageRef: image.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", testutil.ComputeURL+"/"+tenant.ID+"/volumes", http.StatusAccepted, b, true)
+
+	var op types.Operation
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op = pollOperation(t, testutil.ComputeURL+"/"+tenant.ID+"/operations/"+op.ID)
+	if op.State != types.OperationFailed || op.Result != "" {
+		t.Fatalf("Expected operation to fail: %+v", op)
+	}
+
+	if !strings.Contains(op.Error, api.ErrQuota.Error()) {
+		t.Errorf("Unexpected operation error: %s", op.Error)
+	}
+}
+
+func TestOperationRetention(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+
+	failed, err := ctl.startOperation(tenant.ID, types.CreateVolumeOperation, "failed",
+		func(context.Context, operationProgress) (string, error) {
+			return "", errors.New("failed")
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pollOperation(t, testutil.ComputeURL+"/operations/"+failed.ID)
+
+	running, err := ctl.startOperation(tenant.ID, types.CreateVolumeOperation, "running",
+		func(context.Context, operationProgress) (string, error) {
+			<-block
+			return "", nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(block)
+
+	cfg := defaultConfig()
+
+	// recently completed operations are retained
+	ctl.pruneOperations(cfg)
+	_, err = ctl.ShowOperation(tenant.ID, failed.ID)
+	if err != nil {
+		t.Fatalf("Operation pruned before end of retention period: %v", err)
+	}
+
+	// running operations are never pruned
+	cfg.OperationRetention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	ctl.pruneOperations(cfg)
+
+	_, err = ctl.ShowOperation(tenant.ID, failed.ID)
+	if err != types.ErrOperationNotFound {
+		t.Errorf("Completed operation not pruned: %v", err)
+	}
+
+	op, err := ctl.ShowOperation(tenant.ID, running.ID)
+	if err != nil || op.State != types.OperationRunning {
+		t.Errorf("Running operation pruned: %+v %v", op, err)
+	}
+}
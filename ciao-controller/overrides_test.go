@@ -0,0 +1,398 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func addBoundedWorkload(t *testing.T, tenantID string) types.Workload {
+	wl := types.Workload{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		Description: "bounded workload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Bounds: &types.WorkloadBounds{
+			MinVCPUs: 2,
+			MaxVCPUs: 8,
+			MaxMemMB: 4096,
+		},
+	}
+
+	err := ctl.ds.AddWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wl
+}
+
+type instanceUsage struct {
+	instances int
+	vcpus     int
+	memMB     int
+	storageGB int
+}
+
+func getInstanceUsage(t *testing.T, tenantID string) instanceUsage {
+	qds := ctl.ListQuotas(tenantID)
+
+	var u instanceUsage
+	for _, q := range []struct {
+		name  string
+		usage *int
+	}{
+		{"tenant-instances-quota", &u.instances},
+		{"tenant-vcpu-quota", &u.vcpus},
+		{"tenant-mem-quota", &u.memMB},
+		{"tenant-storage-quota", &u.storageGB},
+	} {
+		qd := findQuota(qds, q.name)
+		if qd == nil {
+			t.Fatalf("Quota %s not found", q.name)
+		}
+		*q.usage = qd.Usage
+	}
+
+	return u
+}
+
+func TestOverrideQuotaSymmetry(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, tenant.ID)
+
+	before := getInstanceUsage(t, tenant.ID)
+
+	owl, err := applyOverrides(wl, types.RequirementOverrides{VCPUs: 6, MemMB: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := ctl.ds.AllocateTenantIPPool(tenant.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := newInstance(context.Background(), ctl, tenant.ID, &owl, "", "", ips[0], placement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.VCPUs != 6 || i.MemMB != 2048 {
+		t.Fatalf("Overrides not recorded on instance: %d VCPUs %d MB", i.VCPUs, i.MemMB)
+	}
+
+	reqs := i.newConfig.sc.Start.Requirements
+	if reqs.VCPUs != 6 || reqs.MemMB != 2048 {
+		t.Fatalf("Overrides not sent in start payload: %d VCPUs %d MB", reqs.VCPUs, reqs.MemMB)
+	}
+
+	ok, err := i.Allowed()
+	if err != nil || !ok {
+		t.Fatalf("Instance not allowed: %v", err)
+	}
+
+	expected := instanceUsage{
+		instances: before.instances + 1,
+		vcpus:     before.vcpus + 6,
+		memMB:     before.memMB + 2048,
+		storageGB: before.storageGB,
+	}
+	if u := getInstanceUsage(t, tenant.ID); u != expected {
+		t.Fatalf("Wrong usage after Allowed: expected %+v got %+v", expected, u)
+	}
+
+	err = i.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u := getInstanceUsage(t, tenant.ID); u != before {
+		t.Fatalf("Wrong usage after Clean: expected %+v got %+v", before, u)
+	}
+
+	// without overrides the workload's own requirements are charged
+	ips, err = ctl.ds.AllocateTenantIPPool(tenant.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = newInstance(context.Background(), ctl, tenant.ID, &wl, "", "", ips[0], placement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err = i.Allowed()
+	if err != nil || !ok {
+		t.Fatalf("Instance not allowed: %v", err)
+	}
+
+	expected = instanceUsage{
+		instances: before.instances + 1,
+		vcpus:     before.vcpus + 2,
+		memMB:     before.memMB + 512,
+		storageGB: before.storageGB,
+	}
+	if u := getInstanceUsage(t, tenant.ID); u != expected {
+		t.Fatalf("Wrong usage after Allowed: expected %+v got %+v", expected, u)
+	}
+
+	err = i.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u := getInstanceUsage(t, tenant.ID); u != before {
+		t.Fatalf("Wrong usage after Clean: expected %+v got %+v", before, u)
+	}
+}
+
+func TestOverrideRecorded(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, tenant.ID)
+
+	client, err := testutil.NewSsntpTestClientConnection("TestOverrideRecorded", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+
+	w := types.WorkloadRequest{
+		WorkloadID: wl.ID,
+		TenantID:   tenant.ID,
+		Instances:  1,
+		Overrides:  types.RequirementOverrides{VCPUs: 4, MemMB: 1024},
+	}
+	instances, err := ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.VCPUs != 4 || i.MemMB != 1024 {
+		t.Fatalf("Overrides not recorded: %d VCPUs %d MB", i.VCPUs, i.MemMB)
+	}
+
+	res := instanceResources(i, &wl)
+	for _, r := range res {
+		if (r.Type == payloads.VCPUs && r.Value != 4) ||
+			(r.Type == payloads.MemMB && r.Value != 1024) {
+			t.Fatalf("Wrong resources released for instance: %v", res)
+		}
+	}
+}
+
+func TestOverrideOutOfBounds(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addBoundedWorkload(t, tenant.ID)
+
+	tests := []struct {
+		overrides types.RequirementOverrides
+		bound     string
+	}{
+		{types.RequirementOverrides{VCPUs: 16}, "max_vcpus"},
+		{types.RequirementOverrides{VCPUs: 1}, "min_vcpus"},
+		{types.RequirementOverrides{MemMB: 8192}, "max_mem_mb"},
+		{types.RequirementOverrides{DiskGB: 10}, "max_disk_gb"},
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances"
+
+	for _, test := range tests {
+		var server api.CreateServerRequest
+		server.Server.MaxInstances = 1
+		server.Server.WorkloadID = wl.ID
+		server.Server.VCPUs = test.overrides.VCPUs
+		server.Server.MemMB = test.overrides.MemMB
+		server.Server.DiskGB = test.overrides.DiskGB
+
+		b, err := json.Marshal(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := testHTTPRequest(t, "POST", url, http.StatusBadRequest, b, true)
+		if !strings.Contains(string(body), test.bound) {
+			t.Errorf("Error for %+v does not name %s: %s", test.overrides, test.bound, body)
+		}
+	}
+
+	if u := getInstanceUsage(t, tenant.ID); u.instances != 0 {
+		t.Fatalf("Rejected overrides consumed quota: %+v", u)
+	}
+}
+
+func addLocalStorageWorkload(t *testing.T, tenantID string) types.Workload {
+	wl := types.Workload{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		Description: "local storage workload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Storage: []types.StorageResource{
+			{
+				Ephemeral:  true,
+				Size:       20,
+				SourceType: types.Empty,
+				Local:      true,
+			},
+		},
+		Bounds: &types.WorkloadBounds{
+			MinDiskGB: 10,
+			MaxDiskGB: 50,
+		},
+	}
+
+	err := ctl.ds.AddWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wl
+}
+
+func TestEphemeralQuotaSymmetry(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := addLocalStorageWorkload(t, tenant.ID)
+
+	before := getInstanceUsage(t, tenant.ID)
+
+	tests := []struct {
+		diskGB   int
+		expected int
+	}{
+		{0, 20},
+		{40, 40},
+	}
+
+	for _, test := range tests {
+		owl, err := applyOverrides(wl, types.RequirementOverrides{DiskGB: test.diskGB})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ips, err := ctl.ds.AllocateTenantIPPool(tenant.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i, err := newInstance(context.Background(), ctl, tenant.ID, &owl, "", "", ips[0], placement{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i.EphemeralGB != test.expected {
+			t.Fatalf("Ephemeral size not recorded on instance: expected %d got %d",
+				test.expected, i.EphemeralGB)
+		}
+
+		storage := i.newConfig.sc.Start.Storage
+		if len(storage) != 1 || !storage[0].Local || storage[0].Size != test.expected {
+			t.Fatalf("Ephemeral size not sent in start payload: %+v", storage)
+		}
+
+		ok, err := i.Allowed()
+		if err != nil || !ok {
+			t.Fatalf("Instance not allowed: %v", err)
+		}
+
+		expected := before
+		expected.instances++
+		expected.vcpus += 2
+		expected.memMB += 512
+		expected.storageGB += test.expected
+		if u := getInstanceUsage(t, tenant.ID); u != expected {
+			t.Fatalf("Wrong usage after Allowed: expected %+v got %+v", expected, u)
+		}
+
+		err = i.Clean()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u := getInstanceUsage(t, tenant.ID); u != before {
+			t.Fatalf("Wrong usage after Clean: expected %+v got %+v", before, u)
+		}
+	}
+
+	var server api.CreateServerRequest
+	server.Server.MaxInstances = 1
+	server.Server.WorkloadID = wl.ID
+	server.Server.DiskGB = 80
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances"
+	body := testHTTPRequest(t, "POST", url, http.StatusBadRequest, b, true)
+	if !strings.Contains(string(body), "max_disk_gb") {
+		t.Errorf("Error does not name max_disk_gb: %s", body)
+	}
+
+	if u := getInstanceUsage(t, tenant.ID); u != before {
+		t.Fatalf("Rejected override consumed quota: %+v", u)
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// pagedList is a paginated list endpoint walked by walkPages.  ids
+// returns the identifiers of the items in a page, in the order they were
+// returned, and the next marker given in the body of the page if the list
+// reports it there as well as in the response headers.
+type pagedList struct {
+	url    string
+	header http.Header
+	ids    func(body []byte) ([]string, string, error)
+}
+
+func getPage(t *testing.T, l pagedList, limit int, marker string) ([]byte, string) {
+	url := fmt.Sprintf("%s?limit=%d", l.url, limit)
+	if marker != "" {
+		url += "&marker=" + marker
+	}
+
+	req, err := http.NewRequest("GET", url, bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range l.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := testHTTPClient(t).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d, msg: %s", http.StatusOK, resp.StatusCode, body)
+	}
+
+	return body, resp.Header.Get(api.NextMarkerHeader)
+}
+
+// walkPages pages through l, limit items at a time, while mutate is
+// called mutations times in the background to add and remove other
+// items.  stable lists the items which exist throughout, in canonical
+// order.  Each of them must be returned exactly once, in that order, and
+// no item may be returned twice.
+func walkPages(t *testing.T, l pagedList, limit int, stable []string, mutations int, mutate func(i int) error) {
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < mutations; i++ {
+			err := mutate(i)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	seen := make(map[string]bool)
+	var order []string
+	marker := ""
+	for pages := 0; ; pages++ {
+		if pages > len(stable)+mutations+1 {
+			t.Fatal("List does not end")
+		}
+
+		body, next := getPage(t, l, limit, marker)
+		ids, bodyNext, err := l.ids(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyNext != "" && bodyNext != next {
+			t.Fatalf("Next marker %s in body but %s in header", bodyNext, next)
+		}
+
+		if len(ids) > limit {
+			t.Fatalf("Page of %d items exceeds limit %d", len(ids), limit)
+		}
+
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("Item %s returned twice", id)
+			}
+			seen[id] = true
+			order = append(order, id)
+		}
+
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	isStable := make(map[string]bool)
+	for _, id := range stable {
+		isStable[id] = true
+	}
+
+	var returned []string
+	for _, id := range order {
+		if isStable[id] {
+			returned = append(returned, id)
+		}
+	}
+
+	if len(returned) != len(stable) {
+		t.Fatalf("Expected %d items, got %d", len(stable), len(returned))
+	}
+
+	for i := range stable {
+		if returned[i] != stable[i] {
+			t.Fatalf("Items out of order: expected %v got %v", stable, returned)
+		}
+	}
+}
+
+func addPagedInstance(tenantID string) (*types.Instance, error) {
+	i := &types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		MACAddress: uuid.Generate().String(),
+		State:      payloads.Running,
+		CreateTime: time.Now(),
+	}
+
+	return i, ctl.ds.AddInstance(context.Background(), i)
+}
+
+func addPagedVolume(tenantID string) (types.Volume, error) {
+	v := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+		CreateTime:  time.Now(),
+		TenantID:    tenantID,
+		State:       types.Available,
+	}
+
+	return v, ctl.ds.AddBlockDevice(context.Background(), v)
+}
+
+func TestPaginateInstances(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stable []*types.Instance
+	for i := 0; i < 10; i++ {
+		instance, err := addPagedInstance(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stable = append(stable, instance)
+	}
+
+	sort.Slice(stable, func(i, j int) bool {
+		return stable[i].Cursor().Before(stable[j].Cursor())
+	})
+
+	var ids []string
+	for _, i := range stable {
+		ids = append(ids, i.ID)
+	}
+
+	l := pagedList{
+		url:    testutil.ComputeURL + "/" + tenant.ID + "/instances/detail",
+		header: onBehalfOf(tenant.ID),
+		ids: func(body []byte) ([]string, string, error) {
+			var servers api.Servers
+			err := json.Unmarshal(body, &servers)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var ids []string
+			for _, s := range servers.Servers {
+				ids = append(ids, s.ID)
+			}
+			return ids, servers.NextMarker, nil
+		},
+	}
+
+	var last string
+	walkPages(t, l, 3, ids, 20, func(i int) error {
+		instance, err := addPagedInstance(tenant.ID)
+		if err != nil {
+			return err
+		}
+
+		if last != "" {
+			err = ctl.ds.DeleteInstance(last)
+		}
+		last = instance.ID
+		return err
+	})
+}
+
+func TestPaginateVolumes(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stable []types.Volume
+	for i := 0; i < 10; i++ {
+		v, err := addPagedVolume(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stable = append(stable, v)
+	}
+
+	sort.Slice(stable, func(i, j int) bool {
+		return stable[i].Cursor().Before(stable[j].Cursor())
+	})
+
+	var ids []string
+	for _, v := range stable {
+		ids = append(ids, v.ID)
+	}
+
+	l := pagedList{
+		url:    testutil.ComputeURL + "/" + tenant.ID + "/volumes",
+		header: onBehalfOf(tenant.ID),
+		ids: func(body []byte) ([]string, string, error) {
+			var vols []types.Volume
+			err := json.Unmarshal(body, &vols)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var ids []string
+			for _, v := range vols {
+				ids = append(ids, v.ID)
+			}
+			return ids, "", nil
+		},
+	}
+
+	var last string
+	walkPages(t, l, 4, ids, 20, func(i int) error {
+		v, err := addPagedVolume(tenant.ID)
+		if err != nil {
+			return err
+		}
+
+		if last != "" {
+			err = ctl.ds.DeleteBlockDevice(context.Background(), last)
+		}
+		last = v.ID
+		return err
+	})
+}
+
+func TestPaginatePools(t *testing.T) {
+	var stable []types.Pool
+	for i := 0; i < 8; i++ {
+		p, err := ctl.AddPool("paged-"+uuid.Generate().String(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stable = append(stable, p)
+	}
+
+	defer func() {
+		for _, p := range stable {
+			_ = ctl.DeletePool(p.ID)
+		}
+	}()
+
+	sort.Slice(stable, func(i, j int) bool {
+		return stable[i].Cursor().Before(stable[j].Cursor())
+	})
+
+	var ids []string
+	for _, p := range stable {
+		ids = append(ids, p.ID)
+	}
+
+	l := pagedList{
+		url: testutil.ComputeURL + "/pools",
+		ids: func(body []byte) ([]string, string, error) {
+			var resp types.ListPoolsResponse
+			err := json.Unmarshal(body, &resp)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var ids []string
+			for _, p := range resp.Pools {
+				ids = append(ids, p.ID)
+			}
+			return ids, resp.NextMarker, nil
+		},
+	}
+
+	var last string
+	walkPages(t, l, 3, ids, 20, func(i int) error {
+		p, err := ctl.AddPool("paged-"+uuid.Generate().String(), nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if last != "" {
+			err = ctl.DeletePool(last)
+		}
+		last = p.ID
+		return err
+	})
+
+	if last != "" {
+		_ = ctl.DeletePool(last)
+	}
+}
+
+func TestPaginateMappedIPs(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet := "10.32.0.0/24"
+	pool, err := ctl.AddPool("paged-"+uuid.Generate().String(), &subnet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapIP := func() (types.MappedIP, error) {
+		instance, err := addPagedInstance(tenant.ID)
+		if err != nil {
+			return types.MappedIP{}, err
+		}
+
+		return ctl.ds.MapExternalIP(pool.ID, instance.ID)
+	}
+
+	var stable []types.MappedIP
+	for i := 0; i < 8; i++ {
+		m, err := mapIP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stable = append(stable, m)
+	}
+
+	sort.Slice(stable, func(i, j int) bool {
+		return stable[i].Cursor().Before(stable[j].Cursor())
+	})
+
+	var ids []string
+	for _, m := range stable {
+		ids = append(ids, m.ID)
+	}
+
+	l := pagedList{
+		url:    testutil.ComputeURL + "/" + tenant.ID + "/external-ips",
+		header: onBehalfOf(tenant.ID),
+		ids: func(body []byte) ([]string, string, error) {
+			var IPs []types.MappedIPShort
+			err := json.Unmarshal(body, &IPs)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var ids []string
+			for _, m := range IPs {
+				ids = append(ids, m.ID)
+			}
+			return ids, "", nil
+		},
+	}
+
+	var last string
+	walkPages(t, l, 3, ids, 20, func(i int) error {
+		m, err := mapIP()
+		if err != nil {
+			return err
+		}
+
+		if last != "" {
+			err = ctl.ds.UnMapExternalIP(last)
+		}
+		last = m.ExternalIP
+		return err
+	})
+}
+
+func TestPaginateEvents(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err := ctl.ds.LogEvent(tenant.ID, fmt.Sprintf("Paged event %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := ctl.ListTenantEvents(tenant.ID, types.EventFilter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, e := range events.Events {
+		ids = append(ids, strconv.FormatInt(e.ID, 10))
+	}
+
+	l := pagedList{
+		url:    testutil.ComputeURL + "/" + tenant.ID + "/events",
+		header: onBehalfOf(tenant.ID),
+		ids: func(body []byte) ([]string, string, error) {
+			var events types.CiaoEvents
+			err := json.Unmarshal(body, &events)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var ids []string
+			for _, e := range events.Events {
+				ids = append(ids, strconv.FormatInt(e.ID, 10))
+			}
+			return ids, events.NextMarker, nil
+		},
+	}
+
+	walkPages(t, l, 4, ids, 20, func(i int) error {
+		return ctl.ds.LogEvent(tenant.ID, fmt.Sprintf("Concurrent event %d", i))
+	})
+}
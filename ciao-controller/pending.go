@@ -0,0 +1,128 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// pendingCheckPeriod is how often instances are checked for having been
+// pending for too long.
+const pendingCheckPeriod = 30 * time.Second
+
+// pendingInstanceState tracks the instances the pending instance watchdog
+// has already reported so that each is only reported once.
+type pendingInstanceState struct {
+	sync.Mutex
+	reported map[string]bool
+	wakeCh   chan struct{}
+}
+
+func (p *pendingInstanceState) wakeChannel() chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.wakeCh == nil {
+		p.wakeCh = make(chan struct{}, 1)
+	}
+	return p.wakeCh
+}
+
+// wake makes the watchdog check the pending instances straight away,
+// e.g. because its timeout has changed.
+func (p *pendingInstanceState) wake() {
+	select {
+	case p.wakeChannel() <- struct{}{}:
+	default:
+	}
+}
+
+// checkPendingInstances reports, in the tenant's event log, the instances
+// which have been pending for longer than the pending instance timeout.
+// It returns the IDs of the instances newly reported.
+func (c *controller) checkPendingInstances(now time.Time) []string {
+	timeout := c.durationSetting(settingPendingInstanceTimeout)
+	if timeout == 0 {
+		return nil
+	}
+
+	instances, err := c.ds.GetAllInstances()
+	if err != nil {
+		c.log.Warningf("Unable to check pending instances: %v", err)
+		return nil
+	}
+
+	p := &c.pendingInstances
+	p.Lock()
+	defer p.Unlock()
+
+	if p.reported == nil {
+		p.reported = make(map[string]bool)
+	}
+
+	pending := make(map[string]bool)
+	var reported []string
+	for _, i := range instances {
+		if i.State != payloads.Pending {
+			continue
+		}
+
+		pending[i.ID] = true
+		if p.reported[i.ID] || now.Sub(i.CreateTime) < timeout {
+			continue
+		}
+
+		msg := fmt.Sprintf("Instance %s has been pending for more than %v", i.ID, timeout)
+		if err := c.ds.LogError(i.TenantID, msg); err != nil {
+			c.log.Warningf("Error logging event: %v", err)
+		}
+		c.log.Warningf("%s", msg)
+
+		p.reported[i.ID] = true
+		reported = append(reported, i.ID)
+	}
+
+	for id := range p.reported {
+		if !pending[id] {
+			delete(p.reported, id)
+		}
+	}
+
+	sort.Strings(reported)
+	return reported
+}
+
+// watchPendingInstances periodically reports instances which have been
+// pending for too long until the controller is shut down.
+func (c *controller) watchPendingInstances() {
+	ticker := time.NewTicker(pendingCheckPeriod)
+	defer ticker.Stop()
+
+	wakeCh := c.pendingInstances.wakeChannel()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wakeCh:
+		case <-c.ctx.Done():
+			return
+		}
+		c.checkPendingInstances(time.Now())
+	}
+}
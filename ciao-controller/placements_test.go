@@ -0,0 +1,105 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func testShowServerNode(t *testing.T, tenantID string, instanceID string, header http.Header) string {
+	url := testutil.ComputeURL + "/" + tenantID + "/instances/" + instanceID
+
+	var body []byte
+	if header == nil {
+		body = testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+	} else {
+		body = testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, header)
+	}
+
+	var s api.Server
+	err := json.Unmarshal(body, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.Server.NodeID
+}
+
+func TestInstancePlacements(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addRunningInstance(t, tenant.ID)
+
+	nodeID := uuid.Generate().String()
+	err = ctl.ds.AdoptInstance(i.ID, nodeID, payloads.Running)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/instances/" + i.ID + "/placements"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var p types.InstancePlacements
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.NodeID != nodeID || len(p.Placements) != 1 ||
+		p.Placements[0].NodeID != nodeID ||
+		p.Placements[0].Reason != types.PlacementMigration {
+		t.Errorf("Unexpected placements: %+v", p)
+	}
+
+	_ = testHTTPRequestWithHeader(t, "GET", url, http.StatusForbidden, nil, onBehalfOf(tenant.ID))
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/instances/"+uuid.Generate().String()+"/placements",
+		http.StatusNotFound, nil, true)
+}
+
+func TestTenantNodeVisibility(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addRunningInstance(t, tenant.ID)
+
+	if node := testShowServerNode(t, tenant.ID, i.ID, nil); node != i.NodeID {
+		t.Errorf("Expected admin to see node %s, got %q", i.NodeID, node)
+	}
+
+	if node := testShowServerNode(t, tenant.ID, i.ID, onBehalfOf(tenant.ID)); node != "" {
+		t.Errorf("Node %s visible to tenant", node)
+	}
+
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.TenantNodeVisibility = true
+	})()
+
+	if node := testShowServerNode(t, tenant.ID, i.ID, onBehalfOf(tenant.ID)); node != i.NodeID {
+		t.Errorf("Expected tenant to see node %s, got %q", i.NodeID, node)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+const (
+	// policyIngest is the evaluation of a workload when it is created or
+	// updated.
+	policyIngest = "ingest"
+
+	// policyLaunch is the evaluation of a workload when instances of it
+	// are launched, which catches workloads created before a rule.
+	policyLaunch = "launch"
+)
+
+// workloadImageRefs returns the image name of a container workload and the
+// IDs and names of the images the workload's storage is created from.
+func (c *controller) workloadImageRefs(wl *types.Workload) []string {
+	var refs []string
+
+	if wl.ImageName != "" {
+		refs = append(refs, wl.ImageName)
+	}
+
+	for _, s := range wl.Storage {
+		if s.SourceType != types.ImageService || s.Source == "" {
+			continue
+		}
+
+		refs = append(refs, s.Source)
+
+		image, err := c.ds.GetImage(s.Source)
+		if err == nil && image.Name != "" {
+			refs = append(refs, image.Name)
+		}
+	}
+
+	return refs
+}
+
+// evaluatePolicy checks a workload against the rules of the workload policy,
+// oldest first.  The first deny rule the workload matches is returned as a
+// PolicyViolationError.  Warn rules only log an event for the tenant.
+func (c *controller) evaluatePolicy(wl *types.Workload, tenantID string, stage string) error {
+	refs := c.workloadImageRefs(wl)
+	result := "allow"
+
+	for _, r := range c.ds.GetPolicyRules() {
+		if !r.Matches(wl, refs) {
+			continue
+		}
+
+		if r.Severity == types.PolicyDeny {
+			c.metrics.policyEvaluated(stage, string(types.PolicyDeny))
+			return &types.PolicyViolationError{RuleID: r.ID, Description: r.Description}
+		}
+
+		result = string(types.PolicyWarn)
+
+		msg := fmt.Sprintf("Workload %s matches policy rule %s", wl.ID, r.ID)
+		if r.Description != "" {
+			msg = fmt.Sprintf("%s: %s", msg, r.Description)
+		}
+		c.log.Warningf("%s", msg)
+		_ = c.ds.LogEvent(tenantID, msg)
+	}
+
+	c.metrics.policyEvaluated(stage, result)
+
+	return nil
+}
+
+// policyDenies returns a PolicyViolationError if wl matches a deny rule.
+// Unlike evaluatePolicy it neither logs warnings nor records metrics.
+func (c *controller) policyDenies(wl *types.Workload) error {
+	refs := c.workloadImageRefs(wl)
+
+	for _, r := range c.ds.GetPolicyRules() {
+		if r.Severity == types.PolicyDeny && r.Matches(wl, refs) {
+			return &types.PolicyViolationError{RuleID: r.ID, Description: r.Description}
+		}
+	}
+
+	return nil
+}
+
+// ListPolicyRules returns the rules of the workload policy.
+func (c *controller) ListPolicyRules() ([]types.PolicyRule, error) {
+	return c.ds.GetPolicyRules(), nil
+}
+
+// CreatePolicyRule adds a rule to the workload policy.  The rule applies to
+// workloads created, updated and launched from then on.
+func (c *controller) CreatePolicyRule(req types.PolicyRule) (types.PolicyRule, error) {
+	if !req.Valid() {
+		return types.PolicyRule{}, types.ErrBadPolicyRule
+	}
+
+	req.ID = uuid.Generate().String()
+	req.CreateTime = time.Now()
+
+	if err := c.ds.AddPolicyRule(req); err != nil {
+		return types.PolicyRule{}, err
+	}
+
+	return req, nil
+}
+
+// ShowPolicyRule returns a rule of the workload policy.
+func (c *controller) ShowPolicyRule(ID string) (types.PolicyRule, error) {
+	return c.ds.GetPolicyRule(ID)
+}
+
+// UpdatePolicyRule replaces the conditions and severity of a rule of the
+// workload policy.
+func (c *controller) UpdatePolicyRule(ID string, req types.PolicyRule) (types.PolicyRule, error) {
+	r, err := c.ds.GetPolicyRule(ID)
+	if err != nil {
+		return types.PolicyRule{}, err
+	}
+
+	if !req.Valid() {
+		return types.PolicyRule{}, types.ErrBadPolicyRule
+	}
+
+	req.ID = r.ID
+	req.CreateTime = r.CreateTime
+
+	if err := c.ds.UpdatePolicyRule(req); err != nil {
+		return types.PolicyRule{}, err
+	}
+
+	return req, nil
+}
+
+// DeletePolicyRule removes a rule from the workload policy.
+func (c *controller) DeletePolicyRule(ID string) error {
+	return c.ds.DeletePolicyRule(ID)
+}
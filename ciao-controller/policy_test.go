@@ -0,0 +1,208 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
+)
+
+func TestPolicyRuleMatches(t *testing.T) {
+	wl := types.Workload{
+		FWType: string(payloads.EFI),
+		VMType: payloads.QEMU,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+	}
+	refs := []string{"1b3a3d2e-9e1f-4c2b-8d2d-7d3e6a1f0c11", "ubuntu-14.04-server"}
+
+	tests := []struct {
+		name    string
+		rule    types.PolicyRule
+		matches bool
+	}{
+		{"star", types.PolicyRule{ImagePattern: "ubuntu-14.*"}, true},
+		{"question", types.PolicyRule{ImagePattern: "ubuntu-1?.04-server"}, true},
+		{"class", types.PolicyRule{ImagePattern: "ubuntu-1[0-4].*"}, true},
+		{"negated-class", types.PolicyRule{ImagePattern: "ubuntu-1[^4].*"}, false},
+		{"image-id", types.PolicyRule{ImagePattern: "1b3a3d2e-*"}, true},
+		{"no-match", types.PolicyRule{ImagePattern: "fedora-*"}, false},
+		{"anchored", types.PolicyRule{ImagePattern: "14.04*"}, false},
+		{"vm-type", types.PolicyRule{VMType: payloads.QEMU}, true},
+		{"other-vm-type", types.PolicyRule{VMType: payloads.Docker}, false},
+		{"fw-type", types.PolicyRule{FWType: string(payloads.Legacy)}, false},
+		{"below-min-vcpus", types.PolicyRule{MinVCPUs: 4}, true},
+		{"at-min-mem", types.PolicyRule{MinMemMB: 512}, false},
+		{"all-conditions", types.PolicyRule{ImagePattern: "ubuntu-*", VMType: payloads.QEMU, MinMemMB: 1024}, true},
+		{"one-condition-fails", types.PolicyRule{ImagePattern: "ubuntu-*", VMType: payloads.Docker}, false},
+	}
+
+	for _, tt := range tests {
+		if m := tt.rule.Matches(&wl, refs); m != tt.matches {
+			t.Errorf("%s: expected match %v, got %v", tt.name, tt.matches, m)
+		}
+	}
+}
+
+func TestPolicyRuleValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  types.PolicyRule
+		valid bool
+	}{
+		{"deny", types.PolicyRule{Severity: types.PolicyDeny, ImagePattern: "ubuntu-*"}, true},
+		{"warn", types.PolicyRule{Severity: types.PolicyWarn, MinVCPUs: 2}, true},
+		{"no-severity", types.PolicyRule{ImagePattern: "ubuntu-*"}, false},
+		{"no-conditions", types.PolicyRule{Severity: types.PolicyDeny}, false},
+		{"bad-pattern", types.PolicyRule{Severity: types.PolicyDeny, ImagePattern: "ubuntu-[14"}, false},
+		{"negative", types.PolicyRule{Severity: types.PolicyDeny, MinMemMB: -1}, false},
+	}
+
+	for _, tt := range tests {
+		if v := tt.rule.Valid(); v != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.name, tt.valid, v)
+		}
+	}
+}
+
+func policyWorkload(tenantID string, image string) types.Workload {
+	return types.Workload{
+		TenantID:    tenantID,
+		Description: "policy workload",
+		ImageName:   image,
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.Docker,
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+	}
+}
+
+func addPolicyRule(t *testing.T, severity types.PolicySeverity, pattern string) types.PolicyRule {
+	r, err := ctl.CreatePolicyRule(types.PolicyRule{
+		Description:  "test rule",
+		Severity:     severity,
+		ImagePattern: pattern,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestPolicyWarnAndDeny(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warn := addPolicyRule(t, types.PolicyWarn, "policy-warn-*")
+	defer func() { _ = ctl.DeletePolicyRule(warn.ID) }()
+
+	deny := addPolicyRule(t, types.PolicyDeny, "policy-deny-*")
+	defer func() { _ = ctl.DeletePolicyRule(deny.ID) }()
+
+	warned := ctl.metrics.policyChecks.Value(policyIngest, string(types.PolicyWarn))
+	denied := ctl.metrics.policyChecks.Value(policyIngest, string(types.PolicyDeny))
+
+	_, err = ctl.CreateWorkload(policyWorkload(tenant.ID, "policy-warn-image"))
+	if err != nil {
+		t.Fatalf("Workload matching a warn rule rejected: %v", err)
+	}
+
+	_, err = ctl.CreateWorkload(policyWorkload(tenant.ID, "policy-deny-image"))
+	perr, ok := errors.Cause(err).(*types.PolicyViolationError)
+	if !ok {
+		t.Fatalf("Expected policy violation, got %v", err)
+	}
+
+	if perr.RuleID != deny.ID {
+		t.Errorf("Expected rule %s, got %s", deny.ID, perr.RuleID)
+	}
+
+	if v := ctl.metrics.policyChecks.Value(policyIngest, string(types.PolicyWarn)); v != warned+1 {
+		t.Errorf("Expected %d warnings, got %d", warned+1, v)
+	}
+
+	if v := ctl.metrics.policyChecks.Value(policyIngest, string(types.PolicyDeny)); v != denied+1 {
+		t.Errorf("Expected %d denials, got %d", denied+1, v)
+	}
+
+	// the rule takes effect as soon as it is deleted
+	err = ctl.DeletePolicyRule(deny.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.CreateWorkload(policyWorkload(tenant.ID, "policy-deny-image"))
+	if err != nil {
+		t.Fatalf("Workload rejected by deleted rule: %v", err)
+	}
+}
+
+func TestPolicyDenyLaunch(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := policyWorkload(tenant.ID, "policy-launch-image")
+	wl.ID = uuid.Generate().String()
+	err = ctl.ds.AddWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deny := addPolicyRule(t, types.PolicyDeny, "policy-launch-*")
+	defer func() { _ = ctl.DeletePolicyRule(deny.ID) }()
+
+	w := types.WorkloadRequest{
+		WorkloadID: wl.ID,
+		TenantID:   tenant.ID,
+		Instances:  1,
+	}
+
+	_, err = ctl.startWorkload(context.Background(), w)
+	if err == nil {
+		t.Fatal("Workload launched against deny rule")
+	}
+
+	if !strings.Contains(err.Error(), deny.ID) {
+		t.Errorf("Rule ID missing from error: %v", err)
+	}
+
+	// relaxing the rule to a warning allows the launch
+	deny.Severity = types.PolicyWarn
+	_, err = ctl.UpdatePolicyRule(deny.ID, deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatalf("Workload launch rejected by warn rule: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// preseedNodes returns the compute nodes selected by a preseed request, in
+// order.  Exactly one of all, a label or a list of nodes must be given and
+// the nodes listed must be known compute nodes.
+func (c *controller) preseedNodes(req types.ImagePreseedRequest) ([]string, error) {
+	selectors := 0
+	for _, set := range []bool{req.All, req.Label != "", len(req.Nodes) > 0} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return nil, types.ErrBadImagePreseed
+	}
+
+	compute := make(map[string]types.Node)
+	for _, n := range c.ds.GetNodes() {
+		if n.NodeRole.IsAgent() {
+			compute[n.ID] = n
+		}
+	}
+
+	var nodes []string
+	switch {
+	case req.All:
+		for ID := range compute {
+			nodes = append(nodes, ID)
+		}
+	case req.Label != "":
+		for ID, n := range compute {
+			for _, l := range n.Labels {
+				if l == req.Label {
+					nodes = append(nodes, ID)
+					break
+				}
+			}
+		}
+	default:
+		for _, ID := range req.Nodes {
+			if _, ok := compute[ID]; !ok {
+				return nil, types.ErrBadImagePreseed
+			}
+			nodes = append(nodes, ID)
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, types.ErrBadImagePreseed
+	}
+
+	sort.Strings(nodes)
+
+	return nodes, nil
+}
+
+// PreseedImage asks the selected compute nodes to cache an image so that
+// the first launch of the image on each of them does not need to wait for
+// it to be copied.  The nodes report back asynchronously; the state of the
+// image on each node is returned with the image.
+func (c *controller) PreseedImage(imageID string, req types.ImagePreseedRequest) (types.Image, error) {
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	if image.State != types.Active {
+		return types.Image{}, types.ErrImageNotActive
+	}
+
+	nodes, err := c.preseedNodes(req)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	for _, nodeID := range nodes {
+		seed := types.ImageSeed{
+			NodeID:     nodeID,
+			State:      types.ImageSeeding,
+			UpdateTime: time.Now(),
+		}
+
+		err := c.ds.UpdateImageSeed(image.ID, seed)
+		if err != nil {
+			return types.Image{}, err
+		}
+
+		err = c.client.prefetchImage(nodeID, image.ID)
+		if err != nil {
+			c.log.Warningf("Unable to request prefetch of image %s on node %s: %v", image.ID, nodeID, err)
+
+			seed.State = types.ImageSeedFailed
+			seed.Error = err.Error()
+			if err := c.ds.UpdateImageSeed(image.ID, seed); err != nil {
+				return types.Image{}, err
+			}
+		}
+	}
+
+	image.Seeds = c.imageSeeds(image.ID)
+
+	return image, nil
+}
+
+// imagePrefetched records the outcome of a prefetch reported by a node.
+// Reports for images which have since been deleted are ignored.
+func (c *controller) imagePrefetched(report payloads.ImagePrefetchReportEvent) {
+	if _, err := c.ds.GetImage(report.ImageUUID); err != nil {
+		c.log.Warningf("Prefetch report from node %s for unknown image %s", report.NodeUUID, report.ImageUUID)
+		return
+	}
+
+	seed := types.ImageSeed{
+		NodeID:     report.NodeUUID,
+		State:      types.ImageSeeded,
+		Error:      report.Reason,
+		UpdateTime: time.Now(),
+	}
+	if report.Reason != "" {
+		seed.State = types.ImageSeedFailed
+		c.log.Warningf("Node %s failed to prefetch image %s: %s", report.NodeUUID, report.ImageUUID, report.Reason)
+	} else {
+		c.log.Infof("Node %s prefetched image %s", report.NodeUUID, report.ImageUUID)
+	}
+
+	if err := c.ds.UpdateImageSeed(report.ImageUUID, seed); err != nil {
+		c.log.Warningf("Unable to record prefetch of image %s on node %s: %v", report.ImageUUID, report.NodeUUID, err)
+	}
+}
+
+// imageSeeds returns the state of an image in the image caches of the
+// nodes, or nil if it has never been preseeded.
+func (c *controller) imageSeeds(imageID string) []types.ImageSeed {
+	seeds := c.ds.GetImageSeeds(imageID)
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	return seeds
+}
+
+// preferredNodes returns the nodes which have cached all the images from
+// which the storage of an instance of wl is created, if the scheduler is to
+// prefer them.  The preference is only a hint: the scheduler places the
+// instance elsewhere if none of the nodes has room for it.
+func (c *controller) preferredNodes(tenantID string, wl *types.Workload) []string {
+	if !c.boolSetting(settingPreferSeededNodes) {
+		return nil
+	}
+
+	var preferred map[string]bool
+	for _, s := range wl.Storage {
+		if s.ID != "" || s.SourceType != types.ImageService {
+			continue
+		}
+
+		image, err := c.storageImage(tenantID, s)
+		if err != nil {
+			return nil
+		}
+
+		seeded := make(map[string]bool)
+		for _, nodeID := range c.ds.GetSeededNodes(image.ID) {
+			if preferred == nil || preferred[nodeID] {
+				seeded[nodeID] = true
+			}
+		}
+		preferred = seeded
+	}
+
+	var nodes []string
+	for nodeID := range preferred {
+		nodes = append(nodes, nodeID)
+	}
+
+	sort.Strings(nodes)
+
+	return nodes
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// addPreseedTestAgent connects a compute node with the given labels and
+// makes the controller aware of it.  The test server does not report node
+// connections so the node is added as the scheduler would.
+func addPreseedTestAgent(t *testing.T, labels []string) *testutil.SsntpTestClient {
+	client, err := testutil.NewSsntpTestClientConnection("Preseed", ssntp.AGENT, uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.ds.AddNode(client.UUID, payloads.ComputeNode)
+	client.Labels = labels
+	sendStatsCmd(client, t)
+
+	return client
+}
+
+// waitImageSeeded waits until no node is still caching an image.
+func waitImageSeeded(t *testing.T, imageID string) []types.ImageSeed {
+	for i := 0; i < 50; i++ {
+		seeds := ctl.ds.GetImageSeeds(imageID)
+
+		seeding := false
+		for _, s := range seeds {
+			if s.State == types.ImageSeeding {
+				seeding = true
+			}
+		}
+		if !seeding {
+			return seeds
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Image %s still seeding: %+v", imageID, ctl.ds.GetImageSeeds(imageID))
+	return nil
+}
+
+func TestPreseedImage(t *testing.T) {
+	label := "ssd-" + uuid.Generate().String()[:8]
+
+	seeded := addPreseedTestAgent(t, []string{label})
+	defer seeded.Shutdown()
+
+	failing := addPreseedTestAgent(t, []string{"gpu", label})
+	defer failing.Shutdown()
+	failing.PrefetchFail = true
+	failing.PrefetchFailReason = "No space left on device"
+
+	other := addPreseedTestAgent(t, nil)
+	defer other.Shutdown()
+
+	image, err := addTestImage("", types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seededCh := seeded.AddCmdChan(ssntp.PrefetchImage)
+	failingCh := failing.AddCmdChan(ssntp.PrefetchImage)
+
+	b, err := json.Marshal(types.ImagePreseedRequest{Label: label})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/images/" + image.ID
+	body := testHTTPRequest(t, "POST", url+"/preseed", http.StatusAccepted, b, true)
+
+	var accepted types.Image
+	err = json.Unmarshal(body, &accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accepted.Seeds) != 2 {
+		t.Fatalf("Expected 2 nodes to be seeded, got %+v", accepted.Seeds)
+	}
+
+	for _, ch := range []struct {
+		client *testutil.SsntpTestClient
+		ch     chan testutil.Result
+	}{{seeded, seededCh}, {failing, failingCh}} {
+		result, err := ch.client.GetCmdChanResult(ch.ch, ssntp.PrefetchImage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.NodeUUID != ch.client.UUID {
+			t.Fatalf("Prefetch sent to %s instead of %s", result.NodeUUID, ch.client.UUID)
+		}
+	}
+
+	seeds := waitImageSeeded(t, image.ID)
+	for _, s := range seeds {
+		switch s.NodeID {
+		case seeded.UUID:
+			if s.State != types.ImageSeeded || s.Error != "" {
+				t.Errorf("Expected image seeded on %s, got %+v", s.NodeID, s)
+			}
+		case failing.UUID:
+			if s.State != types.ImageSeedFailed || s.Error != failing.PrefetchFailReason {
+				t.Errorf("Expected prefetch failure on %s, got %+v", s.NodeID, s)
+			}
+		default:
+			t.Errorf("Unexpected node %s seeded", s.NodeID)
+		}
+	}
+
+	// explicit lists of nodes are seeded as well
+	otherCh := other.AddCmdChan(ssntp.PrefetchImage)
+
+	_, err = ctl.PreseedImage(image.ID, types.ImagePreseedRequest{Nodes: []string{other.UUID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = other.GetCmdChanResult(otherCh, ssntp.PrefetchImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = waitImageSeeded(t, image.ID)
+
+	// the seeds are shown to the admin
+	body = testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var shown types.Image
+	err = json.Unmarshal(body, &shown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nodes []string
+	for _, s := range shown.Seeds {
+		nodes = append(nodes, s.NodeID)
+	}
+
+	expected := []string{seeded.UUID, failing.UUID, other.UUID}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Fatalf("Expected seeds on %v, got %+v", expected, shown.Seeds)
+	}
+
+	if seeded := ctl.ds.GetSeededNodes(image.ID); len(seeded) != 2 {
+		t.Fatalf("Expected image to be seeded on 2 nodes, got %v", seeded)
+	}
+}
+
+func TestPreseedImageInvalid(t *testing.T) {
+	image, err := addTestImage("", types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req types.ImagePreseedRequest
+		err error
+	}{
+		{types.ImagePreseedRequest{}, types.ErrBadImagePreseed},
+		{types.ImagePreseedRequest{All: true, Label: "ssd"}, types.ErrBadImagePreseed},
+		{types.ImagePreseedRequest{Nodes: []string{uuid.Generate().String()}}, types.ErrBadImagePreseed},
+		{types.ImagePreseedRequest{Label: "no-such-label"}, types.ErrBadImagePreseed},
+	}
+
+	for _, tt := range tests {
+		_, err := ctl.PreseedImage(image.ID, tt.req)
+		if err != tt.err {
+			t.Errorf("Expected %v for %+v, got %v", tt.err, tt.req, err)
+		}
+	}
+
+	image.ID = uuid.Generate().String()
+	image.Name = "image-" + image.ID[:8]
+	image.State = types.Created
+	err = ctl.ds.AddImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.PreseedImage(image.ID, types.ImagePreseedRequest{All: true})
+	if err != types.ErrImageNotActive {
+		t.Fatalf("Expected %v, got %v", types.ErrImageNotActive, err)
+	}
+}
+
+func TestPreferSeededNodes(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage("", types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := []string{uuid.Generate().String(), uuid.Generate().String()}
+	sort.Strings(nodes)
+	for _, nodeID := range nodes {
+		ctl.imagePrefetched(payloads.ImagePrefetchReportEvent{NodeUUID: nodeID, ImageUUID: image.ID})
+	}
+	ctl.imagePrefetched(payloads.ImagePrefetchReportEvent{
+		NodeUUID:  uuid.Generate().String(),
+		ImageUUID: image.ID,
+		Reason:    "No space left on device",
+	})
+
+	wl := imageWorkload(tenant.ID, image.ID)
+
+	if preferred := ctl.preferredNodes(tenant.ID, &wl); preferred != nil {
+		t.Fatalf("Nodes preferred while disabled: %v", preferred)
+	}
+
+	_, err = ctl.UpdateSetting(context.Background(), settingPreferSeededNodes, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resetTestSetting(t, settingPreferSeededNodes)
+
+	preferred := ctl.preferredNodes(tenant.ID, &wl)
+	if !reflect.DeepEqual(preferred, nodes) {
+		t.Fatalf("Expected seeded nodes %v to be preferred, got %v", nodes, preferred)
+	}
+
+	_, rendered, err := renderConfig(&wl, uuid.Generate().String(), tenant.ID, "", payloads.NetworkResources{}, nil, nil, placement{preferred: preferred})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(rendered.start, "preferred_nodes") || !strings.Contains(rendered.start, nodes[0]) {
+		t.Fatalf("Preferred nodes not in start payload:\n%s", rendered.start)
+	}
+}
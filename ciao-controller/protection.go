@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+)
+
+// protectedResource identifies an instance or volume which is protected
+// from deletion.
+type protectedResource struct {
+	kind string
+	ID   string
+}
+
+// overrideDeletionProtection returns ErrDeletionProtected if any of the
+// resources of a tenant being deleted are protected, unless force is set.
+// Each protection overridden by force is recorded in the tenant's event log.
+func (c *controller) overrideDeletionProtection(ctx context.Context, tenantID string, protected []protectedResource, force bool) error {
+	if len(protected) == 0 {
+		return nil
+	}
+
+	if !force {
+		return types.ErrDeletionProtected
+	}
+
+	for _, r := range protected {
+		msg := fmt.Sprintf("Deletion protection of %s %s overridden", r.kind, r.ID)
+		err := c.ds.LogAction(tenantID, r.ID, service.GetActor(ctx), service.GetOnBehalfOf(ctx), msg)
+		if err != nil {
+			c.log.Warningf("Error logging event: %v", err)
+		}
+		c.log.Infof("%s by %s", msg, service.GetActor(ctx))
+	}
+
+	return nil
+}
+
+// tenantProtectedResources returns the instances and volumes of a tenant
+// which are protected from deletion.
+func (c *controller) tenantProtectedResources(tenantID string) ([]protectedResource, error) {
+	var protected []protectedResource
+
+	instances, err := c.ds.GetAllInstancesFromTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range instances {
+		if i.DeletionProtected {
+			protected = append(protected, protectedResource{"instance", i.ID})
+		}
+	}
+
+	volumes, err := c.ds.GetBlockDevices(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range volumes {
+		if v.DeletionProtected {
+			protected = append(protected, protectedResource{"volume", v.ID})
+		}
+	}
+
+	return protected, nil
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func protectTestInstance(t *testing.T, i *types.Instance) {
+	s, err := ctl.PatchServer(i.TenantID, i.ID, []byte(`{"deletion_protected":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Server.DeletionProtected {
+		t.Fatalf("Instance not protected: %+v", s.Server)
+	}
+}
+
+func testServersAction(t *testing.T, tenantID string, action types.CiaoServersAction) types.CiaoServersActionResponse {
+	b, err := json.Marshal(action)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/v2.1/" + tenantID + "/servers/action"
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, b, true)
+
+	var resp types.CiaoServersActionResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestBulkDeleteSkipsProtected(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unprotected := addRunningInstance(t, tenant.ID)
+	protected := addRunningInstance(t, tenant.ID)
+	protectTestInstance(t, protected)
+
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+
+	resp := testServersAction(t, tenant.ID, types.CiaoServersAction{Action: "os-delete"})
+	if !reflect.DeepEqual(resp.Protected, []string{protected.ID}) {
+		t.Fatalf("Expected protected instance %s to be reported, got %+v", protected.ID, resp)
+	}
+
+	result, err := server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.InstanceUUID != unprotected.ID {
+		t.Fatalf("Expected %s to be deleted, got %s", unprotected.ID, result.InstanceUUID)
+	}
+
+	// the protected instance is skipped even when named explicitly
+	resp = testServersAction(t, tenant.ID, types.CiaoServersAction{
+		Action:    "os-delete",
+		ServerIDs: []string{protected.ID},
+	})
+	if !reflect.DeepEqual(resp.Protected, []string{protected.ID}) {
+		t.Fatalf("Expected protected instance %s to be reported, got %+v", protected.ID, resp)
+	}
+
+	if _, err := ctl.ds.GetTenantInstance(tenant.ID, protected.ID); err != nil {
+		t.Fatalf("Protected instance deleted: %v", err)
+	}
+
+	// other actions are not affected by the protection
+	resp = testServersAction(t, tenant.ID, types.CiaoServersAction{
+		Action:    "os-stop",
+		ServerIDs: []string{protected.ID},
+	})
+	if len(resp.Protected) != 0 {
+		t.Fatalf("Protected instance reported for os-stop: %+v", resp)
+	}
+}
+
+func TestDeleteProtectedInstance(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addRunningInstance(t, tenant.ID)
+	protectTestInstance(t, i)
+
+	err = ctl.DeleteServer(context.Background(), tenant.ID, i.ID, false)
+	if err != types.ErrDeletionProtected {
+		t.Fatalf("Expected %v, got %v", types.ErrDeletionProtected, err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances/" + i.ID
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusConflict, nil, true)
+
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+
+	_ = testHTTPRequest(t, "DELETE", url+"?force=true", http.StatusNoContent, nil, true)
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if items := testListTrash(t, tenant.ID); len(items) != 0 {
+		t.Fatalf("Protected instance added to trash: %+v", items)
+	}
+
+	events, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audited := false
+	for _, e := range events {
+		if e.ObjectID == i.ID && strings.Contains(e.Message, "Deletion protection") {
+			audited = true
+		}
+	}
+	if !audited {
+		t.Fatalf("Forced deletion not audited: %+v", events)
+	}
+}
+
+func TestDeleteProtectedVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := ctl.CreateVolume(context.Background(), tenant.ID, api.RequestedVolume{
+		Size:              1,
+		DeletionProtected: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, vol.ID, false)
+	if err != types.ErrDeletionProtected {
+		t.Fatalf("Expected %v, got %v", types.ErrDeletionProtected, err)
+	}
+
+	_, err = ctl.PatchVolume(context.Background(), tenant.ID, vol.ID, []byte(`{"name":"data"}`))
+	if err != types.ErrBadRequest {
+		t.Fatalf("Expected %v patching unknown field, got %v", types.ErrBadRequest, err)
+	}
+
+	vol, err = ctl.PatchVolume(context.Background(), tenant.ID, vol.ID, []byte(`{"deletion_protected":false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.DeletionProtected {
+		t.Fatalf("Volume protection not cleared: %+v", vol)
+	}
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, vol.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteTenantProtected(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := createTestVolume(tenant.ID, 1, t)
+	_, err = ctl.PatchVolume(context.Background(), tenant.ID, vol, []byte(`{"deletion_protected":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.DeleteTenant(context.Background(), tenant.ID, false)
+	if err != types.ErrDeletionProtected {
+		t.Fatalf("Expected %v, got %v", types.ErrDeletionProtected, err)
+	}
+
+	if _, err := ctl.ds.GetBlockDevice(vol); err != nil {
+		t.Fatalf("Protected volume deleted with tenant: %v", err)
+	}
+
+	deleteTestTenant(t, tenant.ID, true)
+
+	if tenant, err := ctl.ds.GetTenant(tenant.ID); err != nil || tenant != nil {
+		t.Fatalf("Tenant not deleted when forced: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+)
+
+const (
+	// quotaAuditQueueLength is the number of quota audit records which
+	// may be waiting to be written to the datastore.  Records made while
+	// the queue is full are dropped so that the quota service never waits
+	// for the datastore.
+	quotaAuditQueueLength = 4096
+
+	// quotaAuditBatchSize is the largest number of quota audit records
+	// written to the datastore in a single transaction.
+	quotaAuditBatchSize = 256
+)
+
+// quotaAuditor writes the records of the changes in the consumption of
+// resources made by the quota service to the datastore in the background.
+type quotaAuditor struct {
+	ds      *datastore.Datastore
+	log     clogger.CiaoLog
+	records chan types.QuotaAuditRecord
+	dropped int64
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+}
+
+func newQuotaAuditor(ds *datastore.Datastore, log clogger.CiaoLog) *quotaAuditor {
+	return &quotaAuditor{
+		ds:      ds,
+		log:     log,
+		records: make(chan types.QuotaAuditRecord, quotaAuditQueueLength),
+		stop:    make(chan struct{}),
+	}
+}
+
+// record queues a record to be written.  It is the quotas.Auditor of the
+// quota service and so must not block.
+func (a *quotaAuditor) record(r types.QuotaAuditRecord) {
+	select {
+	case a.records <- r:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+func (a *quotaAuditor) start() {
+	a.wg.Add(1)
+	go a.write()
+}
+
+// shutdown writes the records which are queued and stops the auditor.  The
+// auditor must have been removed from the quota service first.
+func (a *quotaAuditor) shutdown() {
+	close(a.stop)
+	a.wg.Wait()
+}
+
+func (a *quotaAuditor) write() {
+	defer a.wg.Done()
+
+	for {
+		select {
+		case r := <-a.records:
+			a.writeBatch(r)
+		case <-a.stop:
+			for {
+				select {
+				case r := <-a.records:
+					a.writeBatch(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeBatch writes first along with the records queued behind it, up to
+// quotaAuditBatchSize of them.
+func (a *quotaAuditor) writeBatch(first types.QuotaAuditRecord) {
+	batch := []types.QuotaAuditRecord{first}
+
+	for queued := true; queued && len(batch) < quotaAuditBatchSize; {
+		select {
+		case r := <-a.records:
+			batch = append(batch, r)
+		default:
+			queued = false
+		}
+	}
+
+	if dropped := atomic.SwapInt64(&a.dropped, 0); dropped > 0 {
+		a.log.Warningf("Dropped %d quota audit records", dropped)
+	}
+
+	err := a.ds.AddQuotaAudit(batch)
+	if err != nil {
+		a.log.Warningf("Unable to record quota audit: %v", err)
+	}
+}
+
+// startQuotaAudit makes the quota service record every change in the
+// consumption of the resources subject to quotas.
+func (c *controller) startQuotaAudit() {
+	c.quotaAudit = newQuotaAuditor(c.ds, c.log)
+	c.quotaAudit.start()
+	c.qs.SetAuditor(c.quotaAudit.record)
+}
+
+// stopQuotaAudit stops recording the changes in the consumption of the
+// resources subject to quotas, once those already made are written.
+func (c *controller) stopQuotaAudit() {
+	if c.quotaAudit == nil {
+		return
+	}
+
+	c.qs.SetAuditor(nil)
+	c.quotaAudit.shutdown()
+}
+
+// ListQuotaHistory returns the quota audit records of a tenant, oldest
+// first.  The resource of the filter may name the resource or its plural.
+func (c *controller) ListQuotaHistory(filter types.QuotaAuditFilter) ([]types.QuotaAuditRecord, error) {
+	if filter.Resource != "" {
+		r, ok := quotas.AuditResource(filter.Resource)
+		if !ok {
+			return nil, types.ErrBadQuotaResource
+		}
+		filter.Resource = string(r)
+	}
+
+	return c.ds.GetQuotaAudit(filter)
+}
+
+// pruneQuotaAudit removes the quota audit records made more than
+// quota_audit_retention ago.
+func (c *controller) pruneQuotaAudit(cfg controllerConfig, now time.Time) {
+	pruned, err := c.ds.PruneQuotaAudit(now.Add(-cfg.QuotaAuditRetention))
+	if err != nil {
+		c.log.Warningf("Unable to prune quota audit: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d quota audit records", pruned)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// waitQuotaHistory polls the quota history of a tenant until it holds n
+// records.
+func waitQuotaHistory(t *testing.T, tenantID string, query url.Values, n int) []types.QuotaAuditRecord {
+	var resp types.QuotaHistoryResponse
+
+	u := testutil.ComputeURL + "/tenants/" + tenantID + "/quotas/history?" + query.Encode()
+
+	for i := 0; i < 50; i++ {
+		body := testHTTPRequest(t, "GET", u, http.StatusOK, nil, true)
+
+		err := json.Unmarshal(body, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.History) >= n {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if len(resp.History) != n {
+		t.Fatalf("Expected %d quota audit records, got %+v", n, resp.History)
+	}
+
+	return resp.History
+}
+
+func TestQuotaHistory(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{{Name: "tenant-instances-quota", Value: 1}})
+
+	instance := payloads.RequestedResource{Type: payloads.Instance, Value: 1}
+	vcpus := payloads.RequestedResource{Type: payloads.VCPUs, Value: 2}
+
+	if res := <-ctl.qs.Consume(tenant.ID, instance, vcpus); !res.Allowed() {
+		t.Fatal("Expected first instance to be allowed")
+	}
+
+	start := time.Now()
+
+	res := <-ctl.qs.Consume(tenant.ID, instance, vcpus)
+	if res.Allowed() {
+		t.Fatal("Expected second instance to be denied")
+	}
+	ctl.qs.Release(tenant.ID, res.Resources()...)
+
+	_ = waitQuotaHistory(t, tenant.ID, url.Values{}, 6)
+
+	history := waitQuotaHistory(t, tenant.ID, url.Values{"resource": {"instances"}}, 3)
+
+	expected := []struct {
+		delta   int
+		usage   int
+		allowed bool
+	}{
+		{1, 1, true},
+		{1, 2, false},
+		{-1, 1, true},
+	}
+
+	for i, e := range expected {
+		r := history[i]
+		if r.TenantID != tenant.ID || r.Resource != string(payloads.Instance) ||
+			r.Delta != e.delta || r.Usage != e.usage || r.Allowed != e.allowed {
+			t.Errorf("Unexpected quota audit record %d: %+v", i, r)
+		}
+	}
+
+	since := start.UTC().Format(time.RFC3339Nano)
+	_ = waitQuotaHistory(t, tenant.ID, url.Values{"resource": {"instance"}, "since": {since}}, 2)
+
+	u := testutil.ComputeURL + "/tenants/" + tenant.ID + "/quotas/history?resource=routers"
+	_ = testHTTPRequest(t, "GET", u, http.StatusBadRequest, nil, true)
+
+	ctl.pruneQuotaAudit(controllerConfig{QuotaAuditRetention: time.Nanosecond}, time.Now())
+
+	_ = waitQuotaHistory(t, tenant.ID, url.Values{}, 0)
+}
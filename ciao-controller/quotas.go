@@ -22,7 +22,39 @@ import (
 	"github.com/pkg/errors"
 )
 
+// UpdateQuotas sets quotas and limits of a tenant.  The quotas of the
+// instances of a workload may only be set for workloads the tenant can use.
 func (c *controller) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	for _, q := range qds {
+		if !quotas.ValidName(q.Name) {
+			return types.ErrBadQuotaResource
+		}
+
+		if q.Value < -1 {
+			return types.ErrBadRequest
+		}
+
+		workloadID, ok := quotas.WorkloadResource(payloads.Resource(q.Name))
+		if !ok {
+			continue
+		}
+
+		wl, err := c.ds.GetWorkload(workloadID)
+		if err != nil {
+			return types.ErrWorkloadNotFound
+		}
+
+		if wl.Visibility != types.Public && wl.TenantID != tenantID {
+			return types.ErrWorkloadNotFound
+		}
+	}
+
+	return c.updateQuotas(tenantID, qds)
+}
+
+// updateQuotas stores quotas and limits of a tenant which have already been
+// validated and passes them to the quota service.
+func (c *controller) updateQuotas(tenantID string, qds []types.QuotaDetails) error {
 	err := c.ds.UpdateQuotas(tenantID, qds)
 	if err != nil {
 		return errors.Wrap(err, "error updating quotas in database")
@@ -58,7 +90,7 @@ func populateQuotasFromDatastore(qs *quotas.Quotas, ds *datastore.Datastore) err
 		}
 		var size, count int
 		for _, bd := range bds {
-			if bd.Internal {
+			if bd.Internal || bd.State == types.PendingDelete {
 				continue
 			}
 			size += bd.Size
@@ -79,11 +111,7 @@ func populateQuotasFromDatastore(qs *quotas.Quotas, ds *datastore.Datastore) err
 			if err != nil {
 				return errors.Wrapf(err, "error getting workload")
 			}
-			resources := []payloads.RequestedResource{
-				{Type: payloads.Instance, Value: 1},
-				{Type: payloads.MemMB, Value: wl.Requirements.MemMB},
-				{Type: payloads.VCPUs, Value: wl.Requirements.VCPUs}}
-			<-qs.Consume(t.ID, resources...)
+			<-qs.Consume(t.ID, instanceResources(instance, &wl)...)
 		}
 	}
 
@@ -0,0 +1,138 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The classes of API requests, which are limited independently so that a
+// client creating resources as fast as it may can still read them.
+const (
+	rateClassWrite = "write"
+	rateClassRead  = "read"
+)
+
+// tokenBucket holds the requests a client may still make in a class.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimitKey struct {
+	client string
+	class  string
+}
+
+// rateLimitState holds the token buckets of the clients of the API.
+type rateLimitState struct {
+	sync.Mutex
+	buckets map[rateLimitKey]*tokenBucket
+}
+
+func validateRateLimit(name string, rate int, burst int) error {
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("%s_rate and %s_burst must not be negative", name, name)
+	}
+
+	if rate > 0 && burst == 0 {
+		return fmt.Errorf("%s_burst must be positive when %s_rate is set", name, name)
+	}
+
+	return nil
+}
+
+// rateClass returns the class of r and the rate per minute and burst size
+// configured for the class.
+func rateClass(cfg controllerConfig, r *http.Request) (string, int, int) {
+	if readOnlyRequest(r) {
+		return rateClassRead, cfg.APIReadRate, cfg.APIReadBurst
+	}
+	return rateClassWrite, cfg.APIWriteRate, cfg.APIWriteBurst
+}
+
+// allow takes a request from the bucket of client for class, which is
+// refilled at rate requests per minute up to burst requests.  If the
+// bucket is empty it returns false and how long the client must wait
+// before its next request is allowed.
+func (s *rateLimitState) allow(client string, class string, rate int, burst int, now time.Time) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.buckets == nil {
+		s.buckets = make(map[rateLimitKey]*tokenBucket)
+	}
+
+	key := rateLimitKey{client: client, class: class}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+
+	perSecond := float64(rate) / 60
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * perSecond
+		b.last = now
+	}
+
+	// the burst may have been lowered since the bucket was filled
+	b.tokens = math.Min(b.tokens, float64(burst))
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	return false, wait
+}
+
+// prune forgets the buckets which have been idle long enough to be full,
+// as if their clients had never made a request.
+func (s *rateLimitState) prune(cfg controllerConfig, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	limits := map[string][2]int{
+		rateClassWrite: {cfg.APIWriteRate, cfg.APIWriteBurst},
+		rateClassRead:  {cfg.APIReadRate, cfg.APIReadBurst},
+	}
+
+	for key, b := range s.buckets {
+		rate, burst := limits[key.class][0], limits[key.class][1]
+		if rate <= 0 || b.tokens+now.Sub(b.last).Minutes()*float64(rate) >= float64(burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// retryAfter returns the value of the Retry-After header for wait, which is
+// rounded up to whole seconds.
+func retryAfter(wait time.Duration) string {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf("%d", seconds)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func TestRateLimitBucket(t *testing.T) {
+	var s rateLimitState
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.allow("a", rateClassWrite, 60, 3, now); !ok {
+			t.Fatalf("Request %d within burst refused", i)
+		}
+	}
+
+	ok, wait := s.allow("a", rateClassWrite, 60, 3, now)
+	if ok || wait != time.Second {
+		t.Fatalf("Expected request beyond burst to wait 1s: %v %v", ok, wait)
+	}
+
+	// classes and clients have buckets of their own
+	if ok, _ := s.allow("a", rateClassRead, 60, 3, now); !ok {
+		t.Errorf("Read refused after writes")
+	}
+	if ok, _ := s.allow("b", rateClassWrite, 60, 3, now); !ok {
+		t.Errorf("Client refused after another's requests")
+	}
+
+	// the bucket refills at the rate
+	if ok, _ := s.allow("a", rateClassWrite, 60, 3, now.Add(500*time.Millisecond)); ok {
+		t.Errorf("Request allowed before refill")
+	}
+	if ok, _ := s.allow("a", rateClassWrite, 60, 3, now.Add(time.Second)); !ok {
+		t.Errorf("Request refused after refill")
+	}
+
+	// no rate means no limit
+	for i := 0; i < 10; i++ {
+		if ok, _ := s.allow("a", rateClassWrite, 0, 0, now); !ok {
+			t.Fatalf("Request refused without limit")
+		}
+	}
+
+	cfg := controllerConfig{APIWriteRate: 60, APIWriteBurst: 3, APIReadRate: 60, APIReadBurst: 3}
+	s.prune(cfg, now.Add(time.Second))
+	if _, ok := s.buckets[rateLimitKey{"a", rateClassWrite}]; !ok || len(s.buckets) != 1 {
+		t.Errorf("Expected only the bucket which is not full to be kept: %v", s.buckets)
+	}
+
+	s.prune(cfg, now.Add(time.Minute))
+	if len(s.buckets) != 0 {
+		t.Errorf("Expected full buckets to be pruned: %d", len(s.buckets))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait     time.Duration
+		expected string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+
+	for _, tt := range tests {
+		if v := retryAfter(tt.wait); v != tt.expected {
+			t.Errorf("%v: expected %s got %s", tt.wait, tt.expected, v)
+		}
+	}
+}
+
+// parallelRequests makes n concurrent requests with client and returns how
+// many were refused for exceeding the rate limit.
+func parallelRequests(t *testing.T, client *http.Client, n int, method string, url string) int {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	limited := 0
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest(method, url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusTooManyRequests {
+				return
+			}
+
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || s < 1 {
+				t.Errorf("Invalid Retry-After: %q", resp.Header.Get("Retry-After"))
+			}
+
+			lock.Lock()
+			limited++
+			lock.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	return limited
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const burst = 5
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.APIWriteRate = 1
+		cfg.APIWriteBurst = burst
+		cfg.APIReadRate = 0
+	})()
+
+	ca := createTestCA(t, "rate limit CA")
+	defer trustTestCA(ca)()
+
+	// clients are limited by name, which must not have been used before
+	user := certClient(ca.clientCert(t, "user-"+uuid.Generate().String(), []string{tenant.ID}))
+	other := certClient(ca.clientCert(t, "user-"+uuid.Generate().String(), []string{tenant.ID}))
+
+	// the requests are refused by the handler once they have been allowed
+	volumesURL := testutil.ComputeURL + "/" + tenant.ID + "/volumes"
+
+	const n = 20
+	if limited := parallelRequests(t, user, n, "POST", volumesURL); limited != n-burst {
+		t.Errorf("Expected %d of %d requests to be limited, got %d", n-burst, n, limited)
+	}
+
+	if limited := parallelRequests(t, user, n, "GET", volumesURL); limited != 0 {
+		t.Errorf("Expected reads not to be limited by writes, %d were", limited)
+	}
+
+	if limited := parallelRequests(t, other, n, "POST", volumesURL); limited != n-burst {
+		t.Errorf("Expected %d requests of another client to be limited, got %d", n-burst, limited)
+	}
+
+	admin := testHTTPClient(t)
+	if limited := parallelRequests(t, admin, n, "POST", volumesURL); limited != 0 {
+		t.Errorf("Expected admin not to be limited, %d requests were", limited)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
+)
+
+// inventoryRequests routes the instance inventories reported by the
+// launchers to the goroutines waiting for them.
+type inventoryRequests struct {
+	lock    sync.Mutex
+	pending map[string]chan payloads.InventoryReportEvent
+}
+
+func (r *inventoryRequests) add(nodeID string) chan payloads.InventoryReportEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]chan payloads.InventoryReportEvent)
+	}
+
+	ch := make(chan payloads.InventoryReportEvent, 1)
+	r.pending[nodeID] = ch
+
+	return ch
+}
+
+func (r *inventoryRequests) remove(nodeID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, nodeID)
+}
+
+// deliver passes report on to the goroutine waiting for it.  It returns
+// false if no inventory was requested from the node.
+func (r *inventoryRequests) deliver(report payloads.InventoryReportEvent) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ch, ok := r.pending[report.NodeUUID]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- report:
+	default:
+	}
+
+	return true
+}
+
+// inventoryDiff describes the differences between the instances the
+// datastore places on a node and those the node reports.
+type inventoryDiff struct {
+	// missing are the datastore instances the node does not have
+	missing []string
+
+	// adopted are the instances reported by the node which the
+	// datastore knows about but does not place on the node
+	adopted []payloads.InventoryInstance
+
+	// unknown are the instances reported by the node which are not in
+	// the datastore
+	unknown []string
+
+	// corrected are the instances the datastore places on the node in a
+	// transitional state which the node reports in another state
+	corrected []payloads.InventoryInstance
+}
+
+// transitionalStates are the states in which an instance is waiting for
+// the result of a command sent to its node.
+var transitionalStates = map[string]bool{
+	payloads.Pending:  true,
+	payloads.Stopping: true,
+}
+
+// diffInventory compares the instances reported by a node with the
+// instances in the datastore.  Instances being migrated are reported by
+// both of the nodes involved and are left to the migration to resolve.
+func diffInventory(nodeID string, instances map[string]*types.Instance, report payloads.InventoryReportEvent) inventoryDiff {
+	var diff inventoryDiff
+
+	reported := make(map[string]bool)
+	for _, r := range report.Instances {
+		reported[r.InstanceUUID] = true
+
+		i, ok := instances[r.InstanceUUID]
+		if !ok {
+			diff.unknown = append(diff.unknown, r.InstanceUUID)
+		} else if i.NodeID != nodeID && i.State != payloads.Migrating {
+			diff.adopted = append(diff.adopted, r)
+		} else if i.NodeID == nodeID && transitionalStates[i.State] && r.State != i.State {
+			diff.corrected = append(diff.corrected, r)
+		}
+	}
+
+	for _, i := range instances {
+		if i.NodeID == nodeID && !i.CNCI && !reported[i.ID] && i.State != payloads.Migrating {
+			diff.missing = append(diff.missing, i.ID)
+		}
+	}
+	sort.Strings(diff.missing)
+
+	return diff
+}
+
+// reconciliationReport summarises a reconciliation.  Released lists the
+// IDs of the storage attachments released rather than of instances.
+type reconciliationReport struct {
+	Nodes     []string
+	TimedOut  []string
+	Failed    []string
+	Adopted   []string
+	Unknown   []string
+	Corrected []string
+	Restarted []string
+	Removed   []string
+	Released  []string
+}
+
+func (r *reconciliationReport) data() map[string]string {
+	return map[string]string{
+		"nodes":     strings.Join(r.Nodes, ","),
+		"timed_out": strings.Join(r.TimedOut, ","),
+		"failed":    strings.Join(r.Failed, ","),
+		"adopted":   strings.Join(r.Adopted, ","),
+		"unknown":   strings.Join(r.Unknown, ","),
+		"corrected": strings.Join(r.Corrected, ","),
+		"restarted": strings.Join(r.Restarted, ","),
+		"removed":   strings.Join(r.Removed, ","),
+		"released":  strings.Join(r.Released, ","),
+	}
+}
+
+func (r *reconciliationReport) String() string {
+	return fmt.Sprintf("%d nodes, %d timed out, %d instances failed, %d adopted, %d unknown, "+
+		"%d corrected, %d restarted, %d removed, %d attachments released",
+		len(r.Nodes), len(r.TimedOut), len(r.Failed), len(r.Adopted), len(r.Unknown),
+		len(r.Corrected), len(r.Restarted), len(r.Removed), len(r.Released))
+}
+
+// requestInventory asks a node for its instances and waits up to timeout
+// for the reply.
+func (c *controller) requestInventory(nodeID string, timeout time.Duration) (payloads.InventoryReportEvent, error) {
+	ch := c.inventories.add(nodeID)
+	defer c.inventories.remove(nodeID)
+
+	err := c.client.requestInventory(nodeID)
+	if err != nil {
+		return payloads.InventoryReportEvent{}, errors.Wrap(err, "Unable to request inventory")
+	}
+
+	select {
+	case report := <-ch:
+		return report, nil
+	case <-time.After(timeout):
+		return payloads.InventoryReportEvent{}, errors.New("Timed out waiting for inventory")
+	}
+}
+
+// inventoryNodes returns the compute nodes which are connected or which
+// the datastore places instances on.
+func (c *controller) inventoryNodes(instances map[string]*types.Instance) []string {
+	nodes := make(map[string]bool)
+
+	for _, n := range c.ds.GetNodes() {
+		if n.NodeRole.IsAgent() {
+			nodes[n.ID] = true
+		}
+	}
+
+	for _, i := range instances {
+		// Instances which have never been reported by a node have a
+		// placeholder node ID.
+		if _, err := uuid.Parse(i.NodeID); err == nil && !i.CNCI {
+			nodes[i.NodeID] = true
+		}
+	}
+
+	var IDs []string
+	for ID := range nodes {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	return IDs
+}
+
+// reconcile compares the datastore with the instances reported by the
+// compute nodes.  Instances the datastore places on a node which no longer
+// has them are marked as failed and instances reported by a node other
+// than the one the datastore expects are adopted.  Instances unknown to
+// the datastore are only reported.  Nodes which do not reply within
+// timeout are skipped.  The launches of instances which have been pending
+// for at least pendingAge and which no node reports are then restarted,
+// and the storage attachments of instances no longer in the datastore are
+// released.
+func (c *controller) reconcile(timeout time.Duration, pendingAge time.Duration) reconciliationReport {
+	var report reconciliationReport
+
+	instances := make(map[string]*types.Instance)
+	all, err := c.ds.GetAllInstances()
+	if err != nil {
+		c.log.Errorf("Unable to reconcile instances: %v", err)
+		return report
+	}
+	for _, i := range all {
+		instances[i.ID] = i
+	}
+
+	report.Nodes = c.inventoryNodes(instances)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	inventories := make(map[string]payloads.InventoryReportEvent)
+	for _, nodeID := range report.Nodes {
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+
+			inventory, err := c.requestInventory(nodeID, timeout)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				clogger.With(c.log, "node", nodeID).Warningf("Node not reconciled: %v", err)
+				report.TimedOut = append(report.TimedOut, nodeID)
+				return
+			}
+			inventories[nodeID] = inventory
+		}(nodeID)
+	}
+	wg.Wait()
+	sort.Strings(report.TimedOut)
+
+	reported := make(map[string]bool)
+	for _, nodeID := range report.Nodes {
+		inventory, ok := inventories[nodeID]
+		if !ok {
+			continue
+		}
+
+		for _, i := range inventory.Instances {
+			reported[i.InstanceUUID] = true
+		}
+
+		diff := diffInventory(nodeID, instances, inventory)
+		c.applyInventoryDiff(nodeID, diff, &report)
+	}
+
+	c.restartPendingInstances(all, reported, pendingAge, time.Now(), &report)
+	c.releaseOrphanedAttachments(&report)
+
+	c.log.Infof("Reconciliation complete: %s", report.String())
+	c.publishEvent(types.ReconciliationEvent, "", "Reconciliation complete: "+report.String(), report.data())
+
+	return report
+}
+
+func (c *controller) applyInventoryDiff(nodeID string, diff inventoryDiff, report *reconciliationReport) {
+	log := clogger.With(c.log, "node", nodeID)
+
+	for _, ID := range diff.missing {
+		reason := fmt.Sprintf("not found on node %s during reconciliation", nodeID)
+		err := c.ds.InstanceFailed(ID, reason)
+		if err != nil {
+			log.Warningf("Unable to mark instance %s as failed: %v", ID, err)
+			continue
+		}
+		log.Warningf("Instance %s %s", ID, reason)
+		report.Failed = append(report.Failed, ID)
+	}
+
+	for _, i := range diff.adopted {
+		err := c.ds.AdoptInstance(i.InstanceUUID, nodeID, i.State)
+		if err != nil {
+			log.Warningf("Unable to adopt instance %s: %v", i.InstanceUUID, err)
+			continue
+		}
+		log.Infof("Adopted instance %s", i.InstanceUUID)
+		report.Adopted = append(report.Adopted, i.InstanceUUID)
+	}
+
+	for _, ID := range diff.unknown {
+		log.Warningf("Unknown instance %s found during reconciliation", ID)
+		report.Unknown = append(report.Unknown, ID)
+	}
+
+	for _, i := range diff.corrected {
+		err := c.ds.AdoptInstance(i.InstanceUUID, nodeID, i.State)
+		if err != nil {
+			log.Warningf("Unable to correct state of instance %s: %v", i.InstanceUUID, err)
+			continue
+		}
+		log.Infof("Corrected state of instance %s to %s", i.InstanceUUID, i.State)
+		report.Corrected = append(report.Corrected, i.InstanceUUID)
+	}
+}
+
+// restartPendingInstances resends the start commands of the instances which
+// have been pending since before now less pendingAge and which no node
+// reported, e.g. because the controller stopped before the command reached
+// the scheduler.  An instance whose launch cannot be restarted is removed
+// and its resources released.  Nothing is done if any node failed to reply
+// as the instances may be on that node.  CNCIs are left to the CNCI health
+// monitor.
+func (c *controller) restartPendingInstances(instances []*types.Instance, reported map[string]bool,
+	pendingAge time.Duration, now time.Time, report *reconciliationReport) {
+	if len(report.TimedOut) > 0 {
+		c.log.Warningf("Pending instances not reconciled as %d nodes did not reply", len(report.TimedOut))
+		return
+	}
+
+	for _, i := range instances {
+		if i.CNCI || i.State != payloads.Pending || reported[i.ID] || now.Sub(i.CreateTime) < pendingAge {
+			continue
+		}
+
+		log := c.instanceLog(i)
+
+		config, err := c.ds.GetLaunchConfig(i.ID)
+		if err == nil {
+			err = c.client.StartWorkload(config)
+		}
+
+		if err != nil {
+			log.Warningf("Unable to restart launch of pending instance: %v", err)
+			c.addHistory(i, types.InstanceHistoryEntry{
+				Type:    types.HistoryResult,
+				Message: fmt.Sprintf("Start failed: %v", err),
+			})
+			c.client.RemoveInstance(i.ID)
+
+			msg := fmt.Sprintf("Instance %s removed during reconciliation as its launch could not be restarted", i.ID)
+			if err := c.ds.LogError(i.TenantID, msg); err != nil {
+				log.Warningf("Error logging event: %v", err)
+			}
+			report.Removed = append(report.Removed, i.ID)
+			continue
+		}
+
+		c.recordCommand(i, "start")
+		log.Infof("Restarted launch of pending instance")
+		report.Restarted = append(report.Restarted, i.ID)
+	}
+
+	sort.Strings(report.Restarted)
+	sort.Strings(report.Removed)
+}
+
+// releaseOrphanedAttachments releases the storage attachments of instances
+// which are no longer in the datastore.  Ephemeral volumes are deleted,
+// along with their quota, and other volumes are made available.
+func (c *controller) releaseOrphanedAttachments(report *reconciliationReport) {
+	released := make(map[string]bool)
+	for _, a := range c.ds.GetOrphanedStorageAttachments() {
+		report.Released = append(report.Released, a.ID)
+		if released[a.InstanceID] {
+			continue
+		}
+		released[a.InstanceID] = true
+
+		err := c.deleteEphemeralStorage(a.InstanceID)
+		if err != nil {
+			c.log.Warningf("Unable to delete ephemeral storage of deleted instance %s: %v", a.InstanceID, err)
+		}
+		c.ds.ReleaseStorageAttachments(a.InstanceID)
+		c.log.Warningf("Released storage attachments of deleted instance %s", a.InstanceID)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func TestDiffInventory(t *testing.T) {
+	instances := map[string]*types.Instance{
+		"running": {ID: "running", NodeID: "node1"},
+		"lost":    {ID: "lost", NodeID: "node1"},
+		"moved":   {ID: "moved", NodeID: "node2"},
+		"stopped": {ID: "stopped", NodeID: ""},
+		"cnci":    {ID: "cnci", NodeID: "node1", CNCI: true},
+		"pending": {ID: "pending", NodeID: "node1", State: payloads.Pending},
+		"booting": {ID: "booting", NodeID: "node1", State: payloads.Pending},
+	}
+
+	report := payloads.InventoryReportEvent{
+		NodeUUID: "node1",
+		Instances: []payloads.InventoryInstance{
+			{InstanceUUID: "running", State: payloads.Running},
+			{InstanceUUID: "moved", State: payloads.Running},
+			{InstanceUUID: "stopped", State: payloads.Exited},
+			{InstanceUUID: "stranger", State: payloads.Running},
+			{InstanceUUID: "pending", State: payloads.Running},
+			{InstanceUUID: "booting", State: payloads.Pending},
+		},
+	}
+
+	diff := diffInventory("node1", instances, report)
+
+	if !reflect.DeepEqual(diff.missing, []string{"lost"}) {
+		t.Errorf("Unexpected missing instances: %v", diff.missing)
+	}
+
+	if !reflect.DeepEqual(diff.adopted, report.Instances[1:3]) {
+		t.Errorf("Unexpected adopted instances: %v", diff.adopted)
+	}
+
+	if !reflect.DeepEqual(diff.unknown, []string{"stranger"}) {
+		t.Errorf("Unexpected unknown instances: %v", diff.unknown)
+	}
+
+	if !reflect.DeepEqual(diff.corrected, report.Instances[4:5]) {
+		t.Errorf("Unexpected corrected instances: %v", diff.corrected)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconcile(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	// the instances started on the first client are lost when it is
+	// replaced by a client with the same UUID
+	client, lost := testStartWorkload(t, 1, false, reason)
+	sendStatsCmd(client, t)
+	client.Shutdown()
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+	sendStatsCmd(client, t)
+
+	adopted := instances[0].ID
+	err := ctl.ds.InstanceStopped(adopted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second workload started on the same client
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+	w := types.WorkloadRequest{
+		WorkloadID: instances[0].WorkloadID,
+		TenantID:   instances[0].TenantID,
+		Instances:  1,
+		Name:       "unknown",
+	}
+	instances, err = ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := instances[0].ID
+	err = ctl.ds.DeleteInstance(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := ctl.reconcile(2*time.Second, time.Hour)
+
+	if !containsString(report.Nodes, testutil.AgentUUID) {
+		t.Fatalf("Node %s not reconciled: %v", testutil.AgentUUID, report.Nodes)
+	}
+
+	if containsString(report.TimedOut, testutil.AgentUUID) {
+		t.Fatalf("Node %s timed out", testutil.AgentUUID)
+	}
+
+	if !containsString(report.Failed, lost[0].ID) {
+		t.Errorf("Instance %s not failed: %v", lost[0].ID, report.Failed)
+	}
+
+	i, err := ctl.ds.GetInstance(lost[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.ExitFailed || i.NodeID != "" {
+		t.Errorf("Lost instance not failed: state %s node %s", i.State, i.NodeID)
+	}
+
+	if !containsString(report.Adopted, adopted) {
+		t.Errorf("Instance %s not adopted: %v", adopted, report.Adopted)
+	}
+
+	i, err = ctl.ds.GetInstance(adopted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.Running || i.NodeID != testutil.AgentUUID {
+		t.Errorf("Instance not adopted: state %s node %s", i.State, i.NodeID)
+	}
+
+	if !containsString(report.Unknown, unknown) {
+		t.Errorf("Instance %s not reported as unknown: %v", unknown, report.Unknown)
+	}
+}
+
+func TestReconcilePendingInstances(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+	sendStatsCmd(client, t)
+
+	// the controller stops after sending the start command, which never
+	// reaches the node
+	client.DropStart = true
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+	w := types.WorkloadRequest{
+		WorkloadID: instances[0].WorkloadID,
+		TenantID:   instances[0].TenantID,
+		Instances:  1,
+		Name:       "lost",
+	}
+	launched, err := ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DropStart = false
+	lost := launched[0]
+
+	// the controller stops before recording the launch configuration
+	abandoned := &types.Instance{
+		ID:          uuid.Generate().String(),
+		TenantID:    instances[0].TenantID,
+		WorkloadID:  instances[0].WorkloadID,
+		MACAddress:  uuid.Generate().String(),
+		State:       payloads.Pending,
+		CreateTime:  time.Now(),
+		StateChange: sync.NewCond(&sync.Mutex{}),
+	}
+	err = ctl.ds.AddInstance(context.Background(), abandoned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report reconciliationReport
+	pending := []*types.Instance{lost, abandoned, instances[0]}
+
+	// nothing is done while a node may still have the instances
+	report.TimedOut = []string{testutil.AgentUUID}
+	ctl.restartPendingInstances(pending, nil, 0, time.Now(), &report)
+	if len(report.Restarted) != 0 || len(report.Removed) != 0 {
+		t.Fatalf("Instances reconciled although a node timed out: %+v", report)
+	}
+
+	// nor to instances which have only just been launched
+	report.TimedOut = nil
+	ctl.restartPendingInstances(pending, nil, time.Hour, time.Now(), &report)
+	if len(report.Restarted) != 0 || len(report.Removed) != 0 {
+		t.Fatalf("Recent instances reconciled: %+v", report)
+	}
+
+	clientCmdCh = client.AddCmdChan(ssntp.START)
+	ctl.restartPendingInstances(pending, nil, 0, time.Now(), &report)
+
+	result, err := client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != lost.ID {
+		t.Fatalf("Expected start of %s, got %s", lost.ID, result.InstanceUUID)
+	}
+
+	if !reflect.DeepEqual(report.Restarted, []string{lost.ID}) {
+		t.Errorf("Unexpected restarted instances: %v", report.Restarted)
+	}
+
+	if !reflect.DeepEqual(report.Removed, []string{abandoned.ID}) {
+		t.Errorf("Unexpected removed instances: %v", report.Removed)
+	}
+
+	_, err = ctl.ds.GetInstance(abandoned.ID)
+	if err == nil {
+		t.Errorf("Instance %s not removed", abandoned.ID)
+	}
+
+	sendStatsCmd(client, t)
+
+	i, err := ctl.ds.GetInstance(lost.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.Running || i.NodeID != testutil.AgentUUID {
+		t.Errorf("Restarted instance not running: state %s node %s", i.State, i.NodeID)
+	}
+}
+
+func TestReconcileOrphanedAttachments(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := addTestBlockDevice(t, tenant.ID)
+	volume.State = types.InUse
+	err = ctl.ds.UpdateBlockDevice(context.Background(), volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the controller stops while deleting the instance
+	instanceID := uuid.Generate().String()
+	a, err := ctl.ds.CreateStorageAttachment(context.Background(), instanceID, payloads.StorageResource{ID: volume.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report reconciliationReport
+	ctl.releaseOrphanedAttachments(&report)
+
+	if !containsString(report.Released, a.ID) {
+		t.Fatalf("Attachment %s not released: %v", a.ID, report.Released)
+	}
+
+	if len(ctl.ds.GetStorageAttachments(instanceID)) != 0 {
+		t.Errorf("Attachments of instance %s not deleted", instanceID)
+	}
+
+	bd, err := ctl.ds.GetBlockDevice(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bd.State != types.Available {
+		t.Errorf("Volume not made available: %s", bd.State)
+	}
+}
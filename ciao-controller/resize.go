@@ -0,0 +1,280 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// pendingResize records the requirements an instance ran with before it
+// was resized, so that they can be restored if the resize fails.
+type pendingResize struct {
+	tenantID string
+	nodeID   string
+	oldVCPUs int
+	oldMemMB int
+	vcpus    int
+	memMB    int
+}
+
+// resizeRequests tracks the resizes which have been sent to the nodes
+// running the instances and which the nodes have not yet reported on.
+// An instance may only be resized once at a time.
+type resizeRequests struct {
+	lock    sync.Mutex
+	pending map[string]pendingResize
+}
+
+func (r *resizeRequests) add(instanceID string, p pendingResize) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]pendingResize)
+	}
+
+	if _, ok := r.pending[instanceID]; ok {
+		return false
+	}
+
+	r.pending[instanceID] = p
+
+	return true
+}
+
+func (r *resizeRequests) remove(instanceID string) (pendingResize, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p, ok := r.pending[instanceID]
+	if ok {
+		delete(r.pending, instanceID)
+	}
+
+	return p, ok
+}
+
+// resizeResources returns the quota tracked resources which change when an
+// instance is resized.
+func resizeResources(vcpus int, memMB int) []payloads.RequestedResource {
+	return []payloads.RequestedResource{
+		{Type: payloads.MemMB, Value: memMB},
+		{Type: payloads.VCPUs, Value: vcpus},
+	}
+}
+
+// checkResize checks a requirement an instance is resized to against the
+// bounds of its workload.  Instances may not shrink below the minimum set
+// by the workload, or below the requirement of the workload if it sets no
+// minimum, and may only grow beyond the requirement of the workload up to
+// the maximum it sets, if any.
+func checkResize(resource string, value int, minName string, min int, maxName string, max int, required int) error {
+	bound := minName
+	if min == 0 {
+		min = required
+		bound = resource
+	}
+
+	if value < min {
+		return &types.RequirementsBoundError{Resource: resource, Bound: bound, Limit: min, Value: value}
+	}
+
+	if max != 0 && value > max {
+		return &types.RequirementsBoundError{Resource: resource, Bound: maxName, Limit: max, Value: value}
+	}
+
+	return nil
+}
+
+// ResizeInstance asks the node running a VM instance to restart it with new
+// VCPU and memory requirements.  Zero values keep the current requirement
+// of the instance.  The quota of the tenant is charged for the new
+// requirements, which are recorded on the instance so that it keeps them
+// when it is restarted, as soon as the resize is accepted.  Both are
+// restored if the node fails to resize the instance.
+func (c *controller) ResizeInstance(tenantID string, instanceID string, vcpus int, memMB int) error {
+	if vcpus < 0 || memMB < 0 || (vcpus == 0 && memMB == 0) {
+		return types.ErrBadResize
+	}
+
+	i, err := c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	if i.State == payloads.Migrating {
+		return types.ErrInstanceMigrating
+	}
+
+	if i.CNCI || i.State != payloads.Running || i.NodeID == "" {
+		return types.ErrInstanceNotResizable
+	}
+
+	w, err := c.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		return err
+	}
+
+	if w.VMType == payloads.Docker {
+		return types.ErrInstanceNotResizable
+	}
+
+	current := instanceRequirements(i, &w)
+	if vcpus == 0 {
+		vcpus = current.VCPUs
+	}
+	if memMB == 0 {
+		memMB = current.MemMB
+	}
+
+	if vcpus == current.VCPUs && memMB == current.MemMB {
+		return types.ErrBadResize
+	}
+
+	var b types.WorkloadBounds
+	if w.Bounds != nil {
+		b = *w.Bounds
+	}
+
+	err = checkResize("vcpus", vcpus, "min_vcpus", b.MinVCPUs, "max_vcpus", b.MaxVCPUs, w.Requirements.VCPUs)
+	if err != nil {
+		return err
+	}
+
+	err = checkResize("mem_mb", memMB, "min_mem_mb", b.MinMemMB, "max_mem_mb", b.MaxMemMB, w.Requirements.MemMB)
+	if err != nil {
+		return err
+	}
+
+	p := pendingResize{
+		tenantID: i.TenantID,
+		nodeID:   i.NodeID,
+		oldVCPUs: current.VCPUs,
+		oldMemMB: current.MemMB,
+		vcpus:    vcpus,
+		memMB:    memMB,
+	}
+
+	if !c.resizes.add(i.ID, p) {
+		return types.ErrInstanceResizing
+	}
+
+	// The instance gives up its old reservation for the new one, which
+	// must fit within the quota of the tenant.
+	c.qs.Release(i.TenantID, resizeResources(p.oldVCPUs, p.oldMemMB)...)
+	res := <-c.qs.Consume(i.TenantID, resizeResources(vcpus, memMB)...)
+	if !res.Allowed() {
+		c.swapResizeQuota(i.TenantID, p.vcpus, p.memMB, p.oldVCPUs, p.oldMemMB)
+		c.resizes.remove(i.ID)
+		c.quotaExceeded(i.TenantID, res)
+		return types.ErrQuota
+	}
+
+	err = c.ds.UpdateInstanceRequirements(i.ID, vcpus, memMB)
+	if err != nil {
+		c.swapResizeQuota(i.TenantID, p.vcpus, p.memMB, p.oldVCPUs, p.oldMemMB)
+		c.resizes.remove(i.ID)
+		return err
+	}
+
+	c.recordCommand(i, "resize")
+
+	go func() {
+		if err := c.client.resizeInstance(i.ID, p.nodeID, vcpus, memMB); err != nil {
+			c.resizeFailed(i.ID, fmt.Sprintf("unable to send resize to node %s: %v", p.nodeID, err))
+		}
+	}()
+
+	return nil
+}
+
+// swapResizeQuota moves the reservation of a tenant from the requirements
+// an instance was to be resized to back to the ones it ran with.  The old
+// requirements were already accounted for, so the result of consuming them
+// again is not checked.
+func (c *controller) swapResizeQuota(tenantID string, vcpus int, memMB int, oldVCPUs int, oldMemMB int) {
+	c.qs.Release(tenantID, resizeResources(vcpus, memMB)...)
+	<-c.qs.Consume(tenantID, resizeResources(oldVCPUs, oldMemMB)...)
+}
+
+// instanceResized completes the resize of an instance restarted with its
+// new requirements.
+func (c *controller) instanceResized(event payloads.InstanceResizedEvent) {
+	p, ok := c.resizes.remove(event.InstanceUUID)
+	if !ok {
+		c.log.Warningf("Unexpected resize of instance %s by node %s", event.InstanceUUID, event.NodeUUID)
+		return
+	}
+
+	log := clogger.With(c.log, "tenant", p.tenantID, "instance", event.InstanceUUID)
+
+	msg := fmt.Sprintf("Instance %s resized to %d vcpus and %d MB of memory", event.InstanceUUID, p.vcpus, p.memMB)
+	log.Infof("%s", msg)
+	if err := c.ds.LogEvent(p.tenantID, msg); err != nil {
+		log.Warningf("Error logging event: %v", err)
+	}
+
+	c.publishEvent(types.InstanceResizedEvent, p.tenantID, msg, map[string]string{
+		"instance": event.InstanceUUID,
+		"vcpus":    strconv.Itoa(p.vcpus),
+		"mem_mb":   strconv.Itoa(p.memMB),
+	})
+}
+
+// resizeFailure rolls back the resize of an instance which its node was
+// unable to carry out.
+func (c *controller) resizeFailure(failure payloads.ErrorResizeFailure) {
+	c.resizeFailed(failure.InstanceUUID, fmt.Sprintf("node %s: %s", failure.NodeUUID, failure.Reason.String()))
+}
+
+// resizeFailed restores the requirements an instance ran with before it
+// was resized and the reservation of its tenant.  The instance may have
+// been deleted in the meantime, in which case its resources have already
+// been released.
+func (c *controller) resizeFailed(instanceID string, reason string) {
+	p, ok := c.resizes.remove(instanceID)
+	if !ok {
+		c.log.Warningf("Resize failure for instance %s which is not being resized: %s", instanceID, reason)
+		return
+	}
+
+	log := clogger.With(c.log, "tenant", p.tenantID, "instance", instanceID)
+
+	err := c.ds.UpdateInstanceRequirements(instanceID, p.oldVCPUs, p.oldMemMB)
+	if err != nil {
+		log.Warningf("Unable to restore requirements: %v", err)
+		return
+	}
+
+	c.swapResizeQuota(p.tenantID, p.vcpus, p.memMB, p.oldVCPUs, p.oldMemMB)
+
+	msg := fmt.Sprintf("Resize of instance %s to %d vcpus and %d MB of memory failed: %s",
+		instanceID, p.vcpus, p.memMB, reason)
+	log.Warningf("%s", msg)
+	if err := c.ds.LogError(p.tenantID, msg); err != nil {
+		log.Warningf("Error logging error: %v", err)
+	}
+
+	c.publishEvent(types.InstanceResizeFailedEvent, p.tenantID, msg, map[string]string{
+		"instance": instanceID,
+		"reason":   reason,
+	})
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// startResizeTestInstance starts an instance and returns it together with
+// the requirements it runs with.
+func startResizeTestInstance(t *testing.T) (*testutil.SsntpTestClient, *types.Instance, payloads.WorkloadRequirements) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	sendStatsCmd(client, t)
+
+	i, err := ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.State != payloads.Running {
+		t.Fatalf("Expected instance running, got %s", i.State)
+	}
+
+	wl, err := ctl.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, i, instanceRequirements(i, &wl)
+}
+
+func quotaUsage(tenantID string, name string) int {
+	for _, qd := range ctl.qs.DumpQuotas(tenantID) {
+		if qd.Name == name {
+			return qd.Usage
+		}
+	}
+	return 0
+}
+
+func checkInstanceRequirements(t *testing.T, instanceID string, vcpus int, memMB int) {
+	i, err := ctl.ds.GetInstance(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.VCPUs != vcpus || i.MemMB != memMB {
+		t.Fatalf("Expected %d vcpus and %d MB, got %d vcpus and %d MB", vcpus, memMB, i.VCPUs, i.MemMB)
+	}
+}
+
+func TestResizeInstance(t *testing.T) {
+	client, i, reqs := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vcpuUsage := quotaUsage(i.TenantID, "tenant-vcpu-quota")
+	memUsage := quotaUsage(i.TenantID, "tenant-mem-quota")
+
+	resizeCh := client.AddCmdChan(ssntp.ResizeInstance)
+	resizedCh := wrappedClient.addEventChan(ssntp.InstanceResized)
+
+	b, err := json.Marshal(types.InstanceResizeRequest{
+		Resize: types.InstanceResizeTarget{VCPUs: reqs.VCPUs + 2, MemMB: reqs.MemMB * 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + i.TenantID + "/instances/" + i.ID + "/action"
+	_ = testHTTPRequest(t, "POST", url, http.StatusAccepted, b, true)
+
+	result, err := client.GetCmdChanResult(resizeCh, ssntp.ResizeInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != i.ID {
+		t.Fatalf("Instance %s resized instead of %s", result.InstanceUUID, i.ID)
+	}
+
+	err = wrappedClient.getEventChan(resizedCh, ssntp.InstanceResized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkInstanceRequirements(t, i.ID, reqs.VCPUs+2, reqs.MemMB*2)
+
+	if usage := quotaUsage(i.TenantID, "tenant-vcpu-quota"); usage != vcpuUsage+2 {
+		t.Fatalf("Expected vcpu usage of %d, got %d", vcpuUsage+2, usage)
+	}
+	if usage := quotaUsage(i.TenantID, "tenant-mem-quota"); usage != memUsage+reqs.MemMB {
+		t.Fatalf("Expected memory usage of %d, got %d", memUsage+reqs.MemMB, usage)
+	}
+
+	// the instance may not shrink below the requirements of its workload
+	b, err = json.Marshal(types.InstanceResizeRequest{
+		Resize: types.InstanceResizeTarget{VCPUs: reqs.VCPUs - 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHTTPRequest(t, "POST", url, http.StatusBadRequest, b, true)
+
+	checkInstanceRequirements(t, i.ID, reqs.VCPUs+2, reqs.MemMB*2)
+}
+
+func TestResizeInstanceFailure(t *testing.T) {
+	client, i, reqs := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vcpuUsage := quotaUsage(i.TenantID, "tenant-vcpu-quota")
+	memUsage := quotaUsage(i.TenantID, "tenant-mem-quota")
+
+	client.ResizeFail = true
+	client.ResizeFailReason = payloads.ResizeRestartFailure
+
+	failureCh := wrappedClient.addErrorChan(ssntp.ResizeFailure)
+
+	err := ctl.ResizeInstance(i.TenantID, i.ID, reqs.VCPUs+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.ResizeInstance(i.TenantID, i.ID, reqs.VCPUs+2, 0)
+	if err != types.ErrInstanceResizing {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceResizing, err)
+	}
+
+	err = wrappedClient.getErrorChan(failureCh, ssntp.ResizeFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkInstanceRequirements(t, i.ID, reqs.VCPUs, reqs.MemMB)
+
+	if usage := quotaUsage(i.TenantID, "tenant-vcpu-quota"); usage != vcpuUsage {
+		t.Fatalf("Expected vcpu usage of %d, got %d", vcpuUsage, usage)
+	}
+	if usage := quotaUsage(i.TenantID, "tenant-mem-quota"); usage != memUsage {
+		t.Fatalf("Expected memory usage of %d, got %d", memUsage, usage)
+	}
+}
+
+func TestResizeInstanceOverQuota(t *testing.T) {
+	client, i, reqs := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vcpuUsage := quotaUsage(i.TenantID, "tenant-vcpu-quota")
+
+	ctl.qs.Update(i.TenantID, []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: vcpuUsage},
+	})
+	defer ctl.qs.Update(i.TenantID, []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: -1},
+	})
+
+	err := ctl.ResizeInstance(i.TenantID, i.ID, reqs.VCPUs+1, 0)
+	if err != types.ErrQuota {
+		t.Fatalf("Expected %v, got %v", types.ErrQuota, err)
+	}
+
+	checkInstanceRequirements(t, i.ID, reqs.VCPUs, reqs.MemMB)
+
+	if usage := quotaUsage(i.TenantID, "tenant-vcpu-quota"); usage != vcpuUsage {
+		t.Fatalf("Expected vcpu usage of %d, got %d", vcpuUsage, usage)
+	}
+
+	err = ctl.ResizeInstance(i.TenantID, i.ID, reqs.VCPUs, reqs.MemMB)
+	if err != types.ErrBadResize {
+		t.Fatalf("Expected %v, got %v", types.ErrBadResize, err)
+	}
+}
@@ -17,16 +17,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/service"
-	"github.com/golang/glog"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 )
@@ -34,28 +34,185 @@ import (
 type clientCertAuthHandler struct {
 	Controller *controller
 	Next       http.Handler
+
+	// Workload is set for the routes which accept workload definitions,
+	// whose bodies are bounded by workload_body_limit_kb rather than
+	// api_body_limit_kb.
+	Workload bool
+
+	// Scope is the resource group an API key needs to be used for the
+	// route, or empty if API keys may not be used for it.
+	Scope string
+
+	// Stream is set for the event stream routes, whose requests last
+	// as long as the client follows the stream rather than being
+	// bounded by api_request_timeout.
+	Stream bool
+
+	// Admin is set for the routes which only admins may use, which are
+	// refused to tenant users whatever tenant they belong to.
+	Admin bool
+
+	// Exchange is set for the route issuing tokens, which any user may
+	// use with a client certificate but not with a token or API key.
+	Exchange bool
 }
 
-func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if len(r.TLS.VerifiedChains) != 1 {
-		http.Error(w, "Unexpected number of certificate chains presented", http.StatusUnauthorized)
-		return
+// bodyLimit returns the maximum size in bytes of the body of a request to
+// the route.
+func (h *clientCertAuthHandler) bodyLimit() int64 {
+	cfg := h.Controller.config.config()
+	if h.Workload {
+		return int64(cfg.WorkloadBodyLimit) * 1024
 	}
+	return int64(cfg.APIBodyLimit) * 1024
+}
+
+func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := uuid.Generate().String()
+	w.Header().Set(api.RequestIDHeader, requestID)
+	r = r.WithContext(service.SetRequestID(r.Context(), requestID))
 
-	certs := r.TLS.VerifiedChains[0]
-	cert := certs[0]
-	tenants := cert.Subject.Organization
+	// mutating requests are audited whatever their outcome, including
+	// those refused by the checks below.
+	if !readOnlyRequest(r) {
+		audit := h.Controller.newAuditRecorder(w, r)
+		w = audit
+		defer func() { h.Controller.auditRequest(r, audit) }()
+	}
 
+	var tenants []string
+	var actor, client string
 	privileged := false
-	if len(tenants) == 1 && tenants[0] == "admin" {
-		privileged = true
+
+	bearer, hasBearer := bearerToken(r)
+	hasBearer = hasBearer && len(r.TLS.VerifiedChains) == 0
+
+	if hasBearer && isToken(bearer) {
+		token, err := h.Controller.authenticateToken(bearer)
+		if err == types.ErrAuthTokensDisabled {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if h.Exchange {
+			http.Error(w, "Tokens may only be obtained with a client certificate", http.StatusForbidden)
+			return
+		}
+
+		privileged = token.Role == tokenRoleAdmin
+		if !privileged {
+			tenants = []string{token.TenantID}
+		}
+		actor = "token/" + token.ID
+		client = token.Subject
+		r = r.WithContext(service.SetPrivilege(r.Context(), privileged))
+	} else if hasBearer {
+		key, err := h.Controller.authenticateAPIKey(bearer)
+		if err != nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if h.Scope == "" {
+			http.Error(w, "API keys may only be used for tenant resources", http.StatusForbidden)
+			return
+		}
+
+		if !key.HasScope(h.Scope) {
+			http.Error(w, "API key does not have scope "+h.Scope, http.StatusForbidden)
+			return
+		}
+
+		tenants = []string{key.TenantID}
+		actor = "api-key/" + key.ID
+		client = actor
+		r = r.WithContext(service.SetPrivilege(r.Context(), false))
+	} else {
+		if len(r.TLS.VerifiedChains) != 1 {
+			http.Error(w, "Unexpected number of certificate chains presented", http.StatusUnauthorized)
+			return
+		}
+
+		certs := r.TLS.VerifiedChains[0]
+		cert := certs[0]
+		admin, roleTenants := certRoles(cert, h.Controller.config.config().CertRoleAttribute)
+		tenants = roleTenants
+
+		caTenant, trusted := h.Controller.certTenant(certs)
+		if !trusted {
+			http.Error(w, "Certificate authority no longer trusted", http.StatusUnauthorized)
+			return
+		}
+
+		if caTenant != "" {
+			// a tenant CA only vouches for the users of its own tenant
+			if admin {
+				http.Error(w, "Certificate claims role not permitted by its CA", http.StatusUnauthorized)
+				return
+			}
+			for i := range tenants {
+				if tenants[i] != caTenant {
+					http.Error(w, "Certificate claims tenant not permitted by its CA", http.StatusUnauthorized)
+					return
+				}
+			}
+			tenants = []string{caTenant}
+		} else {
+			privileged = admin
+		}
+
+		actor = cert.Subject.CommonName
+		client = actor
+		r = r.WithContext(service.SetPrivilege(r.Context(), privileged))
 	}
 
-	r = r.WithContext(service.SetPrivilege(r.Context(), true))
+	r = r.WithContext(service.SetActor(r.Context(), actor))
+
+	// admins are not rate limited, even when acting on behalf of a tenant
+	admin := privileged
+
+	onBehalfOf := r.Header.Get(api.OnBehalfOfHeader)
+	if onBehalfOf != "" {
+		if !privileged {
+			http.Error(w, "Only admins may act on behalf of a tenant", http.StatusForbidden)
+			return
+		}
+
+		if !h.Controller.config.config().Impersonation {
+			http.Error(w, "Acting on behalf of tenants is disabled", http.StatusForbidden)
+			return
+		}
+
+		tenant, err := h.Controller.ds.GetTenant(onBehalfOf)
+		if err != nil || tenant == nil {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		}
+
+		// the request is executed with the scope of the tenant
+		privileged = false
+		tenants = []string{onBehalfOf}
+		r = r.WithContext(service.SetPrivilege(r.Context(), false))
+		r = r.WithContext(service.SetOnBehalfOf(r.Context(), onBehalfOf))
+
+		h.Controller.log.Infof("%s acting on behalf of tenant %s: %s %s",
+			actor, onBehalfOf, r.Method, r.URL.Path)
+	}
+
+	r = r.WithContext(service.SetTenants(r.Context(), tenants))
+
+	if h.Admin && !privileged {
+		http.Error(w, "Access to route requires the admin role", http.StatusForbidden)
+		return
+	}
 
 	vars := mux.Vars(r)
 	tenantFromVars := vars["tenant"]
-	if !privileged {
+	if !privileged && !h.Exchange {
 		tenantMatched := false
 		for i := range tenants {
 			if tenants[i] == tenantFromVars {
@@ -64,38 +221,149 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 			}
 		}
 		if !tenantMatched {
-			http.Error(w, "Access to tenant not permitted with certificate", http.StatusUnauthorized)
+			http.Error(w, "Access to tenant not permitted with credentials", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !admin {
+		class, rate, burst := rateClass(h.Controller.config.config(), r)
+		if ok, wait := h.Controller.rateLimits.allow(client, class, rate, burst, time.Now()); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
 	}
 
 	r = r.WithContext(service.SetTenantID(r.Context(), tenantFromVars))
-	if tenantFromVars != "" {
+
+	// Only the active controller may create the tenant
+	if tenantFromVars != "" && h.Controller.isActive() {
 		err := h.Controller.confirmTenant(tenantFromVars)
 		if err != nil {
 			http.Error(w, "Error confirming tenant", http.StatusInternalServerError)
 		}
 	}
 
-	h.Next.ServeHTTP(w, r)
+	// a frozen tenant's resources may be read but not changed
+	if tenantFromVars != "" && !readOnlyRequest(r) {
+		if frozen, reason := h.Controller.ds.TenantFrozen(tenantFromVars); frozen {
+			http.Error(w, "Tenant is frozen: "+reason, http.StatusLocked)
+			return
+		}
+	}
+
+	// bodies which are too large are rejected as they are read rather
+	// than being buffered first.
+	limit := h.bodyLimit()
+	if r.ContentLength > limit {
+		http.Error(w, api.BodyTooLargeError(limit).Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	// the work done for the request is abandoned when the client goes
+	// away or the request runs out of time.
+	if timeout := h.Controller.config.config().APIRequestTimeout; timeout > 0 && !h.Stream {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	key := r.Header.Get(api.IdempotencyKeyHeader)
+	if key != "" && idempotentRequest(r) {
+		// a replayed response does not repeat the action
+		if h.Controller.serveIdempotent(rec, r, key, h.Next) {
+			return
+		}
+	} else {
+		h.Next.ServeHTTP(rec, r)
+	}
+
+	h.Controller.logAction(r, rec.status)
+}
+
+// readOnlyRequest returns true if r cannot change any state.
+func readOnlyRequest(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
 }
 
 func (c *controller) createCiaoRoutes(r *mux.Router) error {
-	config := api.Config{URL: c.apiURL, CiaoService: c}
+	config := api.Config{URL: c.apiURL, CiaoService: c, Log: c.log}
 
 	r = api.Routes(config, r)
 
+	r.HandleFunc("/metrics", c.serveMetrics).Methods("GET")
+
 	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
 		h := &clientCertAuthHandler{
 			Next:       route.GetHandler(),
 			Controller: c,
+			Workload:   strings.Contains(path, "/workloads"),
+			Scope:      apiKeyScope(path),
+			Stream:     streamPath(path),
+			Admin:      adminRoute(route.GetHandler(), path),
 		}
+		_, h.Exchange = route.GetHandler().(tokenExchangeHandler)
 		route.Handler(h)
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	// signed URLs are the only routes which do not require a client
+	// certificate.
+	r.HandleFunc("/signed/{resource}/{id}", c.serveSignedURL).Methods("GET")
 
-	return err
+	return nil
+}
+
+// serverCertState holds the certificate presented by the API servers.  It
+// is looked up on each handshake so that a certificate replaced through
+// the cluster configuration applies to new connections immediately.
+type serverCertState struct {
+	sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// loadServerCert loads the certificate presented by the API servers.  If
+// the certificate cannot be loaded the previous one is kept.
+func (c *controller) loadServerCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return errors.Wrap(err, "Error loading server certificate")
+	}
+
+	c.serverCert.Lock()
+	c.serverCert.cert = &cert
+	c.serverCert.certFile = certFile
+	c.serverCert.keyFile = keyFile
+	c.serverCert.Unlock()
+
+	return nil
+}
+
+// serverCertificate is the GetCertificate callback of the API servers.
+func (c *controller) serverCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.serverCert.RLock()
+	defer c.serverCert.RUnlock()
+
+	if c.serverCert.cert == nil {
+		return nil, errors.New("No server certificate loaded")
+	}
+
+	return c.serverCert.cert, nil
 }
 
 func (c *controller) createCiaoServer() (*http.Server, error) {
@@ -104,24 +372,24 @@ func (c *controller) createCiaoServer() (*http.Server, error) {
 	addr := fmt.Sprintf(":%d", controllerAPIPort)
 
 	server := &http.Server{
-		Handler: r,
-		Addr:    addr,
+		Handler: &metricsHandler{
+			Controller: c,
+			Router:     r,
+			Next:       &leaderHandler{Controller: c, Next: r},
+		},
+		Addr: addr,
 	}
 
-	clientCertCAbytes, err := ioutil.ReadFile(clientCertCAPath)
+	err := c.loadClientCAs(clientCertCAPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error loading client cert CA")
-	}
-	certPool := x509.NewCertPool()
-	ok := certPool.AppendCertsFromPEM(clientCertCAbytes)
-	if !ok {
-		return nil, errors.New("Error importing client auth CA to poool")
+		return nil, err
 	}
-	tlsConfig := tls.Config{
-		ClientAuth: tls.RequireAndVerifyClientCert,
-		ClientCAs:  certPool,
+
+	err = c.loadServerCert(httpsCAcert, httpsKey)
+	if err != nil {
+		return nil, err
 	}
-	server.TLSConfig = &tlsConfig
+	server.TLSConfig = c.clientCATLSConfig()
 
 	if err := c.createComputeRoutes(r); err != nil {
 		return nil, errors.Wrap(err, "Error adding compute routes")
@@ -136,16 +404,20 @@ func (c *controller) createCiaoServer() (*http.Server, error) {
 }
 
 func (c *controller) ShutdownHTTPServers() {
-	glog.Warning("Shutting down HTTP servers")
+	c.log.Warningf("Shutting down HTTP servers")
 	var wg sync.WaitGroup
-	for _, server := range c.httpServers {
+	servers := append([]*http.Server(nil), c.httpServers...)
+	if c.metricsServer != nil {
+		servers = append(servers, c.metricsServer)
+	}
+	for _, server := range servers {
 		wg.Add(1)
 		go func(server *http.Server) {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 			defer cancel()
 			err := server.Shutdown(ctx)
 			if err != nil {
-				glog.Errorf("Error during HTTP server shutdown")
+				c.log.Errorf("Error during HTTP server shutdown: %v", err)
 			}
 			wg.Done()
 		}(server)
@@ -0,0 +1,192 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// server group names follow the rules for instance names.
+var serverGroupNameRegexp = regexp.MustCompile("^[a-z0-9-]{1,64}$")
+
+// placement constrains the nodes on which an instance is started.  The
+// scheduler prefers the preferred nodes, if any of them has room for the
+// instance, and never picks one of the nodes to avoid.
+type placement struct {
+	preferred []string
+	avoid     []string
+}
+
+// ListServerGroups returns the server groups of a tenant.
+func (c *controller) ListServerGroups(tenantID string) ([]types.ServerGroup, error) {
+	return c.ds.GetServerGroups(tenantID), nil
+}
+
+// CreateServerGroup validates and stores a new, empty server group.
+func (c *controller) CreateServerGroup(tenantID string, req types.ServerGroupRequest) (types.ServerGroup, error) {
+	if !serverGroupNameRegexp.MatchString(req.Name) {
+		return types.ServerGroup{}, types.ErrBadName
+	}
+
+	if req.Policy != types.ServerGroupAffinity && req.Policy != types.ServerGroupAntiAffinity {
+		return types.ServerGroup{}, types.ErrBadServerGroup
+	}
+
+	g := types.ServerGroup{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		Name:       req.Name,
+		Policy:     req.Policy,
+		Soft:       req.Soft,
+		Members:    []string{},
+		CreateTime: time.Now(),
+	}
+
+	if err := c.ds.AddServerGroup(g); err != nil {
+		return types.ServerGroup{}, err
+	}
+
+	return g, nil
+}
+
+// ShowServerGroup returns a server group of a tenant.
+func (c *controller) ShowServerGroup(tenantID string, ID string) (types.ServerGroup, error) {
+	return c.ds.GetServerGroup(tenantID, ID)
+}
+
+// DeleteServerGroup removes a server group.  Its members keep running but
+// are no longer placed by the group's policy.
+func (c *controller) DeleteServerGroup(tenantID string, ID string) error {
+	return c.ds.DeleteServerGroup(tenantID, ID)
+}
+
+// readyComputeNodes returns the set of compute nodes on which instances
+// may currently be started.
+func (c *controller) readyComputeNodes() map[string]bool {
+	nodes := make(map[string]bool)
+
+	for _, n := range c.ds.GetNodeLastStats().Nodes {
+		if n.Status != string(types.NodeStatusReady) || c.ds.NodeInMaintenance(n.ID) {
+			continue
+		}
+
+		node, err := c.ds.GetNode(n.ID)
+		if err != nil || !node.NodeRole.IsAgent() {
+			continue
+		}
+
+		nodes[n.ID] = true
+	}
+
+	return nodes
+}
+
+// sortedNodes returns the IDs of a set of nodes in order.
+func sortedNodes(set map[string]bool) []string {
+	var nodes []string
+	for nodeID := range set {
+		nodes = append(nodes, nodeID)
+	}
+
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// serverGroupPlacement returns the placement of the instances of wl which
+// are to join a server group, given the nodes on which the members of the
+// group have been placed.  A hard affinity policy pins the instances to
+// the node of the oldest placed member, by setting the node requirement of
+// wl, and a hard anti-affinity policy keeps them off the nodes of the
+// members.  A launch which cannot satisfy a hard policy is rejected.
+// Soft policies only set the preferred nodes.
+//
+// Members which have not been placed yet, including the other instances
+// of the launch, do not constrain the placement other than by being
+// counted against the nodes free of members for a hard anti-affinity
+// policy.
+func (c *controller) serverGroupPlacement(g types.ServerGroup, wl *types.Workload, instances int) (placement, error) {
+	var p placement
+
+	memberNodes := make(map[string]bool)
+	var firstNode string
+	unplaced := 0
+	for _, ID := range g.Members {
+		i, err := c.ds.GetInstance(ID)
+		if err != nil {
+			continue
+		}
+
+		if i.NodeID == "" {
+			unplaced++
+			continue
+		}
+
+		if firstNode == "" {
+			firstNode = i.NodeID
+		}
+		memberNodes[i.NodeID] = true
+	}
+
+	conflict := launchFailure(types.LaunchPlacementConflict,
+		fmt.Errorf("No node satisfies the %s policy of server group %s", g.Policy, g.Name))
+
+	ready := c.readyComputeNodes()
+
+	switch g.Policy {
+	case types.ServerGroupAffinity:
+		if firstNode == "" {
+			return p, nil
+		}
+
+		if g.Soft {
+			p.preferred = sortedNodes(memberNodes)
+			return p, nil
+		}
+
+		if !ready[firstNode] || (wl.Requirements.NodeID != "" && wl.Requirements.NodeID != firstNode) {
+			return p, conflict
+		}
+		wl.Requirements.NodeID = firstNode
+
+	case types.ServerGroupAntiAffinity:
+		free := make(map[string]bool)
+		for nodeID := range ready {
+			if !memberNodes[nodeID] {
+				free[nodeID] = true
+			}
+		}
+
+		if g.Soft {
+			if len(memberNodes) > 0 && len(free) > 0 {
+				p.preferred = sortedNodes(free)
+			}
+			return p, nil
+		}
+
+		if len(free) < instances+unplaced {
+			return p, conflict
+		}
+		p.avoid = sortedNodes(memberNodes)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestServerGroups(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.CreateServerGroup(tenant.ID, types.ServerGroupRequest{Name: "web", Policy: "spread"})
+	if err != types.ErrBadServerGroup {
+		t.Fatalf("Expected ErrBadServerGroup, got %v", err)
+	}
+
+	_, err = ctl.CreateServerGroup(tenant.ID, types.ServerGroupRequest{Name: "Web Servers", Policy: types.ServerGroupAffinity})
+	if err != types.ErrBadName {
+		t.Fatalf("Expected ErrBadName, got %v", err)
+	}
+
+	g, err := ctl.CreateServerGroup(tenant.ID, types.ServerGroupRequest{Name: "web", Policy: types.ServerGroupAntiAffinity, Soft: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := ctl.ListServerGroups(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 || groups[0].ID != g.ID || !groups[0].Soft || len(groups[0].Members) != 0 {
+		t.Fatalf("Unexpected server groups %+v", groups)
+	}
+
+	// groups are private to their tenant
+	if _, err := ctl.ShowServerGroup(testutil.ComputeUser, g.ID); err != types.ErrServerGroupNotFound {
+		t.Fatalf("Expected ErrServerGroupNotFound, got %v", err)
+	}
+
+	err = ctl.DeleteServerGroup(tenant.ID, g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ctl.ShowServerGroup(tenant.ID, g.ID); err != types.ErrServerGroupNotFound {
+		t.Fatalf("Expected ErrServerGroupNotFound, got %v", err)
+	}
+}
+
+// startServerGroupInstance launches an instance which joins a server group
+// and waits for it to be placed on the test agent expected to start it.
+func startServerGroupInstance(t *testing.T, client *testutil.SsntpTestClient, tenantID string, groupID string) *types.Instance {
+	wls, err := ctl.ds.GetWorkloads(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+
+	instances, err := ctl.startWorkload(context.Background(), types.WorkloadRequest{
+		WorkloadID:  wls[0].ID,
+		TenantID:    tenantID,
+		Instances:   1,
+		ServerGroup: groupID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendStatsCmd(client, t)
+
+	i, err := ctl.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.NodeID != client.UUID {
+		t.Fatalf("Expected instance on %s, got %q", client.UUID, i.NodeID)
+	}
+
+	return i
+}
+
+func TestServerGroupPlacement(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := testutil.NewSsntpTestClientConnection("ServerGroup", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	ctl.ds.AddNode(client.UUID, payloads.ComputeNode)
+	sendStatsCmd(client, t)
+
+	anti, err := ctl.CreateServerGroup(tenant.ID, types.ServerGroupRequest{Name: "anti", Policy: types.ServerGroupAntiAffinity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	affinity, err := ctl.CreateServerGroup(tenant.ID, types.ServerGroupRequest{Name: "affinity", Policy: types.ServerGroupAffinity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first members are placed freely
+	i := startServerGroupInstance(t, client, tenant.ID, anti.ID)
+	j := startServerGroupInstance(t, client, tenant.ID, affinity.ID)
+
+	anti, err = ctl.ShowServerGroup(tenant.ID, anti.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(anti.Members, []string{i.ID}) {
+		t.Fatalf("Expected instance %s to join group, got members %v", i.ID, anti.Members)
+	}
+
+	affinity, err = ctl.ShowServerGroup(tenant.ID, affinity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ctl.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the members of a group with a hard affinity policy follow the first
+	pinned := wl
+	_, err = ctl.serverGroupPlacement(affinity, &pinned, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned.Requirements.NodeID != client.UUID {
+		t.Fatalf("Expected instances pinned to %s, got %q", client.UUID, pinned.Requirements.NodeID)
+	}
+
+	// a second node, free of members of the groups
+	other := addMigrationTestAgent(t)
+	defer other.Shutdown()
+
+	p, err := ctl.serverGroupPlacement(anti, &wl, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p.avoid, []string{client.UUID}) || p.preferred != nil {
+		t.Fatalf("Expected node %s to be avoided, got %+v", client.UUID, p)
+	}
+
+	// a soft policy only prefers the nodes free of members
+	soft := anti
+	soft.Soft = true
+	p, err = ctl.serverGroupPlacement(soft, &wl, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.avoid != nil || len(p.preferred) == 0 {
+		t.Fatalf("Expected soft anti-affinity to prefer free nodes, got %+v", p)
+	}
+
+	for _, nodeID := range p.preferred {
+		if nodeID == client.UUID {
+			t.Fatalf("Node %s of member preferred: %v", nodeID, p.preferred)
+		}
+	}
+
+	// the nodes to avoid are passed to the scheduler in the start payload
+	k := startServerGroupInstance(t, other, tenant.ID, anti.ID)
+
+	config, err := ctl.ds.GetLaunchConfig(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	launched, err := splitConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sc payloads.Start
+	err = yaml.Unmarshal([]byte(launched.start), &sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sc.Start.AvoidNodes, []string{client.UUID}) {
+		t.Fatalf("Expected node %s avoided in start payload, got %v", client.UUID, sc.Start.AvoidNodes)
+	}
+
+	// a hard policy rejects launches it cannot satisfy
+	anti, err = ctl.ShowServerGroup(tenant.ID, anti.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := len(ctl.readyComputeNodes())
+	_, err = ctl.launchInstances(context.Background(), types.WorkloadRequest{
+		WorkloadID:  wl.ID,
+		TenantID:    tenant.ID,
+		Instances:   ready - 1,
+		ServerGroup: anti.ID,
+	})
+	if e, ok := errors.Cause(err).(*types.LaunchError); !ok || e.Code != types.LaunchPlacementConflict {
+		t.Fatalf("Expected placement conflict launching %d instances, got %v", ready-1, err)
+	}
+
+	// members leave their group when deleted
+	for _, ID := range []string{i.ID, j.ID, k.ID} {
+		err = ctl.ds.DeleteInstance(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ID := range []string{anti.ID, affinity.ID} {
+		g, err := ctl.ShowServerGroup(tenant.ID, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(g.Members) != 0 {
+			t.Fatalf("Deleted instances still members of %s: %v", g.Name, g.Members)
+		}
+	}
+}
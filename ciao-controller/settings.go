@@ -0,0 +1,429 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+)
+
+// The cluster settings which the admin can change while the controller is
+// running.  They share the names of the configuration file keys from which
+// their defaults are taken.
+const (
+	settingPendingInstanceTimeout = "pending_instance_timeout"
+	settingNodeSuspectTimeout     = "node_suspect_timeout"
+	settingNodeDownTimeout        = "node_down_timeout"
+	settingNodeRecoveryPeriod     = "node_recovery_period"
+	settingClockSkewThreshold     = "clock_skew_threshold"
+	settingOperationRetention     = "operation_retention"
+	settingIdempotencyRetention   = "idempotency_retention"
+	settingTrashRetention         = "trash_retention"
+	settingWebhookMaxAttempts     = "webhook_max_attempts"
+	settingWebhookBackoff         = "webhook_backoff"
+	settingWebhookTimeout         = "webhook_timeout"
+	settingCNCIPoolEnabled        = "cnci_pool_enabled"
+	settingCNCIPoolSize           = "cnci_pool_size"
+	settingCNCIPoolConcurrency    = "cnci_pool_refill_concurrency"
+	settingCNCIPoolClaimTimeout   = "cnci_pool_claim_timeout"
+	settingCNCIHeartbeatTimeout   = "cnci_heartbeat_timeout"
+	settingCNCIFailoverBackoff    = "cnci_failover_backoff"
+	settingTenantLaunchLimit      = "tenant_launch_limit"
+	settingTenantLaunchQueue      = "tenant_launch_queue"
+	settingPreferSeededNodes      = "prefer_seeded_nodes"
+)
+
+// settingDef describes a cluster setting.  Values are held as int64s,
+// durations in nanoseconds and booleans as 0 or 1, and must lie within
+// [min, max].
+type settingDef struct {
+	typ         types.SettingType
+	description string
+	min         int64
+	max         int64
+	def         func(cfg controllerConfig) int64
+}
+
+var settingDefs = map[string]settingDef{
+	settingPendingInstanceTimeout: {
+		types.SettingDuration, "Time after which pending instances are reported, 0 to disable",
+		0, int64(24 * time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.PendingInstanceTimeout) },
+	},
+	settingNodeSuspectTimeout: {
+		types.SettingDuration, "Time without stats after which a node is suspect",
+		int64(time.Second), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.NodeSuspectTimeout) },
+	},
+	settingNodeDownTimeout: {
+		types.SettingDuration, "Time without stats after which a node is down",
+		int64(time.Second), int64(24 * time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.NodeDownTimeout) },
+	},
+	settingNodeRecoveryPeriod: {
+		types.SettingDuration, "Time a node must send stats before it is ready again",
+		int64(time.Second), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.NodeRecoveryPeriod) },
+	},
+	settingClockSkewThreshold: {
+		types.SettingDuration, "Clock offset from the controller beyond which a node's clock is reported as skewed",
+		int64(10 * time.Millisecond), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.ClockSkewThreshold) },
+	},
+	settingOperationRetention: {
+		types.SettingDuration, "Time completed operations are kept",
+		int64(time.Minute), int64(365 * 24 * time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.OperationRetention) },
+	},
+	settingIdempotencyRetention: {
+		types.SettingDuration, "Time responses to idempotent requests are kept",
+		int64(time.Minute), int64(365 * 24 * time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.IdempotencyRetention) },
+	},
+	settingTrashRetention: {
+		types.SettingDuration, "Time deleted instances and volumes are kept in the trash, 0 to delete immediately",
+		0, int64(365 * 24 * time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.TrashRetention) },
+	},
+	settingWebhookMaxAttempts: {
+		types.SettingInt, "Number of attempts made to deliver an event to a webhook",
+		1, 100,
+		func(cfg controllerConfig) int64 { return int64(cfg.WebhookMaxAttempts) },
+	},
+	settingWebhookBackoff: {
+		types.SettingDuration, "Initial delay between attempts to deliver an event to a webhook",
+		int64(time.Millisecond), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.WebhookBackoff) },
+	},
+	settingWebhookTimeout: {
+		types.SettingDuration, "Time allowed for a webhook to accept an event",
+		int64(time.Millisecond), int64(10 * time.Minute),
+		func(cfg controllerConfig) int64 { return int64(cfg.WebhookTimeout) },
+	},
+	settingCNCIPoolEnabled: {
+		types.SettingBool, "Whether CNCIs are launched ahead of demand for new tenant subnets",
+		0, 1,
+		func(cfg controllerConfig) int64 { return boolToSetting(cfg.CNCIPoolEnabled) },
+	},
+	settingCNCIPoolSize: {
+		types.SettingInt, "Number of unassigned CNCIs kept in the CNCI pool",
+		0, 64,
+		func(cfg controllerConfig) int64 { return int64(cfg.CNCIPoolSize) },
+	},
+	settingCNCIPoolConcurrency: {
+		types.SettingInt, "Number of CNCIs launched at a time to refill the CNCI pool",
+		1, 16,
+		func(cfg controllerConfig) int64 { return int64(cfg.CNCIPoolRefillConcurrency) },
+	},
+	settingCNCIPoolClaimTimeout: {
+		types.SettingDuration, "Time after which a pooled CNCI claimed but not configured for a subnet is recycled",
+		int64(time.Second), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.CNCIPoolClaimTimeout) },
+	},
+	settingCNCIHeartbeatTimeout: {
+		types.SettingDuration, "Time a tenant CNCI may go without being reported running before it is replaced",
+		int64(time.Second), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.CNCIHeartbeatTimeout) },
+	},
+	settingCNCIFailoverBackoff: {
+		types.SettingDuration, "Initial delay before the CNCI of a subnet is replaced again, doubled for each replacement",
+		int64(time.Second), int64(time.Hour),
+		func(cfg controllerConfig) int64 { return int64(cfg.CNCIFailoverBackoff) },
+	},
+	settingTenantLaunchLimit: {
+		types.SettingInt, "Number of launches a tenant may have pending at once, 0 for no limit",
+		0, 100000,
+		func(cfg controllerConfig) int64 { return int64(cfg.TenantLaunchLimit) },
+	},
+	settingTenantLaunchQueue: {
+		types.SettingBool, "Whether launches beyond the tenant launch limit are queued rather than rejected",
+		0, 1,
+		func(cfg controllerConfig) int64 { return boolToSetting(cfg.TenantLaunchQueue) },
+	},
+	settingPreferSeededNodes: {
+		types.SettingBool, "Whether instances are preferably launched on nodes which have cached their image",
+		0, 1,
+		func(cfg controllerConfig) int64 { return boolToSetting(cfg.PreferSeededNodes) },
+	},
+}
+
+func boolToSetting(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (d settingDef) format(v int64) string {
+	switch d.typ {
+	case types.SettingDuration:
+		return time.Duration(v).String()
+	case types.SettingBool:
+		return strconv.FormatBool(v != 0)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func (d settingDef) parse(key string, value string) (int64, error) {
+	var v int64
+	var err error
+
+	switch d.typ {
+	case types.SettingDuration:
+		var dur time.Duration
+		dur, err = time.ParseDuration(value)
+		v = int64(dur)
+	case types.SettingBool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		v = boolToSetting(b)
+	default:
+		v, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err != nil {
+		return 0, &types.SettingValueError{Key: key, Reason: fmt.Sprintf("not a valid %s: %s", d.typ, value)}
+	}
+
+	if v < d.min || v > d.max {
+		return 0, &types.SettingValueError{
+			Key:    key,
+			Reason: fmt.Sprintf("%s is not between %s and %s", value, d.format(d.min), d.format(d.max)),
+		}
+	}
+
+	return v, nil
+}
+
+// settingsState holds the functions to call when a cluster setting
+// changes.
+type settingsState struct {
+	sync.Mutex
+	watchers []func(key string)
+}
+
+// watch registers fn to be called with the key of every setting which
+// changes.
+func (s *settingsState) watch(fn func(key string)) {
+	s.Lock()
+	s.watchers = append(s.watchers, fn)
+	s.Unlock()
+}
+
+func (s *settingsState) notify(key string) {
+	s.Lock()
+	watchers := append([]func(string){}, s.watchers...)
+	s.Unlock()
+
+	for _, fn := range watchers {
+		fn(key)
+	}
+}
+
+// settingValue returns the current value of a cluster setting: the value
+// set by the admin if there is one, otherwise the value in the controller
+// configuration.
+func (c *controller) settingValue(key string) int64 {
+	return c.configSetting(c.config.config(), key)
+}
+
+// configSetting returns the value of a cluster setting set by the admin if
+// there is one, otherwise its value in cfg.
+func (c *controller) configSetting(cfg controllerConfig, key string) int64 {
+	def, ok := settingDefs[key]
+	if !ok {
+		return 0
+	}
+
+	if s, ok := c.ds.GetSetting(key); ok {
+		if v, err := def.parse(key, s.Value); err == nil {
+			return v
+		}
+	}
+
+	return def.def(cfg)
+}
+
+// durationSetting returns the current value of a duration setting.
+func (c *controller) durationSetting(key string) time.Duration {
+	return time.Duration(c.settingValue(key))
+}
+
+// boolSetting returns the current value of a boolean setting.
+func (c *controller) boolSetting(key string) bool {
+	return c.settingValue(key) != 0
+}
+
+// intSetting returns the current value of an integer setting.
+func (c *controller) intSetting(key string) int {
+	v := c.settingValue(key)
+	if v > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(v)
+}
+
+func (c *controller) setting(key string) (types.Setting, error) {
+	def, ok := settingDefs[key]
+	if !ok {
+		return types.Setting{}, types.ErrSettingNotFound
+	}
+
+	s := types.Setting{
+		Key:         key,
+		Type:        def.typ,
+		Description: def.description,
+		Value:       def.format(c.settingValue(key)),
+		Default:     def.format(def.def(c.config.config())),
+		Min:         def.format(def.min),
+		Max:         def.format(def.max),
+	}
+
+	if v, ok := c.ds.GetSetting(key); ok {
+		s.Modified = true
+		s.UpdateTime = v.UpdateTime
+	}
+
+	return s, nil
+}
+
+// checkSettings returns an error if a value of key would be inconsistent
+// with the values of the other settings.
+func (c *controller) checkSettings(key string, v int64) error {
+	suspect := c.settingValue(settingNodeSuspectTimeout)
+	down := c.settingValue(settingNodeDownTimeout)
+
+	switch key {
+	case settingNodeSuspectTimeout:
+		suspect = v
+	case settingNodeDownTimeout:
+		down = v
+	default:
+		return nil
+	}
+
+	if down <= suspect {
+		return &types.SettingValueError{
+			Key:    key,
+			Reason: fmt.Sprintf("%s must be greater than %s", settingNodeDownTimeout, settingNodeSuspectTimeout),
+		}
+	}
+
+	return nil
+}
+
+// ListSettings returns the cluster settings ordered by key.
+func (c *controller) ListSettings() ([]types.Setting, error) {
+	settings := make([]types.Setting, 0, len(settingDefs))
+	for key := range settingDefs {
+		s, err := c.setting(key)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, s)
+	}
+
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Key < settings[j].Key
+	})
+
+	return settings, nil
+}
+
+// ShowSetting returns a cluster setting.
+func (c *controller) ShowSetting(key string) (types.Setting, error) {
+	return c.setting(key)
+}
+
+// auditSetting records the change of a setting, with its old and new
+// values, in the admin event log.
+func (c *controller) auditSetting(ctx context.Context, key string, old string, new string) {
+	msg := fmt.Sprintf("Setting %s changed from %s to %s", key, old, new)
+	err := c.ds.LogAction("", key, service.GetActor(ctx), service.GetOnBehalfOf(ctx), msg)
+	if err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+	c.log.Infof("%s", msg)
+}
+
+// UpdateSetting changes the value of a cluster setting.  The components
+// which use the setting are notified and apply the new value immediately.
+func (c *controller) UpdateSetting(ctx context.Context, key string, value string) (types.Setting, error) {
+	def, ok := settingDefs[key]
+	if !ok {
+		return types.Setting{}, types.ErrSettingNotFound
+	}
+
+	v, err := def.parse(key, value)
+	if err != nil {
+		return types.Setting{}, err
+	}
+
+	if err := c.checkSettings(key, v); err != nil {
+		return types.Setting{}, err
+	}
+
+	old := def.format(c.settingValue(key))
+
+	err = c.ds.UpdateSetting(types.SettingValue{
+		Key:        key,
+		Value:      def.format(v),
+		UpdateTime: time.Now(),
+	})
+	if err != nil {
+		return types.Setting{}, err
+	}
+
+	c.auditSetting(ctx, key, old, def.format(v))
+	c.settings.notify(key)
+
+	return c.setting(key)
+}
+
+// ResetSetting restores the default value of a cluster setting, which is
+// taken from the controller configuration.
+func (c *controller) ResetSetting(ctx context.Context, key string) (types.Setting, error) {
+	def, ok := settingDefs[key]
+	if !ok {
+		return types.Setting{}, types.ErrSettingNotFound
+	}
+
+	if _, ok := c.ds.GetSetting(key); !ok {
+		return c.setting(key)
+	}
+
+	if err := c.checkSettings(key, def.def(c.config.config())); err != nil {
+		return types.Setting{}, err
+	}
+
+	old := def.format(c.settingValue(key))
+
+	err := c.ds.DeleteSetting(key)
+	if err != nil {
+		return types.Setting{}, err
+	}
+
+	c.auditSetting(ctx, key, old, def.format(c.settingValue(key)))
+	c.settings.notify(key)
+
+	return c.setting(key)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func resetTestSetting(t *testing.T, key string) {
+	if _, err := ctl.ResetSetting(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateSetting(t *testing.T) {
+	defer resetTestSetting(t, settingTrashRetention)
+
+	s, err := ctl.ShowSetting(settingTrashRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Modified || s.Value != s.Default || s.Type != types.SettingDuration {
+		t.Fatalf("Unexpected default setting: %+v", s)
+	}
+
+	s, err = ctl.UpdateSetting(context.Background(), settingTrashRetention, "2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Modified || s.Value != "2h0m0s" || s.UpdateTime.IsZero() {
+		t.Fatalf("Setting not updated: %+v", s)
+	}
+	if ctl.durationSetting(settingTrashRetention) != 2*time.Hour {
+		t.Fatalf("Expected trash retention of 2h, got %v", ctl.durationSetting(settingTrashRetention))
+	}
+
+	entries, err := ctl.ds.GetEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Setting trash_retention changed from " + s.Default + " to 2h0m0s"
+	found := false
+	for _, e := range entries {
+		if e.Message == expected && e.ObjectID == settingTrashRetention {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Change of setting not audited")
+	}
+
+	s, err = ctl.ResetSetting(context.Background(), settingTrashRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Modified || s.Value != s.Default {
+		t.Fatalf("Setting not reset: %+v", s)
+	}
+	if ctl.durationSetting(settingTrashRetention) != defaultConfig().TrashRetention {
+		t.Fatalf("Expected default trash retention, got %v", ctl.durationSetting(settingTrashRetention))
+	}
+}
+
+func TestUpdateSettingInvalid(t *testing.T) {
+	defer resetTestSetting(t, settingNodeDownTimeout)
+
+	tests := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"no_such_setting", "1s", types.ErrSettingNotFound},
+		{settingTrashRetention, "soon", &types.SettingValueError{}},
+		{settingTrashRetention, "-1s", &types.SettingValueError{}},
+		{settingWebhookMaxAttempts, "1000", &types.SettingValueError{}},
+		{settingWebhookMaxAttempts, "1.5", &types.SettingValueError{}},
+		{settingNodeDownTimeout, "1s", &types.SettingValueError{}},
+	}
+
+	for _, tt := range tests {
+		_, err := ctl.UpdateSetting(context.Background(), tt.key, tt.value)
+		if _, ok := tt.err.(*types.SettingValueError); ok {
+			if _, ok := err.(*types.SettingValueError); !ok {
+				t.Errorf("%s=%s: expected invalid value error, got %v", tt.key, tt.value, err)
+			}
+		} else if err != tt.err {
+			t.Errorf("%s=%s: expected %v, got %v", tt.key, tt.value, tt.err, err)
+		}
+	}
+
+	if _, err := ctl.ResetSetting(context.Background(), "no_such_setting"); err != types.ErrSettingNotFound {
+		t.Errorf("Expected %v resetting unknown setting, got %v", types.ErrSettingNotFound, err)
+	}
+
+	if _, ok := ctl.ds.GetSetting(settingTrashRetention); ok {
+		t.Errorf("Invalid value stored")
+	}
+}
+
+func TestSettingNotify(t *testing.T) {
+	defer resetTestSetting(t, settingWebhookMaxAttempts)
+
+	var changed []string
+	ctl.settings.watch(func(key string) {
+		if key == settingWebhookMaxAttempts {
+			changed = append(changed, key)
+		}
+	})
+
+	_, err := ctl.UpdateSetting(context.Background(), settingWebhookMaxAttempts, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changed) != 1 {
+		t.Fatalf("Expected one notification, got %d", len(changed))
+	}
+	if ctl.intSetting(settingWebhookMaxAttempts) != 7 {
+		t.Fatalf("Expected 7 attempts, got %d", ctl.intSetting(settingWebhookMaxAttempts))
+	}
+}
+
+func TestPendingInstanceTimeoutLive(t *testing.T) {
+	defer resetTestSetting(t, settingPendingInstanceTimeout)
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenant.ID,
+		MACAddress: uuid.Generate().String(),
+		State:      payloads.Pending,
+		CreateTime: time.Now(),
+	}
+	if err := ctl.ds.AddInstance(context.Background(), i); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := func(ids []string) bool {
+		for _, id := range ids {
+			if id == i.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	now := i.CreateTime.Add(time.Minute)
+
+	// not pending for long enough with the default timeout
+	if reported(ctl.checkPendingInstances(now)) {
+		t.Fatal("Instance reported before the default timeout")
+	}
+
+	_, err = ctl.UpdateSetting(context.Background(), settingPendingInstanceTimeout, "30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reported(ctl.checkPendingInstances(now)) {
+		t.Fatal("Instance not reported after the timeout was lowered")
+	}
+
+	// each instance is only reported once
+	if reported(ctl.checkPendingInstances(now)) {
+		t.Fatal("Instance reported twice")
+	}
+
+	entries, err := ctl.ds.GetEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Instance " + i.ID + " has been pending for more than 30s"
+	found := false
+	for _, e := range entries {
+		if e.Message == expected && e.TenantID == tenant.ID && e.EventType == "error" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Pending instance not logged")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// signedURLMinKeySize is the shortest signing key accepted, in bytes.
+const signedURLMinKeySize = 16
+
+// parseSignedResources splits signed_url_resources into the set of
+// resources which may be downloaded through signed URLs.
+func parseSignedResources(resources string) map[string]bool {
+	set := make(map[string]bool)
+	for _, r := range strings.Split(resources, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			set[r] = true
+		}
+	}
+	return set
+}
+
+// validateSignedResources checks that every entry of signed_url_resources
+// is a resource which can be signed.
+func validateSignedResources(resources string) error {
+	for r := range parseSignedResources(resources) {
+		if r != types.SignedOperation && r != types.SignedInstanceHistory {
+			return fmt.Errorf("Unknown signed_url_resources entry: %s", r)
+		}
+	}
+
+	return nil
+}
+
+// signedURLKey reads the key with which URLs are signed.  The key is read
+// for every request so that replacing it revokes the URLs signed with the
+// old key straight away.
+func signedURLKey(cfg controllerConfig) ([]byte, error) {
+	if cfg.SignedURLKeyPath == "" {
+		return nil, types.ErrSignedURLsDisabled
+	}
+
+	key, err := ioutil.ReadFile(cfg.SignedURLKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading signed URL key")
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) < signedURLMinKeySize {
+		return nil, fmt.Errorf("Signed URL key must be at least %d bytes", signedURLMinKeySize)
+	}
+
+	return key, nil
+}
+
+// signResource returns the signature which permits resource id of tenantID
+// to be downloaded until expires.
+func signResource(key []byte, resource string, tenantID string, id string, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", resource, tenantID, id, expires)
+	return mac.Sum(nil)
+}
+
+// signedResource retrieves resource id on behalf of tenantID, or of an admin
+// if tenantID is empty, and returns it together with the tenant owning it.
+func (c *controller) signedResource(resource string, tenantID string, id string) (string, interface{}, error) {
+	switch resource {
+	case types.SignedOperation:
+		scope := tenantID
+		if scope == "" {
+			scope = "admin"
+		}
+
+		op, err := c.ShowOperation(scope, id)
+		if err != nil {
+			return "", nil, err
+		}
+		return op.TenantID, op, nil
+
+	case types.SignedInstanceHistory:
+		history, err := c.ShowInstanceHistory(tenantID, id, types.InstanceHistoryFilter{})
+		if err != nil {
+			return "", nil, err
+		}
+		return history.TenantID, history, nil
+	}
+
+	return "", nil, types.ErrBadRequest
+}
+
+// CreateSignedURL returns a URL through which a read-only resource of
+// tenantID, or of any tenant for admins if tenantID is empty, may be
+// downloaded without credentials until the URL expires.
+func (c *controller) CreateSignedURL(tenantID string, req types.SignedURLRequest) (types.SignedURL, error) {
+	cfg := c.config.config()
+
+	if !parseSignedResources(cfg.SignedURLResources)[req.Resource] {
+		return types.SignedURL{}, types.ErrBadRequest
+	}
+
+	lifetime := cfg.SignedURLExpiry
+	if req.ExpiresIn < 0 {
+		return types.SignedURL{}, types.ErrBadRequest
+	} else if req.ExpiresIn > 0 {
+		requested := time.Duration(req.ExpiresIn) * time.Second
+		if requested > lifetime {
+			return types.SignedURL{}, types.ErrBadRequest
+		}
+		lifetime = requested
+	}
+
+	key, err := signedURLKey(cfg)
+	if err != nil {
+		return types.SignedURL{}, err
+	}
+
+	owner, _, err := c.signedResource(req.Resource, tenantID, req.ID)
+	if err != nil {
+		return types.SignedURL{}, err
+	}
+
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	sig := signResource(key, req.Resource, owner, req.ID, expires.Unix())
+
+	query := url.Values{}
+	query.Set("tenant", owner)
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", hex.EncodeToString(sig))
+
+	return types.SignedURL{
+		URL:      fmt.Sprintf("%s/signed/%s/%s?%s", c.apiURL, req.Resource, req.ID, query.Encode()),
+		Resource: req.Resource,
+		ID:       req.ID,
+		TenantID: owner,
+		Expires:  expires,
+	}, nil
+}
+
+// serveSignedURL serves a resource to a request without a client
+// certificate, provided that the URL carries a valid signature which has
+// not expired.
+func (c *controller) serveSignedURL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	resource := vars["resource"]
+	id := vars["id"]
+
+	// the cluster wide operations of admins have no tenant
+	query := r.URL.Query()
+	tenantID := query.Get("tenant")
+
+	cfg := c.config.config()
+	key, err := signedURLKey(cfg)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if !parseSignedResources(cfg.SignedURLResources)[resource] {
+		http.Error(w, "Resource may not be downloaded through signed URLs", http.StatusForbidden)
+		return
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	sig, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(sig, signResource(key, resource, tenantID, id, expires)) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if time.Now().Unix() > expires {
+		http.Error(w, "Signed URL has expired", http.StatusGone)
+		return
+	}
+
+	_, content, err := c.signedResource(resource, tenantID, id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(content)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// anonymousGet makes a GET request without a client certificate and
+// returns the status and body of the response.
+func anonymousGet(t *testing.T, url string) (int, []byte) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{}}}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func addTestOperation(t *testing.T, tenantID string) types.Operation {
+	now := time.Now()
+	op := types.Operation{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		Type:       types.CreateVolumeOperation,
+		State:      types.OperationSucceeded,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	err := ctl.ds.AddOperation(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return op
+}
+
+func writeSignedURLKey(t *testing.T, path string, key string) {
+	err := ioutil.WriteFile(path, []byte(key), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createTestSignedURL(t *testing.T, tenantID string, req types.SignedURLRequest, status int) types.SignedURL {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenantID + "/signed-urls"
+	body := testHTTPRequestWithHeader(t, "POST", url, status, b, onBehalfOf(tenantID))
+	if status != http.StatusCreated {
+		return types.SignedURL{}
+	}
+
+	var signed types.SignedURL
+	err = json.Unmarshal(body, &signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the controller advertises its own address
+	signed.URL = testutil.ComputeURL + strings.TrimPrefix(signed.URL, ctl.apiURL)
+
+	return signed
+}
+
+func TestSignedURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signed-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	keyPath := filepath.Join(dir, "key")
+	writeSignedURLKey(t, keyPath, "0123456789abcdef0123456789abcdef")
+
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.SignedURLKeyPath = keyPath
+	})()
+	cfg := ctl.config.config()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := addTestOperation(t, tenant.ID)
+	otherOp := addTestOperation(t, other.ID)
+
+	signed := createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       op.ID,
+	}, http.StatusCreated)
+
+	if signed.TenantID != tenant.ID || signed.Expires.After(time.Now().Add(cfg.SignedURLExpiry)) {
+		t.Fatalf("Unexpected signed URL %+v", signed)
+	}
+
+	status, body := anonymousGet(t, signed.URL)
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d got %d: %s", http.StatusOK, status, body)
+	}
+
+	var got types.Operation
+	err = json.Unmarshal(body, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != op.ID || got.TenantID != tenant.ID {
+		t.Fatalf("Unexpected operation %+v", got)
+	}
+
+	// the other routes still require a certificate
+	status, _ = anonymousGet(t, testutil.ComputeURL+"/"+tenant.ID+"/operations/"+op.ID)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected %d without a certificate got %d", http.StatusUnauthorized, status)
+	}
+
+	// a tenant may only sign its own resources
+	_ = createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       otherOp.ID,
+	}, http.StatusNotFound)
+
+	// nor for longer than the controller permits
+	_ = createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource:  types.SignedOperation,
+		ID:        op.ID,
+		ExpiresIn: int((cfg.SignedURLExpiry + time.Minute) / time.Second),
+	}, http.StatusForbidden)
+}
+
+func TestSignedURLTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signed-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	keyPath := filepath.Join(dir, "key")
+	writeSignedURLKey(t, keyPath, "0123456789abcdef0123456789abcdef")
+
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.SignedURLKeyPath = keyPath
+	})()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := addTestOperation(t, tenant.ID)
+	otherOp := addTestOperation(t, other.ID)
+
+	signed := createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       op.ID,
+	}, http.StatusCreated)
+
+	tampered := []string{
+		strings.Replace(signed.URL, op.ID, otherOp.ID, 1),
+		strings.Replace(signed.URL, tenant.ID, other.ID, 1),
+		strings.Replace(signed.URL, "expires=", "expires=1", 1),
+		strings.Replace(signed.URL, "signature=", "signature=00", 1),
+		strings.Replace(signed.URL, "/signed/operation/", "/signed/instance_history/", 1),
+	}
+
+	for _, url := range tampered {
+		status, body := anonymousGet(t, url)
+		if status != http.StatusForbidden {
+			t.Errorf("Expected %d for %s got %d: %s", http.StatusForbidden, url, status, body)
+		}
+	}
+
+	// rotating the key revokes the URLs signed with the old one
+	writeSignedURLKey(t, keyPath, "fedcba9876543210fedcba9876543210")
+	status, _ := anonymousGet(t, signed.URL)
+	if status != http.StatusForbidden {
+		t.Errorf("Expected %d after key rotation got %d", http.StatusForbidden, status)
+	}
+}
+
+func TestSignedURLExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signed-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	key := "0123456789abcdef0123456789abcdef"
+	keyPath := filepath.Join(dir, "key")
+	writeSignedURLKey(t, keyPath, key)
+
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.SignedURLKeyPath = keyPath
+	})()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := addTestOperation(t, tenant.ID)
+
+	expires := time.Now().Add(-time.Minute).Unix()
+	sig := signResource([]byte(key), types.SignedOperation, tenant.ID, op.ID, expires)
+	url := fmt.Sprintf("%s/signed/%s/%s?tenant=%s&expires=%d&signature=%s", testutil.ComputeURL,
+		types.SignedOperation, op.ID, tenant.ID, expires, hex.EncodeToString(sig))
+
+	status, body := anonymousGet(t, url)
+	if status != http.StatusGone {
+		t.Errorf("Expected %d got %d: %s", http.StatusGone, status, body)
+	}
+}
+
+func TestSignedURLResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signed-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	keyPath := filepath.Join(dir, "key")
+	writeSignedURLKey(t, keyPath, "0123456789abcdef0123456789abcdef")
+
+	saved := ctl.config.config()
+	defer ctl.config.setConfig(saved)
+
+	cfg := saved
+	cfg.SignedURLKeyPath = keyPath
+	ctl.config.setConfig(cfg)
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := addTestOperation(t, tenant.ID)
+
+	signed := createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       op.ID,
+	}, http.StatusCreated)
+
+	_ = createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: "console",
+		ID:       op.ID,
+	}, http.StatusForbidden)
+
+	// URLs of resources which are no longer eligible stop working
+	cfg.SignedURLResources = types.SignedInstanceHistory
+	ctl.config.setConfig(cfg)
+
+	_ = createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       op.ID,
+	}, http.StatusForbidden)
+
+	status, _ := anonymousGet(t, signed.URL)
+	if status != http.StatusForbidden {
+		t.Errorf("Expected %d got %d", http.StatusForbidden, status)
+	}
+
+	// as do all URLs when signing is disabled
+	cfg.SignedURLResources = types.SignedOperation
+	cfg.SignedURLKeyPath = ""
+	ctl.config.setConfig(cfg)
+
+	_ = createTestSignedURL(t, tenant.ID, types.SignedURLRequest{
+		Resource: types.SignedOperation,
+		ID:       op.ID,
+	}, http.StatusForbidden)
+
+	status, _ = anonymousGet(t, signed.URL)
+	if status != http.StatusNotFound {
+		t.Errorf("Expected %d got %d", http.StatusNotFound, status)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// snapshotCheckPeriod is how often the snapshot schedules are checked for
+// runs which are due.
+const snapshotCheckPeriod = time.Minute
+
+// maxSnapshotRetention is the largest number of snapshots a schedule may
+// keep of each volume.
+const maxSnapshotRetention = 100
+
+// nextSnapshotRun returns the first run of a schedule strictly after t.
+// Runs are aligned to the interval from the start of the UTC day, shifted
+// by the schedule's offset.
+func nextSnapshotRun(s types.SnapshotSchedule, t time.Time) time.Time {
+	interval := time.Duration(s.IntervalMinutes) * time.Minute
+	offset := time.Duration(s.OffsetMinutes) * time.Minute
+
+	return t.UTC().Add(-offset).Truncate(interval).Add(interval + offset)
+}
+
+// validateSnapshotSchedule checks that a schedule selects either a volume
+// of the tenant or a tag, and that its interval, offset and retention are
+// in range.
+func (c *controller) validateSnapshotSchedule(tenantID string, req types.SnapshotScheduleRequest) error {
+	if (req.VolumeID == "") == (req.Tag == "") {
+		return types.ErrBadSnapshotSchedule
+	}
+
+	if req.IntervalMinutes <= 0 || req.OffsetMinutes < 0 || req.OffsetMinutes >= req.IntervalMinutes {
+		return types.ErrBadSnapshotSchedule
+	}
+
+	if req.Retention <= 0 || req.Retention > maxSnapshotRetention {
+		return types.ErrBadSnapshotSchedule
+	}
+
+	if req.Tag != "" {
+		if !volumeTagRegexp.MatchString(req.Tag) {
+			return types.ErrBadVolumeTag
+		}
+		return nil
+	}
+
+	vol, err := c.adminVolume(req.VolumeID)
+	if err != nil {
+		return err
+	}
+
+	if vol.TenantID != tenantID || vol.Internal {
+		return types.ErrVolumeNotFound
+	}
+
+	return nil
+}
+
+// ListSnapshotSchedules returns the snapshot schedules of a tenant.
+func (c *controller) ListSnapshotSchedules(tenantID string) ([]types.SnapshotSchedule, error) {
+	return c.ds.GetSnapshotSchedules(tenantID), nil
+}
+
+// CreateSnapshotSchedule validates and stores a new snapshot schedule.  Its
+// first run is the first one due after it is created.
+func (c *controller) CreateSnapshotSchedule(tenantID string, req types.SnapshotScheduleRequest) (types.SnapshotSchedule, error) {
+	if err := c.validateSnapshotSchedule(tenantID, req); err != nil {
+		return types.SnapshotSchedule{}, err
+	}
+
+	now := time.Now()
+	s := types.SnapshotSchedule{
+		ID:              uuid.Generate().String(),
+		TenantID:        tenantID,
+		VolumeID:        req.VolumeID,
+		Tag:             req.Tag,
+		IntervalMinutes: req.IntervalMinutes,
+		OffsetMinutes:   req.OffsetMinutes,
+		Retention:       req.Retention,
+		CreateTime:      now,
+	}
+	s.NextRun = nextSnapshotRun(s, now)
+
+	if err := c.ds.AddSnapshotSchedule(s); err != nil {
+		return types.SnapshotSchedule{}, err
+	}
+
+	return s, nil
+}
+
+// ShowSnapshotSchedule returns a snapshot schedule of a tenant.
+func (c *controller) ShowSnapshotSchedule(tenantID string, ID string) (types.SnapshotSchedule, error) {
+	return c.ds.GetSnapshotSchedule(tenantID, ID)
+}
+
+// DeleteSnapshotSchedule removes a snapshot schedule.  The snapshots it has
+// taken are kept until their volumes are deleted.
+func (c *controller) DeleteSnapshotSchedule(tenantID string, ID string) error {
+	return c.ds.DeleteSnapshotSchedule(tenantID, ID)
+}
+
+// ListVolumeSnapshots returns the snapshots taken of a tenant's volume, on
+// request or by schedules, oldest first.
+func (c *controller) ListVolumeSnapshots(tenantID string, volumeID string) ([]types.VolumeSnapshot, error) {
+	if _, err := c.tenantVolume(tenantID, volumeID); err != nil {
+		return nil, err
+	}
+
+	return c.ds.GetVolumeSnapshots(volumeID), nil
+}
+
+// scheduledVolumes returns the volumes selected by a snapshot schedule:
+// either its volume, or the tenant's volumes attached with its tag.
+func (c *controller) scheduledVolumes(s types.SnapshotSchedule) ([]types.Volume, error) {
+	if s.VolumeID != "" {
+		vol, err := c.adminVolume(s.VolumeID)
+		if err != nil {
+			return nil, err
+		}
+		return []types.Volume{vol}, nil
+	}
+
+	devices, err := c.ds.GetBlockDevices(s.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []types.Volume
+	for _, vol := range devices {
+		attachments, err := c.ds.GetVolumeAttachments(vol.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range attachments {
+			if a.Tag == s.Tag {
+				volumes = append(volumes, vol)
+				break
+			}
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	return volumes, nil
+}
+
+// deleteVolumeSnapshot removes a snapshot from the storage media and then
+// forgets it.
+func (c *controller) deleteVolumeSnapshot(ctx context.Context, snap types.VolumeSnapshot) error {
+	err := c.DeleteBlockDeviceSnapshot(ctx, snap.VolumeID, snap.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.ds.DeleteVolumeSnapshot(snap.VolumeID, snap.ID)
+}
+
+// removeVolumeSnapshots removes the snapshots of a volume which is being
+// deleted, as the storage media refuse to delete volumes which still have
+// snapshots, along with the schedules which select only that volume.
+func (c *controller) removeVolumeSnapshots(ctx context.Context, vol types.Volume) error {
+	for _, snap := range c.ds.GetVolumeSnapshots(vol.ID) {
+		err := c.deleteVolumeSnapshot(ctx, snap)
+		if err != nil {
+			return fmt.Errorf("Unable to delete snapshot %s of volume %s: %v", snap.ID, vol.ID, err)
+		}
+	}
+
+	for _, s := range c.ds.GetSnapshotSchedules(vol.TenantID) {
+		if s.VolumeID != vol.ID {
+			continue
+		}
+
+		err := c.ds.DeleteSnapshotSchedule(vol.TenantID, s.ID)
+		if err != nil && err != types.ErrSnapshotScheduleNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneVolumeSnapshots deletes the oldest snapshots a schedule has taken of
+// a volume until no more than the schedule's retention are left.
+func (c *controller) pruneVolumeSnapshots(s types.SnapshotSchedule, volumeID string) error {
+	var taken []types.VolumeSnapshot
+	for _, snap := range c.ds.GetVolumeSnapshots(volumeID) {
+		if snap.ScheduleID == s.ID {
+			taken = append(taken, snap)
+		}
+	}
+
+	for ; len(taken) > s.Retention; taken = taken[1:] {
+		err := c.deleteVolumeSnapshot(c.ctx, taken[0])
+		if err != nil {
+			return fmt.Errorf("Unable to prune snapshot %s of volume %s: %v", taken[0].ID, volumeID, err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotVolume takes a snapshot of a volume for a schedule and prunes the
+// snapshots beyond the schedule's retention.  Volumes being attached,
+// detached or deleted are skipped.
+func (c *controller) snapshotVolume(s types.SnapshotSchedule, vol types.Volume, now time.Time) error {
+	if vol.State != types.Available && vol.State != types.InUse {
+		msg := fmt.Sprintf("Snapshot of volume %s by schedule %s skipped: volume is %s", vol.ID, s.ID, vol.State)
+		_ = c.ds.LogEvent(s.TenantID, msg)
+		return nil
+	}
+
+	snap := types.VolumeSnapshot{
+		ID:         uuid.Generate().String(),
+		VolumeID:   vol.ID,
+		TenantID:   s.TenantID,
+		ScheduleID: s.ID,
+		CreateTime: now,
+	}
+
+	err := c.CreateBlockDeviceSnapshot(c.ctx, vol.ID, snap.ID)
+	if err != nil {
+		return fmt.Errorf("Unable to snapshot volume %s: %v", vol.ID, err)
+	}
+
+	err = c.ds.AddVolumeSnapshot(snap)
+	if err != nil {
+		_ = c.DeleteBlockDeviceSnapshot(c.ctx, vol.ID, snap.ID)
+		return fmt.Errorf("Unable to record snapshot of volume %s: %v", vol.ID, err)
+	}
+
+	msg := fmt.Sprintf("Snapshot %s of volume %s taken by schedule %s", snap.ID, vol.ID, s.ID)
+	_ = c.ds.LogEvent(s.TenantID, msg)
+
+	return c.pruneVolumeSnapshots(s, vol.ID)
+}
+
+// runSnapshotSchedule snapshots the volumes selected by a schedule and
+// records the run.  The next run is the first due after now, so the runs
+// missed while the controller was down are made up for by this single run.
+func (c *controller) runSnapshotSchedule(s types.SnapshotSchedule, now time.Time) {
+	var failures []string
+
+	volumes, err := c.scheduledVolumes(s)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("Unable to find volumes of schedule: %v", err))
+	}
+
+	for _, vol := range volumes {
+		if err := c.snapshotVolume(s, vol, now); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	for _, f := range failures {
+		_ = c.ds.LogError(s.TenantID, fmt.Sprintf("Snapshot schedule %s: %s", s.ID, f))
+	}
+
+	s.LastRun = now
+	s.NextRun = nextSnapshotRun(s, now)
+	s.LastError = strings.Join(failures, "; ")
+
+	err = c.ds.UpdateSnapshotSchedule(s)
+	if err != nil && err != types.ErrSnapshotScheduleNotFound {
+		c.log.Warningf("Unable to record run of snapshot schedule %s: %v", s.ID, err)
+	}
+}
+
+// runSnapshotSchedules runs the snapshot schedules which are due.
+func (c *controller) runSnapshotSchedules(now time.Time) {
+	for _, s := range c.ds.GetSnapshotSchedules("") {
+		if s.NextRun.After(now) {
+			continue
+		}
+
+		c.runSnapshotSchedule(s, now)
+	}
+}
+
+// takeScheduledSnapshots runs the snapshot schedules as they fall due while
+// the controller is active.  The schedules are checked as soon as the
+// controller starts so that runs missed while it was down are made up for.
+func (c *controller) takeScheduledSnapshots() {
+	ticker := time.NewTicker(snapshotCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		if c.isActive() {
+			c.runSnapshotSchedules(time.Now())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
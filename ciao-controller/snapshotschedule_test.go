@@ -0,0 +1,367 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// snapshotDriver is a block driver which keeps track of the snapshots it
+// holds.
+type snapshotDriver struct {
+	*storage.NoopDriver
+
+	lock      sync.Mutex
+	snapshots map[string]map[string]bool
+}
+
+func (d *snapshotDriver) CreateBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.snapshots[volumeUUID] == nil {
+		d.snapshots[volumeUUID] = make(map[string]bool)
+	}
+	d.snapshots[volumeUUID][snapshotID] = true
+
+	return nil
+}
+
+func (d *snapshotDriver) DeleteBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.snapshots[volumeUUID], snapshotID)
+
+	return nil
+}
+
+func (d *snapshotDriver) count(volumeUUID string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return len(d.snapshots[volumeUUID])
+}
+
+func useSnapshotDriver() (*snapshotDriver, func()) {
+	d := &snapshotDriver{
+		NoopDriver: &storage.NoopDriver{},
+		snapshots:  make(map[string]map[string]bool),
+	}
+
+	saved := ctl.BlockDriver
+	ctl.BlockDriver = d
+
+	return d, func() { ctl.BlockDriver = saved }
+}
+
+func createTestSnapshotSchedule(t *testing.T, tenantID string, req types.SnapshotScheduleRequest) (types.SnapshotSchedule, func()) {
+	s, err := ctl.CreateSnapshotSchedule(tenantID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, func() { _ = ctl.DeleteSnapshotSchedule(tenantID, s.ID) }
+}
+
+func checkSnapshots(t *testing.T, d *snapshotDriver, volumeID string, expected int) []types.VolumeSnapshot {
+	snapshots := ctl.ds.GetVolumeSnapshots(volumeID)
+	if len(snapshots) != expected || d.count(volumeID) != expected {
+		t.Fatalf("Expected %d snapshots of volume %s, got %d recorded and %d stored",
+			expected, volumeID, len(snapshots), d.count(volumeID))
+	}
+
+	return snapshots
+}
+
+func TestNextSnapshotRun(t *testing.T) {
+	s := types.SnapshotSchedule{IntervalMinutes: 24 * 60, OffsetMinutes: 120}
+
+	tests := []struct {
+		now  string
+		next string
+	}{
+		{"2017-06-01T01:00:00Z", "2017-06-01T02:00:00Z"},
+		{"2017-06-01T02:00:00Z", "2017-06-02T02:00:00Z"},
+		{"2017-06-01T23:59:00Z", "2017-06-02T02:00:00Z"},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		next, _ := time.Parse(time.RFC3339, test.next)
+
+		if got := nextSnapshotRun(s, now); !got.Equal(next) {
+			t.Errorf("Next run after %s: expected %s, got %s", test.now, test.next, got)
+		}
+	}
+}
+
+func TestCreateSnapshotScheduleInvalid(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := createTestVolume(tenant.ID, 1, t)
+
+	tests := []struct {
+		req types.SnapshotScheduleRequest
+		err error
+	}{
+		{types.SnapshotScheduleRequest{IntervalMinutes: 60, Retention: 1}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{VolumeID: vol, Tag: "data", IntervalMinutes: 60, Retention: 1}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{VolumeID: vol, Retention: 1}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{VolumeID: vol, IntervalMinutes: 60, OffsetMinutes: 60, Retention: 1}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{VolumeID: vol, IntervalMinutes: 60}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{VolumeID: vol, IntervalMinutes: 60, Retention: maxSnapshotRetention + 1}, types.ErrBadSnapshotSchedule},
+		{types.SnapshotScheduleRequest{Tag: "data,serial=x", IntervalMinutes: 60, Retention: 1}, types.ErrBadVolumeTag},
+		{types.SnapshotScheduleRequest{VolumeID: "missing", IntervalMinutes: 60, Retention: 1}, types.ErrVolumeNotFound},
+	}
+
+	for i, test := range tests {
+		_, err := ctl.CreateSnapshotSchedule(tenant.ID, test.req)
+		if err != test.err {
+			t.Errorf("test %d: expected %v, got %v", i, test.err, err)
+		}
+	}
+
+	_, err = ctl.CreateSnapshotSchedule(other.ID, types.SnapshotScheduleRequest{
+		VolumeID:        vol,
+		IntervalMinutes: 60,
+		Retention:       1,
+	})
+	if err != types.ErrVolumeNotFound {
+		t.Fatalf("Expected %v scheduling volume of another tenant, got %v", types.ErrVolumeNotFound, err)
+	}
+}
+
+func TestSnapshotScheduleInterval(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := createTestVolume(tenant.ID, 1, t)
+
+	s, cleanup := createTestSnapshotSchedule(t, tenant.ID, types.SnapshotScheduleRequest{
+		VolumeID:        vol,
+		IntervalMinutes: 60,
+		Retention:       5,
+	})
+	defer cleanup()
+
+	next := s.NextRun
+	if !next.After(s.CreateTime) || next.Sub(s.CreateTime) > time.Hour || next.Minute() != 0 {
+		t.Fatalf("Unexpected first run %s of schedule created at %s", next, s.CreateTime)
+	}
+
+	ctl.runSnapshotSchedules(next.Add(-time.Second))
+	checkSnapshots(t, d, vol, 0)
+
+	ctl.runSnapshotSchedules(next)
+	snapshots := checkSnapshots(t, d, vol, 1)
+	if snapshots[0].ScheduleID != s.ID || !snapshots[0].CreateTime.Equal(next) {
+		t.Fatalf("Unexpected snapshot %+v", snapshots[0])
+	}
+
+	s, err = ctl.ShowSnapshotSchedule(tenant.ID, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.LastRun.Equal(next) || !s.NextRun.Equal(next.Add(time.Hour)) || s.LastError != "" {
+		t.Fatalf("Run not recorded: %+v", s)
+	}
+
+	ctl.runSnapshotSchedules(next.Add(30 * time.Minute))
+	checkSnapshots(t, d, vol, 1)
+
+	ctl.runSnapshotSchedules(next.Add(time.Hour))
+	checkSnapshots(t, d, vol, 2)
+
+	events, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := 0
+	for _, e := range events {
+		if strings.Contains(e.Message, "taken by schedule "+s.ID) {
+			taken++
+		}
+	}
+	if taken != 2 {
+		t.Fatalf("Expected 2 snapshot events, got %d: %+v", taken, events)
+	}
+}
+
+func TestSnapshotScheduleRetention(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := createTestVolume(tenant.ID, 1, t)
+
+	s, cleanup := createTestSnapshotSchedule(t, tenant.ID, types.SnapshotScheduleRequest{
+		VolumeID:        vol,
+		IntervalMinutes: 60,
+		Retention:       2,
+	})
+	defer cleanup()
+
+	next := s.NextRun
+	for i := 0; i < 4; i++ {
+		ctl.runSnapshotSchedules(next.Add(time.Duration(i) * time.Hour))
+	}
+
+	// the oldest snapshots are pruned first
+	snapshots := checkSnapshots(t, d, vol, 2)
+	if !snapshots[0].CreateTime.Equal(next.Add(2*time.Hour)) ||
+		!snapshots[1].CreateTime.Equal(next.Add(3*time.Hour)) {
+		t.Fatalf("Unexpected snapshots kept: %+v", snapshots)
+	}
+
+	// deleting the volume removes its snapshots and its schedule
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, vol, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSnapshots(t, d, vol, 0)
+
+	_, err = ctl.ShowSnapshotSchedule(tenant.ID, s.ID)
+	if err != types.ErrSnapshotScheduleNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrSnapshotScheduleNotFound, err)
+	}
+}
+
+func TestSnapshotScheduleCatchUpOnce(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := createTestVolume(tenant.ID, 1, t)
+
+	s, cleanup := createTestSnapshotSchedule(t, tenant.ID, types.SnapshotScheduleRequest{
+		VolumeID:        vol,
+		IntervalMinutes: 60,
+		Retention:       10,
+	})
+	defer cleanup()
+
+	// the controller was down for five and a half intervals
+	now := s.NextRun.Add(5*time.Hour + 30*time.Minute)
+	ctl.runSnapshotSchedules(now)
+	checkSnapshots(t, d, vol, 1)
+
+	s, err = ctl.ShowSnapshotSchedule(tenant.ID, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.LastRun.Equal(now) || !s.NextRun.Equal(now.Truncate(time.Hour).Add(time.Hour)) {
+		t.Fatalf("Unexpected runs after catching up: %+v", s)
+	}
+
+	ctl.runSnapshotSchedules(now.Add(time.Minute))
+	checkSnapshots(t, d, vol, 1)
+}
+
+func TestSnapshotScheduleTag(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addRunningInstance(t, tenant.ID)
+
+	attached := createTestVolume(tenant.ID, 1, t)
+	detaching := createTestVolume(tenant.ID, 1, t)
+	untagged := createTestVolume(tenant.ID, 1, t)
+
+	for _, vol := range []string{attached, detaching} {
+		_, err := ctl.ds.CreateStorageAttachment(context.Background(), i.ID, payloads.StorageResource{ID: vol, Tag: "data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vol, err := ctl.ds.GetBlockDevice(detaching)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol.State = types.Detaching
+	err = ctl.ds.UpdateBlockDevice(context.Background(), vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, cleanup := createTestSnapshotSchedule(t, tenant.ID, types.SnapshotScheduleRequest{
+		Tag:             "data",
+		IntervalMinutes: 60,
+		Retention:       1,
+	})
+	defer cleanup()
+
+	ctl.runSnapshotSchedules(s.NextRun)
+
+	checkSnapshots(t, d, attached, 1)
+	checkSnapshots(t, d, detaching, 0)
+	checkSnapshots(t, d, untagged, 0)
+
+	events, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := false
+	for _, e := range events {
+		if strings.Contains(e.Message, "Snapshot of volume "+detaching) &&
+			strings.Contains(e.Message, "skipped") {
+			skipped = true
+		}
+	}
+	if !skipped {
+		t.Fatalf("Skipped volume not reported: %+v", events)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// eventStreamBuffer is the number of events which may be waiting to be
+// sent to a client following the event stream.
+var eventStreamBuffer = 256
+
+// streamPath returns true if path is the path of an event stream.
+func streamPath(path string) bool {
+	return strings.HasSuffix(path, "/events/stream")
+}
+
+// StreamEvents subscribes to the events of a tenant, or of all tenants if
+// tenantID is empty, as they are logged.  The events logged after
+// lastEventID which are still in the event log are returned as the
+// backlog of the stream.
+func (c *controller) StreamEvents(tenantID string, lastEventID int64) (api.EventStream, error) {
+	events := c.events.subscribeLog(tenantID, eventStreamBuffer)
+	stream := api.EventStream{
+		Events: events,
+		Close:  func() { c.events.unsubscribeLog(events) },
+	}
+
+	// the subscription is made first so that no event is missed, events
+	// in both the backlog and the subscription are skipped by the API.
+	if lastEventID > 0 {
+		filter := types.EventFilter{Marker: lastEventID}
+
+		var logs []*types.LogEntry
+		var err error
+		if tenantID != "" {
+			logs, err = c.ds.GetEventsForTenant(tenantID, filter)
+		} else {
+			logs, err = c.ds.GetEvents(filter)
+		}
+		if err != nil {
+			stream.Close()
+			return api.EventStream{}, err
+		}
+
+		stream.Backlog = ciaoEvents(logs, filter).Events
+	}
+
+	return stream, nil
+}
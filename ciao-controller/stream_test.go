@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+func TestEventHubSlowLogSubscriber(t *testing.T) {
+	h := newEventHub()
+
+	all := h.subscribeLog("", 1)
+	tenant := h.subscribeLog("tenant", 2)
+	other := h.subscribeLog("other", 1)
+	events := h.subscribe(1)
+
+	h.publishLog([]types.LogEntry{
+		{ID: 1, TenantID: "tenant", Message: "first"},
+		{ID: 2, TenantID: "tenant", Message: "second"},
+	})
+
+	// only one event fits in the buffer of the subscriber to all events
+	e, ok := <-all
+	if !ok || e.ID != 1 {
+		t.Fatalf("Expected first event, got %+v", e)
+	}
+
+	if _, ok := <-all; ok {
+		t.Fatal("Expected slow subscriber to be dropped")
+	}
+
+	for _, ID := range []int64{1, 2} {
+		if e := <-tenant; e.ID != ID {
+			t.Fatalf("Expected event %d, got %+v", ID, e)
+		}
+	}
+
+	select {
+	case e := <-other:
+		t.Fatalf("Event of another tenant received: %+v", e)
+	default:
+	}
+
+	// controller event subscribers do not receive log entries, and drop
+	// events rather than being closed when they fall behind
+	select {
+	case e := <-events:
+		t.Fatalf("Log entry received as event: %+v", e)
+	default:
+	}
+
+	h.publish(types.Event{ID: "1"})
+	h.publish(types.Event{ID: "2"})
+
+	if e, ok := <-events; !ok || e.ID != "1" {
+		t.Fatalf("Expected first event, got %+v", e)
+	}
+
+	h.close()
+
+	if _, ok := <-tenant; ok {
+		t.Fatal("Expected stream to end on close")
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatal("Expected subscription to end on close")
+	}
+
+	if _, ok := <-h.subscribeLog("", 1); ok {
+		t.Fatal("Expected subscription after close to be closed")
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"received", "missed"} {
+		err = ctl.ds.LogEvent(tenant.ID, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logged, err := ctl.ds.GetEventsForTenant(tenant.ID, types.EventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logged) < 2 {
+		t.Fatal("Events not logged")
+	}
+
+	received := logged[len(logged)-2]
+	missed := logged[len(logged)-1]
+
+	stream, err := ctl.StreamEvents(tenant.ID, received.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if len(stream.Backlog) != 1 || stream.Backlog[0].ID != missed.ID {
+		t.Fatalf("Expected missed event in backlog, got %+v", stream.Backlog)
+	}
+
+	// events of other tenants are not streamed
+	err = ctl.ds.LogEvent(testutil.ComputeUser, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.ds.LogEvent(tenant.ID, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-stream.Events:
+		if e.Message != "live" || e.ID <= missed.ID {
+			t.Fatalf("Unexpected event streamed: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
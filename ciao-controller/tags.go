@@ -0,0 +1,61 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// validateInstanceTag checks the key and value of an instance tag.  Keys
+// may not contain a colon as instances are listed by key:value.
+func validateInstanceTag(key string, value string) error {
+	if key == "" || strings.Contains(key, ":") {
+		return types.ErrBadInstanceTag
+	}
+
+	if len(key) > types.MaxInstanceTagLength || len(value) > types.MaxInstanceTagLength {
+		return types.ErrBadInstanceTag
+	}
+
+	return nil
+}
+
+// SetInstanceTag tags an instance of a tenant, replacing the value of an
+// existing tag with the same key.
+func (c *controller) SetInstanceTag(tenantID string, instanceID string, key string, value string) error {
+	err := validateInstanceTag(key, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	return c.ds.SetInstanceTag(instanceID, key, value)
+}
+
+// DeleteInstanceTag removes a tag from an instance of a tenant.
+func (c *controller) DeleteInstanceTag(tenantID string, instanceID string, key string) error {
+	_, err := c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	return c.ds.DeleteInstanceTag(instanceID, key)
+}
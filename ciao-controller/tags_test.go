@@ -0,0 +1,198 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func addTaggedTestInstance(t *testing.T, tenantID string) *types.Instance {
+	i := &types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   tenantID,
+		MACAddress: uuid.Generate().String(),
+		State:      payloads.Pending,
+		CreateTime: time.Now(),
+	}
+	if err := ctl.ds.AddInstance(context.Background(), i); err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func TestInstanceTags(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addTaggedTestInstance(t, tenant.ID)
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances/" + i.ID + "/tags/role"
+	b, err := json.Marshal(types.InstanceTagRequest{Value: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHTTPRequest(t, "PUT", url, http.StatusNoContent, b, true)
+
+	err = ctl.SetInstanceTag(tenant.ID, i.ID, "env", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setting an existing key replaces its value
+	err = ctl.SetInstanceTag(tenant.ID, i.ID, "env", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url = testutil.ComputeURL + "/" + tenant.ID + "/instances/" + i.ID
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var s struct {
+		Server api.ServerDetails `json:"server"`
+	}
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Server.Tags) != 2 || s.Server.Tags["role"] != "web" || s.Server.Tags["env"] != "staging" {
+		t.Fatalf("Unexpected tags %v", s.Server.Tags)
+	}
+
+	url = testutil.ComputeURL + "/" + tenant.ID + "/instances/" + i.ID + "/tags/role"
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNoContent, nil, true)
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNotFound, nil, true)
+
+	err = ctl.DeleteInstanceTag(tenant.ID, i.ID, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = ctl.ds.GetInstance(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(i.Tags) != 0 {
+		t.Fatalf("Expected no tags, got %v", i.Tags)
+	}
+
+	// the instance is not visible to other tenants
+	err = ctl.SetInstanceTag(uuid.Generate().String(), i.ID, "role", "web")
+	if err != types.ErrInstanceNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+}
+
+func TestInstanceTagValidation(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := addTaggedTestInstance(t, tenant.ID)
+
+	long := strings.Repeat("x", types.MaxInstanceTagLength+1)
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"", "web"},
+		{"role:web", "web"},
+		{long, "web"},
+		{"role", long},
+	}
+
+	for _, test := range tests {
+		err := ctl.SetInstanceTag(tenant.ID, i.ID, test.key, test.value)
+		if err != types.ErrBadInstanceTag {
+			t.Errorf("Expected %v for %q=%q, got %v", types.ErrBadInstanceTag, test.key, test.value, err)
+		}
+	}
+
+	for n := 0; n < types.MaxInstanceTags; n++ {
+		err := ctl.SetInstanceTag(tenant.ID, i.ID, fmt.Sprintf("key%d", n), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ctl.SetInstanceTag(tenant.ID, i.ID, "onemore", "value")
+	if err != types.ErrTooManyInstanceTags {
+		t.Fatalf("Expected %v, got %v", types.ErrTooManyInstanceTags, err)
+	}
+
+	// existing tags may still be changed at the limit
+	err = ctl.SetInstanceTag(tenant.ID, i.ID, "key0", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListServersDetailByTag(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := addTaggedTestInstance(t, tenant.ID)
+	db := addTaggedTestInstance(t, tenant.ID)
+	_ = addTaggedTestInstance(t, tenant.ID)
+
+	if err := ctl.SetInstanceTag(tenant.ID, web.ID, "role", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.SetInstanceTag(tenant.ID, db.ID, "role", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	match := types.InstanceFilter{TagKey: "role", TagValue: "web"}
+	servers, _, err := ctl.ListServersDetail(tenant.ID, match, types.ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 1 || servers[0].ID != web.ID {
+		t.Fatalf("Expected only %s, got %+v", web.ID, servers)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances/detail?tag=role:db"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var s api.Servers
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Servers) != 1 || s.Servers[0].ID != db.ID {
+		t.Fatalf("Expected only %s, got %+v", db.ID, s.Servers)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// clientCAState holds the pool of CAs trusted to sign the client
+// certificates presented to the API: the global client CA and the CAs
+// registered by tenants.  The pool is rebuilt whenever the set of tenant
+// CAs changes.
+type clientCAState struct {
+	sync.Mutex
+	global  []*x509.Certificate
+	built   bool
+	gen     uint64
+	pool    *x509.CertPool
+	tenants map[string]string
+}
+
+// parseCertificates returns the certificates in PEM encoded data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// loadClientCAs loads the global client CA from path.
+func (c *controller) loadClientCAs(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Error loading client cert CA")
+	}
+
+	certs, err := parseCertificates(data)
+	if err != nil || len(certs) == 0 {
+		return errors.New("Error importing client auth CA to pool")
+	}
+
+	c.clientCAs.Lock()
+	c.clientCAs.global = certs
+	c.clientCAs.built = false
+	c.clientCAs.Unlock()
+
+	return nil
+}
+
+// refreshClientCAs rebuilds the pool of client CAs if the tenant CAs have
+// changed since it was last built.  The caller must hold the clientCAs
+// lock.
+func (c *controller) refreshClientCAs() {
+	s := &c.clientCAs
+
+	if s.built && s.gen == c.ds.TenantCAGeneration() {
+		return
+	}
+
+	cas, gen := c.ds.GetTenantCAs()
+
+	pool := x509.NewCertPool()
+	for _, cert := range s.global {
+		pool.AddCert(cert)
+	}
+
+	tenants := make(map[string]string)
+	for _, ca := range cas {
+		certs, err := parseCertificates([]byte(ca.Certificate))
+		if err != nil || len(certs) != 1 {
+			c.log.Warningf("Invalid CA registered for tenant %s", ca.TenantID)
+			continue
+		}
+
+		pool.AddCert(certs[0])
+		tenants[string(certs[0].Raw)] = ca.TenantID
+	}
+
+	s.pool = pool
+	s.tenants = tenants
+	s.gen = gen
+	s.built = true
+}
+
+// clientCAPool returns the current pool of client CAs.
+func (c *controller) clientCAPool() *x509.CertPool {
+	c.clientCAs.Lock()
+	defer c.clientCAs.Unlock()
+
+	c.refreshClientCAs()
+
+	return c.clientCAs.pool
+}
+
+// certTenant returns the tenant whose CA signed a verified certificate
+// chain, or an empty string if it was signed by the global client CA.  A
+// chain signed by a CA which is no longer trusted, e.g., a tenant CA
+// revoked after the connection was established, is reported as untrusted.
+func (c *controller) certTenant(chain []*x509.Certificate) (string, bool) {
+	c.clientCAs.Lock()
+	defer c.clientCAs.Unlock()
+
+	c.refreshClientCAs()
+
+	root := chain[len(chain)-1]
+	if tenantID, ok := c.clientCAs.tenants[string(root.Raw)]; ok {
+		return tenantID, true
+	}
+
+	for _, cert := range c.clientCAs.global {
+		if bytes.Equal(cert.Raw, root.Raw) {
+			return "", true
+		}
+	}
+
+	return "", false
+}
+
+// clientCATLSConfig returns a TLS configuration which only accepts client
+// certificates signed by the current set of client CAs.  The pool is
+// looked up on each handshake so that changes to the tenant CAs apply to
+// new connections immediately.  Connections without a certificate are
+// accepted for the sake of signed URLs, the other routes refuse their
+// requests.  The server certificate is also looked up on each handshake.
+func (c *controller) clientCATLSConfig() *tls.Config {
+	config := &tls.Config{
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		GetCertificate: c.serverCertificate,
+	}
+
+	server := config.Clone()
+	server.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		handshake := config.Clone()
+		handshake.ClientCAs = c.clientCAPool()
+		return handshake, nil
+	}
+
+	return server
+}
+
+// ShowTenantCA returns the client CA registered for a tenant.
+func (c *controller) ShowTenantCA(tenantID string) (types.TenantCA, error) {
+	return c.ds.GetTenantCA(tenantID)
+}
+
+// UpdateTenantCA registers the CA which signs the client certificates of
+// the users of a tenant, replacing any CA registered before.  A CA may
+// only be registered for a single tenant.
+func (c *controller) UpdateTenantCA(tenantID string, req types.TenantCARequest) (types.TenantCA, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantCA{}, err
+	}
+
+	if tenant == nil {
+		return types.TenantCA{}, types.ErrTenantNotFound
+	}
+
+	certs, err := parseCertificates([]byte(req.Certificate))
+	if err != nil || len(certs) != 1 {
+		return types.TenantCA{}, types.ErrBadRequest
+	}
+
+	cert := certs[0]
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return types.TenantCA{}, types.ErrBadRequest
+	}
+
+	// neither the global CA nor the CA of another tenant may be
+	// registered
+	owner, trusted := c.certTenant([]*x509.Certificate{cert})
+	if trusted && owner != tenantID {
+		return types.TenantCA{}, types.ErrBadRequest
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	ca := types.TenantCA{
+		TenantID:    tenantID,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		Subject:     cert.Subject.String(),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotAfter:    cert.NotAfter,
+		CreateTime:  time.Now(),
+	}
+
+	err = c.ds.UpdateTenantCA(ca)
+	if err != nil {
+		return types.TenantCA{}, err
+	}
+
+	return ca, nil
+}
+
+// DeleteTenantCA revokes the client CA of a tenant.  Certificates signed by
+// it are refused from then on, even on established connections.
+func (c *controller) DeleteTenantCA(tenantID string) error {
+	return c.ds.DeleteTenantCA(tenantID)
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64 = 100
+
+func createTestCA(t *testing.T, cn string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+// clientCert returns a client certificate for user signed by the CA and
+// claiming membership of tenants.
+func (ca testCA) clientCert(t *testing.T, user string, tenants []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: user, Organization: tenants},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func certClient(cert tls.Certificate) *http.Client {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+// certGet makes a GET request with client and returns the status, or 0 if
+// the TLS handshake was refused.
+func certGet(t *testing.T, client *http.Client, url string) int {
+	return certRequest(t, client, "GET", url, nil)
+}
+
+// certRequest makes a request with client and header and returns the
+// status, or 0 if the TLS handshake was refused.
+func certRequest(t *testing.T, client *http.Client, method string, url string, header http.Header) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	_, _ = ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode
+}
+
+func registerTestTenantCA(t *testing.T, tenantID string, ca testCA, status int) {
+	b, err := json.Marshal(types.TenantCARequest{Certificate: ca.pem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants/" + tenantID + "/ca"
+	_ = testHTTPRequest(t, "PUT", url, status, b, true)
+}
+
+func TestTenantCAIsolation(t *testing.T) {
+	tenantA, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantB, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caA := createTestCA(t, "tenant A CA")
+	caB := createTestCA(t, "tenant B CA")
+
+	userA := certClient(caA.clientCert(t, "user-a", []string{tenantA.ID}))
+	userB := certClient(caB.clientCert(t, "user-b", nil))
+	impostor := certClient(caA.clientCert(t, "impostor", []string{tenantB.ID}))
+	admin := certClient(caA.clientCert(t, "admin", []string{"admin"}))
+
+	eventsA := testutil.ComputeURL + "/" + tenantA.ID + "/events"
+	eventsB := testutil.ComputeURL + "/" + tenantB.ID + "/events"
+
+	// certificates signed by an unregistered CA are not offered by the
+	// client, whose request is refused as it has no certificate
+	if status := certGet(t, certClient(caA.clientCert(t, "user-a", []string{tenantA.ID})), eventsA); status != http.StatusUnauthorized {
+		t.Fatalf("Expected request to be refused before registration: %d", status)
+	}
+
+	registerTestTenantCA(t, tenantA.ID, caA, http.StatusCreated)
+	registerTestTenantCA(t, tenantB.ID, caB, http.StatusCreated)
+
+	// a CA may only be registered for one tenant
+	registerTestTenantCA(t, tenantB.ID, caA, http.StatusForbidden)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+		status int
+	}{
+		{"user-a own tenant", userA, eventsA, http.StatusOK},
+		{"user-a other tenant", userA, eventsB, http.StatusUnauthorized},
+		{"user-b own tenant", userB, eventsB, http.StatusOK},
+		{"user-b other tenant", userB, eventsA, http.StatusUnauthorized},
+		{"impostor claimed tenant", impostor, eventsB, http.StatusUnauthorized},
+		{"impostor CA tenant", impostor, eventsA, http.StatusUnauthorized},
+		{"tenant CA admin", admin, testutil.ComputeURL + "/events", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if status := certGet(t, tt.client, tt.url); status != tt.status {
+			t.Errorf("%s: expected %d got %d", tt.name, tt.status, status)
+		}
+	}
+
+	body := testHTTPRequest(t, "GET", testutil.ComputeURL+"/tenants/"+tenantA.ID+"/ca", http.StatusOK, nil, true)
+
+	var ca types.TenantCA
+	err = json.Unmarshal(body, &ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.TenantID != tenantA.ID || ca.Subject != "CN=tenant A CA" || ca.Fingerprint == "" {
+		t.Errorf("Unexpected tenant CA: %+v", ca)
+	}
+
+	// revocation applies to established connections and new handshakes
+	_ = testHTTPRequest(t, "DELETE", testutil.ComputeURL+"/tenants/"+tenantA.ID+"/ca", http.StatusNoContent, nil, true)
+
+	if status := certGet(t, userA, eventsA); status != http.StatusUnauthorized {
+		t.Errorf("Expected revoked CA to be refused on established connection: %d", status)
+	}
+
+	if status := certGet(t, certClient(caA.clientCert(t, "user-a", nil)), eventsA); status != http.StatusUnauthorized {
+		t.Errorf("Expected new connection with revoked CA to be refused: %d", status)
+	}
+
+	if status := certGet(t, userB, eventsB); status != http.StatusOK {
+		t.Errorf("Revocation affected another tenant: %d", status)
+	}
+
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/tenants/"+tenantA.ID+"/ca", http.StatusNotFound, nil, true)
+	_ = testHTTPRequest(t, "DELETE", testutil.ComputeURL+"/tenants/"+tenantB.ID+"/ca", http.StatusNoContent, nil, true)
+}
+
+func TestTenantCAInvalid(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := createTestCA(t, "not a CA")
+	ca.cert.IsCA = false
+	leaf := ca.clientCert(t, "user", nil)
+
+	url := testutil.ComputeURL + "/tenants/" + tenant.ID + "/ca"
+
+	for _, cert := range []string{
+		"",
+		"not a certificate",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]})),
+	} {
+		b, err := json.Marshal(types.TenantCARequest{Certificate: cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = testHTTPRequest(t, "PUT", url, http.StatusForbidden, b, true)
+	}
+
+	global, err := ioutil.ReadFile(clientCertCAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(types.TenantCARequest{Certificate: string(global)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "PUT", url, http.StatusForbidden, b, true)
+}
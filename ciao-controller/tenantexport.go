@@ -0,0 +1,399 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// ExportTenant returns the definitions of a tenant which are needed to
+// recreate it on another cluster.  Only the limits of the tenant's quotas
+// are exported, not their usage.
+func (c *controller) ExportTenant(tenantID string) (types.TenantExport, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantExport{}, err
+	}
+	if t == nil {
+		return types.TenantExport{}, types.ErrTenantNotFound
+	}
+
+	qds, err := c.ds.GetQuotas(tenantID)
+	if err != nil {
+		return types.TenantExport{}, err
+	}
+	for i := range qds {
+		qds[i].Usage = 0
+	}
+
+	wls, err := c.ds.GetTenantWorkloads(tenantID)
+	if err != nil {
+		return types.TenantExport{}, err
+	}
+
+	export := types.TenantExport{
+		Version:   types.TenantExportVersion,
+		ID:        t.ID,
+		Config:    t.TenantConfig,
+		Quotas:    qds,
+		Workloads: []types.Workload{},
+		Templates: []types.LaunchTemplateRequest{},
+	}
+
+	for _, wl := range wls {
+		if wl.Visibility != types.Private || wl.TenantID != tenantID {
+			continue
+		}
+		export.Workloads = append(export.Workloads, wl)
+	}
+
+	for _, lt := range c.ds.GetLaunchTemplates(tenantID) {
+		export.Templates = append(export.Templates, types.LaunchTemplateRequest{
+			Name:    lt.Name,
+			Request: lt.Request,
+		})
+	}
+
+	return export, nil
+}
+
+// tenantImport tracks the import of a tenant export.  Each class of objects
+// is validated against the cluster and against the classes imported before
+// it, and is only applied if none of its objects conflict.
+type tenantImport struct {
+	c            *controller
+	req          types.TenantExport
+	validateOnly bool
+
+	// tenantReady is true if the tenant exists, or would exist were the
+	// import applied.
+	tenantReady bool
+
+	// workloads are the imported workloads which exist, or would exist
+	// were the import applied, indexed by ID.
+	workloads map[string]types.Workload
+}
+
+func conflict(name string, err error) types.TenantImportConflict {
+	return types.TenantImportConflict{Name: name, Reason: err.Error()}
+}
+
+func (ti *tenantImport) importTenant() types.TenantImportClassResult {
+	res := types.TenantImportClassResult{Class: types.TenantImportTenant, Count: 1}
+	config := ti.req.Config
+	config.Frozen = false
+	config.FreezeReason = ""
+
+	if t, _ := ti.c.ds.GetTenant(ti.req.ID); t != nil {
+		if !sameTenantConfig(t, config) {
+			res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, types.ErrTenantExists))
+		}
+
+		// the classes which follow are imported into the existing
+		// tenant
+		ti.tenantReady = true
+		return res
+	}
+
+	if config.SubnetBits != 0 && (config.SubnetBits < 12 || config.SubnetBits > 30) {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, fmt.Errorf("Invalid subnet bits %d", config.SubnetBits)))
+	}
+	if config.MaxSubnets < 0 {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, fmt.Errorf("Invalid max subnets %d", config.MaxSubnets)))
+	}
+	if len(res.Conflicts) > 0 || ti.validateOnly {
+		ti.tenantReady = len(res.Conflicts) == 0
+		return res
+	}
+
+	_, _, err := ti.c.CreateTenant(types.TenantRequest{ID: ti.req.ID, Config: config})
+	if err != nil {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, err))
+		return res
+	}
+
+	ti.tenantReady = true
+	res.Applied = true
+	return res
+}
+
+// tenantMissing returns true if the class has objects but the tenant they
+// belong to was not imported.
+func (ti *tenantImport) tenantMissing(res types.TenantImportClassResult) bool {
+	return !ti.tenantReady && res.Count > 0
+}
+
+func (ti *tenantImport) importQuotas() types.TenantImportClassResult {
+	res := types.TenantImportClassResult{Class: types.TenantImportQuotas, Count: len(ti.req.Quotas)}
+	if ti.tenantMissing(res) {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, types.ErrTenantNotFound))
+		return res
+	}
+
+	for _, q := range ti.req.Quotas {
+		if !quotas.ValidName(q.Name) || q.Value < -1 {
+			res.Conflicts = append(res.Conflicts, conflict(q.Name, fmt.Errorf("Invalid quota %s: %d", q.Name, q.Value)))
+		}
+	}
+	if len(res.Conflicts) > 0 || ti.validateOnly || res.Count == 0 {
+		return res
+	}
+
+	if err := ti.c.updateQuotas(ti.req.ID, ti.req.Quotas); err != nil {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, err))
+		return res
+	}
+
+	res.Applied = true
+	return res
+}
+
+func (ti *tenantImport) validateWorkload(wl *types.Workload) error {
+	if _, err := uuid.Parse(wl.ID); err != nil {
+		return types.ErrBadRequest
+	}
+
+	if wl.Visibility != types.Private {
+		return fmt.Errorf("Workload is not private")
+	}
+
+	if _, err := ti.c.ds.GetWorkload(wl.ID); err == nil {
+		return fmt.Errorf("Workload %s already exists", wl.ID)
+	}
+
+	if _, ok := ti.workloads[wl.ID]; ok {
+		return fmt.Errorf("Workload %s is exported more than once", wl.ID)
+	}
+
+	// validateWorkloadRequest expects a new workload without an ID.  A
+	// tenant which does not exist yet has no images or volumes of its
+	// own so its workloads can only use public ones.
+	id, tenantID := wl.ID, wl.TenantID
+	wl.ID = ""
+	if t, _ := ti.c.ds.GetTenant(tenantID); t == nil {
+		wl.TenantID = ""
+	}
+	err := ti.c.validateWorkloadRequest(wl)
+	wl.ID, wl.TenantID = id, tenantID
+	if err != nil {
+		return err
+	}
+
+	return ti.c.policyDenies(wl)
+}
+
+func (ti *tenantImport) importWorkloads() types.TenantImportClassResult {
+	res := types.TenantImportClassResult{Class: types.TenantImportWorkloads, Count: len(ti.req.Workloads)}
+	if ti.tenantMissing(res) {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, types.ErrTenantNotFound))
+		return res
+	}
+
+	var valid []types.Workload
+	for _, wl := range ti.req.Workloads {
+		wl.TenantID = ti.req.ID
+		name := wl.ID
+		if wl.Description != "" {
+			name = wl.Description
+		}
+
+		if err := ti.validateWorkload(&wl); err != nil {
+			res.Conflicts = append(res.Conflicts, conflict(name, err))
+			continue
+		}
+
+		ti.workloads[wl.ID] = wl
+		valid = append(valid, wl)
+	}
+
+	if len(res.Conflicts) > 0 {
+		for _, wl := range valid {
+			delete(ti.workloads, wl.ID)
+		}
+		return res
+	}
+	if ti.validateOnly || res.Count == 0 {
+		return res
+	}
+
+	var added []string
+	for _, wl := range valid {
+		err := ti.c.ds.AddWorkload(wl)
+		if err != nil {
+			res.Conflicts = append(res.Conflicts, conflict(wl.ID, err))
+			break
+		}
+		added = append(added, wl.ID)
+	}
+
+	if len(res.Conflicts) > 0 {
+		for _, id := range added {
+			if err := ti.c.ds.DeleteWorkload(id); err != nil {
+				ti.c.log.Warningf("Unable to remove imported workload %s: %v", id, err)
+			}
+		}
+		for _, wl := range valid {
+			delete(ti.workloads, wl.ID)
+		}
+		return res
+	}
+
+	res.Applied = true
+	return res
+}
+
+func (ti *tenantImport) validateTemplate(lt types.LaunchTemplateRequest, names map[string]bool) error {
+	if !launchTemplateNameRegexp.MatchString(lt.Name) {
+		return types.ErrBadName
+	}
+
+	if _, err := ti.c.ds.GetLaunchTemplate(ti.req.ID, lt.Name); err == nil {
+		return types.ErrLaunchTemplateExists
+	}
+
+	if names[lt.Name] {
+		return fmt.Errorf("Launch template %s is exported more than once", lt.Name)
+	}
+
+	req, err := decodeLaunchRequest(lt.Request)
+	if err != nil {
+		return err
+	}
+
+	if err := validateServerRequest(req); err != nil {
+		return &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	// the template may use a workload imported along with it
+	wl, ok := ti.workloads[req.Server.WorkloadID]
+	if !ok {
+		wl, err = ti.c.ShowWorkload(ti.req.ID, req.Server.WorkloadID)
+		if err != nil {
+			return &types.LaunchRequestError{Reason: err.Error()}
+		}
+	}
+
+	if _, err := applyOverrides(wl, serverOverrides(req)); err != nil {
+		return &types.LaunchRequestError{Reason: err.Error()}
+	}
+
+	return nil
+}
+
+func (ti *tenantImport) importTemplates() types.TenantImportClassResult {
+	res := types.TenantImportClassResult{Class: types.TenantImportTemplates, Count: len(ti.req.Templates)}
+	if ti.tenantMissing(res) {
+		res.Conflicts = append(res.Conflicts, conflict(ti.req.ID, types.ErrTenantNotFound))
+		return res
+	}
+
+	names := make(map[string]bool)
+	for _, lt := range ti.req.Templates {
+		if err := ti.validateTemplate(lt, names); err != nil {
+			res.Conflicts = append(res.Conflicts, conflict(lt.Name, err))
+		}
+		names[lt.Name] = true
+	}
+	if len(res.Conflicts) > 0 || ti.validateOnly || res.Count == 0 {
+		return res
+	}
+
+	now := time.Now()
+	var added []string
+	for _, lt := range ti.req.Templates {
+		err := ti.c.ds.AddLaunchTemplate(types.LaunchTemplate{
+			TenantID:   ti.req.ID,
+			Name:       lt.Name,
+			Version:    1,
+			Request:    lt.Request,
+			CreateTime: now,
+			UpdateTime: now,
+		})
+		if err != nil {
+			res.Conflicts = append(res.Conflicts, conflict(lt.Name, err))
+			break
+		}
+		added = append(added, lt.Name)
+	}
+
+	if len(res.Conflicts) > 0 {
+		for _, name := range added {
+			if err := ti.c.ds.DeleteLaunchTemplate(ti.req.ID, name); err != nil {
+				ti.c.log.Warningf("Unable to remove imported launch template %s: %v", name, err)
+			}
+		}
+		return res
+	}
+
+	res.Applied = true
+	return res
+}
+
+// ImportTenant recreates a tenant from an export taken on another cluster.
+// The tenant, its quotas, its workloads and its launch templates are
+// imported in turn; the objects of each class are imported together or, if
+// any conflict with the objects on the cluster, not at all.  Workloads keep
+// their IDs so that the launch templates which use them remain valid.  If
+// validateOnly is true the export is checked but nothing is changed.
+func (c *controller) ImportTenant(req types.TenantExport, validateOnly bool) (types.TenantImportResponse, error) {
+	if req.Version != types.TenantExportVersion {
+		return types.TenantImportResponse{}, types.ErrBadTenantExport
+	}
+
+	tuuid, err := uuid.Parse(req.ID)
+	if err != nil {
+		return types.TenantImportResponse{}, types.ErrBadTenantExport
+	}
+	req.ID = tuuid.String()
+
+	ti := tenantImport{
+		c:            c,
+		req:          req,
+		validateOnly: validateOnly,
+		workloads:    make(map[string]types.Workload),
+	}
+
+	resp := types.TenantImportResponse{
+		TenantID:     req.ID,
+		ValidateOnly: validateOnly,
+		Classes: []types.TenantImportClassResult{
+			ti.importTenant(),
+			ti.importQuotas(),
+			ti.importWorkloads(),
+			ti.importTemplates(),
+		},
+	}
+
+	if !validateOnly {
+		var applied []string
+		for _, class := range resp.Classes {
+			if class.Applied {
+				applied = append(applied, class.Class)
+			}
+		}
+		if len(applied) > 0 {
+			msg := fmt.Sprintf("Tenant %s imported: %v", req.ID, applied)
+			_ = c.ds.LogEvent(req.ID, msg)
+			c.log.Infof("%s", msg)
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+const exportTestImageID = "2a8e1d41-6f0c-4b3e-9a57-1c2d3e4f5a6b"
+
+// newExportTestController returns a controller with its own in memory
+// datastore, standing in for the controller of another cluster.
+func newExportTestController(t *testing.T, name string) (*controller, func()) {
+	c := new(controller)
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	c.log = gloginterface.CiaoGlogLogger{}
+	c.tenantReadiness = make(map[string]*tenantConfirmMemo)
+	c.metrics = newControllerMetrics(defaultConfig().MetricsMaxTenants, defaultConfig().QuotaDenialWindow, time.Now)
+	c.ds = new(datastore.Datastore)
+	c.qs = new(quotas.Quotas)
+
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.ds.Init(datastore.Config{
+		PersistentURI:     "file:" + name + "?mode=memory&cache=shared",
+		InitWorkloadsPath: dir,
+	})
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	c.qs.Init()
+
+	// images are not exported so both clusters need the image the
+	// workloads boot from
+	err = c.ds.AddImage(types.Image{
+		ID:         exportTestImageID,
+		Name:       "export-test-image",
+		State:      types.Active,
+		Visibility: types.Public,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.stop()
+		c.ds.Exit()
+		c.qs.Shutdown()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func addExportTestTenant(t *testing.T, c *controller) types.TenantExport {
+	req := types.TenantRequest{
+		ID: uuid.Generate().String(),
+		Quotas: []types.QuotaDetails{
+			{Name: "tenant-instances-quota", Value: 10},
+			{Name: "tenant-vcpu-per-instance-limit", Value: 4},
+		},
+	}
+	req.Config.Name = "exported"
+	req.Config.SubnetBits = 26
+	req.Config.MaxSubnets = 2
+	req.Config.TrashRetentionMinutes = 60
+
+	_, _, err := c.CreateTenant(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := c.CreateWorkload(types.Workload{
+		TenantID:    req.ID,
+		Description: "exported vm",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "---\n...\n",
+		Visibility:  types.Private,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Bounds: &types.WorkloadBounds{MaxVCPUs: 4},
+		Storage: []types.StorageResource{
+			{Bootable: true, Size: 10, SourceType: types.ImageService, Source: "export-test-image"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.CreateWorkload(types.Workload{
+		TenantID:    req.ID,
+		Description: "exported container",
+		VMType:      payloads.Docker,
+		ImageName:   "ubuntu:latest",
+		Config:      "---\n...\n",
+		Visibility:  types.Private,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 1,
+			MemMB: 128,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.CreateLaunchTemplate(req.ID, types.LaunchTemplateRequest{
+		Name:    "web",
+		Request: json.RawMessage(`{"server":{"workload_id":"` + vm.ID + `","max_count":1,"min_count":1,"vcpus":4}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := c.ExportTenant(req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return export
+}
+
+func exportDocument(t *testing.T, export types.TenantExport) []byte {
+	b, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func checkImportResult(t *testing.T, resp types.TenantImportResponse, applied bool, conflicts map[string]int) {
+	for _, class := range resp.Classes {
+		if len(class.Conflicts) != conflicts[class.Class] {
+			t.Errorf("Expected %d conflicts for %s, got %+v", conflicts[class.Class], class.Class, class.Conflicts)
+		}
+		if class.Applied && (!applied || len(class.Conflicts) > 0) {
+			t.Errorf("Class %s applied unexpectedly", class.Class)
+		}
+	}
+}
+
+func TestTenantExportImportRoundTrip(t *testing.T) {
+	src, srcDone := newExportTestController(t, "memdb_export_src")
+	defer srcDone()
+	dst, dstDone := newExportTestController(t, "memdb_export_dst")
+	defer dstDone()
+
+	export := addExportTestTenant(t, src)
+	if len(export.Workloads) != 2 || len(export.Templates) != 1 || len(export.Quotas) != 2 {
+		t.Fatalf("Incomplete export: %+v", export)
+	}
+
+	// the export is a self contained document
+	var doc types.TenantExport
+	if err := json.Unmarshal(exportDocument(t, export), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := dst.ImportTenant(doc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.ValidateOnly {
+		t.Errorf("Import not reported as validate only")
+	}
+	checkImportResult(t, resp, false, nil)
+	if tenant, _ := dst.ds.GetTenant(doc.ID); tenant != nil {
+		t.Fatal("Tenant created by validate only import")
+	}
+
+	resp, err = dst.ImportTenant(doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImportResult(t, resp, true, nil)
+	for _, class := range resp.Classes {
+		if !class.Applied {
+			t.Errorf("Class %s not applied", class.Class)
+		}
+	}
+
+	imported, err := dst.ExportTenant(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(exportDocument(t, imported), exportDocument(t, export)) {
+		t.Fatalf("Imported tenant differs from exported tenant:\n%s\n%s",
+			exportDocument(t, imported), exportDocument(t, export))
+	}
+
+	// the imported quotas are enforced
+	for _, q := range dst.ListQuotas(doc.ID) {
+		if q.Name == "tenant-instances-quota" && q.Value != 10 {
+			t.Errorf("Imported quota not applied: %+v", q)
+		}
+	}
+
+	// importing again conflicts with the workloads and templates
+	// already imported
+	resp, err = dst.ImportTenant(doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImportResult(t, resp, true, map[string]int{
+		types.TenantImportWorkloads: 2,
+		types.TenantImportTemplates: 1,
+	})
+}
+
+func TestTenantImportConflicts(t *testing.T) {
+	src, srcDone := newExportTestController(t, "memdb_conflict_src")
+	defer srcDone()
+	dst, dstDone := newExportTestController(t, "memdb_conflict_dst")
+	defer dstDone()
+
+	export := addExportTestTenant(t, src)
+
+	// a workload ID already used on the target cluster blocks the
+	// import of all the workloads, and so of the template using one
+	wl := export.Workloads[1]
+	wl.TenantID = ""
+	wl.Visibility = types.Public
+	if err := dst.ds.AddWorkload(wl); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := dst.ImportTenant(export, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImportResult(t, resp, true, map[string]int{
+		types.TenantImportWorkloads: 1,
+		types.TenantImportTemplates: 1,
+	})
+
+	if _, err := dst.ds.GetWorkload(export.Workloads[0].ID); err == nil {
+		t.Errorf("Workload imported despite conflict")
+	}
+	if templates := dst.ds.GetLaunchTemplates(export.ID); len(templates) != 0 {
+		t.Errorf("Launch templates imported despite conflict: %+v", templates)
+	}
+	if tenant, _ := dst.ds.GetTenant(export.ID); tenant == nil {
+		t.Errorf("Tenant not imported")
+	}
+
+	// the tenant must be importable in its own right
+	bad := export
+	bad.Config.SubnetBits = 8
+	bad.ID = uuid.Generate().String()
+	resp, err = dst.ImportTenant(bad, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, class := range resp.Classes {
+		if len(class.Conflicts) == 0 {
+			t.Errorf("Expected conflict for %s", class.Class)
+		}
+	}
+
+	bad = export
+	bad.Version = types.TenantExportVersion + 1
+	if _, err := dst.ImportTenant(bad, true); err != types.ErrBadTenantExport {
+		t.Errorf("Expected %v, got %v", types.ErrBadTenantExport, err)
+	}
+}
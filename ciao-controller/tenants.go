@@ -15,12 +15,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
 	"sync"
 
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/uuid"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
@@ -55,15 +62,41 @@ func (c *controller) ListTenants() ([]types.TenantSummary, error) {
 	return summary, nil
 }
 
-func (c *controller) ShowTenant(tenantID string) (types.TenantConfig, error) {
-	var config types.TenantConfig
-
+func (c *controller) ShowTenant(tenantID string) (types.TenantDetails, error) {
 	tenant, err := c.ds.GetTenant(tenantID)
 	if err != nil {
-		return config, err
+		return types.TenantDetails{}, err
 	}
 
-	return tenant.TenantConfig, err
+	return types.TenantDetails{
+		TenantConfig:      tenant.TenantConfig,
+		EffectiveCNCISize: c.effectiveCNCISize(tenant.TenantConfig),
+	}, nil
+}
+
+// effectiveCNCISize returns the size of the CNCIs launched for a tenant,
+// which is the cluster's CNCI size where the tenant does not override it.
+func (c *controller) effectiveCNCISize(config types.TenantConfig) types.CNCISize {
+	cfg := c.config.config()
+	size := types.CNCISize{
+		VCPUs:  cfg.CNCIVcpus,
+		MemMB:  cfg.CNCIMem,
+		DiskMB: cfg.CNCIDisk,
+	}
+
+	if o := config.CNCISize; o != nil {
+		if o.VCPUs != 0 {
+			size.VCPUs = o.VCPUs
+		}
+		if o.MemMB != 0 {
+			size.MemMB = o.MemMB
+		}
+		if o.DiskMB != 0 {
+			size.DiskMB = o.DiskMB
+		}
+	}
+
+	return size
 }
 
 func (c *controller) PatchTenant(tenantID string, patch []byte) error {
@@ -71,45 +104,154 @@ func (c *controller) PatchTenant(tenantID string, patch []byte) error {
 	return c.ds.JSONPatchTenant(tenantID, patch)
 }
 
-func (c *controller) CreateTenant(tenantID string, config types.TenantConfig) (types.TenantSummary, error) {
+// sameTenantConfig reports whether an existing tenant was created with the
+// configuration requested by config.
+func sameTenantConfig(t *types.Tenant, config types.TenantConfig) bool {
+	return t.Name == config.Name &&
+		t.SubnetBits == config.SubnetBits &&
+		t.Permissions == config.Permissions &&
+		t.PreprovisionNetwork == config.PreprovisionNetwork &&
+		t.TrashRetentionMinutes == config.TrashRetentionMinutes &&
+		t.DeferredDeleteMinutes == config.DeferredDeleteMinutes &&
+		t.MaxSubnets == config.MaxSubnets &&
+		reflect.DeepEqual(t.CNCISize, config.CNCISize)
+}
+
+func (c *controller) tenantRecord(tenant *types.Tenant) types.TenantRecord {
+	qds := c.qs.DumpQuotas(tenant.ID)
+	sort.Slice(qds, func(i, j int) bool {
+		return qds[i].Name < qds[j].Name
+	})
+
+	tr := types.TenantRecord{
+		ID:     tenant.ID,
+		Name:   tenant.Name,
+		Config: tenant.TenantConfig,
+		Quotas: qds,
+	}
+
+	ref := fmt.Sprintf("%s/tenants/%s", c.apiURL, tenant.ID)
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+	tr.Links = append(tr.Links, link)
+
+	return tr
+}
+
+// existingTenant returns the record of a tenant being created again.  The
+// creation is only idempotent if the tenant was created with the same
+// configuration.
+func (c *controller) existingTenant(tenantID string, config types.TenantConfig) (types.TenantRecord, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil || tenant == nil {
+		return types.TenantRecord{}, types.ErrTenantExists
+	}
+
+	if !sameTenantConfig(tenant, config) {
+		return types.TenantRecord{}, types.ErrTenantExists
+	}
+
+	return c.tenantRecord(tenant), nil
+}
+
+// CreateTenant creates a tenant with its initial quotas.  Creating a tenant
+// whose ID is already in use with the same configuration returns the
+// existing tenant so that the request can safely be retried, the returned
+// bool is only true if the tenant was created.  Tenant names need not be
+// unique, a warning is returned if the name is already in use.
+func (c *controller) CreateTenant(req types.TenantRequest) (types.TenantRecord, bool, error) {
+	config := req.Config
+
+	if req.ID == "" {
+		req.ID = uuid.Generate().String()
+	}
+
 	// tenant ID must be a UUID4
-	tuuid, err := uuid.Parse(tenantID)
+	tuuid, err := uuid.Parse(req.ID)
 	if err != nil {
-		return types.TenantSummary{}, err
+		return types.TenantRecord{}, false, types.ErrBadRequest
 	}
+	tenantID := tuuid.String()
 
 	// SubnetBits must be between 12 and 30
 	if config.SubnetBits == 0 {
 		config.SubnetBits = 24
 	} else {
 		if config.SubnetBits < 12 || config.SubnetBits > 30 {
-			return types.TenantSummary{}, errors.New("subnet bits must be between 12 and 30")
+			return types.TenantRecord{}, false, types.ErrBadRequest
+		}
+	}
+
+	if config.MaxSubnets < 0 || config.DeferredDeleteMinutes < 0 {
+		return types.TenantRecord{}, false, types.ErrBadRequest
+	}
+
+	if size := config.CNCISize; size != nil {
+		if size.VCPUs < 0 || size.MemMB < 0 || size.DiskMB < 0 {
+			return types.TenantRecord{}, false, types.ErrBadRequest
+		}
+
+		if *size == (types.CNCISize{}) {
+			config.CNCISize = nil
 		}
 	}
 
-	tenant, err := c.ds.AddTenant(tuuid.String(), config)
+	for _, q := range req.Quotas {
+		if !quotas.ValidName(q.Name) || q.Value < -1 {
+			return types.TenantRecord{}, false, types.ErrBadRequest
+		}
+	}
+
+	// a tenant is never created frozen
+	config.Frozen = false
+	config.FreezeReason = ""
+
+	if t, _ := c.ds.GetTenant(tenantID); t != nil {
+		tr, err := c.existingTenant(tenantID, config)
+		return tr, false, err
+	}
+
+	var warnings []string
+	tenants, err := c.ds.GetAllTenants()
 	if err != nil {
-		return types.TenantSummary{}, err
+		return types.TenantRecord{}, false, err
+	}
+	for _, t := range tenants {
+		if config.Name != "" && t.Name == config.Name {
+			warning := fmt.Sprintf("Tenant name %s is already used by tenant %s", config.Name, t.ID)
+			c.log.Warningf("Creating tenant %s: %s", tenantID, warning)
+			warnings = append(warnings, warning)
+		}
 	}
 
+	tenant, err := c.ds.AddTenant(tenantID, config, req.Quotas...)
+	if err == datastore.ErrDuplicateTenant {
+		tr, err := c.existingTenant(tenantID, config)
+		return tr, false, err
+	} else if err != nil {
+		return types.TenantRecord{}, false, err
+	}
+
+	c.qs.Update(tenantID, req.Quotas)
+
 	tenant.CNCIctrl, err = newCNCIManager(c, tenantID)
 	if err != nil {
-		return types.TenantSummary{}, err
+		return types.TenantRecord{}, false, err
 	}
 
-	ts := types.TenantSummary{
-		ID:   tenant.ID,
-		Name: tenant.Name,
+	if config.PreprovisionNetwork {
+		_, err = c.PrepareTenantNetwork(tenant.ID, types.TenantNetworkPrepareRequest{})
+		if err != nil {
+			c.log.Warningf("Unable to prepare network of tenant %s: %v", tenant.ID, err)
+		}
 	}
 
-	ref := fmt.Sprintf("%s/tenants/%s", c.apiURL, tenant.ID)
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
-	}
-	ts.Links = append(ts.Links, link)
+	tr := c.tenantRecord(tenant)
+	tr.Warnings = warnings
 
-	return ts, nil
+	return tr, true, nil
 }
 
 func (c *controller) deleteCNCIInstances(tenantID string) error {
@@ -136,7 +278,7 @@ func (c *controller) deleteCNCIInstances(tenantID string) error {
 			if err != nil {
 				// remove directly.
 				c.client.RemoveInstance(ID)
-				glog.Warningf("Unable to remove tenant cnci: %v", err)
+				clogger.With(c.log, "tenant", tenantID, "instance", ID).Warningf("Unable to remove tenant cnci: %v", err)
 				// keep going.
 			}
 			return
@@ -149,7 +291,7 @@ func (c *controller) deleteCNCIInstances(tenantID string) error {
 	return nil
 }
 
-func (c *controller) deleteInstances(tenantID string) error {
+func (c *controller) deleteInstances(ctx context.Context, tenantID string) error {
 	// remove any external IPs
 	ips := c.ListMappedAddresses(&tenantID)
 	for _, addr := range ips {
@@ -170,11 +312,11 @@ func (c *controller) deleteInstances(tenantID string) error {
 	for _, i := range instances {
 		wg.Add(1)
 		go func(ID string) {
-			err := c.deleteInstanceSync(ID)
+			err := c.deleteInstanceSync(ctx, ID)
 			if err != nil {
 				// remove directly.
 				c.client.RemoveInstance(ID)
-				glog.Warningf("Unable to remove tenant instance: %v", err)
+				clogger.With(c.log, "tenant", tenantID, "instance", ID).Warningf("Unable to remove tenant instance: %v", err)
 			}
 			wg.Done()
 		}(i.ID)
@@ -185,22 +327,119 @@ func (c *controller) deleteInstances(tenantID string) error {
 	return nil
 }
 
-// DeleteTenant will remove any object associated with this tenant.
-// at this point we can assume the admin has already
-// revoked the tenant's certificate. So no more
-// activity can happen for this tenant while this
-// command is going.
-func (c *controller) DeleteTenant(tenantID string) error {
-	err := c.deleteInstances(tenantID)
+// tenantDeletions tracks the tenants being deleted so that a tenant is
+// only deleted once at a time.
+type tenantDeletions struct {
+	sync.Mutex
+	tenants map[string]bool
+}
+
+func (d *tenantDeletions) add(tenantID string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.tenants == nil {
+		d.tenants = make(map[string]bool)
+	}
+
+	if d.tenants[tenantID] {
+		return false
+	}
+
+	d.tenants[tenantID] = true
+
+	return true
+}
+
+func (d *tenantDeletions) remove(tenantID string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.tenants, tenantID)
+}
+
+// DeleteTenant starts an operation which removes any object associated
+// with this tenant.  At this point we can assume the admin has already
+// revoked the tenant's certificate. So no more activity can happen for
+// this tenant while the operation runs.  A tenant which still has
+// instances, or which owns instances or volumes protected from deletion,
+// is only deleted if force is set.
+func (c *controller) DeleteTenant(ctx context.Context, tenantID string, force bool) (types.Operation, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.Operation{}, errors.Wrap(err, "Unable to remove tenant")
+	}
+	if tenant == nil {
+		return types.Operation{}, types.ErrTenantNotFound
+	}
+
+	instances, err := c.ds.GetAllInstancesFromTenant(tenantID)
+	if err != nil {
+		return types.Operation{}, errors.Wrap(err, "Unable to remove tenant")
+	}
+
+	if len(instances) > 0 && !force {
+		return types.Operation{}, types.ErrTenantHasInstances
+	}
+
+	protected, err := c.tenantProtectedResources(tenantID)
+	if err != nil {
+		return types.Operation{}, errors.Wrap(err, "Unable to remove tenant")
+	}
+
+	err = c.overrideDeletionProtection(ctx, tenantID, protected, force)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return types.Operation{}, errors.Wrap(err, "Unable to remove tenant")
+	}
+
+	// a pool without tenants may be used by any tenant
+	for _, p := range pools {
+		if len(p.Tenants) == 1 && p.Tenants[0] == tenantID {
+			return types.Operation{}, errors.Wrapf(types.ErrTenantOnlyPoolTenant, "Pool %s", p.ID)
+		}
+	}
+
+	if !c.tenantDeletions.add(tenantID) {
+		return types.Operation{}, types.ErrTenantDeleting
+	}
+
+	op, err := c.startOperation(tenantID, types.DeleteTenantOperation, tenantID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			defer c.tenantDeletions.remove(tenantID)
+			return tenantID, c.deleteTenant(ctx, tenantID, progress)
+		})
+	if err != nil {
+		c.tenantDeletions.remove(tenantID)
+		return types.Operation{}, err
+	}
+
+	return op, nil
+}
+
+// deleteTenant stops and removes the instances and CNCIs of a tenant,
+// releasing their external IPs, then removes its workloads, images, volumes
+// and everything else it owns before removing the tenant itself, with its
+// quotas and usage.
+func (c *controller) deleteTenant(ctx context.Context, tenantID string, progress operationProgress) error {
+	err := c.deleteInstances(ctx, tenantID)
 	if err != nil {
 		return err
 	}
 
+	progress(20)
+
 	err = c.deleteCNCIInstances(tenantID)
 	if err != nil {
 		return err
 	}
 
+	progress(40)
+
 	// remove any private workloads associated with this tenant.
 	workloads, err := c.ds.GetTenantWorkloads(tenantID)
 	if err != nil {
@@ -224,12 +463,14 @@ func (c *controller) DeleteTenant(tenantID string) error {
 		if i.Visibility == types.Public {
 			continue
 		}
-		err := c.DeleteImage(tenantID, i.ID)
+		err := c.DeleteImage(c.ctx, tenantID, i.ID)
 		if err != nil {
 			return errors.Wrap(err, "Unable to remove tenant")
 		}
 	}
 
+	progress(60)
+
 	// remove any storage for this tenant.
 	bds, err := c.ds.GetBlockDevices(tenantID)
 	if err != nil {
@@ -237,14 +478,157 @@ func (c *controller) DeleteTenant(tenantID string) error {
 	}
 
 	for _, bd := range bds {
-		err := c.DeleteBlockDevice(bd.ID)
+		err := c.removeVolumeSnapshots(c.ctx, bd)
+		if err != nil {
+			return errors.Wrap(err, "Unable to remove tenant")
+		}
+
+		err = c.DeleteBlockDevice(c.ctx, bd.ID)
 		if err != nil {
 			return errors.Wrap(err, "Unable to remove tenant")
 		}
 	}
 
+	progress(80)
+
+	for _, s := range c.ds.GetSnapshotSchedules(tenantID) {
+		err := c.ds.DeleteSnapshotSchedule(tenantID, s.ID)
+		if err != nil {
+			return errors.Wrap(err, "Unable to remove tenant")
+		}
+	}
+
+	for _, t := range c.ds.GetLaunchTemplates(tenantID) {
+		err := c.ds.DeleteLaunchTemplate(tenantID, t.Name)
+		if err != nil {
+			return errors.Wrap(err, "Unable to remove tenant")
+		}
+	}
+
+	// users of a deleted tenant may no longer authenticate
+	err = c.ds.DeleteTenantCA(tenantID)
+	if err != nil && err != types.ErrTenantCANotFound {
+		return errors.Wrap(err, "Unable to remove tenant")
+	}
+
 	c.qs.DeleteTenant(tenantID)
+	c.forgetDegradedTenant(tenantID)
 
-	// quotas get deleted from database as side effect to deleting tenant
+	// quotas and usage get deleted from database as side effect to
+	// deleting tenant
 	return c.ds.DeleteTenant(tenantID)
 }
+
+// FreezeTenant freezes or unfreezes a tenant.  While a tenant is frozen its
+// resources may be read but not changed.  A reason is required to freeze a
+// tenant so that it can be reported to the tenant's users.
+func (c *controller) FreezeTenant(tenantID string, req types.TenantFreezeRequest) error {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if tenant == nil {
+		return types.ErrTenantNotFound
+	}
+
+	if req.Frozen && req.Reason == "" {
+		return types.ErrBadRequest
+	}
+
+	return c.ds.SetTenantFreeze(tenantID, req.Frozen, req.Reason)
+}
+
+// PrepareTenantNetwork launches the CNCI for a subnet of a tenant's network
+// ahead of the tenant's instances so that they do not have to wait for it
+// to start.  The returned operation completes when the CNCI is active, at
+// once if it already is, and its result is the ID of the CNCI.
+func (c *controller) PrepareTenantNetwork(tenantID string, req types.TenantNetworkPrepareRequest) (types.Operation, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if tenant == nil {
+		return types.Operation{}, types.ErrTenantNotFound
+	}
+
+	if tenant.CNCIctrl == nil {
+		return types.Operation{}, errors.Errorf("No CNCI manager for tenant %s", tenantID)
+	}
+
+	subnet, err := c.ds.TenantSubnet(tenantID, req.Subnet)
+	if err != nil {
+		return types.Operation{}, types.ErrBadRequest
+	}
+
+	return c.startOperation(tenantID, types.PrepareNetworkOperation, subnet,
+		func(_ context.Context, progress operationProgress) (string, error) {
+			err := tenant.CNCIctrl.WaitForActive(subnet)
+			if err != nil {
+				return "", errors.Wrapf(err, "Error waiting for CNCI of subnet %s", subnet)
+			}
+
+			cnci, err := tenant.CNCIctrl.GetSubnetCNCI(subnet)
+			if err != nil {
+				return "", err
+			}
+
+			return cnci.ID, nil
+		})
+}
+
+// ShowTenantNetwork describes the subnets of a tenant's network, how many of
+// their addresses are in use and the CNCI of each.
+func (c *controller) ShowTenantNetwork(tenantID string) (types.TenantNetwork, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantNetwork{}, err
+	}
+
+	if tenant == nil {
+		return types.TenantNetwork{}, types.ErrTenantNotFound
+	}
+
+	subnets, err := c.ds.TenantSubnets(tenantID)
+	if err != nil {
+		return types.TenantNetwork{}, err
+	}
+
+	cncis, err := c.ds.GetTenantCNCIs(tenantID)
+	if err != nil {
+		return types.TenantNetwork{}, err
+	}
+
+	// subnets whose instances have all been deleted may still have a CNCI
+	for _, cnci := range cncis {
+		found := false
+		for i := range subnets {
+			if subnets[i].Subnet == cnci.Subnet {
+				subnets[i].CNCIID = cnci.ID
+				found = true
+			}
+		}
+
+		if !found {
+			subnets = append(subnets, types.TenantSubnet{
+				Subnet:   cnci.Subnet,
+				Capacity: datastore.SubnetCapacity(tenant.SubnetBits),
+				CNCIID:   cnci.ID,
+			})
+		}
+	}
+
+	sort.Slice(subnets, func(i, j int) bool {
+		a, _, _ := net.ParseCIDR(subnets[i].Subnet)
+		b, _, _ := net.ParseCIDR(subnets[j].Subnet)
+		return bytes.Compare(a.To4(), b.To4()) < 0
+	})
+
+	return types.TenantNetwork{
+		TenantID:   tenantID,
+		SubnetBits: tenant.SubnetBits,
+		MaxSubnets: tenant.MaxSubnets,
+		Subnets:    subnets,
+	}, nil
+}
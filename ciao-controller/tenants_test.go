@@ -0,0 +1,358 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func addRunningInstance(t *testing.T, tenantID string) *types.Instance {
+	wl := addBoundedWorkload(t, tenantID)
+
+	i := &types.Instance{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		WorkloadID:  wl.ID,
+		NodeID:      uuid.Generate().String(),
+		MACAddress:  uuid.Generate().String(),
+		State:       payloads.Running,
+		StateChange: sync.NewCond(&sync.Mutex{}),
+	}
+
+	err := ctl.ds.AddInstance(context.Background(), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func freezeTestTenant(t *testing.T, tenantID string, frozen bool, reason string) {
+	b, err := json.Marshal(types.TenantFreezeRequest{Frozen: frozen, Reason: reason})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants/" + tenantID + "/freeze"
+	_ = testHTTPRequest(t, "PUT", url, http.StatusNoContent, b, true)
+}
+
+func TestTenantFreeze(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 3; n++ {
+		_ = addRunningInstance(t, tenant.ID)
+	}
+
+	action, err := json.Marshal(types.CiaoServersAction{Action: "os-delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+
+	bulkURL := testutil.ComputeURL + "/v2.1/" + tenant.ID + "/servers/action"
+	_ = testHTTPRequest(t, "POST", bulkURL, http.StatusAccepted, action, true)
+
+	// freeze while the bulk delete is still being carried out
+	freezeTestTenant(t, tenant.ID, true, "storage migration")
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatalf("In-flight delete not completed: %v", err)
+	}
+
+	body := testHTTPRequest(t, "POST", bulkURL, http.StatusLocked, action, true)
+	if !strings.Contains(string(body), "storage migration") {
+		t.Errorf("Freeze reason not returned: %s", body)
+	}
+
+	instanceURL := testutil.ComputeURL + "/" + tenant.ID + "/instances"
+	_ = testHTTPRequest(t, "GET", instanceURL+"/detail", http.StatusOK, nil, true)
+
+	body = testHTTPRequest(t, "GET", testutil.ComputeURL+"/tenants/"+tenant.ID, http.StatusOK, nil, true)
+
+	var config types.TenantConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !config.Frozen || config.FreezeReason != "storage migration" {
+		t.Errorf("Freeze not shown in tenant config: %+v", config)
+	}
+
+	freezeTestTenant(t, tenant.ID, false, "")
+
+	_ = testHTTPRequest(t, "POST", bulkURL, http.StatusAccepted, action, true)
+}
+
+func TestTenantFreezeReason(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.FreezeTenant(tenant.ID, types.TenantFreezeRequest{Frozen: true})
+	if err != types.ErrBadRequest {
+		t.Errorf("Expected %v got %v", types.ErrBadRequest, err)
+	}
+
+	err = ctl.FreezeTenant(uuid.Generate().String(), types.TenantFreezeRequest{Frozen: true, Reason: "testing"})
+	if err != types.ErrTenantNotFound {
+		t.Errorf("Expected %v got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func createTestTenant(t *testing.T, req types.TenantRequest, expectedResponse int) types.TenantRecord {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/tenants"
+	body := testHTTPRequest(t, "POST", url, expectedResponse, b, true)
+	if expectedResponse != http.StatusCreated && expectedResponse != http.StatusOK {
+		return types.TenantRecord{}
+	}
+
+	var record types.TenantRecord
+	err = json.Unmarshal(body, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func tenantQuota(record types.TenantRecord, name string) int {
+	for _, q := range record.Quotas {
+		if q.Name == name {
+			return q.Value
+		}
+	}
+	return 0
+}
+
+func TestTenantCreate(t *testing.T) {
+	req := types.TenantRequest{
+		ID: uuid.Generate().String(),
+		Config: types.TenantConfig{
+			Name:       "created tenant",
+			SubnetBits: 20,
+		},
+		Quotas: []types.QuotaDetails{
+			{Name: "tenant-instances-quota", Value: 7},
+			{Name: "tenant-mem-per-instance-limit", Value: 1024},
+		},
+	}
+
+	record := createTestTenant(t, req, http.StatusCreated)
+	defer func() { _, _ = ctl.DeleteTenant(context.Background(), req.ID, false) }()
+
+	if record.ID != req.ID || record.Name != req.Config.Name || record.Config.SubnetBits != 20 {
+		t.Fatalf("Unexpected tenant record %+v", record)
+	}
+
+	if len(record.Links) != 1 || len(record.Warnings) != 0 {
+		t.Fatalf("Unexpected tenant record %+v", record)
+	}
+
+	if tenantQuota(record, "tenant-instances-quota") != 7 ||
+		tenantQuota(record, "tenant-mem-per-instance-limit") != 1024 ||
+		tenantQuota(record, "tenant-vcpu-quota") != -1 {
+		t.Fatalf("Initial quotas not applied: %v", record.Quotas)
+	}
+
+	qds, err := ctl.ds.GetQuotas(req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(qds) != len(req.Quotas) {
+		t.Fatalf("Expected %d quotas stored got %v", len(req.Quotas), qds)
+	}
+
+	tenant, err := ctl.ds.GetTenant(req.ID)
+	if err != nil || tenant == nil || tenant.CNCIctrl == nil {
+		t.Fatalf("Tenant has no CNCI manager: %v", err)
+	}
+
+	// retrying the creation returns the tenant unchanged
+	req.Quotas = []types.QuotaDetails{{Name: "tenant-instances-quota", Value: 1}}
+	again := createTestTenant(t, req, http.StatusOK)
+	if again.ID != req.ID || tenantQuota(again, "tenant-instances-quota") != 7 {
+		t.Fatalf("Unexpected tenant record on retry %+v", again)
+	}
+
+	// but not with a different configuration
+	req.Config.SubnetBits = 24
+	_ = createTestTenant(t, req, http.StatusConflict)
+}
+
+func TestTenantCreateGeneratedID(t *testing.T) {
+	req := types.TenantRequest{
+		Config: types.TenantConfig{Name: "generated tenant"},
+	}
+
+	record := createTestTenant(t, req, http.StatusCreated)
+	defer func() { _, _ = ctl.DeleteTenant(context.Background(), record.ID, false) }()
+
+	if _, err := uuid.Parse(record.ID); err != nil {
+		t.Fatalf("Invalid tenant ID %s: %v", record.ID, err)
+	}
+
+	if record.Config.SubnetBits != 24 {
+		t.Fatalf("Expected default subnet bits got %d", record.Config.SubnetBits)
+	}
+}
+
+func TestTenantCreateDuplicateName(t *testing.T) {
+	first := createTestTenant(t, types.TenantRequest{
+		Config: types.TenantConfig{Name: "duplicate name"},
+	}, http.StatusCreated)
+	defer func() { _, _ = ctl.DeleteTenant(context.Background(), first.ID, false) }()
+
+	second := createTestTenant(t, types.TenantRequest{
+		Config: types.TenantConfig{Name: "duplicate name"},
+	}, http.StatusCreated)
+	defer func() { _, _ = ctl.DeleteTenant(context.Background(), second.ID, false) }()
+
+	if first.ID == second.ID {
+		t.Fatal("Expected tenants with different IDs")
+	}
+
+	if len(second.Warnings) != 1 || !strings.Contains(second.Warnings[0], first.ID) {
+		t.Fatalf("Expected duplicate name warning got %v", second.Warnings)
+	}
+}
+
+func TestTenantCreateInvalid(t *testing.T) {
+	for _, req := range []types.TenantRequest{
+		{ID: "not-a-uuid"},
+		{Config: types.TenantConfig{SubnetBits: 8}},
+		{Quotas: []types.QuotaDetails{{Name: "tenant-bogus-quota", Value: 1}}},
+		{Quotas: []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: -2}}},
+		{Config: types.TenantConfig{MaxSubnets: -1}},
+		{Config: types.TenantConfig{CNCISize: &types.CNCISize{MemMB: -1}}},
+	} {
+		_ = createTestTenant(t, req, http.StatusForbidden)
+	}
+}
+
+func TestTenantNetwork(t *testing.T) {
+	record := createTestTenant(t, types.TenantRequest{
+		Config: types.TenantConfig{SubnetBits: 29, MaxSubnets: 2},
+	}, http.StatusCreated)
+	defer func() { _, _ = ctl.DeleteTenant(context.Background(), record.ID, false) }()
+
+	url := testutil.ComputeURL + "/tenants/" + record.ID + "/network"
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var network types.TenantNetwork
+	err := json.Unmarshal(body, &network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if network.TenantID != record.ID || network.SubnetBits != 29 || network.MaxSubnets != 2 {
+		t.Fatalf("Unexpected tenant network %+v", network)
+	}
+
+	if len(network.Subnets) != 0 {
+		t.Fatalf("Expected no subnets got %+v", network.Subnets)
+	}
+}
+
+func TestTenantCNCISize(t *testing.T) {
+	netClient, err := testutil.NewSsntpTestClientConnection("TenantCNCISize", ssntp.NETAGENT, testutil.NetAgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netClient.Shutdown()
+
+	record := createTestTenant(t, types.TenantRequest{
+		Config: types.TenantConfig{CNCISize: &types.CNCISize{VCPUs: 2, DiskMB: 1500}},
+	}, http.StatusCreated)
+
+	body := testHTTPRequest(t, "GET", testutil.ComputeURL+"/tenants/"+record.ID, http.StatusOK, nil, true)
+
+	var details types.TenantDetails
+	err = json.Unmarshal(body, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ctl.config.config()
+	expected := types.CNCISize{VCPUs: 2, MemMB: cfg.CNCIMem, DiskMB: 1500}
+	if details.CNCISize == nil || *details.CNCISize != (types.CNCISize{VCPUs: 2, DiskMB: 1500}) ||
+		details.EffectiveCNCISize != expected {
+		t.Fatalf("Unexpected tenant details %+v", details)
+	}
+
+	o, err := ctl.cnciOverrides(record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o != (types.RequirementOverrides{VCPUs: 2, DiskGB: 2}) {
+		t.Fatalf("Unexpected CNCI overrides %+v", o)
+	}
+
+	workloadID, err := ctl.ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ctl.ds.GetWorkload(workloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owl := overrideRequirements(wl, o)
+	if owl.Requirements.VCPUs != 2 || owl.Requirements.MemMB != wl.Requirements.MemMB || owl.Storage[0].Size != 2 {
+		t.Fatalf("Unexpected CNCI workload %+v %+v", owl.Requirements, owl.Storage)
+	}
+
+	// the tenant's CNCIs are launched rather than taken from the pool
+	netClientCmdCh := netClient.AddCmdChan(ssntp.START)
+	_ = testHTTPRequest(t, "POST", testutil.ComputeURL+"/tenants/"+record.ID+"/network/prepare", http.StatusAccepted, nil, true)
+
+	_ = testPreparedCNCI(t, netClient, netClientCmdCh, record.ID)
+
+	// without an override the tenant's CNCIs have the cluster's size
+	details, err = ctl.ShowTenant(testutil.ComputeUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details.EffectiveCNCISize != (types.CNCISize{VCPUs: cfg.CNCIVcpus, MemMB: cfg.CNCIMem, DiskMB: cfg.CNCIDisk}) {
+		t.Fatalf("Unexpected effective CNCI size %+v", details.EffectiveCNCISize)
+	}
+}
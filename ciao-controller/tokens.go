@@ -0,0 +1,319 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/service"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// tokenMinKeySize is the shortest token signing key accepted, in bytes.
+const tokenMinKeySize = 16
+
+const (
+	tokenRoleAdmin  = "admin"
+	tokenRoleTenant = "tenant"
+)
+
+// tokenHeader is the encoded header of every token.  Tokens are JSON Web
+// Tokens signed with HMAC SHA-256, and tokens with any other header are
+// refused rather than trusting the algorithm they name.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var (
+	errTokenTenantRequired = errors.New("Tenant must be given for users of several tenants")
+	errTokenTenantDenied   = errors.New("Access to tenant not permitted with credentials")
+)
+
+// tokenClaims are the claims carried by a token.
+type tokenClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	TenantID  string `json:"tenant,omitempty"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// tokenKey reads the key with which tokens are signed.  The key is read for
+// every request so that replacing it revokes the tokens signed with the old
+// key straight away.
+func tokenKey(cfg controllerConfig) ([]byte, error) {
+	if cfg.TokenKeyPath == "" {
+		return nil, types.ErrAuthTokensDisabled
+	}
+
+	key, err := ioutil.ReadFile(cfg.TokenKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading token key")
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) < tokenMinKeySize {
+		return nil, fmt.Errorf("Token key must be at least %d bytes", tokenMinKeySize)
+	}
+
+	return key, nil
+}
+
+// isToken returns true if a bearer credential is a token rather than an
+// API key, which never contains a ".".
+func isToken(bearer string) bool {
+	return strings.Count(bearer, ".") == 2
+}
+
+func tokenSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken returns a token carrying claims signed with key.
+func signToken(key []byte, claims tokenClaims) (string, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "Error marshalling token claims")
+	}
+
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	return signed + "." + tokenSignature(key, signed), nil
+}
+
+// parseToken returns the claims of token if it was signed with key and has
+// not expired by now.
+func parseToken(key []byte, token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, errors.New("Malformed token")
+	}
+
+	sig := tokenSignature(key, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return claims, errors.New("Invalid token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.Wrap(err, "Malformed token claims")
+	}
+
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return claims, errors.Wrap(err, "Malformed token claims")
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, errors.New("Token expired")
+	}
+
+	return claims, nil
+}
+
+// issueToken issues a token to subject, authenticated by a client
+// certificate granting the admin role if privileged and access to tenants
+// otherwise.  Admins are issued an admin token unless they ask for a token
+// limited to a tenant, tenant users a token for the tenant they ask for,
+// which may be left out if they belong to a single tenant.
+func (c *controller) issueToken(subject string, privileged bool, tenants []string, req types.AuthTokenRequest) (types.NewAuthToken, error) {
+	cfg := c.config.config()
+
+	key, err := tokenKey(cfg)
+	if err != nil {
+		return types.NewAuthToken{}, err
+	}
+
+	role := tokenRoleTenant
+	tenantID := req.TenantID
+	if privileged {
+		if tenantID == "" {
+			role = tokenRoleAdmin
+		}
+	} else if tenantID == "" {
+		if len(tenants) != 1 {
+			return types.NewAuthToken{}, errTokenTenantRequired
+		}
+		tenantID = tenants[0]
+	} else {
+		permitted := false
+		for _, t := range tenants {
+			if t == tenantID {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return types.NewAuthToken{}, errTokenTenantDenied
+		}
+	}
+
+	if tenantID != "" {
+		tenant, err := c.ds.GetTenant(tenantID)
+		if err != nil || tenant == nil {
+			return types.NewAuthToken{}, types.ErrTenantNotFound
+		}
+	}
+
+	// the expiry of the claims is in seconds
+	now := time.Now().Truncate(time.Second)
+	t := types.AuthToken{
+		ID:         uuid.Generate().String(),
+		Subject:    subject,
+		TenantID:   tenantID,
+		Role:       role,
+		ExpireTime: now.Add(cfg.TokenExpiry),
+		CreateTime: now,
+	}
+
+	token, err := signToken(key, tokenClaims{
+		ID:        t.ID,
+		Subject:   t.Subject,
+		TenantID:  t.TenantID,
+		Role:      t.Role,
+		IssuedAt:  t.CreateTime.Unix(),
+		ExpiresAt: t.ExpireTime.Unix(),
+	})
+	if err != nil {
+		return types.NewAuthToken{}, err
+	}
+
+	if err := c.ds.AddAuthToken(t); err != nil {
+		return types.NewAuthToken{}, err
+	}
+
+	return types.NewAuthToken{AuthToken: t, Token: token}, nil
+}
+
+// authenticateToken returns the record of token if it carries a valid
+// signature, has not expired and has not been revoked, and its tenant
+// still exists.
+func (c *controller) authenticateToken(token string) (types.AuthToken, error) {
+	key, err := tokenKey(c.config.config())
+	if err != nil {
+		return types.AuthToken{}, err
+	}
+
+	claims, err := parseToken(key, token, time.Now())
+	if err != nil {
+		return types.AuthToken{}, err
+	}
+
+	t, err := c.ds.GetAuthToken(claims.ID)
+	if err != nil {
+		return types.AuthToken{}, err
+	}
+
+	if t.Role == tokenRoleTenant {
+		tenant, err := c.ds.GetTenant(t.TenantID)
+		if err != nil || tenant == nil {
+			return types.AuthToken{}, types.ErrTenantNotFound
+		}
+	}
+
+	return t, nil
+}
+
+// pruneAuthTokens removes the records of the tokens which have expired.
+func (c *controller) pruneAuthTokens(now time.Time) {
+	pruned, err := c.ds.PruneAuthTokens(now)
+	if err != nil {
+		c.log.Warningf("Unable to prune tokens: %v", err)
+	}
+
+	if pruned > 0 && c.log.V(1) {
+		c.log.Infof("Pruned %d tokens", pruned)
+	}
+}
+
+// tokenExchangeHandler serves the requests for tokens.  It is a type of
+// its own so that its route may be recognised when it is authenticated:
+// any user holding a client certificate may obtain a token, whatever their
+// role.
+type tokenExchangeHandler struct {
+	*controller
+}
+
+func (h tokenExchangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	legacyAPIHandler{h.controller, createToken, false}.ServeHTTP(w, r)
+}
+
+func createToken(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	var req types.AuthTokenRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// the request is optional
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return APIResponse{http.StatusBadRequest, nil}, err
+		}
+	}
+
+	ctx := r.Context()
+	token, err := c.issueToken(service.GetActor(ctx), service.GetPrivilege(ctx), service.GetTenants(ctx), req)
+	switch err {
+	case nil:
+	case errTokenTenantRequired:
+		return APIResponse{http.StatusBadRequest, nil}, err
+	case errTokenTenantDenied:
+		return APIResponse{http.StatusForbidden, nil}, err
+	default:
+		return errorResponse(err), err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	return APIResponse{http.StatusCreated, token}, nil
+}
+
+func listTokens(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	return APIResponse{http.StatusOK, types.ListAuthTokensResponse{Tokens: c.ds.GetAuthTokens()}}, nil
+}
+
+func revokeToken(c *controller, w http.ResponseWriter, r *http.Request) (APIResponse, error) {
+	err := c.ds.DeleteAuthToken(mux.Vars(r)["token"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return APIResponse{http.StatusNoContent, nil}, nil
+}
+
+func tokenRoutes(ctl *controller, r *mux.Router) *mux.Router {
+	r.Handle("/v2.1/tokens", tokenExchangeHandler{ctl}).Methods("POST")
+	r.Handle("/v2.1/tokens",
+		legacyAPIHandler{ctl, listTokens, true}).Methods("GET")
+	r.Handle("/v2.1/tokens/{token}",
+		legacyAPIHandler{ctl, revokeToken, true}).Methods("DELETE")
+
+	return r
+}
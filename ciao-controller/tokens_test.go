@@ -0,0 +1,323 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+var tokensURL = testutil.ComputeURL + "/v2.1/tokens"
+
+// enableTestTokens configures a token signing key until the returned
+// function is called.
+func enableTestTokens(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyPath, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := setTestConfig(func(cfg *controllerConfig) {
+		cfg.TokenKeyPath = keyPath
+	})
+
+	return func() {
+		restore()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// requestTestToken obtains a token with the admin certificate.
+func requestTestToken(t *testing.T, req types.AuthTokenRequest, status int) types.NewAuthToken {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", tokensURL, status, b, true)
+
+	var token types.NewAuthToken
+	if status == http.StatusCreated {
+		if err := json.Unmarshal(body, &token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return token
+}
+
+// certPost makes a POST request with client and returns the status and
+// the body of the response.
+func certPost(t *testing.T, client *http.Client, url string, data []byte) (int, []byte) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestTokenSignature(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	now := time.Now()
+
+	claims := tokenClaims{
+		ID:        "id",
+		Subject:   "user",
+		Role:      tokenRoleAdmin,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+
+	token, err := signToken(key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isToken(token) {
+		t.Fatalf("Token not recognised: %s", token)
+	}
+
+	parsed, err := parseToken(key, token, now)
+	if err != nil || parsed != claims {
+		t.Fatalf("Expected claims %+v got %+v: %v", claims, parsed, err)
+	}
+
+	if _, err := parseToken(key, token, now.Add(time.Minute)); err == nil {
+		t.Errorf("Expired token accepted")
+	}
+
+	if _, err := parseToken([]byte("fedcba9876543210"), token, now); err == nil {
+		t.Errorf("Token accepted with another key")
+	}
+
+	parts := strings.Split(token, ".")
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	if _, err := parseToken(key, none+"."+parts[1]+".", now); err == nil {
+		t.Errorf("Unsigned token accepted")
+	}
+
+	claims.Role = tokenRoleTenant
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+	if _, err := parseToken(key, forged, now); err == nil {
+		t.Errorf("Token with altered claims accepted")
+	}
+}
+
+func TestTokenAdmin(t *testing.T) {
+	defer enableTestTokens(t)()
+
+	token := requestTestToken(t, types.AuthTokenRequest{}, http.StatusCreated)
+	if token.Role != tokenRoleAdmin || token.TenantID != "" {
+		t.Fatalf("Expected admin token: %+v", token.AuthToken)
+	}
+
+	if status, body := apiKeyRequest(t, token.Token, "GET", testutil.ComputeURL+"/tenants"); status != http.StatusOK {
+		t.Fatalf("Admin request with token refused: %d %s", status, body)
+	}
+
+	// tokens are not renewed with tokens
+	if status, _ := apiKeyRequest(t, token.Token, "POST", tokensURL); status != http.StatusForbidden {
+		t.Errorf("Expected token request with a token to be forbidden: %d", status)
+	}
+
+	var list types.ListAuthTokensResponse
+	body := testHTTPRequest(t, "GET", tokensURL, http.StatusOK, nil, true)
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, l := range list.Tokens {
+		found = found || l.ID == token.ID
+	}
+	if !found {
+		t.Fatalf("Token %s not listed: %+v", token.ID, list.Tokens)
+	}
+
+	_ = testHTTPRequest(t, "DELETE", tokensURL+"/"+token.ID, http.StatusNoContent, nil, true)
+	_ = testHTTPRequest(t, "DELETE", tokensURL+"/"+token.ID, http.StatusNotFound, nil, true)
+
+	if status, _ := apiKeyRequest(t, token.Token, "GET", testutil.ComputeURL+"/tenants"); status != http.StatusUnauthorized {
+		t.Errorf("Expected revoked token to be refused: %d", status)
+	}
+}
+
+func TestTokenTenant(t *testing.T) {
+	defer enableTestTokens(t)()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := requestTestToken(t, types.AuthTokenRequest{TenantID: tenant.ID}, http.StatusCreated)
+	if token.Role != tokenRoleTenant || token.TenantID != tenant.ID {
+		t.Fatalf("Expected token for tenant %s: %+v", tenant.ID, token.AuthToken)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"own tenant", testutil.ComputeURL + "/" + tenant.ID + "/events", http.StatusOK},
+		{"other tenant", testutil.ComputeURL + "/" + other.ID + "/events", http.StatusUnauthorized},
+		{"admin route", testutil.ComputeURL + "/tenants", http.StatusForbidden},
+		{"token list", tokensURL, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if status, body := apiKeyRequest(t, token.Token, "GET", tt.url); status != tt.status {
+			t.Errorf("%s: expected %d got %d %s", tt.name, tt.status, status, body)
+		}
+	}
+
+	// the token is refused once expired and pruned
+	ctl.pruneAuthTokens(token.ExpireTime.Add(time.Second))
+
+	if _, err := ctl.ds.GetAuthToken(token.ID); err != types.ErrAuthTokenNotFound {
+		t.Errorf("Expired token not pruned: %v", err)
+	}
+
+	if status, _ := apiKeyRequest(t, token.Token, "GET", tests[0].url); status != http.StatusUnauthorized {
+		t.Errorf("Expected pruned token to be refused: %d", status)
+	}
+}
+
+func TestTokenTenantUser(t *testing.T) {
+	defer enableTestTokens(t)()
+
+	tenantA, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantB, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := createTestCA(t, "token CA")
+	defer trustTestCA(ca)()
+
+	single := certClient(ca.clientCert(t, "user-a", []string{tenantA.ID}))
+	several := certClient(ca.clientCert(t, "user-ab", []string{tenantA.ID, tenantB.ID}))
+
+	request := func(tenantID string) []byte {
+		b, err := json.Marshal(types.AuthTokenRequest{TenantID: tenantID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	status, body := certPost(t, single, tokensURL, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("Token request refused: %d %s", status, body)
+	}
+
+	var token types.NewAuthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		t.Fatal(err)
+	}
+
+	if token.TenantID != tenantA.ID || token.Subject != "user-a" {
+		t.Errorf("Expected token of user-a for tenant %s: %+v", tenantA.ID, token.AuthToken)
+	}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		body   []byte
+		status int
+	}{
+		{"several tenants", several, nil, http.StatusBadRequest},
+		{"named tenant", several, request(tenantB.ID), http.StatusCreated},
+		{"other tenant", several, request(other.ID), http.StatusForbidden},
+		{"malformed request", single, []byte("{"), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if status, body := certPost(t, tt.client, tokensURL, tt.body); status != tt.status {
+			t.Errorf("%s: expected %d got %d %s", tt.name, tt.status, status, body)
+		}
+	}
+}
+
+func TestTokensDisabled(t *testing.T) {
+	restore := enableTestTokens(t)
+	token := requestTestToken(t, types.AuthTokenRequest{}, http.StatusCreated)
+
+	if !ctl.Capabilities().Features[types.FeatureAuthTokens] {
+		t.Errorf("Tokens not reported as enabled")
+	}
+
+	restore()
+
+	if ctl.Capabilities().Features[types.FeatureAuthTokens] {
+		t.Errorf("Tokens reported as enabled")
+	}
+
+	_ = requestTestToken(t, types.AuthTokenRequest{}, http.StatusForbidden)
+
+	status, body := apiKeyRequest(t, token.Token, "GET", testutil.ComputeURL+"/tenants")
+	if status != http.StatusUnauthorized || !strings.Contains(body, "not enabled") {
+		t.Errorf("Expected token to be refused when tokens are disabled: %d %s", status, body)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
+
+// trashRetention returns how long the deleted instances and volumes of a
+// tenant are kept in its trash, zero if they are deleted immediately.
+func (c *controller) trashRetention(tenantID string) time.Duration {
+	retention := c.durationSetting(settingTrashRetention)
+
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil || tenant == nil {
+		return retention
+	}
+
+	switch {
+	case tenant.TrashRetentionMinutes > 0:
+		return time.Duration(tenant.TrashRetentionMinutes) * time.Minute
+	case tenant.TrashRetentionMinutes < 0:
+		return 0
+	}
+
+	return retention
+}
+
+// trashInstance records an instance being deleted in its tenant's trash,
+// along with the volumes attached to it which will survive its deletion.
+func (c *controller) trashInstance(i *types.Instance, retention time.Duration) {
+	now := time.Now()
+	item := types.TrashItem{
+		ID:          i.ID,
+		TenantID:    i.TenantID,
+		Type:        types.TrashInstance,
+		Name:        i.Name,
+		DeleteTime:  now,
+		PurgeTime:   now.Add(retention),
+		WorkloadID:  i.WorkloadID,
+		VCPUs:       i.VCPUs,
+		MemMB:       i.MemMB,
+		EphemeralGB: i.EphemeralGB,
+	}
+
+	for _, a := range c.ds.GetStorageAttachments(i.ID) {
+		if !a.Ephemeral && !a.Boot {
+			item.Volumes = append(item.Volumes, a.BlockID)
+		}
+	}
+
+	err := c.ds.AddTrashItem(item)
+	if err != nil {
+		c.instanceLog(i).Warningf("Error adding instance to trash: %v", err)
+	}
+}
+
+// trashVolume marks a volume as pending deletion and records it in its
+// tenant's trash.  The quota held by the volume is released.
+func (c *controller) trashVolume(ctx context.Context, info types.Volume, retention time.Duration) error {
+	info.State = types.PendingDelete
+	err := c.ds.UpdateBlockDevice(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	item := types.TrashItem{
+		ID:         info.ID,
+		TenantID:   info.TenantID,
+		Type:       types.TrashVolume,
+		Name:       info.Name,
+		DeleteTime: now,
+		PurgeTime:  now.Add(retention),
+	}
+
+	err = c.ds.AddTrashItem(item)
+	if err != nil {
+		info.State = types.Available
+		_ = c.ds.UpdateBlockDevice(context.WithoutCancel(ctx), info)
+		return err
+	}
+
+	c.qs.Release(info.TenantID,
+		payloads.RequestedResource{Type: payloads.Volume, Value: 1},
+		payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: info.Size})
+
+	return nil
+}
+
+// ListTrash returns the trash of tenantID, or of all tenants for admins.
+func (c *controller) ListTrash(tenantID string) ([]types.TrashItem, error) {
+	if tenantID == "admin" {
+		tenantID = ""
+	}
+
+	return c.ds.GetTrashItems(tenantID), nil
+}
+
+// RestoreTrashItem restores an instance or volume from the trash of a
+// tenant.  The quota of the restored resource is consumed again.
+func (c *controller) RestoreTrashItem(ctx context.Context, tenantID string, ID string) (types.TrashRestoreResponse, error) {
+	item, err := c.ds.GetTrashItem(tenantID, ID)
+	if err != nil {
+		return types.TrashRestoreResponse{}, err
+	}
+
+	resp := types.TrashRestoreResponse{Type: item.Type}
+
+	switch item.Type {
+	case types.TrashVolume:
+		resp.ID, err = c.restoreVolume(ctx, item)
+	case types.TrashInstance:
+		resp.ID, err = c.restoreInstance(ctx, item)
+	default:
+		err = fmt.Errorf("Unknown trash item type: %s", item.Type)
+	}
+
+	if err != nil {
+		return types.TrashRestoreResponse{}, err
+	}
+
+	err = c.ds.DeleteTrashItem(item.ID)
+	if err != nil {
+		c.log.Warningf("Error removing %s %s from trash: %v", item.Type, item.ID, err)
+	}
+
+	return resp, nil
+}
+
+func (c *controller) restoreVolume(ctx context.Context, item types.TrashItem) (string, error) {
+	info, err := c.ds.GetBlockDevice(item.ID)
+	if err != nil {
+		return "", types.ErrTrashVolumePurged
+	}
+
+	_, err = c.GetBlockDeviceSize(ctx, item.ID)
+	if err != nil {
+		return "", errors.Wrapf(types.ErrTrashVolumePurged, "volume %s", item.ID)
+	}
+
+	res := <-c.qs.Consume(item.TenantID,
+		payloads.RequestedResource{Type: payloads.Volume, Value: 1},
+		payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: info.Size})
+
+	if !res.Allowed() {
+		c.quotaExceeded(item.TenantID, res)
+		c.qs.Release(item.TenantID, res.Resources()...)
+		return "", types.ErrQuota
+	}
+
+	info.State = types.Available
+	err = c.ds.UpdateBlockDevice(ctx, info)
+	if err != nil {
+		c.qs.Release(item.TenantID, res.Resources()...)
+		return "", err
+	}
+
+	return info.ID, nil
+}
+
+// trashOverrides returns the overrides which relaunch a deleted instance
+// with the requirements it was launched with.
+func trashOverrides(item types.TrashItem, wl types.Workload) types.RequirementOverrides {
+	var o types.RequirementOverrides
+
+	if item.VCPUs != 0 && item.VCPUs != wl.Requirements.VCPUs {
+		o.VCPUs = item.VCPUs
+	}
+
+	if item.MemMB != 0 && item.MemMB != wl.Requirements.MemMB {
+		o.MemMB = item.MemMB
+	}
+
+	size, n := 0, 0
+	for _, s := range wl.Storage {
+		if s.Ephemeral {
+			size += s.Size
+			n++
+		}
+	}
+
+	if n > 0 && item.EphemeralGB != size {
+		o.DiskGB = item.EphemeralGB / n
+	}
+
+	return o
+}
+
+func (c *controller) restoreInstance(ctx context.Context, item types.TrashItem) (string, error) {
+	if item.Name != "" {
+		existingID, err := c.ds.ResolveInstance(item.TenantID, item.Name)
+		if err != nil {
+			return "", errors.Wrap(err, "error trying to resolve name")
+		}
+
+		if existingID != "" {
+			return "", errors.Wrapf(types.ErrTrashNameReused, "name %s", item.Name)
+		}
+	}
+
+	wl, err := c.ds.GetWorkload(item.WorkloadID)
+	if err != nil {
+		return "", err
+	}
+
+	w := types.WorkloadRequest{
+		WorkloadID: item.WorkloadID,
+		TenantID:   item.TenantID,
+		Instances:  1,
+		Name:       item.Name,
+		Overrides:  trashOverrides(item, wl),
+	}
+
+	// volumes which have since been deleted, or attached elsewhere, are
+	// left alone.
+	for _, ID := range item.Volumes {
+		vol, err := c.ds.GetBlockDevice(ID)
+		if err != nil || vol.TenantID != item.TenantID || vol.State != types.Available {
+			continue
+		}
+		w.Volumes = append(w.Volumes, ID)
+	}
+
+	instances, err := c.startWorkload(ctx, w)
+	if err != nil {
+		return "", err
+	}
+
+	return instances[0].ID, nil
+}
+
+// purgeTrash permanently deletes the items in the trash which have passed
+// their purge time.
+func (c *controller) purgeTrash(now time.Time) {
+	purged := 0
+
+	for _, item := range c.ds.GetTrashItems("") {
+		if item.PurgeTime.After(now) {
+			continue
+		}
+
+		if item.Type == types.TrashVolume {
+			err := c.purgeVolume(item.ID)
+			if err != nil {
+				c.log.Warningf("Unable to purge volume %s: %v", item.ID, err)
+				continue
+			}
+		}
+
+		err := c.ds.DeleteTrashItem(item.ID)
+		if err != nil {
+			c.log.Warningf("Unable to remove %s %s from trash: %v", item.Type, item.ID, err)
+			continue
+		}
+
+		purged++
+	}
+
+	if purged > 0 && c.log.V(1) {
+		c.log.Infof("Purged %d items from trash", purged)
+	}
+}
+
+func (c *controller) purgeVolume(ID string) error {
+	info, err := c.adminVolume(ID)
+	if err == types.ErrVolumeNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.State != types.PendingDelete {
+		return nil
+	}
+
+	err = c.removeVolumeSnapshots(c.ctx, info)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.DeleteBlockDevice(c.ctx, ID)
+	if err != nil {
+		return err
+	}
+
+	return c.DeleteBlockDevice(c.ctx, ID)
+}
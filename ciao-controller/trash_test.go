@@ -0,0 +1,307 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// purgedDriver is a block driver whose volumes have all been removed.
+type purgedDriver struct {
+	*storage.NoopDriver
+}
+
+func (d purgedDriver) GetBlockDeviceSize(ctx context.Context, volumeUUID string) (uint64, error) {
+	return 0, errors.New("image not found")
+}
+
+func setTrashRetention(t *testing.T, retention time.Duration) func() {
+	return setTestConfig(func(cfg *controllerConfig) {
+		cfg.TrashRetention = retention
+	})
+}
+
+func testListTrash(t *testing.T, tenantID string) []types.TrashItem {
+	url := testutil.ComputeURL + "/" + tenantID + "/trash"
+	body := testHTTPRequestWithHeader(t, "GET", url, http.StatusOK, nil, onBehalfOf(tenantID))
+
+	var resp types.ListTrashResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Items
+}
+
+func testRestoreTrashItem(t *testing.T, tenantID string, ID string, status int) types.TrashRestoreResponse {
+	url := testutil.ComputeURL + "/" + tenantID + "/trash/" + ID + "/restore"
+	body := testHTTPRequestWithHeader(t, "POST", url, status, nil, onBehalfOf(tenantID))
+
+	var resp types.TrashRestoreResponse
+	if status == http.StatusOK {
+		err := json.Unmarshal(body, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp
+}
+
+func TestTrashVolume(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 10, t)
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, volID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVolume(t, volID, types.PendingDelete, 0)
+
+	vols, err := ctl.ListVolumesDetail(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 0 {
+		t.Errorf("Deleted volume listed: %+v", vols)
+	}
+
+	items := testListTrash(t, tenant.ID)
+	if len(items) != 1 || items[0].ID != volID || items[0].Type != types.TrashVolume ||
+		items[0].PurgeTime.Sub(items[0].DeleteTime) != time.Hour {
+		t.Fatalf("Unexpected trash: %+v", items)
+	}
+
+	// the released quota must be consumed again on restore.
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{{Name: "tenant-volumes-quota", Value: 1}})
+	defer ctl.qs.Update(tenant.ID, []types.QuotaDetails{{Name: "tenant-volumes-quota", Value: -1}})
+
+	otherID := createTestVolume(tenant.ID, 1, t)
+	_ = testRestoreTrashItem(t, tenant.ID, volID, http.StatusForbidden)
+	checkVolume(t, volID, types.PendingDelete, 0)
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, otherID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testRestoreTrashItem(t, tenant.ID, volID, http.StatusOK)
+	if resp.ID != volID || resp.Type != types.TrashVolume {
+		t.Errorf("Unexpected restore response: %+v", resp)
+	}
+
+	checkVolume(t, volID, types.Available, 0)
+	_ = testRestoreTrashItem(t, tenant.ID, volID, http.StatusNotFound)
+
+	items = testListTrash(t, tenant.ID)
+	if len(items) != 1 || items[0].ID != otherID {
+		t.Errorf("Unexpected trash after restore: %+v", items)
+	}
+}
+
+func TestTrashVolumePurged(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 1, t)
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, volID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := ctl.BlockDriver
+	ctl.BlockDriver = purgedDriver{&storage.NoopDriver{}}
+	defer func() { ctl.BlockDriver = driver }()
+
+	_ = testRestoreTrashItem(t, tenant.ID, volID, http.StatusGone)
+	checkVolume(t, volID, types.PendingDelete, 0)
+}
+
+func TestTrashPurge(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 1, t)
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, volID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.purgeTrash(time.Now())
+	checkVolume(t, volID, types.PendingDelete, 0)
+
+	ctl.purgeTrash(time.Now().Add(2 * time.Hour))
+
+	_, err = ctl.ds.GetBlockDevice(volID)
+	if err == nil {
+		t.Error("Volume not purged")
+	}
+
+	if items := testListTrash(t, tenant.ID); len(items) != 0 {
+		t.Errorf("Trash not purged: %+v", items)
+	}
+}
+
+func TestTrashTenantRetention(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.PatchTenant(tenant.ID, []byte(`{"trash_retention_minutes":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retention := ctl.trashRetention(tenant.ID); retention != 10*time.Minute {
+		t.Errorf("Expected tenant retention of 10m, got %v", retention)
+	}
+
+	// tenants may opt out of the trash.
+	err = ctl.PatchTenant(tenant.ID, []byte(`{"trash_retention_minutes":-1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 1, t)
+
+	err = ctl.DeleteVolume(context.Background(), tenant.ID, volID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ds.GetBlockDevice(volID)
+	if err == nil {
+		t.Error("Volume not deleted immediately")
+	}
+
+	if items := testListTrash(t, tenant.ID); len(items) != 0 {
+		t.Errorf("Volume added to trash: %+v", items)
+	}
+}
+
+func TestTrashInstance(t *testing.T) {
+	defer setTrashRetention(t, time.Hour)()
+
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	i := instances[0]
+	volID := createTestVolume(i.TenantID, 1, t)
+
+	_, err := ctl.ds.CreateStorageAttachment(context.Background(), i.ID, payloads.StorageResource{ID: volID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteServer(context.Background(), i.TenantID, i.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl.client.RemoveInstance(i.ID)
+
+	checkVolume(t, volID, types.Available, 0)
+
+	items := testListTrash(t, i.TenantID)
+	if len(items) != 1 || items[0].ID != i.ID || items[0].Type != types.TrashInstance ||
+		items[0].Name != i.Name || len(items[0].Volumes) != 1 || items[0].Volumes[0] != volID {
+		t.Fatalf("Unexpected trash: %+v", items)
+	}
+
+	// the name of the deleted instance has been given to another.
+	w := types.WorkloadRequest{
+		WorkloadID: i.WorkloadID,
+		TenantID:   i.TenantID,
+		Instances:  1,
+		Name:       i.Name,
+	}
+
+	clientCmdCh := client.AddCmdChan(ssntp.START)
+	reused, err := ctl.startWorkload(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testRestoreTrashItem(t, i.TenantID, i.ID, http.StatusConflict)
+
+	ctl.client.RemoveInstance(reused[0].ID)
+
+	clientCmdCh = client.AddCmdChan(ssntp.START)
+	resp := testRestoreTrashItem(t, i.TenantID, i.ID, http.StatusOK)
+	if resp.Type != types.TrashInstance || resp.ID == "" || resp.ID == i.ID {
+		t.Fatalf("Unexpected restore response: %+v", resp)
+	}
+
+	result, err := client.GetCmdChanResult(clientCmdCh, ssntp.START)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != resp.ID {
+		t.Errorf("Restored instance %s not started", resp.ID)
+	}
+
+	restored, err := ctl.ds.GetInstance(resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != i.Name || restored.WorkloadID != i.WorkloadID {
+		t.Errorf("Unexpected restored instance: %+v", restored)
+	}
+
+	checkVolume(t, volID, types.InUse, 1)
+
+	if items := testListTrash(t, i.TenantID); len(items) != 0 {
+		t.Errorf("Instance still in trash: %+v", items)
+	}
+}
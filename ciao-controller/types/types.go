@@ -17,8 +17,12 @@
 package types
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -53,6 +57,11 @@ type StorageResource struct {
 	// Bootable indicates whether should the resource be used for booting
 	Bootable bool `json:"bootable"`
 
+	// BootIndex gives the position of the resource in the boot order of
+	// the instance, starting at 0.  Workloads which do not index their
+	// storage boot from their bootable resources in an undefined order.
+	BootIndex *int `json:"boot_index,omitempty"`
+
 	// Ephemeral indicates whether the storage is temporary
 	// TBD: do we bother to save info about temp storage?
 	//      does it count against quota?
@@ -75,13 +84,17 @@ type StorageResource struct {
 
 	// Internal indicates whether this storage should be shown to the user
 	Internal bool
+
+	// Local indicates that this empty ephemeral storage is created by the
+	// launcher on the compute node rather than by the volume service.
+	Local bool `json:"local,omitempty"`
 }
 
 // Workload contains resource and configuration information for a user
 // workload.
 type Workload struct {
 	ID           string                        `json:"id"`
-	TenantID     string                        `json:"-"`
+	TenantID     string                        `json:"tenant_id,omitempty"`
 	Description  string                        `json:"description"`
 	FWType       string                        `json:"fw_type"`
 	VMType       payloads.Hypervisor           `json:"vm_type"`
@@ -90,6 +103,110 @@ type Workload struct {
 	Storage      []StorageResource             `json:"storage"`
 	Visibility   Visibility                    `json:"visibility"`
 	Requirements payloads.WorkloadRequirements `json:"workload_requirements"`
+	Bounds       *WorkloadBounds               `json:"bounds,omitempty"`
+	Networks     []NetworkRequirement          `json:"networks,omitempty"`
+}
+
+// Validate checks the parts of a workload definition which do not depend on
+// the state of the cluster: its requirements, firmware and hypervisor, and
+// the sources of its storage.  It returns a *WorkloadValidationError listing
+// every violation found, or nil if there are none.
+func (wl *Workload) Validate() error {
+	var violations []string
+
+	if wl.Requirements.VCPUs < 0 {
+		violations = append(violations, "workload_requirements.vcpus must not be negative")
+	}
+
+	if wl.Requirements.MemMB <= 0 {
+		violations = append(violations, "workload_requirements.mem_mb must be positive")
+	}
+
+	switch wl.VMType {
+	case payloads.QEMU:
+		if wl.FWType != string(payloads.EFI) && wl.FWType != payloads.Legacy {
+			violations = append(violations, fmt.Sprintf("fw_type must be %s or %s", payloads.EFI, payloads.Legacy))
+		}
+	case payloads.Docker:
+		// containers have no firmware but the field is still checked
+		// if it is given.
+		if wl.FWType != "" && wl.FWType != string(payloads.EFI) && wl.FWType != payloads.Legacy {
+			violations = append(violations, fmt.Sprintf("fw_type must be %s or %s", payloads.EFI, payloads.Legacy))
+		}
+
+		if wl.ImageName == "" {
+			violations = append(violations, "image_name is required for docker workloads")
+		}
+	default:
+		violations = append(violations, fmt.Sprintf("vm_type must be %s or %s", payloads.QEMU, payloads.Docker))
+	}
+
+	for i, s := range wl.Storage {
+		// an existing volume, a source to create a volume from or
+		// a new empty volume.
+		sources := 0
+		if s.ID != "" {
+			sources++
+		}
+		if s.Source != "" {
+			sources++
+		}
+		if sources == 0 && s.SourceType == Empty {
+			sources++
+		}
+
+		if sources != 1 {
+			violations = append(violations, fmt.Sprintf("storage[%d] must have exactly one of id, source_id or an empty source_type", i))
+		}
+	}
+
+	if len(violations) > 0 {
+		return &WorkloadValidationError{Violations: violations}
+	}
+
+	return nil
+}
+
+// NetworkRequirement describes a network interface which the instances of a
+// workload have in addition to their primary one.  Subnet is the CIDR of
+// the tenant subnet the interface is attached to.  The interface is given
+// an address in any subnet of the tenant's network if Subnet is empty.
+type NetworkRequirement struct {
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// MaxDescriptionLength is the maximum length in bytes of the description
+// of a workload or instance.
+const MaxDescriptionLength = 1024
+
+// MaxUserDataLength is the maximum length in bytes of the cloud-init user
+// data supplied when an instance is created, as submitted.
+const MaxUserDataLength = 64 * 1024
+
+// MaxSearchLength is the maximum length in bytes of the text searched for
+// in the names and descriptions of workloads and instances.
+const MaxSearchLength = 256
+
+// WorkloadBounds limits the resource overrides that may be requested when
+// an instance of a workload is launched. A resource can only be overridden
+// if the workload sets a maximum for it. Minimums default to 1.
+type WorkloadBounds struct {
+	MinVCPUs  int `json:"min_vcpus,omitempty"`
+	MaxVCPUs  int `json:"max_vcpus,omitempty"`
+	MinMemMB  int `json:"min_mem_mb,omitempty"`
+	MaxMemMB  int `json:"max_mem_mb,omitempty"`
+	MinDiskGB int `json:"min_disk_gb,omitempty"`
+	MaxDiskGB int `json:"max_disk_gb,omitempty"`
+}
+
+// RequirementOverrides replaces a workload's resource requirements for the
+// instances launched by a single request. Zero values keep the workload's
+// own requirement. DiskGB sets the size of the workload's ephemeral storage,
+// including any storage created locally by the launcher.
+type RequirementOverrides struct {
+	VCPUs  int
+	MemMB  int
+	DiskGB int
 }
 
 // WorkloadResponse will be returned from /workloads apis
@@ -102,32 +219,336 @@ type WorkloadResponse struct {
 // WorkloadRequest contains resource and configuration for a user
 // workload.
 type WorkloadRequest struct {
-	WorkloadID string
-	TenantID   string
-	Instances  int
-	TraceLabel string
-	Name       string
-	Subnet     string
+	WorkloadID  string
+	TenantID    string
+	Instances   int
+	TraceLabel  string
+	Name        string
+	Description string
+	Subnet      string
+	Overrides   RequirementOverrides
+	Volumes     []string
+	Actor       string
+
+	// DeletionProtected is set to protect the instances created from
+	// deletion until the protection is cleared.
+	DeletionProtected bool
+
+	// Template and TemplateVersion identify the launch template, if
+	// any, the instances are created from.
+	Template        string
+	TemplateVersion int
+
+	// ServerGroup is the ID of the server group, if any, the instances
+	// created join.
+	ServerGroup string
+
+	// UserData is cloud-init user data whose keys replace those of the
+	// workload's config for the instances created.
+	UserData string
 }
 
 // Instance contains information about an instance of a workload.
 type Instance struct {
-	ID          string       `json:"instance_id"`
-	TenantID    string       `json:"tenant_id"`
-	State       string       `json:"instance_state"`
-	WorkloadID  string       `json:"workload_id"`
-	NodeID      string       `json:"node_id"`
-	MACAddress  string       `json:"mac_address"`
-	VnicUUID    string       `json:"vnic_uuid"`
-	Subnet      string       `json:"subnet"`
-	IPAddress   string       `json:"ip_address"`
-	SSHIP       string       `json:"ssh_ip"`
-	SSHPort     int          `json:"ssh_port"`
-	CNCI        bool         `json:"-"`
-	CreateTime  time.Time    `json:"-"`
-	Name        string       `json:"name"`
-	StateLock   sync.RWMutex `json:"-"`
-	StateChange *sync.Cond   `json:"-"`
+	ID                string            `json:"instance_id"`
+	TenantID          string            `json:"tenant_id"`
+	State             string            `json:"instance_state"`
+	WorkloadID        string            `json:"workload_id"`
+	NodeID            string            `json:"node_id"`
+	MACAddress        string            `json:"mac_address"`
+	VnicUUID          string            `json:"vnic_uuid"`
+	Subnet            string            `json:"subnet"`
+	IPAddress         string            `json:"ip_address"`
+	SSHIP             string            `json:"ssh_ip"`
+	SSHPort           int               `json:"ssh_port"`
+	CNCI              bool              `json:"-"`
+	CreateTime        time.Time         `json:"-"`
+	Name              string            `json:"name"`
+	Description       string            `json:"description,omitempty"`
+	VCPUs             int               `json:"vcpus,omitempty"`
+	MemMB             int               `json:"mem_mb,omitempty"`
+	EphemeralGB       int               `json:"ephemeral_gb,omitempty"`
+	Template          string            `json:"template,omitempty"`
+	TemplateVersion   int               `json:"template_version,omitempty"`
+	StatusReason      string            `json:"status_reason,omitempty"`
+	DeletionProtected bool              `json:"deletion_protected"`
+	NICs              []NIC             `json:"nics,omitempty"`
+	UserData          string            `json:"-"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	DeleteTime        time.Time         `json:"-"`
+	StateLock         sync.RWMutex      `json:"-"`
+	StateChange       *sync.Cond        `json:"-"`
+}
+
+// NIC is a network interface of an instance in addition to its primary
+// one, whose details are held by the instance itself.
+type NIC struct {
+	VnicUUID   string `json:"vnic_uuid"`
+	MACAddress string `json:"mac_address"`
+	Subnet     string `json:"subnet"`
+	IPAddress  string `json:"ip_address"`
+}
+
+// MaxInstanceTags is the number of tags an instance may have.
+const MaxInstanceTags = 50
+
+// MaxInstanceTagLength is the maximum length in bytes of the key or the
+// value of an instance tag.
+const MaxInstanceTagLength = 255
+
+// InstanceTagRequest sets the value of an instance tag.
+type InstanceTagRequest struct {
+	Value string `json:"value"`
+}
+
+// InstanceUpdate contains the attributes of an instance which may be
+// changed with a JSON merge patch once it has been created.
+type InstanceUpdate struct {
+	Name              string `json:"name"`
+	Description       string `json:"description"`
+	DeletionProtected bool   `json:"deletion_protected"`
+}
+
+// PlacementReason is the reason an instance was placed on a node.
+type PlacementReason string
+
+const (
+	// PlacementInitial is the first placement of a new instance.
+	PlacementInitial PlacementReason = "initial"
+
+	// PlacementReschedule is the placement of a restarted instance.
+	PlacementReschedule PlacementReason = "reschedule"
+
+	// PlacementMigration is the placement of an instance found running
+	// on a node other than the one it was placed on.
+	PlacementMigration PlacementReason = "migration"
+
+	// PlacementEvacuation is the placement of an instance restarted after
+	// its node was evacuated.
+	PlacementEvacuation PlacementReason = "evacuation"
+
+	// PlacementLiveMigration is the placement of an instance live
+	// migrated to another node at the request of an admin.
+	PlacementLiveMigration PlacementReason = "live_migration"
+)
+
+// Placement records an instance being placed on a node.
+type Placement struct {
+	NodeID    string          `json:"node_id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Reason    PlacementReason `json:"reason"`
+}
+
+// InstancePlacements contains the node an instance is placed on and the
+// history of its placements, oldest first.
+type InstancePlacements struct {
+	InstanceID string      `json:"instance_id"`
+	NodeID     string      `json:"node_id"`
+	Placements []Placement `json:"placements"`
+}
+
+// MigrationState is the stage reached by the live migration of an
+// instance.
+type MigrationState string
+
+const (
+	// MigrationPreparing means that the target node has been asked to
+	// get ready to receive the instance.
+	MigrationPreparing MigrationState = "preparing"
+
+	// MigrationTransferring means that the source node has been asked to
+	// transfer the instance to the target node.
+	MigrationTransferring MigrationState = "transferring"
+)
+
+// Migration records the live migration of an instance from the node
+// running it to a target node while it is in progress.
+type Migration struct {
+	InstanceID   string         `json:"instance_id"`
+	TenantID     string         `json:"tenant_id"`
+	SourceNodeID string         `json:"source_node_id"`
+	TargetNodeID string         `json:"target_node_id"`
+	State        MigrationState `json:"state"`
+	StartTime    time.Time      `json:"start_time"`
+}
+
+// InstanceMigrateTarget identifies the node to which an instance is to be
+// migrated.
+type InstanceMigrateTarget struct {
+	NodeID string `json:"node_id"`
+}
+
+// InstanceMigrateRequest is the body of the migrate instance action.
+type InstanceMigrateRequest struct {
+	Migrate InstanceMigrateTarget `json:"migrate"`
+}
+
+// InstanceResizeTarget gives the requirements an instance is to be resized
+// to.  Zero values keep the current requirement of the instance.
+type InstanceResizeTarget struct {
+	VCPUs int `json:"vcpus,omitempty"`
+	MemMB int `json:"mem_mb,omitempty"`
+}
+
+// InstanceResizeRequest is the body of the resize instance action.
+type InstanceResizeRequest struct {
+	Resize InstanceResizeTarget `json:"resize"`
+}
+
+// HistoryEntryType is the kind of an entry in the history of an instance.
+type HistoryEntryType string
+
+const (
+	// HistoryCreated records the creation of an instance and the
+	// parameters it was created with.
+	HistoryCreated HistoryEntryType = "created"
+
+	// HistoryState records a change in the state of an instance.
+	HistoryState HistoryEntryType = "state"
+
+	// HistoryCommand records a command sent to the nodes for an
+	// instance.
+	HistoryCommand HistoryEntryType = "command"
+
+	// HistoryResult records the result of a command received from a
+	// node.
+	HistoryResult HistoryEntryType = "result"
+
+	// HistoryPlacement records an instance being placed on a node.
+	HistoryPlacement HistoryEntryType = "placement"
+
+	// HistoryAttach records a volume being attached to an instance.
+	HistoryAttach HistoryEntryType = "attach"
+
+	// HistoryDetach records a volume being detached from an instance.
+	HistoryDetach HistoryEntryType = "detach"
+
+	// HistoryRequest is an API request made for an instance, taken from
+	// the audit log.
+	HistoryRequest HistoryEntryType = "request"
+
+	// HistoryEvent is an event logged for an instance.
+	HistoryEvent HistoryEntryType = "event"
+)
+
+// InstanceHistoryEntry is an entry in the history of an instance.  NodeID
+// is only returned to admins, or to tenants if the cluster allows them to
+// see nodes.
+type InstanceHistoryEntry struct {
+	Timestamp  time.Time        `json:"timestamp"`
+	Type       HistoryEntryType `json:"type"`
+	Message    string           `json:"message"`
+	NodeID     string           `json:"node_id,omitempty"`
+	Actor      string           `json:"actor,omitempty"`
+	OnBehalfOf string           `json:"on_behalf_of,omitempty"`
+}
+
+// InstanceHistory contains the lifecycle of an instance, oldest entry
+// first.  NextMarker is set when more entries are available and should
+// be passed as the marker of the next request.
+type InstanceHistory struct {
+	InstanceID string                 `json:"instance_id"`
+	TenantID   string                 `json:"tenant_id"`
+	Entries    []InstanceHistoryEntry `json:"entries"`
+	NextMarker string                 `json:"next_marker,omitempty"`
+}
+
+// InstanceHistoryFilter selects a page of the history of an instance.
+// Entries are returned from the position given by Marker, at most Limit
+// of them.
+type InstanceHistoryFilter struct {
+	Marker int
+	Limit  int
+}
+
+// ConsoleLog contains the last lines written by an instance to its serial
+// console, oldest line first.
+type ConsoleLog struct {
+	InstanceID string   `json:"instance_id"`
+	Lines      []string `json:"lines"`
+}
+
+// InstanceCondition is a caveat, reported by the launcher, with which an
+// instance is running.
+type InstanceCondition struct {
+	Type      payloads.InstanceWarningType `json:"type"`
+	Message   string                       `json:"message"`
+	Timestamp time.Time                    `json:"timestamp"`
+}
+
+// ListCursor is the position of an item in the order in which lists are
+// returned: oldest first, with items created at the same time ordered by
+// ID.  Pagination markers encode the cursor of the last item of a page so
+// that items added or removed while a list is paged through do not cause
+// others to be skipped or repeated.
+type ListCursor struct {
+	CreateTime time.Time
+	ID         string
+}
+
+// Before returns true if the item at c is listed before the item at o.
+func (c ListCursor) Before(o ListCursor) bool {
+	if !c.CreateTime.Equal(o.CreateTime) {
+		return c.CreateTime.Before(o.CreateTime)
+	}
+	return c.ID < o.ID
+}
+
+// Marker encodes the cursor as a pagination marker.
+func (c ListCursor) Marker() string {
+	key := c.CreateTime.UTC().Format(time.RFC3339Nano) + " " + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// ParseListMarker decodes a pagination marker created by Marker.
+func ParseListMarker(marker string) (ListCursor, error) {
+	var c ListCursor
+
+	key, err := base64.RawURLEncoding.DecodeString(marker)
+	if err != nil {
+		return c, fmt.Errorf("Invalid marker: %s", marker)
+	}
+
+	parts := strings.SplitN(string(key), " ", 2)
+	if len(parts) != 2 {
+		return c, fmt.Errorf("Invalid marker: %s", marker)
+	}
+
+	c.CreateTime, err = time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return c, fmt.Errorf("Invalid marker: %s", marker)
+	}
+	c.ID = parts[1]
+
+	return c, nil
+}
+
+// ListFilter selects a page of a list.  Only the items listed after the
+// one encoded in Marker are returned, at most Limit of them if Limit is
+// positive.
+type ListFilter struct {
+	Marker string
+	Limit  int
+}
+
+// InstanceFilter selects the instances which are listed.  Empty fields
+// select instances whatever the value of the attribute.  State and NodeID
+// are compared with the state and node last recorded for an instance, Name
+// with its name and Search must be contained in its name or description.
+// Instances selected by TagKey have the tag with that key and TagValue.
+type InstanceFilter struct {
+	WorkloadID string
+	State      string
+	NodeID     string
+	Name       string
+	Search     string
+	TagKey     string
+	TagValue   string
+}
+
+// Cursor returns the position of the instance in lists.
+func (i *Instance) Cursor() ListCursor {
+	return ListCursor{CreateTime: i.CreateTime, ID: i.ID}
 }
 
 // SortedInstancesByID implements sort.Interface for Instance by ID string
@@ -151,6 +572,48 @@ type TenantConfig struct {
 	Permissions struct {
 		PrivilegedContainers bool `json:"privileged_containers"`
 	} `json:"permissions"`
+	Frozen       bool   `json:"frozen,omitempty"`
+	FreezeReason string `json:"freeze_reason,omitempty"`
+
+	// PreprovisionNetwork launches the CNCI for the tenant's first
+	// subnet when the tenant is created.
+	PreprovisionNetwork bool `json:"preprovision_network,omitempty"`
+
+	// TrashRetentionMinutes overrides how long the tenant's deleted
+	// instances and volumes stay in its trash.  Zero uses the cluster
+	// default and a negative value deletes them immediately.
+	TrashRetentionMinutes int `json:"trash_retention_minutes,omitempty"`
+
+	// DeferredDeleteMinutes is how long the tenant's deleted instances
+	// are kept, in the deleted-pending state, before they are actually
+	// deleted.  They may be restored until then.  Zero deletes instances
+	// immediately.
+	DeferredDeleteMinutes int `json:"deferred_delete_minutes,omitempty"`
+
+	// MaxSubnets limits the number of subnets of the tenant's network.
+	// Once all of them are full launches fail with a SubnetFullError.
+	// Zero lets the network grow into a new subnet whenever the
+	// existing ones are full.
+	MaxSubnets int `json:"max_subnets,omitempty"`
+
+	// CNCISize overrides the cluster's size for the CNCIs launched for
+	// the tenant from then on.
+	CNCISize *CNCISize `json:"cnci_size,omitempty"`
+}
+
+// CNCISize is the size of a tenant's CNCIs.  Zero values in a tenant's
+// configuration leave the cluster's value in effect.
+type CNCISize struct {
+	VCPUs  int `json:"vcpus,omitempty"`
+	MemMB  int `json:"mem_mb,omitempty"`
+	DiskMB int `json:"disk_mb,omitempty"`
+}
+
+// TenantDetails is the configuration of a tenant together with the size
+// of the CNCIs which are launched for it.
+type TenantDetails struct {
+	TenantConfig
+	EffectiveCNCISize CNCISize `json:"effective_cnci_size"`
 }
 
 // Tenant contains information about a tenant or project.
@@ -172,19 +635,51 @@ type TenantsListResponse struct {
 	Tenants []TenantSummary `json:"tenants"`
 }
 
-// TenantRequest contains information for creating a new tenant.
+// TenantRequest contains information for creating a new tenant.  A
+// tenant ID is generated when ID is empty.  Quotas are the initial quotas
+// and limits of the tenant, any not listed are unlimited.
 type TenantRequest struct {
-	ID     string       `json:"id"`
-	Config TenantConfig `json:"config"`
+	ID     string         `json:"id"`
+	Config TenantConfig   `json:"config"`
+	Quotas []QuotaDetails `json:"quotas,omitempty"`
+}
+
+// TenantRecord describes a tenant returned when it is created.  Warnings
+// report problems which did not prevent the creation of the tenant, such as
+// its name being used by another tenant.
+type TenantRecord struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Config   TenantConfig   `json:"config"`
+	Quotas   []QuotaDetails `json:"quotas"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Links    []Link         `json:"links,omitempty"`
 }
 
 // LogEntry stores information about events.
 type LogEntry struct {
-	Timestamp time.Time `json:"time_stamp"`
-	TenantID  string    `json:"tenant_id"`
-	NodeID    string    `json:"node_id"`
-	EventType string    `json:"type"`
-	Message   string    `json:"message"`
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"time_stamp"`
+	TenantID    string    `json:"tenant_id"`
+	NodeID      string    `json:"node_id"`
+	EventType   string    `json:"type"`
+	Message     string    `json:"message"`
+	ObjectID    string    `json:"object_id"`
+	Actor       string    `json:"actor"`
+	OnBehalfOf  string    `json:"on_behalf_of"`
+	FailureCode string    `json:"failure_code,omitempty"`
+}
+
+// EventFilter selects the log entries returned by an event query.  Zero
+// valued fields do not filter.  Only entries with an ID greater than
+// Marker are returned, at most Limit of them.
+type EventFilter struct {
+	Start    time.Time
+	End      time.Time
+	Type     string
+	ObjectID string
+	Marker   int64
+	Limit    int
 }
 
 // NodeStats stores statistics for individual nodes in the cluster.
@@ -257,6 +752,7 @@ type Node struct {
 	AttachVolumeFailures int        `json:"attach_failures"`
 	DeleteFailures       int        `json:"delete_failures"`
 	NodeRole             ssntp.Role `json:"role"`
+	Labels               []string   `json:"labels,omitempty"`
 }
 
 // BlockState represents the state of the block device in the controller
@@ -278,6 +774,10 @@ const (
 	// Detaching means that the volume is in process
 	// of detaching.
 	Detaching BlockState = "detaching"
+
+	// PendingDelete means that the volume has been deleted by its
+	// tenant and is kept in the tenant's trash until it is purged.
+	PendingDelete BlockState = "pending-delete"
 )
 
 // Volume respresents the attributes of this block device.
@@ -291,6 +791,39 @@ type Volume struct {
 	Name        string     `json:"name"`        // a human readable name for this volume
 	Description string     `json:"description"` // some text to describe this volume.
 	Internal    bool       `json:"internal"`    // whether this storage should be shown to the user
+
+	DeletionProtected bool `json:"deletion_protected"` // whether the volume may not be deleted
+}
+
+// VolumeUpdate contains the attributes of a volume which may be changed
+// with a JSON merge patch once it has been created.
+type VolumeUpdate struct {
+	DeletionProtected bool `json:"deletion_protected"`
+}
+
+// Cursor returns the position of the volume in lists.
+func (v Volume) Cursor() ListCursor {
+	return ListCursor{CreateTime: v.CreateTime, ID: v.ID}
+}
+
+// VolumeStateRequest is used by the admin to repair the recorded state of a
+// volume. The reason is kept in the volume owner's event log.
+type VolumeStateRequest struct {
+	State  BlockState `json:"state"`
+	Reason string     `json:"reason"`
+}
+
+// ForceDetachRequest is used by the admin to detach a volume from an
+// instance which can no longer release it. Confirm must be set to detach a
+// volume from an instance which is still running.
+type ForceDetachRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+// VolumeAttachRequest names the instance a volume is attached to, or
+// detached from, by the attach and detach volume actions.
+type VolumeAttachRequest struct {
+	InstanceID string `json:"instance_id"`
 }
 
 // StorageAttachment represents a link between a block device and
@@ -301,6 +834,47 @@ type StorageAttachment struct {
 	BlockID    string // the ID of the block device
 	Ephemeral  bool   // whether the storage should be deleted on Cleanup
 	Boot       bool   // whether this is a boot device
+	Tag        string // the tag requested to identify the volume in the instance
+	Device     string // the path of the volume in the instance reported by the launcher
+}
+
+// AttachmentDetails describes a storage attachment, together with the state
+// of its volume and the node of its instance, for the admin.
+type AttachmentDetails struct {
+	ID         string     `json:"id"`
+	TenantID   string     `json:"tenant_id"`
+	InstanceID string     `json:"instance_id"`
+	VolumeID   string     `json:"volume_id"`
+	NodeID     string     `json:"node_id,omitempty"`
+	State      BlockState `json:"state"`
+	StateTime  time.Time  `json:"state_time"`
+	Boot       bool       `json:"boot"`
+	Ephemeral  bool       `json:"ephemeral"`
+	Tag        string     `json:"tag,omitempty"`
+	Device     string     `json:"device,omitempty"`
+}
+
+// AttachmentFilter selects the attachments returned by an attachments
+// query.  Zero valued fields do not filter.  NodeID matches the node of
+// the latest placement of the attached instance and State the state of the
+// attached volume.  Attachments are listed in ID order; only those with an
+// ID greater than Marker are returned, at most Limit of them.
+type AttachmentFilter struct {
+	TenantID   string
+	InstanceID string
+	VolumeID   string
+	NodeID     string
+	State      BlockState
+	Marker     string
+	Limit      int
+}
+
+// ListAttachmentsResponse represents a page of storage attachments.
+// NextMarker is set when more attachments may be available and should be
+// passed as the marker of the next request.
+type ListAttachmentsResponse struct {
+	Attachments []AttachmentDetails `json:"attachments"`
+	NextMarker  string              `json:"next_marker,omitempty"`
 }
 
 // CiaoNode contains status and statistic information for an individual
@@ -324,6 +898,28 @@ type CiaoNode struct {
 	StartFailures         int       `json:"start_failures"`
 	AttachVolumeFailures  int       `json:"attach_failures"`
 	DeleteFailures        int       `json:"delete_failures"`
+	ClockOffset           int64     `json:"clock_offset_ms"`
+	ClockSkewed           bool      `json:"clock_skewed"`
+	Labels                []string  `json:"labels,omitempty"`
+	Maintenance           bool      `json:"maintenance"`
+}
+
+// CiaoNodeSummary represents the unmarshalled version of the contents of a
+// v2.1/nodes/{node}/summary response.  It summarises the instances placed
+// on a node and their usage, as reported in their latest stats.  LastSeen
+// is when the node last sent stats, zero if it never has, and Stale is set
+// if it has not sent any for longer than the period the summary was
+// requested with.
+type CiaoNodeSummary struct {
+	ID                    string    `json:"id"`
+	TotalInstances        int       `json:"total_instances"`
+	TotalRunningInstances int       `json:"total_running_instances"`
+	TotalPendingInstances int       `json:"total_pending_instances"`
+	TotalExitedInstances  int       `json:"total_exited_instances"`
+	MemUsage              int       `json:"ram_usage"`
+	DiskUsage             int       `json:"disk_usage"`
+	LastSeen              time.Time `json:"last_seen"`
+	Stale                 bool      `json:"stale"`
 }
 
 // NodeStatusType contains the valid values of a node's status
@@ -341,8 +937,71 @@ const (
 	// NodeStatusMaintenance indicates that a node is in maintenance mode
 	// and cannot satisfy start requests.
 	NodeStatusMaintenance NodeStatusType = "MAINTENANCE"
+
+	// NodeStatusSuspect indicates that a node has stopped sending stats
+	// but has not yet been declared down.
+	NodeStatusSuspect NodeStatusType = "SUSPECT"
+
+	// NodeStatusDown indicates that a node has not sent any stats for
+	// long enough to be considered lost.  Its instances are unreachable.
+	NodeStatusDown NodeStatusType = "DOWN"
 )
 
+// DatabaseMaintenance describes the most recent compaction of the
+// controller database.
+type DatabaseMaintenance struct {
+	Time       time.Time `json:"time"`
+	SizeBefore int64     `json:"size_before"`
+	SizeAfter  int64     `json:"size_after"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DatabaseStatus describes the size of the controller database.  Sizes
+// are in bytes.
+type DatabaseStatus struct {
+	FileSize        int64                `json:"file_size"`
+	WALSize         int64                `json:"wal_size"`
+	PageSize        int64                `json:"page_size"`
+	PageCount       int64                `json:"page_count"`
+	FreelistPages   int64                `json:"freelist_pages"`
+	SizeWarning     bool                 `json:"size_warning"`
+	LastMaintenance *DatabaseMaintenance `json:"last_maintenance,omitempty"`
+}
+
+// CiaoClusterStatus represents the unmarshalled version of the contents
+// of a /v2.1/nodes/summary response.  It contains the number of nodes in
+// each status, the capacity of the nodes which are not down and the size
+// of the controller database.
+type CiaoClusterStatus struct {
+	Status struct {
+		TotalNodes            int `json:"total_nodes"`
+		TotalNodesReady       int `json:"total_nodes_ready"`
+		TotalNodesFull        int `json:"total_nodes_full"`
+		TotalNodesMaintenance int `json:"total_nodes_maintenance"`
+		TotalNodesSuspect     int `json:"total_nodes_suspect"`
+		TotalNodesDown        int `json:"total_nodes_down"`
+		MemTotal              int `json:"ram_total"`
+		MemAvailable          int `json:"ram_available"`
+		DiskTotal             int `json:"disk_total"`
+		DiskAvailable         int `json:"disk_available"`
+		OnlineCPUs            int `json:"online_cpus"`
+	} `json:"cluster"`
+	Database DatabaseStatus `json:"database"`
+
+	// DegradedTenants are the tenants whose network controllers could
+	// not be initialized.  Their instances cannot be launched until the
+	// initialization is retried successfully.
+	DegradedTenants []DegradedTenant `json:"degraded_tenants,omitempty"`
+}
+
+// DegradedTenant records the failure to initialize the network controller
+// of a tenant.
+type DegradedTenant struct {
+	TenantID string    `json:"tenant_id"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
 // CiaoNodeStatus contains status information for an individual node.
 type CiaoNodeStatus struct {
 	Status NodeStatusType `json:"status"`
@@ -407,6 +1066,7 @@ type CiaoCNCI struct {
 	IPv4      string           `json:"IPv4"`
 	Geography string           `json:"geography"`
 	Subnets   []CiaoCNCISubnet `json:"subnets"`
+	Image     string           `json:"image,omitempty"`
 }
 
 // CiaoCNCIDetail represents the unmarshalled version of the contents of a
@@ -474,6 +1134,13 @@ type CiaoServersAction struct {
 	ServerIDs []string `json:"servers"`
 }
 
+// CiaoServersActionResponse is the response to a v2.1/servers/action
+// request.  Protected lists the instances which were not deleted by an
+// os-delete action because they are protected from deletion.
+type CiaoServersActionResponse struct {
+	Protected []string `json:"protected,omitempty"`
+}
+
 // CiaoTraceSummary contains information about a specific SSNTP Trace label.
 type CiaoTraceSummary struct {
 	Label     string `json:"label"`
@@ -520,16 +1187,23 @@ type CiaoTraceData struct {
 // CiaoEvent contains information about an individual event generated
 // in a ciao cluster.
 type CiaoEvent struct {
-	Timestamp time.Time `json:"time_stamp"`
-	TenantID  string    `json:"tenant_id"`
-	EventType string    `json:"type"`
-	Message   string    `json:"message"`
+	ID         int64     `json:"id,omitempty"`
+	Timestamp  time.Time `json:"time_stamp"`
+	TenantID   string    `json:"tenant_id"`
+	EventType  string    `json:"type"`
+	Message    string    `json:"message"`
+	ObjectID   string    `json:"object_id,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	OnBehalfOf string    `json:"on_behalf_of,omitempty"`
 }
 
 // CiaoEvents represents the unmarshalled version of the response to a
-// v2.1/{tenant}/event or v2.1/event request.
+// v2.1/{tenant}/event or v2.1/event request.  NextMarker is set when
+// more events are available and should be passed as the marker of the
+// next request.
 type CiaoEvents struct {
-	Events []CiaoEvent `json:"events"`
+	Events     []CiaoEvent `json:"events"`
+	NextMarker string      `json:"next_marker,omitempty"`
 }
 
 // NewCiaoEvents allocates a CiaoEvents structure.
@@ -548,18 +1222,20 @@ var (
 	// ErrTenantNotFound is returned when a tenant ID is unknown.
 	ErrTenantNotFound = errors.New("Tenant not found")
 
+	// ErrTenantExists is returned when creating a tenant whose ID is
+	// already used by a tenant with a different configuration.
+	ErrTenantExists = errors.New("Tenant already exists with a different configuration")
+
 	// ErrInstanceNotFound is returned when an instance is not found.
 	ErrInstanceNotFound = errors.New("Instance not found")
 
+	// ErrNodeNotFound is returned when a node has neither sent stats
+	// nor had instances placed on it.
+	ErrNodeNotFound = errors.New("Node not found")
+
 	// ErrInstanceNotAssigned is returned when an instance is not assigned to a node.
 	ErrInstanceNotAssigned = errors.New("Cannot perform operation: instance not assigned to Node")
 
-	// ErrDuplicateSubnet is returned when a subnet already exists
-	ErrDuplicateSubnet = errors.New("Cannot add overlapping subnet")
-
-	// ErrDuplicateIP is returned when a duplicate external IP is added
-	ErrDuplicateIP = errors.New("Cannot add duplicated external IP")
-
 	// ErrInvalidIP is returned when an IP cannot be parsed
 	ErrInvalidIP = errors.New("The IP Address is not valid")
 
@@ -581,6 +1257,10 @@ var (
 	// ErrBadRequest is returned when we have a malformed request
 	ErrBadRequest = errors.New("Invalid Request")
 
+	// ErrAddressNotInPool is returned when an address requested for an
+	// instance is not one of the addresses of the pool
+	ErrAddressNotInPool = errors.New("Address does not belong to the pool")
+
 	// ErrPoolEmpty is returned when a pool has no free IPs
 	ErrPoolEmpty = errors.New("Pool has no Free IPs")
 
@@ -597,8 +1277,281 @@ var (
 	// ErrWorkloadInUse is returned by DeleteWorkload when an instance of a workload is still active.
 	ErrWorkloadInUse = errors.New("Workload definition still in use")
 
+	// ErrPublicWorkload is returned when a tenant tries to change a public
+	// workload. Only the admin may change the public workload catalog.
+	ErrPublicWorkload = errors.New("Public workloads may only be changed by the admin")
+
+	// ErrWorkloadRequirementsInUse is returned when an update would change
+	// the requirements of a workload which still has instances.
+	ErrWorkloadRequirementsInUse = errors.New("Workload requirements may not change while instances use it")
+
+	// ErrCNCIWorkload is returned when the CNCI workload, which the
+	// controller generates itself, is to be changed or deleted.
+	ErrCNCIWorkload = errors.New("The CNCI workload may not be modified")
+
 	// ErrBadName is returned when a name doesn't match the requirements
 	ErrBadName = errors.New("Requested name doesn't match requirements")
+
+	// ErrDescriptionTooLong is returned when the description of a
+	// workload or instance is longer than MaxDescriptionLength, or a
+	// search is longer than MaxSearchLength.
+	ErrDescriptionTooLong = errors.New("Description too long")
+
+	// ErrBadUserData is returned when the user data of an instance is
+	// longer than MaxUserDataLength or is not a YAML mapping.
+	ErrBadUserData = errors.New("Invalid user data")
+
+	// ErrBadInstanceTag is returned when the key of an instance tag is
+	// empty or contains a colon, or its key or value is longer than
+	// MaxInstanceTagLength.
+	ErrBadInstanceTag = errors.New("Invalid instance tag")
+
+	// ErrTooManyInstanceTags is returned when a tag would be added to an
+	// instance which already has MaxInstanceTags tags.
+	ErrTooManyInstanceTags = errors.New("Too many instance tags")
+
+	// ErrInstanceTagNotFound is returned when an instance tag is not found
+	ErrInstanceTagNotFound = errors.New("Instance tag not found")
+
+	// ErrWebhookNotFound is returned when a webhook subscription is not found
+	ErrWebhookNotFound = errors.New("Webhook not found")
+
+	// ErrLaunchTemplateNotFound is returned when a launch template is not
+	// found
+	ErrLaunchTemplateNotFound = errors.New("Launch template not found")
+
+	// ErrLaunchTemplateExists is returned when creating a launch template
+	// with the name of an existing template of the tenant
+	ErrLaunchTemplateExists = errors.New("Launch template already exists")
+
+	// ErrServerGroupNotFound is returned when a server group is not found
+	ErrServerGroupNotFound = errors.New("Server group not found")
+
+	// ErrBadServerGroup is returned when creating a server group whose
+	// policy is neither affinity nor anti-affinity
+	ErrBadServerGroup = errors.New("Invalid server group policy")
+
+	// ErrLaunchConfigNotFound is returned when the configuration an
+	// instance was started with is not known, e.g. because the instance
+	// was started before launch configurations were recorded
+	ErrLaunchConfigNotFound = errors.New("Launch configuration not found")
+
+	// ErrSnapshotScheduleNotFound is returned when a snapshot schedule is
+	// not found
+	ErrSnapshotScheduleNotFound = errors.New("Snapshot schedule not found")
+
+	// ErrBadSnapshotSchedule is returned when creating a snapshot schedule
+	// which selects no volume, or selects both a volume and a tag, or
+	// whose interval, offset or retention is out of range
+	ErrBadSnapshotSchedule = errors.New("Invalid snapshot schedule")
+
+	// ErrVolumeSnapshotNotFound is returned when a snapshot of a volume is
+	// not found
+	ErrVolumeSnapshotNotFound = errors.New("Volume snapshot not found")
+
+	// ErrVolumeHasSnapshots is returned when deleting a volume of which
+	// snapshots have been taken on request and not yet deleted
+	ErrVolumeHasSnapshots = errors.New("Volume has snapshots")
+
+	// ErrBadImagePreseed is returned when a request to cache an image on
+	// nodes selects no nodes, or selects them in more than one way, or
+	// lists unknown nodes
+	ErrBadImagePreseed = errors.New("Invalid image preseed request")
+
+	// ErrImageNotActive is returned when an image which has not been
+	// uploaded is to be cached on nodes
+	ErrImageNotActive = errors.New("Image is not active")
+
+	// ErrBadMigration is returned when an instance is to be migrated to
+	// an unknown node, a node which is not a compute node or the node
+	// already running it
+	ErrBadMigration = errors.New("Invalid migration target")
+
+	// ErrInstanceNotMigratable is returned when an instance which is not
+	// a running VM is to be migrated
+	ErrInstanceNotMigratable = errors.New("Only running VM instances may be migrated")
+
+	// ErrInstanceMigrating is returned when an instance which is being
+	// migrated is to be migrated again, stopped or deleted
+	ErrInstanceMigrating = errors.New("Instance is being migrated")
+
+	// ErrBadResize is returned when an instance is to be resized without
+	// new requirements, with negative requirements or with the
+	// requirements it already runs with
+	ErrBadResize = errors.New("Invalid resize requirements")
+
+	// ErrInstanceNotResizable is returned when an instance which is not
+	// a running VM is to be resized
+	ErrInstanceNotResizable = errors.New("Only running VM instances may be resized")
+
+	// ErrInstanceResizing is returned when an instance which is being
+	// resized is to be resized again
+	ErrInstanceResizing = errors.New("Instance is being resized")
+
+	// ErrInstanceNameInUse is returned when an instance is given the
+	// name of another instance of its tenant
+	ErrInstanceNameInUse = errors.New("Instance name already in use")
+
+	// ErrBadInstanceName is returned when an instance is given a name
+	// which could be mistaken for an instance ID
+	ErrBadInstanceName = errors.New("Instance names may not be UUIDs")
+
+	// ErrInstanceChangingState is returned when an instance which is
+	// being launched, stopped, migrated or deleted is to be renamed
+	ErrInstanceChangingState = errors.New("Instance is changing state")
+
+	// ErrInstanceDeletePending is returned when an instance which has
+	// been deleted but is still in its grace period is to be started or
+	// stopped
+	ErrInstanceDeletePending = errors.New("Instance is pending deletion")
+
+	// ErrInstanceNotDeletePending is returned when an instance which is
+	// not pending deletion is to be restored
+	ErrInstanceNotDeletePending = errors.New("Instance is not pending deletion")
+
+	// ErrInstancePending is returned when the console log of an instance
+	// which has not yet been started on a node is requested
+	ErrInstancePending = errors.New("Instance is pending")
+
+	// ErrConsoleLogUnavailable is returned when the node running an
+	// instance is unable to return its console log in time
+	ErrConsoleLogUnavailable = errors.New("Console log unavailable")
+
+	// ErrAPIKeyNotFound is returned when an API key is not found
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	// ErrBadAPIKey is returned when creating an API key without a name,
+	// with an unknown scope or with an expiry in the past
+	ErrBadAPIKey = errors.New("Invalid API key request")
+
+	// ErrAuthTokenNotFound is returned when a token is not found
+	ErrAuthTokenNotFound = errors.New("Token not found")
+
+	// ErrAuthTokensDisabled is returned when a token is requested but no
+	// signing key is configured
+	ErrAuthTokensDisabled = errors.New("Tokens are not enabled")
+
+	// ErrPolicyRuleNotFound is returned when a policy rule is not found
+	ErrPolicyRuleNotFound = errors.New("Policy rule not found")
+
+	// ErrBadPolicyRule is returned when a policy rule has no conditions,
+	// an invalid severity or an invalid image pattern
+	ErrBadPolicyRule = errors.New("Invalid policy rule")
+
+	// ErrSettingNotFound is returned when a cluster setting is not known
+	// to the controller
+	ErrSettingNotFound = errors.New("Unknown setting")
+
+	// ErrBadTenantExport is returned when a tenant export is not of a
+	// supported version or does not name a tenant
+	ErrBadTenantExport = errors.New("Invalid tenant export")
+
+	// ErrOperationNotFound is returned when an operation is not found
+	ErrOperationNotFound = errors.New("Operation not found")
+
+	// ErrNoPreviousCNCIImage is returned when rolling back the CNCI image
+	// before a new image has been registered
+	ErrNoPreviousCNCIImage = errors.New("No previous CNCI image")
+
+	// ErrCNCIRolloutInProgress is returned when a CNCI image rollout is
+	// requested while another is still running
+	ErrCNCIRolloutInProgress = errors.New("CNCI image rollout in progress")
+
+	// ErrSignedURLsDisabled is returned when a signed URL is requested
+	// but no signing key is configured
+	ErrSignedURLsDisabled = errors.New("Signed URLs are not enabled")
+
+	// ErrTenantCANotFound is returned when a tenant has no registered
+	// client CA
+	ErrTenantCANotFound = errors.New("Tenant CA not found")
+
+	// ErrVolumeNotFound is returned when a volume is not found
+	ErrVolumeNotFound = errors.New("Volume not found")
+
+	// ErrVolumeInstanceActive is returned when force detaching a volume
+	// from a running instance without confirmation
+	ErrVolumeInstanceActive = errors.New("Volume is attached to a running instance")
+
+	// ErrBadVolumeSize is returned when extending a volume to a size no
+	// larger than its current size
+	ErrBadVolumeSize = errors.New("Volumes may only be extended")
+
+	// ErrVolumeAttached is returned when extending an attached volume
+	// without requesting an online extension
+	ErrVolumeAttached = errors.New("Volume is attached, it may only be extended online")
+
+	// ErrBadVolumeTag is returned when the tag requested for a volume
+	// being attached cannot be used as the serial number of a disk
+	ErrBadVolumeTag = errors.New("Volume tags must be 1 to 20 letters, digits, '.', '_' or '-'")
+
+	// ErrVolumeTagInUse is returned when the tag requested for a volume
+	// being attached already identifies another volume of the instance
+	ErrVolumeTagInUse = errors.New("Tag already used by a volume attached to the instance")
+
+	// ErrVolumeBusy is returned when a volume is attached or detached
+	// while an earlier attach or detach of the volume has not completed
+	ErrVolumeBusy = errors.New("Volume is being attached or detached")
+
+	// ErrVolumeNotAvailable is returned when attaching a volume which is
+	// not available
+	ErrVolumeNotAvailable = errors.New("Volume is not available")
+
+	// ErrVolumeNotInUse is returned when detaching a volume from an
+	// instance it is not attached to
+	ErrVolumeNotInUse = errors.New("Volume is not attached to the instance")
+
+	// ErrBootVolume is returned when detaching the boot volume of an
+	// instance
+	ErrBootVolume = errors.New("Boot volumes may not be detached")
+
+	// ErrInstanceNotRunning is returned when attaching a volume to, or
+	// detaching a volume from, an instance which is not running
+	ErrInstanceNotRunning = errors.New("Instance is not running")
+
+	// ErrDeletionProtected is returned when deleting an instance or
+	// volume, or a tenant owning one, which is protected from deletion
+	ErrDeletionProtected = errors.New("Deletion protection must be cleared before deleting")
+
+	// ErrBadQuotaResource is returned when the quota history of a
+	// resource which is not subject to a quota is requested
+	ErrBadQuotaResource = errors.New("Resource not subject to a quota")
+
+	// ErrBadNodeStatus is returned when a node is asked to change to a
+	// status other than ready or maintenance, or to be evacuated without
+	// being put into maintenance
+	ErrBadNodeStatus = errors.New("Node status must be ready or maintenance")
+
+	// ErrTenantHasInstances is returned when deleting a tenant which
+	// still has instances without forcing the deletion
+	ErrTenantHasInstances = errors.New("Tenant has instances")
+
+	// ErrTenantDeleting is returned when deleting a tenant which is
+	// already being deleted
+	ErrTenantDeleting = errors.New("Tenant is being deleted")
+
+	// ErrTenantOnlyPoolTenant is returned when deleting the only tenant
+	// allowed to use a pool, which would leave the pool open to all
+	// tenants
+	ErrTenantOnlyPoolTenant = errors.New("Tenant is the only tenant allowed to use a pool")
+
+	// ErrTrashItemNotFound is returned when an item is not in the trash
+	ErrTrashItemNotFound = errors.New("Trash item not found")
+
+	// ErrTrashNameReused is returned when restoring an instance whose
+	// name has been given to another instance since it was deleted
+	ErrTrashNameReused = errors.New("Instance name has been reused since the instance was deleted")
+
+	// ErrTrashVolumePurged is returned when restoring a volume whose
+	// storage has already been removed
+	ErrTrashVolumePurged = errors.New("Volume storage has already been purged")
+
+	// ErrLaunchLimit is returned when a tenant launches an instance while
+	// it already has as many launches in progress as it is allowed
+	ErrLaunchLimit = errors.New("Too many launches in progress")
+
+	// ErrSubnetExhausted is returned when every subnet of a tenant's
+	// address range is full
+	ErrSubnetExhausted = errors.New("Tenant network has no free addresses")
 )
 
 // Link provides a url and relationship for a resource.
@@ -615,6 +1568,132 @@ type APILink struct {
 	MinVersion string `json:"minimum_version"`
 }
 
+// Optional controller features reported in Capabilities.
+const (
+	// FeatureSnapshots is the volume and instance snapshot API.
+	FeatureSnapshots = "snapshots"
+
+	// FeatureMigrations is live migration of instances between nodes.
+	FeatureMigrations = "migrations"
+
+	// FeatureMetadataService is the instance metadata service.
+	FeatureMetadataService = "metadata_service"
+
+	// FeatureEventStream is the server-sent events stream.
+	FeatureEventStream = "event_stream"
+
+	// FeatureWebhooks is delivery of controller events to webhooks.
+	FeatureWebhooks = "webhooks"
+
+	// FeatureImpersonation allows admins to act on behalf of tenants.
+	FeatureImpersonation = "impersonation"
+
+	// FeatureTenantCAs allows tenants to register their own client CAs.
+	FeatureTenantCAs = "tenant_cas"
+
+	// FeatureWorkloadOverrides allows launch time overrides of workload
+	// requirements.
+	FeatureWorkloadOverrides = "workload_overrides"
+
+	// FeatureVolumeRepair is admin force detach and volume state repair.
+	FeatureVolumeRepair = "volume_repair"
+
+	// FeatureVolumeAttachments is the admin listing of storage
+	// attachments.
+	FeatureVolumeAttachments = "volume_attachments"
+
+	// FeatureSettings is the admin API for runtime cluster settings.
+	FeatureSettings = "settings"
+
+	// FeatureTenantExport is the export and import of tenant definitions.
+	FeatureTenantExport = "tenant_export"
+
+	// FeatureConsoleLog is the console log sub-resource of instances.
+	FeatureConsoleLog = "console_log"
+
+	// FeatureInstanceResize is changing the VCPUs and memory of running
+	// instances.
+	FeatureInstanceResize = "instance_resize"
+
+	// FeatureInstanceTags is tagging instances and listing them by tag.
+	FeatureInstanceTags = "instance_tags"
+
+	// FeatureDeferredDelete is keeping deleted instances, which may be
+	// restored, for a grace period set per tenant.
+	FeatureDeferredDelete = "deferred_delete"
+
+	// FeatureAuthTokens is authenticating with bearer tokens obtained
+	// with a client certificate.
+	FeatureAuthTokens = "auth_tokens"
+
+	// FeatureLeaderElection is active/standby controller leader election.
+	FeatureLeaderElection = "leader_election"
+
+	// FeatureDBMaintenance is periodic database maintenance.
+	FeatureDBMaintenance = "db_maintenance"
+
+	// FeatureNetworkPrepare is launching tenant CNCIs ahead of instances.
+	FeatureNetworkPrepare = "network_prepare"
+
+	// FeatureTenantNetworkRetry is retrying the initialization of the
+	// network controllers of degraded tenants.
+	FeatureTenantNetworkRetry = "tenant_network_retry"
+
+	// FeatureTrash is the tenant trash of deleted instances and volumes.
+	FeatureTrash = "trash"
+
+	// FeaturePoolAccess is restricting external IP pools to tenants.
+	FeaturePoolAccess = "pool_access"
+
+	// FeatureInstanceHistory is the history sub-resource of instances.
+	FeatureInstanceHistory = "instance_history"
+
+	// FeatureCapacityHints is the tenant capacity resource.
+	FeatureCapacityHints = "capacity_hints"
+
+	// FeatureSubnetLimits is the tenant subnet limit and network resource.
+	FeatureSubnetLimits = "subnet_limits"
+
+	// FeatureSignedURLs is downloading resources through signed URLs.
+	FeatureSignedURLs = "signed_urls"
+
+	// FeatureUsageHistory is tenant usage sampling and export.
+	FeatureUsageHistory = "usage_history"
+
+	// FeatureLaunchTemplates is the tenant launch template resource.
+	FeatureLaunchTemplates = "launch_templates"
+
+	// FeatureServerGroups is the tenant server group resource and the
+	// placement of instances by the policy of their group.
+	FeatureServerGroups = "server_groups"
+
+	// FeatureSnapshotSchedules is periodic snapshots of tenant volumes.
+	FeatureSnapshotSchedules = "snapshot_schedules"
+
+	// FeatureVolumeSnapshots is taking, deleting and restoring snapshots
+	// of volumes on request.
+	FeatureVolumeSnapshots = "volume_snapshots"
+
+	// FeatureImagePreseed is caching images on nodes ahead of launches.
+	FeatureImagePreseed = "image_preseed"
+
+	// FeatureWorkloadPolicy is the admin workload policy resource.
+	FeatureWorkloadPolicy = "workload_policy"
+
+	// FeatureAuditLog is the admin audit log of mutating API requests.
+	FeatureAuditLog = "audit_log"
+)
+
+// Capabilities describes a controller build and the optional features it
+// supports.  Features are enabled if they are both compiled in and enabled
+// by the cluster configuration.
+type Capabilities struct {
+	Version     string            `json:"version"`
+	GitCommit   string            `json:"git_commit"`
+	APIVersions map[string]string `json:"api_versions"`
+	Features    map[string]bool   `json:"features"`
+}
+
 // ExternalSubnet represents a subnet for External IPs.
 type ExternalSubnet struct {
 	ID    string `json:"id"`
@@ -638,9 +1717,118 @@ type Pool struct {
 	Links    []Link           `json:"links"`
 	Subnets  []ExternalSubnet `json:"subnets"`
 	IPs      []ExternalIP     `json:"ips"`
+
+	// Tenants is the list of tenants which may map addresses from the
+	// pool.  Pools without a list may be used by any tenant.
+	Tenants []string `json:"tenants,omitempty"`
+
+	CreateTime time.Time `json:"create_time"`
 }
 
-// NewPoolRequest is used to create a new pool.
+// Cursor returns the position of the pool in lists.
+func (p Pool) Cursor() ListCursor {
+	return ListCursor{CreateTime: p.CreateTime, ID: p.ID}
+}
+
+// Accessible returns true if tenantID may map addresses from the pool.
+func (p Pool) Accessible(tenantID string) bool {
+	if len(p.Tenants) == 0 {
+		return true
+	}
+
+	for _, t := range p.Tenants {
+		if t == tenantID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Contains returns true if address is one of the addresses the pool maps.
+// The first address of each subnet of the pool is never mapped.
+func (p Pool) Contains(address string) bool {
+	IP := net.ParseIP(address)
+	if IP == nil {
+		return false
+	}
+
+	for _, sub := range p.Subnets {
+		_, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			continue
+		}
+
+		if ipNet.Contains(IP) && !IP.Equal(ipNet.IP) {
+			return true
+		}
+	}
+
+	for _, ip := range p.IPs {
+		if IP.Equal(net.ParseIP(ip.Address)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PoolAccessRequest is used by the admin to restrict a pool to a list of
+// tenants.  An empty list makes the pool public.
+type PoolAccessRequest struct {
+	Tenants []string `json:"tenants"`
+}
+
+// PoolRestrictedError is returned when a tenant requests an address from a
+// pool it may not use.
+type PoolRestrictedError struct {
+	Pool string
+}
+
+func (e *PoolRestrictedError) Error() string {
+	return fmt.Sprintf("Pool %s is restricted", e.Pool)
+}
+
+// AddressInUseError is returned when an address requested for an instance
+// is already mapped.  InstanceID, the instance the address is mapped to,
+// is only reported to the admin.
+type AddressInUseError struct {
+	Address    string
+	InstanceID string
+}
+
+func (e *AddressInUseError) Error() string {
+	return fmt.Sprintf("Address %s is already mapped", e.Address)
+}
+
+// RangeOverlapError is returned when an address range added to a pool
+// overlaps a range already in a pool or added along with it, or the CNCI
+// network when Pool is empty.
+type RangeOverlapError struct {
+	Range    string
+	Conflict string
+	Pool     string
+}
+
+func (e *RangeOverlapError) Error() string {
+	if e.Pool == "" {
+		return fmt.Sprintf("%s overlaps the CNCI network %s", e.Range, e.Conflict)
+	}
+	return fmt.Sprintf("%s overlaps %s in pool %s", e.Range, e.Conflict, e.Pool)
+}
+
+// SubnetFullError is returned when a tenant's network has no free address
+// for an instance and may not grow into another subnet.
+type SubnetFullError struct {
+	Subnet   string
+	Capacity int
+}
+
+func (e *SubnetFullError) Error() string {
+	return fmt.Sprintf("Subnet %s is full, it has room for %d instances", e.Subnet, e.Capacity)
+}
+
+// NewPoolRequest is used to create a new pool.
 type NewPoolRequest struct {
 	Name   string  `json:"name"`
 	Subnet *string `json:"subnet"`
@@ -658,9 +1846,11 @@ type PoolSummary struct {
 	Links    []Link `json:"links,omitempty"`
 }
 
-// ListPoolsResponse respresents a summary list of all pools.
+// ListPoolsResponse respresents a summary list of all pools.  NextMarker
+// is set when more pools are available.
 type ListPoolsResponse struct {
-	Pools []PoolSummary `json:"pools"`
+	Pools      []PoolSummary `json:"pools"`
+	NextMarker string        `json:"next_marker,omitempty"`
 }
 
 // NewIPAddressRequest is used to add a new external IP to a pool.
@@ -684,6 +1874,13 @@ type MappedIP struct {
 	PoolID     string `json:"pool_id"`
 	PoolName   string `json:"pool_name"`
 	Links      []Link `json:"links"`
+
+	CreateTime time.Time `json:"create_time"`
+}
+
+// Cursor returns the position of the mapping in lists.
+func (m MappedIP) Cursor() ListCursor {
+	return ListCursor{CreateTime: m.CreateTime, ID: m.ID}
 }
 
 // MappedIPShort is a summary version of a MappedIP.
@@ -700,6 +1897,9 @@ type MappedIPShort struct {
 type MapIPRequest struct {
 	PoolName   *string `json:"pool_name"`
 	InstanceID string  `json:"instance_id"`
+
+	// Address optionally requests a specific free address of the pool.
+	Address string `json:"address,omitempty"`
 }
 
 // QuotaDetails holds information for updating and querying quotas
@@ -772,6 +1972,145 @@ type QuotaListResponse struct {
 	Quotas []QuotaDetails `json:"quotas"`
 }
 
+// QuotaAuditRecord records a change in the consumption of a resource by a
+// tenant.  Delta is positive when the resource is consumed and negative
+// when it is released, Usage is the consumption of the resource after the
+// change and Allowed whether the quota service allowed the consumption.
+type QuotaAuditRecord struct {
+	TenantID  string    `json:"tenant_id"`
+	Resource  string    `json:"resource"`
+	Delta     int       `json:"delta"`
+	Usage     int       `json:"usage"`
+	Allowed   bool      `json:"allowed"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// QuotaAuditFilter selects the quota audit records of a tenant.  An empty
+// Resource selects the records of all resources and a zero Since those
+// recorded at any time.
+type QuotaAuditFilter struct {
+	TenantID string
+	Resource string
+	Since    time.Time
+}
+
+// QuotaHistoryResponse holds the layout for returning the quota audit
+// records of a tenant, oldest first.
+type QuotaHistoryResponse struct {
+	History []QuotaAuditRecord `json:"history"`
+}
+
+// AuditRecord records an API request which may have changed the state of
+// the cluster, whether or not it succeeded.  Actor is the common name of
+// the client certificate, or the API key, which authenticated the request
+// and is empty if the request was refused before it was authenticated.
+// Body is only recorded for bodies no larger than audit_body_limit_kb,
+// BodySize is recorded for all bodies.
+type AuditRecord struct {
+	ID         int64     `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	RequestID  string    `json:"request_id"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	Actor      string    `json:"actor"`
+	OnBehalfOf string    `json:"on_behalf_of,omitempty"`
+	Method     string    `json:"method"`
+	Resource   string    `json:"resource"`
+	Status     int       `json:"status"`
+	Body       string    `json:"body,omitempty"`
+	BodySize   int64     `json:"body_size"`
+}
+
+// AuditFilter selects audit records.  An empty TenantID selects the
+// records of all tenants, zero Start and End times leave the time range
+// open, only records with IDs greater than Marker are selected and at most
+// Limit records are returned, zero for no limit.
+type AuditFilter struct {
+	TenantID string
+	Start    time.Time
+	End      time.Time
+	Marker   int64
+	Limit    int
+}
+
+// AuditResponse holds the layout for returning audit records, oldest
+// first.
+type AuditResponse struct {
+	Records    []AuditRecord `json:"records"`
+	NextMarker string        `json:"next_marker,omitempty"`
+}
+
+// TenantQuotaDenials holds the number of quota denials for a tenant.
+type TenantQuotaDenials struct {
+	TenantID string `json:"tenant_id"`
+	Denials  int    `json:"denials"`
+}
+
+// QuotaDenialsResponse holds the layout for returning the tenants with the
+// most quota denials over the most recent window of time.
+type QuotaDenialsResponse struct {
+	Window  string               `json:"window"`
+	Tenants []TenantQuotaDenials `json:"tenants"`
+}
+
+// WorkloadCapacity estimates how many more instances of a workload a tenant
+// could launch.  Cluster is the number the sampled nodes could place, Quota
+// the number the tenant's remaining quota allows, or -1 if unlimited, and
+// Available the smaller of the two.
+type WorkloadCapacity struct {
+	WorkloadID  string `json:"workload_id"`
+	Description string `json:"description"`
+	Cluster     int    `json:"cluster"`
+	Quota       int    `json:"quota"`
+	Available   int    `json:"available"`
+}
+
+// TenantCapacity holds the capacity hints for the workloads a tenant can
+// see.  Updated is the time of the oldest node statistics the estimates
+// were computed from.  When there are more ready nodes than SampledNodes the
+// cluster estimates are extrapolated from the sample.
+type TenantCapacity struct {
+	TenantID     string             `json:"tenant_id"`
+	Updated      time.Time          `json:"updated"`
+	ReadyNodes   int                `json:"ready_nodes"`
+	SampledNodes int                `json:"sampled_nodes"`
+	Workloads    []WorkloadCapacity `json:"workloads"`
+}
+
+// NodeAllocation sums the resources of the instances placed on a node.
+// VCPUs counts every instance which has not been deleted, while the
+// pending totals only count the instances which have yet to start and so
+// are not reflected in the free resources the node reports.
+type NodeAllocation struct {
+	Instances        int
+	VCPUs            int
+	PendingInstances int
+	PendingMemMB     int
+	PendingDiskMB    int
+}
+
+// NodeWorkloadCapacity is how many more instances of a workload would fit
+// on a node.  The available resources are those the node last reported
+// less the resources of its pending instances.  VCPUsAvailable is the
+// number of online CPUs not allocated to the instances of the node.
+type NodeWorkloadCapacity struct {
+	NodeID           string    `json:"node_id"`
+	Hostname         string    `json:"hostname"`
+	Updated          time.Time `json:"updated"`
+	PendingInstances int       `json:"pending_instances"`
+	MemAvailable     int       `json:"ram_available"`
+	DiskAvailable    int       `json:"disk_available"`
+	VCPUsAvailable   int       `json:"vcpus_available"`
+	Instances        int       `json:"instances"`
+}
+
+// WorkloadNodeCapacity holds how many more instances of a workload would
+// fit on each of the ready nodes which may host it, and in total.
+type WorkloadNodeCapacity struct {
+	WorkloadID string                 `json:"workload_id"`
+	Total      int                    `json:"total"`
+	Nodes      []NodeWorkloadCapacity `json:"nodes"`
+}
+
 // CNCIController is the interface for the cnci controller associated with each tenant
 type CNCIController interface {
 	CNCIAdded(ID string) error
@@ -784,6 +2123,7 @@ type CNCIController interface {
 	WaitForActive(subnet string) error
 	GetInstanceCNCI(InstanceID string) (*Instance, error)
 	GetSubnetCNCI(subnet string) (*Instance, error)
+	Replace(subnet string) (*Instance, error)
 	Shutdown()
 }
 
@@ -827,6 +2167,1118 @@ type Image struct {
 	CreateTime time.Time  `json:"create_time"`
 	Size       uint64     `json:"size"`
 	Visibility Visibility `json:"visibility"`
+	Checksum   string     `json:"checksum,omitempty"`
+
+	// Seeds is the state of the image in the local image caches of the
+	// nodes which have been asked to cache it.  It is only reported to
+	// the admin.
+	Seeds []ImageSeed `json:"seeds,omitempty"`
+}
+
+// ImageSeedState is the state of an image in the local image cache of a
+// node.
+type ImageSeedState string
+
+const (
+	// ImageSeeding means that the node has been asked to cache the image.
+	ImageSeeding ImageSeedState = "seeding"
+
+	// ImageSeeded means that the node has cached the image.
+	ImageSeeded ImageSeedState = "seeded"
+
+	// ImageSeedFailed means that the node was unable to cache the image.
+	ImageSeedFailed ImageSeedState = "failed"
+)
+
+// ImageSeed is the state of an image in the local image cache of a node.
+type ImageSeed struct {
+	NodeID     string         `json:"node_id"`
+	State      ImageSeedState `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	UpdateTime time.Time      `json:"update_time"`
+}
+
+// ImagePreseedRequest selects the nodes which should cache an image ahead
+// of its first launch on them: all the compute nodes, the nodes with a
+// label or the nodes listed.
+type ImagePreseedRequest struct {
+	All   bool     `json:"all,omitempty"`
+	Label string   `json:"label,omitempty"`
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// ImageInUseError is returned when an attempt is made to delete an image
+// which is still referenced by workloads.
+type ImageInUseError struct {
+	ImageID   string
+	Workloads []string
+}
+
+func (e *ImageInUseError) Error() string {
+	return fmt.Sprintf("Image %s is used by workloads: %s", e.ImageID, strings.Join(e.Workloads, ", "))
+}
+
+// TenantNetworkDegradedError is returned when the network controller of a
+// tenant, which manages its CNCIs, could not be initialized.
+type TenantNetworkDegradedError struct {
+	TenantID string
+	Reason   string
+}
+
+func (e *TenantNetworkDegradedError) Error() string {
+	return fmt.Sprintf("Tenant network controller failed to initialize for tenant %s: %s", e.TenantID, e.Reason)
+}
+
+// RequirementsBoundError is returned when a launch time override of a
+// workload's requirements falls outside the bounds set by the workload.
+type RequirementsBoundError struct {
+	Resource string
+	Bound    string
+	Limit    int
+	Value    int
+}
+
+func (e *RequirementsBoundError) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("Workload does not set %s, %s cannot be overridden", e.Bound, e.Resource)
+	}
+	return fmt.Sprintf("Requested %s %d is outside workload bound %s %d", e.Resource, e.Value, e.Bound, e.Limit)
+}
+
+// WorkloadValidationError is returned when a workload definition is
+// invalid.  Violations describes each of the problems found.
+type WorkloadValidationError struct {
+	Violations []string
+}
+
+func (e *WorkloadValidationError) Error() string {
+	return fmt.Sprintf("Invalid workload: %s", strings.Join(e.Violations, "; "))
+}
+
+// LaunchRequestError is returned when the launch request stored in a launch
+// template could not be used to create instances.
+type LaunchRequestError struct {
+	Reason string
+}
+
+func (e *LaunchRequestError) Error() string {
+	return fmt.Sprintf("Invalid launch request: %s", e.Reason)
+}
+
+// LaunchFailureCode classifies why an instance could not be launched so that
+// clients can decide whether, and when, to retry.
+type LaunchFailureCode string
+
+const (
+	// LaunchQuotaExceeded means the tenant does not have the quota for
+	// the instance. Retrying fails until resources are freed.
+	LaunchQuotaExceeded LaunchFailureCode = "quota_exceeded"
+
+	// LaunchNoCapacity means no node can currently host the instance.
+	LaunchNoCapacity LaunchFailureCode = "no_capacity"
+
+	// LaunchStorageError means the storage of the instance could not be
+	// prepared.
+	LaunchStorageError LaunchFailureCode = "storage_error"
+
+	// LaunchNetworkNotReady means the tenant network cannot yet host the
+	// instance, e.g. because its CNCI is not active.
+	LaunchNetworkNotReady LaunchFailureCode = "network_not_ready"
+
+	// LaunchInvalidRequest means the launch can never succeed as
+	// requested.
+	LaunchInvalidRequest LaunchFailureCode = "invalid_request"
+
+	// LaunchNodeError means the node the instance was placed on failed to
+	// start it.
+	LaunchNodeError LaunchFailureCode = "node_error"
+
+	// LaunchLimitExceeded means the tenant already has as many launches
+	// in progress as it is allowed.  Retrying succeeds once some of them
+	// have completed.
+	LaunchLimitExceeded LaunchFailureCode = "launch_limit_exceeded"
+
+	// LaunchNetworkFull means the tenant network has no free address for
+	// the instance.  Retrying fails until addresses are released.
+	LaunchNetworkFull LaunchFailureCode = "network_full"
+
+	// LaunchPlacementConflict means no node satisfies the hard placement
+	// policy of the server group of the instance.  Retrying fails until
+	// nodes are added or members of the group are deleted.
+	LaunchPlacementConflict LaunchFailureCode = "placement_conflict"
+
+	// LaunchInternal means the controller itself failed.
+	LaunchInternal LaunchFailureCode = "internal"
+)
+
+// LaunchError is a failure to launch an instance along with its
+// classification.
+type LaunchError struct {
+	Code LaunchFailureCode
+	Err  error
+}
+
+func (e *LaunchError) Error() string {
+	return e.Err.Error()
+}
+
+// QueuedLaunch is the launch of an instance held back because its tenant
+// already has as many launches in progress as it is allowed.  Config is
+// the start payload sent to the scheduler once the launch leaves the queue
+// and Sequence orders the launches of all tenants by when they were queued.
+type QueuedLaunch struct {
+	InstanceID string
+	TenantID   string
+	Sequence   int64
+	Config     string
+	TraceLabel string
+	QueueTime  time.Time
+}
+
+// StartFailureCode classifies the reason a scheduler or launcher gave for
+// failing to start an instance.
+func StartFailureCode(reason payloads.StartFailureReason) LaunchFailureCode {
+	switch reason {
+	case payloads.FullCloud, payloads.FullComputeNode,
+		payloads.NodeInMaintenance, payloads.NoComputeNodes:
+		return LaunchNoCapacity
+	case payloads.NoNetworkNodes, payloads.NetworkFailure:
+		return LaunchNetworkNotReady
+	case payloads.InvalidPayload, payloads.InvalidData:
+		return LaunchInvalidRequest
+	case payloads.ImageFailure:
+		return LaunchStorageError
+	case payloads.AlreadyRunning, payloads.InstanceExists, payloads.LaunchFailure:
+		return LaunchNodeError
+	default:
+		return LaunchInternal
+	}
+}
+
+// PolicyViolationError is returned when a workload is created, updated or
+// launched against a deny rule of the workload policy.
+type PolicyViolationError struct {
+	RuleID      string
+	Description string
+}
+
+func (e *PolicyViolationError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("Workload denied by policy rule %s", e.RuleID)
+	}
+	return fmt.Sprintf("Workload denied by policy rule %s: %s", e.RuleID, e.Description)
+}
+
+// EventType identifies the kind of event published by the controller.
+type EventType string
+
+const (
+	// InstanceFailedEvent is published when an instance fails to start.
+	InstanceFailedEvent EventType = "instance_failed"
+
+	// QuotaExceededEvent is published when a request is denied because
+	// it would take a tenant over its quota.
+	QuotaExceededEvent EventType = "quota_exceeded"
+
+	// ReconciliationEvent is published when the controller has finished
+	// reconciling the datastore with the instances reported by the
+	// compute nodes.
+	ReconciliationEvent EventType = "reconciliation"
+
+	// NodeStatusEvent is published when a node becomes suspect, goes
+	// down or returns to ready.
+	NodeStatusEvent EventType = "node_status"
+
+	// QuotaDenialSummaryEvent is published periodically with the tenants
+	// which have had the most quota denials.
+	QuotaDenialSummaryEvent EventType = "quota_denial_summary"
+
+	// InstanceConditionRaisedEvent is published when a launcher reports
+	// a new caveat with which an instance is running.
+	InstanceConditionRaisedEvent EventType = "instance_condition_raised"
+
+	// InstanceConditionClearedEvent is published when a launcher no
+	// longer reports a caveat for an instance.
+	InstanceConditionClearedEvent EventType = "instance_condition_cleared"
+
+	// NodeClockSkewEvent is published when the clock of a node drifts
+	// beyond the clock skew threshold or returns within it.
+	NodeClockSkewEvent EventType = "node_clock_skew"
+
+	// TenantNetworkDegradedEvent is published when the network
+	// controller of a tenant fails to initialize.
+	TenantNetworkDegradedEvent EventType = "tenant_network_degraded"
+
+	// TenantNetworkRecoveredEvent is published when the network
+	// controller of a degraded tenant is initialized on retry.
+	TenantNetworkRecoveredEvent EventType = "tenant_network_recovered"
+
+	// InstanceMigratedEvent is published when an instance has been live
+	// migrated to another node.
+	InstanceMigratedEvent EventType = "instance_migrated"
+
+	// InstanceMigrationFailedEvent is published when the live migration
+	// of an instance fails and the instance is left on its node.
+	InstanceMigrationFailedEvent EventType = "instance_migration_failed"
+
+	// InstanceResizedEvent is published when an instance has been
+	// restarted with new requirements.
+	InstanceResizedEvent EventType = "instance_resized"
+
+	// InstanceResizeFailedEvent is published when an instance could not
+	// be restarted with new requirements and its previous requirements
+	// are restored.
+	InstanceResizeFailedEvent EventType = "instance_resize_failed"
+
+	// CNCIFailoverEvent is published when the CNCI of a tenant subnet
+	// has stopped being reported running and has been replaced.
+	CNCIFailoverEvent EventType = "cnci_failover"
+)
+
+// Event describes something of interest that has happened in the cluster.
+type Event struct {
+	ID        string            `json:"id"`
+	Type      EventType         `json:"type"`
+	TenantID  string            `json:"tenant_id,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Message   string            `json:"message"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// WebhookState represents the delivery state of a webhook subscription.
+type WebhookState string
+
+const (
+	// WebhookActive means that events are being delivered to the webhook.
+	WebhookActive WebhookState = "active"
+
+	// WebhookDeadLetter means that delivery to the webhook has been
+	// abandoned after repeated failures.
+	WebhookDeadLetter WebhookState = "dead_letter"
+)
+
+// WebhookStats contains the delivery metrics for a webhook subscription.
+// The metrics are reset when the controller restarts.
+type WebhookStats struct {
+	Delivered      uint64    `json:"delivered"`
+	FailedAttempts uint64    `json:"failed_attempts"`
+	Failed         uint64    `json:"failed"`
+	Dropped        uint64    `json:"dropped"`
+	LastDelivery   time.Time `json:"last_delivery"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// Webhook is a subscription which causes events matching its filters to
+// be posted to an external URL.  The secret used to sign deliveries is
+// never returned through the API.
+type Webhook struct {
+	ID         string       `json:"id"`
+	URL        string       `json:"url"`
+	Secret     string       `json:"-"`
+	EventTypes []EventType  `json:"event_types"`
+	TenantID   string       `json:"tenant_id,omitempty"`
+	State      WebhookState `json:"state"`
+	CreateTime time.Time    `json:"create_time"`
+	Stats      WebhookStats `json:"stats"`
+	Links      []Link       `json:"links,omitempty"`
+}
+
+// TenantCA is a CA certificate registered for a tenant.  The users of the
+// tenant authenticate to the API with client certificates signed by it.
+type TenantCA struct {
+	TenantID    string    `json:"tenant_id"`
+	Certificate string    `json:"certificate"`
+	Subject     string    `json:"subject"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
+	CreateTime  time.Time `json:"create_time"`
+}
+
+// TenantFreezeRequest freezes or unfreezes a tenant.  While frozen all
+// changes to the resources of the tenant are rejected.
+type TenantFreezeRequest struct {
+	Frozen bool   `json:"frozen"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// TenantExportVersion is the version of the tenant export format.
+const TenantExportVersion = 1
+
+// TenantExport holds the definitions of a tenant so that it can be
+// recreated on another cluster: its configuration, its quotas and limits,
+// its private workloads and its launch templates.  The tenant's instances,
+// volumes and other runtime state are not included.
+type TenantExport struct {
+	Version   int                     `json:"version"`
+	ID        string                  `json:"id"`
+	Config    TenantConfig            `json:"config"`
+	Quotas    []QuotaDetails          `json:"quotas"`
+	Workloads []Workload              `json:"workloads"`
+	Templates []LaunchTemplateRequest `json:"launch_templates"`
+}
+
+// The classes of objects imported from a TenantExport.  The objects of a
+// class are imported together, or not at all if any of them conflicts with
+// the objects already on the cluster.
+const (
+	TenantImportTenant    = "tenant"
+	TenantImportQuotas    = "quotas"
+	TenantImportWorkloads = "workloads"
+	TenantImportTemplates = "launch_templates"
+)
+
+// TenantImportConflict describes why an object could not be imported.
+type TenantImportConflict struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// TenantImportClassResult reports the import of a class of objects.
+// Applied is false if the class had conflicts or the import only
+// validated the export.
+type TenantImportClassResult struct {
+	Class     string                 `json:"class"`
+	Count     int                    `json:"count"`
+	Applied   bool                   `json:"applied"`
+	Conflicts []TenantImportConflict `json:"conflicts,omitempty"`
+}
+
+// TenantImportResponse reports the import of a tenant export.
+type TenantImportResponse struct {
+	TenantID     string                    `json:"tenant_id"`
+	ValidateOnly bool                      `json:"validate_only"`
+	Classes      []TenantImportClassResult `json:"classes"`
+}
+
+// TenantNetworkPrepareRequest asks for the CNCI of a tenant subnet to be
+// launched ahead of the tenant's instances.  The tenant's first subnet is
+// prepared if Subnet is empty.
+type TenantNetworkPrepareRequest struct {
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// TenantSubnet describes the utilization of a subnet of a tenant's network.
+// Capacity is the number of addresses in the subnet which may be given to
+// instances, Used the number which have been.
+type TenantSubnet struct {
+	Subnet   string `json:"subnet"`
+	Capacity int    `json:"capacity"`
+	Used     int    `json:"used"`
+	CNCIID   string `json:"cnci_id,omitempty"`
+}
+
+// TenantNetwork describes the subnets of a tenant's network.
+type TenantNetwork struct {
+	TenantID   string         `json:"tenant_id"`
+	SubnetBits int            `json:"subnet_bits"`
+	MaxSubnets int            `json:"max_subnets,omitempty"`
+	Subnets    []TenantSubnet `json:"subnets"`
+}
+
+// TenantSubnets lists the subnets of a tenant's network and how many of
+// their addresses are in use.
+type TenantSubnets struct {
+	Subnets []TenantSubnet `json:"subnets"`
+}
+
+// TenantCARequest registers the PEM encoded CA certificate of a tenant.
+type TenantCARequest struct {
+	Certificate string `json:"certificate"`
+}
+
+// Matches returns true if the event e should be delivered to the webhook.
+// Webhooks without event types receive all events and webhooks without
+// a tenant receive events for all tenants.
+func (w *Webhook) Matches(e Event) bool {
+	if w.TenantID != "" && w.TenantID != e.TenantID {
+		return false
+	}
+
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range w.EventTypes {
+		if t == e.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LeaderLease records which controller holds the leadership of the
+// cluster and until when.
+type LeaderLease struct {
+	Name    string
+	Holder  string
+	Address string
+	Expiry  time.Time
+}
+
+// CNCIImage records the image new CNCIs are launched from and the image
+// it replaced, which CNCIs return to on rollback.
+type CNCIImage struct {
+	Image         string `json:"image"`
+	PreviousImage string `json:"previous_image,omitempty"`
+}
+
+// CNCIRolloutRequest is used to relaunch the CNCIs from a new image.  The
+// CNCIs are replaced BatchSize at a time, or one tenant at a time if
+// ByTenant is set.
+type CNCIRolloutRequest struct {
+	ImageID   string `json:"image_id,omitempty"`
+	BatchSize int    `json:"batch_size"`
+	ByTenant  bool   `json:"by_tenant"`
+}
+
+// IdempotentResponse records the response to a request made with an
+// idempotency key so that it can be replayed if the request is retried.
+type IdempotentResponse struct {
+	TenantID    string
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreateTime  time.Time
+}
+
+// NewWebhookRequest is used to create a new webhook subscription.
+type NewWebhookRequest struct {
+	URL        string      `json:"url"`
+	Secret     string      `json:"secret"`
+	EventTypes []EventType `json:"event_types"`
+	TenantID   string      `json:"tenant_id"`
+}
+
+// ListWebhooksResponse represents a list of webhook subscriptions.
+type ListWebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// LaunchTemplate is a named launch request stored for a tenant.  Request
+// is the body of an instance create request.  Version starts at 1 and is
+// incremented each time the request is updated.
+type LaunchTemplate struct {
+	TenantID   string          `json:"tenant_id"`
+	Name       string          `json:"name"`
+	Version    int             `json:"version"`
+	Request    json.RawMessage `json:"request"`
+	CreateTime time.Time       `json:"create_time"`
+	UpdateTime time.Time       `json:"update_time"`
+}
+
+// LaunchTemplateRequest is used to create or update a launch template.  The
+// name is taken from the path when a template is updated.
+type LaunchTemplateRequest struct {
+	Name    string          `json:"name,omitempty"`
+	Request json.RawMessage `json:"request"`
+}
+
+// ListLaunchTemplatesResponse represents a list of launch templates.
+type ListLaunchTemplatesResponse struct {
+	Templates []LaunchTemplate `json:"templates"`
+}
+
+// ServerGroupPolicy is the placement policy of the members of a server
+// group.
+type ServerGroupPolicy string
+
+const (
+	// ServerGroupAffinity places the members of a group on the same node.
+	ServerGroupAffinity ServerGroupPolicy = "affinity"
+
+	// ServerGroupAntiAffinity places each member of a group on a
+	// different node.
+	ServerGroupAntiAffinity ServerGroupPolicy = "anti-affinity"
+)
+
+// ServerGroup is a set of instances of a tenant placed according to the
+// group's policy.  A hard policy rejects launches which cannot satisfy it,
+// a soft one is only a preference of the scheduler.  Members lists the IDs
+// of the instances in the group, in the order in which they joined.
+type ServerGroup struct {
+	ID         string            `json:"id"`
+	TenantID   string            `json:"tenant_id"`
+	Name       string            `json:"name"`
+	Policy     ServerGroupPolicy `json:"policy"`
+	Soft       bool              `json:"soft"`
+	Members    []string          `json:"members"`
+	CreateTime time.Time         `json:"create_time"`
+}
+
+// ServerGroupRequest is used to create a server group.
+type ServerGroupRequest struct {
+	Name   string            `json:"name"`
+	Policy ServerGroupPolicy `json:"policy"`
+	Soft   bool              `json:"soft,omitempty"`
+}
+
+// ListServerGroupsResponse represents a list of server groups.
+type ListServerGroupsResponse struct {
+	Groups []ServerGroup `json:"server_groups"`
+}
+
+// SnapshotSchedule periodically snapshots either a single volume of a
+// tenant or the tenant's volumes attached with a tag.  Runs are due every
+// IntervalMinutes, shifted by OffsetMinutes from the start of the UTC day,
+// so a schedule with an interval of 1440 minutes and an offset of 120 runs
+// nightly at 02:00 UTC.  Only the newest Retention snapshots taken by the
+// schedule are kept for each volume.
+type SnapshotSchedule struct {
+	ID              string    `json:"id"`
+	TenantID        string    `json:"tenant_id"`
+	VolumeID        string    `json:"volume_id,omitempty"`
+	Tag             string    `json:"tag,omitempty"`
+	IntervalMinutes int       `json:"interval_minutes"`
+	OffsetMinutes   int       `json:"offset_minutes"`
+	Retention       int       `json:"retention"`
+	CreateTime      time.Time `json:"create_time"`
+	LastRun         time.Time `json:"last_run"`
+	NextRun         time.Time `json:"next_run"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// SnapshotScheduleRequest is used to create a snapshot schedule.  Exactly
+// one of VolumeID and Tag must be given.
+type SnapshotScheduleRequest struct {
+	VolumeID        string `json:"volume_id,omitempty"`
+	Tag             string `json:"tag,omitempty"`
+	IntervalMinutes int    `json:"interval_minutes"`
+	OffsetMinutes   int    `json:"offset_minutes,omitempty"`
+	Retention       int    `json:"retention"`
+}
+
+// ListSnapshotSchedulesResponse represents a list of snapshot schedules.
+type ListSnapshotSchedulesResponse struct {
+	Schedules []SnapshotSchedule `json:"schedules"`
+}
+
+// VolumeSnapshot is a snapshot of a volume taken on request or by a
+// snapshot schedule, in which case ScheduleID is set.  Attached is set if
+// the volume was attached to an instance when the snapshot was taken, so
+// the snapshot may not be consistent.
+type VolumeSnapshot struct {
+	ID         string    `json:"id"`
+	VolumeID   string    `json:"volume_id"`
+	TenantID   string    `json:"tenant_id"`
+	ScheduleID string    `json:"schedule_id"`
+	Name       string    `json:"name,omitempty"`
+	Attached   bool      `json:"attached"`
+	CreateTime time.Time `json:"create_time"`
+}
+
+// VolumeSnapshotRequest is used to take a snapshot of a volume.
+type VolumeSnapshotRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// ListVolumeSnapshotsResponse represents a list of the snapshots of a
+// volume.
+type ListVolumeSnapshotsResponse struct {
+	Snapshots []VolumeSnapshot `json:"snapshots"`
+}
+
+// ConfigPreviewRequest holds the launch time inputs with which the
+// configuration of an instance of a workload is previewed.  If InstanceID is
+// set the configuration is rendered for that instance and compared with the
+// configuration it was started with.
+type ConfigPreviewRequest struct {
+	Name       string `json:"name,omitempty"`
+	VCPUs      int    `json:"vcpus,omitempty"`
+	MemMB      int    `json:"mem_mb,omitempty"`
+	DiskGB     int    `json:"disk_gb,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// ConfigPreview holds the documents an instance of a workload would be
+// started with: the instance metadata, the workload's cloud-init and the
+// START payload sent to the launcher.  Secrets in the documents are
+// redacted.  Diff holds the differences from the configuration of the
+// instance previewed, if any.
+type ConfigPreview struct {
+	WorkloadID string       `json:"workload_id"`
+	InstanceID string       `json:"instance_id,omitempty"`
+	MetaData   string       `json:"meta_data"`
+	CloudInit  string       `json:"cloud_init"`
+	Start      string       `json:"start"`
+	Diff       []ConfigDiff `json:"diff,omitempty"`
+}
+
+// ConfigDiff holds the lines of one document of a configuration preview
+// which differ from the configuration an instance was started with.  Lines
+// are prefixed with "-" if they were removed, "+" if they were added and " "
+// if they are unchanged.
+type ConfigDiff struct {
+	Document string   `json:"document"`
+	Lines    []string `json:"lines"`
+}
+
+// APIKey is a key with which the tools of a tenant authenticate to the API
+// in place of a client certificate.  A key may only be used for the route
+// groups listed in its scopes, e.g. "instances", and only until its expiry,
+// if it has one.  Only the hash of the key is stored.
+type APIKey struct {
+	ID           string    `json:"id"`
+	TenantID     string    `json:"tenant_id"`
+	Name         string    `json:"name"`
+	Scopes       []string  `json:"scopes"`
+	Hash         string    `json:"-"`
+	ExpireTime   time.Time `json:"expire_time"`
+	LastUsedTime time.Time `json:"last_used_time"`
+	CreateTime   time.Time `json:"create_time"`
+}
+
+// Expired returns true if the key has an expiry which has passed.
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpireTime.IsZero() && !now.Before(k.ExpireTime)
+}
+
+// HasScope returns true if the key may be used for the route group.
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyRequest is used to create an API key.  ExpireTime is optional.
+type APIKeyRequest struct {
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// NewAPIKey is the response to the creation of an API key.  It is the only
+// time the key itself is returned.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// ListAPIKeysResponse represents a list of API keys.
+type ListAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// AuthToken is a signed, expiring bearer token issued to a user holding a
+// client certificate, which may be presented in place of the certificate.
+// The token carries the role of the user, either "admin" or "tenant" for
+// the tenant it was issued for.  The token itself is not stored, only the
+// record of its issue, which is removed when the token is revoked.
+type AuthToken struct {
+	ID         string    `json:"id"`
+	Subject    string    `json:"subject"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	Role       string    `json:"role"`
+	ExpireTime time.Time `json:"expire_time"`
+	CreateTime time.Time `json:"create_time"`
+}
+
+// Expired returns true if the token's expiry has passed.
+func (t AuthToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpireTime)
+}
+
+// AuthTokenRequest is used to obtain a token.  TenantID is optional for
+// users belonging to a single tenant and for admins, who are issued an
+// admin token unless they name a tenant.
+type AuthTokenRequest struct {
+	TenantID string `json:"tenant_id"`
+}
+
+// NewAuthToken is the response to the issue of a token.  It is the only
+// time the token itself is returned.
+type NewAuthToken struct {
+	AuthToken
+	Token string `json:"token"`
+}
+
+// ListAuthTokensResponse represents a list of tokens.
+type ListAuthTokensResponse struct {
+	Tokens []AuthToken `json:"tokens"`
+}
+
+// PolicySeverity determines what happens to a workload matching a policy
+// rule.
+type PolicySeverity string
+
+const (
+	// PolicyDeny rejects workloads matching the rule and launches of
+	// their instances.
+	PolicyDeny PolicySeverity = "deny"
+
+	// PolicyWarn logs an event for workloads matching the rule but
+	// allows them.
+	PolicyWarn PolicySeverity = "warn"
+)
+
+// PolicyRule is a rule of the workload policy.  A workload matches the rule
+// if it matches every condition the rule sets.  ImagePattern is a glob,
+// as understood by path.Match, which matches the image name of a container
+// workload or the ID or name of an image a workload's storage is created
+// from.  MinVCPUs and MinMemMB match workloads requiring fewer resources.
+type PolicyRule struct {
+	ID           string              `json:"id"`
+	Description  string              `json:"description,omitempty"`
+	Severity     PolicySeverity      `json:"severity"`
+	ImagePattern string              `json:"image_pattern,omitempty"`
+	VMType       payloads.Hypervisor `json:"vm_type,omitempty"`
+	FWType       string              `json:"fw_type,omitempty"`
+	MinVCPUs     int                 `json:"min_vcpus,omitempty"`
+	MinMemMB     int                 `json:"min_mem_mb,omitempty"`
+	CreateTime   time.Time           `json:"create_time"`
+}
+
+// Valid returns true if the rule has a known severity and at least one
+// valid condition.
+func (r *PolicyRule) Valid() bool {
+	if r.Severity != PolicyDeny && r.Severity != PolicyWarn {
+		return false
+	}
+
+	if r.ImagePattern != "" {
+		if _, err := path.Match(r.ImagePattern, ""); err != nil {
+			return false
+		}
+	}
+
+	if r.MinVCPUs < 0 || r.MinMemMB < 0 {
+		return false
+	}
+
+	return r.ImagePattern != "" || r.VMType != "" || r.FWType != "" ||
+		r.MinVCPUs > 0 || r.MinMemMB > 0
+}
+
+// Matches returns true if the workload wl, whose images are referred to by
+// imageRefs, matches every condition of the rule.
+func (r *PolicyRule) Matches(wl *Workload, imageRefs []string) bool {
+	if r.VMType != "" && r.VMType != wl.VMType {
+		return false
+	}
+
+	if r.FWType != "" && r.FWType != wl.FWType {
+		return false
+	}
+
+	if r.MinVCPUs > 0 && wl.Requirements.VCPUs >= r.MinVCPUs {
+		return false
+	}
+
+	if r.MinMemMB > 0 && wl.Requirements.MemMB >= r.MinMemMB {
+		return false
+	}
+
+	if r.ImagePattern == "" {
+		return true
+	}
+
+	for _, ref := range imageRefs {
+		if ok, _ := path.Match(r.ImagePattern, ref); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListPolicyRulesResponse represents the rules of the workload policy.
+type ListPolicyRulesResponse struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// SettingType is the type of the value of a cluster setting.
+type SettingType string
+
+const (
+	// SettingDuration is a setting whose value is a duration, e.g., 90s.
+	SettingDuration SettingType = "duration"
+
+	// SettingInt is a setting whose value is an integer.
+	SettingInt SettingType = "int"
+
+	// SettingBool is a setting whose value is true or false.
+	SettingBool SettingType = "bool"
+)
+
+// SettingValueError is returned when a cluster setting is given a value
+// which is not of its type or is out of its range.
+type SettingValueError struct {
+	Key    string
+	Reason string
+}
+
+func (e *SettingValueError) Error() string {
+	return fmt.Sprintf("Invalid value for setting %s: %s", e.Key, e.Reason)
+}
+
+// Setting describes a cluster setting which can be changed while the
+// controller is running.  Values are given as strings of the type of the
+// setting.  Modified is set if the admin has changed the setting from its
+// default, which is taken from the controller configuration.
+type Setting struct {
+	Key         string      `json:"key"`
+	Type        SettingType `json:"type"`
+	Description string      `json:"description"`
+	Value       string      `json:"value"`
+	Default     string      `json:"default"`
+	Min         string      `json:"min"`
+	Max         string      `json:"max"`
+	Modified    bool        `json:"modified"`
+	UpdateTime  time.Time   `json:"update_time"`
+}
+
+// SettingValue is the value of a cluster setting changed by the admin.
+type SettingValue struct {
+	Key        string
+	Value      string
+	UpdateTime time.Time
+}
+
+// SettingRequest is used to change the value of a cluster setting.
+type SettingRequest struct {
+	Value string `json:"value"`
+}
+
+// ListSettingsResponse represents the cluster settings.
+type ListSettingsResponse struct {
+	Settings []Setting `json:"settings"`
+}
+
+// OperationState describes how far an operation has got.
+type OperationState string
+
+const (
+	// OperationRunning means that the operation has not finished.
+	OperationRunning OperationState = "running"
+
+	// OperationSucceeded means that the operation completed successfully.
+	OperationSucceeded OperationState = "succeeded"
+
+	// OperationFailed means that the operation did not complete.
+	OperationFailed OperationState = "failed"
+)
+
+// OperationType identifies the action performed by an operation.
+type OperationType string
+
+const (
+	// CreateVolumeOperation creates a volume from an image.
+	CreateVolumeOperation OperationType = "create_volume"
+
+	// UpgradeCNCIOperation relaunches the CNCIs from a new image.
+	UpgradeCNCIOperation OperationType = "upgrade_cnci"
+
+	// RollbackCNCIOperation relaunches the CNCIs from the previous image.
+	RollbackCNCIOperation OperationType = "rollback_cnci"
+
+	// PrepareNetworkOperation launches the CNCI for a tenant subnet.
+	PrepareNetworkOperation OperationType = "prepare_network"
+
+	// DeleteTenantOperation deletes a tenant and all of its resources.
+	DeleteTenantOperation OperationType = "delete_tenant"
+
+	// AttachVolumeOperation attaches a volume to a running instance.
+	AttachVolumeOperation OperationType = "attach_volume"
+
+	// DetachVolumeOperation detaches a volume from a running instance.
+	DetachVolumeOperation OperationType = "detach_volume"
+
+	// EvacuateNodeOperation restarts the instances running on a node in
+	// maintenance on other nodes.
+	EvacuateNodeOperation OperationType = "evacuate_node"
+
+	// MigrateInstanceOperation live migrates an instance to another node.
+	MigrateInstanceOperation OperationType = "migrate_instance"
+)
+
+// Operation tracks an API request which completes after the response has
+// been sent.  Target is the object the operation acts upon and Result
+// the object it creates, if any.  Progress is a percentage.
+type Operation struct {
+	ID         string         `json:"id"`
+	TenantID   string         `json:"tenant_id"`
+	Type       OperationType  `json:"type"`
+	Target     string         `json:"target"`
+	Result     string         `json:"result,omitempty"`
+	State      OperationState `json:"state"`
+	Progress   int            `json:"progress"`
+	Error      string         `json:"error,omitempty"`
+	CreateTime time.Time      `json:"create_time"`
+	UpdateTime time.Time      `json:"update_time"`
+}
+
+// SortedOperationsByCreateTime implements sort.Interface for Operation by
+// creation time
+type SortedOperationsByCreateTime []Operation
+
+func (s SortedOperationsByCreateTime) Len() int      { return len(s) }
+func (s SortedOperationsByCreateTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SortedOperationsByCreateTime) Less(i, j int) bool {
+	return s[i].CreateTime.Before(s[j].CreateTime)
+}
+
+// Done returns true if the operation has succeeded or failed.
+func (o Operation) Done() bool {
+	return o.State == OperationSucceeded || o.State == OperationFailed
+}
+
+// ListOperationsResponse represents a list of operations.
+type ListOperationsResponse struct {
+	Operations []Operation `json:"operations"`
+}
+
+// TrashItemType identifies the kind of resource held in the trash.
+type TrashItemType string
+
+const (
+	// TrashInstance is a deleted instance.
+	TrashInstance TrashItemType = "instance"
+
+	// TrashVolume is a deleted volume.
+	TrashVolume TrashItemType = "volume"
+)
+
+// TrashItem is an instance or volume deleted by a tenant which may be
+// restored until PurgeTime.  The ID is that of the deleted resource.
+// Instances record the configuration they are relaunched with and the
+// volumes attached to them when they were deleted.
+type TrashItem struct {
+	ID          string        `json:"id"`
+	TenantID    string        `json:"tenant_id"`
+	Type        TrashItemType `json:"type"`
+	Name        string        `json:"name,omitempty"`
+	DeleteTime  time.Time     `json:"delete_time"`
+	PurgeTime   time.Time     `json:"purge_time"`
+	WorkloadID  string        `json:"workload_id,omitempty"`
+	VCPUs       int           `json:"vcpus,omitempty"`
+	MemMB       int           `json:"mem_mb,omitempty"`
+	EphemeralGB int           `json:"ephemeral_gb,omitempty"`
+	Volumes     []string      `json:"volumes,omitempty"`
+}
+
+// SortedTrashItemsByDeleteTime implements sort.Interface for TrashItem by
+// deletion time
+type SortedTrashItemsByDeleteTime []TrashItem
+
+func (s SortedTrashItemsByDeleteTime) Len() int      { return len(s) }
+func (s SortedTrashItemsByDeleteTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SortedTrashItemsByDeleteTime) Less(i, j int) bool {
+	return s[i].DeleteTime.Before(s[j].DeleteTime)
+}
+
+// ListTrashResponse represents the contents of a tenant's trash.
+type ListTrashResponse struct {
+	Items []TrashItem `json:"items"`
+}
+
+// TrashRestoreResponse identifies the resource restored from the trash.
+// Restored instances are relaunched with a new ID.
+type TrashRestoreResponse struct {
+	Type TrashItemType `json:"type"`
+	ID   string        `json:"id"`
+}
+
+// The resources which may be downloaded through signed URLs.
+const (
+	// SignedOperation is the result of an operation.
+	SignedOperation = "operation"
+
+	// SignedInstanceHistory is the history of an instance.
+	SignedInstanceHistory = "instance_history"
+)
+
+// SignedURLRequest asks for a URL through which a read-only resource may
+// be downloaded without credentials.
+type SignedURLRequest struct {
+	Resource string `json:"resource"`
+	ID       string `json:"id"`
+
+	// ExpiresIn is the lifetime of the URL in seconds, which defaults to
+	// and may not exceed the signed_url_expiry of the controller.
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// SignedURL is a URL through which a resource of a tenant may be
+// downloaded until it expires.
+type SignedURL struct {
+	URL      string    `json:"url"`
+	Resource string    `json:"resource"`
+	ID       string    `json:"id"`
+	TenantID string    `json:"tenant_id"`
+	Expires  time.Time `json:"expires"`
+}
+
+// UsageResource is a kind of resource whose usage is recorded.
+type UsageResource string
+
+const (
+	// UsageInstance is a tenant instance.  CNCIs are not recorded.
+	UsageInstance UsageResource = "instance"
+
+	// UsageVolume is a volume, whose usage is weighted by its size.
+	UsageVolume UsageResource = "volume"
+
+	// UsageExternalIP is an external IP mapped to an instance.
+	UsageExternalIP UsageResource = "external_ip"
+)
+
+// UsageSpan is the lifetime of a resource of a tenant.  End is zero for
+// resources which still exist.
+type UsageSpan struct {
+	TenantID string
+	ID       string
+	Resource UsageResource
+
+	// SizeGB is the size of volumes.
+	SizeGB int
+
+	Start time.Time
+	End   time.Time
+}
+
+// UsageGranularity is the length of the period covered by usage records.
+type UsageGranularity string
+
+const (
+	// UsageSample records cover the period between two samples, which
+	// never crosses the hour.
+	UsageSample UsageGranularity = "sample"
+
+	// UsageHourly records cover an hour.
+	UsageHourly UsageGranularity = "hourly"
+
+	// UsageDaily records cover a day, starting at midnight UTC.
+	UsageDaily UsageGranularity = "daily"
+)
+
+// UsageRecord is the usage a tenant made of its resources between Start
+// and End.  Resources which existed for part of the period are prorated.
+type UsageRecord struct {
+	TenantID        string           `json:"tenant_id"`
+	Granularity     UsageGranularity `json:"granularity"`
+	Start           time.Time        `json:"start"`
+	End             time.Time        `json:"end"`
+	InstanceHours   float64          `json:"instance_hours"`
+	VolumeGBHours   float64          `json:"volume_gb_hours"`
+	ExternalIPHours float64          `json:"external_ip_hours"`
+}
+
+// UsageFilter selects the usage records to export.
+type UsageFilter struct {
+	TenantID    string
+	Granularity UsageGranularity
+	Start       time.Time
+	End         time.Time
+}
+
+// ListUsageResponse is the response to a usage export request.
+type ListUsageResponse struct {
+	Usage []UsageRecord `json:"usage"`
 }
 
 // TransitionInstanceState safely sets thes state on an instance
@@ -0,0 +1,303 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// usageCheckPeriod is how often the usage recorder checks whether usage
+// recording has been enabled.
+const usageCheckPeriod = time.Minute
+
+// spanHours returns the number of hours for which span overlapped the
+// period between from and to.
+func spanHours(span types.UsageSpan, from time.Time, to time.Time) float64 {
+	start := span.Start
+	if start.Before(from) {
+		start = from
+	}
+
+	end := to
+	if !span.End.IsZero() && span.End.Before(end) {
+		end = span.End
+	}
+
+	if !end.After(start) {
+		return 0
+	}
+
+	return end.Sub(start).Hours()
+}
+
+// usageRecords computes the usage each tenant made of its resources
+// between from and to.  Resources created or released during the period
+// are prorated from their create and release times.  Every tenant in
+// tenantIDs gets a record, even if it used nothing.
+func usageRecords(spans []types.UsageSpan, tenantIDs []string, from time.Time, to time.Time) []types.UsageRecord {
+	usage := make(map[string]*types.UsageRecord)
+
+	record := func(tenantID string) *types.UsageRecord {
+		r, ok := usage[tenantID]
+		if !ok {
+			r = &types.UsageRecord{
+				TenantID:    tenantID,
+				Granularity: types.UsageSample,
+				Start:       from,
+				End:         to,
+			}
+			usage[tenantID] = r
+		}
+		return r
+	}
+
+	for _, id := range tenantIDs {
+		_ = record(id)
+	}
+
+	for _, s := range spans {
+		hours := spanHours(s, from, to)
+		if hours == 0 {
+			continue
+		}
+
+		r := record(s.TenantID)
+		switch s.Resource {
+		case types.UsageInstance:
+			r.InstanceHours += hours
+		case types.UsageVolume:
+			r.VolumeGBHours += hours * float64(s.SizeGB)
+		case types.UsageExternalIP:
+			r.ExternalIPHours += hours
+		}
+	}
+
+	return sortedUsage(usage)
+}
+
+// sortedUsage returns the records in usage ordered by start and tenant.
+func sortedUsage(usage map[string]*types.UsageRecord) []types.UsageRecord {
+	records := make([]types.UsageRecord, 0, len(usage))
+	for _, r := range usage {
+		records = append(records, *r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Start.Equal(records[j].Start) {
+			return records[i].Start.Before(records[j].Start)
+		}
+		return records[i].TenantID < records[j].TenantID
+	})
+
+	return records
+}
+
+// sampleUsage records the usage of the tenants' resources since the last
+// sample was taken.  Samples never cross the hour so that they can be
+// rolled up into hourly records.  The spans of the resources released
+// before now have been accounted for and are pruned.
+func (c *controller) sampleUsage(cfg controllerConfig, now time.Time) error {
+	now = now.UTC()
+
+	from, err := c.ds.LastUsageRecordEnd(types.UsageSample)
+	if err != nil {
+		return err
+	}
+
+	if from.IsZero() {
+		from = now.Add(-cfg.UsageSampleInterval)
+	}
+
+	if !now.After(from) {
+		return nil
+	}
+
+	spans, err := c.ds.UsageSpans()
+	if err != nil {
+		return err
+	}
+
+	tenants, err := c.ds.GetAllTenants()
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenants")
+	}
+
+	tenantIDs := make([]string, 0, len(tenants))
+	for _, t := range tenants {
+		tenantIDs = append(tenantIDs, t.ID)
+	}
+
+	var records []types.UsageRecord
+	for start := from; start.Before(now); {
+		end := start.Truncate(time.Hour).Add(time.Hour)
+		if end.After(now) {
+			end = now
+		}
+
+		records = append(records, usageRecords(spans, tenantIDs, start, end)...)
+		start = end
+	}
+
+	err = c.ds.AddUsageRecords(records)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.ds.PruneReleasedUsage(now)
+	return err
+}
+
+// rollupUsage sums the records of granularity from into records of
+// granularity to, each covering a period of the given length, for every
+// period which ended since the last roll up.
+func (c *controller) rollupUsage(from types.UsageGranularity, to types.UsageGranularity,
+	period time.Duration, now time.Time) error {
+	start, err := c.ds.LastUsageRecordEnd(to)
+	if err != nil {
+		return err
+	}
+
+	end := now.UTC().Truncate(period)
+	if !end.After(start) {
+		return nil
+	}
+
+	records, err := c.ds.GetUsageRecords(types.UsageFilter{
+		Granularity: from,
+		Start:       start,
+		End:         end,
+	})
+	if err != nil {
+		return err
+	}
+
+	usage := make(map[string]*types.UsageRecord)
+	for _, r := range records {
+		periodStart := r.Start.UTC().Truncate(period)
+		key := r.TenantID + "/" + periodStart.Format(time.RFC3339)
+
+		sum, ok := usage[key]
+		if !ok {
+			sum = &types.UsageRecord{
+				TenantID:    r.TenantID,
+				Granularity: to,
+				Start:       periodStart,
+				End:         periodStart.Add(period),
+			}
+			usage[key] = sum
+		}
+
+		sum.InstanceHours += r.InstanceHours
+		sum.VolumeGBHours += r.VolumeGBHours
+		sum.ExternalIPHours += r.ExternalIPHours
+	}
+
+	return c.ds.AddUsageRecords(sortedUsage(usage))
+}
+
+// updateUsage samples the usage of the tenants' resources, rolls the
+// samples up into hourly and daily records and prunes the samples which
+// have been rolled up and are older than usage_sample_retention.
+func (c *controller) updateUsage(cfg controllerConfig, now time.Time) error {
+	err := c.sampleUsage(cfg, now)
+	if err != nil {
+		return errors.Wrap(err, "Error sampling usage")
+	}
+
+	err = c.rollupUsage(types.UsageSample, types.UsageHourly, time.Hour, now)
+	if err != nil {
+		return errors.Wrap(err, "Error rolling up hourly usage")
+	}
+
+	err = c.rollupUsage(types.UsageHourly, types.UsageDaily, 24*time.Hour, now)
+	if err != nil {
+		return errors.Wrap(err, "Error rolling up daily usage")
+	}
+
+	before := now.Add(-cfg.UsageSampleRetention)
+	rolledUp, err := c.ds.LastUsageRecordEnd(types.UsageHourly)
+	if err != nil {
+		return errors.Wrap(err, "Error pruning usage samples")
+	}
+
+	if rolledUp.Before(before) {
+		before = rolledUp
+	}
+
+	_, err = c.ds.PruneUsageRecords(types.UsageSample, before)
+	return errors.Wrap(err, "Error pruning usage samples")
+}
+
+// recordUsage periodically records the usage of the tenants' resources
+// while the controller is active.  When usage recording is disabled the
+// spans of released resources are discarded rather than accumulated.
+func (c *controller) recordUsage() {
+	timer := time.NewTimer(usageCheckPeriod)
+	defer timer.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-timer.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		cfg := c.config.config()
+		next := cfg.UsageSampleInterval
+		if next == 0 {
+			next = usageCheckPeriod
+		}
+		timer.Reset(next)
+
+		if !c.isActive() {
+			continue
+		}
+
+		if cfg.UsageSampleInterval == 0 {
+			if _, err := c.ds.PruneReleasedUsage(now); err != nil {
+				c.log.Warningf("Unable to prune released usage: %v", err)
+			}
+			continue
+		}
+
+		if err := c.updateUsage(cfg, now); err != nil {
+			c.log.Warningf("Unable to record usage: %v", err)
+		}
+	}
+}
+
+// ListUsage returns the usage records selected by filter.
+func (c *controller) ListUsage(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	if filter.Granularity == "" {
+		filter.Granularity = types.UsageHourly
+	}
+
+	switch filter.Granularity {
+	case types.UsageSample, types.UsageHourly, types.UsageDaily:
+	default:
+		return nil, types.ErrBadRequest
+	}
+
+	if !filter.Start.IsZero() && !filter.End.IsZero() && !filter.End.After(filter.Start) {
+		return nil, types.ErrBadRequest
+	}
+
+	return c.ds.GetUsageRecords(filter)
+}
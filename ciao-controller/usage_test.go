@@ -0,0 +1,291 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore/datastoretest"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// newUsageController returns a controller with its own datastore whose
+// clock is clock, and which samples usage every 15 minutes.
+func newUsageController(t *testing.T, clock *fakeClock) *controller {
+	cfg := defaultConfig()
+	cfg.UsageSampleInterval = 15 * time.Minute
+
+	return &controller{
+		ds:     datastoretest.NewWithClock(t, clock.Now),
+		log:    ctl.log,
+		config: &configLoader{current: cfg},
+	}
+}
+
+func listTestUsage(t *testing.T, c *controller, tenantID string, g types.UsageGranularity) []types.UsageRecord {
+	records, err := c.ListUsage(types.UsageFilter{TenantID: tenantID, Granularity: g})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func checkUsage(t *testing.T, r types.UsageRecord, start time.Time, end time.Time,
+	instanceHours float64, volumeGBHours float64, externalIPHours float64) {
+	const tolerance = 1e-9
+
+	if !r.Start.Equal(start) || !r.End.Equal(end) {
+		t.Errorf("Expected %s record from %v to %v got %v to %v", r.Granularity, start, end, r.Start, r.End)
+	}
+
+	if math.Abs(r.InstanceHours-instanceHours) > tolerance ||
+		math.Abs(r.VolumeGBHours-volumeGBHours) > tolerance ||
+		math.Abs(r.ExternalIPHours-externalIPHours) > tolerance {
+		t.Errorf("Expected %s usage from %v of %v, %v, %v got %v, %v, %v", r.Granularity, start,
+			instanceHours, volumeGBHours, externalIPHours,
+			r.InstanceHours, r.VolumeGBHours, r.ExternalIPHours)
+	}
+}
+
+func TestUsageProration(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: t0}
+	c := newUsageController(t, clock)
+	cfg := c.config.config()
+	ds := c.ds
+
+	tenant := datastoretest.AddTenant(t, ds)
+	other := datastoretest.AddTenant(t, ds)
+
+	update := func(at time.Duration) {
+		clock.now = t0.Add(at)
+		err := c.updateUsage(cfg, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sampling starts one interval before the first sample
+	update(15 * time.Minute)
+
+	clock.now = t0.Add(20 * time.Minute)
+	ip, err := ds.AllocateTenantIP(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance := &types.Instance{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenant.ID,
+		State:       payloads.Running,
+		IPAddress:   ip.String(),
+		CreateTime:  clock.Now(),
+		StateChange: sync.NewCond(&sync.Mutex{}),
+	}
+
+	err = ds.AddInstance(context.Background(), instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String(), Size: 10},
+		State:       types.Available,
+		TenantID:    tenant.ID,
+		CreateTime:  clock.Now(),
+	}
+
+	err = ds.AddBlockDevice(context.Background(), volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "usage",
+	}
+
+	err = ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update(30 * time.Minute)
+
+	clock.now = t0.Add(40 * time.Minute)
+	m, err := ds.MapExternalIP(pool.ID, instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update(45 * time.Minute)
+
+	clock.now = t0.Add(50 * time.Minute)
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the address outlives the instance it was mapped to
+	clock.now = t0.Add(65 * time.Minute)
+	err = ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// samples are split at the hour
+	update(70 * time.Minute)
+
+	samples := listTestUsage(t, c, tenant.ID, types.UsageSample)
+	if len(samples) != 5 {
+		t.Fatalf("Expected 5 samples got %d", len(samples))
+	}
+
+	checkUsage(t, samples[0], t0, t0.Add(15*time.Minute), 0, 0, 0)
+	checkUsage(t, samples[1], t0.Add(15*time.Minute), t0.Add(30*time.Minute), 10.0/60, 100.0/60, 0)
+	checkUsage(t, samples[2], t0.Add(30*time.Minute), t0.Add(45*time.Minute), 0.25, 2.5, 5.0/60)
+	checkUsage(t, samples[3], t0.Add(45*time.Minute), t0.Add(time.Hour), 5.0/60, 2.5, 0.25)
+	checkUsage(t, samples[4], t0.Add(time.Hour), t0.Add(70*time.Minute), 0, 100.0/60, 5.0/60)
+
+	hourly := listTestUsage(t, c, tenant.ID, types.UsageHourly)
+	if len(hourly) != 1 {
+		t.Fatalf("Expected 1 hourly record got %d", len(hourly))
+	}
+	checkUsage(t, hourly[0], t0, t0.Add(time.Hour), 0.5, 400.0/60, 20.0/60)
+
+	// tenants which used nothing are still accounted for
+	hourly = listTestUsage(t, c, other.ID, types.UsageHourly)
+	if len(hourly) != 1 {
+		t.Fatalf("Expected 1 hourly record got %d", len(hourly))
+	}
+	checkUsage(t, hourly[0], t0, t0.Add(time.Hour), 0, 0, 0)
+
+	// a sample long after the last covers the whole gap
+	update(14*time.Hour + 30*time.Minute)
+
+	hourly = listTestUsage(t, c, tenant.ID, types.UsageHourly)
+	if len(hourly) != 14 {
+		t.Fatalf("Expected 14 hourly records got %d", len(hourly))
+	}
+	checkUsage(t, hourly[1], t0.Add(time.Hour), t0.Add(2*time.Hour), 0, 10, 5.0/60)
+	checkUsage(t, hourly[13], t0.Add(13*time.Hour), t0.Add(14*time.Hour), 0, 10, 0)
+
+	daily := listTestUsage(t, c, tenant.ID, types.UsageDaily)
+	if len(daily) != 1 {
+		t.Fatalf("Expected 1 daily record got %d", len(daily))
+	}
+
+	day := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	checkUsage(t, daily[0], day, day.Add(24*time.Hour), 0.5, 400.0/60+130, 25.0/60)
+
+	// rolled up samples are pruned once they are older than the retention
+	cfg.UsageSampleRetention = time.Hour
+	update(15 * time.Hour)
+
+	samples = listTestUsage(t, c, tenant.ID, types.UsageSample)
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples got %d", len(samples))
+	}
+	checkUsage(t, samples[0], t0.Add(13*time.Hour), t0.Add(14*time.Hour), 0, 10, 0)
+	checkUsage(t, samples[1], t0.Add(14*time.Hour), t0.Add(14*time.Hour+30*time.Minute), 0, 5, 0)
+	checkUsage(t, samples[2], t0.Add(14*time.Hour+30*time.Minute), t0.Add(15*time.Hour), 0, 5, 0)
+
+	// and the released resources once they have been accounted for
+	spans, err := ds.UsageSpans()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spans) != 1 || spans[0].ID != volume.ID {
+		t.Fatalf("Unexpected usage spans %+v", spans)
+	}
+}
+
+func TestUsageExport(t *testing.T) {
+	tenantID := uuid.Generate().String()
+	start := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var records []types.UsageRecord
+	for i := 0; i < 3; i++ {
+		records = append(records, types.UsageRecord{
+			TenantID:        tenantID,
+			Granularity:     types.UsageDaily,
+			Start:           start.Add(time.Duration(i) * 24 * time.Hour),
+			End:             start.Add(time.Duration(i+1) * 24 * time.Hour),
+			InstanceHours:   24 * float64(i+1),
+			VolumeGBHours:   480,
+			ExternalIPHours: 0.5,
+		})
+	}
+
+	err := ctl.ds.AddUsageRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/usage?granularity=daily&tenant_id=" + tenantID +
+		"&start=2017-03-02T00:00:00Z&end=2017-03-04T00:00:00Z"
+
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var resp types.ListUsageResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Usage) != 2 || resp.Usage[0].InstanceHours != 48 || resp.Usage[1].InstanceHours != 72 {
+		t.Fatalf("Unexpected usage %+v", resp.Usage)
+	}
+
+	body = testHTTPRequest(t, "GET", url+"&format=csv", http.StatusOK, nil, true)
+
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 3 || rows[0][0] != "tenant_id" || rows[1][0] != tenantID ||
+		rows[1][2] != "2017-03-02T00:00:00Z" || rows[2][4] != "72.000000" || rows[2][5] != "480.000000" {
+		t.Fatalf("Unexpected CSV %q", rows)
+	}
+
+	_ = testHTTPRequest(t, "GET", testutil.ComputeURL+"/usage?granularity=weekly", http.StatusBadRequest, nil, true)
+
+	// usage is only exported to admins
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequestWithHeader(t, "GET", testutil.ComputeURL+"/usage", http.StatusForbidden, nil, onBehalfOf(tenant.ID))
+}
@@ -16,6 +16,7 @@ package utils
 
 import (
 	"crypto/rand"
+	"fmt"
 	"net"
 )
 
@@ -51,3 +52,32 @@ func NewHardwareAddr() (net.HardwareAddr, error) {
 
 	return hw, nil
 }
+
+// ParseRange parses an IPv4 address range given either as a subnet in CIDR
+// notation or as a single address, which is treated as a /32.
+func ParseRange(r string) (*net.IPNet, error) {
+	if IP := net.ParseIP(r); IP != nil {
+		if IP.To4() == nil {
+			return nil, fmt.Errorf("%s is not an IPv4 address", r)
+		}
+		return &net.IPNet{IP: IP.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 subnet", r)
+	}
+
+	return ipNet, nil
+}
+
+// RangesOverlap returns true if two address ranges share any address.  As
+// ranges are either disjoint or nested it is enough to check whether
+// either one contains the first address of the other.
+func RangesOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
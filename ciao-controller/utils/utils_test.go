@@ -49,3 +49,80 @@ func TestHardwareAddr(t *testing.T) {
 		t.Fatal("Byte 1 may never be zero")
 	}
 }
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		r     string
+		want  string
+		valid bool
+	}{
+		{"10.0.0.0/24", "10.0.0.0/24", true},
+		{"10.0.0.7/24", "10.0.0.0/24", true},
+		{"10.0.0.6/31", "10.0.0.6/31", true},
+		{"10.0.0.7/32", "10.0.0.7/32", true},
+		{"10.0.0.7", "10.0.0.7/32", true},
+		{"10.0.0.0/33", "", false},
+		{"10.0.0", "", false},
+		{"fd00::/64", "", false},
+		{"fd00::1", "", false},
+	}
+
+	for _, test := range tests {
+		ipNet, err := ParseRange(test.r)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %s to be rejected", test.r)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unable to parse %s: %v", test.r, err)
+			continue
+		}
+
+		if ipNet.String() != test.want {
+			t.Errorf("Expected %s to parse as %s, got %s", test.r, test.want, ipNet)
+		}
+	}
+}
+
+func TestRangesOverlap(t *testing.T) {
+	tests := []struct {
+		a       string
+		b       string
+		overlap bool
+	}{
+		{"10.0.0.0/24", "10.0.0.0/24", true},
+		{"10.0.0.0/24", "10.0.0.128/25", true},
+		{"10.0.0.0/24", "10.0.1.0/24", false},
+		{"10.0.0.0/23", "10.0.1.0/24", true},
+		{"10.0.0.0/24", "10.0.0.255", true},
+		{"10.0.0.0/24", "10.0.1.0", false},
+		{"10.0.0.6/31", "10.0.0.7", true},
+		{"10.0.0.6/31", "10.0.0.8", false},
+		{"10.0.0.6/31", "10.0.0.4/31", false},
+		{"10.0.0.4/30", "10.0.0.6/31", true},
+		{"10.0.0.7/32", "10.0.0.7", true},
+		{"10.0.0.7/32", "10.0.0.6/32", false},
+		{"10.0.0.7/32", "10.0.0.6/31", true},
+		{"192.168.128.0/17", "192.168.127.255", false},
+		{"192.168.128.0/17", "192.168.0.0/16", true},
+	}
+
+	for _, test := range tests {
+		a, err := ParseRange(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ParseRange(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if RangesOverlap(a, b) != test.overlap || RangesOverlap(b, a) != test.overlap {
+			t.Errorf("Expected overlap of %s and %s to be %v", test.a, test.b, test.overlap)
+		}
+	}
+}
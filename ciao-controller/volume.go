@@ -15,42 +15,90 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
-	"github.com/golang/glog"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
 )
 
 // CreateVolume will create a new block device and store it in the datastore.
-func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types.Volume, error) {
+func (c *controller) CreateVolume(ctx context.Context, tenant string, req api.RequestedVolume) (types.Volume, error) {
+	return c.createVolume(ctx, tenant, req, func(int) {})
+}
+
+// CreateVolumeFromImage starts an operation which creates a bootable volume
+// from an image, which may take a long time for large images.
+func (c *controller) CreateVolumeFromImage(ctx context.Context, tenant string, req api.RequestedVolume) (types.Operation, error) {
+	s := types.StorageResource{
+		SourceType: types.ImageService,
+		Source:     req.ImageRef,
+	}
+
+	image, err := c.storageImage(tenant, s)
+	if err != nil {
+		return types.Operation{}, err
+	}
+	req.ImageRef = image.ID
+
+	return c.startOperation(tenant, types.CreateVolumeOperation, image.ID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			vol, err := c.createVolume(ctx, tenant, req, progress)
+			return vol.ID, err
+		})
+}
+
+func (c *controller) createVolume(ctx context.Context, tenant string, req api.RequestedVolume, progress operationProgress) (types.Volume, error) {
 	var bd storage.BlockDevice
 
 	var err error
 	// no limits checking for now.
 	if req.ImageRef != "" {
 		// create bootable volume
-		bd, err = c.CreateBlockDeviceFromSnapshot(req.ImageRef, "ciao-image")
+		bd, err = c.CreateBlockDeviceFromSnapshot(ctx, req.ImageRef, "ciao-image")
 		bd.Bootable = true
 	} else if req.SourceVolID != "" {
 		// copy existing volume
-		bd, err = c.CopyBlockDevice(req.SourceVolID)
+		bd, err = c.CopyBlockDevice(ctx, req.SourceVolID)
+	} else if req.SnapshotID != "" {
+		// restore a snapshot of a volume
+		var snap types.VolumeSnapshot
+		snap, err = c.tenantVolumeSnapshot(tenant, "", req.SnapshotID)
+		if err == nil {
+			bd, err = c.CreateBlockDeviceFromSnapshot(ctx, snap.VolumeID, snap.ID)
+		}
 	} else {
 		// create empty volume
-		bd, err = c.CreateBlockDevice("", "", req.Size)
+		bd, err = c.CreateBlockDevice(ctx, "", "", req.Size)
+	}
+
+	if err == nil {
+		progress(50)
 	}
 
 	if err == nil && req.Size > bd.Size {
-		bd.Size, err = c.Resize(bd.ID, req.Size)
+		bd.Size, err = c.Resize(ctx, bd.ID, req.Size)
+		progress(75)
 	}
 
 	if err != nil {
 		return types.Volume{}, err
 	}
 
+	// the volume now exists and must be cleaned up, or recorded, even if
+	// the request is abandoned.
+	cleanupCtx := context.WithoutCancel(ctx)
+
 	// store block device data in datastore
 	// TBD - do we really need to do this, or can we associate
 	// the block device data with the device itself?
@@ -63,6 +111,8 @@ func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types
 		Name:        req.Name,
 		Description: req.Description,
 		Internal:    req.Internal,
+
+		DeletionProtected: req.DeletionProtected,
 	}
 
 	// It's best to make the quota request here as we don't know the volume
@@ -77,15 +127,16 @@ func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types
 		res := <-c.qs.Consume(tenant, resources...)
 
 		if !res.Allowed() {
-			_ = c.DeleteBlockDevice(bd.ID)
+			c.quotaExceeded(tenant, res)
+			_ = c.DeleteBlockDevice(cleanupCtx, bd.ID)
 			c.qs.Release(tenant, res.Resources()...)
 			return types.Volume{}, api.ErrQuota
 		}
 	}
 
-	err = c.ds.AddBlockDevice(data)
+	err = c.ds.AddBlockDevice(ctx, data)
 	if err != nil {
-		_ = c.DeleteBlockDevice(bd.ID)
+		_ = c.DeleteBlockDevice(cleanupCtx, bd.ID)
 		if !data.Internal {
 			c.qs.Release(tenant, resources...)
 		}
@@ -95,7 +146,9 @@ func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types
 	return data, nil
 }
 
-func (c *controller) DeleteVolume(tenant string, volume string) error {
+// DeleteVolume deletes a volume of a tenant.  A volume protected from
+// deletion is only deleted if force is set, and is never kept in the trash.
+func (c *controller) DeleteVolume(ctx context.Context, tenant string, volume string, force bool) error {
 	// get the block device information
 	info, err := c.ds.GetBlockDevice(volume)
 	if err != nil {
@@ -112,14 +165,37 @@ func (c *controller) DeleteVolume(tenant string, volume string) error {
 		return api.ErrVolumeNotAvailable
 	}
 
+	// the snapshots taken on request must be deleted first.
+	if c.hasRequestedSnapshots(info.ID) {
+		return types.ErrVolumeHasSnapshots
+	}
+
+	if info.DeletionProtected {
+		err = c.overrideDeletionProtection(ctx, tenant, []protectedResource{{"volume", info.ID}}, force)
+		if err != nil {
+			return err
+		}
+	}
+
+	// keep the volume in the tenant's trash until it is purged.
+	if retention := c.trashRetention(tenant); retention > 0 && !info.DeletionProtected {
+		return c.trashVolume(ctx, info, retention)
+	}
+
+	err = c.removeVolumeSnapshots(ctx, info)
+	if err != nil {
+		return err
+	}
+
 	// remove the block data from our datastore.
-	err = c.ds.DeleteBlockDevice(volume)
+	err = c.ds.DeleteBlockDevice(ctx, volume)
 	if err != nil {
 		return err
 	}
 
-	// tell the underlying storage media to remove.
-	err = c.DeleteBlockDevice(volume)
+	// once forgotten the volume must be removed from the storage media
+	// even if the request is abandoned.
+	err = c.DeleteBlockDevice(context.WithoutCancel(ctx), volume)
 	if err != nil {
 		return err
 	}
@@ -132,7 +208,110 @@ func (c *controller) DeleteVolume(tenant string, volume string) error {
 	return nil
 }
 
-func (c *controller) AttachVolume(tenant string, volume string, instance string, mountpoint string) error {
+// PatchVolume applies a JSON merge patch to the attributes of a tenant's
+// volume which may be changed, currently only its deletion protection.
+func (c *controller) PatchVolume(ctx context.Context, tenant string, volume string, patch []byte) (types.Volume, error) {
+	info, err := c.ds.GetBlockDevice(volume)
+	if err != nil {
+		return types.Volume{}, err
+	}
+
+	if info.TenantID != tenant {
+		return types.Volume{}, api.ErrVolumeOwner
+	}
+
+	orig, err := json.Marshal(types.VolumeUpdate{DeletionProtected: info.DeletionProtected})
+	if err != nil {
+		return types.Volume{}, errors.Wrap(err, "Error updating volume")
+	}
+
+	merged, err := jsonpatch.MergePatch(orig, patch)
+	if err != nil {
+		return types.Volume{}, types.ErrBadRequest
+	}
+
+	var update types.VolumeUpdate
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&update); err != nil {
+		return types.Volume{}, types.ErrBadRequest
+	}
+
+	if update.DeletionProtected != info.DeletionProtected {
+		err = c.ds.UpdateBlockDeviceDeletionProtection(ctx, volume, update.DeletionProtected)
+		if err != nil {
+			return types.Volume{}, err
+		}
+	}
+
+	return c.ShowVolumeDetails(tenant, volume)
+}
+
+// ExtendVolume grows a tenant's volume to sizeGiB, consuming the quota of
+// the additional space.  Attached volumes are only extended if online is
+// set, in which case the instance must rescan the disk to use the space.
+func (c *controller) ExtendVolume(ctx context.Context, tenant string, volume string, sizeGiB int, online bool) error {
+	info, err := c.tenantVolume(tenant, volume)
+	if err != nil {
+		return err
+	}
+
+	if sizeGiB <= info.Size {
+		return types.ErrBadVolumeSize
+	}
+
+	switch info.State {
+	case types.Available:
+	case types.InUse:
+		if !online {
+			return types.ErrVolumeAttached
+		}
+	default:
+		return api.ErrVolumeNotAvailable
+	}
+
+	delta := payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: sizeGiB - info.Size}
+
+	if !info.Internal {
+		res := <-c.qs.Consume(tenant, delta)
+
+		if !res.Allowed() {
+			c.quotaExceeded(tenant, res)
+			c.qs.Release(tenant, res.Resources()...)
+			return api.ErrQuota
+		}
+	}
+
+	size, err := c.Resize(ctx, info.ID, sizeGiB)
+	if err != nil {
+		if !info.Internal {
+			c.qs.Release(tenant, delta)
+		}
+		return err
+	}
+
+	// the volume has grown and the new size must be recorded even if the
+	// request is abandoned.
+	err = c.ds.UpdateBlockDeviceSize(context.WithoutCancel(ctx), info.ID, size)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Volume %s extended to %d GiB", info.ID, size)
+	_ = c.ds.LogEvent(tenant, msg)
+
+	return nil
+}
+
+// volumeTagRegexp matches the tags which can identify attached volumes.  The
+// tags are used as the serial numbers of the disks, which hold 20 bytes.
+var volumeTagRegexp = regexp.MustCompile("^[A-Za-z0-9._-]{1,20}$")
+
+func (c *controller) AttachVolume(ctx context.Context, tenant string, volume string, instance string, mountpoint string, tag string) error {
+	if tag != "" && !volumeTagRegexp.MatchString(tag) {
+		return types.ErrBadVolumeTag
+	}
+
 	// get the block device information
 	info, err := c.ds.GetBlockDevice(volume)
 	if err != nil {
@@ -155,10 +334,19 @@ func (c *controller) AttachVolume(tenant string, volume string, instance string,
 		return api.ErrInstanceNotFound
 	}
 
+	// check that the tag does not already identify another volume.
+	if tag != "" {
+		for _, a := range c.ds.GetStorageAttachments(i.ID) {
+			if a.Tag == tag {
+				return types.ErrVolumeTagInUse
+			}
+		}
+	}
+
 	// update volume state to attaching
 	info.State = types.Attaching
 
-	err = c.ds.UpdateBlockDevice(info)
+	err = c.ds.UpdateBlockDevice(ctx, info)
 	if err != nil {
 		return err
 	}
@@ -168,32 +356,35 @@ func (c *controller) AttachVolume(tenant string, volume string, instance string,
 		ID:        info.ID,
 		Ephemeral: false,
 		Bootable:  false,
+		Tag:       tag,
 	}
-	_, err = c.ds.CreateStorageAttachment(i.ID, a)
+	_, err = c.ds.CreateStorageAttachment(ctx, i.ID, a)
 	if err != nil {
 		info.State = types.Available
-		dsErr := c.ds.UpdateBlockDevice(info)
+		dsErr := c.ds.UpdateBlockDevice(context.WithoutCancel(ctx), info)
 		if dsErr != nil {
-			glog.Error(dsErr)
+			clogger.With(c.log, "tenant", tenant, "volume", volume).Errorf("Error restoring volume state: %v", dsErr)
 		}
 		return err
 	}
 
 	// send command to attach volume.
-	err = c.client.attachVolume(volume, instance, i.NodeID)
+	err = c.client.attachVolume(volume, instance, i.NodeID, tag)
 	if err != nil {
 		info.State = types.Available
-		dsErr := c.ds.UpdateBlockDevice(info)
+		dsErr := c.ds.UpdateBlockDevice(context.WithoutCancel(ctx), info)
 		if dsErr != nil {
-			glog.Error(dsErr)
+			clogger.With(c.log, "tenant", tenant, "volume", volume).Errorf("Error restoring volume state: %v", dsErr)
 		}
 		return err
 	}
 
+	c.recordHistory(ctx, i, types.HistoryAttach, fmt.Sprintf("Volume %s attached at %s", volume, mountpoint))
+
 	return nil
 }
 
-func (c *controller) DetachVolume(tenant string, volume string, attachment string) error {
+func (c *controller) DetachVolume(ctx context.Context, tenant string, volume string, attachment string) error {
 	// we don't support detaching by attachment ID yet.
 	if attachment != "" {
 		return errors.New("Detaching by attachment ID not implemented")
@@ -241,7 +432,7 @@ func (c *controller) DetachVolume(tenant string, volume string, attachment strin
 		// get instance info
 		i, err := c.ds.GetTenantInstance(tenant, a.InstanceID)
 		if err != nil {
-			glog.Error(api.ErrInstanceNotFound)
+			clogger.With(c.log, "tenant", tenant, "instance", a.InstanceID).Errorf("%v", api.ErrInstanceNotFound)
 			// keep going
 			retval = err
 			continue
@@ -259,15 +450,143 @@ func (c *controller) DetachVolume(tenant string, volume string, attachment strin
 		// update volume state to detaching
 		info.State = types.Available
 
-		err = c.ds.UpdateBlockDevice(info)
+		err = c.ds.UpdateBlockDevice(ctx, info)
 		if err != nil {
 			return err
 		}
+
+		c.recordHistory(ctx, i, types.HistoryDetach, fmt.Sprintf("Volume %s detached", volume))
 	}
 
 	return retval
 }
 
+// adminVolume returns a volume for one of the admin repair operations.
+func (c *controller) adminVolume(volume string) (types.Volume, error) {
+	info, err := c.ds.GetBlockDevice(volume)
+	if err == datastore.ErrNoBlockData {
+		return info, types.ErrVolumeNotFound
+	}
+	return info, err
+}
+
+// ForceDetachVolume removes the attachments of a volume whose instance, or
+// node, can no longer detach it and makes the volume available again. Any
+// lock the instance's node still holds on the volume is broken first. The
+// volume is only detached from a running instance if confirm is set.
+func (c *controller) ForceDetachVolume(ctx context.Context, volume string, confirm bool) error {
+	info, err := c.adminVolume(volume)
+	if err != nil {
+		return err
+	}
+
+	attachments, err := c.ds.GetVolumeAttachments(volume)
+	if err != nil {
+		return err
+	}
+
+	if len(attachments) == 0 && info.State == types.Available {
+		return api.ErrVolumeNotAttached
+	}
+
+	if !confirm {
+		for _, a := range attachments {
+			i, err := c.ds.GetInstance(a.InstanceID)
+			if err == nil && instanceActive(i) {
+				return types.ErrVolumeInstanceActive
+			}
+		}
+	}
+
+	// the volume must not be made available while another node can
+	// still write to it.
+	err = c.ForceRelease(ctx, volume)
+	if err != nil {
+		return errors.Wrapf(err, "error releasing volume (%v)", volume)
+	}
+
+	for _, a := range attachments {
+		err = c.ds.DeleteStorageAttachment(a.ID)
+		if err != nil {
+			return err
+		}
+
+		if i, err := c.ds.GetInstance(a.InstanceID); err == nil {
+			c.recordHistory(ctx, i, types.HistoryDetach, fmt.Sprintf("Volume %s force detached", volume))
+		}
+	}
+
+	// the attachments are gone so the volume must be made available
+	// even if the request is abandoned.
+	oldState := info.State
+	info.State = types.Available
+	err = c.ds.UpdateBlockDevice(context.WithoutCancel(ctx), info)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Volume %s force detached from %d instances, state %s", volume, len(attachments), oldState)
+	err = c.ds.LogAction(info.TenantID, volume, "", "", msg)
+	if err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+
+	return nil
+}
+
+// SetVolumeState overwrites the recorded state of a volume, which may have
+// been left behind by a node which died mid attach or detach. The change
+// and its reason are recorded in the volume owner's event log.
+func (c *controller) SetVolumeState(ctx context.Context, volume string, state types.BlockState, reason string) error {
+	switch state {
+	case types.Available, types.Attaching, types.InUse, types.Detaching:
+	default:
+		return types.ErrBadRequest
+	}
+
+	if reason == "" {
+		return types.ErrBadRequest
+	}
+
+	info, err := c.adminVolume(volume)
+	if err != nil {
+		return err
+	}
+
+	oldState := info.State
+	info.State = state
+	err = c.ds.UpdateBlockDevice(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Volume %s state changed from %s to %s: %s", volume, oldState, state, reason)
+	err = c.ds.LogAction(info.TenantID, volume, "", "", msg)
+	if err != nil {
+		c.log.Warningf("Error logging event: %v", err)
+	}
+
+	return nil
+}
+
+// ListAttachments returns a page of the storage attachments of all tenants
+// which match filter.
+func (c *controller) ListAttachments(filter types.AttachmentFilter) (types.ListAttachmentsResponse, error) {
+	attachments, err := c.ds.GetAttachmentDetails(filter)
+	if err != nil {
+		return types.ListAttachmentsResponse{}, err
+	}
+
+	resp := types.ListAttachmentsResponse{Attachments: attachments}
+
+	// a full page may be followed by more attachments
+	if filter.Limit > 0 && len(attachments) == filter.Limit {
+		resp.NextMarker = attachments[len(attachments)-1].ID
+	}
+
+	return resp, nil
+}
+
 func (c *controller) ListVolumesDetail(tenant string) ([]types.Volume, error) {
 	vols := []types.Volume{}
 
@@ -277,7 +596,7 @@ func (c *controller) ListVolumesDetail(tenant string) ([]types.Volume, error) {
 	}
 
 	for _, vol := range devs {
-		if vol.Internal {
+		if vol.Internal || vol.State == types.PendingDelete {
 			continue
 		}
 
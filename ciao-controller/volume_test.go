@@ -0,0 +1,416 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// lockedDriver is a block driver which cannot break the locks held on its
+// volumes.
+type lockedDriver struct {
+	*storage.NoopDriver
+}
+
+func (d lockedDriver) ForceRelease(ctx context.Context, volumeUUID string) error {
+	return errors.New("volume lock held")
+}
+
+// slowDriver is a block driver whose volumes take a minute to create
+// unless the request creating them is abandoned first.
+type slowDriver struct {
+	*storage.NoopDriver
+	started   chan struct{}
+	abandoned chan error
+}
+
+func newSlowDriver() *slowDriver {
+	return &slowDriver{
+		NoopDriver: &storage.NoopDriver{},
+		started:    make(chan struct{}, 1),
+		abandoned:  make(chan error, 1),
+	}
+}
+
+func (d *slowDriver) CreateBlockDevice(ctx context.Context, volumeUUID string, image string, size int) (storage.BlockDevice, error) {
+	d.started <- struct{}{}
+
+	select {
+	case <-ctx.Done():
+		d.abandoned <- ctx.Err()
+		return storage.BlockDevice{}, ctx.Err()
+	case <-time.After(time.Minute):
+		return d.NoopDriver.CreateBlockDevice(ctx, volumeUUID, image, size)
+	}
+}
+
+// addStuckVolume returns an in-use volume attached to an instance in state.
+func addStuckVolume(t *testing.T, tenantID string, state string) (types.Volume, *types.Instance) {
+	wl := addBoundedWorkload(t, tenantID)
+
+	i := &types.Instance{
+		ID:          uuid.Generate().String(),
+		TenantID:    tenantID,
+		WorkloadID:  wl.ID,
+		NodeID:      uuid.Generate().String(),
+		MACAddress:  uuid.Generate().String(),
+		State:       state,
+		StateChange: sync.NewCond(&sync.Mutex{}),
+	}
+
+	err := ctl.ds.AddInstance(context.Background(), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := addTestBlockDevice(t, tenantID)
+
+	_, err = ctl.ds.CreateStorageAttachment(context.Background(), i.ID, payloads.StorageResource{ID: vol.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol.State = types.InUse
+	err = ctl.ds.UpdateBlockDevice(context.Background(), vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return vol, i
+}
+
+func checkVolume(t *testing.T, volumeID string, state types.BlockState, attachments int) {
+	vol, err := ctl.ds.GetBlockDevice(volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.State != state {
+		t.Errorf("Volume %s in state %s expected %s", volumeID, vol.State, state)
+	}
+
+	as, err := ctl.ds.GetVolumeAttachments(volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != attachments {
+		t.Errorf("Volume %s has %d attachments expected %d", volumeID, len(as), attachments)
+	}
+}
+
+// volumeEvents returns the events logged for a volume other than the
+// changes of its state.
+func volumeEvents(t *testing.T, tenantID string, volumeID string) []types.CiaoEvent {
+	events, err := ctl.ListTenantEvents(tenantID, types.EventFilter{ObjectID: volumeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []types.CiaoEvent
+	for _, e := range events.Events {
+		if e.EventType != "volume_state" {
+			logged = append(logged, e)
+		}
+	}
+	return logged
+}
+
+func TestForceDetachVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _ := addStuckVolume(t, tenant.ID, payloads.Exited)
+
+	err = ctl.ForceDetachVolume(context.Background(), vol.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVolume(t, vol.ID, types.Available, 0)
+
+	if len(volumeEvents(t, tenant.ID, vol.ID)) != 1 {
+		t.Errorf("Force detach not recorded in event log")
+	}
+
+	err = ctl.ForceDetachVolume(context.Background(), vol.ID, false)
+	if err != api.ErrVolumeNotAttached {
+		t.Errorf("Expected %v got %v", api.ErrVolumeNotAttached, err)
+	}
+
+	err = ctl.ForceDetachVolume(context.Background(), uuid.Generate().String(), false)
+	if err != types.ErrVolumeNotFound {
+		t.Errorf("Expected %v got %v", types.ErrVolumeNotFound, err)
+	}
+}
+
+func TestForceDetachRunningInstance(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _ := addStuckVolume(t, tenant.ID, payloads.Running)
+
+	url := testutil.ComputeURL + "/volumes/" + vol.ID + "/force-detach"
+	_ = testHTTPRequest(t, "POST", url, http.StatusConflict, []byte(`{"confirm":false}`), true)
+
+	checkVolume(t, vol.ID, types.InUse, 1)
+
+	_ = testHTTPRequest(t, "POST", url, http.StatusNoContent, []byte(`{"confirm":true}`), true)
+
+	checkVolume(t, vol.ID, types.Available, 0)
+}
+
+func TestForceDetachReleaseFailure(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _ := addStuckVolume(t, tenant.ID, payloads.Exited)
+
+	driver := ctl.BlockDriver
+	ctl.BlockDriver = lockedDriver{&storage.NoopDriver{}}
+	defer func() { ctl.BlockDriver = driver }()
+
+	err = ctl.ForceDetachVolume(context.Background(), vol.ID, true)
+	if err == nil {
+		t.Fatal("Force detach succeeded with volume still locked")
+	}
+
+	// the volume must not be handed out while it may still be in use
+	checkVolume(t, vol.ID, types.InUse, 1)
+
+	if len(volumeEvents(t, tenant.ID, vol.ID)) != 0 {
+		t.Errorf("Failed force detach recorded in event log")
+	}
+
+	ctl.BlockDriver = driver
+
+	err = ctl.ForceDetachVolume(context.Background(), vol.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVolume(t, vol.ID, types.Available, 0)
+}
+
+func TestSetVolumeState(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := addTestBlockDevice(t, tenant.ID)
+
+	tests := []struct {
+		state  types.BlockState
+		reason string
+		err    error
+	}{
+		{"broken", "testing", types.ErrBadRequest},
+		{types.InUse, "", types.ErrBadRequest},
+		{types.InUse, "attach lost with node", nil},
+	}
+
+	for _, test := range tests {
+		err := ctl.SetVolumeState(context.Background(), vol.ID, test.state, test.reason)
+		if err != test.err {
+			t.Errorf("Setting state %s with reason %q: expected %v got %v",
+				test.state, test.reason, test.err, err)
+		}
+	}
+
+	checkVolume(t, vol.ID, types.InUse, 0)
+
+	url := testutil.ComputeURL + "/volumes/" + vol.ID + "/state"
+	body := []byte(`{"state":"available","reason":"node replaced"}`)
+	_ = testHTTPRequest(t, "PUT", url, http.StatusNoContent, body, true)
+
+	checkVolume(t, vol.ID, types.Available, 0)
+
+	events := volumeEvents(t, tenant.ID, vol.ID)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 volume state events got %d", len(events))
+	}
+
+	for i, reason := range []string{"attach lost with node", "node replaced"} {
+		if !strings.Contains(events[i].Message, reason) {
+			t.Errorf("Event %q does not record reason %q", events[i].Message, reason)
+		}
+	}
+
+	err = ctl.SetVolumeState(context.Background(), uuid.Generate().String(), types.Available, "testing")
+	if err != types.ErrVolumeNotFound {
+		t.Errorf("Expected %v got %v", types.ErrVolumeNotFound, err)
+	}
+}
+
+func TestVolumeRequestCancelled(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := ctl.BlockDriver
+	slow := newSlowDriver()
+	ctl.BlockDriver = slow
+	defer func() { ctl.BlockDriver = driver }()
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/volumes"
+	body := []byte(`{"size":1}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := testHTTPClient(t)
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	<-slow.started
+	cancel()
+
+	select {
+	case err := <-slow.abandoned:
+		if err != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Volume creation not abandoned with the request")
+	}
+
+	vols, err := ctl.ListVolumesDetail(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vols) != 0 {
+		t.Errorf("Volume created by abandoned request: %+v", vols)
+	}
+
+	// requests which run out of time are abandoned too
+	defer setTestConfig(func(cfg *controllerConfig) {
+		cfg.APIRequestTimeout = 100 * time.Millisecond
+	})()
+
+	start := time.Now()
+	_ = testHTTPRequest(t, "POST", url, http.StatusServiceUnavailable, body, true)
+	<-slow.started
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Request took %s to time out", elapsed)
+	}
+
+	if err := <-slow.abandoned; err != context.DeadlineExceeded {
+		t.Errorf("Expected %v got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestExtendVolume(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	vol := createTestVolume(tenant.ID, 1, t)
+	usage := quotaUsage(tenant.ID, "tenant-storage-quota")
+
+	err = ctl.ExtendVolume(ctx, tenant.ID, vol, 1, false)
+	if err != types.ErrBadVolumeSize {
+		t.Fatalf("Expected %v got %v", types.ErrBadVolumeSize, err)
+	}
+
+	err = ctl.ExtendVolume(ctx, tenant.ID, vol, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ctl.ds.GetBlockDevice(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 3 {
+		t.Fatalf("Expected volume of 3 GiB got %d", info.Size)
+	}
+
+	if used := quotaUsage(tenant.ID, "tenant-storage-quota"); used != usage+2 {
+		t.Fatalf("Expected storage usage of %d got %d", usage+2, used)
+	}
+
+	// the extension is refused if it exceeds the tenant's quota
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-storage-quota", Value: usage + 3},
+	})
+
+	err = ctl.ExtendVolume(ctx, tenant.ID, vol, 5, false)
+	if err != api.ErrQuota {
+		t.Fatalf("Expected %v got %v", api.ErrQuota, err)
+	}
+
+	if used := quotaUsage(tenant.ID, "tenant-storage-quota"); used != usage+2 {
+		t.Fatalf("Expected storage usage of %d got %d", usage+2, used)
+	}
+}
+
+func TestExtendAttachedVolume(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _ := addStuckVolume(t, tenant.ID, payloads.Running)
+
+	err = ctl.ExtendVolume(context.Background(), tenant.ID, vol.ID, vol.Size+1, false)
+	if err != types.ErrVolumeAttached {
+		t.Fatalf("Expected %v got %v", types.ErrVolumeAttached, err)
+	}
+
+	err = ctl.ExtendVolume(context.Background(), tenant.ID, vol.ID, vol.Size+1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVolume(t, vol.ID, types.InUse, 1)
+}
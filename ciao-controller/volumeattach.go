@@ -0,0 +1,326 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+// volumeAttachTimeout bounds the time spent waiting for a node to report
+// that it has attached or detached a volume.
+var volumeAttachTimeout = 2 * time.Minute
+
+// pendingVolume is an attach or detach of a volume which has been sent to
+// the node running the instance.
+type pendingVolume struct {
+	instanceID string
+	result     chan error
+}
+
+// volumeAttachRequests routes the attach and detach results reported by
+// the nodes to the operations waiting for them.  A volume may only be
+// attached or detached once at a time.
+type volumeAttachRequests struct {
+	lock    sync.Mutex
+	pending map[string]pendingVolume
+}
+
+func (r *volumeAttachRequests) add(volumeID string, instanceID string) (chan error, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]pendingVolume)
+	}
+
+	if _, ok := r.pending[volumeID]; ok {
+		return nil, false
+	}
+
+	ch := make(chan error, 1)
+	r.pending[volumeID] = pendingVolume{instanceID: instanceID, result: ch}
+
+	return ch, true
+}
+
+func (r *volumeAttachRequests) remove(volumeID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, volumeID)
+}
+
+// deliver passes the result of an attach or detach on to the operation
+// waiting for it.  It returns false if no attach or detach of the volume
+// to the instance is pending.
+func (r *volumeAttachRequests) deliver(volumeID string, instanceID string, err error) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p, ok := r.pending[volumeID]
+	if !ok || p.instanceID != instanceID {
+		return false
+	}
+
+	select {
+	case p.result <- err:
+	default:
+	}
+
+	return true
+}
+
+// wait waits for the result of an attach or detach of a volume.
+func (r *volumeAttachRequests) wait(ctx context.Context, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(volumeAttachTimeout):
+		return errors.New("Timed out waiting for node")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runningInstance returns a running instance of a tenant to which volumes
+// may be attached or from which they may be detached.
+func (c *controller) runningInstance(tenantID string, instanceID string) (*types.Instance, error) {
+	i, err := c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	i.StateLock.RLock()
+	state := i.State
+	i.StateLock.RUnlock()
+
+	if i.CNCI || state != payloads.Running || i.NodeID == "" {
+		return nil, types.ErrInstanceNotRunning
+	}
+
+	return i, nil
+}
+
+// setVolumeState records a new state for a volume which is being attached
+// or detached.
+func (c *controller) setVolumeState(ctx context.Context, volumeID string, state types.BlockState) error {
+	info, err := c.ds.GetBlockDevice(volumeID)
+	if err != nil {
+		return err
+	}
+
+	info.State = state
+
+	return c.ds.UpdateBlockDevice(ctx, info)
+}
+
+// AttachVolumeToInstance attaches an available volume of a tenant to one of
+// its running instances.  The volume is attaching until the node running
+// the instance reports that it has attached it, when the attachment is
+// recorded, and is available again if the node fails to attach it.
+func (c *controller) AttachVolumeToInstance(ctx context.Context, tenantID string, volumeID string, instanceID string) (types.Operation, error) {
+	_, err := c.tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	ch, ok := c.volumeRequests.add(volumeID, instanceID)
+	if !ok {
+		return types.Operation{}, types.ErrVolumeBusy
+	}
+
+	// the request is removed by the operation once it is started
+	started := false
+	defer func() {
+		if !started {
+			c.volumeRequests.remove(volumeID)
+		}
+	}()
+
+	// reread the volume now that no other attach or detach can change it
+	info, err := c.tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if info.State != types.Available {
+		return types.Operation{}, types.ErrVolumeNotAvailable
+	}
+
+	i, err := c.runningInstance(tenantID, instanceID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	log := clogger.With(c.log, "tenant", tenantID, "volume", volumeID, "instance", i.ID)
+
+	err = c.setVolumeState(ctx, volumeID, types.Attaching)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	actx := context.WithoutCancel(ctx)
+	op, err := c.startOperation(tenantID, types.AttachVolumeOperation, volumeID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			defer c.volumeRequests.remove(volumeID)
+
+			err := c.client.attachVolume(volumeID, i.ID, i.NodeID, "")
+			if err == nil {
+				err = c.volumeRequests.wait(ctx, ch)
+			}
+
+			if err == nil {
+				_, err = c.ds.CreateStorageAttachment(actx, i.ID, payloads.StorageResource{ID: volumeID})
+			}
+
+			if err != nil {
+				if dsErr := c.setVolumeState(actx, volumeID, types.Available); dsErr != nil {
+					log.Errorf("Error restoring volume state: %v", dsErr)
+				}
+				return "", err
+			}
+
+			c.recordHistory(actx, i, types.HistoryAttach, fmt.Sprintf("Volume %s attached", volumeID))
+
+			return volumeID, nil
+		})
+	if err != nil {
+		if dsErr := c.setVolumeState(actx, volumeID, types.Available); dsErr != nil {
+			log.Errorf("Error restoring volume state: %v", dsErr)
+		}
+		return types.Operation{}, err
+	}
+	started = true
+
+	return op, nil
+}
+
+// DetachVolumeFromInstance detaches a volume of a tenant from the running
+// instance it is attached to.  The volume is detaching until the node
+// running the instance reports that it has detached it, when the
+// attachment is deleted, and is in use again if the node fails to detach
+// it.  Boot volumes may not be detached.
+func (c *controller) DetachVolumeFromInstance(ctx context.Context, tenantID string, volumeID string, instanceID string) (types.Operation, error) {
+	_, err := c.tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	ch, ok := c.volumeRequests.add(volumeID, instanceID)
+	if !ok {
+		return types.Operation{}, types.ErrVolumeBusy
+	}
+
+	// the request is removed by the operation once it is started
+	started := false
+	defer func() {
+		if !started {
+			c.volumeRequests.remove(volumeID)
+		}
+	}()
+
+	// reread the volume now that no other attach or detach can change it
+	info, err := c.tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	if info.State != types.InUse {
+		return types.Operation{}, types.ErrVolumeNotInUse
+	}
+
+	attachments, err := c.ds.GetVolumeAttachments(volumeID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	var attachment *types.StorageAttachment
+	for idx := range attachments {
+		if attachments[idx].InstanceID == instanceID {
+			attachment = &attachments[idx]
+			break
+		}
+	}
+
+	if attachment == nil {
+		return types.Operation{}, types.ErrVolumeNotInUse
+	}
+
+	if attachment.Boot || attachment.Ephemeral {
+		return types.Operation{}, types.ErrBootVolume
+	}
+
+	i, err := c.runningInstance(tenantID, instanceID)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	log := clogger.With(c.log, "tenant", tenantID, "volume", volumeID, "instance", i.ID)
+
+	err = c.setVolumeState(ctx, volumeID, types.Detaching)
+	if err != nil {
+		return types.Operation{}, err
+	}
+
+	actx := context.WithoutCancel(ctx)
+	attachmentID := attachment.ID
+	op, err := c.startOperation(tenantID, types.DetachVolumeOperation, volumeID,
+		func(ctx context.Context, progress operationProgress) (string, error) {
+			defer c.volumeRequests.remove(volumeID)
+
+			err := c.client.detachVolume(volumeID, i.ID, i.NodeID)
+			if err == nil {
+				err = c.volumeRequests.wait(ctx, ch)
+			}
+
+			if err != nil {
+				if dsErr := c.setVolumeState(actx, volumeID, types.InUse); dsErr != nil {
+					log.Errorf("Error restoring volume state: %v", dsErr)
+				}
+				return "", err
+			}
+
+			err = c.ds.DeleteStorageAttachment(attachmentID)
+			if err != nil {
+				log.Warningf("Error deleting storage attachment: %v", err)
+			}
+
+			err = c.setVolumeState(actx, volumeID, types.Available)
+			if err != nil {
+				return "", err
+			}
+
+			c.recordHistory(actx, i, types.HistoryDetach, fmt.Sprintf("Volume %s detached", volumeID))
+
+			return volumeID, nil
+		})
+	if err != nil {
+		if dsErr := c.setVolumeState(actx, volumeID, types.InUse); dsErr != nil {
+			log.Errorf("Error restoring volume state: %v", dsErr)
+		}
+		return types.Operation{}, err
+	}
+	started = true
+
+	return op, nil
+}
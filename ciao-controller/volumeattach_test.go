@@ -0,0 +1,193 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// volumeActionURL returns the URL of the attach or detach action of a
+// volume.
+func volumeActionURL(tenantID string, volumeID string, action string) string {
+	return testutil.ComputeURL + "/" + tenantID + "/volumes/" + volumeID + "/" + action
+}
+
+// doVolumeAction attaches or detaches a volume through the API and waits
+// for the operation to complete.
+func doVolumeAction(t *testing.T, tenantID string, volumeID string, instanceID string, action string) types.Operation {
+	b, err := json.Marshal(types.VolumeAttachRequest{InstanceID: instanceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", volumeActionURL(tenantID, volumeID, action), http.StatusAccepted, b, true)
+
+	var op types.Operation
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pollOperation(t, testutil.ComputeURL+"/"+tenantID+"/operations/"+op.ID)
+}
+
+func checkVolumeState(t *testing.T, volumeID string, state types.BlockState, attachments int) {
+	info, err := ctl.ds.GetBlockDevice(volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State != state {
+		t.Fatalf("Expected volume %s, got %s", state, info.State)
+	}
+
+	a, err := ctl.ds.GetVolumeAttachments(volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a) != attachments {
+		t.Fatalf("Expected %d attachments, got %d", attachments, len(a))
+	}
+}
+
+func TestAttachDetachVolumeAction(t *testing.T) {
+	client, i, _ := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vol := addTestBlockDevice(t, i.TenantID)
+
+	op := doVolumeAction(t, i.TenantID, vol.ID, i.ID, "attach")
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Attach failed: %s", op.Error)
+	}
+	checkVolumeState(t, vol.ID, types.InUse, 1)
+
+	// the volume is no longer available
+	b, err := json.Marshal(types.VolumeAttachRequest{InstanceID: i.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHTTPRequest(t, "POST", volumeActionURL(i.TenantID, vol.ID, "attach"), http.StatusConflict, b, true)
+
+	op = doVolumeAction(t, i.TenantID, vol.ID, i.ID, "detach")
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Detach failed: %s", op.Error)
+	}
+	checkVolumeState(t, vol.ID, types.Available, 0)
+
+	_ = testHTTPRequest(t, "POST", volumeActionURL(i.TenantID, vol.ID, "detach"), http.StatusConflict, b, true)
+}
+
+func TestAttachVolumeActionFailure(t *testing.T) {
+	client, i, _ := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	client.AttachFail = true
+	client.AttachVolumeFailReason = payloads.AttachVolumeAttachFailure
+	defer func() {
+		client.AttachFail = false
+		client.AttachVolumeFailReason = ""
+	}()
+
+	vol := addTestBlockDevice(t, i.TenantID)
+
+	op := doVolumeAction(t, i.TenantID, vol.ID, i.ID, "attach")
+	if op.State != types.OperationFailed {
+		t.Fatalf("Expected attach to fail, got %s", op.State)
+	}
+	checkVolumeState(t, vol.ID, types.Available, 0)
+}
+
+func TestDetachVolumeActionFailure(t *testing.T) {
+	client, i, _ := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vol := addTestBlockDevice(t, i.TenantID)
+
+	op := doVolumeAction(t, i.TenantID, vol.ID, i.ID, "attach")
+	if op.State != types.OperationSucceeded {
+		t.Fatalf("Attach failed: %s", op.Error)
+	}
+
+	client.DetachFail = true
+	client.DetachVolumeFailReason = payloads.DetachVolumeDetachFailure
+	defer func() {
+		client.DetachFail = false
+		client.DetachVolumeFailReason = ""
+	}()
+
+	op = doVolumeAction(t, i.TenantID, vol.ID, i.ID, "detach")
+	if op.State != types.OperationFailed {
+		t.Fatalf("Expected detach to fail, got %s", op.State)
+	}
+	checkVolumeState(t, vol.ID, types.InUse, 1)
+}
+
+func TestVolumeActionBusy(t *testing.T) {
+	client, i, _ := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vol := addTestBlockDevice(t, i.TenantID)
+
+	// an earlier attach of the volume has not completed
+	if _, ok := ctl.volumeRequests.add(vol.ID, i.ID); !ok {
+		t.Fatal("Unable to add volume request")
+	}
+
+	_, err := ctl.AttachVolumeToInstance(context.Background(), i.TenantID, vol.ID, i.ID)
+	if err != types.ErrVolumeBusy {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeBusy, err)
+	}
+
+	b, err := json.Marshal(types.VolumeAttachRequest{InstanceID: i.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHTTPRequest(t, "POST", volumeActionURL(i.TenantID, vol.ID, "attach"), http.StatusConflict, b, true)
+
+	ctl.volumeRequests.remove(vol.ID)
+	checkVolumeState(t, vol.ID, types.Available, 0)
+}
+
+func TestVolumeActionChecks(t *testing.T) {
+	client, i, _ := startResizeTestInstance(t)
+	defer client.Shutdown()
+
+	vol := addTestBlockDevice(t, i.TenantID)
+
+	_, err := ctl.AttachVolumeToInstance(context.Background(), i.TenantID, vol.ID, "unknown")
+	if err != types.ErrInstanceNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+
+	// the volume was not attached so cannot be detached
+	_, err = ctl.DetachVolumeFromInstance(context.Background(), i.TenantID, vol.ID, i.ID)
+	if err != types.ErrVolumeNotInUse {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeNotInUse, err)
+	}
+
+	if _, ok := ctl.volumeRequests.add(vol.ID, i.ID); !ok {
+		t.Fatal("Failed requests were not removed")
+	}
+	ctl.volumeRequests.remove(vol.ID)
+}
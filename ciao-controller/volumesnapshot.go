@@ -0,0 +1,128 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+// tenantVolume returns a volume of a tenant.
+func (c *controller) tenantVolume(tenantID string, volumeID string) (types.Volume, error) {
+	vol, err := c.adminVolume(volumeID)
+	if err != nil {
+		return vol, err
+	}
+
+	if vol.TenantID != tenantID {
+		return types.Volume{}, types.ErrVolumeNotFound
+	}
+
+	return vol, nil
+}
+
+// CreateVolumeSnapshot takes a snapshot of a tenant's volume.  Volumes
+// attached to instances may be snapshotted but the snapshot is flagged as
+// it is only crash consistent.
+func (c *controller) CreateVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, req types.VolumeSnapshotRequest) (types.VolumeSnapshot, error) {
+	vol, err := c.tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return types.VolumeSnapshot{}, err
+	}
+
+	if vol.State != types.Available && vol.State != types.InUse {
+		return types.VolumeSnapshot{}, api.ErrVolumeNotAvailable
+	}
+
+	snap := types.VolumeSnapshot{
+		ID:         uuid.Generate().String(),
+		VolumeID:   vol.ID,
+		TenantID:   tenantID,
+		Name:       req.Name,
+		Attached:   vol.State == types.InUse,
+		CreateTime: time.Now(),
+	}
+
+	err = c.CreateBlockDeviceSnapshot(ctx, vol.ID, snap.ID)
+	if err != nil {
+		return types.VolumeSnapshot{}, fmt.Errorf("Unable to snapshot volume %s: %v", vol.ID, err)
+	}
+
+	err = c.ds.AddVolumeSnapshot(snap)
+	if err != nil {
+		_ = c.DeleteBlockDeviceSnapshot(context.WithoutCancel(ctx), vol.ID, snap.ID)
+		return types.VolumeSnapshot{}, err
+	}
+
+	msg := fmt.Sprintf("Snapshot %s of volume %s taken", snap.ID, vol.ID)
+	_ = c.ds.LogEvent(tenantID, msg)
+
+	return snap, nil
+}
+
+// tenantVolumeSnapshot returns a snapshot of a tenant's volume.
+func (c *controller) tenantVolumeSnapshot(tenantID string, volumeID string, snapshotID string) (types.VolumeSnapshot, error) {
+	snap, err := c.ds.GetVolumeSnapshot(snapshotID)
+	if err != nil {
+		return snap, err
+	}
+
+	if snap.TenantID != tenantID || (volumeID != "" && snap.VolumeID != volumeID) {
+		return types.VolumeSnapshot{}, types.ErrVolumeSnapshotNotFound
+	}
+
+	return snap, nil
+}
+
+// DeleteVolumeSnapshot deletes a snapshot of a tenant's volume, whether it
+// was taken on request or by a schedule.
+func (c *controller) DeleteVolumeSnapshot(ctx context.Context, tenantID string, volumeID string, snapshotID string) error {
+	if _, err := c.tenantVolume(tenantID, volumeID); err != nil {
+		return err
+	}
+
+	snap, err := c.tenantVolumeSnapshot(tenantID, volumeID, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	err = c.deleteVolumeSnapshot(ctx, snap)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Snapshot %s of volume %s deleted", snap.ID, snap.VolumeID)
+	_ = c.ds.LogEvent(tenantID, msg)
+
+	return nil
+}
+
+// hasRequestedSnapshots returns true if snapshots have been taken of a
+// volume on request.  The snapshots taken by schedules are removed along
+// with the volume.
+func (c *controller) hasRequestedSnapshots(volumeID string) bool {
+	for _, snap := range c.ds.GetVolumeSnapshots(volumeID) {
+		if snap.ScheduleID == "" {
+			return true
+		}
+	}
+
+	return false
+}
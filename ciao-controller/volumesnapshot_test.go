@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+)
+
+func TestVolumeSnapshots(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	vol := createTestVolume(tenant.ID, 1, t)
+
+	_, err = ctl.CreateVolumeSnapshot(ctx, other.ID, vol, types.VolumeSnapshotRequest{})
+	if err != types.ErrVolumeNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeNotFound, err)
+	}
+
+	snap, err := ctl.CreateVolumeSnapshot(ctx, tenant.ID, vol, types.VolumeSnapshotRequest{Name: "before upgrade"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots := checkSnapshots(t, d, vol, 1)
+	if snapshots[0].ID != snap.ID || snapshots[0].Name != "before upgrade" ||
+		snapshots[0].ScheduleID != "" || snapshots[0].Attached {
+		t.Fatalf("Unexpected snapshot recorded: %+v", snapshots[0])
+	}
+
+	// the volume cannot be deleted until its snapshots are
+	err = ctl.DeleteVolume(ctx, tenant.ID, vol, false)
+	if err != types.ErrVolumeHasSnapshots {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeHasSnapshots, err)
+	}
+
+	_, err = ctl.CreateVolume(ctx, other.ID, api.RequestedVolume{SnapshotID: snap.ID})
+	if err != types.ErrVolumeSnapshotNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeSnapshotNotFound, err)
+	}
+
+	restored, err := ctl.CreateVolume(ctx, tenant.ID, api.RequestedVolume{SnapshotID: snap.ID, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.DeleteVolume(ctx, tenant.ID, restored.ID, false) }()
+
+	err = ctl.DeleteVolumeSnapshot(ctx, other.ID, vol, snap.ID)
+	if err != types.ErrVolumeNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeNotFound, err)
+	}
+
+	err = ctl.DeleteVolumeSnapshot(ctx, tenant.ID, restored.ID, snap.ID)
+	if err != types.ErrVolumeSnapshotNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrVolumeSnapshotNotFound, err)
+	}
+
+	err = ctl.DeleteVolumeSnapshot(ctx, tenant.ID, vol, snap.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSnapshots(t, d, vol, 0)
+
+	err = ctl.DeleteVolume(ctx, tenant.ID, vol, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVolumeSnapshotAttached(t *testing.T) {
+	d, restore := useSnapshotDriver()
+	defer restore()
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _ := addStuckVolume(t, tenant.ID, payloads.Running)
+
+	snap, err := ctl.CreateVolumeSnapshot(context.Background(), tenant.ID, vol.ID, types.VolumeSnapshotRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !snap.Attached {
+		t.Fatalf("Snapshot of attached volume not flagged: %+v", snap)
+	}
+
+	checkSnapshots(t, d, vol.ID, 1)
+}
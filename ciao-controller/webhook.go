@@ -0,0 +1,438 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+const (
+	// webhookSignatureHeader contains the hex encoded HMAC-SHA256 of the
+	// request body, keyed with the webhook secret, prefixed with "sha256=".
+	webhookSignatureHeader = "X-Ciao-Signature"
+
+	// webhookEventHeader contains the type of the delivered event.
+	webhookEventHeader = "X-Ciao-Event"
+
+	// webhookDeliveryHeader contains the ID of the delivered event.
+	webhookDeliveryHeader = "X-Ciao-Delivery"
+)
+
+// webhookSignature returns the value of the signature header for body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookWorker struct {
+	hook  types.Webhook
+	queue chan types.Event
+	stop  chan struct{}
+}
+
+// webhookDispatcher delivers events received from the event hub to the
+// webhook subscriptions stored in the datastore.  Each subscription has its
+// own worker and queue so that a slow endpoint cannot delay deliveries to
+// the others.  Events are dropped, and counted, when a queue is full.
+type webhookDispatcher struct {
+	ds     *datastore.Datastore
+	hub    *eventHub
+	events chan types.Event
+	log    clogger.CiaoLog
+	client *http.Client
+
+	maxAttempts int
+	backoff     time.Duration
+	queueSize   int
+
+	lock    sync.Mutex
+	workers map[string]*webhookWorker
+	stats   map[string]*types.WebhookStats
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+}
+
+func newWebhookDispatcher(ds *datastore.Datastore, hub *eventHub, log clogger.CiaoLog) *webhookDispatcher {
+	return &webhookDispatcher{
+		ds:          ds,
+		hub:         hub,
+		log:         log,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 5,
+		backoff:     time.Second,
+		queueSize:   100,
+		workers:     make(map[string]*webhookWorker),
+		stats:       make(map[string]*types.WebhookStats),
+		stop:        make(chan struct{}),
+	}
+}
+
+// start subscribes to the event hub and starts a worker for each active
+// webhook in the datastore.
+func (d *webhookDispatcher) start() {
+	for _, hook := range d.ds.GetWebhooks() {
+		d.add(hook)
+	}
+
+	d.events = d.hub.subscribe(d.queueSize)
+
+	d.wg.Add(1)
+	go d.dispatch()
+}
+
+// shutdown stops the dispatcher and waits for all workers to exit.
+// Events queued but not yet delivered are discarded.
+func (d *webhookDispatcher) shutdown() {
+	d.hub.unsubscribe(d.events)
+	close(d.stop)
+	d.wg.Wait()
+}
+
+func (d *webhookDispatcher) dispatch() {
+	defer d.wg.Done()
+
+	for e := range d.events {
+		d.lock.Lock()
+		for ID, w := range d.workers {
+			if !w.hook.Matches(e) {
+				continue
+			}
+
+			select {
+			case w.queue <- e:
+			default:
+				d.stats[ID].Dropped++
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// add starts delivering events to hook.  Webhooks in the dead letter state
+// are tracked but receive no events.
+func (d *webhookDispatcher) add(hook types.Webhook) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.stats[hook.ID]; !ok {
+		d.stats[hook.ID] = &types.WebhookStats{}
+	}
+
+	if hook.State == types.WebhookDeadLetter {
+		return
+	}
+
+	w := &webhookWorker{
+		hook:  hook,
+		queue: make(chan types.Event, d.queueSize),
+		stop:  make(chan struct{}),
+	}
+	d.workers[hook.ID] = w
+
+	d.wg.Add(1)
+	go d.run(w)
+}
+
+// configure changes the retry policy and request timeout used for
+// subsequent deliveries.
+func (d *webhookDispatcher) configure(maxAttempts int, backoff time.Duration, timeout time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.maxAttempts = maxAttempts
+	d.backoff = backoff
+	d.client = &http.Client{Timeout: timeout}
+}
+
+// remove stops delivering events to the webhook with the given ID.
+func (d *webhookDispatcher) remove(ID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if w, ok := d.workers[ID]; ok {
+		close(w.stop)
+		delete(d.workers, ID)
+	}
+	delete(d.stats, ID)
+}
+
+// getStats returns the delivery metrics for the webhook with the given ID.
+func (d *webhookDispatcher) getStats(ID string) types.WebhookStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if s, ok := d.stats[ID]; ok {
+		return *s
+	}
+
+	return types.WebhookStats{}
+}
+
+func (d *webhookDispatcher) run(w *webhookWorker) {
+	defer d.wg.Done()
+
+	log := clogger.With(d.log, "webhook", w.hook.ID)
+
+	for {
+		select {
+		case e := <-w.queue:
+			if !d.deliver(w, e, log) {
+				d.deadLetter(w, log)
+				return
+			}
+		case <-w.stop:
+			return
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// deliver posts e to the webhook, retrying with exponential backoff.  It
+// returns false if the event could not be delivered after maxAttempts.
+func (d *webhookDispatcher) deliver(w *webhookWorker, e types.Event, log clogger.CiaoLog) bool {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Error marshalling event %s: %v", e.ID, err)
+		return true
+	}
+
+	d.lock.Lock()
+	maxAttempts := d.maxAttempts
+	backoff := d.backoff
+	client := d.client
+	d.lock.Unlock()
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = postWebhook(client, w.hook, e, body)
+		if err == nil {
+			d.lock.Lock()
+			if s, ok := d.stats[w.hook.ID]; ok {
+				s.Delivered++
+				s.LastDelivery = time.Now()
+			}
+			d.lock.Unlock()
+			return true
+		}
+
+		log.Warningf("Delivery of event %s failed (attempt %d of %d): %v",
+			e.ID, attempt, maxAttempts, err)
+
+		d.lock.Lock()
+		if s, ok := d.stats[w.hook.ID]; ok {
+			s.FailedAttempts++
+			s.LastError = err.Error()
+		}
+		d.lock.Unlock()
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+			return true
+		case <-d.stop:
+			return true
+		}
+		backoff *= 2
+	}
+
+	d.lock.Lock()
+	if s, ok := d.stats[w.hook.ID]; ok {
+		s.Failed++
+	}
+	d.lock.Unlock()
+
+	return false
+}
+
+func postWebhook(client *http.Client, hook types.Webhook, e types.Event, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(e.Type))
+	req.Header.Set(webhookDeliveryHeader, e.ID)
+	if hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(hook.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// deadLetter stops deliveries to the webhook of w and records its new
+// state in the datastore.
+func (d *webhookDispatcher) deadLetter(w *webhookWorker, log clogger.CiaoLog) {
+	d.lock.Lock()
+	if d.workers[w.hook.ID] != w {
+		// the webhook has been deleted
+		d.lock.Unlock()
+		return
+	}
+	delete(d.workers, w.hook.ID)
+	d.lock.Unlock()
+
+	log.Warningf("Webhook disabled after repeated delivery failures")
+
+	hook := w.hook
+	hook.State = types.WebhookDeadLetter
+	err := d.ds.UpdateWebhook(hook)
+	if err != nil && err != types.ErrWebhookNotFound {
+		log.Errorf("Error updating webhook state: %v", err)
+	}
+}
+
+func (c *controller) webhookResponse(hook types.Webhook) types.Webhook {
+	if c.webhooks != nil {
+		hook.Stats = c.webhooks.getStats(hook.ID)
+	}
+
+	ref := fmt.Sprintf("%s/webhooks/%s", c.apiURL, hook.ID)
+	hook.Links = []types.Link{
+		{
+			Rel:  "self",
+			Href: ref,
+		},
+	}
+
+	return hook
+}
+
+func validEventType(t types.EventType) bool {
+	switch t {
+	case types.InstanceFailedEvent, types.QuotaExceededEvent, types.ReconciliationEvent,
+		types.NodeStatusEvent, types.QuotaDenialSummaryEvent,
+		types.InstanceConditionRaisedEvent, types.InstanceConditionClearedEvent,
+		types.NodeClockSkewEvent, types.TenantNetworkDegradedEvent,
+		types.TenantNetworkRecoveredEvent, types.InstanceMigratedEvent,
+		types.InstanceMigrationFailedEvent, types.InstanceResizedEvent,
+		types.InstanceResizeFailedEvent:
+		return true
+	}
+
+	return false
+}
+
+// ListWebhooks returns all the webhook subscriptions.
+func (c *controller) ListWebhooks() ([]types.Webhook, error) {
+	hooks := c.ds.GetWebhooks()
+
+	webhooks := make([]types.Webhook, 0, len(hooks))
+	for _, hook := range hooks {
+		webhooks = append(webhooks, c.webhookResponse(hook))
+	}
+
+	return webhooks, nil
+}
+
+// AddWebhook creates a new webhook subscription and starts delivering
+// matching events to it.
+func (c *controller) AddWebhook(req types.NewWebhookRequest) (types.Webhook, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return types.Webhook{}, types.ErrBadRequest
+	}
+
+	for _, t := range req.EventTypes {
+		if !validEventType(t) {
+			return types.Webhook{}, types.ErrBadRequest
+		}
+	}
+
+	if req.TenantID != "" {
+		tenant, err := c.ds.GetTenant(req.TenantID)
+		if err != nil {
+			return types.Webhook{}, err
+		}
+		if tenant == nil {
+			return types.Webhook{}, types.ErrTenantNotFound
+		}
+	}
+
+	hook := types.Webhook{
+		ID:         uuid.Generate().String(),
+		URL:        req.URL,
+		Secret:     req.Secret,
+		EventTypes: req.EventTypes,
+		TenantID:   req.TenantID,
+		State:      types.WebhookActive,
+		CreateTime: time.Now(),
+	}
+
+	err = c.ds.AddWebhook(hook)
+	if err != nil {
+		return types.Webhook{}, err
+	}
+
+	if c.webhooks != nil {
+		c.webhooks.add(hook)
+	}
+
+	return c.webhookResponse(hook), nil
+}
+
+// ShowWebhook returns the webhook subscription with the given ID.
+func (c *controller) ShowWebhook(ID string) (types.Webhook, error) {
+	hook, err := c.ds.GetWebhook(ID)
+	if err != nil {
+		return types.Webhook{}, err
+	}
+
+	return c.webhookResponse(hook), nil
+}
+
+// DeleteWebhook removes a webhook subscription.
+func (c *controller) DeleteWebhook(ID string) error {
+	err := c.ds.DeleteWebhook(ID)
+	if err != nil {
+		return err
+	}
+
+	if c.webhooks != nil {
+		c.webhooks.remove(ID)
+	}
+
+	return nil
+}
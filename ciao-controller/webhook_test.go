@@ -0,0 +1,197 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func newTestWebhookDispatcher(t *testing.T, URL string, secret string) (*webhookDispatcher, types.Webhook) {
+	hook := types.Webhook{
+		ID:         uuid.Generate().String(),
+		URL:        URL,
+		Secret:     secret,
+		EventTypes: []types.EventType{types.InstanceFailedEvent},
+		State:      types.WebhookActive,
+		CreateTime: time.Now(),
+	}
+
+	err := ctl.ds.AddWebhook(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newWebhookDispatcher(ctl.ds, newEventHub(), ctl.log)
+	d.backoff = 10 * time.Millisecond
+	d.maxAttempts = 3
+	d.start()
+
+	return d, hook
+}
+
+func TestWebhookSignatureAndRetry(t *testing.T) {
+	secret := "s3cr3t"
+
+	var lock sync.Mutex
+	attempts := 0
+	delivered := make(chan types.Event, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		sig := r.Header.Get(webhookSignatureHeader)
+		if !hmac.Equal([]byte(sig), []byte(webhookSignature(secret, body))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		attempts++
+		first := attempts == 1
+		lock.Unlock()
+
+		if first {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var e types.Event
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		delivered <- e
+	}))
+	defer ts.Close()
+
+	d, hook := newTestWebhookDispatcher(t, ts.URL, secret)
+	defer func() {
+		d.shutdown()
+		_ = ctl.ds.DeleteWebhook(hook.ID)
+	}()
+
+	// this event does not match the subscription and must not be delivered
+	d.hub.publish(types.Event{ID: uuid.Generate().String(), Type: types.QuotaExceededEvent})
+
+	e := types.Event{
+		ID:      uuid.Generate().String(),
+		Type:    types.InstanceFailedEvent,
+		Message: "Instance failed to start",
+	}
+	d.hub.publish(e)
+
+	select {
+	case got := <-delivered:
+		if got.ID != e.ID {
+			t.Fatalf("Expected event %s, got %s", e.ID, got.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook delivery")
+	}
+
+	// Delivered is updated after the response has been received
+	deadline := time.Now().Add(5 * time.Second)
+	for d.getStats(hook.ID).Delivered != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := d.getStats(hook.ID)
+	if stats.Delivered != 1 || stats.FailedAttempts != 1 || stats.Failed != 0 {
+		t.Fatalf("Unexpected delivery stats: %+v", stats)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 2 {
+		t.Fatalf("Expected 2 delivery attempts, got %d", attempts)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	d, hook := newTestWebhookDispatcher(t, ts.URL, "")
+	defer func() {
+		d.shutdown()
+		_ = ctl.ds.DeleteWebhook(hook.ID)
+	}()
+
+	d.hub.publish(types.Event{ID: uuid.Generate().String(), Type: types.InstanceFailedEvent})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		h, err := ctl.ds.GetWebhook(hook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.State == types.WebhookDeadLetter {
+			stats := d.getStats(hook.ID)
+			if stats.Failed != 1 || stats.FailedAttempts != uint64(d.maxAttempts) {
+				t.Fatalf("Unexpected delivery stats: %+v", stats)
+			}
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Webhook was not moved to the dead letter state")
+}
+
+func TestAddWebhookSecretWriteOnly(t *testing.T) {
+	hook, err := ctl.AddWebhook(types.NewWebhookRequest{
+		URL:    "https://example.com/hook",
+		Secret: "s3cr3t",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.DeleteWebhook(hook.ID) }()
+
+	b, err := json.Marshal(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "s3cr3t") {
+		t.Fatalf("Webhook secret returned: %s", string(b))
+	}
+
+	_, err = ctl.AddWebhook(types.NewWebhookRequest{URL: "ftp://example.com"})
+	if err != types.ErrBadRequest {
+		t.Fatalf("Expected ErrBadRequest, got %v", err)
+	}
+}
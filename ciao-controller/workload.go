@@ -15,7 +15,7 @@
 package main
 
 import (
-	"github.com/golang/glog"
+	"net"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
@@ -23,11 +23,6 @@ import (
 )
 
 func validateVMWorkload(req *types.Workload) error {
-	// FWType must be either EFI or legacy.
-	if req.FWType != string(payloads.EFI) && req.FWType != payloads.Legacy {
-		return types.ErrBadRequest
-	}
-
 	// Must have storage for VMs
 	if len(req.Storage) == 0 {
 		return types.ErrBadRequest
@@ -36,16 +31,6 @@ func validateVMWorkload(req *types.Workload) error {
 	return nil
 }
 
-func validateContainerWorkload(req *types.Workload) error {
-	// we should reject anything with ImageID set, but
-	// we'll just ignore it.
-	if req.ImageName == "" {
-		return types.ErrBadRequest
-	}
-
-	return nil
-}
-
 func (c *controller) validateWorkloadStorageSourceID(storage *types.StorageResource, tenantID string) error {
 	if storage.Source == "" {
 		// you may only use no source id with empty type
@@ -99,6 +84,14 @@ func (c *controller) validateWorkloadStorage(req *types.Workload) error {
 			}
 		}
 
+		// the launcher can only create new, sized, ephemeral disks
+		if req.Storage[i].Local {
+			s := req.Storage[i]
+			if !s.Ephemeral || s.SourceType != types.Empty || s.ID != "" || s.Size <= 0 {
+				return types.ErrBadRequest
+			}
+		}
+
 		err := c.validateWorkloadStorageSourceID(&req.Storage[i], req.TenantID)
 		if err != nil {
 			return err
@@ -114,17 +107,231 @@ func (c *controller) validateWorkloadStorage(req *types.Workload) error {
 		return types.ErrBadRequest
 	}
 
+	return validateBootOrder(req.Storage)
+}
+
+// validateBootOrder checks the boot indexes of a workload's storage.
+// Workloads which index none of their storage boot from their only
+// bootable resource.  Otherwise every bootable resource must be indexed,
+// no two resources may share an index and exactly one bootable resource
+// is booted first.
+func validateBootOrder(storage []types.StorageResource) error {
+	bootable := 0
+	indexes := make(map[int]bool)
+	for _, s := range storage {
+		if s.Bootable {
+			bootable++
+		}
+
+		if s.BootIndex == nil {
+			continue
+		}
+
+		index := *s.BootIndex
+		if index < 0 || indexes[index] {
+			return types.ErrBadRequest
+		}
+
+		if index == 0 && !s.Bootable {
+			return types.ErrBadRequest
+		}
+
+		indexes[index] = true
+	}
+
+	if len(indexes) == 0 {
+		if bootable > 1 {
+			return types.ErrBadRequest
+		}
+		return nil
+	}
+
+	if !indexes[0] {
+		return types.ErrBadRequest
+	}
+
+	for _, s := range storage {
+		if s.Bootable && s.BootIndex == nil {
+			return types.ErrBadRequest
+		}
+	}
+
+	return nil
+}
+
+// maxWorkloadNetworks is the number of additional network interfaces an
+// instance may be given on top of its primary one.
+const maxWorkloadNetworks = 7
+
+// validateWorkloadNetworks checks the additional network interfaces of a
+// workload.  Only VMs may have them and each must either name a subnet of
+// the tenant network, in CIDR notation, or leave the choice of subnet to the
+// controller.
+func validateWorkloadNetworks(req *types.Workload) error {
+	if req.VMType != payloads.QEMU || req.Requirements.NetworkNode {
+		return types.ErrBadRequest
+	}
+
+	if len(req.Networks) > maxWorkloadNetworks {
+		return types.ErrBadRequest
+	}
+
+	_, tenantNet, _ := net.ParseCIDR("172.16.0.0/12")
+	for _, n := range req.Networks {
+		if n.Subnet == "" {
+			continue
+		}
+
+		IP, ipNet, err := net.ParseCIDR(n.Subnet)
+		if err != nil || !IP.Equal(ipNet.IP) || !tenantNet.Contains(IP) {
+			return types.ErrBadRequest
+		}
+	}
+
 	return nil
 }
 
+// validBound reports whether a min/max pair is consistent and, when the
+// resource may be overridden, whether the workload's default lies within it.
+func validBound(min, max, def int) bool {
+	if min < 0 || max < 0 {
+		return false
+	}
+
+	if max == 0 {
+		return min == 0
+	}
+
+	if min == 0 {
+		min = 1
+	}
+
+	return min <= max && (def == 0 || (def >= min && def <= max))
+}
+
+func hasEphemeralStorage(wl *types.Workload) bool {
+	for _, s := range wl.Storage {
+		if s.Ephemeral {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWorkloadBounds(req *types.Workload) error {
+	b := req.Bounds
+
+	if !validBound(b.MinVCPUs, b.MaxVCPUs, req.Requirements.VCPUs) ||
+		!validBound(b.MinMemMB, b.MaxMemMB, req.Requirements.MemMB) ||
+		!validBound(b.MinDiskGB, b.MaxDiskGB, 0) {
+		return types.ErrBadRequest
+	}
+
+	// a disk override resizes the ephemeral storage so there must be some
+	if b.MaxDiskGB > 0 && !hasEphemeralStorage(req) {
+		return types.ErrBadRequest
+	}
+
+	return nil
+}
+
+func checkOverride(resource string, value int, minName string, min int, maxName string, max int) error {
+	if max == 0 {
+		return &types.RequirementsBoundError{Resource: resource, Bound: maxName, Value: value}
+	}
+
+	if min == 0 {
+		min = 1
+	}
+
+	if value < min {
+		return &types.RequirementsBoundError{Resource: resource, Bound: minName, Limit: min, Value: value}
+	}
+
+	if value > max {
+		return &types.RequirementsBoundError{Resource: resource, Bound: maxName, Limit: max, Value: value}
+	}
+
+	return nil
+}
+
+// applyOverrides returns a copy of the workload with its requirements, and the
+// size of its ephemeral storage, replaced by the launch time overrides. Each
+// override must lie within the bounds set by the workload.
+func applyOverrides(wl types.Workload, o types.RequirementOverrides) (types.Workload, error) {
+	if o == (types.RequirementOverrides{}) {
+		return wl, nil
+	}
+
+	var b types.WorkloadBounds
+	if wl.Bounds != nil {
+		b = *wl.Bounds
+	}
+
+	if o.VCPUs != 0 {
+		err := checkOverride("vcpus", o.VCPUs, "min_vcpus", b.MinVCPUs, "max_vcpus", b.MaxVCPUs)
+		if err != nil {
+			return wl, err
+		}
+	}
+
+	if o.MemMB != 0 {
+		err := checkOverride("mem_mb", o.MemMB, "min_mem_mb", b.MinMemMB, "max_mem_mb", b.MaxMemMB)
+		if err != nil {
+			return wl, err
+		}
+	}
+
+	if o.DiskGB != 0 {
+		err := checkOverride("disk_gb", o.DiskGB, "min_disk_gb", b.MinDiskGB, "max_disk_gb", b.MaxDiskGB)
+		if err != nil {
+			return wl, err
+		}
+	}
+
+	return overrideRequirements(wl, o), nil
+}
+
+// overrideRequirements returns a copy of the workload with its requirements,
+// and the size of its ephemeral storage, replaced by the non-zero overrides.
+func overrideRequirements(wl types.Workload, o types.RequirementOverrides) types.Workload {
+	if o.VCPUs != 0 {
+		wl.Requirements.VCPUs = o.VCPUs
+	}
+
+	if o.MemMB != 0 {
+		wl.Requirements.MemMB = o.MemMB
+	}
+
+	if o.DiskGB != 0 {
+		// the storage slice is shared with the datastore's copy
+		storage := make([]types.StorageResource, len(wl.Storage))
+		copy(storage, wl.Storage)
+		for i := range storage {
+			if storage[i].Ephemeral {
+				storage[i].Size = o.DiskGB
+			}
+		}
+		wl.Storage = storage
+	}
+
+	return wl
+}
+
 // this is probably an insufficient amount of checking.
 func (c *controller) validateWorkloadRequest(req *types.Workload) error {
 	// ID must be blank.
 	if req.ID != "" {
-		glog.V(2).Info("Invalid workload request: ID is not blank")
+		if c.log.V(2) {
+			c.log.Infof("Invalid workload request: ID is not blank")
+		}
 		return types.ErrBadRequest
 	}
 
+	if len(req.Description) > types.MaxDescriptionLength {
+		return types.ErrDescriptionTooLong
+	}
+
 	// we don't validate the TenantID right now - it is passed
 	// in via the ciao api, and it has passed the regex input
 	// validation already. there's also a conflict with ssntp's uuid.Parse()
@@ -132,29 +339,57 @@ func (c *controller) validateWorkloadRequest(req *types.Workload) error {
 	// separator, and keystone doesn't use the '-' separator for
 	// uuids.
 
+	err := req.Validate()
+	if err != nil {
+		if c.log.V(2) {
+			c.log.Infof("Invalid workload request: %v", err)
+		}
+		return err
+	}
+
 	if req.VMType == payloads.QEMU {
 		err := validateVMWorkload(req)
 		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid VM workload")
-			return err
-		}
-	} else {
-		err := validateContainerWorkload(req)
-		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid container workload")
+			if c.log.V(2) {
+				c.log.Infof("Invalid workload request: invalid VM workload")
+			}
 			return err
 		}
 	}
 
 	if req.Config == "" {
-		glog.V(2).Info("Invalid workload request: config is blank")
+		if c.log.V(2) {
+			c.log.Infof("Invalid workload request: config is blank")
+		}
 		return types.ErrBadRequest
 	}
 
+	if req.Bounds != nil {
+		err := validateWorkloadBounds(req)
+		if err != nil {
+			if c.log.V(2) {
+				c.log.Infof("Invalid workload request: invalid bounds")
+			}
+			return err
+		}
+	}
+
 	if len(req.Storage) > 0 {
 		err := c.validateWorkloadStorage(req)
 		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid storage")
+			if c.log.V(2) {
+				c.log.Infof("Invalid workload request: invalid storage")
+			}
+			return err
+		}
+	}
+
+	if len(req.Networks) > 0 {
+		err := validateWorkloadNetworks(req)
+		if err != nil {
+			if c.log.V(2) {
+				c.log.Infof("Invalid workload request: invalid networks")
+			}
 			return err
 		}
 	}
@@ -173,21 +408,76 @@ func (c *controller) CreateWorkload(req types.Workload) (types.Workload, error)
 
 	req.ID = uuid.Generate().String()
 
+	err = c.evaluatePolicy(&req, req.TenantID, policyIngest)
+	if err != nil {
+		return req, err
+	}
+
 	err = c.ds.AddWorkload(req)
 	return req, err
 }
 
-func (c *controller) DeleteWorkload(tenantID string, workloadID string) error {
+// modifiableWorkload returns the workload if tenantID may change it. The admin
+// may change any workload but the generated CNCI one, and tenants may only
+// change their own private ones.
+func (c *controller) modifiableWorkload(tenantID string, workloadID string) (types.Workload, error) {
 	wl, err := c.ds.GetWorkload(workloadID)
 	if err != nil {
-		return err
+		return wl, err
+	}
+
+	if cnciID, err := c.ds.GetCNCIWorkloadID(); err == nil && cnciID == workloadID {
+		return wl, types.ErrCNCIWorkload
 	}
 
-	if tenantID == "admin" || tenantID == wl.TenantID {
-		return c.ds.DeleteWorkload(workloadID)
+	if tenantID == "admin" {
+		return wl, nil
 	}
 
-	return types.ErrWorkloadNotFound
+	if wl.Visibility == types.Public {
+		return wl, types.ErrPublicWorkload
+	}
+
+	if wl.TenantID != tenantID {
+		return wl, types.ErrWorkloadNotFound
+	}
+
+	return wl, nil
+}
+
+func (c *controller) UpdateWorkload(tenantID string, workloadID string, req types.Workload) (types.Workload, error) {
+	wl, err := c.modifiableWorkload(tenantID, workloadID)
+	if err != nil {
+		return req, err
+	}
+
+	req.ID = ""
+	req.TenantID = wl.TenantID
+	req.Visibility = wl.Visibility
+
+	err = c.validateWorkloadRequest(&req)
+	if err != nil {
+		return req, err
+	}
+
+	req.ID = wl.ID
+
+	err = c.evaluatePolicy(&req, req.TenantID, policyIngest)
+	if err != nil {
+		return req, err
+	}
+
+	err = c.ds.UpdateWorkload(req)
+	return req, err
+}
+
+func (c *controller) DeleteWorkload(tenantID string, workloadID string) error {
+	_, err := c.modifiableWorkload(tenantID, workloadID)
+	if err != nil {
+		return err
+	}
+
+	return c.ds.DeleteWorkload(workloadID)
 }
 
 func (c *controller) ShowWorkload(tenantID string, workloadID string) (types.Workload, error) {
@@ -203,6 +493,12 @@ func (c *controller) ShowWorkload(tenantID string, workloadID string) (types.Wor
 	return types.Workload{}, types.ErrWorkloadNotFound
 }
 
-func (c *controller) ListWorkloads(tenantID string) ([]types.Workload, error) {
+// ListWorkloads returns the workloads available to a tenant, or only those
+// whose description contains search if it is not empty.
+func (c *controller) ListWorkloads(tenantID string, search string) ([]types.Workload, error) {
+	if search != "" {
+		return c.ds.SearchWorkloads(tenantID, search)
+	}
+
 	return c.ds.GetWorkloads(tenantID)
 }
@@ -0,0 +1,479 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
+)
+
+func catalogWorkload(t *testing.T, description string) []byte {
+	b, err := json.Marshal(types.Workload{
+		Description: description,
+		VMType:      payloads.Docker,
+		ImageName:   "ubuntu:latest",
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 1,
+			MemMB: 128,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func createCatalogWorkload(t *testing.T, url string, description string) types.Workload {
+	body := testHTTPRequest(t, "POST", url, http.StatusCreated, catalogWorkload(t, description), true)
+
+	var resp types.WorkloadResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Workload
+}
+
+func listWorkloadIDs(t *testing.T, url string) map[string]bool {
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil, true)
+
+	var wls []types.Workload
+	err := json.Unmarshal(body, &wls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for _, wl := range wls {
+		ids[wl.ID] = true
+	}
+	return ids
+}
+
+func TestWorkloadCatalog(t *testing.T) {
+	tenantA, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantB, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminURL := testutil.ComputeURL + "/workloads"
+	urlA := testutil.ComputeURL + "/" + tenantA.ID + "/workloads"
+	urlB := testutil.ComputeURL + "/" + tenantB.ID + "/workloads"
+
+	public := createCatalogWorkload(t, adminURL, "public")
+	if public.Visibility != types.Public {
+		t.Fatalf("Admin workload not public: %+v", public)
+	}
+
+	private := createCatalogWorkload(t, urlA, "private")
+	if private.Visibility != types.Private || private.TenantID != tenantA.ID {
+		t.Fatalf("Tenant workload not private to the tenant: %+v", private)
+	}
+
+	// listings merge the public catalog with the caller's own workloads
+	ids := listWorkloadIDs(t, urlA)
+	if !ids[public.ID] || !ids[private.ID] {
+		t.Errorf("Tenant A listing missing workloads: %v", ids)
+	}
+
+	ids = listWorkloadIDs(t, urlB)
+	if !ids[public.ID] || ids[private.ID] {
+		t.Errorf("Tenant B listing wrong: %v", ids)
+	}
+
+	_ = testHTTPRequest(t, "GET", urlB+"/"+private.ID, http.StatusNotFound, nil, true)
+
+	cnciID, err := ctl.ds.GetCNCIWorkloadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		status int
+	}{
+		{"other tenant update", "PUT", urlB + "/" + private.ID, http.StatusNotFound},
+		{"other tenant delete", "DELETE", urlB + "/" + private.ID, http.StatusNotFound},
+		{"tenant update public", "PUT", urlA + "/" + public.ID, http.StatusForbidden},
+		{"tenant delete public", "DELETE", urlA + "/" + public.ID, http.StatusForbidden},
+		{"owner update", "PUT", urlA + "/" + private.ID, http.StatusOK},
+		{"admin update public", "PUT", adminURL + "/" + public.ID, http.StatusOK},
+		{"admin update CNCI", "PUT", adminURL + "/" + cnciID, http.StatusForbidden},
+		{"admin delete CNCI", "DELETE", adminURL + "/" + cnciID, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		var body []byte
+		if tt.method == "PUT" {
+			body = catalogWorkload(t, "updated")
+		}
+		_ = testHTTPRequest(t, tt.method, tt.url, tt.status, body, true)
+	}
+
+	for _, id := range []string{public.ID, private.ID} {
+		wl, err := ctl.ds.GetWorkload(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wl.Description != "updated" {
+			t.Errorf("Workload %s not updated: %+v", id, wl)
+		}
+	}
+
+	wl, err := ctl.ds.GetWorkload(private.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wl.Visibility != types.Private || wl.TenantID != tenantA.ID {
+		t.Errorf("Update changed workload ownership: %+v", wl)
+	}
+
+	// tenants cannot launch workloads they cannot see
+	var server api.CreateServerRequest
+	server.Server.MaxInstances = 1
+	server.Server.WorkloadID = private.ID
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHTTPRequest(t, "POST", testutil.ComputeURL+"/"+tenantB.ID+"/instances", http.StatusNotFound, b, true)
+
+	// only the admin may use the privileged catalog routes
+	ca := createTestCA(t, "workload catalog CA")
+	registerTestTenantCA(t, tenantA.ID, ca, http.StatusCreated)
+	userA := certClient(ca.clientCert(t, "user-a", []string{tenantA.ID}))
+
+	if status := certRequest(t, userA, "DELETE", adminURL+"/"+public.ID, nil); status != http.StatusForbidden {
+		t.Errorf("Tenant user deleted public workload: %d", status)
+	}
+
+	_ = testHTTPRequest(t, "DELETE", urlA+"/"+private.ID, http.StatusNoContent, nil, true)
+	_ = testHTTPRequest(t, "DELETE", adminURL+"/"+public.ID, http.StatusNoContent, nil, true)
+}
+
+func TestValidateBootOrder(t *testing.T) {
+	index := func(i int) *int { return &i }
+
+	tests := []struct {
+		name    string
+		storage []types.StorageResource
+		valid   bool
+	}{
+		{"legacy", []types.StorageResource{
+			{},
+			{Bootable: true},
+		}, true},
+		{"unindexed bootable devices", []types.StorageResource{
+			{Bootable: true},
+			{Bootable: true},
+		}, false},
+		{"ordered", []types.StorageResource{
+			{Bootable: true, BootIndex: index(1)},
+			{Bootable: true, BootIndex: index(0)},
+			{},
+		}, true},
+		{"indexed data disk", []types.StorageResource{
+			{Bootable: true, BootIndex: index(0)},
+			{BootIndex: index(1)},
+		}, true},
+		{"no first device", []types.StorageResource{
+			{Bootable: true, BootIndex: index(1)},
+		}, false},
+		{"two first devices", []types.StorageResource{
+			{Bootable: true, BootIndex: index(0)},
+			{Bootable: true, BootIndex: index(0)},
+		}, false},
+		{"first device not bootable", []types.StorageResource{
+			{BootIndex: index(0)},
+			{Bootable: true, BootIndex: index(1)},
+		}, false},
+		{"negative index", []types.StorageResource{
+			{Bootable: true, BootIndex: index(0)},
+			{Bootable: true, BootIndex: index(-1)},
+		}, false},
+		{"unindexed bootable device", []types.StorageResource{
+			{Bootable: true, BootIndex: index(0)},
+			{Bootable: true},
+		}, false},
+	}
+
+	for _, test := range tests {
+		err := validateBootOrder(test.storage)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.valid && err != types.ErrBadRequest {
+			t.Errorf("%s: expected %v got %v", test.name, types.ErrBadRequest, err)
+		}
+	}
+}
+
+func TestBootOrder(t *testing.T) {
+	index := func(i int) *int { return &i }
+
+	tests := []struct {
+		name    string
+		storage []types.StorageResource
+		order   []int
+	}{
+		{"bootable first", []types.StorageResource{
+			{Size: 1},
+			{Size: 2},
+			{Bootable: true},
+		}, []int{2, 0, 1}},
+		{"indexed", []types.StorageResource{
+			{Size: 1},
+			{Bootable: true, BootIndex: index(1)},
+			{Bootable: true, BootIndex: index(0)},
+		}, []int{2, 1, 0}},
+		{"no storage", nil, []int{}},
+	}
+
+	for _, test := range tests {
+		order := bootOrder(test.storage)
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%s: expected %v got %v", test.name, test.order, order)
+		}
+	}
+}
+
+func TestValidateWorkloadNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		vmType   payloads.Hypervisor
+		cnci     bool
+		networks []types.NetworkRequirement
+		valid    bool
+	}{
+		{"any subnet", payloads.QEMU, false, []types.NetworkRequirement{{}}, true},
+		{"tenant subnets", payloads.QEMU, false, []types.NetworkRequirement{
+			{Subnet: "172.16.1.0/24"},
+			{Subnet: "172.16.2.0/24"},
+		}, true},
+		{"container", payloads.Docker, false, []types.NetworkRequirement{{}}, false},
+		{"network node", payloads.QEMU, true, []types.NetworkRequirement{{}}, false},
+		{"too many", payloads.QEMU, false, make([]types.NetworkRequirement, maxWorkloadNetworks+1), false},
+		{"not a cidr", payloads.QEMU, false, []types.NetworkRequirement{{Subnet: "172.16.1.0"}}, false},
+		{"host address", payloads.QEMU, false, []types.NetworkRequirement{{Subnet: "172.16.1.2/24"}}, false},
+		{"outside tenant network", payloads.QEMU, false, []types.NetworkRequirement{{Subnet: "10.0.0.0/24"}}, false},
+	}
+
+	for _, test := range tests {
+		wl := types.Workload{
+			VMType:   test.vmType,
+			Networks: test.networks,
+		}
+		wl.Requirements.NetworkNode = test.cnci
+
+		err := validateWorkloadNetworks(&wl)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.valid && err != types.ErrBadRequest {
+			t.Errorf("%s: expected %v got %v", test.name, types.ErrBadRequest, err)
+		}
+	}
+}
+
+func TestWorkloadValidate(t *testing.T) {
+	vm := types.Workload{
+		FWType: string(payloads.EFI),
+		VMType: payloads.QEMU,
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Storage: []types.StorageResource{
+			{Bootable: true, SourceType: types.ImageService, Source: "ubuntu"},
+			{ID: uuid.Generate().String(), SourceType: types.Empty},
+			{Size: 10, SourceType: types.Empty},
+		},
+	}
+
+	container := types.Workload{
+		VMType:    payloads.Docker,
+		ImageName: "ubuntu:latest",
+		Requirements: payloads.WorkloadRequirements{
+			MemMB: 128,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		modify     func(wl *types.Workload)
+		violations int
+	}{
+		{"vm", func(wl *types.Workload) {}, 0},
+		{"no memory", func(wl *types.Workload) { wl.Requirements.MemMB = 0 }, 1},
+		{"negative vcpus", func(wl *types.Workload) { wl.Requirements.VCPUs = -1 }, 1},
+		{"bad firmware", func(wl *types.Workload) { wl.FWType = "uefi" }, 1},
+		{"bad hypervisor", func(wl *types.Workload) { wl.VMType = "xen" }, 1},
+		{"id and source", func(wl *types.Workload) { wl.Storage[1].Source = "ubuntu" }, 1},
+		{"no source", func(wl *types.Workload) { wl.Storage[2].SourceType = types.ImageService }, 1},
+		{"everything", func(wl *types.Workload) {
+			wl.Requirements.MemMB = -1
+			wl.Requirements.VCPUs = -1
+			wl.FWType = ""
+			wl.Storage[2].SourceType = types.VolumeService
+		}, 4},
+	}
+
+	for _, test := range tests {
+		wl := vm
+		wl.Storage = append([]types.StorageResource(nil), vm.Storage...)
+		test.modify(&wl)
+
+		err := wl.Validate()
+		if test.violations == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+
+		e, ok := err.(*types.WorkloadValidationError)
+		if !ok || len(e.Violations) != test.violations {
+			t.Errorf("%s: expected %d violations, got %v", test.name, test.violations, err)
+		}
+	}
+
+	if err := container.Validate(); err != nil {
+		t.Errorf("container: unexpected error %v", err)
+	}
+
+	container.ImageName = ""
+	container.FWType = "bios"
+	err := container.Validate()
+	if e, ok := err.(*types.WorkloadValidationError); !ok || len(e.Violations) != 2 {
+		t.Errorf("container: expected 2 violations, got %v", err)
+	}
+}
+
+func TestCreateInvalidWorkload(t *testing.T) {
+	var wl types.Workload
+	err := json.Unmarshal(catalogWorkload(t, "invalid"), &wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl.Requirements.MemMB = 0
+	wl.Requirements.VCPUs = -2
+	wl.ImageName = ""
+	b, err := json.Marshal(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", testutil.ComputeURL+"/workloads", http.StatusBadRequest, b, true)
+
+	var resp api.HTTPReturnErrorCode
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every violation is reported, not just the first
+	if len(resp.Error.Violations) != 3 {
+		t.Fatalf("Expected 3 violations, got %+v", resp.Error)
+	}
+}
+
+func TestWorkloadBootOrder(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := addTestImage(tenant.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := 0
+	second := 1
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "boot order workload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "---\n...\n",
+		Requirements: payloads.WorkloadRequirements{
+			VCPUs: 2,
+			MemMB: 512,
+		},
+		Storage: []types.StorageResource{
+			{Bootable: true, BootIndex: &second, SourceType: types.ImageService, Source: image.ID},
+			{Size: 1, SourceType: types.Empty},
+			{Bootable: true, BootIndex: &first, SourceType: types.ImageService, Source: image.ID},
+		},
+	}
+
+	bad := req
+	bad.Storage = []types.StorageResource{req.Storage[0], req.Storage[1]}
+	_, err = ctl.CreateWorkload(bad)
+	if err != types.ErrBadRequest {
+		t.Fatalf("Expected %v got %v", types.ErrBadRequest, err)
+	}
+
+	wl, err := ctl.CreateWorkload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err = ctl.ds.GetWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := newConfig(context.Background(), ctl, &wl, uuid.Generate().String(), tenant.ID, "", net.ParseIP("172.16.0.2"), placement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := config.sc.Start.Storage
+	if len(storage) != len(req.Storage) {
+		t.Fatalf("Expected %d storage resources got %d", len(req.Storage), len(storage))
+	}
+
+	// the storage is given to the launcher in boot order
+	sorted := []types.StorageResource{req.Storage[2], req.Storage[0], req.Storage[1]}
+	for i, s := range sorted {
+		if storage[i].Bootable != s.Bootable {
+			t.Errorf("Storage resource %d out of order: %+v", i, storage[i])
+		}
+
+		if (s.BootIndex == nil) != (storage[i].BootIndex == nil) ||
+			(s.BootIndex != nil && *s.BootIndex != *storage[i].BootIndex) {
+			t.Errorf("Boot index of storage resource %d not preserved: %+v", i, storage[i])
+		}
+	}
+}
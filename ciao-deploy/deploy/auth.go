@@ -32,6 +32,21 @@ import (
 	"github.com/pkg/errors"
 )
 
+// certRoles returns the roles granted to the members of tenants, which the
+// controller reads from the organizational units of their certificates.
+func certRoles(tenants []string) []string {
+	if len(tenants) == 1 && tenants[0] == "admin" {
+		return []string{"admin"}
+	}
+
+	roles := make([]string, 0, len(tenants))
+	for _, t := range tenants {
+		roles = append(roles, "tenant:"+t)
+	}
+
+	return roles
+}
+
 func createCertTemplate(username string, tenants []string) (*x509.Certificate, error) {
 	notBefore := time.Now()
 	notAfter := notBefore.Add(365 * 24 * time.Hour)
@@ -48,6 +63,7 @@ func createCertTemplate(username string, tenants []string) (*x509.Certificate, e
 	}
 	if len(tenants) > 0 {
 		subject.Organization = tenants
+		subject.OrganizationalUnit = certRoles(tenants)
 	}
 
 	template := x509.Certificate{
@@ -23,7 +23,7 @@ import (
 )
 
 func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan interface{}, cfg *vmConfig,
-	instance, instanceDir, volumeUUID string, conn serverConn) *attachVolumeError {
+	instance, instanceDir, volumeUUID, tag string, conn serverConn) *attachVolumeError {
 
 	if cfg.Container {
 		attachErr := &attachVolumeError{nil, payloads.AttachVolumeNotSupported}
@@ -38,6 +38,14 @@ func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan inter
 		return attachErr
 	}
 
+	vol := volumeConfig{UUID: volumeUUID, Tag: tag, Hotplugged: monitorCh != nil}
+	if cfg.findVolumeSerial(vol.serial()) != nil {
+		attachErr := &attachVolumeError{nil, payloads.AttachVolumeTagInUse}
+		glog.Errorf("Serial %s of volume %s already in use by instance %s [%s]",
+			vol.serial(), volumeUUID, instance, string(attachErr.code))
+		return attachErr
+	}
+
 	if monitorCh != nil {
 		volumeMap, err := storageDriver.GetVolumeMapping()
 		if err != nil {
@@ -84,7 +92,7 @@ func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan inter
 		}
 	}
 
-	cfg.Volumes = append(cfg.Volumes, volumeConfig{UUID: volumeUUID})
+	cfg.Volumes = append(cfg.Volumes, vol)
 
 	err := cfg.save(instanceDir)
 	if err != nil {
@@ -0,0 +1,146 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxConsoleLogRead bounds the amount of the console log of an instance
+// read to find its last lines.
+const maxConsoleLogRead = 1024 * 1024
+
+// parseConsoleLogPayload returns the instance whose console log is requested,
+// the ID of the request and the number of lines to return.  The instance and
+// request ID are returned along with any error about the length so that the
+// failure can be reported for them.
+func parseConsoleLogPayload(data []byte) (string, string, int, error) {
+	var clouddata payloads.ConsoleLog
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	instance := strings.TrimSpace(clouddata.ConsoleLog.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		return "", "", 0, fmt.Errorf("Invalid instance id received: %s", instance)
+	}
+
+	requestID := clouddata.ConsoleLog.RequestID
+
+	length := clouddata.ConsoleLog.Length
+	if length <= 0 {
+		return instance, requestID, 0, fmt.Errorf("Invalid length received: %d", length)
+	}
+
+	return instance, requestID, length, nil
+}
+
+// readConsoleLog returns the last length lines of the console log at
+// logPath.  Only the end of large logs is read.
+func readConsoleLog(logPath string, length int) ([]string, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open console log: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to stat console log: %v", err)
+	}
+
+	truncated := false
+	if fi.Size() > maxConsoleLogRead {
+		_, err = f.Seek(-maxConsoleLogRead, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to seek console log: %v", err)
+		}
+		truncated = true
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read console log: %v", err)
+	}
+
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if len(data) == 0 {
+		return []string{}, nil
+	}
+
+	lines := strings.Split(string(data), "\n")
+
+	// The first line read from the end of a large log is likely to be
+	// incomplete.
+	if truncated && len(lines) > 1 {
+		lines = lines[1:]
+	}
+
+	if len(lines) > length {
+		lines = lines[len(lines)-length:]
+	}
+
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	return lines, nil
+}
+
+// sendConsoleLog reports the last lines written by an instance to its
+// serial console to the controller, or the reason they could not be read.
+func sendConsoleLog(conn serverConn, instance string, requestID string, length int, err error) {
+	var e payloads.EventConsoleLogReport
+
+	e.Report.NodeUUID = conn.UUID()
+	e.Report.InstanceUUID = instance
+	e.Report.RequestID = requestID
+
+	if err == nil {
+		logPath := path.Join(instancesDir, instance, consoleLogFile)
+		e.Report.Lines, err = readConsoleLog(logPath, length)
+	}
+
+	if err != nil {
+		glog.Errorf("Unable to read console log of %s: %v", instance, err)
+		e.Report.Reason = err.Error()
+	}
+
+	payload, err := yaml.Marshal(&e)
+	if err != nil {
+		glog.Errorf("Unable to Marshall ConsoleLogReport %v", err)
+		return
+	}
+
+	_, err = conn.SendEvent(ssntp.ConsoleLogReport, payload)
+	if err != nil {
+		glog.Errorf("Failed to send ConsoleLogReport event %v", err)
+	}
+}
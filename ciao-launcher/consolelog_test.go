@@ -0,0 +1,146 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// Check that ConsoleLog payloads are parsed.
+//
+// Parse a valid payload, one with an invalid instance UUID and one with an
+// invalid length.
+//
+// The instance, request ID and length should be returned for the first, an error for
+// the second and an error along with the instance for the third.
+func TestParseConsoleLogPayload(t *testing.T) {
+	instance, requestID, length, err := parseConsoleLogPayload([]byte(testutil.ConsoleLogYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance != testutil.InstanceUUID || requestID != testutil.ConsoleLogRequestID || length != 2 {
+		t.Errorf("Expected %s, %s and 2, got %s, %s and %d", testutil.InstanceUUID,
+			testutil.ConsoleLogRequestID, instance, requestID, length)
+	}
+
+	bad := strings.Replace(testutil.ConsoleLogYaml, testutil.InstanceUUID, "../../etc", 1)
+	instance, _, _, err = parseConsoleLogPayload([]byte(bad))
+	if err == nil || instance != "" {
+		t.Error("Expected invalid instance UUID to be rejected")
+	}
+
+	bad = strings.Replace(testutil.ConsoleLogYaml, "length: 2", "length: 0", 1)
+	instance, _, _, err = parseConsoleLogPayload([]byte(bad))
+	if err == nil || instance != testutil.InstanceUUID {
+		t.Error("Expected invalid length to be reported for the instance")
+	}
+}
+
+// Check that the last lines of a console log are returned.
+//
+// Write a console log with carriage returns and read fewer lines than
+// it holds, more lines than it holds, and the lines of an empty log.
+//
+// The requested number of lines should be returned, oldest first, without
+// carriage returns, all the lines when more are requested and no lines for
+// the empty log.
+func TestReadConsoleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consolelog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	logPath := path.Join(dir, consoleLogFile)
+	err = ioutil.WriteFile(logPath, []byte("one\r\ntwo\r\nthree\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := readConsoleLog(logPath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, ",") != "two,three" {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+
+	lines, err = readConsoleLog(logPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, ",") != "one,two,three" {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+
+	err = ioutil.WriteFile(logPath, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err = readConsoleLog(logPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+}
+
+// Check that only the end of a large console log is read.
+//
+// Write a console log larger than maxConsoleLogRead whose first line is
+// longer than what is read of it, and ask for every line.
+//
+// The partially read first line should not be returned.
+func TestReadConsoleLogLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consolelog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	logPath := path.Join(dir, consoleLogFile)
+	data := strings.Repeat("x", maxConsoleLogRead) + "\nlast\n"
+	err = ioutil.WriteFile(logPath, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := readConsoleLog(logPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, ",") != "last" {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+}
+
+// Check that a console log which does not exist is reported as an error.
+func TestReadConsoleLogMissing(t *testing.T) {
+	_, err := readConsoleLog("/does/not/exist/"+consoleLogFile, 10)
+	if err == nil {
+		t.Error("Expected missing console log to be reported")
+	}
+}
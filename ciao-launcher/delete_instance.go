@@ -39,6 +39,14 @@ func deleteVnic(instanceDir string, conn serverConn) {
 	if err != nil {
 		glog.Warningf("Unable to destroy vnic: %s", err)
 	}
+
+	extraCfgs, err := createExtraVnicCfgs(cfg)
+	if err != nil {
+		glog.Warningf("Unable to create vnicCfg: %s", err)
+		return
+	}
+
+	destroyVnics(conn, extraCfgs)
 }
 
 func processDelete(vm virtualizer, instanceDir string, conn serverConn, creating bool) error {
@@ -0,0 +1,85 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/golang/glog"
+)
+
+func processDetachVolume(storageDriver storage.BlockDriver, monitorCh chan interface{}, cfg *vmConfig,
+	instance, instanceDir, volumeUUID string, conn serverConn) *detachVolumeError {
+
+	if cfg.Container {
+		detachErr := &detachVolumeError{nil, payloads.DetachVolumeNotSupported}
+		glog.Errorf("Cannot detach a volume from a container [%s]", string(detachErr.code))
+		return detachErr
+	}
+
+	vol := cfg.findVolume(volumeUUID)
+	if vol == nil {
+		detachErr := &detachVolumeError{nil, payloads.DetachVolumeNotAttached}
+		glog.Errorf("%s is not attached to instance %s [%s]",
+			volumeUUID, instance, string(detachErr.code))
+		return detachErr
+	}
+
+	if monitorCh != nil {
+		responseCh := make(chan error)
+
+		monitorCh <- virtualizerDetachCmd{
+			responseCh: responseCh,
+			volumeUUID: volumeUUID,
+			hotplugged: vol.Hotplugged,
+		}
+
+		err := <-responseCh
+		if err != nil {
+			glog.Errorf("Unable to detach volume %s from instance %s: %v",
+				volumeUUID, instance, err)
+			return &detachVolumeError{err, payloads.DetachVolumeDetachFailure}
+		}
+
+		// Hotplugged volumes are mapped to the node rather than
+		// accessed directly by qemu.
+		volumeMap, err := storageDriver.GetVolumeMapping()
+		if err != nil {
+			glog.Warningf("Unable to retrieve list of mapped volumes: %v", err)
+		}
+
+		for _, devName := range volumeMap[volumeUUID] {
+			if err := storageDriver.UnmapVolumeFromNode(devName); err != nil {
+				glog.Warningf("Unable to unmap %s : %v", devName, err)
+			}
+		}
+	}
+
+	detached := *vol
+	cfg.removeVolume(volumeUUID)
+
+	err := cfg.save(instanceDir)
+	if err != nil {
+		cfg.Volumes = append(cfg.Volumes, detached)
+		detachErr := &detachVolumeError{err, payloads.DetachVolumeStateFailure}
+		glog.Errorf("Unable to persist instance %s state [%s]: %v",
+			instance, string(detachErr.code), err)
+		return detachErr
+	}
+
+	return nil
+}
@@ -382,7 +382,7 @@ func (d *docker) deleteImage() error {
 	return dockerDeleteContainer(d.cli, d.dockerID, d.cfg.Instance)
 }
 
-func (d *docker) startVM(vnicName, ipAddress, cephID string, fds []*os.File) error {
+func (d *docker) startVM(vnicName, ipAddress, cephID string, fds []*os.File, extra []extraVnic) error {
 	err := d.initDockerClient()
 	if err != nil {
 		return err
@@ -435,6 +435,9 @@ DONE:
 			case virtualizerAttachCmd:
 				err := fmt.Errorf("Live Attach of volumes not supported for containers")
 				cmd.responseCh <- err
+			case virtualizerDetachCmd:
+				err := fmt.Errorf("Live Detach of volumes not supported for containers")
+				cmd.responseCh <- err
 			}
 		}
 	}
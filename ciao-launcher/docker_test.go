@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -71,26 +72,30 @@ func (s dockerTestStorage) MapVolumeToNode(volumeUUID string) (string, error) {
 	return "", nil
 }
 
-func (s dockerTestStorage) CreateBlockDevice(volumeUUID string, image string, sizeGB int) (storage.BlockDevice, error) {
+func (s dockerTestStorage) CreateBlockDevice(ctx gocontext.Context, volumeUUID string, image string, sizeGB int) (storage.BlockDevice, error) {
 	return storage.BlockDevice{}, nil
 }
 
-func (s dockerTestStorage) CreateBlockDeviceFromSnapshot(volumeUUID string, snapshotID string) (storage.BlockDevice, error) {
+func (s dockerTestStorage) CreateBlockDeviceFromSnapshot(ctx gocontext.Context, volumeUUID string, snapshotID string) (storage.BlockDevice, error) {
 	return storage.BlockDevice{}, nil
 }
 
-func (s dockerTestStorage) CreateBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (s dockerTestStorage) CreateBlockDeviceSnapshot(ctx gocontext.Context, volumeUUID string, snapshotID string) error {
 	return nil
 }
 
-func (s dockerTestStorage) DeleteBlockDevice(string) error {
+func (s dockerTestStorage) DeleteBlockDevice(gocontext.Context, string) error {
 	return nil
 }
 
-func (s dockerTestStorage) DeleteBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (s dockerTestStorage) DeleteBlockDeviceSnapshot(ctx gocontext.Context, volumeUUID string, snapshotID string) error {
 	return nil
 }
 
+func (s dockerTestStorage) ListBlockDeviceSnapshots(ctx gocontext.Context, volumeUUID string) ([]string, error) {
+	return nil, nil
+}
+
 func (s dockerTestStorage) UnmapVolumeFromNode(volumeUUID string) error {
 	return nil
 }
@@ -99,11 +104,15 @@ func (s dockerTestStorage) GetVolumeMapping() (map[string][]string, error) {
 	return nil, nil
 }
 
-func (s dockerTestStorage) CopyBlockDevice(volumeUUID string) (storage.BlockDevice, error) {
+func (s dockerTestStorage) ForceRelease(ctx gocontext.Context, volumeUUID string) error {
+	return nil
+}
+
+func (s dockerTestStorage) CopyBlockDevice(ctx gocontext.Context, volumeUUID string) (storage.BlockDevice, error) {
 	return storage.BlockDevice{}, nil
 }
 
-func (s dockerTestStorage) GetBlockDeviceSize(volumeUUID string) (uint64, error) {
+func (s dockerTestStorage) GetBlockDeviceSize(ctx gocontext.Context, volumeUUID string) (uint64, error) {
 	return 0, nil
 }
 
@@ -111,7 +120,7 @@ func (s dockerTestStorage) IsValidSnapshotUUID(string) error {
 	return nil
 }
 
-func (s dockerTestStorage) Resize(string, int) (int, error) {
+func (s dockerTestStorage) Resize(gocontext.Context, string, int) (int, error) {
 	return 0, nil
 }
 
@@ -79,6 +79,16 @@ type insMonitorCmd struct{}
 
 type insAttachVolumeCmd struct {
 	volumeUUID string
+	tag        string
+}
+
+type insDetachVolumeCmd struct {
+	volumeUUID string
+}
+
+type insResizeCmd struct {
+	vcpus int
+	memMB int
 }
 
 /*
@@ -235,17 +245,121 @@ func (id *instanceData) attachVolumeCommand(cmd *insAttachVolumeCmd) {
 	}
 
 	attachErr := processAttachVolume(id.storageDriver, id.monitorCh, id.cfg, id.instance, id.instanceDir,
-		cmd.volumeUUID, id.ac.conn)
+		cmd.volumeUUID, cmd.tag, id.ac.conn)
 	if attachErr != nil {
 		attachErr.send(id.ac.conn, id.instance, cmd.volumeUUID)
 		return
 	}
+	id.sendVolumeEvent(ssntp.VolumeAttached, cmd.volumeUUID)
 	d, m, c := id.vm.stats()
 	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c, id.getVolumes()}
 
 	glog.Infof("Volume %s attached to instance %s", cmd.volumeUUID, id.instance)
 }
 
+func (id *instanceData) detachVolumeCommand(cmd *insDetachVolumeCmd) {
+	if id.shuttingDown {
+		detachErr := &detachVolumeError{nil, payloads.DetachVolumeInstanceFailure}
+		glog.Errorf("Unable to detach instance[%s]", string(detachErr.code))
+		detachErr.send(id.ac.conn, id.instance, cmd.volumeUUID)
+		return
+	}
+
+	detachErr := processDetachVolume(id.storageDriver, id.monitorCh, id.cfg, id.instance, id.instanceDir,
+		cmd.volumeUUID, id.ac.conn)
+	if detachErr != nil {
+		detachErr.send(id.ac.conn, id.instance, cmd.volumeUUID)
+		return
+	}
+	id.sendVolumeEvent(ssntp.VolumeDetached, cmd.volumeUUID)
+	d, m, c := id.vm.stats()
+	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c, id.getVolumes()}
+
+	glog.Infof("Volume %s detached from instance %s", cmd.volumeUUID, id.instance)
+}
+
+func (id *instanceData) sendVolumeEvent(eventType ssntp.Event, volumeUUID string) {
+	e := payloads.VolumeEvent{
+		NodeUUID:     id.ac.conn.UUID(),
+		InstanceUUID: id.instance,
+		VolumeUUID:   volumeUUID,
+	}
+
+	var event interface{}
+	if eventType == ssntp.VolumeAttached {
+		event = &payloads.EventVolumeAttached{Attached: e}
+	} else {
+		event = &payloads.EventVolumeDetached{Detached: e}
+	}
+
+	payload, err := yaml.Marshal(event)
+	if err != nil {
+		glog.Errorf("Unable to Marshall %s event %v", eventType, err)
+		return
+	}
+	_, err = id.ac.conn.SendEvent(eventType, payload)
+	if err != nil {
+		glog.Errorf("Failed to send event command %v", err)
+		return
+	}
+}
+
+func (id *instanceData) resizeCommand(cmd *insResizeCmd) {
+	if id.shuttingDown || id.monitorCh == nil {
+		resizeErr := &resizeError{nil, payloads.ResizeNoInstance}
+		glog.Errorf("Unable to resize instance[%s]", string(resizeErr.code))
+		resizeErr.send(id.ac.conn, id.instance)
+		return
+	}
+
+	if id.cfg.Container || id.cfg.NetworkNode {
+		resizeErr := &resizeError{nil, payloads.ResizeNotSupported}
+		glog.Errorf("Unable to resize instance[%s]", string(resizeErr.code))
+		resizeErr.send(id.ac.conn, id.instance)
+		return
+	}
+
+	glog.Infof("Powerdown %s before resizing", id.instance)
+	id.monitorCh <- virtualizerStopCmd{}
+	<-id.monitorCloseCh
+	id.vm.lostVM()
+	id.monitorCloseCh = nil
+	id.connectedCh = nil
+	close(id.monitorCh)
+	id.monitorCh = nil
+	id.statsTimer = nil
+	id.ovsCh <- &ovsStateChange{id.instance, ovsStopped}
+
+	if networking {
+		deleteVnic(id.instanceDir, id.ac.conn)
+	}
+
+	vcpus, memMB := id.cfg.Cpus, id.cfg.Mem
+	resizeErr := processResize(id.vm, id.cfg, id.instanceDir, id.ac.conn, cmd.vcpus, cmd.memMB)
+	if resizeErr != nil {
+		glog.Errorf("Unable to resize instance[%s]: %v", string(resizeErr.code), resizeErr.err)
+		resizeErr.send(id.ac.conn, id.instance)
+
+		// Try to bring the instance back with the requirements it
+		// was running with before we give up on it.
+		if processResize(id.vm, id.cfg, id.instanceDir, id.ac.conn, vcpus, memMB) != nil {
+			glog.Warningf("Unable to restart VM instance: %s.  Killing it", id.instance)
+			killMe(id.instance, false, true, id.doneCh, id.ac, &id.instanceWg)
+			id.shuttingDown = true
+			return
+		}
+	} else {
+		id.sendInstanceResizedEvent()
+		glog.Infof("Instance %s resized to %d vcpus %d MB", id.instance, cmd.vcpus, cmd.memMB)
+	}
+
+	id.ovsCh <- &ovsResizeCmd{id.instance, id.cfg.Cpus, id.cfg.Mem}
+
+	id.connectedCh = make(chan struct{})
+	id.monitorCloseCh = make(chan struct{})
+	id.monitorCh = id.vm.monitorVM(id.monitorCloseCh, id.connectedCh, &id.instanceWg, false)
+}
+
 func (id *instanceData) logStartTrace() {
 	if id.st == nil {
 		return
@@ -283,6 +397,10 @@ func (id *instanceData) instanceCommand(cmd interface{}) bool {
 		id.monitorCommand(cmd)
 	case *insAttachVolumeCmd:
 		id.attachVolumeCommand(cmd)
+	case *insDetachVolumeCmd:
+		id.detachVolumeCommand(cmd)
+	case *insResizeCmd:
+		id.resizeCommand(cmd)
 	case *insDeleteCmd:
 		if id.deleteCommand(cmd) {
 			return false
@@ -294,10 +412,13 @@ func (id *instanceData) instanceCommand(cmd interface{}) bool {
 	return true
 }
 
-func (id *instanceData) getVolumes() []string {
-	volumes := make([]string, 0, len(id.cfg.Volumes))
+func (id *instanceData) getVolumes() []payloads.VolumeDevice {
+	volumes := make([]payloads.VolumeDevice, 0, len(id.cfg.Volumes))
 	for _, v := range id.cfg.Volumes {
-		volumes = append(volumes, v.UUID)
+		volumes = append(volumes, payloads.VolumeDevice{
+			VolumeUUID: v.UUID,
+			Device:     v.guestDevice(id.cfg.Container),
+		})
 	}
 	return volumes
 }
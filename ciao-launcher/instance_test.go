@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -59,9 +60,13 @@ type instanceTestState struct {
 	stf             payloads.ErrorStartFailure
 	df              payloads.ErrorDeleteFailure
 	avf             payloads.ErrorAttachVolumeFailure
+	dvf             payloads.ErrorDetachVolumeFailure
+	rf              payloads.ErrorResizeFailure
 	deMigration     bool
 	de              payloads.EventInstanceDeleted
 	se              payloads.EventInstanceStopped
+	ire             payloads.EventInstanceResized
+	vde             payloads.EventVolumeDetached
 	connect         bool
 	monitorCh       chan interface{}
 	errorCh         chan struct{}
@@ -91,7 +96,7 @@ func (v *instanceTestState) deleteImage() error {
 	return nil
 }
 
-func (v *instanceTestState) startVM(vnicName, ipAddress, cephID string, fds []*os.File) error {
+func (v *instanceTestState) startVM(vnicName, ipAddress, cephID string, fds []*os.File, extra []extraVnic) error {
 	if v.failStartVM {
 		return fmt.Errorf("Failed to start VM")
 	}
@@ -142,6 +147,16 @@ func (v *instanceTestState) SendError(error ssntp.Error, payload []byte) (int, e
 		if err != nil {
 			v.t.Fatalf("Failed to unmarshall attach volume error %v", err)
 		}
+	case ssntp.DetachVolumeFailure:
+		err := yaml.Unmarshal(payload, &v.dvf)
+		if err != nil {
+			v.t.Fatalf("Failed to unmarshall detach volume error %v", err)
+		}
+	case ssntp.ResizeFailure:
+		err := yaml.Unmarshal(payload, &v.rf)
+		if err != nil {
+			v.t.Fatalf("Failed to unmarshall resize error %v", err)
+		}
 	}
 
 	if v.errorCh != nil {
@@ -165,6 +180,16 @@ func (v *instanceTestState) SendEvent(event ssntp.Event, payload []byte) (int, e
 		if err != nil {
 			v.t.Fatalf("Failed to unmarshall instanceStopped event %v", err)
 		}
+	case ssntp.InstanceResized:
+		err := yaml.Unmarshal(payload, &v.ire)
+		if err != nil {
+			v.t.Fatalf("Failed to unmarshall instanceResized event %v", err)
+		}
+	case ssntp.VolumeDetached:
+		err := yaml.Unmarshal(payload, &v.vde)
+		if err != nil {
+			v.t.Fatalf("Failed to unmarshall volumeDetached event %v", err)
+		}
 	}
 
 	if v.eventCh != nil {
@@ -237,7 +262,7 @@ func (v *instanceTestState) expectStatsUpdateWithVolumes(t *testing.T,
 	found := 0
 	for _, vol := range volumes {
 		for _, vol2 := range stats.volumes {
-			if vol2 == vol {
+			if vol2.VolumeUUID == vol {
 				found++
 				break
 			}
@@ -829,7 +854,7 @@ func TestAttachVolumeToInstance(t *testing.T) {
 	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
 
 	select {
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, ""}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
@@ -850,6 +875,83 @@ func TestAttachVolumeToInstance(t *testing.T) {
 	wg.Wait()
 }
 
+// Check we can remove a volume from an instance
+//
+// We start the instance loop, add a volume, detach it, wait for the instance
+// statistics, try to detach it a second time and then delete the instance.
+//
+// The volume should be removed from the instance by the virtualizer, the
+// VolumeDetached event should be sent and the stats command should verify
+// that the instance has no volumes.  The second detach should fail as the
+// volume is no longer attached.
+func TestDetachVolumeFromInstance(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := standardCfg
+	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
+
+	select {
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, ""}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending attach volume command")
+	}
+
+	select {
+	case monCmd := <-state.monitorCh:
+		monCmd.(virtualizerAttachCmd).responseCh <- nil
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for attach volume command result")
+	}
+
+	_ = state.expectStatsUpdateWithVolumes(t, ovsCh, []string{testutil.VolumeUUID})
+
+	select {
+	case cmdCh <- &insDetachVolumeCmd{testutil.VolumeUUID}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending detach volume command")
+	}
+
+	select {
+	case monCmd := <-state.monitorCh:
+		detach := monCmd.(virtualizerDetachCmd)
+		if detach.volumeUUID != testutil.VolumeUUID || !detach.hotplugged {
+			t.Errorf("Unexpected detach command %+v", detach)
+		}
+		detach.responseCh <- nil
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for detach volume command result")
+	}
+
+	_ = state.expectStatsUpdateWithVolumes(t, ovsCh, []string{})
+
+	if state.vde.Detached.VolumeUUID != testutil.VolumeUUID {
+		t.Errorf("VolumeDetached event not sent for %s", testutil.VolumeUUID)
+	}
+
+	state.errorCh = make(chan struct{})
+	select {
+	case cmdCh <- &insDetachVolumeCmd{testutil.VolumeUUID}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending detach volume command")
+	}
+
+	select {
+	case <-state.errorCh:
+		if state.dvf.Reason != payloads.DetachVolumeNotAttached {
+			t.Errorf("Unexpected error.  Expected %s got %s",
+				payloads.DetachVolumeNotAttached, state.dvf.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for detach to fail")
+	}
+	state.errorCh = nil
+
+	if !state.deleteInstance(t, ovsCh, cmdCh) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	wg.Wait()
+}
+
 // Check that adding an existing volume fails
 //
 // We start the instance loop, add a volume, add the volume a second time
@@ -864,7 +966,7 @@ func TestAttachExistingVolumeToInstance(t *testing.T) {
 	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
 
 	select {
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, ""}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
@@ -881,7 +983,7 @@ func TestAttachExistingVolumeToInstance(t *testing.T) {
 	select {
 	case <-state.errorCh:
 		t.Error("Initial Volume attach failed")
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, ""}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
@@ -903,6 +1005,229 @@ func TestAttachExistingVolumeToInstance(t *testing.T) {
 	wg.Wait()
 }
 
+// Check that tagged volumes are reported and that tags are not reused
+//
+// We start the instance loop, add a tagged volume, add a second volume with
+// the same tag and then delete the instance.
+//
+// The first volume should be attached and reported without a device, as it
+// was hotplugged, and should keep its tag.  The second attach should fail
+// as the tag is already in use.
+func TestAttachTaggedVolumeToInstance(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := standardCfg
+	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
+
+	select {
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, "data"}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending attach volume command")
+	}
+
+	select {
+	case monCmd := <-state.monitorCh:
+		monCmd.(virtualizerAttachCmd).responseCh <- nil
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for attach volume command result")
+	}
+
+	stats := state.getStatsUpdate(t, ovsCh)
+	if stats != nil {
+		expected := []payloads.VolumeDevice{{VolumeUUID: testutil.VolumeUUID}}
+		if !reflect.DeepEqual(stats.volumes, expected) {
+			t.Errorf("Unexpected volumes %v, expected %v", stats.volumes, expected)
+		}
+	}
+
+	select {
+	case <-state.errorCh:
+		t.Error("Initial Volume attach failed")
+	case cmdCh <- &insAttachVolumeCmd{"a7f7ae3b-3d45-4f8a-b17f-3f8b1b8d3c55", "data"}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending attach volume command")
+	}
+
+	select {
+	case <-state.errorCh:
+		if state.avf.Reason != payloads.AttachVolumeTagInUse {
+			t.Errorf("Unexpected error.  Expected %s got %s",
+				payloads.AttachVolumeTagInUse, state.avf.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for attach to fail")
+	}
+
+	if !state.deleteInstance(t, ovsCh, cmdCh) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	wg.Wait()
+}
+
+// Check we can resize a running instance
+//
+// We start the instance loop, start an instance and then send a resize
+// command.  We power down the instance when asked to by the instance loop
+// and wait for the instance to be restarted before deleting it.
+//
+// The instance should be restarted with its new requirements, which should be
+// saved in its configuration and reported to the overseer and the controller.
+// The instance should then be deleted correctly.
+func TestResizeInstance(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := standardCfg
+	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
+
+	state.eventCh = make(chan struct{})
+	monitorCh := state.monitorCh
+	select {
+	case cmdCh <- &insResizeCmd{4, 1024}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending resize command")
+	}
+
+	var resized *ovsResizeCmd
+	timeout := time.After(time.Second * 5)
+	for resized == nil || state.eventCh != nil {
+		select {
+		case monCmd := <-monitorCh:
+			if _, stopCmd := monCmd.(virtualizerStopCmd); !stopCmd {
+				t.Errorf("Invalid monitor command found %t, expected virtualizerStopCmd", monCmd)
+			}
+			close(state.monitorClosedCh)
+			monitorCh = nil
+		case ovsCmd := <-ovsCh:
+			switch cmd := ovsCmd.(type) {
+			case *ovsResizeCmd:
+				resized = cmd
+			case *ovsStateChange, *ovsStatsUpdateCmd:
+			default:
+				t.Error("Unexpected commands received on ovsCh")
+			}
+		case <-state.eventCh:
+			state.eventCh = nil
+		case <-timeout:
+			t.Error("Timed out waiting for instance to be resized")
+			shutdownInstanceLoop(doneCh, ovsCh, &wg, t)
+			t.FailNow()
+		}
+	}
+
+	if resized.vcpus != 4 || resized.memoryMB != 1024 {
+		t.Errorf("Overseer told of wrong requirements %d %d", resized.vcpus, resized.memoryMB)
+	}
+
+	if state.ire.Resized.VCPUs != 4 || state.ire.Resized.MemMB != 1024 {
+		t.Errorf("Controller told of wrong requirements %d %d",
+			state.ire.Resized.VCPUs, state.ire.Resized.MemMB)
+	}
+
+	savedCfg, err := loadVMConfig(path.Join(testInstancesDir, cfg.Instance))
+	if err != nil {
+		t.Errorf("Unable to load instance config: %v", err)
+	} else if savedCfg.Cpus != 4 || savedCfg.Mem != 1024 {
+		t.Errorf("Wrong requirements saved %d %d", savedCfg.Cpus, savedCfg.Mem)
+	}
+
+	if !waitForStateChange(t, ovsRunning, ovsCh) || !state.expectStatsUpdate(t, ovsCh) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	if !state.deleteInstance(t, ovsCh, cmdCh) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	wg.Wait()
+}
+
+// Check that containers cannot be resized
+//
+// We start the instance loop, start a container and then send a resize
+// command.
+//
+// The resize command should fail without powering down the container,
+// which should then be deleted correctly.
+func TestResizeContainer(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := standardCfg
+	cfg.Container = true
+	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
+
+	state.errorCh = make(chan struct{})
+	select {
+	case cmdCh <- &insResizeCmd{4, 1024}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending resize command")
+	}
+
+	select {
+	case <-state.errorCh:
+		state.errorCh = nil
+		if state.rf.Reason != payloads.ResizeNotSupported {
+			t.Errorf("Invalid Error received.  Expected %s found %s",
+				string(payloads.ResizeNotSupported), string(state.rf.Reason))
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for resize error")
+	}
+
+	if !state.deleteInstance(t, ovsCh, cmdCh) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	wg.Wait()
+}
+
+// Check that an instance which cannot be restarted after a resize is killed
+//
+// We start the instance loop, start an instance, arrange for the instance
+// to fail to restart and then send a resize command.
+//
+// The resize command should fail.  The instance should then ask to be deleted
+// and should be deleted correctly.
+func TestResizeRestartFailure(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := standardCfg
+	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
+
+	state.failStartVM = true
+	state.errorCh = make(chan struct{})
+	select {
+	case cmdCh <- &insResizeCmd{4, 1024}:
+	case <-time.After(time.Second):
+		t.Error("Timed out sending resize command")
+	}
+
+	var cmd *cmdWrapper
+	timeout := time.After(time.Second * 5)
+	for cmd == nil || state.errorCh != nil {
+		select {
+		case <-state.monitorCh:
+			close(state.monitorClosedCh)
+			state.monitorCh = nil
+		case <-ovsCh:
+		case <-state.errorCh:
+			state.errorCh = nil
+		case cmd = <-state.ac.cmdCh:
+		case <-timeout:
+			t.Error("Timed out waiting for delete cmd")
+			shutdownInstanceLoop(doneCh, ovsCh, &wg, t)
+			t.FailNow()
+		}
+	}
+
+	if state.rf.Reason != payloads.ResizeRestartFailure {
+		t.Errorf("Invalid Error received.  Expected %s found %s",
+			string(payloads.ResizeRestartFailure), string(state.rf.Reason))
+	}
+
+	if !state.deleteInstanceEx(t, ovsCh, cmdCh, cmd.cmd.(*insDeleteCmd)) {
+		cleanupShutdownFail(t, cfg.Instance, doneCh, ovsCh, &wg)
+	}
+
+	wg.Wait()
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	var err error
@@ -88,6 +88,7 @@ var memLimit bool
 var cephID string
 var prepare bool
 var roles string
+var labels string
 var simulate bool
 var childProcessCreds *syscall.SysProcAttr
 var childProcessKVMCreds *syscall.SysProcAttr
@@ -102,12 +103,14 @@ func init() {
 	flag.StringVar(&cephID, "ceph_id", "", "ceph client id")
 	flag.BoolVar(&prepare, "osprepare", false, "Install dependencies")
 	flag.StringVar(&roles, "roles", "agent", "Roles for which dependencies are to be installed")
+	flag.StringVar(&labels, "labels", "", "Comma separated list of labels reported for this node")
 }
 
 const (
 	lockDir         = "/tmp/lock/ciao"
 	ciaoDir         = "/var/lib/ciao"
 	instancesDir    = ciaoDir + "/instances"
+	imagesDir       = ciaoDir + "/images"
 	dataDir         = ciaoDir + "/data/launcher/"
 	logDir          = ciaoDir + "/logs/launcher"
 	maintenanceFile = dataDir + "/maintenance"
@@ -184,7 +187,7 @@ func processCommand(conn serverConn, cmd *cmdWrapper, ovsCh chan<- interface{})
 		return
 	}
 
-	switch cmd.cmd.(type) {
+	switch c := cmd.cmd.(type) {
 	case *statusCmd:
 		ovsCh <- &ovsStatsStatusCmd{}
 		return
@@ -212,9 +215,27 @@ func processCommand(conn serverConn, cmd *cmdWrapper, ovsCh chan<- interface{})
 		ovsCh <- &ovsRestoreCmd{doneCh}
 		<-doneCh
 		glog.Info("Node restored")
+	case *inventoryCmd:
+		ovsCh <- &ovsInventoryCmd{}
+	case *prefetchCmd:
+		go prefetchImage(conn, c.image)
+	case *consoleLogCmd:
+		go sendConsoleLog(conn, c.instance, c.requestID, c.length, c.err)
 	}
 }
 
+// nodeLabels returns the labels given to the node with the labels flag.
+func nodeLabels() []string {
+	var l []string
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			l = append(l, label)
+		}
+	}
+	return l
+}
+
 func processInstanceCommand(conn serverConn, cmd *cmdWrapper, ovsCh chan<- interface{}) {
 	var target chan<- interface{}
 	var delCmd *insDeleteCmd
@@ -248,6 +269,22 @@ func processInstanceCommand(conn serverConn, cmd *cmdWrapper, ovsCh chan<- inter
 			return
 		}
 		delCmd = insCmd
+	case *insResizeCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			re := resizeError{nil, payloads.ResizeNoInstance}
+			re.send(conn, cmd.instance)
+			return
+		}
+	case *insDetachVolumeCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			de := detachVolumeError{nil, payloads.DetachVolumeNoInstance}
+			de.send(conn, cmd.instance, insCmd.volumeUUID)
+			return
+		}
 	default:
 		target = insCmdChannel(cmd.instance, ovsCh)
 	}
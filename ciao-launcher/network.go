@@ -192,28 +192,47 @@ func initNetworking(ctx context.Context) chan error {
 	return ch
 }
 
+// extraVnic is a network interface created for an instance in addition to
+// its primary one.
+type extraVnic struct {
+	name string
+	mac  string
+	fds  []*os.File
+}
+
 func createCNVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
+	return createNICVnicCfg(cfg, &nicConfig{
+		VnicMAC:  cfg.VnicMAC,
+		VnicIP:   cfg.VnicIP,
+		ConcIP:   cfg.ConcIP,
+		SubnetIP: cfg.SubnetIP,
+		ConcUUID: cfg.ConcUUID,
+		VnicUUID: cfg.VnicUUID,
+	})
+}
+
+func createNICVnicCfg(cfg *vmConfig, nic *nicConfig) (*libsnnet.VnicConfig, error) {
 
 	glog.Info("Creating CN Vnic CFG")
 
-	mac, err := net.ParseMAC(cfg.VnicMAC)
+	mac, err := net.ParseMAC(nic.VnicMAC)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid mac address %v", err)
 	}
 
-	_, vnet, err := net.ParseCIDR(cfg.SubnetIP)
+	_, vnet, err := net.ParseCIDR(nic.SubnetIP)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid vnic subnet %v", err)
 	}
 
-	concIP := net.ParseIP(cfg.ConcIP)
+	concIP := net.ParseIP(nic.ConcIP)
 	if concIP == nil {
-		return nil, fmt.Errorf("Invalid concentrator ip %s", cfg.ConcIP)
+		return nil, fmt.Errorf("Invalid concentrator ip %s", nic.ConcIP)
 	}
 
-	vnicIP := net.ParseIP(cfg.VnicIP)
+	vnicIP := net.ParseIP(nic.VnicIP)
 	if vnicIP == nil {
-		return nil, fmt.Errorf("Invalid vnicIP ip %s", cfg.VnicIP)
+		return nil, fmt.Errorf("Invalid vnicIP ip %s", nic.VnicIP)
 	}
 
 	subnetKey := binary.LittleEndian.Uint32(vnet.IP)
@@ -231,15 +250,29 @@ func createCNVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 		VnicMAC:    mac,
 		Subnet:     *vnet,
 		SubnetKey:  int(subnetKey),
-		VnicID:     cfg.VnicUUID,
+		VnicID:     nic.VnicUUID,
 		InstanceID: cfg.Instance,
 		TenantID:   cfg.TenantUUID,
-		SubnetID:   cfg.SubnetIP,
-		ConcID:     cfg.ConcUUID,
+		SubnetID:   nic.SubnetIP,
+		ConcID:     nic.ConcUUID,
 		Queues:     1,
 	}, nil
 }
 
+// createExtraVnicCfgs returns the configurations of the additional network
+// interfaces of an instance.
+func createExtraVnicCfgs(cfg *vmConfig) ([]*libsnnet.VnicConfig, error) {
+	vnicCfgs := make([]*libsnnet.VnicConfig, 0, len(cfg.ExtraNICs))
+	for i := range cfg.ExtraNICs {
+		vnicCfg, err := createNICVnicCfg(cfg, &cfg.ExtraNICs[i])
+		if err != nil {
+			return nil, err
+		}
+		vnicCfgs = append(vnicCfgs, vnicCfg)
+	}
+	return vnicCfgs, nil
+}
+
 func createCNCIVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 
 	glog.Info("Creating CNCI Vnic CFG")
@@ -362,6 +395,38 @@ func destroyVnic(conn serverConn, vnicCfg *libsnnet.VnicConfig) error {
 	return nil
 }
 
+// createExtraVnics creates the additional network interfaces of an instance.
+// If any of them cannot be created those already created are destroyed.
+func createExtraVnics(conn serverConn, vnicCfgs []*libsnnet.VnicConfig) ([]extraVnic, error) {
+	extra := make([]extraVnic, 0, len(vnicCfgs))
+	for i, vnicCfg := range vnicCfgs {
+		name, _, _, fds, err := createVnic(conn, vnicCfg)
+		if err != nil {
+			for _, e := range extra {
+				cleanupFds(e.fds, len(e.fds))
+			}
+			destroyVnics(conn, vnicCfgs[:i])
+			return nil, err
+		}
+		extra = append(extra, extraVnic{
+			name: name,
+			mac:  vnicCfg.VnicMAC.String(),
+			fds:  fds,
+		})
+	}
+	return extra, nil
+}
+
+// destroyVnics destroys the additional network interfaces of an instance,
+// carrying on if any of them cannot be destroyed.
+func destroyVnics(conn serverConn, vnicCfgs []*libsnnet.VnicConfig) {
+	for _, vnicCfg := range vnicCfgs {
+		if err := destroyVnic(conn, vnicCfg); err != nil {
+			glog.Warningf("Unable to destroy vnic %s: %v", vnicCfg.VnicID, err)
+		}
+	}
+}
+
 func getNodeIPAddress() string {
 	if len(nicInfo) == 0 {
 		return "127.0.0.1"
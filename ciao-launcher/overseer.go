@@ -71,6 +71,12 @@ type ovsRemoveCmd struct {
 	errCh    chan<- error
 }
 
+type ovsResizeCmd struct {
+	instance string
+	vcpus    int
+	memoryMB int
+}
+
 type ovsStateChange struct {
 	instance string
 	state    ovsRunningState
@@ -81,7 +87,7 @@ type ovsStatsUpdateCmd struct {
 	memoryUsageMB int
 	diskUsageMB   int
 	CPUUsage      int
-	volumes       []string
+	volumes       []payloads.VolumeDevice
 }
 
 type ovsMaintenanceCmd struct {
@@ -98,6 +104,7 @@ type ovsTraceFrame struct {
 
 type ovsStatusCmd struct{}
 type ovsStatsStatusCmd struct{}
+type ovsInventoryCmd struct{}
 
 type ovsRunningState int
 
@@ -132,6 +139,18 @@ const (
 	ovsStopped
 )
 
+// String returns the instance state reported to the controller.
+func (s ovsRunningState) String() string {
+	switch s {
+	case ovsRunning:
+		return payloads.Running
+	case ovsStopped:
+		return payloads.Exited
+	}
+
+	return payloads.Pending
+}
+
 const (
 	diskSpaceHWM = 80 * 1000
 	memHWM       = 1 * 1000
@@ -150,7 +169,7 @@ type ovsInstanceState struct {
 	maxMemoryMB    int
 	sshIP          string
 	sshPort        int
-	volumes        []string
+	volumes        []payloads.VolumeDevice
 }
 
 type overseer struct {
@@ -323,6 +342,7 @@ func (ovs *overseer) sendStats(cns *cnStats, status ssntp.Status) {
 	s.CpusOnline = cns.cpusOnline
 	s.DiskTotalMB, s.DiskAvailableMB = cns.totalDiskMB, cns.availableDiskMB
 	s.NodeHostName = hostname // global from network.go
+	s.Labels = nodeLabels()
 	s.Networks = make([]payloads.NetworkStat, len(nicInfo))
 	for i, nic := range nicInfo {
 		s.Networks[i] = *nic
@@ -331,22 +351,22 @@ func (ovs *overseer) sendStats(cns *cnStats, status ssntp.Status) {
 	i := 0
 	for uuid, state := range ovs.instances {
 		s.Instances[i].InstanceUUID = uuid
-		if state.running == ovsRunning {
-			s.Instances[i].State = payloads.Running
-		} else if state.running == ovsStopped {
-			s.Instances[i].State = payloads.Exited
-		} else {
-			s.Instances[i].State = payloads.Pending
-		}
+		s.Instances[i].State = state.running.String()
 		s.Instances[i].MemoryUsageMB = state.memoryUsageMB
 		s.Instances[i].DiskUsageMB = state.diskUsageMB
 		s.Instances[i].CPUUsage = state.CPUUsage
 		s.Instances[i].SSHIP = state.sshIP
 		s.Instances[i].SSHPort = state.sshPort
-		s.Instances[i].Volumes = state.volumes
+		s.Instances[i].Volumes = make([]string, 0, len(state.volumes))
+		for _, v := range state.volumes {
+			s.Instances[i].Volumes = append(s.Instances[i].Volumes, v.VolumeUUID)
+		}
+		s.Instances[i].VolumeDevices = state.volumes
 		i++
 	}
 
+	s.Timestamp = time.Now().UnixNano()
+
 	payload, err := yaml.Marshal(&s)
 	if err != nil {
 		glog.Errorf("Unable to Marshall STATS %v", err)
@@ -510,6 +530,55 @@ func (ovs *overseer) processStatsStatusCommand(cmd *ovsStatsStatusCmd) {
 	ovs.sendStats(cns, status)
 }
 
+func (ovs *overseer) processInventoryCommand(cmd *ovsInventoryCmd) {
+	glog.Info("Overseer: Received Inventory Command")
+
+	var e payloads.EventInventoryReport
+
+	e.Report.NodeUUID = ovs.ac.conn.UUID()
+	e.Report.Instances = make([]payloads.InventoryInstance, 0, len(ovs.instances))
+	for uuid, state := range ovs.instances {
+		e.Report.Instances = append(e.Report.Instances,
+			payloads.InventoryInstance{
+				InstanceUUID: uuid,
+				State:        state.running.String(),
+			})
+	}
+
+	payload, err := yaml.Marshal(&e)
+	if err != nil {
+		glog.Errorf("Unable to Marshall InstanceInventoryReport %v", err)
+		return
+	}
+
+	_, err = ovs.ac.conn.SendEvent(ssntp.InstanceInventoryReport, payload)
+	if err != nil {
+		glog.Errorf("Failed to send InstanceInventoryReport event %v", err)
+	}
+}
+
+func (ovs *overseer) processResizeCommand(cmd *ovsResizeCmd) {
+	glog.Infof("Overseer: resizing %s to %d vcpus %d MB", cmd.instance,
+		cmd.vcpus, cmd.memoryMB)
+	target := ovs.instances[cmd.instance]
+	if target == nil {
+		return
+	}
+
+	ovs.vcpusAllocated += cmd.vcpus - target.maxVCPUs
+	if ovs.vcpusAllocated < 0 {
+		ovs.vcpusAllocated = 0
+	}
+
+	ovs.memoryAllocated += cmd.memoryMB - target.maxMemoryMB
+	if ovs.memoryAllocated < 0 {
+		ovs.memoryAllocated = 0
+	}
+
+	target.maxVCPUs = cmd.vcpus
+	target.maxMemoryMB = cmd.memoryMB
+}
+
 func (ovs *overseer) processStateChangeCommand(cmd *ovsStateChange) {
 	glog.Infof("Overseer: Received State Change %v", *cmd)
 	target := ovs.instances[cmd.instance]
@@ -584,6 +653,10 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		ovs.processStatusCommand(cmd)
 	case *ovsStatsStatusCmd:
 		ovs.processStatsStatusCommand(cmd)
+	case *ovsInventoryCmd:
+		ovs.processInventoryCommand(cmd)
+	case *ovsResizeCmd:
+		ovs.processResizeCommand(cmd)
 	case *ovsStateChange:
 		ovs.processStateChangeCommand(cmd)
 	case *ovsStatsUpdateCmd:
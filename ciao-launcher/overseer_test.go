@@ -55,10 +55,11 @@ func (fakeDeviceInfo) GetMemoryInfo() (total, available int) {
 }
 
 type overseerTestState struct {
-	t        *testing.T
-	ac       *agentClient
-	statusCh chan *fakeStatus
-	statsCh  chan *payloads.Stat
+	t           *testing.T
+	ac          *agentClient
+	statusCh    chan *fakeStatus
+	statsCh     chan *payloads.Stat
+	inventoryCh chan *payloads.EventInventoryReport
 }
 
 func (v *overseerTestState) SendError(error ssntp.Error, payload []byte) (int, error) {
@@ -66,6 +67,19 @@ func (v *overseerTestState) SendError(error ssntp.Error, payload []byte) (int, e
 }
 
 func (v *overseerTestState) SendEvent(event ssntp.Event, payload []byte) (int, error) {
+	switch event {
+	case ssntp.InstanceInventoryReport:
+		if v.inventoryCh == nil {
+			return 0, nil
+		}
+		report := &payloads.EventInventoryReport{}
+		err := yaml.Unmarshal(payload, report)
+		if err != nil {
+			v.t.Errorf("Failed to unmarshall InstanceInventoryReport %v", err)
+		}
+		v.inventoryCh <- report
+	}
+
 	return 0, nil
 }
 
@@ -814,3 +828,69 @@ func TestStateChange(t *testing.T) {
 	shutdownOverseer(ovsCh, state)
 	wg.Wait()
 }
+
+// Check that the ovsInventoryCmd reports all instances.
+//
+// Start the overseer, add an instance and mark it as running.  Then
+// request an inventory.  Shut down the overseer.
+//
+// The inventory should contain the running instance and the UUID of the
+// node.
+func TestInventory(t *testing.T) {
+	diskLimit = false
+	memLimit = false
+
+	instancesDir, err := ioutil.TempDir("", "overseer-tests")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory")
+	}
+	defer func() { _ = os.RemoveAll(instancesDir) }()
+
+	var wg sync.WaitGroup
+	state := &overseerTestState{
+		t:           t,
+		inventoryCh: make(chan *payloads.EventInventoryReport),
+	}
+	state.ac = &agentClient{conn: state, cmdCh: make(chan *cmdWrapper)}
+
+	ovsCh := startOverseerFull(instancesDir, &wg, state.ac, time.Second*1000,
+		fakeDeviceInfo{})
+
+	_ = addInstance(t, ovsCh, state, false)
+
+	select {
+	case ovsCh <- &ovsStateChange{
+		instance: "test-instance",
+		state:    ovsRunning,
+	}:
+	case <-time.After(time.Second):
+		t.Fatal("Unable to send ovsStateChange")
+	}
+
+	select {
+	case ovsCh <- &ovsInventoryCmd{}:
+	case <-time.After(time.Second):
+		t.Fatal("Unable to send ovsInventoryCmd")
+	}
+
+	var report *payloads.EventInventoryReport
+	select {
+	case report = <-state.inventoryCh:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for inventory")
+	}
+
+	if report.Report.NodeUUID != "test-uuid" {
+		t.Errorf("Unexpected node UUID %s", report.Report.NodeUUID)
+	}
+
+	if len(report.Report.Instances) != 1 ||
+		report.Report.Instances[0].InstanceUUID != "test-instance" ||
+		report.Report.Instances[0].State != payloads.Running {
+		t.Errorf("Expected one running instance called test-instance, got %v",
+			report.Report.Instances)
+	}
+
+	shutdownOverseer(ovsCh, state)
+	wg.Wait()
+}
@@ -67,6 +67,9 @@ func printCloudinit(data *payloads.Start) {
 	glog.Infof("SubnetIP:             %v", net.Subnet)
 	glog.Infof("ConcUUID:             %v", net.ConcentratorUUID)
 	glog.Infof("VnicUUID:             %v", net.VnicUUID)
+	for _, extra := range start.ExtraNetworking {
+		glog.Infof("Extra Vnic:           %v %v %v", extra.VnicUUID, extra.VnicMAC, extra.PrivateIP)
+	}
 	glog.Infof("Restart:              %t", start.Restart)
 	glog.Infof("Requirements:         %+v", start.Requirements)
 
@@ -74,6 +77,9 @@ func printCloudinit(data *payloads.Start) {
 		if storage.ID != "" {
 			glog.Info("Volumes:")
 			glog.Infof("  %s Bootable=%t", storage.ID, storage.Bootable)
+			if storage.BootIndex != nil {
+				glog.Infof("  %s BootIndex=%d", storage.ID, *storage.BootIndex)
+			}
 		}
 	}
 }
@@ -147,12 +153,31 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 	net := &start.Networking
 	vnicIP := strings.TrimSpace(net.PrivateIP)
 	sshPort := computeSSHPort(networkNode, vnicIP)
+	var extraNICs []nicConfig
+	for _, extra := range start.ExtraNetworking {
+		if container || networkNode {
+			err = fmt.Errorf("Only VMs may have additional network interfaces")
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+
+		extraNICs = append(extraNICs, nicConfig{
+			VnicMAC:  strings.TrimSpace(extra.VnicMAC),
+			VnicIP:   strings.TrimSpace(extra.PrivateIP),
+			ConcIP:   strings.TrimSpace(extra.ConcentratorIP),
+			SubnetIP: strings.TrimSpace(extra.Subnet),
+			ConcUUID: strings.TrimSpace(extra.ConcentratorUUID),
+			VnicUUID: strings.TrimSpace(extra.VnicUUID),
+		})
+	}
+
 	var volumes []volumeConfig
 	for _, storage := range start.Storage {
 		if storage.ID != "" {
 			volumes = append(volumes, volumeConfig{
-				UUID:     storage.ID,
-				Bootable: storage.Bootable,
+				UUID:      storage.ID,
+				Bootable:  storage.Bootable,
+				BootIndex: storage.BootIndex,
+				Tag:       storage.Tag,
 			})
 		} else {
 			/* See github issue #972:
@@ -180,6 +205,7 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 		Volumes:     volumes,
 		Restart:     clouddata.Start.Restart,
 		Privileged:  privileged,
+		ExtraNICs:   extraNICs,
 	}, nil
 }
 
@@ -212,6 +238,34 @@ func generateAttachVolumeError(node, instance, volume string, ave *attachVolumeE
 	return yaml.Marshal(avf)
 }
 
+func generateDetachVolumeError(node, instance, volume string, dve *detachVolumeError) (out []byte, err error) {
+	dvf := &payloads.ErrorDetachVolumeFailure{
+		NodeUUID:     node,
+		InstanceUUID: instance,
+		VolumeUUID:   volume,
+		Reason:       dve.code,
+	}
+	return yaml.Marshal(dvf)
+}
+
+func generateMigrationError(node, instance string, me *migrationError) (out []byte, err error) {
+	mf := &payloads.ErrorMigrationFailure{
+		NodeUUID:     node,
+		InstanceUUID: instance,
+		Reason:       me.code,
+	}
+	return yaml.Marshal(mf)
+}
+
+func generateResizeError(node, instance string, re *resizeError) (out []byte, err error) {
+	rf := &payloads.ErrorResizeFailure{
+		NodeUUID:     node,
+		InstanceUUID: instance,
+		Reason:       re.code,
+	}
+	return yaml.Marshal(rf)
+}
+
 func generateNetEventPayload(ssntpEvent *libsnnet.SsntpEventInfo, agentUUID string) ([]byte, error) {
 	var event interface{}
 	var eventData *payloads.TenantAddedEvent
@@ -272,16 +326,97 @@ func extractVolumeInfo(cmd *payloads.VolumeCmd, errString string) (string, strin
 	return instance, volume, nil
 }
 
-func parseAttachVolumePayload(data []byte) (string, string, *payloadError) {
+func parseAttachVolumePayload(data []byte) (string, string, string, *payloadError) {
 	var clouddata payloads.AttachVolume
 
 	err := yaml.Unmarshal(data, &clouddata)
 	if err != nil {
 		glog.Errorf("YAML error: %v", err)
-		return "", "", &payloadError{err, payloads.AttachVolumeInvalidPayload}
+		return "", "", "", &payloadError{err, payloads.AttachVolumeInvalidPayload}
+	}
+
+	instance, volume, payloadErr := extractVolumeInfo(&clouddata.Attach, payloads.AttachVolumeInvalidData)
+	if payloadErr != nil {
+		return "", "", "", payloadErr
+	}
+
+	tag := clouddata.Attach.Tag
+	if tag != "" && !volumeTagRegexp.MatchString(tag) {
+		err = fmt.Errorf("Invalid volume tag received: %s", tag)
+		return "", "", "", &payloadError{err, payloads.AttachVolumeInvalidData}
+	}
+
+	return instance, volume, tag, nil
+}
+
+func parseDetachVolumePayload(data []byte) (string, string, *payloadError) {
+	var clouddata payloads.DetachVolume
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		glog.Errorf("YAML error: %v", err)
+		return "", "", &payloadError{err, payloads.DetachVolumeInvalidPayload}
+	}
+
+	return extractVolumeInfo(&clouddata.Detach, payloads.DetachVolumeInvalidData)
+}
+
+func extractMigrationInstance(instance string) (string, *payloadError) {
+	instance = strings.TrimSpace(instance)
+	if !uuidRegexp.MatchString(instance) {
+		err := fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", &payloadError{err, payloads.MigrationInvalidData}
+	}
+	return instance, nil
+}
+
+func parsePrepareMigrationPayload(data []byte) (string, *payloadError) {
+	var clouddata payloads.PrepareMigration
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		glog.Errorf("YAML error: %v", err)
+		return "", &payloadError{err, payloads.MigrationInvalidPayload}
+	}
+
+	return extractMigrationInstance(clouddata.Prepare.InstanceUUID)
+}
+
+func parseMigrateInstancePayload(data []byte) (string, *payloadError) {
+	var clouddata payloads.MigrateInstance
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		glog.Errorf("YAML error: %v", err)
+		return "", &payloadError{err, payloads.MigrationInvalidPayload}
+	}
+
+	return extractMigrationInstance(clouddata.Migrate.InstanceUUID)
+}
+
+func parseResizeInstancePayload(data []byte) (string, int, int, *payloadError) {
+	var clouddata payloads.ResizeInstance
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		glog.Errorf("YAML error: %v", err)
+		return "", 0, 0, &payloadError{err, payloads.ResizeInvalidPayload}
+	}
+
+	instance := strings.TrimSpace(clouddata.Resize.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		err = fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", 0, 0, &payloadError{err, payloads.ResizeInvalidData}
+	}
+
+	vcpus := clouddata.Resize.VCPUs
+	memMB := clouddata.Resize.MemMB
+	if vcpus <= 0 || memMB <= 0 {
+		err = fmt.Errorf("Invalid requirements received: %d vcpus %d MB", vcpus, memMB)
+		return instance, 0, 0, &payloadError{err, payloads.ResizeInvalidData}
 	}
 
-	return extractVolumeInfo(&clouddata.Attach, payloads.AttachVolumeInvalidData)
+	return instance, vcpus, memMB, nil
 }
 
 func linesToBytes(doc []string, buf *bytes.Buffer) {
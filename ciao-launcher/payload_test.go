@@ -18,6 +18,7 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	yaml "gopkg.in/yaml.v2"
@@ -27,6 +28,10 @@ import (
 	"github.com/ciao-project/ciao/testutil"
 )
 
+func bootIndex(i int) *int {
+	return &i
+}
+
 var startTests = []struct {
 	payload string
 	config  *vmConfig
@@ -67,8 +72,123 @@ start:
 			SSHPort:    35050,
 			Volumes: []volumeConfig{
 				{
-					"69e84267-ed01-4738-b15f-b47de06b62e7",
-					true,
+					UUID:     "69e84267-ed01-4738-b15f-b47de06b62e7",
+					Bootable: true,
+				},
+			},
+		},
+	},
+	{
+		`
+start:
+  requirements:
+    vcpus: 2
+    mem_mb: 370
+  instance_uuid: d7d86208-b46c-4465-9018-ee14087d415f
+  tenant_uuid: 67d86208-000-4465-9018-fe14087d415f
+  fw_type: legacy
+  vm_type: qemu
+  networking:
+    vnic_mac: 02:00:e6:f5:af:f9
+    vnic_uuid: 67d86208-b46c-0000-9018-fe14087d415f
+    concentrator_ip: 192.168.42.21
+    concentrator_uuid: 67d86208-b46c-4465-0000-fe14087d415f
+    subnet: 192.168.8.0/21
+    private_ip: 192.168.8.2
+  storage:
+     - id: 69e84267-ed01-4738-b15f-b47de06b62e7
+       boot: true
+       boot_index: 1
+     - id: 3a3b0b76-2c0f-4e05-bb0c-2bf4f4d0d7a1
+       boot: true
+       boot_index: 0
+     - id: 0c2f3ef4-9a7e-4a44-8f2b-8e1a2b7f6c51
+`,
+		&vmConfig{
+			Cpus:       2,
+			Mem:        370,
+			Instance:   "d7d86208-b46c-4465-9018-ee14087d415f",
+			Legacy:     true,
+			VnicMAC:    "02:00:e6:f5:af:f9",
+			VnicIP:     "192.168.8.2",
+			ConcIP:     "192.168.42.21",
+			SubnetIP:   "192.168.8.0/21",
+			TenantUUID: "67d86208-000-4465-9018-fe14087d415f",
+			ConcUUID:   "67d86208-b46c-4465-0000-fe14087d415f",
+			VnicUUID:   "67d86208-b46c-0000-9018-fe14087d415f",
+			SSHPort:    35050,
+			Volumes: []volumeConfig{
+				{
+					UUID:      "69e84267-ed01-4738-b15f-b47de06b62e7",
+					Bootable:  true,
+					BootIndex: bootIndex(1),
+				},
+				{
+					UUID:      "3a3b0b76-2c0f-4e05-bb0c-2bf4f4d0d7a1",
+					Bootable:  true,
+					BootIndex: bootIndex(0),
+				},
+				{
+					UUID: "0c2f3ef4-9a7e-4a44-8f2b-8e1a2b7f6c51",
+				},
+			},
+		},
+	},
+	{
+		`
+start:
+  requirements:
+    vcpus: 2
+    mem_mb: 370
+  instance_uuid: d7d86208-b46c-4465-9018-ee14087d415f
+  tenant_uuid: 67d86208-000-4465-9018-fe14087d415f
+  fw_type: legacy
+  vm_type: qemu
+  networking:
+    vnic_mac: 02:00:e6:f5:af:f9
+    vnic_uuid: 67d86208-b46c-0000-9018-fe14087d415f
+    concentrator_ip: 192.168.42.21
+    concentrator_uuid: 67d86208-b46c-4465-0000-fe14087d415f
+    subnet: 192.168.8.0/21
+    private_ip: 192.168.8.2
+  extra_networking:
+    - vnic_mac: 02:00:c0:a8:10:02
+      vnic_uuid: 67d86208-b46c-0000-9018-fe14087d4160
+      concentrator_ip: 192.168.42.22
+      concentrator_uuid: 67d86208-b46c-4465-0000-fe14087d4160
+      subnet: 192.168.16.0/21
+      private_ip: 192.168.16.2
+  storage:
+     - id: 69e84267-ed01-4738-b15f-b47de06b62e7
+       boot: true
+`,
+		&vmConfig{
+			Cpus:       2,
+			Mem:        370,
+			Instance:   "d7d86208-b46c-4465-9018-ee14087d415f",
+			Legacy:     true,
+			VnicMAC:    "02:00:e6:f5:af:f9",
+			VnicIP:     "192.168.8.2",
+			ConcIP:     "192.168.42.21",
+			SubnetIP:   "192.168.8.0/21",
+			TenantUUID: "67d86208-000-4465-9018-fe14087d415f",
+			ConcUUID:   "67d86208-b46c-4465-0000-fe14087d415f",
+			VnicUUID:   "67d86208-b46c-0000-9018-fe14087d415f",
+			SSHPort:    35050,
+			Volumes: []volumeConfig{
+				{
+					UUID:     "69e84267-ed01-4738-b15f-b47de06b62e7",
+					Bootable: true,
+				},
+			},
+			ExtraNICs: []nicConfig{
+				{
+					VnicMAC:  "02:00:c0:a8:10:02",
+					VnicIP:   "192.168.16.2",
+					ConcIP:   "192.168.42.22",
+					SubnetIP: "192.168.16.0/21",
+					ConcUUID: "67d86208-b46c-4465-0000-fe14087d4160",
+					VnicUUID: "67d86208-b46c-0000-9018-fe14087d4160",
 				},
 			},
 		},
@@ -141,6 +261,33 @@ start:
   storage:
      - id: 69e84267-ed01-4738-b15f-b47de06b62e7
        boot: true
+`,
+		nil,
+	},
+	{
+		`
+start:
+  requirements:
+    vcpus: 2
+    mem_mb: 370
+  instance_uuid: d7d86208-b46c-4465-9018-ee14087d415f
+  tenant_uuid: 67d86208-000-4465-9018-fe14087d415f
+  vm_type: docker
+  docker_image: ubuntu
+  networking:
+    vnic_mac: 02:00:e6:f5:af:f9
+    vnic_uuid: 67d86208-b46c-0000-9018-fe14087d415f
+    concentrator_ip: 192.168.42.21
+    concentrator_uuid: 67d86208-b46c-4465-0000-fe14087d415f
+    subnet: 192.168.8.0/21
+    private_ip: 192.168.8.2
+  extra_networking:
+    - vnic_mac: 02:00:c0:a8:10:02
+      vnic_uuid: 67d86208-b46c-0000-9018-fe14087d4160
+      concentrator_ip: 192.168.42.22
+      concentrator_uuid: 67d86208-b46c-4465-0000-fe14087d4160
+      subnet: 192.168.16.0/21
+      private_ip: 192.168.16.2
 `,
 		nil,
 	},
@@ -148,38 +295,155 @@ start:
 
 // Verify the parseAttachVolumePayload function.
 //
-// The function is passed one valid payload and two invalid payloads.
+// The function is passed two valid payloads, the second of which tags the
+// volume, and three invalid payloads, the last of which has a tag that
+// cannot be used as a serial number.
 //
-// No error should be returned for the valid payload and the returned instance
-// and volume UUIDs should match what is in the payload.  Errors should be
-// returned for the invalid payloads.
+// No error should be returned for the valid payloads and the returned instance
+// and volume UUIDs and tag should match what is in the payload.  Errors should
+// be returned for the invalid payloads.
 func TestParseAttachVolumePayload(t *testing.T) {
-	instance, volume, err := parseAttachVolumePayload([]byte(testutil.AttachVolumeYaml))
+	instance, volume, tag, err := parseAttachVolumePayload([]byte(testutil.AttachVolumeYaml))
 	if err != nil {
 		t.Fatalf("parseAttachVolumePayload failed: %v", err)
 	}
-	if instance != testutil.InstanceUUID || volume != testutil.VolumeUUID {
-		t.Fatalf("VolumeUUID or InstanceUUID is invalid")
+	if instance != testutil.InstanceUUID || volume != testutil.VolumeUUID || tag != "" {
+		t.Fatalf("VolumeUUID, InstanceUUID or tag is invalid")
+	}
+
+	_, _, tag, err = parseAttachVolumePayload([]byte(testutil.AttachVolumeTagYaml))
+	if err != nil {
+		t.Fatalf("parseAttachVolumePayload failed: %v", err)
+	}
+	if tag != "data" {
+		t.Fatalf("Unexpected tag %s", tag)
 	}
 
-	_, _, err = parseAttachVolumePayload([]byte("  -"))
+	_, _, _, err = parseAttachVolumePayload([]byte("  -"))
 	if err == nil || err.code != payloads.AttachVolumeInvalidPayload {
 		t.Fatalf("AttachVolumeInvalidPayload error expected")
 	}
 
-	_, _, err = parseAttachVolumePayload([]byte(testutil.BadAttachVolumeYaml))
+	_, _, _, err = parseAttachVolumePayload([]byte(testutil.BadAttachVolumeYaml))
 	if err == nil || err.code != payloads.AttachVolumeInvalidData {
 		t.Fatalf("AttachVolumeInvalidData error expected")
 	}
+
+	badTag := strings.Replace(testutil.AttachVolumeTagYaml, "tag: data", "tag: data,serial=x", 1)
+	_, _, _, err = parseAttachVolumePayload([]byte(badTag))
+	if err == nil || err.code != payloads.AttachVolumeInvalidData {
+		t.Fatalf("AttachVolumeInvalidData error expected for bad tag")
+	}
+}
+
+// Verify the parsePrepareMigrationPayload and parseMigrateInstancePayload
+// functions.
+//
+// Each function is passed a valid payload, a corrupt payload and a payload
+// with an invalid instance UUID.
+//
+// The instance UUID should be returned for the valid payloads and the
+// appropriate errors for the others.
+func TestParseMigrationPayloads(t *testing.T) {
+	parsers := []struct {
+		parse   func([]byte) (string, *payloadError)
+		payload string
+	}{
+		{parsePrepareMigrationPayload, testutil.PrepareMigrationYaml},
+		{parseMigrateInstancePayload, testutil.MigrateInstanceYaml},
+	}
+
+	for i, p := range parsers {
+		instance, err := p.parse([]byte(p.payload))
+		if err != nil {
+			t.Fatalf("parser %d failed: %v", i, err)
+		}
+		if instance != testutil.InstanceUUID {
+			t.Fatalf("parser %d: InstanceUUID is invalid", i)
+		}
+
+		_, err = p.parse([]byte("  -"))
+		if err == nil || err.code != payloads.MigrationInvalidPayload {
+			t.Fatalf("parser %d: MigrationInvalidPayload error expected", i)
+		}
+
+		bad := strings.Replace(p.payload, testutil.InstanceUUID, "x!", 1)
+		_, err = p.parse([]byte(bad))
+		if err == nil || err.code != payloads.MigrationInvalidData {
+			t.Fatalf("parser %d: MigrationInvalidData error expected", i)
+		}
+	}
+}
+
+// Verify the parseResizeInstancePayload function.
+//
+// The function is passed a valid payload, a corrupt payload, a payload with
+// an invalid instance UUID and a payload with no memory requirement.
+//
+// The instance UUID and requirements should be returned for the valid
+// payload and the appropriate errors for the others.
+func TestParseDetachVolumePayload(t *testing.T) {
+	instance, volume, err := parseDetachVolumePayload([]byte(testutil.DetachVolumeYaml))
+	if err != nil {
+		t.Fatalf("parseDetachVolumePayload failed: %v", err)
+	}
+	if instance != testutil.InstanceUUID || volume != testutil.VolumeUUID {
+		t.Fatalf("VolumeUUID or InstanceUUID is invalid")
+	}
+
+	_, _, err = parseDetachVolumePayload([]byte("  -"))
+	if err == nil || err.code != payloads.DetachVolumeInvalidPayload {
+		t.Fatalf("DetachVolumeInvalidPayload error expected")
+	}
+
+	bad := strings.Replace(testutil.DetachVolumeYaml, testutil.VolumeUUID, "x!", 1)
+	_, _, err = parseDetachVolumePayload([]byte(bad))
+	if err == nil || err.code != payloads.DetachVolumeInvalidData {
+		t.Fatalf("DetachVolumeInvalidData error expected")
+	}
+}
+
+func TestParseResizeInstancePayload(t *testing.T) {
+	instance, vcpus, memMB, err := parseResizeInstancePayload([]byte(testutil.ResizeInstanceYaml))
+	if err != nil {
+		t.Fatalf("parseResizeInstancePayload failed: %v", err)
+	}
+	if instance != testutil.InstanceUUID || vcpus != 4 || memMB != 2048 {
+		t.Fatalf("InstanceUUID or requirements are invalid")
+	}
+
+	_, _, _, err = parseResizeInstancePayload([]byte("  -"))
+	if err == nil || err.code != payloads.ResizeInvalidPayload {
+		t.Fatalf("ResizeInvalidPayload error expected")
+	}
+
+	bad := strings.Replace(testutil.ResizeInstanceYaml, testutil.InstanceUUID, "x!", 1)
+	_, _, _, err = parseResizeInstancePayload([]byte(bad))
+	if err == nil || err.code != payloads.ResizeInvalidData {
+		t.Fatalf("ResizeInvalidData error expected for bad instance")
+	}
+
+	bad = strings.Replace(testutil.ResizeInstanceYaml, "mem_mb: 2048", "mem_mb: 0", 1)
+	instance, _, _, err = parseResizeInstancePayload([]byte(bad))
+	if err == nil || err.code != payloads.ResizeInvalidData {
+		t.Fatalf("ResizeInvalidData error expected for bad requirements")
+	}
+	if instance != testutil.InstanceUUID {
+		t.Fatalf("InstanceUUID expected with bad requirements")
+	}
 }
 
 // Verify the parseStartPayload function.
 //
-// The function is passed one valid payload and a number of invalid payloads.
+// The function is passed three valid payloads, the second of which orders its
+// volumes for booting and the third of which has an additional network
+// interface, and a number of invalid payloads, including a container with
+// an additional network interface.
 //
-// No error should be returned for the valid payload.  The resulting vmConfig
-// structure should match the handcrafted structure associated with the
-// payload.  The invalid payloads should fail to parse.
+// No error should be returned for the valid payloads.  The resulting vmConfig
+// structures should match the handcrafted structures associated with the
+// payloads, with the volumes in the order given by the payload.  The invalid
+// payloads should fail to parse.
 func TestParseStartPayload(t *testing.T) {
 	for i, st := range startTests {
 		cfg, err := parseStartPayload([]byte(st.payload))
@@ -0,0 +1,135 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func parsePrefetchImagePayload(data []byte) (string, error) {
+	var clouddata payloads.PrefetchImage
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", err
+	}
+
+	image := clouddata.Prefetch.ImageUUID
+	if !uuidRegexp.MatchString(image) {
+		return "", fmt.Errorf("Invalid image UUID received: %s", image)
+	}
+
+	return image, nil
+}
+
+// copyImage copies the mapped image at src to dst.  The image is written
+// to a temporary file first so that a partial copy is never mistaken for a
+// cached image.
+func copyImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Unable to open image: %v", err)
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := ioutil.TempFile(path.Dir(dst), ".prefetch-")
+	if err != nil {
+		return fmt.Errorf("Unable to create image file: %v", err)
+	}
+	defer func() { _ = os.Remove(out.Name()) }()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return fmt.Errorf("Unable to copy image: %v", err)
+	}
+
+	err = out.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to write image: %v", err)
+	}
+
+	return os.Rename(out.Name(), dst)
+}
+
+// cacheImage copies an image into cacheDir, unless it has already been
+// cached there.
+func cacheImage(storageDriver storage.BlockDriver, cacheDir, image string) error {
+	imagePath := path.Join(cacheDir, image)
+	if _, err := os.Stat(imagePath); err == nil {
+		glog.Infof("Image %s already cached", image)
+		return nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("Unable to create image cache %s: %v", cacheDir, err)
+	}
+
+	devPath, err := storageDriver.MapVolumeToNode(image)
+	if err != nil {
+		return fmt.Errorf("Unable to map image: %v", err)
+	}
+	defer func() {
+		if err := storageDriver.UnmapVolumeFromNode(image); err != nil {
+			glog.Warningf("Unable to unmap image %s: %v", image, err)
+		}
+	}()
+
+	return copyImage(devPath, imagePath)
+}
+
+// prefetchImage caches an image ahead of the first launch from it and
+// reports to the controller whether the image was cached.
+func prefetchImage(conn serverConn, image string) {
+	var e payloads.EventImagePrefetchReport
+
+	storageDriver := storage.CephDriver{
+		ID: cephID,
+	}
+
+	e.Report.NodeUUID = conn.UUID()
+	e.Report.ImageUUID = image
+
+	if !simulate {
+		glog.Infof("Prefetching image %s", image)
+		if err := cacheImage(storageDriver, imagesDir, image); err != nil {
+			glog.Errorf("Unable to prefetch image %s: %v", image, err)
+			e.Report.Reason = err.Error()
+		}
+	}
+
+	payload, err := yaml.Marshal(&e)
+	if err != nil {
+		glog.Errorf("Unable to Marshall ImagePrefetchReport %v", err)
+		return
+	}
+
+	_, err = conn.SendEvent(ssntp.ImagePrefetchReport, payload)
+	if err != nil {
+		glog.Errorf("Failed to send ImagePrefetchReport event %v", err)
+	}
+}
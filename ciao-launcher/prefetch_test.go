@@ -0,0 +1,148 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// prefetchTestStorage maps images to a file holding their contents.
+type prefetchTestStorage struct {
+	dockerTestStorage
+	device   string
+	mapped   *int
+	unmapped *int
+}
+
+func (s prefetchTestStorage) MapVolumeToNode(volumeUUID string) (string, error) {
+	if s.device == "" {
+		return "", fmt.Errorf("MapVolumeToNode failure forced")
+	}
+	*s.mapped++
+	return s.device, nil
+}
+
+func (s prefetchTestStorage) UnmapVolumeFromNode(volumeUUID string) error {
+	*s.unmapped++
+	return nil
+}
+
+// Check that images are copied into the cache.
+//
+// Create a file to act as the mapped image and cache it twice.
+//
+// The image should be mapped, copied into the cache and unmapped the first
+// time, and found in the cache the second time.
+func TestCacheImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	device := path.Join(dir, "device")
+	err = ioutil.WriteFile(device, []byte("image data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mapped, unmapped int
+	s := prefetchTestStorage{device: device, mapped: &mapped, unmapped: &unmapped}
+	cacheDir := path.Join(dir, "images")
+
+	for i := 0; i < 2; i++ {
+		err = cacheImage(s, cacheDir, testutil.ImageUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if mapped != 1 || unmapped != 1 {
+		t.Errorf("Expected image to be mapped and unmapped once, got %d %d", mapped, unmapped)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(cacheDir, testutil.ImageUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "image data" {
+		t.Errorf("Unexpected cached image contents [%s]", string(data))
+	}
+
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("Expected only the cached image, found %d files", len(files))
+	}
+}
+
+// Check that an image which cannot be mapped is not cached.
+//
+// Cache an image with a storage driver which fails to map it.
+//
+// An error should be returned and nothing left in the cache.
+func TestCacheImageMapFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var mapped, unmapped int
+	s := prefetchTestStorage{mapped: &mapped, unmapped: &unmapped}
+
+	err = cacheImage(s, dir, testutil.ImageUUID)
+	if err == nil {
+		t.Fatal("Expected image caching to fail")
+	}
+
+	if _, err := os.Stat(path.Join(dir, testutil.ImageUUID)); err == nil {
+		t.Error("Image cached after a failure")
+	}
+}
+
+// Check that PrefetchImage payloads are parsed.
+//
+// Parse a valid payload and one with an invalid image UUID.
+//
+// The image UUID should be returned for the first and an error for the
+// second.
+func TestParsePrefetchImagePayload(t *testing.T) {
+	image, err := parsePrefetchImagePayload([]byte(testutil.PrefetchImageYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image != testutil.ImageUUID {
+		t.Errorf("Expected image %s, got %s", testutil.ImageUUID, image)
+	}
+
+	_, err = parsePrefetchImagePayload([]byte("prefetch_image:\n  image_uuid: ../../etc\n"))
+	if err == nil {
+		t.Error("Expected invalid image UUID to be rejected")
+	}
+}
@@ -38,7 +38,12 @@ import (
 const (
 	qemuEfiFw = "/usr/share/qemu/OVMF.fd"
 	seedImage = "seed.iso"
-	vcTries   = 10
+
+	// consoleLogFile, in the instance directory, receives the output of
+	// the serial console of the VM.  It is truncated each time the VM is
+	// started.
+	consoleLogFile = "console.log"
+	vcTries        = 10
 )
 
 type qmpGlogLogger struct{}
@@ -210,7 +215,9 @@ func computeMacvtapParam(vnicName string, mac string, queues int) ([]string, []*
 	return params, fds, nil
 }
 
-func computeTapParam(infds []*os.File, vnicName, mac string) ([]string, []*os.File, []*os.File, error) {
+// computeTapParam returns the qemu parameters for a tap device, along with the
+// files qemu is to be passed, which follow fdBase other files.
+func computeTapParam(infds []*os.File, vnicName, mac string, fdBase int) ([]string, []*os.File, []*os.File, error) {
 	var fdParam bytes.Buffer
 	var vhostFdParam bytes.Buffer
 
@@ -231,8 +238,8 @@ func computeTapParam(infds []*os.File, vnicName, mac string) ([]string, []*os.Fi
 		toClose[i] = f
 		fds[(i*2)+1] = f
 
-		_, _ = fdParam.WriteString(fmt.Sprintf("%s%d", fdSeperator, (i*2)+3))
-		_, _ = vhostFdParam.WriteString(fmt.Sprintf("%s%d", fdSeperator, (i*2)+3+1))
+		_, _ = fdParam.WriteString(fmt.Sprintf("%s%d", fdSeperator, fdBase+(i*2)+3))
+		_, _ = vhostFdParam.WriteString(fmt.Sprintf("%s%d", fdSeperator, fdBase+(i*2)+3+1))
 		fdSeperator = ":"
 
 	}
@@ -247,7 +254,7 @@ func computeTapParam(infds []*os.File, vnicName, mac string) ([]string, []*os.Fi
 	return params, fds, toClose, nil
 }
 
-func launchQemuWithNC(params []string, fds []*os.File, ipAddress string) (int, error) {
+func launchQemuWithNC(params []string, fds []*os.File, ipAddress, consoleLog string) (int, error) {
 	var err error
 
 	tries := 0
@@ -259,8 +266,8 @@ func launchQemuWithNC(params []string, fds []*os.File, ipAddress string) (int, e
 		if port == 0 {
 			break
 		}
-		ncString := "socket,port=%d,host=%s,server,id=gnc0,server,nowait"
-		params[len(params)-1] = fmt.Sprintf(ncString, port, ipAddress)
+		ncString := "socket,port=%d,host=%s,server,id=gnc0,server,nowait,logfile=%s"
+		params[len(params)-1] = fmt.Sprintf(ncString, port, ipAddress, consoleLog)
 		var errStr string
 
 		errStr, err = qemu.LaunchCustomQemu(context.Background(), "", params,
@@ -281,7 +288,8 @@ func launchQemuWithNC(params []string, fds []*os.File, ipAddress string) (int, e
 
 	if port == 0 || (err != nil && tries == vcTries) {
 		glog.Warning("Failed to launch qemu due to chardev error.  Relaunching without virtual console")
-		_, err = qemu.LaunchCustomQemu(context.Background(), "", params[:len(params)-4], fds, childProcessKVMCreds, qmpGlogLogger{})
+		params = append(params[:len(params)-4], "-serial", "file:"+consoleLog)
+		_, err = qemu.LaunchCustomQemu(context.Background(), "", params, fds, childProcessKVMCreds, qmpGlogLogger{})
 	}
 
 	return port, err
@@ -347,12 +355,21 @@ func generateQEMULaunchParams(cfg *vmConfig, isoPath, instanceDir string,
 			v.UUID, cephID, blockdevID)
 		params = append(params, "-drive", volDriveStr)
 		volDeviceStr :=
-			fmt.Sprintf("virtio-blk-pci,scsi=off,bus=pci.0,addr=0x%x,id=device_%s,drive=%s",
-				addr, v.UUID, blockdevID)
+			fmt.Sprintf("virtio-blk-pci,scsi=off,bus=pci.0,addr=0x%x,id=device_%s,drive=%s,serial=%s",
+				addr, v.UUID, blockdevID, v.serial())
+		if v.BootIndex != nil {
+			volDeviceStr += fmt.Sprintf(",bootindex=%d", *v.BootIndex)
+		}
 		params = append(params, "-device", volDeviceStr)
 		addr++
 	}
 
+	// Only boot from the volumes the workload ordered, rather than
+	// falling back to the remaining devices.
+	if cfg.haveBootOrder() {
+		params = append(params, "-boot", "strict=on")
+	}
+
 	isoParam := fmt.Sprintf("file=%s,if=virtio,media=cdrom", isoPath)
 	params = append(params, "-drive", isoParam)
 
@@ -398,7 +415,7 @@ func generateQEMULaunchParams(cfg *vmConfig, isoPath, instanceDir string,
 	return params
 }
 
-func (q *qemuV) startVM(vnicName, ipAddress, cephID string, fds []*os.File) error {
+func (q *qemuV) startVM(vnicName, ipAddress, cephID string, fds []*os.File, extra []extraVnic) error {
 
 	glog.Info("Launching qemu")
 
@@ -420,12 +437,23 @@ func (q *qemuV) startVM(vnicName, ipAddress, cephID string, fds []*os.File) erro
 			var err error
 			var tapParam []string
 			var toClose []*os.File
-			tapParam, fds, toClose, err = computeTapParam(fds, vnicName, q.cfg.VnicMAC)
+			tapParam, fds, toClose, err = computeTapParam(fds, vnicName, q.cfg.VnicMAC, 0)
 			if err != nil {
 				return err
 			}
 			networkParams = append(networkParams, tapParam...)
 			defer cleanupFds(toClose, len(toClose))
+
+			for _, e := range extra {
+				var extraFds []*os.File
+				tapParam, extraFds, toClose, err = computeTapParam(e.fds, e.name, e.mac, len(fds))
+				if err != nil {
+					return err
+				}
+				networkParams = append(networkParams, tapParam...)
+				fds = append(fds, extraFds...)
+				defer cleanupFds(toClose, len(toClose))
+			}
 		}
 	} else {
 		networkParams = append(networkParams, "-net", "nic,model=virtio")
@@ -436,18 +464,22 @@ func (q *qemuV) startVM(vnicName, ipAddress, cephID string, fds []*os.File) erro
 
 	var err error
 
+	consoleLog := path.Join(q.instanceDir, consoleLogFile)
+
 	if !launchWithUI.Enabled() {
 		params = append(params, "-display", "none", "-vga", "none")
+		params = append(params, "-serial", "file:"+consoleLog)
 		_, err = qemu.LaunchCustomQemu(context.Background(), "", params, fds, childProcessKVMCreds, qmpGlogLogger{})
 	} else if launchWithUI.String() == "spice" {
 		var port int
+		params = append(params, "-serial", "file:"+consoleLog)
 		port, err = launchQemuWithSpice(params, fds, ipAddress)
 		if err == nil {
 			q.vcPort = port
 		}
 	} else {
 		var port int
-		port, err = launchQemuWithNC(params, fds, ipAddress)
+		port, err = launchQemuWithNC(params, fds, ipAddress, consoleLog)
 		if err == nil {
 			q.vcPort = port
 		}
@@ -475,19 +507,13 @@ func (q *qemuV) lostVM() {
 func qmpAttach(cmd virtualizerAttachCmd, q *qemu.QMP) {
 	glog.Info("Attach command received")
 
-	// Versions of qemu 2.9 and greater have a 31 byte limit on the size of
-	// IDs used to identify block devices.  We form our ID by appending the
-	// the volumeUUID with the '-'s and the final 3 characters removed, to the
-	// constant string "d_".  Drive names are not allowed to start with numbers.
-
-	blockdevID := fmt.Sprintf("d_%s", strings.Replace(cmd.volumeUUID, "-", "", -1))
-	if len(blockdevID) > 31 {
-		blockdevID = blockdevID[:31]
-	}
+	blockdevID := qmpBlockdevID(cmd.volumeUUID)
 	err := q.ExecuteBlockdevAdd(context.Background(), cmd.device, blockdevID)
 	if err != nil {
 		glog.Errorf("Failed to execute blockdev-add: %v", err)
 	} else {
+		// govmm cannot give the hotplugged disk a serial number.  The
+		// disk receives one when the instance is next restarted.
 		devID := fmt.Sprintf("device_%s", cmd.volumeUUID)
 		err = q.ExecuteDeviceAdd(context.Background(), blockdevID,
 			devID, "virtio-blk-pci", "")
@@ -501,6 +527,42 @@ func qmpAttach(cmd virtualizerAttachCmd, q *qemu.QMP) {
 	cmd.responseCh <- err
 }
 
+// qmpBlockdevID returns the ID of the block device added for a hotplugged
+// volume.  Versions of qemu 2.9 and greater have a 31 byte limit on the
+// size of IDs used to identify block devices.  We form our ID by appending
+// the the volumeUUID with the '-'s and the final 3 characters removed, to
+// the constant string "d_".  Drive names are not allowed to start with
+// numbers.
+func qmpBlockdevID(volumeUUID string) string {
+	blockdevID := fmt.Sprintf("d_%s", strings.Replace(volumeUUID, "-", "", -1))
+	if len(blockdevID) > 31 {
+		blockdevID = blockdevID[:31]
+	}
+	return blockdevID
+}
+
+func qmpDetach(cmd virtualizerDetachCmd, q *qemu.QMP) {
+	glog.Info("Detach command received")
+
+	// The guest must release the disk before the device is removed, which
+	// it may refuse to do.
+	ctx, cancelFN := context.WithTimeout(context.Background(), time.Second*30)
+	devID := fmt.Sprintf("device_%s", cmd.volumeUUID)
+	err := q.ExecuteDeviceDel(ctx, devID)
+	cancelFN()
+	if err != nil {
+		glog.Errorf("Failed to execute device_del: %v", err)
+	} else if cmd.hotplugged {
+		// Drives given on the command line are removed along with
+		// their devices but those added by blockdev-add are not.
+		blockdevID := qmpBlockdevID(cmd.volumeUUID)
+		if err := q.ExecuteBlockdevDel(context.Background(), blockdevID); err != nil {
+			glog.Warningf("Failed to remove block device : %v", err)
+		}
+	}
+	cmd.responseCh <- err
+}
+
 func qmpConnect(qmpChannel chan interface{}, instance, instanceDir string, closedCh chan struct{},
 	connectedCh chan struct{}, wg *sync.WaitGroup, boot bool) {
 
@@ -553,6 +615,8 @@ DONE:
 			}
 		case virtualizerAttachCmd:
 			qmpAttach(cmd, q)
+		case virtualizerDetachCmd:
+			qmpDetach(cmd, q)
 		}
 	}
 }
@@ -88,6 +88,62 @@ func TestGenerateQEMULaunchParams(t *testing.T) {
 	}
 }
 
+// Verify that generateQEMULaunchParams applies the boot order of the volumes.
+//
+// generateQEMULaunchParams is called with three volumes, two of which have a
+// boot index, and then with the same volumes without indexes.
+//
+// The indexed volumes' devices should carry their bootindex and qemu should
+// be told to boot from them alone.  No bootindex or -boot parameters should
+// be generated for the unindexed volumes.
+func TestGenerateQEMULaunchParamsBootOrder(t *testing.T) {
+	cfg := vmConfig{
+		Legacy: true,
+		Volumes: []volumeConfig{
+			{UUID: "vol1", Bootable: true, BootIndex: bootIndex(1)},
+			{UUID: "vol2", Bootable: true, BootIndex: bootIndex(0)},
+			{UUID: "vol3"},
+		},
+	}
+
+	addr := 3
+	if launchWithUI.String() == "spice" {
+		addr = 4
+	}
+
+	volParams := func(indexes ...string) []string {
+		var params []string
+		for i, v := range cfg.Volumes {
+			params = append(params, "-drive",
+				fmt.Sprintf("file=rbd:rbd/%s:id=ciao,if=none,id=drive_%s,format=raw", v.UUID, v.UUID))
+			params = append(params, "-device",
+				fmt.Sprintf("virtio-blk-pci,scsi=off,bus=pci.0,addr=0x%x,id=device_%s,drive=drive_%s,serial=%s%s",
+					addr+i, v.UUID, v.UUID, v.UUID, indexes[i]))
+		}
+		return params
+	}
+
+	params := volParams(",bootindex=1", ",bootindex=0", "")
+	params = append(params, "-boot", "strict=on")
+	params = append(params, genQEMUParams(nil)...)
+	genParams := generateQEMULaunchParams(&cfg, "/var/lib/ciao/instance/1/seed.iso",
+		"/var/lib/ciao/instance/1", nil, "ciao")
+	if !reflect.DeepEqual(params, genParams) {
+		t.Fatalf("%s and %s do not match", params, genParams)
+	}
+
+	for i := range cfg.Volumes {
+		cfg.Volumes[i].BootIndex = nil
+	}
+
+	params = append(volParams("", "", ""), genQEMUParams(nil)...)
+	genParams = generateQEMULaunchParams(&cfg, "/var/lib/ciao/instance/1/seed.iso",
+		"/var/lib/ciao/instance/1", nil, "ciao")
+	if !reflect.DeepEqual(params, genParams) {
+		t.Fatalf("%s and %s do not match", params, genParams)
+	}
+}
+
 func TestQmpConnectBadSocket(t *testing.T) {
 	var wg sync.WaitGroup
 	qmpChannel := make(chan interface{})
@@ -208,3 +264,41 @@ func TestQmpLost(t *testing.T) {
 		return false
 	})
 }
+
+// Verify that volumes are given the expected serial numbers and devices.
+//
+// The serial and guest device of a tagged volume, an untagged volume, a
+// volume with a tag which is not a valid serial number and a hotplugged
+// volume are checked, as is the device of a container volume.
+//
+// Tagged volumes should use their tag as their serial number and the others
+// the start of their UUID.  Hotplugged volumes should have no device.
+func TestVolumeSerial(t *testing.T) {
+	const UUID = "67d86208-b46c-4465-9018-e14187d40103"
+
+	tests := []struct {
+		vol    volumeConfig
+		serial string
+		device string
+	}{
+		{volumeConfig{UUID: UUID, Tag: "data"}, "data", "/dev/disk/by-id/virtio-data"},
+		{volumeConfig{UUID: UUID}, UUID[:20], "/dev/disk/by-id/virtio-" + UUID[:20]},
+		{volumeConfig{UUID: UUID, Tag: "my data"}, UUID[:20], "/dev/disk/by-id/virtio-" + UUID[:20]},
+		{volumeConfig{UUID: UUID, Tag: "data", Hotplugged: true}, "data", ""},
+	}
+
+	for _, test := range tests {
+		if serial := test.vol.serial(); serial != test.serial {
+			t.Errorf("Expected serial %s got %s", test.serial, serial)
+		}
+
+		if device := test.vol.guestDevice(false); device != test.device {
+			t.Errorf("Expected device %s got %s", test.device, device)
+		}
+	}
+
+	vol := volumeConfig{UUID: UUID, Tag: "data"}
+	if device := vol.guestDevice(true); device != "/volumes/"+UUID {
+		t.Errorf("Unexpected container device %s", device)
+	}
+}
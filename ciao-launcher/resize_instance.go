@@ -0,0 +1,119 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"github.com/ciao-project/ciao/networking/libsnnet"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// processResize restarts a powered down VM with new vcpu and memory
+// requirements.  The requirements are saved in the configuration of the
+// instance so that it keeps them if launcher is restarted.  The vnics of
+// the instance must have been destroyed when it was powered down.
+func processResize(vm virtualizer, cfg *vmConfig, instanceDir string, conn serverConn,
+	vcpus, memMB int) *resizeError {
+	var vnicName string
+	var vnicCfg *libsnnet.VnicConfig
+	var extraCfgs []*libsnnet.VnicConfig
+	var extra []extraVnic
+	var fds []*os.File
+	var err error
+
+	cfg.Cpus = vcpus
+	cfg.Mem = memMB
+
+	err = cfg.save(instanceDir)
+	if err != nil {
+		return &resizeError{err, payloads.ResizeRestartFailure}
+	}
+
+	vm.init(cfg, instanceDir)
+
+	if networking {
+		vnicCfg, err = createVnicCfg(cfg)
+		if err != nil {
+			glog.Errorf("Could not create VnicCFG: %s", err)
+			return &resizeError{err, payloads.ResizeRestartFailure}
+		}
+
+		extraCfgs, err = createExtraVnicCfgs(cfg)
+		if err != nil {
+			glog.Errorf("Could not create VnicCFG: %s", err)
+			return &resizeError{err, payloads.ResizeRestartFailure}
+		}
+	}
+
+	if vnicCfg != nil {
+		vnicName, _, _, fds, err = createVnic(conn, vnicCfg)
+		if err != nil {
+			return &resizeError{err, payloads.ResizeRestartFailure}
+		}
+		defer func() {
+			for _, f := range fds {
+				_ = f.Close()
+			}
+		}()
+
+		extra, err = createExtraVnics(conn, extraCfgs)
+		if err != nil {
+			destroyVnic(conn, vnicCfg)
+			return &resizeError{err, payloads.ResizeRestartFailure}
+		}
+		defer func() {
+			for _, e := range extra {
+				cleanupFds(e.fds, len(e.fds))
+			}
+		}()
+	}
+
+	err = vm.startVM(vnicName, getNodeIPAddress(), cephID, fds, extra)
+	if err != nil {
+		if vnicCfg != nil {
+			destroyVnic(conn, vnicCfg)
+			destroyVnics(conn, extraCfgs)
+		}
+		return &resizeError{err, payloads.ResizeRestartFailure}
+	}
+
+	return nil
+}
+
+func (id *instanceData) sendInstanceResizedEvent() {
+	var event payloads.EventInstanceResized
+
+	event.Resized.NodeUUID = id.ac.conn.UUID()
+	event.Resized.InstanceUUID = id.instance
+	event.Resized.VCPUs = id.cfg.Cpus
+	event.Resized.MemMB = id.cfg.Mem
+
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		glog.Errorf("Unable to Marshall InstanceResized %v", err)
+		return
+	}
+	_, err = id.ac.conn.SendEvent(ssntp.InstanceResized, payload)
+	if err != nil {
+		glog.Errorf("Failed to send event command %v", err)
+		return
+	}
+}
@@ -94,7 +94,7 @@ VM:
 
 }
 
-func (s *simulation) startVM(vnicName, ipAddress, cephID string, fds []*os.File) error {
+func (s *simulation) startVM(vnicName, ipAddress, cephID string, fds []*os.File, extra []extraVnic) error {
 	glog.Infof("startVM\n")
 
 	s.killCh = make(chan struct{})
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -32,6 +33,16 @@ type cmdWrapper struct {
 type statusCmd struct{}
 type evacuateCmd struct{}
 type restoreCmd struct{}
+type inventoryCmd struct{}
+type prefetchCmd struct {
+	image string
+}
+type consoleLogCmd struct {
+	instance  string
+	requestID string
+	length    int
+	err       error
+}
 
 // serverConn is an abstract interface representing a connection to
 // a server.  It contains methods to connect to the server and to
@@ -125,7 +136,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insDeleteCmd{stop: stop}}
 	case ssntp.AttachVolume:
-		instance, volume, payloadErr := parseAttachVolumePayload(payload)
+		instance, volume, tag, payloadErr := parseAttachVolumePayload(payload)
 		if payloadErr != nil {
 			attachVolumeError := &attachVolumeError{
 				payloadErr.err,
@@ -135,11 +146,76 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
 			return
 		}
-		client.cmdCh <- &cmdWrapper{instance, &insAttachVolumeCmd{volume}}
+		client.cmdCh <- &cmdWrapper{instance, &insAttachVolumeCmd{volume, tag}}
+	case ssntp.DetachVolume:
+		instance, volume, payloadErr := parseDetachVolumePayload(payload)
+		if payloadErr != nil {
+			detachVolumeError := &detachVolumeError{
+				payloadErr.err,
+				payloads.DetachVolumeFailureReason(payloadErr.code),
+			}
+			detachVolumeError.send(client.conn, "", "")
+			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, &insDetachVolumeCmd{volume}}
 	case ssntp.EVACUATE:
 		client.cmdCh <- &cmdWrapper{"", &evacuateCmd{}}
 	case ssntp.Restore:
 		client.cmdCh <- &cmdWrapper{"", &restoreCmd{}}
+	case ssntp.InstanceInventory:
+		client.cmdCh <- &cmdWrapper{"", &inventoryCmd{}}
+	case ssntp.PrefetchImage:
+		image, err := parsePrefetchImagePayload(payload)
+		if err != nil {
+			glog.Errorf("Unable to parse YAML: %v", err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &prefetchCmd{image}}
+	case ssntp.PrepareMigration, ssntp.MigrateInstance:
+		parse := parsePrepareMigrationPayload
+		if cmd == ssntp.MigrateInstance {
+			parse = parseMigrateInstancePayload
+		}
+		instance, payloadErr := parse(payload)
+		if payloadErr != nil {
+			migrationError := &migrationError{
+				payloadErr.err,
+				payloads.MigrationFailureReason(payloadErr.code),
+			}
+			migrationError.send(client.conn, "")
+			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
+			return
+		}
+		// govmm does not yet expose the QMP migrate command so
+		// instances cannot be live migrated to or from this node.
+		migrationError := &migrationError{
+			errors.New("Live migration is not supported"),
+			payloads.MigrationNotSupported,
+		}
+		migrationError.send(client.conn, instance)
+		glog.Warningf("Unable to %s %s: %v", cmd, instance, migrationError.err)
+	case ssntp.AbortMigration:
+		glog.Infof("Ignoring %s, no migration in progress", cmd)
+	case ssntp.ResizeInstance:
+		instance, vcpus, memMB, payloadErr := parseResizeInstancePayload(payload)
+		if payloadErr != nil {
+			resizeError := &resizeError{
+				payloadErr.err,
+				payloads.ResizeFailureReason(payloadErr.code),
+			}
+			resizeError.send(client.conn, instance)
+			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, &insResizeCmd{vcpus, memMB}}
+	case ssntp.ConsoleLog:
+		instance, requestID, length, err := parseConsoleLogPayload(payload)
+		if err != nil && instance == "" {
+			glog.Errorf("Unable to parse YAML: %v", err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &consoleLogCmd{instance, requestID, length, err}}
 	}
 }
 
@@ -280,3 +280,42 @@ func TestAgentAttachVolume(t *testing.T) {
 
 	checkErrorPayload(t, &ac, state, ssntp.AttachVolume, ssntp.AttachVolumeFailure)
 }
+
+// Verify that the agentClient correctly processes ssntp.DetachVolume
+//
+// Send the ssntp.DetachVolume command to the agent client with a valid payload,
+// then send another ssntp.DetachVolume command with an invalid payload.
+//
+// The command with the valid payload should be processed correctly and a
+// insDetachVolumeCmd should be received on the agent's cmdCh.  The second
+// command with the invalid payload should result in a call to state.SendError.
+func TestAgentDetachVolume(t *testing.T) {
+	state := &ssntpTestState{}
+	cmdCh := make(chan *cmdWrapper)
+	ac := agentClient{conn: state, cmdCh: cmdCh}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		select {
+		case cmd := <-cmdCh:
+			if _, ok := cmd.cmd.(*insDetachVolumeCmd); !ok {
+				t.Errorf("Unexpected command received.  Expected detachVolumeCmd")
+			}
+			if cmd.instance != testutil.InstanceUUID {
+				t.Errorf("Unexpected instanced.  Expected %s found %s",
+					testutil.InstanceUUID, cmd.instance)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Timedout waiting for cmdCh")
+		}
+		wg.Done()
+	}()
+
+	frame := &ssntp.Frame{Payload: []byte(testutil.DetachVolumeYaml)}
+	ac.CommandNotify(ssntp.DetachVolume, frame)
+	wg.Wait()
+
+	checkErrorPayload(t, &ac, state, ssntp.DetachVolume, ssntp.DetachVolumeFailure)
+}
@@ -75,6 +75,8 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, conn ser
 	var bridge string
 	var gatewayIP string
 	var vnicCfg *libsnnet.VnicConfig
+	var extraCfgs []*libsnnet.VnicConfig
+	var extra []extraVnic
 	var st startTimes
 	var fds []*os.File
 
@@ -107,6 +109,12 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, conn ser
 			glog.Errorf("Could not create VnicCFG: %s", err)
 			return nil, &startError{err, payloads.InvalidData, cmd.cfg.Restart}
 		}
+
+		extraCfgs, err = createExtraVnicCfgs(cfg)
+		if err != nil {
+			glog.Errorf("Could not create VnicCFG: %s", err)
+			return nil, &startError{err, payloads.InvalidData, cmd.cfg.Restart}
+		}
 	}
 
 	if vnicCfg != nil {
@@ -119,6 +127,17 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, conn ser
 				_ = f.Close()
 			}
 		}()
+
+		extra, err = createExtraVnics(conn, extraCfgs)
+		if err != nil {
+			destroyVnic(conn, vnicCfg)
+			return nil, &startError{err, payloads.NetworkFailure, cmd.cfg.Restart}
+		}
+		defer func() {
+			for _, e := range extra {
+				cleanupFds(e.fds, len(e.fds))
+			}
+		}()
 	}
 
 	st.networkStamp = time.Now()
@@ -128,16 +147,18 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, conn ser
 	if err != nil {
 		if vnicCfg != nil {
 			destroyVnic(conn, vnicCfg)
+			destroyVnics(conn, extraCfgs)
 		}
 		return nil, &startError{err, payloads.ImageFailure, cmd.cfg.Restart}
 	}
 
 	st.creationStamp = time.Now()
 
-	err = vm.startVM(vnicName, getNodeIPAddress(), cephID, fds)
+	err = vm.startVM(vnicName, getNodeIPAddress(), cephID, fds, extra)
 	if err != nil {
 		if vnicCfg != nil {
 			destroyVnic(conn, vnicCfg)
+			destroyVnics(conn, extraCfgs)
 		}
 		return nil, &startError{err, payloads.LaunchFailure, cmd.cfg.Restart}
 	}
@@ -28,6 +28,11 @@ type virtualizerAttachCmd struct {
 	volumeUUID string
 	device     string
 }
+type virtualizerDetachCmd struct {
+	responseCh chan error
+	volumeUUID string
+	hotplugged bool
+}
 
 var errImageNotFound = errors.New("Image Not Found")
 
@@ -62,8 +67,9 @@ type virtualizer interface {
 	// deleted by the instance go routine.
 	deleteImage() error
 
-	// Boots a VM.  This method is called by START
-	startVM(vnicName, ipAddress, cephID string, fds []*os.File) error
+	// Boots a VM.  This method is called by START.  extra lists the
+	// network interfaces of the VM in addition to the one named vnicName.
+	startVM(vnicName, ipAddress, cephID string, fds []*os.File, extra []extraVnic) error
 
 	//BUG(markus): Need to use context rather than the monitor channel to
 	//detect when we need to quit.
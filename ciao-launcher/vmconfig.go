@@ -20,13 +20,70 @@ import (
 	"encoding/gob"
 	"os"
 	"path"
+	"regexp"
 
 	"github.com/golang/glog"
 )
 
+// maxVolumeSerialLen is the size of the serial numbers of virtio-blk disks.
+// Longer serial numbers are truncated by qemu.
+const maxVolumeSerialLen = 20
+
+// volumeTagRegexp matches the tags which can be used as the serial number
+// of a disk.
+var volumeTagRegexp = regexp.MustCompile("^[A-Za-z0-9._-]{1,20}$")
+
 type volumeConfig struct {
-	UUID     string
-	Bootable bool
+	UUID      string
+	Bootable  bool
+	BootIndex *int
+
+	// Tag identifies the volume inside the instance.  It is used as the
+	// serial number of the disk if it is a valid serial number.
+	Tag string
+
+	// Hotplugged is set for volumes which were attached to a running
+	// instance.  These are not given a serial number until the instance
+	// is restarted.
+	Hotplugged bool
+}
+
+// serial returns the serial number given to the disk of the volume, its
+// tag if it has a valid one and otherwise the start of its UUID.
+func (v *volumeConfig) serial() string {
+	if volumeTagRegexp.MatchString(v.Tag) {
+		return v.Tag
+	}
+
+	if len(v.UUID) > maxVolumeSerialLen {
+		return v.UUID[:maxVolumeSerialLen]
+	}
+	return v.UUID
+}
+
+// guestDevice returns the path of the volume inside the instance or an
+// empty string if the volume cannot yet be found by name.
+func (v *volumeConfig) guestDevice(container bool) string {
+	if container {
+		return path.Join("/volumes", v.UUID)
+	}
+
+	if v.Hotplugged {
+		return ""
+	}
+
+	return "/dev/disk/by-id/virtio-" + v.serial()
+}
+
+// nicConfig describes a network interface of an instance in addition to
+// its primary one, which is described by the Vnic fields of vmConfig.
+type nicConfig struct {
+	VnicMAC  string
+	VnicIP   string
+	ConcIP   string
+	SubnetIP string
+	ConcUUID string
+	VnicUUID string
 }
 
 type vmConfig struct {
@@ -49,6 +106,7 @@ type vmConfig struct {
 	Volumes     []volumeConfig
 	Restart     bool
 	Privileged  bool
+	ExtraNICs   []nicConfig
 }
 
 func loadVMConfig(instanceDir string) (*vmConfig, error) {
@@ -98,6 +156,17 @@ func (cfg *vmConfig) findVolume(UUID string) *volumeConfig {
 	}
 	return nil
 }
+
+// findVolumeSerial returns the volume whose disk has the given serial number.
+func (cfg *vmConfig) findVolumeSerial(serial string) *volumeConfig {
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].serial() == serial {
+			return &cfg.Volumes[i]
+		}
+	}
+	return nil
+}
+
 func (cfg *vmConfig) haveBootableVolume() bool {
 	for _, vol := range cfg.Volumes {
 		if vol.Bootable {
@@ -107,6 +176,17 @@ func (cfg *vmConfig) haveBootableVolume() bool {
 	return false
 }
 
+// haveBootOrder returns true if the workload of the instance gave its
+// volumes an explicit boot order.
+func (cfg *vmConfig) haveBootOrder() bool {
+	for _, vol := range cfg.Volumes {
+		if vol.BootIndex != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (cfg *vmConfig) removeVolume(UUID string) {
 	for i := range cfg.Volumes {
 		if cfg.Volumes[i].UUID == UUID {
@@ -44,6 +44,10 @@ var prepare = flag.Bool("osprepare", false, "Install dependencies")
 var logDir = "/var/lib/ciao/logs/scheduler"
 var configURI = flag.String("configuration-uri", "file:///etc/ciao/configuration.yaml",
 	"Cluster configuration URI")
+var keepaliveInterval = flag.Duration("keepalive-interval", 0,
+	"Interval between keepalives sent to the SSNTP clients, 0 to disable them")
+var keepaliveMisses = flag.Int("keepalive-misses", 0,
+	"Number of keepalive intervals a silent SSNTP client is disconnected after")
 
 type ssntpSchedulerServer struct {
 	// user config overrides ------------------------------------------
@@ -75,6 +79,11 @@ type ssntpSchedulerServer struct {
 	nnMutex    sync.RWMutex // Rlock traversing map, Lock modifying map
 	nnMRU      *nodeStat
 	nnMRUIndex int
+
+	// Nodes put into maintenance by the Controller, which are kept
+	// across reconnections of the nodes
+	maintenance      map[string]bool
+	maintenanceMutex sync.Mutex
 }
 
 func newSsntpSchedulerServer() *ssntpSchedulerServer {
@@ -84,6 +93,7 @@ func newSsntpSchedulerServer() *ssntpSchedulerServer {
 		cnMRUIndex:    -1,
 		nnMap:         make(map[string]*nodeStat),
 		nnMRUIndex:    -1,
+		maintenance:   make(map[string]bool),
 	}
 }
 
@@ -100,6 +110,7 @@ type nodeStat struct {
 	isNetNode   bool
 	networks    []payloads.NetworkStat
 	hostname    string
+	maintenance bool
 }
 
 type controllerStatus uint8
@@ -293,6 +304,7 @@ func connectComputeNode(sched *ssntpSchedulerServer, uuid string) {
 	node.status = ssntp.CONNECTED
 	node.uuid = uuid
 	node.isNetNode = false
+	node.maintenance = sched.inMaintenance(uuid)
 	sched.cnList = append(sched.cnList, &node)
 	sched.cnMap[uuid] = &node
 
@@ -345,6 +357,7 @@ func connectNetworkNode(sched *ssntpSchedulerServer, uuid string) {
 	node.status = ssntp.CONNECTED
 	node.uuid = uuid
 	node.isNetNode = true
+	node.maintenance = sched.inMaintenance(uuid)
 	sched.nnList = append(sched.nnList, &node)
 	sched.nnMap[uuid] = &node
 
@@ -473,9 +486,11 @@ func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status
 }
 
 type workResources struct {
-	instanceUUID string
-	diskReqMB    int
-	requirements payloads.WorkloadRequirements
+	instanceUUID   string
+	diskReqMB      int
+	requirements   payloads.WorkloadRequirements
+	preferredNodes []string
+	avoidNodes     []string
 }
 
 func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (workload workResources, err error) {
@@ -487,6 +502,8 @@ func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (w
 	}
 
 	workload.requirements = work.Start.Requirements
+	workload.preferredNodes = work.Start.PreferredNodes
+	workload.avoidNodes = work.Start.AvoidNodes
 
 	// note the uuid
 	workload.instanceUUID = work.Start.InstanceUUID
@@ -500,6 +517,7 @@ func (sched *ssntpSchedulerServer) workloadFits(node *nodeStat, workload *workRe
 	if node.memAvailMB >= workload.requirements.MemMB &&
 		node.diskAvailMB >= workload.diskReqMB &&
 		node.status == ssntp.READY &&
+		!node.maintenance &&
 		node.isNetNode == workload.requirements.NetworkNode {
 
 		if workload.requirements.Hostname != "" &&
@@ -512,6 +530,12 @@ func (sched *ssntpSchedulerServer) workloadFits(node *nodeStat, workload *workRe
 			return false
 		}
 
+		for _, uuid := range workload.avoidNodes {
+			if uuid == node.uuid {
+				return false
+			}
+		}
+
 		return true
 	}
 	return false
@@ -622,6 +646,38 @@ func getWorkloadAgentUUID(sched *ssntpSchedulerServer, command ssntp.Command, pa
 		var cmd payloads.AttachVolume
 		err := yaml.Unmarshal(payload, &cmd)
 		return cmd.Attach.InstanceUUID, cmd.Attach.WorkloadAgentUUID, err
+	case ssntp.DetachVolume:
+		var cmd payloads.DetachVolume
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Detach.InstanceUUID, cmd.Detach.WorkloadAgentUUID, err
+	case ssntp.InstanceInventory:
+		var cmd payloads.Inventory
+		err := yaml.Unmarshal(payload, &cmd)
+		return "", cmd.Inventory.WorkloadAgentUUID, err
+	case ssntp.PrefetchImage:
+		var cmd payloads.PrefetchImage
+		err := yaml.Unmarshal(payload, &cmd)
+		return "", cmd.Prefetch.WorkloadAgentUUID, err
+	case ssntp.PrepareMigration:
+		var cmd payloads.PrepareMigration
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Prepare.InstanceUUID, cmd.Prepare.WorkloadAgentUUID, err
+	case ssntp.MigrateInstance:
+		var cmd payloads.MigrateInstance
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Migrate.InstanceUUID, cmd.Migrate.WorkloadAgentUUID, err
+	case ssntp.AbortMigration:
+		var cmd payloads.AbortMigration
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Abort.InstanceUUID, cmd.Abort.WorkloadAgentUUID, err
+	case ssntp.ConsoleLog:
+		var cmd payloads.ConsoleLog
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.ConsoleLog.InstanceUUID, cmd.ConsoleLog.WorkloadAgentUUID, err
+	case ssntp.ResizeInstance:
+		var cmd payloads.ResizeInstance
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Resize.InstanceUUID, cmd.Resize.WorkloadAgentUUID, err
 	}
 }
 
@@ -646,6 +702,39 @@ func (sched *ssntpSchedulerServer) decrementResourceUsage(node *nodeStat, worklo
 	node.memAvailMB -= workload.requirements.MemMB
 }
 
+// Find a suitable compute node among the nodes preferred by the workload,
+// returning a reference to a locked nodeStat if found.  The search starts
+// after the MRU so that the preferred nodes share the workloads.
+func pickPreferredComputeNode(sched *ssntpSchedulerServer, workload *workResources) *nodeStat {
+	if len(workload.preferredNodes) == 0 {
+		return nil
+	}
+
+	preferred := make(map[string]bool, len(workload.preferredNodes))
+	for _, uuid := range workload.preferredNodes {
+		preferred[uuid] = true
+	}
+
+	count := len(sched.cnList)
+	for i := 1; i <= count; i++ {
+		index := (sched.cnMRUIndex + i) % count
+		node := sched.cnList[index]
+		if !preferred[node.uuid] {
+			continue
+		}
+
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) == true {
+			sched.cnMRUIndex = index
+			sched.cnMRU = node
+			return node // locked nodeStat
+		}
+		node.mutex.Unlock()
+	}
+
+	return nil
+}
+
 // Find suitable compute node, returning referenced to a locked nodeStat if found
 func pickComputeNode(sched *ssntpSchedulerServer, controllerUUID string, workload *workResources, restart bool) (node *nodeStat) {
 	sched.cnMutex.RLock()
@@ -657,6 +746,11 @@ func pickComputeNode(sched *ssntpSchedulerServer, controllerUUID string, workloa
 		return nil
 	}
 
+	/* Preferred nodes are only a preference, fall back to any node */
+	if node := pickPreferredComputeNode(sched, workload); node != nil {
+		return node // locked nodeStat
+	}
+
 	/* First try nodes after the MRU */
 	if sched.cnMRUIndex != -1 && sched.cnMRUIndex < len(sched.cnList)-1 {
 		for i, node := range sched.cnList[sched.cnMRUIndex+1:] {
@@ -811,9 +905,25 @@ func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command
 		fallthrough
 	case ssntp.AttachVolume:
 		fallthrough
+	case ssntp.DetachVolume:
+		fallthrough
 	case ssntp.EVACUATE:
 		fallthrough
 	case ssntp.Restore:
+		fallthrough
+	case ssntp.InstanceInventory:
+		fallthrough
+	case ssntp.PrefetchImage:
+		fallthrough
+	case ssntp.PrepareMigration:
+		fallthrough
+	case ssntp.MigrateInstance:
+		fallthrough
+	case ssntp.AbortMigration:
+		fallthrough
+	case ssntp.ConsoleLog:
+		fallthrough
+	case ssntp.ResizeInstance:
 		dest, instanceUUID = sched.fwdCmdToComputeNode(command, payload)
 	case ssntp.RefreshCNCI:
 		fallthrough
@@ -855,10 +965,68 @@ func (sched *ssntpSchedulerServer) EventForward(uuid string, event ssntp.Event,
 	return dest
 }
 
+func (sched *ssntpSchedulerServer) inMaintenance(uuid string) bool {
+	sched.maintenanceMutex.Lock()
+	defer sched.maintenanceMutex.Unlock()
+
+	return sched.maintenance[uuid]
+}
+
+// setNodeMaintenance records whether a node is in maintenance.  Nodes in
+// maintenance are not picked to start new instances.
+func (sched *ssntpSchedulerServer) setNodeMaintenance(uuid string, maintenance bool) {
+	sched.maintenanceMutex.Lock()
+	if maintenance {
+		sched.maintenance[uuid] = true
+	} else {
+		delete(sched.maintenance, uuid)
+	}
+	sched.maintenanceMutex.Unlock()
+
+	sched.cnMutex.RLock()
+	if node := sched.cnMap[uuid]; node != nil {
+		node.mutex.Lock()
+		node.maintenance = maintenance
+		node.mutex.Unlock()
+	}
+	sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	if node := sched.nnMap[uuid]; node != nil {
+		node.mutex.Lock()
+		node.maintenance = maintenance
+		node.mutex.Unlock()
+	}
+	sched.nnMutex.RUnlock()
+}
+
+func (sched *ssntpSchedulerServer) nodeMaintenance(uuid string, payload []byte) {
+	role, err := sched.ssntp.ClientRole(uuid)
+	if err != nil || !role.IsController() {
+		glog.Warningf("NodeMaintenance ignored from %s", uuid)
+		return
+	}
+
+	var event payloads.EventNodeMaintenance
+	err = yaml.Unmarshal(payload, &event)
+	if err != nil {
+		glog.Errorf("Bad NodeMaintenance yaml from %s: %v", uuid, err)
+		return
+	}
+
+	glog.Infof("Node %s maintenance %v", event.NodeMaintenance.NodeUUID, event.NodeMaintenance.Maintenance)
+	sched.setNodeMaintenance(event.NodeMaintenance.NodeUUID, event.NodeMaintenance.Maintenance)
+}
+
 func (sched *ssntpSchedulerServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.Frame) {
-	// Currently all events are handled by EventForward, the SSNTP command forwader,
-	// or directly by role defined forwarding rules.
+	// Apart from NodeMaintenance, all events are handled by EventForward,
+	// the SSNTP command forwader, or directly by role defined forwarding
+	// rules.
 	glog.V(2).Infof("EVENT %v from %s\n", event, uuid)
+
+	if event == ssntp.NodeMaintenance {
+		sched.nodeMaintenance(uuid, frame.Payload)
+	}
 }
 
 func (sched *ssntpSchedulerServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
@@ -964,6 +1132,9 @@ func heartBeatComputeNodes(sched *ssntpSchedulerServer) (s string) {
 		node.mutex.Lock()
 		s += fmt.Sprintf("node-%s:", node.uuid[:8])
 		s += node.status.String()
+		if node.maintenance {
+			s += "(M)"
+		}
 		if node == sched.cnMRU {
 			s += "*"
 		}
@@ -1063,6 +1234,38 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand: ssntp.InstanceStopped,
 			Dest:    ssntp.Controller,
 		},
+		{ // all InstanceInventoryReport events go to all Controllers
+			Operand: ssntp.InstanceInventoryReport,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ImagePrefetchReport events go to all Controllers
+			Operand: ssntp.ImagePrefetchReport,
+			Dest:    ssntp.Controller,
+		},
+		{ // all MigrationPrepared events go to all Controllers
+			Operand: ssntp.MigrationPrepared,
+			Dest:    ssntp.Controller,
+		},
+		{ // all InstanceMigrated events go to all Controllers
+			Operand: ssntp.InstanceMigrated,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ConsoleLogReport events go to all Controllers
+			Operand: ssntp.ConsoleLogReport,
+			Dest:    ssntp.Controller,
+		},
+		{ // all InstanceResized events go to all Controllers
+			Operand: ssntp.InstanceResized,
+			Dest:    ssntp.Controller,
+		},
+		{ // all VolumeAttached events go to all Controllers
+			Operand: ssntp.VolumeAttached,
+			Dest:    ssntp.Controller,
+		},
+		{ // all VolumeDetached events go to all Controllers
+			Operand: ssntp.VolumeDetached,
+			Dest:    ssntp.Controller,
+		},
 		{ // all ConcentratorInstanceAdded events go to all Controllers
 			Operand: ssntp.ConcentratorInstanceAdded,
 			Dest:    ssntp.Controller,
@@ -1123,6 +1326,18 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand: ssntp.AttachVolumeFailure,
 			Dest:    ssntp.Controller,
 		},
+		{ // all MigrationFailure errors go to all Controllers
+			Operand: ssntp.MigrationFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ResizeFailure errors go to all Controllers
+			Operand: ssntp.ResizeFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all DetachVolumeFailure errors go to all Controllers
+			Operand: ssntp.DetachVolumeFailure,
+			Dest:    ssntp.Controller,
+		},
 		{ // all AssignPublicIP commands are processed by the Command forwarder
 			Operand:        ssntp.AssignPublicIP,
 			CommandForward: sched,
@@ -1135,6 +1350,38 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand:        ssntp.RefreshCNCI,
 			CommandForward: sched,
 		},
+		{ // all InstanceInventory commands are processed by the Command forwarder
+			Operand:        ssntp.InstanceInventory,
+			CommandForward: sched,
+		},
+		{ // all PrefetchImage commands are processed by the Command forwarder
+			Operand:        ssntp.PrefetchImage,
+			CommandForward: sched,
+		},
+		{ // all PrepareMigration commands are processed by the Command forwarder
+			Operand:        ssntp.PrepareMigration,
+			CommandForward: sched,
+		},
+		{ // all MigrateInstance commands are processed by the Command forwarder
+			Operand:        ssntp.MigrateInstance,
+			CommandForward: sched,
+		},
+		{ // all AbortMigration commands are processed by the Command forwarder
+			Operand:        ssntp.AbortMigration,
+			CommandForward: sched,
+		},
+		{ // all ConsoleLog commands are processed by the Command forwarder
+			Operand:        ssntp.ConsoleLog,
+			CommandForward: sched,
+		},
+		{ // all ResizeInstance commands are processed by the Command forwarder
+			Operand:        ssntp.ResizeInstance,
+			CommandForward: sched,
+		},
+		{ // all DetachVolume commands are processed by the Command forwarder
+			Operand:        ssntp.DetachVolume,
+			CommandForward: sched,
+		},
 	}
 }
 
@@ -1176,6 +1423,9 @@ func configSchedulerServer() (sched *ssntpSchedulerServer) {
 		Cert:      *cert,
 		ConfigURI: *configURI,
 		Log:       ssntp.Log,
+
+		KeepaliveInterval: *keepaliveInterval,
+		KeepaliveMisses:   *keepaliveMisses,
 	}
 
 	setSSNTPForwardRules(sched)
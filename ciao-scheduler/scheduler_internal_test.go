@@ -208,6 +208,155 @@ func TestPickComputeNode(t *testing.T) {
 	}
 }
 
+func TestPickPreferredComputeNode(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	for i := 1; i <= 4; i++ {
+		spinUpComputeNodeLarge(sched, i)
+	}
+	spinUpComputeNodeVerySmall(sched, 5)
+
+	var work = createStartWorkload(2, 256, 10000)
+	work.Start.PreferredNodes = []string{"00000002", "00000004", "00000005"}
+	resources, err := sched.getWorkloadResources(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the preferred nodes with room for the workload take turns
+	for _, expected := range []string{"00000002", "00000004", "00000002"} {
+		node := PickComputeNode(sched, "", &resources, false)
+		if node == nil {
+			t.Fatal("found no compute fit when one should exist")
+		}
+		node.mutex.Unlock()
+
+		if node.uuid != expected {
+			t.Fatalf("expected preferred node %s, got %s", expected, node.uuid)
+		}
+	}
+
+	// the preference is dropped when no preferred node has room
+	resources.preferredNodes = []string{"00000005", "00000006"}
+	node := PickComputeNode(sched, "", &resources, false)
+	if node == nil {
+		t.Fatal("found no compute fit when one should exist")
+	}
+	node.mutex.Unlock()
+
+	if node.uuid == "00000005" {
+		t.Fatal("picked a preferred node without room for the workload")
+	}
+}
+
+func TestPickComputeNodeMaintenance(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	for i := 1; i <= 2; i++ {
+		spinUpComputeNodeLarge(sched, i)
+	}
+
+	var work = createStartWorkload(2, 256, 10000)
+	resources, err := sched.getWorkloadResources(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// instances are not started on nodes in maintenance
+	sched.setNodeMaintenance("00000001", true)
+	for i := 0; i < 4; i++ {
+		node := PickComputeNode(sched, "", &resources, false)
+		if node == nil {
+			t.Fatal("found no compute fit when one should exist")
+		}
+		node.mutex.Unlock()
+
+		if node.uuid != "00000002" {
+			t.Fatalf("picked node %s in maintenance", node.uuid)
+		}
+	}
+
+	// not even when they are preferred
+	resources.preferredNodes = []string{"00000001"}
+	node := PickComputeNode(sched, "", &resources, false)
+	if node == nil {
+		t.Fatal("found no compute fit when one should exist")
+	}
+	node.mutex.Unlock()
+
+	if node.uuid != "00000002" {
+		t.Fatalf("picked preferred node %s in maintenance", node.uuid)
+	}
+
+	sched.setNodeMaintenance("00000002", true)
+	node = PickComputeNode(sched, "", &resources, false)
+	if node != nil {
+		t.Fatal("found compute fit when all nodes are in maintenance")
+	}
+
+	// scheduling resumes once a node is ready
+	sched.setNodeMaintenance("00000001", false)
+	node = PickComputeNode(sched, "", &resources, false)
+	if node == nil {
+		t.Fatal("found no compute fit after maintenance")
+	}
+	node.mutex.Unlock()
+
+	if node.uuid != "00000001" {
+		t.Fatalf("expected node 00000001, got %s", node.uuid)
+	}
+
+	// the maintenance of nodes which are not connected is remembered
+	sched.setNodeMaintenance("00000003", true)
+	if !sched.inMaintenance("00000003") || sched.inMaintenance("00000001") {
+		t.Fatal("maintenance not recorded for nodes")
+	}
+}
+
+func TestPickComputeNodeAvoidNodes(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	for i := 1; i <= 3; i++ {
+		spinUpComputeNodeLarge(sched, i)
+	}
+
+	var work = createStartWorkload(2, 256, 10000)
+	work.Start.AvoidNodes = []string{"00000001", "00000003"}
+	work.Start.PreferredNodes = []string{"00000001"}
+	resources, err := sched.getWorkloadResources(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// avoided nodes are never picked, even when preferred
+	for i := 0; i < 4; i++ {
+		node := PickComputeNode(sched, "", &resources, false)
+		if node == nil {
+			t.Fatal("found no compute fit when one should exist")
+		}
+		node.mutex.Unlock()
+
+		if node.uuid != "00000002" {
+			t.Fatalf("picked avoided node %s", node.uuid)
+		}
+	}
+
+	resources.avoidNodes = []string{"00000001", "00000002", "00000003"}
+	node := PickComputeNode(sched, "", &resources, false)
+	if node != nil {
+		t.Fatal("found compute fit when all nodes are avoided")
+	}
+}
+
 func benchmarkPickComputeNode(b *testing.B, nodecount int) {
 	sched = configSchedulerServer()
 	if sched == nil {
@@ -746,6 +895,14 @@ func TestGetWorkloadAgentUUID(t *testing.T) {
 		{ssntp.DELETE, []byte(testutil.DeleteYaml), testutil.InstanceUUID, testutil.AgentUUID},
 		{ssntp.EVACUATE, []byte(testutil.EvacuateYaml), "", testutil.AgentUUID},
 		{ssntp.Restore, []byte(testutil.RestoreYaml), "", testutil.AgentUUID},
+		{ssntp.InstanceInventory, []byte(testutil.InventoryYaml), "", testutil.AgentUUID},
+		{ssntp.PrefetchImage, []byte(testutil.PrefetchImageYaml), "", testutil.AgentUUID},
+		{ssntp.PrepareMigration, []byte(testutil.PrepareMigrationYaml), testutil.InstanceUUID, testutil.AgentUUID},
+		{ssntp.MigrateInstance, []byte(testutil.MigrateInstanceYaml), testutil.InstanceUUID, testutil.AgentUUID},
+		{ssntp.AbortMigration, []byte(testutil.AbortMigrationYaml), testutil.InstanceUUID, testutil.AgentUUID},
+		{ssntp.ConsoleLog, []byte(testutil.ConsoleLogYaml), testutil.InstanceUUID, testutil.AgentUUID},
+		{ssntp.ResizeInstance, []byte(testutil.ResizeInstanceYaml), testutil.InstanceUUID, testutil.AgentUUID},
+		{ssntp.DetachVolume, []byte(testutil.DetachVolumeYaml), testutil.InstanceUUID, testutil.AgentUUID},
 		{ssntp.AttachVolume, []byte(testutil.AttachVolumeYaml), testutil.InstanceUUID, testutil.AgentUUID},
 	}
 	for _, test := range stringTests {
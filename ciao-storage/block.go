@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 )
 
@@ -24,19 +25,23 @@ var (
 )
 
 // BlockDriver is the interface that all block drivers must implement.
+// The operations performed by the controller on behalf of a request are
+// passed the request's context and are abandoned if it is cancelled.
 type BlockDriver interface {
-	CreateBlockDevice(volumeUUID string, image string, sizeGB int) (BlockDevice, error)
-	CreateBlockDeviceFromSnapshot(volumeUUID string, snapshotID string) (BlockDevice, error)
-	CreateBlockDeviceSnapshot(volumeUUID string, snapshotID string) error
-	DeleteBlockDevice(string) error
-	DeleteBlockDeviceSnapshot(volumeUUID string, snapshotID string) error
+	CreateBlockDevice(ctx context.Context, volumeUUID string, image string, sizeGB int) (BlockDevice, error)
+	CreateBlockDeviceFromSnapshot(ctx context.Context, volumeUUID string, snapshotID string) (BlockDevice, error)
+	CreateBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error
+	DeleteBlockDevice(context.Context, string) error
+	DeleteBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error
+	ListBlockDeviceSnapshots(ctx context.Context, volumeUUID string) ([]string, error)
 	MapVolumeToNode(volumeUUID string) (string, error)
 	UnmapVolumeFromNode(volumeUUID string) error
 	GetVolumeMapping() (map[string][]string, error)
-	CopyBlockDevice(string) (BlockDevice, error)
-	GetBlockDeviceSize(volumeUUID string) (uint64, error)
+	CopyBlockDevice(context.Context, string) (BlockDevice, error)
+	GetBlockDeviceSize(ctx context.Context, volumeUUID string) (uint64, error)
 	IsValidSnapshotUUID(string) error
-	Resize(volumeUUID string, sizeGiB int) (int, error)
+	Resize(ctx context.Context, volumeUUID string, sizeGiB int) (int, error)
+	ForceRelease(ctx context.Context, volumeUUID string) error
 }
 
 // BlockDevice contains information about a block device
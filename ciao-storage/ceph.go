@@ -17,6 +17,7 @@ package storage
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
@@ -32,8 +33,8 @@ type CephDriver struct {
 	ID string
 }
 
-func (d CephDriver) getBlockDeviceSizeGiB(volumeUUID string) (int, error) {
-	bytes, err := d.GetBlockDeviceSize(volumeUUID)
+func (d CephDriver) getBlockDeviceSizeGiB(ctx context.Context, volumeUUID string) (int, error) {
+	bytes, err := d.GetBlockDeviceSize(ctx, volumeUUID)
 
 	if err != nil {
 		return 0, err
@@ -49,7 +50,7 @@ func (d CephDriver) getBlockDeviceSizeGiB(volumeUUID string) (int, error) {
 }
 
 // CreateBlockDevice will create a rbd image in the ceph cluster.
-func (d CephDriver) CreateBlockDevice(volumeUUID string, imagePath string, size int) (BlockDevice, error) {
+func (d CephDriver) CreateBlockDevice(ctx context.Context, volumeUUID string, imagePath string, size int) (BlockDevice, error) {
 	if volumeUUID == "" {
 		volumeUUID = uuid.Generate().String()
 	} else {
@@ -66,10 +67,10 @@ func (d CephDriver) CreateBlockDevice(volumeUUID string, imagePath string, size
 	// should be added as they are enabled in the kernel.
 	if imagePath != "" {
 		rbdStr := fmt.Sprintf("rbd:rbd/%s:id=%s", volumeUUID, d.ID)
-		cmd = exec.Command("qemu-img", "convert", "-O", "rbd", imagePath, rbdStr)
+		cmd = exec.CommandContext(ctx, "qemu-img", "convert", "-O", "rbd", imagePath, rbdStr)
 	} else {
 		// create an empty volume
-		cmd = exec.Command("rbd", "--id", d.ID, "--image-feature", "layering", "create", "--size", strconv.Itoa(size)+"G", volumeUUID)
+		cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "--image-feature", "layering", "create", "--size", strconv.Itoa(size)+"G", volumeUUID)
 	}
 
 	out, err := cmd.CombinedOutput()
@@ -81,21 +82,21 @@ func (d CephDriver) CreateBlockDevice(volumeUUID string, imagePath string, size
 }
 
 // CreateBlockDeviceFromSnapshot will create a block device derived from the previously created snapshot.
-func (d CephDriver) CreateBlockDeviceFromSnapshot(volumeUUID string, snapshotID string) (BlockDevice, error) {
+func (d CephDriver) CreateBlockDeviceFromSnapshot(ctx context.Context, volumeUUID string, snapshotID string) (BlockDevice, error) {
 	ID := uuid.Generate().String()
 
 	var cmd *exec.Cmd
 
-	cmd = exec.Command("rbd", "--id", d.ID, "clone", volumeUUID+"@"+snapshotID, ID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "clone", volumeUUID+"@"+snapshotID, ID)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return BlockDevice{}, fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 
-	size, err := d.getBlockDeviceSizeGiB(volumeUUID)
+	size, err := d.getBlockDeviceSizeGiB(ctx, volumeUUID)
 	if err != nil {
-		d.DeleteBlockDevice(volumeUUID)
+		d.DeleteBlockDevice(context.WithoutCancel(ctx), volumeUUID)
 		return BlockDevice{}, fmt.Errorf("Error when querying block device size: %v", err)
 	}
 
@@ -103,41 +104,41 @@ func (d CephDriver) CreateBlockDeviceFromSnapshot(volumeUUID string, snapshotID
 }
 
 // CreateBlockDeviceSnapshot creates and protects the snapshot with the provided name
-func (d CephDriver) CreateBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (d CephDriver) CreateBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
 	var cmd *exec.Cmd
-	cmd = exec.Command("rbd", "--id", d.ID, "snap", "create", volumeUUID+"@"+snapshotID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "snap", "create", volumeUUID+"@"+snapshotID)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 
-	cmd = exec.Command("rbd", "--id", d.ID, "snap", "protect", volumeUUID+"@"+snapshotID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "snap", "protect", volumeUUID+"@"+snapshotID)
 
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		d.DeleteBlockDevice(volumeUUID)
+		d.DeleteBlockDevice(context.WithoutCancel(ctx), volumeUUID)
 		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 	return nil
 }
 
 // CopyBlockDevice will copy an existing volume
-func (d CephDriver) CopyBlockDevice(volumeUUID string) (BlockDevice, error) {
+func (d CephDriver) CopyBlockDevice(ctx context.Context, volumeUUID string) (BlockDevice, error) {
 	ID := uuid.Generate().String()
 
 	var cmd *exec.Cmd
 
-	cmd = exec.Command("rbd", "--id", d.ID, "cp", volumeUUID, ID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "cp", volumeUUID, ID)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return BlockDevice{}, fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 
-	size, err := d.getBlockDeviceSizeGiB(volumeUUID)
+	size, err := d.getBlockDeviceSizeGiB(ctx, volumeUUID)
 	if err != nil {
-		d.DeleteBlockDevice(volumeUUID)
+		d.DeleteBlockDevice(context.WithoutCancel(ctx), volumeUUID)
 		return BlockDevice{}, fmt.Errorf("Error when querying block device size: %v", err)
 	}
 
@@ -145,8 +146,8 @@ func (d CephDriver) CopyBlockDevice(volumeUUID string) (BlockDevice, error) {
 }
 
 // DeleteBlockDevice will remove a rbd image from the ceph cluster.
-func (d CephDriver) DeleteBlockDevice(volumeUUID string) error {
-	cmd := exec.Command("rbd", "--id", d.ID, "rm", volumeUUID)
+func (d CephDriver) DeleteBlockDevice(ctx context.Context, volumeUUID string) error {
+	cmd := exec.CommandContext(ctx, "rbd", "--id", d.ID, "rm", volumeUUID)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
@@ -155,16 +156,16 @@ func (d CephDriver) DeleteBlockDevice(volumeUUID string) error {
 }
 
 // DeleteBlockDeviceSnapshot unprotects and deletes the snapshot with the provided name
-func (d CephDriver) DeleteBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (d CephDriver) DeleteBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
 	var cmd *exec.Cmd
 
-	cmd = exec.Command("rbd", "--id", d.ID, "snap", "unprotect", volumeUUID+"@"+snapshotID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "snap", "unprotect", volumeUUID+"@"+snapshotID)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 
-	cmd = exec.Command("rbd", "--id", d.ID, "snap", "rm", volumeUUID+"@"+snapshotID)
+	cmd = exec.CommandContext(ctx, "rbd", "--id", d.ID, "snap", "rm", volumeUUID+"@"+snapshotID)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
@@ -172,10 +173,42 @@ func (d CephDriver) DeleteBlockDeviceSnapshot(volumeUUID string, snapshotID stri
 	return nil
 }
 
+// ListBlockDeviceSnapshots returns the names of the snapshots of a rbd image
+func (d CephDriver) ListBlockDeviceSnapshots(ctx context.Context, volumeUUID string) ([]string, error) {
+	args := append(d.getCredentials(), "snap", "ls", "--format", "json", volumeUUID)
+	cmd := exec.CommandContext(ctx, "rbd", args...)
+	data, err := cmd.Output()
+	if err != nil {
+		if err, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, err.Stderr)
+		}
+		return nil, fmt.Errorf("Error when running: %v: %v", cmd.Args, err)
+	}
+
+	return parseSnapshotList(data)
+}
+
+func parseSnapshotList(data []byte) ([]string, error) {
+	var snaps []struct {
+		Name string `json:"name"`
+	}
+	err := json.Unmarshal(data, &snaps)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse output from rbd snap ls: %v", err)
+	}
+
+	names := make([]string, 0, len(snaps))
+	for _, s := range snaps {
+		names = append(names, s.Name)
+	}
+
+	return names, nil
+}
+
 // GetBlockDeviceSize returns the number of bytes used by the block device
-func (d CephDriver) GetBlockDeviceSize(volumeUUID string) (uint64, error) {
+func (d CephDriver) GetBlockDeviceSize(ctx context.Context, volumeUUID string) (uint64, error) {
 	args := append(d.getCredentials(), "info", "--format", "json", volumeUUID)
-	cmd := exec.Command("rbd", args...)
+	cmd := exec.CommandContext(ctx, "rbd", args...)
 	data, err := cmd.Output()
 	if err != nil {
 		if err, ok := err.(*exec.ExitError); ok {
@@ -278,15 +311,51 @@ func (d CephDriver) IsValidSnapshotUUID(snapshotUUID string) error {
 }
 
 // Resize the underlying rbd image. Only extending is permitted. Returns the new size in GiB.
-func (d CephDriver) Resize(volumeUUID string, sizeGiB int) (int, error) {
+func (d CephDriver) Resize(ctx context.Context, volumeUUID string, sizeGiB int) (int, error) {
 	args := append(d.getCredentials(), "resize", volumeUUID, "--no-progress", "-s", fmt.Sprintf("%dG", sizeGiB))
-	cmd := exec.Command("rbd", args...)
+	cmd := exec.CommandContext(ctx, "rbd", args...)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		err = fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
 	}
 
-	size, _ := d.getBlockDeviceSizeGiB(volumeUUID)
+	size, _ := d.getBlockDeviceSizeGiB(ctx, volumeUUID)
 	return size, err
 }
+
+// ForceRelease breaks any locks held on the rbd image, such as the exclusive
+// lock of a node which died with the volume mapped, so that the volume can
+// be mapped elsewhere.
+func (d CephDriver) ForceRelease(ctx context.Context, volumeUUID string) error {
+	args := append(d.getCredentials(), "lock", "list", volumeUUID, "--format", "json")
+	cmd := exec.CommandContext(ctx, "rbd", args...)
+	data, err := cmd.Output()
+	if err != nil {
+		if err, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, err.Stderr)
+		}
+		return fmt.Errorf("Error when running: %v: %v", cmd.Args, err)
+	}
+
+	locks := map[string]struct {
+		Locker  string `json:"locker"`
+		Address string `json:"address"`
+	}{}
+	err = json.Unmarshal([]byte(data), &locks)
+	if err != nil {
+		return fmt.Errorf("Unable to parse output from rbd lock list: %v", err)
+	}
+
+	for lockID, lock := range locks {
+		args := append(d.getCredentials(), "lock", "remove", volumeUUID, lockID, lock.Locker)
+		cmd := exec.CommandContext(ctx, "rbd", args...)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
+		}
+	}
+
+	return nil
+}
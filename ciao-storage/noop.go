@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync/atomic"
@@ -28,37 +29,42 @@ type NoopDriver struct {
 }
 
 // CreateBlockDevice pretends to create a block device.
-func (d *NoopDriver) CreateBlockDevice(volumeUUID string, image string, size int) (BlockDevice, error) {
+func (d *NoopDriver) CreateBlockDevice(ctx context.Context, volumeUUID string, image string, size int) (BlockDevice, error) {
 	return BlockDevice{ID: uuid.Generate().String(), Size: size}, nil
 }
 
 // CreateBlockDeviceFromSnapshot pretends to create a block device snapshot
-func (d *NoopDriver) CreateBlockDeviceFromSnapshot(volumeUUID string, snapshotID string) (BlockDevice, error) {
+func (d *NoopDriver) CreateBlockDeviceFromSnapshot(ctx context.Context, volumeUUID string, snapshotID string) (BlockDevice, error) {
 	return BlockDevice{ID: uuid.Generate().String() + "@" + uuid.Generate().String()}, nil
 }
 
 // CreateBlockDeviceSnapshot pretends to create a block device snapshot
-func (d *NoopDriver) CreateBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (d *NoopDriver) CreateBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
 	return nil
 }
 
 // CopyBlockDevice pretends to copy an existing block device
-func (d *NoopDriver) CopyBlockDevice(string) (BlockDevice, error) {
+func (d *NoopDriver) CopyBlockDevice(context.Context, string) (BlockDevice, error) {
 	return BlockDevice{ID: uuid.Generate().String()}, nil
 }
 
 // DeleteBlockDevice pretends to delete a block device.
-func (d *NoopDriver) DeleteBlockDevice(string) error {
+func (d *NoopDriver) DeleteBlockDevice(context.Context, string) error {
 	return nil
 }
 
 // DeleteBlockDeviceSnapshot pretends to create a block device snapshot
-func (d *NoopDriver) DeleteBlockDeviceSnapshot(volumeUUID string, snapshotID string) error {
+func (d *NoopDriver) DeleteBlockDeviceSnapshot(ctx context.Context, volumeUUID string, snapshotID string) error {
 	return nil
 }
 
+// ListBlockDeviceSnapshots pretends to list the snapshots of a block device
+func (d *NoopDriver) ListBlockDeviceSnapshots(ctx context.Context, volumeUUID string) ([]string, error) {
+	return nil, nil
+}
+
 // GetBlockDeviceSize pretends to return the number of bytes used by the block device
-func (d *NoopDriver) GetBlockDeviceSize(volumeUUID string) (uint64, error) {
+func (d *NoopDriver) GetBlockDeviceSize(ctx context.Context, volumeUUID string) (uint64, error) {
 	return 0, nil
 }
 
@@ -96,6 +102,11 @@ func (d *NoopDriver) IsValidSnapshotUUID(snapshotUUID string) error {
 }
 
 // Resize the underlying rbd image. Only extending is permitted.
-func (d *NoopDriver) Resize(volumeUUID string, sizeGiB int) (int, error) {
+func (d *NoopDriver) Resize(ctx context.Context, volumeUUID string, sizeGiB int) (int, error) {
 	return sizeGiB, nil
 }
+
+// ForceRelease pretends to break the locks held on a block device.
+func (d *NoopDriver) ForceRelease(ctx context.Context, volumeUUID string) error {
+	return nil
+}
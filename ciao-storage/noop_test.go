@@ -15,6 +15,7 @@
 package storage_test
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -35,12 +36,12 @@ func TestNoopCreateBlockDevice(t *testing.T) {
 	}
 	defer os.Remove(path)
 
-	device, err := noopDriver.CreateBlockDevice("", path, 0)
+	device, err := noopDriver.CreateBlockDevice(context.Background(), "", path, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = noopDriver.DeleteBlockDevice(device.ID)
+	err = noopDriver.DeleteBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,22 +59,22 @@ func TestNoopCopyBlockDevice(t *testing.T) {
 	}
 	defer os.Remove(path)
 
-	device, err := noopDriver.CreateBlockDevice("", path, 0)
+	device, err := noopDriver.CreateBlockDevice(context.Background(), "", path, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	copy, err := noopDriver.CopyBlockDevice(device.ID)
+	copy, err := noopDriver.CopyBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = noopDriver.DeleteBlockDevice(copy.ID)
+	err = noopDriver.DeleteBlockDevice(context.Background(), copy.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = noopDriver.DeleteBlockDevice(device.ID)
+	err = noopDriver.DeleteBlockDevice(context.Background(), device.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,12 +103,12 @@ func TestNoopMappings(t *testing.T) {
 }
 
 func TestNoopSnapshots(t *testing.T) {
-	err := noopDriver.CreateBlockDeviceSnapshot("", "")
+	err := noopDriver.CreateBlockDeviceSnapshot(context.Background(), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	bd, err := noopDriver.CreateBlockDeviceFromSnapshot("", "")
+	bd, err := noopDriver.CreateBlockDeviceFromSnapshot(context.Background(), "", "")
 	if err != nil || bd.ID == "" {
 		t.Fatal(err)
 	}
@@ -117,7 +118,12 @@ func TestNoopSnapshots(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = noopDriver.DeleteBlockDeviceSnapshot("", "")
+	_, err = noopDriver.ListBlockDeviceSnapshots(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = noopDriver.DeleteBlockDeviceSnapshot(context.Background(), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,6 +22,11 @@ import (
 var volAttachFlags = struct {
 	mode       string
 	mountpoint string
+	tag        string
+}{}
+
+var ipAttachFlags = struct {
+	address string
 }{}
 
 var attachCmd = &cobra.Command{
@@ -35,7 +40,7 @@ var attachIPCmd = &cobra.Command{
 	Long:  `Attach an external IP from a given pool to an instance.`,
 	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return errors.Wrap(c.MapExternalIP(args[0], args[1]), "Error mapping external IP")
+		return errors.Wrap(c.MapExternalAddress(args[0], args[1], ipAttachFlags.address), "Error mapping external IP")
 	},
 }
 
@@ -44,8 +49,8 @@ var attachVolCmd = &cobra.Command{
 	Short: `Attach a volume to an instance`,
 	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return errors.Wrap(c.AttachVolume(args[0], args[1], volAttachFlags.mountpoint, volAttachFlags.mode),
-			"Error attaching volume")
+		return errors.Wrap(c.AttachTaggedVolume(args[0], args[1], volAttachFlags.mountpoint,
+			volAttachFlags.mode, volAttachFlags.tag), "Error attaching volume")
 	},
 }
 
@@ -55,6 +60,8 @@ func init() {
 
 	rootCmd.AddCommand(attachCmd)
 
+	attachIPCmd.Flags().StringVar(&ipAttachFlags.address, "address", "", "Free address of the pool to map")
 	attachVolCmd.Flags().StringVar(&volAttachFlags.mode, "mode", "rw", "Access mode")
 	attachVolCmd.Flags().StringVar(&volAttachFlags.mountpoint, "mountpoint", "/mnt", "Mount point ")
+	attachVolCmd.Flags().StringVar(&volAttachFlags.tag, "tag", "", "Serial number identifying the volume in the instance, e.g., as /dev/disk/by-id/virtio-TAG")
 }
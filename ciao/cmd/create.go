@@ -15,15 +15,20 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
 
+	"github.com/intel/tfortools"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -40,16 +45,29 @@ var imgFlags = struct {
 }{}
 
 var instanceFlags = struct {
-	instances int
-	label     string
-	name      string
-	workload  string
+	instances   int
+	label       string
+	name        string
+	description string
+	workload    string
+	vcpus       int
+	memMB       int
+	diskGB      int
+	template    string
+	protected   bool
 }{}
 
 var tenantFlags = struct {
 	cidrPrefixSize             int
 	name                       string
 	createPrivilegedContainers bool
+	preprovisionNetwork        bool
+	trashRetention             int
+	maxSubnets                 int
+	cnciVCPUs                  int
+	cnciMem                    int
+	cnciDisk                   int
+	quotas                     []string
 }{}
 
 var volFlags = struct {
@@ -58,6 +76,7 @@ var volFlags = struct {
 	size        int
 	source      string
 	sourcetype  string
+	protected   bool
 }{}
 
 var imageCreateCmd = &cobra.Command{
@@ -123,17 +142,92 @@ func populateCreateServerRequest(server *api.CreateServerRequest) {
 	server.Server.MaxInstances = instanceFlags.instances
 	server.Server.MinInstances = 1
 	server.Server.Name = instanceFlags.name
+	server.Server.Description = instanceFlags.description
+	server.Server.VCPUs = instanceFlags.vcpus
+	server.Server.MemMB = instanceFlags.memMB
+	server.Server.DiskGB = instanceFlags.diskGB
+	server.Server.DeletionProtected = instanceFlags.protected
+}
+
+// templateOverrides returns the fields of a launch template's request
+// replaced by WORKLOAD and the flags given on the command line.
+func templateOverrides(cmd *cobra.Command, args []string) map[string]interface{} {
+	overrides := make(map[string]interface{})
+	flags := cmd.Flags()
+
+	if len(args) > 0 {
+		overrides["workload_id"] = args[0]
+	}
+
+	if flags.Changed("instances") {
+		overrides["max_count"] = instanceFlags.instances
+		overrides["min_count"] = 1
+	}
+
+	if flags.Changed("label") {
+		overrides["metadata"] = map[string]string{"label": instanceFlags.label}
+	}
+
+	if flags.Changed("name") {
+		overrides["name"] = instanceFlags.name
+	}
+
+	if flags.Changed("description") {
+		overrides["description"] = instanceFlags.description
+	}
+
+	if flags.Changed("vcpus") {
+		overrides["vcpus"] = instanceFlags.vcpus
+	}
+
+	if flags.Changed("mem-mb") {
+		overrides["mem_mb"] = instanceFlags.memMB
+	}
+
+	if flags.Changed("disk-gb") {
+		overrides["disk_gb"] = instanceFlags.diskGB
+	}
+
+	if flags.Changed("deletion-protected") {
+		overrides["deletion_protected"] = instanceFlags.protected
+	}
+
+	return overrides
+}
+
+// renderCreatedInstances shows the instances a request launched, even if
+// it failed to launch some of the others.
+func renderCreatedInstances(cmd *cobra.Command, servers api.Servers, err error) error {
+	if len(servers.Servers) > 0 {
+		if rerr := render(cmd, servers.Servers); rerr != nil {
+			return rerr
+		}
+	}
+
+	return errors.Wrap(err, "Error creating instances")
 }
 
 var instanceCreateCmd = &cobra.Command{
-	Use:   "instance WORKLOAD",
+	Use:   "instance [WORKLOAD]",
 	Short: "Create an instance of a workload",
-	Args:  cobra.ExactArgs(1),
+	Long: `Create instances of WORKLOAD, or from the launch template given with
+--template.  When a template is used WORKLOAD and the flags given replace
+the corresponding fields of the template's launch request.`,
+	Args: cobra.RangeArgs(0, 1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := validateCreateCommandArgs(); err != nil {
 			return err
 		}
 
+		if instanceFlags.template != "" {
+			servers, err := c.CreateInstancesFromTemplate(instanceFlags.template, templateOverrides(cmd, args))
+			return renderCreatedInstances(cmd, servers, err)
+		}
+
+		if len(args) != 1 {
+			return errors.New("WORKLOAD must be given unless --template is")
+		}
+
 		var server api.CreateServerRequest
 
 		server.Server.WorkloadID = args[0]
@@ -141,11 +235,7 @@ var instanceCreateCmd = &cobra.Command{
 		populateCreateServerRequest(&server)
 
 		servers, err := c.CreateInstances(server)
-		if err != nil {
-			return errors.Wrap(err, "Error creating instances")
-		}
-
-		return render(cmd, servers.Servers)
+		return renderCreatedInstances(cmd, servers, err)
 	},
 	Annotations: instanceListCmd.Annotations,
 }
@@ -159,41 +249,144 @@ var poolCreateCmd = &cobra.Command{
 	},
 }
 
+var signedURLFlags = struct {
+	expires time.Duration
+}{}
+
+var signedURLCreateTemplate = `{{ .URL }}
+`
+
+var signedURLCreateCmd = &cobra.Command{
+	Use:   "signed-url RESOURCE ID",
+	Short: "Create a URL through which a resource may be downloaded without credentials",
+	Long: `Create a short-lived URL through which a read-only resource may be
+downloaded by anyone who has it, without ciao credentials.  RESOURCE is
+one of operation or instance_history, as permitted by the controller.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		signed, err := c.CreateSignedURL(args[0], args[1], signedURLFlags.expires)
+		if err != nil {
+			return errors.Wrap(err, "Error creating signed URL")
+		}
+
+		return render(cmd, signed)
+	},
+	Annotations: map[string]string{
+		"default_template": signedURLCreateTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.SignedURL{}),
+	},
+}
+
+var tenantCreateTemplate = `ID:			{{ .ID }}
+Name:			{{ .Name }}
+SubnetBits:		{{ .Config.SubnetBits }}
+PrivilegedContainers:	{{ .Config.Permissions.PrivilegedContainers }}
+PreprovisionNetwork:	{{ .Config.PreprovisionNetwork }}
+TrashRetentionMinutes:	{{ .Config.TrashRetentionMinutes }}
+MaxSubnets:		{{ if eq .Config.MaxSubnets 0 }}unlimited{{ else }}{{ .Config.MaxSubnets }}{{ end }}
+{{- with .Config.CNCISize }}
+CNCISize:		{{ if .VCPUs }}{{ .VCPUs }} vCPUs {{ end }}{{ if .MemMB }}{{ .MemMB }} MB memory {{ end }}{{ if .DiskMB }}{{ .DiskMB }} MB disk{{ end }}
+{{- end }}
+Quotas:
+{{- range .Quotas }}
+	{{ .Name }}:	{{ if eq .Value -1 }}unlimited{{ else }}{{ .Value }}{{ end }}
+{{- end }}
+{{- range .Warnings }}
+Warning:		{{ . }}
+{{- end }}
+`
+
+// tenantCNCISize returns the size of the tenant's CNCIs given by the flags,
+// or nil if none were given.
+func tenantCNCISize() *types.CNCISize {
+	size := types.CNCISize{
+		VCPUs:  tenantFlags.cnciVCPUs,
+		MemMB:  tenantFlags.cnciMem,
+		DiskMB: tenantFlags.cnciDisk,
+	}
+
+	if size == (types.CNCISize{}) {
+		return nil
+	}
+
+	return &size
+}
+
+// parseTenantQuotas converts the NAME=VALUE quota flags of a tenant.
+func parseTenantQuotas(flags []string) ([]types.QuotaDetails, error) {
+	var quotas []types.QuotaDetails
+
+	for _, f := range flags {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Quota %s must be of the form NAME=VALUE", f)
+		}
+
+		v, err := parseQuotaValue(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		quotas = append(quotas, types.QuotaDetails{Name: kv[0], Value: v})
+	}
+
+	return quotas, nil
+}
+
 var tenantCreateCmd = &cobra.Command{
-	Use:   "tenant ID",
+	Use:   "tenant [ID]",
 	Short: "Create a new tenant in the cluster",
-	Args:  cobra.ExactArgs(1),
+	Long: `Create a new tenant in the cluster, with an ID generated by the controller
+unless one is given.  Creating a tenant again with the same ID and
+configuration succeeds without changing the tenant, so the command can be
+safely retried.`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if !c.IsPrivileged() {
 			return errors.New("Creating tenants is restricted to privileged users")
 		}
 
-		tenantID := args[0]
-
 		// CIDR prefix size must be between 12 and 30 bits
 		if tenantFlags.cidrPrefixSize != 0 && (tenantFlags.cidrPrefixSize > 30 || tenantFlags.cidrPrefixSize < 12) {
 			return errors.New("Subnet prefix must be 12-30")
 		}
 
-		tuuid, err := uuid.Parse(tenantID)
-		if err != nil {
-			return errors.New("Tenant ID must be a UUID")
+		var req types.TenantRequest
+		if len(args) == 1 {
+			tuuid, err := uuid.Parse(args[0])
+			if err != nil {
+				return errors.New("Tenant ID must be a UUID")
+			}
+			req.ID = tuuid.String()
 		}
 
-		config := types.TenantConfig{
+		req.Config = types.TenantConfig{
 			Name:       tenantFlags.name,
 			SubnetBits: tenantFlags.cidrPrefixSize,
 		}
-		config.Permissions.PrivilegedContainers = tenantFlags.createPrivilegedContainers
+		req.Config.Permissions.PrivilegedContainers = tenantFlags.createPrivilegedContainers
+		req.Config.PreprovisionNetwork = tenantFlags.preprovisionNetwork
+		req.Config.TrashRetentionMinutes = tenantFlags.trashRetention
+		req.Config.MaxSubnets = tenantFlags.maxSubnets
+		req.Config.CNCISize = tenantCNCISize()
 
-		summary, err := c.CreateTenantConfig(tuuid.String(), config)
+		quotas, err := parseTenantQuotas(tenantFlags.quotas)
+		if err != nil {
+			return err
+		}
+		req.Quotas = quotas
+
+		tenant, err := c.CreateTenant(req)
 		if err != nil {
 			return errors.Wrap(err, "Error creating tenant")
 		}
 
-		return render(cmd, summary)
+		return render(cmd, tenant)
+	},
+	Annotations: map[string]string{
+		"default_template": tenantCreateTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.TenantRecord{}),
 	},
-	Annotations: tenantShowCmd.Annotations,
 }
 
 var volumeCreateCmd = &cobra.Command{
@@ -204,12 +397,16 @@ var volumeCreateCmd = &cobra.Command{
 			Description: volFlags.description,
 			Name:        volFlags.name,
 			Size:        volFlags.size,
+
+			DeletionProtected: volFlags.protected,
 		}
 
 		if volFlags.sourcetype == "image" {
 			createReq.ImageRef = volFlags.source
 		} else if volFlags.sourcetype == "volume" {
 			createReq.SourceVolID = volFlags.source
+		} else if volFlags.sourcetype == "snapshot" {
+			createReq.SnapshotID = volFlags.source
 		}
 
 		vol, err := c.CreateVolume(createReq)
@@ -231,8 +428,10 @@ type disk struct {
 	ID        *string `yaml:"volume_id,omitempty"`
 	Size      int     `yaml:"size"`
 	Bootable  bool    `yaml:"bootable"`
+	BootIndex *int    `yaml:"boot_index,omitempty"`
 	Source    source  `yaml:"source"`
 	Ephemeral bool    `yaml:"ephemeral"`
+	Local     bool    `yaml:"local,omitempty"`
 }
 
 type workloadRequirements struct {
@@ -243,14 +442,29 @@ type workloadRequirements struct {
 	Privileged bool   `yaml:"privileged,omitempty"`
 }
 
+type workloadBounds struct {
+	MinVCPUs  int `yaml:"min_vcpus,omitempty"`
+	MaxVCPUs  int `yaml:"max_vcpus,omitempty"`
+	MinMemMB  int `yaml:"min_mem_mb,omitempty"`
+	MaxMemMB  int `yaml:"max_mem_mb,omitempty"`
+	MinDiskGB int `yaml:"min_disk_gb,omitempty"`
+	MaxDiskGB int `yaml:"max_disk_gb,omitempty"`
+}
+
+type workloadNetwork struct {
+	Subnet string `yaml:"subnet,omitempty"`
+}
+
 type workloadOptions struct {
 	Description     string               `yaml:"description"`
 	VMType          string               `yaml:"vm_type"`
 	FWType          string               `yaml:"fw_type,omitempty"`
 	ImageName       string               `yaml:"image_name,omitempty"`
 	Requirements    workloadRequirements `yaml:"requirements"`
+	Bounds          *workloadBounds      `yaml:"bounds,omitempty"`
 	CloudConfigFile string               `yaml:"cloud_init,omitempty"`
 	Disks           []disk               `yaml:"disks,omitempty"`
+	Networks        []workloadNetwork    `yaml:"networks,omitempty"`
 }
 
 func optToReqStorage(opt workloadOptions) ([]types.StorageResource, error) {
@@ -260,7 +474,9 @@ func optToReqStorage(opt workloadOptions) ([]types.StorageResource, error) {
 		res := types.StorageResource{
 			Size:      disk.Size,
 			Bootable:  disk.Bootable,
+			BootIndex: disk.BootIndex,
 			Ephemeral: disk.Ephemeral,
+			Local:     disk.Local,
 		}
 
 		// Use existing volume
@@ -289,9 +505,15 @@ func optToReqStorage(opt workloadOptions) ([]types.StorageResource, error) {
 				if disk.Size <= 0 {
 					return nil, errors.New("Invalid workload yaml: size required when creating a volume")
 				}
+
+				res.SourceType = types.Empty
 			}
 		}
 
+		if disk.Local && (!disk.Ephemeral || res.SourceType != types.Empty) {
+			return nil, errors.New("Invalid workload yaml: local disks must be empty and ephemeral")
+		}
+
 		if disk.Bootable {
 			bootableCount++
 		}
@@ -333,45 +555,177 @@ func optToReq(opt workloadOptions, req *types.Workload) error {
 	req.Requirements.NodeID = opt.Requirements.NodeID
 	req.Requirements.Privileged = opt.Requirements.Privileged
 
+	if opt.Bounds != nil {
+		req.Bounds = &types.WorkloadBounds{
+			MinVCPUs:  opt.Bounds.MinVCPUs,
+			MaxVCPUs:  opt.Bounds.MaxVCPUs,
+			MinMemMB:  opt.Bounds.MinMemMB,
+			MaxMemMB:  opt.Bounds.MaxMemMB,
+			MinDiskGB: opt.Bounds.MinDiskGB,
+			MaxDiskGB: opt.Bounds.MaxDiskGB,
+		}
+	}
+
+	for _, n := range opt.Networks {
+		req.Networks = append(req.Networks, types.NetworkRequirement{Subnet: n.Subnet})
+	}
+
 	return nil
 }
 
+// workloadFromFile builds a workload request from a workload yaml file.
+func workloadFromFile(config string) (types.Workload, error) {
+	var opt workloadOptions
+	var req types.Workload
+
+	f, err := ioutil.ReadFile(config)
+	if err != nil {
+		return req, errors.Wrap(err, "Error reading config file")
+	}
+
+	err = yaml.Unmarshal(f, &opt)
+	if err != nil {
+		return req, errors.Wrap(err, "Error unmarshalling file")
+	}
+
+	err = optToReq(opt, &req)
+	if err != nil {
+		return req, errors.Wrap(err, "Error converting options to request")
+	}
+
+	return req, nil
+}
+
 var workloadCreateCmd = &cobra.Command{
 	Use:   "workload FILE",
 	Short: `Create a new workload`,
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var opt workloadOptions
-		var req types.Workload
+		req, err := workloadFromFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		workload, err := c.CreateWorkload(req)
+		if err != nil {
+			return errors.Wrap(err, "Error creating workload")
+		}
 
-		config := args[0]
+		return render(cmd, workload)
+	},
+	Annotations: workloadShowCmd.Annotations,
+}
+
+// launchRequestFromFile reads the JSON instance create request stored in a
+// launch template from a file.
+func launchRequestFromFile(path string) (json.RawMessage, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading launch request file")
+	}
 
-		f, err := ioutil.ReadFile(config)
+	if !json.Valid(f) {
+		return nil, errors.New("Launch request file does not contain valid JSON")
+	}
+
+	return json.RawMessage(f), nil
+}
+
+var launchTemplateCreateCmd = &cobra.Command{
+	Use:   "launch-template NAME FILE",
+	Short: "Create a launch template",
+	Long: `Create a launch template from FILE, which contains the JSON body of an
+instance create request, e.g. {"server": {"workload_id": "...", "vcpus": 4}}.
+The request is checked against the workload when the template is saved.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		request, err := launchRequestFromFile(args[1])
 		if err != nil {
-			return errors.Wrap(err, "Error reading config file")
+			return err
 		}
 
-		err = yaml.Unmarshal(f, &opt)
+		template, err := c.CreateLaunchTemplate(args[0], request)
 		if err != nil {
-			return errors.Wrap(err, "Error unmarshalling file")
+			return errors.Wrap(err, "Error creating launch template")
+		}
+
+		return render(cmd, template)
+	},
+	Annotations: launchTemplateShowCmd.Annotations,
+}
+
+var snapshotScheduleFlags = struct {
+	volume    string
+	tag       string
+	interval  time.Duration
+	offset    time.Duration
+	retention int
+}{}
+
+var snapshotScheduleCreateCmd = &cobra.Command{
+	Use:   "snapshot-schedule",
+	Short: "Create a schedule of periodic volume snapshots",
+	Long: `Create a schedule which snapshots either a volume, given with --volume,
+or the volumes attached with a tag, given with --tag.  Snapshots are taken
+every --interval, shifted by --offset from midnight UTC, and only the
+newest --retention snapshots of each volume are kept.  For example
+--interval 24h --offset 2h takes a snapshot nightly at 02:00 UTC.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := snapshotScheduleFlags
+		if flags.interval%time.Minute != 0 || flags.offset%time.Minute != 0 {
+			return errors.New("The interval and offset must be whole minutes")
 		}
 
-		err = optToReq(opt, &req)
+		schedule, err := c.CreateSnapshotSchedule(types.SnapshotScheduleRequest{
+			VolumeID:        flags.volume,
+			Tag:             flags.tag,
+			IntervalMinutes: int(flags.interval / time.Minute),
+			OffsetMinutes:   int(flags.offset / time.Minute),
+			Retention:       flags.retention,
+		})
 		if err != nil {
-			return errors.Wrap(err, "Error converting options to request")
+			return errors.Wrap(err, "Error creating snapshot schedule")
 		}
 
-		workload, err := c.CreateWorkload(req)
+		return render(cmd, schedule)
+	},
+	Annotations: snapshotScheduleShowCmd.Annotations,
+}
+
+var volumeSnapshotName string
+
+var volumeSnapshotCreateTemplate = `ID:		{{ .ID }}
+Volume:		{{ .VolumeID }}
+{{- if .Name }}
+Name:		{{ .Name }}
+{{- end }}
+Attached:	{{ .Attached }}
+Created:	{{ .CreateTime }}
+`
+
+var volumeSnapshotCreateCmd = &cobra.Command{
+	Use:   "snapshot VOLUME",
+	Short: "Take a snapshot of a volume",
+	Long: `Take a snapshot of a volume.  Snapshots of volumes attached to instances
+are flagged as they may not be consistent.  A volume cannot be deleted until
+the snapshots taken of it with this command are deleted.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snap, err := c.CreateVolumeSnapshot(args[0], volumeSnapshotName)
 		if err != nil {
-			return errors.Wrap(err, "Error creating workload")
+			return errors.Wrap(err, "Error taking volume snapshot")
 		}
 
-		return render(cmd, workload)
+		return render(cmd, snap)
+	},
+	Annotations: map[string]string{
+		"default_template": volumeSnapshotCreateTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.VolumeSnapshot{}),
 	},
-	Annotations: workloadShowCmd.Annotations,
 }
 
-var createCmds = []*cobra.Command{imageCreateCmd, instanceCreateCmd, poolCreateCmd, volumeCreateCmd, workloadCreateCmd, tenantCreateCmd}
+var createCmds = []*cobra.Command{imageCreateCmd, instanceCreateCmd, launchTemplateCreateCmd, poolCreateCmd, signedURLCreateCmd, snapshotScheduleCreateCmd, volumeSnapshotCreateCmd, volumeCreateCmd, workloadCreateCmd, tenantCreateCmd}
 
 func init() {
 	for _, cmd := range createCmds {
@@ -385,15 +739,38 @@ func init() {
 	instanceCreateCmd.Flags().IntVar(&instanceFlags.instances, "instances", 1, "Number of instances to create")
 	instanceCreateCmd.Flags().StringVar(&instanceFlags.label, "label", "", "Set a frame label. This will trigger frame tracing")
 	instanceCreateCmd.Flags().StringVar(&instanceFlags.name, "name", "", "Name for this instance. When multiple instances are requested this is used as a prefix")
+	instanceCreateCmd.Flags().StringVar(&instanceFlags.description, "description", "", "Description of the instances")
 	instanceCreateCmd.Flags().StringVar(&instanceFlags.workload, "workload", "", "Workload UUID")
+	instanceCreateCmd.Flags().IntVar(&instanceFlags.vcpus, "vcpus", 0, "Override the number of VCPUs, within the workload's bounds")
+	instanceCreateCmd.Flags().IntVar(&instanceFlags.memMB, "mem-mb", 0, "Override the memory in MiB, within the workload's bounds")
+	instanceCreateCmd.Flags().IntVar(&instanceFlags.diskGB, "disk-gb", 0, "Override the ephemeral disk size in GiB, within the workload's bounds")
+	instanceCreateCmd.Flags().StringVar(&instanceFlags.template, "template", "", "Name of the launch template to create the instances from")
+	instanceCreateCmd.Flags().BoolVar(&instanceFlags.protected, "deletion-protected", false, "Protect the instances from deletion until the protection is cleared")
+
+	signedURLCreateCmd.Flags().DurationVar(&signedURLFlags.expires, "expires", 0, "Lifetime of the URL, 0 for the longest the controller permits")
+
+	snapshotScheduleCreateCmd.Flags().StringVar(&snapshotScheduleFlags.volume, "volume", "", "ID of the volume to snapshot")
+	snapshotScheduleCreateCmd.Flags().StringVar(&snapshotScheduleFlags.tag, "tag", "", "Snapshot the volumes attached with this tag")
+	snapshotScheduleCreateCmd.Flags().DurationVar(&snapshotScheduleFlags.interval, "interval", 24*time.Hour, "Time between snapshots")
+	snapshotScheduleCreateCmd.Flags().DurationVar(&snapshotScheduleFlags.offset, "offset", 0, "Shift of the snapshots from midnight UTC, less than the interval")
+	snapshotScheduleCreateCmd.Flags().IntVar(&snapshotScheduleFlags.retention, "retention", 7, "Number of snapshots of each volume to keep")
 
 	volumeCreateCmd.Flags().StringVar(&volFlags.description, "description", "", "Volume description")
 	volumeCreateCmd.Flags().StringVar(&volFlags.name, "name", "", "Volume name")
 	volumeCreateCmd.Flags().IntVar(&volFlags.size, "size", 1, "Size of the volume in GiB")
-	volumeCreateCmd.Flags().StringVar(&volFlags.source, "source", "", "ID of image or volume to clone from")
-	volumeCreateCmd.Flags().StringVar(&volFlags.sourcetype, "source-type", "image", "The type of the source to clone from")
+	volumeCreateCmd.Flags().StringVar(&volFlags.source, "source", "", "ID of image, volume or volume snapshot to clone from")
+	volumeCreateCmd.Flags().StringVar(&volFlags.sourcetype, "source-type", "image", "The type of the source to clone from: image, volume or snapshot")
+	volumeSnapshotCreateCmd.Flags().StringVar(&volumeSnapshotName, "name", "", "Snapshot name")
+	volumeCreateCmd.Flags().BoolVar(&volFlags.protected, "deletion-protected", false, "Protect the volume from deletion until the protection is cleared")
 
 	tenantCreateCmd.Flags().IntVar(&tenantFlags.cidrPrefixSize, "cidr-prefix-size", 0, "Number of bits in network mask (12-30)")
 	tenantCreateCmd.Flags().BoolVar(&tenantFlags.createPrivilegedContainers, "create-privileged-containers", false, "Whether this tenant can create privileged containers")
 	tenantCreateCmd.Flags().StringVar(&tenantFlags.name, "name", "", "Tenant name")
+	tenantCreateCmd.Flags().BoolVar(&tenantFlags.preprovisionNetwork, "preprovision-network", false, "Launch the CNCI for the tenant's first subnet when the tenant is created")
+	tenantCreateCmd.Flags().IntVar(&tenantFlags.trashRetention, "trash-retention", 0, "Minutes deleted instances and volumes stay in the trash, 0 for the cluster default, -1 to delete immediately")
+	tenantCreateCmd.Flags().IntVar(&tenantFlags.maxSubnets, "max-subnets", 0, "Maximum number of subnets in the tenant's network, 0 for no limit")
+	tenantCreateCmd.Flags().IntVar(&tenantFlags.cnciVCPUs, "cnci-vcpus", 0, "Number of vCPUs of the tenant's CNCIs, 0 for the cluster default")
+	tenantCreateCmd.Flags().IntVar(&tenantFlags.cnciMem, "cnci-mem", 0, "Memory of the tenant's CNCIs in MB, 0 for the cluster default")
+	tenantCreateCmd.Flags().IntVar(&tenantFlags.cnciDisk, "cnci-disk", 0, "Disk size of the tenant's CNCIs in MB, 0 for the cluster default")
+	tenantCreateCmd.Flags().StringArrayVar(&tenantFlags.quotas, "quota", nil, "Initial quota or limit of the tenant as NAME=VALUE, VALUE may be unlimited (repeatable)")
 }
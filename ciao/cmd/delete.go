@@ -15,6 +15,9 @@
 package cmd
 
 import (
+	"fmt"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -41,23 +44,61 @@ var imageDelCmd = &cobra.Command{
 	},
 }
 
+// deleteProtected returns the error reported when deleting a resource
+// protected from deletion.  The protection must be cleared explicitly with
+// the update command before the resource can be deleted.
+func deleteProtected(err error, kind string, ID string) error {
+	if errors.Cause(err) == types.ErrDeletionProtected {
+		return fmt.Errorf("%s %s is protected from deletion, clear the protection with \"ciao update %s %s --deletion-protected=false\" first",
+			kind, ID, kind, ID)
+	}
+
+	return err
+}
+
 var deleteInstanceFlags = struct {
-	all bool
+	all   bool
+	force bool
 }{}
 
 var instanceDelCmd = &cobra.Command{
 	Use:   "instance ID",
 	Short: "Delete instance from cluster",
+	Long: `Delete an instance.  Instances protected from deletion are not deleted,
+not even with --all, until their protection is cleared.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if deleteInstanceFlags.all {
-			return errors.Wrap(c.DeleteAllInstances(), "Error deleting all instances")
+			resp, err := c.DeleteAllInstances()
+			if err != nil {
+				return errors.Wrap(err, "Error deleting all instances")
+			}
+
+			for _, ID := range resp.Protected {
+				fmt.Printf("Instance %s is protected from deletion and was not deleted\n", ID)
+			}
+			return nil
 		}
 
 		if len(args) < 1 {
 			return errors.New("Instance ID required")
 		}
 
-		return errors.Wrap(c.DeleteInstance(args[0]), "Error deleting instance")
+		if deleteInstanceFlags.force {
+			return errors.Wrap(c.ForceDeleteInstance(args[0]), "Error deleting instance")
+		}
+
+		return errors.Wrap(deleteProtected(c.DeleteInstance(args[0]), "instance", args[0]),
+			"Error deleting instance")
+	},
+}
+
+var launchTemplateDelCmd = &cobra.Command{
+	Use:   "launch-template NAME",
+	Short: "Delete a launch template",
+	Long:  "Deletes a launch template.  Instances created from it are not affected",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return errors.Wrap(c.DeleteLaunchTemplate(args[0]), "Error deleting launch template")
 	},
 }
 
@@ -70,21 +111,51 @@ var poolDelCmd = &cobra.Command{
 	},
 }
 
+var deleteVolumeForce bool
+
 var volumeDelCmd = &cobra.Command{
 	Use:   "volume ID",
 	Short: "Delete a volume",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return errors.Wrap(c.DeleteVolume(args[0]), "Error deleting volume")
+		if deleteVolumeForce {
+			return errors.Wrap(c.ForceDeleteVolume(args[0]), "Error deleting volume")
+		}
+
+		return errors.Wrap(deleteProtected(c.DeleteVolume(args[0]), "volume", args[0]),
+			"Error deleting volume")
 	},
 }
 
+var deleteTenantFlags = struct {
+	force  bool
+	noWait bool
+}{}
+
 var tenantDelCmd = &cobra.Command{
 	Use:   "tenant ID",
 	Short: "Delete a tenant",
-	Args:  cobra.ExactArgs(1),
+	Long: `Delete a tenant together with its instances, CNCIs, external IPs,
+workloads, images and volumes.  A tenant which still has instances is only
+deleted if --force is given.  The command waits for the deletion to complete
+unless --no-wait is given.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return errors.Wrap(c.DeleteTenant(args[0]), "Error deleting tenant")
+		op, err := c.DeleteTenant(args[0], deleteTenantFlags.force)
+		if errors.Cause(err) == types.ErrDeletionProtected {
+			return errors.New("Tenant owns instances or volumes protected from deletion, use --force to delete them")
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error deleting tenant")
+		}
+
+		if op.ID == "" || deleteTenantFlags.noWait {
+			return nil
+		}
+
+		_, err = c.WaitOperation(op.ID)
+
+		return errors.Wrap(err, "Error deleting tenant")
 	},
 }
 
@@ -97,7 +168,26 @@ var workloadDelCmd = &cobra.Command{
 	},
 }
 
-var delCmds = []*cobra.Command{eventsDelCmd, imageDelCmd, instanceDelCmd, poolDelCmd, volumeDelCmd, workloadDelCmd, tenantDelCmd}
+var snapshotScheduleDelCmd = &cobra.Command{
+	Use:   "snapshot-schedule ID",
+	Short: "Delete a snapshot schedule",
+	Long:  "Deletes a snapshot schedule.  The snapshots it has taken are kept until their volumes are deleted",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return errors.Wrap(c.DeleteSnapshotSchedule(args[0]), "Error deleting snapshot schedule")
+	},
+}
+
+var volumeSnapshotDelCmd = &cobra.Command{
+	Use:   "snapshot VOLUME ID",
+	Short: "Delete a snapshot of a volume",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return errors.Wrap(c.DeleteVolumeSnapshot(args[0], args[1]), "Error deleting volume snapshot")
+	},
+}
+
+var delCmds = []*cobra.Command{eventsDelCmd, imageDelCmd, instanceDelCmd, launchTemplateDelCmd, poolDelCmd, snapshotScheduleDelCmd, volumeSnapshotDelCmd, volumeDelCmd, workloadDelCmd, tenantDelCmd}
 
 func init() {
 	for _, cmd := range delCmds {
@@ -105,6 +195,10 @@ func init() {
 	}
 
 	instanceDelCmd.Flags().BoolVar(&deleteInstanceFlags.all, "all", false, "Delete all instances")
+	instanceDelCmd.Flags().BoolVar(&deleteInstanceFlags.force, "force", false, "Delete the instance even if it is protected, admin only")
+	volumeDelCmd.Flags().BoolVar(&deleteVolumeForce, "force", false, "Delete the volume even if it is protected, admin only")
+	tenantDelCmd.Flags().BoolVar(&deleteTenantFlags.force, "force", false, "Delete the tenant even if it has instances or owns protected instances or volumes")
+	tenantDelCmd.Flags().BoolVar(&deleteTenantFlags.noWait, "no-wait", false, "Return as soon as the deletion has started")
 
 	rootCmd.AddCommand(deleteCmd)
 }
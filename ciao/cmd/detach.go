@@ -33,11 +33,26 @@ var detachIPCmd = &cobra.Command{
 	},
 }
 
+var detachVolFlags struct {
+	force   bool
+	confirm bool
+}
+
 var detachVolCmd = &cobra.Command{
 	Use:   "volume VOLUME",
 	Short: "Detach a volume from an instance",
-	Args:  cobra.ExactArgs(1),
+	Long: `Detach a volume from an instance.
+
+An admin may force a volume left attached to an instance on a failed node to
+be detached. Forcing a volume to detach from a running instance requires
+--confirm.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if detachVolFlags.force {
+			return errors.Wrap(c.ForceDetachVolume(args[0], detachVolFlags.confirm),
+				"Error force detaching volume")
+		}
+
 		return errors.Wrap(c.DetachVolume(args[0]), "Error detaching volume")
 	},
 }
@@ -46,5 +61,8 @@ func init() {
 	detachCmd.AddCommand(detachIPCmd)
 	detachCmd.AddCommand(detachVolCmd)
 
+	detachVolCmd.Flags().BoolVar(&detachVolFlags.force, "force", false, "Detach the volume even if its instance cannot release it (admin only)")
+	detachVolCmd.Flags().BoolVar(&detachVolFlags.confirm, "confirm", false, "Confirm forcing the volume to detach from a running instance")
+
 	rootCmd.AddCommand(detachCmd)
 }
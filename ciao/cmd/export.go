@@ -0,0 +1,141 @@
+// Copyright © 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/intel/tfortools"
+	"github.com/pkg/errors"
+
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export definitions for use on another cluster",
+}
+
+var exportTenantFlags = struct {
+	file string
+}{}
+
+var exportTenantCmd = &cobra.Command{
+	Use:   "tenant TENANT",
+	Short: "Export the definitions of a tenant",
+	Long: `Export the configuration, quotas, private workloads and launch templates
+of a tenant as a JSON document which can be imported into another cluster
+with "ciao import tenant". Instances, volumes, images and other runtime
+state are not exported.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tuuid, err := uuid.Parse(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Tenant ID must be a UUID4")
+		}
+
+		export, err := c.ExportTenant(tuuid.String())
+		if err != nil {
+			return errors.Wrap(err, "Error exporting tenant")
+		}
+
+		b, err := json.MarshalIndent(export, "", "\t")
+		if err != nil {
+			return errors.Wrap(err, "Error marshalling tenant export")
+		}
+		b = append(b, '\n')
+
+		if exportTenantFlags.file == "" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+
+		return errors.Wrap(ioutil.WriteFile(exportTenantFlags.file, b, 0600), "Error writing tenant export")
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import definitions exported from another cluster",
+}
+
+var importTenantFlags = struct {
+	validateOnly bool
+}{}
+
+var importTenantCmd = &cobra.Command{
+	Use:   "tenant FILE",
+	Short: "Import a tenant exported from another cluster",
+	Long: `Import a tenant exported with "ciao export tenant". The tenant, its
+quotas, its workloads and its launch templates are imported in turn. The
+objects of each class are imported together, or not at all if any of them
+conflicts with the objects already on the cluster. With --validate-only the
+conflicts are reported but nothing is imported.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		b, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error reading tenant export")
+		}
+
+		var export types.TenantExport
+		err = json.Unmarshal(b, &export)
+		if err != nil {
+			return errors.Wrap(err, "Error parsing tenant export")
+		}
+
+		resp, err := c.ImportTenant(export, importTenantFlags.validateOnly)
+		if err != nil {
+			return errors.Wrap(err, "Error importing tenant")
+		}
+
+		if template != "" {
+			return render(cmd, resp)
+		}
+
+		for _, class := range resp.Classes {
+			status := "imported"
+			if len(class.Conflicts) > 0 {
+				status = "conflicts"
+			} else if !class.Applied {
+				status = "valid"
+			}
+			fmt.Printf("%-17s %3d %s\n", class.Class, class.Count, status)
+			for _, conflict := range class.Conflicts {
+				fmt.Printf("\t%s: %s\n", conflict.Name, conflict.Reason)
+			}
+		}
+
+		return nil
+	},
+	Annotations: map[string]string{
+		"template_usage": tfortools.GenerateUsageUndecorated(types.TenantImportResponse{}),
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(exportTenantCmd)
+	rootCmd.AddCommand(exportCmd)
+	importCmd.AddCommand(importTenantCmd)
+	rootCmd.AddCommand(importCmd)
+
+	exportTenantCmd.Flags().StringVar(&exportTenantFlags.file, "file", "", "File to write the export to instead of standard output")
+	importTenantCmd.Flags().BoolVar(&importTenantFlags.validateOnly, "validate-only", false, "Report conflicts without importing anything")
+}
@@ -15,6 +15,10 @@
 package cmd
 
 import (
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/intel/tfortools"
@@ -49,6 +53,75 @@ var cnciListCmd = &cobra.Command{
 	},
 }
 
+var attachmentListFlags = struct {
+	tenantID   string
+	instanceID string
+	volumeID   string
+	nodeID     string
+	state      string
+	limit      int
+}{}
+
+var attachmentListCmd = &cobra.Command{
+	Use:  "attachments",
+	Long: `List the storage attachments of all tenants, optionally filtered by tenant, instance, volume, node or volume state.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := types.AttachmentFilter{
+			TenantID:   attachmentListFlags.tenantID,
+			InstanceID: attachmentListFlags.instanceID,
+			VolumeID:   attachmentListFlags.volumeID,
+			NodeID:     attachmentListFlags.nodeID,
+			State:      types.BlockState(attachmentListFlags.state),
+			Limit:      attachmentListFlags.limit,
+		}
+
+		var attachments []types.AttachmentDetails
+		for {
+			page, err := c.ListAttachments(filter)
+			if err != nil {
+				return errors.Wrap(err, "Error listing attachments")
+			}
+
+			attachments = append(attachments, page.Attachments...)
+
+			// without a limit every page is retrieved
+			if attachmentListFlags.limit > 0 || page.NextMarker == "" {
+				break
+			}
+
+			filter.Marker = page.NextMarker
+		}
+
+		return render(cmd, attachments)
+	},
+	Annotations: map[string]string{
+		"default_template": "{{ table .}}",
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.AttachmentDetails{}),
+	},
+}
+
+var eventListFlags = struct {
+	start    string
+	end      string
+	typ      string
+	objectID string
+	limit    int
+}{}
+
+func parseEventTime(flag string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, errors.Wrapf(err, "Invalid --%s", flag)
+	}
+
+	return t, nil
+}
+
 var eventListCmd = &cobra.Command{
 	Use:  "events [TENANT]",
 	Long: `List events for the provided tenant. If no tenant is specified and the user is privileged events for all tenants will be returned otherwise returns the current tenants events.`,
@@ -59,18 +132,44 @@ var eventListCmd = &cobra.Command{
 			tenantID = args[0]
 		}
 
-		if !c.IsPrivileged() {
-			if tenantID == "" {
-				tenantID = c.TenantID
-			}
+		var filter types.EventFilter
+		var err error
+
+		filter.Start, err = parseEventTime("start", eventListFlags.start)
+		if err != nil {
+			return err
 		}
 
-		events, err := c.ListEvents(tenantID)
+		filter.End, err = parseEventTime("end", eventListFlags.end)
 		if err != nil {
-			return errors.Wrap(err, "Error listing events")
+			return err
 		}
 
-		return render(cmd, events.Events)
+		filter.Type = eventListFlags.typ
+		filter.ObjectID = eventListFlags.objectID
+		filter.Limit = eventListFlags.limit
+
+		var events []types.CiaoEvent
+		for {
+			page, err := c.ListEventLog(tenantID, filter)
+			if err != nil {
+				return errors.Wrap(err, "Error listing events")
+			}
+
+			events = append(events, page.Events...)
+
+			// without a limit every page is retrieved
+			if eventListFlags.limit > 0 || page.NextMarker == "" {
+				break
+			}
+
+			filter.Marker, err = strconv.ParseInt(page.NextMarker, 10, 64)
+			if err != nil {
+				return errors.Wrap(err, "Invalid marker returned")
+			}
+		}
+
+		return render(cmd, events)
 	},
 	Annotations: map[string]string{
 		"default_template": "{{ table .}}",
@@ -78,6 +177,102 @@ var eventListCmd = &cobra.Command{
 	},
 }
 
+var usageListFlags = struct {
+	start       string
+	end         string
+	granularity string
+	csv         bool
+}{}
+
+var usageListCmd = &cobra.Command{
+	Use:  "usage [TENANT]",
+	Long: `List the usage tenants made of instances, volumes and external IPs. If no tenant is specified the usage of all tenants is listed. Only privileged users may list usage.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := types.UsageFilter{
+			Granularity: types.UsageGranularity(usageListFlags.granularity),
+		}
+
+		if len(args) == 1 {
+			filter.TenantID = args[0]
+		}
+
+		var err error
+
+		filter.Start, err = parseEventTime("start", usageListFlags.start)
+		if err != nil {
+			return err
+		}
+
+		filter.End, err = parseEventTime("end", usageListFlags.end)
+		if err != nil {
+			return err
+		}
+
+		if usageListFlags.csv {
+			b, err := c.ExportUsageCSV(filter)
+			if err != nil {
+				return errors.Wrap(err, "Error exporting usage")
+			}
+
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+
+		usage, err := c.ListUsage(filter)
+		if err != nil {
+			return errors.Wrap(err, "Error listing usage")
+		}
+
+		return render(cmd, usage)
+	},
+	Annotations: map[string]string{
+		"default_template": "{{ table .}}",
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.UsageRecord{}),
+	},
+}
+
+var instanceHistoryListFlags = struct {
+	limit int
+}{}
+
+var instanceHistoryListCmd = &cobra.Command{
+	Use:  "instance-history ID",
+	Long: `List the history of an instance, oldest entry first. The history of a deleted instance is kept for as long as its tenant's trash retention period.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := types.InstanceHistoryFilter{
+			Limit: instanceHistoryListFlags.limit,
+		}
+
+		var entries []types.InstanceHistoryEntry
+		for {
+			page, err := c.GetInstanceHistory(args[0], filter)
+			if err != nil {
+				return errors.Wrap(err, "Error getting instance history")
+			}
+
+			entries = append(entries, page.Entries...)
+
+			// without a limit every page is retrieved
+			if instanceHistoryListFlags.limit > 0 || page.NextMarker == "" {
+				break
+			}
+
+			filter.Marker, err = strconv.Atoi(page.NextMarker)
+			if err != nil {
+				return errors.Wrap(err, "Invalid marker returned")
+			}
+		}
+
+		return render(cmd, entries)
+	},
+	Annotations: map[string]string{
+		"default_template": "{{ table .}}",
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.InstanceHistoryEntry{}),
+	},
+}
+
 var externalipListCmd = &cobra.Command{
 	Use:  "external-ips",
 	Long: `List external IP addresses.`,
@@ -114,6 +309,23 @@ var imageListCmd = &cobra.Command{
 	},
 }
 
+var instanceListFlags = struct {
+	search string
+	wide   bool
+}{}
+
+// wideInstance is a row of the wide instance list.  Lock is shown for the
+// instances protected from deletion.
+type wideInstance struct {
+	Name        string
+	ID          string
+	SSHIP       string
+	SSHPort     int
+	Status      string
+	Lock        string
+	Description string
+}
+
 var instanceListCmd = &cobra.Command{
 	Use:  "instances [WORKLOAD]",
 	Long: `List instances. If the optional workload ID is provided then only show instances matching that ID.`,
@@ -124,11 +336,32 @@ var instanceListCmd = &cobra.Command{
 			workloadID = args[0]
 		}
 
-		servers, err := c.ListInstancesByWorkload(c.TenantID, workloadID)
+		servers, err := c.SearchInstances(c.TenantID, workloadID, instanceListFlags.search)
 		if err != nil {
 			return errors.Wrap(err, "Error listing instances")
 		}
 
+		if instanceListFlags.wide && template == "" {
+			var instances []wideInstance
+			for _, s := range servers.Servers {
+				i := wideInstance{
+					Name:        s.Name,
+					ID:          s.ID,
+					SSHIP:       s.SSHIP,
+					SSHPort:     s.SSHPort,
+					Status:      s.Status,
+					Description: s.Description,
+				}
+				if s.DeletionProtected {
+					i.Lock = "locked"
+				}
+				instances = append(instances, i)
+			}
+
+			template = "{{ table . }}"
+			return render(cmd, instances)
+		}
+
 		return render(cmd, servers.Servers)
 	},
 	Annotations: map[string]string{
@@ -173,6 +406,96 @@ var nodeListCmd = &cobra.Command{
 	},
 }
 
+var operationListCmd = &cobra.Command{
+	Use:  "operations",
+	Long: `List the asynchronous operations of the tenant.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ops, err := c.ListOperations()
+		if err != nil {
+			return errors.Wrap(err, "Error listing operations")
+		}
+
+		return render(cmd, ops)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "ID" "Type" "Target" "State" "Progress") }}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.Operation{}),
+	},
+}
+
+var trashListCmd = &cobra.Command{
+	Use:  "trash",
+	Long: `List the deleted instances and volumes which may still be restored.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		items, err := c.ListTrash()
+		if err != nil {
+			return errors.Wrap(err, "Error listing trash")
+		}
+
+		return render(cmd, items)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "ID" "Type" "Name" "DeleteTime" "PurgeTime") }}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.TrashItem{}),
+	},
+}
+
+var launchTemplateListCmd = &cobra.Command{
+	Use:  "launch-templates",
+	Long: `List the launch templates of the tenant.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		templates, err := c.ListLaunchTemplates()
+		if err != nil {
+			return errors.Wrap(err, "Error listing launch templates")
+		}
+
+		return render(cmd, templates)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "Name" "Version" "UpdateTime") }}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.LaunchTemplate{}),
+	},
+}
+
+var snapshotScheduleListCmd = &cobra.Command{
+	Use:  "snapshot-schedules",
+	Long: `List the snapshot schedules of the tenant.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schedules, err := c.ListSnapshotSchedules()
+		if err != nil {
+			return errors.Wrap(err, "Error listing snapshot schedules")
+		}
+
+		return render(cmd, schedules)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "ID" "VolumeID" "Tag" "IntervalMinutes" "Retention" "NextRun" "LastError") }}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.SnapshotSchedule{}),
+	},
+}
+
+var volumeSnapshotListCmd = &cobra.Command{
+	Use:  "snapshots VOLUME",
+	Long: `List the snapshots taken of a volume, on request or by the tenant's snapshot schedules, oldest first.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshots, err := c.ListVolumeSnapshots(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error listing volume snapshots")
+		}
+
+		return render(cmd, snapshots)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "ID" "Name" "ScheduleID" "Attached" "CreateTime") }}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.VolumeSnapshot{}),
+	},
+}
+
 var poolListCmd = &cobra.Command{
 	Use:  "pools",
 	Long: `List external IP pools.`,
@@ -217,6 +540,82 @@ var quotasListCmd = &cobra.Command{
 	},
 }
 
+var quotaDenialsListFlags = struct {
+	limit int
+}{}
+
+var quotaDenialsListCmd = &cobra.Command{
+	Use:  "quota-denials",
+	Long: `List the tenants with the most quota denials over the controller's quota denial window.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !c.IsPrivileged() {
+			return errors.New("Listing quota denials is limited to privileged users")
+		}
+
+		denials, err := c.ListQuotaDenials(quotaDenialsListFlags.limit)
+		if err != nil {
+			return errors.Wrap(err, "Error getting quota denials")
+		}
+
+		return render(cmd, denials.Tenants)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "TenantID" "Denials")}}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.TenantQuotaDenials{}),
+	},
+}
+
+var quotaHistoryListFlags = struct {
+	resource string
+	since    string
+}{}
+
+var quotaHistoryListCmd = &cobra.Command{
+	Use:  "quota-history TENANT",
+	Long: `List the changes in the consumption of the resources of a tenant which are subject to quotas, oldest first.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !c.IsPrivileged() {
+			return errors.New("Listing quota history is limited to privileged users")
+		}
+
+		since, err := parseEventTime("since", quotaHistoryListFlags.since)
+		if err != nil {
+			return err
+		}
+
+		history, err := c.ListQuotaHistory(args[0], quotaHistoryListFlags.resource, since)
+		if err != nil {
+			return errors.Wrap(err, "Error getting quota history")
+		}
+
+		return render(cmd, history)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "Timestamp" "Resource" "Delta" "Usage" "Allowed")}}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.QuotaAuditRecord{}),
+	},
+}
+
+var capacityListCmd = &cobra.Command{
+	Use:  "capacity",
+	Long: `List how many more instances of each workload the current tenant could launch.`,
+	Args: cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		capacity, err := c.GetTenantCapacity()
+		if err != nil {
+			return errors.Wrap(err, "Error getting capacity")
+		}
+
+		return render(cmd, capacity.Workloads)
+	},
+	Annotations: map[string]string{
+		"default_template": `{{ table (cols . "WorkloadID" "Description" "Cluster" "Quota" "Available")}}`,
+		"template_usage":   tfortools.GenerateUsageUndecorated([]types.WorkloadCapacity{}),
+	},
+}
+
 var tenantListCmd = &cobra.Command{
 	Use:  "tenants",
 	Long: `List tenants available to the user or if privileged those on the cluster.`,
@@ -291,12 +690,14 @@ type workload struct {
 	Mem  int    `json:"ram"`
 }
 
+var workloadListSearch string
+
 var workloadListCmd = &cobra.Command{
 	Use:  "workloads",
 	Long: `List workloads.`,
 	Args: cobra.ExactArgs(0),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		wls, err := c.ListWorkloads()
+		wls, err := c.SearchWorkloads(workloadListSearch)
 		if err != nil {
 			return errors.Wrap(err, "Error listing workloads")
 		}
@@ -320,17 +721,28 @@ var workloadListCmd = &cobra.Command{
 }
 
 var listCmds = []*cobra.Command{
+	attachmentListCmd,
+	capacityListCmd,
 	cnciListCmd,
 	eventListCmd,
 	externalipListCmd,
 	imageListCmd,
+	instanceHistoryListCmd,
 	instanceListCmd,
+	launchTemplateListCmd,
 	nodeListCmd,
+	operationListCmd,
 	poolListCmd,
+	quotaDenialsListCmd,
+	quotaHistoryListCmd,
 	quotasListCmd,
+	snapshotScheduleListCmd,
 	tenantListCmd,
 	traceListCmd,
+	trashListCmd,
+	usageListCmd,
 	volumeListCmd,
+	volumeSnapshotListCmd,
 	workloadListCmd,
 }
 
@@ -343,5 +755,35 @@ func init() {
 	nodeListCmd.Flags().BoolVar(&nodeListFlags.computeNodesOnly, "compute-nodes", false, "Only show compute nodes")
 	nodeListCmd.Flags().BoolVar(&nodeListFlags.networkNodesOnly, "network-nodes", false, "Only show network nodes")
 
+	attachmentListCmd.Flags().StringVar(&attachmentListFlags.tenantID, "tenant", "", "Only list attachments of volumes owned by this tenant")
+	attachmentListCmd.Flags().StringVar(&attachmentListFlags.instanceID, "instance", "", "Only list attachments to this instance")
+	attachmentListCmd.Flags().StringVar(&attachmentListFlags.volumeID, "volume", "", "Only list attachments of this volume")
+	attachmentListCmd.Flags().StringVar(&attachmentListFlags.nodeID, "node", "", "Only list attachments to instances placed on this node")
+	attachmentListCmd.Flags().StringVar(&attachmentListFlags.state, "state", "", "Only list attachments of volumes in this state, e.g., attaching")
+	attachmentListCmd.Flags().IntVar(&attachmentListFlags.limit, "limit", 0, "Maximum number of attachments to list, 0 lists them all")
+
+	eventListCmd.Flags().StringVar(&eventListFlags.start, "start", "", "Only list events logged at or after this RFC3339 time")
+	eventListCmd.Flags().StringVar(&eventListFlags.end, "end", "", "Only list events logged before this RFC3339 time")
+	eventListCmd.Flags().StringVar(&eventListFlags.typ, "type", "", "Only list events of this type: info, error or action")
+	eventListCmd.Flags().StringVar(&eventListFlags.objectID, "object", "", "Only list events concerning the object with this ID")
+	eventListCmd.Flags().IntVar(&eventListFlags.limit, "limit", 0, "Maximum number of events to list, 0 lists them all")
+
+	instanceListCmd.Flags().StringVar(&instanceListFlags.search, "search", "", "Only list instances whose name or description contains this text")
+	instanceListCmd.Flags().BoolVar(&instanceListFlags.wide, "wide", false, "Include the description and deletion protection of the instances")
+
+	workloadListCmd.Flags().StringVar(&workloadListSearch, "search", "", "Only list workloads whose description contains this text")
+
+	instanceHistoryListCmd.Flags().IntVar(&instanceHistoryListFlags.limit, "limit", 0, "Maximum number of entries to list, 0 lists them all")
+
+	usageListCmd.Flags().StringVar(&usageListFlags.start, "start", "", "Only list usage recorded from this RFC3339 time")
+	usageListCmd.Flags().StringVar(&usageListFlags.end, "end", "", "Only list usage recorded before this RFC3339 time")
+	usageListCmd.Flags().StringVar(&usageListFlags.granularity, "granularity", "hourly", "Period covered by each record: sample, hourly or daily")
+	usageListCmd.Flags().BoolVar(&usageListFlags.csv, "csv", false, "Export the usage as CSV")
+
+	quotaDenialsListCmd.Flags().IntVar(&quotaDenialsListFlags.limit, "limit", 10, "Maximum number of tenants to list")
+
+	quotaHistoryListCmd.Flags().StringVar(&quotaHistoryListFlags.resource, "resource", "", "Only list changes to this resource, e.g., instances")
+	quotaHistoryListCmd.Flags().StringVar(&quotaHistoryListFlags.since, "since", "", "Only list changes made at or after this RFC3339 time")
+
 	rootCmd.AddCommand(listCmd)
 }
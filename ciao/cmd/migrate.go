@@ -0,0 +1,59 @@
+// Copyright © 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var migrateInstanceFlags = struct {
+	noWait bool
+}{}
+
+var migrateInstanceCmd = &cobra.Command{
+	Use:   "instance ID NODE",
+	Short: "Live migrate an instance to another node",
+	Long: `Live migrate a running VM instance to another compute node.  The
+command waits for the migration to complete unless --no-wait is given; the
+instance stays on its node if the migration fails.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := c.MigrateInstance(args[0], args[1])
+		if err != nil {
+			return errors.Wrap(err, "Error migrating instance")
+		}
+
+		if migrateInstanceFlags.noWait {
+			return nil
+		}
+
+		_, err = c.WaitOperation(op.ID)
+
+		return errors.Wrap(err, "Error migrating instance")
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate an object in the cluster",
+}
+
+func init() {
+	migrateCmd.AddCommand(migrateInstanceCmd)
+
+	migrateInstanceCmd.Flags().BoolVar(&migrateInstanceFlags.noWait, "no-wait", false, "Return as soon as the migration has started")
+	rootCmd.AddCommand(migrateCmd)
+}
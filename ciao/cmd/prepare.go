@@ -0,0 +1,119 @@
+// Copyright © 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/intel/tfortools"
+	"github.com/pkg/errors"
+
+	"github.com/spf13/cobra"
+)
+
+var prepareCmd = &cobra.Command{
+	Use:   "prepare",
+	Short: "Prepare resources ahead of their use",
+}
+
+var prepareNetworkFlags = struct {
+	subnet string
+	noWait bool
+}{}
+
+var prepareNetworkCmd = &cobra.Command{
+	Use:   "network [TENANT]",
+	Short: "Launch the CNCI for a tenant subnet ahead of its instances",
+	Long: `Launch the CNCI for a subnet of a tenant's network so that the first
+instances launched in the subnet do not wait for it to start. The tenant's
+first subnet is prepared unless --subnet is given. Admins must name the
+tenant whose network is prepared.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tenantID := c.TenantID
+		if len(args) == 1 {
+			tenantID = args[0]
+		} else if c.IsPrivileged() {
+			return errors.New("A tenant must be given")
+		}
+
+		op, err := c.PrepareTenantNetwork(tenantID, prepareNetworkFlags.subnet)
+		if err != nil {
+			return errors.Wrap(err, "Error preparing tenant network")
+		}
+
+		if !prepareNetworkFlags.noWait {
+			op, err = c.WaitOperation(op.ID)
+			if err != nil {
+				return errors.Wrap(err, "Error preparing tenant network")
+			}
+		}
+
+		return render(cmd, op)
+	},
+	Annotations: map[string]string{
+		"template_usage": tfortools.GenerateUsageUndecorated(types.Operation{}),
+	},
+}
+
+var prepareImageFlags = struct {
+	all   bool
+	label string
+	nodes []string
+}{}
+
+var prepareImageCmd = &cobra.Command{
+	Use:   "image ID",
+	Short: "Cache an image on compute nodes ahead of its first launch",
+	Long: `Ask compute nodes to copy an image into their local image cache so that
+the first instances launched from it on each node do not wait for the copy.
+Exactly one of --all, --label or --node selects the nodes. The nodes cache
+the image in the background; its state on each node is shown by
+"ciao show image".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !c.IsPrivileged() {
+			return errors.New("Preparing images is restricted to privileged users")
+		}
+
+		req := types.ImagePreseedRequest{
+			All:   prepareImageFlags.all,
+			Label: prepareImageFlags.label,
+			Nodes: prepareImageFlags.nodes,
+		}
+
+		image, err := c.PreseedImage(args[0], req)
+		if err != nil {
+			return errors.Wrap(err, "Error preparing image")
+		}
+
+		return render(cmd, image)
+	},
+	Annotations: map[string]string{
+		"template_usage": tfortools.GenerateUsageUndecorated(types.Image{}),
+	},
+}
+
+func init() {
+	prepareCmd.AddCommand(prepareNetworkCmd)
+	prepareCmd.AddCommand(prepareImageCmd)
+	rootCmd.AddCommand(prepareCmd)
+
+	prepareNetworkCmd.Flags().StringVar(&prepareNetworkFlags.subnet, "subnet", "", "Subnet of the tenant network to prepare, in CIDR notation")
+	prepareNetworkCmd.Flags().BoolVar(&prepareNetworkFlags.noWait, "no-wait", false, "Return once the CNCI launch has started")
+
+	prepareImageCmd.Flags().BoolVar(&prepareImageFlags.all, "all", false, "Cache the image on all compute nodes")
+	prepareImageCmd.Flags().StringVar(&prepareImageFlags.label, "label", "", "Cache the image on the compute nodes with this label")
+	prepareImageCmd.Flags().StringSliceVar(&prepareImageFlags.nodes, "node", nil, "Compute node on which to cache the image, may be repeated")
+}
@@ -0,0 +1,55 @@
+// Copyright © 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var resizeInstanceFlags = struct {
+	vcpus int
+	memMB int
+}{}
+
+var resizeInstanceCmd = &cobra.Command{
+	Use:   "instance ID",
+	Short: "Change the VCPUs and memory of an instance",
+	Long: `Restart a running VM instance with new VCPU and memory requirements.  The
+resize completes in the background; the instance keeps its previous
+requirements if the resize fails.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if resizeInstanceFlags.vcpus == 0 && resizeInstanceFlags.memMB == 0 {
+			return errors.New("--vcpus or --mem-mb must be given")
+		}
+
+		return errors.Wrap(c.ResizeInstance(args[0], resizeInstanceFlags.vcpus, resizeInstanceFlags.memMB),
+			"Error resizing instance")
+	},
+}
+
+var resizeCmd = &cobra.Command{
+	Use:   "resize",
+	Short: "Resize an object in the cluster",
+}
+
+func init() {
+	resizeCmd.AddCommand(resizeInstanceCmd)
+	rootCmd.AddCommand(resizeCmd)
+
+	resizeInstanceCmd.Flags().IntVar(&resizeInstanceFlags.vcpus, "vcpus", 0, "Number of VCPUs, 0 keeps the current number")
+	resizeInstanceCmd.Flags().IntVar(&resizeInstanceFlags.memMB, "mem-mb", 0, "Memory in MB, 0 keeps the current memory")
+}
@@ -28,6 +28,19 @@ var restartInstanceCmd = &cobra.Command{
 	},
 }
 
+var restartNetworkCmd = &cobra.Command{
+	Use:   "network TENANT",
+	Short: "Retry the initialization of a tenant's network controller",
+	Long: `Retry the initialization of the network controller of a tenant which
+failed when the controller started, once the cause has been fixed. Instances
+of the tenant cannot be launched until the initialization succeeds. The
+degraded tenants are listed in the cluster status.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return errors.Wrap(c.RetryTenantNetwork(args[0]), "Error restarting tenant network controller")
+	},
+}
+
 var restartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "Restart an object in the cluster",
@@ -35,5 +48,6 @@ var restartCmd = &cobra.Command{
 
 func init() {
 	restartCmd.AddCommand(restartInstanceCmd)
+	restartCmd.AddCommand(restartNetworkCmd)
 	rootCmd.AddCommand(restartCmd)
 }
@@ -19,6 +19,7 @@ import (
 	"os"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
 
 	"github.com/spf13/cobra"
 )
@@ -41,6 +42,25 @@ var restoreCmd = &cobra.Command{
 	},
 }
 
+var trashRestoreCmd = &cobra.Command{
+	Use:   "trash ID",
+	Short: "Restore a deleted instance or volume from the trash",
+	Long: `Restores a deleted instance or volume which is still in the tenant's
+trash.  Instances are relaunched with a new ID and reattached to the volumes
+they used which have not since been deleted.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		resp, err := c.RestoreTrashItem(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error restoring from trash")
+		}
+
+		fmt.Printf("Restored %s %s\n", resp.Type, resp.ID)
+		return nil
+	},
+}
+
 func init() {
+	restoreCmd.AddCommand(trashRestoreCmd)
 	rootCmd.AddCommand(restoreCmd)
 }
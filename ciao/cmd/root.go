@@ -68,6 +68,7 @@ const (
 	ciaoCACertFileEnv     = "CIAO_CA_CERT_FILE"
 	ciaoClientCertFileEnv = "CIAO_CLIENT_CERT_FILE"
 	ciaoTenantIDEnv       = "CIAO_TENANT_ID"
+	ciaoOnBehalfOfEnv     = "CIAO_ON_BEHALF_OF"
 )
 
 func getCiaoEnvVariables() {
@@ -75,6 +76,7 @@ func getCiaoEnvVariables() {
 	c.CACertFile = os.Getenv(ciaoCACertFileEnv)
 	c.ClientCertFile = os.Getenv(ciaoClientCertFileEnv)
 	c.TenantID = os.Getenv(ciaoTenantIDEnv)
+	c.OnBehalfOf = os.Getenv(ciaoOnBehalfOfEnv)
 }
 
 var rootCmd = &cobra.Command{
@@ -29,6 +29,36 @@ var showCmd = &cobra.Command{
 	Short: "Show detailed information about an object",
 }
 
+var capabilitiesShowTemplate = `Version:	{{ .Version }}
+GitCommit:	{{ .GitCommit }}
+APIVersions:
+{{- range $rel, $version := .APIVersions }}
+	{{ $rel }}:	{{ $version }}
+{{- end }}
+Features:
+{{- range $feature, $enabled := .Features }}
+	{{ $feature }}:	{{ $enabled }}
+{{- end }}
+`
+
+var capabilitiesShowCmd = &cobra.Command{
+	Use:   "capabilities",
+	Short: "Show the version and optional features of the controller",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		caps, err := c.Capabilities()
+		if err != nil {
+			return errors.Wrap(err, "Error getting capabilities")
+		}
+
+		return render(cmd, caps)
+	},
+	Annotations: map[string]string{
+		"default_template": capabilitiesShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.Capabilities{}),
+	},
+}
+
 var cnciShowCmd = &cobra.Command{
 	Use:   "cnci ID",
 	Short: "Show information about a CNCI",
@@ -96,6 +126,31 @@ var instanceShowCmd = &cobra.Command{
 	},
 }
 
+var consoleLogShowFlags = struct {
+	length int
+}{}
+
+var consoleLogShowTemplate = `{{ range .Lines }}{{ . }}
+{{ end }}`
+
+var consoleLogShowCmd = &cobra.Command{
+	Use:   "console-log ID",
+	Short: "Show the last lines written by an instance to its serial console",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log, err := c.GetConsoleLog(args[0], consoleLogShowFlags.length)
+		if err != nil {
+			return errors.Wrap(err, "Error getting console log")
+		}
+
+		return render(cmd, log)
+	},
+	Annotations: map[string]string{
+		"default_template": consoleLogShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.ConsoleLog{}),
+	},
+}
+
 var nodeShowCmd = &cobra.Command{
 	Use:   "node ID",
 	Short: "Show information about a node",
@@ -129,6 +184,36 @@ var nodeShowCmd = &cobra.Command{
 	},
 }
 
+var operationShowCmd = &cobra.Command{
+	Use:   "operation ID",
+	Short: "Show the progress of an asynchronous operation",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := c.GetOperation(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error getting operation")
+		}
+
+		return render(cmd, op)
+	},
+	Annotations: map[string]string{
+		"template_usage": tfortools.GenerateUsageUndecorated(types.Operation{}),
+	},
+}
+
+var tenantShowTemplate = `Name:			{{ .Name }}
+SubnetBits:		{{ .SubnetBits }}
+PrivilegedContainers:	{{ .Permissions.PrivilegedContainers }}
+Frozen:			{{ .Frozen }}
+{{- if .Frozen }}
+FreezeReason:		{{ .FreezeReason }}
+{{- end }}
+PreprovisionNetwork:	{{ .PreprovisionNetwork }}
+TrashRetentionMinutes:	{{ .TrashRetentionMinutes }}
+MaxSubnets:		{{ if eq .MaxSubnets 0 }}unlimited{{ else }}{{ .MaxSubnets }}{{ end }}
+CNCISize:		{{ .EffectiveCNCISize.VCPUs }} vCPUs {{ .EffectiveCNCISize.MemMB }} MB memory {{ .EffectiveCNCISize.DiskMB }} MB disk{{ if .CNCISize }} (tenant override){{ end }}
+`
+
 var tenantShowCmd = &cobra.Command{
 	Use:   "tenant ID",
 	Short: "Show tenant configuration",
@@ -138,7 +223,7 @@ var tenantShowCmd = &cobra.Command{
 			return errors.New("Tenant configuration is restricted to privileged users")
 		}
 
-		tenant, err := c.GetTenantConfig(args[0])
+		tenant, err := c.GetTenantDetails(args[0])
 		if err != nil {
 			return errors.Wrap(err, "Error getting tenant config")
 		}
@@ -146,8 +231,39 @@ var tenantShowCmd = &cobra.Command{
 		return render(cmd, tenant)
 	},
 	Annotations: map[string]string{
-		"default_template": `{{ htable (cols (sliceof .) "ID" "Name") }}`,
-		"template_usage":   tfortools.GenerateUsageUndecorated(types.TenantConfig{}),
+		"default_template": tenantShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.TenantDetails{}),
+	},
+}
+
+var networkShowTemplate = `SubnetBits:	{{ .SubnetBits }}
+MaxSubnets:	{{ if eq .MaxSubnets 0 }}unlimited{{ else }}{{ .MaxSubnets }}{{ end }}
+Subnets:
+{{- range .Subnets }}
+	{{ .Subnet }}:	{{ .Used }}/{{ .Capacity }} used{{ if .CNCIID }}, CNCI {{ .CNCIID }}{{ end }}
+{{- end }}
+`
+
+var networkShowCmd = &cobra.Command{
+	Use:   "network [TENANT]",
+	Short: "Show the subnets of a tenant's network and their utilization",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tenantID := c.TenantID
+		if len(args) == 1 {
+			tenantID = args[0]
+		}
+
+		network, err := c.GetTenantNetwork(tenantID)
+		if err != nil {
+			return errors.Wrap(err, "Error getting tenant network")
+		}
+
+		return render(cmd, network)
+	},
+	Annotations: map[string]string{
+		"default_template": networkShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.TenantNetwork{}),
 	},
 }
 
@@ -171,7 +287,7 @@ var traceShowCmd = &cobra.Command{
 var volumeShowTemplate = `ID:		{{ .ID }}
 Name:		{{ .Name }}
 Description:	{{ .Description }}
-State:		{{ .State }}
+State:		{{ .State }}{{ if .DeletionProtected }} (deletion protected){{ end }}
 Size:		{{ .Size }}
 CreateTime:	{{ .CreateTime }}
 `
@@ -215,6 +331,9 @@ Storage:
 	Size:		{{ .Size }}
 	Ephemeral:	{{ .Ephemeral }}
 	Bootable:	{{ .Bootable }}
+{{- if .BootIndex }}
+	BootIndex:	{{ .BootIndex }}
+{{- end }}
 	SourceType:	{{ .SourceType }}
 	Source:		{{ .Source }}
 {{ end }}`
@@ -237,11 +356,103 @@ var workloadShowCmd = &cobra.Command{
 	},
 }
 
+var launchTemplateShowTemplate = `Name:		{{ .Name }}
+Version:	{{ .Version }}
+Created:	{{ .CreateTime }}
+Updated:	{{ .UpdateTime }}
+Request:	{{ printf "%s" .Request }}
+`
+
+var launchTemplateShowCmd = &cobra.Command{
+	Use:   "launch-template NAME",
+	Short: "Show a launch template",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		template, err := c.GetLaunchTemplate(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error getting launch template")
+		}
+
+		return render(cmd, template)
+	},
+	Annotations: map[string]string{
+		"default_template": launchTemplateShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.LaunchTemplate{}),
+	},
+}
+
+var snapshotScheduleShowTemplate = `ID:		{{ .ID }}
+{{- if .VolumeID }}
+Volume:		{{ .VolumeID }}
+{{- else }}
+Tag:		{{ .Tag }}
+{{- end }}
+Interval:	{{ .IntervalMinutes }} minutes
+Offset:		{{ .OffsetMinutes }} minutes
+Retention:	{{ .Retention }}
+Created:	{{ .CreateTime }}
+Last run:	{{ if .LastRun.IsZero }}never{{ else }}{{ .LastRun }}{{ end }}
+Next run:	{{ .NextRun }}
+{{- if .LastError }}
+Last error:	{{ .LastError }}
+{{- end }}
+`
+
+var snapshotScheduleShowCmd = &cobra.Command{
+	Use:   "snapshot-schedule ID",
+	Short: "Show a snapshot schedule",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schedule, err := c.GetSnapshotSchedule(args[0])
+		if err != nil {
+			return errors.Wrap(err, "Error getting snapshot schedule")
+		}
+
+		return render(cmd, schedule)
+	},
+	Annotations: map[string]string{
+		"default_template": snapshotScheduleShowTemplate,
+		"template_usage":   tfortools.GenerateUsageUndecorated(types.SnapshotSchedule{}),
+	},
+}
+
+var nodeSummaryShowFlags = struct {
+	staleMinutes int
+}{}
+
+var nodeSummaryShowCmd = &cobra.Command{
+	Use:   "node-summary ID",
+	Short: "Show a summary of the instances on a node",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !c.IsPrivileged() {
+			return errors.New("Node information is restricted to privileged users")
+		}
+
+		summary, err := c.GetNodeSummary(args[0], nodeSummaryShowFlags.staleMinutes)
+		if err != nil {
+			return errors.Wrap(err, "Error getting node summary")
+		}
+
+		return render(cmd, summary)
+	},
+	Annotations: map[string]string{
+		"template_usage": tfortools.GenerateUsageUndecorated(types.CiaoNodeSummary{}),
+	},
+}
+
 var showCmds = []*cobra.Command{
+	capabilitiesShowCmd,
 	cnciShowCmd,
+	consoleLogShowCmd,
 	imageShowCmd,
 	instanceShowCmd,
+	launchTemplateShowCmd,
+	networkShowCmd,
 	nodeShowCmd,
+	nodeSummaryShowCmd,
+	operationShowCmd,
+	snapshotScheduleShowCmd,
 	tenantShowCmd,
 	traceShowCmd,
 	volumeShowCmd,
@@ -253,5 +464,9 @@ func init() {
 		showCmd.AddCommand(cmd)
 	}
 
+	consoleLogShowCmd.Flags().IntVar(&consoleLogShowFlags.length, "length", 0, "Maximum number of lines to show, 0 shows the controller's default")
+
+	nodeSummaryShowCmd.Flags().IntVar(&nodeSummaryShowFlags.staleMinutes, "stale-minutes", 0, "Minutes without stats after which the node is stale, 0 uses the controller's default")
+
 	rootCmd.AddCommand(showCmd)
 }
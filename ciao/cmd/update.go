@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/uuid"
@@ -28,11 +29,29 @@ var updateCmd = &cobra.Command{
 	Short: "Update status of an object",
 }
 
+// parseQuotaValue converts the value of a quota or limit, which may be
+// "unlimited", to the value used by the API.
+func parseQuotaValue(value string) (int, error) {
+	if value == "unlimited" {
+		return -1, nil
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error converting to integer")
+	}
+
+	return v, nil
+}
+
 var updateQuotasCmd = &cobra.Command{
 	Use:   "quota TENANT NAME VALUE",
 	Short: "Update tenant quotas",
-	Long:  "Updates the quota entry for the supplied tenant with the value or limit",
-	Args:  cobra.ExactArgs(3),
+	Long: `Updates the quota entry for the supplied tenant with the value or limit.
+
+The number of instances of a workload the tenant may run is limited by the
+quota named workload:WORKLOAD_ID:instances.`,
+	Args: cobra.ExactArgs(3),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if !c.IsPrivileged() {
 			return errors.New("Updating quotas is restricted to privileged users")
@@ -42,15 +61,9 @@ var updateQuotasCmd = &cobra.Command{
 		name := args[1]
 		value := args[2]
 
-		var v int
-		if value == "unlimited" {
-			v = -1
-		} else {
-			var err error
-			v, err = strconv.Atoi(value)
-			if err != nil {
-				return errors.Wrap(err, "Error converting to integer")
-			}
+		v, err := parseQuotaValue(value)
+		if err != nil {
+			return err
 		}
 
 		quotas := []types.QuotaDetails{{
@@ -62,6 +75,12 @@ var updateQuotasCmd = &cobra.Command{
 	},
 }
 
+var tenantFreezeFlags = struct {
+	freeze   bool
+	unfreeze bool
+	reason   string
+}{}
+
 var tenantUpdateCmd = &cobra.Command{
 	Use:   "tenant ID",
 	Short: "Update tenant configuration",
@@ -83,9 +102,25 @@ var tenantUpdateCmd = &cobra.Command{
 			return errors.New("Tenant ID must be a UUID")
 		}
 
+		if tenantFreezeFlags.freeze || tenantFreezeFlags.unfreeze {
+			if tenantFreezeFlags.freeze == tenantFreezeFlags.unfreeze {
+				return errors.New("Only one of --freeze and --unfreeze may be given")
+			}
+
+			if tenantFreezeFlags.freeze && tenantFreezeFlags.reason == "" {
+				return errors.New("A reason must be given when freezing a tenant")
+			}
+
+			return errors.Wrap(c.UpdateTenantFreeze(tuuid.String(), tenantFreezeFlags.freeze, tenantFreezeFlags.reason),
+				"Error updating tenant freeze")
+		}
+
 		config := types.TenantConfig{
-			Name:       tenantFlags.name,
-			SubnetBits: tenantFlags.cidrPrefixSize,
+			Name:                  tenantFlags.name,
+			SubnetBits:            tenantFlags.cidrPrefixSize,
+			TrashRetentionMinutes: tenantFlags.trashRetention,
+			MaxSubnets:            tenantFlags.maxSubnets,
+			CNCISize:              tenantCNCISize(),
 		}
 		config.Permissions.PrivilegedContainers = tenantFlags.createPrivilegedContainers
 
@@ -94,13 +129,239 @@ var tenantUpdateCmd = &cobra.Command{
 	},
 }
 
+var imageUpdateCmd = &cobra.Command{
+	Use:   "image ID VISIBILITY",
+	Short: "Update image visibility",
+	Long:  "Changes the visibility of an image to internal, public or private",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !c.IsPrivileged() {
+			return errors.New("Updating images is restricted to privileged users")
+		}
+
+		visibility := types.Visibility(args[1])
+		switch visibility {
+		case types.Public, types.Private, types.Internal:
+		default:
+			return errors.New("Invalid image visibility")
+		}
+
+		return errors.Wrap(c.SetImageVisibility(args[0], visibility),
+			"Error updating image visibility")
+	},
+}
+
+var workloadUpdateCmd = &cobra.Command{
+	Use:   "workload ID FILE",
+	Short: "Update a workload",
+	Long:  "Replaces the definition of an unused workload with the one in the workload yaml FILE",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req, err := workloadFromFile(args[1])
+		if err != nil {
+			return err
+		}
+
+		return errors.Wrap(c.UpdateWorkload(args[0], req), "Error updating workload")
+	},
+}
+
+var launchTemplateUpdateCmd = &cobra.Command{
+	Use:   "launch-template NAME FILE",
+	Short: "Update a launch template",
+	Long:  "Replaces the launch request of a template with the JSON instance create request in FILE.  Instances already created from the template are not affected",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		request, err := launchRequestFromFile(args[1])
+		if err != nil {
+			return err
+		}
+
+		template, err := c.UpdateLaunchTemplate(args[0], request)
+		if err != nil {
+			return errors.Wrap(err, "Error updating launch template")
+		}
+
+		return render(cmd, template)
+	},
+	Annotations: launchTemplateShowCmd.Annotations,
+}
+
+var instanceUpdateFlags = struct {
+	name        string
+	description string
+	protected   bool
+}{}
+
+var instanceUpdateCmd = &cobra.Command{
+	Use:   "instance ID",
+	Short: "Update an instance",
+	Long:  "Renames an instance, replaces its description, or sets or clears its protection from deletion",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if !flags.Changed("name") && !flags.Changed("description") && !flags.Changed("deletion-protected") {
+			return errors.New("--name, --description or --deletion-protected must be given")
+		}
+
+		if flags.Changed("name") {
+			err := c.UpdateInstanceName(args[0], instanceUpdateFlags.name)
+			if err != nil {
+				return errors.Wrap(err, "Error updating instance")
+			}
+		}
+
+		if flags.Changed("description") {
+			err := c.UpdateInstanceDescription(args[0], instanceUpdateFlags.description)
+			if err != nil {
+				return errors.Wrap(err, "Error updating instance")
+			}
+		}
+
+		if flags.Changed("deletion-protected") {
+			err := c.UpdateInstanceDeletionProtection(args[0], instanceUpdateFlags.protected)
+			if err != nil {
+				return errors.Wrap(err, "Error updating instance")
+			}
+		}
+
+		return nil
+	},
+}
+
+var volumeUpdateFlags = struct {
+	reason    string
+	protected bool
+	size      int
+	online    bool
+}{}
+
+var volumeUpdateCmd = &cobra.Command{
+	Use:   "volume ID [STATE]",
+	Short: "Update a volume or repair its state",
+	Long: `Sets or clears the protection of a volume from deletion with
+--deletion-protected, extends a volume to --size GiB, or sets the state of a
+stuck volume to available, attaching, in-use or detaching.  Attached volumes
+are only extended if --online is given.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("size") {
+			if len(args) != 1 || cmd.Flags().Changed("deletion-protected") {
+				return errors.New("A volume may only be extended on its own")
+			}
+
+			return errors.Wrap(c.ExtendVolume(args[0], volumeUpdateFlags.size, volumeUpdateFlags.online),
+				"Error extending volume")
+		}
+
+		if cmd.Flags().Changed("deletion-protected") {
+			if len(args) != 1 {
+				return errors.New("The state of a volume may not be changed with its protection")
+			}
+
+			return errors.Wrap(c.UpdateVolumeDeletionProtection(args[0], volumeUpdateFlags.protected),
+				"Error updating volume")
+		}
+
+		if len(args) != 2 {
+			return errors.New("STATE or --deletion-protected must be given")
+		}
+
+		if !c.IsPrivileged() {
+			return errors.New("Updating volume state is restricted to privileged users")
+		}
+
+		state := types.BlockState(args[1])
+		switch state {
+		case types.Available, types.Attaching, types.InUse, types.Detaching:
+		default:
+			return errors.New("Invalid volume state")
+		}
+
+		if volumeUpdateFlags.reason == "" {
+			return errors.New("A reason for the change must be given")
+		}
+
+		return errors.Wrap(c.SetVolumeState(args[0], state, volumeUpdateFlags.reason),
+			"Error updating volume state")
+	},
+}
+
+var poolUpdateCmd = &cobra.Command{
+	Use:   "pool NAME [TENANT...]",
+	Short: "Restrict an external IP pool to tenants",
+	Long:  "Restricts the mapping of addresses from the pool to the given tenants, or allows all tenants to use the pool if none are given",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return errors.Wrap(c.SetExternalIPPoolTenants(args[0], args[1:]),
+			"Error updating external IP pool")
+	},
+}
+
+var nodeUpdateFlags = struct {
+	evacuate bool
+	noWait   bool
+}{}
+
+var nodeUpdateCmd = &cobra.Command{
+	Use:   "node ID (maintenance|ready)",
+	Short: "Put a node into maintenance or return it to service",
+	Long: `Puts a node into maintenance, so that no new instances are started on it,
+or returns it to service.  The instances on a node put into maintenance are
+restarted on other nodes if --evacuate is given, and the command waits for
+them to be moved unless --no-wait is given.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		status := types.NodeStatusType(strings.ToUpper(args[1]))
+		op, err := c.SetNodeStatus(args[0], status, nodeUpdateFlags.evacuate)
+		if err != nil {
+			return errors.Wrap(err, "Error updating node status")
+		}
+
+		if op.ID == "" || nodeUpdateFlags.noWait {
+			return nil
+		}
+
+		_, err = c.WaitOperation(op.ID)
+
+		return errors.Wrap(err, "Error evacuating node")
+	},
+}
+
 func init() {
 	updateCmd.AddCommand(updateQuotasCmd)
 	updateCmd.AddCommand(tenantUpdateCmd)
+	updateCmd.AddCommand(imageUpdateCmd)
+	updateCmd.AddCommand(instanceUpdateCmd)
+	updateCmd.AddCommand(launchTemplateUpdateCmd)
+	updateCmd.AddCommand(workloadUpdateCmd)
+	updateCmd.AddCommand(volumeUpdateCmd)
+	updateCmd.AddCommand(poolUpdateCmd)
+	updateCmd.AddCommand(nodeUpdateCmd)
+
+	nodeUpdateCmd.Flags().BoolVar(&nodeUpdateFlags.evacuate, "evacuate", false, "Move the node's instances to other nodes")
+	nodeUpdateCmd.Flags().BoolVar(&nodeUpdateFlags.noWait, "no-wait", false, "Do not wait for the evacuation to complete")
+
+	volumeUpdateCmd.Flags().StringVar(&volumeUpdateFlags.reason, "reason", "", "Why the state is being changed")
+	volumeUpdateCmd.Flags().BoolVar(&volumeUpdateFlags.protected, "deletion-protected", false, "Whether the volume is protected from deletion")
+	volumeUpdateCmd.Flags().IntVar(&volumeUpdateFlags.size, "size", 0, "New size of the volume in GiB, larger than its current size")
+	volumeUpdateCmd.Flags().BoolVar(&volumeUpdateFlags.online, "online", false, "Extend the volume even though it is attached")
+
+	instanceUpdateCmd.Flags().StringVar(&instanceUpdateFlags.name, "name", "", "Instance name, unique within the tenant, empty to remove it")
+	instanceUpdateCmd.Flags().StringVar(&instanceUpdateFlags.description, "description", "", "Instance description, empty to remove it")
+	instanceUpdateCmd.Flags().BoolVar(&instanceUpdateFlags.protected, "deletion-protected", false, "Whether the instance is protected from deletion")
 
 	tenantUpdateCmd.Flags().IntVar(&tenantFlags.cidrPrefixSize, "cidr-prefix-size", 0, "Number of bits in network mask (12-30)")
 	tenantUpdateCmd.Flags().BoolVar(&tenantFlags.createPrivilegedContainers, "create-privileged-containers", false, "Whether this tenant can create privileged containers")
 	tenantUpdateCmd.Flags().StringVar(&tenantFlags.name, "name", "", "Tenant name")
+	tenantUpdateCmd.Flags().IntVar(&tenantFlags.maxSubnets, "max-subnets", 0, "Maximum number of subnets in the tenant's network, -1 to remove the limit")
+	tenantUpdateCmd.Flags().IntVar(&tenantFlags.cnciVCPUs, "cnci-vcpus", 0, "Number of vCPUs of newly launched CNCIs, -1 for the cluster default")
+	tenantUpdateCmd.Flags().IntVar(&tenantFlags.cnciMem, "cnci-mem", 0, "Memory of newly launched CNCIs in MB, -1 for the cluster default")
+	tenantUpdateCmd.Flags().IntVar(&tenantFlags.cnciDisk, "cnci-disk", 0, "Disk size of newly launched CNCIs in MB, -1 for the cluster default")
+	tenantUpdateCmd.Flags().IntVar(&tenantFlags.trashRetention, "trash-retention", 0, "Minutes deleted instances and volumes stay in the trash, -1 to delete immediately")
+	tenantUpdateCmd.Flags().BoolVar(&tenantFreezeFlags.freeze, "freeze", false, "Reject all changes to the tenant's resources")
+	tenantUpdateCmd.Flags().BoolVar(&tenantFreezeFlags.unfreeze, "unfreeze", false, "Allow changes to the tenant's resources")
+	tenantUpdateCmd.Flags().StringVar(&tenantFreezeFlags.reason, "reason", "", "Why the tenant is frozen")
 
 	rootCmd.AddCommand(updateCmd)
 }
@@ -0,0 +1,66 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// Capabilities returns the version of the controller and the optional
+// features it supports.  They are retrieved once and reused for the life of
+// the client.  Controllers which predate capability discovery are reported
+// as supporting no optional features.
+func (client *Client) Capabilities() (types.Capabilities, error) {
+	if client.capabilities != nil {
+		return *client.capabilities, nil
+	}
+
+	var caps types.Capabilities
+
+	url, err := client.getCiaoResource("capabilities", api.CapabilitiesV1)
+	if err == nil {
+		err = client.getResource(url, api.CapabilitiesV1, nil, &caps)
+	} else if err == errResourceNotFound {
+		err = nil
+	}
+
+	if err != nil {
+		return caps, err
+	}
+
+	client.capabilities = &caps
+
+	return caps, nil
+}
+
+// requireFeature returns an error if the controller does not support the
+// optional feature.
+func (client *Client) requireFeature(feature string) error {
+	caps, err := client.Capabilities()
+	if err != nil {
+		return errors.Wrap(err, "Error getting controller capabilities")
+	}
+
+	if !caps.Features[feature] {
+		return fmt.Errorf("Server does not support %s", feature)
+	}
+
+	return nil
+}
@@ -41,12 +41,19 @@ type Client struct {
 	CACertFile     string
 	ClientCertFile string
 
-	caCertPool *x509.CertPool
-	clientCert *tls.Certificate
+	// OnBehalfOf is the tenant an admin acts as.  Requests are made with
+	// the scope of that tenant.
+	OnBehalfOf string
+
+	caCertPool   *x509.CertPool
+	clientCert   *tls.Certificate
+	capabilities *types.Capabilities
 
 	Tenants []string
 }
 
+var errResourceNotFound = errors.New("Supported version of resource not found")
+
 type queryValue struct {
 	name, value string
 }
@@ -150,6 +157,15 @@ func (client *Client) Init() error {
 		return err
 	}
 
+	if client.OnBehalfOf != "" {
+		if !client.IsPrivileged() {
+			return errors.New("Only admins may act on behalf of a tenant")
+		}
+
+		client.TenantID = client.OnBehalfOf
+		client.Tenants = []string{client.OnBehalfOf}
+	}
+
 	return nil
 }
 
@@ -188,6 +204,10 @@ func (client *Client) sendHTTPRequest(method string, url string, values []queryV
 		req.Header.Set("Accept", "application/json")
 	}
 
+	if client.OnBehalfOf != "" {
+		req.Header.Set(api.OnBehalfOfHeader, client.OnBehalfOf)
+	}
+
 	tlsConfig := &tls.Config{}
 
 	if client.caCertPool != nil {
@@ -265,7 +285,7 @@ func (client *Client) getCiaoResource(name string, minVersion string) (string, e
 		}
 	}
 
-	return "", errors.New("Supported version of resource not found")
+	return "", errResourceNotFound
 }
 
 // IsPrivileged returns true if the user has admin privileges
@@ -313,6 +333,36 @@ func (client *Client) deleteResource(url string, content string) error {
 	return nil
 }
 
+// deleteProtectedResource deletes an instance, volume or tenant which may be
+// protected from deletion.  The protection is overridden if force is set,
+// which only admins may do.  ErrDeletionProtected is returned if the
+// resource is protected and force is not set.
+func (client *Client) deleteProtectedResource(url string, content string, force bool) error {
+	var values []queryValue
+	if force {
+		if !client.IsPrivileged() {
+			return errors.New("Only admins may override deletion protection")
+		}
+		values = append(values, queryValue{name: "force", value: "true"})
+	}
+
+	resp, err := client.sendHTTPRequest("DELETE", url, values, nil, content)
+	if err != nil {
+		return errors.Wrapf(err, "Error making HTTP request to %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return types.ErrDeletionProtected
+	}
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("HTTP response code from %s not as expected: %s", url, resp.Status)
+	}
+
+	return nil
+}
+
 func (client *Client) putResource(url string, content string, request interface{}) error {
 	b, err := json.Marshal(request)
 	if err != nil {
@@ -0,0 +1,68 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// GetCNCIImage returns the image CNCIs are launched from
+func (client *Client) GetCNCIImage() (types.CNCIImage, error) {
+	var image types.CNCIImage
+
+	if !client.IsPrivileged() {
+		return image, errors.New("This command is only available to admins")
+	}
+
+	url, err := client.getCiaoResource("cncis", api.CNCIsV1)
+	if err != nil {
+		return image, errors.Wrap(err, "Error getting cncis resource")
+	}
+
+	err = client.getResource(url+"/image", api.CNCIsV1, nil, &image)
+
+	return image, err
+}
+
+func (client *Client) rolloutCNCIs(action string, req types.CNCIRolloutRequest) (types.Operation, error) {
+	var op types.Operation
+
+	if !client.IsPrivileged() {
+		return op, errors.New("This command is only available to admins")
+	}
+
+	url, err := client.getCiaoResource("cncis", api.CNCIsV1)
+	if err != nil {
+		return op, errors.Wrap(err, "Error getting cncis resource")
+	}
+
+	err = client.postResource(url+"/"+action, api.CNCIsV1, &req, &op)
+
+	return op, err
+}
+
+// UpgradeCNCIs registers a new CNCI image and starts relaunching the CNCIs
+// from it.  The returned operation tracks the rollout.
+func (client *Client) UpgradeCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	return client.rolloutCNCIs("upgrade", req)
+}
+
+// RollbackCNCIs starts relaunching the CNCIs from the previous CNCI image
+func (client *Client) RollbackCNCIs(req types.CNCIRolloutRequest) (types.Operation, error) {
+	return client.rolloutCNCIs("rollback", req)
+}
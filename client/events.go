@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// ListEventLog retrieves a page of the events matching filter.  Users
+// retrieve the events of their current tenant.  Privileged users retrieve
+// the events of tenantID, or of all tenants if tenantID is empty.  The
+// NextMarker of the result should be used as the Marker of filter to
+// retrieve the next page.
+func (client *Client) ListEventLog(tenantID string, filter types.EventFilter) (types.CiaoEvents, error) {
+	var events types.CiaoEvents
+
+	url, err := client.getCiaoResource("events", api.EventsV1)
+	if err != nil {
+		return events, errors.Wrap(err, "Error getting events resource")
+	}
+
+	var query []queryValue
+	if client.IsPrivileged() && tenantID != "" {
+		query = append(query, queryValue{name: "tenant_id", value: tenantID})
+	}
+	if !filter.Start.IsZero() {
+		query = append(query, queryValue{name: "start", value: filter.Start.Format(time.RFC3339)})
+	}
+	if !filter.End.IsZero() {
+		query = append(query, queryValue{name: "end", value: filter.End.Format(time.RFC3339)})
+	}
+	if filter.Type != "" {
+		query = append(query, queryValue{name: "type", value: filter.Type})
+	}
+	if filter.ObjectID != "" {
+		query = append(query, queryValue{name: "object_id", value: filter.ObjectID})
+	}
+	if filter.Marker > 0 {
+		query = append(query, queryValue{name: "marker", value: strconv.FormatInt(filter.Marker, 10)})
+	}
+	if filter.Limit > 0 {
+		query = append(query, queryValue{name: "limit", value: strconv.Itoa(filter.Limit)})
+	}
+
+	err = client.getResource(url, api.EventsV1, query, &events)
+
+	return events, err
+}
@@ -55,8 +55,15 @@ func (client *Client) getExternalIPRef(address string) (string, error) {
 
 // MapExternalIP maps an IP from the pool to the given instance
 func (client *Client) MapExternalIP(pool string, instanceID string) error {
+	return client.MapExternalAddress(pool, instanceID, "")
+}
+
+// MapExternalAddress maps an IP from the pool to the given instance.  A
+// specific free address of the pool is mapped if address is given.
+func (client *Client) MapExternalAddress(pool string, instanceID string, address string) error {
 	req := types.MapIPRequest{
 		InstanceID: instanceID,
+		Address:    address,
 	}
 
 	if pool != "" {
@@ -116,3 +116,32 @@ func (client *Client) DeleteImage(imageID string) error {
 
 	return client.deleteResource(url, api.ImagesV1)
 }
+
+// SetImageVisibility changes the visibility of the given image
+func (client *Client) SetImageVisibility(imageID string, visibility types.Visibility) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	url := client.buildCiaoURL("images/%s/visibility", imageID)
+	req := api.ImageVisibilityRequest{
+		Visibility: visibility,
+	}
+
+	return client.putResource(url, api.ImagesV1, &req)
+}
+
+// PreseedImage asks compute nodes to cache the given image ahead of its
+// first launch on them
+func (client *Client) PreseedImage(imageID string, req types.ImagePreseedRequest) (types.Image, error) {
+	if !client.IsPrivileged() {
+		return types.Image{}, errors.New("This command is only available to admins")
+	}
+
+	url := client.buildCiaoURL("images/%s/preseed", imageID)
+
+	var image types.Image
+	err := client.postResource(url, api.ImagesV1, &req, &image)
+
+	return image, err
+}
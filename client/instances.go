@@ -18,27 +18,75 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/pkg/errors"
 )
 
-// CreateInstances creates instances by the given request
+// batchLaunchError returns an error describing the instances of a request
+// which failed to launch when the server reports that only some of them
+// were launched, and nil otherwise.
+func batchLaunchError(servers api.Servers) error {
+	var failures []string
+	for i, r := range servers.Results {
+		if r.Error == nil {
+			continue
+		}
+
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("instance %d", i)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", name, r.Error.Message))
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("%d of %d instances failed to launch: %s",
+		len(failures), len(servers.Results), strings.Join(failures, "; "))
+}
+
+// CreateInstances creates instances by the given request.  If only some of
+// the instances are launched, those which were are returned along with an
+// error describing the others.
 func (client *Client) CreateInstances(request api.CreateServerRequest) (api.Servers, error) {
 	var servers api.Servers
 
+	s := request.Server
+	if s.VCPUs != 0 || s.MemMB != 0 || s.DiskGB != 0 {
+		if err := client.requireFeature(types.FeatureWorkloadOverrides); err != nil {
+			return servers, err
+		}
+	}
+
 	url := client.buildCiaoURL("%s/instances", client.TenantID)
 	err := client.postResource(url, api.InstancesV1, &request, &servers)
+	if err != nil {
+		return servers, err
+	}
 
-	return servers, err
+	return servers, batchLaunchError(servers)
 }
 
 // DeleteInstance deletes the given instance
 func (client *Client) DeleteInstance(instanceID string) error {
 	url := client.buildCiaoURL("%s/instances/%s", client.TenantID, instanceID)
-	return client.deleteResource(url, api.InstancesV1)
+	return client.deleteProtectedResource(url, api.InstancesV1, false)
+}
+
+// ForceDeleteInstance deletes an instance even if it is protected from
+// deletion.  Only admins may force the deletion of an instance.
+func (client *Client) ForceDeleteInstance(instanceID string) error {
+	url := client.buildCiaoURL("%s/instances/%s", client.TenantID, instanceID)
+	return client.deleteProtectedResource(url, api.InstancesV1, true)
 }
 
 func (client *Client) instanceAction(instanceID string, action string) error {
@@ -68,8 +116,79 @@ func (client *Client) StartInstance(instanceID string) error {
 	return client.instanceAction(instanceID, "os-start")
 }
 
+// MigrateInstance live migrates the given instance to another compute
+// node, by the operation which is returned.  Only admins may migrate
+// instances.
+func (client *Client) MigrateInstance(instanceID string, nodeID string) (types.Operation, error) {
+	var op types.Operation
+
+	if !client.IsPrivileged() {
+		return op, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureMigrations); err != nil {
+		return op, err
+	}
+
+	req := types.InstanceMigrateRequest{
+		Migrate: types.InstanceMigrateTarget{
+			NodeID: nodeID,
+		},
+	}
+
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return op, errors.Wrap(err, "Error marshalling migration request")
+	}
+
+	url := client.buildCiaoURL("%s/instances/%s/action", client.TenantID, instanceID)
+
+	resp, err := client.sendHTTPRequest("POST", url, nil, bytes.NewReader(b), api.InstancesV1)
+	if err != nil {
+		return op, errors.Wrap(err, "Error making HTTP request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return op, fmt.Errorf("HTTP response code from %s not as expected: %d", url, resp.StatusCode)
+	}
+
+	err = client.unmarshalHTTPResponse(resp, &op)
+
+	return op, err
+}
+
+// ResizeInstance restarts the given instance with new VCPU and memory
+// requirements.  Zero values keep the current requirement of the instance.
+func (client *Client) ResizeInstance(instanceID string, vcpus int, memMB int) error {
+	if err := client.requireFeature(types.FeatureInstanceResize); err != nil {
+		return err
+	}
+
+	req := types.InstanceResizeRequest{
+		Resize: types.InstanceResizeTarget{
+			VCPUs: vcpus,
+			MemMB: memMB,
+		},
+	}
+
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling resize request")
+	}
+
+	return client.instanceAction(instanceID, string(b))
+}
+
 // ListInstancesByWorkload provides the list of instances for a given tenant and workloadID.
 func (client *Client) ListInstancesByWorkload(tenantID string, workloadID string) (api.Servers, error) {
+	return client.SearchInstances(tenantID, workloadID, "")
+}
+
+// SearchInstances gets the instances of a tenant, optionally only those of
+// a workload, whose name or description contains search.  All the
+// instances are returned if search is empty.
+func (client *Client) SearchInstances(tenantID string, workloadID string, search string) (api.Servers, error) {
 	var servers api.Servers
 
 	url := client.buildCiaoURL("%s/instances/detail", tenantID)
@@ -81,6 +200,12 @@ func (client *Client) ListInstancesByWorkload(tenantID string, workloadID string
 			value: workloadID,
 		})
 	}
+	if search != "" {
+		values = append(values, queryValue{
+			name:  "search",
+			value: search,
+		})
+	}
 
 	err := client.getResource(url, api.InstancesV1, values, &servers)
 
@@ -93,6 +218,97 @@ func (client *Client) ListInstances() (api.Servers, error) {
 	return client.ListInstancesByWorkload(client.TenantID, "")
 }
 
+// GetInstanceHistory gets a page of the history of an instance, which may
+// have been deleted.  The NextMarker of the result should be used as the
+// Marker of filter to retrieve the next page.
+func (client *Client) GetInstanceHistory(instanceID string, filter types.InstanceHistoryFilter) (types.InstanceHistory, error) {
+	var history types.InstanceHistory
+
+	if err := client.requireFeature(types.FeatureInstanceHistory); err != nil {
+		return history, err
+	}
+
+	var url string
+	if client.IsPrivileged() {
+		url = client.buildCiaoURL("instances/%s/history", instanceID)
+	} else {
+		url = client.buildCiaoURL("%s/instances/%s/history", client.TenantID, instanceID)
+	}
+
+	var query []queryValue
+	if filter.Marker > 0 {
+		query = append(query, queryValue{name: "marker", value: strconv.Itoa(filter.Marker)})
+	}
+	if filter.Limit > 0 {
+		query = append(query, queryValue{name: "limit", value: strconv.Itoa(filter.Limit)})
+	}
+
+	err := client.getResource(url, api.InstancesV1, query, &history)
+
+	return history, err
+}
+
+// GetConsoleLog gets the last lines written by an instance to its serial
+// console.  If length is 0 the controller's default number of lines is
+// returned.
+func (client *Client) GetConsoleLog(instanceID string, length int) (types.ConsoleLog, error) {
+	var log types.ConsoleLog
+
+	if err := client.requireFeature(types.FeatureConsoleLog); err != nil {
+		return log, err
+	}
+
+	url := client.buildCiaoURL("%s/instances/%s/consolelog", client.TenantID, instanceID)
+
+	var query []queryValue
+	if length > 0 {
+		query = append(query, queryValue{name: "length", value: strconv.Itoa(length)})
+	}
+
+	err := client.getResource(url, api.InstancesV1, query, &log)
+
+	return log, err
+}
+
+// UpdateInstanceName renames an instance.  An empty name leaves the
+// instance unnamed.
+func (client *Client) UpdateInstanceName(instanceID string, name string) error {
+	return client.patchInstance(instanceID, map[string]interface{}{"name": name})
+}
+
+// UpdateInstanceDescription replaces the description of an instance.
+func (client *Client) UpdateInstanceDescription(instanceID string, description string) error {
+	return client.patchInstance(instanceID, map[string]interface{}{"description": description})
+}
+
+// UpdateInstanceDeletionProtection sets or clears the protection of an
+// instance from deletion.
+func (client *Client) UpdateInstanceDeletionProtection(instanceID string, protected bool) error {
+	return client.patchInstance(instanceID, map[string]interface{}{"deletion_protected": protected})
+}
+
+// patchInstance applies a JSON merge patch holding only the attributes
+// being changed to an instance.
+func (client *Client) patchInstance(instanceID string, update map[string]interface{}) error {
+	patch, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("%s/instances/%s", client.TenantID, instanceID)
+
+	resp, err := client.sendHTTPRequest("PATCH", url, nil, bytes.NewReader(patch), "merge-patch+json")
+	if err != nil {
+		return errors.Wrap(err, "Error making HTTP request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP response code from %s not as expected: %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
 // GetInstance gets the details of a single instances
 func (client *Client) GetInstance(instanceID string) (api.Server, error) {
 	var server api.Server
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// ListLaunchTemplates lists the launch templates of the current tenant.
+func (client *Client) ListLaunchTemplates() ([]types.LaunchTemplate, error) {
+	var templates types.ListLaunchTemplatesResponse
+
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return templates.Templates, err
+	}
+
+	url := client.buildCiaoURL("%s/launch-templates", client.TenantID)
+	err := client.getResource(url, api.LaunchTemplatesV1, nil, &templates)
+
+	return templates.Templates, err
+}
+
+// CreateLaunchTemplate stores request, the body of an instance create
+// request, as a launch template of the current tenant.
+func (client *Client) CreateLaunchTemplate(name string, request json.RawMessage) (types.LaunchTemplate, error) {
+	var template types.LaunchTemplate
+
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return template, err
+	}
+
+	req := types.LaunchTemplateRequest{Name: name, Request: request}
+
+	url := client.buildCiaoURL("%s/launch-templates", client.TenantID)
+	err := client.postResource(url, api.LaunchTemplatesV1, &req, &template)
+
+	return template, err
+}
+
+// GetLaunchTemplate gets a launch template of the current tenant.
+func (client *Client) GetLaunchTemplate(name string) (types.LaunchTemplate, error) {
+	var template types.LaunchTemplate
+
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return template, err
+	}
+
+	url := client.buildCiaoURL("%s/launch-templates/%s", client.TenantID, name)
+	err := client.getResource(url, api.LaunchTemplatesV1, nil, &template)
+
+	return template, err
+}
+
+// UpdateLaunchTemplate replaces the launch request of a template and
+// returns the template with its new version.
+func (client *Client) UpdateLaunchTemplate(name string, request json.RawMessage) (types.LaunchTemplate, error) {
+	var template types.LaunchTemplate
+
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return template, err
+	}
+
+	b, err := json.Marshal(types.LaunchTemplateRequest{Request: request})
+	if err != nil {
+		return template, errors.Wrap(err, "Error marshalling JSON")
+	}
+
+	url := client.buildCiaoURL("%s/launch-templates/%s", client.TenantID, name)
+
+	resp, err := client.sendHTTPRequest("PUT", url, nil, bytes.NewReader(b), api.LaunchTemplatesV1)
+	if err != nil {
+		return template, errors.Wrapf(err, "Error making HTTP request to %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return template, fmt.Errorf("HTTP response code from %s not as expected: %d", url, resp.StatusCode)
+	}
+
+	err = client.unmarshalHTTPResponse(resp, &template)
+
+	return template, err
+}
+
+// DeleteLaunchTemplate deletes a launch template of the current tenant.
+// Instances launched from it are not affected.
+func (client *Client) DeleteLaunchTemplate(name string) error {
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("%s/launch-templates/%s", client.TenantID, name)
+	return client.deleteResource(url, api.LaunchTemplatesV1)
+}
+
+// CreateInstancesFromTemplate creates instances from a launch template.
+// The fields of the server object in overrides, named as in an instance
+// create request, replace those of the template.
+func (client *Client) CreateInstancesFromTemplate(template string, overrides map[string]interface{}) (api.Servers, error) {
+	var servers api.Servers
+
+	if err := client.requireFeature(types.FeatureLaunchTemplates); err != nil {
+		return servers, err
+	}
+
+	request := struct {
+		Template string                 `json:"template"`
+		Server   map[string]interface{} `json:"server,omitempty"`
+	}{template, overrides}
+
+	url := client.buildCiaoURL("%s/instances", client.TenantID)
+	err := client.postResource(url, api.InstancesV1, &request, &servers)
+	if err != nil {
+		return servers, err
+	}
+
+	return servers, batchLaunchError(servers)
+}
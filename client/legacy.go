@@ -17,6 +17,7 @@
 package client
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
@@ -55,14 +56,36 @@ func (client *Client) ListInstancesByNode(nodeID string) (types.CiaoServersStats
 	return servers, err
 }
 
-// DeleteAllInstances deletes all the instances
-func (client *Client) DeleteAllInstances() error {
+// DeleteAllInstances deletes all the instances which are not protected from
+// deletion.  The protected instances are listed in the response.
+func (client *Client) DeleteAllInstances() (types.CiaoServersActionResponse, error) {
 	var action types.CiaoServersAction
+	var resp types.CiaoServersActionResponse
 
 	url := client.buildComputeURL("%s/servers/action", client.TenantID)
 	action.Action = "os-delete"
 
-	return client.postResource(url, "", &action, nil)
+	err := client.postResource(url, "", &action, &resp)
+
+	return resp, err
+}
+
+// GetNodeSummary summarises the instances placed on a node.  The node is
+// flagged as stale if it has not sent stats for staleMinutes, or for the
+// controller's default period if staleMinutes is zero.
+func (client *Client) GetNodeSummary(nodeID string, staleMinutes int) (types.CiaoNodeSummary, error) {
+	var summary types.CiaoNodeSummary
+
+	url := client.buildComputeURL("nodes/%s/summary", nodeID)
+
+	var query []queryValue
+	if staleMinutes > 0 {
+		query = append(query, queryValue{name: "stale_minutes", value: strconv.Itoa(staleMinutes)})
+	}
+
+	err := client.getResource(url, "", query, &summary)
+
+	return summary, err
 }
 
 // ListComputeNodes returns the set of compute nodes
@@ -95,6 +118,17 @@ func (client *Client) ListNodes() (types.CiaoNodes, error) {
 	return nodes, err
 }
 
+// GetClusterStatus returns the number of nodes in each status and the
+// capacity of the cluster
+func (client *Client) GetClusterStatus() (types.CiaoClusterStatus, error) {
+	var status types.CiaoClusterStatus
+
+	url := client.buildComputeURL("nodes/summary")
+	err := client.getResource(url, "", nil, &status)
+
+	return status, err
+}
+
 // ListCNCIs returns the set of CNCIs
 func (client *Client) ListCNCIs() (types.CiaoCNCIs, error) {
 	var nodes types.CiaoCNCIs
@@ -17,7 +17,10 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
@@ -43,3 +46,41 @@ func (client *Client) ChangeNodeStatus(nodeID string, status types.NodeStatusTyp
 
 	return err
 }
+
+// SetNodeStatus puts a node into maintenance or returns it to service.  If
+// evacuate is set the instances on a node put into maintenance are moved to
+// other nodes, by the operation which is returned.
+func (client *Client) SetNodeStatus(nodeID string, status types.NodeStatusType, evacuate bool) (types.Operation, error) {
+	var op types.Operation
+
+	if !client.IsPrivileged() {
+		return op, errors.New("This command is only available to admins")
+	}
+
+	b, err := json.Marshal(types.CiaoNodeStatus{Status: status})
+	if err != nil {
+		return op, errors.Wrap(err, "Error marshalling JSON")
+	}
+
+	var values []queryValue
+	if evacuate {
+		values = append(values, queryValue{name: "evacuate", value: "true"})
+	}
+
+	url := client.buildCiaoURL("nodes/%s/status", nodeID)
+	resp, err := client.sendHTTPRequest("PUT", url, values, bytes.NewReader(b), api.NodeV1)
+	if err != nil {
+		return op, errors.Wrapf(err, "Error making HTTP request to %s", url)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return op, nil
+	case http.StatusAccepted:
+		err = client.unmarshalHTTPResponse(resp, &op)
+		return op, err
+	default:
+		return op, fmt.Errorf("HTTP response code from %s not as expected: %s", url, resp.Status)
+	}
+}
@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// operationPollInterval is how often WaitOperation polls an operation.
+const operationPollInterval = time.Second
+
+// ListOperations lists the operations of the current tenant, or of all
+// tenants for the admin.
+func (client *Client) ListOperations() ([]types.Operation, error) {
+	var ops types.ListOperationsResponse
+
+	var url string
+	if client.IsPrivileged() && client.TenantID == "admin" {
+		url = client.buildCiaoURL("operations")
+	} else {
+		url = client.buildCiaoURL("%s/operations", client.TenantID)
+	}
+
+	err := client.getResource(url, api.OperationsV1, nil, &ops)
+
+	return ops.Operations, err
+}
+
+// GetOperation retrieves the current state of an operation
+func (client *Client) GetOperation(operationID string) (types.Operation, error) {
+	var op types.Operation
+
+	var url string
+	if client.IsPrivileged() && client.TenantID == "admin" {
+		url = client.buildCiaoURL("operations/%s", operationID)
+	} else {
+		url = client.buildCiaoURL("%s/operations/%s", client.TenantID, operationID)
+	}
+
+	err := client.getResource(url, api.OperationsV1, nil, &op)
+
+	return op, err
+}
+
+// WaitOperation polls an operation until it completes, returning an error
+// if it failed.
+func (client *Client) WaitOperation(operationID string) (types.Operation, error) {
+	for {
+		op, err := client.GetOperation(operationID)
+		if err != nil {
+			return op, err
+		}
+
+		if op.State == types.OperationFailed {
+			return op, fmt.Errorf("Operation %s failed: %s", op.ID, op.Error)
+		}
+
+		if op.Done() {
+			return op, nil
+		}
+
+		time.Sleep(operationPollInterval)
+	}
+}
+
+// CreateSignedURL returns a URL through which a read-only resource, such as
+// the result of an operation, may be downloaded without credentials until
+// it expires.  A zero expiresIn requests the longest lifetime the
+// controller permits.
+func (client *Client) CreateSignedURL(resource string, ID string, expiresIn time.Duration) (types.SignedURL, error) {
+	var signed types.SignedURL
+
+	if err := client.requireFeature(types.FeatureSignedURLs); err != nil {
+		return signed, err
+	}
+
+	var url string
+	if client.IsPrivileged() && client.TenantID == "admin" {
+		url = client.buildCiaoURL("signed-urls")
+	} else {
+		url = client.buildCiaoURL("%s/signed-urls", client.TenantID)
+	}
+
+	req := types.SignedURLRequest{
+		Resource:  resource,
+		ID:        ID,
+		ExpiresIn: int(expiresIn / time.Second),
+	}
+	err := client.postResource(url, api.SignedURLsV1, &req, &signed)
+
+	return signed, err
+}
@@ -125,6 +125,29 @@ func (client *Client) DeleteExternalIPPool(pool string) error {
 
 }
 
+// SetExternalIPPoolTenants restricts the pool to the given tenants.  An
+// empty list of tenants makes the pool available to all tenants.
+func (client *Client) SetExternalIPPoolTenants(pool string, tenants []string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeaturePoolAccess); err != nil {
+		return err
+	}
+
+	url, err := client.getCiaoPoolRef(pool)
+	if err != nil {
+		return errors.Wrap(err, "Error getting pool reference")
+	}
+
+	req := types.PoolAccessRequest{
+		Tenants: tenants,
+	}
+
+	return client.putResource(url+"/tenants", api.PoolsV1, &req)
+}
+
 // AddExternalIPSubnet adds a subnet to the external IP pool
 func (client *Client) AddExternalIPSubnet(pool string, subnet *net.IPNet) error {
 	if !client.IsPrivileged() {
@@ -0,0 +1,91 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// ListSnapshotSchedules lists the snapshot schedules of the current tenant.
+func (client *Client) ListSnapshotSchedules() ([]types.SnapshotSchedule, error) {
+	var schedules types.ListSnapshotSchedulesResponse
+
+	if err := client.requireFeature(types.FeatureSnapshotSchedules); err != nil {
+		return schedules.Schedules, err
+	}
+
+	url := client.buildCiaoURL("%s/snapshot-schedules", client.TenantID)
+	err := client.getResource(url, api.SnapshotSchedulesV1, nil, &schedules)
+
+	return schedules.Schedules, err
+}
+
+// CreateSnapshotSchedule creates a snapshot schedule for the current
+// tenant.
+func (client *Client) CreateSnapshotSchedule(req types.SnapshotScheduleRequest) (types.SnapshotSchedule, error) {
+	var schedule types.SnapshotSchedule
+
+	if err := client.requireFeature(types.FeatureSnapshotSchedules); err != nil {
+		return schedule, err
+	}
+
+	url := client.buildCiaoURL("%s/snapshot-schedules", client.TenantID)
+	err := client.postResource(url, api.SnapshotSchedulesV1, &req, &schedule)
+
+	return schedule, err
+}
+
+// GetSnapshotSchedule gets a snapshot schedule of the current tenant.
+func (client *Client) GetSnapshotSchedule(ID string) (types.SnapshotSchedule, error) {
+	var schedule types.SnapshotSchedule
+
+	if err := client.requireFeature(types.FeatureSnapshotSchedules); err != nil {
+		return schedule, err
+	}
+
+	url := client.buildCiaoURL("%s/snapshot-schedules/%s", client.TenantID, ID)
+	err := client.getResource(url, api.SnapshotSchedulesV1, nil, &schedule)
+
+	return schedule, err
+}
+
+// DeleteSnapshotSchedule deletes a snapshot schedule of the current
+// tenant.  The snapshots it has taken are kept.
+func (client *Client) DeleteSnapshotSchedule(ID string) error {
+	if err := client.requireFeature(types.FeatureSnapshotSchedules); err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("%s/snapshot-schedules/%s", client.TenantID, ID)
+	return client.deleteResource(url, api.SnapshotSchedulesV1)
+}
+
+// ListVolumeSnapshots lists the snapshots taken of a volume of the current
+// tenant, on request or by its snapshot schedules.
+func (client *Client) ListVolumeSnapshots(volumeID string) ([]types.VolumeSnapshot, error) {
+	var snapshots types.ListVolumeSnapshotsResponse
+
+	if err := client.requireFeature(types.FeatureSnapshotSchedules); err != nil {
+		return snapshots.Snapshots, err
+	}
+
+	url := client.buildCiaoURL("%s/volumes/%s/snapshots", client.TenantID, volumeID)
+	err := client.getResource(url, api.VolumesV1, nil, &snapshots)
+
+	return snapshots.Snapshots, err
+}
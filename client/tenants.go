@@ -20,6 +20,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
@@ -69,6 +72,73 @@ func (client *Client) ListQuotas(tenantID string) ([]types.QuotaDetails, error)
 	return result.Quotas, err
 }
 
+// ListQuotaDenials lists the tenants with the most quota denials over the
+// controller's quota denial window.  At most limit tenants are returned.
+func (client *Client) ListQuotaDenials(limit int) (types.QuotaDenialsResponse, error) {
+	var result types.QuotaDenialsResponse
+
+	if !client.IsPrivileged() {
+		return result, errors.New("This command is only available to admins")
+	}
+
+	url, err := client.getCiaoQuotasResource()
+	if err != nil {
+		return result, errors.Wrap(err, "Error getting quotas resource")
+	}
+
+	url = fmt.Sprintf("%s/quotas/denials", url)
+	query := []queryValue{{name: "limit", value: strconv.Itoa(limit)}}
+	err = client.getResource(url, api.TenantsV1, query, &result)
+
+	return result, err
+}
+
+// ListQuotaHistory lists the changes in the consumption of the resources of
+// a tenant which are subject to quotas, oldest first.  Only the changes of
+// resource, if it is not empty, made since since, if it is not zero, are
+// listed.
+func (client *Client) ListQuotaHistory(tenantID string, resource string, since time.Time) ([]types.QuotaAuditRecord, error) {
+	var result types.QuotaHistoryResponse
+
+	if !client.IsPrivileged() {
+		return result.History, errors.New("This command is only available to admins")
+	}
+
+	url, err := client.getCiaoQuotasResource()
+	if err != nil {
+		return result.History, errors.Wrap(err, "Error getting quotas resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/quotas/history", url, tenantID)
+
+	var query []queryValue
+	if resource != "" {
+		query = append(query, queryValue{name: "resource", value: resource})
+	}
+	if !since.IsZero() {
+		query = append(query, queryValue{name: "since", value: since.UTC().Format(time.RFC3339)})
+	}
+
+	err = client.getResource(url, api.TenantsV1, query, &result)
+
+	return result.History, err
+}
+
+// GetTenantCapacity estimates how many more instances of each of the
+// workloads visible to the current tenant could be launched.
+func (client *Client) GetTenantCapacity() (types.TenantCapacity, error) {
+	var capacity types.TenantCapacity
+
+	if err := client.requireFeature(types.FeatureCapacityHints); err != nil {
+		return capacity, err
+	}
+
+	url := client.buildCiaoURL("%s/capacity", client.TenantID)
+	err := client.getResource(url, api.CapacityV1, nil, &capacity)
+
+	return capacity, err
+}
+
 func (client *Client) getCiaoTenantsResource() (string, error) {
 	url, err := client.getCiaoResource("tenants", api.TenantsV1)
 	return url, err
@@ -123,6 +193,53 @@ func (client *Client) GetTenantConfig(ID string) (types.TenantConfig, error) {
 	return config, err
 }
 
+// GetTenantDetails gets the tenant configuration along with the size of the
+// CNCIs launched for the tenant
+func (client *Client) GetTenantDetails(ID string) (types.TenantDetails, error) {
+	var details types.TenantDetails
+
+	url, err := client.getCiaoTenantRef(ID)
+	if err != nil {
+		return details, err
+	}
+
+	err = client.getResource(url, api.TenantsV1, nil, &details)
+
+	return details, err
+}
+
+// mergeCNCIValue returns the old value of a tenant's CNCI size unless a
+// new value is given.  A negative value resets it to the cluster's.
+func mergeCNCIValue(old int, new int) int {
+	if new < 0 {
+		return 0
+	} else if new == 0 {
+		return old
+	}
+	return new
+}
+
+// mergeCNCISize returns the CNCI size of a tenant once the values of size
+// are applied to old.
+func mergeCNCISize(old *types.CNCISize, size *types.CNCISize) *types.CNCISize {
+	var merged types.CNCISize
+	if old != nil {
+		merged = *old
+	}
+
+	if size != nil {
+		merged.VCPUs = mergeCNCIValue(merged.VCPUs, size.VCPUs)
+		merged.MemMB = mergeCNCIValue(merged.MemMB, size.MemMB)
+		merged.DiskMB = mergeCNCIValue(merged.DiskMB, size.DiskMB)
+	}
+
+	if merged == (types.CNCISize{}) {
+		return nil
+	}
+
+	return &merged
+}
+
 // UpdateTenantConfig updates the tenant configuration
 func (client *Client) UpdateTenantConfig(ID string, config types.TenantConfig) error {
 	url, err := client.getCiaoTenantRef(ID)
@@ -149,6 +266,22 @@ func (client *Client) UpdateTenantConfig(ID string, config types.TenantConfig) e
 		config.SubnetBits = oldconfig.SubnetBits
 	}
 
+	// network pre-provisioning is only chosen when the tenant is created
+	config.PreprovisionNetwork = oldconfig.PreprovisionNetwork
+
+	if config.TrashRetentionMinutes == 0 {
+		config.TrashRetentionMinutes = oldconfig.TrashRetentionMinutes
+	}
+
+	// a negative limit lifts the tenant's subnet limit
+	if config.MaxSubnets == 0 {
+		config.MaxSubnets = oldconfig.MaxSubnets
+	} else if config.MaxSubnets < 0 {
+		config.MaxSubnets = 0
+	}
+
+	config.CNCISize = mergeCNCISize(oldconfig.CNCISize, config.CNCISize)
+
 	b, err := json.Marshal(config)
 	if err != nil {
 		return err
@@ -167,40 +300,82 @@ func (client *Client) UpdateTenantConfig(ID string, config types.TenantConfig) e
 	return err
 }
 
-// CreateTenantConfig creates a new tenant configuration
-func (client *Client) CreateTenantConfig(tenantID string, config types.TenantConfig) (types.TenantSummary, error) {
-	var req types.TenantRequest
-	var summary types.TenantSummary
+// CreateTenant creates a new tenant with its initial quotas.  A tenant ID is
+// generated if req.ID is empty.  Creating a tenant again with the same
+// configuration returns the existing tenant.
+func (client *Client) CreateTenant(req types.TenantRequest) (types.TenantRecord, error) {
+	var record types.TenantRecord
 
 	if !client.IsPrivileged() {
-		return summary, errors.New("This command is only available to admins")
+		return record, errors.New("This command is only available to admins")
 	}
 
 	url, err := client.getCiaoTenantsResource()
 	if err != nil {
-		return summary, err
+		return record, err
 	}
 
-	req.ID = tenantID
-	req.Config = config
+	err = client.postResource(url, api.TenantsV1, &req, &record)
 
-	err = client.postResource(url, api.TenantsV1, &req, &summary)
+	return record, err
+}
 
-	return summary, err
+// CreateTenantConfig creates a new tenant configuration
+func (client *Client) CreateTenantConfig(tenantID string, config types.TenantConfig) (types.TenantSummary, error) {
+	record, err := client.CreateTenant(types.TenantRequest{ID: tenantID, Config: config})
+	if err != nil {
+		return types.TenantSummary{}, err
+	}
+
+	summary := types.TenantSummary{
+		ID:    record.ID,
+		Name:  record.Name,
+		Links: record.Links,
+	}
+
+	return summary, nil
 }
 
-// DeleteTenant deletes the given tenant
-func (client *Client) DeleteTenant(tenantID string) error {
+// DeleteTenant starts deleting the given tenant and everything it owns.
+// The returned operation tracks the deletion.  A tenant which still has
+// instances, or which owns instances or volumes protected from deletion,
+// is only deleted if force is set.
+func (client *Client) DeleteTenant(tenantID string, force bool) (types.Operation, error) {
+	var op types.Operation
+
 	if !client.IsPrivileged() {
-		return errors.New("This command is only available to admins")
+		return op, errors.New("This command is only available to admins")
 	}
 
 	url, err := client.getCiaoTenantRef(tenantID)
 	if err != nil {
-		return err
+		return op, err
 	}
 
-	return client.deleteResource(url, api.TenantsV1)
+	var values []queryValue
+	if force {
+		values = append(values, queryValue{name: "force", value: "true"})
+	}
+
+	resp, err := client.sendHTTPRequest("DELETE", url, values, nil, api.TenantsV1)
+	if err != nil {
+		return op, errors.Wrapf(err, "Error making HTTP request to %s", url)
+	}
+	defer resp.Body.Close()
+
+	// controllers which predate asynchronous tenant deletion have already
+	// deleted the tenant and return no operation.
+	if resp.StatusCode == http.StatusNoContent {
+		return op, nil
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return op, fmt.Errorf("HTTP response code from %s not as expected: %s", url, resp.Status)
+	}
+
+	err = client.unmarshalHTTPResponse(resp, &op)
+
+	return op, err
 }
 
 // ListTenants returns a list of the tenants
@@ -216,3 +391,217 @@ func (client *Client) ListTenants() (types.TenantsListResponse, error) {
 
 	return tenants, err
 }
+
+// UpdateTenantFreeze freezes or unfreezes a tenant.  A reason must be given
+// when freezing a tenant.
+func (client *Client) UpdateTenantFreeze(tenantID string, frozen bool, reason string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/freeze", url, tenantID)
+	req := types.TenantFreezeRequest{Frozen: frozen, Reason: reason}
+
+	return client.putResource(url, api.TenantsV1, &req)
+}
+
+// ExportTenant retrieves the definitions of a tenant which are needed to
+// recreate it on another cluster.
+func (client *Client) ExportTenant(tenantID string) (types.TenantExport, error) {
+	var export types.TenantExport
+
+	if !client.IsPrivileged() {
+		return export, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantExport); err != nil {
+		return export, err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return export, errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/export", url, tenantID)
+	err = client.getResource(url, api.TenantsV1, nil, &export)
+
+	return export, err
+}
+
+// ImportTenant recreates a tenant from an export taken on another cluster.
+// If validateOnly is true the export is checked for conflicts but nothing
+// is imported.
+func (client *Client) ImportTenant(export types.TenantExport, validateOnly bool) (types.TenantImportResponse, error) {
+	var resp types.TenantImportResponse
+
+	if !client.IsPrivileged() {
+		return resp, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantExport); err != nil {
+		return resp, err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return resp, errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/import?validate_only=%t", url, validateOnly)
+	err = client.postResource(url, api.TenantsV1, &export, &resp)
+
+	return resp, err
+}
+
+// PrepareTenantNetwork starts launching the CNCI for a subnet of a tenant's
+// network, or for its first subnet if subnet is empty, so that the tenant's
+// instances do not wait for it.  The returned operation tracks the launch.
+// Only admins may prepare the network of a tenant other than their own.
+func (client *Client) PrepareTenantNetwork(tenantID string, subnet string) (types.Operation, error) {
+	var op types.Operation
+
+	if err := client.requireFeature(types.FeatureNetworkPrepare); err != nil {
+		return op, err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return op, errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	if client.IsPrivileged() {
+		url = fmt.Sprintf("%s/%s/network/prepare", url, tenantID)
+	} else {
+		if tenantID != client.TenantID {
+			return op, errors.New("Preparing the network of another tenant is restricted to admins")
+		}
+		url = fmt.Sprintf("%s/network/prepare", url)
+	}
+
+	req := types.TenantNetworkPrepareRequest{Subnet: subnet}
+	err = client.postResource(url, api.TenantsV1, &req, &op)
+
+	return op, err
+}
+
+// RetryTenantNetwork retries the initialization of the network controller
+// of a tenant which failed when the controller started.  It is restricted
+// to admins.
+func (client *Client) RetryTenantNetwork(tenantID string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantNetworkRetry); err != nil {
+		return err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/network/retry", url, tenantID)
+
+	return client.postResource(url, api.TenantsV1, nil, nil)
+}
+
+// GetTenantNetwork retrieves the subnets of a tenant's network together
+// with how many of their addresses are in use.  Only admins may view the
+// network of a tenant other than their own.
+func (client *Client) GetTenantNetwork(tenantID string) (types.TenantNetwork, error) {
+	var network types.TenantNetwork
+
+	if err := client.requireFeature(types.FeatureSubnetLimits); err != nil {
+		return network, err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return network, errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	if client.IsPrivileged() {
+		url = fmt.Sprintf("%s/%s/network", url, tenantID)
+	} else {
+		if tenantID != client.TenantID {
+			return network, errors.New("Viewing the network of another tenant is restricted to admins")
+		}
+		url = fmt.Sprintf("%s/network", url)
+	}
+
+	err = client.getResource(url, api.TenantsV1, nil, &network)
+
+	return network, err
+}
+
+// GetTenantCA retrieves the client CA registered for a tenant
+func (client *Client) GetTenantCA(tenantID string) (types.TenantCA, error) {
+	var ca types.TenantCA
+
+	if !client.IsPrivileged() {
+		return ca, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantCAs); err != nil {
+		return ca, err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return ca, errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/ca", url, tenantID)
+	err = client.getResource(url, api.TenantsV1, nil, &ca)
+
+	return ca, err
+}
+
+// UpdateTenantCA registers the PEM encoded CA certificate which signs the
+// client certificates of the users of a tenant
+func (client *Client) UpdateTenantCA(tenantID string, certificate string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantCAs); err != nil {
+		return err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/ca", url, tenantID)
+	req := types.TenantCARequest{Certificate: certificate}
+
+	return client.putResource(url, api.TenantsV1, &req)
+}
+
+// DeleteTenantCA revokes the client CA of a tenant
+func (client *Client) DeleteTenantCA(tenantID string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureTenantCAs); err != nil {
+		return err
+	}
+
+	url, err := client.getCiaoTenantsResource()
+	if err != nil {
+		return errors.Wrap(err, "Error getting tenants resource")
+	}
+
+	url = fmt.Sprintf("%s/%s/ca", url, tenantID)
+
+	return client.deleteResource(url, api.TenantsV1)
+}
@@ -0,0 +1,58 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+)
+
+// ListTrash lists the deleted instances and volumes in the trash of the
+// current tenant, or of all tenants for the admin.
+func (client *Client) ListTrash() ([]types.TrashItem, error) {
+	var trash types.ListTrashResponse
+
+	if err := client.requireFeature(types.FeatureTrash); err != nil {
+		return trash.Items, err
+	}
+
+	var url string
+	if client.IsPrivileged() && client.TenantID == "admin" {
+		url = client.buildCiaoURL("trash")
+	} else {
+		url = client.buildCiaoURL("%s/trash", client.TenantID)
+	}
+
+	err := client.getResource(url, api.TrashV1, nil, &trash)
+
+	return trash.Items, err
+}
+
+// RestoreTrashItem restores a deleted instance or volume from the trash of
+// the current tenant.  Restored instances are relaunched with a new ID.
+func (client *Client) RestoreTrashItem(itemID string) (types.TrashRestoreResponse, error) {
+	var resp types.TrashRestoreResponse
+
+	if err := client.requireFeature(types.FeatureTrash); err != nil {
+		return resp, err
+	}
+
+	url := client.buildCiaoURL("%s/trash/%s/restore", client.TenantID, itemID)
+	err := client.postResource(url, api.TrashV1, nil, &resp)
+
+	return resp, err
+}
@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+func usageQuery(filter types.UsageFilter, format string) []queryValue {
+	var query []queryValue
+	if filter.TenantID != "" {
+		query = append(query, queryValue{name: "tenant_id", value: filter.TenantID})
+	}
+	if filter.Granularity != "" {
+		query = append(query, queryValue{name: "granularity", value: string(filter.Granularity)})
+	}
+	if !filter.Start.IsZero() {
+		query = append(query, queryValue{name: "start", value: filter.Start.Format(time.RFC3339)})
+	}
+	if !filter.End.IsZero() {
+		query = append(query, queryValue{name: "end", value: filter.End.Format(time.RFC3339)})
+	}
+	if format != "" {
+		query = append(query, queryValue{name: "format", value: format})
+	}
+
+	return query
+}
+
+// ListUsage retrieves the usage records of the tenants, or of the tenant of
+// filter, which start within the period of filter.  Only privileged users
+// may export usage.
+func (client *Client) ListUsage(filter types.UsageFilter) ([]types.UsageRecord, error) {
+	var resp types.ListUsageResponse
+
+	if !client.IsPrivileged() {
+		return resp.Usage, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureUsageHistory); err != nil {
+		return resp.Usage, err
+	}
+
+	url := client.buildCiaoURL("usage")
+	err := client.getResource(url, api.UsageV1, usageQuery(filter, ""), &resp)
+
+	return resp.Usage, err
+}
+
+// ExportUsageCSV retrieves the usage records selected by filter as CSV.
+func (client *Client) ExportUsageCSV(filter types.UsageFilter) ([]byte, error) {
+	if !client.IsPrivileged() {
+		return nil, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureUsageHistory); err != nil {
+		return nil, err
+	}
+
+	url := client.buildCiaoURL("usage")
+	resp, err := client.sendHTTPRequest("GET", url, usageQuery(filter, "csv"), nil, api.UsageV1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error making HTTP request to %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP response code from %s not as expected: %d", url, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
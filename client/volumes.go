@@ -17,15 +17,41 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
 )
 
-// CreateVolume creates a volume from a request
+// CreateVolume creates a volume from a request.  Volumes created from an
+// image are created asynchronously and CreateVolume waits for the creation
+// to complete.
 func (client *Client) CreateVolume(req api.RequestedVolume) (types.Volume, error) {
 	var vol types.Volume
 
 	url := client.buildCiaoURL("%s/volumes", client.TenantID)
+
+	if req.ImageRef != "" {
+		var op types.Operation
+
+		err := client.postResource(url, api.VolumesV1, &req, &op)
+		if err != nil {
+			return vol, err
+		}
+
+		op, err = client.WaitOperation(op.ID)
+		if err != nil {
+			return vol, err
+		}
+
+		return client.GetVolume(op.Result)
+	}
+
 	err := client.postResource(url, api.VolumesV1, &req, &vol)
 
 	return vol, err
@@ -54,17 +80,100 @@ func (client *Client) GetVolume(volumeID string) (types.Volume, error) {
 // DeleteVolume deletes a volume
 func (client *Client) DeleteVolume(volumeID string) error {
 	url := client.buildCiaoURL("%s/volumes/%s", client.TenantID, volumeID)
+	return client.deleteProtectedResource(url, api.VolumesV1, false)
+}
+
+// ForceDeleteVolume deletes a volume even if it is protected from deletion.
+// Only admins may force the deletion of a volume.
+func (client *Client) ForceDeleteVolume(volumeID string) error {
+	url := client.buildCiaoURL("%s/volumes/%s", client.TenantID, volumeID)
+	return client.deleteProtectedResource(url, api.VolumesV1, true)
+}
+
+// CreateVolumeSnapshot takes a snapshot of a volume of the current tenant.
+func (client *Client) CreateVolumeSnapshot(volumeID string, name string) (types.VolumeSnapshot, error) {
+	var snap types.VolumeSnapshot
+
+	if err := client.requireFeature(types.FeatureVolumeSnapshots); err != nil {
+		return snap, err
+	}
+
+	req := types.VolumeSnapshotRequest{Name: name}
+	url := client.buildCiaoURL("%s/volumes/%s/snapshots", client.TenantID, volumeID)
+	err := client.postResource(url, api.VolumesV1, &req, &snap)
+
+	return snap, err
+}
+
+// DeleteVolumeSnapshot deletes a snapshot of a volume of the current tenant.
+func (client *Client) DeleteVolumeSnapshot(volumeID string, snapshotID string) error {
+	if err := client.requireFeature(types.FeatureVolumeSnapshots); err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("%s/volumes/%s/snapshots/%s", client.TenantID, volumeID, snapshotID)
 	return client.deleteResource(url, api.VolumesV1)
 }
 
+// UpdateVolumeDeletionProtection sets or clears the protection of a volume
+// from deletion.
+func (client *Client) UpdateVolumeDeletionProtection(volumeID string, protected bool) error {
+	patch, err := json.Marshal(types.VolumeUpdate{DeletionProtected: protected})
+	if err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("%s/volumes/%s", client.TenantID, volumeID)
+
+	resp, err := client.sendHTTPRequest("PATCH", url, nil, bytes.NewReader(patch), "merge-patch+json")
+	if err != nil {
+		return errors.Wrap(err, "Error making HTTP request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP response code from %s not as expected: %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// ExtendVolume grows a volume to sizeGiB.  Attached volumes are only
+// extended if online is set.
+func (client *Client) ExtendVolume(volumeID string, sizeGiB int, online bool) error {
+	url := client.buildCiaoURL("%s/volumes/%s/action", client.TenantID, volumeID)
+
+	type ExtendRequest struct {
+		NewSize int  `json:"new_size"`
+		Online  bool `json:"online,omitempty"`
+	}
+
+	var extendReq = struct {
+		Extend ExtendRequest `json:"os-extend"`
+	}{
+		Extend: ExtendRequest{
+			NewSize: sizeGiB,
+			Online:  online,
+		},
+	}
+
+	return client.postResource(url, api.VolumesV1, &extendReq, nil)
+}
+
 // AttachVolume attaches a volume to an instance
 func (client *Client) AttachVolume(volumeID string, instanceID, mountPoint string, mode string) error {
+	return client.AttachTaggedVolume(volumeID, instanceID, mountPoint, mode, "")
+}
+
+// AttachTaggedVolume attaches a volume to an instance. The volume can be
+// found inside the instance using the tag, if one is given.
+func (client *Client) AttachTaggedVolume(volumeID string, instanceID, mountPoint string, mode string, tag string) error {
 	url := client.buildCiaoURL("%s/volumes/%s/action", client.TenantID, volumeID)
 
 	type AttachRequest struct {
 		MountPoint   string `json:"mountpoint"`
 		Mode         string `json:"mode"`
 		InstanceUUID string `json:"instance_uuid"`
+		Tag          string `json:"tag,omitempty"`
 	}
 
 	// mountpoint or mode isn't required
@@ -75,6 +184,7 @@ func (client *Client) AttachVolume(volumeID string, instanceID, mountPoint strin
 			MountPoint:   mountPoint,
 			Mode:         mode,
 			InstanceUUID: instanceID,
+			Tag:          tag,
 		},
 	}
 
@@ -100,3 +210,101 @@ func (client *Client) DetachVolume(volumeID string) error {
 
 	return err
 }
+
+// AttachVolumeToInstance attaches a volume to a running instance. The
+// returned operation completes once the volume has been attached.
+func (client *Client) AttachVolumeToInstance(volumeID string, instanceID string) (types.Operation, error) {
+	var op types.Operation
+
+	url := client.buildCiaoURL("%s/volumes/%s/attach", client.TenantID, volumeID)
+	req := types.VolumeAttachRequest{InstanceID: instanceID}
+
+	err := client.postResource(url, api.VolumesV1, &req, &op)
+
+	return op, err
+}
+
+// DetachVolumeFromInstance detaches a volume from a running instance. The
+// returned operation completes once the volume has been detached.
+func (client *Client) DetachVolumeFromInstance(volumeID string, instanceID string) (types.Operation, error) {
+	var op types.Operation
+
+	url := client.buildCiaoURL("%s/volumes/%s/detach", client.TenantID, volumeID)
+	req := types.VolumeAttachRequest{InstanceID: instanceID}
+
+	err := client.postResource(url, api.VolumesV1, &req, &op)
+
+	return op, err
+}
+
+// ForceDetachVolume removes all the attachments of a volume, breaking any
+// lock held on it, and makes it available again. Confirm must be set to
+// detach the volume from a running instance.
+func (client *Client) ForceDetachVolume(volumeID string, confirm bool) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureVolumeRepair); err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("volumes/%s/force-detach", volumeID)
+	req := types.ForceDetachRequest{Confirm: confirm}
+
+	return client.postResource(url, api.VolumesV1, &req, nil)
+}
+
+// ListAttachments retrieves a page of the storage attachments of all tenants
+// matching filter.  The NextMarker of the result should be used as the
+// Marker of filter to retrieve the next page.
+func (client *Client) ListAttachments(filter types.AttachmentFilter) (types.ListAttachmentsResponse, error) {
+	var attachments types.ListAttachmentsResponse
+
+	if !client.IsPrivileged() {
+		return attachments, errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureVolumeAttachments); err != nil {
+		return attachments, err
+	}
+
+	var query []queryValue
+	for _, v := range []queryValue{
+		{name: "tenant_id", value: filter.TenantID},
+		{name: "instance_id", value: filter.InstanceID},
+		{name: "volume_id", value: filter.VolumeID},
+		{name: "node_id", value: filter.NodeID},
+		{name: "state", value: string(filter.State)},
+		{name: "marker", value: filter.Marker},
+	} {
+		if v.value != "" {
+			query = append(query, v)
+		}
+	}
+	if filter.Limit > 0 {
+		query = append(query, queryValue{name: "limit", value: strconv.Itoa(filter.Limit)})
+	}
+
+	url := client.buildCiaoURL("volumes/attachments")
+	err := client.getResource(url, api.VolumesV1, query, &attachments)
+
+	return attachments, err
+}
+
+// SetVolumeState repairs the recorded state of a volume. The reason is
+// recorded in the event log of the volume's owner.
+func (client *Client) SetVolumeState(volumeID string, state types.BlockState, reason string) error {
+	if !client.IsPrivileged() {
+		return errors.New("This command is only available to admins")
+	}
+
+	if err := client.requireFeature(types.FeatureVolumeRepair); err != nil {
+		return err
+	}
+
+	url := client.buildCiaoURL("volumes/%s/state", volumeID)
+	req := types.VolumeStateRequest{State: state, Reason: reason}
+
+	return client.putResource(url, api.VolumesV1, &req)
+}
@@ -30,6 +30,12 @@ func (client *Client) getCiaoWorkloadsResource() (string, error) {
 
 // ListWorkloads gets the workloads available
 func (client *Client) ListWorkloads() ([]types.Workload, error) {
+	return client.SearchWorkloads("")
+}
+
+// SearchWorkloads gets the workloads available whose description contains
+// search.  All the workloads available are returned if search is empty.
+func (client *Client) SearchWorkloads(search string) ([]types.Workload, error) {
 	var wls []types.Workload
 
 	var url string
@@ -39,7 +45,12 @@ func (client *Client) ListWorkloads() ([]types.Workload, error) {
 		url = client.buildCiaoURL("%s/workloads", client.TenantID)
 	}
 
-	err := client.getResource(url, api.WorkloadsV1, nil, &wls)
+	var query []queryValue
+	if search != "" {
+		query = append(query, queryValue{name: "search", value: search})
+	}
+
+	err := client.getResource(url, api.WorkloadsV1, query, &wls)
 	return wls, err
 }
 
@@ -57,6 +68,18 @@ func (client *Client) CreateWorkload(request types.Workload) (types.Workload, er
 	return response.Workload, err
 }
 
+// UpdateWorkload replaces the definition of the given workload
+func (client *Client) UpdateWorkload(workloadID string, request types.Workload) error {
+	url, err := client.getCiaoWorkloadsResource()
+	if err != nil {
+		return errors.Wrap(err, "Error getting workloads resource")
+	}
+
+	url = fmt.Sprintf("%s/%s", url, workloadID)
+
+	return client.putResource(url, api.WorkloadsV1, &request)
+}
+
 // DeleteWorkload deletes the given workload
 func (client *Client) DeleteWorkload(workloadID string) error {
 	url, err := client.getCiaoWorkloadsResource()
@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package jsoninterface
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciao-project/ciao/clogger"
+)
+
+// CiaoJSONLogger is a CiaoLog implementation that writes each message as a
+// single line JSON object.  Key/value context supplied via With is added to
+// the object as additional fields.
+type CiaoJSONLogger struct {
+	out       *syncWriter
+	verbosity *int32
+	fields    map[string]interface{}
+}
+
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewCiaoJSONLogger creates a new CiaoJSONLogger that writes to w.  Messages
+// passed to V(level) are only considered verbose if level is less than or
+// equal to verbosity.
+func NewCiaoJSONLogger(w io.Writer, verbosity int32) *CiaoJSONLogger {
+	return &CiaoJSONLogger{
+		out:       &syncWriter{w: w},
+		verbosity: &verbosity,
+	}
+}
+
+// SetVerbosity changes the verbosity of the logger and of all the loggers
+// derived from it using With.
+func (l *CiaoJSONLogger) SetVerbosity(verbosity int32) {
+	atomic.StoreInt32(l.verbosity, verbosity)
+}
+
+// V returns true if the given argument is less than or equal
+// to the logger's verbosity level.
+func (l *CiaoJSONLogger) V(level int32) bool {
+	return level <= atomic.LoadInt32(l.verbosity)
+}
+
+// Infof writes informational output to the log.
+func (l *CiaoJSONLogger) Infof(format string, v ...interface{}) {
+	l.write("info", format, v...)
+}
+
+// Warningf writes warning output to the log.
+func (l *CiaoJSONLogger) Warningf(format string, v ...interface{}) {
+	l.write("warning", format, v...)
+}
+
+// Errorf writes error output to the log.
+func (l *CiaoJSONLogger) Errorf(format string, v ...interface{}) {
+	l.write("error", format, v...)
+}
+
+// With returns a logger that adds the given key/value pairs as fields
+// of every message it writes.
+func (l *CiaoJSONLogger) With(keyvals ...interface{}) clogger.CiaoLog {
+	fields := make(map[string]interface{}, len(l.fields)+len(keyvals)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var val interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		fields[fmt.Sprint(keyvals[i])] = val
+	}
+
+	return &CiaoJSONLogger{
+		out:       l.out,
+		verbosity: l.verbosity,
+		fields:    fields,
+	}
+}
+
+func (l *CiaoJSONLogger) write(level string, format string, v ...interface{}) {
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": level,
+			"msg":   entry["msg"],
+			"error": fmt.Sprintf("unable to marshal log fields: %v", err),
+		})
+	}
+
+	l.out.Lock()
+	_, _ = l.out.w.Write(append(b, '\n'))
+	l.out.Unlock()
+}
@@ -16,6 +16,12 @@
 
 package clogger
 
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
 // CiaoLog is a logging interface to be used by other packages to log various
 // interesting pieces of information.  Rather than introduce a dependency
 // on a given logging package, ciao-logger presents this interface that allows
@@ -57,3 +63,94 @@ func (l CiaoNullLogger) Warningf(format string, v ...interface{}) {
 // Errorf no logging done
 func (l CiaoNullLogger) Errorf(format string, v ...interface{}) {
 }
+
+// CiaoFieldLog is implemented by loggers that are able to attach key/value
+// context to the messages they write, e.g., loggers that emit structured
+// output.
+type CiaoFieldLog interface {
+	CiaoLog
+
+	// With returns a logger that attaches the given key/value pairs
+	// to every message it writes.  keyvals is expected to contain an
+	// even number of elements, alternating between keys and values.
+	With(keyvals ...interface{}) CiaoLog
+}
+
+// With returns a logger that attaches the key/value pairs in keyvals to
+// all messages written through l.  If l implements CiaoFieldLog the
+// context is handled natively by l, otherwise the pairs are appended to
+// each message in key=value form.
+func With(l CiaoLog, keyvals ...interface{}) CiaoLog {
+	if fl, ok := l.(CiaoFieldLog); ok {
+		return fl.With(keyvals...)
+	}
+
+	return &fieldLogger{l: l, fields: formatFields(keyvals)}
+}
+
+// formatFields renders keyvals as a space separated list of key=value
+// pairs.  A trailing key without a value is paired with "MISSING".
+func formatFields(keyvals []interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(keyvals); i += 2 {
+		var val interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%v=%v", keyvals[i], val)
+	}
+	return buf.String()
+}
+
+// fieldLogger adds key/value context to the messages of loggers that do
+// not support it natively.
+type fieldLogger struct {
+	l      CiaoLog
+	fields string
+}
+
+func (f *fieldLogger) format(format string) string {
+	if f.fields == "" {
+		return format
+	}
+	return strings.TrimSuffix(format, "\n") + " " +
+		strings.Replace(f.fields, "%", "%%", -1)
+}
+
+// V returns the verbosity of the underlying logger
+func (f *fieldLogger) V(level int32) bool {
+	return f.l.V(level)
+}
+
+// Infof writes informational output, including context, to the underlying
+// logger.
+func (f *fieldLogger) Infof(format string, v ...interface{}) {
+	f.l.Infof(f.format(format), v...)
+}
+
+// Warningf writes warning output, including context, to the underlying
+// logger.
+func (f *fieldLogger) Warningf(format string, v ...interface{}) {
+	f.l.Warningf(f.format(format), v...)
+}
+
+// Errorf writes error output, including context, to the underlying
+// logger.
+func (f *fieldLogger) Errorf(format string, v ...interface{}) {
+	f.l.Errorf(f.format(format), v...)
+}
+
+// With returns a logger that adds keyvals to the context already
+// associated with f.
+func (f *fieldLogger) With(keyvals ...interface{}) CiaoLog {
+	fields := formatFields(keyvals)
+	if f.fields != "" && fields != "" {
+		fields = f.fields + " " + fields
+	} else if fields == "" {
+		fields = f.fields
+	}
+	return &fieldLogger{l: f.l, fields: fields}
+}
@@ -66,6 +66,15 @@ const fullValidConf = `configure:
     admin_ssh_key: ""
     client_auth_ca_cert_path: /etc/pki/ciao/auth-CA.pem
     cnci_net: 10.10.0.0
+    node_suspect_timeout: 30
+    node_down_timeout: 120
+    node_recovery_period: 60
+    token_key_path: /etc/ciao/token.key
+    token_expiry: 3600
+    api_write_rate: 120
+    api_write_burst: 60
+    api_read_rate: 600
+    api_read_burst: 100
   launcher:
     compute_net:
     - 192.168.1.0/24
@@ -121,6 +130,15 @@ func fillPayload(conf *payloads.Configure) {
 	conf.Configure.Controller.CNCIDisk = 128
 	conf.Configure.Controller.ClientAuthCACertPath = clientAuthCACert
 	conf.Configure.Controller.CNCINet = "10.10.0.0"
+	conf.Configure.Controller.NodeSuspectTimeout = 30
+	conf.Configure.Controller.NodeDownTimeout = 120
+	conf.Configure.Controller.NodeRecoveryPeriod = 60
+	conf.Configure.Controller.TokenKeyPath = "/etc/ciao/token.key"
+	conf.Configure.Controller.TokenExpiry = 3600
+	conf.Configure.Controller.APIWriteRate = 120
+	conf.Configure.Controller.APIWriteBurst = 60
+	conf.Configure.Controller.APIReadRate = 600
+	conf.Configure.Controller.APIReadBurst = 100
 	conf.Configure.Launcher.ComputeNetwork = []string{computeNet}
 	conf.Configure.Launcher.ManagementNetwork = []string{mgmtNet}
 	conf.Configure.Launcher.ChildUser = "ciao"
@@ -0,0 +1,172 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package osprepare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// PackageState describes whether a required package is installed.
+type PackageState string
+
+const (
+	// PackageInstalled means the binary provided by the package exists
+	PackageInstalled PackageState = "installed"
+
+	// PackageMissing means the package needs to be installed
+	PackageMissing PackageState = "missing"
+)
+
+// PackageStatus is the state of a single PackageRequirement on this host.
+type PackageStatus struct {
+	BinaryName  string       `json:"binary"`
+	PackageName string       `json:"package"`
+	State       PackageState `json:"state"`
+}
+
+// Report is the result of checking a set of PackageRequirements against
+// the host without installing anything.
+type Report struct {
+	// Distro is the ID of the detected distribution, or the os-release
+	// name and version if the distribution is not supported.
+	Distro    string          `json:"distro"`
+	Supported bool            `json:"supported"`
+	Packages  []PackageStatus `json:"packages"`
+	Missing   []string        `json:"missing"`
+}
+
+// OK returns true if the distribution is supported and nothing needs to be
+// installed.
+func (r *Report) OK() bool {
+	return r.Supported && len(r.Missing) == 0
+}
+
+// WriteTable writes a human readable summary of the report to w.
+func (r *Report) WriteTable(w io.Writer) error {
+	if !r.Supported {
+		_, err := fmt.Fprintf(w, "Unsupported distro: %s\n", r.Distro)
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "OS Detected: %s\n\n", r.Distro); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tBINARY\tSTATE")
+	for _, p := range r.Packages {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.PackageName, p.BinaryName, p.State)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d of %d packages missing\n", len(r.Missing), len(r.Packages))
+	return err
+}
+
+// WriteJSON writes the report to w as a JSON document.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(r)
+}
+
+// prober gives access to the state of the host so that it can be faked
+// during testing.
+type prober interface {
+	// getDistro returns the distribution of the host or nil if it is
+	// not supported.
+	getDistro() distro
+
+	// describe returns the name and version of an unsupported host.
+	describe() string
+
+	// installed returns true if the given binary exists.
+	installed(binary string) bool
+}
+
+type hostProber struct{}
+
+func (hostProber) getDistro() distro {
+	return getDistro()
+}
+
+func (hostProber) describe() string {
+	if rel := getOSRelease(); rel != nil {
+		return fmt.Sprintf("%s %s", rel.Name, rel.Version)
+	}
+	return "no os-release found"
+}
+
+func (hostProber) installed(binary string) bool {
+	return pathExists(binary)
+}
+
+// Check resolves the given PackageRequirements against the host and
+// returns a Report of what is installed and what is missing.  Nothing
+// is installed.
+func Check(reqs ...PackageRequirements) Report {
+	return check(hostProber{}, reqs...)
+}
+
+func check(p prober, reqs ...PackageRequirements) Report {
+	r := Report{
+		Packages: []PackageStatus{},
+		Missing:  []string{},
+	}
+
+	d := p.getDistro()
+	if d == nil {
+		r.Distro = p.describe()
+		return r
+	}
+
+	r.Distro = d.getID()
+	r.Supported = true
+
+	seen := make(map[PackageRequirement]bool)
+	missing := make(map[string]bool)
+	for _, req := range reqs {
+		for _, pkg := range req[r.Distro] {
+			if pkg.BinaryName == "" || pkg.PackageName == "" || seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+
+			status := PackageStatus{
+				BinaryName:  pkg.BinaryName,
+				PackageName: pkg.PackageName,
+				State:       PackageInstalled,
+			}
+
+			if !p.installed(pkg.BinaryName) {
+				status.State = PackageMissing
+				if !missing[pkg.PackageName] {
+					missing[pkg.PackageName] = true
+					r.Missing = append(r.Missing, pkg.PackageName)
+				}
+			}
+
+			r.Packages = append(r.Packages, status)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package osprepare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/clogger"
+)
+
+type fakeDistro struct {
+	id string
+}
+
+func (d *fakeDistro) getID() string {
+	return d.id
+}
+
+func (d *fakeDistro) InstallPackages(ctx context.Context, packages []string, logger clogger.CiaoLog) bool {
+	return false
+}
+
+type fakeProber struct {
+	distro   distro
+	binaries map[string]bool
+}
+
+func (p *fakeProber) getDistro() distro {
+	return p.distro
+}
+
+func (p *fakeProber) describe() string {
+	return "Fake OS 1.0"
+}
+
+func (p *fakeProber) installed(binary string) bool {
+	return p.binaries[binary]
+}
+
+var checkTestReqs = PackageRequirements{
+	"ubuntu": {
+		{"/usr/bin/qemu-img", "qemu-utils"},
+		{"/usr/bin/ceph", "ceph-common"},
+		{"", ""},
+	},
+	"fedora": {
+		{"/usr/bin/qemu-img", "qemu-img"},
+	},
+}
+
+func TestCheckPresentAndMissing(t *testing.T) {
+	p := &fakeProber{
+		distro:   &fakeDistro{id: "ubuntu"},
+		binaries: map[string]bool{"/usr/bin/qemu-img": true},
+	}
+
+	// the duplicate requirement should only be reported once
+	r := check(p, checkTestReqs, PackageRequirements{
+		"ubuntu": {{"/usr/bin/ceph", "ceph-common"}},
+	})
+
+	expected := Report{
+		Distro:    "ubuntu",
+		Supported: true,
+		Packages: []PackageStatus{
+			{"/usr/bin/qemu-img", "qemu-utils", PackageInstalled},
+			{"/usr/bin/ceph", "ceph-common", PackageMissing},
+		},
+		Missing: []string{"ceph-common"},
+	}
+
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("Unexpected report\ngot: %+v\nexp: %+v", r, expected)
+	}
+
+	if r.OK() {
+		t.Fatal("Report with missing packages is OK")
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "1 of 2 packages missing") {
+		t.Errorf("Unexpected table:\n%s", buf.String())
+	}
+}
+
+func TestCheckAllPresent(t *testing.T) {
+	p := &fakeProber{
+		distro:   &fakeDistro{id: "fedora"},
+		binaries: map[string]bool{"/usr/bin/qemu-img": true},
+	}
+
+	r := check(p, checkTestReqs)
+	if !r.OK() {
+		t.Fatalf("Expected report to be OK: %+v", r)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(r, decoded) {
+		t.Fatalf("JSON report mismatch\ngot: %+v\nexp: %+v", decoded, r)
+	}
+}
+
+func TestCheckUnknownDistro(t *testing.T) {
+	p := &fakeProber{}
+
+	r := check(p, checkTestReqs)
+	if r.Supported || r.OK() {
+		t.Fatalf("Unknown distro reported as supported: %+v", r)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "Unsupported distro: Fake OS 1.0\n" {
+		t.Errorf("Unexpected table: %s", buf.String())
+	}
+}
@@ -42,7 +42,7 @@ func (l ospTestLogger) V(level int32) bool {
 
 var info []string
 var warning []string
-var error []string
+var errs []string
 
 func (l ospTestLogger) Infof(format string, v ...interface{}) {
 	info = append(info, format)
@@ -53,7 +53,7 @@ func (l ospTestLogger) Warningf(format string, v ...interface{}) {
 }
 
 func (l ospTestLogger) Errorf(format string, v ...interface{}) {
-	error = append(error, format)
+	errs = append(errs, format)
 }
 
 func TestSudoFormatCommandLogging(t *testing.T) {
@@ -71,7 +71,7 @@ func TestSudoFormatCommandLogging(t *testing.T) {
 }
 
 func TestSudoFormatCommandBadCommandReturn(t *testing.T) {
-	error = []string{}
+	errs = []string{}
 	if getDistro() == nil {
 		t.Skip("Unsupported test distro")
 	}
@@ -80,7 +80,7 @@ func TestSudoFormatCommandBadCommandReturn(t *testing.T) {
 	if sudoFormatCommand(context.Background(), "false", []string{}, l) {
 		t.Fatal("Error return code not detected")
 	}
-	if len(error) != 1 && error[0] != "Error running command: %s" {
+	if len(errs) != 1 && errs[0] != "Error running command: %s" {
 		t.Fatal("Incorrect log message received")
 	}
 }
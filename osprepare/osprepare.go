@@ -19,6 +19,7 @@ package osprepare
 import (
 	"context"
 	"strings"
+	"time"
 
 	"github.com/ciao-project/ciao/clogger"
 )
@@ -122,13 +123,21 @@ func collectPackages(dist distro, reqs PackageRequirements) []string {
 	return nil
 }
 
+// InstallTimeout is the maximum amount of time InstallDeps waits for the
+// package manager before giving up.
+var InstallTimeout = 15 * time.Minute
+
 // InstallDeps installs all the dependencies defined in a component
-// specific PackageRequirements in order to enable running the component
+// specific PackageRequirements in order to enable running the component.
+// The installation is abandoned if ctx is done or InstallTimeout expires.
 func InstallDeps(ctx context.Context, reqs PackageRequirements, logger clogger.CiaoLog) {
 	if logger == nil {
 		logger = clogger.CiaoNullLogger{}
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, InstallTimeout)
+	defer cancel()
+
 	distro := getDistro()
 
 	if distro == nil {
@@ -149,6 +158,9 @@ func InstallDeps(ctx context.Context, reqs PackageRequirements, logger clogger.C
 	if reqPkgs := collectPackages(distro, reqs); reqPkgs != nil {
 		logger.Infof("Missing packages detected: %v", reqPkgs)
 		if distro.InstallPackages(ctx, reqPkgs, logger) == false {
+			if ctx.Err() == context.DeadlineExceeded {
+				logger.Errorf("Timed out installing packages")
+			}
 			logger.Errorf("Failed to install: %s", strings.Join(reqPkgs, ", "))
 			return
 		}
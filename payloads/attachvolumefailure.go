@@ -55,6 +55,10 @@ const (
 	// AttachVolumeNotSupported indicates that the attach volume command
 	// is not supported for the given workload type, e.g., a container.
 	AttachVolumeNotSupported = "not_supported"
+
+	// AttachVolumeTagInUse indicates that the tag requested for the
+	// volume already identifies another volume attached to the instance.
+	AttachVolumeTagInUse = "tag_in_use"
 )
 
 // ErrorAttachVolumeFailure represents the unmarshalled version of the contents of a
@@ -93,6 +97,8 @@ func (r AttachVolumeFailureReason) String() string {
 		return "Instance failure"
 	case AttachVolumeNotSupported:
 		return "Not Supported"
+	case AttachVolumeTagInUse:
+		return "Tag already in use"
 	}
 
 	return ""
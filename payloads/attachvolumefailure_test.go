@@ -80,6 +80,7 @@ func TestAttachVolmeFailureString(t *testing.T) {
 		{AttachVolumeStateFailure, "State failure"},
 		{AttachVolumeInstanceFailure, "Instance failure"},
 		{AttachVolumeNotSupported, "Not Supported"},
+		{AttachVolumeTagInUse, "Tag already in use"},
 	}
 	error := ErrorAttachVolumeFailure{
 		InstanceUUID: testutil.InstanceUUID,
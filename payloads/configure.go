@@ -52,6 +52,16 @@ type ConfigureController struct {
 	AdminSSHKey          string `yaml:"admin_ssh_key"`
 	ClientAuthCACertPath string `yaml:"client_auth_ca_cert_path"`
 	CNCINet              string `yaml:"cnci_net"`
+	APIHostname          string `yaml:"api_hostname"`
+	NodeSuspectTimeout   int    `yaml:"node_suspect_timeout"`
+	NodeDownTimeout      int    `yaml:"node_down_timeout"`
+	NodeRecoveryPeriod   int    `yaml:"node_recovery_period"`
+	TokenKeyPath         string `yaml:"token_key_path"`
+	TokenExpiry          int    `yaml:"token_expiry"`
+	APIWriteRate         int    `yaml:"api_write_rate"`
+	APIWriteBurst        int    `yaml:"api_write_burst"`
+	APIReadRate          int    `yaml:"api_read_rate"`
+	APIReadBurst         int    `yaml:"api_read_burst"`
 }
 
 // ConfigureLauncher contains the unmarshalled configurations for the
@@ -0,0 +1,51 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ConsoleLogCmd contains the nodeID of the SSNTP Agent running an instance,
+// the UUID of that instance and the maximum number of lines of its serial
+// console to report.  RequestID is echoed in the report so that it can be
+// matched to the request.
+type ConsoleLogCmd struct {
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+	InstanceUUID      string `yaml:"instance_uuid"`
+	RequestID         string `yaml:"request_id"`
+	Length            int    `yaml:"length"`
+}
+
+// ConsoleLog represents the SSNTP ConsoleLog command payload.
+type ConsoleLog struct {
+	ConsoleLog ConsoleLogCmd `yaml:"console_log"`
+}
+
+// ConsoleLogReportEvent contains the last lines written by an instance to
+// its serial console.  Reason is empty if the console log could be read.
+// RequestID is that of the ConsoleLogCmd the report answers.
+type ConsoleLogReportEvent struct {
+	NodeUUID     string   `yaml:"node_uuid"`
+	InstanceUUID string   `yaml:"instance_uuid"`
+	RequestID    string   `yaml:"request_id"`
+	Lines        []string `yaml:"lines"`
+	Reason       string   `yaml:"reason,omitempty"`
+}
+
+// EventConsoleLogReport represents the unmarshalled version of the contents
+// of an SSNTP ssntp.ConsoleLogReport event.  This event is sent by
+// ciao-launcher in reply to an ssntp.ConsoleLog command.
+type EventConsoleLogReport struct {
+	Report ConsoleLogReportEvent `yaml:"console_log_report"`
+}
@@ -0,0 +1,118 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+var consoleLogLines = []string{
+	"Ubuntu 16.04 LTS ciao ttyS0",
+	"ciao login: ",
+}
+
+func TestConsoleLogMarshal(t *testing.T) {
+	var cmd ConsoleLog
+	cmd.ConsoleLog.WorkloadAgentUUID = testutil.AgentUUID
+	cmd.ConsoleLog.InstanceUUID = testutil.InstanceUUID
+	cmd.ConsoleLog.RequestID = testutil.ConsoleLogRequestID
+	cmd.ConsoleLog.Length = 2
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.ConsoleLogYaml {
+		t.Errorf("ConsoleLog marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.ConsoleLogYaml)
+	}
+}
+
+func TestConsoleLogUnmarshal(t *testing.T) {
+	var cmd ConsoleLog
+	err := yaml.Unmarshal([]byte(testutil.ConsoleLogYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.ConsoleLog.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.ConsoleLog.WorkloadAgentUUID)
+	}
+
+	if cmd.ConsoleLog.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", cmd.ConsoleLog.InstanceUUID)
+	}
+
+	if cmd.ConsoleLog.RequestID != testutil.ConsoleLogRequestID {
+		t.Errorf("Wrong Request ID field [%s]", cmd.ConsoleLog.RequestID)
+	}
+
+	if cmd.ConsoleLog.Length != 2 {
+		t.Errorf("Wrong Length field [%d]", cmd.ConsoleLog.Length)
+	}
+}
+
+func TestConsoleLogReportMarshal(t *testing.T) {
+	var report EventConsoleLogReport
+	report.Report.NodeUUID = testutil.AgentUUID
+	report.Report.InstanceUUID = testutil.InstanceUUID
+	report.Report.RequestID = testutil.ConsoleLogRequestID
+	report.Report.Lines = consoleLogLines
+
+	y, err := yaml.Marshal(&report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.ConsoleLogReportYaml {
+		t.Errorf("ConsoleLogReport marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.ConsoleLogReportYaml)
+	}
+}
+
+func TestConsoleLogReportUnmarshal(t *testing.T) {
+	var report EventConsoleLogReport
+	err := yaml.Unmarshal([]byte(testutil.ConsoleLogReportYaml), &report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if report.Report.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Node UUID field [%s]", report.Report.NodeUUID)
+	}
+
+	if report.Report.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", report.Report.InstanceUUID)
+	}
+
+	if report.Report.RequestID != testutil.ConsoleLogRequestID {
+		t.Errorf("Wrong Request ID field [%s]", report.Report.RequestID)
+	}
+
+	if len(report.Report.Lines) != len(consoleLogLines) {
+		t.Fatalf("Expected %d lines, got %d", len(consoleLogLines), len(report.Report.Lines))
+	}
+
+	for i := range consoleLogLines {
+		if report.Report.Lines[i] != consoleLogLines[i] {
+			t.Errorf("Wrong line %d [%s]", i, report.Report.Lines[i])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// InventoryCmd contains the nodeID of the SSNTP Agent whose instances
+// should be reported.
+type InventoryCmd struct {
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+}
+
+// Inventory represents the SSNTP InstanceInventory command payload.
+type Inventory struct {
+	Inventory InventoryCmd `yaml:"instance_inventory"`
+}
+
+// InventoryInstance contains the UUID and the state of an instance present
+// on a node.  State uses the same values as InstanceStat.State.
+type InventoryInstance struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+	State        string `yaml:"state"`
+}
+
+// InventoryReportEvent contains every instance present on a node.
+type InventoryReportEvent struct {
+	NodeUUID  string              `yaml:"node_uuid"`
+	Instances []InventoryInstance `yaml:"instances"`
+}
+
+// EventInventoryReport represents the unmarshalled version of the contents
+// of an SSNTP ssntp.InstanceInventoryReport event.  This event is sent by
+// ciao-launcher in reply to an ssntp.InstanceInventory command.
+type EventInventoryReport struct {
+	Report InventoryReportEvent `yaml:"instance_inventory"`
+}
@@ -0,0 +1,92 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestInventoryMarshal(t *testing.T) {
+	var cmd Inventory
+	cmd.Inventory.WorkloadAgentUUID = testutil.AgentUUID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.InventoryYaml {
+		t.Errorf("Inventory marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.InventoryYaml)
+	}
+}
+
+func TestInventoryUnmarshal(t *testing.T) {
+	var cmd Inventory
+	err := yaml.Unmarshal([]byte(testutil.InventoryYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Inventory.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Inventory.WorkloadAgentUUID)
+	}
+}
+
+func TestInventoryReportMarshal(t *testing.T) {
+	var report EventInventoryReport
+	report.Report.NodeUUID = testutil.AgentUUID
+	report.Report.Instances = []InventoryInstance{
+		{
+			InstanceUUID: testutil.InstanceUUID,
+			State:        Running,
+		},
+	}
+
+	y, err := yaml.Marshal(&report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.InventoryReportYaml {
+		t.Errorf("InventoryReport marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.InventoryReportYaml)
+	}
+}
+
+func TestInventoryReportUnmarshal(t *testing.T) {
+	var report EventInventoryReport
+	err := yaml.Unmarshal([]byte(testutil.InventoryReportYaml), &report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if report.Report.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Node UUID field [%s]", report.Report.NodeUUID)
+	}
+
+	if len(report.Report.Instances) != 1 {
+		t.Fatalf("Expected 1 instance, got %d", len(report.Report.Instances))
+	}
+
+	i := report.Report.Instances[0]
+	if i.InstanceUUID != testutil.InstanceUUID || i.State != Running {
+		t.Errorf("Wrong instance [%s %s]", i.InstanceUUID, i.State)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// PrepareMigrationCmd contains the information an SSNTP Agent needs to
+// get ready to receive a running instance from another agent.
+type PrepareMigrationCmd struct {
+	// InstanceUUID is the UUID of the instance being migrated.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// TenantUUID is the UUID of the tenant owning the instance.
+	TenantUUID string `yaml:"tenant_uuid"`
+
+	// WorkloadAgentUUID is the UUID of the agent to which the instance
+	// is migrated.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// SourceAgentUUID is the UUID of the agent currently running the
+	// instance.
+	SourceAgentUUID string `yaml:"source_agent_uuid"`
+
+	// Requirements are the resources needed by the instance.
+	Requirements WorkloadRequirements `yaml:"requirements"`
+
+	// Networking contains the network configuration of the instance.
+	Networking NetworkResources `yaml:"networking"`
+
+	// ExtraNetworking contains the configuration of the network
+	// interfaces of the instance in addition to its primary one.
+	ExtraNetworking []NetworkResources `yaml:"extra_networking,omitempty"`
+
+	// Storage lists the volumes attached to the instance, which must be
+	// attached to it again on the agent to which it is migrated.
+	Storage []StorageResource `yaml:"storage,omitempty"`
+}
+
+// PrepareMigration represents the SSNTP PrepareMigration command payload.
+type PrepareMigration struct {
+	Prepare PrepareMigrationCmd `yaml:"prepare_migration"`
+}
+
+// MigrateInstanceCmd contains the information an SSNTP Agent needs to
+// transfer a running instance to another agent.
+type MigrateInstanceCmd struct {
+	// InstanceUUID is the UUID of the instance being migrated.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// WorkloadAgentUUID is the UUID of the agent currently running the
+	// instance.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// TargetAgentUUID is the UUID of the agent to which the instance is
+	// migrated.
+	TargetAgentUUID string `yaml:"target_agent_uuid"`
+
+	// TargetAddress is the address at which the target agent receives
+	// the instance, as reported in its MigrationPrepared event.
+	TargetAddress string `yaml:"target_address"`
+}
+
+// MigrateInstance represents the SSNTP MigrateInstance command payload.
+type MigrateInstance struct {
+	Migrate MigrateInstanceCmd `yaml:"migrate_instance"`
+}
+
+// AbortMigrationCmd contains the nodeID of the SSNTP Agent which was
+// prepared to receive an instance and the UUID of that instance.
+type AbortMigrationCmd struct {
+	InstanceUUID      string `yaml:"instance_uuid"`
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+}
+
+// AbortMigration represents the SSNTP AbortMigration command payload.
+type AbortMigration struct {
+	Abort AbortMigrationCmd `yaml:"abort_migration"`
+}
+
+// MigrationPreparedEvent is sent by an agent once it is ready to receive
+// an instance.
+type MigrationPreparedEvent struct {
+	// NodeUUID is the UUID of the node to which the instance is migrated.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// InstanceUUID is the UUID of the instance being migrated.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Address is the address at which the instance is received.
+	Address string `yaml:"address"`
+}
+
+// EventMigrationPrepared represents the unmarshalled version of the
+// contents of an SSNTP ssntp.MigrationPrepared event.  This event is sent
+// by ciao-launcher in reply to an ssntp.PrepareMigration command.
+type EventMigrationPrepared struct {
+	Prepared MigrationPreparedEvent `yaml:"migration_prepared"`
+}
+
+// InstanceMigratedEvent is sent by an agent once it has transferred an
+// instance to another agent.
+type InstanceMigratedEvent struct {
+	// InstanceUUID is the UUID of the migrated instance.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// NodeUUID is the UUID of the node from which the instance was
+	// migrated.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// TargetNodeUUID is the UUID of the node now running the instance.
+	TargetNodeUUID string `yaml:"target_node_uuid"`
+}
+
+// EventInstanceMigrated represents the unmarshalled version of the
+// contents of an SSNTP ssntp.InstanceMigrated event.  This event is sent
+// by ciao-launcher in reply to an ssntp.MigrateInstance command.
+type EventInstanceMigrated struct {
+	Migrated InstanceMigratedEvent `yaml:"instance_migrated"`
+}
+
+// MigrationFailureReason denotes the underlying error that prevented an
+// agent from preparing for, or carrying out, the migration of an instance.
+type MigrationFailureReason string
+
+const (
+	// MigrationNoInstance indicates that the instance to be migrated
+	// does not exist on the node which was asked to transfer it.
+	MigrationNoInstance MigrationFailureReason = "no_instance"
+
+	// MigrationAlreadyExists indicates that the node which was asked to
+	// receive the instance already has an instance with the same UUID.
+	MigrationAlreadyExists = "already_exists"
+
+	// MigrationInvalidPayload indicates that the payload of the SSNTP
+	// command was corrupt and could not be unmarshalled.
+	MigrationInvalidPayload = "invalid_payload"
+
+	// MigrationInvalidData is returned by ciao-launcher if the contents
+	// of the payload are incorrect, e.g., the instance_uuid is missing.
+	MigrationInvalidData = "invalid_data"
+
+	// MigrationNotSupported indicates that the agent does not support
+	// the live migration of the instance, e.g., because it is a
+	// container.
+	MigrationNotSupported = "not_supported"
+
+	// MigrationFullComputeNode indicates that the node which was asked to
+	// receive the instance does not have the resources to run it.
+	MigrationFullComputeNode = "full_cn"
+
+	// MigrationStorageFailure indicates that the volumes of the instance
+	// could not be attached on the node which was asked to receive it.
+	MigrationStorageFailure = "storage_failure"
+
+	// MigrationTransferFailure indicates that the transfer of the
+	// instance failed.  The instance keeps running on its original node.
+	MigrationTransferFailure = "transfer_failure"
+)
+
+// ErrorMigrationFailure represents the unmarshalled version of the
+// contents of a SSNTP ERROR frame whose type is set to
+// ssntp.MigrationFailure.
+type ErrorMigrationFailure struct {
+	// NodeUUID is the UUID of the node that generated this error.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// InstanceUUID is the UUID of the instance which could not be
+	// migrated.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Reason provides the reason for the failure, e.g.,
+	// MigrationNotSupported.
+	Reason MigrationFailureReason `yaml:"reason"`
+}
+
+func (r MigrationFailureReason) String() string {
+	switch r {
+	case MigrationNoInstance:
+		return "Instance does not exist"
+	case MigrationAlreadyExists:
+		return "Instance already exists"
+	case MigrationInvalidPayload:
+		return "YAML payload is corrupt"
+	case MigrationInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case MigrationNotSupported:
+		return "Not Supported"
+	case MigrationFullComputeNode:
+		return "Compute node is full"
+	case MigrationStorageFailure:
+		return "Failed to attach volumes"
+	case MigrationTransferFailure:
+		return "Failed to transfer instance"
+	}
+
+	return ""
+}
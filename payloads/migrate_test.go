@@ -0,0 +1,204 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func testPrepareMigration() PrepareMigration {
+	var cmd PrepareMigration
+	cmd.Prepare.InstanceUUID = testutil.InstanceUUID
+	cmd.Prepare.TenantUUID = testutil.TenantUUID
+	cmd.Prepare.WorkloadAgentUUID = testutil.AgentUUID
+	cmd.Prepare.SourceAgentUUID = testutil.PeerAgentUUID
+	cmd.Prepare.Requirements = WorkloadRequirements{MemMB: 4096, VCPUs: 2}
+	cmd.Prepare.Networking = NetworkResources{
+		VnicMAC:          testutil.VNICMAC,
+		VnicUUID:         testutil.VNICUUID,
+		ConcentratorUUID: testutil.CNCIUUID,
+		ConcentratorIP:   testutil.CNCIIP,
+		Subnet:           testutil.TenantSubnet,
+		SubnetKey:        testutil.SubnetKey,
+		PrivateIP:        testutil.InstancePrivateIP,
+	}
+	cmd.Prepare.Storage = []StorageResource{{ID: testutil.VolumeUUID, Bootable: true}}
+	return cmd
+}
+
+func TestPrepareMigrationMarshal(t *testing.T) {
+	cmd := testPrepareMigration()
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.PrepareMigrationYaml {
+		t.Errorf("PrepareMigration marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.PrepareMigrationYaml)
+	}
+}
+
+func TestPrepareMigrationUnmarshal(t *testing.T) {
+	var cmd PrepareMigration
+	err := yaml.Unmarshal([]byte(testutil.PrepareMigrationYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := testPrepareMigration()
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Errorf("PrepareMigration unmarshalling failed\n%+v\n vs\n%+v", cmd, expected)
+	}
+}
+
+func TestMigrateInstanceMarshal(t *testing.T) {
+	var cmd MigrateInstance
+	cmd.Migrate.InstanceUUID = testutil.InstanceUUID
+	cmd.Migrate.WorkloadAgentUUID = testutil.AgentUUID
+	cmd.Migrate.TargetAgentUUID = testutil.PeerAgentUUID
+	cmd.Migrate.TargetAddress = testutil.MigrationAddress
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.MigrateInstanceYaml {
+		t.Errorf("MigrateInstance marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.MigrateInstanceYaml)
+	}
+}
+
+func TestMigrateInstanceUnmarshal(t *testing.T) {
+	var cmd MigrateInstance
+	err := yaml.Unmarshal([]byte(testutil.MigrateInstanceYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Migrate.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", cmd.Migrate.InstanceUUID)
+	}
+
+	if cmd.Migrate.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Migrate.WorkloadAgentUUID)
+	}
+
+	if cmd.Migrate.TargetAgentUUID != testutil.PeerAgentUUID {
+		t.Errorf("Wrong Target Agent UUID field [%s]", cmd.Migrate.TargetAgentUUID)
+	}
+
+	if cmd.Migrate.TargetAddress != testutil.MigrationAddress {
+		t.Errorf("Wrong Target Address field [%s]", cmd.Migrate.TargetAddress)
+	}
+}
+
+func TestAbortMigrationMarshal(t *testing.T) {
+	var cmd AbortMigration
+	cmd.Abort.InstanceUUID = testutil.InstanceUUID
+	cmd.Abort.WorkloadAgentUUID = testutil.AgentUUID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.AbortMigrationYaml {
+		t.Errorf("AbortMigration marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.AbortMigrationYaml)
+	}
+}
+
+func TestMigrationPreparedMarshal(t *testing.T) {
+	var event EventMigrationPrepared
+	event.Prepared.NodeUUID = testutil.AgentUUID
+	event.Prepared.InstanceUUID = testutil.InstanceUUID
+	event.Prepared.Address = testutil.MigrationAddress
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.MigrationPreparedYaml {
+		t.Errorf("MigrationPrepared marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.MigrationPreparedYaml)
+	}
+}
+
+func TestInstanceMigratedUnmarshal(t *testing.T) {
+	var event EventInstanceMigrated
+	err := yaml.Unmarshal([]byte(testutil.InstanceMigratedYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if event.Migrated.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", event.Migrated.InstanceUUID)
+	}
+
+	if event.Migrated.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Node UUID field [%s]", event.Migrated.NodeUUID)
+	}
+
+	if event.Migrated.TargetNodeUUID != testutil.PeerAgentUUID {
+		t.Errorf("Wrong Target Node UUID field [%s]", event.Migrated.TargetNodeUUID)
+	}
+}
+
+func TestMigrationFailureMarshal(t *testing.T) {
+	failure := ErrorMigrationFailure{
+		NodeUUID:     testutil.AgentUUID,
+		InstanceUUID: testutil.InstanceUUID,
+		Reason:       MigrationTransferFailure,
+	}
+
+	y, err := yaml.Marshal(&failure)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.MigrationFailureYaml {
+		t.Errorf("MigrationFailure marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.MigrationFailureYaml)
+	}
+}
+
+func TestMigrationFailureString(t *testing.T) {
+	var stringTests = []struct {
+		r        MigrationFailureReason
+		expected string
+	}{
+		{MigrationNoInstance, "Instance does not exist"},
+		{MigrationAlreadyExists, "Instance already exists"},
+		{MigrationInvalidPayload, "YAML payload is corrupt"},
+		{MigrationInvalidData, "Command section of YAML payload is corrupt or missing required information"},
+		{MigrationNotSupported, "Not Supported"},
+		{MigrationFullComputeNode, "Compute node is full"},
+		{MigrationStorageFailure, "Failed to attach volumes"},
+		{MigrationTransferFailure, "Failed to transfer instance"},
+	}
+
+	for _, test := range stringTests {
+		str := test.r.String()
+		if str != test.expected {
+			t.Errorf("expected \"%s\", got \"%s\"", test.expected, str)
+		}
+	}
+}
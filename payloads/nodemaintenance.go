@@ -0,0 +1,36 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// NodeMaintenanceEvent contains whether a node has been put into or taken
+// out of maintenance.
+type NodeMaintenanceEvent struct {
+	// NodeUUID is the SSNTP UUID of the agent running on the node.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// Maintenance is true if no new instances may be started on the
+	// node.
+	Maintenance bool `yaml:"maintenance"`
+}
+
+// EventNodeMaintenance represents the unmarshalled version of the contents
+// of an SSNTP ssntp.NodeMaintenance event.  This event is sent by the
+// controller to the scheduler when a node is put into or taken out of
+// maintenance.
+type EventNodeMaintenance struct {
+	NodeMaintenance NodeMaintenanceEvent `yaml:"node_maintenance"`
+}
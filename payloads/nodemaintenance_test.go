@@ -0,0 +1,56 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNodeMaintenanceMarshal(t *testing.T) {
+	var event EventNodeMaintenance
+	event.NodeMaintenance.NodeUUID = testutil.AgentUUID
+	event.NodeMaintenance.Maintenance = true
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.NodeMaintenanceYaml {
+		t.Errorf("NodeMaintenance marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.NodeMaintenanceYaml)
+	}
+}
+
+func TestNodeMaintenanceUnmarshal(t *testing.T) {
+	var event EventNodeMaintenance
+	err := yaml.Unmarshal([]byte(testutil.NodeMaintenanceYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if event.NodeMaintenance.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong node UUID field [%s]", event.NodeMaintenance.NodeUUID)
+	}
+
+	if !event.NodeMaintenance.Maintenance {
+		t.Error("Wrong maintenance field")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// PrefetchImageCmd contains the nodeID of the SSNTP Agent which should
+// cache an image and the UUID of that image.
+type PrefetchImageCmd struct {
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+	ImageUUID         string `yaml:"image_uuid"`
+}
+
+// PrefetchImage represents the SSNTP PrefetchImage command payload.
+type PrefetchImage struct {
+	Prefetch PrefetchImageCmd `yaml:"prefetch_image"`
+}
+
+// ImagePrefetchReportEvent contains the result of caching an image on a
+// node.  Reason is empty if the image was cached.
+type ImagePrefetchReportEvent struct {
+	NodeUUID  string `yaml:"node_uuid"`
+	ImageUUID string `yaml:"image_uuid"`
+	Reason    string `yaml:"reason,omitempty"`
+}
+
+// EventImagePrefetchReport represents the unmarshalled version of the
+// contents of an SSNTP ssntp.ImagePrefetchReport event.  This event is sent
+// by ciao-launcher in reply to an ssntp.PrefetchImage command.
+type EventImagePrefetchReport struct {
+	Report ImagePrefetchReportEvent `yaml:"image_prefetch"`
+}
@@ -0,0 +1,92 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPrefetchImageMarshal(t *testing.T) {
+	var cmd PrefetchImage
+	cmd.Prefetch.WorkloadAgentUUID = testutil.AgentUUID
+	cmd.Prefetch.ImageUUID = testutil.ImageUUID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.PrefetchImageYaml {
+		t.Errorf("PrefetchImage marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.PrefetchImageYaml)
+	}
+}
+
+func TestPrefetchImageUnmarshal(t *testing.T) {
+	var cmd PrefetchImage
+	err := yaml.Unmarshal([]byte(testutil.PrefetchImageYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Prefetch.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Prefetch.WorkloadAgentUUID)
+	}
+
+	if cmd.Prefetch.ImageUUID != testutil.ImageUUID {
+		t.Errorf("Wrong Image UUID field [%s]", cmd.Prefetch.ImageUUID)
+	}
+}
+
+func TestImagePrefetchReportMarshal(t *testing.T) {
+	var report EventImagePrefetchReport
+	report.Report.NodeUUID = testutil.AgentUUID
+	report.Report.ImageUUID = testutil.ImageUUID
+	report.Report.Reason = "No space left on device"
+
+	y, err := yaml.Marshal(&report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.ImagePrefetchReportYaml {
+		t.Errorf("ImagePrefetchReport marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.ImagePrefetchReportYaml)
+	}
+}
+
+func TestImagePrefetchReportUnmarshal(t *testing.T) {
+	var report EventImagePrefetchReport
+	err := yaml.Unmarshal([]byte(testutil.ImagePrefetchReportYaml), &report)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if report.Report.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Node UUID field [%s]", report.Report.NodeUUID)
+	}
+
+	if report.Report.ImageUUID != testutil.ImageUUID {
+		t.Errorf("Wrong Image UUID field [%s]", report.Report.ImageUUID)
+	}
+
+	if report.Report.Reason != "No space left on device" {
+		t.Errorf("Wrong reason field [%s]", report.Report.Reason)
+	}
+}
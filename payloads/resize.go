@@ -0,0 +1,120 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ResizeInstanceCmd contains the information an SSNTP Agent needs to
+// restart an instance with new resource requirements.
+type ResizeInstanceCmd struct {
+	// WorkloadAgentUUID is the UUID of the agent running the instance.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// InstanceUUID is the UUID of the instance to be resized.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VCPUs is the number of VCPUs the instance is restarted with.
+	VCPUs int `yaml:"vcpus"`
+
+	// MemMB is the memory, in MB, the instance is restarted with.
+	MemMB int `yaml:"mem_mb"`
+}
+
+// ResizeInstance represents the SSNTP ResizeInstance command payload.
+type ResizeInstance struct {
+	Resize ResizeInstanceCmd `yaml:"resize_instance"`
+}
+
+// InstanceResizedEvent is sent by an agent once it has restarted an
+// instance with its new resource requirements.
+type InstanceResizedEvent struct {
+	// NodeUUID is the UUID of the node running the instance.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// InstanceUUID is the UUID of the resized instance.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VCPUs is the number of VCPUs the instance is now running with.
+	VCPUs int `yaml:"vcpus"`
+
+	// MemMB is the memory, in MB, the instance is now running with.
+	MemMB int `yaml:"mem_mb"`
+}
+
+// EventInstanceResized represents the unmarshalled version of the contents
+// of an SSNTP ssntp.InstanceResized event.  This event is sent by
+// ciao-launcher in reply to an ssntp.ResizeInstance command.
+type EventInstanceResized struct {
+	Resized InstanceResizedEvent `yaml:"instance_resized"`
+}
+
+// ResizeFailureReason denotes the underlying error that prevented an agent
+// from resizing an instance.
+type ResizeFailureReason string
+
+const (
+	// ResizeNoInstance indicates that the instance to be resized does
+	// not exist on the node.
+	ResizeNoInstance ResizeFailureReason = "no_instance"
+
+	// ResizeInvalidPayload indicates that the payload of the SSNTP
+	// command was corrupt and could not be unmarshalled.
+	ResizeInvalidPayload = "invalid_payload"
+
+	// ResizeInvalidData is returned by ciao-launcher if the contents of
+	// the payload are incorrect, e.g., the instance_uuid is missing.
+	ResizeInvalidData = "invalid_data"
+
+	// ResizeNotSupported indicates that the agent does not support
+	// resizing the instance, e.g., because it is a container.
+	ResizeNotSupported = "not_supported"
+
+	// ResizeRestartFailure indicates that the instance could not be
+	// restarted with its new requirements.  If possible the instance is
+	// restarted with its previous requirements.
+	ResizeRestartFailure = "restart_failure"
+)
+
+// ErrorResizeFailure represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.ResizeFailure.
+type ErrorResizeFailure struct {
+	// NodeUUID is the UUID of the node that generated this error.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// InstanceUUID is the UUID of the instance which could not be
+	// resized.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Reason provides the reason for the failure, e.g.,
+	// ResizeNotSupported.
+	Reason ResizeFailureReason `yaml:"reason"`
+}
+
+func (r ResizeFailureReason) String() string {
+	switch r {
+	case ResizeNoInstance:
+		return "Instance does not exist"
+	case ResizeInvalidPayload:
+		return "YAML payload is corrupt"
+	case ResizeInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case ResizeNotSupported:
+		return "Not Supported"
+	case ResizeRestartFailure:
+		return "Failed to restart instance"
+	}
+
+	return ""
+}
@@ -0,0 +1,119 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestResizeInstanceMarshal(t *testing.T) {
+	var cmd ResizeInstance
+	cmd.Resize.WorkloadAgentUUID = testutil.AgentUUID
+	cmd.Resize.InstanceUUID = testutil.InstanceUUID
+	cmd.Resize.VCPUs = 4
+	cmd.Resize.MemMB = 2048
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.ResizeInstanceYaml {
+		t.Errorf("ResizeInstance marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.ResizeInstanceYaml)
+	}
+}
+
+func TestResizeInstanceUnmarshal(t *testing.T) {
+	var cmd ResizeInstance
+	err := yaml.Unmarshal([]byte(testutil.ResizeInstanceYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Resize.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Resize.WorkloadAgentUUID)
+	}
+
+	if cmd.Resize.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", cmd.Resize.InstanceUUID)
+	}
+
+	if cmd.Resize.VCPUs != 4 || cmd.Resize.MemMB != 2048 {
+		t.Errorf("Wrong requirements [%d %d]", cmd.Resize.VCPUs, cmd.Resize.MemMB)
+	}
+}
+
+func TestInstanceResizedMarshal(t *testing.T) {
+	var event EventInstanceResized
+	event.Resized.NodeUUID = testutil.AgentUUID
+	event.Resized.InstanceUUID = testutil.InstanceUUID
+	event.Resized.VCPUs = 4
+	event.Resized.MemMB = 2048
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.InstanceResizedYaml {
+		t.Errorf("InstanceResized marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.InstanceResizedYaml)
+	}
+}
+
+func TestResizeFailureUnmarshal(t *testing.T) {
+	var failure ErrorResizeFailure
+	err := yaml.Unmarshal([]byte(testutil.ResizeFailureYaml), &failure)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if failure.NodeUUID != testutil.AgentUUID {
+		t.Errorf("Wrong Node UUID field [%s]", failure.NodeUUID)
+	}
+
+	if failure.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong Instance UUID field [%s]", failure.InstanceUUID)
+	}
+
+	if failure.Reason != ResizeRestartFailure {
+		t.Errorf("Wrong Reason field [%s]", failure.Reason)
+	}
+}
+
+func TestResizeFailureString(t *testing.T) {
+	var stringTests = []struct {
+		r        ResizeFailureReason
+		expected string
+	}{
+		{ResizeNoInstance, "Instance does not exist"},
+		{ResizeInvalidPayload, "YAML payload is corrupt"},
+		{ResizeInvalidData, "Command section of YAML payload is corrupt or missing required information"},
+		{ResizeNotSupported, "Not Supported"},
+		{ResizeRestartFailure, "Failed to restart instance"},
+	}
+
+	for _, test := range stringTests {
+		str := test.r.String()
+		if str != test.expected {
+			t.Errorf("expected \"%s\", got \"%s\"", test.expected, str)
+		}
+	}
+}
@@ -107,9 +107,10 @@ type StorageResource struct {
 	// Bootable indicates that this is a bootable storage device.
 	Bootable bool `yaml:"boot,omitempty"`
 
-	// BootIndex hints to the hypervisor a bootable disk order among
-	// multple storage resources
-	BootIndex int `yaml:"boot_index,omitempty"`
+	// BootIndex gives the position of the resource in the boot order of
+	// the instance, starting at 0.  When any resource has an index only
+	// the indexed resources are booted from.
+	BootIndex *int `yaml:"boot_index,omitempty"`
 
 	// Ephemeral indicates whether this storage should only last as long as
 	// the instance
@@ -236,6 +237,12 @@ type StartCmd struct {
 	// for the new instance.
 	Networking NetworkResources `yaml:"networking"`
 
+	// ExtraNetworking describes the network interfaces of the new
+	// instance in addition to the one described by Networking, each
+	// attached to a tenant subnet.  Only specified when creating CN
+	// instances.
+	ExtraNetworking []NetworkResources `yaml:"extra_networking,omitempty"`
+
 	// Storage contains all the information required to attach or boot
 	// from storage for the new instance.
 	Storage []StorageResource `yaml:"storage,omitempty"`
@@ -243,6 +250,17 @@ type StartCmd struct {
 	// Requirements indicates what resources are needed for this workload
 	Requirements WorkloadRequirements `yaml:"requirements"`
 
+	// PreferredNodes lists the nodes on which the instance should be
+	// started if any of them can satisfy its requirements, e.g., because
+	// they have already cached its image.  Unlike Requirements.NodeID it
+	// is only a preference.
+	PreferredNodes []string `yaml:"preferred_nodes,omitempty"`
+
+	// AvoidNodes lists the nodes on which the instance must not be
+	// started, e.g., because they host other members of its server
+	// group with an anti-affinity policy.
+	AvoidNodes []string `yaml:"avoid_nodes,omitempty"`
+
 	// Restart is set to true if the payload represents a request to
 	// restart an existing instance on a new node.
 	Restart bool
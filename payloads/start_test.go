@@ -53,6 +53,96 @@ func TestStartMarshal(t *testing.T) {
 	}
 }
 
+// make sure the extra network interfaces of a Start survive marshalling in
+// order, and that a Start without any keeps the single networking block.
+func TestStartExtraNetworking(t *testing.T) {
+	var cmd Start
+	cmd.Start.InstanceUUID = testutil.InstanceUUID
+	cmd.Start.Networking = NetworkResources{VnicUUID: "frontend", PrivateIP: "172.16.0.2"}
+	cmd.Start.ExtraNetworking = []NetworkResources{
+		{VnicUUID: "backend", PrivateIP: "172.16.1.2", Subnet: "172.16.1.0/24"},
+		{VnicUUID: "storage", PrivateIP: "172.16.2.2", Subnet: "172.16.2.0/24"},
+	}
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cmd2 Start
+	err = yaml.Unmarshal(y, &cmd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd2.Start.Networking != cmd.Start.Networking {
+		t.Errorf("Primary networking not preserved: %+v", cmd2.Start.Networking)
+	}
+
+	if len(cmd2.Start.ExtraNetworking) != len(cmd.Start.ExtraNetworking) {
+		t.Fatalf("Expected %d extra interfaces, got %d",
+			len(cmd.Start.ExtraNetworking), len(cmd2.Start.ExtraNetworking))
+	}
+
+	for i, n := range cmd.Start.ExtraNetworking {
+		if cmd2.Start.ExtraNetworking[i] != n {
+			t.Errorf("Extra interface %d not preserved: %+v", i, cmd2.Start.ExtraNetworking[i])
+		}
+	}
+
+	var single Start
+	err = yaml.Unmarshal([]byte(testutil.StartYaml), &single)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if single.Start.ExtraNetworking != nil {
+		t.Errorf("Unexpected extra interfaces: %+v", single.Start.ExtraNetworking)
+	}
+}
+
+// make sure the storage of a Start survives marshalling in order and with
+// its boot indexes, and that storage without an index stays unindexed.
+func TestStartStorageBootOrder(t *testing.T) {
+	first := 0
+	second := 1
+
+	var cmd Start
+	cmd.Start.InstanceUUID = testutil.InstanceUUID
+	cmd.Start.Storage = []StorageResource{
+		{ID: "data", Bootable: false},
+		{ID: "fallback", Bootable: true, BootIndex: &second},
+		{ID: "root", Bootable: true, BootIndex: &first},
+	}
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cmd2 Start
+	err = yaml.Unmarshal(y, &cmd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := cmd2.Start.Storage
+	if len(storage) != len(cmd.Start.Storage) {
+		t.Fatalf("Expected %d storage resources got %d", len(cmd.Start.Storage), len(storage))
+	}
+
+	for i, s := range cmd.Start.Storage {
+		if storage[i].ID != s.ID || storage[i].Bootable != s.Bootable {
+			t.Errorf("Storage resource %d is %+v, expected %+v", i, storage[i], s)
+		}
+
+		if (s.BootIndex == nil) != (storage[i].BootIndex == nil) ||
+			(s.BootIndex != nil && *s.BootIndex != *storage[i].BootIndex) {
+			t.Errorf("Boot index of %s not preserved", s.ID)
+		}
+	}
+}
+
 // make sure the yaml can be unmarshaled into the Start struct with
 // optional data not present
 func TestStartUnmarshalPartial(t *testing.T) {
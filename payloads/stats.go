@@ -52,6 +52,48 @@ type InstanceStat struct {
 
 	// List of volumes attached to the instance.
 	Volumes []string `yaml:"volumes"`
+
+	// Devices through which the volumes attached to the instance can be
+	// found from inside the instance.
+	VolumeDevices []VolumeDevice `yaml:"volume_devices,omitempty"`
+
+	// Caveats with which the instance is running.  A warning which is
+	// no longer reported has been resolved.
+	Warnings []InstanceWarning `yaml:"warnings,omitempty"`
+}
+
+// VolumeDevice describes how a volume appears inside an instance.
+type VolumeDevice struct {
+	// VolumeUUID is the UUID of the volume.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// Device is the path of the volume inside the instance, e.g.,
+	// /dev/disk/by-id/virtio-data.  It is empty if the volume has no
+	// stable name until the instance is restarted.
+	Device string `yaml:"device,omitempty"`
+}
+
+// InstanceWarningType identifies a caveat with which an instance was started.
+type InstanceWarningType string
+
+const (
+	// SoftwareVirtualization indicates that hardware virtualization was
+	// unavailable and the instance is running under software emulation.
+	SoftwareVirtualization InstanceWarningType = "software_virtualization"
+
+	// DiskSpaceLow indicates that the disk holding the instance is
+	// nearly full.
+	DiskSpaceLow InstanceWarningType = "disk_space_low"
+
+	// NoHugepages indicates that hugepages were requested but were
+	// unavailable so regular pages were used.
+	NoHugepages InstanceWarningType = "no_hugepages"
+)
+
+// InstanceWarning describes a caveat with which an instance is running.
+type InstanceWarning struct {
+	Type    InstanceWarningType `yaml:"type"`
+	Message string              `yaml:"message"`
 }
 
 // NetworkStat contains information about a single network interface present on
@@ -102,6 +144,15 @@ type Stat struct {
 	// Array containing statistics information for each instance hosted by
 	// the CN/NN
 	Instances []InstanceStat
+
+	// The time, in nanoseconds since the Unix epoch and according to the
+	// clock of the CN/NN, at which the stats were sent.  Zero if the
+	// CN/NN does not report it.
+	Timestamp int64 `yaml:"timestamp,omitempty"`
+
+	// Labels are the labels with which the CN/NN was configured.  They
+	// are used to select groups of nodes, e.g., to cache an image on.
+	Labels []string `yaml:"labels,omitempty"`
 }
 
 const (
@@ -152,6 +203,25 @@ const (
 	// Missing indicates that the node this instance is running on is not
 	// active
 	Missing = "missing"
+
+	// Unreachable indicates that the node this instance is running on
+	// has stopped reporting and has been declared down
+	Unreachable = "unreachable"
+
+	// Queued indicates that the controller is holding back the launch of
+	// an instance because its tenant already has as many launches in
+	// progress as it is allowed.
+	Queued = "queued"
+
+	// Migrating indicates that an instance is being live migrated to
+	// another node.  Nodes receiving an instance report it in this state
+	// until the transfer completes.
+	Migrating = "migrating"
+
+	// DeletePending indicates that an instance has been deleted by its
+	// tenant but is kept, and may be restored, until its tenant's grace
+	// period for deletions expires.
+	DeletePending = "deleted-pending"
 )
 
 // Init initialises instances of the Stat structure.
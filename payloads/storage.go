@@ -30,6 +30,11 @@ type VolumeCmd struct {
 	// running.  This information is needed by the scheduler to route
 	// the command to the correct CN/NN.
 	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// Tag optionally identifies the volume inside the instance.  When
+	// present it is used instead of the volume UUID as the serial number
+	// of the disk.  Only used when attaching volumes.
+	Tag string `yaml:"tag,omitempty"`
 }
 
 // AttachVolume represents the unmarshalled version of the contents of a SSNTP
@@ -38,3 +43,37 @@ type VolumeCmd struct {
 type AttachVolume struct {
 	Attach VolumeCmd `yaml:"attach_volume"`
 }
+
+// DetachVolume represents the unmarshalled version of the contents of a SSNTP
+// DetachVolume payload.  The structure contains enough information to detach a
+// volume from an existing instance.
+type DetachVolume struct {
+	Detach VolumeCmd `yaml:"detach_volume"`
+}
+
+// VolumeEvent identifies a volume which has been attached to or detached
+// from an instance.
+type VolumeEvent struct {
+	// NodeUUID is the UUID of the node running the instance.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// InstanceUUID is the UUID of the instance.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VolumeUUID is the UUID of the volume.
+	VolumeUUID string `yaml:"volume_uuid"`
+}
+
+// EventVolumeAttached represents the unmarshalled version of the contents
+// of an SSNTP ssntp.VolumeAttached event.  This event is sent by
+// ciao-launcher in reply to an ssntp.AttachVolume command.
+type EventVolumeAttached struct {
+	Attached VolumeEvent `yaml:"volume_attached"`
+}
+
+// EventVolumeDetached represents the unmarshalled version of the contents
+// of an SSNTP ssntp.VolumeDetached event.  This event is sent by
+// ciao-launcher in reply to an ssntp.DetachVolume command.
+type EventVolumeDetached struct {
+	Detached VolumeEvent `yaml:"volume_detached"`
+}
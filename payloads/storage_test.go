@@ -60,3 +60,69 @@ func TestAttachVolmeMarshal(t *testing.T) {
 			string(y), testutil.AttachVolumeYaml)
 	}
 }
+
+func TestAttachVolumeTagMarshal(t *testing.T) {
+	var attach AttachVolume
+	attach.Attach.InstanceUUID = testutil.InstanceUUID
+	attach.Attach.VolumeUUID = testutil.VolumeUUID
+	attach.Attach.WorkloadAgentUUID = testutil.AgentUUID
+	attach.Attach.Tag = "data"
+
+	y, err := yaml.Marshal(&attach)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.AttachVolumeTagYaml {
+		t.Errorf("AttachVolume marshalling failed\n[%s]\n vs\n[%s]",
+			string(y), testutil.AttachVolumeTagYaml)
+	}
+}
+
+func TestDetachVolumeUnmarshal(t *testing.T) {
+	var detach DetachVolume
+	err := yaml.Unmarshal([]byte(testutil.DetachVolumeYaml), &detach)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if detach.Detach.InstanceUUID != testutil.InstanceUUID {
+		t.Errorf("Wrong instance UUID field [%s]", detach.Detach.InstanceUUID)
+	}
+
+	if detach.Detach.VolumeUUID != testutil.VolumeUUID {
+		t.Errorf("Wrong Volume UUID field [%s]", detach.Detach.VolumeUUID)
+	}
+
+	if detach.Detach.WorkloadAgentUUID != testutil.AgentUUID {
+		t.Errorf("Wrong WorkloadAgentUUID field [%s]", detach.Detach.WorkloadAgentUUID)
+	}
+}
+
+func TestVolumeEventsMarshal(t *testing.T) {
+	e := VolumeEvent{
+		NodeUUID:     testutil.AgentUUID,
+		InstanceUUID: testutil.InstanceUUID,
+		VolumeUUID:   testutil.VolumeUUID,
+	}
+
+	y, err := yaml.Marshal(&EventVolumeAttached{Attached: e})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.VolumeAttachedYaml {
+		t.Errorf("VolumeAttached marshalling failed\n[%s]\n vs\n[%s]",
+			string(y), testutil.VolumeAttachedYaml)
+	}
+
+	y, err = yaml.Marshal(&EventVolumeDetached{Detached: e})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.VolumeDetachedYaml {
+		t.Errorf("VolumeDetached marshalling failed\n[%s]\n vs\n[%s]",
+			string(y), testutil.VolumeDetachedYaml)
+	}
+}
@@ -29,6 +29,22 @@ const PrivKey key = 0
 // tenant id which is being used in the API call
 const TenantIDKey key = 1
 
+// RequestIDKey is the index of the context map which holds the unique
+// identifier assigned to an API request.
+const RequestIDKey key = 2
+
+// ActorKey is the index of the context map which holds the identity of
+// the user making an API request.
+const ActorKey key = 3
+
+// OnBehalfOfKey is the index of the context map which holds the tenant an
+// admin is impersonating.
+const OnBehalfOfKey key = 4
+
+// TenantsKey is the index of the context map which holds the tenants the
+// credentials of an API request grant access to.
+const TenantsKey key = 5
+
 // GetPrivilege returns the value of PrivKey
 func GetPrivilege(ctx context.Context) bool {
 	privilege, ok := ctx.Value(PrivKey).(bool)
@@ -53,3 +69,50 @@ func GetTenantID(ctx context.Context) (string, error) {
 func SetTenantID(ctx context.Context, tenantID string) context.Context {
 	return context.WithValue(ctx, TenantIDKey, tenantID)
 }
+
+// GetRequestID returns the value of RequestIDKey or an empty string if
+// no request ID has been assigned.
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(RequestIDKey).(string)
+	return requestID
+}
+
+// SetRequestID sets the value of RequestIDKey
+func SetRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, requestID)
+}
+
+// GetActor returns the value of ActorKey or an empty string if the user
+// is not known.
+func GetActor(ctx context.Context) string {
+	actor, _ := ctx.Value(ActorKey).(string)
+	return actor
+}
+
+// SetActor sets the value of ActorKey
+func SetActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, ActorKey, actor)
+}
+
+// GetOnBehalfOf returns the value of OnBehalfOfKey or an empty string if
+// the request is not made on behalf of another tenant.
+func GetOnBehalfOf(ctx context.Context) string {
+	tenantID, _ := ctx.Value(OnBehalfOfKey).(string)
+	return tenantID
+}
+
+// SetOnBehalfOf sets the value of OnBehalfOfKey
+func SetOnBehalfOf(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, OnBehalfOfKey, tenantID)
+}
+
+// GetTenants returns the value of TenantsKey.
+func GetTenants(ctx context.Context) []string {
+	tenants, _ := ctx.Value(TenantsKey).([]string)
+	return tenants
+}
+
+// SetTenants sets the value of TenantsKey
+func SetTenants(ctx context.Context, tenants []string) context.Context {
+	return context.WithValue(ctx, TenantsKey, tenants)
+}
@@ -83,6 +83,10 @@ type Client struct {
 
 	trace *TraceConfig
 
+	capabilities      Capability
+	keepaliveInterval time.Duration
+	keepaliveMisses   int
+
 	configuration clusterConfiguration
 }
 
@@ -126,10 +130,15 @@ func (client *Client) handleSSNTPServer() {
 				client.status.Unlock()
 
 				client.log.Errorf("Read error: %s\n", err)
+				client.session.stopKeepalive()
 				client.ntf.DisconnectNotify()
 				break
 			}
 
+			if client.session.handleKeepalive(&frame) {
+				continue
+			}
+
 			client.status.Lock()
 			if client.status.status == ssntpClosed {
 				client.status.Unlock()
@@ -185,6 +194,7 @@ func (client *Client) sendConnect() (bool, error) {
 	}
 
 	client.session.setDest(connected.Source[:16])
+	client.session.setPeerCapabilities(connected.Capabilities)
 
 	oidFound, err := verifyRole(client.session.conn, connected.Role)
 	if oidFound == false {
@@ -195,6 +205,7 @@ func (client *Client) sendConnect() (bool, error) {
 
 	client.status.Lock()
 	client.status.status = ssntpConnected
+	client.session.startKeepalive(client.keepaliveInterval, client.keepaliveMisses, client.log)
 	client.status.Unlock()
 
 	client.configuration.setConfiguration(connected.Payload)
@@ -235,6 +246,7 @@ func (client *Client) attemptDial() error {
 				if err == nil {
 					client.log.Infof("Connected\n")
 					session := newSession(&client.uuid, client.role, 0, conn)
+					session.capabilities = client.capabilities
 					client.session = session
 
 					break URILoop
@@ -329,6 +341,9 @@ func (client *Client) Dial(config *Config, ntf ClientNotifier) error {
 	client.uris = config.ConfigURIs(client.uris, client.port)
 
 	client.trace = config.Trace
+	client.capabilities = config.capabilities()
+	client.keepaliveInterval = config.KeepaliveInterval
+	client.keepaliveMisses = config.keepaliveMisses()
 	client.ntf = ntf
 	client.tls = prepareTLSConfig(config, false)
 
@@ -354,6 +369,7 @@ func (client *Client) Close() {
 	}
 
 	if client.session != nil {
+		client.session.stopKeepalive()
 		client.session.conn.Close()
 	}
 	client.status.status = ssntpClosed
@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ignitionConfig builds an ignition file of roughly size bytes, made of
+// systemd units and of files embedded as base64 data URLs, as found in the
+// cloud-init configurations of container host instances.
+func ignitionConfig(size int) string {
+	var buf bytes.Buffer
+
+	buf.WriteString(`{"ignition":{"version":"2.1.0"},"systemd":{"units":[`)
+	for i := 0; buf.Len() < size/2; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"name":"service-%d.service","enabled":true,"contents":`+
+			`"[Unit]\nDescription=Service %d\nAfter=network-online.target\n`+
+			`Requires=network-online.target\n\n[Service]\nType=simple\n`+
+			`ExecStartPre=/usr/bin/mkdir -p /var/lib/service-%d\n`+
+			`ExecStart=/usr/bin/service-%d --config /etc/service-%d.conf --port %d\n`+
+			`Restart=on-failure\nRestartSec=%ds\n\n[Install]\nWantedBy=multi-user.target\n"}`,
+			i, i, i, i, i, 8000+i, i%30)
+	}
+
+	buf.WriteString(`]},"storage":{"files":[`)
+	for i := 0; buf.Len() < size; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		conf := fmt.Sprintf("# service %d configuration\nlisten: 0.0.0.0:%d\n"+
+			"log_level: info\ndata_dir: /var/lib/service-%d\npeers:\n", i, 8000+i, i)
+		for p := 0; p < 8; p++ {
+			conf += fmt.Sprintf("  - 10.%d.%d.%d:%d\n", i%256, p, (i*p)%256, 8000+p)
+		}
+		fmt.Fprintf(&buf, `{"filesystem":"root","path":"/etc/service-%d.conf","mode":420,`+
+			`"contents":{"source":"data:;base64,%s"}}`,
+			i, base64.StdEncoding.EncodeToString([]byte(conf)))
+	}
+	buf.WriteString(`]}}`)
+
+	return buf.String()
+}
+
+// startPayload builds a START payload the way the controller does, with
+// the cloud-init configuration and meta data following the start command.
+func startPayload(t testing.TB, cloudInitSize int) []byte {
+	start := payloads.Start{
+		Start: payloads.StartCmd{
+			TenantUUID:          uuid.Generate().String(),
+			InstanceUUID:        uuid.Generate().String(),
+			FWType:              payloads.EFI,
+			InstancePersistence: payloads.Host,
+			VMType:              payloads.QEMU,
+			Networking: payloads.NetworkResources{
+				VnicMAC:          "02:00:e6:f5:af:f9",
+				VnicUUID:         uuid.Generate().String(),
+				ConcentratorUUID: uuid.Generate().String(),
+				ConcentratorIP:   "192.168.42.21",
+				Subnet:           "192.168.8.0/21",
+				SubnetKey:        "8",
+				SubnetUUID:       uuid.Generate().String(),
+				PrivateIP:        "192.168.8.2",
+			},
+			Requirements: payloads.WorkloadRequirements{
+				VCPUs: 2,
+				MemMB: 2048,
+			},
+		},
+	}
+
+	y, err := yaml.Marshal(&start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := fmt.Sprintf(`{"uuid":"%s","hostname":"instance"}`, start.Start.InstanceUUID)
+
+	return []byte("---\n" + string(y) + "...\n" + ignitionConfig(cloudInitSize) + "\n---\n" + meta + "\n...\n")
+}
+
+func gobLength(t testing.TB, f *Frame) int {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Len()
+}
+
+func TestCompressFrame(t *testing.T) {
+	var s session
+
+	payload := startPayload(t, 64*1024)
+	f := s.commandFrame(START, payload, nil)
+
+	compressed := compressFrame(f)
+	if compressed == f || !compressed.Compressed() {
+		t.Fatal("Frame not compressed")
+	}
+
+	if f.Compressed() || !bytes.Equal(f.Payload, payload) {
+		t.Fatal("Original frame modified")
+	}
+
+	if int(compressed.PayloadLength) != len(compressed.Payload) ||
+		len(compressed.Payload) >= len(payload) {
+		t.Fatalf("Unexpected compressed payload length %d for %d bytes",
+			compressed.PayloadLength, len(payload))
+	}
+
+	if compressed.GetMajor() != Major || compressed.Operand != byte(START) {
+		t.Fatalf("Unexpected compressed frame header %s", compressed)
+	}
+
+	err := decompressFrame(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if compressed.Compressed() || !bytes.Equal(compressed.Payload, payload) ||
+		int(compressed.PayloadLength) != len(payload) {
+		t.Fatal("Payload not restored")
+	}
+}
+
+func TestCompressFrameIncompressible(t *testing.T) {
+	var s session
+
+	// random data does not compress, so the frame is sent as it is
+	var buf bytes.Buffer
+	for buf.Len() < 2*compressionThreshold {
+		u := uuid.Generate()
+		buf.Write(u[:])
+	}
+
+	f := s.commandFrame(START, buf.Bytes(), nil)
+	if compressed := compressFrame(f); compressed != f {
+		t.Fatal("Incompressible frame compressed")
+	}
+}
+
+func TestDecompressFrameInvalid(t *testing.T) {
+	var s session
+
+	f := s.commandFrame(START, []byte("not gzip"), nil)
+	f.Major |= payloadCompressed
+
+	if err := decompressFrame(f); err == nil {
+		t.Fatal("Invalid compressed payload accepted")
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write([]byte(strings.Repeat("x", maxPayloadLength+1)))
+	_ = w.Close()
+
+	f = s.commandFrame(START, buf.Bytes(), nil)
+	f.Major |= payloadCompressed
+
+	if err := decompressFrame(f); err == nil {
+		t.Fatal("Oversized compressed payload accepted")
+	}
+}
+
+func benchmarkStartCompression(b *testing.B, cloudInitSize int) {
+	var s session
+
+	payload := startPayload(b, cloudInitSize)
+	f := s.commandFrame(START, payload, nil)
+
+	var compressed *Frame
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed = compressFrame(f)
+	}
+	b.StopTimer()
+
+	plain := gobLength(b, f)
+	packed := gobLength(b, compressed)
+
+	b.ReportMetric(float64(plain), "frame-B")
+	b.ReportMetric(float64(packed), "compressed-frame-B")
+	b.ReportMetric(100*float64(plain-packed)/float64(plain), "%-saved")
+}
+
+func benchmarkStartDecompression(b *testing.B, cloudInitSize int) {
+	var s session
+
+	payload := startPayload(b, cloudInitSize)
+	compressed := compressFrame(s.commandFrame(START, payload, nil))
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := *compressed
+		if err := decompressFrame(&f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStartCompression64kB(b *testing.B) {
+	benchmarkStartCompression(b, 64*1024)
+}
+
+func BenchmarkStartCompression512kB(b *testing.B) {
+	benchmarkStartCompression(b, 512*1024)
+}
+
+func BenchmarkStartDecompression512kB(b *testing.B) {
+	benchmarkStartDecompression(b, 512*1024)
+}
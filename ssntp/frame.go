@@ -80,13 +80,14 @@ type Frame struct {
 
 // ConnectFrame is the SSNTP connection frame structure.
 type ConnectFrame struct {
-	Major       uint8
-	Minor       uint8
-	Type        Type
-	Operand     uint8
-	Role        Role
-	Source      []byte
-	Destination []byte
+	Major        uint8
+	Minor        uint8
+	Type         Type
+	Operand      uint8
+	Role         Role
+	Source       []byte
+	Destination  []byte
+	Capabilities Capability
 }
 
 // ConnectedFrame is the SSNTP connected frame structure.
@@ -100,9 +101,11 @@ type ConnectedFrame struct {
 	Destination   []byte
 	PayloadLength uint32
 	Payload       []byte
+	Capabilities  Capability
 }
 
-const majorMask = 0x7f
+const majorMask = 0x3f
+const payloadCompressed = 1 << 6
 const pathTraceEnabled = 1 << 7
 
 // PathTrace tells if an SSNTP frames contains tracing information or not.
@@ -128,6 +131,13 @@ func (f *Frame) setTrace(trace *TraceConfig) {
 	}
 }
 
+// Compressed tells if the payload of an SSNTP frame is gzip compressed.
+// Frames are decompressed as they are read so SSNTP users never see
+// compressed payloads.
+func (f Frame) Compressed() bool {
+	return (f.Major & payloadCompressed) == payloadCompressed
+}
+
 // GetMajor returns the SSNTP major number for the frame.
 func (f Frame) GetMajor() uint8 {
 	return f.Major & majorMask
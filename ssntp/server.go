@@ -80,6 +80,10 @@ type Server struct {
 
 	trace *TraceConfig
 
+	capabilities      Capability
+	keepaliveInterval time.Duration
+	keepaliveMisses   int
+
 	configuration clusterConfiguration
 }
 
@@ -135,6 +139,8 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 
 	session := newSession(&server.uuid, server.role, connect.Role, conn)
 	session.setDest(connect.Source[:16])
+	session.capabilities = server.capabilities
+	session.setPeerCapabilities(connect.Capabilities)
 
 	/* TODO Get the CONFIGURE payload from the config package */
 	server.configuration.RLock()
@@ -161,6 +167,9 @@ func handleSSNTPClient(server *Server, conn net.Conn) {
 		return
 	}
 
+	session.startKeepalive(server.keepaliveInterval, server.keepaliveMisses, server.log)
+	defer session.stopKeepalive()
+
 	uuidString := session.dest.String()
 	server.addSession(session, uuidString)
 	server.forwardRules.addForwardDestination(session)
@@ -177,6 +186,10 @@ func handleSSNTPClient(server *Server, conn net.Conn) {
 			break
 		}
 
+		if session.handleKeepalive(&frame) {
+			continue
+		}
+
 		switch frame.Type {
 		case COMMAND:
 			if (Command)(frame.Operand) == CONFIGURE && session.destRole.IsController() {
@@ -263,6 +276,9 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 	server.tls = prepareTLSConfig(config, true)
 	server.forwardRules.forwardRules = config.ForwardRules
 	server.trace = config.Trace
+	server.capabilities = config.capabilities()
+	server.keepaliveInterval = config.KeepaliveInterval
+	server.keepaliveMisses = config.keepaliveMisses()
 	server.stoppedChan = make(chan struct{})
 
 	service := fmt.Sprintf("%s:%d", uri, serverPort)
@@ -17,8 +17,15 @@
 package ssntp
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ciao-project/ciao/uuid"
@@ -40,13 +47,88 @@ func clearWriteTimeout(conn net.Conn) {
 	conn.SetWriteDeadline(time.Time{})
 }
 
+// compressionThreshold is the payload size, in bytes, above which frames
+// are compressed for peers supporting the PayloadCompression capability.
+// Smaller payloads are not worth the CPU time.
+const compressionThreshold = 8 * 1024
+
+// maxPayloadLength bounds the size of a decompressed payload so that a
+// peer can not make us allocate an arbitrary amount of memory.
+const maxPayloadLength = 64 * 1024 * 1024
+
+// compressFrame returns a copy of a frame with its payload gzip
+// compressed.  The frame itself is left untouched as forwarded frames are
+// written to several sessions.  The frame is returned as it is if
+// compression does not make it smaller.
+func compressFrame(f *Frame) *Frame {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(f.Payload); err != nil {
+		return f
+	}
+	if err := w.Close(); err != nil {
+		return f
+	}
+
+	if buf.Len() >= len(f.Payload) {
+		return f
+	}
+
+	compressed := *f
+	compressed.Major |= payloadCompressed
+	compressed.Payload = buf.Bytes()
+	compressed.PayloadLength = (uint32)(buf.Len())
+
+	return &compressed
+}
+
+// decompressFrame replaces the compressed payload of a frame with the
+// original one.
+func decompressFrame(f *Frame) error {
+	r, err := gzip.NewReader(bytes.NewReader(f.Payload))
+	if err != nil {
+		return fmt.Errorf("Invalid compressed payload: %v", err)
+	}
+	defer r.Close()
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r, maxPayloadLength+1))
+	if err != nil {
+		return fmt.Errorf("Invalid compressed payload: %v", err)
+	}
+
+	if len(payload) > maxPayloadLength {
+		return fmt.Errorf("Compressed payload exceeds %d bytes", maxPayloadLength)
+	}
+
+	f.Major &^= payloadCompressed
+	f.Payload = payload
+	f.PayloadLength = (uint32)(len(payload))
+
+	return nil
+}
+
 type session struct {
+	// lastRx is the time, in nanoseconds since the epoch, at which the
+	// last frame was received from the peer.  It is accessed atomically
+	// and kept first for alignment.
+	lastRx int64
+
 	src      uuid.UUID
 	dest     uuid.UUID
 	srcRole  Role
 	destRole Role
 	conn     net.Conn
 
+	// capabilities are the ones advertised to the peer and compress
+	// is set once the peer has advertised PayloadCompression too.
+	capabilities Capability
+	compress     bool
+	keepalive    bool
+
+	keepaliveDone chan struct{}
+	keepaliveOnce sync.Once
+
 	encoder *gob.Encoder
 	decoder *gob.Decoder
 }
@@ -75,6 +157,76 @@ func (session *session) setDest(uuid []byte) {
 	copy(session.dest[:], uuid[:16])
 }
 
+func (session *session) setPeerCapabilities(capabilities Capability) {
+	session.compress = session.capabilities&capabilities&PayloadCompression != 0
+	session.keepalive = capabilities&Keepalive != 0
+}
+
+func (session *session) lastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&session.lastRx))
+}
+
+// startKeepalive starts sending PINGs to the peer every interval, if the
+// peer supports them, and closes the connection once nothing has been
+// received from the peer for misses intervals.  The connection read loop
+// then fails and goes through its usual disconnection path.
+func (session *session) startKeepalive(interval time.Duration, misses int, log Logger) {
+	if interval <= 0 || !session.keepalive {
+		return
+	}
+
+	atomic.StoreInt64(&session.lastRx, time.Now().UnixNano())
+	session.keepaliveDone = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		timeout := time.Duration(misses) * interval
+		for {
+			select {
+			case <-ticker.C:
+			case <-session.keepaliveDone:
+				return
+			}
+
+			if silence := time.Since(session.lastReceived()); silence > timeout {
+				log.Errorf("Nothing received from %s for %v, disconnecting\n", session.dest, silence)
+				session.conn.Close()
+				return
+			}
+
+			if _, err := session.Write(session.commandFrame(PING, nil, nil)); err != nil {
+				log.Infof("PING to %s failed: %s\n", session.dest, err)
+			}
+		}
+	}()
+}
+
+func (session *session) stopKeepalive() {
+	if session.keepaliveDone == nil {
+		return
+	}
+
+	session.keepaliveOnce.Do(func() {
+		close(session.keepaliveDone)
+	})
+}
+
+// handleKeepalive answers PING commands and swallows PONG statuses, which
+// are never notified.  It returns true if the frame was a keepalive.
+func (session *session) handleKeepalive(frame *Frame) bool {
+	switch {
+	case frame.Type == COMMAND && (Command)(frame.Operand) == PING:
+		session.Write(session.statusFrame(PONG, nil, nil))
+		return true
+	case frame.Type == STATUS && (Status)(frame.Operand) == PONG:
+		return true
+	}
+
+	return false
+}
+
 func (session *session) connectedFrame(serverRole Role, payload []byte) (f *ConnectedFrame) {
 	f = &ConnectedFrame{
 		Major:         Major,
@@ -86,6 +238,7 @@ func (session *session) connectedFrame(serverRole Role, payload []byte) (f *Conn
 		Destination:   session.dest[:],
 		PayloadLength: (uint32)(len(payload)),
 		Payload:       payload,
+		Capabilities:  session.capabilities,
 	}
 
 	return
@@ -93,13 +246,14 @@ func (session *session) connectedFrame(serverRole Role, payload []byte) (f *Conn
 
 func (session *session) connectFrame() (f *ConnectFrame) {
 	f = &ConnectFrame{
-		Major:       Major,
-		Minor:       minor,
-		Type:        COMMAND,
-		Operand:     byte(CONNECT),
-		Role:        session.srcRole,
-		Source:      session.src[:],
-		Destination: session.dest[:],
+		Major:        Major,
+		Minor:        minor,
+		Type:         COMMAND,
+		Operand:      byte(CONNECT),
+		Role:         session.srcRole,
+		Source:       session.src[:],
+		Destination:  session.dest[:],
+		Capabilities: session.capabilities,
 	}
 
 	return
@@ -183,6 +337,10 @@ func (session *session) Write(frame interface{}) (int, error) {
 		f.Trace.Path[f.Trace.PathLength-1].TxTimestamp = time.Now()
 	}
 
+	if f, ok := frame.(*Frame); ok && session.compress && len(f.Payload) > compressionThreshold {
+		frame = compressFrame(f)
+	}
+
 	setWriteTimeout(session.conn)
 	err := session.encoder.Encode(frame)
 	clearWriteTimeout(session.conn)
@@ -192,9 +350,20 @@ func (session *session) Write(frame interface{}) (int, error) {
 
 func (session *session) Read(frame interface{}) error {
 	err := session.decoder.Decode(frame)
+	if err != nil {
+		return err
+	}
 
 	switch f := frame.(type) {
 	case *Frame:
+		atomic.StoreInt64(&session.lastRx, time.Now().UnixNano())
+
+		if f.Compressed() {
+			if err := decompressFrame(f); err != nil {
+				return err
+			}
+		}
+
 		if f.PathTrace() == false {
 			break
 		}
@@ -209,6 +378,6 @@ func (session *session) Read(frame interface{}) error {
 		f.Trace.PathLength++
 	}
 
-	return err
+	return nil
 
 }
@@ -31,6 +31,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ciao-project/ciao/uuid"
 	"github.com/golang/glog"
@@ -42,11 +43,13 @@ type Type uint8
 
 // Command is the SSNTP Command operand.
 // It can be CONNECT, START, STOP, STATS, EVACUATE, DELETE, RESTART,
-// AssignPublicIP, ReleasePublicIP, CONFIGURE, AttachVolume or RefreshCNCI.
+// AssignPublicIP, ReleasePublicIP, CONFIGURE, AttachVolume, RefreshCNCI,
+// InstanceInventory, PrefetchImage, PrepareMigration, MigrateInstance,
+// AbortMigration, ConsoleLog, ResizeInstance, DetachVolume or PING.
 type Command uint8
 
 // Status is the SSNTP Status operand.
-// It can be CONNECTED, READY, FULL, OFFLINE or MAINTENANCE
+// It can be CONNECTED, READY, FULL, OFFLINE, MAINTENANCE or PONG
 type Status uint8
 
 // Role describes the SSNTP role for the frame sender.
@@ -54,14 +57,19 @@ type Status uint8
 type Role uint32
 
 // Error is the SSNTP Error operand. It can be InvalidFrameType Error,
-// StartFailure, ConnectionFailure, DeleteFailure, ConnectionAborted or
-// InvalidConfiguration.
+// StartFailure, ConnectionFailure, DeleteFailure, ConnectionAborted,
+// InvalidConfiguration, AttachVolumeFailure, AssignPublicIPFailure,
+// UnassignPublicIPFailure, MigrationFailure, ResizeFailure or
+// DetachVolumeFailure.
 type Error uint8
 
 // Event is the SSNTP Event operand.
 // It can be TenantAdded, TenantRemoval, InstanceDeleted, InstanceStopped,
 // ConcentratorInstanceAdded, PublicIPAssigned, PublicIPUnassigned, TraceReport,
-// NodeConnected or NodeDisconnected
+// NodeConnected, NodeDisconnected, InstanceInventoryReport,
+// ImagePrefetchReport, MigrationPrepared, InstanceMigrated,
+// ConsoleLogReport, InstanceResized, NodeMaintenance, VolumeAttached or
+// VolumeDetached.
 type Event uint8
 
 const (
@@ -233,6 +241,132 @@ const (
 	// tunnel information.
 	// The payload for this command contains the UIID of the CNCI to refresh.
 	RefreshCNCI
+
+	// InstanceInventory is sent by the Controller to ask a specific CIAO
+	// agent to report all of the instances it is currently managing.  The
+	// agent replies with an InstanceInventoryReport event.
+	// The payload for this command contains the UUID of the agent.
+	//
+	//                                       SSNTP InstanceInventory Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xb)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	InstanceInventory
+
+	// PrefetchImage is sent by the Controller to ask a specific CIAO
+	// agent to copy an image into its local image cache ahead of the
+	// first launch from that image.  The agent replies with an
+	// ImagePrefetchReport event once the image is cached or the copy
+	// has failed.
+	// The payload for this command contains the UUID of the agent and
+	// the UUID of the image.
+	//
+	//                                       SSNTP PrefetchImage Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xc)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	PrefetchImage
+
+	// PrepareMigration is sent by the Controller to the CIAO agent to
+	// which a running instance is to be live migrated.  The agent gets
+	// ready to receive the instance, attaching its volumes, and replies
+	// with a MigrationPrepared event, or with a MigrationFailure error if
+	// it cannot receive the instance.
+	// The payload for this command contains the UUIDs of both agents and
+	// of the instance, and the resources of the instance.
+	//
+	//                                       SSNTP PrepareMigration Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xd)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	PrepareMigration
+
+	// MigrateInstance is sent by the Controller to the CIAO agent running
+	// an instance once the agent to which the instance is migrated is
+	// ready to receive it.  The agent transfers the instance and replies
+	// with an InstanceMigrated event, or with a MigrationFailure error if
+	// the transfer fails, in which case the instance keeps running on it.
+	// The payload for this command contains the UUIDs of both agents and
+	// of the instance, and the address at which the instance is received.
+	//
+	//                                       SSNTP MigrateInstance Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xe)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	MigrateInstance
+
+	// AbortMigration is sent by the Controller to the CIAO agent which
+	// was prepared to receive an instance when the migration of the
+	// instance has failed.  The agent discards whatever it prepared for
+	// the instance without reporting the instance as deleted.
+	// The payload for this command contains the UUIDs of the agent and of
+	// the instance.
+	//
+	//                                       SSNTP AbortMigration Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xf)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	AbortMigration
+
+	// ConsoleLog is sent by the Controller to the CIAO agent running an
+	// instance to retrieve the last lines written by the instance to its
+	// serial console.  The agent replies with a ConsoleLogReport event.
+	// The payload for this command contains the UUIDs of the agent and of
+	// the instance, and the maximum number of lines to return.
+	//
+	//                                       SSNTP ConsoleLog Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0x10) |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	ConsoleLog
+
+	// ResizeInstance is sent by the Controller to the CIAO agent running
+	// an instance to restart it with new resource requirements.  The
+	// agent replies with an InstanceResized event, or with a
+	// ResizeFailure error if the instance could not be restarted with
+	// its new requirements.
+	// The payload for this command contains the UUIDs of the agent and of
+	// the instance, and the number of VCPUs and the memory the instance
+	// is restarted with.
+	//
+	//                                       SSNTP ResizeInstance Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0x11) |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	ResizeInstance
+
+	// DetachVolume is sent by the Controller to the CIAO agent running an
+	// instance to detach a storage volume from it.  The agent replies
+	// with a VolumeDetached event, or with a DetachVolumeFailure error if
+	// the volume could not be detached.
+	// The payload for this command contains the UUIDs of the agent, of the
+	// instance and of the volume.
+	//
+	//                                       SSNTP DetachVolume Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0x12) |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	DetachVolume
+
+	// PING is sent periodically by SSNTP clients and servers configured
+	// with a keepalive interval to the peers which advertised the
+	// Keepalive capability.  The peer replies with a PONG status.  PING
+	// frames are handled by the SSNTP package and are never notified.
+	//
+	//                                       SSNTP PING Command frame
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x0) |  (0x13) |       (0x0)     |
+	//	+---------------------------------------------------+
+	PING
 )
 
 const (
@@ -297,6 +431,17 @@ const (
 	//	|       |       | (0x1) |  (0x4)  |       (0x0)     |
 	//	+---------------------------------------------------+
 	MAINTENANCE
+
+	// PONG is the reply to a PING command.  PONG frames are handled by
+	// the SSNTP package and are never notified.
+	//
+	//					 SSNTP PONG Status frame
+	//
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x1) |  (0x5)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	PONG
 )
 
 const (
@@ -447,6 +592,119 @@ const (
 	//	|       |       | (0x3) |  (0x2)  |                 | instance information  |
 	//	+---------------------------------------------------------------------------+
 	InstanceStopped
+
+	// InstanceInventoryReport is sent by workload agents in reply to an
+	// InstanceInventory command.  The payload contains the node UUID
+	// and the UUID and state of every instance present on the node.
+	//
+	//					 SSNTP InstanceInventoryReport Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xa)  |                 | instance inventory    |
+	//	+---------------------------------------------------------------------------+
+	InstanceInventoryReport
+
+	// ImagePrefetchReport is sent by workload agents in reply to a
+	// PrefetchImage command.  The payload contains the node UUID, the
+	// image UUID and, if the image could not be cached, the reason why.
+	//
+	//					 SSNTP ImagePrefetchReport Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xb)  |                 | prefetch result       |
+	//	+---------------------------------------------------------------------------+
+	ImagePrefetchReport
+
+	// MigrationPrepared is sent by workload agents in reply to a
+	// PrepareMigration command once they are ready to receive an
+	// instance.  The payload contains the node UUID, the instance UUID
+	// and the address at which the instance is received.
+	//
+	//					 SSNTP MigrationPrepared Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xc)  |                 | migration target      |
+	//	+---------------------------------------------------------------------------+
+	MigrationPrepared
+
+	// InstanceMigrated is sent by workload agents in reply to a
+	// MigrateInstance command once an instance has been transferred to
+	// the agent to which it was migrated.  The payload contains the UUIDs
+	// of both nodes and of the instance.
+	//
+	//					 SSNTP InstanceMigrated Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xd)  |                 | migrated instance     |
+	//	+---------------------------------------------------------------------------+
+	InstanceMigrated
+
+	// ConsoleLogReport is sent by workload agents in reply to a
+	// ConsoleLog command.  The payload contains the node UUID, the
+	// instance UUID, the last lines of the serial console of the instance
+	// and, if the console log could not be read, the reason why.
+	//
+	//					 SSNTP ConsoleLogReport Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xe)  |                 | console log           |
+	//	+---------------------------------------------------------------------------+
+	ConsoleLogReport
+
+	// InstanceResized is sent by workload agents once they have
+	// restarted an instance with the requirements of a ResizeInstance
+	// command.  The payload contains the node UUID, the instance UUID
+	// and the requirements the instance is now running with.
+	//
+	//					 SSNTP InstanceResized Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0xf)  |                 | resized instance      |
+	//	+---------------------------------------------------------------------------+
+	InstanceResized
+
+	// NodeMaintenance is sent by the Controller to the Scheduler when a
+	// node is put into or taken out of maintenance.  The Scheduler does
+	// not start new instances on nodes in maintenance.  The payload
+	// contains the node UUID and whether it is in maintenance.
+	//
+	//					 SSNTP NodeMaintenance Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0x10) |                 | node maintenance      |
+	//	+---------------------------------------------------------------------------+
+	NodeMaintenance
+
+	// VolumeAttached is sent by workload agents once they have attached
+	// the volume of an AttachVolume command to an instance.  The payload
+	// contains the node UUID, the instance UUID and the volume UUID.
+	//
+	//					 SSNTP VolumeAttached Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0x11) |                 | attached volume       |
+	//	+---------------------------------------------------------------------------+
+	VolumeAttached
+
+	// VolumeDetached is sent by workload agents once they have detached
+	// the volume of a DetachVolume command from an instance.  The payload
+	// contains the node UUID, the instance UUID and the volume UUID.
+	//
+	//					 SSNTP VolumeDetached Event frame
+	//
+	//	+---------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted        |
+	//	|       |       | (0x3) |  (0x12) |                 | detached volume       |
+	//	+---------------------------------------------------------------------------+
+	VolumeDetached
 )
 
 // SSNTP clients and servers can have one or several roles and are expected to declare their
@@ -471,6 +729,22 @@ const (
 	CNCIAGENT = 0x20
 )
 
+// Capability is a set of optional SSNTP protocol features.  SSNTP clients
+// and servers advertise the ones they support in their CONNECT and
+// CONNECTED frames, and a feature is only used on a connection when both
+// ends support it.  Peers predating capabilities advertise none.
+type Capability uint32
+
+const (
+	// PayloadCompression means the peer can read frames whose payload
+	// has been gzip compressed.
+	PayloadCompression Capability = 1 << iota
+
+	// Keepalive means the peer replies to PING commands with a PONG
+	// status.
+	Keepalive
+)
+
 // We use SSL extended key usage attributes for specifying and verifying SSNTP
 // client and server claimed roles.
 // For example if a client claims to be a Controller, then its client certificate
@@ -532,6 +806,18 @@ const (
 	// UnassignPublicIPFailure is sent by the CNCI when a an external IP
 	// cannot be unassigned.
 	UnassignPublicIPFailure
+
+	// MigrationFailure is sent by launcher agents to report that they
+	// could not prepare for, or carry out, the migration of an instance.
+	MigrationFailure
+
+	// ResizeFailure is sent by launcher agents to report that they could
+	// not restart an instance with new resource requirements.
+	ResizeFailure
+
+	// DetachVolumeFailure is sent by launcher agents to report a failure
+	// to detach a volume from an instance.
+	DetachVolumeFailure
 )
 
 // Major is the SSNTP protocol major version
@@ -541,6 +827,7 @@ const defaultURL = "localhost"
 const port = 8888
 const readTimeout = 30
 const writeTimeout = 30
+const defaultKeepaliveMisses = 3
 
 // UUIDPrefix is the default storage path for persistent UUIDs
 const UUIDPrefix = "/var/lib/ciao/local/uuid-storage/role"
@@ -585,6 +872,24 @@ func (command Command) String() string {
 		return "Restore"
 	case RefreshCNCI:
 		return "Refresh CNCI List"
+	case InstanceInventory:
+		return "Instance Inventory"
+	case PrefetchImage:
+		return "Prefetch Image"
+	case PrepareMigration:
+		return "Prepare Migration"
+	case MigrateInstance:
+		return "Migrate Instance"
+	case AbortMigration:
+		return "Abort Migration"
+	case ConsoleLog:
+		return "Console Log"
+	case ResizeInstance:
+		return "Resize Instance"
+	case DetachVolume:
+		return "Detach storage volume"
+	case PING:
+		return "PING"
 	}
 
 	return ""
@@ -602,6 +907,8 @@ func (status Status) String() string {
 		return "OFFLINE"
 	case MAINTENANCE:
 		return "MAINTENANCE"
+	case PONG:
+		return "PONG"
 	}
 
 	return ""
@@ -629,6 +936,24 @@ func (status Event) String() string {
 		return "Node Connected"
 	case NodeDisconnected:
 		return "Node Disconnected"
+	case InstanceInventoryReport:
+		return "Instance Inventory Report"
+	case ImagePrefetchReport:
+		return "Image Prefetch Report"
+	case MigrationPrepared:
+		return "Migration Prepared"
+	case InstanceMigrated:
+		return "Instance Migrated"
+	case ConsoleLogReport:
+		return "Console Log Report"
+	case InstanceResized:
+		return "Instance Resized"
+	case NodeMaintenance:
+		return "Node Maintenance"
+	case VolumeAttached:
+		return "Volume Attached"
+	case VolumeDetached:
+		return "Volume Detached"
 	}
 
 	return ""
@@ -648,6 +973,12 @@ func (error Error) String() string {
 		return "SSNTP Connection aborted"
 	case InvalidConfiguration:
 		return "Cluster configuration is invalid"
+	case MigrationFailure:
+		return "Could not migrate instance"
+	case ResizeFailure:
+		return "Could not resize instance"
+	case DetachVolumeFailure:
+		return "Could not detach volume"
 	}
 
 	return ""
@@ -866,6 +1197,21 @@ type Config struct {
 	// used by the underlying TLS session.  If Rand is nil, the default
 	// random number generator for the TLS package will be used.
 	Rand io.Reader
+
+	// DisableCompression stops the client or server from advertising
+	// the PayloadCompression capability, so that the frames it sends and
+	// receives are never compressed.
+	DisableCompression bool
+	// KeepaliveInterval is how often a PING is sent to the peers which
+	// support keepalives.  A peer from which no frame has been received
+	// for KeepaliveMisses intervals is disconnected, servers notifying
+	// its disconnection and clients reconnecting.  Keepalives are not
+	// sent when KeepaliveInterval is zero.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveMisses is the number of keepalive intervals a peer may
+	// stay silent before being disconnected.  The default is 3.
+	KeepaliveMisses int
 }
 
 // Logger is an interface for SSNTP users to define their own
@@ -1145,6 +1491,22 @@ func (config *Config) configUUID(role Role) (lockedUUID, uuid.UUID) {
 	return lockedUUID{}, uuid
 }
 
+func (config *Config) capabilities() Capability {
+	if config.DisableCompression {
+		return Keepalive
+	}
+
+	return Keepalive | PayloadCompression
+}
+
+func (config *Config) keepaliveMisses() int {
+	if config.KeepaliveMisses <= 0 {
+		return defaultKeepaliveMisses
+	}
+
+	return config.KeepaliveMisses
+}
+
 func (config *Config) transport() string {
 	if config.Transport == "" {
 		return "tcp"
@@ -18,10 +18,14 @@ package ssntp_test
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/asn1"
+	"encoding/gob"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"sync"
@@ -1283,6 +1287,276 @@ func TestCommand(t *testing.T) {
 	}
 }
 
+func testCompressedCommand(t *testing.T, serverCompression bool, clientCompression bool) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.typeChannel = make(chan string)
+
+	serverConfig, err := buildTestConfig(SERVER)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+	serverConfig.DisableCompression = !serverCompression
+
+	clientConfig, err := buildTestConfig(AGENT)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+	clientConfig.DisableCompression = !clientCompression
+
+	err = server.ssntp.ServeThreadSync(serverConfig, &server)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = client.ssntp.Dial(clientConfig, &client)
+	if err != nil {
+		t.Fatalf("Failed to connect")
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	client.payload = bytes.Repeat([]byte("runcmd:\n  - echo compressed\n"), 8192)
+	client.ssntp.SendCommand(START, client.payload)
+
+	select {
+	case frameType := <-client.typeChannel:
+		if frameType != COMMAND.String() {
+			t.Fatalf("Did not receive the right frame type")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the command notification")
+	}
+
+	select {
+	case check := <-client.cmdChannel:
+		if check != START.String() {
+			t.Fatalf("Did not receive the right payload")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the command notification")
+	}
+}
+
+// Test SSNTP compressed Command frame
+//
+// Test that an SSNTP client and server both supporting payload
+// compression can exchange a large Command frame and get the same
+// payload back.
+//
+// Test is expected to pass.
+func TestCompressedCommand(t *testing.T) {
+	testCompressedCommand(t, true, true)
+}
+
+// Test SSNTP Command frame with mixed compression support
+//
+// Test that large Command frames are still exchanged when only one
+// end of the connection supports payload compression.
+//
+// Test is expected to pass.
+func TestCompressedCommandMixed(t *testing.T) {
+	testCompressedCommand(t, true, false)
+	testCompressedCommand(t, false, true)
+}
+
+// stalledClient opens an SSNTP connection advertising the Keepalive
+// capability and then never sends anything, as a peer whose host died
+// would.
+func stalledClient(t *testing.T, config *Config) (net.Conn, *gob.Decoder) {
+	caPEM, err := ioutil.ReadFile(config.CAcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(caPEM)
+
+	conn, err := tls.Dial(*transport, fmt.Sprintf(":%d", 8888), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      certPool,
+		ServerName:   "localhost",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := ConnectFrame{
+		Major:        Major,
+		Type:         COMMAND,
+		Operand:      byte(CONNECT),
+		Role:         AGENT,
+		Source:       make([]byte, 16),
+		Destination:  make([]byte, 16),
+		Capabilities: Keepalive,
+	}
+	connect.Source[0] = 1
+
+	decoder := gob.NewDecoder(conn)
+	err = gob.NewEncoder(conn).Encode(&connect)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	var connected ConnectedFrame
+	err = decoder.Decode(&connected)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	if connected.Capabilities&Keepalive == 0 {
+		conn.Close()
+		t.Fatal("Server does not advertise keepalives")
+	}
+
+	return conn, decoder
+}
+
+// Test SSNTP keepalive dead peer detection
+//
+// Test that an SSNTP server sends PINGs to a client which supports
+// keepalives and disconnects it once it has not answered for the
+// configured number of intervals.
+//
+// Test is expected to pass.
+func TestKeepaliveDeadPeer(t *testing.T) {
+	var server ssntpEchoServer
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string)
+
+	serverConfig, err := buildTestConfig(SERVER)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+	serverConfig.KeepaliveInterval = 50 * time.Millisecond
+	serverConfig.KeepaliveMisses = 2
+
+	clientConfig, err := buildTestConfig(AGENT)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+
+	err = server.ssntp.ServeThreadSync(serverConfig, &server)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer server.ssntp.Stop()
+
+	conn, decoder := stalledClient(t, clientConfig)
+	defer conn.Close()
+
+	var ping Frame
+	err = decoder.Decode(&ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ping.Type != COMMAND || (Command)(ping.Operand) != PING {
+		t.Fatalf("Expected a PING, got %s", ping)
+	}
+
+	agentRole := Role(AGENT)
+	select {
+	case role := <-server.roleDisconnectChannel:
+		if role != agentRole.String() {
+			t.Fatalf("Unexpected disconnected role %s", role)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dead peer not disconnected")
+	}
+}
+
+// Test SSNTP keepalive on an idle connection
+//
+// Test that an idle SSNTP client and server both sending keepalives
+// stay connected, that the PING and PONG frames are not notified and
+// that the connection is still usable afterwards.
+//
+// Test is expected to pass.
+func TestKeepaliveIdlePeer(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string, 1)
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.typeChannel = make(chan string)
+
+	serverConfig, err := buildTestConfig(SERVER)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+	serverConfig.KeepaliveInterval = 20 * time.Millisecond
+	serverConfig.KeepaliveMisses = 3
+
+	clientConfig, err := buildTestConfig(AGENT)
+	if err != nil {
+		t.Fatalf("Could not build a test config")
+	}
+	clientConfig.KeepaliveInterval = 20 * time.Millisecond
+	clientConfig.KeepaliveMisses = 3
+
+	err = server.ssntp.ServeThreadSync(serverConfig, &server)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = client.ssntp.Dial(clientConfig, &client)
+	if err != nil {
+		t.Fatalf("Failed to connect")
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	select {
+	case role := <-server.roleDisconnectChannel:
+		t.Fatalf("Idle %s disconnected", role)
+	case frameType := <-client.typeChannel:
+		t.Fatalf("Unexpected %s frame notified", frameType)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	client.payload = []byte("idle")
+	client.ssntp.SendCommand(START, client.payload)
+
+	select {
+	case frameType := <-client.typeChannel:
+		if frameType != COMMAND.String() {
+			t.Fatalf("Did not receive the right frame type")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the command notification")
+	}
+
+	select {
+	case check := <-client.cmdChannel:
+		if check != START.String() {
+			t.Fatalf("Did not receive the right payload")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the command notification")
+	}
+}
+
 // Test SSNTP Command traced frame label
 //
 // Test that an SSNTP client can send a traced Command frame to an echo
@@ -2477,6 +2751,14 @@ func TestCommandStringer(t *testing.T) {
 		{ReleasePublicIP, "Release public IP"},
 		{CONFIGURE, "CONFIGURE"},
 		{AttachVolume, "Attach storage volume"},
+		{InstanceInventory, "Instance Inventory"},
+		{PrefetchImage, "Prefetch Image"},
+		{PrepareMigration, "Prepare Migration"},
+		{MigrateInstance, "Migrate Instance"},
+		{AbortMigration, "Abort Migration"},
+		{ConsoleLog, "Console Log"},
+		{ResizeInstance, "Resize Instance"},
+		{DetachVolume, "Detach storage volume"},
 	}
 
 	for _, test := range stringTests {
@@ -2520,6 +2802,15 @@ func TestEventStringer(t *testing.T) {
 		{TraceReport, "Trace Report"},
 		{NodeConnected, "Node Connected"},
 		{NodeDisconnected, "Node Disconnected"},
+		{InstanceInventoryReport, "Instance Inventory Report"},
+		{ImagePrefetchReport, "Image Prefetch Report"},
+		{MigrationPrepared, "Migration Prepared"},
+		{InstanceMigrated, "Instance Migrated"},
+		{ConsoleLogReport, "Console Log Report"},
+		{InstanceResized, "Instance Resized"},
+		{NodeMaintenance, "Node Maintenance"},
+		{VolumeAttached, "Volume Attached"},
+		{VolumeDetached, "Volume Detached"},
 	}
 
 	for _, test := range stringTests {
@@ -2541,6 +2832,9 @@ func TestErrorStringer(t *testing.T) {
 		{DeleteFailure, "Could not delete instance"},
 		{ConnectionAborted, "SSNTP Connection aborted"},
 		{InvalidConfiguration, "Cluster configuration is invalid"},
+		{MigrationFailure, "Could not migrate instance"},
+		{ResizeFailure, "Could not resize instance"},
+		{DetachVolumeFailure, "Could not detach volume"},
 	}
 
 	for _, test := range stringTests {
@@ -38,12 +38,25 @@ type SsntpTestClient struct {
 	Role                   ssntp.Role
 	StartFail              bool
 	StartFailReason        payloads.StartFailureReason
+	DropStart              bool
 	DeleteFail             bool
 	DeleteFailReason       payloads.DeleteFailureReason
 	AttachFail             bool
 	AttachVolumeFailReason payloads.AttachVolumeFailureReason
+	DetachFail             bool
+	DetachVolumeFailReason payloads.DetachVolumeFailureReason
+	PrefetchFail           bool
+	PrefetchFailReason     string
+	MigrationFail          bool
+	MigrationFailReason    payloads.MigrationFailureReason
+	ConsoleLog             []string
+	ConsoleLogFailReason   string
+	ResizeFail             bool
+	ResizeFailReason       payloads.ResizeFailureReason
+	Labels                 []string
 	traces                 []*ssntp.Frame
 	tracesLock             *sync.Mutex
+	clockOffset            time.Duration
 
 	CmdChans        map[ssntp.Command]chan Result
 	CmdChansLock    *sync.Mutex
@@ -346,6 +359,12 @@ func (client *SsntpTestClient) handleStart(payload []byte) Result {
 		return result
 	}
 
+	// the command is discarded as though it had been lost when the
+	// controller stopped
+	if client.DropStart {
+		return result
+	}
+
 	istat := payloads.InstanceStat{
 		InstanceUUID:  cmd.Start.InstanceUUID,
 		State:         payloads.Running,
@@ -390,6 +409,29 @@ func (client *SsntpTestClient) handleDelete(payload []byte) Result {
 	return result
 }
 
+// SetInstanceWarnings replaces the warnings reported for an instance in
+// the SsntpTestClient's subsequent STATS commands
+func (client *SsntpTestClient) SetInstanceWarnings(instanceID string, warnings []payloads.InstanceWarning) {
+	client.instancesLock.Lock()
+	defer client.instancesLock.Unlock()
+
+	for i := range client.instances {
+		if client.instances[i].InstanceUUID == instanceID {
+			client.instances[i].Warnings = warnings
+		}
+	}
+}
+
+// SetClockOffset sets how far ahead of the real time, or behind it if
+// negative, the SsntpTestClient's clock is when it timestamps its
+// subsequent STATS commands
+func (client *SsntpTestClient) SetClockOffset(offset time.Duration) {
+	client.instancesLock.Lock()
+	defer client.instancesLock.Unlock()
+
+	client.clockOffset = offset
+}
+
 func (client *SsntpTestClient) handleAttachVolume(payload []byte) Result {
 	var result Result
 	var cmd payloads.AttachVolume
@@ -412,13 +454,389 @@ func (client *SsntpTestClient) handleAttachVolume(payload []byte) Result {
 	for i, istat := range client.instances {
 		if istat.InstanceUUID == cmd.Attach.InstanceUUID {
 			client.instances[i].Volumes = append(istat.Volumes, cmd.Attach.VolumeUUID)
+
+			serial := cmd.Attach.Tag
+			if serial == "" {
+				serial = cmd.Attach.VolumeUUID
+			}
+			client.instances[i].VolumeDevices = append(istat.VolumeDevices, payloads.VolumeDevice{
+				VolumeUUID: cmd.Attach.VolumeUUID,
+				Device:     "/dev/disk/by-id/virtio-" + serial,
+			})
+		}
+	}
+	client.instancesLock.Unlock()
+
+	client.sendVolumeEvent(ssntp.VolumeAttached, cmd.Attach.InstanceUUID, cmd.Attach.VolumeUUID)
+
+	return result
+}
+
+func (client *SsntpTestClient) handleDetachVolume(payload []byte) Result {
+	var result Result
+	var cmd payloads.DetachVolume
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.Detach.InstanceUUID
+	result.NodeUUID = client.UUID
+
+	if client.DetachFail {
+		result.Err = errors.New(client.DetachVolumeFailReason.String())
+		client.sendDetachVolumeFailure(cmd.Detach.InstanceUUID, cmd.Detach.VolumeUUID, client.DetachVolumeFailReason)
+		go client.SendResultAndDelErrorChan(ssntp.DetachVolumeFailure, result)
+		return result
+	}
+
+	// update statistics for volume
+	client.instancesLock.Lock()
+	for i, istat := range client.instances {
+		if istat.InstanceUUID != cmd.Detach.InstanceUUID {
+			continue
+		}
+
+		var volumes []string
+		for _, v := range istat.Volumes {
+			if v != cmd.Detach.VolumeUUID {
+				volumes = append(volumes, v)
+			}
+		}
+		client.instances[i].Volumes = volumes
+
+		var devices []payloads.VolumeDevice
+		for _, d := range istat.VolumeDevices {
+			if d.VolumeUUID != cmd.Detach.VolumeUUID {
+				devices = append(devices, d)
+			}
 		}
+		client.instances[i].VolumeDevices = devices
 	}
 	client.instancesLock.Unlock()
 
+	client.sendVolumeEvent(ssntp.VolumeDetached, cmd.Detach.InstanceUUID, cmd.Detach.VolumeUUID)
+
 	return result
 }
 
+func (client *SsntpTestClient) sendVolumeEvent(event ssntp.Event, instanceUUID string, volumeUUID string) {
+	e := payloads.VolumeEvent{
+		NodeUUID:     client.UUID,
+		InstanceUUID: instanceUUID,
+		VolumeUUID:   volumeUUID,
+	}
+
+	var payload interface{}
+	if event == ssntp.VolumeAttached {
+		payload = payloads.EventVolumeAttached{Attached: e}
+	} else {
+		payload = payloads.EventVolumeDetached{Detached: e}
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	_, err = client.Ssntp.SendEvent(event, y)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (client *SsntpTestClient) handleInventory(payload []byte) Result {
+	var result Result
+	var cmd payloads.Inventory
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.NodeUUID = client.UUID
+
+	var event payloads.EventInventoryReport
+	event.Report.NodeUUID = client.UUID
+
+	client.instancesLock.Lock()
+	for _, istat := range client.instances {
+		event.Report.Instances = append(event.Report.Instances,
+			payloads.InventoryInstance{
+				InstanceUUID: istat.InstanceUUID,
+				State:        istat.State,
+			})
+	}
+	client.instancesLock.Unlock()
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.InstanceInventoryReport, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) handlePrefetchImage(payload []byte) Result {
+	var result Result
+	var cmd payloads.PrefetchImage
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.NodeUUID = client.UUID
+
+	var event payloads.EventImagePrefetchReport
+	event.Report.NodeUUID = client.UUID
+	event.Report.ImageUUID = cmd.Prefetch.ImageUUID
+	if client.PrefetchFail {
+		event.Report.Reason = client.PrefetchFailReason
+	}
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.ImagePrefetchReport, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) handlePrepareMigration(payload []byte) Result {
+	var result Result
+	var cmd payloads.PrepareMigration
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.Prepare.InstanceUUID
+	result.TenantUUID = cmd.Prepare.TenantUUID
+	result.NodeUUID = client.UUID
+
+	if client.MigrationFail {
+		result.Err = errors.New(client.MigrationFailReason.String())
+		client.sendMigrationFailure(cmd.Prepare.InstanceUUID, client.MigrationFailReason)
+		go client.SendResultAndDelErrorChan(ssntp.MigrationFailure, result)
+		return result
+	}
+
+	istat := payloads.InstanceStat{
+		InstanceUUID: cmd.Prepare.InstanceUUID,
+		State:        payloads.Migrating,
+	}
+	for _, s := range cmd.Prepare.Storage {
+		istat.Volumes = append(istat.Volumes, s.ID)
+	}
+
+	client.instancesLock.Lock()
+	client.instances = append(client.instances, istat)
+	client.instancesLock.Unlock()
+
+	var event payloads.EventMigrationPrepared
+	event.Prepared.NodeUUID = client.UUID
+	event.Prepared.InstanceUUID = cmd.Prepare.InstanceUUID
+	event.Prepared.Address = MigrationAddress
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.MigrationPrepared, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) handleMigrateInstance(payload []byte) Result {
+	var result Result
+	var cmd payloads.MigrateInstance
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.Migrate.InstanceUUID
+	result.NodeUUID = client.UUID
+
+	if client.MigrationFail {
+		result.Err = errors.New(client.MigrationFailReason.String())
+		client.sendMigrationFailure(cmd.Migrate.InstanceUUID, client.MigrationFailReason)
+		go client.SendResultAndDelErrorChan(ssntp.MigrationFailure, result)
+		return result
+	}
+
+	client.removeInstance(cmd.Migrate.InstanceUUID)
+
+	var event payloads.EventInstanceMigrated
+	event.Migrated.InstanceUUID = cmd.Migrate.InstanceUUID
+	event.Migrated.NodeUUID = client.UUID
+	event.Migrated.TargetNodeUUID = cmd.Migrate.TargetAgentUUID
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.InstanceMigrated, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) handleAbortMigration(payload []byte) Result {
+	var result Result
+	var cmd payloads.AbortMigration
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.Abort.InstanceUUID
+	result.NodeUUID = client.UUID
+
+	client.removeInstance(cmd.Abort.InstanceUUID)
+
+	return result
+}
+
+func (client *SsntpTestClient) handleConsoleLog(payload []byte) Result {
+	var result Result
+	var cmd payloads.ConsoleLog
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.ConsoleLog.InstanceUUID
+	result.NodeUUID = client.UUID
+
+	var event payloads.EventConsoleLogReport
+	event.Report.NodeUUID = client.UUID
+	event.Report.InstanceUUID = cmd.ConsoleLog.InstanceUUID
+	event.Report.RequestID = cmd.ConsoleLog.RequestID
+	if client.ConsoleLogFailReason != "" {
+		event.Report.Reason = client.ConsoleLogFailReason
+	} else {
+		lines := client.ConsoleLog
+		if cmd.ConsoleLog.Length < len(lines) {
+			lines = lines[len(lines)-cmd.ConsoleLog.Length:]
+		}
+		event.Report.Lines = lines
+	}
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.ConsoleLogReport, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) handleResizeInstance(payload []byte) Result {
+	var result Result
+	var cmd payloads.ResizeInstance
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.InstanceUUID = cmd.Resize.InstanceUUID
+	result.NodeUUID = client.UUID
+
+	if client.ResizeFail {
+		result.Err = errors.New(client.ResizeFailReason.String())
+		client.sendResizeFailure(cmd.Resize.InstanceUUID, client.ResizeFailReason)
+		go client.SendResultAndDelErrorChan(ssntp.ResizeFailure, result)
+		return result
+	}
+
+	var event payloads.EventInstanceResized
+	event.Resized.NodeUUID = client.UUID
+	event.Resized.InstanceUUID = cmd.Resize.InstanceUUID
+	event.Resized.VCPUs = cmd.Resize.VCPUs
+	event.Resized.MemMB = cmd.Resize.MemMB
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	_, err = client.Ssntp.SendEvent(ssntp.InstanceResized, y)
+	if err != nil {
+		result.Err = err
+	}
+
+	return result
+}
+
+func (client *SsntpTestClient) removeInstance(instanceUUID string) {
+	client.instancesLock.Lock()
+	defer client.instancesLock.Unlock()
+
+	for i := range client.instances {
+		if client.instances[i].InstanceUUID == instanceUUID {
+			client.instances = append(client.instances[:i], client.instances[i+1:]...)
+			break
+		}
+	}
+}
+
+// FinishMigration marks an instance the SsntpTestClient was prepared to
+// receive as running in its subsequent STATS commands, as a node does once
+// the transfer of the instance completes
+func (client *SsntpTestClient) FinishMigration(instanceUUID string) {
+	client.instancesLock.Lock()
+	defer client.instancesLock.Unlock()
+
+	for i := range client.instances {
+		if client.instances[i].InstanceUUID == instanceUUID {
+			client.instances[i].State = payloads.Running
+		}
+	}
+}
+
 // CommandNotify implements the SSNTP client CommandNotify callback for SsntpTestClient
 func (client *SsntpTestClient) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
 	payload := frame.Payload
@@ -450,6 +868,30 @@ func (client *SsntpTestClient) CommandNotify(command ssntp.Command, frame *ssntp
 	case ssntp.AttachVolume:
 		result = client.handleAttachVolume(payload)
 
+	case ssntp.InstanceInventory:
+		result = client.handleInventory(payload)
+
+	case ssntp.PrefetchImage:
+		result = client.handlePrefetchImage(payload)
+
+	case ssntp.PrepareMigration:
+		result = client.handlePrepareMigration(payload)
+
+	case ssntp.MigrateInstance:
+		result = client.handleMigrateInstance(payload)
+
+	case ssntp.AbortMigration:
+		result = client.handleAbortMigration(payload)
+
+	case ssntp.ConsoleLog:
+		result = client.handleConsoleLog(payload)
+
+	case ssntp.ResizeInstance:
+		result = client.handleResizeInstance(payload)
+
+	case ssntp.DetachVolume:
+		result = client.handleDetachVolume(payload)
+
 	default:
 		fmt.Fprintf(os.Stderr, "client %s unhandled command %s\n", client.Role.String(), command.String())
 	}
@@ -499,6 +941,8 @@ func (client *SsntpTestClient) SendStatsCmd() {
 
 	client.instancesLock.Lock()
 	payload := StatsPayload(client.UUID, client.Name, client.instances, nil)
+	payload.Timestamp = time.Now().Add(client.clockOffset).UnixNano()
+	payload.Labels = client.Labels
 	client.instancesLock.Unlock()
 
 	y, err := yaml.Marshal(payload)
@@ -744,3 +1188,58 @@ func (client *SsntpTestClient) sendAttachVolumeFailure(instanceUUID string, volu
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
+
+func (client *SsntpTestClient) sendDetachVolumeFailure(instanceUUID string, volumeUUID string, reason payloads.DetachVolumeFailureReason) {
+	e := payloads.ErrorDetachVolumeFailure{
+		NodeUUID:     client.UUID,
+		InstanceUUID: instanceUUID,
+		VolumeUUID:   volumeUUID,
+		Reason:       reason,
+	}
+
+	y, err := yaml.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	_, err = client.Ssntp.SendError(ssntp.DetachVolumeFailure, y)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (client *SsntpTestClient) sendMigrationFailure(instanceUUID string, reason payloads.MigrationFailureReason) {
+	e := payloads.ErrorMigrationFailure{
+		NodeUUID:     client.UUID,
+		InstanceUUID: instanceUUID,
+		Reason:       reason,
+	}
+
+	y, err := yaml.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	_, err = client.Ssntp.SendError(ssntp.MigrationFailure, y)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (client *SsntpTestClient) sendResizeFailure(instanceUUID string, reason payloads.ResizeFailureReason) {
+	e := payloads.ErrorResizeFailure{
+		NodeUUID:     client.UUID,
+		InstanceUUID: instanceUUID,
+		Reason:       reason,
+	}
+
+	y, err := yaml.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	_, err = client.Ssntp.SendError(ssntp.ResizeFailure, y)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -516,6 +516,187 @@ func TestPublicIPAssigned(t *testing.T) {
 	}
 }
 
+func TestInventory(t *testing.T) {
+	agentCh := agent.AddCmdChan(ssntp.InstanceInventory)
+	serverCh := server.AddCmdChan(ssntp.InstanceInventory)
+	serverEvtCh := server.AddEventChan(ssntp.InstanceInventoryReport)
+	controllerCh := controller.AddEventChan(ssntp.InstanceInventoryReport)
+
+	go controller.Ssntp.SendCommand(ssntp.InstanceInventory, []byte(InventoryYaml))
+
+	_, err := server.GetCmdChanResult(serverCh, ssntp.InstanceInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agent.GetCmdChanResult(agentCh, ssntp.InstanceInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.GetEventChanResult(serverEvtCh, ssntp.InstanceInventoryReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := controller.GetEventChanResult(controllerCh, ssntp.InstanceInventoryReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != AgentUUID {
+		t.Fatalf("Expected inventory from %s, got %s", AgentUUID, result.NodeUUID)
+	}
+}
+
+func TestPrefetchImage(t *testing.T) {
+	agentCh := agent.AddCmdChan(ssntp.PrefetchImage)
+	serverCh := server.AddCmdChan(ssntp.PrefetchImage)
+	serverEvtCh := server.AddEventChan(ssntp.ImagePrefetchReport)
+	controllerCh := controller.AddEventChan(ssntp.ImagePrefetchReport)
+
+	go controller.Ssntp.SendCommand(ssntp.PrefetchImage, []byte(PrefetchImageYaml))
+
+	_, err := server.GetCmdChanResult(serverCh, ssntp.PrefetchImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agent.GetCmdChanResult(agentCh, ssntp.PrefetchImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.GetEventChanResult(serverEvtCh, ssntp.ImagePrefetchReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := controller.GetEventChanResult(controllerCh, ssntp.ImagePrefetchReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != AgentUUID {
+		t.Fatalf("Expected prefetch report from %s, got %s", AgentUUID, result.NodeUUID)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	for _, step := range []struct {
+		cmd   ssntp.Command
+		yaml  string
+		event ssntp.Event
+	}{
+		{ssntp.PrepareMigration, PrepareMigrationYaml, ssntp.MigrationPrepared},
+		{ssntp.MigrateInstance, MigrateInstanceYaml, ssntp.InstanceMigrated},
+	} {
+		agentCh := agent.AddCmdChan(step.cmd)
+		serverCh := server.AddCmdChan(step.cmd)
+		controllerCh := controller.AddEventChan(step.event)
+
+		go controller.Ssntp.SendCommand(step.cmd, []byte(step.yaml))
+
+		_, err := server.GetCmdChanResult(serverCh, step.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = agent.GetCmdChanResult(agentCh, step.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := controller.GetEventChanResult(controllerCh, step.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.NodeUUID != AgentUUID || result.InstanceUUID != InstanceUUID {
+			t.Fatalf("Unexpected %s event %+v", step.event, result)
+		}
+	}
+
+	agentCh := agent.AddCmdChan(ssntp.AbortMigration)
+
+	go controller.Ssntp.SendCommand(ssntp.AbortMigration, []byte(AbortMigrationYaml))
+
+	result, err := agent.GetCmdChanResult(agentCh, ssntp.AbortMigration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != InstanceUUID {
+		t.Fatalf("Expected abort of %s, got %s", InstanceUUID, result.InstanceUUID)
+	}
+}
+
+func TestConsoleLog(t *testing.T) {
+	agentCh := agent.AddCmdChan(ssntp.ConsoleLog)
+	serverCh := server.AddCmdChan(ssntp.ConsoleLog)
+	serverEvtCh := server.AddEventChan(ssntp.ConsoleLogReport)
+	controllerCh := controller.AddEventChan(ssntp.ConsoleLogReport)
+
+	go controller.Ssntp.SendCommand(ssntp.ConsoleLog, []byte(ConsoleLogYaml))
+
+	_, err := server.GetCmdChanResult(serverCh, ssntp.ConsoleLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agent.GetCmdChanResult(agentCh, ssntp.ConsoleLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.GetEventChanResult(serverEvtCh, ssntp.ConsoleLogReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := controller.GetEventChanResult(controllerCh, ssntp.ConsoleLogReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != AgentUUID || result.InstanceUUID != InstanceUUID {
+		t.Fatalf("Unexpected console log report %+v", result)
+	}
+}
+
+func TestResizeInstance(t *testing.T) {
+	agentCh := agent.AddCmdChan(ssntp.ResizeInstance)
+	serverCh := server.AddCmdChan(ssntp.ResizeInstance)
+	controllerCh := controller.AddEventChan(ssntp.InstanceResized)
+
+	go controller.Ssntp.SendCommand(ssntp.ResizeInstance, []byte(ResizeInstanceYaml))
+
+	_, err := server.GetCmdChanResult(serverCh, ssntp.ResizeInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agent.GetCmdChanResult(agentCh, ssntp.ResizeInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := controller.GetEventChanResult(controllerCh, ssntp.InstanceResized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != AgentUUID || result.InstanceUUID != InstanceUUID {
+		t.Fatalf("Unexpected resized event %+v", result)
+	}
+}
+
+func TestDetachVolume(t *testing.T) {
+	agentCh := agent.AddCmdChan(ssntp.DetachVolume)
+	serverCh := server.AddCmdChan(ssntp.DetachVolume)
+	controllerCh := controller.AddEventChan(ssntp.VolumeDetached)
+
+	go controller.Ssntp.SendCommand(ssntp.DetachVolume, []byte(DetachVolumeYaml))
+
+	_, err := server.GetCmdChanResult(serverCh, ssntp.DetachVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agent.GetCmdChanResult(agentCh, ssntp.DetachVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := controller.GetEventChanResult(controllerCh, ssntp.VolumeDetached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != AgentUUID || result.InstanceUUID != InstanceUUID ||
+		result.VolumeUUID != VolumeUUID {
+		t.Fatalf("Unexpected detached event %+v", result)
+	}
+}
+
 func TestMain(m *testing.M) {
 	var err error
 
@@ -323,6 +323,78 @@ func (ctl *SsntpTestController) EventNotify(event ssntp.Event, frame *ssntp.Fram
 		if err != nil {
 			result.Err = err
 		}
+	case ssntp.InstanceInventoryReport:
+		var reportEvent payloads.EventInventoryReport
+
+		err := yaml.Unmarshal(frame.Payload, &reportEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = reportEvent.Report.NodeUUID
+	case ssntp.ImagePrefetchReport:
+		var reportEvent payloads.EventImagePrefetchReport
+
+		err := yaml.Unmarshal(frame.Payload, &reportEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = reportEvent.Report.NodeUUID
+	case ssntp.MigrationPrepared:
+		var preparedEvent payloads.EventMigrationPrepared
+
+		err := yaml.Unmarshal(frame.Payload, &preparedEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = preparedEvent.Prepared.NodeUUID
+		result.InstanceUUID = preparedEvent.Prepared.InstanceUUID
+	case ssntp.InstanceMigrated:
+		var migratedEvent payloads.EventInstanceMigrated
+
+		err := yaml.Unmarshal(frame.Payload, &migratedEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = migratedEvent.Migrated.NodeUUID
+		result.InstanceUUID = migratedEvent.Migrated.InstanceUUID
+	case ssntp.ConsoleLogReport:
+		var reportEvent payloads.EventConsoleLogReport
+
+		err := yaml.Unmarshal(frame.Payload, &reportEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = reportEvent.Report.NodeUUID
+		result.InstanceUUID = reportEvent.Report.InstanceUUID
+	case ssntp.InstanceResized:
+		var resizedEvent payloads.EventInstanceResized
+
+		err := yaml.Unmarshal(frame.Payload, &resizedEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = resizedEvent.Resized.NodeUUID
+		result.InstanceUUID = resizedEvent.Resized.InstanceUUID
+	case ssntp.VolumeAttached:
+		var attachedEvent payloads.EventVolumeAttached
+
+		err := yaml.Unmarshal(frame.Payload, &attachedEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = attachedEvent.Attached.NodeUUID
+		result.InstanceUUID = attachedEvent.Attached.InstanceUUID
+		result.VolumeUUID = attachedEvent.Attached.VolumeUUID
+	case ssntp.VolumeDetached:
+		var detachedEvent payloads.EventVolumeDetached
+
+		err := yaml.Unmarshal(frame.Payload, &detachedEvent)
+		if err != nil {
+			result.Err = err
+		}
+		result.NodeUUID = detachedEvent.Detached.NodeUUID
+		result.InstanceUUID = detachedEvent.Detached.InstanceUUID
+		result.VolumeUUID = detachedEvent.Detached.VolumeUUID
 	default:
 		fmt.Fprintf(os.Stderr, "controller unhandled event: %s\n", event.String())
 	}
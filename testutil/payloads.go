@@ -104,6 +104,19 @@ const AgentUUID = "4cb19522-1e18-439a-883a-f9b2a3a95f5e"
 // VolumeUUID is a node UUID for storage tests
 const VolumeUUID = "67d86208-b46c-4465-9018-e14187d4010"
 
+// ImageUUID is an image UUID for image prefetch tests
+const ImageUUID = "b286cd45-7d0c-4525-a140-4db6c95e41fa"
+
+// PeerAgentUUID is the UUID of the other node in migration tests
+const PeerAgentUUID = "0b6a7e4c-2f59-4c3e-9d1a-5f0c8b3e2d71"
+
+// MigrationAddress is the address at which an instance is received in
+// migration tests
+const MigrationAddress = "192.168.1.2:49152"
+
+// ConsoleLogRequestID is the request ID of console log tests
+const ConsoleLogRequestID = "9c1b5a1e-7f0d-4b8e-a3c2-6d4e2f1a8b90"
+
 // User is a user under which non-privileged ciao processes should run.
 const User = "ciao"
 
@@ -232,6 +245,136 @@ const RestoreYaml = `restore:
   workload_agent_uuid: ` + AgentUUID + `
 `
 
+// InventoryYaml is a sample node InstanceInventory ssntp.Command payload for test cases
+const InventoryYaml = `instance_inventory:
+  workload_agent_uuid: ` + AgentUUID + `
+`
+
+// InventoryReportYaml is a sample InstanceInventoryReport ssntp.Event payload for test cases
+const InventoryReportYaml = `instance_inventory:
+  node_uuid: ` + AgentUUID + `
+  instances:
+  - instance_uuid: ` + InstanceUUID + `
+    state: active
+`
+
+// PrefetchImageYaml is a sample node PrefetchImage ssntp.Command payload for test cases
+const PrefetchImageYaml = `prefetch_image:
+  workload_agent_uuid: ` + AgentUUID + `
+  image_uuid: ` + ImageUUID + `
+`
+
+// ImagePrefetchReportYaml is a sample ImagePrefetchReport ssntp.Event payload for test cases
+const ImagePrefetchReportYaml = `image_prefetch:
+  node_uuid: ` + AgentUUID + `
+  image_uuid: ` + ImageUUID + `
+  reason: No space left on device
+`
+
+// PrepareMigrationYaml is a sample PrepareMigration ssntp.Command payload for test cases
+const PrepareMigrationYaml = `prepare_migration:
+  instance_uuid: ` + InstanceUUID + `
+  tenant_uuid: ` + TenantUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+  source_agent_uuid: ` + PeerAgentUUID + `
+  requirements:
+    mem_mb: 4096
+    vcpus: 2
+  networking:
+    vnic_mac: ` + VNICMAC + `
+    vnic_uuid: ` + VNICUUID + `
+    concentrator_uuid: ` + CNCIUUID + `
+    concentrator_ip: ` + CNCIIP + `
+    subnet: ` + TenantSubnet + `
+    subnet_key: "` + SubnetKey + `"
+    subnet_uuid: ""
+    private_ip: ` + InstancePrivateIP + `
+    public_ip: false
+  storage:
+  - id: ` + VolumeUUID + `
+    boot: true
+`
+
+// MigrateInstanceYaml is a sample MigrateInstance ssntp.Command payload for test cases
+const MigrateInstanceYaml = `migrate_instance:
+  instance_uuid: ` + InstanceUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+  target_agent_uuid: ` + PeerAgentUUID + `
+  target_address: ` + MigrationAddress + `
+`
+
+// AbortMigrationYaml is a sample AbortMigration ssntp.Command payload for test cases
+const AbortMigrationYaml = `abort_migration:
+  instance_uuid: ` + InstanceUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+`
+
+// MigrationPreparedYaml is a sample MigrationPrepared ssntp.Event payload for test cases
+const MigrationPreparedYaml = `migration_prepared:
+  node_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  address: ` + MigrationAddress + `
+`
+
+// InstanceMigratedYaml is a sample InstanceMigrated ssntp.Event payload for test cases
+const InstanceMigratedYaml = `instance_migrated:
+  instance_uuid: ` + InstanceUUID + `
+  node_uuid: ` + AgentUUID + `
+  target_node_uuid: ` + PeerAgentUUID + `
+`
+
+// MigrationFailureYaml is a sample MigrationFailure ssntp.Error payload for test cases
+const MigrationFailureYaml = `node_uuid: ` + AgentUUID + `
+instance_uuid: ` + InstanceUUID + `
+reason: transfer_failure
+`
+
+// ConsoleLogYaml is a sample ConsoleLog ssntp.Command payload for test cases
+const ConsoleLogYaml = `console_log:
+  workload_agent_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  request_id: ` + ConsoleLogRequestID + `
+  length: 2
+`
+
+// ConsoleLogReportYaml is a sample ConsoleLogReport ssntp.Event payload for test cases
+const ConsoleLogReportYaml = `console_log_report:
+  node_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  request_id: ` + ConsoleLogRequestID + `
+  lines:
+  - Ubuntu 16.04 LTS ciao ttyS0
+  - 'ciao login: '
+`
+
+// ResizeInstanceYaml is a sample ResizeInstance ssntp.Command payload for test cases
+const ResizeInstanceYaml = `resize_instance:
+  workload_agent_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  vcpus: 4
+  mem_mb: 2048
+`
+
+// InstanceResizedYaml is a sample InstanceResized ssntp.Event payload for test cases
+const InstanceResizedYaml = `instance_resized:
+  node_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  vcpus: 4
+  mem_mb: 2048
+`
+
+// NodeMaintenanceYaml is a sample NodeMaintenance ssntp.Event payload for test cases
+const NodeMaintenanceYaml = `node_maintenance:
+  node_uuid: ` + AgentUUID + `
+  maintenance: true
+`
+
+// ResizeFailureYaml is a sample ResizeFailure ssntp.Error payload for test cases
+const ResizeFailureYaml = `node_uuid: ` + AgentUUID + `
+instance_uuid: ` + InstanceUUID + `
+reason: restart_failure
+`
+
 // CNCITunnelID is a gre tunnel ID derived from the tenant UUID
 var CNCITunnelID = crc32.ChecksumIEEE([]byte(TenantUUID))
 
@@ -335,6 +478,16 @@ const ConfigureYaml = `configure:
     admin_ssh_key: ""
     client_auth_ca_cert_path: ""
     cnci_net: 10.10.0.0
+    api_hostname: ""
+    node_suspect_timeout: 0
+    node_down_timeout: 0
+    node_recovery_period: 0
+    token_key_path: ""
+    token_expiry: 0
+    api_write_rate: 0
+    api_write_burst: 0
+    api_read_rate: 0
+    api_read_burst: 0
   launcher:
     compute_net:
     - ` + ComputeNet + `
@@ -542,6 +695,15 @@ const AttachVolumeYaml = `attach_volume:
   workload_agent_uuid: ` + AgentUUID + `
 `
 
+// AttachVolumeTagYaml is a sample yaml payload for the ssntp Attach Volume
+// command which tags the volume.
+const AttachVolumeTagYaml = `attach_volume:
+  instance_uuid: ` + InstanceUUID + `
+  volume_uuid: ` + VolumeUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+  tag: data
+`
+
 // BadAttachVolumeYaml is a corrupt yaml payload for the ssntp Attach Volume command.
 const BadAttachVolumeYaml = `attach_volume:
   volume_uuid: ` + VolumeUUID + `
@@ -553,3 +715,31 @@ instance_uuid: ` + InstanceUUID + `
 volume_uuid: ` + VolumeUUID + `
 reason: attach_failure
 `
+
+// DetachVolumeYaml is a sample yaml payload for the ssntp Detach Volume command.
+const DetachVolumeYaml = `detach_volume:
+  instance_uuid: ` + InstanceUUID + `
+  volume_uuid: ` + VolumeUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+`
+
+// DetachVolumeFailureYaml is a sample DetachVolumeFailure ssntp.Error payload for test cases
+const DetachVolumeFailureYaml = `node_uuid: ` + AgentUUID + `
+instance_uuid: ` + InstanceUUID + `
+volume_uuid: ` + VolumeUUID + `
+reason: detach_failure
+`
+
+// VolumeAttachedYaml is a sample VolumeAttached ssntp.Event payload for test cases
+const VolumeAttachedYaml = `volume_attached:
+  node_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  volume_uuid: ` + VolumeUUID + `
+`
+
+// VolumeDetachedYaml is a sample VolumeDetached ssntp.Event payload for test cases
+const VolumeDetachedYaml = `volume_detached:
+  node_uuid: ` + AgentUUID + `
+  instance_uuid: ` + InstanceUUID + `
+  volume_uuid: ` + VolumeUUID + `
+`
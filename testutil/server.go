@@ -325,6 +325,18 @@ func getAttachVolumeResult(payload []byte, result *Result) {
 	}
 }
 
+func getDetachVolumeResult(payload []byte, result *Result) {
+	var volCmd payloads.DetachVolume
+
+	err := yaml.Unmarshal(payload, &volCmd)
+	result.Err = err
+	if err == nil {
+		result.NodeUUID = volCmd.Detach.WorkloadAgentUUID
+		result.InstanceUUID = volCmd.Detach.InstanceUUID
+		result.VolumeUUID = volCmd.Detach.VolumeUUID
+	}
+}
+
 func getStartResults(payload []byte, result *Result) {
 	var startCmd payloads.Start
 
@@ -398,6 +410,54 @@ func (server *SsntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 	case ssntp.AttachVolume:
 		getAttachVolumeResult(payload, &result)
 
+	case ssntp.DetachVolume:
+		getDetachVolumeResult(payload, &result)
+
+	case ssntp.InstanceInventory:
+		var invCmd payloads.Inventory
+
+		err := yaml.Unmarshal(payload, &invCmd)
+		result.Err = err
+		if err == nil {
+			result.NodeUUID = invCmd.Inventory.WorkloadAgentUUID
+		}
+
+	case ssntp.PrefetchImage:
+		var prefetchCmd payloads.PrefetchImage
+
+		err := yaml.Unmarshal(payload, &prefetchCmd)
+		result.Err = err
+		if err == nil {
+			result.NodeUUID = prefetchCmd.Prefetch.WorkloadAgentUUID
+		}
+
+	case ssntp.PrepareMigration:
+		fallthrough
+	case ssntp.MigrateInstance:
+		fallthrough
+	case ssntp.AbortMigration:
+		result.NodeUUID, result.Err = getMigrationAgentUUID(command, payload)
+
+	case ssntp.ConsoleLog:
+		var consoleCmd payloads.ConsoleLog
+
+		err := yaml.Unmarshal(payload, &consoleCmd)
+		result.Err = err
+		if err == nil {
+			result.NodeUUID = consoleCmd.ConsoleLog.WorkloadAgentUUID
+			result.InstanceUUID = consoleCmd.ConsoleLog.InstanceUUID
+		}
+
+	case ssntp.ResizeInstance:
+		var resizeCmd payloads.ResizeInstance
+
+		err := yaml.Unmarshal(payload, &resizeCmd)
+		result.Err = err
+		if err == nil {
+			result.NodeUUID = resizeCmd.Resize.WorkloadAgentUUID
+			result.InstanceUUID = resizeCmd.Resize.InstanceUUID
+		}
+
 	default:
 		fmt.Fprintf(os.Stderr, "server unhandled command %s\n", command.String())
 	}
@@ -430,6 +490,59 @@ func (server *SsntpTestServer) EventNotify(uuid string, event ssntp.Event, frame
 		var stopEvent payloads.EventInstanceStopped
 
 		result.Err = yaml.Unmarshal(payload, &stopEvent)
+	case ssntp.InstanceInventoryReport:
+		var reportEvent payloads.EventInventoryReport
+
+		result.Err = yaml.Unmarshal(payload, &reportEvent)
+		result.NodeUUID = reportEvent.Report.NodeUUID
+	case ssntp.ImagePrefetchReport:
+		var reportEvent payloads.EventImagePrefetchReport
+
+		result.Err = yaml.Unmarshal(payload, &reportEvent)
+		result.NodeUUID = reportEvent.Report.NodeUUID
+	case ssntp.MigrationPrepared:
+		var preparedEvent payloads.EventMigrationPrepared
+
+		result.Err = yaml.Unmarshal(payload, &preparedEvent)
+		result.NodeUUID = preparedEvent.Prepared.NodeUUID
+		result.InstanceUUID = preparedEvent.Prepared.InstanceUUID
+	case ssntp.InstanceMigrated:
+		var migratedEvent payloads.EventInstanceMigrated
+
+		result.Err = yaml.Unmarshal(payload, &migratedEvent)
+		result.NodeUUID = migratedEvent.Migrated.NodeUUID
+		result.InstanceUUID = migratedEvent.Migrated.InstanceUUID
+	case ssntp.ConsoleLogReport:
+		var reportEvent payloads.EventConsoleLogReport
+
+		result.Err = yaml.Unmarshal(payload, &reportEvent)
+		result.NodeUUID = reportEvent.Report.NodeUUID
+		result.InstanceUUID = reportEvent.Report.InstanceUUID
+	case ssntp.InstanceResized:
+		var resizedEvent payloads.EventInstanceResized
+
+		result.Err = yaml.Unmarshal(payload, &resizedEvent)
+		result.NodeUUID = resizedEvent.Resized.NodeUUID
+		result.InstanceUUID = resizedEvent.Resized.InstanceUUID
+	case ssntp.VolumeAttached:
+		var attachedEvent payloads.EventVolumeAttached
+
+		result.Err = yaml.Unmarshal(payload, &attachedEvent)
+		result.NodeUUID = attachedEvent.Attached.NodeUUID
+		result.InstanceUUID = attachedEvent.Attached.InstanceUUID
+		result.VolumeUUID = attachedEvent.Attached.VolumeUUID
+	case ssntp.VolumeDetached:
+		var detachedEvent payloads.EventVolumeDetached
+
+		result.Err = yaml.Unmarshal(payload, &detachedEvent)
+		result.NodeUUID = detachedEvent.Detached.NodeUUID
+		result.InstanceUUID = detachedEvent.Detached.InstanceUUID
+		result.VolumeUUID = detachedEvent.Detached.VolumeUUID
+	case ssntp.NodeMaintenance:
+		var maintenanceEvent payloads.EventNodeMaintenance
+
+		result.Err = yaml.Unmarshal(payload, &maintenanceEvent)
+		result.NodeUUID = maintenanceEvent.NodeMaintenance.NodeUUID
 	case ssntp.ConcentratorInstanceAdded:
 		// forward rule auto-sends to controllers
 	case ssntp.TenantAdded:
@@ -546,15 +659,38 @@ func (server *SsntpTestServer) handleStart(payload []byte) (dest ssntp.ForwardDe
 	} else {
 		server.clientsLock.Lock()
 		defer server.clientsLock.Unlock()
-		if len(server.clients) > 0 {
-			index := rand.Intn(len(server.clients))
-			dest.AddRecipient(server.clients[index])
+
+		// honour the node constraints as the scheduler would
+		var clients []string
+		for _, uuid := range server.clients {
+			if startCmd.Start.Requirements.NodeID != "" && startCmd.Start.Requirements.NodeID != uuid {
+				continue
+			}
+			if avoidNode(startCmd.Start.AvoidNodes, uuid) {
+				continue
+			}
+			clients = append(clients, uuid)
+		}
+
+		if len(clients) > 0 {
+			index := rand.Intn(len(clients))
+			dest.AddRecipient(clients[index])
 		}
 	}
 
 	return dest
 }
 
+func avoidNode(avoid []string, uuid string) bool {
+	for _, a := range avoid {
+		if a == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (server *SsntpTestServer) handleAttachVolume(payload []byte) ssntp.ForwardDestination {
 	var cmd payloads.AttachVolume
 	var dest ssntp.ForwardDestination
@@ -576,6 +712,150 @@ func (server *SsntpTestServer) handleAttachVolume(payload []byte) ssntp.ForwardD
 	return dest
 }
 
+func (server *SsntpTestServer) handleDetachVolume(payload []byte) ssntp.ForwardDestination {
+	var cmd payloads.DetachVolume
+	var dest ssntp.ForwardDestination
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == cmd.Detach.WorkloadAgentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
+func (server *SsntpTestServer) handleInventory(payload []byte) ssntp.ForwardDestination {
+	var cmd payloads.Inventory
+	var dest ssntp.ForwardDestination
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == cmd.Inventory.WorkloadAgentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
+func (server *SsntpTestServer) handlePrefetchImage(payload []byte) ssntp.ForwardDestination {
+	var cmd payloads.PrefetchImage
+	var dest ssntp.ForwardDestination
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == cmd.Prefetch.WorkloadAgentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
+func (server *SsntpTestServer) handleConsoleLog(payload []byte) ssntp.ForwardDestination {
+	var cmd payloads.ConsoleLog
+	var dest ssntp.ForwardDestination
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == cmd.ConsoleLog.WorkloadAgentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
+func (server *SsntpTestServer) handleResizeInstance(payload []byte) ssntp.ForwardDestination {
+	var cmd payloads.ResizeInstance
+	var dest ssntp.ForwardDestination
+
+	err := yaml.Unmarshal(payload, &cmd)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == cmd.Resize.WorkloadAgentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
+func getMigrationAgentUUID(command ssntp.Command, payload []byte) (string, error) {
+	switch command {
+	case ssntp.PrepareMigration:
+		var cmd payloads.PrepareMigration
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Prepare.WorkloadAgentUUID, err
+	case ssntp.MigrateInstance:
+		var cmd payloads.MigrateInstance
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Migrate.WorkloadAgentUUID, err
+	case ssntp.AbortMigration:
+		var cmd payloads.AbortMigration
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Abort.WorkloadAgentUUID, err
+	}
+
+	return "", fmt.Errorf("unsupported ssntp.Command type \"%s\"", command)
+}
+
+func (server *SsntpTestServer) handleMigration(command ssntp.Command, payload []byte) ssntp.ForwardDestination {
+	var dest ssntp.ForwardDestination
+
+	agentUUID, err := getMigrationAgentUUID(command, payload)
+	if err != nil {
+		return dest
+	}
+
+	server.clientsLock.Lock()
+	defer server.clientsLock.Unlock()
+
+	for _, c := range server.clients {
+		if c == agentUUID {
+			dest.AddRecipient(c)
+		}
+	}
+
+	return dest
+}
+
 // CommandForward implements an SSNTP CommandForward callback for SsntpTestServer
 func (server *SsntpTestServer) CommandForward(uuid string, command ssntp.Command, frame *ssntp.Frame) (dest ssntp.ForwardDestination) {
 	payload := frame.Payload
@@ -585,6 +865,22 @@ func (server *SsntpTestServer) CommandForward(uuid string, command ssntp.Command
 		dest = server.handleStart(payload)
 	case ssntp.AttachVolume:
 		dest = server.handleAttachVolume(payload)
+	case ssntp.DetachVolume:
+		dest = server.handleDetachVolume(payload)
+	case ssntp.InstanceInventory:
+		dest = server.handleInventory(payload)
+	case ssntp.PrefetchImage:
+		dest = server.handlePrefetchImage(payload)
+	case ssntp.PrepareMigration:
+		fallthrough
+	case ssntp.MigrateInstance:
+		fallthrough
+	case ssntp.AbortMigration:
+		dest = server.handleMigration(command, payload)
+	case ssntp.ConsoleLog:
+		dest = server.handleConsoleLog(payload)
+	case ssntp.ResizeInstance:
+		dest = server.handleResizeInstance(payload)
 	case ssntp.EVACUATE:
 		fallthrough
 	case ssntp.DELETE:
@@ -605,6 +901,13 @@ func (server *SsntpTestServer) Shutdown() {
 // StartTestServer starts a go routine for based on a
 // testutil.SsntpTestServer configuration with standard ssntp.FrameRorwardRules
 func StartTestServer() *SsntpTestServer {
+	return StartConfiguredTestServer(0, "")
+}
+
+// StartConfiguredTestServer starts a testutil.SsntpTestServer listening on
+// port, or on the default SSNTP port if port is 0, which sends the cluster
+// configuration found at configURI to the clients which connect to it.
+func StartConfiguredTestServer(port uint32, configURI string) *SsntpTestServer {
 	server := new(SsntpTestServer)
 	server.clientsLock = &sync.Mutex{}
 	server.netClientsLock = &sync.Mutex{}
@@ -616,9 +919,11 @@ func StartTestServer() *SsntpTestServer {
 	openServerChans(server)
 
 	serverConfig := ssntp.Config{
-		CAcert: ssntp.DefaultCACert,
-		Cert:   ssntp.RoleToDefaultCertName(ssntp.SERVER),
-		Log:    ssntp.Log,
+		CAcert:    ssntp.DefaultCACert,
+		Cert:      ssntp.RoleToDefaultCertName(ssntp.SERVER),
+		Log:       ssntp.Log,
+		Port:      port,
+		ConfigURI: configURI,
 		ForwardRules: []ssntp.FrameForwardRule{
 			{ // all STATS commands go to all Controllers
 				Operand: ssntp.STATS,
@@ -680,6 +985,82 @@ func StartTestServer() *SsntpTestServer {
 				Operand:        ssntp.AttachVolume,
 				CommandForward: server,
 			},
+			{ // all InstanceInventory commands are processed by the Command forwarder
+				Operand:        ssntp.InstanceInventory,
+				CommandForward: server,
+			},
+			{ // all InstanceInventoryReport events go to all Controllers
+				Operand: ssntp.InstanceInventoryReport,
+				Dest:    ssntp.Controller,
+			},
+			{ // all PrefetchImage commands are processed by the Command forwarder
+				Operand:        ssntp.PrefetchImage,
+				CommandForward: server,
+			},
+			{ // all ImagePrefetchReport events go to all Controllers
+				Operand: ssntp.ImagePrefetchReport,
+				Dest:    ssntp.Controller,
+			},
+			{ // all PrepareMigration commands are processed by the Command forwarder
+				Operand:        ssntp.PrepareMigration,
+				CommandForward: server,
+			},
+			{ // all MigrateInstance commands are processed by the Command forwarder
+				Operand:        ssntp.MigrateInstance,
+				CommandForward: server,
+			},
+			{ // all AbortMigration commands are processed by the Command forwarder
+				Operand:        ssntp.AbortMigration,
+				CommandForward: server,
+			},
+			{ // all MigrationPrepared events go to all Controllers
+				Operand: ssntp.MigrationPrepared,
+				Dest:    ssntp.Controller,
+			},
+			{ // all InstanceMigrated events go to all Controllers
+				Operand: ssntp.InstanceMigrated,
+				Dest:    ssntp.Controller,
+			},
+			{ // all MigrationFailure errors go to all Controllers
+				Operand: ssntp.MigrationFailure,
+				Dest:    ssntp.Controller,
+			},
+			{ // all ConsoleLog commands are processed by the Command forwarder
+				Operand:        ssntp.ConsoleLog,
+				CommandForward: server,
+			},
+			{ // all ConsoleLogReport events go to all Controllers
+				Operand: ssntp.ConsoleLogReport,
+				Dest:    ssntp.Controller,
+			},
+			{ // all ResizeInstance commands are processed by the Command forwarder
+				Operand:        ssntp.ResizeInstance,
+				CommandForward: server,
+			},
+			{ // all InstanceResized events go to all Controllers
+				Operand: ssntp.InstanceResized,
+				Dest:    ssntp.Controller,
+			},
+			{ // all ResizeFailure errors go to all Controllers
+				Operand: ssntp.ResizeFailure,
+				Dest:    ssntp.Controller,
+			},
+			{ // all DetachVolume commands are processed by the Command forwarder
+				Operand:        ssntp.DetachVolume,
+				CommandForward: server,
+			},
+			{ // all VolumeAttached events go to all Controllers
+				Operand: ssntp.VolumeAttached,
+				Dest:    ssntp.Controller,
+			},
+			{ // all VolumeDetached events go to all Controllers
+				Operand: ssntp.VolumeDetached,
+				Dest:    ssntp.Controller,
+			},
+			{ // all DetachVolumeFailure errors go to all Controllers
+				Operand: ssntp.DetachVolumeFailure,
+				Dest:    ssntp.Controller,
+			},
 		},
 	}
 